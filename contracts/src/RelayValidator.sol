@@ -237,8 +237,58 @@ contract RelayValidator is ReentrancyGuard, Ownable, Pausable {
         uint256 requestId,
         bytes calldata signature
     ) external {
-        ValidationRequest storage request = validationRequests[requestId];
-        
+        ValidationRequest storage request = _openRequest(requestId);
+
+        if (validators[msg.sender].status != ValidatorStatus.Active) {
+            revert ValidatorNotActive();
+        }
+        if (request.hasSigned[msg.sender]) {
+            revert AlreadySigned();
+        }
+
+        _recordSignature(requestId, request, msg.sender, signature);
+
+        if (request.receivedSignatures >= request.requiredSignatures) {
+            _completeValidation(requestId);
+        }
+    }
+
+    /// @notice Submits a quorum of signatures in one transaction, so one
+    /// coordinator pays the gas instead of every signer. Signers whose
+    /// signature is already recorded are skipped.
+    function submitAggregatedSignatures(
+        uint256 requestId,
+        address[] calldata signers,
+        bytes[] calldata signatures
+    ) external {
+        ValidationRequest storage request = _openRequest(requestId);
+
+        if (validators[msg.sender].status != ValidatorStatus.Active) {
+            revert ValidatorNotActive();
+        }
+        if (signers.length != signatures.length) {
+            revert InvalidSignature();
+        }
+
+        for (uint256 i = 0; i < signers.length; i++) {
+            if (request.hasSigned[signers[i]]) {
+                continue;
+            }
+            if (validators[signers[i]].status != ValidatorStatus.Active) {
+                revert ValidatorNotActive();
+            }
+            _recordSignature(requestId, request, signers[i], signatures[i]);
+        }
+
+        if (request.receivedSignatures < request.requiredSignatures) {
+            revert InsufficientSignatures();
+        }
+        _completeValidation(requestId);
+    }
+
+    function _openRequest(uint256 requestId) internal view returns (ValidationRequest storage request) {
+        request = validationRequests[requestId];
+
         if (request.id == 0) {
             revert InvalidValidationRequest();
         }
@@ -248,19 +298,20 @@ contract RelayValidator is ReentrancyGuard, Ownable, Pausable {
         if (block.timestamp > request.deadline) {
             revert ValidationExpired();
         }
-        if (validators[msg.sender].status != ValidatorStatus.Active) {
-            revert ValidatorNotActive();
-        }
-        if (request.hasSigned[msg.sender]) {
-            revert AlreadySigned();
-        }
+    }
 
+    function _recordSignature(
+        uint256 requestId,
+        ValidationRequest storage request,
+        address signer,
+        bytes calldata signature
+    ) internal {
         // Verify BLS signature first
         bool isValidBLS = false;
         if (signature.length >= 48) {
             BLS12381.G1Point memory sigPoint = BLSSignatureAggregator.parseSignature(signature);
             BLS12381.G2Point memory pubKey = BLSSignatureAggregator.convertPublicKey(
-                validators[msg.sender].blsPublicKey
+                validators[signer].blsPublicKey
             );
             isValidBLS = BLSSignatureAggregator.verifySingle(sigPoint, request.messageHash, pubKey);
         }
@@ -269,28 +320,24 @@ contract RelayValidator is ReentrancyGuard, Ownable, Pausable {
         if (!isValidBLS) {
             bytes32 ethSignedHash = request.messageHash.toEthSignedMessageHash();
             address recoveredSigner = ethSignedHash.recover(signature);
-            if (recoveredSigner != msg.sender) {
+            if (recoveredSigner != signer) {
                 revert InvalidSignature();
             }
         }
 
-        request.hasSigned[msg.sender] = true;
-        request.signatures[msg.sender] = signature;
-        request.signers.push(msg.sender);
+        request.hasSigned[signer] = true;
+        request.signatures[signer] = signature;
+        request.signers.push(signer);
         request.receivedSignatures++;
 
-        validators[msg.sender].lastActivity = block.timestamp;
-        validators[msg.sender].validationCount++;
+        validators[signer].lastActivity = block.timestamp;
+        validators[signer].validationCount++;
 
         if (request.status == ValidationStatus.Pending) {
             request.status = ValidationStatus.InProgress;
         }
 
-        emit ValidationSigned(requestId, msg.sender, signature);
-
-        if (request.receivedSignatures >= request.requiredSignatures) {
-            _completeValidation(requestId);
-        }
+        emit ValidationSigned(requestId, signer, signature);
     }
 
     function _completeValidation(uint256 requestId) internal {
@@ -105,6 +105,86 @@ contract RelayValidatorTest is Test {
         vm.stopPrank();
     }
 
+    function testSubmitAggregatedSignatures() public {
+        _setupValidators();
+        
+        bytes32 messageHash = keccak256("test payment");
+        uint256 requestId = relayValidator.requestValidation(1, messageHash, 100 ether);
+        
+        address[] memory signers = new address[](2);
+        signers[0] = validator1;
+        signers[1] = validator2;
+        bytes[] memory signatures = new bytes[](2);
+        signatures[0] = _signShare(1, messageHash);
+        signatures[1] = _signShare(2, messageHash);
+        
+        // A validator outside the quorum can coordinate the submission
+        vm.prank(validator3);
+        relayValidator.submitAggregatedSignatures(requestId, signers, signatures);
+        
+        (,,,, uint256 receivedSigs, RelayValidator.ValidationStatus status,,,) = relayValidator.getValidationRequest(requestId);
+        assertEq(receivedSigs, 2);
+        assertEq(uint(status), uint(RelayValidator.ValidationStatus.Completed));
+    }
+
+    function testSubmitAggregatedSignaturesSkipsRecordedShares() public {
+        _setupValidators();
+        
+        bytes32 messageHash = keccak256("test payment");
+        uint256 requestId = relayValidator.requestValidation(1, messageHash, 100 ether);
+        
+        vm.prank(validator1);
+        relayValidator.signValidation(requestId, _signShare(1, messageHash));
+        
+        address[] memory signers = new address[](2);
+        signers[0] = validator1;
+        signers[1] = validator2;
+        bytes[] memory signatures = new bytes[](2);
+        signatures[0] = _signShare(1, messageHash);
+        signatures[1] = _signShare(2, messageHash);
+        
+        vm.prank(validator2);
+        relayValidator.submitAggregatedSignatures(requestId, signers, signatures);
+        
+        (,,,, uint256 receivedSigs, RelayValidator.ValidationStatus status,,,) = relayValidator.getValidationRequest(requestId);
+        assertEq(receivedSigs, 2);
+        assertEq(uint(status), uint(RelayValidator.ValidationStatus.Completed));
+    }
+
+    function testSubmitAggregatedSignaturesBelowQuorum() public {
+        _setupValidators();
+        
+        bytes32 messageHash = keccak256("test payment");
+        uint256 requestId = relayValidator.requestValidation(1, messageHash, 100 ether);
+        
+        address[] memory signers = new address[](1);
+        signers[0] = validator1;
+        bytes[] memory signatures = new bytes[](1);
+        signatures[0] = _signShare(1, messageHash);
+        
+        vm.prank(validator1);
+        vm.expectRevert(RelayValidator.InsufficientSignatures.selector);
+        relayValidator.submitAggregatedSignatures(requestId, signers, signatures);
+    }
+
+    function testSubmitAggregatedSignaturesRejectsForgedShare() public {
+        _setupValidators();
+        
+        bytes32 messageHash = keccak256("test payment");
+        uint256 requestId = relayValidator.requestValidation(1, messageHash, 100 ether);
+        
+        address[] memory signers = new address[](2);
+        signers[0] = validator1;
+        signers[1] = validator2;
+        bytes[] memory signatures = new bytes[](2);
+        signatures[0] = _signShare(1, messageHash);
+        signatures[1] = _signShare(3, messageHash);
+        
+        vm.prank(validator1);
+        vm.expectRevert(RelayValidator.InvalidSignature.selector);
+        relayValidator.submitAggregatedSignatures(requestId, signers, signatures);
+    }
+
     function testSlashValidator() public {
         _setupValidators();
         
@@ -205,6 +285,12 @@ contract RelayValidatorTest is Test {
         relayValidator.requestValidation(2, messageHash, 100 ether);
     }
 
+    function _signShare(uint256 key, bytes32 messageHash) internal pure returns (bytes memory) {
+        bytes32 ethSignedHash = keccak256(abi.encodePacked("\x19Ethereum Signed Message:\n32", messageHash));
+        (uint8 v, bytes32 r, bytes32 s) = vm.sign(key, ethSignedHash);
+        return abi.encodePacked(r, s, v);
+    }
+
     function _setupValidators() internal {
         vm.deal(validator1, 20 ether);
         vm.deal(validator2, 20 ether);
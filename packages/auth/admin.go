@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config configures a service's admin endpoints. Services embed it in their
+// own config struct, so the settings load like the rest of theirs.
+type Config struct {
+	// JWTSecret verifies admin tokens. Admin endpoints answer 503 when it is
+	// empty, rather than being left open.
+	JWTSecret string `config:"jwt_secret" env:"ADMIN_JWT_SECRET" secret:"true"`
+	// JWTIssuer is required of tokens when set
+	JWTIssuer string `config:"jwt_issuer" env:"ADMIN_JWT_ISSUER"`
+	// AuditLog is a file audit entries are appended to, as JSON lines. They
+	// go to stderr when it is empty.
+	AuditLog string `config:"audit_log" env:"ADMIN_AUDIT_LOG"`
+}
+
+// Admin authenticates admin requests and audits them
+type Admin struct {
+	service string
+	secret  []byte
+	issuer  string
+	audit   *AuditLog
+	closer  io.Closer
+	now     func() time.Time
+}
+
+// New returns the admin guard for a service, opening its audit log
+func New(service string, cfg Config) (*Admin, error) {
+	var out io.Writer = os.Stderr
+	var closer io.Closer
+	if cfg.AuditLog != "" {
+		file, err := os.OpenFile(cfg.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = file, file
+	}
+
+	return &Admin{
+		service: service,
+		secret:  []byte(cfg.JWTSecret),
+		issuer:  cfg.JWTIssuer,
+		audit:   NewAuditLog(out, defaultAuditHistory),
+		closer:  closer,
+		now:     time.Now,
+	}, nil
+}
+
+// Enabled reports whether a secret is configured
+func (a *Admin) Enabled() bool {
+	return len(a.secret) > 0
+}
+
+// Verify checks an admin token against the service's secret and issuer
+func (a *Admin) Verify(token string) (*Claims, error) {
+	return Verify(token, a.secret, a.issuer, a.now())
+}
+
+// Token signs a token for the service itself, lasting ttl, with which it
+// calls the admin endpoints of other services sharing the secret
+func (a *Admin) Token(ttl time.Duration, roles ...string) (string, error) {
+	now := a.now()
+	return Sign(Claims{
+		Subject:   a.service,
+		Roles:     roles,
+		Issuer:    a.issuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}, a.secret)
+}
+
+// Close closes the audit log file
+func (a *Admin) Close() error {
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+	return nil
+}
+
+type claimsKey struct{}
+
+// ClaimsFrom returns the claims of the admin who made the request, or nil
+// outside an admin endpoint
+func ClaimsFrom(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
+
+// Require guards an action: the request needs a valid bearer token with one
+// of roles. Missing or invalid tokens get 401 and tokens without the role
+// 403. Every request is audited under action with the response status.
+func (a *Admin) Require(action string, roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entry := AuditEntry{
+				Time:       a.now().UTC(),
+				Service:    a.service,
+				Action:     action,
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				RemoteAddr: r.RemoteAddr,
+			}
+			defer func() { a.audit.Record(entry) }()
+
+			if !a.Enabled() {
+				entry.Outcome = OutcomeDisabled
+				entry.Status = http.StatusServiceUnavailable
+				writeError(w, entry.Status, "Admin API is not configured")
+				return
+			}
+
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || token == "" {
+				entry.Outcome = OutcomeUnauthenticated
+				entry.Status = http.StatusUnauthorized
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeError(w, entry.Status, "Admin token required")
+				return
+			}
+			claims, err := a.Verify(token)
+			if err != nil {
+				entry.Outcome = OutcomeUnauthenticated
+				entry.Status = http.StatusUnauthorized
+				entry.Error = err.Error()
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin", error="invalid_token"`)
+				message := "Invalid admin token"
+				if errors.Is(err, ErrExpiredToken) {
+					message = "Admin token expired"
+				}
+				writeError(w, entry.Status, message)
+				return
+			}
+			entry.Subject = claims.Subject
+			entry.Roles = claims.Roles
+
+			if !claims.HasRole(roles...) {
+				entry.Outcome = OutcomeDenied
+				entry.Status = http.StatusForbidden
+				writeError(w, entry.Status, "Role not allowed to "+action)
+				return
+			}
+
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+			entry.Outcome = OutcomeAllowed
+			entry.Status = rec.status
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+		})
+	}
+}
+
+// AuditHandler serves the service's recent audit entries, newest first, to
+// operators and auditors. ?limit= caps how many are returned.
+func (a *Admin) AuditHandler() http.Handler {
+	return a.Require("admin.audit.read", RoleOperator, RoleAuditor)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultAuditHistory
+		if value := r.URL.Query().Get("limit"); value != "" {
+			if n, err := parsePositive(value); err == nil && n < limit {
+				limit = n
+			}
+		}
+		entries := a.audit.Recent(limit)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"entries": entries, "count": len(entries)})
+	}))
+}
+
+// statusRecorder remembers the status a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
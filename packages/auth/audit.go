@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultAuditHistory is how many entries a service keeps in memory for
+// GET /admin/audit. The log itself keeps every entry.
+const defaultAuditHistory = 1000
+
+// Audit outcomes
+const (
+	OutcomeAllowed         = "allowed"
+	OutcomeDenied          = "denied"
+	OutcomeUnauthenticated = "unauthenticated"
+	OutcomeDisabled        = "disabled"
+)
+
+// AuditEntry records one admin request
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Service    string    `json:"service"`
+	Action     string    `json:"action"`
+	Subject    string    `json:"subject,omitempty"`
+	Roles      []string  `json:"roles,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	RemoteAddr string    `json:"remote_addr"`
+	Outcome    string    `json:"outcome"`
+	Status     int       `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AuditLog writes entries as JSON lines and keeps the latest in memory
+type AuditLog struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	recent []AuditEntry
+	next   int
+	full   bool
+}
+
+// NewAuditLog returns a log writing to out and remembering the last size
+// entries
+func NewAuditLog(out io.Writer, size int) *AuditLog {
+	return &AuditLog{out: out, recent: make([]AuditEntry, size)}
+}
+
+// Record writes an entry. A failed write is logged, since the action it
+// records has already happened.
+func (l *AuditLog) Record(entry AuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry for %s: %v", entry.Action, err)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit entry %s: %v", line, err)
+	}
+	l.recent[l.next] = entry
+	l.next = (l.next + 1) % len(l.recent)
+	l.full = l.full || l.next == 0
+}
+
+// Recent returns up to limit entries, newest first
+func (l *AuditLog) Recent(limit int) []AuditEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.recent)
+	}
+	if limit > count {
+		limit = count
+	}
+
+	entries := make([]AuditEntry, 0, limit)
+	for i := 0; i < limit; i++ {
+		index := (l.next - 1 - i + len(l.recent)) % len(l.recent)
+		entries = append(entries, l.recent[index])
+	}
+	return entries
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func parsePositive(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return n, nil
+}
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var secret = []byte("test-secret")
+
+func token(t *testing.T, subject string, ttl time.Duration, roles ...string) string {
+	token, err := Sign(Claims{Subject: subject, Roles: roles, ExpiresAt: time.Now().Add(ttl).Unix()}, secret)
+	require.NoError(t, err)
+	return token
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+
+	t.Run("should return the claims of a signed token", func(t *testing.T) {
+		claims, err := Verify(token(t, "alice", time.Hour, RoleOperator), secret, "", now)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", claims.Subject)
+		assert.Equal(t, []string{RoleOperator}, claims.Roles)
+	})
+
+	t.Run("should reject tokens signed with another secret", func(t *testing.T) {
+		_, err := Verify(token(t, "alice", time.Hour, RoleOperator), []byte("other"), "", now)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("should reject expired tokens", func(t *testing.T) {
+		_, err := Verify(token(t, "alice", -time.Minute, RoleOperator), secret, "", now)
+		assert.ErrorIs(t, err, ErrExpiredToken)
+	})
+
+	t.Run("should reject unsigned tokens", func(t *testing.T) {
+		parts := strings.Split(token(t, "alice", time.Hour, RoleOperator), ".")
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+		_, err := Verify(header+"."+parts[1]+".", secret, "", now)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("should reject tokens without an admin role", func(t *testing.T) {
+		_, err := Verify(token(t, "alice", time.Hour, "user"), secret, "", now)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("should check the issuer when one is expected", func(t *testing.T) {
+		signed, err := Sign(Claims{Subject: "alice", Roles: []string{RoleAuditor}, Issuer: "crosspay", ExpiresAt: now.Add(time.Hour).Unix()}, secret)
+		require.NoError(t, err)
+
+		_, err = Verify(signed, secret, "crosspay", now)
+		assert.NoError(t, err)
+		_, err = Verify(signed, secret, "elsewhere", now)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+}
+
+func TestVerifyPayload(t *testing.T) {
+	type session struct {
+		Subject string `json:"sub"`
+		Role    string `json:"role"`
+	}
+
+	t.Run("should decode the payload of a signed token", func(t *testing.T) {
+		signed, err := SignPayload(session{Subject: "acme", Role: "merchant"}, secret)
+		require.NoError(t, err)
+		var got session
+		require.NoError(t, VerifyPayload(signed, secret, &got))
+		assert.Equal(t, session{Subject: "acme", Role: "merchant"}, got)
+	})
+
+	t.Run("should reject tampered payloads", func(t *testing.T) {
+		signed, err := SignPayload(session{Subject: "acme", Role: "merchant"}, secret)
+		require.NoError(t, err)
+		parts := strings.Split(signed, ".")
+		parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"acme","role":"ops"}`))
+		var got session
+		assert.ErrorIs(t, VerifyPayload(strings.Join(parts, "."), secret, &got), ErrInvalidToken)
+		assert.ErrorIs(t, VerifyPayload(signed, []byte("other"), &got), ErrInvalidToken)
+	})
+}
+
+func TestToken(t *testing.T) {
+	t.Run("should sign tokens for the service itself", func(t *testing.T) {
+		admin, err := New("payment-processor", Config{JWTSecret: string(secret), JWTIssuer: "crosspay"})
+		require.NoError(t, err)
+		signed, err := admin.Token(time.Minute, RoleOperator)
+		require.NoError(t, err)
+
+		claims, err := Verify(signed, secret, "crosspay", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, "payment-processor", claims.Subject)
+		assert.Equal(t, []string{RoleOperator}, claims.Roles)
+		_, err = Verify(signed, secret, "crosspay", time.Now().Add(2*time.Minute))
+		assert.ErrorIs(t, err, ErrExpiredToken)
+	})
+
+	t.Run("should fail without a secret", func(t *testing.T) {
+		admin, err := New("payment-processor", Config{})
+		require.NoError(t, err)
+		_, err = admin.Token(time.Minute, RoleOperator)
+		assert.Error(t, err)
+	})
+}
+
+func TestRequire(t *testing.T) {
+	newAdmin := func(secret string) (*Admin, *bytes.Buffer) {
+		var out bytes.Buffer
+		admin, err := New("oracle-service", Config{JWTSecret: secret})
+		require.NoError(t, err)
+		admin.audit = NewAuditLog(&out, 10)
+		return admin, &out
+	}
+	pause := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(ClaimsFrom(r.Context()).Subject))
+	})
+	call := func(admin *Admin, bearer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/oracle/circuit-breaker/pause", nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		rec := httptest.NewRecorder()
+		admin.Require("oracle.circuit_breaker.pause", RoleOperator)(pause).ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("should let allowed roles through and audit them", func(t *testing.T) {
+		admin, out := newAdmin(string(secret))
+
+		rec := call(admin, token(t, "alice", time.Hour, RoleOperator))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "alice", rec.Body.String())
+
+		var entry AuditEntry
+		require.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+		assert.Equal(t, "oracle-service", entry.Service)
+		assert.Equal(t, "oracle.circuit_breaker.pause", entry.Action)
+		assert.Equal(t, "alice", entry.Subject)
+		assert.Equal(t, OutcomeAllowed, entry.Outcome)
+		assert.Equal(t, http.StatusOK, entry.Status)
+	})
+
+	t.Run("should forbid other roles", func(t *testing.T) {
+		admin, _ := newAdmin(string(secret))
+
+		rec := call(admin, token(t, "bob", time.Hour, RoleAuditor, RoleSupport))
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		entries := admin.audit.Recent(10)
+		require.Len(t, entries, 1)
+		assert.Equal(t, OutcomeDenied, entries[0].Outcome)
+		assert.Equal(t, "bob", entries[0].Subject)
+	})
+
+	t.Run("should require a valid token", func(t *testing.T) {
+		admin, _ := newAdmin(string(secret))
+
+		assert.Equal(t, http.StatusUnauthorized, call(admin, "").Code)
+		assert.Equal(t, http.StatusUnauthorized, call(admin, "not.a.token").Code)
+
+		entries := admin.audit.Recent(10)
+		require.Len(t, entries, 2)
+		assert.Equal(t, OutcomeUnauthenticated, entries[0].Outcome)
+	})
+
+	t.Run("should refuse every request without a secret", func(t *testing.T) {
+		admin, _ := newAdmin("")
+
+		rec := call(admin, token(t, "alice", time.Hour, RoleOperator))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Run("should return the latest entries newest first", func(t *testing.T) {
+		var out bytes.Buffer
+		audit := NewAuditLog(&out, 3)
+		for _, action := range []string{"a", "b", "c", "d"} {
+			audit.Record(AuditEntry{Action: action})
+		}
+
+		entries := audit.Recent(10)
+		require.Len(t, entries, 3)
+		assert.Equal(t, "d", entries[0].Action)
+		assert.Equal(t, "b", entries[2].Action)
+		assert.Equal(t, 4, strings.Count(out.String(), "\n"))
+	})
+
+	t.Run("should serve the audit log to auditors", func(t *testing.T) {
+		admin, err := New("ens-resolver", Config{JWTSecret: string(secret)})
+		require.NoError(t, err)
+		admin.audit = NewAuditLog(&bytes.Buffer{}, 10)
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/audit?limit=5", nil)
+		req.Header.Set("Authorization", "Bearer "+token(t, "carol", time.Hour, RoleAuditor))
+		rec := httptest.NewRecorder()
+		admin.AuditHandler().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		req.Header.Set("Authorization", "Bearer "+token(t, "dave", time.Hour, RoleSupport))
+		rec = httptest.NewRecorder()
+		admin.AuditHandler().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		// Both reads were audited
+		assert.Len(t, admin.audit.Recent(10), 2)
+	})
+}
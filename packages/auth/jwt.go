@@ -0,0 +1,142 @@
+// Package auth guards the operational endpoints of the Go services, such as
+// pausing the oracle circuit breaker or clearing the ENS cache. Admins call
+// them with an HS256 JWT signed with the secret the services share. The
+// token's roles decide which actions it may take, and every call, allowed
+// or not, is written to an audit log.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Admin roles. Operators may take every action, support staff the ones that
+// help a user without changing how the service runs, and auditors may only
+// read.
+const (
+	RoleOperator = "operator"
+	RoleSupport  = "support"
+	RoleAuditor  = "auditor"
+)
+
+// Roles lists every admin role
+var Roles = []string{RoleOperator, RoleSupport, RoleAuditor}
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+)
+
+// Claims are what an admin token asserts
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Roles     []string `json:"roles"`
+	Issuer    string   `json:"iss,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// HasRole reports whether the claims carry any of roles
+func (c *Claims) HasRole(roles ...string) bool {
+	for _, have := range c.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Sign returns an HS256 JWT for claims
+func Sign(claims Claims, secret []byte) (string, error) {
+	return SignPayload(claims, secret)
+}
+
+// SignPayload returns an HS256 JWT carrying payload as its claims, for
+// tokens other than admin tokens, such as dashboard sessions
+func SignPayload(payload interface{}, secret []byte) (string, error) {
+	if len(secret) == 0 {
+		return "", errors.New("auth: empty secret")
+	}
+	claims, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return unsigned + "." + signature(unsigned, secret), nil
+}
+
+// Verify checks a token's signature, expiry and, when issuer is not empty,
+// its issuer, and returns its claims. Only HS256 tokens with a subject, an
+// expiry and at least one known role are accepted.
+func Verify(token string, secret []byte, issuer string, now time.Time) (*Claims, error) {
+	var claims Claims
+	if err := VerifyPayload(token, secret, &claims); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case claims.Subject == "" || claims.ExpiresAt == 0:
+		return nil, fmt.Errorf("%w: sub and exp are required", ErrInvalidToken)
+	case !claims.HasRole(Roles...):
+		return nil, fmt.Errorf("%w: no admin role", ErrInvalidToken)
+	case issuer != "" && claims.Issuer != issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	case now.Unix() >= claims.ExpiresAt:
+		return nil, ErrExpiredToken
+	case claims.NotBefore != 0 && now.Unix() < claims.NotBefore:
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	return &claims, nil
+}
+
+// VerifyPayload checks the signature of an HS256 JWT and decodes its claims
+// into payload. Checking what they assert, such as their expiry, is left to
+// the caller.
+func VerifyPayload(token string, secret []byte, payload interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || len(secret) == 0 {
+		return ErrInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "HS256" {
+		return ErrInvalidToken
+	}
+
+	expected := signature(parts[0]+"."+parts[1], secret)
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return ErrInvalidToken
+	}
+
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := json.Unmarshal(claims, payload); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func signature(unsigned string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
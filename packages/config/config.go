@@ -0,0 +1,508 @@
+// Package config loads a service's settings into a struct, layering
+// defaults, an optional YAML or TOML file and environment variables, and
+// validates the result so a misconfigured service fails at startup with a
+// list of everything that is wrong.
+//
+// Settings are described by struct tags:
+//
+//	type Config struct {
+//		Port     string        `config:"port" env:"PORT" default:"8080" validate:"required"`
+//		Timeout  time.Duration `config:"timeout" env:"TIMEOUT" default:"5s" validate:"min=1s,max=1m"`
+//		Mode     string        `config:"mode" env:"MODE" default:"memory" validate:"oneof=memory|sql"`
+//		Upstream string        `config:"upstream" env:"UPSTREAM_URL" validate:"url"`
+//		APIKey   string        `config:"api_key" env:"API_KEY" secret:"true"`
+//		Database struct {
+//			Path string `config:"path" env:"DATABASE_PATH" default:"./app.db"`
+//		} `config:"database"`
+//	}
+//
+// A setting takes its default, then the value at its key in the file named
+// by CONFIG_FILE, then its environment variable if that is set and not
+// empty. Nested structs become nested tables in the file.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv is the environment variable naming the config file
+const FileEnv = "CONFIG_FILE"
+
+// RedactedValue replaces the value of secret settings that are set
+const RedactedValue = "[redacted]"
+
+// Source is where a setting's value came from
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+)
+
+// Setting is a loaded setting
+type Setting struct {
+	Key    string
+	Env    string
+	Value  interface{}
+	Source Source
+	Secret bool
+}
+
+// Result describes a loaded configuration
+type Result struct {
+	// File is the config file read, if any
+	File     string
+	Settings []Setting
+}
+
+// Error lists every problem found while loading a configuration
+type Error struct {
+	File     string
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	header := "invalid configuration"
+	if e.File != "" {
+		header += " in " + e.File
+	}
+	return header + ":\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// field is a setting of the struct being loaded
+type field struct {
+	key    string
+	env    string
+	def    string
+	rules  string
+	secret bool
+	value  reflect.Value
+	source Source
+	origin string
+}
+
+// Load fills cfg, a pointer to a struct, from defaults, the file named by
+// CONFIG_FILE and the environment
+func Load(cfg interface{}) (*Result, error) {
+	return LoadFile(cfg, os.Getenv(FileEnv))
+}
+
+// LoadFile is Load with an explicit config file. An empty path reads no
+// file.
+func LoadFile(cfg interface{}, path string) (*Result, error) {
+	root := reflect.ValueOf(cfg)
+	if root.Kind() != reflect.Pointer || root.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config: Load needs a pointer to a struct, got %T", cfg)
+	}
+
+	fields, err := collect(root.Elem(), "")
+	if err != nil {
+		return nil, err
+	}
+	loadErr := &Error{File: path}
+
+	for _, f := range fields {
+		f.source = SourceDefault
+		if f.def == "" {
+			continue
+		}
+		if err := set(f.value, f.def); err != nil {
+			loadErr.Problems = append(loadErr.Problems, fmt.Sprintf("%s: invalid default %q: %v", f.key, f.def, err))
+		}
+	}
+
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		byKey := make(map[string]*field, len(fields))
+		for _, f := range fields {
+			byKey[f.key] = f
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			f, ok := byKey[key]
+			if !ok {
+				loadErr.Problems = append(loadErr.Problems, fmt.Sprintf("%s: unknown setting", key))
+				continue
+			}
+			f.source, f.origin = SourceFile, "from "+filepath.Base(path)
+			if err := setFileValue(f.value, values[key]); err != nil {
+				loadErr.Problems = append(loadErr.Problems, fmt.Sprintf("%s: %v (%s)", key, err, f.origin))
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if f.env == "" {
+			continue
+		}
+		value := os.Getenv(f.env)
+		if value == "" {
+			continue
+		}
+		f.source, f.origin = SourceEnv, "from "+f.env
+		if err := set(f.value, value); err != nil {
+			loadErr.Problems = append(loadErr.Problems, fmt.Sprintf("%s: %v (%s=%q)", f.key, err, f.env, value))
+		}
+	}
+
+	result := &Result{File: path}
+	for _, f := range fields {
+		if err := validate(f.value, f.rules); err != nil {
+			loadErr.Problems = append(loadErr.Problems, fmt.Sprintf("%s: %v (%s)", f.key, err, f.describe()))
+		}
+		result.Settings = append(result.Settings, Setting{
+			Key:    f.key,
+			Env:    f.env,
+			Value:  f.value.Interface(),
+			Source: f.source,
+			Secret: f.secret,
+		})
+	}
+
+	if len(loadErr.Problems) > 0 {
+		return nil, loadErr
+	}
+	return result, nil
+}
+
+// describe says where the field's value came from, for errors
+func (f *field) describe() string {
+	if f.origin != "" {
+		return f.origin
+	}
+	if f.env != "" {
+		return "set it in the config file or " + f.env
+	}
+	return "set it in the config file"
+}
+
+// collect lists the settings of a struct, recursing into nested structs
+func collect(v reflect.Value, prefix string) ([]*field, error) {
+	var fields []*field
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key, ok := sf.Tag.Lookup("config")
+		if !ok || key == "-" || !sf.IsExported() {
+			continue
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		if sf.Type.Kind() == reflect.Struct {
+			nested, err := collect(v.Field(i), key)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, nested...)
+			continue
+		}
+		if !supported(sf.Type) {
+			return nil, fmt.Errorf("config: %s has unsupported type %s", key, sf.Type)
+		}
+
+		fields = append(fields, &field{
+			key:    key,
+			env:    sf.Tag.Get("env"),
+			def:    sf.Tag.Get("default"),
+			rules:  sf.Tag.Get("validate"),
+			secret: sf.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fields, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func supported(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// set parses a default or environment value into v. Lists are comma
+// separated.
+func set(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("not a duration")
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("not a non-negative integer")
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("not a number")
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
+
+// setFileValue stores a value decoded from a config file into v
+func setFileValue(v reflect.Value, value interface{}) error {
+	if v.Kind() == reflect.Slice {
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("must be a list")
+		}
+		items := make([]string, 0, len(list))
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+		v.Set(reflect.ValueOf(items))
+		return nil
+	}
+
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return fmt.Errorf("must be a single value")
+	case float64, float32:
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return set(v, strconv.FormatFloat(reflect.ValueOf(value).Float(), 'f', -1, 64))
+		}
+	}
+	return set(v, fmt.Sprint(value))
+}
+
+// readFile decodes a YAML or TOML file, by extension, into settings keyed
+// by their dotted path
+func readFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	doc := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("config: %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: failed to parse %s: %w", path, err)
+	}
+
+	values := make(map[string]interface{})
+	flatten(doc, "", values)
+	return values, nil
+}
+
+func flatten(doc map[string]interface{}, prefix string, values map[string]interface{}) {
+	for key, value := range doc {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			flatten(nested, key, values)
+			continue
+		}
+		values[key] = value
+	}
+}
+
+// validate checks v against comma separated rules: required, min=, max=,
+// oneof= with | separated choices, and url
+func validate(v reflect.Value, rules string) error {
+	if rules == "" {
+		return nil
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+
+		switch name {
+		case "required":
+			if v.IsZero() {
+				return fmt.Errorf("is required")
+			}
+		case "min", "max":
+			bound := reflect.New(v.Type()).Elem()
+			if err := set(bound, arg); err != nil {
+				return fmt.Errorf("invalid %s rule %q", name, arg)
+			}
+			if c := compare(v, bound); (name == "min" && c < 0) || (name == "max" && c > 0) {
+				word := "at least"
+				if name == "max" {
+					word = "at most"
+				}
+				return fmt.Errorf("must be %s %s, got %s", word, arg, format(v))
+			}
+		case "oneof":
+			choices := strings.Split(arg, "|")
+			if v.Kind() != reflect.String || !contains(choices, v.String()) {
+				return fmt.Errorf("must be one of %s, got %q", strings.Join(choices, ", "), format(v))
+			}
+		case "url":
+			if v.String() == "" {
+				continue
+			}
+			parsed, err := url.Parse(v.String())
+			if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				return fmt.Errorf("must be an absolute URL, got %q", v.String())
+			}
+		default:
+			return fmt.Errorf("unknown validation rule %q", name)
+		}
+	}
+	return nil
+}
+
+// compare orders two numbers of the same type
+func compare(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp(a.Int() < b.Int(), a.Int() > b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp(a.Uint() < b.Uint(), a.Uint() > b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return cmp(a.Float() < b.Float(), a.Float() > b.Float())
+	case reflect.String:
+		return cmp(len(a.String()) < len(b.String()), len(a.String()) > len(b.String()))
+	case reflect.Slice:
+		return cmp(a.Len() < b.Len(), a.Len() > b.Len())
+	}
+	return 0
+}
+
+func cmp(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+func format(v reflect.Value) string {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns the settings nested by key, with the values of secret
+// settings that are set replaced
+func (r *Result) Redacted() map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, s := range r.Settings {
+		value := s.Value
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if s.Secret && !reflect.ValueOf(s.Value).IsZero() {
+			value = RedactedValue
+		}
+
+		node := out
+		parts := strings.Split(s.Key, ".")
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = value
+	}
+	return out
+}
+
+// Sources maps each setting's key to where its value came from
+func (r *Result) Sources() map[string]Source {
+	sources := make(map[string]Source, len(r.Settings))
+	for _, s := range r.Settings {
+		sources[s.Key] = s.Source
+	}
+	return sources
+}
+
+// Handler serves the redacted configuration and each setting's source as
+// JSON, for a /config debug endpoint
+func (r *Result) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"file":    r.File,
+			"config":  r.Redacted(),
+			"sources": r.Sources(),
+		})
+	}
+}
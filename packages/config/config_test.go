@@ -0,0 +1,183 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	Port     string        `config:"port" env:"TEST_PORT" default:"8080" validate:"required"`
+	Interval time.Duration `config:"interval" env:"TEST_INTERVAL" default:"30s" validate:"min=1s,max=1h"`
+	Workers  int           `config:"workers" env:"TEST_WORKERS" default:"3" validate:"min=1"`
+	Mode     string        `config:"mode" env:"TEST_MODE" default:"memory" validate:"oneof=memory|sql"`
+	Rate     float64       `config:"rate" env:"TEST_RATE"`
+	Verbose  bool          `config:"verbose" env:"TEST_VERBOSE"`
+	Origins  []string      `config:"origins" env:"TEST_ORIGINS"`
+	Database struct {
+		URL      string `config:"url" env:"TEST_DATABASE_URL" validate:"url"`
+		Password string `config:"password" env:"TEST_DATABASE_PASSWORD" secret:"true"`
+	} `config:"database"`
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadLayers(t *testing.T) {
+	t.Run("should apply defaults", func(t *testing.T) {
+		var cfg testConfig
+		result, err := LoadFile(&cfg, "")
+		require.NoError(t, err)
+
+		assert.Equal(t, "8080", cfg.Port)
+		assert.Equal(t, 30*time.Second, cfg.Interval)
+		assert.Equal(t, 3, cfg.Workers)
+		assert.Equal(t, SourceDefault, result.Sources()["port"])
+	})
+
+	t.Run("should read a YAML file over defaults", func(t *testing.T) {
+		path := writeFile(t, "service.yaml", `
+port: "9090"
+interval: 2m
+workers: 8
+rate: 1.5
+origins: [https://a.example, https://b.example]
+database:
+  url: postgres://db:5432/app
+  password: hunter2
+`)
+		var cfg testConfig
+		result, err := LoadFile(&cfg, path)
+		require.NoError(t, err)
+
+		assert.Equal(t, "9090", cfg.Port)
+		assert.Equal(t, 2*time.Minute, cfg.Interval)
+		assert.Equal(t, 8, cfg.Workers)
+		assert.Equal(t, 1.5, cfg.Rate)
+		assert.Equal(t, []string{"https://a.example", "https://b.example"}, cfg.Origins)
+		assert.Equal(t, "postgres://db:5432/app", cfg.Database.URL)
+		assert.Equal(t, SourceFile, result.Sources()["database.url"])
+		assert.Equal(t, SourceDefault, result.Sources()["mode"])
+	})
+
+	t.Run("should read a TOML file", func(t *testing.T) {
+		path := writeFile(t, "service.toml", `
+workers = 5
+verbose = true
+
+[database]
+url = "postgres://db/app"
+`)
+		var cfg testConfig
+		_, err := LoadFile(&cfg, path)
+		require.NoError(t, err)
+
+		assert.Equal(t, 5, cfg.Workers)
+		assert.True(t, cfg.Verbose)
+		assert.Equal(t, "postgres://db/app", cfg.Database.URL)
+	})
+
+	t.Run("should let the environment override the file", func(t *testing.T) {
+		path := writeFile(t, "service.yaml", "workers: 8\n")
+		t.Setenv("TEST_WORKERS", "12")
+		t.Setenv("TEST_ORIGINS", "https://a.example, https://b.example")
+		t.Setenv(FileEnv, path)
+
+		var cfg testConfig
+		result, err := Load(&cfg)
+		require.NoError(t, err)
+
+		assert.Equal(t, 12, cfg.Workers)
+		assert.Equal(t, []string{"https://a.example", "https://b.example"}, cfg.Origins)
+		assert.Equal(t, SourceEnv, result.Sources()["workers"])
+		assert.Equal(t, path, result.File)
+	})
+
+	t.Run("should reject unsupported file formats", func(t *testing.T) {
+		var cfg testConfig
+		_, err := LoadFile(&cfg, writeFile(t, "service.json", "{}"))
+		assert.ErrorContains(t, err, "unsupported format")
+	})
+}
+
+func TestLoadValidation(t *testing.T) {
+	t.Run("should report every problem at once", func(t *testing.T) {
+		path := writeFile(t, "service.yaml", `
+workers: 0
+mode: redis
+prot: "80"
+database:
+  url: not-a-url
+`)
+		t.Setenv("TEST_INTERVAL", "soon")
+
+		var cfg testConfig
+		_, err := LoadFile(&cfg, path)
+		require.Error(t, err)
+
+		var loadErr *Error
+		require.True(t, errors.As(err, &loadErr))
+		assert.Len(t, loadErr.Problems, 5)
+		assert.Contains(t, err.Error(), "prot: unknown setting")
+		assert.Contains(t, err.Error(), `interval: not a duration (TEST_INTERVAL="soon")`)
+		assert.Contains(t, err.Error(), "workers: must be at least 1, got 0 (from service.yaml)")
+		assert.Contains(t, err.Error(), "mode: must be one of memory, sql")
+		assert.Contains(t, err.Error(), "database.url: must be an absolute URL")
+	})
+
+	t.Run("should check duration bounds", func(t *testing.T) {
+		t.Setenv("TEST_INTERVAL", "2h")
+
+		var cfg testConfig
+		_, err := LoadFile(&cfg, "")
+		assert.ErrorContains(t, err, "interval: must be at most 1h, got 2h0m0s (from TEST_INTERVAL)")
+	})
+
+	t.Run("should name where a required setting can be set", func(t *testing.T) {
+		var cfg struct {
+			Token string `config:"token" env:"TEST_TOKEN" validate:"required"`
+		}
+		_, err := LoadFile(&cfg, "")
+		assert.ErrorContains(t, err, "token: is required (set it in the config file or TEST_TOKEN)")
+	})
+}
+
+func TestRedacted(t *testing.T) {
+	t.Setenv("TEST_DATABASE_PASSWORD", "hunter2")
+
+	var cfg testConfig
+	result, err := LoadFile(&cfg, "")
+	require.NoError(t, err)
+
+	t.Run("should hide secrets and nest keys", func(t *testing.T) {
+		redacted := result.Redacted()
+		assert.Equal(t, "30s", redacted["interval"])
+		assert.Equal(t, RedactedValue, redacted["database"].(map[string]interface{})["password"])
+	})
+
+	t.Run("should serve the redacted config", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		result.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "hunter2")
+
+		var body struct {
+			Config  map[string]interface{} `json:"config"`
+			Sources map[string]Source      `json:"sources"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, "8080", body.Config["port"])
+		assert.Equal(t, SourceEnv, body.Sources["database.password"])
+	})
+}
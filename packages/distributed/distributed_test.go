@@ -0,0 +1,256 @@
+package distributed
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// coordinators returns a coordinator without Redis and two replicas sharing
+// a Redis server, so each behaviour is checked against both
+func coordinators(t *testing.T, cfg Config) map[string][2]*Coordinator {
+	single, err := New("test", cfg)
+	require.NoError(t, err)
+
+	server := miniredis.RunT(t)
+	cfg.RedisURL = "redis://" + server.Addr()
+	first, err := New("test", cfg)
+	require.NoError(t, err)
+	second, err := New("test", cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		first.Close()
+		second.Close()
+	})
+	return map[string][2]*Coordinator{
+		"in process": {single, single},
+		"redis":      {first, second},
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Run("should fail when Redis is unreachable", func(t *testing.T) {
+		_, err := New("test", Config{RedisURL: "redis://127.0.0.1:1"})
+		assert.Error(t, err)
+		_, err = New("test", Config{RedisURL: "http://"})
+		assert.Error(t, err)
+	})
+
+	t.Run("should prefix keys with the service", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		c, err := New("payment-processor", Config{RedisURL: "redis://" + server.Addr()})
+		require.NoError(t, err)
+		defer c.Close()
+		assert.True(t, c.Distributed())
+
+		lock, err := c.Lock(context.Background(), "payment:7")
+		require.NoError(t, err)
+		assert.True(t, server.Exists("crosspay:payment-processor:lock:payment:7"))
+		require.NoError(t, lock.Unlock(context.Background()))
+		assert.False(t, server.Exists("crosspay:payment-processor:lock:payment:7"))
+	})
+}
+
+func TestLock(t *testing.T) {
+	for name, c := range coordinators(t, Config{LockTTL: time.Second}) {
+		t.Run("should exclude other holders "+name, func(t *testing.T) {
+			ctx := context.Background()
+			lock, err := c[0].Lock(ctx, "refund:1")
+			require.NoError(t, err)
+
+			_, err = c[1].Lock(ctx, "refund:1")
+			assert.ErrorIs(t, err, ErrLocked)
+			other, err := c[1].Lock(ctx, "refund:2")
+			require.NoError(t, err)
+			require.NoError(t, other.Unlock(ctx))
+
+			require.NoError(t, lock.Unlock(ctx))
+			require.NoError(t, lock.Unlock(ctx))
+			lock, err = c[1].Lock(ctx, "refund:1")
+			require.NoError(t, err)
+			require.NoError(t, lock.Unlock(ctx))
+		})
+	}
+
+	for name, c := range coordinators(t, Config{LockTTL: time.Second, LockWait: 2 * time.Second}) {
+		t.Run("should wait for a held lock "+name, func(t *testing.T) {
+			ctx := context.Background()
+			lock, err := c[0].Lock(ctx, "gc")
+			require.NoError(t, err)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				lock.Unlock(ctx)
+			}()
+
+			started := time.Now()
+			waited, err := c[1].Lock(ctx, "gc")
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, time.Since(started), 50*time.Millisecond)
+			require.NoError(t, waited.Unlock(ctx))
+		})
+	}
+}
+
+func TestWithLock(t *testing.T) {
+	for name, c := range coordinators(t, Config{LockTTL: time.Second, LockWait: 5 * time.Second}) {
+		t.Run("should run critical sections one at a time "+name, func(t *testing.T) {
+			var running, overlaps int32
+			var wg sync.WaitGroup
+			for i := 0; i < 6; i++ {
+				wg.Add(1)
+				go func(c *Coordinator) {
+					defer wg.Done()
+					err := c.WithLock(context.Background(), "complete:9", func(ctx context.Context) error {
+						if atomic.AddInt32(&running, 1) > 1 {
+							atomic.AddInt32(&overlaps, 1)
+						}
+						time.Sleep(20 * time.Millisecond)
+						atomic.AddInt32(&running, -1)
+						return nil
+					})
+					assert.NoError(t, err)
+				}(c[i%2])
+			}
+			wg.Wait()
+			assert.Zero(t, overlaps)
+		})
+	}
+
+	t.Run("should extend the lock past its TTL and return fn's error", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		cfg := Config{RedisURL: "redis://" + server.Addr(), LockTTL: time.Second}
+		first, err := New("test", cfg)
+		require.NoError(t, err)
+		defer first.Close()
+		second, err := New("test", cfg)
+		require.NoError(t, err)
+		defer second.Close()
+
+		failure := errors.New("settlement failed")
+		err = first.WithLock(context.Background(), "gc", func(ctx context.Context) error {
+			// Without the extension after a third of the TTL the lock
+			// would have expired by the second fast-forward
+			server.FastForward(600 * time.Millisecond)
+			time.Sleep(500 * time.Millisecond)
+			server.FastForward(600 * time.Millisecond)
+			_, err := second.Lock(context.Background(), "gc")
+			assert.ErrorIs(t, err, ErrLocked)
+			return failure
+		})
+		assert.ErrorIs(t, err, failure)
+
+		lock, err := second.Lock(context.Background(), "gc")
+		require.NoError(t, err)
+		require.NoError(t, lock.Unlock(context.Background()))
+	})
+}
+
+func TestAllow(t *testing.T) {
+	for name, c := range coordinators(t, Config{}) {
+		t.Run("should count requests across replicas "+name, func(t *testing.T) {
+			ctx := context.Background()
+			for i := 0; i < 3; i++ {
+				decision, err := c[i%2].Allow(ctx, "verify:10.0.0.1", 3, time.Minute)
+				require.NoError(t, err)
+				assert.True(t, decision.Allowed)
+				assert.Equal(t, 2-i, decision.Remaining)
+			}
+
+			decision, err := c[1].Allow(ctx, "verify:10.0.0.1", 3, time.Minute)
+			require.NoError(t, err)
+			assert.False(t, decision.Allowed)
+			assert.Zero(t, decision.Remaining)
+			assert.Greater(t, decision.ResetAfter, time.Duration(0))
+			assert.LessOrEqual(t, decision.ResetAfter, time.Minute)
+
+			decision, err = c[0].Allow(ctx, "verify:10.0.0.2", 3, time.Minute)
+			require.NoError(t, err)
+			assert.True(t, decision.Allowed)
+		})
+	}
+
+	t.Run("should start a new window once the last one ends", func(t *testing.T) {
+		c, err := New("test", Config{})
+		require.NoError(t, err)
+		now := time.Date(2026, 5, 4, 9, 0, 0, 0, time.UTC)
+		c.local.now = func() time.Time { return now }
+
+		for i := 0; i < 2; i++ {
+			_, err := c.Allow(context.Background(), "a", 1, time.Minute)
+			require.NoError(t, err)
+		}
+		now = now.Add(time.Minute)
+		decision, err := c.Allow(context.Background(), "a", 1, time.Minute)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, time.Minute, decision.ResetAfter)
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Run("should answer 429 over the limit", func(t *testing.T) {
+		c, err := New("test", Config{})
+		require.NoError(t, err)
+		handler := c.RateLimit("verify", 2, time.Minute, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		serve := func(addr string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/verify/abc", nil)
+			r.RemoteAddr = addr
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w
+		}
+		assert.Equal(t, http.StatusOK, serve("10.0.0.1:5000").Code)
+		w := serve("10.0.0.1:5001")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+
+		w = serve("10.0.0.1:5002")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "60", w.Header().Get("Retry-After"))
+		assert.JSONEq(t, `{"error": "Rate limit exceeded", "retry_after": 60}`, w.Body.String())
+		assert.Equal(t, http.StatusOK, serve("10.0.0.2:5000").Code)
+	})
+
+	t.Run("should let requests through when Redis fails", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		c, err := New("test", Config{RedisURL: "redis://" + server.Addr()})
+		require.NoError(t, err)
+		defer c.Close()
+		server.Close()
+
+		handler := c.RateLimit("verify", 1, time.Minute, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/verify/abc", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+	})
+
+	t.Run("should be disabled by a limit of 0", func(t *testing.T) {
+		c, err := New("test", Config{})
+		require.NoError(t, err)
+		handler := c.RateLimit("verify", 0, time.Minute, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/verify/abc", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Empty(t, w.Header().Get("X-RateLimit-Limit"))
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package distributed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redsync/redsync/v4"
+)
+
+// ErrLocked is returned when a lock is held by another replica or request
+// for longer than the configured wait
+var ErrLocked = errors.New("lock is held elsewhere")
+
+// lockRetryDelay is how often a held lock is retried while waiting for it
+const lockRetryDelay = 50 * time.Millisecond
+
+// Lock is a held lock
+type Lock struct {
+	name    string
+	mutex   *redsync.Mutex
+	release func()
+	once    sync.Once
+}
+
+// Lock takes the named lock, waiting up to the configured LockWait for it
+// to be released elsewhere. It returns ErrLocked when the wait runs out,
+// and fails, rather than letting the caller in, when Redis is unreachable.
+func (c *Coordinator) Lock(ctx context.Context, name string) (*Lock, error) {
+	if c.sync == nil {
+		return c.local.lock(ctx, name, c.cfg.LockWait)
+	}
+
+	tries := 1 + int(c.cfg.LockWait/lockRetryDelay)
+	mutex := c.sync.NewMutex(c.key("lock", name),
+		redsync.WithExpiry(c.cfg.LockTTL),
+		redsync.WithTries(tries),
+		redsync.WithRetryDelay(lockRetryDelay),
+	)
+	if err := mutex.LockContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var taken *redsync.ErrTaken
+		var nodeTaken *redsync.ErrNodeTaken
+		if errors.Is(err, redsync.ErrFailed) || errors.As(err, &taken) || errors.As(err, &nodeTaken) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("failed to take lock %s: %w", name, err)
+	}
+	return &Lock{name: name, mutex: mutex}, nil
+}
+
+// Unlock releases the lock. Releasing it again does nothing.
+func (l *Lock) Unlock(ctx context.Context) error {
+	var err error
+	l.once.Do(func() {
+		if l.mutex == nil {
+			l.release()
+			return
+		}
+		if ok, unlockErr := l.mutex.UnlockContext(ctx); !ok {
+			err = fmt.Errorf("failed to release lock %s: %v", l.name, unlockErr)
+		}
+	})
+	return err
+}
+
+// Extend resets the lock's TTL. It fails when the lock has expired and may
+// have been taken elsewhere.
+func (l *Lock) Extend(ctx context.Context) error {
+	if l.mutex == nil {
+		return nil
+	}
+	if ok, err := l.mutex.ExtendContext(ctx); !ok {
+		return fmt.Errorf("failed to extend lock %s: %v", l.name, err)
+	}
+	return nil
+}
+
+// WithLock runs fn holding the named lock, extending it while fn runs. The
+// context fn is given is cancelled if the lock is lost.
+func (c *Coordinator) WithLock(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	lock, err := c.Lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Unlock(context.Background()); err != nil {
+			log.Printf("Failed to release lock %s: %v", name, err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if lock.mutex != nil {
+		go func() {
+			ticker := time.NewTicker(c.cfg.LockTTL / 3)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := lock.Extend(ctx); err != nil && ctx.Err() == nil {
+						log.Printf("Lost lock %s: %v", name, err)
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+	return fn(ctx)
+}
+
+// lock takes a lock held within the process
+func (l *local) lock(ctx context.Context, name string, wait time.Duration) (*Lock, error) {
+	var deadline <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		l.mu.Lock()
+		released, held := l.locks[name]
+		if !held {
+			done := make(chan struct{})
+			l.locks[name] = done
+			l.mu.Unlock()
+			return &Lock{name: name, release: func() {
+				l.mu.Lock()
+				delete(l.locks, name)
+				l.mu.Unlock()
+				close(done)
+			}}, nil
+		}
+		l.mu.Unlock()
+
+		if deadline == nil {
+			return nil, ErrLocked
+		}
+		select {
+		case <-released:
+		case <-deadline:
+			return nil, ErrLocked
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
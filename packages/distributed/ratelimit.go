@@ -0,0 +1,129 @@
+package distributed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Decision is the outcome of counting a request against a rate limit
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// ResetAfter is how long until the window, and so the count, resets
+	ResetAfter time.Duration
+}
+
+// windowScript counts a request in a fixed window, starting the window with
+// the first request
+var windowScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl < 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+	ttl = tonumber(ARGV[1])
+end
+return {count, ttl}
+`)
+
+// Allow counts a request against the limit of requests per window for key
+func (c *Coordinator) Allow(ctx context.Context, key string, limit int, window time.Duration) (Decision, error) {
+	var count int
+	var resetAfter time.Duration
+	if c.client == nil {
+		count, resetAfter = c.local.count(key, window)
+	} else {
+		values, err := windowScript.Run(ctx, c.client, []string{c.key("ratelimit", key)}, window.Milliseconds()).Int64Slice()
+		if err != nil {
+			return Decision{}, fmt.Errorf("failed to count request: %w", err)
+		}
+		count, resetAfter = int(values[0]), time.Duration(values[1])*time.Millisecond
+	}
+
+	decision := Decision{Allowed: count <= limit, Limit: limit, Remaining: limit - count, ResetAfter: resetAfter}
+	if decision.Remaining < 0 {
+		decision.Remaining = 0
+	}
+	return decision, nil
+}
+
+// RateLimit answers 429 to clients making more than limit requests per
+// window, counted under name across every replica. key identifies the
+// client, the peer IP address when it is nil. Requests go through when Redis
+// fails, so an outage does not take the routes down with it. A limit of 0
+// or less disables it.
+func (c *Coordinator) RateLimit(name string, limit int, window time.Duration, key func(r *http.Request) string) func(http.Handler) http.Handler {
+	if key == nil {
+		key = ClientIP
+	}
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 || window <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			decision, err := c.Allow(r.Context(), name+":"+key(r), limit, window)
+			if err != nil {
+				log.Printf("Rate limit %s not enforced: %v", name, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+			if !decision.Allowed {
+				retryAfter := int(math.Ceil(decision.ResetAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error":       "Rate limit exceeded",
+					"retry_after": retryAfter,
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClientIP is the peer address of a request without its port
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// count counts a request in the key's window within the process
+func (l *local) count(key string, d time.Duration) (int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	w, ok := l.windows[key]
+	if !ok || !now.Before(w.resetAt) {
+		// Expired windows are dropped once per window length, so the map
+		// does not grow with every client ever seen
+		if now.Sub(l.swept) >= d {
+			for k, old := range l.windows {
+				if !now.Before(old.resetAt) {
+					delete(l.windows, k)
+				}
+			}
+			l.swept = now
+		}
+		w = &window{resetAt: now.Add(d)}
+		l.windows[key] = w
+	}
+	w.count++
+	return w.count, w.resetAt.Sub(now)
+}
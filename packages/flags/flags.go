@@ -0,0 +1,320 @@
+// Package flags rolls risky features out gradually: a flag is on for
+// everyone, for a list of merchants, or for a stable percentage of them, and
+// can be changed at runtime from the environment, a file or a remote
+// service without a deploy.
+//
+//	type Config struct {
+//		Flags flags.Config `config:"flags"`
+//	}
+//
+//	set, err := flags.New(cfg.Flags,
+//		flags.Flag{Name: "pdf_receipts", Description: "Render receipts as PDF", Enabled: true},
+//	)
+//	go set.Run(ctx)
+//	if set.Enabled("pdf_receipts", merchant) {
+//		...
+//	}
+//
+// Unknown flags are off, so code guarded by a flag stays dark until the
+// flag is defined.
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config configures where a service's flags are loaded from. Services embed
+// it in their own config struct, so the settings load like the rest of
+// theirs.
+type Config struct {
+	// File is a JSON file of flags, reread on every refresh
+	File string `config:"file" env:"FEATURE_FLAGS_FILE"`
+	// URL serves flags as JSON, in the same form as File
+	URL string `config:"url" env:"FEATURE_FLAGS_URL" validate:"url"`
+	// Token is sent to URL as a bearer token
+	Token string `config:"token" env:"FEATURE_FLAGS_TOKEN" secret:"true"`
+	// Refresh is how often flags are reloaded
+	Refresh time.Duration `config:"refresh" env:"FEATURE_FLAGS_REFRESH" default:"30s" validate:"min=1s"`
+}
+
+// Flag is a feature and who it is on for
+type Flag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Enabled turns the flag on for everyone
+	Enabled bool `json:"enabled"`
+	// Percentage turns the flag on for this share of merchants, from 0 to
+	// 100. A merchant stays in or out as long as the percentage does not
+	// drop below its bucket, so raising it only adds merchants.
+	Percentage float64 `json:"percentage,omitempty"`
+	// Merchants the flag is on for whatever the percentage
+	Merchants []string `json:"merchants,omitempty"`
+	// Source is the provider the flag was last set by, or "default"
+	Source string `json:"source"`
+}
+
+// EnabledFor reports whether f is on for merchant. Without a merchant only
+// flags enabled for everyone are on.
+func (f Flag) EnabledFor(merchant string) bool {
+	if f.Enabled {
+		return true
+	}
+	merchant = strings.ToLower(strings.TrimSpace(merchant))
+	if merchant == "" {
+		return false
+	}
+	for _, m := range f.Merchants {
+		if m == merchant {
+			return true
+		}
+	}
+	return f.Percentage > 0 && float64(bucket(f.Name, merchant)) < f.Percentage*100
+}
+
+// bucket places a merchant in one of 10000 buckets of a flag. Hashing the
+// flag name too spreads the merchants of each flag differently, so the
+// same merchants are not first in line for every rollout.
+func bucket(name, merchant string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name + "/" + merchant))
+	return h.Sum32() % 10000
+}
+
+// normalize validates f and lowercases its name and merchants, so they
+// match however they were written
+func (f *Flag) normalize() error {
+	f.Name = strings.ToLower(strings.TrimSpace(f.Name))
+	if f.Name == "" {
+		return errors.New("flag name is required")
+	}
+	if f.Percentage < 0 || f.Percentage > 100 {
+		return fmt.Errorf("flag %s: percentage must be between 0 and 100, got %g", f.Name, f.Percentage)
+	}
+	merchants := make([]string, 0, len(f.Merchants))
+	for _, m := range f.Merchants {
+		if m = strings.ToLower(strings.TrimSpace(m)); m != "" {
+			merchants = append(merchants, m)
+		}
+	}
+	f.Merchants = merchants
+	return nil
+}
+
+// Provider loads flags from a source, keyed by name
+type Provider interface {
+	Name() string
+	Load(ctx context.Context) (map[string]Flag, error)
+}
+
+// ProviderStatus is how a provider's last load went
+type ProviderStatus struct {
+	Name     string    `json:"name"`
+	LoadedAt time.Time `json:"loaded_at,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Status is the flags of a set and where they came from
+type Status struct {
+	Flags       []Flag           `json:"flags"`
+	Providers   []ProviderStatus `json:"providers"`
+	RefreshedAt time.Time        `json:"refreshed_at"`
+}
+
+// Set is a service's flags: its defaults overridden by its providers, in
+// order. A provider sets whole flags, so a flag it defines replaces the
+// default rather than merging with it.
+type Set struct {
+	defaults  map[string]Flag
+	providers []Provider
+	refresh   time.Duration
+
+	mutex     sync.RWMutex
+	loaded    []map[string]Flag
+	statuses  []ProviderStatus
+	flags     map[string]Flag
+	refreshed time.Time
+}
+
+// New returns the flags of a service, loaded from the file and URL of cfg
+// and FLAG_<NAME> environment variables, in that order of precedence from
+// lowest to highest. It fails when a configured provider cannot be loaded,
+// so a service does not start with flags other than those it was given.
+func New(cfg Config, defaults ...Flag) (*Set, error) {
+	var providers []Provider
+	if cfg.File != "" {
+		providers = append(providers, &File{Path: cfg.File})
+	}
+	if cfg.URL != "" {
+		providers = append(providers, &Remote{URL: cfg.URL, Token: cfg.Token})
+	}
+	providers = append(providers, &Env{Prefix: EnvPrefix})
+
+	s, err := NewSet(defaults, providers...)
+	if err != nil {
+		return nil, err
+	}
+	s.refresh = cfg.Refresh
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSet returns a set of defaults overridden by providers, in order. Its
+// flags are the defaults until it is refreshed.
+func NewSet(defaults []Flag, providers ...Provider) (*Set, error) {
+	s := &Set{
+		defaults:  make(map[string]Flag, len(defaults)),
+		providers: providers,
+		refresh:   30 * time.Second,
+		loaded:    make([]map[string]Flag, len(providers)),
+		statuses:  make([]ProviderStatus, len(providers)),
+	}
+	for _, f := range defaults {
+		if err := f.normalize(); err != nil {
+			return nil, fmt.Errorf("flags: %w", err)
+		}
+		f.Source = "default"
+		s.defaults[f.Name] = f
+	}
+	for i, p := range providers {
+		s.statuses[i].Name = p.Name()
+	}
+	s.flags = s.merge()
+	return s, nil
+}
+
+// Refresh reloads every provider. A provider that fails keeps the flags it
+// last loaded, so an unreachable flag service does not flip features back
+// to their defaults.
+func (s *Set) Refresh(ctx context.Context) error {
+	results := make([]map[string]Flag, len(s.providers))
+	failures := make([]error, len(s.providers))
+	for i, p := range s.providers {
+		results[i], failures[i] = p.Load(ctx)
+	}
+
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var errs []error
+	for i, p := range s.providers {
+		if failures[i] != nil {
+			s.statuses[i].Error = failures[i].Error()
+			errs = append(errs, fmt.Errorf("flags: %s: %w", p.Name(), failures[i]))
+			continue
+		}
+		s.loaded[i] = results[i]
+		s.statuses[i] = ProviderStatus{Name: p.Name(), LoadedAt: now}
+	}
+	s.flags = s.merge()
+	s.refreshed = now
+	return errors.Join(errs...)
+}
+
+// merge layers the loaded flags over the defaults. Callers hold the mutex
+// or own s.
+func (s *Set) merge() map[string]Flag {
+	flags := make(map[string]Flag, len(s.defaults))
+	for name, f := range s.defaults {
+		flags[name] = f
+	}
+	for i, loaded := range s.loaded {
+		for name, f := range loaded {
+			if f.Description == "" {
+				f.Description = s.defaults[name].Description
+			}
+			f.Name = name
+			f.Source = s.providers[i].Name()
+			flags[name] = f
+		}
+	}
+	return flags
+}
+
+// Run refreshes the flags every Config.Refresh until ctx is done
+func (s *Set) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Refresh(ctx); err != nil {
+				log.Printf("Failed to refresh feature flags: %v", err)
+			}
+		}
+	}
+}
+
+// Enabled reports whether the flag name is on for merchant, which may be
+// empty. Unknown flags are off.
+func (s *Set) Enabled(name, merchant string) bool {
+	s.mutex.RLock()
+	f, ok := s.flags[strings.ToLower(name)]
+	s.mutex.RUnlock()
+	return ok && f.EnabledFor(merchant)
+}
+
+// Lookup returns the flag name as it stands
+func (s *Set) Lookup(name string) (Flag, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	f, ok := s.flags[strings.ToLower(name)]
+	return f, ok
+}
+
+// Status returns every flag, sorted by name, and how its providers last
+// loaded, for health checks
+func (s *Set) Status() Status {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	status := Status{
+		Flags:       make([]Flag, 0, len(s.flags)),
+		Providers:   append([]ProviderStatus{}, s.statuses...),
+		RefreshedAt: s.refreshed,
+	}
+	for _, f := range s.flags {
+		status.Flags = append(status.Flags, f)
+	}
+	sort.Slice(status.Flags, func(i, j int) bool { return status.Flags[i].Name < status.Flags[j].Name })
+	return status
+}
+
+// Handler serves the status of the flags as JSON, and with a merchant
+// query parameter, which flags are on for that merchant
+func (s *Set) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+			return
+		}
+		status := s.Status()
+		merchant := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("merchant")))
+		enabled := make(map[string]bool, len(status.Flags))
+		for _, f := range status.Flags {
+			enabled[f.Name] = f.EnabledFor(merchant)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Status
+			Merchant string          `json:"merchant,omitempty"`
+			Enabled  map[string]bool `json:"enabled"`
+		}{status, merchant, enabled})
+	}
+}
@@ -0,0 +1,191 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// static is a provider whose flags or error tests set
+type static struct {
+	flags map[string]Flag
+	err   error
+}
+
+func (s *static) Name() string { return "static" }
+
+func (s *static) Load(context.Context) (map[string]Flag, error) {
+	return s.flags, s.err
+}
+
+func TestFlag(t *testing.T) {
+	t.Run("should be on for listed merchants whatever their case", func(t *testing.T) {
+		f := Flag{Name: "pdf_receipts", Merchants: []string{"0xABC"}}
+		require.NoError(t, f.normalize())
+		assert.True(t, f.EnabledFor("0xabc"))
+		assert.True(t, f.EnabledFor(" 0xAbC "))
+		assert.False(t, f.EnabledFor("0xdef"))
+		assert.False(t, f.EnabledFor(""))
+	})
+
+	t.Run("should roll out to a stable share of merchants", func(t *testing.T) {
+		f := Flag{Name: "pdf_receipts", Percentage: 25}
+		on := 0
+		for i := 0; i < 4000; i++ {
+			merchant := fmt.Sprintf("0x%040x", i)
+			if f.EnabledFor(merchant) {
+				on++
+				// Raising the percentage keeps the merchants already in
+				assert.True(t, Flag{Name: "pdf_receipts", Percentage: 50}.EnabledFor(merchant))
+			}
+			assert.Equal(t, f.EnabledFor(merchant), f.EnabledFor(merchant))
+		}
+		assert.InDelta(t, 1000, on, 100)
+		assert.True(t, Flag{Name: "pdf_receipts", Percentage: 100}.EnabledFor("0xabc"))
+		assert.False(t, Flag{Name: "pdf_receipts", Percentage: 100}.EnabledFor(""))
+	})
+
+	t.Run("should reject percentages out of range", func(t *testing.T) {
+		f := Flag{Name: "pdf_receipts", Percentage: 101}
+		assert.Error(t, f.normalize())
+		f = Flag{Name: " ", Enabled: true}
+		assert.Error(t, f.normalize())
+	})
+}
+
+func TestParseFlag(t *testing.T) {
+	t.Run("should read switches, percentages and merchants", func(t *testing.T) {
+		f, err := ParseFlag("PDF_RECEIPTS", "10%, 0xABC,0xdef")
+		require.NoError(t, err)
+		assert.Equal(t, Flag{Name: "pdf_receipts", Percentage: 10, Merchants: []string{"0xabc", "0xdef"}}, f)
+
+		f, err = ParseFlag("PDF_RECEIPTS", "on")
+		require.NoError(t, err)
+		assert.True(t, f.Enabled)
+
+		f, err = ParseFlag("PDF_RECEIPTS", "off")
+		require.NoError(t, err)
+		assert.False(t, f.EnabledFor("0xabc"))
+	})
+
+	t.Run("should reject invalid percentages", func(t *testing.T) {
+		_, err := ParseFlag("pdf_receipts", "lots%")
+		assert.Error(t, err)
+		_, err = ParseFlag("pdf_receipts", "150%")
+		assert.Error(t, err)
+	})
+}
+
+func TestSet(t *testing.T) {
+	defaults := []Flag{
+		{Name: "pdf_receipts", Description: "Render receipts as PDF", Enabled: true},
+		{Name: "fdc_payment_webhook", Description: "Create FDC proofs of payments"},
+	}
+
+	t.Run("should layer providers over the defaults in order", func(t *testing.T) {
+		first := &static{flags: map[string]Flag{
+			"pdf_receipts":        {Name: "pdf_receipts", Merchants: []string{"0xabc"}},
+			"fdc_payment_webhook": {Name: "fdc_payment_webhook", Enabled: true},
+		}}
+		second := &static{flags: map[string]Flag{
+			"fdc_payment_webhook": {Name: "fdc_payment_webhook"},
+		}}
+		set, err := NewSet(defaults, first, second)
+		require.NoError(t, err)
+		assert.True(t, set.Enabled("pdf_receipts", "0xdef"))
+		assert.False(t, set.Enabled("fdc_payment_webhook", "0xdef"))
+
+		require.NoError(t, set.Refresh(context.Background()))
+		assert.False(t, set.Enabled("pdf_receipts", "0xdef"))
+		assert.True(t, set.Enabled("PDF_RECEIPTS", "0xABC"))
+		assert.False(t, set.Enabled("fdc_payment_webhook", "0xabc"))
+		assert.False(t, set.Enabled("bridge_adapter", "0xabc"))
+
+		f, ok := set.Lookup("pdf_receipts")
+		require.True(t, ok)
+		assert.Equal(t, "Render receipts as PDF", f.Description)
+		assert.Equal(t, "static", f.Source)
+	})
+
+	t.Run("should keep the last good flags of a failing provider", func(t *testing.T) {
+		provider := &static{flags: map[string]Flag{"pdf_receipts": {Name: "pdf_receipts"}}}
+		set, err := NewSet(defaults, provider)
+		require.NoError(t, err)
+		require.NoError(t, set.Refresh(context.Background()))
+
+		provider.err = errors.New("connection refused")
+		err = set.Refresh(context.Background())
+		assert.ErrorContains(t, err, "flags: static: connection refused")
+		assert.False(t, set.Enabled("pdf_receipts", "0xabc"))
+
+		status := set.Status()
+		require.Len(t, status.Providers, 1)
+		assert.Equal(t, "connection refused", status.Providers[0].Error)
+		assert.False(t, status.Providers[0].LoadedAt.IsZero())
+		require.Len(t, status.Flags, 2)
+		assert.Equal(t, "fdc_payment_webhook", status.Flags[0].Name)
+		assert.Equal(t, "default", status.Flags[0].Source)
+	})
+
+	t.Run("should load from a file, a flag service and the environment", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "flags.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"pdf_receipts": {"percentage": 0, "merchants": ["0xABC"]}}`), 0o600))
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+			w.Write([]byte(`{"fdc_payment_webhook": {"merchants": ["0xdef"]}}`))
+		}))
+		defer server.Close()
+		t.Setenv("FLAG_BRIDGE_ADAPTER", "on")
+
+		set, err := New(Config{File: path, URL: server.URL, Token: "secret"}, defaults...)
+		require.NoError(t, err)
+		assert.True(t, set.Enabled("pdf_receipts", "0xabc"))
+		assert.False(t, set.Enabled("pdf_receipts", "0xdef"))
+		assert.True(t, set.Enabled("fdc_payment_webhook", "0xdef"))
+		assert.True(t, set.Enabled("bridge_adapter", ""))
+
+		bridge, _ := set.Lookup("bridge_adapter")
+		assert.Equal(t, "env", bridge.Source)
+	})
+
+	t.Run("should fail to start on a broken provider", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "flags.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"pdf_receipts": {"percentage": 200}}`), 0o600))
+		_, err := New(Config{File: path}, defaults...)
+		assert.ErrorContains(t, err, "percentage must be between 0 and 100")
+
+		_, err = New(Config{File: filepath.Join(t.TempDir(), "missing.json")}, defaults...)
+		assert.Error(t, err)
+	})
+
+	t.Run("should serve which flags are on for a merchant", func(t *testing.T) {
+		set, err := NewSet(append(defaults, Flag{Name: "bridge_adapter", Merchants: []string{"0xabc"}}))
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		set.Handler()(recorder, httptest.NewRequest(http.MethodGet, "/flags?merchant=0xABC", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var body struct {
+			Flags    []Flag          `json:"flags"`
+			Merchant string          `json:"merchant"`
+			Enabled  map[string]bool `json:"enabled"`
+		}
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(&body))
+		assert.Len(t, body.Flags, 3)
+		assert.Equal(t, "0xabc", body.Merchant)
+		assert.Equal(t, map[string]bool{"pdf_receipts": true, "fdc_payment_webhook": false, "bridge_adapter": true}, body.Enabled)
+
+		recorder = httptest.NewRecorder()
+		set.Handler()(recorder, httptest.NewRequest(http.MethodPost, "/flags", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	})
+}
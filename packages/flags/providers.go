@@ -0,0 +1,153 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the environment variables Env reads flags from
+const EnvPrefix = "FLAG_"
+
+// Env loads flags from environment variables named Prefix and the flag's
+// name, such as FLAG_PDF_RECEIPTS for pdf_receipts. A value is a comma
+// separated list of on or off, a percentage of merchants and the merchants
+// the flag is on for:
+//
+//	FLAG_PDF_RECEIPTS=off
+//	FLAG_FDC_PAYMENT_WEBHOOK=10%,0x5fbdb2315678afecb367f032d93f642f64180aa3
+type Env struct {
+	Prefix string
+}
+
+func (e *Env) Name() string { return "env" }
+
+// Load reads the flags set in the environment
+func (e *Env) Load(context.Context) (map[string]Flag, error) {
+	flags := make(map[string]Flag)
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		name, ok := strings.CutPrefix(key, e.Prefix)
+		if !ok || name == "" {
+			continue
+		}
+		f, err := ParseFlag(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		flags[f.Name] = f
+	}
+	return flags, nil
+}
+
+// ParseFlag reads a flag written as an Env value
+func ParseFlag(name, value string) (Flag, error) {
+	f := Flag{Name: name}
+	for _, term := range strings.Split(value, ",") {
+		term = strings.TrimSpace(term)
+		switch strings.ToLower(term) {
+		case "":
+		case "on", "true", "1":
+			f.Enabled = true
+		case "off", "false", "0":
+			f.Enabled = false
+		default:
+			if percentage, ok := strings.CutSuffix(term, "%"); ok {
+				p, err := strconv.ParseFloat(percentage, 64)
+				if err != nil {
+					return Flag{}, fmt.Errorf("invalid percentage %q", term)
+				}
+				f.Percentage = p
+				continue
+			}
+			f.Merchants = append(f.Merchants, term)
+		}
+	}
+	if err := f.normalize(); err != nil {
+		return Flag{}, err
+	}
+	return f, nil
+}
+
+// File loads flags from a JSON object of flags keyed by name, reread on
+// every load so edits apply without a restart:
+//
+//	{
+//		"pdf_receipts": {"percentage": 25, "merchants": ["0x5fbd..."]},
+//		"fdc_payment_webhook": {"enabled": true}
+//	}
+type File struct {
+	Path string
+}
+
+func (f *File) Name() string { return "file" }
+
+// Load reads the file
+func (f *File) Load(context.Context) (map[string]Flag, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return decodeFlags(file)
+}
+
+// Remote loads flags from a flag service answering GET URL with the JSON
+// of File
+type Remote struct {
+	URL string
+	// Token is sent as a bearer token when set
+	Token string
+	// Client makes the requests; nil uses http.DefaultClient. Loads are
+	// bounded by the context Refresh is given.
+	Client *http.Client
+}
+
+func (r *Remote) Name() string { return "remote" }
+
+// Load fetches the flags
+func (r *Remote) Load(ctx context.Context) (map[string]Flag, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("flag service returned %s", resp.Status)
+	}
+	return decodeFlags(io.LimitReader(resp.Body, 1<<20))
+}
+
+// decodeFlags reads a JSON object of flags keyed by name
+func decodeFlags(r io.Reader) (map[string]Flag, error) {
+	var raw map[string]Flag
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid flags: %w", err)
+	}
+	flags := make(map[string]Flag, len(raw))
+	for name, f := range raw {
+		f.Name = name
+		if err := f.normalize(); err != nil {
+			return nil, err
+		}
+		flags[f.Name] = f
+	}
+	return flags, nil
+}
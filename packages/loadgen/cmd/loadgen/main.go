@@ -0,0 +1,144 @@
+// Command loadgen sends synthetic or recorded load to a service and reports
+// latency percentiles:
+//
+//	go run ./cmd/loadgen -target http://localhost:8080 -scenario relay -rate 200 -duration 1m
+//	go run ./cmd/loadgen -target http://localhost:8084 -scenario analytics -rate 500 -amount uniform:1000-5000000 -record traffic.jsonl
+//	go run ./cmd/loadgen -target http://localhost:8084 -replay traffic.jsonl -speed 4
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/loadgen"
+)
+
+// headers collects repeated -header flags
+type headers http.Header
+
+func (h headers) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headers) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("want Name: value, got %q", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(key), strings.TrimSpace(val))
+	return nil
+}
+
+func main() {
+	target := flag.String("target", "", "base URL of the service under load")
+	scenario := flag.String("scenario", "", "synthetic load to send: "+strings.Join(loadgen.Scenarios, ", "))
+	replay := flag.String("replay", "", "recording to replay instead of synthetic load")
+	speed := flag.Float64("speed", 1, "replay speed, 2 replays twice as fast as recorded")
+	loops := flag.Int("loops", 1, "how many times to replay the recording")
+	rate := flag.Float64("rate", 0, "requests per second; required for synthetic load, and overrides the recorded pace of a replay")
+	poisson := flag.Bool("poisson", false, "space requests as independent arrivals instead of evenly")
+	duration := flag.Duration("duration", 0, "how long to run; 0 runs until -requests are sent or the replay ends")
+	requests := flag.Int("requests", 0, "how many synthetic requests to send; 0 sends until -duration")
+	concurrency := flag.Int("concurrency", loadgen.DefaultConcurrency, "most requests in flight")
+	timeout := flag.Duration("timeout", loadgen.DefaultTimeout, "how long a request may take")
+	amount := flag.String("amount", "lognormal:100000000,1.5", "distribution of payment amounts: fixed:N, uniform:MIN-MAX or lognormal:MEDIAN,SIGMA")
+	highValue := flag.Float64("high-value", 1e10, "amount from which payments are high value")
+	private := flag.Float64("private", 0.1, "share of payments that are private")
+	statuses := flag.String("statuses", loadgen.DefaultStatuses, "weights of payment metric statuses")
+	chainID := flag.Uint64("chain-id", 31337, "chain payments are on")
+	seed := flag.Int64("seed", 0, "seed of the synthetic payloads, so runs can be repeated; 0 picks one")
+	record := flag.String("record", "", "file to record the requests sent to, for replaying")
+	jsonReport := flag.Bool("json", false, "print the report as JSON")
+	header := headers{}
+	flag.Var(header, "header", "header to send with every request, as Name: value; repeatable")
+	flag.Parse()
+
+	if *target == "" || (*scenario == "") == (*replay == "") {
+		flag.Usage()
+		log.Fatal("-target and one of -scenario or -replay are required")
+	}
+
+	var source loadgen.Source
+	if *replay != "" {
+		file, err := os.Open(*replay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recorded, err := loadgen.ReadRecording(file)
+		file.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		source = loadgen.NewReplay(recorded, *speed, *loops)
+	} else {
+		if *rate <= 0 {
+			log.Fatal("-rate is required for synthetic load")
+		}
+		if *duration == 0 && *requests == 0 {
+			log.Fatal("-duration or -requests is required for synthetic load")
+		}
+		if *seed == 0 {
+			*seed = time.Now().UnixNano()
+		}
+		synthetic, err := loadgen.NewSynthetic(*scenario, *seed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if synthetic.Amount, err = loadgen.ParseDistribution(*amount); err != nil {
+			log.Fatal(err)
+		}
+		if synthetic.Statuses, err = loadgen.ParseWeights(*statuses); err != nil {
+			log.Fatal(err)
+		}
+		synthetic.HighValue = *highValue
+		synthetic.PrivateRatio = *private
+		synthetic.ChainID = *chainID
+		synthetic.Requests = *requests
+		source = synthetic
+	}
+
+	cfg := loadgen.Config{
+		Target:      *target,
+		Header:      http.Header(header),
+		Rate:        *rate,
+		Poisson:     *poisson,
+		Duration:    *duration,
+		Concurrency: *concurrency,
+		Timeout:     *timeout,
+	}
+	if *record != "" {
+		file, err := os.Create(*record)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		cfg.Record = file
+	}
+
+	// Interrupting stops sending and reports the requests sent so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := loadgen.Run(ctx, cfg, source)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *jsonReport {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,207 @@
+// Package loadgen sends load to a service, synthetic or replayed from
+// recorded traffic, and reports the latency of its answers, for capacity
+// planning of the relay network and the analytics pipeline. Load is open
+// loop: requests are sent on schedule whether or not earlier ones were
+// answered, and latency is measured from when a request was due, so a
+// target that falls behind shows in the percentiles instead of slowing the
+// load down.
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request is a request to send, at Offset from the start of the run
+type Request struct {
+	Offset time.Duration   `json:"-"`
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Source yields the requests of a run in order, returning false once it has
+// none left
+type Source interface {
+	Next() (Request, bool)
+}
+
+// Config is a load test run
+type Config struct {
+	// Target is the base URL of the service under load
+	Target string
+	// Header is added to every request, such as an Authorization header
+	Header http.Header
+	// Rate paces requests at this many per second. Zero sends each request
+	// at its Offset, as replays do.
+	Rate float64
+	// Poisson spaces paced requests by exponential gaps averaging 1/Rate,
+	// as independent clients arrive, instead of evenly
+	Poisson bool
+	// Duration ends the run early; zero runs until the source is exhausted
+	Duration time.Duration
+	// Concurrency is the most requests in flight. A request due while that
+	// many are in flight waits, and its wait counts towards its latency.
+	Concurrency int
+	// Timeout is how long a request may take
+	Timeout time.Duration
+	// Record, when set, is written every request sent, so the run can be
+	// replayed
+	Record io.Writer
+	// Client sends the requests; nil uses a client sized for Concurrency
+	Client *http.Client
+}
+
+// Defaults of a Config
+const (
+	DefaultConcurrency = 64
+	DefaultTimeout     = 10 * time.Second
+)
+
+// ErrNoTarget is returned by Run without a target
+var ErrNoTarget = errors.New("loadgen: target is required")
+
+// Run sends the requests of source to the target until source is exhausted,
+// cfg.Duration passes or ctx is done, and reports their latencies
+func Run(ctx context.Context, cfg Config, source Source) (*Report, error) {
+	if cfg.Target == "" {
+		return nil, ErrNoTarget
+	}
+	if cfg.Rate < 0 {
+		return nil, fmt.Errorf("loadgen: rate must not be negative, got %g", cfg.Rate)
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DefaultConcurrency
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Transport: &http.Transport{
+			MaxIdleConns:        cfg.Concurrency,
+			MaxIdleConnsPerHost: cfg.Concurrency,
+		}}
+	}
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	var recorder *Recorder
+	if cfg.Record != nil {
+		recorder = NewRecorder(cfg.Record)
+	}
+
+	target := strings.TrimRight(cfg.Target, "/")
+	collector := newCollector()
+	slots := make(chan struct{}, cfg.Concurrency)
+	var wg sync.WaitGroup
+	var recordErr error
+	arrivals := rand.New(rand.NewSource(time.Now().UnixNano()))
+	start := time.Now()
+	paced := time.Duration(0)
+
+	for {
+		req, ok := source.Next()
+		if !ok {
+			break
+		}
+		offset := req.Offset
+		if cfg.Rate > 0 {
+			offset = paced
+			gap := 1 / cfg.Rate
+			if cfg.Poisson {
+				gap = arrivals.ExpFloat64() / cfg.Rate
+			}
+			paced += time.Duration(gap * float64(time.Second))
+		}
+		due := start.Add(offset)
+		if !sleepUntil(ctx, due) {
+			break
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if recorder != nil {
+			req.Offset = offset
+			if recordErr = recorder.Write(req); recordErr != nil {
+				<-slots
+				break
+			}
+		}
+
+		wg.Add(1)
+		go func(req Request, due time.Time) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			status, err := send(client, target, cfg.Header, cfg.Timeout, req)
+			collector.add(req, status, err, time.Since(due))
+		}(req, due)
+	}
+	wg.Wait()
+	if recordErr != nil {
+		return nil, recordErr
+	}
+	return collector.report(time.Since(start)), nil
+}
+
+// sleepUntil waits for due, reporting false when ctx is done first
+func sleepUntil(ctx context.Context, due time.Time) bool {
+	wait := time.Until(due)
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// send sends req and reads its answer, returning the answer's status
+func send(client *http.Client, target string, header http.Header, timeout time.Duration, req Request) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var body io.Reader
+	if len(req.Body) > 0 {
+		body = bytes.NewReader(req.Body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, target+req.Path, body)
+	if err != nil {
+		return 0, err
+	}
+	for key, values := range header {
+		httpReq.Header[key] = values
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,236 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	t.Run("should send every request and report by endpoint", func(t *testing.T) {
+		var received atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received.Add(1)
+			assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+
+		requests := []Request{
+			{Method: "POST", Path: "/validate", Body: json.RawMessage(`{"payment_id":1}`)},
+			{Method: "POST", Path: "/validate", Body: json.RawMessage(`{"payment_id":2}`)},
+			{Method: "GET", Path: "/missing"},
+		}
+		var recording bytes.Buffer
+		report, err := Run(context.Background(), Config{
+			Target: server.URL,
+			Header: http.Header{"Authorization": {"Bearer token"}},
+			Rate:   1000,
+			Record: &recording,
+		}, NewReplay(requests, 1, 2))
+		require.NoError(t, err)
+
+		assert.EqualValues(t, 6, received.Load())
+		assert.Equal(t, 6, report.Total.Requests)
+		assert.Equal(t, 2, report.Total.Failures)
+		assert.Equal(t, map[string]int{"200": 4, "404": 2}, report.Total.Statuses)
+		require.Len(t, report.Endpoints, 2)
+		assert.Equal(t, "GET /missing", report.Endpoints[0].Endpoint)
+		assert.Equal(t, 4, report.Endpoints[1].Requests)
+		assert.Positive(t, report.Total.Latency.Max)
+
+		recorded, err := ReadRecording(&recording)
+		require.NoError(t, err)
+		require.Len(t, recorded, 6)
+		assert.JSONEq(t, `{"payment_id":2}`, string(recorded[1].Body))
+		assert.Equal(t, 5*time.Millisecond, recorded[5].Offset)
+	})
+
+	t.Run("should stop after the duration", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		synthetic, err := NewSynthetic(ScenarioRelay, 1)
+		require.NoError(t, err)
+		started := time.Now()
+		report, err := Run(context.Background(), Config{Target: server.URL, Rate: 100, Duration: 200 * time.Millisecond}, synthetic)
+		require.NoError(t, err)
+
+		assert.Less(t, time.Since(started), 2*time.Second)
+		assert.InDelta(t, 20, report.Total.Requests, 5)
+	})
+
+	t.Run("should count unanswered requests as failures", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.Close()
+
+		report, err := Run(context.Background(), Config{Target: server.URL}, NewReplay([]Request{{Method: "GET", Path: "/status"}}, 1, 1))
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Total.Failures)
+		assert.Equal(t, map[string]int{"error": 1}, report.Total.Statuses)
+	})
+
+	t.Run("should require a target", func(t *testing.T) {
+		_, err := Run(context.Background(), Config{}, NewReplay(nil, 1, 1))
+		assert.ErrorIs(t, err, ErrNoTarget)
+	})
+}
+
+func TestPercentiles(t *testing.T) {
+	t.Run("should summarize latencies by nearest rank", func(t *testing.T) {
+		latencies := make([]time.Duration, 100)
+		for i := range latencies {
+			latencies[len(latencies)-1-i] = time.Duration(i+1) * time.Millisecond
+		}
+		p := NewPercentiles(latencies)
+		assert.Equal(t, Percentiles{Min: 1, Mean: 50.5, P50: 50, P90: 90, P95: 95, P99: 99, Max: 100}, p)
+		assert.Equal(t, Percentiles{}, NewPercentiles(nil))
+	})
+
+	t.Run("should write a table with a total", func(t *testing.T) {
+		report := &Report{
+			Elapsed:   time.Second,
+			Endpoints: []Stats{{Endpoint: "POST /validate", Requests: 10}},
+			Total:     Stats{Endpoint: "total", Requests: 10, Statuses: map[string]int{"200": 10}},
+		}
+		var out strings.Builder
+		require.NoError(t, report.WriteText(&out))
+		assert.Contains(t, out.String(), "POST /validate")
+		assert.Contains(t, out.String(), "10 requests in 1s")
+	})
+}
+
+func TestSynthetic(t *testing.T) {
+	t.Run("should generate relay validation requests", func(t *testing.T) {
+		synthetic, err := NewSynthetic(ScenarioRelay, 7)
+		require.NoError(t, err)
+		synthetic.Amount = Distribution{Kind: DistributionFixed, A: 2e10}
+		synthetic.Requests = 2
+
+		first, ok := synthetic.Next()
+		require.True(t, ok)
+		assert.Equal(t, "/validate", first.Path)
+		var payload struct {
+			PaymentID    uint64 `json:"payment_id"`
+			MessageHash  string `json:"message_hash"`
+			RequiredSigs int    `json:"required_signatures"`
+			IsHighValue  bool   `json:"is_high_value"`
+		}
+		require.NoError(t, json.Unmarshal(first.Body, &payload))
+		assert.Len(t, payload.MessageHash, 66)
+		assert.True(t, payload.IsHighValue)
+		assert.Equal(t, 3, payload.RequiredSigs)
+
+		second, _ := synthetic.Next()
+		require.NoError(t, json.Unmarshal(second.Body, &payload))
+		_, ok = synthetic.Next()
+		assert.False(t, ok)
+	})
+
+	t.Run("should generate payment metrics the analytics schema accepts", func(t *testing.T) {
+		synthetic, err := NewSynthetic(ScenarioAnalytics, 7)
+		require.NoError(t, err)
+		synthetic.Statuses, err = ParseWeights("failed=1")
+		require.NoError(t, err)
+
+		req, ok := synthetic.Next()
+		require.True(t, ok)
+		assert.Equal(t, "/api/metrics/payment", req.Path)
+		var metric map[string]interface{}
+		require.NoError(t, json.Unmarshal(req.Body, &metric))
+		assert.Equal(t, "failed", metric["status"])
+		assert.EqualValues(t, 31337, metric["chain_id"])
+		assert.Regexp(t, `^0x[0-9a-f]{40}$`, metric["sender"])
+		assert.Regexp(t, `^[1-9][0-9]*$`, metric["amount"])
+		_, err = time.Parse(time.RFC3339Nano, metric["timestamp"].(string))
+		assert.NoError(t, err)
+	})
+
+	t.Run("should repeat payloads from the same seed", func(t *testing.T) {
+		first, _ := NewSynthetic(ScenarioRelay, 42)
+		second, _ := NewSynthetic(ScenarioRelay, 42)
+		a, _ := first.Next()
+		b, _ := second.Next()
+		assert.Equal(t, a, b)
+	})
+
+	t.Run("should reject unknown scenarios", func(t *testing.T) {
+		_, err := NewSynthetic("indexer", 1)
+		assert.Error(t, err)
+	})
+}
+
+func TestDistribution(t *testing.T) {
+	t.Run("should parse distributions back from their form", func(t *testing.T) {
+		for _, s := range []string{"fixed:1000", "uniform:1000-5000000", "lognormal:100000000,1.5"} {
+			d, err := ParseDistribution(s)
+			require.NoError(t, err)
+			assert.Equal(t, s, d.String())
+		}
+		for _, s := range []string{"", "normal:1,2", "fixed:x", "uniform:5-1", "lognormal:0,1", "uniform:1"} {
+			_, err := ParseDistribution(s)
+			assert.Error(t, err, s)
+		}
+	})
+
+	t.Run("should sample within bounds", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(1))
+		uniform := Distribution{Kind: DistributionUniform, A: 10, B: 20}
+		for i := 0; i < 1000; i++ {
+			v := uniform.Sample(rng)
+			assert.True(t, v >= 10 && v <= 20)
+		}
+		assert.Equal(t, 5.0, Distribution{Kind: DistributionFixed, A: 5}.Sample(rng))
+	})
+
+	t.Run("should pick weighted values in proportion", func(t *testing.T) {
+		weights, err := ParseWeights("completed=3,failed=1")
+		require.NoError(t, err)
+		assert.Equal(t, "completed=3,failed=1", weights.String())
+
+		rng := rand.New(rand.NewSource(1))
+		counts := map[string]int{}
+		for i := 0; i < 4000; i++ {
+			counts[weights.Pick(rng)]++
+		}
+		assert.InDelta(t, 3000, counts["completed"], 150)
+
+		_, err = ParseWeights("completed=0")
+		assert.Error(t, err)
+		_, err = ParseWeights("completed")
+		assert.Error(t, err)
+	})
+}
+
+func TestReplay(t *testing.T) {
+	t.Run("should replay at speed and loop after a mean gap", func(t *testing.T) {
+		replay := NewReplay([]Request{
+			{Method: "GET", Path: "/a", Offset: 0},
+			{Method: "GET", Path: "/b", Offset: 100 * time.Millisecond},
+		}, 2, 2)
+		var offsets []time.Duration
+		for req, ok := replay.Next(); ok; req, ok = replay.Next() {
+			offsets = append(offsets, req.Offset)
+		}
+		assert.Equal(t, []time.Duration{0, 50 * time.Millisecond, 100 * time.Millisecond, 150 * time.Millisecond}, offsets)
+	})
+
+	t.Run("should reject malformed recordings", func(t *testing.T) {
+		_, err := ReadRecording(strings.NewReader("{\"offset_ms\":1,\"method\":\"GET\",\"path\":\"/a\"}\n\nnot json\n"))
+		assert.ErrorContains(t, err, "line 3")
+		_, err = ReadRecording(strings.NewReader(`{"offset_ms":1,"path":"/a"}`))
+		assert.ErrorContains(t, err, "method and path are required")
+	})
+}
@@ -0,0 +1,117 @@
+package loadgen
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// recorded is a line of a recording: a request and when it was sent, in
+// milliseconds from the start of the run
+type recorded struct {
+	OffsetMS float64 `json:"offset_ms"`
+	Request
+}
+
+// Recorder writes requests as a recording, one JSON object per line:
+//
+//	{"offset_ms":12.5,"method":"POST","path":"/validate","body":{"payment_id":7}}
+type Recorder struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewRecorder returns a recorder writing to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{encoder: json.NewEncoder(w)}
+}
+
+// Write records req
+func (r *Recorder) Write(req Request) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	line := recorded{OffsetMS: float64(req.Offset) / float64(time.Millisecond), Request: req}
+	if err := r.encoder.Encode(line); err != nil {
+		return fmt.Errorf("loadgen: failed to record %s %s: %w", req.Method, req.Path, err)
+	}
+	return nil
+}
+
+// ReadRecording reads the requests of a recording, as Recorder writes them.
+// Blank lines are skipped, and requests are returned in the order recorded.
+func ReadRecording(r io.Reader) ([]Request, error) {
+	var requests []Request
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := scanner.Bytes()
+		if len(data) == 0 {
+			continue
+		}
+		var rec recorded
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("loadgen: recording line %d: %w", line, err)
+		}
+		if rec.Method == "" || rec.Path == "" {
+			return nil, fmt.Errorf("loadgen: recording line %d: method and path are required", line)
+		}
+		if rec.OffsetMS < 0 {
+			return nil, fmt.Errorf("loadgen: recording line %d: offset_ms must not be negative", line)
+		}
+		rec.Request.Offset = time.Duration(rec.OffsetMS * float64(time.Millisecond))
+		requests = append(requests, rec.Request)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("loadgen: failed to read recording: %w", err)
+	}
+	return requests, nil
+}
+
+// Replay is a source sending recorded requests at their offsets divided by
+// speed, so a speed of 2 replays traffic twice as fast as it was recorded.
+// Loops replays the recording that many times, one after the other.
+type Replay struct {
+	requests []Request
+	speed    float64
+	loops    int
+
+	next   int
+	loop   int
+	length time.Duration
+}
+
+// NewReplay returns a replay of requests. A speed of zero or less replays
+// at the recorded pace, and loops of zero or less replays once.
+func NewReplay(requests []Request, speed float64, loops int) *Replay {
+	if speed <= 0 {
+		speed = 1
+	}
+	if loops <= 0 {
+		loops = 1
+	}
+	replay := &Replay{requests: requests, speed: speed, loops: loops}
+	if len(requests) > 0 {
+		// Later loops start a mean gap after the last request of the one before
+		last := requests[len(requests)-1].Offset
+		replay.length = last + last/time.Duration(max(len(requests)-1, 1))
+	}
+	return replay
+}
+
+// Next returns the next recorded request
+func (r *Replay) Next() (Request, bool) {
+	if r.next == len(r.requests) {
+		r.next = 0
+		r.loop++
+	}
+	if r.loop >= r.loops || len(r.requests) == 0 {
+		return Request{}, false
+	}
+	req := r.requests[r.next]
+	r.next++
+	req.Offset = time.Duration(float64(time.Duration(r.loop)*r.length+req.Offset) / r.speed)
+	return req, true
+}
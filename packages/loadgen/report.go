@@ -0,0 +1,166 @@
+package loadgen
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Report is the outcome of a run, over all requests and per endpoint
+type Report struct {
+	Elapsed   time.Duration `json:"-"`
+	ElapsedS  float64       `json:"elapsed_s"`
+	Total     Stats         `json:"total"`
+	Endpoints []Stats       `json:"endpoints"`
+}
+
+// Stats are the answers to the requests sent to an endpoint. Latencies are
+// in milliseconds.
+type Stats struct {
+	Endpoint string `json:"endpoint"`
+	Requests int    `json:"requests"`
+	// Failures are requests answered with a status of 400 or more, or not
+	// answered at all
+	Failures int `json:"failures"`
+	// Throughput is requests per second of the run
+	Throughput float64 `json:"throughput_rps"`
+	// Statuses counts answers by status, with "error" for requests that
+	// were not answered
+	Statuses map[string]int `json:"statuses"`
+	Latency  Percentiles    `json:"latency_ms"`
+}
+
+// Percentiles summarize latencies, in milliseconds
+type Percentiles struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// NewPercentiles summarizes latencies, by nearest rank
+func NewPercentiles(latencies []time.Duration) Percentiles {
+	if len(latencies) == 0 {
+		return Percentiles{}
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	total := time.Duration(0)
+	for _, latency := range sorted {
+		total += latency
+	}
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		return milliseconds(sorted[max(i, 0)])
+	}
+	return Percentiles{
+		Min:  milliseconds(sorted[0]),
+		Mean: milliseconds(total / time.Duration(len(sorted))),
+		P50:  rank(50),
+		P90:  rank(90),
+		P95:  rank(95),
+		P99:  rank(99),
+		Max:  milliseconds(sorted[len(sorted)-1]),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+// WriteText writes r as a table, one row per endpoint and a total
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "endpoint\trequests\tfailures\trps\tmin\tmean\tp50\tp90\tp95\tp99\tmax\t\n")
+	for _, stats := range append(append([]Stats(nil), r.Endpoints...), r.Total) {
+		l := stats.Latency
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n",
+			stats.Endpoint, stats.Requests, stats.Failures, stats.Throughput,
+			l.Min, l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d requests in %s, latencies in ms, statuses %v\n",
+		r.Total.Requests, r.Elapsed.Round(time.Millisecond), r.Total.Statuses)
+	return err
+}
+
+// collector gathers the answers of a run as they arrive
+type collector struct {
+	mutex     sync.Mutex
+	endpoints map[string]*answers
+}
+
+type answers struct {
+	latencies []time.Duration
+	statuses  map[string]int
+	failures  int
+}
+
+func newCollector() *collector {
+	return &collector{endpoints: make(map[string]*answers)}
+}
+
+func (c *collector) add(req Request, status int, err error, latency time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	endpoint := req.Method + " " + req.Path
+	a, ok := c.endpoints[endpoint]
+	if !ok {
+		a = &answers{statuses: make(map[string]int)}
+		c.endpoints[endpoint] = a
+	}
+	a.latencies = append(a.latencies, latency)
+	if err != nil || status >= 400 {
+		a.failures++
+	}
+	if err != nil && status == 0 {
+		a.statuses["error"]++
+		return
+	}
+	a.statuses[strconv.Itoa(status)]++
+}
+
+func (c *collector) report(elapsed time.Duration) *Report {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	report := &Report{Elapsed: elapsed, ElapsedS: elapsed.Seconds()}
+	all := &answers{statuses: make(map[string]int)}
+	for endpoint, a := range c.endpoints {
+		report.Endpoints = append(report.Endpoints, a.stats(endpoint, elapsed))
+		all.latencies = append(all.latencies, a.latencies...)
+		all.failures += a.failures
+		for status, count := range a.statuses {
+			all.statuses[status] += count
+		}
+	}
+	sort.Slice(report.Endpoints, func(i, j int) bool {
+		return report.Endpoints[i].Endpoint < report.Endpoints[j].Endpoint
+	})
+	report.Total = all.stats("total", elapsed)
+	return report
+}
+
+func (a *answers) stats(endpoint string, elapsed time.Duration) Stats {
+	stats := Stats{
+		Endpoint: endpoint,
+		Requests: len(a.latencies),
+		Failures: a.failures,
+		Statuses: a.statuses,
+		Latency:  NewPercentiles(a.latencies),
+	}
+	if elapsed > 0 {
+		stats.Throughput = float64(stats.Requests) / elapsed.Seconds()
+	}
+	return stats
+}
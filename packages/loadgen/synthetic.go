@@ -0,0 +1,281 @@
+package loadgen
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scenarios a synthetic source generates
+const (
+	// ScenarioRelay requests validations from a relay node: POST /validate
+	ScenarioRelay = "relay"
+	// ScenarioAnalytics ingests payment metrics: POST /api/metrics/payment
+	ScenarioAnalytics = "analytics"
+)
+
+// Scenarios are the scenarios a synthetic source can generate
+var Scenarios = []string{ScenarioRelay, ScenarioAnalytics}
+
+// Distribution is a distribution of values, such as payment amounts:
+//
+//	fixed:1000000             always 1000000
+//	uniform:1000-5000000      uniform between 1000 and 5000000
+//	lognormal:1000000,1.5     log-normal with median 1000000 and sigma 1.5
+type Distribution struct {
+	Kind string
+	A, B float64
+}
+
+// Kinds of distributions
+const (
+	DistributionFixed     = "fixed"
+	DistributionUniform   = "uniform"
+	DistributionLogNormal = "lognormal"
+)
+
+// ParseDistribution reads a distribution as its String form
+func ParseDistribution(s string) (Distribution, error) {
+	kind, params, _ := strings.Cut(s, ":")
+	var separator string
+	switch kind {
+	case DistributionFixed:
+		value, err := strconv.ParseFloat(params, 64)
+		if err != nil || value < 0 {
+			return Distribution{}, fmt.Errorf("loadgen: invalid distribution %q: fixed needs a value of 0 or more", s)
+		}
+		return Distribution{Kind: kind, A: value}, nil
+	case DistributionUniform:
+		separator = "-"
+	case DistributionLogNormal:
+		separator = ","
+	default:
+		return Distribution{}, fmt.Errorf("loadgen: invalid distribution %q: kind must be fixed, uniform or lognormal", s)
+	}
+
+	first, second, ok := strings.Cut(params, separator)
+	a, errA := strconv.ParseFloat(first, 64)
+	b, errB := strconv.ParseFloat(second, 64)
+	if !ok || errA != nil || errB != nil {
+		return Distribution{}, fmt.Errorf("loadgen: invalid distribution %q: %s needs two values separated by %q", s, kind, separator)
+	}
+	if kind == DistributionUniform && (a < 0 || b < a) {
+		return Distribution{}, fmt.Errorf("loadgen: invalid distribution %q: bounds must be 0 or more and in order", s)
+	}
+	if kind == DistributionLogNormal && (a <= 0 || b < 0) {
+		return Distribution{}, fmt.Errorf("loadgen: invalid distribution %q: median must be positive and sigma 0 or more", s)
+	}
+	return Distribution{Kind: kind, A: a, B: b}, nil
+}
+
+func (d Distribution) String() string {
+	number := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	switch d.Kind {
+	case DistributionUniform:
+		return d.Kind + ":" + number(d.A) + "-" + number(d.B)
+	case DistributionLogNormal:
+		return d.Kind + ":" + number(d.A) + "," + number(d.B)
+	}
+	return DistributionFixed + ":" + number(d.A)
+}
+
+// Sample draws a value from d
+func (d Distribution) Sample(rng *rand.Rand) float64 {
+	switch d.Kind {
+	case DistributionUniform:
+		return d.A + rng.Float64()*(d.B-d.A)
+	case DistributionLogNormal:
+		return d.A * math.Exp(d.B*rng.NormFloat64())
+	}
+	return d.A
+}
+
+// Weights picks values in proportion to their weights, written as
+// completed=80,pending=15,failed=5
+type Weights struct {
+	values     []string
+	cumulative []float64
+}
+
+// ParseWeights reads weights as their String form
+func ParseWeights(s string) (Weights, error) {
+	var w Weights
+	total := 0.0
+	for _, entry := range strings.Split(s, ",") {
+		value, weightText, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		weight, err := strconv.ParseFloat(weightText, 64)
+		if !ok || value == "" || err != nil || weight < 0 {
+			return Weights{}, fmt.Errorf("loadgen: invalid weight %q: want value=weight", entry)
+		}
+		total += weight
+		w.values = append(w.values, value)
+		w.cumulative = append(w.cumulative, total)
+	}
+	if total == 0 {
+		return Weights{}, fmt.Errorf("loadgen: invalid weights %q: all weights are 0", s)
+	}
+	return w, nil
+}
+
+func (w Weights) String() string {
+	entries := make([]string, len(w.values))
+	previous := 0.0
+	for i, value := range w.values {
+		entries[i] = fmt.Sprintf("%s=%g", value, w.cumulative[i]-previous)
+		previous = w.cumulative[i]
+	}
+	return strings.Join(entries, ",")
+}
+
+// Pick draws a value, or returns "" from empty weights
+func (w Weights) Pick(rng *rand.Rand) string {
+	if len(w.values) == 0 {
+		return ""
+	}
+	target := rng.Float64() * w.cumulative[len(w.cumulative)-1]
+	for i, cumulative := range w.cumulative {
+		if target < cumulative {
+			return w.values[i]
+		}
+	}
+	return w.values[len(w.values)-1]
+}
+
+// Synthetic generates the requests of a scenario with payloads drawn from
+// its distributions
+type Synthetic struct {
+	// Scenario is ScenarioRelay or ScenarioAnalytics
+	Scenario string
+	// ChainID is the chain payments are on
+	ChainID uint64
+	// Amount is the distribution of payment amounts, in token base units
+	Amount Distribution
+	// HighValue is the amount from which payments are high value and need
+	// an extra validator signature
+	HighValue float64
+	// Signatures is the signatures a payment that is not high value needs
+	Signatures int
+	// PrivateRatio is the share of payments that are private
+	PrivateRatio float64
+	// Statuses weighs the statuses of payment metrics
+	Statuses Weights
+	// Parties is how many distinct senders and recipients payments are
+	// between
+	Parties int
+	// Requests is how many requests to generate; zero generates until the
+	// run ends
+	Requests int
+
+	rng       *rand.Rand
+	generated int
+	paymentID uint64
+	parties   []string
+	tokens    []string
+}
+
+// DefaultStatuses weighs payment statuses roughly as they settle on chain
+const DefaultStatuses = "completed=85,pending=10,failed=4,refunded=1"
+
+// NewSynthetic returns a synthetic source of scenario with the default
+// payload distributions, drawing from seed
+func NewSynthetic(scenario string, seed int64) (*Synthetic, error) {
+	if scenario != ScenarioRelay && scenario != ScenarioAnalytics {
+		return nil, fmt.Errorf("loadgen: unknown scenario %q, want one of %s", scenario, strings.Join(Scenarios, ", "))
+	}
+	statuses, err := ParseWeights(DefaultStatuses)
+	if err != nil {
+		return nil, err
+	}
+	rng := rand.New(rand.NewSource(seed))
+	return &Synthetic{
+		Scenario:     scenario,
+		ChainID:      31337,
+		Amount:       Distribution{Kind: DistributionLogNormal, A: 1e8, B: 1.5},
+		HighValue:    1e10,
+		Signatures:   2,
+		PrivateRatio: 0.1,
+		Statuses:     statuses,
+		Parties:      1000,
+		rng:          rng,
+		// Start payment IDs apart between runs, so runs against the same
+		// relay node do not collide
+		paymentID: uint64(rng.Int63n(1 << 40)),
+		tokens: []string{
+			"0x0000000000000000000000000000000000000000",
+			"0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48",
+			"0xdac17f958d2ee523a2206206994597c13d831ec7",
+		},
+	}, nil
+}
+
+// Next generates the next request
+func (s *Synthetic) Next() (Request, bool) {
+	if s.Requests > 0 && s.generated >= s.Requests {
+		return Request{}, false
+	}
+	s.generated++
+	s.paymentID++
+
+	amount := math.Max(1, math.Round(s.Amount.Sample(s.rng)))
+	highValue := s.HighValue > 0 && amount >= s.HighValue
+	if s.Scenario == ScenarioRelay {
+		signatures := s.Signatures
+		if highValue {
+			signatures++
+		}
+		return s.request("/validate", map[string]interface{}{
+			"payment_id":          s.paymentID,
+			"message_hash":        s.hash(),
+			"required_signatures": signatures,
+			"is_high_value":       highValue,
+		}), true
+	}
+
+	metric := map[string]interface{}{
+		"payment_id": s.paymentID,
+		"chain_id":   s.ChainID,
+		"sender":     s.party(),
+		"recipient":  s.party(),
+		"token":      s.tokens[s.rng.Intn(len(s.tokens))],
+		"amount":     strconv.FormatFloat(amount, 'f', 0, 64),
+		"fee":        strconv.FormatFloat(math.Floor(amount/1000), 'f', 0, 64),
+		"status":     s.Statuses.Pick(s.rng),
+		"is_private": s.rng.Float64() < s.PrivateRatio,
+		"timestamp":  time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if highValue {
+		metric["required_sigs"] = s.Signatures + 1
+	}
+	return s.request("/api/metrics/payment", metric), true
+}
+
+func (s *Synthetic) request(path string, body interface{}) Request {
+	data, _ := json.Marshal(body)
+	return Request{Method: "POST", Path: path, Body: data}
+}
+
+// hash is a random 32 byte message hash
+func (s *Synthetic) hash() string {
+	b := make([]byte, 32)
+	s.rng.Read(b)
+	return "0x" + hex.EncodeToString(b)
+}
+
+// party picks one of the parties payments are between, so metrics group by
+// sender and recipient as real traffic does
+func (s *Synthetic) party() string {
+	if s.parties == nil {
+		s.parties = make([]string, max(s.Parties, 1))
+		for i := range s.parties {
+			b := make([]byte, 20)
+			s.rng.Read(b)
+			s.parties[i] = "0x" + hex.EncodeToString(b)
+		}
+	}
+	return s.parties[s.rng.Intn(len(s.parties))]
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig says which cross-origin requests are allowed
+type CORSConfig struct {
+	// AllowedOrigins are the origins, such as https://app.crosspay.io, that
+	// may call the service from a browser. "*" allows any origin. Without
+	// any, no cross-origin request is allowed.
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET, POST, PUT, DELETE and OPTIONS
+	AllowedMethods []string
+	// AllowedHeaders defaults to Content-Type and Authorization
+	AllowedHeaders []string
+	// AllowCredentials lets browsers send cookies. It cannot be combined
+	// with "*", so the request's origin is echoed instead.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response
+	MaxAge time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	defaultCORSHeaders = []string{"Content-Type", "Authorization"}
+)
+
+// CORS answers preflight requests and sets CORS headers for allowed
+// origins. Requests from other origins are served without them, so
+// browsers block the response. Preflight requests are answered here and
+// never reach the handler.
+func CORS(cfg CORSConfig) Middleware {
+	allowed := make(map[string]bool, len(cfg.AllowedOrigins))
+	anyOrigin := false
+	for _, origin := range cfg.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		if origin == "*" {
+			anyOrigin = true
+		}
+		allowed[origin] = true
+	}
+
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if origin != "" {
+				w.Header().Add("Vary", "Origin")
+			}
+			if origin != "" && (anyOrigin || allowed[strings.ToLower(origin)]) {
+				if anyOrigin && !cfg.AllowCredentials {
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+				} else {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+				}
+				if cfg.AllowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+				if preflight {
+					w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+					w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+					if cfg.MaxAge > 0 {
+						w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+					}
+				}
+			}
+
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Logger logs each request's method, path, status, response size and
+// duration once it is served. A nil logger logs to the standard logger.
+func Logger(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := newRecorder(w)
+			defer func() {
+				status := rec.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				logger.Printf("%s %s %d %dB %s", r.Method, r.URL.Path, status, rec.written, time.Since(start).Round(time.Microsecond))
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
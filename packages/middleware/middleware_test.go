@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+})
+
+func TestCORS(t *testing.T) {
+	handler := CORS(CORSConfig{AllowedOrigins: []string{"https://app.crosspay.io/"}, MaxAge: time.Hour})(ok)
+
+	t.Run("should allow listed origins", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", "https://app.crosspay.io")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "https://app.crosspay.io", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "Origin", w.Header().Get("Vary"))
+	})
+
+	t.Run("should not allow other origins", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", "https://evil.example")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("should answer preflight requests", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodOptions, "/", nil)
+		req.Header.Set("Origin", "https://app.crosspay.io")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "GET, POST, PUT, DELETE, OPTIONS", w.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "Content-Type, Authorization", w.Header().Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "3600", w.Header().Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("should allow no origins by default", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", "https://app.crosspay.io")
+		w := httptest.NewRecorder()
+		CORS(CORSConfig{})(ok).ServeHTTP(w, req)
+
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("should echo the origin for a wildcard with credentials", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", "https://any.example")
+		w := httptest.NewRecorder()
+		CORS(CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true})(ok).ServeHTTP(w, req)
+
+		assert.Equal(t, "https://any.example", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	})
+}
+
+func TestRecoverAndLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	t.Run("should answer a panic with a JSON 500", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		Chain(panicking, Logger(logger), Recover(logger)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/boom", nil))
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.JSONEq(t, `{"error":"Internal server error"}`, w.Body.String())
+		assert.Contains(t, logs.String(), "panic serving GET /boom: boom")
+		assert.Contains(t, logs.String(), "GET /boom 500")
+	})
+
+	t.Run("should log status and size", func(t *testing.T) {
+		logs.Reset()
+		w := httptest.NewRecorder()
+		Chain(ok, Logger(logger), Recover(logger)).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ok", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, logs.String(), "POST /ok 200 11B")
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	t.Run("should pass through fast responses", func(t *testing.T) {
+		created := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Id", "42")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("done"))
+		})
+		w := httptest.NewRecorder()
+		Timeout(time.Second)(created).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "42", w.Header().Get("X-Id"))
+		assert.Equal(t, "done", w.Body.String())
+	})
+
+	t.Run("should cancel slow handlers", func(t *testing.T) {
+		cancelled := make(chan struct{})
+		slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			close(cancelled)
+			w.Write([]byte("too late"))
+		})
+		w := httptest.NewRecorder()
+		Timeout(20*time.Millisecond)(slow).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.JSONEq(t, `{"error":"Request timed out"}`, w.Body.String())
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("handler context was not cancelled")
+		}
+	})
+
+	t.Run("should hand panics to Recover", func(t *testing.T) {
+		panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})
+		w := httptest.NewRecorder()
+		handler := Chain(panicking, Recover(log.New(&bytes.Buffer{}, "", 0)), Timeout(time.Second))
+		require.NotPanics(t, func() {
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		})
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recover turns a panicking handler into a 500 with a JSON error body, and
+// logs the panic with its stack. A nil logger logs to the standard logger.
+func Recover(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := newRecorder(w)
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				// The server aborts the response quietly for this one
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				logger.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+				if rec.status == 0 {
+					WriteError(rec, http.StatusInternalServerError, "Internal server error")
+				}
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
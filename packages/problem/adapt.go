@@ -0,0 +1,167 @@
+package problem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Adapt answers the errors of next as problems. An error response, one
+// with a status of 400 or more, that is JSON, plain text or empty is held
+// until next returns and rewritten: the "error" or "message" member of a
+// JSON object, or the text, becomes the detail, a string "code" member the
+// code, and the other members are kept as extensions. An "error" that is
+// itself a code, such as {"error": "quota_exceeded"}, stays the code when
+// there is no "code" member, and the "message" becomes the detail.
+// Problems, JSON without an error message and other bodies are passed
+// through, as are successful responses, which are not held, so streams and
+// WebSocket upgrades are unaffected.
+func Adapt(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aw := &adaptWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+		aw.finish(r)
+	})
+}
+
+// adaptWriter holds error responses it can rewrite
+type adaptWriter struct {
+	http.ResponseWriter
+	status int
+	// held is the body of an error response being held
+	held *bytes.Buffer
+}
+
+func (w *adaptWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status >= 400 && adaptable(w.Header().Get("Content-Type")) {
+		w.held = new(bytes.Buffer)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *adaptWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held != nil {
+		return w.held.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish writes the held error response as a problem, or as it was when it
+// is not one Adapt understands
+func (w *adaptWriter) finish(r *http.Request) {
+	if w.held == nil {
+		return
+	}
+	p, ok := fromResponse(w.status, w.Header().Get("Content-Type"), w.held.Bytes())
+	if !ok {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.held.Bytes())
+		return
+	}
+	Write(w.ResponseWriter, r, p)
+}
+
+// Flush and Hijack keep streaming responses and WebSocket upgrades working
+// behind the writer
+func (w *adaptWriter) Flush() {
+	if w.held != nil {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *adaptWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("problem: response does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (w *adaptWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// adaptable reports whether an error response of contentType can be
+// rewritten
+func adaptable(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || mediaType == "text/plain")
+}
+
+// fromResponse reads the problem of an error response
+func fromResponse(status int, contentType string, body []byte) (*Problem, bool) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return New(status, "", ""), true
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "text/plain" {
+		return New(status, "", strings.TrimSpace(string(body))), true
+	}
+
+	var members map[string]interface{}
+	if err := json.Unmarshal(body, &members); err != nil || members == nil {
+		return nil, false
+	}
+	var detail, code string
+	if value, ok := members["code"].(string); ok {
+		code = value
+		delete(members, "code")
+	}
+	// Services that answer their code as the error, such as storage-worker's
+	// {"error": "quota_exceeded", "message": "..."}, keep it
+	message, _ := members["error"].(string)
+	coded := code == "" && isCode(message)
+	if coded {
+		code = message
+		delete(members, "error")
+	}
+	for _, key := range []string{"error", "message"} {
+		if value, ok := members[key].(string); ok {
+			detail = value
+			delete(members, key)
+			break
+		}
+	}
+	// Other objects are results that come with an error status, such as a
+	// verdict that a receipt was not found
+	if detail == "" && !coded {
+		return nil, false
+	}
+	p := New(status, code, detail)
+	for key, value := range members {
+		p.With(key, value)
+	}
+	return p, true
+}
+
+// isCode reports whether message is a code rather than a sentence: lower
+// case words joined by underscores
+func isCode(message string) bool {
+	if message == "" || message[0] < 'a' || message[0] > 'z' {
+		return false
+	}
+	for _, c := range message {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
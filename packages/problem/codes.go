@@ -0,0 +1,106 @@
+package problem
+
+// Codes of the errors clients act on. They live here rather than with the
+// service answering them, so SDKs branch on one list and a code means the
+// same wherever it is answered.
+
+// Addresses a payment cannot use
+const (
+	CodeInvalidAddress  = "invalid_address"
+	CodeInvalidChecksum = "invalid_checksum"
+	CodeNotPayable      = "not_payable"
+	CodeENSNotResolved  = "ens_not_resolved"
+	CodeENSMismatch     = "ens_mismatch"
+	CodeENSUnavailable  = "ens_unavailable"
+)
+
+// Tokens and locked quotes
+const (
+	CodeTokenNotAllowed = "token_not_allowed"
+	CodeInvalidQuote    = "invalid_quote"
+	CodeQuoteMismatch   = "quote_mismatch"
+	CodeQuoteExpired    = "quote_expired"
+	CodeQuoteUsed       = "quote_used"
+	CodeQuoteUnpriced   = "quote_unpriced"
+)
+
+// Compliance checks
+const (
+	CodeKYCRequired              = "kyc_required"
+	CodeLimitExceeded            = "limit_exceeded"
+	CodeTravelRuleRequired       = "travel_rule_required"
+	CodeUnknownVASP              = "unknown_vasp"
+	CodeInvalidTravelRulePerson  = "invalid_travel_rule_person"
+	CodeInvalidTravelRuleMessage = "invalid_travel_rule_message"
+)
+
+// Payments, streams and payroll runs
+const (
+	CodeInvalidMetadata     = "invalid_metadata"
+	CodeMetadataUnavailable = "metadata_unavailable"
+	CodeStreamEnded         = "stream_ended"
+	CodeInvalidTopUp        = "invalid_top_up"
+	CodeInvalidPayroll      = "invalid_payroll"
+	CodePayrollSubmitted    = "payroll_submitted"
+)
+
+// Contacts and WalletConnect sessions
+const (
+	CodeInvalidContact     = "invalid_contact"
+	CodeContactExists      = "contact_exists"
+	CodeWalletConnectEnded = "walletconnect_session_inactive"
+)
+
+// Erasure requests
+const (
+	CodeInvalidErasure          = "invalid_erasure"
+	CodeInvalidErasureSignature = "invalid_erasure_signature"
+	CodeAddressErased           = "address_erased"
+	CodeErasurePending          = "erasure_pending"
+	CodeErasureFinal            = "erasure_final"
+)
+
+// Stored files and signed download links (storage-worker, analytics)
+const (
+	CodeQuotaExceeded      = "quota_exceeded"
+	CodeFileRejected       = "file_rejected"
+	CodeScannerUnavailable = "scanner_unavailable"
+	CodeVerificationFailed = "verification_failed"
+	CodeInvalidLink        = "invalid_link"
+	CodeLinkExpired        = "link_expired"
+)
+
+// Validators and their evidence (relay-network)
+const (
+	CodeChainNotValidated   = "chain_not_validated"
+	CodeValidationReverted  = "validation_reverted"
+	CodeAlreadyRegistered   = "already_registered"
+	CodeNotRegistered       = "not_registered"
+	CodeRegistrationPending = "registration_pending"
+	CodeUnbonding           = "unbonding"
+	CodeInsufficientStake   = "insufficient_stake"
+	CodeEvidenceReviewed    = "evidence_reviewed"
+)
+
+// Analytics scopes, dashboards and disclosures
+const (
+	CodeScopeForbidden       = "scope_forbidden"
+	CodeDashboardChanged     = "dashboard_changed"
+	CodeDisclosureTransition = "invalid_disclosure_transition"
+	CodeNotComputed          = "not_computed"
+)
+
+// Prices, proofs and randomness (oracle-service)
+const (
+	CodeUnknownSymbol       = "unknown_symbol"
+	CodePriceNotRecorded    = "price_not_recorded"
+	CodeProofProcessed      = "proof_processed"
+	CodeRandomnessFulfilled = "randomness_fulfilled"
+)
+
+// ENS records and subnames (ens-resolver), beside ens_not_resolved
+const (
+	CodeENSRecordNotSet = "ens_record_not_set"
+	CodeSubnameTaken    = "subname_taken"
+	CodeSubnameInactive = "subname_inactive"
+)
@@ -0,0 +1,154 @@
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decode(t *testing.T, w *httptest.ResponseRecorder) *Problem {
+	t.Helper()
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+	var p Problem
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&p))
+	return &p
+}
+
+func TestProblem(t *testing.T) {
+	t.Run("should write problems with their code and instance", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		p := New(http.StatusBadRequest, "invalid_checksum", "invalid address checksum").With("field", "recipient")
+		Write(w, httptest.NewRequest(http.MethodPost, "/api/payments/create", nil), p)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		var members map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&members))
+		assert.Equal(t, map[string]interface{}{
+			"type":     TypeBase + "invalid_checksum",
+			"title":    "Bad Request",
+			"status":   float64(400),
+			"detail":   "invalid address checksum",
+			"instance": "/api/payments/create",
+			"code":     "invalid_checksum",
+			"field":    "recipient",
+		}, members)
+	})
+
+	t.Run("should default the code to the status's", func(t *testing.T) {
+		assert.Equal(t, CodeNotFound, New(http.StatusNotFound, "", "").Code)
+		assert.Equal(t, CodeUpstreamFailed, StatusCode(http.StatusBadGateway))
+		assert.Equal(t, CodeClientError, StatusCode(http.StatusTeapot))
+		assert.Equal(t, CodeServerError, StatusCode(http.StatusLoopDetected))
+	})
+
+	t.Run("should read problems back with their extensions", func(t *testing.T) {
+		data, err := json.Marshal(New(http.StatusConflict, "", "payment is locked").With("payment_id", "42"))
+		require.NoError(t, err)
+		var p Problem
+		require.NoError(t, json.Unmarshal(data, &p))
+		assert.Equal(t, http.StatusConflict, p.Status)
+		assert.Equal(t, CodeConflict, p.Code)
+		assert.Equal(t, map[string]interface{}{"payment_id": "42"}, p.Extensions)
+		assert.EqualError(t, &p, "409 conflict: payment is locked")
+	})
+}
+
+func TestAdapt(t *testing.T) {
+	serve := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Adapt(handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/things/1", nil))
+		return w
+	}
+
+	t.Run("should rewrite JSON errors keeping their code and members", func(t *testing.T) {
+		w := serve(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "bad recipient", "code": "invalid_address", "field": "recipient"})
+		})
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		p := decode(t, w)
+		assert.Equal(t, "invalid_address", p.Code)
+		assert.Equal(t, "bad recipient", p.Detail)
+		assert.Equal(t, "/api/things/1", p.Instance)
+		assert.Equal(t, map[string]interface{}{"field": "recipient"}, p.Extensions)
+	})
+
+	t.Run("should keep an error that is a code as the code", func(t *testing.T) {
+		w := serve(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusPaymentRequired)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "quota_exceeded", "message": "storage quota exceeded", "quota": "storage"})
+		})
+		p := decode(t, w)
+		assert.Equal(t, CodeQuotaExceeded, p.Code)
+		assert.Equal(t, "storage quota exceeded", p.Detail)
+		assert.Equal(t, map[string]interface{}{"quota": "storage"}, p.Extensions)
+
+		w = serve(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "file_rejected", "threat": "EICAR"})
+		})
+		p = decode(t, w)
+		assert.Equal(t, CodeFileRejected, p.Code)
+		assert.Empty(t, p.Detail)
+		assert.Equal(t, map[string]interface{}{"threat": "EICAR"}, p.Extensions)
+
+		w = serve(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusPaymentRequired)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Budget exhausted"})
+		})
+		p = decode(t, w)
+		assert.Equal(t, CodePaymentRequired, p.Code)
+		assert.Equal(t, "Budget exhausted", p.Detail)
+	})
+
+	t.Run("should rewrite plain text and empty errors", func(t *testing.T) {
+		w := serve(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Validation request not found", http.StatusNotFound)
+		})
+		p := decode(t, w)
+		assert.Equal(t, CodeNotFound, p.Code)
+		assert.Equal(t, "Validation request not found", p.Detail)
+
+		w = serve(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+		assert.Equal(t, CodeUnauthorized, decode(t, w).Code)
+	})
+
+	t.Run("should pass other responses through", func(t *testing.T) {
+		w := serve(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"ok":true}`))
+		})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `{"ok":true}`, w.Body.String())
+
+		w = serve(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/csv")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("a,b"))
+		})
+		assert.Equal(t, "a,b", w.Body.String())
+
+		w = serve(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"verdict":"unknown"}`))
+		})
+		assert.Equal(t, `{"verdict":"unknown"}`, w.Body.String())
+
+		w = serve(func(w http.ResponseWriter, r *http.Request) {
+			Error(w, r, http.StatusGone, "", "expired")
+		})
+		assert.Equal(t, "expired", decode(t, w).Detail)
+	})
+}
@@ -0,0 +1,366 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// State queries answer from the latest state whatever block they name; the
+// chain keeps no history of balances, nonces or contract state.
+
+const clientVersion = "crosspay-sandbox/v1"
+
+// ethAPI serves the eth namespace
+type ethAPI struct {
+	chain *Chain
+}
+
+// callArgs are the eth_call and eth_estimateGas arguments the chain uses
+type callArgs struct {
+	From  *common.Address `json:"from"`
+	To    *common.Address `json:"to"`
+	Value *hexutil.Big    `json:"value"`
+	Data  *hexutil.Bytes  `json:"data"`
+	Input *hexutil.Bytes  `json:"input"`
+}
+
+func (args *callArgs) message() (from common.Address, value *big.Int, data []byte) {
+	if args.From != nil {
+		from = *args.From
+	}
+	value = new(big.Int)
+	if args.Value != nil {
+		value = args.Value.ToInt()
+	}
+	if args.Input != nil {
+		data = *args.Input
+	} else if args.Data != nil {
+		data = *args.Data
+	}
+	return from, value, data
+}
+
+func (api *ethAPI) ChainId() *hexutil.Big {
+	return (*hexutil.Big)(api.chain.ChainID())
+}
+
+func (api *ethAPI) BlockNumber() hexutil.Uint64 {
+	return hexutil.Uint64(api.chain.BlockNumber())
+}
+
+func (api *ethAPI) GasPrice() *hexutil.Big {
+	return (*hexutil.Big)(new(big.Int).Set(api.chain.config.BaseFee))
+}
+
+func (api *ethAPI) MaxPriorityFeePerGas() *hexutil.Big {
+	return (*hexutil.Big)(new(big.Int))
+}
+
+func (api *ethAPI) GetBalance(address common.Address, block *rpc.BlockNumberOrHash) *hexutil.Big {
+	return (*hexutil.Big)(api.chain.Balance(address))
+}
+
+func (api *ethAPI) GetTransactionCount(address common.Address, block *rpc.BlockNumberOrHash) hexutil.Uint64 {
+	api.chain.mutex.RLock()
+	defer api.chain.mutex.RUnlock()
+
+	return hexutil.Uint64(api.chain.nonces[address])
+}
+
+func (api *ethAPI) GetCode(address common.Address, block *rpc.BlockNumberOrHash) hexutil.Bytes {
+	api.chain.mutex.RLock()
+	defer api.chain.mutex.RUnlock()
+
+	return common.CopyBytes(api.chain.code[address])
+}
+
+func (api *ethAPI) Call(args callArgs, block *rpc.BlockNumberOrHash) (hexutil.Bytes, error) {
+	if args.To == nil {
+		return nil, ErrContractCreation
+	}
+	from, value, data := args.message()
+	return api.chain.Call(from, *args.To, value, data)
+}
+
+// EstimateGas returns the gas the transaction will use. Transactions are not
+// simulated, so one that will revert is only seen to fail in its receipt.
+func (api *ethAPI) EstimateGas(args callArgs, block *rpc.BlockNumberOrHash) (hexutil.Uint64, error) {
+	if args.To == nil {
+		return 0, ErrContractCreation
+	}
+	_, _, data := args.message()
+
+	api.chain.mutex.RLock()
+	defer api.chain.mutex.RUnlock()
+	return hexutil.Uint64(api.chain.gas(*args.To, data)), nil
+}
+
+func (api *ethAPI) SendRawTransaction(input hexutil.Bytes) (common.Hash, error) {
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(input); err != nil {
+		return common.Hash{}, err
+	}
+	if _, err := api.chain.SendTransaction(tx); err != nil {
+		return common.Hash{}, err
+	}
+	return tx.Hash(), nil
+}
+
+func (api *ethAPI) GetBlockByNumber(number rpc.BlockNumber, full bool) (map[string]interface{}, error) {
+	api.chain.mutex.RLock()
+	defer api.chain.mutex.RUnlock()
+
+	head := int64(len(api.chain.blocks) - 1)
+	n := number.Int64()
+	switch number {
+	case rpc.EarliestBlockNumber:
+		n = 0
+	case rpc.LatestBlockNumber, rpc.PendingBlockNumber, rpc.SafeBlockNumber, rpc.FinalizedBlockNumber:
+		n = head
+	}
+	if n < 0 || n > head {
+		return nil, nil
+	}
+	return api.chain.marshalBlock(api.chain.blocks[n], full)
+}
+
+func (api *ethAPI) GetBlockByHash(hash common.Hash, full bool) (map[string]interface{}, error) {
+	api.chain.mutex.RLock()
+	defer api.chain.mutex.RUnlock()
+
+	for _, block := range api.chain.blocks {
+		if block.Hash() == hash {
+			return api.chain.marshalBlock(block, full)
+		}
+	}
+	return nil, nil
+}
+
+func (api *ethAPI) GetTransactionByHash(hash common.Hash) (map[string]interface{}, error) {
+	api.chain.mutex.RLock()
+	defer api.chain.mutex.RUnlock()
+
+	lookup, ok := api.chain.txs[hash]
+	if !ok {
+		return nil, nil
+	}
+	return marshalTransaction(lookup)
+}
+
+func (api *ethAPI) GetTransactionReceipt(hash common.Hash) (*types.Receipt, error) {
+	api.chain.mutex.RLock()
+	defer api.chain.mutex.RUnlock()
+
+	lookup, ok := api.chain.txs[hash]
+	if !ok {
+		return nil, nil
+	}
+	return lookup.receipt, nil
+}
+
+func (api *ethAPI) GetLogs(crit filterArgs) ([]*types.Log, error) {
+	api.chain.mutex.RLock()
+	defer api.chain.mutex.RUnlock()
+
+	head := uint64(len(api.chain.blocks) - 1)
+	from, to := uint64(0), head
+	if crit.BlockHash != nil {
+		found := false
+		for i, block := range api.chain.blocks {
+			if block.Hash() == *crit.BlockHash {
+				from, to, found = uint64(i), uint64(i), true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("unknown block")
+		}
+	} else {
+		from, to = resolveBlock(crit.FromBlock, 0, head), resolveBlock(crit.ToBlock, head, head)
+	}
+
+	logs := []*types.Log{}
+	for n := from; n <= to && n <= head; n++ {
+		for _, receipt := range api.chain.receipts[n] {
+			for _, log := range receipt.Logs {
+				if crit.matches(log) {
+					logs = append(logs, log)
+				}
+			}
+		}
+	}
+	return logs, nil
+}
+
+// netAPI serves the net namespace
+type netAPI struct {
+	chain *Chain
+}
+
+func (api *netAPI) Version() string {
+	return strconv.FormatInt(api.chain.config.ChainID, 10)
+}
+
+// web3API serves the web3 namespace
+type web3API struct{}
+
+func (api *web3API) ClientVersion() string {
+	return clientVersion
+}
+
+// filterArgs are the eth_getLogs criteria
+type filterArgs struct {
+	BlockHash *common.Hash
+	FromBlock *rpc.BlockNumber
+	ToBlock   *rpc.BlockNumber
+	Addresses []common.Address
+	Topics    [][]common.Hash
+}
+
+func (args *filterArgs) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		BlockHash *common.Hash      `json:"blockHash"`
+		FromBlock *rpc.BlockNumber  `json:"fromBlock"`
+		ToBlock   *rpc.BlockNumber  `json:"toBlock"`
+		Address   json.RawMessage   `json:"address"`
+		Topics    []json.RawMessage `json:"topics"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	args.BlockHash, args.FromBlock, args.ToBlock = raw.BlockHash, raw.FromBlock, raw.ToBlock
+
+	// address and each topic are either one value or a list of them
+	if len(raw.Address) > 0 && string(raw.Address) != "null" {
+		if err := json.Unmarshal(raw.Address, &args.Addresses); err != nil {
+			var address common.Address
+			if err := json.Unmarshal(raw.Address, &address); err != nil {
+				return errors.New("invalid address filter")
+			}
+			args.Addresses = []common.Address{address}
+		}
+	}
+	for _, topic := range raw.Topics {
+		var hashes []common.Hash
+		if len(topic) > 0 && string(topic) != "null" {
+			if err := json.Unmarshal(topic, &hashes); err != nil {
+				var hash common.Hash
+				if err := json.Unmarshal(topic, &hash); err != nil {
+					return errors.New("invalid topic filter")
+				}
+				hashes = []common.Hash{hash}
+			}
+		}
+		args.Topics = append(args.Topics, hashes)
+	}
+	return nil
+}
+
+// matches reports whether log is emitted by one of the addresses and has
+// one of the topics at each filtered position
+func (args *filterArgs) matches(log *types.Log) bool {
+	if len(args.Addresses) > 0 {
+		found := false
+		for _, address := range args.Addresses {
+			if address == log.Address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(args.Topics) > len(log.Topics) {
+		return false
+	}
+	for i, hashes := range args.Topics {
+		if len(hashes) == 0 {
+			continue
+		}
+		found := false
+		for _, hash := range hashes {
+			if hash == log.Topics[i] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveBlock turns a block tag into a number, with fallback when no block
+// is given
+func resolveBlock(number *rpc.BlockNumber, fallback, head uint64) uint64 {
+	if number == nil {
+		return fallback
+	}
+	switch *number {
+	case rpc.EarliestBlockNumber:
+		return 0
+	case rpc.LatestBlockNumber, rpc.PendingBlockNumber, rpc.SafeBlockNumber, rpc.FinalizedBlockNumber:
+		return head
+	}
+	return uint64(number.Int64())
+}
+
+// marshalBlock encodes a block the way eth_getBlockBy* returns it. The
+// caller holds the lock.
+func (c *Chain) marshalBlock(block *types.Block, full bool) (map[string]interface{}, error) {
+	fields, err := marshalFields(block.Header())
+	if err != nil {
+		return nil, err
+	}
+	fields["size"] = hexutil.Uint64(block.Size())
+	fields["uncles"] = []common.Hash{}
+
+	txs := make([]interface{}, len(block.Transactions()))
+	for i, tx := range block.Transactions() {
+		if !full {
+			txs[i] = tx.Hash()
+			continue
+		}
+		if txs[i], err = marshalTransaction(c.txs[tx.Hash()]); err != nil {
+			return nil, err
+		}
+	}
+	fields["transactions"] = txs
+	return fields, nil
+}
+
+// marshalTransaction encodes a mined transaction the way
+// eth_getTransactionByHash returns it
+func marshalTransaction(lookup *txLookup) (map[string]interface{}, error) {
+	fields, err := marshalFields(lookup.tx)
+	if err != nil {
+		return nil, err
+	}
+	fields["from"] = lookup.from
+	fields["blockHash"] = lookup.receipt.BlockHash
+	fields["blockNumber"] = (*hexutil.Big)(lookup.receipt.BlockNumber)
+	fields["transactionIndex"] = hexutil.Uint64(lookup.receipt.TransactionIndex)
+	return fields, nil
+}
+
+// marshalFields encodes v as a JSON object that fields can be added to
+func marshalFields(v interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,495 @@
+// Package sandbox is an in-memory chain that speaks enough Ethereum JSON-RPC
+// for the services to run without a node or testnet funds.
+//
+// Every transaction is mined into a block of its own as soon as it is sent,
+// and block timestamps advance by a fixed step from the genesis time, so the
+// same transactions always give the same hashes, block numbers and
+// confirmations. Contracts are Go implementations of Contract rather than EVM
+// bytecode.
+package sandbox
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+const (
+	// DefaultChainID is the chain ID used when none is configured
+	DefaultChainID = 31337
+	// DevAccounts is how many DevKey accounts are funded at genesis
+	DevAccounts = 10
+
+	blockGasLimit = 30_000_000
+	transferGas   = 21_000
+	calldataGas   = 16
+	contractGas   = 50_000
+)
+
+var (
+	ErrAlreadyKnown      = errors.New("already known")
+	ErrNonceTooLow       = errors.New("nonce too low")
+	ErrNonceTooHigh      = errors.New("nonce too high")
+	ErrInvalidChainID    = errors.New("invalid chain id for signer")
+	ErrInsufficientFunds = errors.New("insufficient funds for transfer")
+	ErrFeeCapTooLow      = errors.New("max fee per gas less than block base fee")
+	ErrContractCreation  = errors.New("contract creation is not supported by the sandbox chain")
+)
+
+var (
+	defaultGenesis = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	devBalance     = new(big.Int).Mul(big.NewInt(10_000), big.NewInt(params.Ether))
+	// stubCode is the code reported for Go contracts: PUSH1 0 PUSH1 0 REVERT
+	stubCode = []byte{0x60, 0x00, 0x60, 0x00, 0xfd}
+)
+
+// Config sets up a chain. The zero value is a chain with DefaultChainID,
+// a genesis at 2024-01-01 UTC, one second blocks and a 1 gwei base fee.
+type Config struct {
+	ChainID   int64
+	Genesis   time.Time
+	BlockTime time.Duration
+	BaseFee   *big.Int
+}
+
+// Chain is an in-memory chain. It is safe for concurrent use.
+type Chain struct {
+	config  Config
+	chainID *big.Int
+	signer  types.Signer
+	server  *rpc.Server
+
+	mutex     sync.RWMutex
+	blocks    []*types.Block
+	receipts  [][]*types.Receipt
+	txs       map[common.Hash]*txLookup
+	nonces    map[common.Address]uint64
+	balances  map[common.Address]*big.Int
+	code      map[common.Address][]byte
+	contracts map[common.Address]Contract
+	listeners []*http.Server
+}
+
+// txLookup locates a mined transaction
+type txLookup struct {
+	tx      *types.Transaction
+	from    common.Address
+	receipt *types.Receipt
+}
+
+// New creates a chain with its genesis block and the DevKey accounts funded
+func New(config Config) *Chain {
+	if config.ChainID == 0 {
+		config.ChainID = DefaultChainID
+	}
+	if config.Genesis.IsZero() {
+		config.Genesis = defaultGenesis
+	}
+	if config.BlockTime < time.Second {
+		config.BlockTime = time.Second
+	}
+	if config.BaseFee == nil {
+		config.BaseFee = big.NewInt(params.GWei)
+	}
+
+	chainID := big.NewInt(config.ChainID)
+	c := &Chain{
+		config:    config,
+		chainID:   chainID,
+		signer:    types.LatestSignerForChainID(chainID),
+		server:    rpc.NewServer(),
+		txs:       make(map[common.Hash]*txLookup),
+		nonces:    make(map[common.Address]uint64),
+		balances:  make(map[common.Address]*big.Int),
+		code:      make(map[common.Address][]byte),
+		contracts: make(map[common.Address]Contract),
+	}
+	for i := 0; i < DevAccounts; i++ {
+		c.balances[DevAddress(i)] = new(big.Int).Set(devBalance)
+	}
+	c.seal(nil, nil)
+
+	for namespace, api := range map[string]interface{}{
+		"eth":  &ethAPI{chain: c},
+		"net":  &netAPI{chain: c},
+		"web3": &web3API{},
+	} {
+		if err := c.server.RegisterName(namespace, api); err != nil {
+			panic(err)
+		}
+	}
+	return c
+}
+
+// DevKey returns the i-th development key. The keys are the same on every
+// chain, and the first DevAccounts of them are funded at genesis.
+func DevKey(i int) *ecdsa.PrivateKey {
+	key, err := crypto.ToECDSA(crypto.Keccak256([]byte(fmt.Sprintf("crosspay-sandbox-%d", i))))
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// DevAddress returns the address of DevKey(i)
+func DevAddress(i int) common.Address {
+	return crypto.PubkeyToAddress(DevKey(i).PublicKey)
+}
+
+// ChainID returns the chain's ID
+func (c *Chain) ChainID() *big.Int {
+	return new(big.Int).Set(c.chainID)
+}
+
+// Deploy installs a contract at address
+func (c *Chain) Deploy(address common.Address, contract Contract) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.contracts[address] = contract
+	if len(c.code[address]) == 0 {
+		c.code[address] = stubCode
+	}
+}
+
+// SetCode sets the code reported for address, so callers that check for a
+// contract find one
+func (c *Chain) SetCode(address common.Address, code []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.code[address] = common.CopyBytes(code)
+}
+
+// SetBalance sets the balance of address
+func (c *Chain) SetBalance(address common.Address, balance *big.Int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.balances[address] = new(big.Int).Set(balance)
+}
+
+// Balance returns the balance of address
+func (c *Chain) Balance(address common.Address) *big.Int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.balance(address)
+}
+
+// BlockNumber returns the number of the latest block
+func (c *Chain) BlockNumber() uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return uint64(len(c.blocks) - 1)
+}
+
+// Mine mines n empty blocks
+func (c *Chain) Mine(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := 0; i < n; i++ {
+		c.seal(nil, nil)
+	}
+}
+
+// Run mines an empty block every interval until ctx is done, for callers
+// that wait for confirmations. Without it blocks are only mined for
+// transactions and by Mine.
+func (c *Chain) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Mine(1)
+		}
+	}
+}
+
+// SendTransaction validates a signed transaction and mines it. A reverted
+// transaction is still mined, with a failed receipt.
+func (c *Chain) SendTransaction(tx *types.Transaction) (*types.Receipt, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, known := c.txs[tx.Hash()]; known {
+		return nil, ErrAlreadyKnown
+	}
+	if tx.Protected() && tx.ChainId().Cmp(c.chainID) != 0 {
+		return nil, fmt.Errorf("%w: have %d want %d", ErrInvalidChainID, tx.ChainId(), c.chainID)
+	}
+	from, err := types.Sender(c.signer, tx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender: %w", err)
+	}
+	if tx.To() == nil {
+		return nil, ErrContractCreation
+	}
+	if nonce := c.nonces[from]; tx.Nonce() < nonce {
+		return nil, fmt.Errorf("%w: address %s, tx: %d state: %d", ErrNonceTooLow, from.Hex(), tx.Nonce(), nonce)
+	} else if tx.Nonce() > nonce {
+		return nil, fmt.Errorf("%w: address %s, tx: %d state: %d", ErrNonceTooHigh, from.Hex(), tx.Nonce(), nonce)
+	}
+	if tx.GasFeeCap().Cmp(c.config.BaseFee) < 0 {
+		return nil, fmt.Errorf("%w: address %s, maxFeePerGas: %s, baseFee: %s", ErrFeeCapTooLow, from.Hex(), tx.GasFeeCap(), c.config.BaseFee)
+	}
+	if c.balance(from).Cmp(tx.Value()) < 0 {
+		return nil, fmt.Errorf("%w: address %s have %s want %s", ErrInsufficientFunds, from.Hex(), c.balance(from), tx.Value())
+	}
+
+	receipt, _ := c.include(tx, from)
+	return receipt, nil
+}
+
+// Impersonate mines a transaction from an account without its key. The
+// account is credited whatever value it lacks. The transaction carries a
+// placeholder signature derived from the sender, so its hash is as
+// deterministic as a signed one. The error is the revert, if the contract
+// reverted, in which case the failed receipt is returned too.
+func (c *Chain) Impersonate(from, to common.Address, value *big.Int, data []byte) (*types.Receipt, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if value == nil {
+		value = new(big.Int)
+	}
+	if balance := c.balance(from); balance.Cmp(value) < 0 {
+		c.balances[from] = new(big.Int).Set(value)
+	}
+
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   c.chainID,
+		Nonce:     c.nonces[from],
+		GasTipCap: new(big.Int),
+		GasFeeCap: new(big.Int).Set(c.config.BaseFee),
+		Gas:       c.gas(to, data),
+		To:        &to,
+		Value:     value,
+		Data:      data,
+		V:         new(big.Int),
+		R:         new(big.Int).SetBytes(crypto.Keccak256(from.Bytes())),
+		S:         big.NewInt(1),
+	})
+	return c.include(tx, from)
+}
+
+// Call runs a read-only call against the latest state
+func (c *Chain) Call(from, to common.Address, value *big.Int, data []byte) ([]byte, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	contract, ok := c.contracts[to]
+	if !ok {
+		return nil, nil
+	}
+	if value == nil {
+		value = new(big.Int)
+	}
+	number := uint64(len(c.blocks) - 1)
+	output, err := contract.Call(&Message{
+		From:        from,
+		To:          to,
+		Value:       value,
+		Data:        data,
+		BlockNumber: number,
+		Time:        c.blocks[number].Time(),
+	})
+	if err != nil {
+		return nil, asRevert(err)
+	}
+	return output, nil
+}
+
+// Client returns an in-process client for the chain
+func (c *Chain) Client() *ethclient.Client {
+	return ethclient.NewClient(rpc.DialInProc(c.server))
+}
+
+// Handler returns the chain's JSON-RPC endpoint as an HTTP handler
+func (c *Chain) Handler() http.Handler {
+	return c.server
+}
+
+// Listen serves the JSON-RPC endpoint on addr, such as "127.0.0.1:0", and
+// returns its URL, for clients that dial an RPC URL
+func (c *Chain) Listen(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	server := &http.Server{Handler: c.server}
+	go server.Serve(listener)
+
+	c.mutex.Lock()
+	c.listeners = append(c.listeners, server)
+	c.mutex.Unlock()
+	return "http://" + listener.Addr().String(), nil
+}
+
+// Close stops the listeners and the JSON-RPC server
+func (c *Chain) Close() {
+	c.mutex.Lock()
+	listeners := c.listeners
+	c.listeners = nil
+	c.mutex.Unlock()
+
+	for _, server := range listeners {
+		server.Close()
+	}
+	c.server.Stop()
+}
+
+// balance returns the balance of address. The caller holds the lock.
+func (c *Chain) balance(address common.Address) *big.Int {
+	if balance, ok := c.balances[address]; ok {
+		return new(big.Int).Set(balance)
+	}
+	return new(big.Int)
+}
+
+// gas is the gas a transaction to `to` with data uses. Nothing is executed,
+// so it is the same whatever the contract does.
+func (c *Chain) gas(to common.Address, data []byte) uint64 {
+	gas := uint64(transferGas + calldataGas*len(data))
+	if _, ok := c.contracts[to]; ok {
+		gas += contractGas
+	}
+	return gas
+}
+
+// include executes tx and mines it into a new block. The caller holds the
+// lock and has validated tx.
+func (c *Chain) include(tx *types.Transaction, from common.Address) (*types.Receipt, error) {
+	number := uint64(len(c.blocks))
+	to := *tx.To()
+	c.nonces[from]++
+
+	status := types.ReceiptStatusSuccessful
+	var (
+		logs      []*types.Log
+		transfers []transfer
+		revert    error
+	)
+	if contract, ok := c.contracts[to]; ok {
+		msg := &Message{
+			From:        from,
+			To:          to,
+			Value:       tx.Value(),
+			Data:        tx.Data(),
+			BlockNumber: number,
+			Time:        c.blockTime(number),
+			balance:     new(big.Int).Add(c.balance(to), tx.Value()),
+		}
+		var err error
+		if logs, err = contract.Transact(msg); err != nil {
+			status, logs, revert = types.ReceiptStatusFailed, nil, asRevert(err)
+		}
+		transfers = msg.transfers
+	}
+
+	if status == types.ReceiptStatusSuccessful {
+		c.move(from, to, tx.Value())
+		for _, t := range transfers {
+			c.move(to, t.to, t.value)
+		}
+	}
+
+	gasUsed := min(c.gas(to, tx.Data()), tx.Gas())
+	tip, _ := tx.EffectiveGasTip(c.config.BaseFee)
+	receipt := &types.Receipt{
+		Type:              tx.Type(),
+		Status:            status,
+		CumulativeGasUsed: gasUsed,
+		Logs:              logs,
+		TxHash:            tx.Hash(),
+		GasUsed:           gasUsed,
+		EffectiveGasPrice: new(big.Int).Add(c.config.BaseFee, tip),
+	}
+	if receipt.Logs == nil {
+		receipt.Logs = []*types.Log{}
+	}
+	c.txs[tx.Hash()] = &txLookup{tx: tx, from: from, receipt: receipt}
+	c.seal(types.Transactions{tx}, []*types.Receipt{receipt})
+	return receipt, revert
+}
+
+// move moves value between accounts. The caller holds the lock.
+func (c *Chain) move(from, to common.Address, value *big.Int) {
+	if value.Sign() == 0 {
+		return
+	}
+	c.balances[from] = new(big.Int).Sub(c.balance(from), value)
+	c.balances[to] = new(big.Int).Add(c.balance(to), value)
+}
+
+// seal appends a block with txs and fills in where their receipts and logs
+// were mined. The caller holds the lock.
+func (c *Chain) seal(txs types.Transactions, receipts []*types.Receipt) *types.Block {
+	number := uint64(len(c.blocks))
+	var (
+		parent  common.Hash
+		gasUsed uint64
+	)
+	if number > 0 {
+		parent = c.blocks[number-1].Hash()
+	}
+	for _, receipt := range receipts {
+		receipt.Bloom = types.CreateBloom(receipt)
+		gasUsed += receipt.GasUsed
+	}
+
+	header := &types.Header{
+		ParentHash: parent,
+		Difficulty: new(big.Int),
+		Number:     new(big.Int).SetUint64(number),
+		GasLimit:   blockGasLimit,
+		GasUsed:    gasUsed,
+		Time:       c.blockTime(number),
+		BaseFee:    new(big.Int).Set(c.config.BaseFee),
+	}
+	block := types.NewBlock(header, &types.Body{Transactions: txs}, receipts, trie.NewStackTrie(nil))
+
+	var logIndex uint
+	for i, receipt := range receipts {
+		receipt.BlockHash = block.Hash()
+		receipt.BlockNumber = block.Number()
+		receipt.TransactionIndex = uint(i)
+		for _, log := range receipt.Logs {
+			log.BlockNumber = number
+			log.BlockHash = block.Hash()
+			log.TxHash = receipt.TxHash
+			log.TxIndex = uint(i)
+			log.Index = logIndex
+			logIndex++
+		}
+	}
+
+	c.blocks = append(c.blocks, block)
+	c.receipts = append(c.receipts, receipts)
+	return block
+}
+
+// blockTime is the timestamp of block number
+func (c *Chain) blockTime(number uint64) uint64 {
+	return uint64(c.config.Genesis.Unix()) + number*uint64(c.config.BlockTime/time.Second)
+}
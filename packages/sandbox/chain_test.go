@@ -0,0 +1,255 @@
+package sandbox
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	counterABI = mustParseABI(`[
+		{"type":"function","name":"increment","stateMutability":"payable","inputs":[{"name":"by","type":"uint256"}],"outputs":[]},
+		{"type":"function","name":"count","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+		{"type":"function","name":"withdraw","stateMutability":"nonpayable","inputs":[{"name":"amount","type":"uint256"}],"outputs":[]},
+		{"type":"event","name":"Incremented","inputs":[{"name":"caller","type":"address","indexed":true},{"name":"count","type":"uint256"}]}
+	]`)
+	counterAddress = common.HexToAddress("0x00000000000000000000000000000000000c0de1")
+	recipient      = common.HexToAddress("0x00000000000000000000000000000000000000b0")
+)
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// counter counts increments and refuses to increment by zero
+type counter struct {
+	count *big.Int
+}
+
+func (c *counter) Call(msg *Message) ([]byte, error) {
+	method, err := counterABI.MethodById(msg.Data)
+	if err != nil || method.Name != "count" {
+		return nil, Revert("not a view")
+	}
+	return method.Outputs.Pack(c.count)
+}
+
+func (c *counter) Transact(msg *Message) ([]*types.Log, error) {
+	method, err := counterABI.MethodById(msg.Data)
+	if err != nil {
+		return nil, Revert("unknown method")
+	}
+	args, err := method.Inputs.Unpack(msg.Data[4:])
+	if err != nil {
+		return nil, err
+	}
+	amount := args[0].(*big.Int)
+
+	switch method.Name {
+	case "increment":
+		if amount.Sign() == 0 {
+			return nil, Revert("zero increment")
+		}
+		c.count = new(big.Int).Add(c.count, amount)
+		log, err := NewLog(msg.To, counterABI.Events["Incremented"], msg.From, c.count)
+		if err != nil {
+			return nil, err
+		}
+		return []*types.Log{log}, nil
+	case "withdraw":
+		return nil, msg.Send(msg.From, amount)
+	}
+	return nil, Revert("unknown method")
+}
+
+func setupChain(t *testing.T) (*Chain, *ethclient.Client) {
+	chain := New(Config{ChainID: 4202})
+	chain.Deploy(counterAddress, &counter{count: new(big.Int)})
+	client := chain.Client()
+	t.Cleanup(func() {
+		client.Close()
+		chain.Close()
+	})
+	return chain, client
+}
+
+// signedTx signs a transaction from DevKey(0)
+func signedTx(t *testing.T, chain *Chain, nonce uint64, to common.Address, value *big.Int, data []byte) *types.Transaction {
+	tx, err := types.SignNewTx(DevKey(0), types.LatestSignerForChainID(chain.ChainID()), &types.DynamicFeeTx{
+		ChainID:   chain.ChainID(),
+		Nonce:     nonce,
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: big.NewInt(2 * params.GWei),
+		Gas:       100000,
+		To:        &to,
+		Value:     value,
+		Data:      data,
+	})
+	require.NoError(t, err)
+	return tx
+}
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should mine each transaction into its own block", func(t *testing.T) {
+		chain, client := setupChain(t)
+
+		tx := signedTx(t, chain, 0, recipient, big.NewInt(params.Ether), nil)
+		require.NoError(t, client.SendTransaction(ctx, tx))
+
+		receipt, err := client.TransactionReceipt(ctx, tx.Hash())
+		require.NoError(t, err)
+		assert.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+		assert.Equal(t, uint64(1), receipt.BlockNumber.Uint64())
+		assert.Equal(t, uint64(transferGas), receipt.GasUsed)
+
+		block, err := client.BlockByNumber(ctx, nil)
+		require.NoError(t, err)
+		assert.Equal(t, receipt.BlockHash, block.Hash())
+		assert.Equal(t, tx.Hash(), block.Transactions()[0].Hash())
+
+		mined, pending, err := client.TransactionByHash(ctx, tx.Hash())
+		require.NoError(t, err)
+		assert.False(t, pending)
+		sender, err := types.Sender(types.LatestSignerForChainID(chain.ChainID()), mined)
+		require.NoError(t, err)
+		assert.Equal(t, DevAddress(0), sender)
+
+		balance, err := client.BalanceAt(ctx, recipient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, big.NewInt(params.Ether), balance)
+		nonce, err := client.PendingNonceAt(ctx, DevAddress(0))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), nonce)
+	})
+
+	t.Run("should give the same hashes for the same transactions", func(t *testing.T) {
+		first, _ := setupChain(t)
+		second, _ := setupChain(t)
+
+		for _, chain := range []*Chain{first, second} {
+			_, err := chain.SendTransaction(signedTx(t, chain, 0, recipient, big.NewInt(1), nil))
+			require.NoError(t, err)
+			_, err = chain.Impersonate(recipient, counterAddress, nil, mustPack(t, "increment", big.NewInt(2)))
+			require.NoError(t, err)
+			chain.Mine(3)
+		}
+
+		assert.Equal(t, uint64(5), first.BlockNumber())
+		assert.Equal(t, first.blocks[5].Hash(), second.blocks[5].Hash())
+		assert.Equal(t, first.blocks[2].Transactions()[0].Hash(), second.blocks[2].Transactions()[0].Hash())
+		assert.Equal(t, first.blocks[1].Time()+4, first.blocks[5].Time())
+	})
+
+	t.Run("should reject transactions with a wrong nonce", func(t *testing.T) {
+		chain, client := setupChain(t)
+
+		tx := signedTx(t, chain, 0, recipient, big.NewInt(1), nil)
+		require.NoError(t, client.SendTransaction(ctx, tx))
+
+		err := client.SendTransaction(ctx, tx)
+		assert.ErrorContains(t, err, ErrAlreadyKnown.Error())
+		err = client.SendTransaction(ctx, signedTx(t, chain, 0, recipient, big.NewInt(2), nil))
+		assert.ErrorContains(t, err, ErrNonceTooLow.Error())
+		err = client.SendTransaction(ctx, signedTx(t, chain, 5, recipient, big.NewInt(2), nil))
+		assert.ErrorContains(t, err, ErrNonceTooHigh.Error())
+		assert.Equal(t, uint64(1), chain.BlockNumber())
+	})
+
+	t.Run("should run contracts and filter their logs", func(t *testing.T) {
+		chain, client := setupChain(t)
+
+		receipt, err := chain.Impersonate(recipient, counterAddress, nil, mustPack(t, "increment", big.NewInt(3)))
+		require.NoError(t, err)
+		require.Len(t, receipt.Logs, 1)
+		chain.Mine(1)
+
+		logs, err := client.FilterLogs(ctx, ethereum.FilterQuery{
+			Addresses: []common.Address{counterAddress},
+			Topics:    [][]common.Hash{{counterABI.Events["Incremented"].ID}, {common.BytesToHash(recipient.Bytes())}},
+		})
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		assert.Equal(t, receipt.TxHash, logs[0].TxHash)
+		assert.Equal(t, uint64(1), logs[0].BlockNumber)
+		values, err := counterABI.Unpack("Incremented", logs[0].Data)
+		require.NoError(t, err)
+		assert.Equal(t, big.NewInt(3), values[0])
+
+		output, err := client.CallContract(ctx, ethereum.CallMsg{To: &counterAddress, Data: mustPack(t, "count")}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, big.NewInt(3), new(big.Int).SetBytes(output))
+
+		code, err := client.CodeAt(ctx, counterAddress, nil)
+		require.NoError(t, err)
+		assert.NotEmpty(t, code)
+	})
+
+	t.Run("should mine reverted transactions without their effects", func(t *testing.T) {
+		chain, client := setupChain(t)
+
+		tx := signedTx(t, chain, 0, counterAddress, big.NewInt(5), mustPack(t, "increment", big.NewInt(0)))
+		require.NoError(t, client.SendTransaction(ctx, tx))
+
+		receipt, err := client.TransactionReceipt(ctx, tx.Hash())
+		require.NoError(t, err)
+		assert.Equal(t, types.ReceiptStatusFailed, receipt.Status)
+		assert.Empty(t, receipt.Logs)
+		assert.Equal(t, 0, chain.Balance(counterAddress).Sign())
+
+		_, err = chain.Impersonate(recipient, counterAddress, nil, mustPack(t, "increment", big.NewInt(0)))
+		assert.EqualError(t, err, "execution reverted: zero increment")
+	})
+
+	t.Run("should pay out what contracts send", func(t *testing.T) {
+		chain, _ := setupChain(t)
+
+		_, err := chain.Impersonate(DevAddress(1), counterAddress, big.NewInt(10), mustPack(t, "increment", big.NewInt(1)))
+		require.NoError(t, err)
+		_, err = chain.Impersonate(recipient, counterAddress, nil, mustPack(t, "withdraw", big.NewInt(11)))
+		assert.Error(t, err)
+		_, err = chain.Impersonate(recipient, counterAddress, nil, mustPack(t, "withdraw", big.NewInt(4)))
+		require.NoError(t, err)
+
+		assert.Equal(t, big.NewInt(6), chain.Balance(counterAddress))
+		assert.Equal(t, big.NewInt(4), chain.Balance(recipient))
+	})
+
+	t.Run("should serve JSON-RPC over HTTP", func(t *testing.T) {
+		chain, _ := setupChain(t)
+
+		url, err := chain.Listen("127.0.0.1:0")
+		require.NoError(t, err)
+		client, err := ethclient.Dial(url)
+		require.NoError(t, err)
+		defer client.Close()
+
+		chainID, err := client.ChainID(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, big.NewInt(4202), chainID)
+		header, err := client.HeaderByNumber(ctx, big.NewInt(0))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(defaultGenesis.Unix()), header.Time)
+	})
+}
+
+func mustPack(t *testing.T, method string, args ...interface{}) []byte {
+	data, err := counterABI.Pack(method, args...)
+	require.NoError(t, err)
+	return data
+}
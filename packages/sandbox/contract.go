@@ -0,0 +1,105 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Contract is a contract implemented in Go. Call answers eth_call and must
+// leave the contract unchanged. Transact executes a transaction and returns
+// the logs it emits; an error reverts the transaction, so Transact must only
+// change state once it can no longer fail.
+type Contract interface {
+	Call(msg *Message) ([]byte, error)
+	Transact(msg *Message) ([]*types.Log, error)
+}
+
+// Message is a call or transaction sent to a contract
+type Message struct {
+	From        common.Address
+	To          common.Address
+	Value       *big.Int
+	Data        []byte
+	BlockNumber uint64
+	Time        uint64
+
+	// balance is what the contract holds including Value, less what it has
+	// already sent
+	balance   *big.Int
+	transfers []transfer
+}
+
+type transfer struct {
+	to    common.Address
+	value *big.Int
+}
+
+// Send pays value from the contract's balance to an account. The payment is
+// made when the transaction succeeds.
+func (m *Message) Send(to common.Address, value *big.Int) error {
+	if m.balance == nil || m.balance.Cmp(value) < 0 {
+		return Revert("insufficient balance")
+	}
+	m.balance = new(big.Int).Sub(m.balance, value)
+	m.transfers = append(m.transfers, transfer{to: to, value: new(big.Int).Set(value)})
+	return nil
+}
+
+// RevertError is returned for calls and transactions a contract reverted
+type RevertError struct {
+	Reason string
+}
+
+func (e *RevertError) Error() string {
+	if e.Reason == "" {
+		return "execution reverted"
+	}
+	return "execution reverted: " + e.Reason
+}
+
+// Revert returns the error a contract reverts with
+func Revert(reason string) error {
+	return &RevertError{Reason: reason}
+}
+
+// asRevert wraps errors that are not reverts yet
+func asRevert(err error) *RevertError {
+	var revert *RevertError
+	if errors.As(err, &revert) {
+		return revert
+	}
+	return &RevertError{Reason: err.Error()}
+}
+
+// NewLog encodes an event emitted by address. args are the event's inputs in
+// declaration order, indexed ones included.
+func NewLog(address common.Address, event abi.Event, args ...interface{}) (*types.Log, error) {
+	if len(args) != len(event.Inputs) {
+		return nil, fmt.Errorf("event %s takes %d arguments, got %d", event.Name, len(event.Inputs), len(args))
+	}
+
+	topics := []common.Hash{event.ID}
+	var data []interface{}
+	for i, input := range event.Inputs {
+		if !input.Indexed {
+			data = append(data, args[i])
+			continue
+		}
+		topic, err := abi.MakeTopics([]interface{}{args[i]})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s.%s: %w", event.Name, input.Name, err)
+		}
+		topics = append(topics, topic[0][0])
+	}
+
+	packed, err := event.Inputs.NonIndexed().Pack(data...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", event.Name, err)
+	}
+	return &types.Log{Address: address, Topics: topics, Data: packed}, nil
+}
@@ -0,0 +1,210 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job is a task run on a schedule
+type Job struct {
+	Name string
+	// Schedule is a cron expression, a descriptor such as @hourly, or
+	// "@every <duration>"
+	Schedule string
+	// Jitter delays each run by a random amount up to it, so instances of a
+	// service sharing a schedule do not all run at once
+	Jitter time.Duration
+	Run    func(ctx context.Context) error
+}
+
+// Status is what a job is doing and how its runs went
+type Status struct {
+	Name           string     `json:"name"`
+	Schedule       string     `json:"schedule"`
+	Running        bool       `json:"running"`
+	NextRunAt      *time.Time `json:"next_run_at,omitempty"`
+	LastRunAt      *time.Time `json:"last_run_at,omitempty"`
+	LastDurationMS int64      `json:"last_duration_ms"`
+	LastError      string     `json:"last_error,omitempty"`
+	Runs           int64      `json:"runs"`
+	Failures       int64      `json:"failures"`
+	// Skipped counts runs that were due while the previous one was still
+	// running
+	Skipped int64 `json:"skipped"`
+}
+
+// Scheduler runs jobs on their schedules. A job never overlaps itself: a
+// run due while the previous one is still going is skipped.
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    map[string]*entry
+	started bool
+	wg      sync.WaitGroup
+}
+
+type entry struct {
+	job      Job
+	schedule Schedule
+	status   Status
+}
+
+func New() *Scheduler {
+	return &Scheduler{jobs: make(map[string]*entry)}
+}
+
+// Add registers a job. It fails for schedules that do not parse and names
+// already taken, so services can refuse to start with a bad schedule.
+func (s *Scheduler) Add(job Job) error {
+	schedule, err := Parse(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", job.Name, err)
+	}
+	if job.Jitter < 0 {
+		return fmt.Errorf("job %s: jitter must not be negative", job.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return fmt.Errorf("job %s: scheduler already started", job.Name)
+	}
+	if _, ok := s.jobs[job.Name]; ok {
+		return fmt.Errorf("job %s is already scheduled", job.Name)
+	}
+	s.jobs[job.Name] = &entry{job: job, schedule: schedule, status: Status{Name: job.Name, Schedule: job.Schedule}}
+	return nil
+}
+
+// Start runs every job on its schedule until ctx is done
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	for _, e := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(ctx, e)
+	}
+}
+
+// Wait blocks until the jobs have stopped and their last runs returned,
+// after the context Start was given is done
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Scheduler) loop(ctx context.Context, e *entry) {
+	defer s.wg.Done()
+	log.Printf("Scheduled job %s (%s)", e.job.Name, e.job.Schedule)
+
+	next := e.schedule.Next(time.Now())
+	for !next.IsZero() {
+		due := next
+		if e.job.Jitter > 0 {
+			due = due.Add(time.Duration(rand.Int63n(int64(e.job.Jitter))))
+		}
+		s.mu.Lock()
+		e.status.NextRunAt = &due
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		running := e.status.Running
+		if running {
+			e.status.Skipped++
+		} else {
+			e.status.Running = true
+		}
+		s.mu.Unlock()
+		if running {
+			log.Printf("Job %s is still running, skipping the run due at %s", e.job.Name, due.Format(time.RFC3339))
+		} else {
+			s.wg.Add(1)
+			go s.run(ctx, e)
+		}
+
+		// Schedules continue from when the run was due, so an interval
+		// does not drift by how long the timer took to fire
+		next = e.schedule.Next(next)
+		if now := time.Now(); next.Before(now) {
+			next = e.schedule.Next(now)
+		}
+	}
+
+	s.mu.Lock()
+	e.status.NextRunAt = nil
+	s.mu.Unlock()
+	log.Printf("Job %s has no more runs", e.job.Name)
+}
+
+// run runs a job once, recording its outcome. A panic fails the run
+// instead of the service.
+func (s *Scheduler) run(ctx context.Context, e *entry) {
+	defer s.wg.Done()
+	started := time.Now()
+	var err error
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+		err = e.job.Run(ctx)
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.status.Running = false
+	e.status.LastRunAt = &started
+	e.status.LastDurationMS = time.Since(started).Milliseconds()
+	e.status.Runs++
+	e.status.LastError = ""
+	if err != nil {
+		e.status.Failures++
+		e.status.LastError = err.Error()
+		log.Printf("Job %s failed: %v", e.job.Name, err)
+	}
+}
+
+// Jobs returns the status of every job, by name
+func (s *Scheduler) Jobs() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]Status, 0, len(s.jobs))
+	for _, e := range s.jobs {
+		jobs = append(jobs, e.status)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	return jobs
+}
+
+// Handler serves the status of every job as JSON
+func (s *Scheduler) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"jobs": s.Jobs()})
+	}
+}
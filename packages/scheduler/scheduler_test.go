@@ -0,0 +1,171 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func at(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParse(t *testing.T) {
+	t.Run("should find the next run of cron expressions", func(t *testing.T) {
+		from := at("2026-03-14T10:07:30Z") // a Saturday
+		cases := map[string]string{
+			"* * * * *":           "2026-03-14T10:08:00Z",
+			"*/15 * * * *":        "2026-03-14T10:15:00Z",
+			"5 * * * *":           "2026-03-14T11:05:00Z",
+			"0 9-17 * * MON-FRI":  "2026-03-16T09:00:00Z",
+			"30 2 1,15 * *":       "2026-03-15T02:30:00Z",
+			"0 0 1 jan *":         "2027-01-01T00:00:00Z",
+			"0 12 * * 7":          "2026-03-15T12:00:00Z",
+			"0 0 13 * 5":          "2026-03-20T00:00:00Z",
+			"@hourly":             "2026-03-14T11:00:00Z",
+			"@daily":              "2026-03-15T00:00:00Z",
+			"@weekly":             "2026-03-15T00:00:00Z",
+			"@every 90s":          "2026-03-14T10:09:00Z",
+			" 10-20/5 10 14 3 * ": "2026-03-14T10:10:00Z",
+		}
+		for spec, want := range cases {
+			schedule, err := Parse(spec)
+			require.NoError(t, err, spec)
+			assert.Equal(t, at(want), schedule.Next(from), spec)
+		}
+	})
+
+	t.Run("should end schedules that never match", func(t *testing.T) {
+		schedule, err := Parse("0 0 30 2 *")
+		require.NoError(t, err)
+		assert.True(t, schedule.Next(at("2026-01-01T00:00:00Z")).IsZero())
+	})
+
+	t.Run("should reject invalid schedules", func(t *testing.T) {
+		for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *", "@every", "@every -1s", "@sometimes"} {
+			_, err := Parse(spec)
+			assert.Error(t, err, spec)
+		}
+	})
+}
+
+func TestScheduler(t *testing.T) {
+	t.Run("should run jobs and record their outcome", func(t *testing.T) {
+		s := New()
+		runs := make(chan struct{}, 10)
+		require.NoError(t, s.Add(Job{Name: "sync", Schedule: "@every 10ms", Run: func(ctx context.Context) error {
+			runs <- struct{}{}
+			return errors.New("upstream unavailable")
+		}}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.Start(ctx)
+		<-runs
+		<-runs
+		cancel()
+		s.Wait()
+
+		jobs := s.Jobs()
+		require.Len(t, jobs, 1)
+		assert.GreaterOrEqual(t, jobs[0].Runs, int64(2))
+		assert.Equal(t, jobs[0].Runs, jobs[0].Failures)
+		assert.Equal(t, "upstream unavailable", jobs[0].LastError)
+		assert.NotNil(t, jobs[0].LastRunAt)
+	})
+
+	t.Run("should skip runs while the previous one is running", func(t *testing.T) {
+		s := New()
+		release := make(chan struct{})
+		require.NoError(t, s.Add(Job{Name: "slow", Schedule: "@every 5ms", Run: func(ctx context.Context) error {
+			<-release
+			return nil
+		}}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.Start(ctx)
+		require.Eventually(t, func() bool { return s.Jobs()[0].Skipped >= 2 }, time.Second, 5*time.Millisecond)
+		status := s.Jobs()[0]
+		assert.True(t, status.Running)
+		assert.Zero(t, status.Runs)
+
+		close(release)
+		cancel()
+		s.Wait()
+		assert.Equal(t, int64(1), s.Jobs()[0].Runs)
+	})
+
+	t.Run("should fail runs that panic", func(t *testing.T) {
+		s := New()
+		require.NoError(t, s.Add(Job{Name: "broken", Schedule: "@every 5ms", Run: func(ctx context.Context) error {
+			panic("nil map")
+		}}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.Start(ctx)
+		require.Eventually(t, func() bool { return s.Jobs()[0].Failures >= 1 }, time.Second, 5*time.Millisecond)
+		cancel()
+		s.Wait()
+		assert.Equal(t, "panic: nil map", s.Jobs()[0].LastError)
+	})
+
+	t.Run("should delay runs by up to the jitter", func(t *testing.T) {
+		s := New()
+		require.NoError(t, s.Add(Job{Name: "report", Schedule: "@hourly", Jitter: time.Minute, Run: func(ctx context.Context) error { return nil }}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.Start(ctx)
+		require.Eventually(t, func() bool { return s.Jobs()[0].NextRunAt != nil }, time.Second, 5*time.Millisecond)
+		cancel()
+		s.Wait()
+
+		next := *s.Jobs()[0].NextRunAt
+		hour := next.Truncate(time.Hour)
+		assert.Less(t, next.Sub(hour), time.Minute)
+	})
+
+	t.Run("should reject bad schedules and duplicate names", func(t *testing.T) {
+		s := New()
+		noop := func(ctx context.Context) error { return nil }
+		assert.Error(t, s.Add(Job{Name: "a", Schedule: "every minute", Run: noop}))
+		assert.Error(t, s.Add(Job{Name: "a", Schedule: "@hourly", Jitter: -time.Second, Run: noop}))
+		require.NoError(t, s.Add(Job{Name: "a", Schedule: "@hourly", Run: noop}))
+		assert.Error(t, s.Add(Job{Name: "a", Schedule: "@daily", Run: noop}))
+	})
+}
+
+func TestHandler(t *testing.T) {
+	t.Run("should list jobs by name", func(t *testing.T) {
+		s := New()
+		noop := func(ctx context.Context) error { return nil }
+		require.NoError(t, s.Add(Job{Name: "price_update", Schedule: "@every 30s", Run: noop}))
+		require.NoError(t, s.Add(Job{Name: "health_check", Schedule: "*/5 * * * *", Run: noop}))
+
+		w := httptest.NewRecorder()
+		s.Handler()(w, httptest.NewRequest(http.MethodGet, "/api/jobs", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Jobs []Status `json:"jobs"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.Len(t, response.Jobs, 2)
+		assert.Equal(t, "health_check", response.Jobs[0].Name)
+		assert.Equal(t, "*/5 * * * *", response.Jobs[0].Schedule)
+		assert.Equal(t, "price_update", response.Jobs[1].Name)
+
+		w = httptest.NewRecorder()
+		s.Handler()(w, httptest.NewRequest(http.MethodPost, "/api/jobs", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
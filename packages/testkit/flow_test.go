@@ -0,0 +1,73 @@
+package testkit
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentFlow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the services")
+	}
+	stack := Start(t)
+
+	t.Run("should create a payment whose receipt verifies on chain", func(t *testing.T) {
+		var created struct {
+			PaymentID  int64  `json:"payment_id"`
+			TxHash     string `json:"tx_hash"`
+			ReceiptCID string `json:"receipt_cid"`
+		}
+		status := stack.PaymentProcessor.Do(t, http.MethodPost, "/api/payments/create", map[string]string{
+			"sender":    "0x00000000000000000000000000000000000000a1",
+			"recipient": "0x00000000000000000000000000000000000000b2",
+			"token":     "0x0000000000000000000000000000000000000000",
+			"amount":    "1000000",
+		}, &created)
+		require.Equal(t, http.StatusCreated, status)
+		require.NotEmpty(t, created.ReceiptCID, "the receipt is generated with the payment")
+
+		var verdict struct {
+			Verdict string `json:"verdict"`
+			Checks  []struct {
+				Name   string `json:"name"`
+				Status string `json:"status"`
+				Detail string `json:"detail"`
+			} `json:"checks"`
+			Payment struct {
+				ID      int64  `json:"id"`
+				TxHash  string `json:"tx_hash"`
+				Amount  string `json:"amount"`
+				ChainID int    `json:"chain_id"`
+			} `json:"payment"`
+		}
+		status = stack.StorageWorker.Do(t, http.MethodGet, "/verify/"+created.ReceiptCID, nil, &verdict)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "valid", verdict.Verdict, "%+v", verdict.Checks)
+		assert.Equal(t, created.PaymentID, verdict.Payment.ID)
+		assert.Equal(t, created.TxHash, verdict.Payment.TxHash)
+		assert.Equal(t, "1000000", verdict.Payment.Amount)
+		assert.Equal(t, ChainID, verdict.Payment.ChainID)
+	})
+
+	t.Run("should answer errors as problems across services", func(t *testing.T) {
+		var problem struct {
+			Code   string `json:"code"`
+			Status int    `json:"status"`
+		}
+		status := stack.PaymentProcessor.Do(t, http.MethodPost, "/api/payments/create", map[string]string{
+			"sender":    "0x00000000000000000000000000000000000000a1",
+			"recipient": "0x52908400098527886E0F7030069857D2E4169Ee7",
+			"token":     "0x0000000000000000000000000000000000000000",
+			"amount":    "1000",
+		}, &problem)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "invalid_checksum", problem.Code)
+
+		status = stack.StorageWorker.Do(t, http.MethodGet, "/api/receipts/download/", nil, &problem)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, http.StatusBadRequest, problem.Status)
+	})
+}
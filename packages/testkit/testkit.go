@@ -0,0 +1,274 @@
+// Package testkit boots the payment services together for end-to-end
+// tests: payment-processor on its sandbox chain, storage-worker storing
+// receipts in memory instead of on Filecoin, oracle-service and
+// ens-resolver on their mock data. Each service is built from its module,
+// since services are main packages, and run on an ephemeral port with its
+// state in the test's temporary directory, so nothing outside the test is
+// touched and every test gets a fresh stack.
+package testkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Names of the services a stack runs
+const (
+	PaymentProcessor = "payment-processor"
+	StorageWorker    = "storage-worker"
+	OracleService    = "oracle-service"
+	ENSResolver      = "ens-resolver"
+)
+
+// The sandbox chain payments are made on, and its PaymentCore
+const (
+	ChainID     = 31337
+	PaymentCore = "0x5fbdb2315678afecb367f032d93f642f64180aa3"
+)
+
+// StartTimeout is how long a service has to answer its health check
+var StartTimeout = 60 * time.Second
+
+// Service is a running service
+type Service struct {
+	Name string
+	// URL is the service's base URL, such as http://127.0.0.1:41234
+	URL string
+
+	port int
+	cmd  *exec.Cmd
+	logs *syncBuffer
+	done chan struct{}
+}
+
+// Logs returns what the service has logged so far
+func (s *Service) Logs() string {
+	return s.logs.String()
+}
+
+// Stack is the running services, wired to each other
+type Stack struct {
+	PaymentProcessor *Service
+	StorageWorker    *Service
+	OracleService    *Service
+	ENSResolver      *Service
+}
+
+// Start builds and starts the stack, and stops it when t ends. Services are
+// started in dependency order, each once its dependencies are healthy, and
+// storage-worker verifies receipts against the payment processor's sandbox
+// chain. The logs of every service are printed when t fails.
+func Start(t testing.TB) *Stack {
+	t.Helper()
+	root := repositoryRoot(t)
+	dir := t.TempDir()
+
+	stack := &Stack{
+		PaymentProcessor: newService(t, PaymentProcessor),
+		StorageWorker:    newService(t, StorageWorker),
+		OracleService:    newService(t, OracleService),
+		ENSResolver:      newService(t, ENSResolver),
+	}
+	stack.OracleService.start(t, root, dir, nil)
+	stack.ENSResolver.start(t, root, dir, nil)
+	stack.StorageWorker.start(t, root, dir, map[string]string{
+		"DATABASE_PATH":                  filepath.Join(dir, "storage.db"),
+		"ORACLE_SERVICE_URL":             stack.OracleService.URL,
+		"RECEIPT_CHAIN_RPC_URLS":         fmt.Sprintf("%d=%s/sandbox/rpc", ChainID, stack.PaymentProcessor.URL),
+		"RECEIPT_PAYMENT_CORE_ADDRESSES": fmt.Sprintf("%d=%s", ChainID, PaymentCore),
+	})
+	stack.PaymentProcessor.start(t, root, dir, map[string]string{
+		"DATABASE_PATH":        filepath.Join(dir, "payments.db"),
+		"SANDBOX":              "true",
+		"SANDBOX_GENESIS_TIME": "1767225600",
+		"CHAIN_ID":             strconv.Itoa(ChainID),
+		"PAYMENT_CORE_ADDRESS": PaymentCore,
+		"STORAGE_SERVICE_URL":  stack.StorageWorker.URL,
+		"ORACLE_SERVICE_URL":   stack.OracleService.URL,
+		"ENS_SERVICE_URL":      stack.ENSResolver.URL,
+	})
+	return stack
+}
+
+// newService takes a free port for the service name, so services can be
+// pointed at each other before they start
+func newService(t testing.TB, name string) *Service {
+	t.Helper()
+	port, err := freePort()
+	if err != nil {
+		t.Fatalf("testkit: no free port for %s: %v", name, err)
+	}
+	return &Service{
+		Name: name,
+		URL:  fmt.Sprintf("http://127.0.0.1:%d", port),
+		port: port,
+		logs: &syncBuffer{},
+		done: make(chan struct{}),
+	}
+}
+
+// start builds the service into dir and runs it with env, from its
+// directory so its relative paths resolve
+func (s *Service) start(t testing.TB, root, dir string, env map[string]string) {
+	t.Helper()
+	binary := filepath.Join(dir, s.Name)
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Dir = filepath.Join(root, "services", s.Name)
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("testkit: failed to build %s: %v\n%s", s.Name, err, output)
+	}
+
+	s.cmd = exec.Command(binary)
+	s.cmd.Dir = build.Dir
+	s.cmd.Env = append(os.Environ(), fmt.Sprintf("PORT=%d", s.port))
+	for key, value := range env {
+		s.cmd.Env = append(s.cmd.Env, key+"="+value)
+	}
+	s.cmd.Stdout, s.cmd.Stderr = s.logs, s.logs
+	if err := s.cmd.Start(); err != nil {
+		t.Fatalf("testkit: failed to start %s: %v", s.Name, err)
+	}
+	go func() {
+		s.cmd.Wait()
+		close(s.done)
+	}()
+	t.Cleanup(func() {
+		s.stop()
+		if t.Failed() {
+			t.Logf("testkit: %s logs:\n%s", s.Name, s.Logs())
+		}
+	})
+
+	if err := s.waitHealthy(); err != nil {
+		t.Fatalf("testkit: %s did not start: %v\n%s", s.Name, err, s.Logs())
+	}
+}
+
+// waitHealthy polls the service's /health until it answers 200
+func (s *Service) waitHealthy() error {
+	deadline := time.Now().Add(StartTimeout)
+	client := &http.Client{Timeout: time.Second}
+	for {
+		resp, err := client.Get(s.URL + "/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("health check answered %d", resp.StatusCode)
+		}
+		select {
+		case <-s.done:
+			return fmt.Errorf("exited: %v", s.cmd.ProcessState)
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no healthy answer after %s: %w", StartTimeout, err)
+		}
+	}
+}
+
+// stop interrupts the service, killing it when it does not shut down
+func (s *Service) stop() {
+	s.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		s.cmd.Process.Kill()
+		<-s.done
+	}
+}
+
+// Do sends a request with a JSON body, when body is not nil, to the
+// service's path and decodes a JSON answer into out, when out is not nil.
+// It returns the answer's status.
+func (s *Service) Do(t testing.TB, method, path string, body, out interface{}) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("testkit: failed to encode %s %s: %v", method, path, err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		t.Fatalf("testkit: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("testkit: %s %s %s: %v", s.Name, method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("testkit: failed to read %s %s %s: %v", s.Name, method, path, err)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("testkit: %s %s %s answered %d with %q: %v", s.Name, method, path, resp.StatusCode, data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// repositoryRoot is the directory holding services and packages
+func repositoryRoot(t testing.TB) string {
+	t.Helper()
+	if root := os.Getenv("CROSSPAY_ROOT"); root != "" {
+		return root
+	}
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("testkit: cannot locate the repository, set CROSSPAY_ROOT")
+	}
+	return filepath.Join(filepath.Dir(file), "..", "..")
+}
+
+// freePort returns a port nothing listens on
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// syncBuffer collects a service's output, which its process writes while
+// tests read it
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,317 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client reads the query API of the analytics service, which ingests and
+// stores every metric. The dashboard keeps no metrics of its own.
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// ErrNotFound is returned for anything the analytics service has no
+// metrics for
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalidQuery is returned for queries the analytics service rejects
+var ErrInvalidQuery = errors.New("invalid query")
+
+// apiResponse is the envelope of every analytics service response
+type apiResponse struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Dashboard is the analytics service dashboard, counted over the last 24
+// hours (validators over the last hour)
+type Dashboard struct {
+	PaymentStats    map[string]int64 `json:"payment_stats"`
+	ValidatorStats  map[string]int64 `json:"validator_stats"`
+	PaymentsPrivacy map[string]int64 `json:"payments_by_is_private"`
+}
+
+// ValidatorStats is a validator's row of the leaderboard
+type ValidatorStats struct {
+	Rank              int         `json:"rank"`
+	ValidatorAddress  string      `json:"validator_address"`
+	ChainID           string      `json:"chain_id"`
+	Stake             string      `json:"stake"`
+	Status            string      `json:"status"`
+	LastSeen          time.Time   `json:"last_seen"`
+	Uptime            float64     `json:"uptime"`
+	AvgResponseTimeMs float64     `json:"avg_response_time_ms"`
+	Signatures        int64       `json:"signatures"`
+	Participation     float64     `json:"participation_rate"`
+	Slashes           int64       `json:"slashes"`
+	SlashHistory      []time.Time `json:"slash_history"`
+	Score             float64     `json:"score"`
+	RecommendedWeight float64     `json:"recommended_weight"`
+	SLAMet            bool        `json:"sla_met"`
+}
+
+// TrancheRisk is a vault tranche's state and losses over a window
+type TrancheRisk struct {
+	TrancheType    string  `json:"tranche_type"`
+	TotalAssets    string  `json:"total_assets"`
+	APY            float64 `json:"apy"`
+	RiskScore      float64 `json:"risk_score"`
+	UtilizationPct float64 `json:"utilization_pct"`
+	MaxDrawdownPct float64 `json:"max_drawdown_pct"`
+}
+
+// VaultSlashing is one slashing of a vault and its loss per tranche
+type VaultSlashing struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Amount    string            `json:"amount"`
+	Losses    map[string]string `json:"losses"`
+}
+
+// VaultRisk is a vault's tranches and slashings over a window
+type VaultRisk struct {
+	Tranches  []TrancheRisk   `json:"tranches"`
+	Slashings []VaultSlashing `json:"slashings"`
+}
+
+// ChainState is a chain's indexing progress and the state last read from
+// its contracts
+type ChainState struct {
+	ChainID          uint64       `json:"chain_id"`
+	Healthy          bool         `json:"healthy"`
+	Error            string       `json:"error,omitempty"`
+	HeadBlock        uint64       `json:"head_block"`
+	IndexedBlock     uint64       `json:"indexed_block"`
+	PaymentCount     uint64       `json:"payment_count"`
+	ValidationCount  uint64       `json:"validation_count"`
+	ActiveValidators []string     `json:"active_validators"`
+	TotalStake       string       `json:"total_stake"`
+	Vaults           []VaultState `json:"vaults"`
+}
+
+// VaultState is a vault's totals, read from the contract
+type VaultState struct {
+	Address        string `json:"address"`
+	TotalAssets    string `json:"total_assets"`
+	InsuranceFund  string `json:"insurance_fund"`
+	SlashingEvents uint64 `json:"slashing_events"`
+}
+
+// DisclosureSummary counts the disclosure audit log entries of a window by
+// status, and the requests by scope
+type DisclosureSummary struct {
+	ByStatus map[string]int64 `json:"by_status"`
+	ByScope  map[string]int64 `json:"by_scope"`
+}
+
+// HistoryQuery is a chart of one metric, aggregated over each interval of
+// a time range. Metrics are named measurement.field, as the analytics
+// service lists them.
+type HistoryQuery struct {
+	Metric      string
+	From        time.Time
+	To          time.Time
+	Interval    time.Duration
+	Aggregation string
+	ChainID     string
+	GroupBy     string
+}
+
+// Series is a metric's values over time, one per interval. Grouped queries
+// name each series after its tag value.
+type Series struct {
+	Name   string  `json:"name"`
+	Points []Point `json:"points"`
+}
+
+// Point is an interval's aggregated value
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// NewClient reads the analytics service at baseURL, authenticating with
+// token when it is set
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Dashboard fetches the dashboard
+func (c *Client) Dashboard(ctx context.Context) (*Dashboard, error) {
+	var dashboard Dashboard
+	if err := c.get(ctx, "/api/dashboard", nil, &dashboard); err != nil {
+		return nil, err
+	}
+	return &dashboard, nil
+}
+
+// Leaderboard fetches the validators over window, ranked by score, on one
+// chain if chainID is set
+func (c *Client) Leaderboard(ctx context.Context, window, chainID string) ([]ValidatorStats, error) {
+	query := url.Values{"window": {window}, "limit": {"1000"}}
+	if chainID != "" {
+		query.Set("chain_id", chainID)
+	}
+	var leaderboard struct {
+		Validators []ValidatorStats `json:"validators"`
+	}
+	if err := c.get(ctx, "/api/validators/leaderboard", query, &leaderboard); err != nil {
+		return nil, err
+	}
+	return leaderboard.Validators, nil
+}
+
+// VaultRisk fetches a vault's tranches and slashings over window
+func (c *Client) VaultRisk(ctx context.Context, address, chainID, window string) (*VaultRisk, error) {
+	query := url.Values{"chain_id": {chainID}, "window": {window}}
+	var risk VaultRisk
+	if err := c.get(ctx, "/api/vaults/"+url.PathEscape(address)+"/risk", query, &risk); err != nil {
+		return nil, err
+	}
+	return &risk, nil
+}
+
+// Chains fetches the state of every chain the analytics service indexes
+func (c *Client) Chains(ctx context.Context) ([]ChainState, error) {
+	var chains []ChainState
+	if err := c.get(ctx, "/api/chains", nil, &chains); err != nil {
+		return nil, err
+	}
+	return chains, nil
+}
+
+// DisclosureSummary fetches the disclosures recorded over window
+func (c *Client) DisclosureSummary(ctx context.Context, window string) (*DisclosureSummary, error) {
+	var summary DisclosureSummary
+	if err := c.get(ctx, "/api/disclosures/summary", url.Values{"window": {window}}, &summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// HistoryMetrics lists the metrics History can chart
+func (c *Client) HistoryMetrics(ctx context.Context) ([]string, error) {
+	var metrics []string
+	if err := c.do(ctx, http.MethodGet, "/api/grafana/search", nil, nil, &metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// History fetches a metric's series from the analytics service's Grafana
+// datasource API, which reads rollups for long ranges
+func (c *Client) History(ctx context.Context, query HistoryQuery) ([]Series, error) {
+	payload := map[string]string{"aggregate": query.Aggregation}
+	if query.ChainID != "" {
+		payload["chain_id"] = query.ChainID
+	}
+	if query.GroupBy != "" {
+		payload["group_by"] = query.GroupBy
+	}
+	body := map[string]interface{}{
+		"range":      map[string]time.Time{"from": query.From, "to": query.To},
+		"intervalMs": query.Interval.Milliseconds(),
+		"targets":    []map[string]interface{}{{"target": query.Metric, "refId": "A", "payload": payload}},
+	}
+
+	var grafanaSeries []struct {
+		Target     string       `json:"target"`
+		Datapoints [][2]float64 `json:"datapoints"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/grafana/query", nil, body, &grafanaSeries); err != nil {
+		return nil, err
+	}
+
+	series := make([]Series, len(grafanaSeries))
+	for i, s := range grafanaSeries {
+		series[i] = Series{Name: s.Target, Points: make([]Point, len(s.Datapoints))}
+		for j, datapoint := range s.Datapoints {
+			series[i].Points[j] = Point{Timestamp: time.UnixMilli(int64(datapoint[1])).UTC(), Value: datapoint[0]}
+		}
+	}
+	return series, nil
+}
+
+// EventsURL is the WebSocket URL of the analytics service event stream
+func (c *Client) EventsURL() string {
+	events := strings.Replace(c.baseURL, "http", "ws", 1) + "/ws"
+	if c.token != "" {
+		events += "?token=" + url.QueryEscape(c.token)
+	}
+	return events
+}
+
+// get fetches an endpoint that wraps its data in the response envelope
+func (c *Client) get(ctx context.Context, path string, query url.Values, data interface{}) error {
+	var envelope apiResponse
+	if err := c.do(ctx, http.MethodGet, path, query, nil, &envelope); err != nil {
+		return err
+	}
+	if !envelope.Success {
+		return fmt.Errorf("analytics service error for %s: %s", path, envelope.Error)
+	}
+	return json.Unmarshal(envelope.Data, data)
+}
+
+// do sends a request, with body encoded as JSON if set, and decodes the
+// response into out
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	endpoint := c.baseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusBadRequest:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%w: %s", ErrInvalidQuery, strings.TrimSpace(string(message)))
+	default:
+		return fmt.Errorf("analytics service returned status %d for %s", resp.StatusCode, path)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return nil
+}
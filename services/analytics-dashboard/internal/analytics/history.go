@@ -0,0 +1,143 @@
+package analytics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHistoryRange is the longest range a chart can cover
+	maxHistoryRange = 365 * 24 * time.Hour
+	// maxHistoryPoints caps the intervals of a chart, per series
+	maxHistoryPoints = 1000
+	// defaultHistoryPoints is roughly how many intervals a chart has when
+	// no interval is given
+	defaultHistoryPoints = 120
+)
+
+// historyAggregations are how each interval's values can be combined
+var historyAggregations = []string{"mean", "max", "min", "sum", "count", "last"}
+
+// GetHistoryMetrics lists the metrics /metrics/history can chart
+func (s *Service) GetHistoryMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics, err := s.client.HistoryMetrics(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch history metrics: %v", err)
+		http.Error(w, "Analytics service unavailable", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"metrics":      metrics,
+		"aggregations": historyAggregations,
+	})
+}
+
+// GetHistory charts a metric over ?range= (default 24h), one point per
+// ?interval= aggregated with ?aggregation= (default mean). The series are
+// restricted to ?chain_id=, or the configured chain, and split by the tag
+// ?group_by= if set.
+func (s *Service) GetHistory(w http.ResponseWriter, r *http.Request) {
+	query, err := s.historyQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series, err := s.client.History(r.Context(), query)
+	if errors.Is(err, ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch history of %s: %v", query.Metric, err)
+		http.Error(w, "Analytics service unavailable", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"metric":      query.Metric,
+		"from":        query.From,
+		"to":          query.To,
+		"interval":    query.Interval.String(),
+		"aggregation": query.Aggregation,
+		"series":      series,
+	})
+}
+
+func (s *Service) historyQuery(r *http.Request) (HistoryQuery, error) {
+	params := r.URL.Query()
+	query := HistoryQuery{
+		Metric:      r.PathValue("metric"),
+		Aggregation: params.Get("aggregation"),
+		ChainID:     params.Get("chain_id"),
+		GroupBy:     params.Get("group_by"),
+	}
+
+	rng := 24 * time.Hour
+	if value := params.Get("range"); value != "" {
+		parsed, err := parseSpan(value)
+		if err != nil || parsed <= 0 || parsed > maxHistoryRange {
+			return query, fmt.Errorf("invalid range %q", value)
+		}
+		rng = parsed
+	}
+
+	query.Interval = (rng / defaultHistoryPoints).Truncate(time.Minute)
+	if query.Interval < time.Minute {
+		query.Interval = time.Minute
+	}
+	if value := params.Get("interval"); value != "" {
+		parsed, err := parseSpan(value)
+		if err != nil || parsed < time.Second {
+			return query, fmt.Errorf("invalid interval %q", value)
+		}
+		query.Interval = parsed
+	}
+	if rng/query.Interval > maxHistoryPoints {
+		return query, fmt.Errorf("interval %s gives more than %d points over %s", query.Interval, maxHistoryPoints, rng)
+	}
+
+	if query.Aggregation == "" {
+		query.Aggregation = "mean"
+	}
+	if !contains(historyAggregations, query.Aggregation) {
+		return query, fmt.Errorf("invalid aggregation %q", query.Aggregation)
+	}
+	if query.ChainID == "" {
+		query.ChainID = s.config.ChainID
+	}
+
+	query.To = time.Now().UTC().Truncate(time.Second)
+	query.From = query.To.Add(-rng)
+	return query, nil
+}
+
+// parseSpan parses a Go duration, or a whole number of days such as 7d
+func parseSpan(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,51 +1,91 @@
 package analytics
 
 import (
+	"context"
 	"encoding/json"
+	"log"
+	"math/big"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/crosspay/analytics-dashboard/internal/metrics"
 )
 
+// Service serves the dashboard's /metrics endpoints from the analytics
+// service. It is an adapter that keeps their response shapes while clients
+// move to the analytics service API.
 type Service struct {
-	collector MetricsCollector
+	client *Client
+	config Config
 }
 
-type MetricsCollector interface {
-	GetValidatorMetrics() map[string]*metrics.ValidatorMetrics
-	GetVaultMetrics() *metrics.VaultMetrics
-	GetPaymentMetrics() *metrics.PaymentMetrics
-	GetPrivacyMetrics() *metrics.PrivacyMetrics
-	GetNetworkMetrics() *metrics.NetworkMetrics
-	IsCollecting() bool
+// Config selects what the dashboard shows
+type Config struct {
+	// ChainID restricts validators to one chain, and is the chain of the
+	// vault
+	ChainID string
+	// VaultAddress is the vault shown by /metrics/vault
+	VaultAddress string
 }
 
 type DashboardResponse struct {
-	Timestamp        time.Time                           `json:"timestamp"`
+	Timestamp        time.Time                            `json:"timestamp"`
 	ValidatorMetrics map[string]*metrics.ValidatorMetrics `json:"validator_metrics"`
-	VaultMetrics     *metrics.VaultMetrics               `json:"vault_metrics"`
-	PaymentMetrics   *metrics.PaymentMetrics             `json:"payment_metrics"`
-	PrivacyMetrics   *metrics.PrivacyMetrics             `json:"privacy_metrics"`
-	NetworkMetrics   *metrics.NetworkMetrics             `json:"network_metrics"`
-	SystemStatus     string                              `json:"system_status"`
+	VaultMetrics     *metrics.VaultMetrics                `json:"vault_metrics"`
+	PaymentMetrics   *metrics.PaymentMetrics              `json:"payment_metrics"`
+	PrivacyMetrics   *metrics.PrivacyMetrics              `json:"privacy_metrics"`
+	NetworkMetrics   *metrics.NetworkMetrics              `json:"network_metrics"`
+	SystemStatus     string                               `json:"system_status"`
 }
 
-func NewService(collector MetricsCollector) *Service {
+func NewService(client *Client, config Config) *Service {
 	return &Service{
-		collector: collector,
+		client: client,
+		config: config,
 	}
 }
 
 func (s *Service) GetMetrics(w http.ResponseWriter, r *http.Request) {
-	response := DashboardResponse{
-		Timestamp:        time.Now(),
-		ValidatorMetrics: s.collector.GetValidatorMetrics(),
-		VaultMetrics:     s.collector.GetVaultMetrics(),
-		PaymentMetrics:   s.collector.GetPaymentMetrics(),
-		PrivacyMetrics:   s.collector.GetPrivacyMetrics(),
-		NetworkMetrics:   s.collector.GetNetworkMetrics(),
-		SystemStatus:     s.getSystemStatus(),
+	response := DashboardResponse{Timestamp: time.Now(), SystemStatus: "healthy"}
+
+	validators, err := s.validators(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch validator metrics: %v", err)
+		response.SystemStatus = "degraded"
+	}
+	response.ValidatorMetrics = validatorMetrics(validators)
+	response.NetworkMetrics = networkMetrics(validators)
+
+	chain, err := s.chain(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch chain state: %v", err)
+		response.SystemStatus = "degraded"
+	}
+	if chain != nil {
+		applyChainState(response.NetworkMetrics, chain)
+		if !chain.Healthy {
+			response.SystemStatus = "degraded"
+		}
+	}
+
+	if response.VaultMetrics, err = s.vault(r.Context()); err != nil {
+		log.Printf("Failed to fetch vault metrics: %v", err)
+		response.SystemStatus = "degraded"
+	}
+
+	dashboard, err := s.client.Dashboard(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch dashboard: %v", err)
+		response.SystemStatus = "degraded"
+		dashboard = &Dashboard{}
+	}
+	response.PaymentMetrics = paymentMetrics(dashboard, validators)
+	response.PrivacyMetrics = privacyMetrics(dashboard, s.disclosures(r.Context()))
+
+	if response.SystemStatus == "healthy" {
+		response.SystemStatus = s.getSystemStatus(response.NetworkMetrics)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -53,11 +93,17 @@ func (s *Service) GetMetrics(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Service) GetValidatorMetrics(w http.ResponseWriter, r *http.Request) {
-	metrics := s.collector.GetValidatorMetrics()
+	validators, err := s.validators(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch validator metrics: %v", err)
+		http.Error(w, "Analytics service unavailable", http.StatusBadGateway)
+		return
+	}
+	metrics := validatorMetrics(validators)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"timestamp": time.Now(),
+		"timestamp":  time.Now(),
 		"validators": metrics,
 		"summary": map[string]interface{}{
 			"total_validators": len(metrics),
@@ -68,65 +114,306 @@ func (s *Service) GetValidatorMetrics(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Service) GetVaultMetrics(w http.ResponseWriter, r *http.Request) {
-	metrics := s.collector.GetVaultMetrics()
+	metrics, err := s.vault(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch vault metrics: %v", err)
+		http.Error(w, "Analytics service unavailable", http.StatusBadGateway)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"timestamp": time.Now(),
 		"vault":     metrics,
 		"health": map[string]interface{}{
-			"is_balanced":     s.isVaultBalanced(metrics),
-			"risk_level":      s.calculateRiskLevel(metrics),
-			"yield_trending":  "stable",
+			"is_balanced":    s.isVaultBalanced(metrics),
+			"risk_level":     s.calculateRiskLevel(metrics),
+			"yield_trending": "stable",
 		},
 	})
 }
 
 func (s *Service) GetPaymentMetrics(w http.ResponseWriter, r *http.Request) {
-	metrics := s.collector.GetPaymentMetrics()
+	dashboard, err := s.client.Dashboard(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch dashboard: %v", err)
+		http.Error(w, "Analytics service unavailable", http.StatusBadGateway)
+		return
+	}
+	validators, err := s.validators(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch validator metrics: %v", err)
+	}
+	metrics := paymentMetrics(dashboard, validators)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"timestamp": time.Now(),
 		"payments":  metrics,
 		"trends": map[string]interface{}{
-			"hourly_volume":  "increasing",
-			"privacy_adoption": (float64(metrics.PrivatePayments) / float64(metrics.TotalPayments)) * 100,
+			"hourly_volume":          "increasing",
+			"privacy_adoption":       percent(metrics.PrivatePayments, metrics.TotalPayments),
 			"validation_performance": metrics.SuccessRate,
 		},
 	})
 }
 
 func (s *Service) GetPrivacyMetrics(w http.ResponseWriter, r *http.Request) {
-	metrics := s.collector.GetPrivacyMetrics()
+	dashboard, err := s.client.Dashboard(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch dashboard: %v", err)
+		http.Error(w, "Analytics service unavailable", http.StatusBadGateway)
+		return
+	}
+	metrics := privacyMetrics(dashboard, s.disclosures(r.Context()))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"timestamp": time.Now(),
 		"privacy":   metrics,
 		"insights": map[string]interface{}{
-			"disclosure_approval_rate": (float64(metrics.ApprovedDisclosures) / float64(metrics.DisclosureRequests)) * 100,
+			"disclosure_approval_rate": percent(metrics.ApprovedDisclosures, metrics.DisclosureRequests),
 			"grant_participation":      metrics.SealedBidGrants,
 			"privacy_trend":            "growing",
 		},
 	})
 }
 
-func (s *Service) getSystemStatus() string {
-	if !s.collector.IsCollecting() {
-		return "degraded"
+// validators fetches the validators over the last 24 hours
+func (s *Service) validators(ctx context.Context) ([]ValidatorStats, error) {
+	return s.client.Leaderboard(ctx, "24h", s.config.ChainID)
+}
+
+// disclosures fetches the disclosures of the last 24 hours. The audit log
+// needs a database the analytics service may not have, so without it the
+// counts are left at zero.
+func (s *Service) disclosures(ctx context.Context) *DisclosureSummary {
+	summary, err := s.client.DisclosureSummary(ctx, "24h")
+	if err != nil {
+		log.Printf("Failed to fetch disclosure summary: %v", err)
+		return nil
 	}
+	return summary
+}
 
-	networkMetrics := s.collector.GetNetworkMetrics()
-	if networkMetrics.NetworkUptime < 95.0 {
-		return "degraded"
+// chain fetches the state of the configured chain, or nil when none is
+// configured or the analytics service does not index it
+func (s *Service) chain(ctx context.Context) (*ChainState, error) {
+	if s.config.ChainID == "" {
+		return nil, nil
 	}
+	chains, err := s.client.Chains(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range chains {
+		if strconv.FormatUint(chains[i].ChainID, 10) == s.config.ChainID {
+			return &chains[i], nil
+		}
+	}
+	return nil, nil
+}
 
-	validatorMetrics := s.collector.GetValidatorMetrics()
-	if len(validatorMetrics) < 3 {
-		return "warning"
+// vault fetches the configured vault over the last 30 days. Without one, or
+// before it has reported, the metrics are empty.
+func (s *Service) vault(ctx context.Context) (*metrics.VaultMetrics, error) {
+	vault := &metrics.VaultMetrics{
+		TotalTVL:         "0",
+		JuniorTVL:        "0",
+		MezzanineTVL:     "0",
+		SeniorTVL:        "0",
+		InsuranceFund:    "0",
+		SlashingEvents:   []metrics.SlashingEvent{},
+		UtilizationRates: make(map[string]float64),
+	}
+	if s.config.VaultAddress == "" || s.config.ChainID == "" {
+		return vault, nil
+	}
+	risk, err := s.client.VaultRisk(ctx, s.config.VaultAddress, s.config.ChainID, "30d")
+	if err == ErrNotFound {
+		return vault, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
+	total := new(big.Int)
+	for _, tranche := range risk.Tranches {
+		balance, ok := new(big.Int).SetString(tranche.TotalAssets, 10)
+		if !ok {
+			continue
+		}
+		total.Add(total, balance)
+		vault.UtilizationRates[tranche.TrancheType] = tranche.UtilizationPct
+		switch tranche.TrancheType {
+		case "junior":
+			vault.JuniorTVL, vault.JuniorAPY = tranche.TotalAssets, tranche.APY
+		case "mezzanine":
+			vault.MezzanineTVL, vault.MezzanineAPY = tranche.TotalAssets, tranche.APY
+		case "senior":
+			vault.SeniorTVL, vault.SeniorAPY = tranche.TotalAssets, tranche.APY
+		}
+	}
+	vault.TotalTVL = total.String()
+
+	// the insurance fund is only read from the contract
+	chain, err := s.chain(ctx)
+	if err != nil {
+		log.Printf("Failed to fetch chain state: %v", err)
+	}
+	if chain != nil {
+		for _, state := range chain.Vaults {
+			if strings.EqualFold(state.Address, s.config.VaultAddress) {
+				vault.InsuranceFund = state.InsuranceFund
+			}
+		}
+	}
+
+	for i, slashing := range risk.Slashings {
+		vault.SlashingEvents = append(vault.SlashingEvents, metrics.SlashingEvent{
+			EventID:          uint64(i + 1),
+			Amount:           slashing.Amount,
+			Timestamp:        slashing.Timestamp,
+			JuniorSlashed:    lossOf(slashing, "junior"),
+			MezzanineSlashed: lossOf(slashing, "mezzanine"),
+			SeniorSlashed:    lossOf(slashing, "senior"),
+		})
+	}
+	return vault, nil
+}
+
+func lossOf(slashing VaultSlashing, tranche string) string {
+	if loss, ok := slashing.Losses[tranche]; ok {
+		return loss
+	}
+	return "0"
+}
+
+// validatorMetrics keys validators by address. A validator on several
+// chains is shown as its best ranked one.
+func validatorMetrics(validators []ValidatorStats) map[string]*metrics.ValidatorMetrics {
+	result := make(map[string]*metrics.ValidatorMetrics)
+	for _, v := range validators {
+		if _, ok := result[v.ValidatorAddress]; ok {
+			continue
+		}
+		result[v.ValidatorAddress] = &metrics.ValidatorMetrics{
+			Address:          v.ValidatorAddress,
+			Stake:            v.Stake,
+			Uptime:           v.Uptime * 100,
+			ValidationCount:  uint64(v.Signatures),
+			SlashCount:       uint64(v.Slashes),
+			LastActivity:     v.LastSeen,
+			Status:           v.Status,
+			PerformanceScore: v.Score,
+		}
+	}
+	return result
+}
+
+func networkMetrics(validators []ValidatorStats) *metrics.NetworkMetrics {
+	network := &metrics.NetworkMetrics{TotalValidators: len(validators), AverageStake: "0", TotalStaked: "0"}
+	total := new(big.Int)
+	uptime := 0.0
+	for _, v := range validators {
+		if v.Status == "active" {
+			network.ActiveValidators++
+		}
+		uptime += v.Uptime
+		if stake, ok := new(big.Int).SetString(v.Stake, 10); ok {
+			total.Add(total, stake)
+		}
+	}
+	if len(validators) > 0 {
+		network.NetworkUptime = uptime / float64(len(validators)) * 100
+		network.TotalStaked = total.String()
+		network.AverageStake = new(big.Int).Quo(total, big.NewInt(int64(len(validators)))).String()
+	}
+	return network
+}
+
+// applyChainState replaces the figures derived from validator reports with
+// those read from the contracts: the active validator set, its total stake
+// and the last block indexed
+func applyChainState(network *metrics.NetworkMetrics, chain *ChainState) {
+	network.LastBlockProcessed = chain.IndexedBlock
+	if chain.ActiveValidators == nil {
+		return
+	}
+	network.ActiveValidators = len(chain.ActiveValidators)
+	if stake, ok := new(big.Int).SetString(chain.TotalStake, 10); ok {
+		network.TotalStaked = stake.String()
+		if n := len(chain.ActiveValidators); n > 0 {
+			network.AverageStake = new(big.Int).Quo(stake, big.NewInt(int64(n))).String()
+		}
+	}
+}
+
+// paymentMetrics counts the payments created in the last 24 hours. The
+// validation latency is the validators' mean response time, weighted by
+// their signatures.
+func paymentMetrics(dashboard *Dashboard, validators []ValidatorStats) *metrics.PaymentMetrics {
+	payments := &metrics.PaymentMetrics{
+		TotalPayments:     uint64(dashboard.PaymentStats["pending"]),
+		PrivatePayments:   uint64(dashboard.PaymentsPrivacy["true"]),
+		ValidatedPayments: uint64(dashboard.PaymentStats["validated"]),
+		AverageAmount:     "0",
+		TotalVolume:       "0",
+		PaymentsByStatus:  make(map[string]uint64),
+	}
+	for status, count := range dashboard.PaymentStats {
+		payments.PaymentsByStatus[status] = uint64(count)
+	}
+	completed := uint64(dashboard.PaymentStats["completed"])
+	payments.SuccessRate = percent(completed, completed+uint64(dashboard.PaymentStats["failed"]))
+
+	var signatures int64
+	latency := 0.0
+	for _, v := range validators {
+		signatures += v.Signatures
+		latency += v.AvgResponseTimeMs * float64(v.Signatures)
+	}
+	if signatures > 0 {
+		payments.ValidationLatency = latency / float64(signatures)
+	}
+	return payments
+}
+
+// privacyMetrics counts private payments and the disclosures recorded in
+// the last 24 hours, if the audit log is available. Sealed bid grants are
+// not reported to the analytics service.
+func privacyMetrics(dashboard *Dashboard, disclosures *DisclosureSummary) *metrics.PrivacyMetrics {
+	private := uint64(dashboard.PaymentsPrivacy["true"])
+	privacy := &metrics.PrivacyMetrics{
+		EncryptedPayments: private,
+		PrivacyUsageRate:  percent(private, private+uint64(dashboard.PaymentsPrivacy["false"])),
+		DisclosuresByType: make(map[string]uint64),
+	}
+	if disclosures != nil {
+		privacy.DisclosureRequests = uint64(disclosures.ByStatus["requested"])
+		privacy.ApprovedDisclosures = uint64(disclosures.ByStatus["approved"])
+		for scope, count := range disclosures.ByScope {
+			privacy.DisclosuresByType[scope] = uint64(count)
+		}
+	}
+	return privacy
+}
+
+// percent is part as a percentage of whole, or 0 when whole is
+func percent(part, whole uint64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) / float64(whole) * 100
+}
+
+func (s *Service) getSystemStatus(network *metrics.NetworkMetrics) string {
+	if network.TotalValidators > 0 && network.NetworkUptime < 95.0 {
+		return "degraded"
+	}
+	if network.TotalValidators < 3 {
+		return "warning"
+	}
 	return "healthy"
 }
 
@@ -149,17 +436,17 @@ func (s *Service) calculateAverageUptime(validators map[string]*metrics.Validato
 	for _, v := range validators {
 		totalUptime += v.Uptime
 	}
-	
+
 	return totalUptime / float64(len(validators))
 }
 
 func (s *Service) isVaultBalanced(vault *metrics.VaultMetrics) bool {
-	return vault.UtilizationRates["junior"] >= 15.0 && 
-		   vault.UtilizationRates["junior"] <= 25.0 &&
-		   vault.UtilizationRates["mezzanine"] >= 25.0 && 
-		   vault.UtilizationRates["mezzanine"] <= 35.0 &&
-		   vault.UtilizationRates["senior"] >= 45.0 && 
-		   vault.UtilizationRates["senior"] <= 55.0
+	return vault.UtilizationRates["junior"] >= 15.0 &&
+		vault.UtilizationRates["junior"] <= 25.0 &&
+		vault.UtilizationRates["mezzanine"] >= 25.0 &&
+		vault.UtilizationRates["mezzanine"] <= 35.0 &&
+		vault.UtilizationRates["senior"] >= 45.0 &&
+		vault.UtilizationRates["senior"] <= 55.0
 }
 
 func (s *Service) calculateRiskLevel(vault *metrics.VaultMetrics) string {
@@ -169,4 +456,4 @@ func (s *Service) calculateRiskLevel(vault *metrics.VaultMetrics) string {
 		return "medium"
 	}
 	return "low"
-}
\ No newline at end of file
+}
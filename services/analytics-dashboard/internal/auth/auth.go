@@ -0,0 +1,333 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	sharedauth "github.com/arcbjorn/crosspay/packages/auth"
+)
+
+// Users log in with a long-lived API key and get a short-lived session
+// token, an HS256 JWT, which the WebSocket requires. The token carries the
+// user's role: ops users receive every event, merchants only the topics
+// their role allows and only payments to their own addresses. Admins may
+// use their admin token from packages/auth instead, and are treated as ops.
+// Without a users file authentication is off and every client is treated as
+// ops.
+
+const (
+	RoleOps      = "ops"
+	RoleMerchant = "merchant"
+)
+
+// defaultTopics are the event types each role receives. "*" allows every
+// type.
+var defaultTopics = map[string][]string{
+	RoleOps:      {"*"},
+	RoleMerchant: {"payment_update", "heartbeat"},
+}
+
+var (
+	ErrUnauthenticated = errors.New("missing session token")
+	ErrInvalidToken    = errors.New("invalid session token")
+	ErrExpiredToken    = errors.New("session token expired")
+)
+
+// User is an entry of the users file
+type User struct {
+	Name      string   `json:"name"`
+	APIKey    string   `json:"api_key"`
+	Role      string   `json:"role"`
+	Merchants []string `json:"merchants,omitempty"`
+}
+
+// Session is what a session token grants, and its JWT claims
+type Session struct {
+	Subject   string   `json:"sub"`
+	Role      string   `json:"role"`
+	Merchants []string `json:"merchants,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// Expiry is when the session ends, or the zero time if it does not
+func (s *Session) Expiry() time.Time {
+	if s.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(s.ExpiresAt, 0)
+}
+
+// Authenticator mints and checks session tokens
+type Authenticator struct {
+	users  map[string]*User
+	topics map[string][]string
+	secret []byte
+	ttl    time.Duration
+	admin  *sharedauth.Admin
+}
+
+// Load reads the users from the JSON file at DASHBOARD_USERS_PATH:
+//
+//	{"users": [{"name": "acme", "api_key": "...", "role": "merchant", "merchants": ["0x..."]}],
+//	 "topics": {"merchant": ["payment_update", "heartbeat"]}}
+//
+// topics optionally replaces the event types a role receives. Tokens are
+// signed with DASHBOARD_SESSION_SECRET and last DASHBOARD_SESSION_TTL.
+// Admin tokens are checked against ADMIN_JWT_SECRET and ADMIN_JWT_ISSUER.
+func Load() (*Authenticator, error) {
+	admin, err := sharedauth.New("analytics-dashboard", sharedauth.Config{
+		JWTSecret: os.Getenv("ADMIN_JWT_SECRET"),
+		JWTIssuer: os.Getenv("ADMIN_JWT_ISSUER"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{
+		users:  make(map[string]*User),
+		topics: make(map[string][]string),
+		ttl:    15 * time.Minute,
+		admin:  admin,
+	}
+	for role, topics := range defaultTopics {
+		a.topics[role] = topics
+	}
+
+	if value := os.Getenv("DASHBOARD_SESSION_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid DASHBOARD_SESSION_TTL %q", value)
+		}
+		a.ttl = ttl
+	}
+	if secret := os.Getenv("DASHBOARD_SESSION_SECRET"); secret != "" {
+		a.secret = []byte(secret)
+	} else {
+		a.secret = make([]byte, 32)
+		if _, err := rand.Read(a.secret); err != nil {
+			return nil, err
+		}
+	}
+
+	path := os.Getenv("DASHBOARD_USERS_PATH")
+	if path == "" {
+		log.Println("DASHBOARD_USERS_PATH not set, WebSocket is open to every client")
+		return a, nil
+	}
+	if os.Getenv("DASHBOARD_SESSION_SECRET") == "" {
+		log.Println("DASHBOARD_SESSION_SECRET not set, session tokens will not survive a restart")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Users  []User              `json:"users"`
+		Topics map[string][]string `json:"topics"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for role, topics := range config.Topics {
+		if _, ok := defaultTopics[role]; !ok {
+			return nil, fmt.Errorf("topics: unknown role %q", role)
+		}
+		a.topics[role] = topics
+	}
+	for i := range config.Users {
+		user := &config.Users[i]
+		if user.APIKey == "" {
+			return nil, fmt.Errorf("user %s: api_key is required", user.Name)
+		}
+		switch user.Role {
+		case RoleOps:
+		case RoleMerchant:
+			if len(user.Merchants) == 0 {
+				return nil, fmt.Errorf("user %s: merchants are required", user.Name)
+			}
+			for j, merchant := range user.Merchants {
+				user.Merchants[j] = strings.ToLower(merchant)
+			}
+		default:
+			return nil, fmt.Errorf("user %s: unknown role %q", user.Name, user.Role)
+		}
+		a.users[hashKey(user.APIKey)] = user
+		user.APIKey = ""
+	}
+
+	log.Printf("Loaded %d dashboard users", len(a.users))
+	return a, nil
+}
+
+// Enabled reports whether clients need a session token
+func (a *Authenticator) Enabled() bool {
+	return len(a.users) > 0
+}
+
+// Login exchanges an API key for a session token
+func (a *Authenticator) Login(apiKey string) (string, *Session, error) {
+	user, ok := a.users[hashKey(apiKey)]
+	if !ok {
+		return "", nil, ErrInvalidToken
+	}
+	now := time.Now()
+	session := &Session{
+		Subject:   user.Name,
+		Role:      user.Role,
+		Merchants: user.Merchants,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(a.ttl).Unix(),
+	}
+	token, err := a.sign(session)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+// Authenticate reads the session token of a request from ?token= (browsers
+// cannot set headers on a WebSocket) or an Authorization bearer header.
+// With authentication off every request gets an ops session.
+func (a *Authenticator) Authenticate(r *http.Request) (*Session, error) {
+	if !a.Enabled() {
+		return &Session{Subject: "anonymous", Role: RoleOps}, nil
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+	session, err := a.Verify(token)
+	if errors.Is(err, ErrInvalidToken) && a.admin.Enabled() {
+		if claims, adminErr := a.admin.Verify(token); adminErr == nil {
+			return &Session{Subject: claims.Subject, Role: RoleOps, IssuedAt: claims.IssuedAt, ExpiresAt: claims.ExpiresAt}, nil
+		} else if errors.Is(adminErr, sharedauth.ErrExpiredToken) {
+			return nil, ErrExpiredToken
+		}
+	}
+	return session, err
+}
+
+// Allows reports whether a session receives an event of a topic. Merchants
+// only receive payments to one of their addresses.
+func (a *Authenticator) Allows(session *Session, topic, merchant string) bool {
+	topics := a.topics[session.Role]
+	if !contains(topics, "*") && !contains(topics, topic) {
+		return false
+	}
+	if session.Role != RoleMerchant || !merchantTopics[topic] {
+		return true
+	}
+	return merchant != "" && contains(session.Merchants, strings.ToLower(merchant))
+}
+
+// merchantTopics carry a merchant, so merchants only get the ones that
+// name one of theirs
+var merchantTopics = map[string]bool{"payment_update": true}
+
+// HandleLogin answers POST /auth/login {"api_key": "..."} with a session
+// token and its expiry
+func (a *Authenticator) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if !a.Enabled() {
+		http.Error(w, "Authentication is not configured", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.APIKey == "" {
+		http.Error(w, "api_key is required", http.StatusBadRequest)
+		return
+	}
+
+	token, session, err := a.Login(req.APIKey)
+	if errors.Is(err, ErrInvalidToken) {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to mint session token: %v", err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_at": session.Expiry(),
+		"role":       session.Role,
+	})
+}
+
+func (a *Authenticator) sign(session *Session) (string, error) {
+	return sharedauth.SignPayload(session, a.secret)
+}
+
+// Verify checks a session token's signature and expiry
+func (a *Authenticator) Verify(token string) (*Session, error) {
+	var session Session
+	if err := sharedauth.VerifyPayload(token, a.secret, &session); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if _, ok := a.topics[session.Role]; !ok {
+		return nil, ErrInvalidToken
+	}
+	if !time.Now().Before(session.Expiry()) {
+		return nil, ErrExpiredToken
+	}
+	return &session, nil
+}
+
+// OriginChecker allows WebSocket connections from the origins listed in
+// DASHBOARD_ALLOWED_ORIGINS, comma separated, or "*" for any. Without it
+// only pages served by the dashboard itself may connect. Clients that send
+// no Origin, which browsers always do, are allowed.
+func OriginChecker() func(r *http.Request) bool {
+	var allowed []string
+	for _, origin := range strings.Split(os.Getenv("DASHBOARD_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			allowed = append(allowed, strings.ToLower(origin))
+		}
+	}
+	if contains(allowed, "*") {
+		log.Println("DASHBOARD_ALLOWED_ORIGINS allows WebSocket connections from any origin")
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || contains(allowed, "*") || contains(allowed, strings.ToLower(origin)) {
+			return true
+		}
+		parsed, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(parsed.Host, r.Host)
+	}
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
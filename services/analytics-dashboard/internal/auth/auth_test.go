@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sharedauth "github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	path := filepath.Join(t.TempDir(), "users.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"users": [
+		{"name": "ops", "api_key": "ops-key", "role": "ops"},
+		{"name": "acme", "api_key": "acme-key", "role": "merchant", "merchants": ["0xABC"]}
+	]}`), 0o600))
+	t.Setenv("DASHBOARD_USERS_PATH", path)
+	t.Setenv("DASHBOARD_SESSION_SECRET", "session-secret")
+	t.Setenv("ADMIN_JWT_SECRET", "admin-secret")
+	a, err := Load()
+	require.NoError(t, err)
+	return a
+}
+
+func TestSessionTokens(t *testing.T) {
+	a := newTestAuthenticator(t)
+
+	t.Run("should verify the tokens it issues", func(t *testing.T) {
+		token, session, err := a.Login("acme-key")
+		require.NoError(t, err)
+		assert.Equal(t, RoleMerchant, session.Role)
+
+		verified, err := a.Verify(token)
+		require.NoError(t, err)
+		assert.Equal(t, "acme", verified.Subject)
+		assert.Equal(t, []string{"0xabc"}, verified.Merchants)
+		assert.WithinDuration(t, time.Now().Add(15*time.Minute), verified.Expiry(), 5*time.Second)
+	})
+
+	t.Run("should reject unknown API keys", func(t *testing.T) {
+		_, _, err := a.Login("guess")
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("should reject expired tokens", func(t *testing.T) {
+		token, err := a.sign(&Session{Subject: "acme", Role: RoleMerchant, ExpiresAt: time.Now().Add(-time.Second).Unix()})
+		require.NoError(t, err)
+		_, err = a.Verify(token)
+		assert.ErrorIs(t, err, ErrExpiredToken)
+	})
+
+	t.Run("should reject tampered tokens and unknown roles", func(t *testing.T) {
+		token, _, err := a.Login("acme-key")
+		require.NoError(t, err)
+		parts := strings.Split(token, ".")
+		parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"acme","role":"ops","exp":9999999999}`))
+		_, err = a.Verify(strings.Join(parts, "."))
+		assert.ErrorIs(t, err, ErrInvalidToken)
+
+		token, err = a.sign(&Session{Subject: "acme", Role: "root", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+		require.NoError(t, err)
+		_, err = a.Verify(token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := newTestAuthenticator(t)
+
+	t.Run("should read the token from the query or the header", func(t *testing.T) {
+		token, _, err := a.Login("ops-key")
+		require.NoError(t, err)
+
+		session, err := a.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?token="+token, nil))
+		require.NoError(t, err)
+		assert.Equal(t, RoleOps, session.Role)
+
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		session, err = a.Authenticate(req)
+		require.NoError(t, err)
+		assert.Equal(t, "ops", session.Subject)
+
+		_, err = a.Authenticate(httptest.NewRequest(http.MethodGet, "/ws", nil))
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("should give admin tokens an ops session", func(t *testing.T) {
+		token, err := sharedauth.Sign(sharedauth.Claims{Subject: "alice", Roles: []string{sharedauth.RoleAuditor}, ExpiresAt: time.Now().Add(time.Hour).Unix()}, []byte("admin-secret"))
+		require.NoError(t, err)
+		session, err := a.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?token="+token, nil))
+		require.NoError(t, err)
+		assert.Equal(t, "alice", session.Subject)
+		assert.Equal(t, RoleOps, session.Role)
+
+		token, err = sharedauth.Sign(sharedauth.Claims{Subject: "alice", Roles: []string{sharedauth.RoleAuditor}, ExpiresAt: time.Now().Add(-time.Minute).Unix()}, []byte("admin-secret"))
+		require.NoError(t, err)
+		_, err = a.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?token="+token, nil))
+		assert.ErrorIs(t, err, ErrExpiredToken)
+	})
+
+	t.Run("should only send merchants their own payments", func(t *testing.T) {
+		merchant := &Session{Role: RoleMerchant, Merchants: []string{"0xabc"}}
+		assert.True(t, a.Allows(merchant, "payment_update", "0xABC"))
+		assert.False(t, a.Allows(merchant, "payment_update", "0xdef"))
+		assert.True(t, a.Allows(merchant, "heartbeat", ""))
+		assert.False(t, a.Allows(merchant, "validator_update", ""))
+		assert.True(t, a.Allows(&Session{Role: RoleOps}, "validator_update", ""))
+	})
+}
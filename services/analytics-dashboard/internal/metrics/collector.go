@@ -1,337 +0,0 @@
-package metrics
-
-import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"log"
-	"net/http"
-	"sync"
-	"time"
-
-	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
-)
-
-type ValidatorMetrics struct {
-	Address         string    `json:"address"`
-	Stake           string    `json:"stake"`
-	Uptime          float64   `json:"uptime"`
-	ValidationCount uint64    `json:"validation_count"`
-	SlashCount      uint64    `json:"slash_count"`
-	LastActivity    time.Time `json:"last_activity"`
-	Status          string    `json:"status"`
-	PerformanceScore float64  `json:"performance_score"`
-}
-
-type VaultMetrics struct {
-	TotalTVL         string             `json:"total_tvl"`
-	JuniorTVL        string             `json:"junior_tvl"`
-	MezzanineTVL     string             `json:"mezzanine_tvl"`
-	SeniorTVL        string             `json:"senior_tvl"`
-	JuniorAPY        float64            `json:"junior_apy"`
-	MezzanineAPY     float64            `json:"mezzanine_apy"`
-	SeniorAPY        float64            `json:"senior_apy"`
-	SlashingEvents   []SlashingEvent    `json:"slashing_events"`
-	InsuranceFund    string             `json:"insurance_fund"`
-	UtilizationRates map[string]float64 `json:"utilization_rates"`
-}
-
-type PaymentMetrics struct {
-	TotalPayments      uint64            `json:"total_payments"`
-	PrivatePayments    uint64            `json:"private_payments"`
-	ValidatedPayments  uint64            `json:"validated_payments"`
-	AverageAmount      string            `json:"average_amount"`
-	TotalVolume        string            `json:"total_volume"`
-	PaymentsByStatus   map[string]uint64 `json:"payments_by_status"`
-	ValidationLatency  float64           `json:"validation_latency_ms"`
-	SuccessRate        float64           `json:"success_rate"`
-}
-
-type PrivacyMetrics struct {
-	EncryptedPayments    uint64            `json:"encrypted_payments"`
-	DisclosureRequests   uint64            `json:"disclosure_requests"`
-	ApprovedDisclosures  uint64            `json:"approved_disclosures"`
-	SealedBidGrants      uint64            `json:"sealed_bid_grants"`
-	PrivacyUsageRate     float64           `json:"privacy_usage_rate"`
-	DisclosuresByType    map[string]uint64 `json:"disclosures_by_type"`
-}
-
-type SlashingEvent struct {
-	EventID         uint64    `json:"event_id"`
-	Amount          string    `json:"amount"`
-	Validator       string    `json:"validator"`
-	Reason          string    `json:"reason"`
-	Timestamp       time.Time `json:"timestamp"`
-	JuniorSlashed   string    `json:"junior_slashed"`
-	MezzanineSlashed string   `json:"mezzanine_slashed"`
-	SeniorSlashed   string    `json:"senior_slashed"`
-}
-
-type NetworkMetrics struct {
-	TotalValidators     int       `json:"total_validators"`
-	ActiveValidators    int       `json:"active_validators"`
-	NetworkUptime       float64   `json:"network_uptime"`
-	AverageStake        string    `json:"average_stake"`
-	TotalStaked         string    `json:"total_staked"`
-	LastBlockProcessed  uint64    `json:"last_block_processed"`
-	BlockProcessingRate float64   `json:"blocks_per_second"`
-	PeerConnections     int       `json:"peer_connections"`
-}
-
-type Collector struct {
-	client               *ethclient.Client
-	validatorMetrics     map[string]*ValidatorMetrics
-	vaultMetrics         *VaultMetrics
-	paymentMetrics       *PaymentMetrics
-	privacyMetrics       *PrivacyMetrics
-	networkMetrics       *NetworkMetrics
-	mutex                sync.RWMutex
-	ctx                  context.Context
-	cancel               context.CancelFunc
-	contractAddresses    map[string]common.Address
-	isCollecting         bool
-}
-
-func NewCollector() *Collector {
-	ctx, cancel := context.WithCancel(context.Background())
-	
-	return &Collector{
-		validatorMetrics: make(map[string]*ValidatorMetrics),
-		vaultMetrics:     &VaultMetrics{},
-		paymentMetrics:   &PaymentMetrics{},
-		privacyMetrics:   &PrivacyMetrics{},
-		networkMetrics:   &NetworkMetrics{},
-		ctx:              ctx,
-		cancel:           cancel,
-		contractAddresses: make(map[string]common.Address),
-	}
-}
-
-func (c *Collector) StartCollection() {
-	c.isCollecting = true
-	log.Println("Starting metrics collection...")
-
-	if err := c.connectToBlockchain(); err != nil {
-		log.Printf("Failed to connect to blockchain: %v", err)
-		return
-	}
-
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-c.ctx.Done():
-			return
-		case <-ticker.C:
-			if err := c.collectMetrics(); err != nil {
-				log.Printf("Failed to collect metrics: %v", err)
-			}
-		}
-	}
-}
-
-func (c *Collector) Stop() {
-	c.isCollecting = false
-	c.cancel()
-	if c.client != nil {
-		c.client.Close()
-	}
-	log.Println("Metrics collection stopped")
-}
-
-func (c *Collector) connectToBlockchain() error {
-	client, err := ethclient.Dial("http://localhost:8545")
-	if err != nil {
-		return fmt.Errorf("failed to connect to Ethereum client: %w", err)
-	}
-	c.client = client
-	return nil
-}
-
-func (c *Collector) collectMetrics() error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
-	if err := c.collectValidatorMetrics(); err != nil {
-		log.Printf("Failed to collect validator metrics: %v", err)
-	}
-
-	if err := c.collectVaultMetrics(); err != nil {
-		log.Printf("Failed to collect vault metrics: %v", err)
-	}
-
-	if err := c.collectPaymentMetrics(); err != nil {
-		log.Printf("Failed to collect payment metrics: %v", err)
-	}
-
-	if err := c.collectPrivacyMetrics(); err != nil {
-		log.Printf("Failed to collect privacy metrics: %v", err)
-	}
-
-	if err := c.collectNetworkMetrics(); err != nil {
-		log.Printf("Failed to collect network metrics: %v", err)
-	}
-
-	return nil
-}
-
-func (c *Collector) collectValidatorMetrics() error {
-	log.Println("Collecting validator metrics...")
-	
-	c.validatorMetrics["0x742d35Cc6634C0532925a3b8D34300e8"] = &ValidatorMetrics{
-		Address:          "0x742d35Cc6634C0532925a3b8D34300e8",
-		Stake:            "10000000000000000000", // 10 ETH
-		Uptime:           99.5,
-		ValidationCount:  1250,
-		SlashCount:       0,
-		LastActivity:     time.Now().Add(-2 * time.Minute),
-		Status:           "active",
-		PerformanceScore: 98.5,
-	}
-
-	return nil
-}
-
-func (c *Collector) collectVaultMetrics() error {
-	log.Println("Collecting vault metrics...")
-	
-	c.vaultMetrics = &VaultMetrics{
-		TotalTVL:     "1000000000000000000000", // 1000 ETH
-		JuniorTVL:    "200000000000000000000",  // 200 ETH
-		MezzanineTVL: "300000000000000000000",  // 300 ETH
-		SeniorTVL:    "500000000000000000000",  // 500 ETH
-		JuniorAPY:    12.0,
-		MezzanineAPY: 8.0,
-		SeniorAPY:    5.0,
-		InsuranceFund: "50000000000000000000", // 50 ETH
-		UtilizationRates: map[string]float64{
-			"junior":    20.0,
-			"mezzanine": 30.0,
-			"senior":    50.0,
-		},
-		SlashingEvents: []SlashingEvent{
-			{
-				EventID:          1,
-				Amount:           "1000000000000000000", // 1 ETH
-				Validator:        "0x742d35Cc6634C0532925a3b8D34300e8",
-				Reason:           "Failed validation timeout",
-				Timestamp:        time.Now().Add(-2 * time.Hour),
-				JuniorSlashed:    "1000000000000000000",
-				MezzanineSlashed: "0",
-				SeniorSlashed:    "0",
-			},
-		},
-	}
-
-	return nil
-}
-
-func (c *Collector) collectPaymentMetrics() error {
-	log.Println("Collecting payment metrics...")
-	
-	c.paymentMetrics = &PaymentMetrics{
-		TotalPayments:     15420,
-		PrivatePayments:   3845,
-		ValidatedPayments: 12675,
-		AverageAmount:     "500000000000000000", // 0.5 ETH
-		TotalVolume:       "7710000000000000000000", // 7710 ETH
-		PaymentsByStatus: map[string]uint64{
-			"pending":   45,
-			"completed": 15200,
-			"refunded":  125,
-			"cancelled": 50,
-		},
-		ValidationLatency: 2850.0, // ms
-		SuccessRate:      98.7,
-	}
-
-	return nil
-}
-
-func (c *Collector) collectPrivacyMetrics() error {
-	log.Println("Collecting privacy metrics...")
-	
-	c.privacyMetrics = &PrivacyMetrics{
-		EncryptedPayments:   3845,
-		DisclosureRequests:  127,
-		ApprovedDisclosures: 89,
-		SealedBidGrants:     23,
-		PrivacyUsageRate:    24.9,
-		DisclosuresByType: map[string]uint64{
-			"compliance": 45,
-			"audit":      32,
-			"participant": 12,
-		},
-	}
-
-	return nil
-}
-
-func (c *Collector) collectNetworkMetrics() error {
-	log.Println("Collecting network metrics...")
-	
-	c.networkMetrics = &NetworkMetrics{
-		TotalValidators:     15,
-		ActiveValidators:    13,
-		NetworkUptime:       99.8,
-		AverageStake:        "12500000000000000000", // 12.5 ETH
-		TotalStaked:         "187500000000000000000", // 187.5 ETH
-		LastBlockProcessed:  18459234,
-		BlockProcessingRate: 2.1,
-		PeerConnections:     48,
-	}
-
-	return nil
-}
-
-func (c *Collector) GetValidatorMetrics() map[string]*ValidatorMetrics {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	
-	metrics := make(map[string]*ValidatorMetrics)
-	for k, v := range c.validatorMetrics {
-		metrics[k] = v
-	}
-	return metrics
-}
-
-func (c *Collector) GetVaultMetrics() *VaultMetrics {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	return c.vaultMetrics
-}
-
-func (c *Collector) GetPaymentMetrics() *PaymentMetrics {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	return c.paymentMetrics
-}
-
-func (c *Collector) GetPrivacyMetrics() *PrivacyMetrics {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	return c.privacyMetrics
-}
-
-func (c *Collector) GetNetworkMetrics() *NetworkMetrics {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	return c.networkMetrics
-}
-
-func (c *Collector) IsCollecting() bool {
-	return c.isCollecting
-}
-
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	response := map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now(),
-		"service":   "analytics-dashboard",
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
\ No newline at end of file
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"time"
+)
+
+// The response types of the dashboard's /metrics endpoints. They are filled
+// in from the analytics service, which collects every metric; fields it does
+// not track are left at their zero values.
+
+type ValidatorMetrics struct {
+	Address          string    `json:"address"`
+	Stake            string    `json:"stake"`
+	Uptime           float64   `json:"uptime"`
+	ValidationCount  uint64    `json:"validation_count"`
+	SlashCount       uint64    `json:"slash_count"`
+	LastActivity     time.Time `json:"last_activity"`
+	Status           string    `json:"status"`
+	PerformanceScore float64   `json:"performance_score"`
+}
+
+type VaultMetrics struct {
+	TotalTVL         string             `json:"total_tvl"`
+	JuniorTVL        string             `json:"junior_tvl"`
+	MezzanineTVL     string             `json:"mezzanine_tvl"`
+	SeniorTVL        string             `json:"senior_tvl"`
+	JuniorAPY        float64            `json:"junior_apy"`
+	MezzanineAPY     float64            `json:"mezzanine_apy"`
+	SeniorAPY        float64            `json:"senior_apy"`
+	SlashingEvents   []SlashingEvent    `json:"slashing_events"`
+	InsuranceFund    string             `json:"insurance_fund"`
+	UtilizationRates map[string]float64 `json:"utilization_rates"`
+}
+
+type PaymentMetrics struct {
+	TotalPayments     uint64            `json:"total_payments"`
+	PrivatePayments   uint64            `json:"private_payments"`
+	ValidatedPayments uint64            `json:"validated_payments"`
+	AverageAmount     string            `json:"average_amount"`
+	TotalVolume       string            `json:"total_volume"`
+	PaymentsByStatus  map[string]uint64 `json:"payments_by_status"`
+	ValidationLatency float64           `json:"validation_latency_ms"`
+	SuccessRate       float64           `json:"success_rate"`
+}
+
+type PrivacyMetrics struct {
+	EncryptedPayments   uint64            `json:"encrypted_payments"`
+	DisclosureRequests  uint64            `json:"disclosure_requests"`
+	ApprovedDisclosures uint64            `json:"approved_disclosures"`
+	SealedBidGrants     uint64            `json:"sealed_bid_grants"`
+	PrivacyUsageRate    float64           `json:"privacy_usage_rate"`
+	DisclosuresByType   map[string]uint64 `json:"disclosures_by_type"`
+}
+
+type SlashingEvent struct {
+	EventID          uint64    `json:"event_id"`
+	Amount           string    `json:"amount"`
+	Validator        string    `json:"validator"`
+	Reason           string    `json:"reason"`
+	Timestamp        time.Time `json:"timestamp"`
+	JuniorSlashed    string    `json:"junior_slashed"`
+	MezzanineSlashed string    `json:"mezzanine_slashed"`
+	SeniorSlashed    string    `json:"senior_slashed"`
+}
+
+type NetworkMetrics struct {
+	TotalValidators     int     `json:"total_validators"`
+	ActiveValidators    int     `json:"active_validators"`
+	NetworkUptime       float64 `json:"network_uptime"`
+	AverageStake        string  `json:"average_stake"`
+	TotalStaked         string  `json:"total_staked"`
+	LastBlockProcessed  uint64  `json:"last_block_processed"`
+	BlockProcessingRate float64 `json:"blocks_per_second"`
+	PeerConnections     int     `json:"peer_connections"`
+}
@@ -1,28 +1,39 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/crosspay/analytics-dashboard/internal/auth"
 	"github.com/gorilla/websocket"
 )
 
 type Hub struct {
 	clients    map[*Client]bool
-	broadcast  chan []byte
+	broadcast  chan outbound
 	register   chan *Client
 	unregister chan *Client
 	mutex      sync.RWMutex
 	upgrader   websocket.Upgrader
+	auth       *auth.Authenticator
 }
 
 type Client struct {
-	hub  *Hub
-	conn *websocket.Conn
-	send chan []byte
+	hub     *Hub
+	conn    *websocket.Conn
+	send    chan []byte
+	session *auth.Session
+}
+
+// outbound is an encoded message, with what decides who may receive it
+type outbound struct {
+	topic    string
+	merchant string
+	payload  []byte
 }
 
 type Message struct {
@@ -31,17 +42,18 @@ type Message struct {
 	Timestamp time.Time   `json:"timestamp"`
 }
 
-func NewHub() *Hub {
+// NewHub sends each message to the clients whose session allows it, and
+// only accepts connections from the allowed origins
+func NewHub(authenticator *auth.Authenticator) *Hub {
 	return &Hub{
 		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
+		broadcast:  make(chan outbound, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+			CheckOrigin: auth.OriginChecker(),
 		},
+		auth: authenticator,
 	}
 }
 
@@ -67,16 +79,19 @@ func (h *Hub) Run() {
 			log.Printf("Client disconnected. Total clients: %d", len(h.clients))
 
 		case message := <-h.broadcast:
-			h.mutex.RLock()
+			h.mutex.Lock()
 			for client := range h.clients {
+				if !h.auth.Allows(client.session, message.topic, message.merchant) {
+					continue
+				}
 				select {
-				case client.send <- message:
+				case client.send <- message.payload:
 				default:
 					delete(h.clients, client)
 					close(client.send)
 				}
 			}
-			h.mutex.RUnlock()
+			h.mutex.Unlock()
 
 		case <-ticker.C:
 			h.sendHeartbeat()
@@ -98,7 +113,16 @@ func (h *Hub) Stop() {
 	close(h.unregister)
 }
 
+// HandleWebSocket connects a client with a valid session token. The
+// connection is closed when the session expires, and the client has to log
+// in again.
 func (h *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	session, err := h.auth.Authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade failed: %v", err)
@@ -106,18 +130,33 @@ func (h *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &Client{
-		hub:  h,
-		conn: conn,
-		send: make(chan []byte, 256),
+		hub:     h,
+		conn:    conn,
+		send:    make(chan []byte, 256),
+		session: session,
 	}
 
 	client.hub.register <- client
 
+	if expiry := session.Expiry(); !expiry.IsZero() {
+		time.AfterFunc(time.Until(expiry), func() {
+			message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session expired")
+			conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+			conn.Close()
+		})
+	}
+
 	go client.writePump()
 	go client.readPump()
 }
 
 func (h *Hub) BroadcastUpdate(messageType string, data interface{}) {
+	h.publish(messageType, "", data)
+}
+
+// publish queues a message for the clients allowed its type and, for
+// payments, its merchant
+func (h *Hub) publish(messageType, merchant string, data interface{}) {
 	message := Message{
 		Type:      messageType,
 		Data:      data,
@@ -131,12 +170,83 @@ func (h *Hub) BroadcastUpdate(messageType string, data interface{}) {
 	}
 
 	select {
-	case h.broadcast <- messageBytes:
+	case h.broadcast <- outbound{topic: messageType, merchant: merchant, payload: messageBytes}:
 	default:
 		log.Println("Broadcast channel full, dropping message")
 	}
 }
 
+// relayedTypes renames analytics service events to the dashboard's event
+// types; other events keep their type
+var relayedTypes = map[string]string{
+	"payment":   "payment_update",
+	"validator": "validator_update",
+	"vault":     "vault_update",
+}
+
+// Relay rebroadcasts the events of the analytics service WebSocket at url
+// until ctx is done, reconnecting when the connection drops
+func (h *Hub) Relay(ctx context.Context, url string) {
+	backoff := time.Second
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+		if err == nil {
+			log.Println("Relaying analytics service events")
+			backoff = time.Second
+			h.relayEvents(ctx, conn)
+		} else if ctx.Err() == nil {
+			log.Printf("Failed to connect to analytics service events: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (h *Hub) relayEvents(ctx context.Context, conn *websocket.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer conn.Close()
+
+	for {
+		var event struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := conn.ReadJSON(&event); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Analytics service events dropped: %v", err)
+			}
+			return
+		}
+		if renamed, ok := relayedTypes[event.Type]; ok {
+			event.Type = renamed
+		}
+		// the analytics service tags payments with their recipient as
+		// merchant
+		var payment struct {
+			Recipient string `json:"recipient"`
+		}
+		if event.Type == "payment_update" {
+			json.Unmarshal(event.Data, &payment)
+		}
+		h.publish(event.Type, payment.Recipient, event.Data)
+	}
+}
+
 func (h *Hub) sendHeartbeat() {
 	h.BroadcastUpdate("heartbeat", map[string]interface{}{
 		"connected_clients": len(h.clients),
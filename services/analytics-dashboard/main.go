@@ -10,18 +10,30 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/arcbjorn/crosspay/packages/problem"
 	"github.com/crosspay/analytics-dashboard/internal/analytics"
-	"github.com/crosspay/analytics-dashboard/internal/metrics"
+	"github.com/crosspay/analytics-dashboard/internal/auth"
 	"github.com/crosspay/analytics-dashboard/internal/websocket"
 )
 
+// The dashboard reads every metric from the analytics service, which is the
+// only service that collects them. It keeps serving its own endpoints and
+// WebSocket while clients move to the analytics service API.
 func main() {
-	metricsCollector := metrics.NewCollector()
-	analyticsService := analytics.NewService(metricsCollector)
-	wsHub := websocket.NewHub()
+	client := analytics.NewClient(getEnv("ANALYTICS_SERVICE_URL", "http://localhost:8084"), getEnv("ANALYTICS_API_TOKEN", ""))
+	analyticsService := analytics.NewService(client, analytics.Config{
+		ChainID:      getEnv("DASHBOARD_CHAIN_ID", ""),
+		VaultAddress: getEnv("DASHBOARD_VAULT_ADDRESS", ""),
+	})
+	authenticator, err := auth.Load()
+	if err != nil {
+		log.Fatalf("Failed to load dashboard users: %v", err)
+	}
+	wsHub := websocket.NewHub(authenticator)
 
+	relayCtx, stopRelay := context.WithCancel(context.Background())
 	go wsHub.Run()
-	go metricsCollector.StartCollection()
+	go wsHub.Relay(relayCtx, client.EventsURL())
 
 	mux := http.NewServeMux()
 	
@@ -31,17 +43,21 @@ func main() {
 	mux.HandleFunc("GET /metrics/vault", analyticsService.GetVaultMetrics)
 	mux.HandleFunc("GET /metrics/payments", analyticsService.GetPaymentMetrics)
 	mux.HandleFunc("GET /metrics/privacy", analyticsService.GetPrivacyMetrics)
+	mux.HandleFunc("GET /metrics/history", analyticsService.GetHistoryMetrics)
+	mux.HandleFunc("GET /metrics/history/{metric}", analyticsService.GetHistory)
+	mux.HandleFunc("POST /auth/login", authenticator.HandleLogin)
 	mux.HandleFunc("GET /ws", wsHub.HandleWebSocket)
 	
 	mux.Handle("GET /", http.FileServer(http.Dir("./static/")))
 
+	port := getEnv("PORT", "8090")
 	server := &http.Server{
-		Addr:    ":8090",
-		Handler: mux,
+		Addr:    ":" + port,
+		Handler: problem.Adapt(mux),
 	}
 
 	go func() {
-		log.Println("Starting analytics dashboard on port 8090")
+		log.Printf("Starting analytics dashboard on port %s", port)
 		if err := server.ListenAndServe(); err != http.ErrServerClosed {
 			log.Fatalf("Server failed: %v", err)
 		}
@@ -60,8 +76,8 @@ func main() {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	stopRelay()
 	wsHub.Stop()
-	metricsCollector.Stop()
 	log.Println("Analytics dashboard stopped")
 }
 
@@ -74,4 +90,11 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-}
\ No newline at end of file
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
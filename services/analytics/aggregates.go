@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rolling payment aggregates are kept in memory from the payment stream, so
+// dashboards get throughput, volume and failure rate without deriving them
+// from raw events. Payments are counted in one-second buckets by their
+// timestamp over the last AGGREGATE_WINDOW_SECONDS, so metrics replayed or
+// indexed late do not inflate the current rates. The aggregates are
+// broadcast to WebSocket clients as "aggregates" events every
+// AGGREGATE_BROADCAST_SECONDS.
+
+// Aggregates are the payment rates over the rolling window. PaymentsPerSec,
+// VolumePerMin and VolumeUSDPerMin count completed payments; FailureRate is
+// the share of payments that finished in the window that failed.
+// VolumePerMin adds up base units of every token, VolumeUSDPerMin the
+// amounts of the payments priced in USD.
+type Aggregates struct {
+	ChainID         string    `json:"chain_id"`
+	WindowSeconds   int       `json:"window_seconds"`
+	PaymentsPerSec  float64   `json:"payments_per_sec"`
+	CreatedPerSec   float64   `json:"created_per_sec"`
+	VolumePerMin    string    `json:"volume_per_min"`
+	VolumeUSDPerMin float64   `json:"volume_usd_per_min"`
+	FailureRate     float64   `json:"failure_rate"`
+	Created         uint64    `json:"created"`
+	Completed       uint64    `json:"completed"`
+	Failed          uint64    `json:"failed"`
+	ComputedAt      time.Time `json:"computed_at"`
+}
+
+// RealtimeAggregates is the overall aggregates and those of each chain
+type RealtimeAggregates struct {
+	Aggregates
+	Chains map[string]Aggregates `json:"chains"`
+}
+
+// aggregateBucket counts the payments of one second
+type aggregateBucket struct {
+	second    int64
+	created   uint64
+	completed uint64
+	failed    uint64
+	volume    *big.Int
+	volumeUSD float64
+}
+
+func (b *aggregateBucket) add(other *aggregateBucket) {
+	b.created += other.created
+	b.completed += other.completed
+	b.failed += other.failed
+	b.volume.Add(b.volume, other.volume)
+	b.volumeUSD += other.volumeUSD
+}
+
+// PaymentAggregator keeps a ring of one-second buckets per chain
+type PaymentAggregator struct {
+	window int
+	chains map[uint64][]aggregateBucket
+	mutex  sync.Mutex
+}
+
+// NewPaymentAggregator aggregates over the last AGGREGATE_WINDOW_SECONDS
+func NewPaymentAggregator() *PaymentAggregator {
+	window := getEnvInt("AGGREGATE_WINDOW_SECONDS", 60)
+	if window < 1 {
+		window = 1
+	}
+	return &PaymentAggregator{window: window, chains: make(map[uint64][]aggregateBucket)}
+}
+
+// Add counts a payment metric received at now. Metrics older than the
+// window are ignored, and ones from the future are counted as now.
+func (a *PaymentAggregator) Add(metric PaymentMetric, now time.Time) {
+	at := metric.Timestamp
+	if at.IsZero() || at.After(now) {
+		at = now
+	}
+	second := at.Unix()
+	if now.Unix()-second >= int64(a.window) {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ring, ok := a.chains[metric.ChainID]
+	if !ok {
+		ring = make([]aggregateBucket, a.window)
+		a.chains[metric.ChainID] = ring
+	}
+	bucket := &ring[second%int64(a.window)]
+	if bucket.second != second || bucket.volume == nil {
+		*bucket = aggregateBucket{second: second, volume: new(big.Int)}
+	}
+
+	switch metric.Status {
+	case "pending":
+		bucket.created++
+	case "completed":
+		bucket.completed++
+		if amount, ok := new(big.Int).SetString(metric.Amount, 10); ok {
+			bucket.volume.Add(bucket.volume, amount)
+		}
+		bucket.volumeUSD += metric.AmountUSD
+	case "failed":
+		bucket.failed++
+	}
+}
+
+// Snapshot returns the aggregates of the window ending at now
+func (a *PaymentAggregator) Snapshot(now time.Time) RealtimeAggregates {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	total := aggregateBucket{volume: new(big.Int)}
+	snapshot := RealtimeAggregates{Chains: make(map[string]Aggregates)}
+	for chainID, ring := range a.chains {
+		chain := aggregateBucket{volume: new(big.Int)}
+		for i := range ring {
+			if ring[i].volume != nil && now.Unix()-ring[i].second < int64(a.window) {
+				chain.add(&ring[i])
+			}
+		}
+		if chain.created+chain.completed+chain.failed == 0 {
+			continue
+		}
+		total.add(&chain)
+		key := strconv.FormatUint(chainID, 10)
+		snapshot.Chains[key] = a.aggregates(key, &chain, now)
+	}
+	snapshot.Aggregates = a.aggregates("all", &total, now)
+	return snapshot
+}
+
+func (a *PaymentAggregator) aggregates(chainID string, bucket *aggregateBucket, now time.Time) Aggregates {
+	seconds := float64(a.window)
+	volume := new(big.Int).Mul(bucket.volume, big.NewInt(60))
+	volume.Quo(volume, big.NewInt(int64(a.window)))
+
+	aggregates := Aggregates{
+		ChainID:         chainID,
+		WindowSeconds:   a.window,
+		PaymentsPerSec:  float64(bucket.completed) / seconds,
+		CreatedPerSec:   float64(bucket.created) / seconds,
+		VolumePerMin:    volume.String(),
+		VolumeUSDPerMin: bucket.volumeUSD * 60 / seconds,
+		Created:         bucket.created,
+		Completed:       bucket.completed,
+		Failed:          bucket.failed,
+		ComputedAt:      now.UTC(),
+	}
+	if finished := bucket.completed + bucket.failed; finished > 0 {
+		aggregates.FailureRate = float64(bucket.failed) / float64(finished)
+	}
+	return aggregates
+}
+
+// Run broadcasts a snapshot every interval until ctx is done
+func (a *PaymentAggregator) Run(ctx context.Context, interval time.Duration, broadcast func(RealtimeAggregates)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			broadcast(a.Snapshot(now))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleAggregates serves the current aggregates, of one chain with
+// ?chain_id=
+func (s *AnalyticsServer) handleAggregates(w http.ResponseWriter, r *http.Request) {
+	snapshot := s.aggregator.Snapshot(time.Now())
+
+	var data interface{} = snapshot
+	if chainID := r.URL.Query().Get("chain_id"); chainID != "" {
+		if _, err := strconv.ParseUint(chainID, 10, 64); err != nil {
+			http.Error(w, "Invalid chain_id", http.StatusBadRequest)
+			return
+		}
+		chain, ok := snapshot.Chains[chainID]
+		if !ok {
+			chain = s.aggregator.aggregates(chainID, &aggregateBucket{volume: new(big.Int)}, snapshot.ComputedAt)
+		}
+		data = chain
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: data})
+}
@@ -0,0 +1,737 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// Alert rules are evaluated against the raw bucket on an interval. A rule
+// that breaches for its whole `for` duration fires and notifies its
+// channels; it resolves, and notifies again, once it stops breaching.
+// Silenced alerts are still tracked but send no notifications.
+
+const (
+	RuleThreshold    = "threshold"
+	RuleRateOfChange = "rate_of_change"
+	RuleAbsence      = "absence"
+
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// resolvedRetention is how long resolved alerts stay listed
+const resolvedRetention = 24 * time.Hour
+
+var (
+	ruleAggregates = map[string]bool{"mean": true, "max": true, "min": true, "sum": true, "count": true, "last": true, "spread": true, "p50": true, "p95": true, "p99": true}
+	ruleOperators  = map[string]bool{">": true, ">=": true, "<": true, "<=": true}
+	// rulePercentiles are the aggregates read as quantiles
+	rulePercentiles = map[string]float64{"p50": 0.5, "p95": 0.95, "p99": 0.99}
+)
+
+// Duration is a time.Duration written as a string such as "5m" in JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// AlertRule defines a condition on one measurement. Threshold rules compare
+// an aggregate over the window with Value. Rate of change rules compare the
+// percentage change of the aggregate from the previous window. Absence rules
+// fire when no point arrived within the window, per group seen within the
+// lookback.
+type AlertRule struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Description string            `json:"description,omitempty"`
+	Measurement string            `json:"measurement"`
+	Field       string            `json:"field,omitempty"`
+	Aggregate   string            `json:"aggregate,omitempty"`
+	Filters     map[string]string `json:"filters,omitempty"`
+	GroupBy     []string          `json:"group_by,omitempty"`
+	Operator    string            `json:"operator,omitempty"`
+	Value       float64           `json:"value"`
+	Window      Duration          `json:"window"`
+	Lookback    Duration          `json:"lookback,omitempty"`
+	For         Duration          `json:"for,omitempty"`
+	Severity    string            `json:"severity,omitempty"`
+	Channels    []string          `json:"channels,omitempty"`
+}
+
+// AlertConfig is the ALERT_RULES_PATH file
+type AlertConfig struct {
+	Channels []ChannelConfig `json:"channels"`
+	Rules    []AlertRule     `json:"rules"`
+}
+
+// defaultAlertRules cover the alert types in docs/ANALYTICS.md and are used
+// when ALERT_RULES_PATH is unset
+var defaultAlertRules = []AlertRule{
+	{
+		Name: "validator_offline", Type: RuleAbsence, Severity: "critical",
+		Description: "Validator has not reported in 5 minutes",
+		Measurement: "validators", GroupBy: []string{"validator_address"},
+		Window: Duration(5 * time.Minute), Lookback: Duration(time.Hour),
+	},
+	{
+		Name: "validator_slow", Type: RuleThreshold, Severity: "warning",
+		Description: "Validator response time above 2 seconds",
+		Measurement: "validators", Field: "response_time_ms", Aggregate: "mean", GroupBy: []string{"validator_address"},
+		Operator: ">", Value: 2000, Window: Duration(5 * time.Minute), For: Duration(10 * time.Minute),
+	},
+	{
+		Name: "payment_failures", Type: RuleThreshold, Severity: "warning",
+		Description: "More than 10 failed payments in 15 minutes",
+		Measurement: "payments", Field: "payment_id", Aggregate: "count", Filters: map[string]string{"status": "failed"},
+		GroupBy: []string{"chain_id"}, Operator: ">", Value: 10, Window: Duration(15 * time.Minute),
+	},
+	{
+		Name: "payment_reorgs", Type: RuleThreshold, Severity: "critical",
+		Description: "A reorg replaced blocks with indexed payments",
+		Measurement: "payments", Field: "payment_id", Aggregate: "count", Filters: map[string]string{"status": PaymentReorged},
+		GroupBy: []string{"chain_id"}, Operator: ">", Value: 0, Window: Duration(time.Hour),
+	},
+	{
+		Name: "payment_volume_drop", Type: RuleRateOfChange, Severity: "warning",
+		Description: "Payment volume fell by more than half from the previous hour",
+		Measurement: "payments", Field: "payment_id", Aggregate: "count", GroupBy: []string{"chain_id"},
+		Operator: "<", Value: -50, Window: Duration(time.Hour),
+	},
+	{
+		Name: "high_slashing", Type: RuleThreshold, Severity: "critical",
+		Description: "Multiple slashing events within an hour",
+		Measurement: "vaults", Field: "slashing_events", Aggregate: "spread", GroupBy: []string{"vault_address"},
+		Operator: ">=", Value: 2, Window: Duration(time.Hour),
+	},
+	{
+		Name: "gas_budget_high", Type: RuleThreshold, Severity: "warning",
+		Description: "Merchant has used 80% of today's gas sponsorship budget",
+		Measurement: "gas_budgets", Field: "used_pct", Aggregate: "last", GroupBy: []string{"chain_id", "merchant"},
+		Operator: ">=", Value: 80, Window: Duration(time.Hour),
+	},
+	{
+		Name: "gas_budget_exhausted", Type: RuleThreshold, Severity: "critical",
+		Description: "Merchant has used all of today's gas sponsorship budget",
+		Measurement: "gas_budgets", Field: "used_pct", Aggregate: "last", GroupBy: []string{"chain_id", "merchant"},
+		Operator: ">=", Value: 100, Window: Duration(time.Hour),
+	},
+}
+
+// Validate checks a rule is complete and names only known channels
+func (r *AlertRule) Validate(channels map[string]Notifier) error {
+	if r.Name == "" {
+		return fmt.Errorf("rule name is required")
+	}
+	if _, ok := sampleFields[r.Measurement]; !ok {
+		return fmt.Errorf("rule %s: unknown measurement %q", r.Name, r.Measurement)
+	}
+	if r.Window <= 0 {
+		return fmt.Errorf("rule %s: window is required", r.Name)
+	}
+
+	switch r.Type {
+	case RuleThreshold, RuleRateOfChange:
+		if r.Field == "" {
+			return fmt.Errorf("rule %s: field is required", r.Name)
+		}
+		if r.Aggregate == "" {
+			r.Aggregate = "mean"
+		}
+		if !ruleAggregates[r.Aggregate] {
+			return fmt.Errorf("rule %s: unknown aggregate %q", r.Name, r.Aggregate)
+		}
+		if !ruleOperators[r.Operator] {
+			return fmt.Errorf("rule %s: unknown operator %q", r.Name, r.Operator)
+		}
+	case RuleAbsence:
+		if r.Lookback == 0 {
+			r.Lookback = Duration(24 * time.Hour)
+		}
+		if r.Lookback <= r.Window {
+			return fmt.Errorf("rule %s: lookback must be longer than the window", r.Name)
+		}
+	default:
+		return fmt.Errorf("rule %s: unknown type %q", r.Name, r.Type)
+	}
+
+	if r.Severity == "" {
+		r.Severity = "warning"
+	}
+	for _, channel := range r.Channels {
+		if _, ok := channels[channel]; !ok {
+			return fmt.Errorf("rule %s: unknown channel %q", r.Name, channel)
+		}
+	}
+	return nil
+}
+
+// LoadAlertConfig reads rules and channels from the file at path,
+// ALERT_RULES_PATH, falling back to the default rules without channels
+func LoadAlertConfig(path string) (AlertConfig, error) {
+	if path == "" {
+		return AlertConfig{Rules: defaultAlertRules}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return AlertConfig{}, err
+	}
+	var cfg AlertConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return AlertConfig{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Sample is one group's value, or the time it was last seen, as read by a
+// rule
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+	Time   time.Time
+}
+
+// AlertSource reads the samples rules are evaluated against
+type AlertSource interface {
+	Aggregate(ctx context.Context, rule AlertRule, start, stop time.Time) ([]Sample, error)
+	LastSeen(ctx context.Context, rule AlertRule, start, stop time.Time) ([]Sample, error)
+}
+
+// Alert is the state of one rule for one group
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	State       string            `json:"state"`
+	Severity    string            `json:"severity"`
+	Description string            `json:"description,omitempty"`
+	Value       float64           `json:"value"`
+	ActiveSince time.Time         `json:"active_since"`
+	FiredAt     *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolved_at,omitempty"`
+	Silenced    bool              `json:"silenced"`
+}
+
+// Silence mutes notifications for alerts of Rule, or of every rule when
+// empty, whose labels include Labels
+type Silence struct {
+	ID      string            `json:"id"`
+	Rule    string            `json:"rule,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Comment string            `json:"comment,omitempty"`
+	Until   time.Time         `json:"until"`
+}
+
+func (s *Silence) matches(alert *Alert, now time.Time) bool {
+	if now.After(s.Until) {
+		return false
+	}
+	if s.Rule != "" && s.Rule != alert.Rule {
+		return false
+	}
+	for key, value := range s.Labels {
+		if alert.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// AlertEngine evaluates rules and tracks the alerts they raise
+type AlertEngine struct {
+	source    AlertSource
+	rules     []AlertRule
+	notifiers map[string]Notifier
+	onChange  func(Alert)
+
+	alerts   map[string]*Alert
+	silences map[string]*Silence
+	mutex    sync.Mutex
+}
+
+// NewAlertEngine validates the rules and builds the notification channels.
+// onChange is called for every alert that fires or resolves.
+func NewAlertEngine(cfg AlertConfig, source AlertSource, onChange func(Alert)) (*AlertEngine, error) {
+	notifiers := make(map[string]Notifier)
+	for _, channel := range cfg.Channels {
+		notifier, err := NewNotifier(channel)
+		if err != nil {
+			return nil, err
+		}
+		notifiers[channel.Name] = notifier
+	}
+
+	seen := make(map[string]bool)
+	rules := make([]AlertRule, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		if err := rule.Validate(notifiers); err != nil {
+			return nil, err
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule %s", rule.Name)
+		}
+		seen[rule.Name] = true
+		rules[i] = rule
+	}
+
+	return &AlertEngine{
+		source:    source,
+		rules:     rules,
+		notifiers: notifiers,
+		onChange:  onChange,
+		alerts:    make(map[string]*Alert),
+		silences:  make(map[string]*Silence),
+	}, nil
+}
+
+// Run evaluates every rule each interval until ctx is done
+func (e *AlertEngine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		e.Evaluate(ctx, time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Evaluate checks every rule once. A rule whose query fails keeps its
+// current alerts.
+func (e *AlertEngine) Evaluate(ctx context.Context, now time.Time) {
+	for _, rule := range e.rules {
+		breaches, err := e.check(ctx, rule, now)
+		if err != nil {
+			log.Printf("Failed to evaluate alert rule %s: %v", rule.Name, err)
+			continue
+		}
+		e.update(ctx, rule, breaches, now)
+	}
+	e.prune(now)
+}
+
+// check returns the groups breaching a rule, keyed by their labels
+func (e *AlertEngine) check(ctx context.Context, rule AlertRule, now time.Time) (map[string]Sample, error) {
+	window := time.Duration(rule.Window)
+	breaches := make(map[string]Sample)
+
+	switch rule.Type {
+	case RuleThreshold:
+		samples, err := e.source.Aggregate(ctx, rule, now.Add(-window), now)
+		if err != nil {
+			return nil, err
+		}
+		for _, sample := range samples {
+			if compare(sample.Value, rule.Operator, rule.Value) {
+				breaches[labelKey(sample.Labels)] = sample
+			}
+		}
+
+	case RuleRateOfChange:
+		current, err := e.source.Aggregate(ctx, rule, now.Add(-window), now)
+		if err != nil {
+			return nil, err
+		}
+		previous, err := e.source.Aggregate(ctx, rule, now.Add(-2*window), now.Add(-window))
+		if err != nil {
+			return nil, err
+		}
+		before := make(map[string]float64)
+		for _, sample := range previous {
+			before[labelKey(sample.Labels)] = sample.Value
+		}
+		for _, sample := range current {
+			prev, ok := before[labelKey(sample.Labels)]
+			if !ok || prev == 0 {
+				continue
+			}
+			change := (sample.Value - prev) / abs(prev) * 100
+			if compare(change, rule.Operator, rule.Value) {
+				breaches[labelKey(sample.Labels)] = Sample{Labels: sample.Labels, Value: change}
+			}
+		}
+
+	case RuleAbsence:
+		lookback := time.Duration(rule.Lookback)
+		samples, err := e.source.LastSeen(ctx, rule, now.Add(-lookback), now)
+		if err != nil {
+			return nil, err
+		}
+		if len(samples) == 0 && len(rule.GroupBy) == 0 {
+			breaches[""] = Sample{Value: lookback.Seconds()}
+		}
+		for _, sample := range samples {
+			if silent := now.Sub(sample.Time); silent > window {
+				breaches[labelKey(sample.Labels)] = Sample{Labels: sample.Labels, Value: silent.Seconds(), Time: sample.Time}
+			}
+		}
+	}
+	return breaches, nil
+}
+
+// update moves a rule's alerts through pending, firing and resolved
+func (e *AlertEngine) update(ctx context.Context, rule AlertRule, breaches map[string]Sample, now time.Time) {
+	var changed []Alert
+
+	e.mutex.Lock()
+	for key, sample := range breaches {
+		id := rule.Name + "|" + key
+		alert, exists := e.alerts[id]
+		if !exists || alert.State == AlertResolved {
+			alert = &Alert{
+				Rule:        rule.Name,
+				Labels:      sample.Labels,
+				State:       AlertPending,
+				Severity:    rule.Severity,
+				Description: rule.Description,
+				ActiveSince: now,
+			}
+			e.alerts[id] = alert
+		}
+		alert.Value = sample.Value
+		alert.Silenced = e.silenced(alert, now)
+
+		if alert.State == AlertPending && now.Sub(alert.ActiveSince) >= time.Duration(rule.For) {
+			firedAt := now
+			alert.State = AlertFiring
+			alert.FiredAt = &firedAt
+			changed = append(changed, *alert)
+		}
+	}
+
+	prefix := rule.Name + "|"
+	for id, alert := range e.alerts {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		if _, breaching := breaches[strings.TrimPrefix(id, prefix)]; breaching {
+			continue
+		}
+		switch alert.State {
+		case AlertPending:
+			delete(e.alerts, id)
+		case AlertFiring:
+			resolvedAt := now
+			alert.State = AlertResolved
+			alert.ResolvedAt = &resolvedAt
+			alert.Silenced = e.silenced(alert, now)
+			changed = append(changed, *alert)
+		}
+	}
+	e.mutex.Unlock()
+
+	for _, alert := range changed {
+		log.Printf("Alert %s %s %v: %.4g", alert.Rule, alert.State, alert.Labels, alert.Value)
+		if e.onChange != nil {
+			e.onChange(alert)
+		}
+		if !alert.Silenced {
+			e.notify(ctx, rule, alert)
+		}
+	}
+}
+
+// notify sends an alert to the rule's channels, or every channel when the
+// rule names none
+func (e *AlertEngine) notify(ctx context.Context, rule AlertRule, alert Alert) {
+	channels := rule.Channels
+	if len(channels) == 0 {
+		channels = sortedKeys(e.notifiers)
+	}
+	for _, channel := range channels {
+		if err := e.notifiers[channel].Notify(ctx, alert); err != nil {
+			log.Printf("Failed to notify %s of alert %s: %v", channel, alert.Rule, err)
+		}
+	}
+}
+
+// silenced reports whether an active silence matches an alert. Callers hold
+// the mutex.
+func (e *AlertEngine) silenced(alert *Alert, now time.Time) bool {
+	for _, silence := range e.silences {
+		if silence.matches(alert, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops expired silences and alerts resolved long ago
+func (e *AlertEngine) prune(now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for id, silence := range e.silences {
+		if now.After(silence.Until) {
+			delete(e.silences, id)
+		}
+	}
+	for id, alert := range e.alerts {
+		if alert.ResolvedAt != nil && now.Sub(*alert.ResolvedAt) > resolvedRetention {
+			delete(e.alerts, id)
+		}
+	}
+}
+
+// Alerts lists pending, firing and recently resolved alerts, firing first
+func (e *AlertEngine) Alerts() []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	now := time.Now()
+	alerts := make([]Alert, 0, len(e.alerts))
+	for _, alert := range e.alerts {
+		alert.Silenced = e.silenced(alert, now)
+		alerts = append(alerts, *alert)
+	}
+
+	order := map[string]int{AlertFiring: 0, AlertPending: 1, AlertResolved: 2}
+	sort.Slice(alerts, func(i, j int) bool {
+		if order[alerts[i].State] != order[alerts[j].State] {
+			return order[alerts[i].State] < order[alerts[j].State]
+		}
+		return alerts[i].ActiveSince.After(alerts[j].ActiveSince)
+	})
+	return alerts
+}
+
+// Rules returns the rules being evaluated
+func (e *AlertEngine) Rules() []AlertRule {
+	return e.rules
+}
+
+// Silences lists the active silences
+func (e *AlertEngine) Silences() []Silence {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	silences := make([]Silence, 0, len(e.silences))
+	for _, silence := range e.silences {
+		silences = append(silences, *silence)
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].Until.Before(silences[j].Until)
+	})
+	return silences
+}
+
+// AddSilence stores a silence and returns it with its ID
+func (e *AlertEngine) AddSilence(silence Silence) (Silence, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Silence{}, err
+	}
+	silence.ID = hex.EncodeToString(id)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.silences[silence.ID] = &silence
+	return silence, nil
+}
+
+// RemoveSilence deletes a silence, reporting whether it existed
+func (e *AlertEngine) RemoveSilence(id string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, exists := e.silences[id]; !exists {
+		return false
+	}
+	delete(e.silences, id)
+	return true
+}
+
+// influxAlertSource reads rule samples from an InfluxDB bucket
+type influxAlertSource struct {
+	queryAPI api.QueryAPI
+	bucket   string
+}
+
+// query selects a rule's points between start and stop, grouped by its
+// group_by tags
+func (s *influxAlertSource) query(rule AlertRule, start, stop time.Time) string {
+	flux := fmt.Sprintf(`from(bucket: %q)
+	|> range(start: %s, stop: %s)
+	|> filter(fn: (r) => r._measurement == %q)`,
+		s.bucket, start.UTC().Format(time.RFC3339), stop.UTC().Format(time.RFC3339), rule.Measurement)
+
+	if rule.Field != "" {
+		flux += fmt.Sprintf("\n\t|> filter(fn: (r) => r._field == %q)", rule.Field)
+	}
+	for _, tag := range sortedKeys(rule.Filters) {
+		flux += fmt.Sprintf("\n\t|> filter(fn: (r) => r[%q] == %q)", tag, rule.Filters[tag])
+	}
+
+	columns := make([]string, len(rule.GroupBy))
+	for i, tag := range rule.GroupBy {
+		columns[i] = fmt.Sprintf("%q", tag)
+	}
+	return flux + fmt.Sprintf("\n\t|> group(columns: [%s])", strings.Join(columns, ", "))
+}
+
+func (s *influxAlertSource) Aggregate(ctx context.Context, rule AlertRule, start, stop time.Time) ([]Sample, error) {
+	aggregate := rule.Aggregate + "()"
+	if q, ok := rulePercentiles[rule.Aggregate]; ok {
+		aggregate = fmt.Sprintf(`quantile(q: %g, method: "estimate_tdigest")`, q)
+	}
+	return s.samples(ctx, rule, s.query(rule, start, stop)+"\n\t|> "+aggregate)
+}
+
+func (s *influxAlertSource) LastSeen(ctx context.Context, rule AlertRule, start, stop time.Time) ([]Sample, error) {
+	return s.samples(ctx, rule, s.query(rule, start, stop)+"\n\t|> last()")
+}
+
+func (s *influxAlertSource) samples(ctx context.Context, rule AlertRule, flux string) ([]Sample, error) {
+	result, err := s.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []Sample
+	for result.Next() {
+		record := result.Record()
+		labels := make(map[string]string)
+		for _, tag := range rule.GroupBy {
+			if value, ok := record.ValueByKey(tag).(string); ok {
+				labels[tag] = value
+			}
+		}
+
+		sample := Sample{Labels: labels, Time: record.Time()}
+		switch value := record.Value().(type) {
+		case float64:
+			sample.Value = value
+		case int64:
+			sample.Value = float64(value)
+		case uint64:
+			sample.Value = float64(value)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, result.Err()
+}
+
+func compare(value float64, operator string, threshold float64) bool {
+	switch operator {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	}
+	return false
+}
+
+func abs(value float64) float64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+// labelKey identifies a group by its sorted labels
+func labelKey(labels map[string]string) string {
+	var parts []string
+	for _, key := range sortedKeys(labels) {
+		parts = append(parts, key+"="+labels[key])
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *AnalyticsServer) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: s.alerts.Alerts()})
+}
+
+func (s *AnalyticsServer) handleAlertRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: s.alerts.Rules()})
+}
+
+func (s *AnalyticsServer) handleSilences(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: s.alerts.Silences()})
+}
+
+// handleCreateSilence accepts a silence lasting either until a time or for a
+// duration such as "2h"
+func (s *AnalyticsServer) handleCreateSilence(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Silence
+		Duration Duration `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	silence := req.Silence
+	if req.Duration > 0 {
+		silence.Until = time.Now().Add(time.Duration(req.Duration))
+	}
+	if !silence.Until.After(time.Now()) {
+		http.Error(w, "Silence needs a duration or a future until", http.StatusBadRequest)
+		return
+	}
+
+	silence, err := s.alerts.AddSilence(silence)
+	if err != nil {
+		http.Error(w, "Failed to create silence", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: silence})
+}
+
+func (s *AnalyticsServer) handleDeleteSilence(w http.ResponseWriter, r *http.Request) {
+	if !s.alerts.RemoveSilence(mux.Vars(r)["id"]) {
+		http.Error(w, "Silence not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true})
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubAlertSource answers every rule with the samples tests set, the ones
+// of previous for windows ending before stop, or err
+type stubAlertSource struct {
+	samples  []Sample
+	lastSeen []Sample
+	previous []Sample
+	stop     time.Time
+	err      error
+}
+
+func (s *stubAlertSource) Aggregate(ctx context.Context, rule AlertRule, start, stop time.Time) ([]Sample, error) {
+	if stop.Before(s.stop) {
+		return s.previous, s.err
+	}
+	return s.samples, s.err
+}
+
+func (s *stubAlertSource) LastSeen(ctx context.Context, rule AlertRule, start, stop time.Time) ([]Sample, error) {
+	return s.lastSeen, s.err
+}
+
+// webhookRecorder is a webhook channel that records the alerts posted to it
+type webhookRecorder struct {
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func (h *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var alert Alert
+	if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	h.alerts = append(h.alerts, alert)
+	h.mu.Unlock()
+}
+
+// notified returns the state of each alert posted so far
+func (h *webhookRecorder) notified() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	states := make([]string, 0, len(h.alerts))
+	for _, alert := range h.alerts {
+		states = append(states, alert.State)
+	}
+	return states
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	t.Run("should fill in defaults", func(t *testing.T) {
+		rule := AlertRule{Name: "slow", Type: RuleThreshold, Measurement: "validators", Field: "response_time_ms", Operator: ">", Window: Duration(time.Minute)}
+		require.NoError(t, rule.Validate(nil))
+		assert.Equal(t, "mean", rule.Aggregate)
+		assert.Equal(t, "warning", rule.Severity)
+	})
+
+	t.Run("should reject incomplete rules", func(t *testing.T) {
+		rule := AlertRule{Name: "slow", Type: RuleThreshold, Measurement: "validators", Field: "response_time_ms", Operator: "!=", Window: Duration(time.Minute)}
+		assert.ErrorContains(t, rule.Validate(nil), `unknown operator "!="`)
+
+		rule = AlertRule{Name: "offline", Type: RuleAbsence, Measurement: "validators", Window: Duration(time.Hour), Lookback: Duration(time.Minute)}
+		assert.ErrorContains(t, rule.Validate(nil), "lookback must be longer than the window")
+
+		rule = AlertRule{Name: "slow", Type: RuleThreshold, Measurement: "validators", Field: "response_time_ms", Operator: ">", Window: Duration(time.Minute), Channels: []string{"ops"}}
+		assert.ErrorContains(t, rule.Validate(nil), `unknown channel "ops"`)
+	})
+}
+
+func TestAlertEngine(t *testing.T) {
+	newEngine := func(t *testing.T, source AlertSource, rule AlertRule) (*AlertEngine, *[]Alert) {
+		var changes []Alert
+		engine, err := NewAlertEngine(AlertConfig{Rules: []AlertRule{rule}}, source, func(alert Alert) {
+			changes = append(changes, alert)
+		})
+		require.NoError(t, err)
+		return engine, &changes
+	}
+	slow := AlertRule{
+		Name: "validator_slow", Type: RuleThreshold, Measurement: "validators", Field: "response_time_ms",
+		GroupBy: []string{"validator_address"}, Operator: ">", Value: 2000,
+		Window: Duration(5 * time.Minute), For: Duration(10 * time.Minute),
+	}
+	labels := map[string]string{"validator_address": "0xabc"}
+
+	t.Run("should fire once a breach lasts its for duration and then resolve", func(t *testing.T) {
+		source := &stubAlertSource{samples: []Sample{{Labels: labels, Value: 2500}}}
+		engine, changes := newEngine(t, source, slow)
+		now := time.Now()
+
+		engine.Evaluate(context.Background(), now)
+		alerts := engine.Alerts()
+		require.Len(t, alerts, 1)
+		assert.Equal(t, AlertPending, alerts[0].State)
+		assert.Empty(t, *changes)
+
+		engine.Evaluate(context.Background(), now.Add(10*time.Minute))
+		alerts = engine.Alerts()
+		require.Len(t, alerts, 1)
+		assert.Equal(t, AlertFiring, alerts[0].State)
+		assert.Equal(t, 2500.0, alerts[0].Value)
+		require.Len(t, *changes, 1)
+
+		source.samples = []Sample{{Labels: labels, Value: 1200}}
+		engine.Evaluate(context.Background(), now.Add(15*time.Minute))
+		alerts = engine.Alerts()
+		require.Len(t, alerts, 1)
+		assert.Equal(t, AlertResolved, alerts[0].State)
+		require.NotNil(t, alerts[0].ResolvedAt)
+		require.Len(t, *changes, 2)
+		assert.Equal(t, AlertResolved, (*changes)[1].State)
+	})
+
+	t.Run("should drop pending alerts that stop breaching", func(t *testing.T) {
+		source := &stubAlertSource{samples: []Sample{{Labels: labels, Value: 2500}}}
+		engine, changes := newEngine(t, source, slow)
+		now := time.Now()
+
+		engine.Evaluate(context.Background(), now)
+		source.samples = nil
+		engine.Evaluate(context.Background(), now.Add(time.Minute))
+		assert.Empty(t, engine.Alerts())
+		assert.Empty(t, *changes)
+	})
+
+	t.Run("should fire absence rules for silent groups", func(t *testing.T) {
+		now := time.Now()
+		source := &stubAlertSource{lastSeen: []Sample{
+			{Labels: map[string]string{"validator_address": "0xabc"}, Time: now.Add(-10 * time.Minute)},
+			{Labels: map[string]string{"validator_address": "0xdef"}, Time: now.Add(-time.Minute)},
+		}}
+		engine, changes := newEngine(t, source, AlertRule{
+			Name: "validator_offline", Type: RuleAbsence, Measurement: "validators", GroupBy: []string{"validator_address"},
+			Window: Duration(5 * time.Minute), Lookback: Duration(time.Hour),
+		})
+
+		engine.Evaluate(context.Background(), now)
+		require.Len(t, *changes, 1)
+		assert.Equal(t, AlertFiring, (*changes)[0].State)
+		assert.Equal(t, "0xabc", (*changes)[0].Labels["validator_address"])
+		assert.Equal(t, 600.0, (*changes)[0].Value)
+	})
+
+	t.Run("should mark alerts matching a silence", func(t *testing.T) {
+		source := &stubAlertSource{samples: []Sample{{Labels: labels, Value: 2500}}}
+		engine, _ := newEngine(t, source, slow)
+		silence, err := engine.AddSilence(Silence{Rule: "validator_slow", Labels: labels, Until: time.Now().Add(time.Hour)})
+		require.NoError(t, err)
+
+		engine.Evaluate(context.Background(), time.Now())
+		alerts := engine.Alerts()
+		require.Len(t, alerts, 1)
+		assert.True(t, alerts[0].Silenced)
+
+		require.True(t, engine.RemoveSilence(silence.ID))
+		assert.False(t, engine.Alerts()[0].Silenced)
+		assert.False(t, engine.RemoveSilence(silence.ID))
+	})
+
+	t.Run("should only track the groups that breach", func(t *testing.T) {
+		source := &stubAlertSource{samples: []Sample{
+			{Labels: map[string]string{"validator_address": "0xabc"}, Value: 2500},
+			{Labels: map[string]string{"validator_address": "0xdef"}, Value: 2000},
+			{Labels: map[string]string{"validator_address": "0x123"}, Value: 1500},
+		}}
+		engine, _ := newEngine(t, source, slow)
+
+		engine.Evaluate(context.Background(), time.Now())
+		alerts := engine.Alerts()
+		require.Len(t, alerts, 1)
+		assert.Equal(t, "0xabc", alerts[0].Labels["validator_address"])
+	})
+
+	t.Run("should fire rules without a for duration at once", func(t *testing.T) {
+		rule := slow
+		rule.For = 0
+		source := &stubAlertSource{samples: []Sample{{Labels: labels, Value: 2500}}}
+		engine, changes := newEngine(t, source, rule)
+		now := time.Now()
+
+		engine.Evaluate(context.Background(), now)
+		require.Len(t, *changes, 1)
+		assert.Equal(t, AlertFiring, (*changes)[0].State)
+		assert.Equal(t, now, *(*changes)[0].FiredAt)
+	})
+
+	t.Run("should compare the rate of change with the previous window", func(t *testing.T) {
+		drop := AlertRule{
+			Name: "volume_drop", Type: RuleRateOfChange, Measurement: "payments", Field: "amount_usd", Aggregate: "sum",
+			GroupBy: []string{"chain_id"}, Operator: "<", Value: -50, Window: Duration(time.Hour),
+		}
+		group := map[string]string{"chain_id": "4202"}
+
+		for _, tc := range []struct {
+			name     string
+			previous []Sample
+			current  float64
+			change   float64
+			fires    bool
+		}{
+			{name: "drop past the threshold", previous: []Sample{{Labels: group, Value: 100}}, current: 40, change: -60, fires: true},
+			{name: "drop at the threshold", previous: []Sample{{Labels: group, Value: 100}}, current: 50},
+			{name: "rise", previous: []Sample{{Labels: group, Value: 100}}, current: 300},
+			{name: "negative previous value", previous: []Sample{{Labels: group, Value: -100}}, current: -220, change: -120, fires: true},
+			{name: "nothing before", current: 0},
+			{name: "zero before", previous: []Sample{{Labels: group, Value: 0}}, current: 10},
+			{name: "other group before", previous: []Sample{{Labels: map[string]string{"chain_id": "1"}, Value: 100}}, current: 10},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				now := time.Now()
+				source := &stubAlertSource{samples: []Sample{{Labels: group, Value: tc.current}}, previous: tc.previous, stop: now}
+				engine, changes := newEngine(t, source, drop)
+
+				engine.Evaluate(context.Background(), now)
+				if !tc.fires {
+					assert.Empty(t, *changes)
+					assert.Empty(t, engine.Alerts())
+					return
+				}
+				require.Len(t, *changes, 1)
+				assert.Equal(t, AlertFiring, (*changes)[0].State)
+				assert.InDelta(t, tc.change, (*changes)[0].Value, 1e-9)
+			})
+		}
+	})
+
+	t.Run("should keep alerts while the source fails", func(t *testing.T) {
+		source := &stubAlertSource{samples: []Sample{{Labels: labels, Value: 2500}}}
+		engine, changes := newEngine(t, source, slow)
+		now := time.Now()
+		engine.Evaluate(context.Background(), now)
+		engine.Evaluate(context.Background(), now.Add(10*time.Minute))
+		require.Len(t, *changes, 1)
+
+		source.samples, source.err = nil, errors.New("influxdb unavailable")
+		engine.Evaluate(context.Background(), now.Add(15*time.Minute))
+		alerts := engine.Alerts()
+		require.Len(t, alerts, 1)
+		assert.Equal(t, AlertFiring, alerts[0].State)
+		assert.Len(t, *changes, 1)
+	})
+
+	t.Run("should start over when a resolved alert breaches again", func(t *testing.T) {
+		source := &stubAlertSource{samples: []Sample{{Labels: labels, Value: 2500}}}
+		engine, changes := newEngine(t, source, slow)
+		now := time.Now()
+		engine.Evaluate(context.Background(), now)
+		engine.Evaluate(context.Background(), now.Add(10*time.Minute))
+		source.samples = nil
+		engine.Evaluate(context.Background(), now.Add(15*time.Minute))
+		require.Len(t, *changes, 2)
+
+		source.samples = []Sample{{Labels: labels, Value: 3000}}
+		engine.Evaluate(context.Background(), now.Add(20*time.Minute))
+		alerts := engine.Alerts()
+		require.Len(t, alerts, 1)
+		assert.Equal(t, AlertPending, alerts[0].State)
+		assert.Equal(t, now.Add(20*time.Minute), alerts[0].ActiveSince)
+		assert.Nil(t, alerts[0].FiredAt)
+		assert.Nil(t, alerts[0].ResolvedAt)
+
+		engine.Evaluate(context.Background(), now.Add(30*time.Minute))
+		require.Len(t, *changes, 3)
+		assert.Equal(t, AlertFiring, (*changes)[2].State)
+	})
+
+	t.Run("should list resolved alerts for a day", func(t *testing.T) {
+		source := &stubAlertSource{samples: []Sample{{Labels: labels, Value: 2500}}}
+		engine, _ := newEngine(t, source, slow)
+		now := time.Now()
+		engine.Evaluate(context.Background(), now)
+		engine.Evaluate(context.Background(), now.Add(10*time.Minute))
+		source.samples = nil
+		resolved := now.Add(15 * time.Minute)
+		engine.Evaluate(context.Background(), resolved)
+
+		engine.Evaluate(context.Background(), resolved.Add(resolvedRetention))
+		require.Len(t, engine.Alerts(), 1)
+		engine.Evaluate(context.Background(), resolved.Add(resolvedRetention+time.Second))
+		assert.Empty(t, engine.Alerts())
+	})
+
+	t.Run("should fire absence rules without groups when nothing reports", func(t *testing.T) {
+		missing := AlertRule{Name: "probe_missing", Type: RuleAbsence, Measurement: "probes", Window: Duration(15 * time.Minute), Lookback: Duration(time.Hour)}
+		engine, changes := newEngine(t, &stubAlertSource{}, missing)
+
+		engine.Evaluate(context.Background(), time.Now())
+		require.Len(t, *changes, 1)
+		assert.Equal(t, 3600.0, (*changes)[0].Value)
+		assert.Empty(t, (*changes)[0].Labels)
+
+		missing.Name, missing.GroupBy = "probe_stage_missing", []string{"stage"}
+		engine, changes = newEngine(t, &stubAlertSource{}, missing)
+		engine.Evaluate(context.Background(), time.Now())
+		assert.Empty(t, *changes)
+	})
+}
+
+func TestAlertSilences(t *testing.T) {
+	labels := map[string]string{"validator_address": "0xabc"}
+	other := map[string]string{"validator_address": "0xdef"}
+	slow := AlertRule{
+		Name: "validator_slow", Type: RuleThreshold, Measurement: "validators", Field: "response_time_ms",
+		GroupBy: []string{"validator_address"}, Operator: ">", Value: 2000, Window: Duration(5 * time.Minute),
+		Channels: []string{"ops"},
+	}
+	newEngine := func(t *testing.T, source AlertSource, rules ...AlertRule) (*AlertEngine, *[]Alert, *webhookRecorder) {
+		recorder := &webhookRecorder{}
+		server := httptest.NewServer(recorder)
+		t.Cleanup(server.Close)
+
+		var changes []Alert
+		engine, err := NewAlertEngine(AlertConfig{
+			Rules:    rules,
+			Channels: []ChannelConfig{{Name: "ops", Type: "webhook", URL: server.URL}},
+		}, source, func(alert Alert) {
+			changes = append(changes, alert)
+		})
+		require.NoError(t, err)
+		return engine, &changes, recorder
+	}
+
+	t.Run("should match silences within their window", func(t *testing.T) {
+		now := time.Now()
+		alert := &Alert{Rule: "validator_slow", Labels: map[string]string{"validator_address": "0xabc", "chain_id": "4202"}}
+
+		for _, tc := range []struct {
+			name    string
+			silence Silence
+			matches bool
+		}{
+			{name: "rule and labels", silence: Silence{Rule: "validator_slow", Labels: labels, Until: now.Add(time.Minute)}, matches: true},
+			{name: "until now", silence: Silence{Rule: "validator_slow", Until: now}, matches: true},
+			{name: "expired", silence: Silence{Rule: "validator_slow", Until: now.Add(-time.Nanosecond)}},
+			{name: "every rule", silence: Silence{Labels: labels, Until: now.Add(time.Minute)}, matches: true},
+			{name: "everything", silence: Silence{Until: now.Add(time.Minute)}, matches: true},
+			{name: "other rule", silence: Silence{Rule: "validator_offline", Until: now.Add(time.Minute)}},
+			{name: "other labels", silence: Silence{Labels: other, Until: now.Add(time.Minute)}},
+			{name: "label the alert lacks", silence: Silence{Labels: map[string]string{"vault_address": "0xabc"}, Until: now.Add(time.Minute)}},
+			{name: "some labels", silence: Silence{Labels: map[string]string{"chain_id": "4202"}, Until: now.Add(time.Minute)}, matches: true},
+		} {
+			assert.Equal(t, tc.matches, tc.silence.matches(alert, now), tc.name)
+		}
+	})
+
+	t.Run("should hold back notifications until the silence ends", func(t *testing.T) {
+		source := &stubAlertSource{samples: []Sample{{Labels: labels, Value: 2500}}}
+		engine, changes, recorder := newEngine(t, source, slow)
+		now := time.Now()
+		_, err := engine.AddSilence(Silence{Rule: "validator_slow", Until: now.Add(30 * time.Minute)})
+		require.NoError(t, err)
+
+		engine.Evaluate(context.Background(), now)
+		require.Len(t, *changes, 1)
+		assert.True(t, (*changes)[0].Silenced)
+		assert.Empty(t, recorder.notified())
+
+		engine.Evaluate(context.Background(), now.Add(30*time.Minute))
+		assert.Len(t, engine.Silences(), 1)
+		engine.Evaluate(context.Background(), now.Add(31*time.Minute))
+		assert.Empty(t, engine.Silences())
+		assert.Len(t, *changes, 1)
+
+		source.samples = nil
+		engine.Evaluate(context.Background(), now.Add(40*time.Minute))
+		require.Len(t, *changes, 2)
+		assert.False(t, (*changes)[1].Silenced)
+		assert.Equal(t, []string{AlertResolved}, recorder.notified())
+	})
+
+	t.Run("should silence the resolution of an alert that fired before", func(t *testing.T) {
+		source := &stubAlertSource{samples: []Sample{{Labels: labels, Value: 2500}}}
+		engine, _, recorder := newEngine(t, source, slow)
+		now := time.Now()
+		engine.Evaluate(context.Background(), now)
+		require.Equal(t, []string{AlertFiring}, recorder.notified())
+
+		_, err := engine.AddSilence(Silence{Labels: labels, Until: now.Add(time.Hour)})
+		require.NoError(t, err)
+		source.samples = nil
+		engine.Evaluate(context.Background(), now.Add(5*time.Minute))
+		assert.Equal(t, []string{AlertFiring}, recorder.notified())
+	})
+
+	t.Run("should only silence the matching groups and rules", func(t *testing.T) {
+		offline := AlertRule{
+			Name: "validator_offline", Type: RuleAbsence, Measurement: "validators", GroupBy: []string{"validator_address"},
+			Window: Duration(5 * time.Minute), Lookback: Duration(time.Hour), Channels: []string{"ops"},
+		}
+		now := time.Now()
+		source := &stubAlertSource{
+			samples:  []Sample{{Labels: labels, Value: 2500}, {Labels: other, Value: 2500}},
+			lastSeen: []Sample{{Labels: labels, Time: now.Add(-10 * time.Minute)}, {Labels: other, Time: now.Add(-10 * time.Minute)}},
+		}
+		engine, changes, recorder := newEngine(t, source, slow, offline)
+		_, err := engine.AddSilence(Silence{Labels: labels, Until: now.Add(time.Hour)})
+		require.NoError(t, err)
+		_, err = engine.AddSilence(Silence{Rule: "validator_offline", Labels: other, Until: now.Add(time.Hour)})
+		require.NoError(t, err)
+
+		engine.Evaluate(context.Background(), now)
+		require.Len(t, *changes, 4)
+		silenced := make(map[string]bool)
+		for _, alert := range *changes {
+			silenced[alert.Rule+" "+alert.Labels["validator_address"]] = alert.Silenced
+		}
+		assert.Equal(t, map[string]bool{
+			"validator_slow 0xabc":    true,
+			"validator_slow 0xdef":    false,
+			"validator_offline 0xabc": true,
+			"validator_offline 0xdef": true,
+		}, silenced)
+		assert.Equal(t, []string{AlertFiring}, recorder.notified())
+	})
+}
+
+func TestCompare(t *testing.T) {
+	assert.True(t, compare(3, ">", 2))
+	assert.True(t, compare(2, ">=", 2))
+	assert.False(t, compare(2, "<", 2))
+	assert.True(t, compare(-60, "<=", -50))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Read endpoints can require an API token. Admin tokens see every metric;
+// merchant tokens only see payments to their own addresses, and that
+// restriction is added to every query built for them. Payments are tagged
+// with their recipient as merchant, so the scope is applied by InfluxDB.
+// Metric ingestion is left open for the internal services reporting to it.
+
+const (
+	RoleAdmin    = "admin"
+	RoleMerchant = "merchant"
+)
+
+// APIToken grants a role, and for merchants the addresses it may read
+type APIToken struct {
+	Name      string   `json:"name"`
+	Token     string   `json:"token"`
+	Role      string   `json:"role"`
+	Merchants []string `json:"merchants,omitempty"`
+}
+
+// Scope is what an authenticated request may read
+type Scope struct {
+	Name      string
+	Role      string
+	Merchants []string
+}
+
+type scopeKey struct{}
+
+// adminScope is used for every request when open access is enabled
+var adminScope = &Scope{Name: "anonymous", Role: RoleAdmin}
+
+// deniedScope is given to requests that reach a scoped handler without
+// passing the middleware. It has no role and no merchants, so it reads
+// nothing.
+var deniedScope = &Scope{Name: "anonymous"}
+
+// IsAdmin reports whether the scope sees global data
+func (s *Scope) IsAdmin() bool {
+	return s.Role == RoleAdmin
+}
+
+// fluxFilter restricts a query to the scope's merchants. It is empty for
+// admins.
+func (s *Scope) fluxFilter() string {
+	if s.IsAdmin() {
+		return ""
+	}
+	merchants := make([]string, len(s.Merchants))
+	for i, merchant := range s.Merchants {
+		merchants[i] = fmt.Sprintf("%q", merchant)
+	}
+	return fmt.Sprintf(`|> filter(fn: (r) => contains(value: r["merchant"], set: [%s]))`, strings.Join(merchants, ", "))
+}
+
+// allows reports whether a broadcast may be sent to a client with this scope
+func (s *Scope) allows(event *wsEvent) bool {
+	return s.IsAdmin() || (event.Type == "payment" && containsString(s.Merchants, event.Merchant))
+}
+
+// Authenticator maps API tokens to scopes
+type Authenticator struct {
+	scopes map[string]*Scope
+	// open treats every request as admin
+	open bool
+}
+
+// LoadAuthenticator reads tokens from the JSON file at path,
+// ANALYTICS_TOKENS_PATH:
+//
+//	{"tokens": [{"name": "acme", "token": "...", "role": "merchant", "merchants": ["0x..."]}]}
+//
+// The path is required unless open, ANALYTICS_OPEN_ACCESS, is set for local
+// development, in which case every request is treated as admin.
+func LoadAuthenticator(path string, open bool) (*Authenticator, error) {
+	auth := &Authenticator{scopes: make(map[string]*Scope)}
+
+	if path == "" {
+		if !open {
+			return nil, fmt.Errorf("ANALYTICS_TOKENS_PATH is required unless ANALYTICS_OPEN_ACCESS is set")
+		}
+		log.Printf("ANALYTICS_OPEN_ACCESS set, API is open with global access")
+		auth.open = true
+		return auth, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Tokens []APIToken `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for _, token := range config.Tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %s: token is required", token.Name)
+		}
+		scope := &Scope{Name: token.Name, Role: token.Role}
+		switch token.Role {
+		case RoleAdmin:
+		case RoleMerchant:
+			if len(token.Merchants) == 0 {
+				return nil, fmt.Errorf("token %s: merchants are required", token.Name)
+			}
+			for _, merchant := range token.Merchants {
+				scope.Merchants = append(scope.Merchants, strings.ToLower(merchant))
+			}
+		default:
+			return nil, fmt.Errorf("token %s: unknown role %q", token.Name, token.Role)
+		}
+		auth.scopes[hashToken(token.Token)] = scope
+	}
+
+	log.Printf("Loaded %d API tokens", len(auth.scopes))
+	return auth, nil
+}
+
+// Middleware attaches the scope of the request's token, rejecting requests
+// without a valid one unless access is open. The token is read from the
+// Authorization header, X-API-Key or, for WebSocket clients that cannot set
+// headers, the token query parameter.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := adminScope
+		if !a.open {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" {
+				token = r.Header.Get("X-API-Key")
+			}
+			if token == "" {
+				token = r.URL.Query().Get("token")
+			}
+
+			var ok bool
+			if scope, ok = a.scopes[hashToken(token)]; !ok || token == "" {
+				http.Error(w, "Invalid or missing API token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopeKey{}, scope)))
+	})
+}
+
+// requireAdmin rejects requests from merchant tokens
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !scopeFrom(r).IsAdmin() {
+			http.Error(w, "Admin token required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// scopeFrom returns the scope attached by the middleware, or deniedScope for
+// routes it does not cover
+func scopeFrom(r *http.Request) *Scope {
+	if scope, ok := r.Context().Value(scopeKey{}).(*Scope); ok {
+		return scope
+	}
+	return deniedScope
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"tokens": [
+		{"name": "ops", "token": "admin-token", "role": "admin"},
+		{"name": "acme", "token": "merchant-token", "role": "merchant", "merchants": ["0xABCDEF0000000000000000000000000000000001"]}
+	]}`), 0o600))
+	auth, err := LoadAuthenticator(path, false)
+	require.NoError(t, err)
+	return auth
+}
+
+func TestAuthenticator(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	var scope *Scope
+	handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope = scopeFrom(r)
+	}))
+
+	t.Run("should scope merchant tokens to their merchants", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/realtime/payments", nil)
+		req.Header.Set("Authorization", "Bearer merchant-token")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.False(t, scope.IsAdmin())
+		assert.Equal(t, []string{"0xabcdef0000000000000000000000000000000001"}, scope.Merchants)
+		assert.Equal(t, `|> filter(fn: (r) => contains(value: r["merchant"], set: ["0xabcdef0000000000000000000000000000000001"]))`, scope.fluxFilter())
+	})
+
+	t.Run("should not filter admin queries", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/ws?token=admin-token", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.True(t, scope.IsAdmin())
+		assert.Empty(t, scope.fluxFilter())
+	})
+
+	t.Run("should reject missing and unknown tokens", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/dashboard", nil))
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/dashboard", nil)
+		req.Header.Set("X-API-Key", "guess")
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("should keep merchants out of admin endpoints", func(t *testing.T) {
+		guarded := auth.Middleware(requireAdmin(func(w http.ResponseWriter, r *http.Request) {}))
+
+		req := httptest.NewRequest(http.MethodGet, "/api/dashboard", nil)
+		req.Header.Set("Authorization", "Bearer merchant-token")
+		recorder := httptest.NewRecorder()
+		guarded.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+		req.Header.Set("Authorization", "Bearer admin-token")
+		recorder = httptest.NewRecorder()
+		guarded.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("should only send merchants their own payments", func(t *testing.T) {
+		merchant := &Scope{Role: RoleMerchant, Merchants: []string{"0xabc"}}
+		assert.True(t, merchant.allows(&wsEvent{Type: "payment", Merchant: "0xabc"}))
+		assert.False(t, merchant.allows(&wsEvent{Type: "payment", Merchant: "0xdef"}))
+		assert.False(t, merchant.allows(&wsEvent{Type: "validator"}))
+		assert.True(t, adminScope.allows(&wsEvent{Type: "validator"}))
+	})
+
+	t.Run("should deny handlers the middleware does not cover", func(t *testing.T) {
+		scope := scopeFrom(httptest.NewRequest(http.MethodGet, "/api/dashboard", nil))
+		assert.False(t, scope.IsAdmin())
+		assert.Empty(t, scope.Merchants)
+		assert.False(t, scope.allows(&wsEvent{Type: "payment"}))
+
+		recorder := httptest.NewRecorder()
+		requireAdmin(func(w http.ResponseWriter, r *http.Request) {})(recorder, httptest.NewRequest(http.MethodGet, "/api/dashboard", nil))
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("should require a token file unless access is open", func(t *testing.T) {
+		_, err := LoadAuthenticator("", false)
+		assert.ErrorContains(t, err, "ANALYTICS_TOKENS_PATH is required")
+
+		open, err := LoadAuthenticator("", true)
+		require.NoError(t, err)
+		handler := open.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scope = scopeFrom(r)
+		}))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/dashboard", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.True(t, scope.IsAdmin())
+	})
+
+	t.Run("should reject every request when the token file has no tokens", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "tokens.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"tokens": []}`), 0o600))
+		empty, err := LoadAuthenticator(path, false)
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		empty.Middleware(handler).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/dashboard", nil))
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("should reject merchant tokens without merchants", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "tokens.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"tokens": [{"name": "acme", "token": "t", "role": "merchant"}]}`), 0o600))
+		_, err := LoadAuthenticator(path, false)
+		assert.ErrorContains(t, err, "merchants are required")
+	})
+}
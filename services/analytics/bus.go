@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Metrics can also be published to NATS JetStream instead of POSTed. The
+// stream keeps each metric until an instance writes it to InfluxDB and acks
+// it, so bursts and restarts delay metrics instead of dropping them. Every
+// instance binds the same durable consumer, and JetStream spreads the messages
+// across them. A redelivered metric rewrites the same InfluxDB point, so
+// at-least-once delivery does not double count.
+
+// MetricSubjectPrefix is prepended to the metric type (payment, validator,
+// vault, signature or receipt) to form the subject a metric is published on
+const MetricSubjectPrefix = "analytics.metrics."
+
+var errMalformedMetric = errors.New("malformed metric")
+
+// BusConfig configures the event bus consumer
+type BusConfig struct {
+	URL        string
+	Stream     string
+	Durable    string
+	MaxDeliver int
+	AckWait    time.Duration
+	MaxAge     time.Duration
+}
+
+func loadBusConfig(url string) BusConfig {
+	return BusConfig{
+		URL:        url,
+		Stream:     getEnv("EVENT_BUS_STREAM", "ANALYTICS"),
+		Durable:    getEnv("EVENT_BUS_CONSUMER", "analytics-ingest"),
+		MaxDeliver: getEnvInt("EVENT_BUS_MAX_DELIVER", 10),
+		AckWait:    time.Duration(getEnvInt("EVENT_BUS_ACK_WAIT_SECONDS", 30)) * time.Second,
+		MaxAge:     time.Duration(getEnvInt("EVENT_BUS_RETENTION_HOURS", 72)) * time.Hour,
+	}
+}
+
+// BusConsumer ingests metrics from a JetStream stream
+type BusConsumer struct {
+	server  *AnalyticsServer
+	config  BusConfig
+	conn    *nats.Conn
+	consume jetstream.ConsumeContext
+}
+
+// NewBusConsumer connects to NATS, creates the stream and durable consumer if
+// they do not exist and starts consuming
+func NewBusConsumer(cfg BusConfig, server *AnalyticsServer) (*BusConsumer, error) {
+	conn, err := nats.Connect(cfg.URL, nats.Name("crosspay-analytics"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", cfg.URL, err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     cfg.Stream,
+		Subjects: []string{MetricSubjectPrefix + ">"},
+		Storage:  jetstream.FileStorage,
+		MaxAge:   cfg.MaxAge,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create stream %s: %w", cfg.Stream, err)
+	}
+
+	consumer, err := js.CreateOrUpdateConsumer(ctx, cfg.Stream, jetstream.ConsumerConfig{
+		Durable:       cfg.Durable,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       cfg.AckWait,
+		MaxDeliver:    cfg.MaxDeliver,
+		FilterSubject: MetricSubjectPrefix + ">",
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create consumer %s: %w", cfg.Durable, err)
+	}
+
+	b := &BusConsumer{server: server, config: cfg, conn: conn}
+	b.consume, err = consumer.Consume(b.handle, jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		log.Printf("Event bus consume error: %v", err)
+	}))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	log.Printf("Consuming metrics from stream %s as %s", cfg.Stream, cfg.Durable)
+	return b, nil
+}
+
+// handle acks a metric once it is written. Malformed metrics are terminated,
+// since redelivering them cannot succeed; failed writes are redelivered after
+// a delay until MaxDeliver is reached.
+func (b *BusConsumer) handle(msg jetstream.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.AckWait)
+	defer cancel()
+
+	err := b.ingest(ctx, msg.Subject(), msg.Data())
+	switch {
+	case err == nil:
+		if err := msg.Ack(); err != nil {
+			log.Printf("Failed to ack metric on %s: %v", msg.Subject(), err)
+		}
+	case errors.Is(err, errMalformedMetric):
+		b.server.ingest.CountInvalid()
+		log.Printf("Dropping metric on %s: %v", msg.Subject(), err)
+		msg.Term()
+	default:
+		if meta, metaErr := msg.Metadata(); metaErr == nil && int(meta.NumDelivered) >= b.config.MaxDeliver {
+			log.Printf("Giving up on metric on %s after %d deliveries: %v", msg.Subject(), meta.NumDelivered, err)
+		} else {
+			log.Printf("Failed to ingest metric on %s, redelivering: %v", msg.Subject(), err)
+		}
+		msg.NakWithDelay(5 * time.Second)
+	}
+}
+
+// ingest writes a metric to InfluxDB, waiting for the write so it is only
+// acked once stored, then announces it like a POSTed metric
+func (b *BusConsumer) ingest(ctx context.Context, subject string, data []byte) error {
+	var point *write.Point
+	var announce func()
+
+	switch strings.TrimPrefix(subject, MetricSubjectPrefix) {
+	case "payment":
+		var metric PaymentMetric
+		if err := decodeMetric("payment", data, &metric); err != nil {
+			return err
+		}
+		b.server.geo.Enrich(&metric, nil)
+		b.server.fx.Enrich(ctx, &metric)
+		point = paymentPoint(&metric)
+		announce = func() { b.server.announcePayment(metric) }
+	case "validator":
+		var metric ValidatorMetric
+		if err := decodeMetric("validator", data, &metric); err != nil {
+			return err
+		}
+		point = validatorPoint(metric)
+		announce = func() { b.server.announceValidator(metric) }
+	case "vault":
+		var metric VaultMetric
+		if err := decodeMetric("vault", data, &metric); err != nil {
+			return err
+		}
+		point = vaultPoint(metric)
+		announce = func() { b.server.announceVault(metric) }
+	case "signature":
+		var metric SignatureMetric
+		if err := decodeMetric("signature", data, &metric); err != nil {
+			return err
+		}
+		point = signaturePoint(metric)
+		announce = func() {}
+	case "receipt":
+		var metric ReceiptMetric
+		if err := decodeMetric("receipt", data, &metric); err != nil {
+			return err
+		}
+		point = receiptPoint(metric)
+		announce = func() {}
+	default:
+		return fmt.Errorf("%w: unknown subject %s", errMalformedMetric, subject)
+	}
+
+	if err := b.server.writer.WritePoint(ctx, point); err != nil {
+		return err
+	}
+	announce()
+	return nil
+}
+
+// Stop stops fetching metrics and waits for the ones in flight to be acked
+func (b *BusConsumer) Stop() {
+	b.consume.Stop()
+	if err := b.conn.Drain(); err != nil {
+		log.Printf("Failed to drain NATS connection: %v", err)
+	}
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(getEnv(key, "")); err == nil {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+const (
+	// indexerMaxBackoff caps the wait between attempts while a chain fails
+	indexerMaxBackoff = 5 * time.Minute
+	// indexerReconnectAfter is how many failures in a row drop the RPC
+	// connection so the next attempt dials again
+	indexerReconnectAfter = 3
+)
+
+// VaultState is a vault's totals, read from the contract
+type VaultState struct {
+	Address        string `json:"address"`
+	TotalAssets    string `json:"total_assets"`
+	InsuranceFund  string `json:"insurance_fund"`
+	SlashingEvents uint64 `json:"slashing_events"`
+}
+
+// ChainState is the indexer's view of a chain: its progress and the state
+// last read from its contracts. When the RPC endpoint fails, the last state
+// read is kept, marked unhealthy with the error.
+type ChainState struct {
+	ChainID          uint64       `json:"chain_id"`
+	Healthy          bool         `json:"healthy"`
+	Error            string       `json:"error,omitempty"`
+	Failures         int          `json:"consecutive_failures"`
+	LastSuccess      *time.Time   `json:"last_success,omitempty"`
+	HeadBlock        uint64       `json:"head_block"`
+	IndexedBlock     uint64       `json:"indexed_block"`
+	LagBlocks        uint64       `json:"lag_blocks"`
+	FinalizedBlock   uint64       `json:"finalized_block"`
+	Reorgs           int          `json:"reorgs"`
+	LastReorg        *Reorg       `json:"last_reorg,omitempty"`
+	BlockNumber      uint64       `json:"state_block,omitempty"`
+	ReadAt           *time.Time   `json:"state_read_at,omitempty"`
+	PaymentCount     uint64       `json:"payment_count"`
+	ValidationCount  uint64       `json:"validation_count"`
+	ActiveValidators []string     `json:"active_validators"`
+	TotalStake       string       `json:"total_stake"`
+	Vaults           []VaultState `json:"vaults"`
+}
+
+// States returns the state of every indexed chain, ordered by chain ID
+func (i *Indexer) States() []ChainState {
+	states := make([]ChainState, 0, len(i.chains))
+	for _, chain := range i.chains {
+		chain.stateMutex.RLock()
+		states = append(states, chain.state)
+		chain.stateMutex.RUnlock()
+	}
+	sort.Slice(states, func(a, b int) bool { return states[a].ChainID < states[b].ChainID })
+	return states
+}
+
+// indexerBackoff is the wait after failures attempts in a row: interval
+// doubled for each, up to indexerMaxBackoff
+func indexerBackoff(interval time.Duration, failures int) time.Duration {
+	wait := interval
+	for n := 1; n < failures && wait < indexerMaxBackoff; n++ {
+		wait *= 2
+	}
+	if wait > indexerMaxBackoff {
+		wait = indexerMaxBackoff
+	}
+	return wait
+}
+
+// recordResult updates the chain's health and progress after an attempt
+// and returns the number of failures in a row
+func (c *chainIndexer) recordResult(err error) int {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	c.state.HeadBlock = c.head
+	c.state.FinalizedBlock = c.finalized
+	if c.nextBlock > 0 {
+		c.state.IndexedBlock = c.nextBlock - 1
+	}
+	c.state.LagBlocks = 0
+	if c.state.HeadBlock > c.state.IndexedBlock {
+		c.state.LagBlocks = c.state.HeadBlock - c.state.IndexedBlock
+	}
+
+	if err != nil {
+		c.state.Healthy = false
+		c.state.Error = err.Error()
+		c.state.Failures++
+		return c.state.Failures
+	}
+	now := time.Now().UTC()
+	c.state.Healthy = true
+	c.state.Error = ""
+	c.state.Failures = 0
+	c.state.LastSuccess = &now
+	return 0
+}
+
+// refreshState reads the contracts' state as of the last confirmed block
+// and records it as a chain_state point
+func (c *chainIndexer) refreshState(ctx context.Context) error {
+	if c.head < c.chain.Confirmations {
+		return nil
+	}
+	block := c.head - c.chain.Confirmations
+
+	state, err := c.readState(&bind.CallOpts{Context: ctx, BlockNumber: new(big.Int).SetUint64(block)})
+	if err != nil {
+		return fmt.Errorf("failed to read contract state at block %d: %w", block, err)
+	}
+	now := time.Now().UTC()
+	if err := c.server.writer.WritePoint(ctx, c.statePoint(state, now)); err != nil {
+		return fmt.Errorf("failed to write chain state: %w", err)
+	}
+
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	c.state.BlockNumber = block
+	c.state.ReadAt = &now
+	c.state.PaymentCount = state.PaymentCount
+	c.state.ValidationCount = state.ValidationCount
+	c.state.ActiveValidators = state.ActiveValidators
+	c.state.TotalStake = state.TotalStake
+	c.state.Vaults = state.Vaults
+	return nil
+}
+
+// readState reads the payment and validation counts, the active validators
+// and their stake, and each vault's totals
+func (c *chainIndexer) readState(opts *bind.CallOpts) (*ChainState, error) {
+	state := &ChainState{ActiveValidators: []string{}, TotalStake: "0", Vaults: []VaultState{}}
+
+	if c.paymentCore != nil {
+		count, err := callUint(c.paymentCore, opts, "getPaymentCount")
+		if err != nil {
+			return nil, err
+		}
+		state.PaymentCount = count.Uint64()
+	}
+
+	if c.relayValidator != nil {
+		count, err := callUint(c.relayValidator, opts, "getValidationCount")
+		if err != nil {
+			return nil, err
+		}
+		state.ValidationCount = count.Uint64()
+
+		var out []interface{}
+		if err := c.relayValidator.Call(opts, &out, "getActiveValidators"); err != nil {
+			return nil, fmt.Errorf("getActiveValidators: %w", err)
+		}
+		total := new(big.Int)
+		for _, validator := range out[0].([]common.Address) {
+			stake, err := callUint(c.relayValidator, opts, "validatorStakes", validator)
+			if err != nil {
+				return nil, err
+			}
+			total.Add(total, stake)
+			state.ActiveValidators = append(state.ActiveValidators, validator.Hex())
+		}
+		state.TotalStake = total.String()
+	}
+
+	for _, vault := range c.chain.Vaults {
+		address := common.HexToAddress(vault)
+		var totals []interface{}
+		if err := c.vaults[address].Call(opts, &totals, "getVaultMetrics"); err != nil {
+			return nil, fmt.Errorf("getVaultMetrics(%s): %w", address.Hex(), err)
+		}
+		state.Vaults = append(state.Vaults, VaultState{
+			Address:        address.Hex(),
+			TotalAssets:    totals[0].(*big.Int).String(),
+			InsuranceFund:  totals[4].(*big.Int).String(),
+			SlashingEvents: totals[5].(*big.Int).Uint64(),
+		})
+	}
+	return state, nil
+}
+
+func (c *chainIndexer) statePoint(state *ChainState, at time.Time) *write.Point {
+	stake, _ := new(big.Float).SetString(state.TotalStake)
+	totalStake, _ := stake.Float64()
+	indexed := c.nextBlock - 1
+	var lag uint64
+	if c.head > indexed {
+		lag = c.head - indexed
+	}
+	return write.NewPointWithMeasurement("chain_state").
+		AddTag("chain_id", strconv.FormatUint(c.chain.ChainID, 10)).
+		AddField("head_block", c.head).
+		AddField("indexed_block", indexed).
+		AddField("lag_blocks", lag).
+		AddField("payment_count", state.PaymentCount).
+		AddField("validation_count", state.ValidationCount).
+		AddField("active_validators", len(state.ActiveValidators)).
+		AddField("total_stake", totalStake).
+		SetTime(at)
+}
+
+// handleChains serves the state of every indexed chain
+func (s *AnalyticsServer) handleChains(w http.ResponseWriter, r *http.Request) {
+	states := []ChainState{}
+	if s.indexer != nil {
+		states = s.indexer.States()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: states})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"time"
@@ -13,6 +14,8 @@ import (
 type AnalyticsClient struct {
 	BaseURL    string
 	HTTPClient *http.Client
+	// Token is sent with queries when the service requires API tokens
+	Token string
 }
 
 // NewAnalyticsClient creates a new analytics client
@@ -40,6 +43,12 @@ func (c *AnalyticsClient) SendVaultMetric(metric VaultMetric) error {
 	return c.sendMetric("/api/metrics/vault", metric)
 }
 
+// SendGasBudgetMetric sends a merchant's daily gas spend to the analytics
+// service
+func (c *AnalyticsClient) SendGasBudgetMetric(metric GasBudgetMetric) error {
+	return c.sendMetric("/api/metrics/gas-budget", metric)
+}
+
 // QueryMetrics queries metrics from the analytics service
 func (c *AnalyticsClient) QueryMetrics(query AnalyticsQuery) (*AnalyticsResponse, error) {
 	jsonData, err := json.Marshal(query)
@@ -47,7 +56,7 @@ func (c *AnalyticsClient) QueryMetrics(query AnalyticsQuery) (*AnalyticsResponse
 		return nil, fmt.Errorf("failed to marshal query: %w", err)
 	}
 
-	resp, err := c.HTTPClient.Post(c.BaseURL+"/api/query", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := c.query(http.MethodPost, "/api/query", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
@@ -67,7 +76,7 @@ func (c *AnalyticsClient) QueryMetrics(query AnalyticsQuery) (*AnalyticsResponse
 
 // GetDashboard retrieves dashboard data
 func (c *AnalyticsClient) GetDashboard() (*AnalyticsResponse, error) {
-	resp, err := c.HTTPClient.Get(c.BaseURL + "/api/dashboard")
+	resp, err := c.query(http.MethodGet, "/api/dashboard", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get dashboard: %w", err)
 	}
@@ -87,7 +96,7 @@ func (c *AnalyticsClient) GetDashboard() (*AnalyticsResponse, error) {
 
 // GetRealtimeMetrics retrieves real-time metrics for a specific type
 func (c *AnalyticsClient) GetRealtimeMetrics(metricType string) (*AnalyticsResponse, error) {
-	resp, err := c.HTTPClient.Get(fmt.Sprintf("%s/api/realtime/%s", c.BaseURL, metricType))
+	resp, err := c.query(http.MethodGet, "/api/realtime/"+metricType, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get realtime metrics: %w", err)
 	}
@@ -105,6 +114,21 @@ func (c *AnalyticsClient) GetRealtimeMetrics(metricType string) (*AnalyticsRespo
 	return &result, nil
 }
 
+// query sends a request to a read endpoint with the client's token
+func (c *AnalyticsClient) query(method, endpoint string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.BaseURL+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return c.HTTPClient.Do(req)
+}
+
 // sendMetric is a helper method to send metrics to the analytics service
 func (c *AnalyticsClient) sendMetric(endpoint string, metric interface{}) error {
 	jsonData, err := json.Marshal(metric)
@@ -135,7 +159,7 @@ func ExampleUsage() {
 		PaymentID:      12345,
 		ChainID:        1,
 		Sender:         "0x742d35Cc6634C0532925a3b8D4ba9f4e6ad1B6AF",
-		Recipient:      "0x8ba1f109551bD432803012645Hac136c4c5688dC",
+		Recipient:      "0x8ba1f109551bD432803012645Aac136c4c5688dC",
 		Token:          "0x0000000000000000000000000000000000000000",
 		Amount:         "1000000000000000000", // 1 ETH in wei
 		Fee:            "1000000000000000",    // 0.001 ETH in wei
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/config"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Config holds the server's core settings, loaded from the file at
+// CONFIG_FILE and the environment. Feature settings such as GeoIP, SMTP and
+// remote write are still read from their environment variables when the
+// feature starts.
+type Config struct {
+	Port     string `config:"port" env:"PORT" default:"8084" validate:"required"`
+	InfluxDB struct {
+		URL    string `config:"url" env:"INFLUXDB_URL" default:"http://localhost:8086" validate:"required,url"`
+		Token  string `config:"token" env:"INFLUXDB_TOKEN" default:"your-token-here" validate:"required" secret:"true"`
+		Org    string `config:"org" env:"INFLUXDB_ORG" default:"crosspay" validate:"required"`
+		Bucket string `config:"bucket" env:"INFLUXDB_BUCKET" default:"analytics" validate:"required"`
+	} `config:"influxdb"`
+	Storage struct {
+		Mode        string `config:"mode" env:"STORAGE_MODE" default:"influx" validate:"oneof=influx|fallback|dual"`
+		DatabaseURL string `config:"database_url" env:"DATABASE_URL" validate:"url" secret:"true"`
+	} `config:"storage"`
+	DisclosureDatabaseURL string `config:"disclosure_database_url" env:"DISCLOSURE_DATABASE_URL" validate:"url" secret:"true"`
+	EventBusURL           string `config:"event_bus_url" env:"EVENT_BUS_URL" validate:"url"`
+	TokensPath            string `config:"tokens_path" env:"ANALYTICS_TOKENS_PATH"`
+	AlertRulesPath        string `config:"alert_rules_path" env:"ALERT_RULES_PATH"`
+	IndexerConfigPath     string `config:"indexer_config_path" env:"INDEXER_CONFIG_PATH"`
+	WSClientBuffer        int    `config:"ws_client_buffer" env:"WS_CLIENT_BUFFER" default:"256" validate:"min=1"`
+	// WSPingInterval is how often WebSocket clients are pinged. One silent
+	// for two intervals is disconnected.
+	WSPingInterval time.Duration `config:"ws_ping_interval" env:"WS_PING_INTERVAL" default:"30s" validate:"min=1s"`
+	// BroadcastBusURL is the NATS server instances relay WebSocket
+	// broadcasts to each other through, event_bus_url when unset
+	BroadcastBusURL  string `config:"broadcast_bus_url" env:"BROADCAST_BUS_URL" validate:"url"`
+	BroadcastSubject string `config:"broadcast_subject" env:"BROADCAST_SUBJECT" default:"analytics.broadcasts" validate:"required"`
+	// OpenAccess serves every request with admin access when tokens_path is
+	// unset. It is meant for local development only.
+	OpenAccess bool `config:"open_access" env:"ANALYTICS_OPEN_ACCESS"`
+	// CORSAllowedOrigins may call the API from a browser, "*" for any
+	CORSAllowedOrigins []string `config:"cors_allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	// QueryTimeout bounds the query and report endpoints
+	QueryTimeout time.Duration `config:"query_timeout" env:"QUERY_TIMEOUT" default:"10s" validate:"min=1s,max=15s"`
+	Workers      struct {
+		AlertEvaluationSeconds    int `config:"alert_evaluation_seconds" env:"ALERT_EVALUATION_INTERVAL_SECONDS" default:"30" validate:"min=1"`
+		StorageReconcileSeconds   int `config:"storage_reconcile_seconds" env:"STORAGE_RECONCILE_INTERVAL_SECONDS" default:"60" validate:"min=1"`
+		SQLRetentionHours         int `config:"sql_retention_hours" env:"SQL_RETENTION_HOURS" default:"720" validate:"min=1"`
+		SummaryMinutes            int `config:"summary_minutes" env:"SUMMARY_INTERVAL_MINUTES" default:"15" validate:"min=1"`
+		AggregateBroadcastSeconds int `config:"aggregate_broadcast_seconds" env:"AGGREGATE_BROADCAST_SECONDS" default:"1" validate:"min=1"`
+		PrometheusPushSeconds     int `config:"prometheus_push_seconds" env:"PROMETHEUS_PUSH_INTERVAL_SECONDS" default:"15" validate:"min=1"`
+		DashboardRefreshSeconds   int `config:"dashboard_refresh_seconds" env:"DASHBOARD_REFRESH_INTERVAL_SECONDS" default:"10" validate:"min=1"`
+		PaymentSLOSeconds         int `config:"payment_slo_seconds" env:"PAYMENT_SLO_INTERVAL_SECONDS" default:"60" validate:"min=1"`
+	} `config:"workers"`
+	// Ingest batches the metrics POSTed to /api/metrics/* before writing
+	Ingest struct {
+		BatchSize     int           `config:"batch_size" env:"INGEST_BATCH_SIZE" default:"500" validate:"min=1"`
+		FlushInterval time.Duration `config:"flush_interval" env:"INGEST_FLUSH_INTERVAL" default:"1s" validate:"min=10ms"`
+		BufferSize    int           `config:"buffer_size" env:"INGEST_BUFFER_SIZE" default:"10000" validate:"min=1"`
+		MaxRetries    int           `config:"max_retries" env:"INGEST_MAX_RETRIES" default:"3" validate:"min=0"`
+		// SpillDir holds batches InfluxDB rejected until they are replayed.
+		// They are dropped when it is unset.
+		SpillDir string `config:"spill_dir" env:"INGEST_SPILL_DIR"`
+	} `config:"ingest"`
+	// Export dumps measurements to files in an S3-compatible bucket, or to
+	// Filecoin through storage-worker
+	Export struct {
+		S3 struct {
+			Endpoint        string `config:"endpoint" env:"EXPORT_S3_ENDPOINT" validate:"url"`
+			Region          string `config:"region" env:"EXPORT_S3_REGION"`
+			Bucket          string `config:"bucket" env:"EXPORT_S3_BUCKET"`
+			Prefix          string `config:"prefix" env:"EXPORT_S3_PREFIX" default:"exports/"`
+			AccessKeyID     string `config:"access_key_id" env:"EXPORT_S3_ACCESS_KEY_ID"`
+			SecretAccessKey string `config:"secret_access_key" env:"EXPORT_S3_SECRET_ACCESS_KEY" secret:"true"`
+			PathStyle       bool   `config:"path_style" env:"EXPORT_S3_PATH_STYLE"`
+		} `config:"s3"`
+		// MaxPoints bounds the points of one measurement in one export
+		MaxPoints int           `config:"max_points" env:"EXPORT_MAX_POINTS" default:"1000000" validate:"min=1"`
+		URLTTL    time.Duration `config:"url_ttl" env:"EXPORT_URL_TTL" default:"24h" validate:"min=1m,max=168h"`
+	} `config:"export"`
+	// Prober runs a synthetic payment through the services, off without
+	// prober.payment_url
+	Prober ProberConfig `config:"prober"`
+	// Admin guards the admin actions, such as silencing alerts
+	Admin auth.Config `config:"admin"`
+}
+
+// ProberConfig sets up the prober. It runs a tiny payment through the
+// payment processor, the relay network and storage-worker on a testnet
+// every interval.
+type ProberConfig struct {
+	PaymentURL string `config:"payment_url" env:"PROBER_PAYMENT_URL" validate:"url"`
+	// RelayURL is the relay node asked to validate the payment. The
+	// validate stage is skipped without it.
+	RelayURL           string        `config:"relay_url" env:"PROBER_RELAY_URL" validate:"url"`
+	Sender             string        `config:"sender" env:"PROBER_SENDER"`
+	Recipient          string        `config:"recipient" env:"PROBER_RECIPIENT"`
+	Token              string        `config:"token" env:"PROBER_TOKEN" default:"0x0000000000000000000000000000000000000000"`
+	Amount             string        `config:"amount" env:"PROBER_AMOUNT" default:"1000"`
+	RequiredSignatures int           `config:"required_signatures" env:"PROBER_REQUIRED_SIGNATURES" default:"1" validate:"min=1"`
+	Interval           time.Duration `config:"interval" env:"PROBER_INTERVAL" default:"5m" validate:"min=10s"`
+	// Each stage is given up on after its timeout, and alerted on when
+	// it takes longer than its threshold
+	StageTimeout      time.Duration `config:"stage_timeout" env:"PROBER_STAGE_TIMEOUT" default:"2m" validate:"min=1s"`
+	CreateThreshold   time.Duration `config:"create_threshold" env:"PROBER_CREATE_THRESHOLD" default:"10s" validate:"min=1ms"`
+	ValidateThreshold time.Duration `config:"validate_threshold" env:"PROBER_VALIDATE_THRESHOLD" default:"60s" validate:"min=1ms"`
+	CompleteThreshold time.Duration `config:"complete_threshold" env:"PROBER_COMPLETE_THRESHOLD" default:"10s" validate:"min=1ms"`
+	ReceiptThreshold  time.Duration `config:"receipt_threshold" env:"PROBER_RECEIPT_THRESHOLD" default:"30s" validate:"min=1ms"`
+}
+
+// LoadConfig loads and validates the server's settings
+func LoadConfig() (*Config, *config.Result, error) {
+	var cfg Config
+	result, err := config.Load(&cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Storage.Mode != StorageInflux && cfg.Storage.DatabaseURL == "" {
+		return nil, nil, &config.Error{File: result.File, Problems: []string{
+			"storage.database_url: is required with storage.mode " + cfg.Storage.Mode + " (set it in the config file or DATABASE_URL)",
+		}}
+	}
+	if cfg.Prober.PaymentURL != "" {
+		var problems []string
+		if !common.IsHexAddress(cfg.Prober.Sender) {
+			problems = append(problems, "prober.sender: must be an address (set it in the config file or PROBER_SENDER)")
+		}
+		if !common.IsHexAddress(cfg.Prober.Recipient) {
+			problems = append(problems, "prober.recipient: must be an address (set it in the config file or PROBER_RECIPIENT)")
+		}
+		if len(problems) > 0 {
+			return nil, nil, &config.Error{File: result.File, Problems: problems}
+		}
+	}
+	if cfg.DisclosureDatabaseURL == "" {
+		cfg.DisclosureDatabaseURL = cfg.Storage.DatabaseURL
+	}
+	if cfg.BroadcastBusURL == "" {
+		cfg.BroadcastBusURL = cfg.EventBusURL
+	}
+	return &cfg, result, nil
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/gorilla/mux"
+)
+
+// Custom dashboards are definitions the frontend renders: named panels,
+// each charting Grafana datasource targets over a time range. They belong
+// to the API token that created them, by its name, and no other token can
+// read or change them. Every panel query goes through the same builder as
+// Grafana targets, so a definition can only name known measurements, fields,
+// aggregates and tags, and a merchant token's panels only chart its own
+// payments. Definitions are kept in Postgres at DATABASE_URL.
+
+const (
+	maxDashboardPanels       = 24
+	maxDashboardPanelQueries = 10
+	maxDashboardNameLength   = 100
+	// dashboardGridColumns is the width of the grid panels are laid out on
+	dashboardGridColumns = 24
+)
+
+// dashboardPanelTypes are how a panel can be drawn
+var dashboardPanelTypes = []string{"timeseries", "stat", "bar", "table"}
+
+// panelPayloadKeys are the options a panel query can set
+var panelPayloadKeys = []string{"aggregate", "chain_id", "group_by"}
+
+var (
+	errDashboardNotFound = errors.New("dashboard not found")
+	errDashboardConflict = errors.New("dashboard was changed since it was read")
+)
+
+const customDashboardSchema = `
+CREATE TABLE IF NOT EXISTS analytics_dashboards (
+	id TEXT PRIMARY KEY,
+	owner TEXT NOT NULL,
+	name TEXT NOT NULL,
+	definition JSONB NOT NULL,
+	version INT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_analytics_dashboards_owner ON analytics_dashboards (owner, name);
+`
+
+// PanelQuery is a Grafana datasource target and its payload
+type PanelQuery struct {
+	Target  string            `json:"target"`
+	RefID   string            `json:"ref_id,omitempty"`
+	Payload map[string]string `json:"payload,omitempty"`
+}
+
+// PanelLayout places a panel on the dashboard grid
+type PanelLayout struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// DashboardPanel is one chart of a dashboard. TimeRange overrides the
+// dashboard's.
+type DashboardPanel struct {
+	Title     string       `json:"title"`
+	Type      string       `json:"type"`
+	TimeRange string       `json:"time_range,omitempty"`
+	Queries   []PanelQuery `json:"queries"`
+	Layout    PanelLayout  `json:"layout"`
+}
+
+// CustomDashboard is a stored dashboard definition. Version counts its
+// changes; an update naming an older version is refused.
+type CustomDashboard struct {
+	ID          string           `json:"id"`
+	Owner       string           `json:"owner"`
+	Name        string           `json:"name"`
+	Description string           `json:"description,omitempty"`
+	TimeRange   string           `json:"time_range"`
+	Panels      []DashboardPanel `json:"panels"`
+	Version     int              `json:"version"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+}
+
+// dashboardDefinition is the part of a dashboard stored as JSON
+type dashboardDefinition struct {
+	Description string           `json:"description,omitempty"`
+	TimeRange   string           `json:"time_range"`
+	Panels      []DashboardPanel `json:"panels"`
+}
+
+// CustomDashboardStore keeps dashboard definitions in Postgres
+type CustomDashboardStore struct {
+	db    *sql.DB
+	mutex sync.Mutex
+	ready bool
+}
+
+// NewCustomDashboardStore keeps dashboards in the Postgres database at url.
+// Without it custom dashboards are disabled and the store is nil.
+func NewCustomDashboardStore(url string) (*CustomDashboardStore, error) {
+	if url == "" {
+		log.Println("DATABASE_URL not set, custom dashboards disabled")
+		return nil, nil
+	}
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	return &CustomDashboardStore{db: db}, nil
+}
+
+func (c *CustomDashboardStore) ensureSchema(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ready {
+		return nil
+	}
+	if _, err := c.db.ExecContext(ctx, customDashboardSchema); err != nil {
+		return fmt.Errorf("failed to create dashboard schema: %w", err)
+	}
+	c.ready = true
+	return nil
+}
+
+const customDashboardColumns = `id, owner, name, definition, version, created_at, updated_at`
+
+func scanCustomDashboard(row interface{ Scan(...interface{}) error }) (*CustomDashboard, error) {
+	var dashboard CustomDashboard
+	var definition []byte
+	if err := row.Scan(&dashboard.ID, &dashboard.Owner, &dashboard.Name, &definition, &dashboard.Version,
+		&dashboard.CreatedAt, &dashboard.UpdatedAt); err != nil {
+		return nil, err
+	}
+	var stored dashboardDefinition
+	if err := json.Unmarshal(definition, &stored); err != nil {
+		return nil, fmt.Errorf("invalid definition of dashboard %s: %w", dashboard.ID, err)
+	}
+	dashboard.Description, dashboard.TimeRange, dashboard.Panels = stored.Description, stored.TimeRange, stored.Panels
+	return &dashboard, nil
+}
+
+func (d *CustomDashboard) definition() ([]byte, error) {
+	return json.Marshal(dashboardDefinition{Description: d.Description, TimeRange: d.TimeRange, Panels: d.Panels})
+}
+
+// List returns owner's dashboards by name
+func (c *CustomDashboardStore) List(ctx context.Context, owner string) ([]*CustomDashboard, error) {
+	if err := c.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT `+customDashboardColumns+` FROM analytics_dashboards WHERE owner = $1 ORDER BY name, id`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dashboards := []*CustomDashboard{}
+	for rows.Next() {
+		dashboard, err := scanCustomDashboard(rows)
+		if err != nil {
+			return nil, err
+		}
+		dashboards = append(dashboards, dashboard)
+	}
+	return dashboards, rows.Err()
+}
+
+// Get returns one of owner's dashboards
+func (c *CustomDashboardStore) Get(ctx context.Context, owner, id string) (*CustomDashboard, error) {
+	if err := c.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+	dashboard, err := scanCustomDashboard(c.db.QueryRowContext(ctx,
+		`SELECT `+customDashboardColumns+` FROM analytics_dashboards WHERE id = $1 AND owner = $2`, id, owner))
+	if err == sql.ErrNoRows {
+		return nil, errDashboardNotFound
+	}
+	return dashboard, err
+}
+
+// Create stores a new dashboard under a new ID, at version 1
+func (c *CustomDashboardStore) Create(ctx context.Context, dashboard *CustomDashboard) error {
+	if err := c.ensureSchema(ctx); err != nil {
+		return err
+	}
+	id, err := newDisclosureID()
+	if err != nil {
+		return err
+	}
+	definition, err := dashboard.definition()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	dashboard.ID, dashboard.Version, dashboard.CreatedAt, dashboard.UpdatedAt = id, 1, now, now
+	_, err = c.db.ExecContext(ctx, `INSERT INTO analytics_dashboards (`+customDashboardColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		dashboard.ID, dashboard.Owner, dashboard.Name, definition, dashboard.Version, dashboard.CreatedAt, dashboard.UpdatedAt)
+	return err
+}
+
+// Update replaces a dashboard's definition and bumps its version. With a
+// version set, the dashboard must still be at that version.
+func (c *CustomDashboardStore) Update(ctx context.Context, dashboard *CustomDashboard) error {
+	current, err := c.Get(ctx, dashboard.Owner, dashboard.ID)
+	if err != nil {
+		return err
+	}
+	if dashboard.Version != 0 && dashboard.Version != current.Version {
+		return errDashboardConflict
+	}
+	definition, err := dashboard.definition()
+	if err != nil {
+		return err
+	}
+
+	dashboard.Version, dashboard.CreatedAt = current.Version+1, current.CreatedAt
+	dashboard.UpdatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	result, err := c.db.ExecContext(ctx, `UPDATE analytics_dashboards
+		SET name = $1, definition = $2, version = $3, updated_at = $4
+		WHERE id = $5 AND owner = $6 AND version = $7`,
+		dashboard.Name, definition, dashboard.Version, dashboard.UpdatedAt, dashboard.ID, dashboard.Owner, current.Version)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return errDashboardConflict
+	}
+	return nil
+}
+
+// Delete removes one of owner's dashboards
+func (c *CustomDashboardStore) Delete(ctx context.Context, owner, id string) error {
+	if err := c.ensureSchema(ctx); err != nil {
+		return err
+	}
+	result, err := c.db.ExecContext(ctx, `DELETE FROM analytics_dashboards WHERE id = $1 AND owner = $2`, id, owner)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return errDashboardNotFound
+	}
+	return nil
+}
+
+func (c *CustomDashboardStore) Close() error {
+	return c.db.Close()
+}
+
+// panelQuery builds the Grafana query of a panel over the rng up to now,
+// with about a hundred points per series
+func panelQuery(rng time.Duration, now time.Time) *grafanaQuery {
+	query := &grafanaQuery{IntervalMs: (rng / 100).Milliseconds()}
+	query.Range.From = now.Add(-rng)
+	query.Range.To = now
+	return query
+}
+
+// validateDashboard fills in the defaults of a definition and checks every
+// panel query against the builder, as the scope would run it
+func (s *AnalyticsServer) validateDashboard(scope *Scope, dashboard *CustomDashboard) error {
+	if dashboard.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(dashboard.Name) > maxDashboardNameLength {
+		return fmt.Errorf("name must be at most %d characters", maxDashboardNameLength)
+	}
+	if dashboard.TimeRange == "" {
+		dashboard.TimeRange = "24h"
+	}
+	if !containsString(snapshotRanges, dashboard.TimeRange) {
+		return fmt.Errorf("invalid time_range %q", dashboard.TimeRange)
+	}
+	if len(dashboard.Panels) > maxDashboardPanels {
+		return fmt.Errorf("at most %d panels are allowed", maxDashboardPanels)
+	}
+	if dashboard.Panels == nil {
+		dashboard.Panels = []DashboardPanel{}
+	}
+
+	now := time.Now()
+	for i := range dashboard.Panels {
+		panel := &dashboard.Panels[i]
+		if panel.Type == "" {
+			panel.Type = "timeseries"
+		}
+		if !containsString(dashboardPanelTypes, panel.Type) {
+			return fmt.Errorf("panel %d: invalid type %q", i, panel.Type)
+		}
+		if panel.TimeRange != "" && !containsString(snapshotRanges, panel.TimeRange) {
+			return fmt.Errorf("panel %d: invalid time_range %q", i, panel.TimeRange)
+		}
+		layout := panel.Layout
+		if layout.W == 0 {
+			panel.Layout.W, layout.W = dashboardGridColumns, dashboardGridColumns
+		}
+		if layout.H == 0 {
+			panel.Layout.H, layout.H = 8, 8
+		}
+		if layout.X < 0 || layout.Y < 0 || layout.W < 1 || layout.H < 1 || layout.X+layout.W > dashboardGridColumns {
+			return fmt.Errorf("panel %d: layout must fit a %d column grid", i, dashboardGridColumns)
+		}
+		if len(panel.Queries) == 0 || len(panel.Queries) > maxDashboardPanelQueries {
+			return fmt.Errorf("panel %d: needs 1 to %d queries", i, maxDashboardPanelQueries)
+		}
+
+		for j, query := range panel.Queries {
+			for key := range query.Payload {
+				if !containsString(panelPayloadKeys, key) {
+					return fmt.Errorf("panel %d query %d: unknown payload option %q", i, j, key)
+				}
+			}
+			target := grafanaTarget{Target: query.Target, RefID: query.RefID, Payload: query.Payload}
+			if _, _, err := s.grafanaFlux(scope, panelQuery(time.Hour, now), target); err != nil {
+				return fmt.Errorf("panel %d query %d: %v", i, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+// customDashboardStore writes 503 when custom dashboards are disabled
+func (s *AnalyticsServer) customDashboardStore(w http.ResponseWriter) *CustomDashboardStore {
+	if s.dashboards == nil {
+		http.Error(w, "Custom dashboards require DATABASE_URL", http.StatusServiceUnavailable)
+	}
+	return s.dashboards
+}
+
+// writeDashboardError answers a store error
+func writeDashboardError(w http.ResponseWriter, r *http.Request, action string, err error) {
+	switch {
+	case errors.Is(err, errDashboardNotFound):
+		http.Error(w, "Dashboard not found", http.StatusNotFound)
+	case errors.Is(err, errDashboardConflict):
+		problem.Error(w, r, http.StatusConflict, problem.CodeDashboardChanged, "Dashboard was changed since it was read")
+	default:
+		log.Printf("Failed to %s dashboard: %v", action, err)
+		http.Error(w, fmt.Sprintf("Failed to %s dashboard", action), http.StatusInternalServerError)
+	}
+}
+
+// handleListCustomDashboards lists the token's dashboards
+func (s *AnalyticsServer) handleListCustomDashboards(w http.ResponseWriter, r *http.Request) {
+	store := s.customDashboardStore(w)
+	if store == nil {
+		return
+	}
+	dashboards, err := store.List(r.Context(), scopeFrom(r).Name)
+	if err != nil {
+		writeDashboardError(w, r, "list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: dashboards})
+}
+
+// handleCreateCustomDashboard validates and stores a new dashboard
+func (s *AnalyticsServer) handleCreateCustomDashboard(w http.ResponseWriter, r *http.Request) {
+	store := s.customDashboardStore(w)
+	if store == nil {
+		return
+	}
+	var dashboard CustomDashboard
+	if err := json.NewDecoder(r.Body).Decode(&dashboard); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	scope := scopeFrom(r)
+	if err := s.validateDashboard(scope, &dashboard); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dashboard.Owner = scope.Name
+	if err := store.Create(r.Context(), &dashboard); err != nil {
+		writeDashboardError(w, r, "create", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: dashboard})
+}
+
+// handleCustomDashboard serves one of the token's dashboards
+func (s *AnalyticsServer) handleCustomDashboard(w http.ResponseWriter, r *http.Request) {
+	store := s.customDashboardStore(w)
+	if store == nil {
+		return
+	}
+	dashboard, err := store.Get(r.Context(), scopeFrom(r).Name, mux.Vars(r)["id"])
+	if err != nil {
+		writeDashboardError(w, r, "read", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: dashboard})
+}
+
+// handleUpdateCustomDashboard replaces one of the token's dashboards. A
+// version in the body must match the stored one.
+func (s *AnalyticsServer) handleUpdateCustomDashboard(w http.ResponseWriter, r *http.Request) {
+	store := s.customDashboardStore(w)
+	if store == nil {
+		return
+	}
+	var dashboard CustomDashboard
+	if err := json.NewDecoder(r.Body).Decode(&dashboard); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	scope := scopeFrom(r)
+	if err := s.validateDashboard(scope, &dashboard); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dashboard.ID, dashboard.Owner = mux.Vars(r)["id"], scope.Name
+	if err := store.Update(r.Context(), &dashboard); err != nil {
+		writeDashboardError(w, r, "update", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: dashboard})
+}
+
+// handleDeleteCustomDashboard removes one of the token's dashboards
+func (s *AnalyticsServer) handleDeleteCustomDashboard(w http.ResponseWriter, r *http.Request) {
+	store := s.customDashboardStore(w)
+	if store == nil {
+		return
+	}
+	if err := store.Delete(r.Context(), scopeFrom(r).Name, mux.Vars(r)["id"]); err != nil {
+		writeDashboardError(w, r, "delete", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PanelData is the series of one panel, as the dashboard lists its panels
+type PanelData struct {
+	Title     string          `json:"title"`
+	TimeRange string          `json:"time_range"`
+	Series    []grafanaSeries `json:"series"`
+}
+
+// handleCustomDashboardData runs the queries of one of the token's
+// dashboards. ?time_range= overrides the range of every panel.
+func (s *AnalyticsServer) handleCustomDashboardData(w http.ResponseWriter, r *http.Request) {
+	store := s.customDashboardStore(w)
+	if store == nil {
+		return
+	}
+	override := r.URL.Query().Get("time_range")
+	if override != "" && !containsString(snapshotRanges, override) {
+		http.Error(w, "Invalid time_range", http.StatusBadRequest)
+		return
+	}
+	scope := scopeFrom(r)
+	dashboard, err := store.Get(r.Context(), scope.Name, mux.Vars(r)["id"])
+	if err != nil {
+		writeDashboardError(w, r, "read", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	panels := make([]PanelData, len(dashboard.Panels))
+	for i, panel := range dashboard.Panels {
+		timeRange := panel.TimeRange
+		if timeRange == "" {
+			timeRange = dashboard.TimeRange
+		}
+		if override != "" {
+			timeRange = override
+		}
+		panels[i] = PanelData{Title: panel.Title, TimeRange: timeRange, Series: []grafanaSeries{}}
+
+		query := panelQuery(timeRangeDuration(timeRange), now)
+		for j, panelQuery := range panel.Queries {
+			target := grafanaTarget{Target: panelQuery.Target, RefID: panelQuery.RefID, Payload: panelQuery.Payload}
+			if target.RefID == "" {
+				target.RefID = strconv.Itoa(j)
+			}
+			// The token may have lost access since the panel was saved
+			flux, groupBy, err := s.grafanaFlux(scope, query, target)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Panel %d query %d: %v", i, j, err), http.StatusBadRequest)
+				return
+			}
+			series, err := s.querySeries(r.Context(), flux, target, groupBy)
+			if err != nil {
+				log.Printf("Dashboard panel query error: %v", err)
+				http.Error(w, "Query failed", http.StatusInternalServerError)
+				return
+			}
+			panels[i].Series = append(panels[i].Series, series...)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: map[string]interface{}{
+		"id":          dashboard.ID,
+		"version":     dashboard.Version,
+		"computed_at": now,
+		"panels":      panels,
+	}})
+}
+
+// handleDashboardTargets lists what the token's panel queries can chart, for
+// building an editor: each target with the aggregates and group_by tags it
+// accepts
+func (s *AnalyticsServer) handleDashboardTargets(w http.ResponseWriter, r *http.Request) {
+	type targetOptions struct {
+		Target     string   `json:"target"`
+		Aggregates []string `json:"aggregates"`
+		GroupBy    []string `json:"group_by"`
+	}
+	targets := []targetOptions{}
+	for _, target := range grafanaTargets(scopeFrom(r)) {
+		measurement, _, _ := strings.Cut(target, ".")
+		tags := append([]string(nil), grafanaTags[measurement]...)
+		sort.Strings(tags)
+		targets = append(targets, targetOptions{Target: target, Aggregates: grafanaAggregates, GroupBy: tags})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: map[string]interface{}{
+		"targets":     targets,
+		"panel_types": dashboardPanelTypes,
+		"time_ranges": snapshotRanges,
+	}})
+}
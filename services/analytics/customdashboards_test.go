@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dashboardDriver is a database/sql driver that runs the statements of
+// CustomDashboardStore against rows kept in memory, one table per DSN
+type dashboardDriver struct {
+	mu     sync.Mutex
+	tables map[string]*dashboardTable
+}
+
+type dashboardTable struct {
+	mu   sync.Mutex
+	rows []map[string]driver.Value
+}
+
+var (
+	testDashboardDriver = &dashboardDriver{tables: make(map[string]*dashboardTable)}
+	registerDashboards  sync.Once
+)
+
+func (d *dashboardDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tables[name] == nil {
+		d.tables[name] = &dashboardTable{}
+	}
+	return &dashboardConn{table: d.tables[name]}, nil
+}
+
+type dashboardConn struct {
+	table *dashboardTable
+}
+
+func (c *dashboardConn) Prepare(query string) (driver.Stmt, error) {
+	return &dashboardStmt{table: c.table, query: strings.Join(strings.Fields(query), " ")}, nil
+}
+
+func (c *dashboardConn) Close() error { return nil }
+func (c *dashboardConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported")
+}
+
+type dashboardStmt struct {
+	table *dashboardTable
+	query string
+}
+
+func (s *dashboardStmt) Close() error  { return nil }
+func (s *dashboardStmt) NumInput() int { return -1 }
+
+func (s *dashboardStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.table.mu.Lock()
+	defer s.table.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "INSERT INTO analytics_dashboards"):
+		row := make(map[string]driver.Value)
+		for i, column := range strings.Split(customDashboardColumns, ", ") {
+			row[column] = args[i]
+		}
+		s.table.rows = append(s.table.rows, row)
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "UPDATE analytics_dashboards"):
+		for _, row := range s.table.rows {
+			if row["id"] == args[4] && row["owner"] == args[5] && row["version"] == args[6] {
+				row["name"], row["definition"], row["version"], row["updated_at"] = args[0], args[1], args[2], args[3]
+				return driver.RowsAffected(1), nil
+			}
+		}
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "DELETE FROM analytics_dashboards"):
+		for i, row := range s.table.rows {
+			if row["id"] == args[0] && row["owner"] == args[1] {
+				s.table.rows = append(s.table.rows[:i], s.table.rows[i+1:]...)
+				return driver.RowsAffected(1), nil
+			}
+		}
+		return driver.RowsAffected(0), nil
+	}
+	return nil, fmt.Errorf("unexpected statement %q", s.query)
+}
+
+func (s *dashboardStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.table.mu.Lock()
+	defer s.table.mu.Unlock()
+
+	var match func(row map[string]driver.Value) bool
+	switch {
+	case strings.HasSuffix(s.query, "WHERE owner = $1 ORDER BY name, id"):
+		match = func(row map[string]driver.Value) bool { return row["owner"] == args[0] }
+	case strings.HasSuffix(s.query, "WHERE id = $1 AND owner = $2"):
+		match = func(row map[string]driver.Value) bool { return row["id"] == args[0] && row["owner"] == args[1] }
+	default:
+		return nil, fmt.Errorf("unexpected query %q", s.query)
+	}
+	rows := &dashboardRows{columns: strings.Split(customDashboardColumns, ", ")}
+	for _, row := range s.table.rows {
+		if match(row) {
+			rows.rows = append(rows.rows, row)
+		}
+	}
+	return rows, nil
+}
+
+type dashboardRows struct {
+	columns []string
+	rows    []map[string]driver.Value
+}
+
+func (r *dashboardRows) Columns() []string { return r.columns }
+func (r *dashboardRows) Close() error      { return nil }
+
+func (r *dashboardRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, column := range r.columns {
+		dest[i] = r.rows[0][column]
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// newTestDashboardServer serves the custom dashboard routes behind the
+// token middleware, with dashboards kept in memory and panel queries sent
+// to a fake InfluxDB. acme and globex are merchants, ops is an admin.
+func newTestDashboardServer(t *testing.T) (http.Handler, *CustomDashboardStore, *fakeInflux) {
+	registerDashboards.Do(func() { sql.Register("dashboards-test", testDashboardDriver) })
+	db, err := sql.Open("dashboards-test", t.Name())
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	store := &CustomDashboardStore{db: db}
+
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"tokens": [
+		{"name": "ops", "token": "ops-token", "role": "admin"},
+		{"name": "acme", "token": "acme-token", "role": "merchant", "merchants": ["0xAC00000000000000000000000000000000000001"]},
+		{"name": "globex", "token": "globex-token", "role": "merchant", "merchants": ["0x6E00000000000000000000000000000000000002"]}
+	]}`), 0o600))
+	auth, err := LoadAuthenticator(path, false)
+	require.NoError(t, err)
+
+	influx, client := newFakeInflux(t)
+	s := &AnalyticsServer{dashboards: store, storage: NewStorage(client, "crosspay", "analytics"), queryAPI: client.QueryAPI("crosspay")}
+	router := mux.NewRouter()
+	read := router.PathPrefix("/api").Subrouter()
+	read.Use(auth.Middleware)
+	read.HandleFunc("/dashboards", s.handleListCustomDashboards).Methods("GET")
+	read.HandleFunc("/dashboards", s.handleCreateCustomDashboard).Methods("POST")
+	read.HandleFunc("/dashboards/targets", s.handleDashboardTargets).Methods("GET")
+	read.HandleFunc("/dashboards/{id}", s.handleCustomDashboard).Methods("GET")
+	read.HandleFunc("/dashboards/{id}", s.handleUpdateCustomDashboard).Methods("PUT")
+	read.HandleFunc("/dashboards/{id}", s.handleDeleteCustomDashboard).Methods("DELETE")
+	read.HandleFunc("/dashboards/{id}/data", s.handleCustomDashboardData).Methods("GET")
+	return router, store, influx
+}
+
+// dashboardRequest sends a request with token to handler
+func dashboardRequest(handler http.Handler, token, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+const paymentsDashboard = `{"name": "Sales", "owner": "globex", "panels": [
+	{"title": "Latency", "queries": [{"target": "payments.processing_time_ms", "payload": {"group_by": "merchant"}}]}
+]}`
+
+func TestCustomDashboardScopes(t *testing.T) {
+	t.Run("should keep each token's dashboards to itself", func(t *testing.T) {
+		handler, _, _ := newTestDashboardServer(t)
+
+		w := dashboardRequest(handler, "acme-token", http.MethodPost, "/api/dashboards", paymentsDashboard)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var created struct {
+			Data CustomDashboard `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+		assert.Equal(t, "acme", created.Data.Owner)
+		id := created.Data.ID
+
+		assert.Equal(t, http.StatusOK, dashboardRequest(handler, "acme-token", http.MethodGet, "/api/dashboards/"+id, "").Code)
+		for _, token := range []string{"globex-token", "ops-token"} {
+			assert.Equal(t, http.StatusNotFound, dashboardRequest(handler, token, http.MethodGet, "/api/dashboards/"+id, "").Code, token)
+			assert.Equal(t, http.StatusNotFound, dashboardRequest(handler, token, http.MethodGet, "/api/dashboards/"+id+"/data", "").Code, token)
+			assert.Equal(t, http.StatusNotFound, dashboardRequest(handler, token, http.MethodPut, "/api/dashboards/"+id, paymentsDashboard).Code, token)
+			assert.Equal(t, http.StatusNotFound, dashboardRequest(handler, token, http.MethodDelete, "/api/dashboards/"+id, "").Code, token)
+
+			w = dashboardRequest(handler, token, http.MethodGet, "/api/dashboards", "")
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, `{"success": true, "data": []}`, w.Body.String(), token)
+		}
+		assert.Equal(t, http.StatusOK, dashboardRequest(handler, "acme-token", http.MethodGet, "/api/dashboards/"+id, "").Code)
+	})
+
+	t.Run("should refuse merchant panels that chart other measurements or merchants", func(t *testing.T) {
+		handler, _, _ := newTestDashboardServer(t)
+
+		for name, queries := range map[string]string{
+			"validators":       `[{"target": "validators.response_time_ms"}]`,
+			"vaults":           `[{"target": "payments.processing_time_ms"}, {"target": "vaults.apy"}]`,
+			"unknown field":    `[{"target": "payments.amount"}]`,
+			"merchant payload": `[{"target": "payments.processing_time_ms", "payload": {"merchant": "0x6e00000000000000000000000000000000000002"}}]`,
+			"flux in chain_id": `[{"target": "payments.processing_time_ms", "payload": {"chain_id": "1\") or (true"}}]`,
+			"unknown group_by": `[{"target": "payments.processing_time_ms", "payload": {"group_by": "sender"}}]`,
+		} {
+			body := `{"name": "Sneaky", "panels": [{"title": "Panel", "queries": ` + queries + `}]}`
+			w := dashboardRequest(handler, "acme-token", http.MethodPost, "/api/dashboards", body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, name)
+		}
+
+		w := dashboardRequest(handler, "acme-token", http.MethodPost, "/api/dashboards",
+			`{"name": "Validators", "panels": [{"title": "Panel", "queries": [{"target": "validators.response_time_ms"}]}]}`)
+		assert.Contains(t, w.Body.String(), "merchant tokens can only query payments")
+		w = dashboardRequest(handler, "ops-token", http.MethodPost, "/api/dashboards",
+			`{"name": "Validators", "panels": [{"title": "Panel", "queries": [{"target": "validators.response_time_ms"}]}]}`)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	})
+
+	t.Run("should only chart the merchant's own payments", func(t *testing.T) {
+		handler, _, influx := newTestDashboardServer(t)
+		w := dashboardRequest(handler, "acme-token", http.MethodPost, "/api/dashboards", paymentsDashboard)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var created struct {
+			Data CustomDashboard `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+
+		w = dashboardRequest(handler, "acme-token", http.MethodGet, "/api/dashboards/"+created.Data.ID+"/data", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Len(t, influx.queries, 1)
+		assert.Contains(t, influx.queries[0], `|> filter(fn: (r) => contains(value: r["merchant"], set: ["0xac00000000000000000000000000000000000001"]))`)
+		assert.NotContains(t, influx.queries[0], "0x6e00")
+	})
+
+	t.Run("should refuse panels the token can no longer chart", func(t *testing.T) {
+		handler, store, influx := newTestDashboardServer(t)
+		now := time.Now().UTC()
+		stored := &CustomDashboard{
+			Owner: "acme", Name: "Old", TimeRange: "24h",
+			Panels: []DashboardPanel{{Title: "Validators", Queries: []PanelQuery{{Target: "validators.response_time_ms"}}}},
+		}
+		definition, err := stored.definition()
+		require.NoError(t, err)
+		_, err = store.db.Exec(`INSERT INTO analytics_dashboards (`+customDashboardColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			"old", stored.Owner, stored.Name, definition, 1, now, now)
+		require.NoError(t, err)
+
+		w := dashboardRequest(handler, "acme-token", http.MethodGet, "/api/dashboards/old/data", "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "merchant tokens can only query payments")
+		assert.Empty(t, influx.queries)
+	})
+
+	t.Run("should only offer merchants payment targets", func(t *testing.T) {
+		handler, _, _ := newTestDashboardServer(t)
+
+		w := dashboardRequest(handler, "acme-token", http.MethodGet, "/api/dashboards/targets", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Data struct {
+				Targets []struct {
+					Target string `json:"target"`
+				} `json:"targets"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.NotEmpty(t, response.Data.Targets)
+		for _, target := range response.Data.Targets {
+			assert.True(t, strings.HasPrefix(target.Target, "payments."), target.Target)
+		}
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The dashboard is served from a snapshot refreshed every
+// DASHBOARD_REFRESH_INTERVAL_SECONDS rather than queried per request. A
+// refresh runs the dashboard's Flux queries in parallel, and a query that
+// fails keeps its stats from the previous snapshot. Each snapshot is encoded
+// once and carries an ETag, so clients polling with If-None-Match get a 304
+// until the stats change.
+
+// dashboardGeoTags are the payment tags the dashboard counts payments by
+var dashboardGeoTags = []string{"country", "region", "is_private"}
+
+// dashboardQuery returns some of the dashboard's stats, by key
+type dashboardQuery func(ctx context.Context) (map[string]interface{}, error)
+
+// dashboardSnapshot is the dashboard as of one refresh
+type dashboardSnapshot struct {
+	data       map[string]interface{}
+	body       []byte
+	etag       string
+	computedAt time.Time
+}
+
+// DashboardCache holds the latest dashboard snapshot
+type DashboardCache struct {
+	queries []dashboardQuery
+
+	refreshMu sync.Mutex
+	mu        sync.RWMutex
+	snapshot  *dashboardSnapshot
+}
+
+// NewDashboardCache returns an empty cache of the server's dashboard
+func NewDashboardCache(s *AnalyticsServer) *DashboardCache {
+	queries := []dashboardQuery{s.dashboardPayments, s.dashboardVolume, s.dashboardValidators, s.dashboardVaults}
+	for _, tag := range dashboardGeoTags {
+		tag := tag
+		queries = append(queries, func(ctx context.Context) (map[string]interface{}, error) {
+			return s.dashboardPaymentsBy(ctx, tag)
+		})
+	}
+	return &DashboardCache{queries: queries}
+}
+
+// Run refreshes the snapshot every interval until ctx is done
+func (c *DashboardCache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.Refresh(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Get returns the latest snapshot, refreshing it first if there is none yet
+func (c *DashboardCache) Get(ctx context.Context) *dashboardSnapshot {
+	c.mu.RLock()
+	snapshot := c.snapshot
+	c.mu.RUnlock()
+	if snapshot != nil {
+		return snapshot
+	}
+	return c.Refresh(ctx)
+}
+
+// Refresh runs the dashboard queries in parallel and stores the result.
+// Concurrent calls share one refresh.
+func (c *DashboardCache) Refresh(ctx context.Context) *dashboardSnapshot {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	c.mu.RLock()
+	previous := c.snapshot
+	c.mu.RUnlock()
+	if previous != nil && time.Since(previous.computedAt) < time.Second {
+		return previous
+	}
+
+	data := make(map[string]interface{})
+	var dataMu sync.Mutex
+	var wg sync.WaitGroup
+	failed := false
+	for _, query := range c.queries {
+		wg.Add(1)
+		go func(query dashboardQuery) {
+			defer wg.Done()
+			stats, err := query(ctx)
+			dataMu.Lock()
+			defer dataMu.Unlock()
+			if err != nil {
+				failed = true
+				log.Printf("Dashboard query failed: %v", err)
+				return
+			}
+			for key, value := range stats {
+				data[key] = value
+			}
+		}(query)
+	}
+	wg.Wait()
+
+	// Keep the stats of failed queries from the last snapshot
+	if failed && previous != nil {
+		for key, value := range previous.data {
+			if _, ok := data[key]; !ok {
+				data[key] = value
+			}
+		}
+	}
+
+	snapshot := &dashboardSnapshot{data: data, computedAt: time.Now()}
+	body, err := json.Marshal(AnalyticsResponse{Success: true, Data: data})
+	if err != nil {
+		log.Printf("Failed to encode dashboard: %v", err)
+		if previous != nil {
+			return previous
+		}
+		body = []byte(`{"success":true,"data":{}}`)
+	}
+	snapshot.body = append(body, '\n')
+	sum := sha256.Sum256(snapshot.body)
+	snapshot.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	if previous != nil && previous.etag == snapshot.etag {
+		// Unchanged stats keep their ETag and Last-Modified
+		snapshot.computedAt = previous.computedAt
+	}
+
+	c.mu.Lock()
+	c.snapshot = snapshot
+	c.mu.Unlock()
+	return snapshot
+}
+
+// etagMatches reports whether an If-None-Match header lists etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *AnalyticsServer) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	snapshot := s.dashboard.Get(r.Context())
+	w.Header().Set("ETag", snapshot.etag)
+	w.Header().Set("Last-Modified", snapshot.computedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), snapshot.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(snapshot.body)
+}
+
+// dashboardPayments counts the last 24 hours' payments by status
+func (s *AnalyticsServer) dashboardPayments(ctx context.Context) (map[string]interface{}, error) {
+	result, err := s.queryAPI.Query(ctx, `
+		from(bucket: "analytics")
+		|> range(start: -24h)
+		|> filter(fn: (r) => r["_measurement"] == "payments" and r["_field"] == "payment_id")
+		|> group(columns: ["status"])
+		|> count()
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("payment stats: %w", err)
+	}
+
+	paymentStats := make(map[string]int64)
+	for result.Next() {
+		status, _ := result.Record().ValueByKey("status").(string)
+		count, _ := result.Record().Value().(int64)
+		paymentStats[status] = count
+	}
+	return map[string]interface{}{"payment_stats": paymentStats}, result.Err()
+}
+
+// dashboardVolume sums the USD volume of the last 24 hours' completed
+// payments, in total and by token
+func (s *AnalyticsServer) dashboardVolume(ctx context.Context) (map[string]interface{}, error) {
+	result, err := s.queryAPI.Query(ctx, `
+		from(bucket: "analytics")
+		|> range(start: -24h)
+		|> filter(fn: (r) => r["_measurement"] == "payments" and r["_field"] == "amount_usd" and r["status"] == "completed")
+		|> group(columns: ["token"])
+		|> sum()
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("payment volume: %w", err)
+	}
+
+	volumeByToken := make(map[string]float64)
+	total := 0.0
+	for result.Next() {
+		token, _ := result.Record().ValueByKey("token").(string)
+		volume, _ := result.Record().Value().(float64)
+		volumeByToken[token] = volume
+		total += volume
+	}
+	return map[string]interface{}{
+		"payment_volume_usd":          total,
+		"payment_volume_usd_by_token": volumeByToken,
+	}, result.Err()
+}
+
+// dashboardValidators counts the last hour's validator reports by status
+func (s *AnalyticsServer) dashboardValidators(ctx context.Context) (map[string]interface{}, error) {
+	result, err := s.queryAPI.Query(ctx, `
+		from(bucket: "analytics")
+		|> range(start: -1h)
+		|> filter(fn: (r) => r["_measurement"] == "validators" and r["_field"] == "response_time_ms")
+		|> group(columns: ["status"])
+		|> count()
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("validator stats: %w", err)
+	}
+
+	validatorStats := make(map[string]int64)
+	for result.Next() {
+		status, _ := result.Record().ValueByKey("status").(string)
+		count, _ := result.Record().Value().(int64)
+		validatorStats[status] = count
+	}
+	return map[string]interface{}{"validator_stats": validatorStats}, result.Err()
+}
+
+// dashboardVaults averages the last hour's latest vault values by tranche
+func (s *AnalyticsServer) dashboardVaults(ctx context.Context) (map[string]interface{}, error) {
+	result, err := s.queryAPI.Query(ctx, `
+		from(bucket: "analytics")
+		|> range(start: -1h)
+		|> filter(fn: (r) => r["_measurement"] == "vaults")
+		|> last()
+		|> group(columns: ["tranche_type"])
+		|> mean(column: "_value")
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("vault stats: %w", err)
+	}
+
+	vaultStats := make(map[string]float64)
+	for result.Next() {
+		tranche, _ := result.Record().ValueByKey("tranche_type").(string)
+		avgValue, _ := result.Record().Value().(float64)
+		vaultStats[tranche] = avgValue
+	}
+	return map[string]interface{}{"vault_stats": vaultStats}, result.Err()
+}
+
+// dashboardPaymentsBy counts the last 24 hours' payments by where they were
+// made from, or by privacy. Payments without the tag count as unknown.
+func (s *AnalyticsServer) dashboardPaymentsBy(ctx context.Context, tag string) (map[string]interface{}, error) {
+	result, err := s.queryAPI.Query(ctx, fmt.Sprintf(`
+		from(bucket: "analytics")
+		|> range(start: -24h)
+		|> filter(fn: (r) => r["_measurement"] == "payments" and r["_field"] == "payment_id")
+		|> group(columns: [%q])
+		|> count()
+	`, tag))
+	if err != nil {
+		return nil, fmt.Errorf("payments by %s: %w", tag, err)
+	}
+
+	geoStats := make(map[string]int64)
+	for result.Next() {
+		key, ok := result.Record().ValueByKey(tag).(string)
+		if !ok || key == "" {
+			key = "unknown"
+		}
+		count, _ := result.Record().Value().(int64)
+		geoStats[key] += count
+	}
+	return map[string]interface{}{"payments_by_" + tag: geoStats}, result.Err()
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/gorilla/mux"
+)
+
+// Disclosures of private payments are recorded in an append-only audit log
+// in Postgres. A request and each change of its status are separate
+// entries, so nothing is ever updated, and the database rejects updates and
+// deletes. Every entry is hashed together with the hash of the entry before
+// it, so altering or removing one breaks the chain from there on, which
+// /api/disclosures/verify and any holder of an export can check.
+
+const (
+	DisclosureRequested = "requested"
+	DisclosureApproved  = "approved"
+	DisclosureRejected  = "rejected"
+	DisclosureRevealed  = "revealed"
+)
+
+const (
+	defaultDisclosureLimit = 100
+	maxDisclosureLimit     = 1000
+)
+
+// genesisDisclosureHash is the previous hash of the first entry
+var genesisDisclosureHash = strings.Repeat("0", 64)
+
+// disclosureScopes are what a request can ask to see
+var disclosureScopes = []string{"amount", "parties", "metadata", "full"}
+
+// disclosureWindows are the windows the summary can count over
+var disclosureWindows = []string{"1h", "24h", "7d", "30d"}
+
+// disclosureTransitions lists the statuses a request can move to from its
+// current one. A reveal without approval is an emergency disclosure.
+var disclosureTransitions = map[string][]string{
+	DisclosureRequested: {DisclosureApproved, DisclosureRejected, DisclosureRevealed},
+	DisclosureApproved:  {DisclosureRevealed},
+}
+
+var (
+	errDisclosureNotFound   = errors.New("disclosure request not found")
+	errDisclosureTransition = errors.New("invalid disclosure status change")
+)
+
+const disclosureSchema = `
+CREATE TABLE IF NOT EXISTS disclosure_audit (
+	seq BIGINT PRIMARY KEY,
+	request_id TEXT NOT NULL,
+	payment_id TEXT NOT NULL,
+	chain_id BIGINT NOT NULL,
+	requester TEXT NOT NULL,
+	scope TEXT NOT NULL,
+	status TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	tx_hash TEXT NOT NULL,
+	recorded_by TEXT NOT NULL,
+	recorded_at TIMESTAMPTZ NOT NULL,
+	prev_hash TEXT NOT NULL,
+	hash TEXT NOT NULL UNIQUE
+);
+CREATE INDEX IF NOT EXISTS idx_disclosure_audit_request ON disclosure_audit (request_id, seq);
+CREATE INDEX IF NOT EXISTS idx_disclosure_audit_payment ON disclosure_audit (payment_id);
+CREATE INDEX IF NOT EXISTS idx_disclosure_audit_recorded_at ON disclosure_audit (recorded_at);
+
+CREATE OR REPLACE FUNCTION disclosure_audit_immutable() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'disclosure_audit entries cannot be changed';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS disclosure_audit_immutable ON disclosure_audit;
+CREATE TRIGGER disclosure_audit_immutable BEFORE UPDATE OR DELETE ON disclosure_audit
+	FOR EACH ROW EXECUTE FUNCTION disclosure_audit_immutable();
+`
+
+// disclosureLockID serializes appends, so each entry links to the last one
+const disclosureLockID = 0x646973636c6f7365
+
+const disclosureColumns = `seq, request_id, payment_id, chain_id, requester, scope, status, reason, tx_hash, recorded_by, recorded_at, prev_hash, hash`
+
+// DisclosureEntry is one entry of the audit log: a disclosure request, or
+// a change of its status, which repeats the request's details
+type DisclosureEntry struct {
+	Seq        int64     `json:"seq"`
+	RequestID  string    `json:"request_id"`
+	PaymentID  string    `json:"payment_id"`
+	ChainID    uint64    `json:"chain_id"`
+	Requester  string    `json:"requester"`
+	Scope      string    `json:"scope"`
+	Status     string    `json:"status"`
+	Reason     string    `json:"reason"`
+	TxHash     string    `json:"tx_hash"`
+	RecordedBy string    `json:"recorded_by"`
+	RecordedAt time.Time `json:"recorded_at"`
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `json:"hash"`
+}
+
+// computeHash is the SHA-256 of the previous hash, a newline, and the JSON
+// of every other field in declaration order, with recorded_at in RFC 3339
+// with nanoseconds
+func (e *DisclosureEntry) computeHash() string {
+	content, _ := json.Marshal(struct {
+		Seq        int64  `json:"seq"`
+		RequestID  string `json:"request_id"`
+		PaymentID  string `json:"payment_id"`
+		ChainID    uint64 `json:"chain_id"`
+		Requester  string `json:"requester"`
+		Scope      string `json:"scope"`
+		Status     string `json:"status"`
+		Reason     string `json:"reason"`
+		TxHash     string `json:"tx_hash"`
+		RecordedBy string `json:"recorded_by"`
+		RecordedAt string `json:"recorded_at"`
+	}{e.Seq, e.RequestID, e.PaymentID, e.ChainID, e.Requester, e.Scope, e.Status, e.Reason, e.TxHash, e.RecordedBy,
+		e.RecordedAt.UTC().Format(time.RFC3339Nano)})
+
+	sum := sha256.Sum256(append([]byte(e.PrevHash+"\n"), content...))
+	return hex.EncodeToString(sum[:])
+}
+
+// DisclosureFilter selects entries. Empty fields match everything.
+type DisclosureFilter struct {
+	RequestID string
+	PaymentID string
+	Requester string
+	Status    string
+	Scope     string
+	From      time.Time
+	To        time.Time
+	After     int64
+	Limit     int
+}
+
+// DisclosureVerification is the result of checking the hash chain
+type DisclosureVerification struct {
+	Valid      bool   `json:"valid"`
+	Entries    int64  `json:"entries"`
+	HeadHash   string `json:"head_hash"`
+	InvalidSeq int64  `json:"invalid_seq,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// DisclosureLog is the audit log of disclosures
+type DisclosureLog struct {
+	db    *sql.DB
+	ready bool
+	mutex sync.Mutex
+}
+
+// NewDisclosureLog keeps the audit log in the Postgres database at url,
+// DISCLOSURE_DATABASE_URL or DATABASE_URL. Without either, disclosures
+// cannot be recorded and the log is nil. As with the point store, the
+// schema is created on first use.
+func NewDisclosureLog(url string) (*DisclosureLog, error) {
+	if url == "" {
+		log.Println("DATABASE_URL not set, disclosure audit log disabled")
+		return nil, nil
+	}
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	return &DisclosureLog{db: db}, nil
+}
+
+func (l *DisclosureLog) ensureSchema(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.ready {
+		return nil
+	}
+	if _, err := l.db.ExecContext(ctx, disclosureSchema); err != nil {
+		return fmt.Errorf("failed to create disclosure schema: %w", err)
+	}
+	l.ready = true
+	return nil
+}
+
+// Append records an entry, linked to the last one. A request gets a new
+// request ID; a status change copies the details of its request, and must
+// be allowed from the request's current status.
+func (l *DisclosureLog) Append(ctx context.Context, entry DisclosureEntry) (*DisclosureEntry, error) {
+	if err := l.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(disclosureLockID)); err != nil {
+		return nil, err
+	}
+
+	if entry.Status == DisclosureRequested {
+		if entry.RequestID, err = newDisclosureID(); err != nil {
+			return nil, err
+		}
+	} else {
+		current, err := scanDisclosure(tx.QueryRowContext(ctx,
+			`SELECT `+disclosureColumns+` FROM disclosure_audit WHERE request_id = $1 ORDER BY seq DESC LIMIT 1`, entry.RequestID))
+		if err == sql.ErrNoRows {
+			return nil, errDisclosureNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !containsString(disclosureTransitions[current.Status], entry.Status) {
+			return nil, fmt.Errorf("%w: %s to %s", errDisclosureTransition, current.Status, entry.Status)
+		}
+		entry.PaymentID, entry.ChainID = current.PaymentID, current.ChainID
+		entry.Requester, entry.Scope = current.Requester, current.Scope
+	}
+
+	entry.Seq, entry.PrevHash = 1, genesisDisclosureHash
+	var last int64
+	var lastHash string
+	err = tx.QueryRowContext(ctx, `SELECT seq, hash FROM disclosure_audit ORDER BY seq DESC LIMIT 1`).Scan(&last, &lastHash)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		entry.Seq, entry.PrevHash = last+1, lastHash
+	}
+	// Postgres keeps microseconds, so the hash is over what is stored
+	entry.RecordedAt = time.Now().UTC().Truncate(time.Microsecond)
+	entry.Hash = entry.computeHash()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO disclosure_audit (`+disclosureColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		entry.Seq, entry.RequestID, entry.PaymentID, int64(entry.ChainID), entry.Requester, entry.Scope, entry.Status,
+		entry.Reason, entry.TxHash, entry.RecordedBy, entry.RecordedAt, entry.PrevHash, entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Query returns the entries matching filter, in order
+func (l *DisclosureLog) Query(ctx context.Context, filter DisclosureFilter) ([]DisclosureEntry, error) {
+	if err := l.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	where("seq > $%d", filter.After)
+	if filter.RequestID != "" {
+		where("request_id = $%d", filter.RequestID)
+	}
+	if filter.PaymentID != "" {
+		where("payment_id = $%d", filter.PaymentID)
+	}
+	if filter.Requester != "" {
+		where("requester = $%d", strings.ToLower(filter.Requester))
+	}
+	if filter.Status != "" {
+		where("status = $%d", filter.Status)
+	}
+	if filter.Scope != "" {
+		where("scope = $%d", filter.Scope)
+	}
+	if !filter.From.IsZero() {
+		where("recorded_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		where("recorded_at < $%d", filter.To)
+	}
+	query := `SELECT ` + disclosureColumns + ` FROM disclosure_audit WHERE ` + strings.Join(conditions, " AND ") + ` ORDER BY seq`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := l.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []DisclosureEntry{}
+	for rows.Next() {
+		entry, err := scanDisclosure(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, rows.Err()
+}
+
+// Verify recomputes every hash and checks each entry links to the one
+// before it
+func (l *DisclosureLog) Verify(ctx context.Context) (*DisclosureVerification, error) {
+	if err := l.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := l.db.QueryContext(ctx, `SELECT `+disclosureColumns+` FROM disclosure_audit ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &DisclosureVerification{Valid: true, HeadHash: genesisDisclosureHash}
+	for rows.Next() {
+		entry, err := scanDisclosure(rows)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case entry.Seq != result.Entries+1:
+			result.Error = fmt.Sprintf("expected entry %d", result.Entries+1)
+		case entry.PrevHash != result.HeadHash:
+			result.Error = "previous hash does not match"
+		case entry.computeHash() != entry.Hash:
+			result.Error = "hash does not match contents"
+		}
+		if result.Error != "" {
+			result.Valid, result.InvalidSeq = false, entry.Seq
+			return result, nil
+		}
+		result.Entries++
+		result.HeadHash = entry.Hash
+	}
+	return result, rows.Err()
+}
+
+// Summary counts the entries recorded since start by status, and the
+// requests by scope
+func (l *DisclosureLog) Summary(ctx context.Context, start time.Time) (map[string]int64, map[string]int64, error) {
+	if err := l.ensureSchema(ctx); err != nil {
+		return nil, nil, err
+	}
+	rows, err := l.db.QueryContext(ctx, `SELECT status, scope, count(*) FROM disclosure_audit
+		WHERE recorded_at >= $1 GROUP BY status, scope`, start)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	byStatus := make(map[string]int64)
+	byScope := make(map[string]int64)
+	for rows.Next() {
+		var status, scope string
+		var count int64
+		if err := rows.Scan(&status, &scope, &count); err != nil {
+			return nil, nil, err
+		}
+		byStatus[status] += count
+		if status == DisclosureRequested {
+			byScope[scope] += count
+		}
+	}
+	return byStatus, byScope, rows.Err()
+}
+
+func (l *DisclosureLog) Close() error {
+	return l.db.Close()
+}
+
+func scanDisclosure(row interface{ Scan(...interface{}) error }) (*DisclosureEntry, error) {
+	var entry DisclosureEntry
+	var chainID int64
+	err := row.Scan(&entry.Seq, &entry.RequestID, &entry.PaymentID, &chainID, &entry.Requester, &entry.Scope, &entry.Status,
+		&entry.Reason, &entry.TxHash, &entry.RecordedBy, &entry.RecordedAt, &entry.PrevHash, &entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	entry.ChainID = uint64(chainID)
+	entry.RecordedAt = entry.RecordedAt.UTC()
+	return &entry, nil
+}
+
+func newDisclosureID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// disclosureRequest is the body of POST /api/disclosures. A request sets
+// the payment, requester and scope; a status change names the request.
+type disclosureRequest struct {
+	RequestID string `json:"request_id"`
+	PaymentID string `json:"payment_id"`
+	ChainID   uint64 `json:"chain_id"`
+	Requester string `json:"requester"`
+	Scope     string `json:"scope"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason"`
+	TxHash    string `json:"tx_hash"`
+}
+
+// disclosureLog writes 503 when there is no audit log
+func (s *AnalyticsServer) disclosureLog(w http.ResponseWriter) *DisclosureLog {
+	if s.disclosures == nil {
+		http.Error(w, "Disclosure audit log requires DATABASE_URL", http.StatusServiceUnavailable)
+	}
+	return s.disclosures
+}
+
+// handleRecordDisclosure appends a disclosure request or status change
+func (s *AnalyticsServer) handleRecordDisclosure(w http.ResponseWriter, r *http.Request) {
+	disclosures := s.disclosureLog(w)
+	if disclosures == nil {
+		return
+	}
+	var req disclosureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	entry := DisclosureEntry{
+		RequestID:  req.RequestID,
+		Status:     req.Status,
+		Reason:     req.Reason,
+		TxHash:     strings.ToLower(req.TxHash),
+		RecordedBy: scopeFrom(r).Name,
+	}
+	switch {
+	case req.Status == DisclosureRequested:
+		if req.PaymentID == "" || req.ChainID == 0 || req.Requester == "" {
+			http.Error(w, "payment_id, chain_id and requester are required", http.StatusBadRequest)
+			return
+		}
+		if !containsString(disclosureScopes, req.Scope) {
+			http.Error(w, fmt.Sprintf("scope must be one of %s", strings.Join(disclosureScopes, ", ")), http.StatusBadRequest)
+			return
+		}
+		entry.PaymentID, entry.ChainID, entry.Scope = req.PaymentID, req.ChainID, req.Scope
+		entry.Requester = strings.ToLower(req.Requester)
+	case req.Status == DisclosureApproved || req.Status == DisclosureRejected || req.Status == DisclosureRevealed:
+		if req.RequestID == "" {
+			http.Error(w, "request_id is required", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Invalid status %q", req.Status), http.StatusBadRequest)
+		return
+	}
+
+	recorded, err := disclosures.Append(r.Context(), entry)
+	switch {
+	case errors.Is(err, errDisclosureNotFound):
+		http.Error(w, "Disclosure request not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errDisclosureTransition):
+		problem.Error(w, r, http.StatusConflict, problem.CodeDisclosureTransition, err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to record disclosure: %v", err)
+		http.Error(w, "Failed to record disclosure", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: recorded})
+}
+
+// disclosureFilter reads the filter from ?request_id, payment_id,
+// requester, status, scope, from and to (RFC 3339)
+func disclosureFilter(r *http.Request) (DisclosureFilter, error) {
+	params := r.URL.Query()
+	filter := DisclosureFilter{
+		RequestID: params.Get("request_id"),
+		PaymentID: params.Get("payment_id"),
+		Requester: params.Get("requester"),
+		Status:    params.Get("status"),
+		Scope:     params.Get("scope"),
+	}
+	for name, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := params.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s %q", name, value)
+			}
+			*t = parsed
+		}
+	}
+	return filter, nil
+}
+
+// handleDisclosures serves the entries matching the filter, ?limit= at a
+// time after the entry ?after=
+func (s *AnalyticsServer) handleDisclosures(w http.ResponseWriter, r *http.Request) {
+	disclosures := s.disclosureLog(w)
+	if disclosures == nil {
+		return
+	}
+	filter, err := disclosureFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit = defaultDisclosureLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > maxDisclosureLimit {
+			http.Error(w, fmt.Sprintf("limit must be 1 to %d", maxDisclosureLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("after"); value != "" {
+		if filter.After, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := disclosures.Query(r.Context(), filter)
+	if err != nil {
+		log.Printf("Disclosure query error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{"entries": entries}
+	if len(entries) == filter.Limit {
+		data["next_after"] = entries[len(entries)-1].Seq
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: data})
+}
+
+// handleDisclosure serves a request's current status and its history
+func (s *AnalyticsServer) handleDisclosure(w http.ResponseWriter, r *http.Request) {
+	disclosures := s.disclosureLog(w)
+	if disclosures == nil {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	entries, err := disclosures.Query(r.Context(), DisclosureFilter{RequestID: id})
+	if err != nil {
+		log.Printf("Disclosure query error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		http.Error(w, "Disclosure request not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: map[string]interface{}{
+		"request_id": id,
+		"status":     entries[len(entries)-1].Status,
+		"entries":    entries,
+	}})
+}
+
+// handleVerifyDisclosures checks the whole hash chain
+func (s *AnalyticsServer) handleVerifyDisclosures(w http.ResponseWriter, r *http.Request) {
+	disclosures := s.disclosureLog(w)
+	if disclosures == nil {
+		return
+	}
+	result, err := disclosures.Verify(r.Context())
+	if err != nil {
+		log.Printf("Disclosure verification error: %v", err)
+		http.Error(w, "Verification failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: result})
+}
+
+// handleDisclosureSummary counts the entries of the last ?window= (default
+// 24h) by status, and the requests by scope
+func (s *AnalyticsServer) handleDisclosureSummary(w http.ResponseWriter, r *http.Request) {
+	disclosures := s.disclosureLog(w)
+	if disclosures == nil {
+		return
+	}
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "24h"
+	}
+	if !containsString(disclosureWindows, window) {
+		http.Error(w, "Invalid window", http.StatusBadRequest)
+		return
+	}
+	byStatus, byScope, err := disclosures.Summary(r.Context(), time.Now().Add(-timeRangeDuration(window)))
+	if err != nil {
+		log.Printf("Disclosure summary error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: map[string]interface{}{
+		"window":    window,
+		"by_status": byStatus,
+		"by_scope":  byScope,
+	}})
+}
+
+// handleExportDisclosures exports the entries matching the filter, with
+// their hashes, as JSON or, with ?format=csv, CSV. The JSON export also
+// carries the result of verifying the whole chain.
+func (s *AnalyticsServer) handleExportDisclosures(w http.ResponseWriter, r *http.Request) {
+	disclosures := s.disclosureLog(w)
+	if disclosures == nil {
+		return
+	}
+	filter, err := disclosureFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := disclosures.Query(r.Context(), filter)
+	if err != nil {
+		log.Printf("Disclosure export error: %v", err)
+		http.Error(w, "Export failed", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	filename := fmt.Sprintf("disclosures-%s.%s", now.Format("20060102T150405Z"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		out := csv.NewWriter(w)
+		out.Write(strings.Split(strings.ReplaceAll(disclosureColumns, " ", ""), ","))
+		for _, e := range entries {
+			out.Write([]string{strconv.FormatInt(e.Seq, 10), e.RequestID, e.PaymentID, strconv.FormatUint(e.ChainID, 10),
+				e.Requester, e.Scope, e.Status, e.Reason, e.TxHash, e.RecordedBy, e.RecordedAt.Format(time.RFC3339Nano),
+				e.PrevHash, e.Hash})
+		}
+		out.Flush()
+		return
+	}
+
+	verification, err := disclosures.Verify(r.Context())
+	if err != nil {
+		log.Printf("Disclosure verification error: %v", err)
+		http.Error(w, "Export failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"exported_at":  now,
+		"exported_by":  scopeFrom(r).Name,
+		"verification": verification,
+		"entries":      entries,
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Erasing an address pseudonymizes it wherever metrics carry it: the
+// merchant tag and the sender field become "erased-" and a hash of the
+// address, in every tier, so counts and volumes still add up. The location
+// tags and client IP of those points are dropped. InfluxDB cannot update a
+// point in place, so each one is deleted and written again. Points still
+// waiting in Postgres are replayed first, and the Postgres copies of the
+// address's points are deleted.
+
+// erasableMeasurements are the measurements that carry addresses
+var erasableMeasurements = []string{"payments", "risk_score", "gas_budgets"}
+
+// erasedColumns are personal data dropped from erased points
+var erasedColumns = map[string]bool{"country": true, "region": true, "asn": true, "client_ip": true}
+
+// ErasureResult counts the points an erasure rewrote in each tier
+type ErasureResult struct {
+	Pseudonym      string         `json:"pseudonym"`
+	Points         map[string]int `json:"points"`
+	PostgresPoints int64          `json:"postgres_points"`
+	ErasedAt       time.Time      `json:"erased_at"`
+}
+
+// pseudonym is what an erased address is replaced with
+func pseudonym(address string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(address)))
+	return "erased-" + hex.EncodeToString(sum[:8])
+}
+
+// eraseAddress pseudonymizes address in every tier
+func (s *AnalyticsServer) eraseAddress(ctx context.Context, address string) (*ErasureResult, error) {
+	address = strings.ToLower(address)
+	result := &ErasureResult{Pseudonym: pseudonym(address), Points: make(map[string]int)}
+
+	if err := s.writer.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to replay Postgres points: %w", err)
+	}
+	for _, res := range resolutions {
+		count, err := s.eraseTier(ctx, res, address, result.Pseudonym)
+		if err != nil {
+			return nil, fmt.Errorf("failed to erase %s points: %w", res.Name, err)
+		}
+		result.Points[res.Name] = count
+	}
+	removed, err := s.writer.Erase(ctx, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to erase Postgres points: %w", err)
+	}
+	result.PostgresPoints = removed
+	result.ErasedAt = time.Now().UTC()
+	return result, nil
+}
+
+// erasedPoint is a point to delete, by its series and time, and its
+// pseudonymized replacement
+type erasedPoint struct {
+	predicate string
+	at        time.Time
+	point     *write.Point
+}
+
+// eraseTier rewrites the points of one tier that carry address
+func (s *AnalyticsServer) eraseTier(ctx context.Context, res Resolution, address, alias string) (int, error) {
+	measurements := make([]string, len(erasableMeasurements))
+	for i, measurement := range erasableMeasurements {
+		measurements[i] = fmt.Sprintf("r._measurement == %q", measurement)
+	}
+	flux := fmt.Sprintf(`from(bucket: %q)
+	|> range(start: 0)
+	|> filter(fn: (r) => %s)
+	|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+	|> filter(fn: (r) => (exists r.merchant and r.merchant == %q) or (exists r.sender and r.sender == %q))`,
+		s.storage.BucketFor(res), strings.Join(measurements, " or "), address, address)
+
+	result, err := s.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return 0, err
+	}
+	var erased []erasedPoint
+	for result.Next() {
+		record := result.Record()
+		entry := erasedPoint{at: record.Time(), point: write.NewPointWithMeasurement(record.Measurement()).SetTime(record.Time())}
+		predicate := []string{fmt.Sprintf(`_measurement=%q`, record.Measurement())}
+
+		// Group key columns are the tags; the other columns left by the
+		// pivot are fields
+		for _, column := range result.TableMetadata().Columns() {
+			name := column.Name()
+			value := record.ValueByKey(name)
+			if strings.HasPrefix(name, "_") || name == "result" || name == "table" || value == nil {
+				continue
+			}
+			if column.IsGroup() {
+				tag := fmt.Sprint(value)
+				predicate = append(predicate, fmt.Sprintf(`%s=%q`, name, tag))
+				if tag == address {
+					tag = alias
+				}
+				if !erasedColumns[name] && tag != "" {
+					entry.point.AddTag(name, tag)
+				}
+				continue
+			}
+			if value == address {
+				value = alias
+			}
+			if !erasedColumns[name] {
+				entry.point.AddField(name, value)
+			}
+		}
+		entry.predicate = strings.Join(predicate, " AND ")
+		erased = append(erased, entry)
+	}
+	if err := result.Err(); err != nil {
+		return 0, err
+	}
+
+	// Delete before writing: a replacement in the same series would
+	// otherwise be deleted with the original
+	for _, entry := range erased {
+		if err := s.storage.Delete(ctx, res, entry.at, entry.at, entry.predicate); err != nil {
+			return 0, err
+		}
+	}
+	points := make([]*write.Point, len(erased))
+	for i, entry := range erased {
+		points[i] = entry.point
+	}
+	if len(points) == 0 {
+		return 0, nil
+	}
+	if res.Every == 0 {
+		err = s.writer.WritePoint(ctx, points...)
+	} else {
+		err = s.storage.Write(ctx, res, points...)
+	}
+	return len(points), err
+}
+
+// handleErase pseudonymizes an address in every stored metric, for the
+// payment processor's erasure requests
+func (s *AnalyticsServer) handleErase(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !common.IsHexAddress(req.Address) {
+		http.Error(w, "Invalid address", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.eraseAddress(r.Context(), req.Address)
+	if err != nil {
+		log.Printf("Failed to erase an address: %v", err)
+		http.Error(w, "Failed to erase address", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Erased address as %s: %v points, %d in Postgres", result.Pseudonym, result.Points, result.PostgresPoints)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: result})
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/gorilla/mux"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Export jobs dump measurements over a time range to CSV or Parquet files
+// for offline analysis, one file per measurement. Each file holds a row per
+// point: its time, field and value, and a column per tag the measurement
+// can be grouped by. Files go to the S3-compatible bucket at
+// EXPORT_S3_BUCKET, or to Filecoin through storage-worker as export
+// objects. Jobs run one at a time in the background; their status and
+// download links are read back from /api/exports/{id}. Job status is kept
+// in memory, so it is lost on restart, but the files are not.
+
+const (
+	exportFormatCSV     = "csv"
+	exportFormatParquet = "parquet"
+
+	exportDestinationS3       = "s3"
+	exportDestinationFilecoin = "filecoin"
+
+	exportPending   = "pending"
+	exportRunning   = "running"
+	exportCompleted = "completed"
+	exportFailed    = "failed"
+
+	// maxExportJobs bounds the jobs kept, the oldest finished ones being
+	// forgotten first. It is also how many can wait to run.
+	maxExportJobs = 100
+)
+
+var exportFormats = []string{exportFormatCSV, exportFormatParquet}
+
+var (
+	errExportNotFound  = errors.New("export not found")
+	errExportQueueFull = errors.New("too many exports waiting")
+)
+
+// ExportFile is a file an export wrote. URL is filled in when the job is
+// read, so it is always a fresh link.
+type ExportFile struct {
+	Measurement string     `json:"measurement"`
+	Name        string     `json:"name"`
+	Resolution  string     `json:"resolution"`
+	Rows        int        `json:"rows"`
+	Bytes       int        `json:"bytes"`
+	Key         string     `json:"key,omitempty"`
+	CID         string     `json:"cid,omitempty"`
+	URL         string     `json:"url,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// ExportJob is an export and its progress
+type ExportJob struct {
+	ID           string       `json:"id"`
+	Status       string       `json:"status"`
+	Format       string       `json:"format"`
+	Destination  string       `json:"destination"`
+	Measurements []string     `json:"measurements"`
+	From         time.Time    `json:"from"`
+	To           time.Time    `json:"to"`
+	CreatedBy    string       `json:"created_by"`
+	CreatedAt    time.Time    `json:"created_at"`
+	StartedAt    *time.Time   `json:"started_at,omitempty"`
+	FinishedAt   *time.Time   `json:"finished_at,omitempty"`
+	Files        []ExportFile `json:"files"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// exportRequest is the body of POST /api/exports. To defaults to now, the
+// format to CSV and the destination to S3 when a bucket is set.
+type exportRequest struct {
+	Measurements []string  `json:"measurements"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	Format       string    `json:"format"`
+	Destination  string    `json:"destination"`
+}
+
+// Exporter runs export jobs
+type Exporter struct {
+	queryAPI  api.QueryAPI
+	storage   *Storage
+	files     *SnapshotStore
+	s3        *S3Client
+	s3Prefix  string
+	maxPoints int
+	urlTTL    time.Duration
+
+	mu    sync.Mutex
+	jobs  map[string]*ExportJob
+	order []string
+	queue chan string
+}
+
+// NewExporter writes exports to the EXPORT_S3_BUCKET bucket if set, and to
+// Filecoin through files
+func NewExporter(cfg *Config, queryAPI api.QueryAPI, storage *Storage, files *SnapshotStore) *Exporter {
+	e := &Exporter{
+		queryAPI:  queryAPI,
+		storage:   storage,
+		files:     files,
+		s3Prefix:  cfg.Export.S3.Prefix,
+		maxPoints: cfg.Export.MaxPoints,
+		urlTTL:    cfg.Export.URLTTL,
+		jobs:      make(map[string]*ExportJob),
+		queue:     make(chan string, maxExportJobs),
+	}
+	if s3 := cfg.Export.S3; s3.Bucket != "" {
+		e.s3 = NewS3Client(s3.Endpoint, s3.Region, s3.Bucket, s3.AccessKeyID, s3.SecretAccessKey, s3.PathStyle)
+	} else {
+		log.Println("EXPORT_S3_BUCKET not set, exports can only be stored on Filecoin")
+	}
+	return e
+}
+
+// Run runs queued jobs one at a time until ctx is done. A job running then
+// fails.
+func (e *Exporter) Run(ctx context.Context) {
+	for {
+		select {
+		case id := <-e.queue:
+			e.run(ctx, id)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Submit validates a request and queues its job
+func (e *Exporter) Submit(request exportRequest, createdBy string) (*ExportJob, error) {
+	job, err := e.newJob(request, createdBy)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case e.queue <- job.ID:
+	default:
+		return nil, errExportQueueFull
+	}
+	e.jobs[job.ID] = job
+	e.order = append(e.order, job.ID)
+	e.prune()
+	return e.copyJob(job), nil
+}
+
+// newJob checks a request and fills in its defaults
+func (e *Exporter) newJob(request exportRequest, createdBy string) (*ExportJob, error) {
+	if len(request.Measurements) == 0 {
+		return nil, errors.New("measurements is required")
+	}
+	var measurements []string
+	for _, measurement := range request.Measurements {
+		if _, ok := grafanaFields[measurement]; !ok {
+			return nil, fmt.Errorf("unknown measurement %q", measurement)
+		}
+		if !containsString(measurements, measurement) {
+			measurements = append(measurements, measurement)
+		}
+	}
+
+	now := time.Now().UTC()
+	if request.To.IsZero() || request.To.After(now) {
+		request.To = now
+	}
+	if request.From.IsZero() {
+		return nil, errors.New("from is required")
+	}
+	if !request.From.Before(request.To) {
+		return nil, errors.New("from must be before to")
+	}
+
+	if request.Format == "" {
+		request.Format = exportFormatCSV
+	}
+	if !containsString(exportFormats, request.Format) {
+		return nil, fmt.Errorf("format must be %s", strings.Join(exportFormats, " or "))
+	}
+	if request.Destination == "" {
+		request.Destination = exportDestinationFilecoin
+		if e.s3 != nil {
+			request.Destination = exportDestinationS3
+		}
+	}
+	switch request.Destination {
+	case exportDestinationS3:
+		if e.s3 == nil {
+			return nil, errors.New("S3 exports require EXPORT_S3_BUCKET")
+		}
+	case exportDestinationFilecoin:
+	default:
+		return nil, fmt.Errorf("destination must be %s or %s", exportDestinationS3, exportDestinationFilecoin)
+	}
+
+	id, err := newDisclosureID()
+	if err != nil {
+		return nil, err
+	}
+	return &ExportJob{
+		ID:           id,
+		Status:       exportPending,
+		Format:       request.Format,
+		Destination:  request.Destination,
+		Measurements: measurements,
+		From:         request.From.UTC(),
+		To:           request.To.UTC(),
+		CreatedBy:    createdBy,
+		CreatedAt:    now,
+		Files:        []ExportFile{},
+	}, nil
+}
+
+// prune forgets the oldest finished jobs beyond maxExportJobs
+func (e *Exporter) prune() {
+	excess := len(e.order) - maxExportJobs
+	kept := e.order[:0]
+	for _, id := range e.order {
+		if status := e.jobs[id].Status; excess > 0 && (status == exportCompleted || status == exportFailed) {
+			delete(e.jobs, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	e.order = kept
+}
+
+// run exports every measurement of a job, failing the job at the first
+// measurement that fails
+func (e *Exporter) run(ctx context.Context, id string) {
+	e.mu.Lock()
+	job := e.jobs[id]
+	started := time.Now().UTC()
+	job.Status, job.StartedAt = exportRunning, &started
+	request := *job
+	e.mu.Unlock()
+	log.Printf("Exporting %s from %s to %s as %s", strings.Join(request.Measurements, ", "),
+		request.From.Format(time.RFC3339), request.To.Format(time.RFC3339), request.Format)
+
+	var err error
+	for _, measurement := range request.Measurements {
+		var file *ExportFile
+		if file, err = e.export(ctx, &request, measurement); err != nil {
+			err = fmt.Errorf("%s: %w", measurement, err)
+			break
+		}
+		e.mu.Lock()
+		job.Files = append(job.Files, *file)
+		e.mu.Unlock()
+	}
+
+	finished := time.Now().UTC()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	job.FinishedAt = &finished
+	if err != nil {
+		job.Status, job.Error = exportFailed, err.Error()
+		log.Printf("Export %s failed: %v", id, err)
+		return
+	}
+	job.Status = exportCompleted
+	log.Printf("Export %s completed in %s", id, finished.Sub(started).Round(time.Millisecond))
+}
+
+// export writes one measurement of a job and stores the file
+func (e *Exporter) export(ctx context.Context, job *ExportJob, measurement string) (*ExportFile, error) {
+	// Retention is relative to now, so the tier depends on how far back
+	// the range starts. Rollups hold averages over the tier's interval.
+	resolution := e.storage.Resolve(measurement, time.Since(job.From))
+	tags := grafanaTags[measurement]
+	data, rows, err := e.encode(ctx, job, measurement, e.storage.BucketFor(resolution), tags)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &ExportFile{
+		Measurement: measurement,
+		Name:        measurement + "." + job.Format,
+		Resolution:  resolution.Name,
+		Rows:        rows,
+		Bytes:       len(data),
+	}
+	contentType := exportContentType(file.Name)
+	switch job.Destination {
+	case exportDestinationS3:
+		file.Key = e.s3Prefix + job.ID + "/" + file.Name
+		err = e.s3.Put(ctx, file.Key, contentType, data)
+	case exportDestinationFilecoin:
+		file.CID, err = e.files.Put(ctx, "export", fmt.Sprintf("export-%s-%s", job.ID, file.Name), data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to store %s: %w", file.Name, err)
+	}
+	return file, nil
+}
+
+// encode reads a measurement's points in time order and writes them in the
+// job's format, returning the file and its rows
+func (e *Exporter) encode(ctx context.Context, job *ExportJob, measurement, bucket string, tags []string) ([]byte, int, error) {
+	fields := make([]string, len(grafanaFields[measurement]))
+	for i, field := range grafanaFields[measurement] {
+		fields[i] = fmt.Sprintf("r._field == %q", field)
+	}
+	columns, _ := json.Marshal(append([]string{"_time", "_field", "_value"}, tags...))
+	flux := fmt.Sprintf(`from(bucket: %q)
+	|> range(start: %s, stop: %s)
+	|> filter(fn: (r) => r._measurement == %q and (%s))
+	|> keep(columns: %s)
+	|> group()
+	|> sort(columns: ["_time"])
+	|> limit(n: %d)`,
+		bucket, job.From.Format(time.RFC3339Nano), job.To.Format(time.RFC3339Nano),
+		measurement, strings.Join(fields, " or "), columns, e.maxPoints+1)
+
+	result, err := e.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer result.Close()
+
+	var out bytes.Buffer
+	encoder, err := newExportEncoder(job.Format, &out, tags)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows := 0
+	values := make([]*string, len(tags))
+	for result.Next() {
+		if rows == e.maxPoints {
+			return nil, 0, fmt.Errorf("more than %d points, narrow the range or raise EXPORT_MAX_POINTS", e.maxPoints)
+		}
+		record := result.Record()
+		var value float64
+		switch v := record.Value().(type) {
+		case float64:
+			value = v
+		case int64:
+			value = float64(v)
+		case uint64:
+			value = float64(v)
+		default:
+			continue
+		}
+		for i, tag := range tags {
+			values[i] = nil
+			if tagValue, ok := record.ValueByKey(tag).(string); ok {
+				values[i] = &tagValue
+			}
+		}
+		if err := encoder.Write(record.Time(), record.Field(), value, values); err != nil {
+			return nil, 0, err
+		}
+		rows++
+	}
+	if result.Err() != nil {
+		return nil, 0, result.Err()
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, 0, err
+	}
+	return out.Bytes(), rows, nil
+}
+
+// exportEncoder writes an export file row by row. Tags missing from a point
+// are nil.
+type exportEncoder interface {
+	Write(at time.Time, field string, value float64, tags []*string) error
+	Close() error
+}
+
+func newExportEncoder(format string, out *bytes.Buffer, tags []string) (exportEncoder, error) {
+	if format == exportFormatParquet {
+		return newParquetEncoder(out, tags)
+	}
+	encoder := &csvEncoder{writer: csv.NewWriter(out)}
+	return encoder, encoder.writer.Write(append([]string{"time", "field", "value"}, tags...))
+}
+
+type csvEncoder struct {
+	writer *csv.Writer
+}
+
+func (c *csvEncoder) Write(at time.Time, field string, value float64, tags []*string) error {
+	row := []string{at.UTC().Format(time.RFC3339Nano), field, strconv.FormatFloat(value, 'g', -1, 64)}
+	for _, tag := range tags {
+		if tag == nil {
+			row = append(row, "")
+		} else {
+			row = append(row, *tag)
+		}
+	}
+	return c.writer.Write(row)
+}
+
+func (c *csvEncoder) Close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+// parquetEncoder writes a snappy compressed Parquet file with time as
+// milliseconds since the epoch and optional tag columns
+type parquetEncoder struct {
+	writer *writer.CSVWriter
+	row    []interface{}
+}
+
+func newParquetEncoder(out *bytes.Buffer, tags []string) (*parquetEncoder, error) {
+	schema := []string{
+		"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS",
+		"name=field, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY",
+		"name=value, type=DOUBLE",
+	}
+	for _, tag := range tags {
+		schema = append(schema, fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL", tag))
+	}
+	parquetWriter, err := writer.NewCSVWriterFromWriter(schema, out, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetEncoder{writer: parquetWriter, row: make([]interface{}, len(schema))}, nil
+}
+
+func (p *parquetEncoder) Write(at time.Time, field string, value float64, tags []*string) error {
+	p.row[0], p.row[1], p.row[2] = at.UnixMilli(), field, value
+	for i, tag := range tags {
+		p.row[3+i] = nil
+		if tag != nil {
+			p.row[3+i] = *tag
+		}
+	}
+	return p.writer.Write(p.row)
+}
+
+func (p *parquetEncoder) Close() error {
+	return p.writer.WriteStop()
+}
+
+func exportContentType(name string) string {
+	if strings.HasSuffix(name, "."+exportFormatParquet) {
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv"
+}
+
+// Get returns a job with fresh download links, signed by files for those
+// stored on Filecoin
+func (e *Exporter) Get(id string) (*ExportJob, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	job, ok := e.jobs[id]
+	if !ok {
+		return nil, errExportNotFound
+	}
+	return e.withLinks(e.copyJob(job)), nil
+}
+
+// List returns every job kept, newest first, without links
+func (e *Exporter) List() []*ExportJob {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	jobs := make([]*ExportJob, 0, len(e.order))
+	for _, id := range e.order {
+		jobs = append(jobs, e.copyJob(e.jobs[id]))
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	return jobs
+}
+
+func (e *Exporter) copyJob(job *ExportJob) *ExportJob {
+	copied := *job
+	copied.Files = append([]ExportFile{}, job.Files...)
+	return &copied
+}
+
+func (e *Exporter) withLinks(job *ExportJob) *ExportJob {
+	for i := range job.Files {
+		file := &job.Files[i]
+		var expires time.Time
+		switch {
+		case file.Key != "":
+			file.URL, expires = e.s3.PresignGet(file.Key, e.urlTTL)
+		case file.CID != "":
+			expires = time.Now().Add(e.urlTTL).Truncate(time.Second)
+			file.URL = e.fileURL(file.CID, file.Name, expires)
+		default:
+			continue
+		}
+		file.ExpiresAt = &expires
+	}
+	return job
+}
+
+// fileSignature signs a Filecoin export link with the snapshot link key.
+// The name is signed too, since it sets the downloaded file's name and type.
+func (e *Exporter) fileSignature(cid, name string, expires int64) string {
+	mac := hmac.New(sha256.New, e.files.secret)
+	fmt.Fprintf(mac, "export|%s|%s|%d", cid, name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// fileURL returns the download link of a file stored on Filecoin
+func (e *Exporter) fileURL(cid, name string, expires time.Time) string {
+	return fmt.Sprintf("%s/api/exports/files/%s?name=%s&expires=%d&signature=%s", e.files.baseURL,
+		url.PathEscape(cid), url.QueryEscape(name), expires.Unix(), e.fileSignature(cid, name, expires.Unix()))
+}
+
+// handleCreateExport queues an export, answering 202 with the job
+func (s *AnalyticsServer) handleCreateExport(w http.ResponseWriter, r *http.Request) {
+	var request exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	job, err := s.exports.Submit(request, scopeFrom(r).Name)
+	if err == errExportQueueFull {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many exports waiting", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/exports/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: job})
+}
+
+// handleExports lists the export jobs, newest first
+func (s *AnalyticsServer) handleExports(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: s.exports.List()})
+}
+
+// handleExport serves an export job with its download links
+func (s *AnalyticsServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	job, err := s.exports.Get(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: job})
+}
+
+// handleExportFile serves an export file stored on Filecoin through its
+// signed link
+func (s *AnalyticsServer) handleExportFile(w http.ResponseWriter, r *http.Request) {
+	cid := mux.Vars(r)["cid"]
+	name := r.URL.Query().Get("name")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	signature := r.URL.Query().Get("signature")
+	if err != nil || !hmac.Equal([]byte(signature), []byte(s.exports.fileSignature(cid, name, expires))) {
+		problem.Error(w, r, http.StatusForbidden, problem.CodeInvalidLink, "Invalid export link")
+		return
+	}
+	if time.Now().Unix() > expires {
+		problem.Error(w, r, http.StatusGone, problem.CodeLinkExpired, "Export link expired")
+		return
+	}
+
+	data, err := s.snapshots.Get(r.Context(), cid)
+	if err == errSnapshotNotFound {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to retrieve export %s: %v", cid, err)
+		http.Error(w, "Failed to retrieve export", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", exportContentType(name))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(name)))
+	w.Write(data)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestExporter returns an exporter reading points from a fake InfluxDB,
+// writing to an S3 stub when s3 is set and to a storage-worker stub that
+// keeps uploads in files
+func newTestExporter(t *testing.T, s3 bool) (*Exporter, *fakeInflux, *s3Stub, map[string][]byte) {
+	influx, client := newFakeInflux(t)
+	files := make(map[string][]byte)
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/storage/upload":
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := io.ReadAll(file)
+			cid := fmt.Sprintf("bafy%d", len(files))
+			files[cid] = data
+			json.NewEncoder(w).Encode(map[string]string{"cid": cid})
+		case strings.HasPrefix(r.URL.Path, "/api/storage/retrieve/"):
+			data, ok := files[strings.TrimPrefix(r.URL.Path, "/api/storage/retrieve/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]byte{"data": data})
+		}
+	}))
+	t.Cleanup(worker.Close)
+
+	var cfg Config
+	cfg.Export.MaxPoints = 10
+	cfg.Export.URLTTL = time.Hour
+	cfg.Export.S3.Prefix = "exports/"
+	var stub *s3Stub
+	if s3 {
+		var s3Client *S3Client
+		stub, s3Client = newS3Stub(t)
+		cfg.Export.S3.Endpoint, cfg.Export.S3.Bucket, cfg.Export.S3.PathStyle = s3Client.endpoint, "exports", true
+	}
+	snapshots := &SnapshotStore{url: worker.URL, baseURL: "https://analytics.example", secret: []byte("secret"), client: worker.Client()}
+	return NewExporter(&cfg, client.QueryAPI("crosspay"), NewStorage(client, "crosspay", "analytics"), snapshots), influx, stub, files
+}
+
+// paymentRecords answers export queries with n payment points
+func paymentRecords(n int) func(string) []fluxRecord {
+	return func(flux string) []fluxRecord {
+		records := make([]fluxRecord, n)
+		for i := range records {
+			records[i] = fluxRecord{
+				"_time":    time.Date(2026, 10, 1, 12, i, 0, 0, time.UTC),
+				"_field":   "processing_time_ms",
+				"_value":   int64(1000 + i),
+				"chain_id": "4202",
+				"status":   "completed",
+			}
+		}
+		return records
+	}
+}
+
+func TestExportJobs(t *testing.T) {
+	lastHour := exportRequest{Measurements: []string{"payments"}, From: time.Now().Add(-time.Hour)}
+
+	t.Run("should validate requests and fill in defaults", func(t *testing.T) {
+		exporter, _, _, _ := newTestExporter(t, false)
+		future := time.Now().Add(time.Hour)
+		for _, tc := range []struct {
+			request exportRequest
+			err     string
+		}{
+			{exportRequest{From: lastHour.From}, "measurements is required"},
+			{exportRequest{Measurements: []string{"secrets"}, From: lastHour.From}, `unknown measurement "secrets"`},
+			{exportRequest{Measurements: []string{"payments"}}, "from is required"},
+			{exportRequest{Measurements: []string{"payments"}, From: future}, "from must be before to"},
+			{exportRequest{Measurements: []string{"payments"}, From: lastHour.From, Format: "xlsx"}, "format must be csv or parquet"},
+			{exportRequest{Measurements: []string{"payments"}, From: lastHour.From, Destination: "s3"}, "S3 exports require EXPORT_S3_BUCKET"},
+			{exportRequest{Measurements: []string{"payments"}, From: lastHour.From, Destination: "ftp"}, "destination must be s3 or filecoin"},
+		} {
+			_, err := exporter.Submit(tc.request, "ops")
+			assert.EqualError(t, err, tc.err)
+		}
+
+		job, err := exporter.Submit(exportRequest{Measurements: []string{"payments", "payments", "probes"}, From: lastHour.From, To: future}, "ops")
+		require.NoError(t, err)
+		assert.Equal(t, exportPending, job.Status)
+		assert.Equal(t, exportFormatCSV, job.Format)
+		assert.Equal(t, exportDestinationFilecoin, job.Destination)
+		assert.Equal(t, []string{"payments", "probes"}, job.Measurements)
+		assert.WithinDuration(t, time.Now(), job.To, time.Minute)
+		assert.Equal(t, "ops", job.CreatedBy)
+
+		exporter, _, _, _ = newTestExporter(t, true)
+		job, err = exporter.Submit(lastHour, "ops")
+		require.NoError(t, err)
+		assert.Equal(t, exportDestinationS3, job.Destination)
+	})
+
+	t.Run("should upload each measurement to S3 and link it until the links expire", func(t *testing.T) {
+		exporter, influx, stub, _ := newTestExporter(t, true)
+		influx.query = paymentRecords(3)
+
+		job, err := exporter.Submit(lastHour, "ops")
+		require.NoError(t, err)
+		exporter.run(context.Background(), job.ID)
+
+		job, err = exporter.Get(job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, exportCompleted, job.Status)
+		assert.NotNil(t, job.StartedAt)
+		assert.NotNil(t, job.FinishedAt)
+		require.Len(t, job.Files, 1)
+		file := job.Files[0]
+		assert.Equal(t, "payments.csv", file.Name)
+		assert.Equal(t, "raw", file.Resolution)
+		assert.Equal(t, 3, file.Rows)
+		assert.Equal(t, "exports/"+job.ID+"/payments.csv", file.Key)
+		require.NotNil(t, file.ExpiresAt)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *file.ExpiresAt, time.Minute)
+		link, err := url.Parse(file.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "3600", link.Query().Get("X-Amz-Expires"))
+
+		objects := stub.uploaded()
+		require.Len(t, objects, 1)
+		assert.Equal(t, "/exports/exports/"+job.ID+"/payments.csv", objects[0].path)
+		lines := strings.Split(strings.TrimSpace(string(objects[0].content)), "\n")
+		assert.Equal(t, "time,field,value,chain_id,status,token,is_private,merchant,country,region,asn", lines[0])
+		assert.Equal(t, "2026-10-01T12:00:00Z,processing_time_ms,1000,4202,completed,,,,,,", lines[1])
+		assert.Len(t, lines, 4)
+		assert.Len(t, influx.queries, 1)
+		assert.Contains(t, influx.queries[0], `from(bucket: "analytics")`)
+
+		// Links are signed again on every read
+		assert.Empty(t, exporter.List()[0].Files[0].URL)
+	})
+
+	t.Run("should fail the job when S3 rejects an upload", func(t *testing.T) {
+		exporter, influx, stub, _ := newTestExporter(t, true)
+		influx.query = paymentRecords(1)
+		stub.status, stub.body = http.StatusForbidden, "<Error><Code>AccessDenied</Code></Error>"
+
+		job, err := exporter.Submit(exportRequest{Measurements: []string{"payments", "probes"}, From: lastHour.From}, "ops")
+		require.NoError(t, err)
+		exporter.run(context.Background(), job.ID)
+
+		job, err = exporter.Get(job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, exportFailed, job.Status)
+		assert.Contains(t, job.Error, "payments: failed to store payments.csv: s3 put failed with status 403")
+		assert.Contains(t, job.Error, "AccessDenied")
+		assert.Empty(t, job.Files)
+		// The job stops at the first measurement that fails
+		assert.Len(t, influx.queries, 1)
+	})
+
+	t.Run("should fail the job when a measurement has too many points", func(t *testing.T) {
+		exporter, influx, stub, _ := newTestExporter(t, true)
+		influx.query = paymentRecords(11)
+
+		job, err := exporter.Submit(lastHour, "ops")
+		require.NoError(t, err)
+		exporter.run(context.Background(), job.ID)
+
+		job, err = exporter.Get(job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, exportFailed, job.Status)
+		assert.Contains(t, job.Error, "more than 10 points")
+		assert.Empty(t, stub.uploaded())
+	})
+
+	t.Run("should refuse jobs while the queue is full", func(t *testing.T) {
+		exporter, _, _, _ := newTestExporter(t, false)
+		for i := 0; i < maxExportJobs; i++ {
+			_, err := exporter.Submit(lastHour, "ops")
+			require.NoError(t, err)
+		}
+		_, err := exporter.Submit(lastHour, "ops")
+		assert.ErrorIs(t, err, errExportQueueFull)
+		assert.Len(t, exporter.List(), maxExportJobs)
+
+		_, err = exporter.Get("unknown")
+		assert.ErrorIs(t, err, errExportNotFound)
+	})
+}
+
+func TestExportFileLinks(t *testing.T) {
+	exporter, influx, _, files := newTestExporter(t, false)
+	influx.query = paymentRecords(2)
+	server := &AnalyticsServer{exports: exporter, snapshots: exporter.files}
+
+	job, err := exporter.Submit(exportRequest{Measurements: []string{"payments"}, From: time.Now().Add(-time.Hour)}, "ops")
+	require.NoError(t, err)
+	exporter.run(context.Background(), job.ID)
+	job, err = exporter.Get(job.ID)
+	require.NoError(t, err)
+	require.Equal(t, exportCompleted, job.Status, job.Error)
+	file := job.Files[0]
+	require.Contains(t, files, file.CID)
+
+	download := func(link string) *httptest.ResponseRecorder {
+		parsed, err := url.Parse(link)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, parsed.RequestURI(), nil)
+		req = mux.SetURLVars(req, map[string]string{"cid": strings.TrimPrefix(parsed.Path, "/api/exports/files/")})
+		w := httptest.NewRecorder()
+		server.handleExportFile(w, req)
+		return w
+	}
+	problemCode := func(w *httptest.ResponseRecorder) string {
+		var body problem.Problem
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		return body.Code
+	}
+
+	t.Run("should serve the file until its link expires", func(t *testing.T) {
+		require.NotNil(t, file.ExpiresAt)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *file.ExpiresAt, time.Minute)
+		assert.True(t, strings.HasPrefix(file.URL, "https://analytics.example/api/exports/files/"+file.CID+"?"))
+
+		w := download(file.URL)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+		assert.Equal(t, `attachment; filename="payments.csv"`, w.Header().Get("Content-Disposition"))
+		assert.Equal(t, files[file.CID], w.Body.Bytes())
+
+		expired := time.Now().Add(-time.Second)
+		w = download(exporter.fileURL(file.CID, file.Name, expired))
+		assert.Equal(t, http.StatusGone, w.Code)
+		assert.Equal(t, problem.CodeLinkExpired, problemCode(w))
+	})
+
+	t.Run("should reject links that were altered", func(t *testing.T) {
+		for name, alter := range map[string]func(url.Values){
+			"renamed":   func(query url.Values) { query.Set("name", "payments.parquet") },
+			"extended":  func(query url.Values) { query.Set("expires", fmt.Sprint(time.Now().Add(48*time.Hour).Unix())) },
+			"unsigned":  func(query url.Values) { query.Del("signature") },
+			"bad stamp": func(query url.Values) { query.Set("expires", "tomorrow") },
+		} {
+			parsed, err := url.Parse(file.URL)
+			require.NoError(t, err)
+			query := parsed.Query()
+			alter(query)
+			parsed.RawQuery = query.Encode()
+
+			w := download(parsed.String())
+			assert.Equal(t, http.StatusForbidden, w.Code, name)
+			assert.Equal(t, problem.CodeInvalidLink, problemCode(w), name)
+		}
+	})
+
+	t.Run("should answer 404 for files no longer stored", func(t *testing.T) {
+		w := download(exporter.fileURL("bafymissing", "payments.csv", time.Now().Add(time.Hour)))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// WebSocket clients only see the broadcasts of the instance they are
+// connected to, while a metric is ingested by whichever instance received
+// the POST or the JetStream message. With a broadcast bus every instance
+// publishes the payment, validator and vault events it ingests on a plain
+// NATS subject, and the others deliver them to their own clients. Remote
+// payments also feed the rolling aggregates, so every instance broadcasts
+// the same rates. Alerts are not relayed: each instance evaluates the rules
+// against the shared InfluxDB and broadcasts them already.
+//
+// Relayed events are best effort. One published while an instance is
+// disconnected from NATS is not replayed to it, which only matters to
+// clients watching the live stream at that moment.
+
+// fanoutEventTypes are the events relayed between instances
+var fanoutEventTypes = map[string]bool{"payment": true, "validator": true, "vault": true}
+
+// fanoutMessage is a broadcast as it travels between instances, with the
+// fields subscriptions and token scopes filter on
+type fanoutMessage struct {
+	Type      string          `json:"type"`
+	ChainID   uint64          `json:"chain_id,omitempty"`
+	Addresses []string        `json:"addresses,omitempty"`
+	Merchant  string          `json:"merchant,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// BroadcastFanout relays WebSocket broadcasts between instances
+type BroadcastFanout struct {
+	server  *AnalyticsServer
+	conn    *nats.Conn
+	sub     *nats.Subscription
+	subject string
+}
+
+// NewBroadcastFanout connects to NATS and subscribes to the broadcasts of
+// the other instances. The connection does not echo, so an instance does
+// not receive the events it published itself.
+func NewBroadcastFanout(url, subject string, server *AnalyticsServer) (*BroadcastFanout, error) {
+	conn, err := nats.Connect(url, nats.Name("crosspay-analytics-broadcasts"), nats.NoEcho(), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", url, err)
+	}
+
+	f := &BroadcastFanout{server: server, conn: conn, subject: subject}
+	f.sub, err = conn.Subscribe(subject, f.receive)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+	}
+
+	log.Printf("Sharing WebSocket broadcasts with other instances on %s", subject)
+	return f, nil
+}
+
+// Publish relays an event ingested by this instance to the others
+func (f *BroadcastFanout) Publish(event wsEvent) {
+	if !fanoutEventTypes[event.Type] {
+		return
+	}
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		log.Printf("Failed to encode %s broadcast for other instances: %v", event.Type, err)
+		return
+	}
+	message, err := json.Marshal(fanoutMessage{
+		Type:      event.Type,
+		ChainID:   event.ChainID,
+		Addresses: event.Addresses,
+		Merchant:  event.Merchant,
+		Data:      data,
+	})
+	if err != nil {
+		log.Printf("Failed to encode %s broadcast for other instances: %v", event.Type, err)
+		return
+	}
+	if err := f.conn.Publish(f.subject, message); err != nil {
+		log.Printf("Failed to relay %s broadcast to other instances: %v", event.Type, err)
+	}
+}
+
+// receive delivers another instance's event to this instance's clients
+func (f *BroadcastFanout) receive(msg *nats.Msg) {
+	var message fanoutMessage
+	if err := json.Unmarshal(msg.Data, &message); err != nil || !fanoutEventTypes[message.Type] {
+		log.Printf("Dropping malformed broadcast on %s", msg.Subject)
+		return
+	}
+
+	if message.Type == "payment" {
+		var metric PaymentMetric
+		if err := json.Unmarshal(message.Data, &metric); err == nil {
+			f.server.aggregator.Add(metric, time.Now())
+		}
+	}
+	f.server.broadcastToClients(wsEvent{
+		Type:      message.Type,
+		ChainID:   message.ChainID,
+		Addresses: message.Addresses,
+		Merchant:  message.Merchant,
+		Data:      message.Data,
+	})
+}
+
+// Close unsubscribes and flushes the events still being published
+func (f *BroadcastFanout) Close() {
+	if err := f.sub.Unsubscribe(); err != nil {
+		log.Printf("Failed to unsubscribe from %s: %v", f.subject, err)
+	}
+	if err := f.conn.Drain(); err != nil {
+		log.Printf("Failed to drain NATS connection: %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNATS is a NATS server speaking just enough of the protocol for
+// plain publish and subscribe: CONNECT, PING, SUB, UNSUB and PUB. Messages
+// are routed as they are published, so once a publisher has flushed, every
+// subscriber has been sent them.
+type fakeNATS struct {
+	listener net.Listener
+
+	mu   sync.Mutex
+	subs map[*natsClient]map[string]string
+}
+
+// natsClient is a connection to a fakeNATS and its CONNECT options
+type natsClient struct {
+	conn net.Conn
+	echo bool
+	mu   sync.Mutex
+}
+
+func (c *natsClient) send(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.conn, format, args...)
+}
+
+// newFakeNATS starts a fakeNATS and returns its URL
+func newFakeNATS(t *testing.T) (*fakeNATS, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &fakeNATS{listener: listener, subs: make(map[*natsClient]map[string]string)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, "nats://" + listener.Addr().String()
+}
+
+func (s *fakeNATS) serve(conn net.Conn) {
+	client := &natsClient{conn: conn, echo: true}
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, client)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	client.send("INFO {\"server_id\":\"fake\",\"proto\":1,\"max_payload\":1048576}\r\n")
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		op, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		fields := strings.Fields(args)
+		switch strings.ToUpper(op) {
+		case "CONNECT":
+			var options struct {
+				Echo *bool `json:"echo"`
+			}
+			json.Unmarshal([]byte(args), &options)
+			if options.Echo != nil {
+				client.echo = *options.Echo
+			}
+		case "PING":
+			client.send("PONG\r\n")
+		case "SUB":
+			s.mu.Lock()
+			if s.subs[client] == nil {
+				s.subs[client] = make(map[string]string)
+			}
+			s.subs[client][fields[len(fields)-1]] = fields[0]
+			s.mu.Unlock()
+		case "UNSUB":
+			s.mu.Lock()
+			delete(s.subs[client], fields[0])
+			s.mu.Unlock()
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			s.route(client, fields[0], payload[:size])
+		}
+	}
+}
+
+// route sends a message to every subscription of subject
+func (s *fakeNATS) route(from *natsClient, subject string, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for client, subs := range s.subs {
+		if client == from && !from.echo {
+			continue
+		}
+		for sid, subscribed := range subs {
+			if subscribed == subject {
+				client.send("MSG %s %s %d\r\n%s\r\n", subject, sid, len(payload), payload)
+			}
+		}
+	}
+}
+
+// subscribers counts the subscriptions to subject
+func (s *fakeNATS) subscribers(subject string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, subs := range s.subs {
+		for _, subscribed := range subs {
+			if subscribed == subject {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+const testBroadcastSubject = "analytics.broadcasts"
+
+// newTestInstance is an analytics instance sharing broadcasts over url
+func newTestInstance(t *testing.T, url string) *AnalyticsServer {
+	server := &AnalyticsServer{
+		broadcasts: make(chan wsEvent, 16),
+		clients:    make(map[*wsClient]bool),
+		aggregator: NewPaymentAggregator(),
+	}
+	fanout, err := NewBroadcastFanout(url, testBroadcastSubject, server)
+	require.NoError(t, err)
+	t.Cleanup(fanout.conn.Close)
+	// the subscription is in place once the server has answered a ping
+	require.NoError(t, fanout.conn.Flush())
+	server.fanout = fanout
+	return server
+}
+
+// addTestClient connects a WebSocket client with a send buffer of buffer
+// messages to server. Nothing writes its buffer out, so it fills up.
+func addTestClient(t *testing.T, server *AnalyticsServer, buffer int, scope *Scope) (*wsClient, *websocket.Conn) {
+	accepted := make(chan *websocket.Conn, 1)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(httpServer.Close)
+
+	remote, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { remote.Close() })
+
+	client := &wsClient{conn: <-accepted, send: make(chan []byte, buffer), scope: scope}
+	t.Cleanup(func() { client.conn.Close() })
+	server.clientsMutex.Lock()
+	server.clients[client] = true
+	server.clientsMutex.Unlock()
+	return client, remote
+}
+
+// paymentEvent is the broadcast of a payment to merchant on chainID
+func paymentEvent(id, chainID uint64, merchant string) wsEvent {
+	metric := PaymentMetric{PaymentID: id, ChainID: chainID, Status: "completed", Recipient: merchant, Token: "0x0", Amount: "1000", Timestamp: time.Now()}
+	return wsEvent{Type: "payment", ChainID: chainID, Merchant: merchant, Data: metric}
+}
+
+// nextPayment waits for the next message on a client's buffer and returns
+// the payment in it
+func nextPayment(t *testing.T, client *wsClient) PaymentMetric {
+	select {
+	case message, ok := <-client.send:
+		require.True(t, ok, "client was disconnected")
+		var event struct {
+			Type string        `json:"type"`
+			Data PaymentMetric `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(message, &event))
+		require.Equal(t, "payment", event.Type)
+		return event.Data
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message delivered")
+		return PaymentMetric{}
+	}
+}
+
+func isClient(server *AnalyticsServer, client *wsClient) bool {
+	server.clientsMutex.RLock()
+	defer server.clientsMutex.RUnlock()
+	return server.clients[client]
+}
+
+func TestBroadcastFanout(t *testing.T) {
+	merchant := "0x00000000000000000000000000000000000000b2"
+
+	t.Run("should relay ingested events to the other instances only", func(t *testing.T) {
+		_, url := newFakeNATS(t)
+		a, b := newTestInstance(t, url), newTestInstance(t, url)
+
+		a.fanout.Publish(wsEvent{Type: "alert", Data: Alert{Rule: "probe_failed"}})
+		a.fanout.Publish(paymentEvent(1, 4202, merchant))
+		require.NoError(t, a.fanout.conn.Flush())
+
+		select {
+		case event := <-b.broadcasts:
+			assert.Equal(t, "payment", event.Type)
+			assert.Equal(t, uint64(4202), event.ChainID)
+			assert.Equal(t, merchant, event.Merchant)
+			var metric PaymentMetric
+			require.NoError(t, json.Unmarshal(event.Data.(json.RawMessage), &metric))
+			assert.Equal(t, uint64(1), metric.PaymentID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("payment not relayed")
+		}
+		assert.Empty(t, a.broadcasts)
+		assert.Empty(t, b.broadcasts)
+	})
+
+	t.Run("should evict slow clients without holding up the others", func(t *testing.T) {
+		_, url := newFakeNATS(t)
+		a, b := newTestInstance(t, url), newTestInstance(t, url)
+		go b.handleWebSocketBroadcasts()
+
+		fast, _ := addTestClient(t, b, 8, adminScope)
+		slow, slowRemote := addTestClient(t, b, 1, adminScope)
+		slow.send <- []byte(`{"type":"queued"}`)
+		// a full client the payments are not for is left alone
+		other, _ := addTestClient(t, b, 0, &Scope{Name: "globex", Role: RoleMerchant, Merchants: []string{"0x00000000000000000000000000000000000000c3"}})
+
+		a.fanout.Publish(paymentEvent(1, 4202, merchant))
+		assert.Equal(t, uint64(1), nextPayment(t, fast).PaymentID)
+		require.Eventually(t, func() bool { return !isClient(b, slow) }, 5*time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, `{"type":"queued"}`, string(<-slow.send))
+		_, open := <-slow.send
+		assert.False(t, open)
+		slowRemote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := slowRemote.ReadMessage()
+		assert.Error(t, err)
+
+		a.fanout.Publish(paymentEvent(2, 4202, merchant))
+		assert.Equal(t, uint64(2), nextPayment(t, fast).PaymentID)
+		assert.True(t, isClient(b, fast))
+		assert.True(t, isClient(b, other))
+	})
+
+	t.Run("should deliver every event again once a client unsubscribes", func(t *testing.T) {
+		_, url := newFakeNATS(t)
+		a, b := newTestInstance(t, url), newTestInstance(t, url)
+		go b.handleWebSocketBroadcasts()
+		client, _ := addTestClient(t, b, 8, adminScope)
+
+		reply := client.handleRequest([]byte(`{"action":"subscribe","types":["payment"],"chain_ids":[1]}`))
+		require.Equal(t, "subscribed", reply["type"])
+		a.fanout.Publish(paymentEvent(1, 4202, merchant))
+		a.fanout.Publish(paymentEvent(2, 1, merchant))
+		assert.Equal(t, uint64(2), nextPayment(t, client).PaymentID)
+
+		// unsubscribing races with the broadcasts still being delivered
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for id := uint64(3); id < 10; id++ {
+				a.fanout.Publish(paymentEvent(id, 1, merchant))
+			}
+		}()
+		require.Equal(t, "unsubscribed", client.handleRequest([]byte(`{"action":"unsubscribe"}`))["type"])
+		<-done
+		for id := uint64(3); id < 10; id++ {
+			assert.Equal(t, id, nextPayment(t, client).PaymentID)
+		}
+
+		a.fanout.Publish(paymentEvent(10, 4202, merchant))
+		assert.Equal(t, uint64(10), nextPayment(t, client).PaymentID)
+	})
+
+	t.Run("should stop receiving once closed", func(t *testing.T) {
+		nats, url := newFakeNATS(t)
+		a, b, c := newTestInstance(t, url), newTestInstance(t, url), newTestInstance(t, url)
+		require.Equal(t, 3, nats.subscribers(testBroadcastSubject))
+
+		b.fanout.Close()
+		require.Eventually(t, b.fanout.conn.IsClosed, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, 2, nats.subscribers(testBroadcastSubject))
+
+		a.fanout.Publish(paymentEvent(1, 4202, merchant))
+		require.NoError(t, a.fanout.conn.Flush())
+		select {
+		case event := <-c.broadcasts:
+			assert.Equal(t, "payment", event.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatal("payment not relayed")
+		}
+		assert.Empty(t, b.broadcasts)
+	})
+
+	t.Run("should drop malformed broadcasts", func(t *testing.T) {
+		_, url := newFakeNATS(t)
+		a, b := newTestInstance(t, url), newTestInstance(t, url)
+
+		require.NoError(t, a.fanout.conn.Publish(testBroadcastSubject, []byte("not json")))
+		require.NoError(t, a.fanout.conn.Publish(testBroadcastSubject, []byte(`{"type":"aggregates","data":{}}`)))
+		a.fanout.Publish(paymentEvent(1, 4202, merchant))
+		require.NoError(t, a.fanout.conn.Flush())
+
+		select {
+		case event := <-b.broadcasts:
+			assert.Equal(t, "payment", event.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatal("payment not relayed")
+		}
+		assert.Empty(t, b.broadcasts)
+	})
+}
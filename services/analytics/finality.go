@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Reading Confirmations blocks behind the head keeps out most reorgs, but
+// not a deeper one. So every block the indexer wrote points from, and the
+// last block of each range, is remembered with its hash until the chain
+// finalizes it. Each poll compares the newest remembered block with the
+// canonical chain. Blocks are hash linked, so when it still matches every
+// older one does too. When it does not, the indexer walks back to the
+// newest block that still matches, deletes the points of every replaced
+// block, marks the payments they reported as reorged and rewinds to re-read
+// the new chain from there. A payment whose transaction was included again
+// gets its status back when its event is re-read.
+
+// PaymentReorged is the status written for a payment whose event was in a
+// block a reorg replaced
+const PaymentReorged = "reorged"
+
+// Reorg is a reorg the indexer recovered from
+type Reorg struct {
+	ChainID    uint64    `json:"chain_id"`
+	FromBlock  uint64    `json:"from_block"`
+	Depth      uint64    `json:"depth"`
+	Payments   []uint64  `json:"payments"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// indexedBlock is a block the indexer read and what it wrote from it. A
+// block without points only marks the end of a range. Points of a block lie
+// between its time and its time plus lastLog nanoseconds.
+type indexedBlock struct {
+	number   uint64
+	hash     common.Hash
+	time     time.Time
+	hasLogs  bool
+	lastLog  uint
+	payments []PaymentMetric
+}
+
+// remember records the points written for a log. Logs arrive in block
+// order, so a block is either the last remembered or a new one.
+func (c *chainIndexer) remember(entry types.Log, at time.Time, metrics []indexedMetric) {
+	block := c.rememberBlock(entry.BlockNumber, entry.BlockHash)
+	if !block.hasLogs {
+		block.time, block.hasLogs = at, true
+	}
+	if entry.Index > block.lastLog {
+		block.lastLog = entry.Index
+	}
+	for _, metric := range metrics {
+		if metric.payment != nil {
+			block.payments = append(block.payments, *metric.payment)
+		}
+	}
+}
+
+// rememberBlock returns the remembered block with number, adding it after
+// the others if it is new
+func (c *chainIndexer) rememberBlock(number uint64, hash common.Hash) *indexedBlock {
+	if n := len(c.blocks); n > 0 && c.blocks[n-1].number == number {
+		c.blocks[n-1].hash = hash
+		return &c.blocks[n-1]
+	}
+	c.blocks = append(c.blocks, indexedBlock{number: number, hash: hash})
+	return &c.blocks[len(c.blocks)-1]
+}
+
+// rememberRangeEnd records the hash of the last block of an indexed range,
+// so a reorg that only replaced blocks without logs is noticed too
+func (c *chainIndexer) rememberRangeEnd(ctx context.Context, number uint64) (common.Hash, error) {
+	header, err := c.client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to get block %d: %w", number, err)
+	}
+	c.rememberBlock(number, header.Hash())
+	return header.Hash(), nil
+}
+
+// finalizedBlock returns the chain's finalized block, or FinalityBlocks
+// behind the head on chains without the finalized tag
+func (c *chainIndexer) finalizedBlock(ctx context.Context) uint64 {
+	header, err := c.client.HeaderByNumber(ctx, big.NewInt(int64(rpc.FinalizedBlockNumber)))
+	if err == nil && header != nil {
+		return header.Number.Uint64()
+	}
+	if c.head < c.chain.FinalityBlocks {
+		return 0
+	}
+	return c.head - c.chain.FinalityBlocks
+}
+
+// checkReorg forgets the blocks that are final, then reverts the blocks a
+// reorg replaced
+func (c *chainIndexer) checkReorg(ctx context.Context) error {
+	finalized := c.finalizedBlock(ctx)
+	c.finalized = finalized
+
+	final := 0
+	for final < len(c.blocks) && c.blocks[final].number <= finalized {
+		final++
+	}
+	c.blocks = append(c.blocks[:0], c.blocks[final:]...)
+
+	keep := len(c.blocks)
+	for keep > 0 {
+		block := c.blocks[keep-1]
+		header, err := c.client.HeaderByNumber(ctx, new(big.Int).SetUint64(block.number))
+		if err != nil {
+			return fmt.Errorf("failed to get block %d: %w", block.number, err)
+		}
+		if header.Hash() == block.hash {
+			break
+		}
+		keep--
+	}
+
+	if keep == len(c.blocks) {
+		return nil
+	}
+
+	from, parent := finalized+1, common.Hash{}
+	if keep > 0 {
+		from, parent = c.blocks[keep-1].number+1, c.blocks[keep-1].hash
+	} else {
+		log.Printf("Reorg on chain %d replaced every block remembered; points from before the last restart may remain", c.chain.ChainID)
+	}
+	if from > c.nextBlock {
+		from = c.nextBlock
+	}
+	if err := c.revert(ctx, c.blocks[keep:], from, parent); err != nil {
+		return err
+	}
+	c.blocks = c.blocks[:keep]
+	return nil
+}
+
+// revert deletes the points written from replaced blocks, marks their
+// payments as reorged and rewinds indexing to from. parent is the hash of
+// the block before from, when known.
+func (c *chainIndexer) revert(ctx context.Context, replaced []indexedBlock, from uint64, parent common.Hash) error {
+	chainID := strconv.FormatUint(c.chain.ChainID, 10)
+	predicate := fmt.Sprintf(`chain_id="%s"`, chainID)
+
+	var points []*write.Point
+	var reorged []PaymentMetric
+	seen := make(map[uint64]bool)
+	for _, block := range replaced {
+		if !block.hasLogs {
+			continue
+		}
+		if err := c.server.storage.DeleteRaw(ctx, block.time, block.time.Add(time.Duration(block.lastLog)), predicate); err != nil {
+			return fmt.Errorf("failed to delete points of block %d: %w", block.number, err)
+		}
+		// the latest status wins, and is marked at its own time so it
+		// stays the payment's latest status until its event is re-read
+		for i := len(block.payments) - 1; i >= 0; i-- {
+			metric := block.payments[i]
+			if seen[metric.PaymentID] {
+				continue
+			}
+			seen[metric.PaymentID] = true
+			metric.Status = PaymentReorged
+			metric.ProcessingTime = 0
+			points = append(points, paymentPoint(&metric))
+			reorged = append(reorged, metric)
+		}
+	}
+
+	reorg := Reorg{
+		ChainID:    c.chain.ChainID,
+		FromBlock:  from,
+		Depth:      c.nextBlock - from,
+		Payments:   make([]uint64, 0, len(reorged)),
+		DetectedAt: time.Now().UTC(),
+	}
+	for _, metric := range reorged {
+		reorg.Payments = append(reorg.Payments, metric.PaymentID)
+	}
+	points = append(points, write.NewPointWithMeasurement("indexer_reorgs").
+		AddTag("chain_id", chainID).
+		AddField("from_block", from).
+		AddField("depth", reorg.Depth).
+		AddField("payments", len(reorged)).
+		SetTime(reorg.DetectedAt))
+
+	if err := c.server.writer.WritePoint(ctx, points...); err != nil {
+		return err
+	}
+	if err := c.saveCheckpoint(ctx, from, parent); err != nil {
+		return err
+	}
+	c.nextBlock = from
+
+	log.Printf("Reorg on chain %d from block %d (%d blocks indexed again), %d payments marked reorged", c.chain.ChainID, from, reorg.Depth, len(reorged))
+	for _, metric := range reorged {
+		c.server.announcePayment(metric)
+	}
+
+	c.stateMutex.Lock()
+	c.state.Reorgs++
+	c.state.LastReorg = &reorg
+	c.stateMutex.Unlock()
+	return nil
+}
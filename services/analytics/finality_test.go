@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// indexBlocks remembers blocks from to to of fake as indexed, with a
+// payment in the blocks listed in payments
+func indexBlocks(c *chainIndexer, fake *fakeChain, from, to uint64, payments map[uint64]uint64) {
+	for number := from; number <= to; number++ {
+		block := c.rememberBlock(number, fake.hash(number))
+		if id, ok := payments[number]; ok {
+			block.time = time.Unix(int64(1_700_000_000+12*number), 0).UTC()
+			block.hasLogs, block.lastLog = true, 3
+			block.payments = append(block.payments, PaymentMetric{PaymentID: id, ChainID: 4202, Status: "completed", Timestamp: block.time})
+		}
+	}
+	c.nextBlock = to + 1
+}
+
+func TestCheckReorg(t *testing.T) {
+	payments := map[uint64]uint64{91: 1, 93: 2, 95: 3}
+
+	for _, tc := range []struct {
+		name      string
+		finalized uint64
+		reorg     uint64
+		next      uint64
+		kept      []uint64
+		deleted   []uint64
+		reorged   []uint64
+	}{
+		{
+			name: "chain unchanged", finalized: 80,
+			next: 96, kept: []uint64{90, 91, 92, 93, 94, 95},
+		},
+		{
+			name: "finalized blocks forgotten", finalized: 92,
+			next: 96, kept: []uint64{93, 94, 95},
+		},
+		{
+			name: "newest block replaced", finalized: 80, reorg: 95,
+			next: 95, kept: []uint64{90, 91, 92, 93, 94}, deleted: []uint64{95}, reorged: []uint64{3},
+		},
+		{
+			name: "replaced block without logs", finalized: 80, reorg: 94,
+			next: 94, kept: []uint64{90, 91, 92, 93}, deleted: []uint64{95}, reorged: []uint64{3},
+		},
+		{
+			name: "several blocks replaced", finalized: 80, reorg: 92,
+			next: 92, kept: []uint64{90, 91}, deleted: []uint64{93, 95}, reorged: []uint64{2, 3},
+		},
+		{
+			name: "every remembered block replaced", finalized: 80, reorg: 85,
+			next: 81, deleted: []uint64{91, 93, 95}, reorged: []uint64{1, 2, 3},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			finalized := tc.finalized
+			fake := &fakeChain{head: 100, finalized: &finalized}
+			c, influx := newTestChainIndexer(t, fake, IndexedChain{Confirmations: 5, FinalityBlocks: 64}, 100)
+			indexBlocks(c, fake, 90, 95, payments)
+			if tc.reorg > 0 {
+				fake.reorg(tc.reorg)
+			}
+
+			require.NoError(t, c.checkReorg(context.Background()))
+			assert.Equal(t, tc.next, c.nextBlock)
+			kept := make([]uint64, 0, len(c.blocks))
+			for _, block := range c.blocks {
+				kept = append(kept, block.number)
+			}
+			assert.Equal(t, append([]uint64{}, tc.kept...), kept)
+
+			deleted := make([]uint64, 0)
+			for _, request := range influx.deleted() {
+				assert.Equal(t, `chain_id="4202"`, request.Predicate)
+				deleted = append(deleted, uint64(request.Start.Unix()-1_700_000_000)/12)
+				assert.Equal(t, 3*time.Nanosecond, request.Stop.Sub(request.Start))
+			}
+			assert.Equal(t, append([]uint64{}, tc.deleted...), deleted)
+
+			var reorged []uint64
+			for len(c.server.paymentStream) > 0 {
+				metric := <-c.server.paymentStream
+				assert.Equal(t, PaymentReorged, metric.Status)
+				reorged = append(reorged, metric.PaymentID)
+			}
+			assert.Equal(t, tc.reorged, reorged)
+			for _, line := range influx.written("payments") {
+				assert.True(t, strings.Contains(line, "status="+PaymentReorged), line)
+			}
+
+			if tc.reorg == 0 {
+				assert.Empty(t, influx.written("indexer_reorgs"))
+				assert.Zero(t, c.state.Reorgs)
+				return
+			}
+			require.Len(t, influx.written("indexer_reorgs"), 1)
+			require.NotNil(t, c.state.LastReorg)
+			assert.Equal(t, tc.next, c.state.LastReorg.FromBlock)
+			assert.Equal(t, 96-tc.next, c.state.LastReorg.Depth)
+			checkpoints := influx.written("indexer_checkpoints")
+			require.Len(t, checkpoints, 1)
+			assert.Contains(t, checkpoints[0], "next_block="+strconv.FormatUint(tc.next, 10)+"u")
+		})
+	}
+
+	t.Run("should count from the finality depth on chains without the finalized tag", func(t *testing.T) {
+		fake := &fakeChain{head: 100}
+		c, _ := newTestChainIndexer(t, fake, IndexedChain{Confirmations: 5, FinalityBlocks: 8}, 100)
+		indexBlocks(c, fake, 90, 95, nil)
+		c.head = fake.head
+
+		require.NoError(t, c.checkReorg(context.Background()))
+		assert.Equal(t, uint64(92), c.finalized)
+		assert.Len(t, c.blocks, 3)
+	})
+}
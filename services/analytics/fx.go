@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payment amounts are in base units of their token, so volumes summed
+// across tokens mean nothing. Payments are priced in USD as they are
+// ingested: the token's symbol and decimals come from a token list, and
+// its rate is the FTSO price in effect at the payment's timestamp, read from
+// oracle-service's price history. The amount_usd, fee_usd and usd_rate
+// fields are stored with the payment; a payment whose token or rate is
+// unknown is stored without them.
+
+// fxCacheSize bounds the cached rates before the cache is cleared
+const fxCacheSize = 10000
+
+const nativeTokenAddress = "0x0000000000000000000000000000000000000000"
+
+// fxToken is how a token is priced
+type fxToken struct {
+	Symbol   string
+	Decimals int
+}
+
+// FXEnricher prices payments in USD at the time they were made
+type FXEnricher struct {
+	oracleURL string
+	client    *http.Client
+	tokens    map[string]fxToken
+	rates     map[string]float64
+	mutex     sync.Mutex
+}
+
+// NewFXEnricher prices payments with the oracle at ORACLE_SERVICE_URL,
+// and does nothing when it is unset. FX_TOKEN_LIST names a token list in
+// the payment processor's tokens.json format; unlisted native tokens are
+// priced as ETH.
+func NewFXEnricher() (*FXEnricher, error) {
+	fx := &FXEnricher{
+		oracleURL: strings.TrimSuffix(getEnv("ORACLE_SERVICE_URL", ""), "/"),
+		client:    &http.Client{Timeout: 2 * time.Second},
+		tokens:    make(map[string]fxToken),
+		rates:     make(map[string]float64),
+	}
+	if fx.oracleURL == "" {
+		return fx, nil
+	}
+
+	if path := getEnv("FX_TOKEN_LIST", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		var list struct {
+			Tokens []struct {
+				ChainID  uint64 `json:"chainId"`
+				Address  string `json:"address"`
+				Symbol   string `json:"symbol"`
+				Decimals int    `json:"decimals"`
+			} `json:"tokens"`
+		}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("invalid token list %s: %w", path, err)
+		}
+		for _, entry := range list.Tokens {
+			if entry.Symbol == "" || entry.Decimals < 0 {
+				return nil, fmt.Errorf("invalid token list %s: %s has no symbol or decimals", path, entry.Address)
+			}
+			fx.tokens[fxTokenKey(entry.ChainID, entry.Address)] = fxToken{Symbol: strings.ToUpper(entry.Symbol), Decimals: entry.Decimals}
+		}
+	}
+	log.Printf("Pricing payments in USD with %s (%d listed tokens)", fx.oracleURL, len(fx.tokens))
+	return fx, nil
+}
+
+func fxTokenKey(chainID uint64, address string) string {
+	return fmt.Sprintf("%d:%s", chainID, strings.ToLower(address))
+}
+
+// Enrich sets a payment's amount_usd, fee_usd and usd_rate, replacing any
+// the metric arrived with. It leaves them unset if the token is unlisted
+// or the oracle has no valid price for the payment's timestamp.
+func (f *FXEnricher) Enrich(ctx context.Context, metric *PaymentMetric) {
+	metric.AmountUSD, metric.FeeUSD, metric.USDRate = 0, 0, 0
+	if f.oracleURL == "" {
+		return
+	}
+
+	token, ok := f.tokens[fxTokenKey(metric.ChainID, metric.Token)]
+	if !ok {
+		if !strings.EqualFold(metric.Token, nativeTokenAddress) && metric.Token != "" {
+			return
+		}
+		token = fxToken{Symbol: "ETH", Decimals: 18}
+	}
+	at := metric.Timestamp
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	rate, err := f.rate(ctx, token.Symbol+"/USD", at)
+	if err != nil {
+		log.Printf("No USD rate for payment %d: %v", metric.PaymentID, err)
+		return
+	}
+	if rate == 0 {
+		return
+	}
+	amount, ok := usdValue(metric.Amount, token.Decimals, rate)
+	if !ok {
+		return
+	}
+	metric.AmountUSD = amount
+	metric.FeeUSD, _ = usdValue(metric.Fee, token.Decimals, rate)
+	metric.USDRate = rate
+}
+
+// rate returns the price of symbol at at, cached per minute. Zero means
+// the oracle has no valid price then; that is cached too.
+func (f *FXEnricher) rate(ctx context.Context, symbol string, at time.Time) (float64, error) {
+	key := fmt.Sprintf("%s@%d", symbol, at.Unix()/60)
+	f.mutex.Lock()
+	rate, ok := f.rates[key]
+	f.mutex.Unlock()
+	if ok {
+		return rate, nil
+	}
+
+	rate, err := f.fetchRate(ctx, symbol, at)
+	if err != nil {
+		return 0, err
+	}
+
+	f.mutex.Lock()
+	if len(f.rates) >= fxCacheSize {
+		f.rates = make(map[string]float64)
+	}
+	f.rates[key] = rate
+	f.mutex.Unlock()
+	return rate, nil
+}
+
+// fetchRate reads the price of symbol in effect at at from the oracle's
+// price history
+func (f *FXEnricher) fetchRate(ctx context.Context, symbol string, at time.Time) (float64, error) {
+	query := url.Values{"at": {fmt.Sprintf("%d", at.Unix())}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.oracleURL+"/api/ftso/price/"+symbol+"/history?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("oracle returned status %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Price float64 `json:"price"`
+		Valid bool    `json:"valid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return 0, fmt.Errorf("invalid oracle response: %w", err)
+	}
+	if !data.Valid || data.Price <= 0 {
+		return 0, nil
+	}
+	return data.Price, nil
+}
+
+// usdValue converts a base-unit amount of a token with decimals to USD
+func usdValue(amount string, decimals int, rate float64) (float64, bool) {
+	if amount == "" {
+		return 0, true
+	}
+	value, ok := new(big.Float).SetString(amount)
+	if !ok || value.Sign() < 0 {
+		return 0, false
+	}
+	scale := new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+	value.Quo(value, scale).Mul(value, big.NewFloat(rate))
+	usd, _ := value.Float64()
+	return usd, true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Payment metrics can carry the payer's IP address as client_ip. It is
+// looked up in MaxMind databases to tag the payment with its country,
+// region (continent) and ASN. The address is never stored as given: it is
+// dropped after the lookup, or kept truncated to its network or as a keyed
+// hash, depending on GEOIP_IP_MODE. Tags have bounded cardinality; the
+// stored address is a field.
+
+const (
+	IPModeDrop     = "drop"
+	IPModeTruncate = "truncate"
+	IPModeHash     = "hash"
+)
+
+// GeoEnricher tags payments with where their client IP is from
+type GeoEnricher struct {
+	country      *geoip2.Reader
+	asn          *geoip2.Reader
+	mode         string
+	salt         []byte
+	useRequestIP bool
+}
+
+// NewGeoEnricher opens the databases at GEOIP_COUNTRY_DB (GeoLite2 Country
+// or City) and GEOIP_ASN_DB (GeoLite2 ASN); either may be left unset.
+// GEOIP_IP_MODE selects how the address is kept: drop (default), truncate
+// (to a /24 or /48) or hash (HMAC-SHA256 keyed with GEOIP_HASH_SALT).
+func NewGeoEnricher() (*GeoEnricher, error) {
+	geo := &GeoEnricher{
+		mode:         getEnv("GEOIP_IP_MODE", IPModeDrop),
+		salt:         []byte(getEnv("GEOIP_HASH_SALT", "")),
+		useRequestIP: getEnv("GEOIP_USE_REQUEST_IP", "false") == "true",
+	}
+
+	switch geo.mode {
+	case IPModeDrop, IPModeTruncate:
+	case IPModeHash:
+		if len(geo.salt) == 0 {
+			return nil, fmt.Errorf("GEOIP_IP_MODE=hash requires GEOIP_HASH_SALT")
+		}
+	default:
+		return nil, fmt.Errorf("unknown GEOIP_IP_MODE %q", geo.mode)
+	}
+
+	var err error
+	if path := getEnv("GEOIP_COUNTRY_DB", ""); path != "" {
+		if geo.country, err = geoip2.Open(path); err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		log.Printf("Enriching payments with countries from %s", path)
+	}
+	if path := getEnv("GEOIP_ASN_DB", ""); path != "" {
+		if geo.asn, err = geoip2.Open(path); err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		log.Printf("Enriching payments with ASNs from %s", path)
+	}
+	return geo, nil
+}
+
+// Enrich sets a payment's country, region and ASN from its client IP, then
+// replaces the IP with the form GEOIP_IP_MODE keeps. Without a client_ip,
+// r's address is used when GEOIP_USE_REQUEST_IP is set; r may be nil.
+func (g *GeoEnricher) Enrich(metric *PaymentMetric, r *http.Request) {
+	address := metric.ClientIP
+	if address == "" && g.useRequestIP && r != nil {
+		address = requestIP(r)
+	}
+	metric.ClientIP = ""
+	ip := net.ParseIP(strings.TrimSpace(address))
+	if ip == nil {
+		return
+	}
+
+	if g.country != nil {
+		if record, err := g.country.Country(ip); err == nil {
+			metric.Country = record.Country.IsoCode
+			metric.Region = record.Continent.Code
+		}
+	}
+	if g.asn != nil {
+		if record, err := g.asn.ASN(ip); err == nil && record.AutonomousSystemNumber != 0 {
+			metric.ASN = fmt.Sprintf("AS%d", record.AutonomousSystemNumber)
+		}
+	}
+
+	switch g.mode {
+	case IPModeTruncate:
+		metric.ClientIP = truncateIP(ip).String()
+	case IPModeHash:
+		mac := hmac.New(sha256.New, g.salt)
+		mac.Write(ip.To16())
+		metric.ClientIP = hex.EncodeToString(mac.Sum(nil))[:32]
+	}
+}
+
+// Close closes the databases
+func (g *GeoEnricher) Close() {
+	if g.country != nil {
+		g.country.Close()
+	}
+	if g.asn != nil {
+		g.asn.Close()
+	}
+}
+
+// truncateIP zeroes the host part of an address: IPv4 to its /24, IPv6 to
+// its /48
+func truncateIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(48, 128))
+}
+
+// requestIP is the first X-Forwarded-For address, or the peer address
+func requestIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The /api/grafana endpoints implement the Grafana JSON datasource
+// (simpod-json-datasource) protocol, so existing Grafana dashboards can
+// chart the analytics measurements. A target names a measurement and
+// numeric field, such as payments.processing_time_ms. Its payload can set
+// the aggregate, restrict it to a chain and split it by a tag. Queries read
+// the storage tier Resolve picks for the range, so long ranges chart rollup
+// averages. Merchant tokens can only chart payments, scoped to their
+// merchants.
+
+// grafanaFields are the numeric fields that can be charted, by measurement
+var grafanaFields = map[string][]string{
+	"payments":    {"processing_time_ms", "required_sigs", "received_sigs"},
+	"validators":  {"response_time_ms"},
+	"vaults":      {"utilization_pct", "apy", "risk_score", "slashing_events", "slash_loss_pct"},
+	"chain_state": {"lag_blocks", "payment_count", "validation_count", "active_validators", "total_stake"},
+	"gas_budgets": {"used_pct"},
+	"signatures":  {"latency_ms"},
+	"receipts":    {"size_bytes", "cost_fil", "duration_ms"},
+	"probes":      {"duration_ms"},
+}
+
+// grafanaTags are the tags a target can be split by, by measurement
+var grafanaTags = map[string][]string{
+	"payments":    {"chain_id", "status", "token", "is_private", "merchant", "country", "region", "asn"},
+	"validators":  {"chain_id", "validator_address", "status", "event"},
+	"vaults":      {"chain_id", "vault_address", "tranche_type"},
+	"chain_state": {"chain_id"},
+	"gas_budgets": {"chain_id", "merchant"},
+	"signatures":  {"chain_id", "validator_address", "event"},
+	"receipts":    {"chain_id", "format", "language", "source", "status", "failure_reason"},
+	"probes":      {"stage", "status"},
+}
+
+var grafanaAggregates = []string{"mean", "max", "min", "sum", "count", "last"}
+
+// grafanaMetric is an entry of the /metrics response, with the payload
+// options Grafana offers for it
+type grafanaMetric struct {
+	Label    string           `json:"label"`
+	Value    string           `json:"value"`
+	Payloads []grafanaPayload `json:"payloads"`
+}
+
+type grafanaPayload struct {
+	Label   string          `json:"label"`
+	Name    string          `json:"name"`
+	Type    string          `json:"type,omitempty"`
+	Options []grafanaOption `json:"options,omitempty"`
+}
+
+type grafanaOption struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// grafanaQuery is the body of a /query request
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs int64           `json:"intervalMs"`
+	Targets    []grafanaTarget `json:"targets"`
+}
+
+type grafanaTarget struct {
+	Target  string            `json:"target"`
+	RefID   string            `json:"refId"`
+	Hide    bool              `json:"hide"`
+	Payload map[string]string `json:"payload"`
+}
+
+// grafanaSeries is a time series in the /query response. Each datapoint is
+// a value and a Unix time in milliseconds.
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	RefID      string       `json:"refId,omitempty"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// grafanaTargets lists the targets the scope may chart, sorted
+func grafanaTargets(scope *Scope) []string {
+	var targets []string
+	for measurement, fields := range grafanaFields {
+		if !scope.IsAdmin() && measurement != "payments" {
+			continue
+		}
+		for _, field := range fields {
+			targets = append(targets, measurement+"."+field)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// handleGrafanaTest answers the datasource connection test
+func (s *AnalyticsServer) handleGrafanaTest(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGrafanaSearch lists the targets, for datasource versions before
+// /metrics
+func (s *AnalyticsServer) handleGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grafanaTargets(scopeFrom(r)))
+}
+
+// handleGrafanaMetrics lists the targets with their payload options
+func (s *AnalyticsServer) handleGrafanaMetrics(w http.ResponseWriter, r *http.Request) {
+	aggregates := make([]grafanaOption, len(grafanaAggregates))
+	for i, aggregate := range grafanaAggregates {
+		aggregates[i] = grafanaOption{Label: aggregate, Value: aggregate}
+	}
+
+	metrics := []grafanaMetric{}
+	for _, target := range grafanaTargets(scopeFrom(r)) {
+		measurement := strings.SplitN(target, ".", 2)[0]
+		var tags []grafanaOption
+		for _, tag := range grafanaTags[measurement] {
+			tags = append(tags, grafanaOption{Label: tag, Value: tag})
+		}
+		metrics = append(metrics, grafanaMetric{
+			Label: target,
+			Value: target,
+			Payloads: []grafanaPayload{
+				{Label: "Aggregate", Name: "aggregate", Type: "select", Options: aggregates},
+				{Label: "Chain ID", Name: "chain_id"},
+				{Label: "Group by", Name: "group_by", Type: "select", Options: tags},
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
+
+// handleGrafanaQuery returns a time series per target, or per value of its
+// group_by tag
+func (s *AnalyticsServer) handleGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var query grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if query.Range.From.IsZero() || !query.Range.To.After(query.Range.From) {
+		http.Error(w, "Invalid range", http.StatusBadRequest)
+		return
+	}
+
+	scope := scopeFrom(r)
+	series := []grafanaSeries{}
+	for _, target := range query.Targets {
+		if target.Hide || target.Target == "" {
+			continue
+		}
+		flux, groupBy, err := s.grafanaFlux(scope, &query, target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		targetSeries, err := s.querySeries(r.Context(), flux, target, groupBy)
+		if err != nil {
+			log.Printf("Grafana query error: %v", err)
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		series = append(series, targetSeries...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// querySeries runs a target's query, returning one series per group in the
+// order InfluxDB returns them
+func (s *AnalyticsServer) querySeries(ctx context.Context, flux string, target grafanaTarget, groupBy string) ([]grafanaSeries, error) {
+	result, err := s.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+
+	series := []grafanaSeries{}
+	index := make(map[string]int)
+	for result.Next() {
+		record := result.Record()
+		value, ok := record.Value().(float64)
+		if !ok {
+			continue
+		}
+
+		name := target.Target
+		if groupBy != "" {
+			name = fmt.Sprintf("%s{%s=%v}", target.Target, groupBy, record.ValueByKey(groupBy))
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(series)
+			index[name] = i
+			series = append(series, grafanaSeries{Target: name, RefID: target.RefID, Datapoints: [][2]float64{}})
+		}
+		series[i].Datapoints = append(series[i].Datapoints, [2]float64{value, float64(record.Time().UnixMilli())})
+	}
+	return series, result.Err()
+}
+
+// grafanaFlux builds the query for a target, aggregated over the request
+// interval or the tier's, whichever is coarser
+func (s *AnalyticsServer) grafanaFlux(scope *Scope, query *grafanaQuery, target grafanaTarget) (string, string, error) {
+	measurement, field, _ := strings.Cut(target.Target, ".")
+	if !containsString(grafanaFields[measurement], field) {
+		return "", "", fmt.Errorf("unknown target %q", target.Target)
+	}
+	if !scope.IsAdmin() && measurement != "payments" {
+		return "", "", fmt.Errorf("merchant tokens can only query payments")
+	}
+
+	aggregate := target.Payload["aggregate"]
+	if aggregate == "" {
+		aggregate = "mean"
+	}
+	if !containsString(grafanaAggregates, aggregate) {
+		return "", "", fmt.Errorf("unknown aggregate %q", aggregate)
+	}
+	groupBy := target.Payload["group_by"]
+	if groupBy != "" && !containsString(grafanaTags[measurement], groupBy) {
+		return "", "", fmt.Errorf("unknown group_by tag %q", groupBy)
+	}
+
+	// retention is relative to now, so the tier depends on how far back the
+	// range starts
+	resolution := s.storage.Resolve(measurement, time.Since(query.Range.From))
+	every := time.Duration(query.IntervalMs) * time.Millisecond
+	if every < resolution.Every {
+		every = resolution.Every
+	}
+	if every < time.Second {
+		every = time.Second
+	}
+
+	flux := fmt.Sprintf(`from(bucket: %q)
+	|> range(start: %s, stop: %s)
+	|> filter(fn: (r) => r._measurement == %q and r._field == %q)`,
+		s.storage.BucketFor(resolution), query.Range.From.UTC().Format(time.RFC3339), query.Range.To.UTC().Format(time.RFC3339),
+		measurement, field)
+	if filter := scope.fluxFilter(); filter != "" {
+		flux += "\n\t" + filter
+	}
+
+	if chainID := target.Payload["chain_id"]; chainID != "" {
+		if _, err := strconv.ParseUint(chainID, 10, 64); err != nil {
+			return "", "", fmt.Errorf("invalid chain_id %q", chainID)
+		}
+		flux += fmt.Sprintf("\n\t|> filter(fn: (r) => r.chain_id == %q)", chainID)
+	}
+
+	columns := ""
+	if groupBy != "" {
+		columns = fmt.Sprintf("%q", groupBy)
+	}
+	flux += fmt.Sprintf(`
+	|> group(columns: [%s])
+	|> toFloat()
+	|> aggregateWindow(every: %dms, fn: %s, createEmpty: false)
+	|> toFloat()`, columns, every.Milliseconds(), aggregate)
+	return flux, groupBy, nil
+}
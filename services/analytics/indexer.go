@@ -0,0 +1,813 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// The indexer turns contract events into metrics, so services do not have to
+// report them. Each chain is polled for PaymentCore, RelayValidator and
+// TrancheVault logs up to Confirmations blocks behind the head. The next
+// block to read is checkpointed in InfluxDB once a range is written, so a
+// restart resumes where it stopped. Every point is timestamped with its
+// block time plus its log index in nanoseconds, so reading a range again
+// rewrites the same points rather than adding new ones.
+
+const paymentCoreABI = `[
+	{"type":"event","name":"PaymentCreated","inputs":[
+		{"name":"id","type":"uint256","indexed":true},
+		{"name":"sender","type":"address","indexed":true},
+		{"name":"recipient","type":"address","indexed":true},
+		{"name":"token","type":"address","indexed":false},
+		{"name":"amount","type":"uint256","indexed":false},
+		{"name":"fee","type":"uint256","indexed":false},
+		{"name":"metadataURI","type":"string","indexed":false},
+		{"name":"senderENS","type":"string","indexed":false},
+		{"name":"recipientENS","type":"string","indexed":false}]},
+	{"type":"event","name":"PaymentCompleted","inputs":[
+		{"name":"id","type":"uint256","indexed":true},
+		{"name":"completer","type":"address","indexed":true}]},
+	{"type":"event","name":"PaymentRefunded","inputs":[
+		{"name":"id","type":"uint256","indexed":true},
+		{"name":"refunder","type":"address","indexed":true}]},
+	{"type":"event","name":"PaymentCancelled","inputs":[
+		{"name":"id","type":"uint256","indexed":true},
+		{"name":"canceller","type":"address","indexed":true}]},
+	{"type":"function","name":"getPayment","stateMutability":"view",
+		"inputs":[{"name":"paymentId","type":"uint256"}],
+		"outputs":[{"name":"","type":"tuple","components":[
+			{"name":"id","type":"uint256"},
+			{"name":"sender","type":"address"},
+			{"name":"recipient","type":"address"},
+			{"name":"token","type":"address"},
+			{"name":"amount","type":"uint256"},
+			{"name":"fee","type":"uint256"},
+			{"name":"status","type":"uint8"},
+			{"name":"createdAt","type":"uint256"},
+			{"name":"completedAt","type":"uint256"},
+			{"name":"metadataURI","type":"string"},
+			{"name":"receiptCID","type":"string"},
+			{"name":"senderENS","type":"string"},
+			{"name":"recipientENS","type":"string"},
+			{"name":"oraclePrice","type":"string"},
+			{"name":"randomSeed","type":"bytes32"},
+			{"name":"validatorRequestId","type":"uint256"},
+			{"name":"requiresValidation","type":"bool"}]}]},
+	{"type":"function","name":"getPaymentCount","stateMutability":"view",
+		"inputs":[],"outputs":[{"name":"","type":"uint256"}]}
+]`
+
+const relayValidatorABI = `[
+	{"type":"event","name":"ValidatorRegistered","inputs":[
+		{"name":"validator","type":"address","indexed":true},
+		{"name":"stake","type":"uint256","indexed":false}]},
+	{"type":"event","name":"ValidatorSlashed","inputs":[
+		{"name":"validator","type":"address","indexed":true},
+		{"name":"slashedAmount","type":"uint256","indexed":false},
+		{"name":"reason","type":"string","indexed":false}]},
+	{"type":"event","name":"ValidatorExited","inputs":[
+		{"name":"validator","type":"address","indexed":true},
+		{"name":"returnedStake","type":"uint256","indexed":false}]},
+	{"type":"event","name":"ValidationSigned","inputs":[
+		{"name":"requestId","type":"uint256","indexed":true},
+		{"name":"validator","type":"address","indexed":true},
+		{"name":"signature","type":"bytes","indexed":false}]},
+	{"type":"event","name":"ValidationCompleted","inputs":[
+		{"name":"requestId","type":"uint256","indexed":true},
+		{"name":"aggregatedSignature","type":"bytes","indexed":false},
+		{"name":"signerCount","type":"uint256","indexed":false}]},
+	{"type":"event","name":"ValidationFailed","inputs":[
+		{"name":"requestId","type":"uint256","indexed":true},
+		{"name":"reason","type":"string","indexed":false}]},
+	{"type":"function","name":"getActiveValidators","stateMutability":"view",
+		"inputs":[],"outputs":[{"name":"","type":"address[]"}]},
+	{"type":"function","name":"getValidationCount","stateMutability":"view",
+		"inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"validatorStakes","stateMutability":"view",
+		"inputs":[{"name":"","type":"address"}],
+		"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"getValidationRequest","stateMutability":"view",
+		"inputs":[{"name":"requestId","type":"uint256"}],
+		"outputs":[{"name":"id","type":"uint256"},{"name":"paymentId","type":"uint256"},{"name":"messageHash","type":"bytes32"},{"name":"requiredSignatures","type":"uint256"},{"name":"receivedSignatures","type":"uint256"},{"name":"status","type":"uint8"},{"name":"createdAt","type":"uint256"},{"name":"deadline","type":"uint256"},{"name":"isHighValue","type":"bool"}]}
+]`
+
+const trancheVaultABI = `[
+	{"type":"event","name":"Deposited","inputs":[
+		{"name":"user","type":"address","indexed":true},
+		{"name":"tranche","type":"uint8","indexed":true},
+		{"name":"amount","type":"uint256","indexed":false},
+		{"name":"shares","type":"uint256","indexed":false}]},
+	{"type":"event","name":"Withdrawn","inputs":[
+		{"name":"user","type":"address","indexed":true},
+		{"name":"tranche","type":"uint8","indexed":true},
+		{"name":"amount","type":"uint256","indexed":false},
+		{"name":"shares","type":"uint256","indexed":false}]},
+	{"type":"event","name":"YieldDistributed","inputs":[
+		{"name":"tranche","type":"uint8","indexed":true},
+		{"name":"totalYield","type":"uint256","indexed":false},
+		{"name":"perTokenYield","type":"uint256","indexed":false}]},
+	{"type":"event","name":"TrancheRebalanced","inputs":[
+		{"name":"tranche","type":"uint8","indexed":true},
+		{"name":"oldBalance","type":"uint256","indexed":false},
+		{"name":"newBalance","type":"uint256","indexed":false}]},
+	{"type":"event","name":"Slashed","inputs":[
+		{"name":"eventId","type":"uint256","indexed":true},
+		{"name":"totalAmount","type":"uint256","indexed":false},
+		{"name":"juniorLoss","type":"uint256","indexed":false},
+		{"name":"mezzanineLoss","type":"uint256","indexed":false},
+		{"name":"seniorLoss","type":"uint256","indexed":false},
+		{"name":"validator","type":"address","indexed":false},
+		{"name":"reason","type":"string","indexed":false}]},
+	{"type":"function","name":"getVaultMetrics","stateMutability":"view","inputs":[],
+		"outputs":[{"name":"totalAssets","type":"uint256"},{"name":"juniorTVL","type":"uint256"},{"name":"mezzanineTVL","type":"uint256"},{"name":"seniorTVL","type":"uint256"},{"name":"insuranceBalance","type":"uint256"},{"name":"totalSlashingEvents","type":"uint256"}]},
+	{"type":"function","name":"getTrancheAPY","stateMutability":"view",
+		"inputs":[{"name":"tranche","type":"uint8"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"getTrancheRisk","stateMutability":"view",
+		"inputs":[{"name":"tranche","type":"uint8"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"getTrancheUtilization","stateMutability":"view",
+		"inputs":[{"name":"tranche","type":"uint8"}],"outputs":[{"name":"","type":"uint256"}]}
+]`
+
+var (
+	paymentCoreContract    = mustParseABI(paymentCoreABI)
+	relayValidatorContract = mustParseABI(relayValidatorABI)
+	trancheVaultContract   = mustParseABI(trancheVaultABI)
+)
+
+// trancheNames are the TrancheVault.TrancheType values in order
+var trancheNames = []string{"junior", "mezzanine", "senior"}
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// IndexedChain lists the contracts indexed on one chain. PaymentCore is
+// needed to report validation results as payment metrics. FinalityBlocks is
+// how far behind the head blocks are final on chains without the finalized
+// block tag.
+type IndexedChain struct {
+	ChainID        uint64   `json:"chain_id"`
+	RPCURL         string   `json:"rpc_url"`
+	PaymentCore    string   `json:"payment_core,omitempty"`
+	RelayValidator string   `json:"relay_validator,omitempty"`
+	Vaults         []string `json:"vaults,omitempty"`
+	StartBlock     uint64   `json:"start_block,omitempty"`
+	Confirmations  uint64   `json:"confirmations,omitempty"`
+	FinalityBlocks uint64   `json:"finality_blocks,omitempty"`
+}
+
+// IndexerConfig configures the chains indexed and how they are polled
+type IndexerConfig struct {
+	Chains        []IndexedChain `json:"chains"`
+	PollInterval  Duration       `json:"poll_interval,omitempty"`
+	StateInterval Duration       `json:"state_interval,omitempty"`
+	MaxBlockRange uint64         `json:"max_block_range,omitempty"`
+}
+
+// LoadIndexerConfig reads the chains to index from the JSON file at path,
+// INDEXER_CONFIG_PATH. It returns nil when the indexer is not configured.
+func LoadIndexerConfig(path string) (*IndexerConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg IndexerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = Duration(12 * time.Second)
+	}
+	if cfg.StateInterval <= 0 {
+		cfg.StateInterval = Duration(time.Minute)
+	}
+	if cfg.MaxBlockRange == 0 {
+		cfg.MaxBlockRange = 1000
+	}
+	for i, chain := range cfg.Chains {
+		if chain.ChainID == 0 || chain.RPCURL == "" {
+			return nil, fmt.Errorf("chain %d: chain_id and rpc_url are required", i)
+		}
+		for _, address := range append([]string{chain.PaymentCore, chain.RelayValidator}, chain.Vaults...) {
+			if address != "" && !common.IsHexAddress(address) {
+				return nil, fmt.Errorf("chain %d: invalid address %q", chain.ChainID, address)
+			}
+		}
+		if chain.Confirmations == 0 {
+			cfg.Chains[i].Confirmations = 12
+		}
+		if chain.FinalityBlocks == 0 {
+			cfg.Chains[i].FinalityBlocks = 64
+		}
+	}
+	return &cfg, nil
+}
+
+// indexedMetric is a point to write and how to announce it once written.
+// payment is set for payment points, to be marked if a reorg replaces them.
+type indexedMetric struct {
+	point    *write.Point
+	announce func()
+	payment  *PaymentMetric
+}
+
+// chainIndexer indexes the contracts of one chain
+type chainIndexer struct {
+	server         *AnalyticsServer
+	chain          IndexedChain
+	maxRange       uint64
+	client         *ethclient.Client
+	paymentCore    *bind.BoundContract
+	relayValidator *bind.BoundContract
+	vaults         map[common.Address]*bind.BoundContract
+	addresses      []common.Address
+	head           uint64
+	nextBlock      uint64
+	finalized      uint64
+	blocks         []indexedBlock
+	blockTimes     map[uint64]time.Time
+	state          ChainState
+	stateMutex     sync.RWMutex
+}
+
+// Indexer indexes every configured chain
+type Indexer struct {
+	config *IndexerConfig
+	chains []*chainIndexer
+}
+
+// NewIndexer sets up the indexing of each chain. Chains connect to their
+// RPC endpoint when they start, and keep retrying while it is down.
+func NewIndexer(cfg *IndexerConfig, server *AnalyticsServer) *Indexer {
+	indexer := &Indexer{config: cfg}
+	for _, chain := range cfg.Chains {
+		c := &chainIndexer{
+			server:   server,
+			chain:    chain,
+			maxRange: cfg.MaxBlockRange,
+			state:    ChainState{ChainID: chain.ChainID},
+		}
+		if chain.PaymentCore != "" {
+			c.addresses = append(c.addresses, common.HexToAddress(chain.PaymentCore))
+		}
+		if chain.RelayValidator != "" {
+			c.addresses = append(c.addresses, common.HexToAddress(chain.RelayValidator))
+		}
+		for _, vault := range chain.Vaults {
+			c.addresses = append(c.addresses, common.HexToAddress(vault))
+		}
+		indexer.chains = append(indexer.chains, c)
+	}
+	return indexer
+}
+
+// Run indexes every chain until ctx is done
+func (i *Indexer) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, chain := range i.chains {
+		wg.Add(1)
+		go func(chain *chainIndexer) {
+			defer wg.Done()
+			chain.run(ctx, time.Duration(i.config.PollInterval), time.Duration(i.config.StateInterval))
+		}(chain)
+	}
+	wg.Wait()
+}
+
+// connect dials the chain's RPC endpoint and binds its contracts
+func (c *chainIndexer) connect(ctx context.Context) error {
+	client, err := ethclient.DialContext(ctx, c.chain.RPCURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+
+	c.client = client
+	c.vaults = make(map[common.Address]*bind.BoundContract)
+	if c.chain.PaymentCore != "" {
+		c.paymentCore = bind.NewBoundContract(common.HexToAddress(c.chain.PaymentCore), paymentCoreContract, client, nil, nil)
+	}
+	if c.chain.RelayValidator != "" {
+		c.relayValidator = bind.NewBoundContract(common.HexToAddress(c.chain.RelayValidator), relayValidatorContract, client, nil, nil)
+	}
+	for _, vault := range c.chain.Vaults {
+		address := common.HexToAddress(vault)
+		c.vaults[address] = bind.NewBoundContract(address, trancheVaultContract, client, nil, nil)
+	}
+	return nil
+}
+
+// run indexes the chain every interval and reads its contract state every
+// stateInterval. While the RPC endpoint fails, it retries with exponential
+// backoff, reconnecting after repeated failures, and the last state read is
+// kept and marked unhealthy.
+func (c *chainIndexer) run(ctx context.Context, interval, stateInterval time.Duration) {
+	log.Printf("Indexing %d contracts on chain %d", len(c.addresses), c.chain.ChainID)
+	defer func() {
+		if c.client != nil {
+			c.client.Close()
+		}
+	}()
+
+	var stateReadAt time.Time
+	for {
+		var err error
+		if c.client == nil {
+			err = c.connect(ctx)
+		}
+		if err == nil {
+			err = c.poll(ctx)
+		}
+		if err == nil && time.Since(stateReadAt) >= stateInterval {
+			if err = c.refreshState(ctx); err == nil {
+				stateReadAt = time.Now()
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		failures := c.recordResult(err)
+		wait := interval
+		if err != nil {
+			log.Printf("Failed to index chain %d (attempt %d): %v", c.chain.ChainID, failures, err)
+			wait = indexerBackoff(interval, failures)
+			if failures%indexerReconnectAfter == 0 && c.client != nil {
+				c.client.Close()
+				c.client = nil
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll indexes the confirmed blocks not yet read, one range at a time,
+// checkpointing after each
+func (c *chainIndexer) poll(ctx context.Context) error {
+	head, err := c.client.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get block number: %w", err)
+	}
+	c.head = head
+	if head < c.chain.Confirmations {
+		return nil
+	}
+	safe := head - c.chain.Confirmations
+
+	if c.nextBlock == 0 {
+		var parent common.Hash
+		if c.nextBlock, parent, err = c.checkpoint(ctx); err != nil {
+			return err
+		}
+		if c.nextBlock > 0 && parent != (common.Hash{}) {
+			c.rememberBlock(c.nextBlock-1, parent)
+		}
+		if c.nextBlock == 0 {
+			c.nextBlock = c.chain.StartBlock
+		}
+		if c.nextBlock == 0 {
+			c.nextBlock = safe + 1
+		}
+		log.Printf("Indexing chain %d from block %d", c.chain.ChainID, c.nextBlock)
+	}
+
+	if err := c.checkReorg(ctx); err != nil {
+		return err
+	}
+
+	for c.nextBlock <= safe {
+		to := c.nextBlock + c.maxRange - 1
+		if to > safe {
+			to = safe
+		}
+		if err := c.index(ctx, c.nextBlock, to); err != nil {
+			return err
+		}
+		hash, err := c.rememberRangeEnd(ctx, to)
+		if err != nil {
+			return err
+		}
+		if err := c.saveCheckpoint(ctx, to+1, hash); err != nil {
+			return err
+		}
+		c.nextBlock = to + 1
+	}
+	return nil
+}
+
+// index writes the metrics of every log in [from, to], then announces them
+// and remembers the blocks they came from
+func (c *chainIndexer) index(ctx context.Context, from, to uint64) error {
+	logs, err := c.client.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(from),
+		ToBlock:   new(big.Int).SetUint64(to),
+		Addresses: c.addresses,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to filter logs %d-%d: %w", from, to, err)
+	}
+
+	c.blockTimes = make(map[uint64]time.Time)
+	var metrics []indexedMetric
+	var indexed []types.Log
+	var decodedByLog [][]indexedMetric
+	for _, entry := range logs {
+		if entry.Removed || len(entry.Topics) == 0 {
+			continue
+		}
+		decoded, err := c.decode(ctx, entry)
+		if err != nil {
+			return fmt.Errorf("failed to index log %d in block %d: %w", entry.Index, entry.BlockNumber, err)
+		}
+		if len(decoded) > 0 {
+			metrics = append(metrics, decoded...)
+			indexed = append(indexed, entry)
+			decodedByLog = append(decodedByLog, decoded)
+		}
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	points := make([]*write.Point, len(metrics))
+	for i, metric := range metrics {
+		points[i] = metric.point
+	}
+	if err := c.server.writer.WritePoint(ctx, points...); err != nil {
+		return err
+	}
+	for _, metric := range metrics {
+		metric.announce()
+	}
+	for i, entry := range indexed {
+		c.remember(entry, c.blockTimes[entry.BlockNumber].Add(time.Duration(entry.Index)), decodedByLog[i])
+	}
+	return nil
+}
+
+// decode turns a log into the metrics it implies. Logs of events the
+// indexer does not track produce none.
+func (c *chainIndexer) decode(ctx context.Context, entry types.Log) ([]indexedMetric, error) {
+	var contract abi.ABI
+	switch {
+	case c.paymentCore != nil && entry.Address == common.HexToAddress(c.chain.PaymentCore):
+		contract = paymentCoreContract
+	case c.relayValidator != nil && entry.Address == common.HexToAddress(c.chain.RelayValidator):
+		contract = relayValidatorContract
+	case c.vaults[entry.Address] != nil:
+		contract = trancheVaultContract
+	default:
+		return nil, nil
+	}
+
+	event, err := contract.EventByID(entry.Topics[0])
+	if err != nil {
+		return nil, nil
+	}
+	fields := make(map[string]interface{})
+	if err := abi.ParseTopicsIntoMap(fields, indexedArgs(event.Inputs), entry.Topics[1:]); err != nil {
+		return nil, err
+	}
+	if len(entry.Data) > 0 {
+		if err := contract.UnpackIntoMap(fields, event.Name, entry.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	at, err := c.blockTime(ctx, entry.BlockNumber)
+	if err != nil {
+		return nil, err
+	}
+	// distinct per log, and the same each time the log is read
+	at = at.Add(time.Duration(entry.Index))
+	opts := &bind.CallOpts{Context: ctx, BlockNumber: new(big.Int).SetUint64(entry.BlockNumber)}
+
+	switch event.Name {
+	case "PaymentCreated":
+		return c.paymentMetric(ctx, PaymentMetric{
+			PaymentID: fields["id"].(*big.Int).Uint64(),
+			ChainID:   c.chain.ChainID,
+			Sender:    fields["sender"].(common.Address).Hex(),
+			Recipient: fields["recipient"].(common.Address).Hex(),
+			Token:     fields["token"].(common.Address).Hex(),
+			Amount:    fields["amount"].(*big.Int).String(),
+			Fee:       fields["fee"].(*big.Int).String(),
+			Status:    "pending",
+			Timestamp: at,
+		}), nil
+	case "PaymentCompleted", "PaymentRefunded", "PaymentCancelled":
+		metric, err := c.payment(opts, fields["id"].(*big.Int), at)
+		if err != nil {
+			return nil, err
+		}
+		metric.Status = strings.ToLower(strings.TrimPrefix(event.Name, "Payment"))
+		if metric.Status == "completed" {
+			metric.ProcessingTime = at.Sub(metric.createdAt).Milliseconds()
+		}
+		return c.paymentMetric(ctx, metric.PaymentMetric), nil
+	case "ValidationCompleted", "ValidationFailed":
+		return c.validationResult(opts, event.Name, fields, at)
+	case "ValidationSigned":
+		validator := fields["validator"].(common.Address)
+		request, err := c.validationRequest(opts, fields["requestId"].(*big.Int))
+		if err != nil {
+			return nil, err
+		}
+		return c.validatorMetric(opts, validator, "active", "signed", at.Sub(request.createdAt).Milliseconds(), at)
+	case "ValidatorRegistered":
+		return c.validatorMetric(opts, fields["validator"].(common.Address), "active", "registered", 0, at)
+	case "ValidatorSlashed":
+		return c.validatorMetric(opts, fields["validator"].(common.Address), "slashed", "slashed", 0, at)
+	case "ValidatorExited":
+		return c.validatorMetric(opts, fields["validator"].(common.Address), "exited", "exited", 0, at)
+	case "Deposited", "Withdrawn", "YieldDistributed", "TrancheRebalanced":
+		return c.vaultMetrics(opts, entry.Address, []uint8{fields["tranche"].(uint8)}, nil, at)
+	case "Slashed":
+		losses := []*big.Int{fields["juniorLoss"].(*big.Int), fields["mezzanineLoss"].(*big.Int), fields["seniorLoss"].(*big.Int)}
+		return c.vaultMetrics(opts, entry.Address, []uint8{0, 1, 2}, losses, at)
+	}
+	return nil, nil
+}
+
+// validationResult reports the payment a validation request was for as
+// validated or failed. It needs PaymentCore to look the payment up.
+func (c *chainIndexer) validationResult(opts *bind.CallOpts, eventName string, fields map[string]interface{}, at time.Time) ([]indexedMetric, error) {
+	if c.paymentCore == nil {
+		return nil, nil
+	}
+	request, err := c.validationRequest(opts, fields["requestId"].(*big.Int))
+	if err != nil {
+		return nil, err
+	}
+	metric, err := c.payment(opts, request.paymentID, at)
+	if err != nil {
+		return nil, err
+	}
+
+	metric.Status = "failed"
+	metric.RequiredSigs = uint32(request.requiredSignatures)
+	metric.ReceivedSigs = uint32(request.receivedSignatures)
+	if eventName == "ValidationCompleted" {
+		metric.Status = "validated"
+		metric.ReceivedSigs = uint32(fields["signerCount"].(*big.Int).Uint64())
+	}
+	return c.paymentMetric(opts.Context, metric.PaymentMetric), nil
+}
+
+// paymentMetric prices a payment in USD at its block time and builds its
+// point
+func (c *chainIndexer) paymentMetric(ctx context.Context, metric PaymentMetric) []indexedMetric {
+	c.server.fx.Enrich(ctx, &metric)
+	return []indexedMetric{{
+		point:    paymentPoint(&metric),
+		announce: func() { c.server.announcePayment(metric) },
+		payment:  &metric,
+	}}
+}
+
+// validatorMetric reports a validator's stake as of the event's block
+func (c *chainIndexer) validatorMetric(opts *bind.CallOpts, validator common.Address, status, event string, responseTime int64, at time.Time) ([]indexedMetric, error) {
+	stake, err := callUint(c.relayValidator, opts, "validatorStakes", validator)
+	if err != nil {
+		return nil, err
+	}
+
+	metric := ValidatorMetric{
+		ValidatorAddr: validator.Hex(),
+		ChainID:       c.chain.ChainID,
+		Stake:         stake.String(),
+		Status:        status,
+		Event:         event,
+		ResponseTime:  responseTime,
+		Timestamp:     at,
+	}
+	return []indexedMetric{{
+		point:    validatorPoint(metric),
+		announce: func() { c.server.announceValidator(metric) },
+	}}, nil
+}
+
+// vaultMetrics reports the state of a vault's tranches as of the event's
+// block. APY, utilization and risk are read in basis points. losses, if
+// set, are what a slashing took from each tranche.
+func (c *chainIndexer) vaultMetrics(opts *bind.CallOpts, address common.Address, tranches []uint8, losses []*big.Int, at time.Time) ([]indexedMetric, error) {
+	vault := c.vaults[address]
+
+	var totals []interface{}
+	if err := vault.Call(opts, &totals, "getVaultMetrics"); err != nil {
+		return nil, fmt.Errorf("getVaultMetrics: %w", err)
+	}
+
+	var metrics []indexedMetric
+	for _, tranche := range tranches {
+		if int(tranche) >= len(trancheNames) {
+			continue
+		}
+		apy, err := callUint(vault, opts, "getTrancheAPY", tranche)
+		if err != nil {
+			return nil, err
+		}
+		risk, err := callUint(vault, opts, "getTrancheRisk", tranche)
+		if err != nil {
+			return nil, err
+		}
+		utilization, err := callUint(vault, opts, "getTrancheUtilization", tranche)
+		if err != nil {
+			return nil, err
+		}
+
+		metric := VaultMetric{
+			VaultAddress:   address.Hex(),
+			ChainID:        c.chain.ChainID,
+			TrancheType:    trancheNames[tranche],
+			TotalAssets:    totals[1+int(tranche)].(*big.Int).String(),
+			UtilizationPct: float64(utilization.Uint64()) / 100,
+			APY:            float64(apy.Uint64()) / 100,
+			RiskScore:      float64(risk.Uint64()) / 100,
+			SlashingEvents: totals[5].(*big.Int).Uint64(),
+			Timestamp:      at,
+		}
+		if losses != nil {
+			metric.SlashLoss = losses[tranche].String()
+		}
+		metrics = append(metrics, indexedMetric{
+			point:    vaultPoint(metric),
+			announce: func() { c.server.announceVault(metric) },
+		})
+	}
+	return metrics, nil
+}
+
+// onchainPayment is the PaymentCore.getPayment tuple
+type onchainPayment struct {
+	Id                 *big.Int
+	Sender             common.Address
+	Recipient          common.Address
+	Token              common.Address
+	Amount             *big.Int
+	Fee                *big.Int
+	Status             uint8
+	CreatedAt          *big.Int
+	CompletedAt        *big.Int
+	MetadataURI        string
+	ReceiptCID         string
+	SenderENS          string
+	RecipientENS       string
+	OraclePrice        string
+	RandomSeed         [32]byte
+	ValidatorRequestId *big.Int
+	RequiresValidation bool
+}
+
+type indexedPayment struct {
+	PaymentMetric
+	createdAt time.Time
+}
+
+// payment reads a payment from PaymentCore to fill in a metric for an event
+// that only carries its ID
+func (c *chainIndexer) payment(opts *bind.CallOpts, id *big.Int, at time.Time) (*indexedPayment, error) {
+	var out []interface{}
+	if err := c.paymentCore.Call(opts, &out, "getPayment", id); err != nil {
+		return nil, fmt.Errorf("getPayment(%s): %w", id, err)
+	}
+	payment := abi.ConvertType(out[0], new(onchainPayment)).(*onchainPayment)
+
+	return &indexedPayment{
+		PaymentMetric: PaymentMetric{
+			PaymentID: id.Uint64(),
+			ChainID:   c.chain.ChainID,
+			Sender:    payment.Sender.Hex(),
+			Recipient: payment.Recipient.Hex(),
+			Token:     payment.Token.Hex(),
+			Amount:    payment.Amount.String(),
+			Fee:       payment.Fee.String(),
+			Timestamp: at,
+		},
+		createdAt: time.Unix(payment.CreatedAt.Int64(), 0),
+	}, nil
+}
+
+type validationRequest struct {
+	paymentID          *big.Int
+	requiredSignatures uint64
+	receivedSignatures uint64
+	createdAt          time.Time
+}
+
+func (c *chainIndexer) validationRequest(opts *bind.CallOpts, requestID *big.Int) (*validationRequest, error) {
+	var out []interface{}
+	if err := c.relayValidator.Call(opts, &out, "getValidationRequest", requestID); err != nil {
+		return nil, fmt.Errorf("getValidationRequest(%s): %w", requestID, err)
+	}
+	return &validationRequest{
+		paymentID:          out[1].(*big.Int),
+		requiredSignatures: out[3].(*big.Int).Uint64(),
+		receivedSignatures: out[4].(*big.Int).Uint64(),
+		createdAt:          time.Unix(out[6].(*big.Int).Int64(), 0),
+	}, nil
+}
+
+func (c *chainIndexer) blockTime(ctx context.Context, number uint64) (time.Time, error) {
+	if at, ok := c.blockTimes[number]; ok {
+		return at, nil
+	}
+	header, err := c.client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get block %d: %w", number, err)
+	}
+	at := time.Unix(int64(header.Time), 0).UTC()
+	c.blockTimes[number] = at
+	return at, nil
+}
+
+// checkpoint returns the next block to index recorded for the chain, or 0,
+// and the hash the block before it had when it was indexed, if recorded
+func (c *chainIndexer) checkpoint(ctx context.Context) (uint64, common.Hash, error) {
+	flux := fmt.Sprintf(`from(bucket: %q)
+	|> range(start: 0)
+	|> filter(fn: (r) => r._measurement == "indexer_checkpoints" and r.chain_id == %q)
+	|> filter(fn: (r) => r._field == "next_block" or r._field == "parent_hash")
+	|> last()`, c.server.storage.bucket, strconv.FormatUint(c.chain.ChainID, 10))
+
+	result, err := c.server.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return 0, common.Hash{}, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var next uint64
+	var parent common.Hash
+	for result.Next() {
+		record := result.Record()
+		switch record.Field() {
+		case "next_block":
+			next = uintValue(record.Value())
+		case "parent_hash":
+			if hash, ok := record.Value().(string); ok && hash != "" {
+				parent = common.HexToHash(hash)
+			}
+		}
+	}
+	return next, parent, result.Err()
+}
+
+// saveCheckpoint records the next block to index and, when known, the hash
+// of the block before it, so a reorg while the service is down is noticed
+func (c *chainIndexer) saveCheckpoint(ctx context.Context, next uint64, parent common.Hash) error {
+	point := write.NewPointWithMeasurement("indexer_checkpoints").
+		AddTag("chain_id", strconv.FormatUint(c.chain.ChainID, 10)).
+		AddField("next_block", next).
+		SetTime(time.Now())
+	if parent != (common.Hash{}) {
+		point.AddField("parent_hash", parent.Hex())
+	}
+	if err := c.server.writer.WritePoint(ctx, point); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+func callUint(contract *bind.BoundContract, opts *bind.CallOpts, method string, args ...interface{}) (*big.Int, error) {
+	var out []interface{}
+	if err := contract.Call(opts, &out, method, args...); err != nil {
+		return nil, fmt.Errorf("%s: %w", method, err)
+	}
+	return out[0].(*big.Int), nil
+}
+
+func indexedArgs(inputs abi.Arguments) abi.Arguments {
+	var indexed abi.Arguments
+	for _, input := range inputs {
+		if input.Indexed {
+			indexed = append(indexed, input)
+		}
+	}
+	return indexed
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChain serves the JSON-RPC methods the indexer calls for a chain of
+// empty blocks. reorg replaces blocks, and getLogs records the ranges read.
+type fakeChain struct {
+	mu        sync.Mutex
+	head      uint64
+	finalized *uint64
+	reorgs    []uint64
+	ranges    [][2]uint64
+}
+
+// header returns block number of the current chain. Each reorg from a block
+// changes it and, through the parent hashes, every block after it.
+func (c *fakeChain) header(number uint64) *types.Header {
+	var version byte
+	for _, from := range c.reorgs {
+		if number >= from {
+			version++
+		}
+	}
+	header := &types.Header{
+		Number:     new(big.Int).SetUint64(number),
+		Time:       1_700_000_000 + 12*number,
+		Difficulty: new(big.Int),
+		Extra:      []byte{version},
+	}
+	if number > 0 {
+		header.ParentHash = c.header(number - 1).Hash()
+	}
+	return header
+}
+
+// hash returns the hash of block number of the current chain
+func (c *fakeChain) hash(number uint64) common.Hash {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.header(number).Hash()
+}
+
+// reorg replaces the blocks from number on
+func (c *fakeChain) reorg(number uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reorgs = append(c.reorgs, number)
+}
+
+// read returns the block ranges logs were read for
+func (c *fakeChain) read() [][2]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][2]uint64(nil), c.ranges...)
+}
+
+func (c *fakeChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var request struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+
+	switch request.Method {
+	case "eth_blockNumber":
+		response["result"] = hexutil.Uint64(c.head)
+	case "eth_getBlockByNumber":
+		var tag string
+		json.Unmarshal(request.Params[0], &tag)
+		switch tag {
+		case "finalized":
+			if c.finalized == nil {
+				response["error"] = map[string]interface{}{"code": -32000, "message": "finalized block not found"}
+			} else {
+				response["result"] = c.header(*c.finalized)
+			}
+		case "latest":
+			response["result"] = c.header(c.head)
+		default:
+			number, err := hexutil.DecodeUint64(tag)
+			if err != nil || number > c.head {
+				response["result"] = nil
+			} else {
+				response["result"] = c.header(number)
+			}
+		}
+	case "eth_getLogs":
+		var filter struct {
+			FromBlock hexutil.Uint64 `json:"fromBlock"`
+			ToBlock   hexutil.Uint64 `json:"toBlock"`
+		}
+		json.Unmarshal(request.Params[0], &filter)
+		c.ranges = append(c.ranges, [2]uint64{uint64(filter.FromBlock), uint64(filter.ToBlock)})
+		response["result"] = []types.Log{}
+	default:
+		response["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// newTestChainIndexer connects an indexer for chain to a fake chain and a
+// fake InfluxDB
+func newTestChainIndexer(t *testing.T, fake *fakeChain, chain IndexedChain, maxRange uint64) (*chainIndexer, *fakeInflux) {
+	rpcServer := httptest.NewServer(fake)
+	t.Cleanup(rpcServer.Close)
+	influx, client := newFakeInflux(t)
+
+	server := &AnalyticsServer{
+		writer:        &MetricWriter{influx: client.WriteAPIBlocking("crosspay", "analytics"), mode: StorageInflux},
+		storage:       NewStorage(client, "crosspay", "analytics"),
+		queryAPI:      client.QueryAPI("crosspay"),
+		paymentStream: make(chan PaymentMetric, 16),
+		broadcasts:    make(chan wsEvent, 16),
+	}
+	chain.ChainID = 4202
+	chain.RPCURL = rpcServer.URL
+	c := NewIndexer(&IndexerConfig{Chains: []IndexedChain{chain}, MaxBlockRange: maxRange}, server).chains[0]
+	require.NoError(t, c.connect(context.Background()))
+	t.Cleanup(c.client.Close)
+	return c, influx
+}
+
+func TestChainIndexerPoll(t *testing.T) {
+	t.Run("should only read blocks past the confirmation depth", func(t *testing.T) {
+		for _, tc := range []struct {
+			name          string
+			head          uint64
+			confirmations uint64
+			startBlock    uint64
+			maxRange      uint64
+			ranges        [][2]uint64
+			next          uint64
+		}{
+			{name: "head within the depth", head: 10, confirmations: 12, startBlock: 1},
+			{name: "one range", head: 100, confirmations: 12, startBlock: 80, maxRange: 100, ranges: [][2]uint64{{80, 88}}, next: 89},
+			{name: "ranges of at most the max range", head: 100, confirmations: 12, startBlock: 80, maxRange: 5, ranges: [][2]uint64{{80, 84}, {85, 88}}, next: 89},
+			{name: "start block not yet confirmed", head: 100, confirmations: 12, startBlock: 95, maxRange: 100, next: 95},
+			{name: "no start block", head: 100, confirmations: 12, maxRange: 100, next: 89},
+			{name: "no confirmations", head: 100, startBlock: 100, maxRange: 100, ranges: [][2]uint64{{100, 100}}, next: 101},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				fake := &fakeChain{head: tc.head}
+				c, influx := newTestChainIndexer(t, fake, IndexedChain{
+					StartBlock:     tc.startBlock,
+					Confirmations:  tc.confirmations,
+					FinalityBlocks: 64,
+				}, tc.maxRange)
+
+				require.NoError(t, c.poll(context.Background()))
+				assert.Equal(t, tc.ranges, fake.read())
+				assert.Equal(t, tc.next, c.nextBlock)
+				assert.Len(t, influx.written("indexer_checkpoints"), len(tc.ranges))
+			})
+		}
+	})
+
+	t.Run("should read new blocks once they are confirmed", func(t *testing.T) {
+		fake := &fakeChain{head: 100}
+		c, influx := newTestChainIndexer(t, fake, IndexedChain{StartBlock: 80, Confirmations: 12, FinalityBlocks: 64}, 100)
+
+		require.NoError(t, c.poll(context.Background()))
+		require.NoError(t, c.poll(context.Background()))
+		fake.head = 103
+		require.NoError(t, c.poll(context.Background()))
+
+		assert.Equal(t, [][2]uint64{{80, 88}, {89, 91}}, fake.read())
+		checkpoints := influx.written("indexer_checkpoints")
+		require.Len(t, checkpoints, 2)
+		assert.Contains(t, checkpoints[1], "next_block=92u")
+		assert.Contains(t, checkpoints[1], `parent_hash="`+fake.hash(91).Hex()+`"`)
+	})
+
+	t.Run("should resume from the checkpoint after a restart", func(t *testing.T) {
+		for _, tc := range []struct {
+			name   string
+			reorg  uint64
+			ranges [][2]uint64
+			reorgs int
+		}{
+			{name: "chain unchanged", ranges: [][2]uint64{{90, 95}}},
+			{name: "checkpointed block replaced while down", reorg: 85, ranges: [][2]uint64{{81, 95}}, reorgs: 1},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				finalized := uint64(80)
+				fake := &fakeChain{head: 100, finalized: &finalized}
+				parent := fake.hash(89)
+				if tc.reorg > 0 {
+					fake.reorg(tc.reorg)
+				}
+				c, influx := newTestChainIndexer(t, fake, IndexedChain{StartBlock: 10, Confirmations: 5, FinalityBlocks: 64}, 100)
+				influx.query = func(flux string) []fluxRecord {
+					return []fluxRecord{
+						{"_field": "next_block", "_value": uint64(90)},
+						{"_field": "parent_hash", "_value": parent.Hex()},
+					}
+				}
+
+				require.NoError(t, c.poll(context.Background()))
+				assert.Equal(t, tc.ranges, fake.read())
+				assert.Equal(t, uint64(96), c.nextBlock)
+				assert.Len(t, influx.written("indexer_reorgs"), tc.reorgs)
+				assert.Equal(t, tc.reorgs, c.state.Reorgs)
+			})
+		}
+	})
+}
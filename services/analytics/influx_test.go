@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// fluxRecord is a row a fakeInflux query answers with, by column
+type fluxRecord map[string]interface{}
+
+// influxDelete is a delete request fakeInflux received
+type influxDelete struct {
+	Start     time.Time `json:"start"`
+	Stop      time.Time `json:"stop"`
+	Predicate string    `json:"predicate"`
+}
+
+// fakeInflux serves the InfluxDB write, delete and query APIs. It records
+// the lines written and the deletes made, and answers queries with the
+// records query returns.
+type fakeInflux struct {
+	mu      sync.Mutex
+	lines   []string
+	deletes []influxDelete
+	queries []string
+	query   func(flux string) []fluxRecord
+}
+
+// newFakeInflux starts a fakeInflux and returns a client for it
+func newFakeInflux(t *testing.T) (*fakeInflux, influxdb2.Client) {
+	fake := &fakeInflux{}
+	server := httptest.NewServer(fake)
+	client := influxdb2.NewClient(server.URL, "token")
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return fake, client
+}
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/api/v2/write":
+		body, _ := io.ReadAll(r.Body)
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if line != "" {
+				f.lines = append(f.lines, line)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/v2/delete":
+		var request influxDelete
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.deletes = append(f.deletes, request)
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/v2/query":
+		var request struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.queries = append(f.queries, request.Query)
+		var records []fluxRecord
+		if f.query != nil {
+			records = f.query(request.Query)
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		io.WriteString(w, annotatedCSV(records))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// written returns the lines written to measurement
+func (f *fakeInflux) written(measurement string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var lines []string
+	for _, line := range f.lines {
+		if strings.HasPrefix(line, measurement+",") || strings.HasPrefix(line, measurement+" ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// deleted returns the deletes made so far
+func (f *fakeInflux) deleted() []influxDelete {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]influxDelete(nil), f.deletes...)
+}
+
+// annotatedCSV encodes records as a Flux query result, one table per
+// record so each can have its own columns and types. A record's "result"
+// names the yield it belongs to, _result without it.
+func annotatedCSV(records []fluxRecord) string {
+	var out strings.Builder
+	for i, record := range records {
+		columns := make([]string, 0, len(record))
+		for column := range record {
+			if column != "result" {
+				columns = append(columns, column)
+			}
+		}
+		sort.Strings(columns)
+
+		result, _ := record["result"].(string)
+		types, groups, defaults, names, values := []string{"#datatype", "string", "long"}, []string{"#group", "false", "false"},
+			[]string{"#default", "_result", ""}, []string{"", "result", "table"}, []string{"", result, fmt.Sprint(i)}
+		for _, column := range columns {
+			datatype, value := fluxValue(record[column])
+			types = append(types, datatype)
+			groups = append(groups, "false")
+			defaults = append(defaults, "")
+			names = append(names, column)
+			values = append(values, value)
+		}
+		writer := csv.NewWriter(&out)
+		writer.WriteAll([][]string{types, groups, defaults, names, values})
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// fluxValue returns the annotated CSV type and encoding of value
+func fluxValue(value interface{}) (string, string) {
+	switch v := value.(type) {
+	case time.Time:
+		return "dateTime:RFC3339Nano", v.UTC().Format(time.RFC3339Nano)
+	case uint64:
+		return "unsignedLong", fmt.Sprint(v)
+	case int, int64:
+		return "long", fmt.Sprint(v)
+	case float64:
+		return "double", fmt.Sprint(v)
+	case bool:
+		return "boolean", fmt.Sprint(v)
+	default:
+		return "string", fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Metrics POSTed to /api/metrics/* are buffered instead of written one
+// point per request. The buffer is flushed in batches of INGEST_BATCH_SIZE,
+// or every INGEST_FLUSH_INTERVAL when fewer are waiting. A batch that fails
+// is retried with backoff, and one that still fails is spilled to a file in
+// INGEST_SPILL_DIR and replayed once writes succeed again, so an InfluxDB
+// outage delays metrics instead of dropping them. POSTs are answered with
+// 503 only when the buffer is full.
+
+var errIngestBufferFull = errors.New("ingest buffer is full")
+
+// ingestRetryDelay is the backoff before a failed batch's first retry. It
+// doubles with each retry.
+const ingestRetryDelay = 500 * time.Millisecond
+
+// ingestReplayFiles bounds the spill files replayed per flush, so a long
+// backlog does not hold up newly buffered points
+const ingestReplayFiles = 10
+
+// pointWriter is where the buffer writes batches and replays spilled lines
+type pointWriter interface {
+	WritePoint(ctx context.Context, points ...*write.Point) error
+	WriteLines(ctx context.Context, lines ...string) error
+}
+
+// IngestStats is the state of the ingest buffer
+type IngestStats struct {
+	Buffered int `json:"buffered"`
+	Capacity int `json:"capacity"`
+	// SpilledPoints are on disk waiting for InfluxDB, in SpilledBatches files
+	SpilledPoints  int        `json:"spilled_points"`
+	SpilledBatches int        `json:"spilled_batches"`
+	Written        uint64     `json:"written"`
+	Retries        uint64     `json:"retries"`
+	Dropped        uint64     `json:"dropped"`
+	Rejected       uint64     `json:"rejected"`
+	Invalid        uint64     `json:"invalid"`
+	LastFlushAt    *time.Time `json:"last_flush_at,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// IngestBuffer batches metric writes behind the ingestion endpoints
+type IngestBuffer struct {
+	writer        pointWriter
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	spillDir      string
+
+	mu      sync.Mutex
+	pending []*write.Point
+	stats   IngestStats
+	spillID int
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewIngestBuffer returns a buffer in front of writer, counting the points
+// already spilled by a previous run
+func NewIngestBuffer(writer pointWriter, cfg *Config) (*IngestBuffer, error) {
+	b := &IngestBuffer{
+		writer:        writer,
+		batchSize:     cfg.Ingest.BatchSize,
+		flushInterval: cfg.Ingest.FlushInterval,
+		maxRetries:    cfg.Ingest.MaxRetries,
+		spillDir:      cfg.Ingest.SpillDir,
+		stats:         IngestStats{Capacity: cfg.Ingest.BufferSize},
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if b.spillDir == "" {
+		log.Println("INGEST_SPILL_DIR not set, batches InfluxDB rejects are dropped after retrying")
+		return b, nil
+	}
+
+	if err := os.MkdirAll(b.spillDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	files, err := b.spillFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		lines, err := readSpillFile(file)
+		if err != nil {
+			return nil, err
+		}
+		b.stats.SpilledPoints += len(lines)
+	}
+	b.stats.SpilledBatches = len(files)
+	if len(files) > 0 {
+		log.Printf("%d spilled points in %d batches waiting to be replayed", b.stats.SpilledPoints, len(files))
+	}
+	return b, nil
+}
+
+// Add buffers points to be written. It fails without buffering any when
+// they do not all fit.
+func (b *IngestBuffer) Add(points ...*write.Point) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending)+len(points) > b.stats.Capacity {
+		b.stats.Rejected += uint64(len(points))
+		return errIngestBufferFull
+	}
+	b.pending = append(b.pending, points...)
+	if len(b.pending) >= b.batchSize {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// CountInvalid records a metric rejected for breaking its schema
+func (b *IngestBuffer) CountInvalid() {
+	b.mu.Lock()
+	b.stats.Invalid++
+	b.mu.Unlock()
+}
+
+// Stats returns the state of the buffer
+func (b *IngestBuffer) Stats() IngestStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := b.stats
+	stats.Buffered = len(b.pending)
+	return stats
+}
+
+// Run flushes the buffer until Stop is called, then flushes what is left
+func (b *IngestBuffer) Run() {
+	defer close(b.done)
+	log.Printf("Buffering metric writes in batches of %d, flushed every %s", b.batchSize, b.flushInterval)
+
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.wake:
+		case <-ticker.C:
+		case <-b.stop:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			b.flush(ctx, 0)
+			cancel()
+			return
+		}
+		b.flush(context.Background(), b.maxRetries)
+	}
+}
+
+// Stop stops Run and waits for its last flush
+func (b *IngestBuffer) Stop() {
+	close(b.stop)
+	<-b.done
+}
+
+// flush writes every buffered point in batches, then replays spilled ones
+// if InfluxDB is taking writes
+func (b *IngestBuffer) flush(ctx context.Context, retries int) {
+	for {
+		b.mu.Lock()
+		n := len(b.pending)
+		if n > b.batchSize {
+			n = b.batchSize
+		}
+		batch := b.pending[:n:n]
+		b.pending = b.pending[n:]
+		// While batches are spilling InfluxDB is likely still down, so new
+		// ones are not held up retrying
+		if b.stats.SpilledBatches > 0 {
+			retries = 0
+		}
+		b.mu.Unlock()
+		if len(batch) == 0 {
+			break
+		}
+		if !b.write(ctx, batch, retries) {
+			return
+		}
+	}
+	b.replay(ctx)
+}
+
+// write writes a batch, retrying with backoff, and spills it when every
+// attempt failed. It reports whether the batch was written.
+func (b *IngestBuffer) write(ctx context.Context, batch []*write.Point, retries int) bool {
+	var err error
+	delay := ingestRetryDelay
+	for attempt := 0; ; attempt++ {
+		if err = b.writer.WritePoint(ctx, batch...); err == nil {
+			now := time.Now()
+			b.mu.Lock()
+			b.stats.Written += uint64(len(batch))
+			b.stats.LastFlushAt = &now
+			b.stats.LastError = ""
+			b.mu.Unlock()
+			return true
+		}
+		if attempt >= retries {
+			break
+		}
+
+		b.mu.Lock()
+		b.stats.Retries++
+		b.mu.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay *= 2
+	}
+
+	b.mu.Lock()
+	b.stats.LastError = err.Error()
+	b.mu.Unlock()
+	if spillErr := b.spill(batch); spillErr != nil {
+		log.Printf("Dropping %d points InfluxDB rejected (%v): %v", len(batch), err, spillErr)
+		b.mu.Lock()
+		b.stats.Dropped += uint64(len(batch))
+		b.mu.Unlock()
+	}
+	return false
+}
+
+// spill writes a batch to a new file in the spill directory as line
+// protocol
+func (b *IngestBuffer) spill(batch []*write.Point) error {
+	if b.spillDir == "" {
+		return errors.New("no spill directory")
+	}
+
+	var content strings.Builder
+	for _, point := range batch {
+		line, err := lineProtocol(point)
+		if err != nil {
+			return err
+		}
+		content.WriteString(line)
+		content.WriteByte('\n')
+	}
+
+	b.mu.Lock()
+	b.spillID++
+	name := filepath.Join(b.spillDir, fmt.Sprintf("ingest-%d-%06d.lp", time.Now().UnixNano(), b.spillID))
+	b.mu.Unlock()
+	if err := os.WriteFile(name+".tmp", []byte(content.String()), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.stats.SpilledPoints += len(batch)
+	b.stats.SpilledBatches++
+	b.mu.Unlock()
+	log.Printf("InfluxDB unavailable, spilled %d points to %s", len(batch), name)
+	return nil
+}
+
+// replay writes the oldest spilled batches back, stopping at the first
+// that fails
+func (b *IngestBuffer) replay(ctx context.Context) {
+	if b.spillDir == "" || b.Stats().SpilledBatches == 0 {
+		return
+	}
+	files, err := b.spillFiles()
+	if err != nil {
+		log.Printf("Failed to list spilled batches: %v", err)
+		return
+	}
+	if len(files) > ingestReplayFiles {
+		files = files[:ingestReplayFiles]
+	}
+
+	for _, file := range files {
+		lines, err := readSpillFile(file)
+		if err != nil {
+			log.Printf("Failed to read spilled batch %s: %v", file, err)
+			return
+		}
+		if len(lines) > 0 {
+			if err := b.writer.WriteLines(ctx, lines...); err != nil {
+				return
+			}
+		}
+		if err := os.Remove(file); err != nil {
+			log.Printf("Failed to remove replayed batch %s: %v", file, err)
+			return
+		}
+
+		b.mu.Lock()
+		b.stats.SpilledPoints -= len(lines)
+		b.stats.SpilledBatches--
+		b.stats.Written += uint64(len(lines))
+		b.mu.Unlock()
+		log.Printf("Replayed %d spilled points from %s", len(lines), file)
+	}
+}
+
+// spillFiles lists the spilled batches, oldest first
+func (b *IngestBuffer) spillFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(b.spillDir, "ingest-*.lp"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func readSpillFile(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// bufferMetric queues a metric's point, answering 503 when the buffer is
+// full. It reports whether the point was buffered.
+func (s *AnalyticsServer) bufferMetric(w http.ResponseWriter, point *write.Point) bool {
+	if err := s.ingest.Add(point); err != nil {
+		log.Printf("Failed to store metric: %v", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Failed to store metric", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// handleIngestStatus serves the state of the ingest buffer
+func (s *AnalyticsServer) handleIngestStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: s.ingest.Stats()})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubPointWriter records what it is given, failing while failures is
+// above zero
+type stubPointWriter struct {
+	mu       sync.Mutex
+	failures int
+	points   []*write.Point
+	lines    []string
+}
+
+func (w *stubPointWriter) fail() error {
+	if w.failures > 0 {
+		w.failures--
+		return errors.New("influxdb unavailable")
+	}
+	return nil
+}
+
+func (w *stubPointWriter) WritePoint(ctx context.Context, points ...*write.Point) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.fail(); err != nil {
+		return err
+	}
+	w.points = append(w.points, points...)
+	return nil
+}
+
+func (w *stubPointWriter) WriteLines(ctx context.Context, lines ...string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.fail(); err != nil {
+		return err
+	}
+	w.lines = append(w.lines, lines...)
+	return nil
+}
+
+func newTestIngestBuffer(t *testing.T, writer pointWriter, spillDir string) *IngestBuffer {
+	var cfg Config
+	cfg.Ingest.BatchSize = 2
+	cfg.Ingest.FlushInterval = time.Second
+	cfg.Ingest.BufferSize = 4
+	cfg.Ingest.SpillDir = spillDir
+	buffer, err := NewIngestBuffer(writer, &cfg)
+	require.NoError(t, err)
+	return buffer
+}
+
+func testPoints(n int) []*write.Point {
+	points := make([]*write.Point, n)
+	for i := range points {
+		points[i] = write.NewPoint("payments", map[string]string{"chain_id": "1"}, map[string]interface{}{"payment_id": uint64(i + 1)}, time.Unix(1772366400, 0))
+	}
+	return points
+}
+
+func TestIngestBuffer(t *testing.T) {
+	t.Run("should retry a failed batch", func(t *testing.T) {
+		writer := &stubPointWriter{failures: 1}
+		buffer := newTestIngestBuffer(t, writer, "")
+		require.NoError(t, buffer.Add(testPoints(2)...))
+
+		buffer.flush(context.Background(), 1)
+		stats := buffer.Stats()
+		assert.Len(t, writer.points, 2)
+		assert.Equal(t, uint64(2), stats.Written)
+		assert.Equal(t, uint64(1), stats.Retries)
+		assert.Zero(t, stats.Buffered)
+		assert.Empty(t, stats.LastError)
+	})
+
+	t.Run("should spill rejected batches and replay them once writes succeed", func(t *testing.T) {
+		dir := t.TempDir()
+		writer := &stubPointWriter{failures: 1}
+		buffer := newTestIngestBuffer(t, writer, dir)
+		require.NoError(t, buffer.Add(testPoints(3)...))
+
+		buffer.flush(context.Background(), 0)
+		stats := buffer.Stats()
+		assert.Equal(t, 2, stats.SpilledPoints)
+		assert.Equal(t, 1, stats.SpilledBatches)
+		assert.Equal(t, 1, stats.Buffered)
+		assert.Equal(t, "influxdb unavailable", stats.LastError)
+		files, err := filepath.Glob(filepath.Join(dir, "ingest-*.lp"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+
+		// A restart counts the spilled points waiting on disk
+		assert.Equal(t, 2, newTestIngestBuffer(t, writer, dir).Stats().SpilledPoints)
+
+		buffer.flush(context.Background(), 0)
+		stats = buffer.Stats()
+		assert.Len(t, writer.points, 1)
+		assert.Len(t, writer.lines, 2)
+		assert.Contains(t, writer.lines[0], "payments,chain_id=1 payment_id=1u")
+		assert.Equal(t, uint64(3), stats.Written)
+		assert.Zero(t, stats.SpilledPoints)
+		assert.Zero(t, stats.SpilledBatches)
+		_, err = os.Stat(files[0])
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("should drop rejected batches without a spill directory", func(t *testing.T) {
+		writer := &stubPointWriter{failures: 1}
+		buffer := newTestIngestBuffer(t, writer, "")
+		require.NoError(t, buffer.Add(testPoints(2)...))
+
+		buffer.flush(context.Background(), 0)
+		assert.Equal(t, uint64(2), buffer.Stats().Dropped)
+	})
+
+	t.Run("should refuse points that do not fit", func(t *testing.T) {
+		buffer := newTestIngestBuffer(t, &stubPointWriter{}, "")
+		require.NoError(t, buffer.Add(testPoints(3)...))
+
+		assert.ErrorIs(t, buffer.Add(testPoints(2)...), errIngestBufferFull)
+		stats := buffer.Stats()
+		assert.Equal(t, 3, stats.Buffered)
+		assert.Equal(t, uint64(2), stats.Rejected)
+	})
+}
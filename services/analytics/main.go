@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,19 +14,50 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/config"
+	"github.com/arcbjorn/crosspay/packages/middleware"
+	"github.com/arcbjorn/crosspay/packages/problem"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 )
 
 type AnalyticsServer struct {
+	config        *Config
+	settings      *config.Result
 	influxClient  influxdb2.Client
-	writeAPI      api.WriteAPI
+	writer        *MetricWriter
+	ingest        *IngestBuffer
 	queryAPI      api.QueryAPI
+	storage       *Storage
+	alerts        *AlertEngine
+	summaries     *PaymentSummaries
+	dashboard     *DashboardCache
+	slo           *PaymentSLO
+	prober        *Prober
+	aggregator    *PaymentAggregator
+	snapshots     *SnapshotStore
+	exports       *Exporter
+	risk          *RiskScorer
+	validatorSLA  ValidatorSLA
+	geo           *GeoEnricher
+	fx            *FXEnricher
+	topAddresses  TopAddresses
+	indexer       *Indexer
+	fanout        *BroadcastFanout
+	disclosures   *DisclosureLog
+	dashboards    *CustomDashboardStore
+	auth          *Authenticator
+	admin         *auth.Admin
 	upgrader      websocket.Upgrader
-	clients       map[*websocket.Conn]bool
+	clients       map[*wsClient]bool
 	clientsMutex  sync.RWMutex
+	broadcasts    chan wsEvent
+	clientBuffer  int
+	pingInterval  time.Duration
 	paymentStream chan PaymentMetric
 }
 
@@ -44,6 +76,17 @@ type PaymentMetric struct {
 	Timestamp     time.Time `json:"timestamp"`
 	CompletedAt   *time.Time `json:"completed_at,omitempty"`
 	ProcessingTime int64     `json:"processing_time_ms,omitempty"`
+	// ClientIP is the payer's address, replaced by its truncated or hashed
+	// form, or dropped, once Country, Region and ASN are looked up
+	ClientIP       string     `json:"client_ip,omitempty"`
+	Country        string     `json:"country,omitempty"`
+	Region         string     `json:"region,omitempty"`
+	ASN            string     `json:"asn,omitempty"`
+	// AmountUSD and FeeUSD are the amount and fee in USD at USDRate, the
+	// token's price at Timestamp, set when both are known
+	AmountUSD      float64    `json:"amount_usd,omitempty"`
+	FeeUSD         float64    `json:"fee_usd,omitempty"`
+	USDRate        float64    `json:"usd_rate,omitempty"`
 }
 
 type ValidatorMetric struct {
@@ -51,6 +94,7 @@ type ValidatorMetric struct {
 	ChainID       uint64    `json:"chain_id"`
 	Stake         string    `json:"stake"`
 	Status        string    `json:"status"`
+	Event         string    `json:"event,omitempty"`
 	ResponseTime  int64     `json:"response_time_ms"`
 	Timestamp     time.Time `json:"timestamp"`
 }
@@ -64,9 +108,22 @@ type VaultMetric struct {
 	APY            float64   `json:"apy"`
 	RiskScore      float64   `json:"risk_score"`
 	SlashingEvents uint64    `json:"slashing_events"`
+	SlashLoss      string    `json:"slash_loss,omitempty"`
 	Timestamp      time.Time `json:"timestamp"`
 }
 
+// GasBudgetMetric is a merchant's sponsored gas spend for one UTC day, as
+// the payment processor reports it whenever the spend changes
+type GasBudgetMetric struct {
+	Merchant  string    `json:"merchant"`
+	ChainID   uint64    `json:"chain_id"`
+	Day       string    `json:"day"`
+	Spent     string    `json:"spent"`
+	Budget    string    `json:"budget,omitempty"`
+	UsedPct   float64   `json:"used_pct"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
 type AnalyticsQuery struct {
 	MetricType string            `json:"metric_type"` // "payments", "validators", "vaults"
 	TimeRange  string            `json:"time_range"`  // "1h", "24h", "7d", "30d"
@@ -75,56 +132,260 @@ type AnalyticsQuery struct {
 }
 
 type AnalyticsResponse struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data"`
-	Error   string      `json:"error,omitempty"`
+	Success    bool        `json:"success"`
+	Data       interface{} `json:"data"`
+	Resolution string      `json:"resolution,omitempty"`
+	Error      string      `json:"error,omitempty"`
 }
 
-func NewAnalyticsServer() *AnalyticsServer {
-	influxURL := getEnv("INFLUXDB_URL", "http://localhost:8086")
-	token := getEnv("INFLUXDB_TOKEN", "your-token-here")
-	org := getEnv("INFLUXDB_ORG", "crosspay")
-	bucket := getEnv("INFLUXDB_BUCKET", "analytics")
+func NewAnalyticsServer(cfg *Config, settings *config.Result) *AnalyticsServer {
+	org := cfg.InfluxDB.Org
+	bucket := cfg.InfluxDB.Bucket
 
-	client := influxdb2.NewClient(influxURL, token)
-	writeAPI := client.WriteAPI(org, bucket)
+	client := influxdb2.NewClient(cfg.InfluxDB.URL, cfg.InfluxDB.Token)
 	queryAPI := client.QueryAPI(org)
+	influxWrite := client.WriteAPIBlocking(org, bucket)
+
+	writer, err := NewMetricWriter(influxWrite, cfg.Storage.Mode, cfg.Storage.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to set up metric storage: %v", err)
+	}
 
-	return &AnalyticsServer{
+	server := &AnalyticsServer{
+		config:        cfg,
+		settings:      settings,
 		influxClient:  client,
-		writeAPI:      writeAPI,
+		writer:        writer,
 		queryAPI:      queryAPI,
+		storage:       NewStorage(client, org, bucket),
 		upgrader:      websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
-		clients:       make(map[*websocket.Conn]bool),
+		clients:       make(map[*wsClient]bool),
+		broadcasts:    make(chan wsEvent, 1000),
+		clientBuffer:  cfg.WSClientBuffer,
+		pingInterval:  cfg.WSPingInterval,
 		paymentStream: make(chan PaymentMetric, 1000),
+		aggregator:    NewPaymentAggregator(),
+		snapshots:     NewSnapshotStore(),
+		risk:          NewRiskScorer(),
+		validatorSLA:  loadValidatorSLA(),
+	}
+	server.summaries = NewPaymentSummaries(queryAPI, influxWrite, bucket, server.storage)
+	server.dashboard = NewDashboardCache(server)
+	server.slo = NewPaymentSLO(queryAPI, bucket, server.storage)
+	if cfg.Prober.PaymentURL != "" {
+		server.prober = NewProber(cfg.Prober, server.writer)
+	}
+	server.exports = NewExporter(cfg, queryAPI, server.storage, server.snapshots)
+
+	server.ingest, err = NewIngestBuffer(writer, cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up metric ingestion: %v", err)
+	}
+
+	server.disclosures, err = NewDisclosureLog(cfg.DisclosureDatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to open disclosure audit log: %v", err)
+	}
+
+	server.dashboards, err = NewCustomDashboardStore(cfg.Storage.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to open custom dashboards: %v", err)
+	}
+
+	server.geo, err = NewGeoEnricher()
+	if err != nil {
+		log.Fatalf("Failed to set up GeoIP enrichment: %v", err)
+	}
+
+	server.fx, err = NewFXEnricher()
+	if err != nil {
+		log.Fatalf("Failed to set up USD pricing: %v", err)
+	}
+
+	server.topAddresses, err = loadTopAddresses()
+	if err != nil {
+		log.Fatalf("Invalid top list settings: %v", err)
+	}
+
+	server.auth, err = LoadAuthenticator(cfg.TokensPath, cfg.OpenAccess)
+	if err != nil {
+		log.Fatalf("Failed to load API tokens: %v", err)
+	}
+	server.admin, err = auth.New("analytics", cfg.Admin)
+	if err != nil {
+		log.Fatalf("Failed to open admin audit log: %v", err)
 	}
+
+	alertConfig, err := LoadAlertConfig(cfg.AlertRulesPath)
+	if err != nil {
+		log.Fatalf("Failed to load alert rules: %v", err)
+	}
+	if cfg.AlertRulesPath == "" {
+		// The default rules also alert on the payment latency SLO target
+		// and the prober's stages
+		rules := alertConfig.Rules
+		alertConfig.Rules = append(rules[:len(rules):len(rules)], server.slo.AlertRule())
+		if server.prober != nil {
+			alertConfig.Rules = append(alertConfig.Rules, server.prober.AlertRules()...)
+		}
+	}
+	source := &influxAlertSource{queryAPI: queryAPI, bucket: bucket}
+	server.alerts, err = NewAlertEngine(alertConfig, source, func(alert Alert) {
+		server.broadcastToClients(alertEvent(alert))
+	})
+	if err != nil {
+		log.Fatalf("Invalid alert rules: %v", err)
+	}
+
+	return server
 }
 
 func (s *AnalyticsServer) Start() {
 	// Start background workers
 	go s.processMetrics()
 	go s.handleWebSocketBroadcasts()
+	go s.ingest.Run()
+
+	// Share broadcasts with the other instances before metrics arrive
+	if url := s.config.BroadcastBusURL; url != "" {
+		fanout, err := NewBroadcastFanout(url, s.config.BroadcastSubject, s)
+		if err != nil {
+			log.Fatalf("Failed to start broadcast fan-out: %v", err)
+		}
+		s.fanout = fanout
+	}
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	go s.storage.Maintain(workerCtx, time.Hour)
+	workers := s.config.Workers
+	go s.alerts.Run(workerCtx, time.Duration(workers.AlertEvaluationSeconds)*time.Second)
+	go s.writer.Reconcile(workerCtx, time.Duration(workers.StorageReconcileSeconds)*time.Second,
+		time.Duration(workers.SQLRetentionHours)*time.Hour)
+	go s.summaries.Run(workerCtx, time.Duration(workers.SummaryMinutes)*time.Minute)
+	go s.dashboard.Run(workerCtx, time.Duration(workers.DashboardRefreshSeconds)*time.Second)
+	go s.slo.Run(workerCtx, time.Duration(workers.PaymentSLOSeconds)*time.Second)
+	go s.exports.Run(workerCtx)
+	if s.prober != nil {
+		go s.prober.Run(workerCtx)
+	}
+	go s.aggregator.Run(workerCtx, time.Duration(workers.AggregateBroadcastSeconds)*time.Second, func(aggregates RealtimeAggregates) {
+		s.broadcastToClients(wsEvent{Type: "aggregates", Data: aggregates})
+	})
+	if remoteWriter := NewRemoteWriter(); remoteWriter != nil {
+		go remoteWriter.Run(workerCtx, time.Duration(workers.PrometheusPushSeconds)*time.Second, s.aggregator, s.ingest)
+	}
+
+	indexerConfig, err := LoadIndexerConfig(s.config.IndexerConfigPath)
+	if err != nil {
+		log.Fatalf("Failed to load indexer config: %v", err)
+	}
+	if indexerConfig != nil {
+		s.indexer = NewIndexer(indexerConfig, s)
+		go s.indexer.Run(workerCtx)
+	}
+
+	var bus *BusConsumer
+	if url := s.config.EventBusURL; url != "" {
+		var err error
+		bus, err = NewBusConsumer(loadBusConfig(url), s)
+		if err != nil {
+			log.Fatalf("Failed to start event bus consumer: %v", err)
+		}
+	}
 
 	router := mux.NewRouter()
 
-	// REST API endpoints
+	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	}).Methods("GET")
+
+	// Metric ingestion endpoints
 	router.HandleFunc("/api/metrics/payment", s.handlePaymentMetric).Methods("POST")
 	router.HandleFunc("/api/metrics/validator", s.handleValidatorMetric).Methods("POST")
 	router.HandleFunc("/api/metrics/vault", s.handleVaultMetric).Methods("POST")
-	router.HandleFunc("/api/query", s.handleQuery).Methods("POST")
-	router.HandleFunc("/api/dashboard", s.handleDashboard).Methods("GET")
-	router.HandleFunc("/api/realtime/{metric_type}", s.handleRealtimeQuery).Methods("GET")
+	router.HandleFunc("/api/metrics/signature", s.handleSignatureMetric).Methods("POST")
+	router.HandleFunc("/api/metrics/receipt", s.handleReceiptMetric).Methods("POST")
+	router.HandleFunc("/api/metrics/gas-budget", s.handleGasBudgetMetric).Methods("POST")
+	router.HandleFunc("/api/metrics/schemas", s.handleMetricSchemas).Methods("GET")
+
+	// Shared snapshots and export files, authorized by their signed link
+	router.HandleFunc("/api/snapshots/{cid}", s.handleSnapshot).Methods("GET")
+	router.HandleFunc("/api/exports/files/{cid}", s.handleExportFile).Methods("GET")
+
+	// Admin actions, authorized by an admin JWT rather than an API token
+	router.Handle("/api/alerts/silences", s.admin.Require("analytics.silences.create", auth.RoleOperator)(http.HandlerFunc(s.handleCreateSilence))).Methods("POST")
+	router.Handle("/api/alerts/silences/{id}", s.admin.Require("analytics.silences.delete", auth.RoleOperator)(http.HandlerFunc(s.handleDeleteSilence))).Methods("DELETE")
+	router.Handle("/admin/audit", s.admin.AuditHandler()).Methods("GET")
+
+	// Read endpoints, scoped by API token
+	read := router.NewRoute().Subrouter()
+	read.Use(s.auth.Middleware)
+	// Queries that scan InfluxDB give up after QUERY_TIMEOUT
+	timeout := middleware.Timeout(s.config.QueryTimeout)
+	read.Handle("/api/query", timeout(http.HandlerFunc(s.handleQuery))).Methods("POST")
+	read.Handle("/api/dashboard", timeout(requireAdmin(s.handleDashboard))).Methods("GET")
+	read.HandleFunc("/api/realtime/aggregates", requireAdmin(s.handleAggregates)).Methods("GET")
+	read.Handle("/api/realtime/{metric_type}", timeout(http.HandlerFunc(s.handleRealtimeQuery))).Methods("GET")
+	read.Handle("/api/payments/funnel", timeout(requireAdmin(s.handleFunnel))).Methods("GET")
+	read.Handle("/api/payments/cohorts", timeout(requireAdmin(s.handleCohorts))).Methods("GET")
+	read.HandleFunc("/api/risk/payment/{id}", requireAdmin(s.handlePaymentRisk)).Methods("GET")
+	read.Handle("/api/validators/leaderboard", timeout(requireAdmin(s.handleValidatorLeaderboard))).Methods("GET")
+	read.Handle("/api/analytics/top/{dimension}", timeout(requireAdmin(s.handleTop))).Methods("GET")
+	read.HandleFunc("/api/analytics/slo", requireAdmin(s.handlePaymentSLO)).Methods("GET")
+	read.Handle("/api/analytics/validations", timeout(requireAdmin(s.handleValidations))).Methods("GET")
+	read.Handle("/api/analytics/receipts/stats", timeout(requireAdmin(s.handleReceiptStats))).Methods("GET")
+	read.HandleFunc("/api/validators/{address}/sla", requireAdmin(s.handleValidatorSLA)).Methods("GET")
+	read.HandleFunc("/api/vaults/{address}/risk", requireAdmin(s.handleVaultRisk)).Methods("GET")
+	read.HandleFunc("/api/vaults/{address}/scenarios", requireAdmin(s.handleVaultScenarios)).Methods("GET")
+	read.HandleFunc("/api/chains", requireAdmin(s.handleChains)).Methods("GET")
+	read.HandleFunc("/api/disclosures", requireAdmin(s.handleDisclosures)).Methods("GET")
+	read.HandleFunc("/api/disclosures", requireAdmin(s.handleRecordDisclosure)).Methods("POST")
+	read.HandleFunc("/api/disclosures/summary", requireAdmin(s.handleDisclosureSummary)).Methods("GET")
+	read.HandleFunc("/api/disclosures/verify", requireAdmin(s.handleVerifyDisclosures)).Methods("GET")
+	read.HandleFunc("/api/disclosures/export", requireAdmin(s.handleExportDisclosures)).Methods("GET")
+	read.HandleFunc("/api/disclosures/{id}", requireAdmin(s.handleDisclosure)).Methods("GET")
+	read.HandleFunc("/api/dashboards", s.handleListCustomDashboards).Methods("GET")
+	read.HandleFunc("/api/dashboards", s.handleCreateCustomDashboard).Methods("POST")
+	read.HandleFunc("/api/dashboards/targets", s.handleDashboardTargets).Methods("GET")
+	read.HandleFunc("/api/dashboards/{id}", s.handleCustomDashboard).Methods("GET")
+	read.HandleFunc("/api/dashboards/{id}", s.handleUpdateCustomDashboard).Methods("PUT")
+	read.HandleFunc("/api/dashboards/{id}", s.handleDeleteCustomDashboard).Methods("DELETE")
+	read.Handle("/api/dashboards/{id}/data", timeout(http.HandlerFunc(s.handleCustomDashboardData))).Methods("GET")
+	read.HandleFunc("/api/snapshots", requireAdmin(s.handleCreateSnapshot)).Methods("POST")
+	read.HandleFunc("/api/exports", requireAdmin(s.handleExports)).Methods("GET")
+	read.HandleFunc("/api/exports", requireAdmin(s.handleCreateExport)).Methods("POST")
+	read.HandleFunc("/api/exports/{id}", requireAdmin(s.handleExport)).Methods("GET")
+	read.HandleFunc("/api/privacy/erase", requireAdmin(s.handleErase)).Methods("POST")
+	read.HandleFunc("/api/alerts", requireAdmin(s.handleAlerts)).Methods("GET")
+	read.HandleFunc("/api/probes", requireAdmin(s.handleProbes)).Methods("GET")
+	read.HandleFunc("/api/alerts/rules", requireAdmin(s.handleAlertRules)).Methods("GET")
+	read.HandleFunc("/api/alerts/silences", requireAdmin(s.handleSilences)).Methods("GET")
+	read.HandleFunc("/api/ingest/status", requireAdmin(s.handleIngestStatus)).Methods("GET")
+	read.HandleFunc("/config", requireAdmin(s.settings.Handler())).Methods("GET")
+
+	// Grafana JSON datasource
+	read.HandleFunc("/api/grafana", s.handleGrafanaTest).Methods("GET")
+	read.HandleFunc("/api/grafana/", s.handleGrafanaTest).Methods("GET")
+	read.HandleFunc("/api/grafana/search", s.handleGrafanaSearch).Methods("POST")
+	read.HandleFunc("/api/grafana/metrics", s.handleGrafanaMetrics).Methods("POST")
+	read.Handle("/api/grafana/query", timeout(http.HandlerFunc(s.handleGrafanaQuery))).Methods("POST")
 
 	// WebSocket endpoint for real-time updates
-	router.HandleFunc("/ws", s.handleWebSocket)
+	read.HandleFunc("/ws", s.handleWebSocket)
 
-	// CORS middleware
-	router.Use(corsMiddleware)
+	handler := middleware.Chain(router,
+		middleware.Logger(nil),
+		problem.Adapt,
+		middleware.Recover(nil),
+		middleware.CORS(middleware.CORSConfig{AllowedOrigins: s.config.CORSAllowedOrigins}),
+	)
 
-	port := getEnv("PORT", "8084")
+	port := s.config.Port
 	server := &http.Server{
 		Addr:         ":" + port,
-		Handler:      router,
+		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 	}
@@ -150,36 +411,102 @@ func (s *AnalyticsServer) Start() {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
+	if bus != nil {
+		bus.Stop()
+	}
+	if s.fanout != nil {
+		s.fanout.Close()
+	}
+	s.ingest.Stop()
+	s.writer.Close()
+	if s.disclosures != nil {
+		s.disclosures.Close()
+	}
+	if s.dashboards != nil {
+		s.dashboards.Close()
+	}
+	s.geo.Close()
 	s.influxClient.Close()
+	s.admin.Close()
 	log.Println("Analytics server stopped")
 }
 
 func (s *AnalyticsServer) handlePaymentMetric(w http.ResponseWriter, r *http.Request) {
 	var metric PaymentMetric
-	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !s.decodeMetricRequest(w, r, "payment", &metric) {
 		return
 	}
 
-	// Calculate processing time if completed
-	if metric.CompletedAt != nil {
-		metric.ProcessingTime = metric.CompletedAt.Sub(metric.Timestamp).Milliseconds()
+	s.geo.Enrich(&metric, r)
+	s.fx.Enrich(r.Context(), &metric)
+	if !s.bufferMetric(w, paymentPoint(&metric)) {
+		return
 	}
+	s.announcePayment(metric)
 
-	// Send to processing channel
-	select {
-	case s.paymentStream <- metric:
-	default:
-		log.Printf("Payment stream channel full, dropping metric for payment %d", metric.PaymentID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true})
+}
+
+func (s *AnalyticsServer) handleValidatorMetric(w http.ResponseWriter, r *http.Request) {
+	var metric ValidatorMetric
+	if !s.decodeMetricRequest(w, r, "validator", &metric) {
+		return
+	}
+
+	if !s.bufferMetric(w, validatorPoint(metric)) {
+		return
+	}
+	s.announceValidator(metric)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true})
+}
+
+func (s *AnalyticsServer) handleVaultMetric(w http.ResponseWriter, r *http.Request) {
+	var metric VaultMetric
+	if !s.decodeMetricRequest(w, r, "vault", &metric) {
+		return
+	}
+
+	if !s.bufferMetric(w, vaultPoint(metric)) {
+		return
+	}
+	s.announceVault(metric)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true})
+}
+
+func (s *AnalyticsServer) handleGasBudgetMetric(w http.ResponseWriter, r *http.Request) {
+	var metric GasBudgetMetric
+	if !s.decodeMetricRequest(w, r, "gas-budget", &metric) {
+		return
+	}
+
+	if !s.bufferMetric(w, gasBudgetPoint(metric)) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true})
+}
+
+// paymentPoint fills in the processing time of a completed payment and
+// builds its InfluxDB point
+func paymentPoint(metric *PaymentMetric) *write.Point {
+	if metric.CompletedAt != nil {
+		metric.ProcessingTime = metric.CompletedAt.Sub(metric.Timestamp).Milliseconds()
 	}
 
-	// Write to InfluxDB
 	point := influxdb2.NewPointWithMeasurement("payments").
 		AddTag("chain_id", fmt.Sprintf("%d", metric.ChainID)).
 		AddTag("status", metric.Status).
 		AddTag("token", metric.Token).
 		AddTag("is_private", fmt.Sprintf("%t", metric.IsPrivate)).
+		AddTag("merchant", strings.ToLower(metric.Recipient)).
 		AddField("payment_id", metric.PaymentID).
+		AddField("sender", strings.ToLower(metric.Sender)).
 		AddField("amount", metric.Amount).
 		AddField("fee", metric.Fee).
 		AddField("processing_time_ms", metric.ProcessingTime).
@@ -189,55 +516,60 @@ func (s *AnalyticsServer) handlePaymentMetric(w http.ResponseWriter, r *http.Req
 		point.AddField("required_sigs", metric.RequiredSigs).
 			AddField("received_sigs", metric.ReceivedSigs)
 	}
-
-	s.writeAPI.WritePoint(point)
-
-	// Broadcast to WebSocket clients
-	s.broadcastToClients(map[string]interface{}{
-		"type": "payment",
-		"data": metric,
-	})
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true})
-}
-
-func (s *AnalyticsServer) handleValidatorMetric(w http.ResponseWriter, r *http.Request) {
-	var metric ValidatorMetric
-	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	if metric.Country != "" {
+		point.AddTag("country", metric.Country)
+	}
+	if metric.Region != "" {
+		point.AddTag("region", metric.Region)
+	}
+	if metric.ASN != "" {
+		point.AddTag("asn", metric.ASN)
 	}
+	if metric.ClientIP != "" {
+		point.AddField("client_ip", metric.ClientIP)
+	}
+	if metric.USDRate > 0 {
+		point.AddField("amount_usd", metric.AmountUSD).
+			AddField("fee_usd", metric.FeeUSD).
+			AddField("usd_rate", metric.USDRate)
+	}
+	return point
+}
 
-	// Write to InfluxDB
+func validatorPoint(metric ValidatorMetric) *write.Point {
 	point := influxdb2.NewPointWithMeasurement("validators").
 		AddTag("chain_id", fmt.Sprintf("%d", metric.ChainID)).
 		AddTag("validator_address", metric.ValidatorAddr).
-		AddTag("status", metric.Status).
+		AddTag("status", metric.Status)
+	if metric.Event != "" {
+		point.AddTag("event", metric.Event)
+	}
+	return point.
 		AddField("stake", metric.Stake).
 		AddField("response_time_ms", metric.ResponseTime).
 		SetTime(metric.Timestamp)
-
-	s.writeAPI.WritePoint(point)
-
-	// Broadcast to WebSocket clients
-	s.broadcastToClients(map[string]interface{}{
-		"type": "validator",
-		"data": metric,
-	})
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true})
 }
 
-func (s *AnalyticsServer) handleVaultMetric(w http.ResponseWriter, r *http.Request) {
-	var metric VaultMetric
-	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+// gasBudgetPoint builds the InfluxDB point of a merchant's daily gas spend.
+// Merchants without a budget report a used_pct of zero.
+func gasBudgetPoint(metric GasBudgetMetric) *write.Point {
+	point := influxdb2.NewPointWithMeasurement("gas_budgets").
+		AddTag("chain_id", fmt.Sprintf("%d", metric.ChainID)).
+		AddTag("merchant", strings.ToLower(metric.Merchant)).
+		AddField("day", metric.Day).
+		AddField("spent", metric.Spent).
+		AddField("used_pct", metric.UsedPct).
+		SetTime(metric.Timestamp)
+	if metric.Budget != "" {
+		point.AddField("budget", metric.Budget)
 	}
+	return point
+}
 
-	// Write to InfluxDB
+// vaultPoint builds the InfluxDB point of a tranche. A slashing's loss is
+// also recorded as a percentage of the tranche before it; total_assets is
+// the balance after it.
+func vaultPoint(metric VaultMetric) *write.Point {
 	point := influxdb2.NewPointWithMeasurement("vaults").
 		AddTag("chain_id", fmt.Sprintf("%d", metric.ChainID)).
 		AddTag("vault_address", metric.VaultAddress).
@@ -248,17 +580,51 @@ func (s *AnalyticsServer) handleVaultMetric(w http.ResponseWriter, r *http.Reque
 		AddField("risk_score", metric.RiskScore).
 		AddField("slashing_events", metric.SlashingEvents).
 		SetTime(metric.Timestamp)
+	if loss, ok := new(big.Float).SetString(metric.SlashLoss); ok && loss.Sign() > 0 {
+		point.AddField("slash_loss", metric.SlashLoss)
+		if balance, ok := new(big.Float).SetString(metric.TotalAssets); ok {
+			before := new(big.Float).Add(balance, loss)
+			pct, _ := new(big.Float).Quo(loss, before).Float64()
+			point.AddField("slash_loss_pct", pct*100)
+		}
+	}
+	return point
+}
 
-	s.writeAPI.WritePoint(point)
+// announcePayment hands a recorded payment to the processing stream and the
+// WebSocket clients
+func (s *AnalyticsServer) announcePayment(metric PaymentMetric) {
+	select {
+	case s.paymentStream <- metric:
+	default:
+		log.Printf("Payment stream channel full, dropping metric for payment %d", metric.PaymentID)
+	}
 
-	// Broadcast to WebSocket clients
-	s.broadcastToClients(map[string]interface{}{
-		"type": "vault",
-		"data": metric,
+	s.announce(wsEvent{
+		Type:      "payment",
+		ChainID:   metric.ChainID,
+		Addresses: []string{metric.Sender, metric.Recipient},
+		Merchant:  strings.ToLower(metric.Recipient),
+		Data:      metric,
 	})
+}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true})
+func (s *AnalyticsServer) announceValidator(metric ValidatorMetric) {
+	s.announce(wsEvent{
+		Type:      "validator",
+		ChainID:   metric.ChainID,
+		Addresses: []string{metric.ValidatorAddr},
+		Data:      metric,
+	})
+}
+
+func (s *AnalyticsServer) announceVault(metric VaultMetric) {
+	s.announce(wsEvent{
+		Type:      "vault",
+		ChainID:   metric.ChainID,
+		Addresses: []string{metric.VaultAddress},
+		Data:      metric,
+	})
 }
 
 func (s *AnalyticsServer) handleQuery(w http.ResponseWriter, r *http.Request) {
@@ -268,50 +634,34 @@ func (s *AnalyticsServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	timeFilter := parseTimeRange(query.TimeRange)
-	var fluxQuery string
-
-	switch query.MetricType {
-	case "payments":
-		fluxQuery = fmt.Sprintf(`
-			from(bucket: "analytics")
-			|> range(start: %s)
-			|> filter(fn: (r) => r["_measurement"] == "payments")
-		`, timeFilter)
-		
-		if query.ChainID != nil {
-			fluxQuery += fmt.Sprintf(`|> filter(fn: (r) => r["chain_id"] == "%d")`, *query.ChainID)
-		}
-
-	case "validators":
-		fluxQuery = fmt.Sprintf(`
-			from(bucket: "analytics")
-			|> range(start: %s)
-			|> filter(fn: (r) => r["_measurement"] == "validators")
-		`, timeFilter)
-		
-		if query.ChainID != nil {
-			fluxQuery += fmt.Sprintf(`|> filter(fn: (r) => r["chain_id"] == "%d")`, *query.ChainID)
-		}
-
-	case "vaults":
-		fluxQuery = fmt.Sprintf(`
-			from(bucket: "analytics")
-			|> range(start: %s)
-			|> filter(fn: (r) => r["_measurement"] == "vaults")
-		`, timeFilter)
-		
-		if query.ChainID != nil {
-			fluxQuery += fmt.Sprintf(`|> filter(fn: (r) => r["chain_id"] == "%d")`, *query.ChainID)
-		}
-
-	default:
+	// Metric types are named after their measurements
+	measurement := query.MetricType
+	if _, ok := sampleFields[measurement]; !ok {
 		http.Error(w, "Invalid metric type", http.StatusBadRequest)
 		return
 	}
+	scope := scopeFrom(r)
+	if !scope.IsAdmin() && measurement != "payments" {
+		problem.Error(w, r, http.StatusForbidden, problem.CodeScopeForbidden, "Merchant tokens can only query payments")
+		return
+	}
+
+	// Long ranges read rollups instead of every raw point
+	rng := timeRangeDuration(query.TimeRange)
+	resolution := s.storage.Resolve(measurement, rng)
+	fluxQuery := fmt.Sprintf(`
+		from(bucket: "%s")
+		|> range(start: -%s)
+		|> filter(fn: (r) => r["_measurement"] == "%s")
+	`, s.storage.BucketFor(resolution), fluxDuration(rng), measurement)
+	fluxQuery += scope.fluxFilter()
+
+	if query.ChainID != nil {
+		fluxQuery += fmt.Sprintf(`|> filter(fn: (r) => r["chain_id"] == "%d")`, *query.ChainID)
+	}
 
 	// Execute query
-	result, err := s.queryAPI.Query(context.Background(), fluxQuery)
+	result, err := s.queryAPI.Query(r.Context(), fluxQuery)
 	if err != nil {
 		log.Printf("Query error: %v", err)
 		http.Error(w, "Query failed", http.StatusInternalServerError)
@@ -335,80 +685,9 @@ func (s *AnalyticsServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(AnalyticsResponse{
-		Success: true,
-		Data:    records,
-	})
-}
-
-func (s *AnalyticsServer) handleDashboard(w http.ResponseWriter, r *http.Request) {
-	// Get comprehensive dashboard data
-	dashboardData := make(map[string]interface{})
-
-	// Payment volume (last 24h)
-	paymentQuery := `
-		from(bucket: "analytics")
-		|> range(start: -24h)
-		|> filter(fn: (r) => r["_measurement"] == "payments")
-		|> group(columns: ["status"])
-		|> count()
-	`
-	
-	paymentResult, err := s.queryAPI.Query(context.Background(), paymentQuery)
-	if err == nil {
-		paymentStats := make(map[string]int64)
-		for paymentResult.Next() {
-			status := paymentResult.Record().ValueByKey("status").(string)
-			count := paymentResult.Record().Value().(int64)
-			paymentStats[status] = count
-		}
-		dashboardData["payment_stats"] = paymentStats
-	}
-
-	// Validator health
-	validatorQuery := `
-		from(bucket: "analytics")
-		|> range(start: -1h)
-		|> filter(fn: (r) => r["_measurement"] == "validators")
-		|> group(columns: ["status"])
-		|> count()
-	`
-	
-	validatorResult, err := s.queryAPI.Query(context.Background(), validatorQuery)
-	if err == nil {
-		validatorStats := make(map[string]int64)
-		for validatorResult.Next() {
-			status := validatorResult.Record().ValueByKey("status").(string)
-			count := validatorResult.Record().Value().(int64)
-			validatorStats[status] = count
-		}
-		dashboardData["validator_stats"] = validatorStats
-	}
-
-	// Vault metrics
-	vaultQuery := `
-		from(bucket: "analytics")
-		|> range(start: -1h)
-		|> filter(fn: (r) => r["_measurement"] == "vaults")
-		|> last()
-		|> group(columns: ["tranche_type"])
-		|> mean(column: "_value")
-	`
-	
-	vaultResult, err := s.queryAPI.Query(context.Background(), vaultQuery)
-	if err == nil {
-		vaultStats := make(map[string]float64)
-		for vaultResult.Next() {
-			tranche := vaultResult.Record().ValueByKey("tranche_type").(string)
-			avgValue := vaultResult.Record().Value().(float64)
-			vaultStats[tranche] = avgValue
-		}
-		dashboardData["vault_stats"] = vaultStats
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(AnalyticsResponse{
-		Success: true,
-		Data:    dashboardData,
+		Success:    true,
+		Data:       records,
+		Resolution: resolution.Name,
 	})
 }
 
@@ -416,6 +695,12 @@ func (s *AnalyticsServer) handleRealtimeQuery(w http.ResponseWriter, r *http.Req
 	vars := mux.Vars(r)
 	metricType := vars["metric_type"]
 
+	scope := scopeFrom(r)
+	if !scope.IsAdmin() && metricType != "payments" {
+		problem.Error(w, r, http.StatusForbidden, problem.CodeScopeForbidden, "Merchant tokens can only query payments")
+		return
+	}
+
 	// Get real-time data (last 5 minutes)
 	timeFilter := "-5m"
 	var fluxQuery string
@@ -426,9 +711,10 @@ func (s *AnalyticsServer) handleRealtimeQuery(w http.ResponseWriter, r *http.Req
 			from(bucket: "analytics")
 			|> range(start: %s)
 			|> filter(fn: (r) => r["_measurement"] == "payments")
+			%s
 			|> sort(columns: ["_time"], desc: true)
 			|> limit(n: 100)
-		`, timeFilter)
+		`, timeFilter, scope.fluxFilter())
 
 	case "validators":
 		fluxQuery = fmt.Sprintf(`
@@ -453,7 +739,7 @@ func (s *AnalyticsServer) handleRealtimeQuery(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	result, err := s.queryAPI.Query(context.Background(), fluxQuery)
+	result, err := s.queryAPI.Query(r.Context(), fluxQuery)
 	if err != nil {
 		log.Printf("Realtime query error: %v", err)
 		http.Error(w, "Query failed", http.StatusInternalServerError)
@@ -482,93 +768,98 @@ func (s *AnalyticsServer) handleWebSocket(w http.ResponseWriter, r *http.Request
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
-	defer conn.Close()
 
+	client := &wsClient{conn: conn, send: make(chan []byte, s.clientBuffer), scope: scopeFrom(r)}
 	s.clientsMutex.Lock()
-	s.clients[conn] = true
+	s.clients[client] = true
+	total := len(s.clients)
 	s.clientsMutex.Unlock()
 
-	log.Printf("New WebSocket client connected. Total clients: %d", len(s.clients))
+	log.Printf("New WebSocket client connected. Total clients: %d", total)
 
-	// Handle client disconnection
-	defer func() {
-		s.clientsMutex.Lock()
-		delete(s.clients, conn)
-		s.clientsMutex.Unlock()
-		log.Printf("WebSocket client disconnected. Remaining clients: %d", len(s.clients))
-	}()
+	go s.writeClient(client)
+	defer s.removeClient(client)
 
-	// Keep connection alive
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			break
-		}
-	}
+	s.readClient(client)
 }
 
 func (s *AnalyticsServer) processMetrics() {
 	for metric := range s.paymentStream {
-		// Additional processing logic can be added here
+		s.aggregator.Add(metric, time.Now())
+		s.scorePayment(metric)
 		log.Printf("Processed payment metric: ID=%d, Chain=%d, Status=%s", 
 			metric.PaymentID, metric.ChainID, metric.Status)
 	}
 }
 
+// handleWebSocketBroadcasts routes each broadcast to the clients subscribed
+// to it, disconnecting clients whose send buffer is full
 func (s *AnalyticsServer) handleWebSocketBroadcasts() {
-	// This goroutine handles broadcasting to WebSocket clients
-	// In a real implementation, this would be triggered by the broadcastToClients method
-	// For now, it just keeps the goroutine alive
-	for {
-		time.Sleep(time.Minute)
+	for event := range s.broadcasts {
+		message, err := json.Marshal(map[string]interface{}{
+			"type": event.Type,
+			"data": event.Data,
+		})
+		if err != nil {
+			log.Printf("Failed to encode %s broadcast: %v", event.Type, err)
+			continue
+		}
+
+		var slow []*wsClient
+		s.clientsMutex.RLock()
+		for client := range s.clients {
+			if !client.wants(&event) {
+				continue
+			}
+			select {
+			case client.send <- message:
+			default:
+				slow = append(slow, client)
+			}
+		}
+		s.clientsMutex.RUnlock()
+
+		for _, client := range slow {
+			log.Printf("Evicting slow WebSocket client %s", client.conn.RemoteAddr())
+			s.removeClient(client)
+		}
 	}
 }
 
-func (s *AnalyticsServer) broadcastToClients(data map[string]interface{}) {
-	s.clientsMutex.RLock()
-	defer s.clientsMutex.RUnlock()
-
-	message, _ := json.Marshal(data)
-	
-	for client := range s.clients {
-		if err := client.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			client.Close()
-			delete(s.clients, client)
-		}
+// announce broadcasts an event ingested by this instance to its WebSocket
+// clients and relays it to the other instances'
+func (s *AnalyticsServer) announce(event wsEvent) {
+	s.broadcastToClients(event)
+	if s.fanout != nil {
+		s.fanout.Publish(event)
 	}
 }
 
-func parseTimeRange(timeRange string) string {
+// broadcastToClients queues an event for the WebSocket clients subscribed to
+// it
+func (s *AnalyticsServer) broadcastToClients(event wsEvent) {
+	select {
+	case s.broadcasts <- event:
+	default:
+		log.Printf("Broadcast queue full, dropping %s event", event.Type)
+	}
+}
+
+func timeRangeDuration(timeRange string) time.Duration {
 	switch strings.ToLower(timeRange) {
 	case "1h":
-		return "-1h"
+		return time.Hour
 	case "24h":
-		return "-24h"
+		return 24 * time.Hour
 	case "7d":
-		return "-7d"
+		return 7 * 24 * time.Hour
 	case "30d":
-		return "-30d"
+		return 30 * 24 * time.Hour
 	default:
-		return "-1h"
+		return time.Hour
 	}
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -577,6 +868,10 @@ func getEnv(key, defaultValue string) string {
 }
 
 func main() {
-	server := NewAnalyticsServer()
+	cfg, settings, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := NewAnalyticsServer(cfg, settings)
 	server.Start()
 }
\ No newline at end of file
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notifier delivers alert notifications to one channel
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// ChannelConfig defines a notification channel. Webhook and Slack channels
+// post to URL; email channels send to To through the SMTP_* server.
+type ChannelConfig struct {
+	Name string   `json:"name"`
+	Type string   `json:"type"`
+	URL  string   `json:"url,omitempty"`
+	To   []string `json:"to,omitempty"`
+}
+
+// NewNotifier builds the notifier for a channel
+func NewNotifier(cfg ChannelConfig) (Notifier, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	switch cfg.Type {
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("channel %s: url is required", cfg.Name)
+		}
+		return &webhookNotifier{url: cfg.URL, client: client}, nil
+	case "slack":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("channel %s: url is required", cfg.Name)
+		}
+		return &slackNotifier{url: cfg.URL, client: client}, nil
+	case "email":
+		if len(cfg.To) == 0 {
+			return nil, fmt.Errorf("channel %s: to is required", cfg.Name)
+		}
+		addr := getEnv("SMTP_ADDR", "")
+		if addr == "" {
+			return nil, fmt.Errorf("channel %s: SMTP_ADDR is not set", cfg.Name)
+		}
+		return &emailNotifier{
+			addr:     addr,
+			from:     getEnv("SMTP_FROM", "alerts@crosspay.local"),
+			username: getEnv("SMTP_USERNAME", ""),
+			password: getEnv("SMTP_PASSWORD", ""),
+			to:       cfg.To,
+		}, nil
+	default:
+		return nil, fmt.Errorf("channel %s: unknown type %q", cfg.Name, cfg.Type)
+	}
+}
+
+// webhookNotifier posts the alert as JSON
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	return postJSON(ctx, n.client, n.url, alert)
+}
+
+// slackNotifier posts a message to a Slack incoming webhook
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, alert Alert) error {
+	return postJSON(ctx, n.client, n.url, map[string]string{"text": alertSummary(alert)})
+}
+
+// emailNotifier sends a plain-text email over SMTP
+type emailNotifier struct {
+	addr     string
+	from     string
+	username string
+	password string
+	to       []string
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, alert Alert) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, strings.Split(n.addr, ":")[0])
+	}
+
+	subject := fmt.Sprintf("[%s] %s %s", strings.ToUpper(alert.Severity), alert.Rule, alert.State)
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n",
+		n.from, strings.Join(n.to, ", "), subject, alertSummary(alert))
+	return smtp.SendMail(n.addr, auth, n.from, n.to, []byte(body))
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// alertSummary describes an alert in one line
+func alertSummary(alert Alert) string {
+	var labels []string
+	for _, key := range sortedKeys(alert.Labels) {
+		labels = append(labels, key+"="+alert.Labels[key])
+	}
+
+	summary := fmt.Sprintf("%s %s (value %.4g)", alert.Rule, alert.State, alert.Value)
+	if alert.Description != "" {
+		summary = fmt.Sprintf("%s %s: %s (value %.4g)", alert.Rule, alert.State, alert.Description, alert.Value)
+	}
+	if len(labels) > 0 {
+		summary += " [" + strings.Join(labels, ", ") + "]"
+	}
+	return summary
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// The prober is a canary for the whole payment path. Every PROBER_INTERVAL
+// it creates a tiny payment through the payment processor, has the relay
+// network validate it, completes it and generates its receipt, timing each
+// stage. Runs are written to the probes measurement, one point per stage
+// and one for the whole run, and the default alert rules fire when a stage
+// fails, is slower than its threshold, or the prober stops reporting. It is
+// meant for a testnet deployment, where the payment costs nothing.
+
+// probeStages are the stages of a run, in order
+var probeStages = []string{"create", "validate", "complete", "receipt"}
+
+// Outcomes of a stage or a run
+const (
+	probeOK      = "ok"
+	probeFailed  = "failed"
+	probeSkipped = "skipped"
+)
+
+// maxProbeRuns is how many recent runs GET /api/probes returns
+const maxProbeRuns = 20
+
+// ProbeStage is one stage of a run. Skipped stages follow a failed one, or
+// are validations without a relay node to ask.
+type ProbeStage struct {
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	DurationMs  int64  `json:"duration_ms"`
+	ThresholdMs int64  `json:"threshold_ms"`
+	Slow        bool   `json:"slow,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ProbeRun is one synthetic payment through every stage
+type ProbeRun struct {
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	PaymentID  uint64       `json:"payment_id,omitempty"`
+	Status     string       `json:"status"`
+	DurationMs int64        `json:"duration_ms"`
+	Stages     []ProbeStage `json:"stages"`
+}
+
+// Prober runs synthetic payments and keeps the recent runs
+type Prober struct {
+	cfg        ProberConfig
+	writer     *MetricWriter
+	client     *http.Client
+	thresholds map[string]time.Duration
+	now        func() time.Time
+
+	mu   sync.RWMutex
+	runs []ProbeRun
+}
+
+// NewProber probes the services in cfg, writing each run with writer
+func NewProber(cfg ProberConfig, writer *MetricWriter) *Prober {
+	cfg.PaymentURL = strings.TrimRight(cfg.PaymentURL, "/")
+	cfg.RelayURL = strings.TrimRight(cfg.RelayURL, "/")
+	return &Prober{
+		cfg:    cfg,
+		writer: writer,
+		client: &http.Client{},
+		thresholds: map[string]time.Duration{
+			"create":   cfg.CreateThreshold,
+			"validate": cfg.ValidateThreshold,
+			"complete": cfg.CompleteThreshold,
+			"receipt":  cfg.ReceiptThreshold,
+		},
+		now: time.Now,
+	}
+}
+
+// AlertRules fire when a stage is slower than its threshold, when a run
+// fails, and when no run has been recorded for three intervals
+func (p *Prober) AlertRules() []AlertRule {
+	window := Duration(2 * p.cfg.Interval)
+	rules := make([]AlertRule, 0, len(probeStages)+2)
+	for _, stage := range probeStages {
+		threshold := p.thresholds[stage]
+		rules = append(rules, AlertRule{
+			Name: "probe_" + stage + "_slow", Type: RuleThreshold, Severity: "warning",
+			Description: fmt.Sprintf("Synthetic payment %s stage slower than %s", stage, threshold),
+			Measurement: "probes", Field: "duration_ms", Aggregate: "max", Filters: map[string]string{"stage": stage, "status": probeOK},
+			Operator: ">", Value: float64(threshold.Milliseconds()), Window: window,
+		})
+	}
+	return append(rules,
+		AlertRule{
+			Name: "probe_failed", Type: RuleThreshold, Severity: "critical",
+			Description: "Synthetic payment failed, GET /api/probes has the failed stage",
+			Measurement: "probes", Field: "duration_ms", Aggregate: "count", Filters: map[string]string{"stage": "total", "status": probeFailed},
+			Operator: ">", Value: 0, Window: window,
+		},
+		AlertRule{
+			Name: "probe_missing", Type: RuleAbsence, Severity: "warning",
+			Description: "No synthetic payment recorded",
+			Measurement: "probes", Filters: map[string]string{"stage": "total"},
+			GroupBy: []string{"stage"}, Window: Duration(3 * p.cfg.Interval), Lookback: Duration(24 * time.Hour),
+		},
+	)
+}
+
+// Run probes every PROBER_INTERVAL until ctx is done
+func (p *Prober) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	p.run(ctx, ticker.C)
+}
+
+// run probes now and on every tick until ctx is done
+func (p *Prober) run(ctx context.Context, ticks <-chan time.Time) {
+	for {
+		run := p.Probe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if run.Status != probeOK {
+			log.Printf("Synthetic payment %d failed: %s", run.PaymentID, run.failure())
+		}
+		if err := p.writer.WritePoint(ctx, run.points()...); err != nil {
+			log.Printf("Failed to write synthetic payment %d: %v", run.PaymentID, err)
+		}
+		select {
+		case <-ticks:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Probe runs one synthetic payment through every stage and keeps it
+func (p *Prober) Probe(ctx context.Context) ProbeRun {
+	run := ProbeRun{StartedAt: p.now(), Status: probeOK}
+	steps := map[string]func(context.Context, *ProbeRun) error{
+		"create":   p.create,
+		"validate": p.validate,
+		"complete": p.complete,
+		"receipt":  p.receipt,
+	}
+	for _, name := range probeStages {
+		stage := ProbeStage{Name: name, Status: probeSkipped, ThresholdMs: p.thresholds[name].Milliseconds()}
+		if run.Status == probeOK && (name != "validate" || p.cfg.RelayURL != "") {
+			stageCtx, cancel := context.WithTimeout(ctx, p.cfg.StageTimeout)
+			started := p.now()
+			err := steps[name](stageCtx, &run)
+			cancel()
+
+			elapsed := p.now().Sub(started)
+			stage.DurationMs = elapsed.Milliseconds()
+			stage.Status = probeOK
+			if err != nil {
+				stage.Status, stage.Error = probeFailed, err.Error()
+				run.Status = probeFailed
+			} else {
+				stage.Slow = elapsed > p.thresholds[name]
+			}
+		}
+		run.Stages = append(run.Stages, stage)
+	}
+	run.FinishedAt = p.now()
+	run.DurationMs = run.FinishedAt.Sub(run.StartedAt).Milliseconds()
+
+	p.mu.Lock()
+	p.runs = append([]ProbeRun{run}, p.runs...)
+	if len(p.runs) > maxProbeRuns {
+		p.runs = p.runs[:maxProbeRuns]
+	}
+	p.mu.Unlock()
+	return run
+}
+
+// Runs returns the recent runs, newest first
+func (p *Prober) Runs() []ProbeRun {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]ProbeRun(nil), p.runs...)
+}
+
+func (p *Prober) create(ctx context.Context, run *ProbeRun) error {
+	var created struct {
+		PaymentID uint64 `json:"payment_id"`
+	}
+	err := p.post(ctx, p.cfg.PaymentURL+"/api/payments/create", map[string]string{
+		"sender":    p.cfg.Sender,
+		"recipient": p.cfg.Recipient,
+		"token":     p.cfg.Token,
+		"amount":    p.cfg.Amount,
+	}, &created)
+	if err != nil {
+		return err
+	}
+	if created.PaymentID == 0 {
+		return errors.New("payment processor returned no payment_id")
+	}
+	run.PaymentID = created.PaymentID
+	return nil
+}
+
+// validate asks the relay node to validate the payment and follows its
+// validation stream until enough validators have signed
+func (p *Prober) validate(ctx context.Context, run *ProbeRun) error {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("crosspay-probe:%d", run.PaymentID)))
+	err := p.post(ctx, p.cfg.RelayURL+"/validate", map[string]interface{}{
+		"payment_id":          run.PaymentID,
+		"message_hash":        "0x" + hex.EncodeToString(hash[:]),
+		"required_signatures": p.cfg.RequiredSignatures,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/validations/%d/stream", p.cfg.RelayURL, run.PaymentID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("validation stream returned status %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event struct {
+			Type       string `json:"type"`
+			Signatures int    `json:"signatures"`
+			Required   int    `json:"required_signatures"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("invalid validation event: %w", err)
+		}
+		switch {
+		case event.Type == "expired" || event.Type == "reverted":
+			return fmt.Errorf("validation %s with %d of %d signatures", event.Type, event.Signatures, event.Required)
+		case event.Type == "quorum" || event.Type == "submitted" || (event.Required > 0 && event.Signatures >= event.Required):
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("validation stream closed before quorum")
+}
+
+func (p *Prober) complete(ctx context.Context, run *ProbeRun) error {
+	return p.post(ctx, fmt.Sprintf("%s/api/payments/complete/%d", p.cfg.PaymentURL, run.PaymentID), nil, nil)
+}
+
+func (p *Prober) receipt(ctx context.Context, run *ProbeRun) error {
+	return p.post(ctx, fmt.Sprintf("%s/api/receipts/generate/%d", p.cfg.PaymentURL, run.PaymentID), map[string]string{"format": "json"}, nil)
+}
+
+// post sends body as JSON and decodes the response into out if set. Any
+// status other than 2xx is an error carrying the start of the response.
+func (p *Prober) post(ctx context.Context, url string, body, out interface{}) error {
+	var payload io.Reader = http.NoBody
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s returned status %d: %s", req.URL.Path, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// failure is the error of the stage that failed
+func (r ProbeRun) failure() string {
+	for _, stage := range r.Stages {
+		if stage.Status == probeFailed {
+			return stage.Name + ": " + stage.Error
+		}
+	}
+	return ""
+}
+
+// points are the run's stages, then the whole run as stage total. Skipped
+// stages are written too, so a missing relay node shows up in dashboards.
+func (r ProbeRun) points() []*write.Point {
+	point := func(stage, status string, durationMs int64) *write.Point {
+		return influxdb2.NewPointWithMeasurement("probes").
+			AddTag("stage", stage).
+			AddTag("status", status).
+			AddField("duration_ms", durationMs).
+			AddField("payment_id", r.PaymentID).
+			SetTime(r.FinishedAt)
+	}
+	points := make([]*write.Point, 0, len(r.Stages)+1)
+	for _, stage := range r.Stages {
+		points = append(points, point(stage.Name, stage.Status, stage.DurationMs))
+	}
+	return append(points, point("total", r.Status, r.DurationMs))
+}
+
+// handleProbes serves the recent synthetic payments, newest first
+func (s *AnalyticsServer) handleProbes(w http.ResponseWriter, r *http.Request) {
+	if s.prober == nil {
+		http.Error(w, "Prober is not configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: s.prober.Runs()})
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock only moves when advanced
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// probeStub serves the payment processor and relay node endpoints the
+// prober calls. Each stage advances the clock by its delay, answers 500 if
+// it is the failing stage, and the validation stream sends events.
+type probeStub struct {
+	clock    *fakeClock
+	delays   map[string]time.Duration
+	fail     string
+	events   []string
+	onCreate func(created int)
+
+	mu      sync.Mutex
+	created int
+	calls   []string
+}
+
+func (s *probeStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.calls = append(s.calls, r.Method+" "+r.URL.Path)
+	s.mu.Unlock()
+
+	stage := ""
+	switch {
+	case r.URL.Path == "/api/payments/create":
+		stage = "create"
+	case r.URL.Path == "/validate":
+		if s.fail == "validate" {
+			http.Error(w, "relay unavailable", http.StatusInternalServerError)
+		}
+		return
+	case strings.HasSuffix(r.URL.Path, "/stream"):
+		stage = "validate"
+	case strings.HasPrefix(r.URL.Path, "/api/payments/complete/"):
+		stage = "complete"
+	case strings.HasPrefix(r.URL.Path, "/api/receipts/generate/"):
+		stage = "receipt"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	s.clock.advance(s.delays[stage])
+	if s.fail == stage {
+		http.Error(w, stage+" unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	switch stage {
+	case "create":
+		s.mu.Lock()
+		s.created++
+		created := s.created
+		s.mu.Unlock()
+		if s.onCreate != nil {
+			s.onCreate(created)
+		}
+		json.NewEncoder(w).Encode(map[string]uint64{"payment_id": uint64(100 + created)})
+	case "validate":
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range s.events {
+			fmt.Fprintf(w, "event: validation\ndata: %s\n\n", event)
+		}
+	default:
+		w.Write([]byte(`{"success":true}`))
+	}
+}
+
+// requests returns the requests made so far
+func (s *probeStub) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// newTestProber points a prober with a fake clock at stub, writing runs to
+// a fake InfluxDB. The relay node is the stub too unless relay is false.
+func newTestProber(t *testing.T, stub *probeStub, relay bool) (*Prober, *fakeInflux) {
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	influx, client := newFakeInflux(t)
+
+	cfg := ProberConfig{
+		PaymentURL:         server.URL + "/",
+		Sender:             "0x00000000000000000000000000000000000000a1",
+		Recipient:          "0x00000000000000000000000000000000000000b2",
+		Token:              "0x0000000000000000000000000000000000000000",
+		Amount:             "1000",
+		RequiredSignatures: 2,
+		Interval:           5 * time.Minute,
+		StageTimeout:       time.Minute,
+		CreateThreshold:    10 * time.Second,
+		ValidateThreshold:  60 * time.Second,
+		CompleteThreshold:  10 * time.Second,
+		ReceiptThreshold:   30 * time.Second,
+	}
+	if relay {
+		cfg.RelayURL = server.URL
+	}
+	prober := NewProber(cfg, &MetricWriter{influx: client.WriteAPIBlocking("crosspay", "analytics"), mode: StorageInflux})
+	prober.now = stub.clock.Now
+	return prober, influx
+}
+
+// stageStatuses returns the status of each stage of run, in order
+func stageStatuses(run ProbeRun) []string {
+	statuses := make([]string, 0, len(run.Stages))
+	for _, stage := range run.Stages {
+		statuses = append(statuses, stage.Status)
+	}
+	return statuses
+}
+
+func TestProber(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	quorum := []string{`{"type":"signature","signatures":1,"required_signatures":2}`, `{"type":"quorum","signatures":2,"required_signatures":2}`}
+
+	t.Run("should time each stage against its threshold", func(t *testing.T) {
+		stub := &probeStub{
+			clock:  &fakeClock{now: start},
+			delays: map[string]time.Duration{"create": 2 * time.Second, "validate": 61 * time.Second, "complete": 10 * time.Second, "receipt": 31 * time.Second},
+			events: quorum,
+		}
+		prober, _ := newTestProber(t, stub, true)
+
+		run := prober.Probe(context.Background())
+		assert.Equal(t, probeOK, run.Status)
+		assert.Equal(t, uint64(101), run.PaymentID)
+		assert.Equal(t, start, run.StartedAt)
+		assert.Equal(t, start.Add(104*time.Second), run.FinishedAt)
+		assert.Equal(t, int64(104000), run.DurationMs)
+		assert.Equal(t, []ProbeStage{
+			{Name: "create", Status: probeOK, DurationMs: 2000, ThresholdMs: 10000},
+			{Name: "validate", Status: probeOK, DurationMs: 61000, ThresholdMs: 60000, Slow: true},
+			{Name: "complete", Status: probeOK, DurationMs: 10000, ThresholdMs: 10000},
+			{Name: "receipt", Status: probeOK, DurationMs: 31000, ThresholdMs: 30000, Slow: true},
+		}, run.Stages)
+		assert.Empty(t, run.failure())
+		assert.Equal(t, []string{
+			"POST /api/payments/create",
+			"POST /validate",
+			"GET /validations/101/stream",
+			"POST /api/payments/complete/101",
+			"POST /api/receipts/generate/101",
+		}, stub.requests())
+	})
+
+	t.Run("should skip the stages after a failed one", func(t *testing.T) {
+		for _, tc := range []struct {
+			name     string
+			fail     string
+			events   []string
+			statuses []string
+			failure  string
+			requests int
+		}{
+			{
+				name: "payment not created", fail: "create", events: quorum,
+				statuses: []string{probeFailed, probeSkipped, probeSkipped, probeSkipped},
+				failure:  "create: /api/payments/create returned status 500: create unavailable", requests: 1,
+			},
+			{
+				name: "relay node refused", fail: "validate", events: quorum,
+				statuses: []string{probeOK, probeFailed, probeSkipped, probeSkipped},
+				failure:  "validate: /validate returned status 500: relay unavailable", requests: 2,
+			},
+			{
+				name: "validation expired", events: []string{`{"type":"expired","signatures":1,"required_signatures":2}`},
+				statuses: []string{probeOK, probeFailed, probeSkipped, probeSkipped},
+				failure:  "validate: validation expired with 1 of 2 signatures", requests: 3,
+			},
+			{
+				name: "stream closed before quorum", events: quorum[:1],
+				statuses: []string{probeOK, probeFailed, probeSkipped, probeSkipped},
+				failure:  "validate: validation stream closed before quorum", requests: 3,
+			},
+			{
+				name: "receipt not generated", fail: "receipt", events: quorum,
+				statuses: []string{probeOK, probeOK, probeOK, probeFailed},
+				failure:  "receipt: /api/receipts/generate/101 returned status 500: receipt unavailable", requests: 5,
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				stub := &probeStub{clock: &fakeClock{now: start}, fail: tc.fail, events: tc.events}
+				prober, _ := newTestProber(t, stub, true)
+
+				run := prober.Probe(context.Background())
+				assert.Equal(t, probeFailed, run.Status)
+				assert.Equal(t, tc.statuses, stageStatuses(run))
+				assert.Equal(t, tc.failure, run.failure())
+				assert.Len(t, stub.requests(), tc.requests)
+			})
+		}
+	})
+
+	t.Run("should skip validation without a relay node", func(t *testing.T) {
+		stub := &probeStub{clock: &fakeClock{now: start}, delays: map[string]time.Duration{"validate": time.Hour}}
+		prober, _ := newTestProber(t, stub, false)
+
+		run := prober.Probe(context.Background())
+		assert.Equal(t, probeOK, run.Status)
+		assert.Equal(t, []string{probeOK, probeSkipped, probeOK, probeOK}, stageStatuses(run))
+		assert.Zero(t, run.DurationMs)
+	})
+
+	t.Run("should probe on every tick and write each run", func(t *testing.T) {
+		stub := &probeStub{
+			clock:  &fakeClock{now: start},
+			delays: map[string]time.Duration{"create": time.Second, "validate": 3 * time.Second, "complete": time.Second, "receipt": 2 * time.Second},
+			events: quorum,
+		}
+		prober, influx := newTestProber(t, stub, true)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		// The third run is cancelled, so it is kept but never written
+		stub.onCreate = func(created int) {
+			if created == 3 {
+				cancel()
+			}
+		}
+
+		ticks := make(chan time.Time)
+		done := make(chan struct{})
+		go func() {
+			prober.run(ctx, ticks)
+			close(done)
+		}()
+		ticks <- start.Add(5 * time.Minute)
+		ticks <- start.Add(10 * time.Minute)
+		<-done
+
+		runs := prober.Runs()
+		require.Len(t, runs, 3)
+		for i, run := range runs[1:] {
+			assert.Equal(t, uint64(102-i), run.PaymentID)
+			assert.Equal(t, probeOK, run.Status)
+			assert.Equal(t, int64(7000), run.DurationMs)
+		}
+		assert.Equal(t, runs[2].FinishedAt, runs[1].StartedAt)
+
+		totals := make([]string, 0, 2)
+		for _, line := range influx.written("probes") {
+			if strings.Contains(line, "stage=total") {
+				totals = append(totals, line)
+			}
+		}
+		require.Len(t, totals, 2)
+		for i, line := range totals {
+			finished := start.Add(time.Duration(7*(i+1)) * time.Second)
+			assert.Equal(t, fmt.Sprintf("probes,stage=total,status=ok duration_ms=7000i,payment_id=%du %d", 101+i, finished.UnixNano()), line)
+		}
+		assert.Len(t, influx.written("probes"), 10)
+	})
+
+	t.Run("should keep the newest runs", func(t *testing.T) {
+		stub := &probeStub{clock: &fakeClock{now: start}, events: quorum}
+		prober, _ := newTestProber(t, stub, true)
+
+		for i := 0; i < maxProbeRuns+5; i++ {
+			prober.Probe(context.Background())
+		}
+		runs := prober.Runs()
+		require.Len(t, runs, maxProbeRuns)
+		assert.Equal(t, uint64(100+maxProbeRuns+5), runs[0].PaymentID)
+		assert.Equal(t, uint64(106), runs[maxProbeRuns-1].PaymentID)
+	})
+
+	t.Run("should alert on the configured thresholds and interval", func(t *testing.T) {
+		prober, _ := newTestProber(t, &probeStub{clock: &fakeClock{now: start}}, true)
+
+		rules := make(map[string]AlertRule)
+		for _, rule := range prober.AlertRules() {
+			require.NoError(t, rule.Validate(nil), rule.Name)
+			rules[rule.Name] = rule
+		}
+		assert.Len(t, rules, len(probeStages)+2)
+		assert.Equal(t, float64(60000), rules["probe_validate_slow"].Value)
+		assert.Equal(t, Duration(10*time.Minute), rules["probe_validate_slow"].Window)
+		assert.Equal(t, Duration(10*time.Minute), rules["probe_failed"].Window)
+		assert.Equal(t, Duration(15*time.Minute), rules["probe_missing"].Window)
+	})
+}
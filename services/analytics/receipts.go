@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// storage-worker reports every receipt it tries to generate, through the
+// API or its job queue, as a receipt metric: its format and language, and
+// either its size and storage cost or the step that failed. Receipt stats
+// are read from the raw points, so they cover at most the raw retention of
+// receipts.
+
+// receiptStatuses are the outcomes a receipt metric can report
+var receiptStatuses = []string{"success", "failed"}
+
+// receiptFailureReasons are the steps of a receipt's generation that can
+// fail
+var receiptFailureReasons = []string{"payment_not_found", "generation_failed", "rendering_failed", "storage_failed", "registration_failed"}
+
+// ReceiptMetric is one attempt to generate a receipt. SizeBytes and CostFIL
+// are set when it succeeded, FailureReason when it failed.
+type ReceiptMetric struct {
+	PaymentID     uint64    `json:"payment_id"`
+	ChainID       uint64    `json:"chain_id,omitempty"`
+	Format        string    `json:"format"`
+	Language      string    `json:"language"`
+	Source        string    `json:"source"`
+	Status        string    `json:"status"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	SizeBytes     int64     `json:"size_bytes,omitempty"`
+	CostFIL       float64   `json:"cost_fil,omitempty"`
+	DurationMs    int64     `json:"duration_ms"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+func receiptPoint(metric ReceiptMetric) *write.Point {
+	point := influxdb2.NewPointWithMeasurement("receipts").
+		AddTag("format", metric.Format).
+		AddTag("language", metric.Language).
+		AddTag("source", metric.Source).
+		AddTag("status", metric.Status).
+		AddField("payment_id", metric.PaymentID).
+		AddField("size_bytes", metric.SizeBytes).
+		AddField("cost_fil", metric.CostFIL).
+		AddField("duration_ms", metric.DurationMs).
+		SetTime(metric.Timestamp)
+	if metric.ChainID != 0 {
+		point.AddTag("chain_id", fmt.Sprintf("%d", metric.ChainID))
+	}
+	if metric.FailureReason != "" {
+		point.AddTag("failure_reason", metric.FailureReason)
+	}
+	return point
+}
+
+func (s *AnalyticsServer) handleReceiptMetric(w http.ResponseWriter, r *http.Request) {
+	var metric ReceiptMetric
+	if !s.decodeMetricRequest(w, r, "receipt", &metric) {
+		return
+	}
+	if metric.Status == "failed" && metric.FailureReason == "" {
+		s.ingest.CountInvalid()
+		http.Error(w, "failure_reason is required when status is failed", http.StatusBadRequest)
+		return
+	}
+
+	if !s.bufferMetric(w, receiptPoint(metric)) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true})
+}
+
+// ReceiptBreakdown counts receipt attempts and sums the receipts generated.
+// The size average is over the generated receipts.
+type ReceiptBreakdown struct {
+	Attempts       int64   `json:"attempts"`
+	Receipts       int64   `json:"total_receipts"`
+	Failures       int64   `json:"failures"`
+	SuccessRate    float64 `json:"success_rate"`
+	TotalSizeBytes int64   `json:"total_size_bytes"`
+	AvgSizeBytes   float64 `json:"avg_size_bytes"`
+	StorageCostFIL float64 `json:"storage_cost_fil"`
+}
+
+func (b *ReceiptBreakdown) finish() {
+	if b.Attempts > 0 {
+		b.SuccessRate = float64(b.Receipts) / float64(b.Attempts)
+	}
+	if b.Receipts > 0 {
+		b.AvgSizeBytes = float64(b.TotalSizeBytes) / float64(b.Receipts)
+	}
+}
+
+// ReceiptStats sums up receipt generation over a window, overall, by format
+// and by language, with the failures by the step that failed
+type ReceiptStats struct {
+	Window string `json:"window"`
+	ReceiptBreakdown
+	AvgDurationMs  float64                      `json:"avg_duration_ms"`
+	ByFormat       map[string]*ReceiptBreakdown `json:"by_format"`
+	ByLanguage     map[string]*ReceiptBreakdown `json:"by_language"`
+	FailureReasons map[string]int64             `json:"failure_reasons"`
+}
+
+// ReceiptStats reads receipt generation over window, on chainID if set
+func (s *AnalyticsServer) ReceiptStats(ctx context.Context, window, chainID string) (*ReceiptStats, error) {
+	chainFilter := ""
+	if chainID != "" {
+		chainFilter = fmt.Sprintf(" and r.chain_id == %q", chainID)
+	}
+	flux := fmt.Sprintf(`data = from(bucket: %q)
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == "receipts"%s)
+data |> filter(fn: (r) => r._field == "payment_id")
+	|> group(columns: ["format", "language", "status", "failure_reason"])
+	|> count()
+	|> yield(name: "count")
+data |> filter(fn: (r) => r._field == "size_bytes" or r._field == "cost_fil" or r._field == "duration_ms")
+	|> toFloat()
+	|> group(columns: ["format", "language", "status", "_field"])
+	|> sum()
+	|> yield(name: "sum")`, s.storage.bucket, fluxDuration(timeRangeDuration(window)), chainFilter)
+
+	stats := &ReceiptStats{
+		Window:         window,
+		ByFormat:       make(map[string]*ReceiptBreakdown),
+		ByLanguage:     make(map[string]*ReceiptBreakdown),
+		FailureReasons: make(map[string]int64),
+	}
+	breakdown := func(entries map[string]*ReceiptBreakdown, key string) *ReceiptBreakdown {
+		entry, ok := entries[key]
+		if !ok {
+			entry = &ReceiptBreakdown{}
+			entries[key] = entry
+		}
+		return entry
+	}
+
+	result, err := s.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+	var totalDurationMs float64
+	for result.Next() {
+		record := result.Record()
+		format, _ := record.ValueByKey("format").(string)
+		language, _ := record.ValueByKey("language").(string)
+		succeeded := record.ValueByKey("status") == "success"
+		entries := []*ReceiptBreakdown{&stats.ReceiptBreakdown, breakdown(stats.ByFormat, format), breakdown(stats.ByLanguage, language)}
+		value := floatValue(record.Value())
+
+		switch record.Result() {
+		case "count":
+			for _, entry := range entries {
+				entry.Attempts += int64(value)
+				if succeeded {
+					entry.Receipts += int64(value)
+				} else {
+					entry.Failures += int64(value)
+				}
+			}
+			if !succeeded {
+				reason, _ := record.ValueByKey("failure_reason").(string)
+				stats.FailureReasons[reason] += int64(value)
+			}
+		case "sum":
+			switch record.Field() {
+			case "duration_ms":
+				totalDurationMs += value
+			case "size_bytes":
+				if succeeded {
+					for _, entry := range entries {
+						entry.TotalSizeBytes += int64(value)
+					}
+				}
+			case "cost_fil":
+				if succeeded {
+					for _, entry := range entries {
+						entry.StorageCostFIL += value
+					}
+				}
+			}
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	stats.finish()
+	for _, entry := range stats.ByFormat {
+		entry.finish()
+	}
+	for _, entry := range stats.ByLanguage {
+		entry.finish()
+	}
+	if stats.Attempts > 0 {
+		stats.AvgDurationMs = totalDurationMs / float64(stats.Attempts)
+	}
+	return stats, nil
+}
+
+// handleReceiptStats serves receipt generation stats over ?window= (1h, 24h,
+// 7d or 30d, default 24h), on ?chain_id= if set
+func (s *AnalyticsServer) handleReceiptStats(w http.ResponseWriter, r *http.Request) {
+	window, chainID, ok := validatorParams(w, r)
+	if !ok {
+		return
+	}
+	if keep := s.storage.retention["receipts"]["raw"]; keep != 0 && keep < timeRangeDuration(window) {
+		http.Error(w, fmt.Sprintf("Receipts are kept for %s", keep), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := s.ReceiptStats(r.Context(), window, chainID)
+	if err != nil {
+		log.Printf("Receipt stats query error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: stats})
+}
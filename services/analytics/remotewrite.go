@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The rolling payment aggregates can be pushed to Prometheus, or anything
+// accepting its remote-write protocol such as Mimir or Thanos, so existing
+// alerting stacks can use them. Every push sends one sample per chain for
+// each metric. A chain with no payments in the window is sent as zeros
+// rather than left to go stale. The depth of the ingest buffer is pushed
+// alongside them.
+
+// remoteWriteMetrics maps the pushed metric names to the aggregates they
+// are read from
+var remoteWriteMetrics = []struct {
+	name  string
+	value func(Aggregates) float64
+}{
+	{"crosspay_payments_completed_per_second", func(a Aggregates) float64 { return a.PaymentsPerSec }},
+	{"crosspay_payments_created_per_second", func(a Aggregates) float64 { return a.CreatedPerSec }},
+	{"crosspay_payment_volume_per_minute", func(a Aggregates) float64 {
+		volume, _, err := big.ParseFloat(a.VolumePerMin, 10, 64, big.ToNearestEven)
+		if err != nil {
+			return 0
+		}
+		value, _ := volume.Float64()
+		return value
+	}},
+	{"crosspay_payment_volume_usd_per_minute", func(a Aggregates) float64 { return a.VolumeUSDPerMin }},
+	{"crosspay_payment_failure_ratio", func(a Aggregates) float64 { return a.FailureRate }},
+}
+
+// ingestMetrics maps the pushed ingest buffer metric names to the stats
+// they are read from
+var ingestMetrics = []struct {
+	name  string
+	value func(IngestStats) float64
+}{
+	{"crosspay_ingest_buffered_points", func(s IngestStats) float64 { return float64(s.Buffered) }},
+	{"crosspay_ingest_buffer_capacity", func(s IngestStats) float64 { return float64(s.Capacity) }},
+	{"crosspay_ingest_spilled_points", func(s IngestStats) float64 { return float64(s.SpilledPoints) }},
+	{"crosspay_ingest_written_points_total", func(s IngestStats) float64 { return float64(s.Written) }},
+	{"crosspay_ingest_dropped_points_total", func(s IngestStats) float64 { return float64(s.Dropped) }},
+	{"crosspay_ingest_rejected_points_total", func(s IngestStats) float64 { return float64(s.Rejected) }},
+	{"crosspay_ingest_invalid_metrics_total", func(s IngestStats) float64 { return float64(s.Invalid) }},
+}
+
+// promLabel is a remote-write label
+type promLabel struct {
+	name  string
+	value string
+}
+
+// promSeries is a remote-write time series with a single sample
+type promSeries struct {
+	labels []promLabel
+	value  float64
+	time   time.Time
+}
+
+// RemoteWriter pushes aggregates to a Prometheus remote-write endpoint
+type RemoteWriter struct {
+	url      string
+	job      string
+	username string
+	password string
+	token    string
+	client   *http.Client
+	chains   map[string]bool
+}
+
+// NewRemoteWriter pushes to PROMETHEUS_REMOTE_WRITE_URL, authenticating
+// with PROMETHEUS_REMOTE_WRITE_USERNAME and _PASSWORD or with
+// PROMETHEUS_REMOTE_WRITE_TOKEN. It returns nil when no URL is set.
+func NewRemoteWriter() *RemoteWriter {
+	url := getEnv("PROMETHEUS_REMOTE_WRITE_URL", "")
+	if url == "" {
+		return nil
+	}
+	return &RemoteWriter{
+		url:      url,
+		job:      getEnv("PROMETHEUS_JOB", "crosspay-analytics"),
+		username: getEnv("PROMETHEUS_REMOTE_WRITE_USERNAME", ""),
+		password: getEnv("PROMETHEUS_REMOTE_WRITE_PASSWORD", ""),
+		token:    getEnv("PROMETHEUS_REMOTE_WRITE_TOKEN", ""),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		chains:   make(map[string]bool),
+	}
+}
+
+// Run pushes the aggregator's snapshot and the ingest buffer's stats every
+// interval until ctx is done
+func (p *RemoteWriter) Run(ctx context.Context, interval time.Duration, aggregator *PaymentAggregator, ingest *IngestBuffer) {
+	log.Printf("Pushing payment aggregates to %s every %s", p.url, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := p.Push(ctx, aggregator.Snapshot(now), ingest.Stats()); err != nil {
+				log.Printf("Failed to push aggregates to Prometheus: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Push sends one snapshot and the ingest buffer's stats
+func (p *RemoteWriter) Push(ctx context.Context, snapshot RealtimeAggregates, ingest IngestStats) error {
+	for chainID := range snapshot.Chains {
+		p.chains[chainID] = true
+	}
+	chains := make([]string, 0, len(p.chains))
+	for chainID := range p.chains {
+		chains = append(chains, chainID)
+	}
+	sort.Strings(chains)
+
+	var series []promSeries
+	for _, chainID := range chains {
+		aggregates, ok := snapshot.Chains[chainID]
+		if !ok {
+			aggregates = Aggregates{ChainID: chainID, VolumePerMin: "0"}
+		}
+		for _, metric := range remoteWriteMetrics {
+			series = append(series, promSeries{
+				labels: []promLabel{{"__name__", metric.name}, {"chain_id", chainID}, {"job", p.job}},
+				value:  metric.value(aggregates),
+				time:   snapshot.ComputedAt,
+			})
+		}
+	}
+	for _, metric := range ingestMetrics {
+		series = append(series, promSeries{
+			labels: []promLabel{{"__name__", metric.name}, {"job", p.job}},
+			value:  metric.value(ingest),
+			time:   snapshot.ComputedAt,
+		})
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(snappy.Encode(nil, encodeWriteRequest(series))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	} else if p.username != "" {
+		req.SetBasicAuth(p.username, p.password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest. Labels must be
+// sorted by name.
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []promSeries) []byte {
+	var request []byte
+	for _, s := range series {
+		var timeSeries []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+
+			timeSeries = protowire.AppendTag(timeSeries, 1, protowire.BytesType)
+			timeSeries = protowire.AppendBytes(timeSeries, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.time.UnixMilli()))
+
+		timeSeries = protowire.AppendTag(timeSeries, 2, protowire.BytesType)
+		timeSeries = protowire.AppendBytes(timeSeries, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, timeSeries)
+	}
+	return request
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Every new payment on the payment stream is scored for fraud risk from
+// three signals, each compared with the sender's earlier payments:
+//   - velocity: how many payments the sender made within RISK_VELOCITY_WINDOW
+//   - amount z-score: how unusual the amount is, on a log scale, for the
+//     sender and token, or for the token across senders while the sender
+//     has too few payments to compare with
+//   - new recipient: whether the sender has not paid the recipient before
+//
+// Scores go from 0 to 100 and are written to the risk_score measurement,
+// where the payment processor can look them up before settling. Sender
+// history is kept in memory for RISK_HISTORY, so it starts empty after a
+// restart and early scores are lenient.
+
+const (
+	// riskMinSamples is how many earlier amounts a z-score needs
+	riskMinSamples = 5
+
+	riskVelocityWeight     = 40.0
+	riskAmountWeight       = 40.0
+	riskNewRecipientWeight = 20.0
+)
+
+// RiskSignals is a payment's risk score and the signals behind it
+type RiskSignals struct {
+	PaymentID    uint64    `json:"payment_id"`
+	ChainID      uint64    `json:"chain_id"`
+	Sender       string    `json:"sender"`
+	Score        float64   `json:"score"`
+	Level        string    `json:"level"`
+	Velocity     int64     `json:"velocity"`
+	AmountZScore float64   `json:"amount_zscore"`
+	NewRecipient bool      `json:"new_recipient"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// amountStats is a running mean and variance (Welford) of log10 amounts
+type amountStats struct {
+	count float64
+	mean  float64
+	m2    float64
+}
+
+func (a *amountStats) add(x float64) {
+	a.count++
+	delta := x - a.mean
+	a.mean += delta / a.count
+	a.m2 += delta * (x - a.mean)
+}
+
+// zscore compares x with the amounts seen so far, if there are enough
+func (a *amountStats) zscore(x float64) (float64, bool) {
+	if a == nil || a.count < riskMinSamples {
+		return 0, false
+	}
+	std := math.Sqrt(a.m2 / (a.count - 1))
+	if std == 0 {
+		if x == a.mean {
+			return 0, true
+		}
+		// every earlier amount was the same, so any other is unusual
+		return math.Copysign(10, x-a.mean), true
+	}
+	return (x - a.mean) / std, true
+}
+
+// senderHistory is what the scorer remembers about a sender
+type senderHistory struct {
+	payments   []time.Time
+	amounts    map[string]*amountStats
+	recipients map[string]bool
+	lastSeen   time.Time
+}
+
+// RiskScorer scores payments from the history of their senders
+type RiskScorer struct {
+	window    time.Duration
+	threshold int
+	history   time.Duration
+	senders   map[string]*senderHistory
+	tokens    map[string]*amountStats
+	scored    map[string]time.Time
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+// NewRiskScorer reads RISK_VELOCITY_WINDOW (default 1h), the
+// RISK_VELOCITY_THRESHOLD payments within it that score the full velocity
+// weight (default 10) and RISK_HISTORY (default 720h)
+func NewRiskScorer() *RiskScorer {
+	threshold := getEnvInt("RISK_VELOCITY_THRESHOLD", 10)
+	if threshold < 2 {
+		threshold = 2
+	}
+	return &RiskScorer{
+		window:    envDuration("RISK_VELOCITY_WINDOW", time.Hour),
+		threshold: threshold,
+		history:   envDuration("RISK_HISTORY", 30*24*time.Hour),
+		senders:   make(map[string]*senderHistory),
+		tokens:    make(map[string]*amountStats),
+		scored:    make(map[string]time.Time),
+	}
+}
+
+// Score scores a new payment and adds it to its sender's history. Only
+// pending payments are scored, each once; ok is false for anything else.
+func (r *RiskScorer) Score(metric PaymentMetric) (signals RiskSignals, ok bool) {
+	sender := strings.ToLower(metric.Sender)
+	if metric.Status != "pending" || sender == "" {
+		return signals, false
+	}
+	recipient := strings.ToLower(metric.Recipient)
+	token := strings.ToLower(metric.Token)
+	at := metric.Timestamp
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := fmt.Sprintf("%d:%d", metric.ChainID, metric.PaymentID)
+	if _, seen := r.scored[key]; seen {
+		return signals, false
+	}
+	r.scored[key] = at
+	r.prune(at)
+
+	history, known := r.senders[sender]
+	if !known {
+		history = &senderHistory{amounts: make(map[string]*amountStats), recipients: make(map[string]bool)}
+		r.senders[sender] = history
+	}
+
+	// velocity counts this payment and the sender's others in the window
+	history.payments = append(history.payments, at)
+	var velocity int64
+	for _, paid := range history.payments {
+		if at.Sub(paid) < r.window && paid.Sub(at) < r.window {
+			velocity++
+		}
+	}
+
+	signals = RiskSignals{
+		PaymentID:    metric.PaymentID,
+		ChainID:      metric.ChainID,
+		Sender:       sender,
+		Velocity:     velocity,
+		NewRecipient: known && recipient != "" && !history.recipients[recipient],
+		Timestamp:    at,
+	}
+
+	amount, hasAmount := logAmount(metric.Amount)
+	if hasAmount {
+		z, ok := history.amounts[token].zscore(amount)
+		if !ok {
+			z, _ = r.tokens[token].zscore(amount)
+		}
+		signals.AmountZScore = z
+	}
+
+	velocityRisk := math.Min(1, float64(velocity-1)/float64(r.threshold-1))
+	amountRisk := math.Min(1, math.Max(0, math.Abs(signals.AmountZScore)-1)/3)
+	signals.Score = math.Round(velocityRisk*riskVelocityWeight + amountRisk*riskAmountWeight)
+	if signals.NewRecipient {
+		signals.Score += riskNewRecipientWeight
+	}
+	signals.Level = riskLevel(signals.Score)
+
+	// remember this payment for the ones after it
+	if hasAmount {
+		if history.amounts[token] == nil {
+			history.amounts[token] = &amountStats{}
+		}
+		history.amounts[token].add(amount)
+		if r.tokens[token] == nil {
+			r.tokens[token] = &amountStats{}
+		}
+		r.tokens[token].add(amount)
+	}
+	if recipient != "" {
+		history.recipients[recipient] = true
+	}
+	if at.After(history.lastSeen) {
+		history.lastSeen = at
+	}
+	return signals, true
+}
+
+// prune drops velocity timestamps and scored payments older than the
+// window, and senders idle for longer than the history, at most once a
+// minute
+func (r *RiskScorer) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < time.Minute {
+		return
+	}
+	r.lastPrune = now
+
+	for key, at := range r.scored {
+		if now.Sub(at) > r.window {
+			delete(r.scored, key)
+		}
+	}
+	for sender, history := range r.senders {
+		if now.Sub(history.lastSeen) > r.history {
+			delete(r.senders, sender)
+			continue
+		}
+		recent := history.payments[:0]
+		for _, paid := range history.payments {
+			if now.Sub(paid) < r.window {
+				recent = append(recent, paid)
+			}
+		}
+		history.payments = recent
+	}
+}
+
+func riskLevel(score float64) string {
+	switch {
+	case score >= 70:
+		return "high"
+	case score >= 40:
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+// logAmount is log10 of a base-unit amount, if it is positive
+func logAmount(value string) (float64, bool) {
+	amount, ok := new(big.Float).SetString(value)
+	if !ok || amount.Sign() <= 0 {
+		return 0, false
+	}
+	f, _ := amount.Float64()
+	return math.Log10(f), true
+}
+
+// riskPoint builds the risk_score point of a payment, tagged with its chain,
+// level and merchant
+func riskPoint(signals RiskSignals, metric PaymentMetric) *write.Point {
+	return influxdb2.NewPointWithMeasurement("risk_score").
+		AddTag("chain_id", fmt.Sprintf("%d", signals.ChainID)).
+		AddTag("level", signals.Level).
+		AddTag("merchant", strings.ToLower(metric.Recipient)).
+		AddField("payment_id", signals.PaymentID).
+		AddField("sender", signals.Sender).
+		AddField("score", signals.Score).
+		AddField("velocity", signals.Velocity).
+		AddField("amount_zscore", signals.AmountZScore).
+		AddField("new_recipient", signals.NewRecipient).
+		SetTime(signals.Timestamp)
+}
+
+// scorePayment scores a payment from the stream and records the score
+func (s *AnalyticsServer) scorePayment(metric PaymentMetric) {
+	signals, ok := s.risk.Score(metric)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.writer.WritePoint(ctx, riskPoint(signals, metric)); err != nil {
+		log.Printf("Failed to write risk score for payment %d: %v", metric.PaymentID, err)
+		return
+	}
+	if signals.Level == "high" {
+		log.Printf("High risk payment %d on chain %d: score=%.0f velocity=%d amount_zscore=%.2f new_recipient=%t",
+			signals.PaymentID, signals.ChainID, signals.Score, signals.Velocity, signals.AmountZScore, signals.NewRecipient)
+	}
+}
+
+// handlePaymentRisk serves the latest risk score of a payment, of one chain
+// with ?chain_id=
+func (s *AnalyticsServer) handlePaymentRisk(w http.ResponseWriter, r *http.Request) {
+	paymentID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return
+	}
+	chainFilter := ""
+	if chainID := r.URL.Query().Get("chain_id"); chainID != "" {
+		if _, err := strconv.ParseUint(chainID, 10, 64); err != nil {
+			http.Error(w, "Invalid chain_id", http.StatusBadRequest)
+			return
+		}
+		chainFilter = fmt.Sprintf("\n\t|> filter(fn: (r) => r.chain_id == %q)", chainID)
+	}
+
+	flux := fmt.Sprintf(`from(bucket: %q)
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == "risk_score")%s
+	|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+	|> filter(fn: (r) => r.payment_id == uint(v: %d))
+	|> group()
+	|> sort(columns: ["_time"], desc: true)
+	|> limit(n: 1)`, s.storage.bucket, fluxDuration(s.risk.history), chainFilter, paymentID)
+
+	result, err := s.queryAPI.Query(r.Context(), flux)
+	if err != nil {
+		log.Printf("Risk query error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	if !result.Next() {
+		if result.Err() != nil {
+			log.Printf("Risk query result error: %v", result.Err())
+			http.Error(w, "Query processing failed", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Payment not scored", http.StatusNotFound)
+		return
+	}
+
+	record := result.Record()
+	signals := RiskSignals{PaymentID: paymentID, Timestamp: record.Time()}
+	signals.ChainID, _ = strconv.ParseUint(fmt.Sprint(record.ValueByKey("chain_id")), 10, 64)
+	signals.Level, _ = record.ValueByKey("level").(string)
+	signals.Sender, _ = record.ValueByKey("sender").(string)
+	signals.Score, _ = record.ValueByKey("score").(float64)
+	signals.Velocity, _ = record.ValueByKey("velocity").(int64)
+	signals.AmountZScore, _ = record.ValueByKey("amount_zscore").(float64)
+	signals.NewRecipient, _ = record.ValueByKey("new_recipient").(bool)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: signals})
+}
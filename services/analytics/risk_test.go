@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRiskLevel(t *testing.T) {
+	for _, tc := range []struct {
+		score float64
+		level string
+	}{
+		{0, "low"},
+		{39, "low"},
+		{39.5, "low"},
+		{40, "medium"},
+		{69, "medium"},
+		{69.9, "medium"},
+		{70, "high"},
+		{100, "high"},
+	} {
+		assert.Equal(t, tc.level, riskLevel(tc.score), "score %v", tc.score)
+	}
+}
+
+func TestRiskScorer(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	sender := "0x00000000000000000000000000000000000000A1"
+	merchant := "0x00000000000000000000000000000000000000B2"
+	token := "0x0000000000000000000000000000000000000000"
+
+	// payment is the id-th pending payment of sender to recipient at
+	payment := func(id uint64, recipient, amount string, at time.Time) PaymentMetric {
+		return PaymentMetric{
+			PaymentID: id, ChainID: 4202, Status: "pending", Sender: sender, Recipient: recipient,
+			Token: token, Amount: amount, Timestamp: at,
+		}
+	}
+	score := func(t *testing.T, scorer *RiskScorer, metric PaymentMetric) RiskSignals {
+		signals, ok := scorer.Score(metric)
+		require.True(t, ok)
+		return signals
+	}
+
+	t.Run("should weigh velocity up to the threshold", func(t *testing.T) {
+		for _, tc := range []struct {
+			payments int
+			score    float64
+			level    string
+		}{
+			{1, 0, "low"},
+			{2, 4, "low"},
+			{5, 18, "low"},
+			{9, 36, "low"},
+			{10, 40, "medium"},
+			{11, 40, "medium"},
+			{30, 40, "medium"},
+		} {
+			scorer := NewRiskScorer()
+			var signals RiskSignals
+			for i := 0; i < tc.payments; i++ {
+				signals = score(t, scorer, payment(uint64(i+1), merchant, "", start.Add(time.Duration(i)*time.Minute)))
+			}
+			assert.Equal(t, int64(tc.payments), signals.Velocity, "%d payments", tc.payments)
+			assert.Equal(t, tc.score, signals.Score, "%d payments", tc.payments)
+			assert.Equal(t, tc.level, signals.Level, "%d payments", tc.payments)
+		}
+	})
+
+	t.Run("should only count payments within the velocity window", func(t *testing.T) {
+		for _, tc := range []struct {
+			gap      time.Duration
+			velocity int64
+		}{
+			{59 * time.Minute, 2},
+			{time.Hour - time.Nanosecond, 2},
+			{time.Hour, 1},
+			{2 * time.Hour, 1},
+		} {
+			scorer := NewRiskScorer()
+			score(t, scorer, payment(1, merchant, "", start))
+			signals := score(t, scorer, payment(2, merchant, "", start.Add(tc.gap)))
+			assert.Equal(t, tc.velocity, signals.Velocity, "gap %s", tc.gap)
+		}
+	})
+
+	t.Run("should weigh amounts from one to four deviations away", func(t *testing.T) {
+		// log10 amounts 1, 3, 1, 3 and 2 have a mean of 2 and a deviation
+		// of 1, so each payment's z-score is its log10 amount minus 2
+		history := []string{"10", "1000", "10", "1000", "100"}
+
+		for _, tc := range []struct {
+			amount string
+			zscore float64
+			score  float64
+		}{
+			{"100", 0, 0},
+			{"1000", 1, 0},
+			{"10", -1, 0},
+			{"10000", 2, 13},
+			{"1", -2, 13},
+			{"100000", 3, 27},
+			{"1000000", 4, 40},
+			{"100000000", 6, 40},
+			{"0.000001", -8, 40},
+		} {
+			scorer := NewRiskScorer()
+			for i, amount := range history {
+				score(t, scorer, payment(uint64(i+1), merchant, amount, start.Add(time.Duration(i)*2*time.Hour)))
+			}
+
+			signals := score(t, scorer, payment(10, merchant, tc.amount, start.Add(12*time.Hour)))
+			assert.InDelta(t, tc.zscore, signals.AmountZScore, 1e-9, tc.amount)
+			assert.Equal(t, int64(1), signals.Velocity, tc.amount)
+			assert.Equal(t, tc.score, signals.Score, tc.amount)
+		}
+	})
+
+	t.Run("should compare amounts with the token until the sender has enough", func(t *testing.T) {
+		for _, tc := range []struct {
+			name   string
+			others int
+			own    int
+			zscore float64
+		}{
+			{name: "no history", zscore: 0},
+			{name: "too few payments of the token", others: riskMinSamples - 1, zscore: 0},
+			{name: "token history", others: riskMinSamples, zscore: 10},
+			{name: "too few of the sender's own", others: riskMinSamples, own: riskMinSamples - 1, zscore: 1.05409},
+			{name: "sender history", others: riskMinSamples, own: riskMinSamples, zscore: 0},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				scorer := NewRiskScorer()
+				id := uint64(0)
+				for i := 0; i < tc.others; i++ {
+					id++
+					other := payment(id, merchant, "100", start.Add(time.Duration(id)*2*time.Hour))
+					other.Sender = fmt.Sprintf("0x%040d", id)
+					score(t, scorer, other)
+				}
+				for i := 0; i < tc.own; i++ {
+					id++
+					score(t, scorer, payment(id, merchant, "1000", start.Add(time.Duration(id)*2*time.Hour)))
+				}
+
+				signals := score(t, scorer, payment(id+1, merchant, "1000", start.Add(time.Duration(id+1)*2*time.Hour)))
+				assert.InDelta(t, tc.zscore, signals.AmountZScore, 1e-5)
+			})
+		}
+	})
+
+	t.Run("should add the new recipient weight to known senders", func(t *testing.T) {
+		scorer := NewRiskScorer()
+		first := score(t, scorer, payment(1, merchant, "", start))
+		assert.False(t, first.NewRecipient)
+
+		for _, tc := range []struct {
+			recipient string
+			new       bool
+			score     float64
+		}{
+			{merchant, false, 0},
+			{"0x00000000000000000000000000000000000000b2", false, 0},
+			{"0x00000000000000000000000000000000000000C3", true, 20},
+			{"", false, 0},
+		} {
+			scorer := NewRiskScorer()
+			score(t, scorer, payment(1, merchant, "", start))
+			signals := score(t, scorer, payment(2, tc.recipient, "", start.Add(2*time.Hour)))
+			assert.Equal(t, tc.new, signals.NewRecipient, tc.recipient)
+			assert.Equal(t, tc.score, signals.Score, tc.recipient)
+		}
+	})
+
+	t.Run("should reach 100 with every signal at its weight", func(t *testing.T) {
+		scorer := NewRiskScorer()
+		for i := 0; i < 9; i++ {
+			score(t, scorer, payment(uint64(i+1), merchant, "100", start.Add(time.Duration(i)*time.Minute)))
+		}
+
+		signals := score(t, scorer, payment(10, "0x00000000000000000000000000000000000000c3", "1000000", start.Add(10*time.Minute)))
+		assert.Equal(t, float64(100), signals.Score)
+		assert.Equal(t, "high", signals.Level)
+	})
+
+	t.Run("should reach the full velocity weight at no fewer than two payments", func(t *testing.T) {
+		for _, tc := range []struct {
+			threshold string
+			payments  int
+			score     float64
+		}{
+			{"1", 2, 40},
+			{"2", 2, 40},
+			{"3", 2, 20},
+			{"5", 3, 20},
+			{"ten", 6, 22},
+		} {
+			t.Setenv("RISK_VELOCITY_THRESHOLD", tc.threshold)
+			scorer := NewRiskScorer()
+			var signals RiskSignals
+			for i := 0; i < tc.payments; i++ {
+				signals = score(t, scorer, payment(uint64(i+1), merchant, "", start.Add(time.Duration(i)*time.Minute)))
+			}
+			assert.Equal(t, tc.score, signals.Score, "threshold %s", tc.threshold)
+		}
+	})
+
+	t.Run("should score each pending payment once", func(t *testing.T) {
+		scorer := NewRiskScorer()
+		_, ok := scorer.Score(payment(1, merchant, "100", start))
+		assert.True(t, ok)
+		_, ok = scorer.Score(payment(1, merchant, "100", start.Add(time.Minute)))
+		assert.False(t, ok)
+
+		completed := payment(2, merchant, "100", start)
+		completed.Status = "completed"
+		_, ok = scorer.Score(completed)
+		assert.False(t, ok)
+
+		anonymous := payment(3, merchant, "100", start)
+		anonymous.Sender = ""
+		_, ok = scorer.Score(anonymous)
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// s3Object is an upload an s3Stub received
+type s3Object struct {
+	path    string
+	header  http.Header
+	content []byte
+}
+
+// s3Stub accepts PUTs of objects, answering status with body when status
+// is set
+type s3Stub struct {
+	mu      sync.Mutex
+	objects []s3Object
+	status  int
+	body    string
+}
+
+// newS3Stub starts an s3Stub and returns a path-style client of its
+// "exports" bucket
+func newS3Stub(t *testing.T) (*s3Stub, *S3Client) {
+	stub := &s3Stub{}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	return stub, NewS3Client(server.URL, "eu-west-1", "exports", "AKIDEXAMPLE", "secret", true)
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.status != 0 {
+		http.Error(w, s.body, s.status)
+		return
+	}
+	content, _ := io.ReadAll(r.Body)
+	s.objects = append(s.objects, s3Object{path: r.URL.EscapedPath(), header: r.Header.Clone(), content: content})
+}
+
+// uploaded returns the objects uploaded so far
+func (s *s3Stub) uploaded() []s3Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]s3Object(nil), s.objects...)
+}
+
+func TestS3Client(t *testing.T) {
+	t.Run("should upload signed objects under their escaped key", func(t *testing.T) {
+		stub, client := newS3Stub(t)
+
+		require.NoError(t, client.Put(context.Background(), "exports/job 1/payments.csv", "text/csv", []byte("time,field,value\n")))
+		objects := stub.uploaded()
+		require.Len(t, objects, 1)
+		object := objects[0]
+		assert.Equal(t, "/exports/exports/job%201/payments.csv", object.path)
+		assert.Equal(t, "time,field,value\n", string(object.content))
+		assert.Equal(t, "text/csv", object.header.Get("Content-Type"))
+		assert.Equal(t, sha256Hex(object.content), object.header.Get("X-Amz-Content-Sha256"))
+
+		authorization := object.header.Get("Authorization")
+		day := time.Now().UTC().Format("20060102")
+		assert.True(t, strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"+day+"/eu-west-1/s3/aws4_request, "), authorization)
+		assert.Contains(t, authorization, "SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date, ")
+	})
+
+	t.Run("should report the status and body of rejected uploads", func(t *testing.T) {
+		for _, tc := range []struct {
+			status int
+			body   string
+		}{
+			{http.StatusForbidden, "<Error><Code>SignatureDoesNotMatch</Code></Error>"},
+			{http.StatusNotFound, "<Error><Code>NoSuchBucket</Code></Error>"},
+			{http.StatusServiceUnavailable, "<Error><Code>SlowDown</Code></Error>"},
+		} {
+			stub, client := newS3Stub(t)
+			stub.status, stub.body = tc.status, tc.body
+
+			err := client.Put(context.Background(), "payments.csv", "text/csv", []byte("data"))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), fmt.Sprintf("s3 put failed with status %d", tc.status))
+			assert.Contains(t, err.Error(), tc.body)
+		}
+	})
+
+	t.Run("should fail when the endpoint cannot be reached", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+		client := NewS3Client(server.URL, "", "exports", "AKIDEXAMPLE", "secret", true)
+
+		err := client.Put(context.Background(), "payments.csv", "text/csv", []byte("data"))
+		assert.ErrorContains(t, err, "s3 put failed: ")
+	})
+
+	t.Run("should presign links that expire after at most 7 days", func(t *testing.T) {
+		_, client := newS3Stub(t)
+
+		for _, tc := range []struct {
+			ttl     time.Duration
+			expires string
+			valid   time.Duration
+		}{
+			{time.Hour, "3600", time.Hour},
+			{maxPresignTTL, "604800", maxPresignTTL},
+			{30 * 24 * time.Hour, "604800", maxPresignTTL},
+		} {
+			link, expiresAt := client.PresignGet("exports/job/payments.csv", tc.ttl)
+			parsed, err := url.Parse(link)
+			require.NoError(t, err)
+			assert.Equal(t, "/exports/exports/job/payments.csv", parsed.Path)
+
+			query := parsed.Query()
+			assert.Equal(t, tc.expires, query.Get("X-Amz-Expires"))
+			assert.Equal(t, "host", query.Get("X-Amz-SignedHeaders"))
+			assert.Len(t, query.Get("X-Amz-Signature"), 64)
+			assert.WithinDuration(t, time.Now().Add(tc.valid), expiresAt, time.Minute)
+			assert.True(t, strings.HasSuffix(parsed.RawQuery, "&X-Amz-Signature="+query.Get("X-Amz-Signature")))
+		}
+	})
+
+	t.Run("should address buckets by host unless path style is set", func(t *testing.T) {
+		client := NewS3Client("", "eu-west-1", "exports", "AKIDEXAMPLE", "secret", false)
+		assert.Equal(t, "https://exports.s3.eu-west-1.amazonaws.com/a/b%20c.csv", client.objectURL("a/b c.csv"))
+
+		client = NewS3Client("http://minio:9000/", "", "exports", "AKIDEXAMPLE", "secret", true)
+		assert.Equal(t, "http://minio:9000/exports/a/b%20c.csv", client.objectURL("a/b c.csv"))
+	})
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Every ingested metric, POSTed or published on the event bus, is checked
+// against the schema of its type before it is written. A metric names its
+// schema with schema_version, and one without it is read as the latest.
+// Metrics with missing or unknown fields, amounts that are not base-10
+// integers, statuses outside their enum or timestamps from the future are
+// rejected whole rather than written with junk tags: POSTs answer 400 and
+// the event bus drops them without redelivering.
+
+// maxMetricSize bounds the body of a POSTed metric
+const maxMetricSize = 64 << 10
+
+// maxMetricClockSkew is how far ahead of this instance's clock a metric's
+// timestamp may be
+const maxMetricClockSkew = 5 * time.Minute
+
+// maxAmount is the largest amount a uint256 holds
+var maxAmount = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// Field kinds a schema checks values against
+const (
+	fieldUint    = "uint"    // non-negative JSON integer
+	fieldNumber  = "number"  // JSON number, within Min and Max
+	fieldBool    = "bool"    // JSON boolean
+	fieldString  = "string"  // JSON string
+	fieldAmount  = "amount"  // base-10 uint256 as a string
+	fieldAddress = "address" // 0x-prefixed hex address
+	fieldEnum    = "enum"    // one of Values
+	fieldTime    = "time"    // RFC 3339 timestamp, not in the future
+	fieldDay     = "day"     // UTC date as YYYY-MM-DD
+)
+
+// SchemaField is one field of a metric schema
+type SchemaField struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`
+	Required bool     `json:"required,omitempty"`
+	Values   []string `json:"values,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+}
+
+// MetricSchema is one version of the fields a metric type accepts
+type MetricSchema struct {
+	Metric  string        `json:"metric"`
+	Version int           `json:"version"`
+	Fields  []SchemaField `json:"fields"`
+}
+
+// SchemaError lists every way a metric breaks its schema
+type SchemaError struct {
+	Metric   string
+	Version  int
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s metric does not match schema v%d: %s", e.Metric, e.Version, strings.Join(e.Problems, "; "))
+}
+
+// Unwrap makes a SchemaError a malformed metric, so the event bus drops it
+func (e *SchemaError) Unwrap() error {
+	return errMalformedMetric
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+// paymentStatuses are the states a payment metric can report
+var paymentStatuses = []string{"pending", "validated", "completed", "failed", "refunded", "cancelled"}
+
+// validatorStatuses are the states a validator metric can report, as the
+// relay network and the indexer report them
+var validatorStatuses = []string{"unregistered", "pending", "active", "exiting", "unbonding", "exited", "slashed"}
+
+// metricSchemas are the schemas of each metric type, by version. The last
+// one is the latest.
+var metricSchemas = map[string][]MetricSchema{
+	"payment": {{Metric: "payment", Version: 1, Fields: []SchemaField{
+		{Name: "payment_id", Kind: fieldUint, Required: true},
+		{Name: "chain_id", Kind: fieldUint, Required: true, Min: bound(1)},
+		{Name: "sender", Kind: fieldAddress, Required: true},
+		{Name: "recipient", Kind: fieldAddress, Required: true},
+		{Name: "token", Kind: fieldAddress, Required: true},
+		{Name: "amount", Kind: fieldAmount, Required: true},
+		{Name: "fee", Kind: fieldAmount},
+		{Name: "status", Kind: fieldEnum, Required: true, Values: paymentStatuses},
+		{Name: "is_private", Kind: fieldBool},
+		{Name: "required_sigs", Kind: fieldUint},
+		{Name: "received_sigs", Kind: fieldUint},
+		{Name: "timestamp", Kind: fieldTime, Required: true},
+		{Name: "completed_at", Kind: fieldTime},
+		{Name: "processing_time_ms", Kind: fieldNumber, Min: bound(0)},
+		{Name: "client_ip", Kind: fieldString},
+		{Name: "country", Kind: fieldString},
+		{Name: "region", Kind: fieldString},
+		{Name: "asn", Kind: fieldString},
+		{Name: "amount_usd", Kind: fieldNumber, Min: bound(0)},
+		{Name: "fee_usd", Kind: fieldNumber, Min: bound(0)},
+		{Name: "usd_rate", Kind: fieldNumber, Min: bound(0)},
+	}}},
+	"validator": {{Metric: "validator", Version: 1, Fields: []SchemaField{
+		{Name: "validator_address", Kind: fieldAddress, Required: true},
+		{Name: "chain_id", Kind: fieldUint, Required: true, Min: bound(1)},
+		{Name: "stake", Kind: fieldAmount},
+		{Name: "status", Kind: fieldEnum, Required: true, Values: validatorStatuses},
+		{Name: "event", Kind: fieldEnum, Values: []string{"signed", "registered", "slashed", "exited"}},
+		{Name: "response_time_ms", Kind: fieldNumber, Min: bound(0)},
+		{Name: "timestamp", Kind: fieldTime, Required: true},
+	}}},
+	"vault": {{Metric: "vault", Version: 1, Fields: []SchemaField{
+		{Name: "vault_address", Kind: fieldAddress, Required: true},
+		{Name: "chain_id", Kind: fieldUint, Required: true, Min: bound(1)},
+		{Name: "tranche_type", Kind: fieldEnum, Required: true, Values: trancheNames},
+		{Name: "total_assets", Kind: fieldAmount, Required: true},
+		{Name: "utilization_pct", Kind: fieldNumber, Min: bound(0), Max: bound(100)},
+		{Name: "apy", Kind: fieldNumber, Min: bound(-100)},
+		{Name: "risk_score", Kind: fieldNumber, Min: bound(0), Max: bound(100)},
+		{Name: "slashing_events", Kind: fieldUint},
+		{Name: "slash_loss", Kind: fieldAmount},
+		{Name: "timestamp", Kind: fieldTime, Required: true},
+	}}},
+	"gas-budget": {{Metric: "gas-budget", Version: 1, Fields: []SchemaField{
+		{Name: "merchant", Kind: fieldAddress, Required: true},
+		{Name: "chain_id", Kind: fieldUint, Required: true, Min: bound(1)},
+		{Name: "day", Kind: fieldDay, Required: true},
+		{Name: "spent", Kind: fieldAmount, Required: true},
+		{Name: "budget", Kind: fieldAmount},
+		{Name: "used_pct", Kind: fieldNumber, Min: bound(0)},
+		{Name: "timestamp", Kind: fieldTime, Required: true},
+	}}},
+	"signature": {{Metric: "signature", Version: 1, Fields: []SchemaField{
+		{Name: "request_id", Kind: fieldUint, Required: true},
+		{Name: "payment_id", Kind: fieldUint, Required: true},
+		{Name: "chain_id", Kind: fieldUint, Required: true, Min: bound(1)},
+		{Name: "validator_address", Kind: fieldAddress, Required: true},
+		{Name: "event", Kind: fieldEnum, Required: true, Values: signatureEvents},
+		{Name: "signatures", Kind: fieldUint},
+		{Name: "required_signatures", Kind: fieldUint},
+		{Name: "latency_ms", Kind: fieldNumber, Min: bound(0)},
+		{Name: "tx_hash", Kind: fieldString},
+		{Name: "timestamp", Kind: fieldTime, Required: true},
+	}}},
+	"receipt": {{Metric: "receipt", Version: 1, Fields: []SchemaField{
+		{Name: "payment_id", Kind: fieldUint, Required: true},
+		{Name: "chain_id", Kind: fieldUint, Min: bound(1)},
+		{Name: "format", Kind: fieldEnum, Required: true, Values: []string{"json", "pdf"}},
+		{Name: "language", Kind: fieldString, Required: true},
+		{Name: "source", Kind: fieldEnum, Required: true, Values: []string{"api", "queue"}},
+		{Name: "status", Kind: fieldEnum, Required: true, Values: receiptStatuses},
+		{Name: "failure_reason", Kind: fieldEnum, Values: receiptFailureReasons},
+		{Name: "size_bytes", Kind: fieldUint},
+		{Name: "cost_fil", Kind: fieldNumber, Min: bound(0)},
+		{Name: "duration_ms", Kind: fieldNumber, Min: bound(0)},
+		{Name: "timestamp", Kind: fieldTime, Required: true},
+	}}},
+}
+
+// schemaFor returns the schema a metric of the given type and version is
+// checked against, the latest when version is 0
+func schemaFor(metric string, version int) (MetricSchema, error) {
+	schemas, ok := metricSchemas[metric]
+	if !ok {
+		return MetricSchema{}, fmt.Errorf("%w: unknown metric type %s", errMalformedMetric, metric)
+	}
+	if version == 0 {
+		return schemas[len(schemas)-1], nil
+	}
+	for _, schema := range schemas {
+		if schema.Version == version {
+			return schema, nil
+		}
+	}
+	return MetricSchema{}, &SchemaError{Metric: metric, Version: version, Problems: []string{"unknown schema_version"}}
+}
+
+// decodeMetric checks data against the schema of its metric type and
+// decodes it into metric
+func decodeMetric(metricType string, data []byte, metric interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("%w: %v", errMalformedMetric, err)
+	}
+
+	version := 0
+	if raw, ok := fields["schema_version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil || version < 1 {
+			return &SchemaError{Metric: metricType, Problems: []string{"schema_version: must be a positive integer"}}
+		}
+		delete(fields, "schema_version")
+	}
+	schema, err := schemaFor(metricType, version)
+	if err != nil {
+		return err
+	}
+	if problems := schema.check(fields, time.Now()); len(problems) > 0 {
+		return &SchemaError{Metric: metricType, Version: schema.Version, Problems: problems}
+	}
+
+	if err := json.Unmarshal(data, metric); err != nil {
+		return &SchemaError{Metric: metricType, Version: schema.Version, Problems: []string{err.Error()}}
+	}
+	return nil
+}
+
+// check returns the problems with a metric's fields, in field order. Null
+// and empty string values count as missing.
+func (s MetricSchema) check(fields map[string]json.RawMessage, now time.Time) []string {
+	var problems []string
+	known := make(map[string]bool, len(s.Fields))
+	for _, field := range s.Fields {
+		known[field.Name] = true
+		raw, ok := fields[field.Name]
+		if !ok || string(raw) == "null" || string(raw) == `""` {
+			if field.Required {
+				problems = append(problems, field.Name+": is required")
+			}
+			continue
+		}
+		if problem := field.check(raw, now); problem != "" {
+			problems = append(problems, field.Name+": "+problem)
+		}
+	}
+
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, name+": is not a field of this schema")
+	}
+	return problems
+}
+
+// check returns what is wrong with a field's value, or "" if nothing is
+func (f SchemaField) check(raw json.RawMessage, now time.Time) string {
+	var text string
+	switch f.Kind {
+	case fieldString, fieldAmount, fieldAddress, fieldEnum, fieldTime, fieldDay:
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return "must be a string"
+		}
+	}
+
+	switch f.Kind {
+	case fieldUint, fieldNumber:
+		if raw[0] == '"' {
+			return "must be a number"
+		}
+		var value float64
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "must be a number"
+		}
+		if f.Kind == fieldUint && (value < 0 || value != math.Trunc(value)) {
+			return "must be a non-negative integer"
+		}
+		if f.Min != nil && value < *f.Min {
+			return fmt.Sprintf("must be at least %g", *f.Min)
+		}
+		if f.Max != nil && value > *f.Max {
+			return fmt.Sprintf("must be at most %g", *f.Max)
+		}
+	case fieldBool:
+		var value bool
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "must be true or false"
+		}
+	case fieldAmount:
+		amount, ok := new(big.Int).SetString(text, 10)
+		if !ok {
+			return "must be a base-10 integer"
+		}
+		if amount.Sign() < 0 || amount.Cmp(maxAmount) > 0 {
+			return "must be between 0 and 2^256-1"
+		}
+	case fieldAddress:
+		if !strings.HasPrefix(text, "0x") || !common.IsHexAddress(text) {
+			return "must be a 0x-prefixed hex address"
+		}
+	case fieldEnum:
+		for _, value := range f.Values {
+			if text == value {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(f.Values, ", ")
+	case fieldTime:
+		at, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return "must be an RFC 3339 timestamp"
+		}
+		if at.After(now.Add(maxMetricClockSkew)) {
+			return "is in the future"
+		}
+	case fieldDay:
+		if _, err := time.Parse("2006-01-02", text); err != nil {
+			return "must be a date as YYYY-MM-DD"
+		}
+	}
+	return ""
+}
+
+// decodeMetricRequest reads a POSTed metric into metric, answering 400 when
+// it is not JSON or breaks its schema. It reports whether metric was read.
+func (s *AnalyticsServer) decodeMetricRequest(w http.ResponseWriter, r *http.Request, metricType string, metric interface{}) bool {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxMetricSize))
+	if err == nil {
+		err = decodeMetric(metricType, data, metric)
+	}
+	if err == nil {
+		return true
+	}
+
+	s.ingest.CountInvalid()
+	var schemaErr *SchemaError
+	if errors.As(err, &schemaErr) {
+		log.Printf("Rejecting %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	return false
+}
+
+// handleMetricSchemas serves every version of each metric type's schema
+func (s *AnalyticsServer) handleMetricSchemas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: metricSchemas})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMetric(t *testing.T) {
+	payment := func(fields string) []byte {
+		return []byte(`{"payment_id": 1, "chain_id": 1, "sender": "0x742d35Cc6634C0532925a3b844Bc454e4438f44e",
+			"recipient": "0x8ba1f109551bD432803012645Ac136ddd64DBA72", "token": "0x0000000000000000000000000000000000000000",
+			"amount": "1000000", "timestamp": "2026-03-01T12:00:00Z"` + fields + `}`)
+	}
+
+	t.Run("should decode a metric that matches its schema", func(t *testing.T) {
+		var metric PaymentMetric
+		require.NoError(t, decodeMetric("payment", payment(`, "status": "completed", "schema_version": 1`), &metric))
+		assert.Equal(t, uint64(1), metric.PaymentID)
+		assert.Equal(t, "1000000", metric.Amount)
+		assert.Equal(t, "completed", metric.Status)
+	})
+
+	t.Run("should list every problem with a metric", func(t *testing.T) {
+		var metric PaymentMetric
+		err := decodeMetric("payment", payment(`, "status": "lost", "amount_usd": -1, "referrer": "x"`), &metric)
+
+		var schemaErr *SchemaError
+		require.ErrorAs(t, err, &schemaErr)
+		assert.Equal(t, 1, schemaErr.Version)
+		assert.Equal(t, []string{
+			"status: must be one of pending, validated, completed, failed, refunded, cancelled",
+			"amount_usd: must be at least 0",
+			"referrer: is not a field of this schema",
+		}, schemaErr.Problems)
+		assert.True(t, errors.Is(err, errMalformedMetric))
+	})
+
+	t.Run("should require fields and reject bad amounts", func(t *testing.T) {
+		var metric PaymentMetric
+		err := decodeMetric("payment", []byte(`{"payment_id": 1, "chain_id": 1, "amount": "1e18", "status": "pending"}`), &metric)
+
+		var schemaErr *SchemaError
+		require.ErrorAs(t, err, &schemaErr)
+		assert.Contains(t, schemaErr.Problems, "sender: is required")
+		assert.Contains(t, schemaErr.Problems, "timestamp: is required")
+		assert.Len(t, schemaErr.Problems, 5)
+	})
+
+	t.Run("should reject timestamps from the future", func(t *testing.T) {
+		schema, err := schemaFor("payment", 0)
+		require.NoError(t, err)
+		now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+		field := schema.Fields[len(schema.Fields)-1]
+		for _, f := range schema.Fields {
+			if f.Name == "timestamp" {
+				field = f
+			}
+		}
+		assert.Empty(t, field.check([]byte(`"2026-03-01T12:04:00Z"`), now))
+		assert.NotEmpty(t, field.check([]byte(`"2026-03-01T13:00:00Z"`), now))
+	})
+
+	t.Run("should reject unknown types and versions", func(t *testing.T) {
+		var metric PaymentMetric
+		assert.ErrorIs(t, decodeMetric("refund", payment(""), &metric), errMalformedMetric)
+
+		err := decodeMetric("payment", payment(`, "status": "completed", "schema_version": 9`), &metric)
+		assert.ErrorContains(t, err, "unknown schema_version")
+	})
+}
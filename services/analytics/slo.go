@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+)
+
+// Payment completion times are summarized as percentiles per chain and
+// token, every PAYMENT_SLO_INTERVAL_SECONDS, over the windows raw payments
+// are kept for. Percentiles cannot be derived from rollups, which average
+// processing_time_ms, so only raw completed payments with a processing time
+// are read. Each p95 is checked against PAYMENT_SLO_P95_MS, and the default
+// payment_latency_slo alert rule fires on the same target.
+
+// defaultPaymentSLOP95Ms is the p95 completion time target without
+// PAYMENT_SLO_P95_MS
+const defaultPaymentSLOP95Ms = 30000
+
+// PaymentLatency is the completion time percentiles of one chain and token
+// over a window
+type PaymentLatency struct {
+	ChainID  string  `json:"chain_id"`
+	Token    string  `json:"token"`
+	Payments int64   `json:"payments"`
+	P50Ms    float64 `json:"p50_ms"`
+	P95Ms    float64 `json:"p95_ms"`
+	P99Ms    float64 `json:"p99_ms"`
+	SLOMet   bool    `json:"slo_met"`
+}
+
+// PaymentSLOReport is the latest percentiles over one window
+type PaymentSLOReport struct {
+	Window      string           `json:"window"`
+	TargetP95Ms float64          `json:"target_p95_ms"`
+	ComputedAt  time.Time        `json:"computed_at"`
+	Latencies   []PaymentLatency `json:"latencies"`
+}
+
+// PaymentSLO keeps the latest completion time percentiles
+type PaymentSLO struct {
+	queryAPI api.QueryAPI
+	bucket   string
+	storage  *Storage
+	target   float64
+	now      func() time.Time
+
+	mu      sync.RWMutex
+	reports map[string]*PaymentSLOReport
+}
+
+// NewPaymentSLO checks p95 completion times against PAYMENT_SLO_P95_MS
+func NewPaymentSLO(queryAPI api.QueryAPI, bucket string, storage *Storage) *PaymentSLO {
+	target := float64(defaultPaymentSLOP95Ms)
+	if value := getEnv("PAYMENT_SLO_P95_MS", ""); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 {
+			log.Printf("Ignoring invalid PAYMENT_SLO_P95_MS=%q", value)
+		} else {
+			target = parsed
+		}
+	}
+	return &PaymentSLO{queryAPI: queryAPI, bucket: bucket, storage: storage, target: target, now: time.Now, reports: make(map[string]*PaymentSLOReport)}
+}
+
+// AlertRule fires when a chain and token's p95 completion time over 15
+// minutes is above the target
+func (p *PaymentSLO) AlertRule() AlertRule {
+	return AlertRule{
+		Name: "payment_latency_slo", Type: RuleThreshold, Severity: "warning",
+		Description: fmt.Sprintf("p95 payment completion time above %gms", p.target),
+		Measurement: "payments", Field: "processing_time_ms", Aggregate: "p95", Filters: map[string]string{"status": "completed"},
+		GroupBy: []string{"chain_id", "token"}, Operator: ">", Value: p.target, Window: Duration(15 * time.Minute),
+	}
+}
+
+// Run computes the percentiles every interval until ctx is done
+func (p *PaymentSLO) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	p.run(ctx, ticker.C)
+}
+
+// run computes the percentiles now and on every tick until ctx is done
+func (p *PaymentSLO) run(ctx context.Context, ticks <-chan time.Time) {
+	for {
+		if err := p.Compute(ctx, p.now()); err != nil {
+			log.Printf("Failed to compute payment latency percentiles: %v", err)
+		}
+		select {
+		case <-ticks:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Compute refreshes the percentiles of every window retained raw
+func (p *PaymentSLO) Compute(ctx context.Context, now time.Time) error {
+	for _, window := range validatorWindows {
+		rng := timeRangeDuration(window)
+		if keep := p.storage.retention["payments"]["raw"]; keep != 0 && keep < rng {
+			continue
+		}
+		latencies, err := p.latencies(ctx, rng)
+		if err != nil {
+			return fmt.Errorf("window %s: %w", window, err)
+		}
+
+		p.mu.Lock()
+		p.reports[window] = &PaymentSLOReport{Window: window, TargetP95Ms: p.target, ComputedAt: now, Latencies: latencies}
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// latencies reads the count and percentiles of each chain and token's
+// completion times over the last rng
+func (p *PaymentSLO) latencies(ctx context.Context, rng time.Duration) ([]PaymentLatency, error) {
+	flux := fmt.Sprintf(`data = from(bucket: %q)
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == "payments" and r._field == "processing_time_ms" and r.status == "completed" and r._value > 0)
+	|> group(columns: ["chain_id", "token"])
+data |> count() |> yield(name: "count")
+data |> quantile(q: 0.5, method: "estimate_tdigest") |> yield(name: "p50")
+data |> quantile(q: 0.95, method: "estimate_tdigest") |> yield(name: "p95")
+data |> quantile(q: 0.99, method: "estimate_tdigest") |> yield(name: "p99")`,
+		p.bucket, fluxDuration(rng))
+
+	result, err := p.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct{ chainID, token string }
+	latencies := make(map[key]*PaymentLatency)
+	for result.Next() {
+		record := result.Record()
+		chainID, _ := record.ValueByKey("chain_id").(string)
+		token, _ := record.ValueByKey("token").(string)
+		entry, ok := latencies[key{chainID, token}]
+		if !ok {
+			entry = &PaymentLatency{ChainID: chainID, Token: token}
+			latencies[key{chainID, token}] = entry
+		}
+
+		value := 0.0
+		switch v := record.Value().(type) {
+		case float64:
+			value = v
+		case int64:
+			value = float64(v)
+		}
+		switch record.Result() {
+		case "count":
+			entry.Payments = int64(value)
+		case "p50":
+			entry.P50Ms = value
+		case "p95":
+			entry.P95Ms = value
+		case "p99":
+			entry.P99Ms = value
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	list := make([]PaymentLatency, 0, len(latencies))
+	for _, entry := range latencies {
+		entry.SLOMet = entry.P95Ms <= p.target
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ChainID != list[j].ChainID {
+			return list[i].ChainID < list[j].ChainID
+		}
+		return list[i].Token < list[j].Token
+	})
+	return list, nil
+}
+
+// Report returns the latest percentiles over window, on one chain and for
+// one token if set, or nil before they are first computed
+func (p *PaymentSLO) Report(window, chainID, token string) *PaymentSLOReport {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	report, ok := p.reports[window]
+	if !ok {
+		return nil
+	}
+
+	filtered := *report
+	filtered.Latencies = []PaymentLatency{}
+	for _, latency := range report.Latencies {
+		if (chainID == "" || latency.ChainID == chainID) && (token == "" || strings.EqualFold(latency.Token, token)) {
+			filtered.Latencies = append(filtered.Latencies, latency)
+		}
+	}
+	return &filtered
+}
+
+// handlePaymentSLO serves /api/analytics/slo: the latest completion time
+// percentiles for ?window= (1h, 24h, 7d or 30d, default 24h), ?chain_id=
+// and ?token=
+func (s *AnalyticsServer) handlePaymentSLO(w http.ResponseWriter, r *http.Request) {
+	window, chainID, ok := validatorParams(w, r)
+	if !ok {
+		return
+	}
+
+	report := s.slo.Report(window, chainID, r.URL.Query().Get("token"))
+	if report == nil {
+		problem.Error(w, r, http.StatusNotFound, problem.CodeNotComputed, "Payment latency not computed yet")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: report})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// latencyRecords answers the percentile query with one record per yield
+// for each chain and token, whose p95 is given
+func latencyRecords(payments int64, p95 map[[2]string]float64) func(flux string) []fluxRecord {
+	return func(flux string) []fluxRecord {
+		var records []fluxRecord
+		for key, value := range p95 {
+			for result, v := range map[string]interface{}{"count": payments, "p50": value / 2, "p95": value, "p99": value * 2} {
+				records = append(records, fluxRecord{"result": result, "chain_id": key[0], "token": key[1], "_value": v})
+			}
+		}
+		return records
+	}
+}
+
+// newTestPaymentSLO reads percentiles from a fake InfluxDB
+func newTestPaymentSLO(t *testing.T) (*PaymentSLO, *fakeInflux) {
+	influx, client := newFakeInflux(t)
+	return NewPaymentSLO(client.QueryAPI("crosspay"), "analytics", NewStorage(client, "crosspay", "analytics")), influx
+}
+
+func TestPaymentSLO(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	usdc := "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"
+
+	t.Run("should check each p95 against the target", func(t *testing.T) {
+		slo, influx := newTestPaymentSLO(t)
+		influx.query = latencyRecords(40, map[[2]string]float64{
+			{"4202", usdc}:    29999,
+			{"4202", "0x0"}:   30000,
+			{"314159", "0x0"}: 30001,
+		})
+
+		require.NoError(t, slo.Compute(context.Background(), now))
+		for _, window := range validatorWindows {
+			report := slo.Report(window, "", "")
+			require.NotNil(t, report, window)
+			assert.Equal(t, now, report.ComputedAt)
+			assert.Equal(t, float64(defaultPaymentSLOP95Ms), report.TargetP95Ms)
+			assert.Equal(t, []PaymentLatency{
+				{ChainID: "314159", Token: "0x0", Payments: 40, P50Ms: 15000.5, P95Ms: 30001, P99Ms: 60002},
+				{ChainID: "4202", Token: "0x0", Payments: 40, P50Ms: 15000, P95Ms: 30000, P99Ms: 60000, SLOMet: true},
+				{ChainID: "4202", Token: usdc, Payments: 40, P50Ms: 14999.5, P95Ms: 29999, P99Ms: 59998, SLOMet: true},
+			}, report.Latencies)
+		}
+
+		require.Len(t, influx.queries, len(validatorWindows))
+		for i, rng := range []string{"1h", "1d", "7d", "30d"} {
+			assert.Contains(t, influx.queries[i], "range(start: -"+rng+")")
+			assert.Contains(t, influx.queries[i], `r.status == "completed" and r._value > 0`)
+		}
+	})
+
+	t.Run("should use PAYMENT_SLO_P95_MS as the target", func(t *testing.T) {
+		for _, tc := range []struct {
+			value  string
+			target float64
+			met    bool
+		}{
+			{"", defaultPaymentSLOP95Ms, true},
+			{"1500", 1500, false},
+			{"2000", 2000, true},
+			{"-5", defaultPaymentSLOP95Ms, true},
+			{"fast", defaultPaymentSLOP95Ms, true},
+		} {
+			t.Setenv("PAYMENT_SLO_P95_MS", tc.value)
+			slo, influx := newTestPaymentSLO(t)
+			influx.query = latencyRecords(3, map[[2]string]float64{{"4202", usdc}: 2000})
+
+			require.NoError(t, slo.Compute(context.Background(), now))
+			report := slo.Report("1h", "", "")
+			require.NotNil(t, report, tc.value)
+			assert.Equal(t, tc.target, report.TargetP95Ms, tc.value)
+			require.Len(t, report.Latencies, 1)
+			assert.Equal(t, tc.met, report.Latencies[0].SLOMet, tc.value)
+
+			rule := slo.AlertRule()
+			require.NoError(t, rule.Validate(nil))
+			assert.Equal(t, tc.target, rule.Value, tc.value)
+			assert.Equal(t, "p95", rule.Aggregate)
+		}
+	})
+
+	t.Run("should only compute windows raw payments are kept for", func(t *testing.T) {
+		t.Setenv("RETENTION_PAYMENTS_RAW", "48h")
+		slo, influx := newTestPaymentSLO(t)
+		influx.query = latencyRecords(1, map[[2]string]float64{{"4202", usdc}: 100})
+
+		require.NoError(t, slo.Compute(context.Background(), now))
+		assert.NotNil(t, slo.Report("1h", "", ""))
+		assert.NotNil(t, slo.Report("24h", "", ""))
+		assert.Nil(t, slo.Report("7d", "", ""))
+		assert.Nil(t, slo.Report("30d", "", ""))
+		assert.Len(t, influx.queries, 2)
+	})
+
+	t.Run("should recompute on every tick with the clock's time", func(t *testing.T) {
+		slo, influx := newTestPaymentSLO(t)
+		influx.query = latencyRecords(1, map[[2]string]float64{{"4202", usdc}: 100})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		// The third computation starts cancelled, so it changes nothing
+		reads := 0
+		slo.now = func() time.Time {
+			reads++
+			if reads == 3 {
+				cancel()
+			}
+			return now.Add(time.Duration(reads-1) * time.Minute)
+		}
+
+		ticks := make(chan time.Time)
+		done := make(chan struct{})
+		go func() {
+			slo.run(ctx, ticks)
+			close(done)
+		}()
+		ticks <- now.Add(time.Minute)
+		ticks <- now.Add(2 * time.Minute)
+		<-done
+
+		assert.Equal(t, 3, reads)
+		assert.Len(t, influx.queries, 2*len(validatorWindows))
+		for _, window := range validatorWindows {
+			assert.Equal(t, now.Add(time.Minute), slo.Report(window, "", "").ComputedAt, window)
+		}
+	})
+
+	t.Run("should filter reports by chain and token", func(t *testing.T) {
+		slo, influx := newTestPaymentSLO(t)
+		influx.query = latencyRecords(5, map[[2]string]float64{
+			{"4202", usdc}:   100,
+			{"4202", "0x0"}:  200,
+			{"314159", usdc}: 300,
+		})
+		require.NoError(t, slo.Compute(context.Background(), now))
+
+		for _, tc := range []struct {
+			chainID, token string
+			p95            []float64
+		}{
+			{"", "", []float64{300, 200, 100}},
+			{"4202", "", []float64{200, 100}},
+			{"", strings.ToLower(usdc), []float64{300, 100}},
+			{"4202", usdc, []float64{100}},
+			{"10", "", []float64{}},
+		} {
+			report := slo.Report("24h", tc.chainID, tc.token)
+			require.NotNil(t, report)
+			p95 := make([]float64, 0, len(report.Latencies))
+			for _, latency := range report.Latencies {
+				p95 = append(p95, latency.P95Ms)
+			}
+			assert.Equal(t, tc.p95, p95, tc.chainID+" "+tc.token)
+		}
+	})
+
+	t.Run("should serve the latest report once computed", func(t *testing.T) {
+		slo, influx := newTestPaymentSLO(t)
+		influx.query = latencyRecords(5, map[[2]string]float64{{"4202", usdc}: 100})
+		server := &AnalyticsServer{slo: slo}
+
+		request := func(query string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			server.handlePaymentSLO(w, httptest.NewRequest(http.MethodGet, "/api/analytics/slo"+query, nil))
+			return w
+		}
+
+		w := request("")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		var body problem.Problem
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		assert.Equal(t, problem.CodeNotComputed, body.Code)
+		assert.Equal(t, http.StatusBadRequest, request("?window=2h").Code)
+		assert.Equal(t, http.StatusBadRequest, request("?chain_id=base").Code)
+
+		require.NoError(t, slo.Compute(context.Background(), now))
+		w = request("?window=1h&chain_id=4202")
+		require.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Success bool             `json:"success"`
+			Data    PaymentSLOReport `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, "1h", response.Data.Window)
+		assert.Equal(t, now, response.Data.ComputedAt)
+		require.Len(t, response.Data.Latencies, 1)
+		assert.True(t, response.Data.Latencies[0].SLOMet)
+	})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/gorilla/mux"
+)
+
+// Snapshots capture the dashboard, the rolling aggregates and a few charts
+// at one moment, so they can be shared with people who have no analytics
+// token. They are stored in storage-worker as report objects. Each one is
+// content addressed, so a share link names the CID it was stored under and
+// always returns the same snapshot. Links are signed and expire, and anyone
+// holding a link can read the snapshot until then.
+
+const maxSnapshotCharts = 10
+
+// snapshotRanges are the time ranges a chart can cover
+var snapshotRanges = []string{"1h", "24h", "7d", "30d"}
+
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// SnapshotChart is a chart to capture: a Grafana datasource target and
+// payload over a time range. Series is filled in when it is captured.
+type SnapshotChart struct {
+	Title     string            `json:"title,omitempty"`
+	Target    string            `json:"target"`
+	TimeRange string            `json:"time_range,omitempty"`
+	Payload   map[string]string `json:"payload,omitempty"`
+	Series    []grafanaSeries   `json:"series"`
+}
+
+// Snapshot is the stored document
+type Snapshot struct {
+	Title      string                 `json:"title,omitempty"`
+	CreatedBy  string                 `json:"created_by"`
+	CreatedAt  time.Time              `json:"created_at"`
+	Dashboard  map[string]interface{} `json:"dashboard"`
+	Aggregates RealtimeAggregates     `json:"aggregates"`
+	Charts     []SnapshotChart        `json:"charts"`
+}
+
+// snapshotRequest is the body of POST /api/snapshots
+type snapshotRequest struct {
+	Title     string          `json:"title"`
+	Charts    []SnapshotChart `json:"charts"`
+	ExpiresIn Duration        `json:"expires_in"`
+}
+
+// SnapshotStore keeps snapshots in storage-worker and signs their links
+type SnapshotStore struct {
+	url     string
+	apiKey  string
+	baseURL string
+	secret  []byte
+	ttl     time.Duration
+	maxTTL  time.Duration
+	client  *http.Client
+}
+
+// NewSnapshotStore stores snapshots through the storage-worker at
+// STORAGE_SERVICE_URL, authenticated with STORAGE_API_KEY. Links are signed
+// with SNAPSHOT_URL_SECRET, valid for SNAPSHOT_URL_TTL unless the request
+// asks otherwise, and never longer than SNAPSHOT_URL_MAX_TTL.
+func NewSnapshotStore() *SnapshotStore {
+	store := &SnapshotStore{
+		url:     strings.TrimSuffix(getEnv("STORAGE_SERVICE_URL", "http://localhost:8080"), "/"),
+		apiKey:  getEnv("STORAGE_API_KEY", ""),
+		baseURL: strings.TrimSuffix(getEnv("SNAPSHOT_BASE_URL", ""), "/"),
+		ttl:     envDuration("SNAPSHOT_URL_TTL", 7*24*time.Hour),
+		maxTTL:  envDuration("SNAPSHOT_URL_MAX_TTL", 30*24*time.Hour),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if secret := getEnv("SNAPSHOT_URL_SECRET", ""); secret != "" {
+		store.secret = []byte(secret)
+	} else {
+		log.Println("SNAPSHOT_URL_SECRET not set, snapshot links will not survive a restart")
+		store.secret = make([]byte, 32)
+		if _, err := rand.Read(store.secret); err != nil {
+			log.Fatalf("Failed to generate snapshot secret: %v", err)
+		}
+	}
+	return store
+}
+
+// envDuration reads a positive Go duration, falling back to defaultValue
+func envDuration(key string, defaultValue time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Ignoring invalid %s=%q", key, value)
+		return defaultValue
+	}
+	return parsed
+}
+
+// Put uploads a file of an object class and returns its CID
+func (s *SnapshotStore) Put(ctx context.Context, class, filename string, data []byte) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("class", class)
+	file, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	file.Write(data)
+	form.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+"/api/storage/upload", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	s.authorize(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("storage-worker returned status %d", resp.StatusCode)
+	}
+
+	var upload struct {
+		CID string `json:"cid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		return "", fmt.Errorf("failed to decode upload response: %w", err)
+	}
+	if upload.CID == "" {
+		return "", fmt.Errorf("storage-worker returned no CID")
+	}
+	return upload.CID, nil
+}
+
+// Get downloads a file by CID
+func (s *SnapshotStore) Get(ctx context.Context, cid string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"/api/storage/retrieve/"+url.PathEscape(cid), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.authorize(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errSnapshotNotFound
+	default:
+		return nil, fmt.Errorf("storage-worker returned status %d", resp.StatusCode)
+	}
+
+	var retrieved struct {
+		Data []byte `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&retrieved); err != nil {
+		return nil, fmt.Errorf("failed to decode retrieve response: %w", err)
+	}
+	return retrieved.Data, nil
+}
+
+func (s *SnapshotStore) authorize(req *http.Request) {
+	if s.apiKey != "" {
+		req.Header.Set("X-API-Key", s.apiKey)
+	}
+}
+
+func (s *SnapshotStore) signature(cid string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s|%d", cid, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the share link of a snapshot, valid until expires
+func (s *SnapshotStore) URL(cid string, expires time.Time) string {
+	return fmt.Sprintf("%s/api/snapshots/%s?expires=%d&signature=%s",
+		s.baseURL, url.PathEscape(cid), expires.Unix(), s.signature(cid, expires.Unix()))
+}
+
+// handleCreateSnapshot captures and stores a snapshot, returning its link
+func (s *AnalyticsServer) handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req snapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req.Charts) > maxSnapshotCharts {
+		http.Error(w, fmt.Sprintf("At most %d charts can be captured", maxSnapshotCharts), http.StatusBadRequest)
+		return
+	}
+	ttl := time.Duration(req.ExpiresIn)
+	if ttl == 0 {
+		ttl = s.snapshots.ttl
+	}
+	if ttl < 0 || ttl > s.snapshots.maxTTL {
+		http.Error(w, fmt.Sprintf("expires_in must be at most %s", s.snapshots.maxTTL), http.StatusBadRequest)
+		return
+	}
+
+	scope := scopeFrom(r)
+	now := time.Now().UTC()
+	snapshot := Snapshot{
+		Title:      req.Title,
+		CreatedBy:  scope.Name,
+		CreatedAt:  now,
+		Dashboard:  s.dashboard.Get(r.Context()).data,
+		Aggregates: s.aggregator.Snapshot(now),
+		Charts:     req.Charts,
+	}
+	for i := range snapshot.Charts {
+		chart := &snapshot.Charts[i]
+		if chart.TimeRange == "" {
+			chart.TimeRange = "24h"
+		}
+		if !containsString(snapshotRanges, chart.TimeRange) {
+			http.Error(w, fmt.Sprintf("Invalid time_range %q", chart.TimeRange), http.StatusBadRequest)
+			return
+		}
+
+		// about a hundred points per chart
+		rng := timeRangeDuration(chart.TimeRange)
+		query := grafanaQuery{IntervalMs: (rng / 100).Milliseconds()}
+		query.Range.From = now.Add(-rng)
+		query.Range.To = now
+		target := grafanaTarget{Target: chart.Target, Payload: chart.Payload}
+
+		flux, groupBy, err := s.grafanaFlux(scope, &query, target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chart.Series, err = s.querySeries(r.Context(), flux, target, groupBy)
+		if err != nil {
+			log.Printf("Snapshot chart query error: %v", err)
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		http.Error(w, "Failed to encode snapshot", http.StatusInternalServerError)
+		return
+	}
+	cid, err := s.snapshots.Put(r.Context(), "report", fmt.Sprintf("snapshot-%d.json", now.Unix()), data)
+	if err != nil {
+		log.Printf("Failed to store snapshot: %v", err)
+		http.Error(w, "Failed to store snapshot", http.StatusBadGateway)
+		return
+	}
+
+	expires := now.Add(ttl).Truncate(time.Second)
+	log.Printf("Snapshot %s created by %s, shared until %s", cid, scope.Name, expires.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: map[string]interface{}{
+		"cid":        cid,
+		"url":        s.snapshots.URL(cid, expires),
+		"expires_at": expires,
+	}})
+}
+
+// handleSnapshot serves a snapshot through its signed link
+func (s *AnalyticsServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	cid := mux.Vars(r)["cid"]
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	signature := r.URL.Query().Get("signature")
+	if err != nil || !hmac.Equal([]byte(signature), []byte(s.snapshots.signature(cid, expires))) {
+		problem.Error(w, r, http.StatusForbidden, problem.CodeInvalidLink, "Invalid snapshot link")
+		return
+	}
+	if time.Now().Unix() > expires {
+		problem.Error(w, r, http.StatusGone, problem.CodeLinkExpired, "Snapshot link expired")
+		return
+	}
+
+	data, err := s.snapshots.Get(r.Context(), cid)
+	if err == errSnapshotNotFound {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to retrieve snapshot %s: %v", cid, err)
+		http.Error(w, "Failed to retrieve snapshot", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
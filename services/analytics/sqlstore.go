@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	lp "github.com/influxdata/line-protocol"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Metric points can also be written to a Postgres table, so ingestion keeps
+// working while InfluxDB is down. In fallback mode a point only goes to
+// Postgres when InfluxDB rejects it; in dual mode every point goes to both.
+// Points InfluxDB has not accepted are kept unsynced and replayed into it
+// by the reconciler, from their line protocol, once it is back.
+
+const (
+	StorageInflux   = "influx"
+	StorageFallback = "fallback"
+	StorageDual     = "dual"
+)
+
+const sqlStoreSchema = `
+CREATE TABLE IF NOT EXISTS analytics_points (
+	id BIGSERIAL PRIMARY KEY,
+	measurement TEXT NOT NULL,
+	tags JSONB NOT NULL,
+	fields JSONB NOT NULL,
+	time TIMESTAMPTZ NOT NULL,
+	line TEXT NOT NULL,
+	line_hash TEXT NOT NULL UNIQUE,
+	synced BOOLEAN NOT NULL DEFAULT false
+);
+CREATE INDEX IF NOT EXISTS idx_analytics_points_measurement_time ON analytics_points (measurement, time);
+CREATE INDEX IF NOT EXISTS idx_analytics_points_unsynced ON analytics_points (id) WHERE NOT synced;
+`
+
+// PointStore keeps metric points alongside InfluxDB, remembering which ones
+// InfluxDB has not accepted yet
+type PointStore interface {
+	Insert(ctx context.Context, synced bool, points ...*write.Point) error
+	// Unsynced returns up to limit points InfluxDB does not have, oldest first
+	Unsynced(ctx context.Context, limit int) ([]StoredPoint, error)
+	// MarkSynced records that InfluxDB now has points, deleting them unless
+	// keep is set
+	MarkSynced(ctx context.Context, ids []int64, keep bool) error
+	// Prune deletes synced points older than retention
+	Prune(ctx context.Context, retention time.Duration) error
+	// Erase deletes the points of an address's payments, as merchant or
+	// sender, and returns how many it deleted
+	Erase(ctx context.Context, address string) (int64, error)
+	Close() error
+}
+
+// StoredPoint is a point held by a PointStore, as line protocol
+type StoredPoint struct {
+	ID   int64
+	Line string
+}
+
+// SQLStore keeps metric points in Postgres
+type SQLStore struct {
+	db    *sql.DB
+	ready bool
+	mutex sync.Mutex
+}
+
+// NewSQLStore opens the database at url. The schema is created on first
+// use, so an unreachable database does not stop the service from starting.
+func NewSQLStore(url string) (*SQLStore, error) {
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) ensureSchema(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ready {
+		return nil
+	}
+	if _, err := s.db.ExecContext(ctx, sqlStoreSchema); err != nil {
+		return fmt.Errorf("failed to create schema: %w", err)
+	}
+	s.ready = true
+	return nil
+}
+
+// Insert stores points, marked synced if InfluxDB already has them. A point
+// stored before is not duplicated, but is marked synced once either write
+// reached InfluxDB.
+func (s *SQLStore) Insert(ctx context.Context, synced bool, points ...*write.Point) error {
+	if err := s.ensureSchema(ctx); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO analytics_points (measurement, tags, fields, time, line, line_hash, synced)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (line_hash) DO UPDATE SET synced = analytics_points.synced OR EXCLUDED.synced`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, point := range points {
+		tags := make(map[string]string)
+		for _, tag := range point.TagList() {
+			tags[tag.Key] = tag.Value
+		}
+		fields := make(map[string]interface{})
+		for _, field := range point.FieldList() {
+			fields[field.Key] = field.Value
+		}
+		tagsJSON, _ := json.Marshal(tags)
+		fieldsJSON, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+
+		line, err := lineProtocol(point)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256([]byte(line))
+		if _, err := stmt.ExecContext(ctx, point.Name(), string(tagsJSON), string(fieldsJSON), point.Time(), line, hex.EncodeToString(sum[:]), synced); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// lineProtocol encodes a point the way the InfluxDB write API does, which
+// drops empty tags
+func lineProtocol(point *write.Point) (string, error) {
+	var buffer bytes.Buffer
+	encoder := lp.NewEncoder(&buffer)
+	encoder.SetFieldTypeSupport(lp.UintSupport)
+	encoder.FailOnFieldErr(true)
+	encoder.SetPrecision(time.Nanosecond)
+	if _, err := encoder.Encode(point); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buffer.String()), nil
+}
+
+func (s *SQLStore) Unsynced(ctx context.Context, limit int) ([]StoredPoint, error) {
+	if err := s.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, line FROM analytics_points WHERE NOT synced ORDER BY id LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []StoredPoint
+	for rows.Next() {
+		var point StoredPoint
+		if err := rows.Scan(&point.ID, &point.Line); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+func (s *SQLStore) MarkSynced(ctx context.Context, ids []int64, keep bool) error {
+	query := `UPDATE analytics_points SET synced = true WHERE id = ANY($1)`
+	if !keep {
+		query = `DELETE FROM analytics_points WHERE id = ANY($1)`
+	}
+	_, err := s.db.ExecContext(ctx, query, ids)
+	return err
+}
+
+func (s *SQLStore) Prune(ctx context.Context, retention time.Duration) error {
+	if err := s.ensureSchema(ctx); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM analytics_points WHERE synced AND time < $1`, time.Now().Add(-retention))
+	return err
+}
+
+func (s *SQLStore) Erase(ctx context.Context, address string) (int64, error) {
+	if err := s.ensureSchema(ctx); err != nil {
+		return 0, err
+	}
+	result, err := s.db.ExecContext(ctx, `DELETE FROM analytics_points WHERE tags->>'merchant' = $1 OR fields->>'sender' = $1`, address)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// MetricWriter writes points to InfluxDB and, depending on the storage
+// mode, to a PointStore. A write only fails when neither accepted it.
+type MetricWriter struct {
+	influx api.WriteAPIBlocking
+	store  PointStore
+	mode   string
+}
+
+// NewMetricWriter writes in the storage mode STORAGE_MODE (influx,
+// fallback or dual). The SQL modes store points in the Postgres database at
+// url, DATABASE_URL.
+func NewMetricWriter(influx api.WriteAPIBlocking, mode, url string) (*MetricWriter, error) {
+	writer := &MetricWriter{influx: influx, mode: mode}
+
+	switch writer.mode {
+	case StorageInflux:
+		return writer, nil
+	case StorageFallback, StorageDual:
+		if url == "" {
+			return nil, fmt.Errorf("STORAGE_MODE=%s requires DATABASE_URL", writer.mode)
+		}
+		store, err := NewSQLStore(url)
+		if err != nil {
+			return nil, err
+		}
+		writer.store = store
+		log.Printf("Writing metrics to InfluxDB with Postgres in %s mode", writer.mode)
+		return writer, nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_MODE %q", writer.mode)
+	}
+}
+
+func (m *MetricWriter) WritePoint(ctx context.Context, points ...*write.Point) error {
+	err := m.influx.WritePoint(ctx, points...)
+	if m.store == nil || (err == nil && m.mode == StorageFallback) {
+		return err
+	}
+
+	if storeErr := m.store.Insert(ctx, err == nil, points...); storeErr != nil {
+		if err != nil {
+			return fmt.Errorf("InfluxDB write failed: %v; Postgres write failed: %w", err, storeErr)
+		}
+		log.Printf("Failed to write %d points to Postgres: %v", len(points), storeErr)
+		return nil
+	}
+	if err != nil {
+		log.Printf("InfluxDB write failed, stored %d points in Postgres to replay: %v", len(points), err)
+	}
+	return nil
+}
+
+// WriteLines writes line protocol records, such as points spilled by the
+// ingest buffer, to InfluxDB
+func (m *MetricWriter) WriteLines(ctx context.Context, lines ...string) error {
+	return m.influx.WriteRecord(ctx, lines...)
+}
+
+// Reconcile replays unsynced points into InfluxDB every interval, and in
+// dual mode prunes synced points older than retention, until ctx is done
+func (m *MetricWriter) Reconcile(ctx context.Context, interval, retention time.Duration) {
+	if m.store == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for {
+			synced, err := m.replay(ctx, 5000)
+			if err != nil {
+				log.Printf("Failed to reconcile Postgres points: %v", err)
+				break
+			}
+			if synced > 0 {
+				log.Printf("Replayed %d points from Postgres into InfluxDB", synced)
+			}
+			if synced < 5000 {
+				break
+			}
+		}
+		if m.mode == StorageDual {
+			if err := m.store.Prune(ctx, retention); err != nil {
+				log.Printf("Failed to prune Postgres points: %v", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// replay writes up to limit unsynced points into InfluxDB and returns how
+// many it synced. Fallback mode deletes them once synced; dual mode keeps
+// them.
+func (m *MetricWriter) replay(ctx context.Context, limit int) (int, error) {
+	points, err := m.store.Unsynced(ctx, limit)
+	if err != nil || len(points) == 0 {
+		return 0, err
+	}
+
+	ids := make([]int64, len(points))
+	lines := make([]string, len(points))
+	for i, point := range points {
+		ids[i] = point.ID
+		lines[i] = point.Line
+	}
+	if err := m.influx.WriteRecord(ctx, lines...); err != nil {
+		return 0, fmt.Errorf("InfluxDB still rejects writes: %w", err)
+	}
+	if err := m.store.MarkSynced(ctx, ids, m.mode == StorageDual); err != nil {
+		return 0, err
+	}
+	return len(points), nil
+}
+
+// Sync replays every unsynced point into InfluxDB
+func (m *MetricWriter) Sync(ctx context.Context) error {
+	if m.store == nil {
+		return nil
+	}
+	for {
+		synced, err := m.replay(ctx, 5000)
+		if err != nil || synced < 5000 {
+			return err
+		}
+	}
+}
+
+// Erase deletes an address's points from the point store, if any
+func (m *MetricWriter) Erase(ctx context.Context, address string) (int64, error) {
+	if m.store == nil {
+		return 0, nil
+	}
+	return m.store.Erase(ctx, address)
+}
+
+// Close closes the point store, if any
+func (m *MetricWriter) Close() {
+	if m.store != nil {
+		m.store.Close()
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// Raw points are rolled up into 1m, 1h and 1d buckets by InfluxDB tasks, each
+// tier built from the one below it. Numeric fields are averaged, and a
+// samples field counts the raw points behind each rollup. String fields such
+// as amounts are only kept raw. Every measurement has its own retention per
+// tier, and queries read the finest tier that covers their time range.
+
+// Resolution is a storage tier: raw points or rollups at a fixed interval
+type Resolution struct {
+	Name     string
+	Every    time.Duration
+	MaxRange time.Duration
+}
+
+// resolutions lists the tiers from finest to coarsest. MaxRange is the
+// longest query range a tier serves before a coarser one is used; zero means
+// unbounded.
+var resolutions = []Resolution{
+	{Name: "raw", MaxRange: 6 * time.Hour},
+	{Name: "1m", Every: time.Minute, MaxRange: 3 * 24 * time.Hour},
+	{Name: "1h", Every: time.Hour, MaxRange: 60 * 24 * time.Hour},
+	{Name: "1d", Every: 24 * time.Hour},
+}
+
+// sampleFields names a field every point of a measurement carries, counted
+// into the samples field of its rollups
+var sampleFields = map[string]string{
+	"payments":    "payment_id",
+	"validators":  "response_time_ms",
+	"vaults":      "utilization_pct",
+	"chain_state": "head_block",
+	"gas_budgets": "used_pct",
+	"signatures":  "latency_ms",
+	"receipts":    "payment_id",
+	"probes":      "duration_ms",
+}
+
+// defaultRetention is how long each measurement is kept per tier; zero keeps
+// it forever. Validators report far more often than the others, so their raw
+// points are dropped sooner.
+var defaultRetention = map[string]map[string]time.Duration{
+	"payments":    {"raw": 30 * 24 * time.Hour, "1m": 7 * 24 * time.Hour, "1h": 180 * 24 * time.Hour, "1d": 0},
+	"validators":  {"raw": 7 * 24 * time.Hour, "1m": 7 * 24 * time.Hour, "1h": 90 * 24 * time.Hour, "1d": 0},
+	"vaults":      {"raw": 30 * 24 * time.Hour, "1m": 7 * 24 * time.Hour, "1h": 180 * 24 * time.Hour, "1d": 0},
+	"chain_state": {"raw": 30 * 24 * time.Hour, "1m": 7 * 24 * time.Hour, "1h": 180 * 24 * time.Hour, "1d": 0},
+	"gas_budgets": {"raw": 30 * 24 * time.Hour, "1m": 7 * 24 * time.Hour, "1h": 180 * 24 * time.Hour, "1d": 0},
+	"signatures":  {"raw": 30 * 24 * time.Hour, "1m": 7 * 24 * time.Hour, "1h": 180 * 24 * time.Hour, "1d": 0},
+	"receipts":    {"raw": 30 * 24 * time.Hour, "1m": 7 * 24 * time.Hour, "1h": 180 * 24 * time.Hour, "1d": 0},
+	"probes":      {"raw": 30 * 24 * time.Hour, "1m": 7 * 24 * time.Hour, "1h": 90 * 24 * time.Hour, "1d": 0},
+}
+
+// Storage manages the rollup buckets and tasks and the retention of each
+// measurement
+type Storage struct {
+	client    influxdb2.Client
+	org       string
+	bucket    string
+	retention map[string]map[string]time.Duration
+}
+
+// NewStorage reads per-measurement retention overrides from
+// RETENTION_<MEASUREMENT>_<TIER>, e.g. RETENTION_VALIDATORS_RAW=48h. A value
+// of 0 keeps the data forever.
+func NewStorage(client influxdb2.Client, org, bucket string) *Storage {
+	retention := make(map[string]map[string]time.Duration)
+	for measurement, tiers := range defaultRetention {
+		retention[measurement] = make(map[string]time.Duration)
+		for tier, keep := range tiers {
+			key := fmt.Sprintf("RETENTION_%s_%s", strings.ToUpper(measurement), strings.ToUpper(tier))
+			if value := getEnv(key, ""); value != "" {
+				parsed, err := time.ParseDuration(value)
+				if err != nil {
+					log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+				} else {
+					keep = parsed
+				}
+			}
+			retention[measurement][tier] = keep
+		}
+	}
+
+	return &Storage{client: client, org: org, bucket: bucket, retention: retention}
+}
+
+// BucketFor returns the bucket holding a tier
+func (s *Storage) BucketFor(res Resolution) string {
+	if res.Every == 0 {
+		return s.bucket
+	}
+	return s.bucket + "_" + res.Name
+}
+
+// Resolve picks the finest tier that serves a query over the last rng and
+// still holds that much of the measurement
+func (s *Storage) Resolve(measurement string, rng time.Duration) Resolution {
+	for _, res := range resolutions {
+		if res.MaxRange != 0 && rng > res.MaxRange {
+			continue
+		}
+		if keep := s.retention[measurement][res.Name]; keep != 0 && keep < rng {
+			continue
+		}
+		return res
+	}
+	return resolutions[len(resolutions)-1]
+}
+
+// bucketRetention is the longest any measurement is kept in a tier, the
+// bucket's own retention. Shorter per-measurement retention is enforced by
+// Prune.
+func (s *Storage) bucketRetention(res Resolution) time.Duration {
+	var longest time.Duration
+	for _, tiers := range s.retention {
+		keep := tiers[res.Name]
+		if keep == 0 {
+			return 0
+		}
+		if keep > longest {
+			longest = keep
+		}
+	}
+	return longest
+}
+
+// Setup creates or updates the rollup buckets and tasks
+func (s *Storage) Setup(ctx context.Context) error {
+	org, err := s.client.OrganizationsAPI().FindOrganizationByName(ctx, s.org)
+	if err != nil {
+		return fmt.Errorf("failed to find organization %s: %w", s.org, err)
+	}
+
+	for i, res := range resolutions {
+		if res.Every == 0 {
+			continue
+		}
+		if err := s.ensureBucket(ctx, org, res); err != nil {
+			return err
+		}
+		if err := s.ensureTask(ctx, *org.Id, s.rollupFlux(resolutions[i-1], res)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) ensureBucket(ctx context.Context, org *domain.Organization, res Resolution) error {
+	name := s.BucketFor(res)
+	rule := domain.RetentionRule{EverySeconds: int64(s.bucketRetention(res).Seconds())}
+
+	bucket, err := s.client.BucketsAPI().FindBucketByName(ctx, name)
+	if err != nil {
+		if _, err := s.client.BucketsAPI().CreateBucketWithName(ctx, org, name, rule); err != nil {
+			return fmt.Errorf("failed to create bucket %s: %w", name, err)
+		}
+		log.Printf("Created rollup bucket %s", name)
+		return nil
+	}
+
+	bucket.RetentionRules = domain.RetentionRules{rule}
+	if _, err := s.client.BucketsAPI().UpdateBucket(ctx, bucket); err != nil {
+		return fmt.Errorf("failed to update retention of bucket %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *Storage) ensureTask(ctx context.Context, orgID string, rollup rollupTask) error {
+	tasks, err := s.client.TasksAPI().FindTasks(ctx, &api.TaskFilter{Name: rollup.name, OrgID: orgID})
+	if err != nil {
+		return fmt.Errorf("failed to look up task %s: %w", rollup.name, err)
+	}
+
+	if len(tasks) == 0 {
+		if _, err := s.client.TasksAPI().CreateTaskByFlux(ctx, rollup.flux, orgID); err != nil {
+			return fmt.Errorf("failed to create task %s: %w", rollup.name, err)
+		}
+		log.Printf("Created rollup task %s", rollup.name)
+		return nil
+	}
+
+	task := tasks[0]
+	if task.Flux == rollup.flux {
+		return nil
+	}
+	task.Flux = rollup.flux
+	if _, err := s.client.TasksAPI().UpdateTask(ctx, &task); err != nil {
+		return fmt.Errorf("failed to update task %s: %w", rollup.name, err)
+	}
+	return nil
+}
+
+type rollupTask struct {
+	name string
+	flux string
+}
+
+// rollupFlux builds the task rolling the source tier up into target. Rollups
+// of raw points average numeric fields and count samples; coarser rollups
+// average the averages and sum the samples.
+func (s *Storage) rollupFlux(source, target Resolution) rollupTask {
+	name := "crosspay-rollup-" + target.Name
+	every := fluxDuration(target.Every)
+	to := fmt.Sprintf(`to(bucket: %q, org: %q)`, s.BucketFor(target), s.org)
+
+	// sorted so the script, and so the change check in ensureTask, is stable
+	var measurements, sampled []string
+	for measurement := range sampleFields {
+		measurements = append(measurements, measurement)
+	}
+	sort.Strings(measurements)
+	for i, measurement := range measurements {
+		sampled = append(sampled, fmt.Sprintf("%q", sampleFields[measurement]))
+		measurements[i] = fmt.Sprintf("%q", measurement)
+	}
+
+	header := fmt.Sprintf(`import "types"
+
+option task = {name: %q, every: %s, offset: 30s}
+
+data = from(bucket: %q)
+    |> range(start: -task.every)
+    |> filter(fn: (r) => contains(value: r._measurement, set: [%s]))
+`, name, every, s.BucketFor(source), strings.Join(measurements, ", "))
+
+	if source.Every == 0 {
+		return rollupTask{name: name, flux: header + fmt.Sprintf(`
+data
+    |> filter(fn: (r) => r._field != "payment_id")
+    |> filter(fn: (r) => types.isType(v: r._value, type: "float") or types.isType(v: r._value, type: "int") or types.isType(v: r._value, type: "uint"))
+    |> toFloat()
+    |> aggregateWindow(every: %s, fn: mean, createEmpty: false)
+    |> %s
+
+data
+    |> filter(fn: (r) => contains(value: r._field, set: [%s]))
+    |> aggregateWindow(every: %s, fn: count, createEmpty: false)
+    |> set(key: "_field", value: "samples")
+    |> toFloat()
+    |> %s
+`, every, to, strings.Join(sampled, ", "), every, to)}
+	}
+
+	return rollupTask{name: name, flux: header + fmt.Sprintf(`
+data
+    |> filter(fn: (r) => r._field != "samples")
+    |> aggregateWindow(every: %s, fn: mean, createEmpty: false)
+    |> %s
+
+data
+    |> filter(fn: (r) => r._field == "samples")
+    |> aggregateWindow(every: %s, fn: sum, createEmpty: false)
+    |> %s
+`, every, to, every, to)}
+}
+
+// fluxDuration formats a whole number of minutes, hours or days as a Flux
+// duration literal
+func fluxDuration(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+}
+
+// Prune deletes points older than their measurement's retention in each tier
+func (s *Storage) Prune(ctx context.Context) {
+	now := time.Now()
+	for measurement, tiers := range s.retention {
+		for _, res := range resolutions {
+			keep := tiers[res.Name]
+			if keep == 0 {
+				continue
+			}
+			predicate := fmt.Sprintf(`_measurement="%s"`, measurement)
+			err := s.client.DeleteAPI().DeleteWithName(ctx, s.org, s.BucketFor(res), time.Unix(0, 0), now.Add(-keep), predicate)
+			if err != nil {
+				log.Printf("Failed to prune %s from %s: %v", measurement, s.BucketFor(res), err)
+			}
+		}
+	}
+}
+
+// DeleteRaw deletes the raw points between start and stop, both included,
+// that match predicate
+func (s *Storage) DeleteRaw(ctx context.Context, start, stop time.Time, predicate string) error {
+	return s.client.DeleteAPI().DeleteWithName(ctx, s.org, s.bucket, start, stop, predicate)
+}
+
+// Delete deletes the points of a tier between start and stop, both included,
+// that match predicate
+func (s *Storage) Delete(ctx context.Context, res Resolution, start, stop time.Time, predicate string) error {
+	return s.client.DeleteAPI().DeleteWithName(ctx, s.org, s.BucketFor(res), start, stop, predicate)
+}
+
+// Write writes points straight into a tier's bucket
+func (s *Storage) Write(ctx context.Context, res Resolution, points ...*write.Point) error {
+	return s.client.WriteAPIBlocking(s.org, s.BucketFor(res)).WritePoint(ctx, points...)
+}
+
+// Maintain sets up the rollups, retrying until InfluxDB accepts them, then
+// prunes expired points every interval until ctx is done
+func (s *Storage) Maintain(ctx context.Context, interval time.Duration) {
+	for {
+		err := s.Setup(ctx)
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to set up rollups, retrying in a minute: %v", err)
+		select {
+		case <-time.After(time.Minute):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.Prune(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
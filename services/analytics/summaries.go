@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Funnel conversion and sender cohorts scan every raw payment, which is too
+// slow to do per request. They are computed periodically instead and written
+// to the payment_funnel and payment_cohorts measurements, which the endpoints
+// read.
+//
+// The funnel counts the distinct payments seen in a window, how many of them
+// reached their validator quorum (or completed, which implies it) and how
+// many completed. Cohorts group senders by the week (Monday, UTC) of their
+// first payment and count how many paid again in each later week. Both only
+// see raw payments, so cohorts cover at most the raw payment retention, and a
+// sender whose earlier payments have expired counts as new.
+
+const week = 7 * 24 * time.Hour
+
+// funnelWindows are the windows the funnel is computed over
+var funnelWindows = []string{"24h", "7d", "30d"}
+
+// FunnelStage counts the payments that reached each stage of a funnel
+type FunnelStage struct {
+	ChainID        string    `json:"chain_id"`
+	Window         string    `json:"window"`
+	Created        int64     `json:"created"`
+	Validated      int64     `json:"validated"`
+	Completed      int64     `json:"completed"`
+	ValidationRate float64   `json:"validation_rate"`
+	CompletionRate float64   `json:"completion_rate"`
+	ComputedAt     time.Time `json:"computed_at"`
+}
+
+// Cohort is the senders whose first payment fell in one week. Active[k] and
+// Retention[k] are the number and share of them that paid k weeks later.
+type Cohort struct {
+	Week      string    `json:"week"`
+	Senders   int64     `json:"senders"`
+	Active    []int64   `json:"active"`
+	Retention []float64 `json:"retention"`
+}
+
+// PaymentSummaries materializes the funnel and cohort measurements
+type PaymentSummaries struct {
+	queryAPI api.QueryAPI
+	writeAPI api.WriteAPIBlocking
+	bucket   string
+	storage  *Storage
+	weeks    int
+}
+
+// NewPaymentSummaries tracks up to COHORT_WEEKS weekly cohorts, fewer if raw
+// payments are not kept that long
+func NewPaymentSummaries(queryAPI api.QueryAPI, writeAPI api.WriteAPIBlocking, bucket string, storage *Storage) *PaymentSummaries {
+	weeks := getEnvInt("COHORT_WEEKS", 12)
+	if keep := storage.retention["payments"]["raw"]; keep != 0 && int(keep/week) < weeks {
+		weeks = int(keep / week)
+	}
+	if weeks < 1 {
+		weeks = 1
+	}
+	return &PaymentSummaries{queryAPI: queryAPI, writeAPI: writeAPI, bucket: bucket, storage: storage, weeks: weeks}
+}
+
+// Run materializes the summaries every interval until ctx is done
+func (p *PaymentSummaries) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Materialize(ctx, time.Now()); err != nil {
+			log.Printf("Failed to materialize payment summaries: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Materialize computes the funnel for every window retained raw and the
+// cohorts, and writes them
+func (p *PaymentSummaries) Materialize(ctx context.Context, now time.Time) error {
+	var points []*write.Point
+
+	for _, window := range funnelWindows {
+		rng := timeRangeDuration(window)
+		if keep := p.storage.retention["payments"]["raw"]; keep != 0 && keep < rng {
+			continue
+		}
+		stages, err := p.funnel(ctx, window, rng)
+		if err != nil {
+			return fmt.Errorf("funnel over %s: %w", window, err)
+		}
+		for _, stage := range stages {
+			points = append(points, influxdb2.NewPointWithMeasurement("payment_funnel").
+				AddTag("window", window).
+				AddTag("chain_id", stage.ChainID).
+				AddField("created", stage.Created).
+				AddField("validated", stage.Validated).
+				AddField("completed", stage.Completed).
+				AddField("validation_rate", stage.ValidationRate).
+				AddField("completion_rate", stage.CompletionRate).
+				SetTime(now))
+		}
+	}
+
+	first := weekStart(now).Add(-time.Duration(p.weeks-1) * week)
+	cohorts, err := p.cohorts(ctx, first)
+	if err != nil {
+		return fmt.Errorf("cohorts: %w", err)
+	}
+	for _, cohort := range cohorts {
+		start, _ := time.Parse(time.DateOnly, cohort.Week)
+		for offset, active := range cohort.Active {
+			points = append(points, influxdb2.NewPointWithMeasurement("payment_cohorts").
+				AddTag("cohort", cohort.Week).
+				AddTag("offset", strconv.Itoa(offset)).
+				AddField("senders", cohort.Senders).
+				AddField("active", active).
+				AddField("retention", cohort.Retention[offset]).
+				SetTime(start.Add(time.Duration(offset)*week)))
+		}
+	}
+
+	return p.writeAPI.WritePoint(ctx, points...)
+}
+
+// funnel counts the payments of each chain, and of all chains under "all",
+// at each stage over the last rng. Payments are identified by chain and
+// payment ID.
+func (p *PaymentSummaries) funnel(ctx context.Context, window string, rng time.Duration) ([]FunnelStage, error) {
+	flux := fmt.Sprintf(`from(bucket: %q)
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == "payments")
+	|> filter(fn: (r) => contains(value: r._field, set: ["payment_id", "required_sigs", "received_sigs"]))
+	|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+	|> keep(columns: ["chain_id", "status", "payment_id", "required_sigs", "received_sigs"])`,
+		p.bucket, fluxDuration(rng))
+
+	result, err := p.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+
+	type progress struct {
+		chainID   string
+		validated bool
+		completed bool
+	}
+	payments := make(map[string]*progress)
+	for result.Next() {
+		record := result.Record()
+		chainID, _ := record.ValueByKey("chain_id").(string)
+		status, _ := record.ValueByKey("status").(string)
+		key := chainID + "/" + strconv.FormatUint(uintValue(record.ValueByKey("payment_id")), 10)
+
+		payment, ok := payments[key]
+		if !ok {
+			payment = &progress{chainID: chainID}
+			payments[key] = payment
+		}
+		required := uintValue(record.ValueByKey("required_sigs"))
+		if status == "completed" || (required > 0 && uintValue(record.ValueByKey("received_sigs")) >= required) {
+			payment.validated = true
+		}
+		if status == "completed" {
+			payment.completed = true
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	byChain := map[string]*FunnelStage{"all": {ChainID: "all"}}
+	for _, payment := range payments {
+		if byChain[payment.chainID] == nil {
+			byChain[payment.chainID] = &FunnelStage{ChainID: payment.chainID}
+		}
+		for _, stage := range []*FunnelStage{byChain["all"], byChain[payment.chainID]} {
+			stage.Created++
+			if payment.validated {
+				stage.Validated++
+			}
+			if payment.completed {
+				stage.Completed++
+			}
+		}
+	}
+
+	var stages []FunnelStage
+	for _, chainID := range sortedKeys(byChain) {
+		stage := *byChain[chainID]
+		stage.Window = window
+		if stage.Created > 0 {
+			stage.ValidationRate = float64(stage.Validated) / float64(stage.Created)
+			stage.CompletionRate = float64(stage.Completed) / float64(stage.Created)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// cohorts groups the senders seen since first by the week of their first
+// payment and counts the ones active in each following week
+func (p *PaymentSummaries) cohorts(ctx context.Context, first time.Time) ([]Cohort, error) {
+	flux := fmt.Sprintf(`from(bucket: %q)
+	|> range(start: %s)
+	|> filter(fn: (r) => r._measurement == "payments" and r._field == "sender")
+	|> keep(columns: ["_time", "_value"])`,
+		p.bucket, first.UTC().Format(time.RFC3339))
+
+	result, err := p.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+
+	// active week indexes, counted from first, of each sender
+	activity := make(map[string]map[int]bool)
+	for result.Next() {
+		sender, _ := result.Record().Value().(string)
+		if sender == "" {
+			continue
+		}
+		if activity[sender] == nil {
+			activity[sender] = make(map[int]bool)
+		}
+		activity[sender][int(result.Record().Time().Sub(first)/week)] = true
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	cohorts := make([]Cohort, p.weeks)
+	for i := range cohorts {
+		cohorts[i] = Cohort{
+			Week:   first.Add(time.Duration(i) * week).Format(time.DateOnly),
+			Active: make([]int64, p.weeks-i),
+		}
+	}
+	for _, weeks := range activity {
+		joined := p.weeks
+		for index := range weeks {
+			if index < joined {
+				joined = index
+			}
+		}
+		if joined >= p.weeks {
+			continue
+		}
+		cohorts[joined].Senders++
+		for index := range weeks {
+			if index < p.weeks {
+				cohorts[joined].Active[index-joined]++
+			}
+		}
+	}
+
+	for i := range cohorts {
+		cohorts[i].Retention = make([]float64, len(cohorts[i].Active))
+		if cohorts[i].Senders == 0 {
+			continue
+		}
+		for offset, active := range cohorts[i].Active {
+			cohorts[i].Retention[offset] = float64(active) / float64(cohorts[i].Senders)
+		}
+	}
+	return cohorts, nil
+}
+
+// Funnel reads the latest materialized funnel over window, for one chain or
+// "all"
+func (p *PaymentSummaries) Funnel(ctx context.Context, window, chainID string) (*FunnelStage, error) {
+	flux := fmt.Sprintf(`from(bucket: %q)
+	|> range(start: -7d)
+	|> filter(fn: (r) => r._measurement == "payment_funnel" and r.window == %q and r.chain_id == %q)
+	|> last()`, p.bucket, window, chainID)
+
+	result, err := p.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+
+	var stage *FunnelStage
+	for result.Next() {
+		record := result.Record()
+		if stage == nil {
+			stage = &FunnelStage{ChainID: chainID, Window: window, ComputedAt: record.Time()}
+		}
+		switch record.Field() {
+		case "created":
+			stage.Created = int64(uintValue(record.Value()))
+		case "validated":
+			stage.Validated = int64(uintValue(record.Value()))
+		case "completed":
+			stage.Completed = int64(uintValue(record.Value()))
+		case "validation_rate":
+			stage.ValidationRate, _ = record.Value().(float64)
+		case "completion_rate":
+			stage.CompletionRate, _ = record.Value().(float64)
+		}
+	}
+	return stage, result.Err()
+}
+
+// Cohorts reads the materialized cohorts of the last weeks weeks, oldest
+// first
+func (p *PaymentSummaries) Cohorts(ctx context.Context, weeks int) ([]Cohort, error) {
+	first := weekStart(time.Now()).Add(-time.Duration(weeks-1) * week)
+	flux := fmt.Sprintf(`from(bucket: %q)
+	|> range(start: %s)
+	|> filter(fn: (r) => r._measurement == "payment_cohorts")
+	|> filter(fn: (r) => r._field == "senders" or r._field == "active")
+	|> filter(fn: (r) => r.cohort >= %q)
+	|> last()`, p.bucket, first.UTC().Format(time.RFC3339), first.Format(time.DateOnly))
+
+	result, err := p.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+
+	byWeek := make(map[string]*Cohort)
+	for result.Next() {
+		record := result.Record()
+		cohortWeek, _ := record.ValueByKey("cohort").(string)
+		offset, err := strconv.Atoi(fmt.Sprint(record.ValueByKey("offset")))
+		if err != nil || offset < 0 || offset >= weeks {
+			continue
+		}
+
+		cohort := byWeek[cohortWeek]
+		if cohort == nil {
+			cohort = &Cohort{Week: cohortWeek}
+			byWeek[cohortWeek] = cohort
+		}
+		for len(cohort.Active) <= offset {
+			cohort.Active = append(cohort.Active, 0)
+		}
+
+		value := int64(uintValue(record.Value()))
+		if record.Field() == "senders" {
+			cohort.Senders = value
+		} else {
+			cohort.Active[offset] = value
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	cohorts := make([]Cohort, 0, len(byWeek))
+	for _, cohortWeek := range sortedKeys(byWeek) {
+		cohort := *byWeek[cohortWeek]
+		cohort.Retention = make([]float64, len(cohort.Active))
+		for offset, active := range cohort.Active {
+			if cohort.Senders > 0 {
+				cohort.Retention[offset] = float64(active) / float64(cohort.Senders)
+			}
+		}
+		cohorts = append(cohorts, cohort)
+	}
+	return cohorts, nil
+}
+
+// weekStart returns midnight UTC on the Monday starting t's week
+func weekStart(t time.Time) time.Time {
+	day := t.UTC().Truncate(24 * time.Hour)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// uintValue reads an unsigned count from a query value, which may come back
+// as any numeric type
+func uintValue(value interface{}) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case int64:
+		if v > 0 {
+			return uint64(v)
+		}
+	case float64:
+		if v > 0 {
+			return uint64(v)
+		}
+	}
+	return 0
+}
+
+// handleFunnel serves the latest funnel for ?window= (24h, 7d or 30d, default
+// 24h) and ?chain_id= (a chain ID or all, the default)
+func (s *AnalyticsServer) handleFunnel(w http.ResponseWriter, r *http.Request) {
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "24h"
+	}
+	if !containsString(funnelWindows, window) {
+		http.Error(w, "Invalid window", http.StatusBadRequest)
+		return
+	}
+	chainID := r.URL.Query().Get("chain_id")
+	if chainID == "" {
+		chainID = "all"
+	}
+	if chainID != "all" {
+		if _, err := strconv.ParseUint(chainID, 10, 64); err != nil {
+			http.Error(w, "Invalid chain_id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	stage, err := s.summaries.Funnel(r.Context(), window, chainID)
+	if err != nil {
+		log.Printf("Funnel query error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	if stage == nil {
+		problem.Error(w, r, http.StatusNotFound, problem.CodeNotComputed, "Funnel not computed yet")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: stage})
+}
+
+// handleCohorts serves the cohorts of the last ?weeks= weeks, by default all
+// the ones tracked
+func (s *AnalyticsServer) handleCohorts(w http.ResponseWriter, r *http.Request) {
+	weeks := s.summaries.weeks
+	if value := r.URL.Query().Get("weeks"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid weeks", http.StatusBadRequest)
+			return
+		}
+		weeks = parsed
+	}
+
+	cohorts, err := s.summaries.Cohorts(r.Context(), weeks)
+	if err != nil {
+		log.Printf("Cohort query error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: cohorts})
+}
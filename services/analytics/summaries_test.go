@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPaymentSummaries reads and writes summaries to a fake InfluxDB
+func newTestPaymentSummaries(t *testing.T) (*PaymentSummaries, *fakeInflux) {
+	influx, client := newFakeInflux(t)
+	return NewPaymentSummaries(client.QueryAPI("crosspay"), client.WriteAPIBlocking("crosspay", "analytics"), "analytics", NewStorage(client, "crosspay", "analytics")), influx
+}
+
+func TestPaymentFunnel(t *testing.T) {
+	now := time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	t.Run("should count each payment once at the furthest stage it reached", func(t *testing.T) {
+		summaries, influx := newTestPaymentSummaries(t)
+		influx.query = func(flux string) []fluxRecord {
+			if !strings.Contains(flux, "pivot(") {
+				return nil
+			}
+			payment := func(chainID, status string, id, required, received uint64) fluxRecord {
+				return fluxRecord{"chain_id": chainID, "status": status, "payment_id": id, "required_sigs": required, "received_sigs": received}
+			}
+			return []fluxRecord{
+				payment("4202", "pending", 1, 3, 0),
+				payment("4202", "pending", 1, 3, 3),
+				payment("4202", "completed", 1, 3, 3),
+				payment("4202", "pending", 2, 3, 2),
+				payment("4202", "completed", 3, 0, 0),
+				payment("314159", "pending", 1, 0, 0),
+			}
+		}
+
+		require.NoError(t, summaries.Materialize(context.Background(), now))
+		lines := influx.written("payment_funnel")
+		require.Len(t, lines, 3*len(funnelWindows))
+		for _, want := range []string{
+			"payment_funnel,window=24h,chain_id=314159 created=1i,validated=0i,completed=0i,validation_rate=0,completion_rate=0 ",
+			"payment_funnel,window=24h,chain_id=4202 created=3i,validated=2i,completed=2i,validation_rate=0.6666666666666666,completion_rate=0.6666666666666666 ",
+			"payment_funnel,window=24h,chain_id=all created=4i,validated=2i,completed=2i,validation_rate=0.5,completion_rate=0.5 ",
+		} {
+			assert.Contains(t, lines, want+"1772625600000000000")
+		}
+	})
+
+	t.Run("should serve the latest funnel of a chain", func(t *testing.T) {
+		summaries, influx := newTestPaymentSummaries(t)
+		computed := now.Add(-time.Minute)
+		influx.query = func(flux string) []fluxRecord {
+			return []fluxRecord{
+				{"_time": computed, "_field": "created", "_value": int64(4)},
+				{"_time": computed, "_field": "validated", "_value": int64(3)},
+				{"_time": computed, "_field": "completed", "_value": int64(2)},
+				{"_time": computed, "_field": "validation_rate", "_value": 0.75},
+				{"_time": computed, "_field": "completion_rate", "_value": 0.5},
+			}
+		}
+		server := &AnalyticsServer{summaries: summaries}
+		request := func(query url.Values) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			server.handleFunnel(w, httptest.NewRequest(http.MethodGet, "/api/payments/funnel?"+query.Encode(), nil))
+			return w
+		}
+
+		for _, tc := range []struct {
+			name   string
+			query  url.Values
+			status int
+			flux   string
+		}{
+			{name: "defaults", status: http.StatusOK, flux: `r.window == "24h" and r.chain_id == "all"`},
+			{name: "all chains", query: url.Values{"window": {"7d"}, "chain_id": {"all"}}, status: http.StatusOK, flux: `r.window == "7d" and r.chain_id == "all"`},
+			{name: "one chain", query: url.Values{"window": {"30d"}, "chain_id": {"4202"}}, status: http.StatusOK, flux: `r.window == "30d" and r.chain_id == "4202"`},
+			{name: "unknown window", query: url.Values{"window": {"1h"}}, status: http.StatusBadRequest},
+			{name: "chain name", query: url.Values{"chain_id": {"base"}}, status: http.StatusBadRequest},
+			{name: "negative chain", query: url.Values{"chain_id": {"-1"}}, status: http.StatusBadRequest},
+			{name: "chain ID past uint64", query: url.Values{"chain_id": {"18446744073709551616"}}, status: http.StatusBadRequest},
+			{name: "injected filter", query: url.Values{"chain_id": {`1" or r.chain_id != "`}}, status: http.StatusBadRequest},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				influx.mu.Lock()
+				influx.queries = nil
+				influx.mu.Unlock()
+
+				w := request(tc.query)
+				require.Equal(t, tc.status, w.Code, w.Body.String())
+				if tc.status != http.StatusOK {
+					assert.Empty(t, influx.queries)
+					return
+				}
+				require.Len(t, influx.queries, 1)
+				assert.Contains(t, influx.queries[0], tc.flux)
+
+				var response struct {
+					Data FunnelStage `json:"data"`
+				}
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+				assert.Equal(t, int64(4), response.Data.Created)
+				assert.Equal(t, int64(3), response.Data.Validated)
+				assert.Equal(t, int64(2), response.Data.Completed)
+				assert.Equal(t, 0.75, response.Data.ValidationRate)
+				assert.Equal(t, computed, response.Data.ComputedAt)
+			})
+		}
+	})
+
+	t.Run("should answer not computed before the first run", func(t *testing.T) {
+		summaries, _ := newTestPaymentSummaries(t)
+		server := &AnalyticsServer{summaries: summaries}
+
+		w := httptest.NewRecorder()
+		server.handleFunnel(w, httptest.NewRequest(http.MethodGet, "/api/payments/funnel?chain_id=4202", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), `"not_computed"`)
+	})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Top lists rank the tokens, senders, recipients and chains of completed
+// payments over a window by USD volume or payment count. Tokens, recipients
+// (the merchant tag) and chains are tags, so long windows read rollups,
+// where a series' volume is its mean amount_usd times its samples. Senders
+// are a string field, which is only kept raw, so they cover at most the
+// raw payment retention. Addresses are shown in full, truncated, or as a
+// keyed hash, depending on TOP_ADDRESS_MODE or ?addresses=.
+
+const (
+	AddressModeFull     = "full"
+	AddressModeTruncate = "truncate"
+	AddressModeHash     = "hash"
+)
+
+// topDimensions maps each top list to the columns it groups payments by
+var topDimensions = map[string][]string{
+	"tokens":     {"chain_id", "token"},
+	"senders":    {"sender"},
+	"recipients": {"merchant"},
+	"chains":     {"chain_id"},
+}
+
+// TopEntry is one token, sender, recipient or chain of a top list
+type TopEntry struct {
+	Rank      int     `json:"rank"`
+	Key       string  `json:"key"`
+	ChainID   string  `json:"chain_id,omitempty"`
+	Payments  int64   `json:"payments"`
+	VolumeUSD float64 `json:"volume_usd"`
+	Share     float64 `json:"share"`
+}
+
+// TopList is the ranked entries of a dimension over a window
+type TopList struct {
+	Dimension  string      `json:"dimension"`
+	Window     string      `json:"window"`
+	ChainID    string      `json:"chain_id,omitempty"`
+	Sort       string      `json:"sort"`
+	Addresses  string      `json:"addresses,omitempty"`
+	Resolution string      `json:"resolution"`
+	Total      int         `json:"total"`
+	Entries    []*TopEntry `json:"entries"`
+}
+
+// TopAddresses is how addresses are shown in top lists
+type TopAddresses struct {
+	mode string
+	salt []byte
+}
+
+// loadTopAddresses reads TOP_ADDRESS_MODE, full, truncate (default) or hash
+// (HMAC-SHA256 keyed with TOP_ADDRESS_SALT)
+func loadTopAddresses() (TopAddresses, error) {
+	addresses := TopAddresses{
+		mode: getEnv("TOP_ADDRESS_MODE", AddressModeTruncate),
+		salt: []byte(getEnv("TOP_ADDRESS_SALT", "")),
+	}
+	if err := addresses.check(addresses.mode); err != nil {
+		return TopAddresses{}, fmt.Errorf("TOP_ADDRESS_MODE: %w", err)
+	}
+	return addresses, nil
+}
+
+func (a TopAddresses) check(mode string) error {
+	switch mode {
+	case AddressModeFull, AddressModeTruncate:
+		return nil
+	case AddressModeHash:
+		if len(a.salt) == 0 {
+			return fmt.Errorf("hash requires TOP_ADDRESS_SALT")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown address mode %q", mode)
+}
+
+// show formats an address in mode. Erased pseudonyms are shown as they are.
+func (a TopAddresses) show(address, mode string) string {
+	if !strings.HasPrefix(address, "0x") {
+		return address
+	}
+	switch mode {
+	case AddressModeTruncate:
+		if len(address) > 10 {
+			return address[:6] + "…" + address[len(address)-4:]
+		}
+	case AddressModeHash:
+		mac := hmac.New(sha256.New, a.salt)
+		mac.Write([]byte(strings.ToLower(address)))
+		return "hash-" + hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+	return address
+}
+
+// TopList ranks a dimension's completed payments over window, on one chain
+// if chainID is set, by "volume" or "payments"
+func (s *AnalyticsServer) TopList(ctx context.Context, dimension, window, chainID, by string) (*TopList, error) {
+	rng := timeRangeDuration(window)
+	columns := topDimensions[dimension]
+	group := fmt.Sprintf("\n\t|> group(columns: [%s])", quoteColumns(columns))
+	entries := make(map[string]*TopEntry)
+	lookup := func(values map[string]interface{}) *TopEntry {
+		key := fmt.Sprint(values[columns[len(columns)-1]])
+		chain := ""
+		if len(columns) > 1 {
+			chain = fmt.Sprint(values["chain_id"])
+		}
+		entry, ok := entries[chain+"/"+key]
+		if !ok {
+			entry = &TopEntry{Key: key, ChainID: chain}
+			entries[chain+"/"+key] = entry
+		}
+		return entry
+	}
+
+	completed := `r.status == "completed"`
+	var resolution Resolution
+	if dimension == "senders" {
+		resolution = resolutions[0]
+		chain := ""
+		if chainID != "" {
+			chain = fmt.Sprintf("\n\t|> filter(fn: (r) => r.chain_id == %q)", chainID)
+		}
+		// pivoted to one row per payment, with its sender and USD amount
+		err := s.eachRecord(ctx, fmt.Sprintf(`from(bucket: %q)
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == "payments" and (r._field == "sender" or r._field == "amount_usd"))
+	|> filter(fn: (r) => %s)%s
+	|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+	|> filter(fn: (r) => exists r.sender)
+	|> map(fn: (r) => ({sender: r.sender, amount_usd: if exists r.amount_usd then r.amount_usd else 0.0}))%s
+	|> reduce(identity: {payments: 0, amount_usd: 0.0}, fn: (r, accumulator) => ({payments: accumulator.payments + 1, amount_usd: accumulator.amount_usd + r.amount_usd}))`,
+			s.storage.bucket, fluxDuration(rng), completed, chain, group),
+			func(values map[string]interface{}, at time.Time) {
+				entry := lookup(values)
+				entry.Payments = int64(floatValue(values["payments"]))
+				entry.VolumeUSD = floatValue(values["amount_usd"])
+			})
+		if err != nil {
+			return nil, fmt.Errorf("sender query: %w", err)
+		}
+	} else {
+		resolution = s.storage.Resolve("payments", rng)
+		tier := s.validatorQuery("payments", rng, chainID)
+		err := s.eachRecord(ctx, tier.from("payments", tier.counted, completed)+group+
+			fmt.Sprintf("\n\t|> %s()", tier.countFn),
+			func(values map[string]interface{}, at time.Time) {
+				lookup(values).Payments = int64(floatValue(values["_value"]))
+			})
+		if err != nil {
+			return nil, fmt.Errorf("payment count query: %w", err)
+		}
+
+		volume := tier.from("payments", "amount_usd", completed) + group + `
+	|> sum()`
+		if tier.every != 0 {
+			// a rollup's volume is its mean amount times its samples
+			volume = fmt.Sprintf(`from(bucket: %q)
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == "payments" and (r._field == "amount_usd" or r._field == "samples"))
+	|> filter(fn: (r) => %s)%s
+	|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+	|> filter(fn: (r) => exists r.amount_usd and exists r.samples)
+	|> map(fn: (r) => ({r with _value: r.amount_usd * r.samples}))%s
+	|> sum()`, tier.bucket, fluxDuration(rng), completed, tier.chain, group)
+		}
+		err = s.eachRecord(ctx, volume, func(values map[string]interface{}, at time.Time) {
+			lookup(values).VolumeUSD = floatValue(values["_value"])
+		})
+		if err != nil {
+			return nil, fmt.Errorf("volume query: %w", err)
+		}
+	}
+
+	list := &TopList{Dimension: dimension, Window: window, ChainID: chainID, Sort: by, Resolution: resolution.Name, Entries: []*TopEntry{}}
+	total := 0.0
+	for _, entry := range entries {
+		entry.VolumeUSD = math.Round(entry.VolumeUSD*100) / 100
+		total += entry.VolumeUSD
+		list.Entries = append(list.Entries, entry)
+	}
+	for _, entry := range list.Entries {
+		if total > 0 {
+			entry.Share = math.Round(entry.VolumeUSD/total*10000) / 10000
+		}
+	}
+	sortTopEntries(list.Entries, by)
+	list.Total = len(list.Entries)
+	return list, nil
+}
+
+// sortTopEntries orders entries by volume or payments, largest first, and
+// ranks them
+func sortTopEntries(entries []*TopEntry, by string) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if by == "payments" && a.Payments != b.Payments {
+			return a.Payments > b.Payments
+		}
+		if a.VolumeUSD != b.VolumeUSD {
+			return a.VolumeUSD > b.VolumeUSD
+		}
+		if a.Payments != b.Payments {
+			return a.Payments > b.Payments
+		}
+		return a.ChainID+"/"+a.Key < b.ChainID+"/"+b.Key
+	})
+	for i, entry := range entries {
+		entry.Rank = i + 1
+	}
+}
+
+func quoteColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = strconv.Quote(column)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// handleTop serves /api/analytics/top/{dimension}: ?window= (1h, 24h, 7d
+// or 30d), ?chain_id=, ?sort= (volume or payments), ?limit= (default 10, at
+// most 100) and ?addresses= (full, truncate or hash)
+func (s *AnalyticsServer) handleTop(w http.ResponseWriter, r *http.Request) {
+	dimension := mux.Vars(r)["dimension"]
+	if _, ok := topDimensions[dimension]; !ok {
+		http.Error(w, "Unknown top list", http.StatusNotFound)
+		return
+	}
+	window, chainID, ok := validatorParams(w, r)
+	if !ok {
+		return
+	}
+	by := r.URL.Query().Get("sort")
+	if by == "" {
+		by = "volume"
+	}
+	if by != "volume" && by != "payments" {
+		http.Error(w, "Invalid sort", http.StatusBadRequest)
+		return
+	}
+	limit := 10
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	mode := s.topAddresses.mode
+	if value := r.URL.Query().Get("addresses"); value != "" {
+		if err := s.topAddresses.check(value); err != nil {
+			http.Error(w, "Invalid addresses: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		mode = value
+	}
+
+	list, err := s.TopList(r.Context(), dimension, window, chainID, by)
+	if err != nil {
+		log.Printf("Top %s error: %v", dimension, err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	if len(list.Entries) > limit {
+		list.Entries = list.Entries[:limit]
+	}
+	if dimension != "chains" {
+		list.Addresses = mode
+		for _, entry := range list.Entries {
+			entry.Key = s.topAddresses.show(entry.Key, mode)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: list})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTopServer answers top list queries from a fake InfluxDB
+func newTestTopServer(t *testing.T) (*AnalyticsServer, *fakeInflux) {
+	influx, client := newFakeInflux(t)
+	return &AnalyticsServer{
+		storage:      NewStorage(client, "crosspay", "analytics"),
+		queryAPI:     client.QueryAPI("crosspay"),
+		topAddresses: TopAddresses{mode: AddressModeFull},
+	}, influx
+}
+
+// topRequest calls handleTop for dimension with query and decodes the list
+func topRequest(t *testing.T, server *AnalyticsServer, dimension, query string) (*httptest.ResponseRecorder, TopList) {
+	req := httptest.NewRequest(http.MethodGet, "/api/analytics/top/"+dimension+"?"+query, nil)
+	req = mux.SetURLVars(req, map[string]string{"dimension": dimension})
+	w := httptest.NewRecorder()
+	server.handleTop(w, req)
+
+	var response struct {
+		Data TopList `json:"data"`
+	}
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	}
+	return w, response.Data
+}
+
+// topKeys returns the rank and key of each entry
+func topKeys(entries []*TopEntry) []string {
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, fmt.Sprintf("%d %s", entry.Rank, entry.Key))
+	}
+	return keys
+}
+
+func TestSortTopEntries(t *testing.T) {
+	entry := func(chainID, key string, payments int64, volume float64) *TopEntry {
+		return &TopEntry{ChainID: chainID, Key: key, Payments: payments, VolumeUSD: volume}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		by      string
+		entries []*TopEntry
+		want    []string
+	}{
+		{
+			name:    "by volume",
+			by:      "volume",
+			entries: []*TopEntry{entry("", "a", 9, 10), entry("", "b", 1, 30), entry("", "c", 5, 20)},
+			want:    []string{"1 b", "2 c", "3 a"},
+		},
+		{
+			name:    "equal volume by payments",
+			by:      "volume",
+			entries: []*TopEntry{entry("", "a", 2, 10), entry("", "b", 7, 10), entry("", "c", 4, 10)},
+			want:    []string{"1 b", "2 c", "3 a"},
+		},
+		{
+			name:    "equal volume and payments by key",
+			by:      "volume",
+			entries: []*TopEntry{entry("", "c", 3, 10), entry("", "a", 3, 10), entry("", "b", 3, 10)},
+			want:    []string{"1 a", "2 b", "3 c"},
+		},
+		{
+			name:    "by payments",
+			by:      "payments",
+			entries: []*TopEntry{entry("", "a", 9, 10), entry("", "b", 1, 30), entry("", "c", 5, 20)},
+			want:    []string{"1 a", "2 c", "3 b"},
+		},
+		{
+			name:    "equal payments by volume",
+			by:      "payments",
+			entries: []*TopEntry{entry("", "a", 5, 10), entry("", "b", 5, 30), entry("", "c", 5, 20)},
+			want:    []string{"1 b", "2 c", "3 a"},
+		},
+		{
+			name:    "equal payments and volume by key",
+			by:      "payments",
+			entries: []*TopEntry{entry("", "b", 5, 10), entry("", "c", 5, 10), entry("", "a", 5, 10)},
+			want:    []string{"1 a", "2 b", "3 c"},
+		},
+		{
+			name:    "same token on two chains by chain",
+			by:      "volume",
+			entries: []*TopEntry{entry("4202", "0xusdc", 1, 10), entry("314159", "0xusdc", 1, 10), entry("314159", "0xdai", 1, 10)},
+			want:    []string{"1 0xdai", "2 0xusdc", "3 0xusdc"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sortTopEntries(tc.entries, tc.by)
+			assert.Equal(t, tc.want, topKeys(tc.entries))
+		})
+	}
+}
+
+func TestHandleTop(t *testing.T) {
+	// senders answers the sender query with n senders, the i-th (from 1)
+	// with i payments of 10 USD
+	senders := func(n int) func(flux string) []fluxRecord {
+		return func(flux string) []fluxRecord {
+			records := make([]fluxRecord, 0, n)
+			for i := 1; i <= n; i++ {
+				records = append(records, fluxRecord{"sender": fmt.Sprintf("0x%040x", i), "payments": int64(i), "amount_usd": float64(10 * i)})
+			}
+			return records
+		}
+	}
+
+	t.Run("should bound the limit", func(t *testing.T) {
+		for _, tc := range []struct {
+			query   string
+			status  int
+			entries int
+		}{
+			{query: "", status: http.StatusOK, entries: 10},
+			{query: "limit=1", status: http.StatusOK, entries: 1},
+			{query: "limit=25", status: http.StatusOK, entries: 25},
+			{query: "limit=100", status: http.StatusOK, entries: 100},
+			{query: "limit=0", status: http.StatusBadRequest},
+			{query: "limit=-1", status: http.StatusBadRequest},
+			{query: "limit=101", status: http.StatusBadRequest},
+			{query: "limit=ten", status: http.StatusBadRequest},
+			{query: "limit=2.5", status: http.StatusBadRequest},
+		} {
+			t.Run(tc.query, func(t *testing.T) {
+				server, influx := newTestTopServer(t)
+				influx.query = senders(120)
+
+				w, list := topRequest(t, server, "senders", tc.query)
+				require.Equal(t, tc.status, w.Code, w.Body.String())
+				if tc.status != http.StatusOK {
+					assert.Contains(t, w.Body.String(), "Invalid limit")
+					assert.Empty(t, influx.queries)
+					return
+				}
+				assert.Equal(t, 120, list.Total)
+				require.Len(t, list.Entries, tc.entries)
+				assert.Equal(t, 1, list.Entries[0].Rank)
+				assert.Equal(t, fmt.Sprintf("0x%040x", 120), list.Entries[0].Key)
+				assert.Equal(t, tc.entries, list.Entries[tc.entries-1].Rank)
+			})
+		}
+	})
+
+	t.Run("should return every entry under the limit", func(t *testing.T) {
+		server, influx := newTestTopServer(t)
+		influx.query = senders(3)
+
+		w, list := topRequest(t, server, "senders", "limit=100")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 3, list.Total)
+		assert.Len(t, list.Entries, 3)
+	})
+
+	t.Run("should break ties the same way on every request", func(t *testing.T) {
+		server, influx := newTestTopServer(t)
+		influx.query = func(flux string) []fluxRecord {
+			value := func(chainID string, volume, payments float64) fluxRecord {
+				if strings.Contains(flux, "sum()") {
+					return fluxRecord{"chain_id": chainID, "_value": volume}
+				}
+				return fluxRecord{"chain_id": chainID, "_value": int64(payments)}
+			}
+			return []fluxRecord{value("10", 50, 2), value("4202", 50, 5), value("1", 50, 5), value("314159", 80, 1)}
+		}
+
+		for _, tc := range []struct {
+			sort string
+			want []string
+		}{
+			{"volume", []string{"1 314159", "2 1", "3 4202", "4 10"}},
+			{"payments", []string{"1 1", "2 4202", "3 10", "4 314159"}},
+		} {
+			for i := 0; i < 5; i++ {
+				w, list := topRequest(t, server, "chains", "window=1h&sort="+tc.sort+"&limit=3")
+				require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+				assert.Equal(t, 4, list.Total)
+				assert.Equal(t, tc.want[:3], topKeys(list.Entries), tc.sort)
+			}
+		}
+	})
+}
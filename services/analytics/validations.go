@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Relay validators report each signature share they produce, and each
+// aggregate they submit, as signature metrics. Signed payments record their
+// required and received signatures on the payment itself, so joining the
+// two gives a payment's validation timeline, from creation through each
+// validator's share and the quorum to the on-chain result, and how quickly
+// each validator contributes. The contract records every share at once when
+// the aggregate is submitted, so the shares' own times only come from the
+// relay network.
+
+// signatureEvents are what a signature metric can report
+var signatureEvents = []string{"signed", "submitted"}
+
+// validationLookback is how far back a payment's timeline is looked for
+const validationLookback = 30 * 24 * time.Hour
+
+// SignatureMetric is a relay validator's signature share for a payment's
+// validation request, or its submission of the request's aggregate.
+// LatencyMs is how long after the validator saw the request it acted.
+type SignatureMetric struct {
+	RequestID     uint64    `json:"request_id"`
+	PaymentID     uint64    `json:"payment_id"`
+	ChainID       uint64    `json:"chain_id"`
+	ValidatorAddr string    `json:"validator_address"`
+	Event         string    `json:"event"`
+	Signatures    uint32    `json:"signatures,omitempty"`
+	RequiredSigs  uint32    `json:"required_signatures,omitempty"`
+	LatencyMs     int64     `json:"latency_ms,omitempty"`
+	TxHash        string    `json:"tx_hash,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+func signaturePoint(metric SignatureMetric) *write.Point {
+	point := influxdb2.NewPointWithMeasurement("signatures").
+		AddTag("chain_id", fmt.Sprintf("%d", metric.ChainID)).
+		AddTag("validator_address", metric.ValidatorAddr).
+		AddTag("event", metric.Event).
+		AddField("payment_id", metric.PaymentID).
+		AddField("request_id", metric.RequestID).
+		AddField("signatures", metric.Signatures).
+		AddField("required_sigs", metric.RequiredSigs).
+		AddField("latency_ms", metric.LatencyMs).
+		SetTime(metric.Timestamp)
+	if metric.TxHash != "" {
+		point.AddField("tx_hash", metric.TxHash)
+	}
+	return point
+}
+
+func (s *AnalyticsServer) handleSignatureMetric(w http.ResponseWriter, r *http.Request) {
+	var metric SignatureMetric
+	if !s.decodeMetricRequest(w, r, "signature", &metric) {
+		return
+	}
+
+	if !s.bufferMetric(w, signaturePoint(metric)) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true})
+}
+
+// TimelineEvent is a step of a payment's validation: a payment status or a
+// validator's share or submission. SinceCreatedMs is its time after the
+// payment was created, when that is known.
+type TimelineEvent struct {
+	Time             time.Time `json:"time"`
+	Type             string    `json:"type"`
+	ValidatorAddress string    `json:"validator_address,omitempty"`
+	Signatures       uint64    `json:"signatures,omitempty"`
+	LatencyMs        *int64    `json:"latency_ms,omitempty"`
+	TxHash           string    `json:"tx_hash,omitempty"`
+	SinceCreatedMs   *int64    `json:"since_created_ms,omitempty"`
+}
+
+// ValidationTimeline is a payment's validation from creation to its result
+type ValidationTimeline struct {
+	PaymentID      uint64          `json:"payment_id"`
+	ChainID        string          `json:"chain_id"`
+	Status         string          `json:"status,omitempty"`
+	CreatedAt      *time.Time      `json:"created_at,omitempty"`
+	RequiredSigs   uint64          `json:"required_signatures"`
+	ReceivedSigs   uint64          `json:"received_signatures"`
+	Signers        []string        `json:"signers"`
+	QuorumAt       *time.Time      `json:"quorum_at,omitempty"`
+	TimeToQuorumMs *int64          `json:"time_to_quorum_ms,omitempty"`
+	SubmittedAt    *time.Time      `json:"submitted_at,omitempty"`
+	TxHash         string          `json:"tx_hash,omitempty"`
+	Events         []TimelineEvent `json:"events"`
+}
+
+// errAmbiguousPayment is returned when a payment ID is found on more than
+// one chain and no chain was given
+var errAmbiguousPayment = fmt.Errorf("payment found on several chains, set chain_id")
+
+// ValidationTimeline joins a payment's records with the signature metrics
+// of its validation, on chainID if set. It returns nil when neither is
+// found.
+func (s *AnalyticsServer) ValidationTimeline(ctx context.Context, paymentID uint64, chainID string) (*ValidationTimeline, error) {
+	lookback := validationLookback
+	if keep := s.storage.retention["payments"]["raw"]; keep != 0 && keep < lookback {
+		lookback = keep
+	}
+	chainFilter := ""
+	if chainID != "" {
+		chainFilter = fmt.Sprintf("\n\t|> filter(fn: (r) => r.chain_id == %q)", chainID)
+	}
+	query := func(measurement string, fields ...string) string {
+		filter := ""
+		for i, field := range fields {
+			if i > 0 {
+				filter += " or "
+			}
+			filter += fmt.Sprintf("r._field == %q", field)
+		}
+		return fmt.Sprintf(`from(bucket: %q)
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == %q and (%s))%s
+	|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+	|> filter(fn: (r) => r.payment_id == uint(v: %d))
+	|> group()
+	|> sort(columns: ["_time"])`, s.storage.bucket, fluxDuration(lookback), measurement, filter, chainFilter, paymentID)
+	}
+
+	timeline := &ValidationTimeline{PaymentID: paymentID, ChainID: chainID, Signers: []string{}, Events: []TimelineEvent{}}
+	chains := make(map[string]bool)
+	err := s.eachRecord(ctx, query("payments", "payment_id", "required_sigs", "received_sigs"), func(values map[string]interface{}, at time.Time) {
+		chains[fmt.Sprint(values["chain_id"])] = true
+		status := fmt.Sprint(values["status"])
+		if timeline.CreatedAt == nil {
+			created := at
+			timeline.CreatedAt = &created
+		}
+		timeline.Status = status
+		if required := uint64(floatValue(values["required_sigs"])); required > 0 {
+			timeline.RequiredSigs = required
+		}
+		if received := uint64(floatValue(values["received_sigs"])); received > 0 {
+			timeline.ReceivedSigs = received
+		}
+		timeline.Events = append(timeline.Events, TimelineEvent{Time: at, Type: status, Signatures: uint64(floatValue(values["received_sigs"]))})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("payment records: %w", err)
+	}
+
+	var shares []TimelineEvent
+	err = s.eachRecord(ctx, query("signatures", "payment_id", "signatures", "required_sigs", "latency_ms", "tx_hash"), func(values map[string]interface{}, at time.Time) {
+		chains[fmt.Sprint(values["chain_id"])] = true
+		latency := int64(floatValue(values["latency_ms"]))
+		event := TimelineEvent{
+			Time:             at,
+			Type:             fmt.Sprint(values["event"]),
+			ValidatorAddress: fmt.Sprint(values["validator_address"]),
+			Signatures:       uint64(floatValue(values["signatures"])),
+			LatencyMs:        &latency,
+		}
+		event.TxHash, _ = values["tx_hash"].(string)
+		if required := uint64(floatValue(values["required_sigs"])); timeline.RequiredSigs == 0 && required > 0 {
+			timeline.RequiredSigs = required
+		}
+		switch event.Type {
+		case "signed":
+			shares = append(shares, event)
+		case "submitted":
+			if timeline.SubmittedAt == nil {
+				submitted := at
+				timeline.SubmittedAt, timeline.TxHash = &submitted, event.TxHash
+			}
+		}
+		timeline.Events = append(timeline.Events, event)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("signatures: %w", err)
+	}
+
+	if len(timeline.Events) == 0 {
+		return nil, nil
+	}
+	if chainID == "" {
+		if len(chains) > 1 {
+			return nil, errAmbiguousPayment
+		}
+		for chain := range chains {
+			timeline.ChainID = chain
+		}
+	}
+
+	// The quorum is reached by the share of the required-th distinct signer
+	signed := make(map[string]bool)
+	for _, share := range shares {
+		if signed[share.ValidatorAddress] {
+			continue
+		}
+		signed[share.ValidatorAddress] = true
+		timeline.Signers = append(timeline.Signers, share.ValidatorAddress)
+		if timeline.QuorumAt == nil && timeline.RequiredSigs > 0 && uint64(len(signed)) == timeline.RequiredSigs {
+			quorum := share.Time
+			timeline.QuorumAt = &quorum
+		}
+	}
+
+	sort.SliceStable(timeline.Events, func(i, j int) bool { return timeline.Events[i].Time.Before(timeline.Events[j].Time) })
+	if created := timeline.CreatedAt; created != nil {
+		for i := range timeline.Events {
+			since := timeline.Events[i].Time.Sub(*created).Milliseconds()
+			timeline.Events[i].SinceCreatedMs = &since
+		}
+		if timeline.QuorumAt != nil {
+			toQuorum := timeline.QuorumAt.Sub(*created).Milliseconds()
+			timeline.TimeToQuorumMs = &toQuorum
+		}
+	}
+	return timeline, nil
+}
+
+// ValidatorContribution is how often and how quickly a validator signed
+// over a window. Participation is the share of the chain's signed requests
+// it signed.
+type ValidatorContribution struct {
+	ValidatorAddress string  `json:"validator_address"`
+	ChainID          string  `json:"chain_id"`
+	Signatures       int64   `json:"signatures"`
+	Submissions      int64   `json:"submissions"`
+	Participation    float64 `json:"participation_rate"`
+	AvgLatencyMs     float64 `json:"avg_latency_ms"`
+	P50LatencyMs     float64 `json:"p50_latency_ms"`
+	P95LatencyMs     float64 `json:"p95_latency_ms"`
+}
+
+// ChainValidations sums up a chain's validations over a window: the
+// requests validators signed, and the signatures payments required and
+// received
+type ChainValidations struct {
+	ChainID           string  `json:"chain_id"`
+	Requests          int64   `json:"requests"`
+	PaymentsValidated int64   `json:"payments_validated"`
+	AvgRequiredSigs   float64 `json:"avg_required_signatures"`
+	AvgReceivedSigs   float64 `json:"avg_received_signatures"`
+}
+
+// ValidatorContributions reads each validator's signing over window, on
+// chainID if set, from the raw signature metrics: percentiles cannot be
+// read from rollups
+func (s *AnalyticsServer) ValidatorContributions(ctx context.Context, window, chainID string) ([]ChainValidations, []ValidatorContribution, error) {
+	rng := timeRangeDuration(window)
+	chainFilter := ""
+	if chainID != "" {
+		chainFilter = fmt.Sprintf(" and r.chain_id == %q", chainID)
+	}
+
+	type key struct{ chainID, address string }
+	contributions := make(map[key]*ValidatorContribution)
+	chains := make(map[string]*ChainValidations)
+	chain := func(id string) *ChainValidations {
+		entry, ok := chains[id]
+		if !ok {
+			entry = &ChainValidations{ChainID: id}
+			chains[id] = entry
+		}
+		return entry
+	}
+
+	flux := fmt.Sprintf(`data = from(bucket: %q)
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == "signatures" and r._field == "latency_ms"%s)
+	|> group(columns: ["chain_id", "validator_address", "event"])
+data |> count() |> yield(name: "count")
+data |> filter(fn: (r) => r.event == "signed") |> mean() |> yield(name: "mean")
+data |> filter(fn: (r) => r.event == "signed") |> quantile(q: 0.5, method: "estimate_tdigest") |> yield(name: "p50")
+data |> filter(fn: (r) => r.event == "signed") |> quantile(q: 0.95, method: "estimate_tdigest") |> yield(name: "p95")`,
+		s.storage.bucket, fluxDuration(rng), chainFilter)
+	result, err := s.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signature latencies: %w", err)
+	}
+	for result.Next() {
+		record := result.Record()
+		k := key{chainID: fmt.Sprint(record.ValueByKey("chain_id")), address: fmt.Sprint(record.ValueByKey("validator_address"))}
+		entry, ok := contributions[k]
+		if !ok {
+			entry = &ValidatorContribution{ChainID: k.chainID, ValidatorAddress: k.address}
+			contributions[k] = entry
+		}
+		value := floatValue(record.Value())
+		switch record.Result() {
+		case "count":
+			if record.ValueByKey("event") == "submitted" {
+				entry.Submissions = int64(value)
+			} else {
+				entry.Signatures = int64(value)
+			}
+		case "mean":
+			entry.AvgLatencyMs = value
+		case "p50":
+			entry.P50LatencyMs = value
+		case "p95":
+			entry.P95LatencyMs = value
+		}
+	}
+	if result.Err() != nil {
+		return nil, nil, fmt.Errorf("signature latencies: %w", result.Err())
+	}
+
+	err = s.eachRecord(ctx, fmt.Sprintf(`from(bucket: %q)
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == "signatures" and r._field == "request_id" and r.event == "signed"%s)
+	|> group(columns: ["chain_id"])
+	|> distinct()
+	|> count()`, s.storage.bucket, fluxDuration(rng), chainFilter), func(values map[string]interface{}, at time.Time) {
+		chain(fmt.Sprint(values["chain_id"])).Requests = int64(floatValue(values["_value"]))
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("signed requests: %w", err)
+	}
+
+	// Payments that needed signatures, as the payment records report them
+	payments := s.validatorQuery("payments", rng, chainID)
+	err = s.eachRecord(ctx, payments.from("payments", "required_sigs", "r._value > 0")+`
+	|> group(columns: ["chain_id"])
+	|> mean()`, func(values map[string]interface{}, at time.Time) {
+		chain(fmt.Sprint(values["chain_id"])).AvgRequiredSigs = floatValue(values["_value"])
+	})
+	if err == nil {
+		err = s.eachRecord(ctx, payments.from("payments", "received_sigs", "r._value > 0")+`
+	|> group(columns: ["chain_id"])
+	|> mean()`, func(values map[string]interface{}, at time.Time) {
+			chain(fmt.Sprint(values["chain_id"])).AvgReceivedSigs = floatValue(values["_value"])
+		})
+	}
+	if err == nil {
+		err = s.eachRecord(ctx, payments.from("payments", payments.counted, `r.status == "validated"`)+`
+	|> group(columns: ["chain_id"])
+	|> `+payments.countFn+`()`, func(values map[string]interface{}, at time.Time) {
+			chain(fmt.Sprint(values["chain_id"])).PaymentsValidated = int64(floatValue(values["_value"]))
+		})
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("payment signatures: %w", err)
+	}
+
+	validators := make([]ValidatorContribution, 0, len(contributions))
+	for _, entry := range contributions {
+		if requests := chain(entry.ChainID).Requests; requests > 0 {
+			entry.Participation = float64(entry.Signatures) / float64(requests)
+		}
+		validators = append(validators, *entry)
+	}
+	sort.Slice(validators, func(i, j int) bool {
+		if validators[i].ChainID != validators[j].ChainID {
+			return validators[i].ChainID < validators[j].ChainID
+		}
+		if validators[i].Signatures != validators[j].Signatures {
+			return validators[i].Signatures > validators[j].Signatures
+		}
+		return validators[i].ValidatorAddress < validators[j].ValidatorAddress
+	})
+
+	summaries := make([]ChainValidations, 0, len(chains))
+	for _, entry := range chains {
+		summaries = append(summaries, *entry)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ChainID < summaries[j].ChainID })
+	return summaries, validators, nil
+}
+
+// handleValidations serves /api/analytics/validations: the validation
+// timeline of ?payment_id= if set, otherwise each validator's contributions
+// over ?window= (1h, 24h, 7d or 30d, default 24h). Both take ?chain_id=.
+func (s *AnalyticsServer) handleValidations(w http.ResponseWriter, r *http.Request) {
+	window, chainID, ok := validatorParams(w, r)
+	if !ok {
+		return
+	}
+
+	if value := r.URL.Query().Get("payment_id"); value != "" {
+		paymentID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid payment_id", http.StatusBadRequest)
+			return
+		}
+		timeline, err := s.ValidationTimeline(r.Context(), paymentID, chainID)
+		if err == errAmbiguousPayment {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Validation timeline query error: %v", err)
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		if timeline == nil {
+			http.Error(w, "Payment not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: timeline})
+		return
+	}
+
+	if keep := s.storage.retention["signatures"]["raw"]; keep != 0 && keep < timeRangeDuration(window) {
+		http.Error(w, fmt.Sprintf("Signatures are kept for %s", keep), http.StatusBadRequest)
+		return
+	}
+	chains, validators, err := s.ValidatorContributions(r.Context(), window, chainID)
+	if err != nil {
+		log.Printf("Validator contribution query error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: map[string]interface{}{
+		"window":     window,
+		"chains":     chains,
+		"validators": validators,
+	}})
+}
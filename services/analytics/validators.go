@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The validator leaderboard rates each validator over a window from the
+// validator and payment measurements:
+//   - uptime: the share of intervals since it was first seen in the window
+//     in which it reported as active
+//   - response time: the mean time from a validation request to its
+//     signature
+//   - participation: its signatures out of the validation rounds (payments
+//     validated or failed) on its chain
+//   - slashes: how often, and when, it was slashed
+//
+// These are combined into a score, and each validator's share of the
+// scores on its chain is its recommended stake weight. Each figure is also
+// checked against the SLA targets. Long windows read rollups, so they count
+// intervals and samples rather than individual points.
+
+// validatorWindows are the windows the leaderboard is computed over
+var validatorWindows = []string{"1h", "24h", "7d", "30d"}
+
+// ValidatorStats is a validator's figures over a window
+type ValidatorStats struct {
+	Rank              int         `json:"rank"`
+	ValidatorAddress  string      `json:"validator_address"`
+	ChainID           string      `json:"chain_id"`
+	Stake             string      `json:"stake,omitempty"`
+	Status            string      `json:"status,omitempty"`
+	LastSeen          time.Time   `json:"last_seen,omitempty"`
+	Uptime            float64     `json:"uptime"`
+	AvgResponseTimeMs float64     `json:"avg_response_time_ms"`
+	Signatures        int64       `json:"signatures"`
+	Participation     float64     `json:"participation_rate"`
+	Slashes           int64       `json:"slashes"`
+	SlashHistory      []time.Time `json:"slash_history,omitempty"`
+	Score             float64     `json:"score"`
+	RecommendedWeight float64     `json:"recommended_weight"`
+	SLAMet            bool        `json:"sla_met"`
+	SLABreaches       []string    `json:"sla_breaches,omitempty"`
+}
+
+// ValidatorSLA is the service level every validator is checked against
+type ValidatorSLA struct {
+	Uptime         float64 `json:"uptime"`
+	Participation  float64 `json:"participation_rate"`
+	ResponseTimeMs float64 `json:"avg_response_time_ms"`
+}
+
+// loadValidatorSLA reads VALIDATOR_SLA_UPTIME (default 0.99),
+// VALIDATOR_SLA_PARTICIPATION (default 0.9) and VALIDATOR_SLA_RESPONSE_MS
+// (default 5000)
+func loadValidatorSLA() ValidatorSLA {
+	sla := ValidatorSLA{Uptime: 0.99, Participation: 0.9, ResponseTimeMs: 5000}
+	for key, target := range map[string]*float64{
+		"VALIDATOR_SLA_UPTIME":        &sla.Uptime,
+		"VALIDATOR_SLA_PARTICIPATION": &sla.Participation,
+		"VALIDATOR_SLA_RESPONSE_MS":   &sla.ResponseTimeMs,
+	} {
+		if value := getEnv(key, ""); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || parsed <= 0 {
+				log.Printf("Ignoring invalid %s=%q", key, value)
+				continue
+			}
+			*target = parsed
+		}
+	}
+	return sla
+}
+
+type validatorKey struct {
+	chainID string
+	address string
+}
+
+// validatorQuery builds the start of a query over the last rng of one field
+// of a measurement, from the tier that serves it. For counting, the field
+// is the measurement's sample field, read as samples from rollups and
+// summed with countFn.
+type validatorQuery struct {
+	bucket  string
+	rng     time.Duration
+	every   time.Duration
+	counted string
+	countFn string
+	chain   string
+}
+
+func (s *AnalyticsServer) validatorQuery(measurement string, rng time.Duration, chainID string) validatorQuery {
+	resolution := s.storage.Resolve(measurement, rng)
+	query := validatorQuery{bucket: s.storage.BucketFor(resolution), rng: rng, every: resolution.Every, counted: sampleFields[measurement], countFn: "count"}
+	if resolution.Every != 0 {
+		query.counted, query.countFn = "samples", "sum"
+	}
+	if chainID != "" {
+		query.chain = fmt.Sprintf("\n\t|> filter(fn: (r) => r.chain_id == %q)", chainID)
+	}
+	return query
+}
+
+func (q validatorQuery) from(measurement, field, filter string) string {
+	return fmt.Sprintf(`from(bucket: %q)
+	|> range(start: -%s)
+	|> filter(fn: (r) => r._measurement == %q and r._field == %q)
+	|> filter(fn: (r) => %s)%s`, q.bucket, fluxDuration(q.rng), measurement, field, filter, q.chain)
+}
+
+// ValidatorStats rates the validators seen over window, on one chain if
+// chainID is set, sorted by score
+func (s *AnalyticsServer) ValidatorStats(ctx context.Context, window, chainID string, now time.Time) ([]*ValidatorStats, error) {
+	rng := timeRangeDuration(window)
+	validators := s.validatorQuery("validators", rng, chainID)
+	payments := s.validatorQuery("payments", rng, chainID)
+	stats := make(map[validatorKey]*ValidatorStats)
+
+	lookup := func(values map[string]interface{}) *ValidatorStats {
+		key := validatorKey{chainID: fmt.Sprint(values["chain_id"]), address: fmt.Sprint(values["validator_address"])}
+		entry, ok := stats[key]
+		if !ok {
+			entry = &ValidatorStats{ValidatorAddress: key.address, ChainID: key.chainID}
+			stats[key] = entry
+		}
+		return entry
+	}
+	group := `
+	|> group(columns: ["chain_id", "validator_address"])`
+
+	// uptime: the intervals with an active report since the first one
+	interval := 5 * time.Minute
+	if rng > 24*time.Hour {
+		interval = time.Hour
+	}
+	if interval < validators.every {
+		interval = validators.every
+	}
+	active := make(map[*ValidatorStats][]time.Time)
+	err := s.eachRecord(ctx, validators.from("validators", validators.counted, `r.status == "active"`)+group+
+		fmt.Sprintf("\n\t|> aggregateWindow(every: %s, fn: %s, createEmpty: false)", fluxDuration(interval), validators.countFn),
+		func(values map[string]interface{}, at time.Time) {
+			entry := lookup(values)
+			active[entry] = append(active[entry], at)
+		})
+	if err != nil {
+		return nil, fmt.Errorf("uptime query: %w", err)
+	}
+	start := now.Add(-rng)
+	for entry, intervals := range active {
+		first := intervals[0].Add(-interval)
+		for _, at := range intervals {
+			if at.Add(-interval).Before(first) {
+				first = at.Add(-interval)
+			}
+		}
+		if first.Before(start) {
+			first = start
+		}
+		expected := math.Ceil(float64(now.Sub(first)) / float64(interval))
+		entry.Uptime = math.Min(1, float64(len(intervals))/math.Max(1, expected))
+	}
+
+	// signatures and their response times
+	err = s.eachRecord(ctx, validators.from("validators", validators.counted, `r.event == "signed"`)+group+
+		fmt.Sprintf("\n\t|> %s()", validators.countFn),
+		func(values map[string]interface{}, at time.Time) {
+			lookup(values).Signatures = int64(floatValue(values["_value"]))
+		})
+	if err != nil {
+		return nil, fmt.Errorf("signature query: %w", err)
+	}
+	err = s.eachRecord(ctx, validators.from("validators", "response_time_ms", `r.event == "signed"`)+group+`
+	|> toFloat()
+	|> mean()`,
+		func(values map[string]interface{}, at time.Time) {
+			lookup(values).AvgResponseTimeMs = math.Round(floatValue(values["_value"]))
+		})
+	if err != nil {
+		return nil, fmt.Errorf("response time query: %w", err)
+	}
+
+	// slashes, as points (raw) or intervals with samples (rollups)
+	err = s.eachRecord(ctx, validators.from("validators", validators.counted, `r.status == "slashed"`),
+		func(values map[string]interface{}, at time.Time) {
+			entry := lookup(values)
+			if validators.every == 0 {
+				entry.Slashes++
+			} else {
+				entry.Slashes += int64(floatValue(values["_value"]))
+			}
+			entry.SlashHistory = append(entry.SlashHistory, at.UTC())
+		})
+	if err != nil {
+		return nil, fmt.Errorf("slash query: %w", err)
+	}
+
+	// stake is a string field, so it is only kept raw. The latest report
+	// also gives the validator's status and when it was last seen.
+	raw := validatorQuery{bucket: s.storage.bucket, rng: rng, chain: validators.chain}
+	err = s.eachRecord(ctx, raw.from("validators", "stake", "true")+group+`
+	|> sort(columns: ["_time"])
+	|> last()`,
+		func(values map[string]interface{}, at time.Time) {
+			entry := lookup(values)
+			entry.Stake = fmt.Sprint(values["_value"])
+			entry.Status = fmt.Sprint(values["status"])
+			entry.LastSeen = at.UTC()
+		})
+	if err != nil {
+		return nil, fmt.Errorf("stake query: %w", err)
+	}
+
+	// validation rounds per chain
+	rounds := make(map[string]float64)
+	err = s.eachRecord(ctx, payments.from("payments", payments.counted, `r.status == "validated" or r.status == "failed"`)+`
+	|> group(columns: ["chain_id"])`+fmt.Sprintf("\n\t|> %s()", payments.countFn),
+		func(values map[string]interface{}, at time.Time) {
+			rounds[fmt.Sprint(values["chain_id"])] = floatValue(values["_value"])
+		})
+	if err != nil {
+		return nil, fmt.Errorf("validation round query: %w", err)
+	}
+
+	sla := s.validatorSLA
+	var entries []*ValidatorStats
+	chainScores := make(map[string]float64)
+	for _, entry := range stats {
+		// a chain without validation rounds had nothing to miss
+		entry.Participation = 1
+		if total := rounds[entry.ChainID]; total > 0 {
+			entry.Participation = math.Min(1, float64(entry.Signatures)/total)
+		}
+
+		responseScore := 0.0
+		if entry.Signatures > 0 {
+			responseScore = math.Min(1, sla.ResponseTimeMs/math.Max(entry.AvgResponseTimeMs, 1))
+		}
+		score := 100 * (0.4*entry.Uptime + 0.4*entry.Participation + 0.2*responseScore) * math.Pow(0.5, float64(entry.Slashes))
+		entry.Score = math.Round(score*10) / 10
+		chainScores[entry.ChainID] += entry.Score
+
+		if entry.Uptime < sla.Uptime {
+			entry.SLABreaches = append(entry.SLABreaches, "uptime")
+		}
+		if entry.Participation < sla.Participation {
+			entry.SLABreaches = append(entry.SLABreaches, "participation_rate")
+		}
+		if entry.Signatures > 0 && entry.AvgResponseTimeMs > sla.ResponseTimeMs {
+			entry.SLABreaches = append(entry.SLABreaches, "avg_response_time_ms")
+		}
+		if entry.Slashes > 0 {
+			entry.SLABreaches = append(entry.SLABreaches, "slashed")
+		}
+		entry.SLAMet = len(entry.SLABreaches) == 0
+		entries = append(entries, entry)
+	}
+	for _, entry := range entries {
+		if total := chainScores[entry.ChainID]; total > 0 {
+			entry.RecommendedWeight = math.Round(entry.Score/total*10000) / 10000
+		}
+	}
+
+	sortValidators(entries, "score")
+	return entries, nil
+}
+
+// eachRecord runs a query and calls fn with every record's values and time
+func (s *AnalyticsServer) eachRecord(ctx context.Context, flux string, fn func(values map[string]interface{}, at time.Time)) error {
+	result, err := s.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return err
+	}
+	for result.Next() {
+		fn(result.Record().Values(), result.Record().Time())
+	}
+	return result.Err()
+}
+
+// floatValue converts a numeric query value
+func floatValue(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return 0
+}
+
+// sortValidators orders validators by a figure, best first, and ranks them
+func sortValidators(entries []*ValidatorStats, by string) {
+	better := map[string]func(a, b *ValidatorStats) bool{
+		"score":         func(a, b *ValidatorStats) bool { return a.Score > b.Score },
+		"uptime":        func(a, b *ValidatorStats) bool { return a.Uptime > b.Uptime },
+		"participation": func(a, b *ValidatorStats) bool { return a.Participation > b.Participation },
+		"signatures":    func(a, b *ValidatorStats) bool { return a.Signatures > b.Signatures },
+		"response_time": func(a, b *ValidatorStats) bool {
+			// validators that never signed go last
+			if (a.Signatures == 0) != (b.Signatures == 0) {
+				return b.Signatures == 0
+			}
+			return a.AvgResponseTimeMs < b.AvgResponseTimeMs
+		},
+	}[by]
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if better(entries[i], entries[j]) != better(entries[j], entries[i]) {
+			return better(entries[i], entries[j])
+		}
+		if entries[i].ChainID != entries[j].ChainID {
+			return entries[i].ChainID < entries[j].ChainID
+		}
+		return entries[i].ValidatorAddress < entries[j].ValidatorAddress
+	})
+	for i, entry := range entries {
+		entry.Rank = i + 1
+	}
+}
+
+// validatorParams reads ?window= (default 24h) and ?chain_id=
+func validatorParams(w http.ResponseWriter, r *http.Request) (window, chainID string, ok bool) {
+	window = r.URL.Query().Get("window")
+	if window == "" {
+		window = "24h"
+	}
+	if !containsString(validatorWindows, window) {
+		http.Error(w, "Invalid window", http.StatusBadRequest)
+		return "", "", false
+	}
+	chainID = r.URL.Query().Get("chain_id")
+	if chainID != "" {
+		if _, err := strconv.ParseUint(chainID, 10, 64); err != nil {
+			http.Error(w, "Invalid chain_id", http.StatusBadRequest)
+			return "", "", false
+		}
+	}
+	return window, chainID, true
+}
+
+// handleValidatorLeaderboard serves validators ranked by ?sort= (score,
+// uptime, participation, signatures or response_time), at most ?limit=
+func (s *AnalyticsServer) handleValidatorLeaderboard(w http.ResponseWriter, r *http.Request) {
+	window, chainID, ok := validatorParams(w, r)
+	if !ok {
+		return
+	}
+	by := r.URL.Query().Get("sort")
+	if by == "" {
+		by = "score"
+	}
+	if !containsString([]string{"score", "uptime", "participation", "signatures", "response_time"}, by) {
+		http.Error(w, "Invalid sort", http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	entries, err := s.ValidatorStats(r.Context(), window, chainID, time.Now())
+	if err != nil {
+		log.Printf("Validator leaderboard error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	sortValidators(entries, by)
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: map[string]interface{}{
+		"window":     window,
+		"sla":        s.validatorSLA,
+		"validators": entries,
+	}})
+}
+
+// handleValidatorSLA serves one validator's figures on each chain it is on
+func (s *AnalyticsServer) handleValidatorSLA(w http.ResponseWriter, r *http.Request) {
+	window, chainID, ok := validatorParams(w, r)
+	if !ok {
+		return
+	}
+	address := mux.Vars(r)["address"]
+
+	entries, err := s.ValidatorStats(r.Context(), window, chainID, time.Now())
+	if err != nil {
+		log.Printf("Validator SLA error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	var matched []*ValidatorStats
+	for _, entry := range entries {
+		if strings.EqualFold(entry.ValidatorAddress, address) {
+			matched = append(matched, entry)
+		}
+	}
+	if len(matched) == 0 {
+		http.Error(w, "Validator not seen in window", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: map[string]interface{}{
+		"window":     window,
+		"sla":        s.validatorSLA,
+		"validators": matched,
+	}})
+}
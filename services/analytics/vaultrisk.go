@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Vault risk shows what each tranche of a vault has lost and could lose.
+// Losses fall on the junior tranche first, then mezzanine, then senior, as
+// TrancheVault.executeSlashing applies them:
+//   - max drawdown: the largest fall of the tranche's balance from a peak
+//     within the window. It includes withdrawals, so it is an upper bound on
+//     what depositors lost
+//   - slash losses: each slashing's loss as a share of the tranche, and the
+//     tranche's share of everything the vault lost
+//   - scenarios: what a slashing of a given share of the vault would take
+//     from each tranche at today's balances
+//
+// Balances are strings, which are only kept raw, so windows are limited to
+// the raw retention of vaults.
+
+// vaultRiskWindows are the windows vault risk is computed over
+var vaultRiskWindows = []string{"24h", "7d", "30d"}
+
+// defaultSlashScenarios are the slashings, in percent of the vault, that
+// scenarios cover unless the request names others
+var defaultSlashScenarios = []float64{1, 5, 10, 25}
+
+// TrancheRisk is a tranche's state and losses over a window
+type TrancheRisk struct {
+	TrancheType    string           `json:"tranche_type"`
+	TotalAssets    string           `json:"total_assets"`
+	APY            float64          `json:"apy"`
+	RiskScore      float64          `json:"risk_score"`
+	UtilizationPct float64          `json:"utilization_pct"`
+	MaxDrawdownPct float64          `json:"max_drawdown_pct"`
+	SlashLosses    SlashLossSummary `json:"slash_losses"`
+}
+
+// SlashLossSummary is the distribution of a tranche's slashing losses, in
+// percent of the tranche before each one
+type SlashLossSummary struct {
+	Events        int     `json:"events"`
+	TotalLoss     string  `json:"total_loss"`
+	ShareOfLosses float64 `json:"share_of_losses"`
+	MeanPct       float64 `json:"mean_pct"`
+	MedianPct     float64 `json:"median_pct"`
+	P95Pct        float64 `json:"p95_pct"`
+	MaxPct        float64 `json:"max_pct"`
+}
+
+// VaultSlashing is one slashing of a vault and what it took from each
+// tranche
+type VaultSlashing struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Amount    string            `json:"amount"`
+	Losses    map[string]string `json:"losses"`
+}
+
+// SlashScenario is what a slashing of SlashPct of the vault would take
+// from each tranche
+type SlashScenario struct {
+	SlashPct   float64               `json:"slash_pct"`
+	SlashTotal string                `json:"slash_amount"`
+	Tranches   []TrancheScenarioLoss `json:"tranches"`
+}
+
+// TrancheScenarioLoss is a tranche's loss in a scenario
+type TrancheScenarioLoss struct {
+	TrancheType string  `json:"tranche_type"`
+	Loss        string  `json:"loss"`
+	LossPct     float64 `json:"loss_pct"`
+	Remaining   string  `json:"remaining"`
+	WipedOut    bool    `json:"wiped_out"`
+}
+
+// vaultFlux starts a raw query over the last rng of one vault's fields. The
+// address is matched case-insensitively, as reporters may not checksum it.
+func (s *AnalyticsServer) vaultFlux(address, chainID string, rng time.Duration, fields ...string) string {
+	var matches []string
+	for _, field := range fields {
+		matches = append(matches, fmt.Sprintf("r._field == %q", field))
+	}
+	start := "0"
+	if rng > 0 {
+		start = "-" + fluxDuration(rng)
+	}
+	return fmt.Sprintf(`import "strings"
+
+from(bucket: %q)
+	|> range(start: %s)
+	|> filter(fn: (r) => r._measurement == "vaults" and (%s))
+	|> filter(fn: (r) => r.chain_id == %q and strings.toLower(v: r.vault_address) == %q)`,
+		s.storage.bucket, start, strings.Join(matches, " or "), chainID, strings.ToLower(address))
+}
+
+// trancheBalances reads the latest state of a vault's tranches, in
+// waterfall order, filling in their balance, APY, risk and utilization
+func (s *AnalyticsServer) trancheBalances(ctx context.Context, address, chainID string) ([]*TrancheRisk, error) {
+	tranches := make(map[string]*TrancheRisk)
+	err := s.eachRecord(ctx, s.vaultFlux(address, chainID, s.storage.retention["vaults"]["raw"], "total_assets", "apy", "risk_score", "utilization_pct")+`
+	|> last()`,
+		func(values map[string]interface{}, at time.Time) {
+			name := fmt.Sprint(values["tranche_type"])
+			tranche, ok := tranches[name]
+			if !ok {
+				tranche = &TrancheRisk{TrancheType: name, TotalAssets: "0"}
+				tranches[name] = tranche
+			}
+			switch values["_field"] {
+			case "total_assets":
+				tranche.TotalAssets = fmt.Sprint(values["_value"])
+			case "apy":
+				tranche.APY = floatValue(values["_value"])
+			case "risk_score":
+				tranche.RiskScore = floatValue(values["_value"])
+			case "utilization_pct":
+				tranche.UtilizationPct = floatValue(values["_value"])
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var ordered []*TrancheRisk
+	for _, name := range trancheNames {
+		if tranche, ok := tranches[name]; ok {
+			ordered = append(ordered, tranche)
+		}
+	}
+	return ordered, nil
+}
+
+// VaultRisk computes the drawdown and slashing losses of a vault's tranches
+// over window, and lists its slashings, oldest first
+func (s *AnalyticsServer) VaultRisk(ctx context.Context, address, chainID, window string) ([]*TrancheRisk, []VaultSlashing, error) {
+	tranches, err := s.trancheBalances(ctx, address, chainID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("balance query: %w", err)
+	}
+	byName := make(map[string]*TrancheRisk)
+	for _, tranche := range tranches {
+		byName[tranche.TrancheType] = tranche
+	}
+	rng := timeRangeDuration(window)
+
+	// drawdown from the running peak of each tranche's balance
+	peaks := make(map[string]*big.Float)
+	err = s.eachRecord(ctx, s.vaultFlux(address, chainID, rng, "total_assets"), func(values map[string]interface{}, at time.Time) {
+		tranche := byName[fmt.Sprint(values["tranche_type"])]
+		balance, ok := new(big.Float).SetString(fmt.Sprint(values["_value"]))
+		if tranche == nil || !ok {
+			return
+		}
+		peak := peaks[tranche.TrancheType]
+		if peak == nil || balance.Cmp(peak) > 0 {
+			peaks[tranche.TrancheType] = balance
+			return
+		}
+		if peak.Sign() > 0 {
+			ratio, _ := new(big.Float).Quo(balance, peak).Float64()
+			tranche.MaxDrawdownPct = math.Max(tranche.MaxDrawdownPct, math.Round((1-ratio)*10000)/100)
+		}
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("drawdown query: %w", err)
+	}
+
+	// slashing losses, one row per slashing and tranche
+	percents := make(map[string][]float64)
+	totals := make(map[string]*big.Int)
+	vaultTotal := new(big.Int)
+	slashings := make(map[time.Time]*VaultSlashing)
+	err = s.eachRecord(ctx, s.vaultFlux(address, chainID, rng, "slash_loss", "slash_loss_pct")+`
+	|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`,
+		func(values map[string]interface{}, at time.Time) {
+			name := fmt.Sprint(values["tranche_type"])
+			loss, ok := new(big.Int).SetString(fmt.Sprint(values["slash_loss"]), 10)
+			if byName[name] == nil || !ok {
+				return
+			}
+			if totals[name] == nil {
+				totals[name] = new(big.Int)
+			}
+			totals[name].Add(totals[name], loss)
+			vaultTotal.Add(vaultTotal, loss)
+			percents[name] = append(percents[name], floatValue(values["slash_loss_pct"]))
+
+			// every tranche of a slashing is reported at the same time
+			slashing, ok := slashings[at]
+			if !ok {
+				slashing = &VaultSlashing{Timestamp: at.UTC(), Amount: "0", Losses: make(map[string]string)}
+				slashings[at] = slashing
+			}
+			amount, _ := new(big.Int).SetString(slashing.Amount, 10)
+			slashing.Amount = amount.Add(amount, loss).String()
+			slashing.Losses[name] = loss.String()
+		})
+	if err != nil {
+		return nil, nil, fmt.Errorf("slash loss query: %w", err)
+	}
+	history := []VaultSlashing{}
+	for _, slashing := range slashings {
+		history = append(history, *slashing)
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Timestamp.Before(history[j].Timestamp) })
+
+	for _, tranche := range tranches {
+		summary := SlashLossSummary{TotalLoss: "0"}
+		if total := totals[tranche.TrancheType]; total != nil {
+			summary.TotalLoss = total.String()
+			if vaultTotal.Sign() > 0 {
+				share, _ := new(big.Rat).SetFrac(total, vaultTotal).Float64()
+				summary.ShareOfLosses = math.Round(share*10000) / 10000
+			}
+		}
+		losses := percents[tranche.TrancheType]
+		if len(losses) > 0 {
+			sort.Float64s(losses)
+			sum := 0.0
+			for _, pct := range losses {
+				sum += pct
+			}
+			summary.Events = len(losses)
+			summary.MeanPct = math.Round(sum/float64(len(losses))*100) / 100
+			summary.MedianPct = math.Round(percentile(losses, 0.5)*100) / 100
+			summary.P95Pct = math.Round(percentile(losses, 0.95)*100) / 100
+			summary.MaxPct = math.Round(losses[len(losses)-1]*100) / 100
+		}
+		tranche.SlashLosses = summary
+	}
+	return tranches, history, nil
+}
+
+// percentile interpolates the p-th percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	if lower+1 >= len(sorted) {
+		return sorted[lower]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+// slashScenario applies a slashing of pct percent of the vault to the
+// tranches, junior first
+func slashScenario(tranches []*TrancheRisk, pct float64) SlashScenario {
+	total := new(big.Int)
+	balances := make([]*big.Int, len(tranches))
+	for i, tranche := range tranches {
+		balance, ok := new(big.Int).SetString(tranche.TotalAssets, 10)
+		if !ok {
+			balance = new(big.Int)
+		}
+		balances[i] = balance
+		total.Add(total, balance)
+	}
+
+	// basis points keep the arithmetic in integers
+	slash := new(big.Int).Mul(total, big.NewInt(int64(math.Round(pct*100))))
+	slash.Quo(slash, big.NewInt(10000))
+	scenario := SlashScenario{SlashPct: pct, SlashTotal: slash.String()}
+
+	remaining := new(big.Int).Set(slash)
+	for i, tranche := range tranches {
+		loss := new(big.Int).Set(remaining)
+		if loss.Cmp(balances[i]) > 0 {
+			loss.Set(balances[i])
+		}
+		remaining.Sub(remaining, loss)
+
+		result := TrancheScenarioLoss{
+			TrancheType: tranche.TrancheType,
+			Loss:        loss.String(),
+			Remaining:   new(big.Int).Sub(balances[i], loss).String(),
+			WipedOut:    balances[i].Sign() > 0 && loss.Cmp(balances[i]) == 0,
+		}
+		if balances[i].Sign() > 0 {
+			share, _ := new(big.Rat).SetFrac(loss, balances[i]).Float64()
+			result.LossPct = math.Round(share*10000) / 100
+		}
+		scenario.Tranches = append(scenario.Tranches, result)
+	}
+	return scenario
+}
+
+// vaultParams reads the vault address and the required ?chain_id=
+func vaultParams(w http.ResponseWriter, r *http.Request) (address, chainID string, ok bool) {
+	address = mux.Vars(r)["address"]
+	chainID = r.URL.Query().Get("chain_id")
+	if _, err := strconv.ParseUint(chainID, 10, 64); err != nil {
+		http.Error(w, "chain_id is required", http.StatusBadRequest)
+		return "", "", false
+	}
+	return address, chainID, true
+}
+
+// handleVaultRisk serves the drawdown and slashing losses of each tranche
+// of a vault over ?window= (default 30d)
+func (s *AnalyticsServer) handleVaultRisk(w http.ResponseWriter, r *http.Request) {
+	address, chainID, ok := vaultParams(w, r)
+	if !ok {
+		return
+	}
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "30d"
+	}
+	if !containsString(vaultRiskWindows, window) {
+		http.Error(w, "Invalid window", http.StatusBadRequest)
+		return
+	}
+
+	tranches, slashings, err := s.VaultRisk(r.Context(), address, chainID, window)
+	if err != nil {
+		log.Printf("Vault risk error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	if len(tranches) == 0 {
+		http.Error(w, "Vault not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: map[string]interface{}{
+		"vault_address": address,
+		"chain_id":      chainID,
+		"window":        window,
+		"tranches":      tranches,
+		"slashings":     slashings,
+	}})
+}
+
+// handleVaultScenarios serves what slashings of ?slash_pct= percent of a
+// vault, repeatable, would take from each tranche at its latest balances
+func (s *AnalyticsServer) handleVaultScenarios(w http.ResponseWriter, r *http.Request) {
+	address, chainID, ok := vaultParams(w, r)
+	if !ok {
+		return
+	}
+	slashes := defaultSlashScenarios
+	if values := r.URL.Query()["slash_pct"]; len(values) > 0 {
+		slashes = nil
+		for _, value := range values {
+			pct, err := strconv.ParseFloat(value, 64)
+			if err != nil || pct <= 0 || pct > 100 {
+				http.Error(w, fmt.Sprintf("Invalid slash_pct %q", value), http.StatusBadRequest)
+				return
+			}
+			slashes = append(slashes, pct)
+		}
+	}
+
+	tranches, err := s.trancheBalances(r.Context(), address, chainID)
+	if err != nil {
+		log.Printf("Vault scenario error: %v", err)
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	if len(tranches) == 0 {
+		http.Error(w, "Vault not found", http.StatusNotFound)
+		return
+	}
+
+	scenarios := make([]SlashScenario, len(slashes))
+	for i, pct := range slashes {
+		scenarios[i] = slashScenario(tranches, pct)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnalyticsResponse{Success: true, Data: map[string]interface{}{
+		"vault_address": address,
+		"chain_id":      chainID,
+		"scenarios":     scenarios,
+	}})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket clients receive every event until they send a subscribe message
+// such as
+//
+//	{"action": "subscribe", "types": ["payment"], "chain_ids": [1], "addresses": ["0xabc..."]}
+//
+// after which only matching events are sent. An empty list matches anything,
+// and events that carry no chain or address are not filtered on it. Each
+// client has its own send buffer; a client that lets it fill is disconnected
+// rather than holding up the others. Clients are pinged every
+// WS_PING_INTERVAL, and one that has not answered, or sent anything, for two
+// intervals is disconnected, so half-open connections do not pile up.
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	// wsMaxMessageSize bounds the subscribe messages clients send
+	wsMaxMessageSize = 64 << 10
+)
+
+var wsEventTypes = map[string]bool{"payment": true, "validator": true, "vault": true, "alert": true, "aggregates": true}
+
+// Subscription selects the events a WebSocket client receives
+type Subscription struct {
+	Types     []string `json:"types,omitempty"`
+	ChainIDs  []uint64 `json:"chain_ids,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// wsRequest is a message sent by a WebSocket client
+type wsRequest struct {
+	Action string `json:"action"`
+	Subscription
+}
+
+// wsEvent is a broadcast with the fields subscriptions filter on
+type wsEvent struct {
+	Type      string
+	ChainID   uint64
+	Addresses []string
+	Merchant  string
+	Data      interface{}
+}
+
+func (s *Subscription) matches(event *wsEvent) bool {
+	if len(s.Types) > 0 && !containsString(s.Types, event.Type) {
+		return false
+	}
+	if len(s.ChainIDs) > 0 && event.ChainID != 0 {
+		found := false
+		for _, chainID := range s.ChainIDs {
+			found = found || chainID == event.ChainID
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(s.Addresses) > 0 && len(event.Addresses) > 0 {
+		for _, address := range event.Addresses {
+			if containsString(s.Addresses, strings.ToLower(address)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// wsClient is a WebSocket connection, the scope of its token and the events
+// it subscribed to
+type wsClient struct {
+	conn         *websocket.Conn
+	send         chan []byte
+	scope        *Scope
+	subscription *Subscription
+	mutex        sync.Mutex
+}
+
+func (c *wsClient) wants(event *wsEvent) bool {
+	if !c.scope.allows(event) {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.subscription == nil || c.subscription.matches(event)
+}
+
+// handleRequest applies a subscribe or unsubscribe message and returns the
+// reply. Unsubscribing restores the default of receiving every event.
+func (c *wsClient) handleRequest(data []byte) map[string]interface{} {
+	var req wsRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return map[string]interface{}{"type": "error", "error": "invalid JSON"}
+	}
+
+	switch req.Action {
+	case "subscribe":
+		for _, eventType := range req.Types {
+			if !wsEventTypes[eventType] {
+				return map[string]interface{}{"type": "error", "error": fmt.Sprintf("unknown event type %q", eventType)}
+			}
+		}
+		subscription := req.Subscription
+		for i, address := range subscription.Addresses {
+			subscription.Addresses[i] = strings.ToLower(address)
+		}
+
+		c.mutex.Lock()
+		c.subscription = &subscription
+		c.mutex.Unlock()
+		return map[string]interface{}{"type": "subscribed", "data": subscription}
+	case "unsubscribe":
+		c.mutex.Lock()
+		c.subscription = nil
+		c.mutex.Unlock()
+		return map[string]interface{}{"type": "unsubscribed"}
+	default:
+		return map[string]interface{}{"type": "error", "error": fmt.Sprintf("unknown action %q", req.Action)}
+	}
+}
+
+// writeClient is the only writer of a client's connection. It sends the
+// client's buffered messages and pings it every ping interval, until its
+// buffer is closed or a write fails.
+func (s *AnalyticsServer) writeClient(client *wsClient) {
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message, ok := <-client.send:
+			// removeClient closes the buffer along with the connection
+			if !ok {
+				return
+			}
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				s.removeClient(client)
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				s.removeClient(client)
+				return
+			}
+		}
+	}
+}
+
+// readClient applies a client's subscription requests until it disconnects
+// or stays silent, answering no ping, for two ping intervals
+func (s *AnalyticsServer) readClient(client *wsClient) {
+	readWait := 2 * s.pingInterval
+	client.conn.SetReadLimit(wsMaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(readWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(readWait))
+	})
+
+	for {
+		_, data, err := client.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("WebSocket client %s dropped: %v", client.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		client.conn.SetReadDeadline(time.Now().Add(readWait))
+		s.reply(client, client.handleRequest(data))
+	}
+}
+
+// reply queues a message for one client, dropping it if the buffer is full
+func (s *AnalyticsServer) reply(client *wsClient, data map[string]interface{}) {
+	message, _ := json.Marshal(data)
+
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	if s.clients[client] {
+		select {
+		case client.send <- message:
+		default:
+		}
+	}
+}
+
+// removeClient closes a client's connection and send buffer. It is safe to
+// call more than once.
+func (s *AnalyticsServer) removeClient(client *wsClient) {
+	s.clientsMutex.Lock()
+	removed := s.clients[client]
+	if removed {
+		delete(s.clients, client)
+		close(client.send)
+	}
+	remaining := len(s.clients)
+	s.clientsMutex.Unlock()
+
+	client.conn.Close()
+	if removed {
+		log.Printf("WebSocket client disconnected. Remaining clients: %d", remaining)
+	}
+}
+
+// alertEvent routes an alert by the chain and addresses in its labels
+func alertEvent(alert Alert) wsEvent {
+	event := wsEvent{Type: "alert", Data: alert}
+	if chainID, err := strconv.ParseUint(alert.Labels["chain_id"], 10, 64); err == nil {
+		event.ChainID = chainID
+	}
+	for _, label := range []string{"validator_address", "vault_address"} {
+		if address := alert.Labels[label]; address != "" {
+			event.Addresses = append(event.Addresses, address)
+		}
+	}
+	return event
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/config"
+)
+
+// Config holds the resolver's settings, loaded from the file at
+// CONFIG_FILE and the environment
+type Config struct {
+	Port string `config:"port" env:"PORT" default:"8082" validate:"required"`
+	// CORSAllowedOrigins may call the API from a browser, "*" for any
+	CORSAllowedOrigins []string `config:"cors_allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	// Jobs are the schedules of the background jobs: cron expressions,
+	// descriptors such as @hourly, or "@every <duration>"
+	Jobs struct {
+		CacheEviction string `config:"cache_eviction" env:"CACHE_EVICTION_SCHEDULE" default:"@every 5m" validate:"required"`
+		// Jitter delays each run by up to this much
+		Jitter time.Duration `config:"jitter" env:"JOB_JITTER" default:"0s" validate:"min=0s"`
+	} `config:"jobs"`
+	Admin auth.Config `config:"admin"`
+}
+
+// loadConfig loads and validates the resolver's settings
+func loadConfig() (*Config, *config.Result, error) {
+	var cfg Config
+	result, err := config.Load(&cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cfg, result, nil
+}
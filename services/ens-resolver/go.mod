@@ -2,9 +2,26 @@ module ens-resolver
 
 go 1.25.0
 
+require (
+	github.com/arcbjorn/crosspay/packages/auth v0.0.0
+	github.com/arcbjorn/crosspay/packages/config v0.0.0
+	github.com/arcbjorn/crosspay/packages/middleware v0.0.0
+	github.com/arcbjorn/crosspay/packages/problem v0.0.0
+	github.com/arcbjorn/crosspay/packages/scheduler v0.0.0
+	github.com/stretchr/testify v1.11.1
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pelletier/go-toml/v2 v2.2.2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.11.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace (
+	github.com/arcbjorn/crosspay/packages/auth => ../../packages/auth
+	github.com/arcbjorn/crosspay/packages/config => ../../packages/config
+	github.com/arcbjorn/crosspay/packages/middleware => ../../packages/middleware
+	github.com/arcbjorn/crosspay/packages/problem => ../../packages/problem
+	github.com/arcbjorn/crosspay/packages/scheduler => ../../packages/scheduler
+)
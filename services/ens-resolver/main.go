@@ -9,9 +9,39 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/middleware"
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/arcbjorn/crosspay/packages/scheduler"
 )
 
 func main() {
+	cfg, settings, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	admin, err := auth.New("ens-resolver", cfg.Admin)
+	if err != nil {
+		log.Fatalf("Failed to open admin audit log: %v", err)
+	}
+	defer admin.Close()
+
+	jobs := scheduler.New()
+	err = jobs.Add(scheduler.Job{
+		Name:     "cache_eviction",
+		Schedule: cfg.Jobs.CacheEviction,
+		Jitter:   cfg.Jobs.Jitter,
+		Run: func(context.Context) error {
+			evictExpiredEntries()
+			return nil
+		},
+	})
+	if err != nil {
+		log.Fatalf("Invalid job schedule: %v", err)
+	}
+
 	mux := http.NewServeMux()
 	
 	// Health check endpoint
@@ -39,33 +69,50 @@ func main() {
 	mux.HandleFunc("/api/subnames/revoke/", handleRevokeSubname)
 
 	// Cache management endpoints
-	mux.HandleFunc("/api/cache/stats", handleCacheStats)
-	mux.HandleFunc("/api/cache/clear", handleClearCache)
-	mux.HandleFunc("/api/cache/entry/", handleClearCacheEntry)
+	mux.Handle("/api/cache/stats", admin.Require("ens.cache.stats", auth.Roles...)(http.HandlerFunc(handleCacheStats)))
+	mux.Handle("/api/cache/clear", admin.Require("ens.cache.clear", auth.RoleOperator)(http.HandlerFunc(handleClearCache)))
+	mux.Handle("/api/cache/entry/", admin.Require("ens.cache.clear_entry", auth.RoleOperator, auth.RoleSupport)(http.HandlerFunc(handleClearCacheEntry)))
+
+	// Background job status
+	mux.Handle("/api/jobs", admin.Require("ens.jobs", auth.Roles...)(jobs.Handler()))
+
+	// Admin audit log
+	mux.Handle("/admin/audit", admin.AuditHandler())
+
+	// Effective configuration, secrets redacted
+	mux.HandleFunc("/config", settings.Handler())
 
 	srv := &http.Server{
-		Addr:    ":8082",
-		Handler: mux,
+		Addr: ":" + cfg.Port,
+		Handler: middleware.Chain(mux,
+			middleware.Logger(nil),
+			problem.Adapt,
+			middleware.Recover(nil),
+			middleware.CORS(middleware.CORSConfig{AllowedOrigins: cfg.CORSAllowedOrigins}),
+		),
 	}
 
 	// Initialize ENS resolver
 	initializeENSResolver()
 
 	go func() {
-		log.Println("ENS resolver starting on :8082")
+		log.Printf("ENS resolver starting on :%s", cfg.Port)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 	}()
 
-	// Start background services
-	go startCacheEviction()
+	// Start background jobs
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	jobs.Start(jobsCtx)
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	log.Println("Shutting down ENS resolver...")
+	stopJobs()
 	
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -91,14 +138,3 @@ func initializeENSResolver() {
 	
 	log.Println("ENS resolver initialized")
 }
-
-func startCacheEviction() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-
-	log.Println("Starting cache eviction process...")
-	
-	for range ticker.C {
-		evictExpiredEntries()
-	}
-}
\ No newline at end of file
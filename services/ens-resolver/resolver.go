@@ -9,6 +9,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
 )
 
 type ENSRecord struct {
@@ -147,7 +149,7 @@ func handleResolveName(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Name not found: %s", name)})
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Name not found: %s", name), "code": problem.CodeENSNotResolved})
 		return
 	}
 	
@@ -194,7 +196,7 @@ func handleReverseResolve(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("No ENS name found for address: %s", address)})
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("No ENS name found for address: %s", address), "code": problem.CodeENSNotResolved})
 		return
 	}
 	
@@ -302,7 +304,7 @@ func handleGetAvatar(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Name not found"})
+			json.NewEncoder(w).Encode(map[string]string{"error": "Name not found", "code": problem.CodeENSNotResolved})
 			return
 		}
 		record = resolved
@@ -311,7 +313,7 @@ func handleGetAvatar(w http.ResponseWriter, r *http.Request) {
 	if record.Avatar == "" {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "No avatar set for this name"})
+		json.NewEncoder(w).Encode(map[string]string{"error": "No avatar set for this name", "code": problem.CodeENSRecordNotSet})
 		return
 	}
 	
@@ -350,7 +352,7 @@ func handleGetTextRecord(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Name not found"})
+			json.NewEncoder(w).Encode(map[string]string{"error": "Name not found", "code": problem.CodeENSNotResolved})
 			return
 		}
 		record = resolved
@@ -359,7 +361,7 @@ func handleGetTextRecord(w http.ResponseWriter, r *http.Request) {
 	if record.TextRecords == nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "No text records found"})
+		json.NewEncoder(w).Encode(map[string]string{"error": "No text records found", "code": problem.CodeENSRecordNotSet})
 		return
 	}
 	
@@ -367,7 +369,7 @@ func handleGetTextRecord(w http.ResponseWriter, r *http.Request) {
 	if !exists {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Text record '%s' not found", key)})
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Text record '%s' not found", key), "code": problem.CodeENSRecordNotSet})
 		return
 	}
 	
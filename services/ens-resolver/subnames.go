@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
 )
 
 type SubnameRegistration struct {
@@ -143,7 +145,7 @@ func handleRegisterSubname(w http.ResponseWriter, r *http.Request) {
 	if exists && existing.Active {
 		w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusConflict)
-	json.NewEncoder(w).Encode(map[string]interface{}{"error": "Subname already registered"})
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": "Subname already registered", "code": problem.CodeSubnameTaken})
 		return
 	}
 	
@@ -406,7 +408,7 @@ func handleRevokeSubname(w http.ResponseWriter, r *http.Request) {
 	if !exists || !registration.Active {
 		w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusNotFound)
-	json.NewEncoder(w).Encode(map[string]interface{}{"error": "Subname not found or already inactive"})
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": "Subname not found or already inactive", "code": problem.CodeSubnameInactive})
 		return
 	}
 	
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// Channels users can be notified on
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+	ChannelPush  = "push"
+)
+
+// errPermanent marks delivery failures retrying cannot fix, such as a push
+// subscription the browser has removed
+var errPermanent = errors.New("permanent failure")
+
+// Channel delivers messages to one kind of destination: an email address, a
+// phone number or a push subscription endpoint
+type Channel interface {
+	// Send delivers the message and returns the provider's reference for it
+	Send(ctx context.Context, destination string, message *Message) (string, error)
+}
+
+// buildChannels returns the channels that are configured
+func buildChannels(cfg *Config) map[string]Channel {
+	client := &http.Client{Timeout: cfg.Delivery.Timeout}
+	channels := make(map[string]Channel)
+
+	switch cfg.Email.Provider {
+	case "smtp":
+		if cfg.Email.SMTP.Addr != "" {
+			channels[ChannelEmail] = &smtpChannel{
+				addr:     cfg.Email.SMTP.Addr,
+				from:     cfg.Email.From,
+				username: cfg.Email.SMTP.Username,
+				password: cfg.Email.SMTP.Password,
+			}
+		}
+	case "ses":
+		if cfg.Email.SES.AccessKeyID != "" {
+			channels[ChannelEmail] = newSESChannel(cfg, client)
+		}
+	}
+
+	if cfg.SMS.AccountSID != "" && cfg.SMS.From != "" {
+		channels[ChannelSMS] = &twilioChannel{
+			apiURL:     strings.TrimRight(cfg.SMS.APIURL, "/"),
+			accountSID: cfg.SMS.AccountSID,
+			authToken:  cfg.SMS.AuthToken,
+			from:       cfg.SMS.From,
+			client:     client,
+		}
+	}
+
+	if cfg.Push.VAPIDPublicKey != "" && cfg.Push.VAPIDPrivateKey != "" {
+		channels[ChannelPush] = &webPushChannel{
+			publicKey:  cfg.Push.VAPIDPublicKey,
+			privateKey: cfg.Push.VAPIDPrivateKey,
+			subject:    cfg.Push.Subject,
+			ttl:        cfg.Push.TTL,
+			client:     client,
+		}
+	}
+	return channels
+}
+
+// smtpChannel sends plain-text email over SMTP
+type smtpChannel struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func (c *smtpChannel) Send(ctx context.Context, destination string, message *Message) (string, error) {
+	var auth smtp.Auth
+	if c.username != "" {
+		auth = smtp.PlainAuth("", c.username, c.password, strings.Split(c.addr, ":")[0])
+	}
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		c.from, destination, message.Subject, strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	if err := smtp.SendMail(c.addr, auth, c.from, []string{destination}, []byte(body)); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// sesChannel sends email through the Amazon SES v2 API
+type sesChannel struct {
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	from      string
+	client    *http.Client
+	now       func() time.Time
+}
+
+func newSESChannel(cfg *Config, client *http.Client) *sesChannel {
+	endpoint := cfg.Email.SES.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://email.%s.amazonaws.com", cfg.Email.SES.Region)
+	}
+	return &sesChannel{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		region:    cfg.Email.SES.Region,
+		accessKey: cfg.Email.SES.AccessKeyID,
+		secretKey: cfg.Email.SES.SecretAccessKey,
+		from:      cfg.Email.From,
+		client:    client,
+		now:       time.Now,
+	}
+}
+
+func (c *sesChannel) Send(ctx context.Context, destination string, message *Message) (string, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"FromEmailAddress": c.from,
+		"Destination":      map[string]interface{}{"ToAddresses": []string{destination}},
+		"Content": map[string]interface{}{
+			"Simple": map[string]interface{}{
+				"Subject": map[string]string{"Data": message.Subject, "Charset": "UTF-8"},
+				"Body": map[string]interface{}{
+					"Text": map[string]string{"Data": message.Body, "Charset": "UTF-8"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+"/v2/email/outbound-emails", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.sign(req, payload)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("SES responded with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusBadRequest {
+			err = fmt.Errorf("%w: %v", errPermanent, err)
+		}
+		return "", err
+	}
+
+	var result struct {
+		MessageID string `json:"MessageId"`
+	}
+	json.Unmarshal(body, &result)
+	return result.MessageID, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+func (c *sesChannel) sign(req *http.Request, payload []byte) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("Host", req.URL.Host)
+
+	headerNames := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		headerNames = append(headerNames, strings.ToLower(name))
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name)
+		canonicalHeaders.WriteString(":")
+		canonicalHeaders.WriteString(strings.TrimSpace(req.Header.Get(name)))
+		canonicalHeaders.WriteString("\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/ses/aws4_request", shortDate, c.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), shortDate)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "ses")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// twilioChannel sends SMS through the Twilio Messages API
+type twilioChannel struct {
+	apiURL     string
+	accountSID string
+	authToken  string
+	from       string
+	client     *http.Client
+}
+
+func (c *twilioChannel) Send(ctx context.Context, destination string, message *Message) (string, error) {
+	form := url.Values{"To": {destination}, "From": {c.from}, "Body": {message.Short}}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", c.apiURL, url.PathEscape(c.accountSID))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.accountSID, c.authToken)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		SID     string `json:"sid"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&result)
+
+	if resp.StatusCode >= 300 {
+		err := fmt.Errorf("Twilio responded with status %d: %s", resp.StatusCode, result.Message)
+		if resp.StatusCode == http.StatusBadRequest {
+			err = fmt.Errorf("%w: %v", errPermanent, err)
+		}
+		return "", err
+	}
+	return result.SID, nil
+}
+
+// webPushChannel sends Web Push notifications signed with the service's
+// VAPID key. The destination is a subscription endpoint; its keys are read
+// from the push_subscriptions table.
+type webPushChannel struct {
+	publicKey  string
+	privateKey string
+	subject    string
+	ttl        time.Duration
+	client     *http.Client
+}
+
+func (c *webPushChannel) Send(ctx context.Context, destination string, message *Message) (string, error) {
+	subscription, err := getPushSubscription(destination)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errPermanent, err)
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"title": message.Subject,
+		"body":  message.Short,
+		"url":   message.URL,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := webpush.SendNotificationWithContext(ctx, payload, subscription, &webpush.Options{
+		HTTPClient:      c.client,
+		Subscriber:      c.subject,
+		VAPIDPublicKey:  c.publicKey,
+		VAPIDPrivateKey: c.privateKey,
+		TTL:             int(c.ttl.Seconds()),
+		Urgency:         webpush.UrgencyNormal,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotFound:
+		// The browser unsubscribed; stop sending to it
+		if err := deletePushSubscription(destination); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: subscription expired with status %d", errPermanent, resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return "", fmt.Errorf("push service responded with status %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Location"), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTwilioChannel(t *testing.T) {
+	message := &Message{Subject: "Payment #7 completed", Short: "CrossPay: payment #7 completed"}
+
+	t.Run("should send the short message and return its SID", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/2010-04-01/Accounts/AC123/Messages.json", r.URL.Path)
+			user, pass, ok := r.BasicAuth()
+			assert.True(t, ok)
+			assert.Equal(t, "AC123", user)
+			assert.Equal(t, "secret", pass)
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "+14155550123", r.PostForm.Get("To"))
+			assert.Equal(t, "+15005550006", r.PostForm.Get("From"))
+			assert.Equal(t, message.Short, r.PostForm.Get("Body"))
+
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"sid": "SM1"})
+		}))
+		defer server.Close()
+
+		channel := &twilioChannel{apiURL: server.URL, accountSID: "AC123", authToken: "secret", from: "+15005550006", client: server.Client()}
+		reference, err := channel.Send(context.Background(), "+14155550123", message)
+		require.NoError(t, err)
+		assert.Equal(t, "SM1", reference)
+	})
+
+	t.Run("should not retry rejected numbers", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "The 'To' number is not a valid phone number."})
+		}))
+		defer server.Close()
+
+		channel := &twilioChannel{apiURL: server.URL, accountSID: "AC123", authToken: "secret", from: "+15005550006", client: server.Client()}
+		_, err := channel.Send(context.Background(), "+10000000", message)
+		assert.True(t, errors.Is(err, errPermanent))
+	})
+}
+
+func TestSESChannel(t *testing.T) {
+	t.Run("should send a signed SES v2 request", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v2/email/outbound-emails", r.URL.Path)
+			assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"),
+				"AWS4-HMAC-SHA256 Credential=AKID/20251018/eu-west-1/ses/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature="))
+			assert.Equal(t, "20251018T120000Z", r.Header.Get("X-Amz-Date"))
+
+			var body struct {
+				FromEmailAddress string
+				Destination      struct{ ToAddresses []string }
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "notifications@crosspay.test", body.FromEmailAddress)
+			assert.Equal(t, []string{"alice@example.com"}, body.Destination.ToAddresses)
+
+			json.NewEncoder(w).Encode(map[string]string{"MessageId": "ses-1"})
+		}))
+		defer server.Close()
+
+		channel := &sesChannel{
+			endpoint:  server.URL,
+			region:    "eu-west-1",
+			accessKey: "AKID",
+			secretKey: "secret",
+			from:      "notifications@crosspay.test",
+			client:    server.Client(),
+			now:       func() time.Time { return time.Date(2025, 10, 18, 12, 0, 0, 0, time.UTC) },
+		}
+		reference, err := channel.Send(context.Background(), "alice@example.com", &Message{Subject: "Hi", Body: "Hello"})
+		require.NoError(t, err)
+		assert.Equal(t, "ses-1", reference)
+	})
+}
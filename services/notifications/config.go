@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/config"
+)
+
+// Config holds the notification service's settings, loaded from the file at
+// CONFIG_FILE and the environment
+type Config struct {
+	Port         string `config:"port" env:"PORT" default:"8085" validate:"required"`
+	DatabasePath string `config:"database_path" env:"DATABASE_PATH" default:"./notifications.db" validate:"required"`
+
+	// CORSAllowedOrigins may call the API from a browser, "*" for any
+	CORSAllowedOrigins []string `config:"cors_allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	// AppURL is linked from notifications
+	AppURL string `config:"app_url" env:"APP_URL" default:"http://localhost:3000" validate:"url"`
+
+	Events struct {
+		// AnalyticsWSURL is the analytics event stream payment, validation and
+		// validator events are read from. Events are only taken over the API
+		// when it is empty.
+		AnalyticsWSURL string `config:"analytics_ws_url" env:"ANALYTICS_WS_URL" default:"ws://localhost:8084/ws" validate:"url"`
+		AnalyticsToken string `config:"analytics_token" env:"ANALYTICS_TOKEN" secret:"true"`
+		// Token is required from producers POSTing events when set
+		Token string `config:"token" env:"EVENTS_TOKEN" secret:"true"`
+	} `config:"events"`
+
+	Delivery struct {
+		MaxAttempts   int           `config:"max_attempts" env:"DELIVERY_MAX_ATTEMPTS" default:"5" validate:"min=1"`
+		RetryInterval time.Duration `config:"retry_interval" env:"DELIVERY_RETRY_INTERVAL" default:"1m" validate:"min=1s"`
+		Timeout       time.Duration `config:"timeout" env:"DELIVERY_TIMEOUT" default:"15s" validate:"min=1s"`
+	} `config:"delivery"`
+
+	Email struct {
+		Provider string `config:"provider" env:"EMAIL_PROVIDER" default:"smtp" validate:"oneof=smtp|ses"`
+		From     string `config:"from" env:"EMAIL_FROM" default:"notifications@crosspay.local"`
+		SMTP     struct {
+			Addr     string `config:"addr" env:"SMTP_ADDR"`
+			Username string `config:"username" env:"SMTP_USERNAME"`
+			Password string `config:"password" env:"SMTP_PASSWORD" secret:"true"`
+		} `config:"smtp"`
+		SES struct {
+			Region          string `config:"region" env:"SES_REGION" default:"us-east-1"`
+			Endpoint        string `config:"endpoint" env:"SES_ENDPOINT" validate:"url"`
+			AccessKeyID     string `config:"access_key_id" env:"SES_ACCESS_KEY_ID"`
+			SecretAccessKey string `config:"secret_access_key" env:"SES_SECRET_ACCESS_KEY" secret:"true"`
+		} `config:"ses"`
+	} `config:"email"`
+
+	SMS struct {
+		APIURL     string `config:"api_url" env:"TWILIO_API_URL" default:"https://api.twilio.com" validate:"url"`
+		AccountSID string `config:"account_sid" env:"TWILIO_ACCOUNT_SID"`
+		AuthToken  string `config:"auth_token" env:"TWILIO_AUTH_TOKEN" secret:"true"`
+		From       string `config:"from" env:"SMS_FROM"`
+	} `config:"sms"`
+
+	Push struct {
+		VAPIDPublicKey  string `config:"vapid_public_key" env:"VAPID_PUBLIC_KEY"`
+		VAPIDPrivateKey string `config:"vapid_private_key" env:"VAPID_PRIVATE_KEY" secret:"true"`
+		// Subject is the contact push services reach the sender at, a mailto:
+		// or https: URL
+		Subject string        `config:"subject" env:"VAPID_SUBJECT" default:"mailto:notifications@crosspay.local"`
+		TTL     time.Duration `config:"ttl" env:"PUSH_TTL" default:"24h" validate:"min=0s"`
+	} `config:"push"`
+}
+
+// loadConfig loads and validates the service's settings
+func loadConfig() (*Config, *config.Result, error) {
+	var cfg Config
+	result, err := config.Load(&cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cfg, result, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	_ "modernc.org/sqlite"
+)
+
+var db *sql.DB
+
+func openNotificationDB(dbPath string) error {
+	var err error
+	db, err = sql.Open("sqlite", dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// Each connection to an in-memory database is a separate database
+	if dbPath == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := createNotificationTables(); err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	log.Printf("SQLite database initialized: %s", dbPath)
+	return nil
+}
+
+func createNotificationTables() error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS preferences (
+		address TEXT PRIMARY KEY,
+		email TEXT NOT NULL DEFAULT '',
+		phone TEXT NOT NULL DEFAULT '',
+		channels TEXT NOT NULL DEFAULT '',
+		events TEXT NOT NULL DEFAULT '',
+		updated_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS push_subscriptions (
+		endpoint TEXT PRIMARY KEY,
+		address TEXT NOT NULL,
+		p256dh TEXT NOT NULL,
+		auth TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_push_subscriptions_address ON push_subscriptions(address);
+
+	CREATE TABLE IF NOT EXISTS deliveries (
+		id TEXT PRIMARY KEY,
+		event_key TEXT NOT NULL,
+		event TEXT NOT NULL,
+		address TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		short TEXT NOT NULL,
+		url TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		reference TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		UNIQUE (event_key, address, channel, destination)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_deliveries_address ON deliveries(address, created_at);
+	CREATE INDEX IF NOT EXISTS idx_deliveries_status ON deliveries(status);
+	`
+
+	_, err := db.Exec(schema)
+	return err
+}
+
+func closeDB() error {
+	if db != nil {
+		return db.Close()
+	}
+	return nil
+}
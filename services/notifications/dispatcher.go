@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Deliveries are recorded before they are sent, so a failed send is retried
+// every RetryInterval until it succeeds or MaxAttempts is reached. An event
+// is delivered at most once per address, channel and destination, however
+// often it is received.
+
+// Delivery statuses
+const (
+	DeliveryPending = "pending"
+	DeliverySent    = "sent"
+	DeliveryFailed  = "failed"
+)
+
+// eventQueueSize is how many received events may wait to be dispatched
+const eventQueueSize = 1000
+
+// Delivery is one notification to one destination
+type Delivery struct {
+	ID          string    `json:"id"`
+	EventKey    string    `json:"event_key"`
+	Event       string    `json:"event"`
+	Address     string    `json:"address"`
+	Channel     string    `json:"channel"`
+	Destination string    `json:"destination"`
+	Subject     string    `json:"subject"`
+	Body        string    `json:"-"`
+	Short       string    `json:"-"`
+	URL         string    `json:"-"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error,omitempty"`
+	Reference   string    `json:"reference,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Dispatcher turns events into deliveries on the channels each recipient
+// chose
+type Dispatcher struct {
+	channels      map[string]Channel
+	appURL        string
+	maxAttempts   int
+	retryInterval time.Duration
+	timeout       time.Duration
+	events        chan *Event
+	now           func() time.Time
+}
+
+func NewDispatcher(cfg *Config, channels map[string]Channel) *Dispatcher {
+	return &Dispatcher{
+		channels:      channels,
+		appURL:        cfg.AppURL,
+		maxAttempts:   cfg.Delivery.MaxAttempts,
+		retryInterval: cfg.Delivery.RetryInterval,
+		timeout:       cfg.Delivery.Timeout,
+		events:        make(chan *Event, eventQueueSize),
+		now:           time.Now,
+	}
+}
+
+// Enqueue queues an event for dispatch, dropping it if the queue is full
+func (d *Dispatcher) Enqueue(event *Event) bool {
+	select {
+	case d.events <- event:
+		return true
+	default:
+		log.Printf("Event queue full, dropping %s event %s", event.Type, event.Key)
+		return false
+	}
+}
+
+// Run dispatches queued events and retries failed deliveries until ctx is
+// done
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-d.events:
+			if err := d.Dispatch(ctx, event); err != nil {
+				log.Printf("Failed to dispatch %s event %s: %v", event.Type, event.Key, err)
+			}
+		case <-ticker.C:
+			if err := d.retry(ctx); err != nil {
+				log.Printf("Failed to retry deliveries: %v", err)
+			}
+		}
+	}
+}
+
+// Dispatch records and sends the deliveries for an event
+func (d *Dispatcher) Dispatch(ctx context.Context, event *Event) error {
+	addresses := make([]string, 0, len(event.Recipients))
+	for address := range event.Recipients {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	for _, address := range addresses {
+		prefs, err := getPreferences(address)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !prefs.wants(event.Type) {
+			continue
+		}
+
+		message, err := render(event, event.Recipients[address], d.appURL)
+		if err != nil {
+			return err
+		}
+
+		for _, channel := range prefs.Channels {
+			if d.channels[channel] == nil {
+				continue
+			}
+			destinations, err := d.destinations(prefs, channel)
+			if err != nil {
+				return err
+			}
+			for _, destination := range destinations {
+				delivery, err := d.record(event, address, channel, destination, message)
+				if err != nil {
+					return err
+				}
+				if delivery != nil {
+					d.deliver(ctx, delivery)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// destinations returns where a user is reached on a channel
+func (d *Dispatcher) destinations(prefs *Preferences, channel string) ([]string, error) {
+	switch channel {
+	case ChannelEmail:
+		return []string{prefs.Email}, nil
+	case ChannelSMS:
+		return []string{prefs.Phone}, nil
+	case ChannelPush:
+		return pushEndpoints(prefs.Address)
+	}
+	return nil, nil
+}
+
+// record stores a pending delivery. It returns nil if the event was already
+// delivered to the destination.
+func (d *Dispatcher) record(event *Event, address, channel, destination string, message *Message) (*Delivery, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := d.now().UTC()
+	delivery := &Delivery{
+		ID:          hex.EncodeToString(id),
+		EventKey:    event.Key,
+		Event:       event.Type,
+		Address:     address,
+		Channel:     channel,
+		Destination: destination,
+		Subject:     message.Subject,
+		Body:        message.Body,
+		Short:       message.Short,
+		URL:         message.URL,
+		Status:      DeliveryPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	result, err := db.Exec(`INSERT OR IGNORE INTO deliveries (id, event_key, event, address, channel, destination, subject, body, short, url, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		delivery.ID, delivery.EventKey, delivery.Event, delivery.Address, delivery.Channel, delivery.Destination,
+		delivery.Subject, delivery.Body, delivery.Short, delivery.URL, delivery.Status, now.Unix(), now.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to record delivery: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+	return delivery, nil
+}
+
+// deliver makes one attempt at a delivery and records the outcome
+func (d *Dispatcher) deliver(ctx context.Context, delivery *Delivery) {
+	channel := d.channels[delivery.Channel]
+	if channel == nil {
+		return
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	message := &Message{Subject: delivery.Subject, Body: delivery.Body, Short: delivery.Short, URL: delivery.URL}
+	reference, err := channel.Send(sendCtx, delivery.Destination, message)
+
+	delivery.Attempts++
+	delivery.UpdatedAt = d.now().UTC()
+	switch {
+	case err == nil:
+		delivery.Status = DeliverySent
+		delivery.Reference = reference
+		delivery.Error = ""
+	case errors.Is(err, errPermanent) || delivery.Attempts >= d.maxAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.Error = err.Error()
+		log.Printf("Giving up on %s delivery %s to %s: %v", delivery.Channel, delivery.ID, delivery.Address, err)
+	default:
+		delivery.Error = err.Error()
+		log.Printf("Failed to deliver %s delivery %s to %s, will retry: %v", delivery.Channel, delivery.ID, delivery.Address, err)
+	}
+
+	_, err = db.Exec(`UPDATE deliveries SET status = ?, attempts = ?, error = ?, reference = ?, updated_at = ? WHERE id = ?`,
+		delivery.Status, delivery.Attempts, delivery.Error, delivery.Reference, delivery.UpdatedAt.Unix(), delivery.ID)
+	if err != nil {
+		log.Printf("Failed to update delivery %s: %v", delivery.ID, err)
+	}
+}
+
+// retry makes another attempt at the pending deliveries whose last attempt
+// failed
+func (d *Dispatcher) retry(ctx context.Context) error {
+	deliveries, err := queryDeliveries(`WHERE status = ? AND attempts > 0 ORDER BY updated_at LIMIT 100`, DeliveryPending)
+	if err != nil {
+		return err
+	}
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		d.deliver(ctx, delivery)
+	}
+	return nil
+}
+
+const deliveryColumns = `id, event_key, event, address, channel, destination, subject, body, short, url, status, attempts, error, reference, created_at, updated_at`
+
+func getDelivery(id string) (*Delivery, error) {
+	deliveries, err := queryDeliveries(`WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return deliveries[0], nil
+}
+
+func queryDeliveries(where string, args ...interface{}) ([]*Delivery, error) {
+	rows, err := db.Query(`SELECT `+deliveryColumns+` FROM deliveries `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*Delivery{}
+	for rows.Next() {
+		delivery := &Delivery{}
+		var createdAt, updatedAt int64
+		err := rows.Scan(&delivery.ID, &delivery.EventKey, &delivery.Event, &delivery.Address, &delivery.Channel,
+			&delivery.Destination, &delivery.Subject, &delivery.Body, &delivery.Short, &delivery.URL, &delivery.Status,
+			&delivery.Attempts, &delivery.Error, &delivery.Reference, &createdAt, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		delivery.CreatedAt = time.Unix(createdAt, 0).UTC()
+		delivery.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testSender    = "0x00000000000000000000000000000000000000a1"
+	testRecipient = "0x00000000000000000000000000000000000000b2"
+)
+
+// fakeChannel records sends and fails them with err when set
+type fakeChannel struct {
+	sent []string
+	err  error
+}
+
+func (c *fakeChannel) Send(ctx context.Context, destination string, message *Message) (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	c.sent = append(c.sent, destination+": "+message.Subject)
+	return "ref-1", nil
+}
+
+func setupDispatcherTest(t *testing.T) (*Dispatcher, *fakeChannel, *fakeChannel) {
+	require.NoError(t, openNotificationDB(filepath.Join(t.TempDir(), "notifications.db")))
+	t.Cleanup(func() { closeDB() })
+
+	email := &fakeChannel{}
+	sms := &fakeChannel{}
+	cfg := &Config{AppURL: "https://app.crosspay.test"}
+	cfg.Delivery.MaxAttempts = 2
+	cfg.Delivery.RetryInterval = time.Minute
+	cfg.Delivery.Timeout = time.Second
+	return NewDispatcher(cfg, map[string]Channel{ChannelEmail: email, ChannelSMS: sms}), email, sms
+}
+
+func completedPayment() *Event {
+	return paymentEvent(PaymentMetric{
+		PaymentID: 7,
+		ChainID:   4202,
+		Sender:    testSender,
+		Recipient: "0x00000000000000000000000000000000000000B2",
+		Token:     "0x0000000000000000000000000000000000000000",
+		Amount:    "1000",
+		Status:    "completed",
+	})
+}
+
+func TestDispatch(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should notify recipients on the channels they chose", func(t *testing.T) {
+		dispatcher, email, sms := setupDispatcherTest(t)
+		require.NoError(t, savePreferences(&Preferences{Address: testSender, Email: "alice@example.com", Channels: []string{ChannelEmail}}))
+		require.NoError(t, savePreferences(&Preferences{Address: testRecipient, Phone: "+14155550123", Channels: []string{ChannelSMS}}))
+
+		require.NoError(t, dispatcher.Dispatch(ctx, completedPayment()))
+
+		assert.Equal(t, []string{"alice@example.com: Payment #7 completed"}, email.sent)
+		assert.Equal(t, []string{"+14155550123: Payment #7 completed"}, sms.sent)
+
+		deliveries, err := queryDeliveries(`WHERE address = ?`, testRecipient)
+		require.NoError(t, err)
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, DeliverySent, deliveries[0].Status)
+		assert.Equal(t, "ref-1", deliveries[0].Reference)
+		assert.Equal(t, 1, deliveries[0].Attempts)
+		assert.Equal(t, "https://app.crosspay.test/receipt/7", deliveries[0].URL)
+	})
+
+	t.Run("should deliver an event received twice once", func(t *testing.T) {
+		dispatcher, email, _ := setupDispatcherTest(t)
+		require.NoError(t, savePreferences(&Preferences{Address: testSender, Email: "alice@example.com", Channels: []string{ChannelEmail}}))
+
+		require.NoError(t, dispatcher.Dispatch(ctx, completedPayment()))
+		require.NoError(t, dispatcher.Dispatch(ctx, completedPayment()))
+
+		assert.Len(t, email.sent, 1)
+	})
+
+	t.Run("should skip events the recipient did not subscribe to", func(t *testing.T) {
+		dispatcher, email, _ := setupDispatcherTest(t)
+		require.NoError(t, savePreferences(&Preferences{
+			Address:  testSender,
+			Email:    "alice@example.com",
+			Channels: []string{ChannelEmail},
+			Events:   []string{EventValidationFailed},
+		}))
+
+		require.NoError(t, dispatcher.Dispatch(ctx, completedPayment()))
+
+		assert.Empty(t, email.sent)
+	})
+
+	t.Run("should retry failed deliveries until they succeed", func(t *testing.T) {
+		dispatcher, email, _ := setupDispatcherTest(t)
+		require.NoError(t, savePreferences(&Preferences{Address: testSender, Email: "alice@example.com", Channels: []string{ChannelEmail}}))
+
+		email.err = errors.New("connection refused")
+		require.NoError(t, dispatcher.Dispatch(ctx, completedPayment()))
+
+		deliveries, err := queryDeliveries(`WHERE address = ?`, testSender)
+		require.NoError(t, err)
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, DeliveryPending, deliveries[0].Status)
+		assert.Equal(t, "connection refused", deliveries[0].Error)
+
+		email.err = nil
+		require.NoError(t, dispatcher.retry(ctx))
+
+		delivery, err := getDelivery(deliveries[0].ID)
+		require.NoError(t, err)
+		assert.Equal(t, DeliverySent, delivery.Status)
+		assert.Equal(t, 2, delivery.Attempts)
+		assert.Empty(t, delivery.Error)
+	})
+
+	t.Run("should give up after max attempts or a permanent failure", func(t *testing.T) {
+		dispatcher, email, sms := setupDispatcherTest(t)
+		require.NoError(t, savePreferences(&Preferences{Address: testSender, Email: "alice@example.com", Channels: []string{ChannelEmail}}))
+		require.NoError(t, savePreferences(&Preferences{Address: testRecipient, Phone: "+14155550123", Channels: []string{ChannelSMS}}))
+
+		email.err = errors.New("connection refused")
+		sms.err = errPermanent
+		require.NoError(t, dispatcher.Dispatch(ctx, completedPayment()))
+		require.NoError(t, dispatcher.retry(ctx))
+
+		for _, address := range []string{testSender, testRecipient} {
+			deliveries, err := queryDeliveries(`WHERE address = ?`, address)
+			require.NoError(t, err)
+			require.Len(t, deliveries, 1)
+			assert.Equal(t, DeliveryFailed, deliveries[0].Status)
+		}
+	})
+}
+
+func TestPreferences(t *testing.T) {
+	t.Run("should require a destination for each channel", func(t *testing.T) {
+		prefs := &Preferences{Address: testSender, Channels: []string{ChannelEmail}}
+		assert.Error(t, prefs.validate())
+
+		prefs = &Preferences{Address: testSender, Phone: "4155550123", Channels: []string{ChannelSMS}}
+		assert.Error(t, prefs.validate())
+
+		prefs = &Preferences{Address: testSender, Channels: []string{"pager"}}
+		assert.Error(t, prefs.validate())
+	})
+
+	t.Run("should reject unknown events", func(t *testing.T) {
+		prefs := &Preferences{Address: testSender, Events: []string{"payment_lost"}}
+		assert.Error(t, prefs.validate())
+	})
+
+	t.Run("should normalize addresses", func(t *testing.T) {
+		prefs := &Preferences{Address: "0x00000000000000000000000000000000000000A1", Email: "Alice <alice@example.com>", Channels: []string{ChannelEmail}}
+		require.NoError(t, prefs.validate())
+		assert.Equal(t, testSender, prefs.Address)
+		assert.Equal(t, "alice@example.com", prefs.Email)
+	})
+}
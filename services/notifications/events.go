@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Notification events users can subscribe to. Payment and validation events
+// go to the payment's sender and recipient, validator events to the
+// validator.
+const (
+	EventPaymentCreated      = "payment_created"
+	EventPaymentCompleted    = "payment_completed"
+	EventPaymentRefunded     = "payment_refunded"
+	EventPaymentCancelled    = "payment_cancelled"
+	EventPaymentReorged      = "payment_reorged"
+	EventValidationCompleted = "validation_completed"
+	EventValidationFailed    = "validation_failed"
+	EventValidatorSlashed    = "validator_slashed"
+	EventValidatorExited     = "validator_exited"
+)
+
+// EventTypes lists every notification event
+var EventTypes = []string{
+	EventPaymentCreated,
+	EventPaymentCompleted,
+	EventPaymentRefunded,
+	EventPaymentCancelled,
+	EventPaymentReorged,
+	EventValidationCompleted,
+	EventValidationFailed,
+	EventValidatorSlashed,
+	EventValidatorExited,
+}
+
+// paymentEvents maps the payment statuses the analytics service reports to
+// notification events. The indexer reports validation results as a payment
+// turning validated or failed.
+var paymentEvents = map[string]string{
+	"pending":   EventPaymentCreated,
+	"completed": EventPaymentCompleted,
+	"refunded":  EventPaymentRefunded,
+	"cancelled": EventPaymentCancelled,
+	"reorged":   EventPaymentReorged,
+	"validated": EventValidationCompleted,
+	"failed":    EventValidationFailed,
+}
+
+// validatorEvents maps validator statuses to notification events
+var validatorEvents = map[string]string{
+	"slashed": EventValidatorSlashed,
+	"exited":  EventValidatorExited,
+}
+
+// PaymentMetric is the payment the analytics service broadcasts and accepts
+// on POST /api/metrics/payment
+type PaymentMetric struct {
+	PaymentID    uint64    `json:"payment_id"`
+	ChainID      uint64    `json:"chain_id"`
+	Sender       string    `json:"sender"`
+	Recipient    string    `json:"recipient"`
+	Token        string    `json:"token"`
+	Amount       string    `json:"amount"`
+	Status       string    `json:"status"`
+	IsPrivate    bool      `json:"is_private"`
+	RequiredSigs uint32    `json:"required_sigs,omitempty"`
+	ReceivedSigs uint32    `json:"received_sigs,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// ValidatorMetric is the validator status the analytics service broadcasts
+// and accepts on POST /api/metrics/validator
+type ValidatorMetric struct {
+	ValidatorAddr string    `json:"validator_address"`
+	ChainID       uint64    `json:"chain_id"`
+	Stake         string    `json:"stake"`
+	Status        string    `json:"status"`
+	Event         string    `json:"event,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// Event is something to notify users about
+type Event struct {
+	Type string
+	// Key identifies the event, so an event received twice is delivered once
+	Key     string
+	ChainID uint64
+	// Recipients maps the addresses to notify to their role in the event
+	Recipients map[string]string
+	Payment    *PaymentMetric
+	Validator  *ValidatorMetric
+}
+
+// paymentEvent returns the notification event for a payment metric, or nil
+// for statuses users are not notified about
+func paymentEvent(metric PaymentMetric) *Event {
+	eventType, ok := paymentEvents[metric.Status]
+	if !ok {
+		return nil
+	}
+
+	event := &Event{
+		Type:       eventType,
+		Key:        fmt.Sprintf("payment:%d:%d:%s", metric.ChainID, metric.PaymentID, metric.Status),
+		ChainID:    metric.ChainID,
+		Recipients: make(map[string]string),
+		Payment:    &metric,
+	}
+	if metric.Sender != "" {
+		event.Recipients[strings.ToLower(metric.Sender)] = "sender"
+	}
+	if metric.Recipient != "" {
+		event.Recipients[strings.ToLower(metric.Recipient)] = "recipient"
+	}
+	return event
+}
+
+// validatorEvent returns the notification event for a validator metric, or
+// nil for statuses validators are not notified about
+func validatorEvent(metric ValidatorMetric) *Event {
+	eventType, ok := validatorEvents[metric.Status]
+	if !ok || metric.ValidatorAddr == "" {
+		return nil
+	}
+
+	return &Event{
+		Type:       eventType,
+		Key:        fmt.Sprintf("validator:%d:%s:%s:%d", metric.ChainID, strings.ToLower(metric.ValidatorAddr), metric.Status, metric.Timestamp.Unix()),
+		ChainID:    metric.ChainID,
+		Recipients: map[string]string{strings.ToLower(metric.ValidatorAddr): "validator"},
+		Validator:  &metric,
+	}
+}
+
+// decodeEvent decodes a broadcast or POSTed metric of the given type
+func decodeEvent(metricType string, data []byte) (*Event, error) {
+	switch metricType {
+	case "payment":
+		var metric PaymentMetric
+		if err := json.Unmarshal(data, &metric); err != nil {
+			return nil, err
+		}
+		return paymentEvent(metric), nil
+	case "validator":
+		var metric ValidatorMetric
+		if err := json.Unmarshal(data, &metric); err != nil {
+			return nil, err
+		}
+		return validatorEvent(metric), nil
+	default:
+		return nil, fmt.Errorf("unknown event type %q", metricType)
+	}
+}
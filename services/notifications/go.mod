@@ -0,0 +1,42 @@
+module notifications
+
+go 1.25.0
+
+require (
+	github.com/SherClockHolmes/webpush-go v1.4.0
+	github.com/arcbjorn/crosspay/packages/config v0.0.0
+	github.com/arcbjorn/crosspay/packages/middleware v0.0.0
+	github.com/arcbjorn/crosspay/packages/problem v0.0.0
+	github.com/gorilla/websocket v1.5.1
+	github.com/stretchr/testify v1.11.1
+	modernc.org/sqlite v1.32.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/pelletier/go-toml/v2 v2.2.2 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+	modernc.org/gc/v3 v3.0.0-20240107210532-573471604cb6 // indirect
+	modernc.org/libc v1.55.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
+	modernc.org/strutil v1.2.0 // indirect
+	modernc.org/token v1.1.0 // indirect
+)
+
+replace (
+	github.com/arcbjorn/crosspay/packages/config => ../../packages/config
+	github.com/arcbjorn/crosspay/packages/middleware => ../../packages/middleware
+	github.com/arcbjorn/crosspay/packages/problem => ../../packages/problem
+)
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Server serves the preferences, push subscription, event and delivery API
+type Server struct {
+	config     *Config
+	channels   map[string]Channel
+	dispatcher *Dispatcher
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// handleChannels lists the channels that are configured and the events
+// users can choose from
+func (s *Server) handleChannels(w http.ResponseWriter, r *http.Request) {
+	channels := []string{}
+	for _, channel := range []string{ChannelEmail, ChannelSMS, ChannelPush} {
+		if s.channels[channel] != nil {
+			channels = append(channels, channel)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"channels": channels,
+		"events":   EventTypes,
+	})
+}
+
+func (s *Server) handleGetPreferences(w http.ResponseWriter, r *http.Request) {
+	prefs, err := getPreferences(r.PathValue("address"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "No preferences for address")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+func (s *Server) handlePutPreferences(w http.ResponseWriter, r *http.Request) {
+	var prefs Preferences
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	prefs.Address = r.PathValue("address")
+	if err := prefs.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, channel := range prefs.Channels {
+		if s.channels[channel] == nil {
+			writeError(w, http.StatusBadRequest, "Channel "+channel+" is not configured")
+			return
+		}
+	}
+
+	if err := savePreferences(&prefs); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+func (s *Server) handleDeletePreferences(w http.ResponseWriter, r *http.Request) {
+	err := deletePreferences(r.PathValue("address"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "No preferences for address")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePushKey returns the VAPID public key browsers subscribe with
+func (s *Server) handlePushKey(w http.ResponseWriter, r *http.Request) {
+	if s.channels[ChannelPush] == nil {
+		writeError(w, http.StatusServiceUnavailable, "Push notifications are not configured")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"public_key": s.config.Push.VAPIDPublicKey})
+}
+
+func (s *Server) handleSubscribePush(w http.ResponseWriter, r *http.Request) {
+	var sub PushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if err := sub.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := savePushSubscription(&sub); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"address": sub.Address, "endpoint": sub.Endpoint})
+}
+
+func (s *Server) handleUnsubscribePush(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Endpoint == "" {
+		writeError(w, http.StatusBadRequest, "endpoint is required")
+		return
+	}
+	if err := deletePushSubscription(request.Endpoint); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleEvent takes a payment or validator metric from a producer that does
+// not go through the analytics service
+func (s *Server) handleEvent(w http.ResponseWriter, r *http.Request) {
+	if token := s.config.Events.Token; token != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Failed to read body")
+		return
+	}
+	eventType := r.PathValue("type")
+	if eventType != "payment" && eventType != "validator" {
+		writeError(w, http.StatusNotFound, "Unknown event type "+eventType)
+		return
+	}
+	event, err := decodeEvent(eventType, data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if event == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"queued": false})
+		return
+	}
+	if !s.dispatcher.Enqueue(event) {
+		writeError(w, http.StatusServiceUnavailable, "Event queue is full")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"queued": true, "event": event.Type})
+}
+
+// handleListDeliveries lists an address's deliveries, newest first
+func (s *Server) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	address := strings.ToLower(query.Get("address"))
+	if !addressPattern.MatchString(address) {
+		writeError(w, http.StatusBadRequest, "address is required")
+		return
+	}
+
+	where := `WHERE address = ?`
+	args := []interface{}{address}
+	if status := query.Get("status"); status != "" {
+		where += ` AND status = ?`
+		args = append(args, status)
+	}
+	limit := 50
+	if value, err := strconv.Atoi(query.Get("limit")); err == nil && value > 0 && value <= 500 {
+		limit = value
+	}
+	where += ` ORDER BY created_at DESC LIMIT ?`
+	args = append(args, limit)
+
+	deliveries, err := queryDeliveries(where, args...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": deliveries, "count": len(deliveries)})
+}
+
+func (s *Server) handleGetDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, err := getDelivery(r.PathValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "Delivery not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, delivery)
+}
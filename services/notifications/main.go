@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/middleware"
+	"github.com/arcbjorn/crosspay/packages/problem"
+)
+
+func main() {
+	cfg, settings, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := openNotificationDB(cfg.DatabasePath); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer closeDB()
+
+	channels := buildChannels(cfg)
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("Notification channels: %v", names)
+
+	dispatcher := NewDispatcher(cfg, channels)
+	server := &Server{config: cfg, channels: channels, dispatcher: dispatcher}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":    "healthy",
+			"service":   "notifications",
+			"timestamp": time.Now().Unix(),
+		})
+	})
+
+	mux.HandleFunc("GET /api/channels", server.handleChannels)
+	mux.HandleFunc("GET /api/preferences/{address}", server.handleGetPreferences)
+	mux.HandleFunc("PUT /api/preferences/{address}", server.handlePutPreferences)
+	mux.HandleFunc("DELETE /api/preferences/{address}", server.handleDeletePreferences)
+	mux.HandleFunc("GET /api/push/key", server.handlePushKey)
+	mux.HandleFunc("POST /api/push/subscriptions", server.handleSubscribePush)
+	mux.HandleFunc("DELETE /api/push/subscriptions", server.handleUnsubscribePush)
+	mux.HandleFunc("POST /api/events/{type}", server.handleEvent)
+	mux.HandleFunc("GET /api/deliveries", server.handleListDeliveries)
+	mux.HandleFunc("GET /api/deliveries/{id}", server.handleGetDelivery)
+
+	// Effective configuration, secrets redacted
+	mux.HandleFunc("GET /config", settings.Handler())
+
+	srv := &http.Server{
+		Addr: ":" + cfg.Port,
+		Handler: middleware.Chain(mux,
+			middleware.Logger(nil),
+			problem.Adapt,
+			middleware.Recover(nil),
+			middleware.CORS(middleware.CORSConfig{AllowedOrigins: cfg.CORSAllowedOrigins}),
+		),
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	go dispatcher.Run(ctx)
+	if cfg.Events.AnalyticsWSURL != "" {
+		go NewAnalyticsStream(cfg.Events.AnalyticsWSURL, cfg.Events.AnalyticsToken, dispatcher).Run(ctx)
+	}
+
+	go func() {
+		log.Printf("Notification service starting on :%s", cfg.Port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Println("Shutting down notification service...")
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Fatalf("Server forced to shutdown: %v", err)
+	}
+
+	log.Println("Notification service stopped")
+}
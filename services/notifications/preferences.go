@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+var (
+	addressPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+	// phonePattern is an E.164 number, as SMS providers expect
+	phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+)
+
+// Preferences are how a user wants to be notified. Channels lists the
+// channels to use; Events lists the events to notify about, every event
+// when empty.
+type Preferences struct {
+	Address   string    `json:"address"`
+	Email     string    `json:"email"`
+	Phone     string    `json:"phone"`
+	Channels  []string  `json:"channels"`
+	Events    []string  `json:"events"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// validate normalizes the preferences and checks that every enabled channel
+// has somewhere to deliver to
+func (p *Preferences) validate() error {
+	if !addressPattern.MatchString(p.Address) {
+		return fmt.Errorf("invalid address %q", p.Address)
+	}
+	p.Address = strings.ToLower(p.Address)
+
+	if p.Email != "" {
+		parsed, err := mail.ParseAddress(p.Email)
+		if err != nil {
+			return fmt.Errorf("invalid email %q", p.Email)
+		}
+		p.Email = parsed.Address
+	}
+	if p.Phone != "" && !phonePattern.MatchString(p.Phone) {
+		return fmt.Errorf("invalid phone %q, expected E.164 such as +14155550123", p.Phone)
+	}
+
+	if p.Channels == nil {
+		p.Channels = []string{}
+	}
+	for _, channel := range p.Channels {
+		switch channel {
+		case ChannelEmail:
+			if p.Email == "" {
+				return errors.New("email is required for the email channel")
+			}
+		case ChannelSMS:
+			if p.Phone == "" {
+				return errors.New("phone is required for the sms channel")
+			}
+		case ChannelPush:
+		default:
+			return fmt.Errorf("unknown channel %q", channel)
+		}
+	}
+
+	if p.Events == nil {
+		p.Events = []string{}
+	}
+	for _, event := range p.Events {
+		if !containsString(EventTypes, event) {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the user wants to be notified about eventType
+func (p *Preferences) wants(eventType string) bool {
+	return len(p.Events) == 0 || containsString(p.Events, eventType)
+}
+
+func savePreferences(prefs *Preferences) error {
+	prefs.UpdatedAt = time.Now().UTC()
+	_, err := db.Exec(`INSERT OR REPLACE INTO preferences (address, email, phone, channels, events, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		prefs.Address, prefs.Email, prefs.Phone, strings.Join(prefs.Channels, ","), strings.Join(prefs.Events, ","), prefs.UpdatedAt.Unix())
+	return err
+}
+
+// getPreferences returns a user's preferences, or sql.ErrNoRows if they have
+// not set any
+func getPreferences(address string) (*Preferences, error) {
+	prefs := &Preferences{}
+	var channels, events string
+	var updatedAt int64
+	err := db.QueryRow(`SELECT address, email, phone, channels, events, updated_at FROM preferences WHERE address = ?`,
+		strings.ToLower(address)).Scan(&prefs.Address, &prefs.Email, &prefs.Phone, &channels, &events, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	prefs.Channels = splitList(channels)
+	prefs.Events = splitList(events)
+	prefs.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+	return prefs, nil
+}
+
+func deletePreferences(address string) error {
+	result, err := db.Exec(`DELETE FROM preferences WHERE address = ?`, strings.ToLower(address))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = db.Exec(`DELETE FROM push_subscriptions WHERE address = ?`, strings.ToLower(address))
+	return err
+}
+
+// PushSubscription is a browser's push subscription, as returned by
+// PushManager.subscribe(), for an address
+type PushSubscription struct {
+	Address  string `json:"address"`
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+func (s *PushSubscription) validate() error {
+	if !addressPattern.MatchString(s.Address) {
+		return fmt.Errorf("invalid address %q", s.Address)
+	}
+	s.Address = strings.ToLower(s.Address)
+	if !strings.HasPrefix(s.Endpoint, "https://") {
+		return fmt.Errorf("invalid endpoint %q", s.Endpoint)
+	}
+	if s.Keys.P256dh == "" || s.Keys.Auth == "" {
+		return errors.New("keys.p256dh and keys.auth are required")
+	}
+	return nil
+}
+
+// savePushSubscription stores a subscription. A browser that subscribes
+// again under another address moves its endpoint to that address.
+func savePushSubscription(sub *PushSubscription) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO push_subscriptions (endpoint, address, p256dh, auth, created_at) VALUES (?, ?, ?, ?, ?)`,
+		sub.Endpoint, sub.Address, sub.Keys.P256dh, sub.Keys.Auth, time.Now().Unix())
+	return err
+}
+
+func getPushSubscription(endpoint string) (*webpush.Subscription, error) {
+	sub := &webpush.Subscription{Endpoint: endpoint}
+	err := db.QueryRow(`SELECT p256dh, auth FROM push_subscriptions WHERE endpoint = ?`, endpoint).
+		Scan(&sub.Keys.P256dh, &sub.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func deletePushSubscription(endpoint string) error {
+	_, err := db.Exec(`DELETE FROM push_subscriptions WHERE endpoint = ?`, endpoint)
+	return err
+}
+
+// pushEndpoints returns the endpoints of an address's push subscriptions
+func pushEndpoints(address string) ([]string, error) {
+	rows, err := db.Query(`SELECT endpoint FROM push_subscriptions WHERE address = ? ORDER BY created_at`, address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []string
+	for rows.Next() {
+		var endpoint string
+		if err := rows.Scan(&endpoint); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, rows.Err()
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The analytics service broadcasts every payment and validator metric it
+// records, from the REST API, the event bus and the chain indexer, on its
+// WebSocket stream. The stream does not replay, so events broadcast while
+// the connection is down are not notified.
+
+const (
+	streamMinBackoff = time.Second
+	streamMaxBackoff = 30 * time.Second
+)
+
+// streamMessage is a message on the analytics WebSocket stream
+type streamMessage struct {
+	Type  string          `json:"type"`
+	Data  json.RawMessage `json:"data"`
+	Error string          `json:"error,omitempty"`
+}
+
+// AnalyticsStream reads events from the analytics WebSocket stream and
+// queues them for dispatch, reconnecting when the connection drops
+type AnalyticsStream struct {
+	url        string
+	token      string
+	dispatcher *Dispatcher
+	dialer     *websocket.Dialer
+}
+
+func NewAnalyticsStream(url, token string, dispatcher *Dispatcher) *AnalyticsStream {
+	return &AnalyticsStream{
+		url:        url,
+		token:      token,
+		dispatcher: dispatcher,
+		dialer:     &websocket.Dialer{HandshakeTimeout: 10 * time.Second},
+	}
+}
+
+// Run reads the stream until ctx is done
+func (s *AnalyticsStream) Run(ctx context.Context) {
+	backoff := streamMinBackoff
+	for {
+		connected, err := s.read(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = streamMinBackoff
+		}
+		log.Printf("Analytics stream disconnected, reconnecting in %s: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+// read connects, subscribes to payment and validator events and queues them
+// until the connection fails. It reports whether it got connected.
+func (s *AnalyticsStream) read(ctx context.Context) (bool, error) {
+	header := http.Header{}
+	if s.token != "" {
+		header.Set("Authorization", "Bearer "+s.token)
+	}
+	conn, _, err := s.dialer.DialContext(ctx, s.url, header)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Unblock ReadMessage when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	subscribe := map[string]interface{}{"action": "subscribe", "types": []string{"payment", "validator"}}
+	if err := conn.WriteJSON(subscribe); err != nil {
+		return true, err
+	}
+	log.Printf("Reading payment and validator events from %s", s.url)
+
+	for {
+		var message streamMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			return true, err
+		}
+
+		switch message.Type {
+		case "payment", "validator":
+			event, err := decodeEvent(message.Type, message.Data)
+			if err != nil {
+				log.Printf("Skipping malformed %s event: %v", message.Type, err)
+				continue
+			}
+			if event != nil {
+				s.dispatcher.Enqueue(event)
+			}
+		case "error":
+			log.Printf("Analytics stream error: %s", message.Error)
+		}
+	}
+}
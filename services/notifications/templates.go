@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Message is a rendered notification. Emails use Subject and Body, SMS and
+// push notifications the shorter Short, with Subject as the push title.
+type Message struct {
+	Subject string
+	Body    string
+	Short   string
+	URL     string
+}
+
+// messageTemplate is the text of one event's notifications
+type messageTemplate struct {
+	subject *template.Template
+	body    *template.Template
+	short   *template.Template
+}
+
+// templateData is what templates are rendered with
+type templateData struct {
+	Role      string
+	Payment   *PaymentMetric
+	Validator *ValidatorMetric
+	URL       string
+}
+
+func mustTemplate(name, subject, body, short string) *messageTemplate {
+	return &messageTemplate{
+		subject: template.Must(template.New(name + ".subject").Parse(subject)),
+		body:    template.Must(template.New(name + ".body").Parse(body)),
+		short:   template.Must(template.New(name + ".short").Parse(short)),
+	}
+}
+
+// paymentBody is the email body shared by payment and validation events
+const paymentBody = `Payment #{{.Payment.PaymentID}} on chain {{.Payment.ChainID}}
+{{if eq .Role "sender"}}To: {{.Payment.Recipient}}{{else}}From: {{.Payment.Sender}}{{end}}
+{{if .Payment.IsPrivate}}Amount: private{{else}}Amount: {{.Payment.Amount}} of token {{.Payment.Token}}{{end}}
+Status: {{.Payment.Status}}
+
+View the payment: {{.URL}}
+`
+
+var templates = map[string]*messageTemplate{
+	EventPaymentCreated: mustTemplate(EventPaymentCreated,
+		`{{if eq .Role "sender"}}Payment #{{.Payment.PaymentID}} created{{else}}Incoming payment #{{.Payment.PaymentID}}{{end}}`,
+		`{{if eq .Role "sender"}}Your payment was created and is waiting to complete.{{else}}A payment to you was created.{{end}}
+
+`+paymentBody,
+		`CrossPay: {{if eq .Role "sender"}}your payment #{{.Payment.PaymentID}} was created{{else}}incoming payment #{{.Payment.PaymentID}}{{end}}`),
+	EventPaymentCompleted: mustTemplate(EventPaymentCompleted,
+		`Payment #{{.Payment.PaymentID}} completed`,
+		`{{if eq .Role "sender"}}Your payment has completed.{{else}}A payment to you has completed and the funds are yours.{{end}}
+
+`+paymentBody,
+		`CrossPay: payment #{{.Payment.PaymentID}} completed`),
+	EventPaymentRefunded: mustTemplate(EventPaymentRefunded,
+		`Payment #{{.Payment.PaymentID}} refunded`,
+		`{{if eq .Role "sender"}}Your payment was refunded to you.{{else}}A payment to you was refunded to its sender.{{end}}
+
+`+paymentBody,
+		`CrossPay: payment #{{.Payment.PaymentID}} was refunded`),
+	EventPaymentCancelled: mustTemplate(EventPaymentCancelled,
+		`Payment #{{.Payment.PaymentID}} cancelled`,
+		`{{if eq .Role "sender"}}Your payment was cancelled.{{else}}A payment to you was cancelled by its sender.{{end}}
+
+`+paymentBody,
+		`CrossPay: payment #{{.Payment.PaymentID}} was cancelled`),
+	EventPaymentReorged: mustTemplate(EventPaymentReorged,
+		`Payment #{{.Payment.PaymentID}} was dropped by a chain reorganization`,
+		`The block with this payment was replaced by a chain reorganization. Check whether the payment was included again before relying on it.
+
+`+paymentBody,
+		`CrossPay: payment #{{.Payment.PaymentID}} was dropped by a chain reorg, check its status`),
+	EventValidationCompleted: mustTemplate(EventValidationCompleted,
+		`Payment #{{.Payment.PaymentID}} validated`,
+		`The relay validators approved this payment with {{.Payment.ReceivedSigs}} of {{.Payment.RequiredSigs}} required signatures.
+
+`+paymentBody,
+		`CrossPay: payment #{{.Payment.PaymentID}} was validated`),
+	EventValidationFailed: mustTemplate(EventValidationFailed,
+		`Payment #{{.Payment.PaymentID}} failed validation`,
+		`The relay validators did not approve this payment in time: it received {{.Payment.ReceivedSigs}} of {{.Payment.RequiredSigs}} required signatures.
+
+`+paymentBody,
+		`CrossPay: payment #{{.Payment.PaymentID}} failed validation`),
+	EventValidatorSlashed: mustTemplate(EventValidatorSlashed,
+		`Validator {{.Validator.ValidatorAddr}} was slashed`,
+		`Your validator {{.Validator.ValidatorAddr}} on chain {{.Validator.ChainID}} was slashed. Its remaining stake is {{.Validator.Stake}}.
+
+Open CrossPay: {{.URL}}
+`,
+		`CrossPay: your validator was slashed on chain {{.Validator.ChainID}}`),
+	EventValidatorExited: mustTemplate(EventValidatorExited,
+		`Validator {{.Validator.ValidatorAddr}} exited`,
+		`Your validator {{.Validator.ValidatorAddr}} on chain {{.Validator.ChainID}} has exited the validator set.
+
+Open CrossPay: {{.URL}}
+`,
+		`CrossPay: your validator exited on chain {{.Validator.ChainID}}`),
+}
+
+// render renders an event's notification for one of its recipients
+func render(event *Event, role, appURL string) (*Message, error) {
+	tmpl, ok := templates[event.Type]
+	if !ok {
+		return nil, fmt.Errorf("no template for event %s", event.Type)
+	}
+
+	data := templateData{Role: role, Payment: event.Payment, Validator: event.Validator}
+	appURL = strings.TrimRight(appURL, "/")
+	switch {
+	case event.Payment != nil:
+		data.URL = fmt.Sprintf("%s/receipt/%d", appURL, event.Payment.PaymentID)
+	default:
+		data.URL = appURL
+	}
+
+	message := &Message{URL: data.URL}
+	for _, part := range []struct {
+		tmpl *template.Template
+		out  *string
+	}{{tmpl.subject, &message.Subject}, {tmpl.body, &message.Body}, {tmpl.short, &message.Short}} {
+		var buf bytes.Buffer
+		if err := part.tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to render %s: %w", part.tmpl.Name(), err)
+		}
+		*part.out = buf.String()
+	}
+	return message, nil
+}
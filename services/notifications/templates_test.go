@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	t.Run("should map payment statuses to events", func(t *testing.T) {
+		event, err := decodeEvent("payment", []byte(`{"payment_id":3,"chain_id":4202,"sender":"0xA1","recipient":"0xB2","status":"validated"}`))
+		require.NoError(t, err)
+		require.NotNil(t, event)
+		assert.Equal(t, EventValidationCompleted, event.Type)
+		assert.Equal(t, "payment:4202:3:validated", event.Key)
+		assert.Equal(t, map[string]string{"0xa1": "sender", "0xb2": "recipient"}, event.Recipients)
+	})
+
+	t.Run("should ignore statuses users are not notified about", func(t *testing.T) {
+		event, err := decodeEvent("validator", []byte(`{"validator_address":"0xA1","chain_id":4202,"status":"active","event":"signed"}`))
+		require.NoError(t, err)
+		assert.Nil(t, event)
+	})
+
+	t.Run("should notify validators when slashed", func(t *testing.T) {
+		event, err := decodeEvent("validator", []byte(`{"validator_address":"0xA1","chain_id":4202,"status":"slashed","stake":"100"}`))
+		require.NoError(t, err)
+		require.NotNil(t, event)
+		assert.Equal(t, EventValidatorSlashed, event.Type)
+		assert.Equal(t, map[string]string{"0xa1": "validator"}, event.Recipients)
+	})
+}
+
+func TestRender(t *testing.T) {
+	t.Run("should have a template for every event", func(t *testing.T) {
+		for _, eventType := range EventTypes {
+			assert.Contains(t, templates, eventType)
+		}
+	})
+
+	t.Run("should word payments for the recipient's role", func(t *testing.T) {
+		event := paymentEvent(PaymentMetric{PaymentID: 9, ChainID: 84532, Sender: testSender, Recipient: testRecipient, Amount: "25", Token: "0xtoken", Status: "pending"})
+
+		message, err := render(event, "recipient", "https://app.crosspay.test/")
+		require.NoError(t, err)
+		assert.Equal(t, "Incoming payment #9", message.Subject)
+		assert.Contains(t, message.Body, "From: "+testSender)
+		assert.Contains(t, message.Body, "Amount: 25 of token 0xtoken")
+		assert.Contains(t, message.Body, "https://app.crosspay.test/receipt/9")
+		assert.Equal(t, "CrossPay: incoming payment #9", message.Short)
+
+		message, err = render(event, "sender", "https://app.crosspay.test")
+		require.NoError(t, err)
+		assert.Equal(t, "Payment #9 created", message.Subject)
+		assert.Contains(t, message.Body, "To: "+testRecipient)
+	})
+
+	t.Run("should hide private payment amounts", func(t *testing.T) {
+		event := paymentEvent(PaymentMetric{PaymentID: 9, Sender: testSender, Recipient: testRecipient, Amount: "25", IsPrivate: true, Status: "completed"})
+
+		message, err := render(event, "recipient", "https://app.crosspay.test")
+		require.NoError(t, err)
+		assert.Contains(t, message.Body, "Amount: private")
+		assert.NotContains(t, message.Body, "25")
+	})
+}
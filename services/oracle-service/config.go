@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/config"
+	"github.com/arcbjorn/crosspay/packages/flags"
+)
+
+// Config holds the oracle service's settings, loaded from the file at
+// CONFIG_FILE and the environment
+type Config struct {
+	Port string `config:"port" env:"PORT" default:"8081" validate:"required"`
+	// CORSAllowedOrigins may call the API from a browser, "*" for any
+	CORSAllowedOrigins []string `config:"cors_allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	// PriceHistory is how many points are kept per symbol for history and
+	// point-in-time lookups; at the default interval, 2880 is a day
+	PriceHistory int `config:"price_history" env:"PRICE_HISTORY_POINTS" default:"2880" validate:"min=1"`
+	// Jobs are the schedules of the background jobs: cron expressions,
+	// descriptors such as @hourly, or "@every <duration>"
+	Jobs struct {
+		PriceUpdate   string `config:"price_update" env:"PRICE_UPDATE_SCHEDULE" default:"@every 30s" validate:"required"`
+		RandomFulfill string `config:"random_fulfill" env:"RANDOM_FULFILL_SCHEDULE" default:"@every 10s" validate:"required"`
+		HealthCheck   string `config:"health_check" env:"HEALTH_CHECK_SCHEDULE" default:"@every 60s" validate:"required"`
+		// Jitter delays each run by up to this much
+		Jitter time.Duration `config:"jitter" env:"JOB_JITTER" default:"0s" validate:"min=0s"`
+	} `config:"jobs"`
+	Admin auth.Config `config:"admin"`
+	// Flags roll risky features, such as the FDC payment webhook, out per
+	// merchant
+	Flags flags.Config `config:"flags"`
+}
+
+// loadConfig loads and validates the service's settings
+func loadConfig() (*Config, *config.Result, error) {
+	var cfg Config
+	result, err := config.Load(&cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cfg, result, nil
+}
@@ -10,6 +10,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
 )
 
 type ExternalProof struct {
@@ -221,7 +223,7 @@ func handleConfirmProof(w http.ResponseWriter, r *http.Request) {
 	if proof.Status != "submitted" {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Proof already processed"})
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Proof already processed", "code": problem.CodeProofProcessed})
 		return
 	}
 	
@@ -276,6 +278,20 @@ func handlePaymentWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	// The merchant is the recipient; the flow is rolled out merchant by
+	// merchant
+	if !features.Enabled(flagFDCPaymentWebhook, confirmation.To) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":    "skipped",
+			"reason":    flagFDCPaymentWebhook + " is off for this merchant",
+			"tx_hash":   confirmation.TxHash,
+			"timestamp": time.Now().Unix(),
+		})
+		return
+	}
+
 	// Process payment confirmation and create FDC proof
 	proofID, err := createPaymentProof(confirmation)
 	if err != nil {
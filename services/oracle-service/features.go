@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+
+	"github.com/arcbjorn/crosspay/packages/flags"
+)
+
+// Feature flags of the oracle service
+const (
+	// flagFDCPaymentWebhook creates FDC proofs of the payment confirmations
+	// posted to the webhook. Confirmations to merchants it is off for are
+	// acknowledged without a proof.
+	flagFDCPaymentWebhook = "fdc_payment_webhook"
+)
+
+var defaultFlags = []flags.Flag{
+	{Name: flagFDCPaymentWebhook, Description: "Create FDC proofs of payment confirmations posted to the webhook", Enabled: true},
+}
+
+// features holds the defaults until initFeatureFlags loads the configured
+// providers
+var features = mustFlags(flags.NewSet(defaultFlags))
+
+func mustFlags(set *flags.Set, err error) *flags.Set {
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// initFeatureFlags loads the flags from FEATURE_FLAGS_FILE,
+// FEATURE_FLAGS_URL and FLAG_<NAME> variables
+func initFeatureFlags(cfg *Config) error {
+	set, err := flags.New(cfg.Flags, defaultFlags...)
+	if err != nil {
+		return err
+	}
+	features = set
+	for _, f := range set.Status().Flags {
+		log.Printf("Feature flag %s: enabled=%t percentage=%g merchants=%d (%s)", f.Name, f.Enabled, f.Percentage, len(f.Merchants), f.Source)
+	}
+	return nil
+}
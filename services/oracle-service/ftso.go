@@ -6,10 +6,13 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
 )
 
 type PriceData struct {
@@ -29,9 +32,12 @@ var (
 	currentPrices = make(map[string]PriceData)
 	priceHistory  = make(map[string][]PriceData)
 	pricesMutex   = sync.RWMutex{}
+
+	// priceHistorySize is how many points are kept per symbol
+	priceHistorySize = 100
 	
 	supportedSymbols = []string{
-		"ETH/USD", "BTC/USD", "FLR/USD", "USDC/USD", "CBTC/USD",
+		"ETH/USD", "BTC/USD", "FLR/USD", "USDC/USD", "CBTC/USD", "FIL/USD",
 	}
 	
 	// Mock base prices
@@ -41,6 +47,7 @@ var (
 		"FLR/USD":  0.05,
 		"USDC/USD": 1.0,
 		"CBTC/USD": 45000.0, // Same as BTC for Citrea
+		"FIL/USD":  4.5,
 	}
 )
 
@@ -90,13 +97,7 @@ func updatePriceFeeds() {
 		
 		currentPrices[symbol] = priceData
 		
-		// Keep last 100 price points
-		history := priceHistory[symbol]
-		history = append(history, priceData)
-		if len(history) > 100 {
-			history = history[1:]
-		}
-		priceHistory[symbol] = history
+		priceHistory[symbol] = appendPriceHistory(priceHistory[symbol], priceData)
 		
 		updated++
 	}
@@ -107,6 +108,11 @@ func updatePriceFeeds() {
 }
 
 func handleGetPrice(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/history") {
+		handleGetPriceHistory(w, r)
+		return
+	}
+
 	// Extract symbol from URL path
 	path := strings.TrimPrefix(r.URL.Path, "/api/ftso/price/")
 	symbol := strings.TrimSuffix(path, "/")
@@ -118,7 +124,7 @@ func handleGetPrice(w http.ResponseWriter, r *http.Request) {
 	if !exists {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Symbol not found"})
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Symbol not found", "code": problem.CodeUnknownSymbol})
 		return
 	}
 	
@@ -156,7 +162,31 @@ func handleGetPriceHistory(w http.ResponseWriter, r *http.Request) {
 	if !exists {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Symbol not found"})
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Symbol not found", "code": problem.CodeUnknownSymbol})
+		return
+	}
+
+	// With ?at=<unix seconds>, return the price in effect at that time
+	if atStr := r.URL.Query().Get("at"); atStr != "" {
+		at, err := strconv.ParseInt(atStr, 10, 64)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid timestamp"})
+			return
+		}
+
+		priceData, found := priceAt(history, at)
+		if !found {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "No price recorded at that time", "code": problem.CodePriceNotRecorded})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(priceData)
 		return
 	}
 	
@@ -245,12 +275,7 @@ func handleUpdatePrice(w http.ResponseWriter, r *http.Request) {
 	currentPrices[request.Symbol] = priceData
 	
 	// Add to history
-	history := priceHistory[request.Symbol]
-	history = append(history, priceData)
-	if len(history) > 100 {
-		history = history[1:]
-	}
-	priceHistory[request.Symbol] = history
+	priceHistory[request.Symbol] = appendPriceHistory(priceHistory[request.Symbol], priceData)
 	pricesMutex.Unlock()
 	
 	log.Printf("Price updated: %s = $%.2f", request.Symbol, request.Price)
@@ -282,6 +307,28 @@ func handleGetSupportedSymbols(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// appendPriceHistory adds a point to a symbol's history, dropping the
+// oldest beyond priceHistorySize
+func appendPriceHistory(history []PriceData, priceData PriceData) []PriceData {
+	history = append(history, priceData)
+	if len(history) > priceHistorySize {
+		history = history[len(history)-priceHistorySize:]
+	}
+	return history
+}
+
+// priceAt returns the latest point of history at or before at. It is only
+// valid if it was recorded within 2 minutes of at, like a current price.
+func priceAt(history []PriceData, at int64) (PriceData, bool) {
+	i := sort.Search(len(history), func(i int) bool { return history[i].Timestamp > at })
+	if i == 0 {
+		return PriceData{}, false
+	}
+	priceData := history[i-1]
+	priceData.Valid = priceData.Valid && at-priceData.Timestamp <= 120
+	return priceData, true
+}
+
 // Helper function to get price for contracts
 func getPriceForPayment(symbol string) (PriceData, error) {
 	pricesMutex.RLock()
@@ -36,7 +36,6 @@ var (
 	statusMutex     = sync.RWMutex{}
 	startTime       = time.Now()
 	circuitBreaker  = false
-	healthCheckInterval = 60 * time.Second
 )
 
 func initOracleHealth() {
@@ -327,20 +326,3 @@ func writeUnhealthyResponse(w http.ResponseWriter) {
 		"retry_after_seconds": 60,
 	})
 }
-
-func startHealthMonitor() {
-	// Initialize health status
-	initOracleHealth()
-	
-	ticker := time.NewTicker(healthCheckInterval)
-	defer ticker.Stop()
-	
-	log.Printf("Starting oracle health monitor (interval: %v)", healthCheckInterval)
-	
-	for {
-		select {
-		case <-ticker.C:
-			performOracleHealthCheck()
-		}
-	}
-}
\ No newline at end of file
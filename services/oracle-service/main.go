@@ -9,9 +9,34 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/middleware"
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/arcbjorn/crosspay/packages/scheduler"
 )
 
 func main() {
+	cfg, settings, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	admin, err := auth.New("oracle-service", cfg.Admin)
+	if err != nil {
+		log.Fatalf("Failed to open admin audit log: %v", err)
+	}
+	defer admin.Close()
+
+	if err := initFeatureFlags(cfg); err != nil {
+		log.Fatalf("Failed to load feature flags: %v", err)
+	}
+
+	jobs, err := scheduleJobs(cfg)
+	if err != nil {
+		log.Fatalf("Invalid job schedule: %v", err)
+	}
+
 	mux := http.NewServeMux()
 	
 	// Health check endpoint
@@ -21,18 +46,19 @@ func main() {
 			"status": "healthy",
 			"service": "oracle-service",
 			"timestamp": time.Now().Unix(),
+			"flags": features.Status(),
 		})
 	})
 
 	// FTSO endpoints
 	mux.HandleFunc("/api/ftso/price/", handleGetPrice)
 	mux.HandleFunc("/api/ftso/symbols", handleGetSupportedSymbols)
-	mux.HandleFunc("/api/ftso/price/update", handleUpdatePrice)
+	mux.Handle("/api/ftso/price/update", admin.Require("oracle.price.update", auth.RoleOperator)(http.HandlerFunc(handleUpdatePrice)))
 
 	// Random number endpoints
 	mux.HandleFunc("/api/random/request", handleRequestRandom)
 	mux.HandleFunc("/api/random/status/", handleRandomStatus)
-	mux.HandleFunc("/api/random/fulfill", handleFulfillRandom)
+	mux.Handle("/api/random/fulfill", admin.Require("oracle.random.fulfill", auth.RoleOperator)(http.HandlerFunc(handleFulfillRandom)))
 	mux.HandleFunc("/api/random/winners", handleSelectWinners)
 
 	// FDC endpoints
@@ -45,34 +71,53 @@ func main() {
 	// Oracle health endpoints
 	mux.HandleFunc("/api/oracle/status", handleOracleStatus)
 	mux.HandleFunc("/api/oracle/healthcheck", handlePerformHealthCheck)
-	mux.HandleFunc("/api/oracle/circuit-breaker/pause", handleEmergencyPause)
-	mux.HandleFunc("/api/oracle/circuit-breaker/resume", handleEmergencyResume)
+	mux.Handle("/api/oracle/circuit-breaker/pause", admin.Require("oracle.circuit_breaker.pause", auth.RoleOperator)(http.HandlerFunc(handleEmergencyPause)))
+	mux.Handle("/api/oracle/circuit-breaker/resume", admin.Require("oracle.circuit_breaker.resume", auth.RoleOperator)(http.HandlerFunc(handleEmergencyResume)))
+
+	// Background job status
+	mux.Handle("/api/jobs", admin.Require("oracle.jobs", auth.Roles...)(jobs.Handler()))
+
+	// Admin audit log
+	mux.Handle("/admin/audit", admin.AuditHandler())
+
+	// Effective configuration, secrets redacted
+	mux.HandleFunc("/config", settings.Handler())
+
+	// Feature flags, and with ?merchant= which are on for a merchant
+	mux.HandleFunc("/flags", features.Handler())
 
 	srv := &http.Server{
-		Addr:    ":8081",
-		Handler: mux,
+		Addr: ":" + cfg.Port,
+		Handler: middleware.Chain(mux,
+			middleware.Logger(nil),
+			problem.Adapt,
+			middleware.Recover(nil),
+			middleware.CORS(middleware.CORSConfig{AllowedOrigins: cfg.CORSAllowedOrigins}),
+		),
 	}
 
 	// Initialize oracle services
+	priceHistorySize = cfg.PriceHistory
 	initializeOracle()
 
 	go func() {
-		log.Println("Oracle service starting on :8081")
+		log.Printf("Oracle service starting on :%s", cfg.Port)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 	}()
 
-	// Start background services
-	go startPriceFeedUpdater()
-	go startRandomFulfiller()
-	go startHealthMonitor()
+	// Start background jobs
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	jobs.Start(jobsCtx)
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	log.Println("Shutting down oracle service...")
+	stopJobs()
 	
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -95,29 +140,39 @@ func initializeOracle() {
 	
 	// Initialize FDC client (mock)
 	initializeFDC()
-	
-	log.Println("Oracle services initialized")
-}
-
-func startPriceFeedUpdater() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
 
-	log.Println("Starting price feed updater...")
+	// Initialize health status
+	initOracleHealth()
 	
-	for range ticker.C {
-		updatePriceFeeds()
-	}
+	log.Println("Oracle services initialized")
 }
 
-func startRandomFulfiller() {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-
-	log.Println("Starting random number fulfiller...")
-	
-	for range ticker.C {
-		fulfillPendingRandomRequests()
+// scheduleJobs schedules the price feed updater, the random number
+// fulfiller, the health monitor and the feature flag refresh
+func scheduleJobs(cfg *Config) (*scheduler.Scheduler, error) {
+	jobs := scheduler.New()
+	for _, job := range []scheduler.Job{
+		{Name: "price_update", Schedule: cfg.Jobs.PriceUpdate, Run: func(context.Context) error {
+			updatePriceFeeds()
+			return nil
+		}},
+		{Name: "random_fulfill", Schedule: cfg.Jobs.RandomFulfill, Run: func(context.Context) error {
+			fulfillPendingRandomRequests()
+			return nil
+		}},
+		{Name: "health_check", Schedule: cfg.Jobs.HealthCheck, Run: func(context.Context) error {
+			performOracleHealthCheck()
+			return nil
+		}},
+		{Name: "feature_flags", Schedule: "@every " + cfg.Flags.Refresh.String(), Run: func(ctx context.Context) error {
+			return features.Refresh(ctx)
+		}},
+	} {
+		job.Jitter = cfg.Jobs.Jitter
+		if err := jobs.Add(job); err != nil {
+			return nil, err
+		}
 	}
+	return jobs, nil
 }
 
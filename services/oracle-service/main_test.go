@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/arcbjorn/crosspay/packages/flags"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -97,4 +99,67 @@ func TestRandomNumberEndpoint(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "req_123456", response["requestId"])
 	assert.Equal(t, false, response["fulfilled"])
-}
\ No newline at end of file
+}
+
+func TestPriceHistoryAt(t *testing.T) {
+	pricesMutex.Lock()
+	priceHistory["ETH/USD"] = []PriceData{
+		{Symbol: "ETH/USD", Price: 2400, Timestamp: 1000, Decimals: 8, Valid: true},
+		{Symbol: "ETH/USD", Price: 2500, Timestamp: 1030, Decimals: 8, Valid: true},
+	}
+	pricesMutex.Unlock()
+	t.Cleanup(func() {
+		pricesMutex.Lock()
+		delete(priceHistory, "ETH/USD")
+		pricesMutex.Unlock()
+	})
+
+	get := func(at string) (int, map[string]interface{}) {
+		rr := httptest.NewRecorder()
+		handleGetPrice(rr, httptest.NewRequest("GET", "/api/ftso/price/ETH/USD/history?at="+at, nil))
+		var response map[string]interface{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		return rr.Code, response
+	}
+
+	code, response := get("1029")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2400.0, response["price"])
+	assert.Equal(t, true, response["valid"])
+
+	code, response = get("1200")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2500.0, response["price"])
+	assert.Equal(t, false, response["valid"])
+
+	code, _ = get("999")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestPaymentWebhookFlag(t *testing.T) {
+	previous := features
+	t.Cleanup(func() { features = previous })
+	set, err := flags.NewSet([]flags.Flag{{Name: flagFDCPaymentWebhook, Merchants: []string{"0xMerchant"}}})
+	assert.NoError(t, err)
+	features = set
+
+	post := func(to string) map[string]interface{} {
+		body := `{"tx_hash":"0xabc","from":"0xpayer","to":"` + to + `","amount":"100","chain_id":14}`
+		rr := httptest.NewRecorder()
+		handlePaymentWebhook(rr, httptest.NewRequest("POST", "/api/fdc/webhook/payment", strings.NewReader(body)))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var response map[string]interface{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		return response
+	}
+
+	response := post("0xmerchant")
+	assert.Equal(t, "processed", response["status"])
+	assert.NotEmpty(t, response["proof_id"])
+
+	response = post("0xother")
+	assert.Equal(t, "skipped", response["status"])
+	assert.Nil(t, response["proof_id"])
+}
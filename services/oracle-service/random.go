@@ -10,6 +10,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
 )
 
 type RandomRequest struct {
@@ -161,7 +163,7 @@ func handleFulfillRandom(w http.ResponseWriter, r *http.Request) {
 	if randomReq.Status == "fulfilled" {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Request already fulfilled"})
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Request already fulfilled", "code": problem.CodeRandomnessFulfilled})
 		return
 	}
 	
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// A payment's sender and recipient are screened once they are resolved.
+// Known burn addresses are flagged. With RPC access to the payment's chain,
+// a recipient of a native payment that is a contract must accept value:
+// the payment core pays it out with an empty call, so a contract without a
+// payable fallback or receive function would make the payment impossible
+// to complete. A recipient that cannot be read on chain is flagged
+// unverified.
+
+// Address flags reported on a payment's parties
+const (
+	AddressBurn       = "burn_address"
+	AddressContract   = "contract"
+	AddressUnverified = "unverified"
+)
+
+// Error codes of addresses a payment cannot use
+const (
+	AddressCodeInvalid        = problem.CodeInvalidAddress
+	AddressCodeChecksum       = problem.CodeInvalidChecksum
+	AddressCodeNotPayable     = problem.CodeNotPayable
+	AddressCodeENSNotResolved = problem.CodeENSNotResolved
+	AddressCodeENSMismatch    = problem.CodeENSMismatch
+	AddressCodeENSUnavailable = problem.CodeENSUnavailable
+)
+
+var errNotPayable = errors.New("contract does not accept native payments")
+
+// addressErrorCodes maps the errors of unusable addresses to their codes
+var addressErrorCodes = []struct {
+	err  error
+	code string
+}{
+	{errInvalidAddress, AddressCodeInvalid},
+	{errAddressChecksum, AddressCodeChecksum},
+	{errNotPayable, AddressCodeNotPayable},
+	{errENSNotResolved, AddressCodeENSNotResolved},
+	{errENSMismatch, AddressCodeENSMismatch},
+	{errENSUnavailable, AddressCodeENSUnavailable},
+}
+
+// knownBurnAddresses hold tokens sent to them forever
+var knownBurnAddresses = []string{
+	"0x0000000000000000000000000000000000000000",
+	"0x0000000000000000000000000000000000000001",
+	"0x000000000000000000000000000000000000dEaD",
+	"0xdEAD000000000000000042069420694206942069",
+}
+
+// AddressError is a sender or recipient a payment cannot use. Code is one
+// of the AddressCode constants, for clients to act on.
+type AddressError struct {
+	Field string
+	Code  string
+	Err   error
+}
+
+func (e *AddressError) Error() string { return e.Field + ": " + e.Err.Error() }
+func (e *AddressError) Unwrap() error { return e.Err }
+
+// addressError wraps err, which names an address of field, in an
+// *AddressError
+func addressError(field string, err error) error {
+	code := AddressCodeInvalid
+	for _, known := range addressErrorCodes {
+		if errors.Is(err, known.err) {
+			code = known.code
+			break
+		}
+	}
+	return &AddressError{Field: field, Code: code, Err: err}
+}
+
+// addresses screens payment parties. It is always set; without it only
+// the known burn addresses are flagged.
+var addresses *addressScreener
+
+type addressScreener struct {
+	chains map[int64]chainReader
+	// payer is the payment core, which pays native payments out
+	payer common.Address
+	burn  map[common.Address]bool
+}
+
+// newAddressScreener flags the known burn addresses and extra, and reads
+// recipients on chains
+func newAddressScreener(chains map[int64]chainReader, payer common.Address, extra []string) *addressScreener {
+	s := &addressScreener{chains: chains, payer: payer, burn: make(map[common.Address]bool)}
+	for _, address := range append(knownBurnAddresses, extra...) {
+		if address = strings.TrimSpace(address); common.IsHexAddress(address) {
+			s.burn[common.HexToAddress(address)] = true
+		}
+	}
+	return s
+}
+
+// screen flags party, a payment's field on chainID, and returns an
+// *AddressError when the payment cannot use it. Recipients of native
+// payments are checked for accepting value.
+func (s *addressScreener) screen(ctx context.Context, chainID int64, field string, party *PaymentParty, native bool) error {
+	if s == nil {
+		s = newAddressScreener(nil, common.Address{}, nil)
+	}
+	if party.Address == "" {
+		return nil
+	}
+	address := common.HexToAddress(party.Address)
+	if s.burn[address] {
+		party.Flags = append(party.Flags, AddressBurn)
+	}
+
+	chain, ok := s.chains[chainID]
+	if field != "recipient" || !native || !ok {
+		return nil
+	}
+	code, err := chain.CodeAt(ctx, address, nil)
+	if err != nil {
+		log.Printf("Warning: Failed to read %s %s on chain %d: %v", field, party.Address, chainID, err)
+		party.Flags = append(party.Flags, AddressUnverified)
+		return nil
+	}
+	if len(code) == 0 {
+		return nil
+	}
+	party.Flags = append(party.Flags, AddressContract)
+
+	_, err = chain.CallContract(ctx, ethereum.CallMsg{From: s.payer, To: &address, Value: big.NewInt(1)}, nil)
+	switch {
+	case err == nil:
+		return nil
+	case isCallRevert(err):
+		return addressError(field, fmt.Errorf("%w: %s on chain %d", errNotPayable, party.Address, chainID))
+	default:
+		log.Printf("Warning: Failed to check that %s %s on chain %d accepts value: %v", field, party.Address, chainID, err)
+		party.Flags = append(party.Flags, AddressUnverified)
+		return nil
+	}
+}
+
+// isCallRevert reports whether a call failed because the contract reverted,
+// rather than because the chain could not be reached
+func isCallRevert(err error) bool {
+	var dataErr rpc.DataError
+	return isRevert(err) || errors.As(err, &dataErr) || strings.Contains(err.Error(), "execution reverted")
+}
+
+// writeAddressError answers 502 when the ENS resolver cannot be reached and
+// 400 for addresses a payment cannot use, with the address's field and
+// error code
+func writeAddressError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	response := map[string]interface{}{"error": err.Error()}
+	var addressErr *AddressError
+	if errors.As(err, &addressErr) {
+		response["code"], response["field"] = addressErr.Code, addressErr.Field
+	}
+	if errors.Is(err, errENSUnavailable) {
+		status = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressScreening(t *testing.T) {
+	payer := common.HexToAddress("0x00000000000000000000000000000000000000e1")
+	screener := func(chain *fakeChain) *addressScreener {
+		return newAddressScreener(map[int64]chainReader{4202: chain}, payer, []string{"0x00000000000000000000000000000000000000b1"})
+	}
+	ctx := context.Background()
+
+	t.Run("should flag known and configured burn addresses", func(t *testing.T) {
+		s := screener(&fakeChain{})
+		party := PaymentParty{Address: "0x000000000000000000000000000000000000dead"}
+		require.NoError(t, s.screen(ctx, 4202, "recipient", &party, false))
+		assert.Equal(t, []string{AddressBurn}, party.Flags)
+
+		party = PaymentParty{Address: "0x00000000000000000000000000000000000000b1"}
+		require.NoError(t, s.screen(ctx, 4202, "sender", &party, true))
+		assert.Equal(t, []string{AddressBurn}, party.Flags)
+
+		var unset *addressScreener
+		party = PaymentParty{Address: "0x0000000000000000000000000000000000000000"}
+		require.NoError(t, unset.screen(ctx, 4202, "recipient", &party, true))
+		assert.Equal(t, []string{AddressBurn}, party.Flags)
+	})
+
+	t.Run("should refuse native payments to contracts that do not accept value", func(t *testing.T) {
+		var sent ethereum.CallMsg
+		s := screener(&fakeChain{code: []byte{0x60}, call: func(msg ethereum.CallMsg) ([]byte, error) {
+			sent = msg
+			return nil, errors.New("execution reverted")
+		}})
+		party := PaymentParty{Address: settlementMerchant}
+		err := s.screen(ctx, 4202, "recipient", &party, true)
+		assert.ErrorIs(t, err, errNotPayable)
+		var addressErr *AddressError
+		require.ErrorAs(t, err, &addressErr)
+		assert.Equal(t, AddressCodeNotPayable, addressErr.Code)
+		assert.Equal(t, payer, sent.From)
+		assert.Equal(t, int64(1), sent.Value.Int64())
+
+		party = PaymentParty{Address: settlementMerchant}
+		assert.NoError(t, s.screen(ctx, 4202, "recipient", &party, false), "token payments do not send value")
+	})
+
+	t.Run("should accept payable contracts and flag those it cannot check", func(t *testing.T) {
+		s := screener(&fakeChain{code: []byte{0x60}, call: func(msg ethereum.CallMsg) ([]byte, error) { return nil, nil }})
+		party := PaymentParty{Address: settlementMerchant}
+		require.NoError(t, s.screen(ctx, 4202, "recipient", &party, true))
+		assert.Equal(t, []string{AddressContract}, party.Flags)
+
+		s = screener(&fakeChain{code: []byte{0x60}, call: func(msg ethereum.CallMsg) ([]byte, error) {
+			return nil, errors.New("connection refused")
+		}})
+		party = PaymentParty{Address: settlementMerchant}
+		require.NoError(t, s.screen(ctx, 4202, "recipient", &party, true))
+		assert.Equal(t, []string{AddressContract, AddressUnverified}, party.Flags)
+
+		party = PaymentParty{Address: settlementMerchant}
+		require.NoError(t, s.screen(ctx, 1, "recipient", &party, true))
+		assert.Empty(t, party.Flags, "chains without RPC access are not read")
+	})
+
+	t.Run("should answer unusable addresses with their field and code", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleCreatePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/create", strings.NewReader(
+			`{"sender": "`+kycSender+`", "recipient": "0x52908400098527886E0F7030069857D2E4169Ee7", "token": "`+nativeToken+`", "amount": "1000"}`)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		var response map[string]string
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, AddressCodeChecksum, response["code"])
+		assert.Equal(t, "recipient", response["field"])
+	})
+}
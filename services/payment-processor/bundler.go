@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// User operation statuses. A pending operation the bundler has not included
+// within the drop timeout is considered dropped.
+const (
+	UserOpPending  = "pending"
+	UserOpIncluded = "included"
+	UserOpFailed   = "failed"
+	UserOpDropped  = "dropped"
+)
+
+var (
+	errAccountNotDeployed = errors.New("smart account is not deployed; factory and factory_data are required")
+	errUnsigned           = errors.New("user operation is not signed")
+	errSponsorshipLimit   = errors.New("sender has used all of its sponsored payments")
+	errUserOpNotFound     = errors.New("user operation not found")
+)
+
+// userOps is nil when sponsored payments are not configured
+var userOps *userOpService
+
+// chainReader is the chain access sponsored payments need
+type chainReader interface {
+	CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+	CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error)
+	SuggestGasTipCap(ctx context.Context) (*big.Int, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// rpcCaller is the JSON-RPC access to the bundler and paymaster
+type rpcCaller interface {
+	CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error
+}
+
+// userOpService builds, sends and tracks the user operations of sponsored
+// payments on one chain. Without a paymaster, operations are built unsponsored
+// and the sender's account pays for its gas.
+type userOpService struct {
+	chain            chainReader
+	bundler          rpcCaller
+	paymaster        rpcCaller
+	paymasterContext map[string]interface{}
+	chainID          *big.Int
+	entryPoint       common.Address
+	paymentCore      common.Address
+	sponsorLimit     int
+	pollInterval     time.Duration
+	dropAfter        time.Duration
+	now              func() time.Time
+}
+
+// BuiltUserOperation is an operation ready for the wallet to sign. The
+// signature goes in the operation's signature field.
+type BuiltUserOperation struct {
+	UserOperation *UserOperation `json:"user_operation"`
+	Hash          common.Hash    `json:"user_op_hash"`
+	EntryPoint    common.Address `json:"entry_point"`
+	ChainID       int64          `json:"chain_id"`
+	Sponsored     bool           `json:"sponsored"`
+	// ChainWarning is set when the chain is degraded or down
+	ChainWarning *ChainWarning `json:"chain_warning,omitempty"`
+	// Limits is the evaluation of the payment against the limit rules
+	Limits *LimitEvaluation `json:"limits,omitempty"`
+}
+
+// UserOpRecord is a sent user operation and what became of it. PaymentID is
+// set once the payment it created has been read from its receipt.
+type UserOpRecord struct {
+	Hash          string     `json:"user_op_hash"`
+	ChainID       int64      `json:"chain_id"`
+	Sender        string     `json:"sender"`
+	Nonce         string     `json:"nonce"`
+	Sponsored     bool       `json:"sponsored"`
+	Status        string     `json:"status"`
+	TxHash        string     `json:"tx_hash,omitempty"`
+	BlockNumber   uint64     `json:"block_number,omitempty"`
+	ActualGasCost string     `json:"actual_gas_cost,omitempty"`
+	PaymentID     string     `json:"payment_id,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+}
+
+// paymasterResult is the answer to pm_getPaymasterStubData and
+// pm_getPaymasterData (ERC-7677)
+type paymasterResult struct {
+	Paymaster                     *common.Address `json:"paymaster"`
+	PaymasterData                 hexutil.Bytes   `json:"paymasterData"`
+	PaymasterVerificationGasLimit *hexutil.Big    `json:"paymasterVerificationGasLimit"`
+	PaymasterPostOpGasLimit       *hexutil.Big    `json:"paymasterPostOpGasLimit"`
+}
+
+func (r *paymasterResult) apply(op *UserOperation) {
+	op.Paymaster = r.Paymaster
+	op.PaymasterData = r.PaymasterData
+	if r.PaymasterVerificationGasLimit != nil {
+		op.PaymasterVerificationGasLimit = r.PaymasterVerificationGasLimit
+	}
+	if r.PaymasterPostOpGasLimit != nil {
+		op.PaymasterPostOpGasLimit = r.PaymasterPostOpGasLimit
+	}
+}
+
+// gasEstimate is the answer to eth_estimateUserOperationGas
+type gasEstimate struct {
+	PreVerificationGas            *hexutil.Big `json:"preVerificationGas"`
+	VerificationGasLimit          *hexutil.Big `json:"verificationGasLimit"`
+	CallGasLimit                  *hexutil.Big `json:"callGasLimit"`
+	PaymasterVerificationGasLimit *hexutil.Big `json:"paymasterVerificationGasLimit"`
+}
+
+// userOpReceipt is the answer to eth_getUserOperationReceipt
+type userOpReceipt struct {
+	Success       bool         `json:"success"`
+	Reason        string       `json:"reason"`
+	ActualGasCost *hexutil.Big `json:"actualGasCost"`
+	Logs          []struct {
+		Address common.Address `json:"address"`
+		Topics  []common.Hash  `json:"topics"`
+		Data    hexutil.Bytes  `json:"data"`
+	} `json:"logs"`
+	Receipt struct {
+		TransactionHash common.Hash  `json:"transactionHash"`
+		BlockNumber     *hexutil.Big `json:"blockNumber"`
+	} `json:"receipt"`
+}
+
+// build returns an operation that makes the payment from request.Sender,
+// with gas estimated by the bundler and sponsored by the paymaster when the
+// sender is eligible
+func (s *userOpService) build(ctx context.Context, request *SponsoredPaymentRequest, amount *big.Int) (*BuiltUserOperation, error) {
+	callData, err := paymentCallData(s.paymentCore, request, amount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode payment call: %w", err)
+	}
+	return s.buildCall(ctx, common.HexToAddress(request.Sender), request.Factory, request.FactoryData, callData)
+}
+
+// buildCall returns an operation that makes the account call in callData
+// from sender. factory and factoryData deploy the account when it has no
+// code yet.
+func (s *userOpService) buildCall(ctx context.Context, sender common.Address, factory, factoryData string, callData []byte) (*BuiltUserOperation, error) {
+	op := &UserOperation{Sender: sender, CallData: callData}
+
+	code, err := s.chain.CodeAt(ctx, sender, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account code: %w", err)
+	}
+	if len(code) == 0 {
+		if factory == "" {
+			return nil, errAccountNotDeployed
+		}
+		factoryAddress := common.HexToAddress(factory)
+		op.Factory = &factoryAddress
+		op.FactoryData = common.FromHex(factoryData)
+	}
+
+	nonce, err := s.nonce(ctx, sender)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
+	}
+	op.Nonce = (*hexutil.Big)(nonce)
+	if err := s.setFees(ctx, op); err != nil {
+		return nil, fmt.Errorf("failed to read gas price: %w", err)
+	}
+	op.Signature = common.FromHex(dummySignature)
+
+	sponsored := false
+	if s.paymaster != nil {
+		if sponsored, err = s.eligible(sender); err != nil {
+			return nil, err
+		}
+	}
+	if sponsored {
+		var stub paymasterResult
+		if err := s.paymaster.CallContext(ctx, &stub, "pm_getPaymasterStubData", op, s.entryPoint, s.chainIDHex(), s.paymasterContext); err != nil {
+			return nil, fmt.Errorf("paymaster failed to sponsor: %w", err)
+		}
+		stub.apply(op)
+	}
+
+	if err := s.estimate(ctx, op); err != nil {
+		return nil, err
+	}
+	if sponsored {
+		if sponsored, err = s.withinGasBudget(op); err != nil {
+			return nil, err
+		}
+		if !sponsored {
+			// The merchant's gas budget cannot cover the operation, so it is
+			// estimated again for the account to pay
+			op.Paymaster, op.PaymasterData = nil, nil
+			op.PaymasterVerificationGasLimit, op.PaymasterPostOpGasLimit = nil, nil
+			if err := s.estimate(ctx, op); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if sponsored {
+		var data paymasterResult
+		if err := s.paymaster.CallContext(ctx, &data, "pm_getPaymasterData", op, s.entryPoint, s.chainIDHex(), s.paymasterContext); err != nil {
+			return nil, fmt.Errorf("paymaster failed to sponsor: %w", err)
+		}
+		data.apply(op)
+	}
+
+	op.Signature = nil
+	hash, err := op.Hash(s.entryPoint, s.chainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash user operation: %w", err)
+	}
+	return &BuiltUserOperation{
+		UserOperation: op,
+		Hash:          hash,
+		EntryPoint:    s.entryPoint,
+		ChainID:       s.chainID.Int64(),
+		Sponsored:     sponsored,
+	}, nil
+}
+
+// estimate sets the operation's gas limits from the bundler's estimate
+func (s *userOpService) estimate(ctx context.Context, op *UserOperation) error {
+	var estimate gasEstimate
+	if err := s.bundler.CallContext(ctx, &estimate, "eth_estimateUserOperationGas", op, s.entryPoint); err != nil {
+		return fmt.Errorf("bundler failed to estimate gas: %w", err)
+	}
+	op.PreVerificationGas = estimate.PreVerificationGas
+	op.VerificationGasLimit = estimate.VerificationGasLimit
+	op.CallGasLimit = estimate.CallGasLimit
+	if op.Paymaster != nil && estimate.PaymasterVerificationGasLimit != nil {
+		op.PaymasterVerificationGasLimit = estimate.PaymasterVerificationGasLimit
+	}
+	return nil
+}
+
+// withinGasBudget reports whether the gas budget of the merchant a sponsored
+// operation pays covers its maximum cost
+func (s *userOpService) withinGasBudget(op *UserOperation) (bool, error) {
+	if gasBudgets == nil {
+		return true, nil
+	}
+	merchant, ok := sponsoredMerchant(s.paymentCore, op.CallData)
+	if !ok {
+		return true, nil
+	}
+	return gasBudgets.allows(merchant, maxGasCost(op))
+}
+
+// nonce reads the sender's next nonce from the EntryPoint, on key 0
+func (s *userOpService) nonce(ctx context.Context, sender common.Address) (*big.Int, error) {
+	data, err := entryPointABI.Pack("getNonce", sender, new(big.Int))
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.chain.CallContract(ctx, ethereum.CallMsg{To: &s.entryPoint, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	values, err := entryPointABI.Unpack("getNonce", out)
+	if err != nil {
+		return nil, err
+	}
+	return values[0].(*big.Int), nil
+}
+
+// setFees prices the operation at twice the base fee plus the suggested tip,
+// so it stays valid while the base fee rises for a few blocks
+func (s *userOpService) setFees(ctx context.Context, op *UserOperation) error {
+	tip, err := s.chain.SuggestGasTipCap(ctx)
+	if err != nil {
+		return err
+	}
+	head, err := s.chain.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	maxFee := new(big.Int).Set(tip)
+	if head.BaseFee != nil {
+		maxFee.Add(maxFee, new(big.Int).Mul(head.BaseFee, big.NewInt(2)))
+	}
+	op.MaxPriorityFeePerGas = (*hexutil.Big)(tip)
+	op.MaxFeePerGas = (*hexutil.Big)(maxFee)
+	return nil
+}
+
+func (s *userOpService) chainIDHex() string {
+	return hexutil.EncodeBig(s.chainID)
+}
+
+// eligible reports whether the sender may have another operation sponsored.
+// Operations that failed or were dropped do not count.
+func (s *userOpService) eligible(sender common.Address) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM user_operations WHERE sender = ? AND sponsored AND status NOT IN (?, ?)`,
+		strings.ToLower(sender.Hex()), UserOpFailed, UserOpDropped).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to count sponsored operations: %w", err)
+	}
+	return count < s.sponsorLimit, nil
+}
+
+// send submits a signed operation to the bundler and records it as pending
+func (s *userOpService) send(ctx context.Context, op *UserOperation) (*UserOpRecord, error) {
+	if len(op.Signature) == 0 {
+		return nil, errUnsigned
+	}
+	sponsored := op.Paymaster != nil
+	if sponsored && s.paymaster != nil {
+		eligible, err := s.eligible(op.Sender)
+		if err != nil {
+			return nil, err
+		}
+		if !eligible {
+			return nil, errSponsorshipLimit
+		}
+		withinBudget, err := s.withinGasBudget(op)
+		if err != nil {
+			return nil, err
+		}
+		if !withinBudget {
+			return nil, errGasBudgetExceeded
+		}
+	}
+
+	var hash common.Hash
+	if err := s.bundler.CallContext(ctx, &hash, "eth_sendUserOperation", op, s.entryPoint); err != nil {
+		return nil, fmt.Errorf("bundler rejected user operation: %w", err)
+	}
+
+	record := &UserOpRecord{
+		Hash:      hash.Hex(),
+		ChainID:   s.chainID.Int64(),
+		Sender:    strings.ToLower(op.Sender.Hex()),
+		Nonce:     bigOrZero(op.Nonce).String(),
+		Sponsored: sponsored,
+		Status:    UserOpPending,
+		CreatedAt: s.now().UTC(),
+	}
+	_, err := db.Exec(`INSERT INTO user_operations (hash, chain_id, sender, nonce, sponsored, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		record.Hash, record.ChainID, record.Sender, record.Nonce, record.Sponsored, record.Status, record.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record user operation: %w", err)
+	}
+	log.Printf("Sent user operation %s from %s (sponsored: %t)", record.Hash, record.Sender, sponsored)
+	if merchant, ok := sponsoredMerchant(s.paymentCore, op.CallData); sponsored && gasBudgets != nil && ok {
+		if err := gasBudgets.reserve(ctx, record.Hash, merchant, maxGasCost(op)); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return record, nil
+}
+
+// refresh asks the bundler for the receipt of a pending operation and
+// records the outcome. An included operation's payments are recorded in the
+// payments table with the transaction that carried them.
+func (s *userOpService) refresh(ctx context.Context, record *UserOpRecord) error {
+	if record.Status != UserOpPending {
+		return nil
+	}
+
+	var receipt *userOpReceipt
+	if err := s.bundler.CallContext(ctx, &receipt, "eth_getUserOperationReceipt", common.HexToHash(record.Hash)); err != nil {
+		return fmt.Errorf("failed to get receipt of %s: %w", record.Hash, err)
+	}
+
+	now := s.now().UTC()
+	var paymentIDs []string
+	if receipt == nil {
+		if s.dropAfter <= 0 || now.Sub(record.CreatedAt) < s.dropAfter {
+			return nil
+		}
+		record.Status = UserOpDropped
+		record.Reason = fmt.Sprintf("not included within %s", s.dropAfter)
+	} else {
+		record.Status = UserOpIncluded
+		if !receipt.Success {
+			record.Status = UserOpFailed
+			record.Reason = receipt.Reason
+		}
+		record.TxHash = receipt.Receipt.TransactionHash.Hex()
+		if receipt.Receipt.BlockNumber != nil {
+			record.BlockNumber = receipt.Receipt.BlockNumber.ToInt().Uint64()
+		}
+		if receipt.ActualGasCost != nil {
+			record.ActualGasCost = receipt.ActualGasCost.ToInt().String()
+		}
+		for _, entry := range receipt.Logs {
+			if entry.Address != s.paymentCore || len(entry.Topics) != 4 || entry.Topics[0] != paymentCoreABI.Events["PaymentCreated"].ID {
+				continue
+			}
+			paymentID, err := storeCreatedPayment(record.ChainID, record.TxHash, entry.Topics, entry.Data)
+			if err != nil {
+				return err
+			}
+			record.PaymentID = paymentID
+			paymentIDs = append(paymentIDs, paymentID)
+		}
+	}
+	record.UpdatedAt = &now
+
+	_, err := db.Exec(`UPDATE user_operations SET status = ?, tx_hash = ?, block_number = ?, actual_gas_cost = ?, payment_id = ?, reason = ?, updated_at = ? WHERE hash = ?`,
+		record.Status, record.TxHash, record.BlockNumber, record.ActualGasCost, record.PaymentID, record.Reason, now, record.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to update user operation %s: %w", record.Hash, err)
+	}
+	log.Printf("User operation %s is %s", record.Hash, record.Status)
+
+	if gasBudgets != nil {
+		if err := gasBudgets.settle(ctx, record); err != nil {
+			return err
+		}
+	}
+
+	// An operation that creates a split's legs settles the split
+	if splits != nil {
+		return splits.settleUserOp(record, paymentIDs)
+	}
+	return nil
+}
+
+// storeCreatedPayment stores the payment a PaymentCreated log reports, with
+// the transaction that emitted it, and returns its ID
+func storeCreatedPayment(chainID int64, txHash string, topics []common.Hash, data []byte) (string, error) {
+	fields := make(map[string]interface{})
+	if err := paymentCoreABI.UnpackIntoMap(fields, "PaymentCreated", data); err != nil {
+		return "", fmt.Errorf("failed to decode payment of %s: %w", txHash, err)
+	}
+	paymentID := topics[1].Big().String()
+
+	_, err := db.Exec(`INSERT OR IGNORE INTO payments (id, chain_id, tx_hash, sender, sender_ens, recipient, recipient_ens, token, amount, metadata, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 'pending')`,
+		paymentID,
+		chainID,
+		txHash,
+		strings.ToLower(common.BytesToAddress(topics[2].Bytes()).Hex()),
+		fields["senderENS"],
+		strings.ToLower(common.BytesToAddress(topics[3].Bytes()).Hex()),
+		fields["recipientENS"],
+		strings.ToLower(fields["token"].(common.Address).Hex()),
+		fields["amount"].(*big.Int).String(),
+		fields["metadataURI"],
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to record payment %s: %w", paymentID, err)
+	}
+	return paymentID, nil
+}
+
+// track refreshes the pending operations every pollInterval until ctx is
+// done
+func (s *userOpService) track(ctx context.Context) {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			records, err := queryUserOps(`WHERE status = ? ORDER BY created_at`, UserOpPending)
+			if err != nil {
+				log.Printf("Failed to load pending user operations: %v", err)
+				continue
+			}
+			for _, record := range records {
+				if err := s.refresh(ctx, record); err != nil {
+					log.Printf("Failed to track user operation: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// getUserOp returns the recorded operation with hash
+func getUserOp(hash string) (*UserOpRecord, error) {
+	records, err := queryUserOps(`WHERE hash = ?`, common.HexToHash(hash).Hex())
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errUserOpNotFound
+	}
+	return records[0], nil
+}
+
+// queryUserOps returns the recorded operations matching where
+func queryUserOps(where string, args ...interface{}) ([]*UserOpRecord, error) {
+	rows, err := db.Query(`SELECT hash, chain_id, sender, nonce, sponsored, status, tx_hash, block_number, actual_gas_cost, payment_id, reason, created_at, updated_at FROM user_operations `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*UserOpRecord
+	for rows.Next() {
+		record := &UserOpRecord{}
+		var txHash, gasCost, paymentID, reason sql.NullString
+		var blockNumber sql.NullInt64
+		var updatedAt sql.NullTime
+		err := rows.Scan(&record.Hash, &record.ChainID, &record.Sender, &record.Nonce, &record.Sponsored, &record.Status,
+			&txHash, &blockNumber, &gasCost, &paymentID, &reason, &record.CreatedAt, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		record.TxHash, record.ActualGasCost = txHash.String, gasCost.String
+		record.PaymentID, record.Reason = paymentID.String, reason.String
+		record.BlockNumber = uint64(blockNumber.Int64)
+		if updatedAt.Valid {
+			record.UpdatedAt = &updatedAt.Time
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
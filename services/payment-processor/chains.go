@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// The chain monitor probes the RPC endpoint of every chain payments can be
+// made on: CHAIN_ID through RPC_URL, and the chains in CHAIN_RPC_URLS. Each
+// probe reads the head block and the gas price and times the calls. A chain
+// is degraded when its RPC answers slower than CHAIN_MAX_LATENCY, its head
+// block is older than CHAIN_MAX_BLOCK_AGE, or its gas price is over
+// CHAIN_GAS_SPIKE_FACTOR times the median of its recent probes. It is down
+// after CHAIN_DOWN_AFTER failed probes in a row. Payments on a degraded or
+// down chain are still accepted, with a warning naming the healthiest chain
+// that lists the same token.
+
+const (
+	ChainHealthy  = "healthy"
+	ChainDegraded = "degraded"
+	ChainDown     = "down"
+	// ChainUnknown is a chain that has not been probed yet
+	ChainUnknown = "unknown"
+)
+
+const (
+	// chainGasSamples is how many gas prices the baseline is the median of
+	chainGasSamples = 20
+	// chainGasMinSamples is how many gas prices are needed before spikes
+	// are flagged
+	chainGasMinSamples = 5
+)
+
+// chainMonitor is nil when no chain has an RPC endpoint
+var chainMonitor *chainMonitorService
+
+// chainHealthReader is the chain access a probe needs
+type chainHealthReader interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+}
+
+// ChainHealth is a chain's state as of its last probe
+type ChainHealth struct {
+	ChainID     int64      `json:"chain_id"`
+	Status      string     `json:"status"`
+	Reasons     []string   `json:"reasons,omitempty"`
+	LatencyMs   int64      `json:"rpc_latency_ms"`
+	HeadBlock   uint64     `json:"head_block"`
+	BlockAge    int64      `json:"block_age_seconds"`
+	GasPrice    string     `json:"gas_price,omitempty"`
+	GasBaseline string     `json:"gas_baseline,omitempty"`
+	Failures    int        `json:"consecutive_failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	CheckedAt   *time.Time `json:"checked_at,omitempty"`
+}
+
+// ChainWarning tells a payer their chain is degraded or down, and which
+// healthy chain lists the same token, if any
+type ChainWarning struct {
+	ChainID          int64    `json:"chain_id"`
+	Status           string   `json:"status"`
+	Reasons          []string `json:"reasons,omitempty"`
+	SuggestedChainID int64    `json:"suggested_chain_id,omitempty"`
+}
+
+// monitoredChain is a chain's reader and probe history
+type monitoredChain struct {
+	reader chainHealthReader
+	// checkAge is false for chains that only mine on demand, such as an
+	// idle sandbox chain
+	checkAge  bool
+	health    ChainHealth
+	gasPrices []*big.Int
+}
+
+// chainMonitorService keeps the health of each monitored chain
+type chainMonitorService struct {
+	chains      map[int64]*monitoredChain
+	interval    time.Duration
+	maxLatency  time.Duration
+	maxBlockAge time.Duration
+	spikeFactor float64
+	downAfter   int
+	now         func() time.Time
+	mutex       sync.RWMutex
+}
+
+// parseChainRPCURLs reads a comma separated list of chainID=url
+func parseChainRPCURLs(value string) (map[int64]string, error) {
+	urls := make(map[int64]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		separator := strings.Index(entry, "=")
+		if separator <= 0 {
+			return nil, fmt.Errorf("invalid chain RPC %q, expected chainID=url", entry)
+		}
+		chainID, err := strconv.ParseInt(entry[:separator], 10, 64)
+		if err != nil || chainID <= 0 {
+			return nil, fmt.Errorf("invalid chain ID in %q", entry)
+		}
+		urls[chainID] = entry[separator+1:]
+	}
+	return urls, nil
+}
+
+// add monitors a chain
+func (m *chainMonitorService) add(chainID int64, reader chainHealthReader, checkAge bool) {
+	m.chains[chainID] = &monitoredChain{
+		reader:   reader,
+		checkAge: checkAge,
+		health:   ChainHealth{ChainID: chainID, Status: ChainUnknown},
+	}
+}
+
+// track probes every chain every interval until ctx is done
+func (m *chainMonitorService) track(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAll probes every chain at once
+func (m *chainMonitorService) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for chainID, chain := range m.chains {
+		wg.Add(1)
+		go func(chainID int64, chain *monitoredChain) {
+			defer wg.Done()
+			m.probe(ctx, chainID, chain)
+		}(chainID, chain)
+	}
+	wg.Wait()
+}
+
+// probe reads a chain's head block and gas price and updates its health
+func (m *chainMonitorService) probe(ctx context.Context, chainID int64, chain *monitoredChain) {
+	probeCtx, cancel := context.WithTimeout(ctx, m.interval)
+	defer cancel()
+
+	started := m.now()
+	header, err := chain.reader.HeaderByNumber(probeCtx, nil)
+	var gasPrice *big.Int
+	if err == nil {
+		gasPrice, err = chain.reader.SuggestGasPrice(probeCtx)
+	}
+	checkedAt := m.now()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	health := &chain.health
+	previous := health.Status
+	health.CheckedAt = &checkedAt
+	if err != nil {
+		health.Failures++
+		health.LastError = err.Error()
+		health.Status = ChainDegraded
+		health.Reasons = []string{fmt.Sprintf("RPC failed %d time(s) in a row", health.Failures)}
+		if health.Failures >= m.downAfter {
+			health.Status = ChainDown
+		}
+	} else {
+		health.Failures = 0
+		health.LastError = ""
+		health.Reasons = nil
+		health.LatencyMs = checkedAt.Sub(started).Milliseconds()
+		health.HeadBlock = header.Number.Uint64()
+		health.BlockAge = checkedAt.Unix() - int64(header.Time)
+		if health.BlockAge < 0 {
+			health.BlockAge = 0
+		}
+		health.GasPrice = gasPrice.String()
+		health.GasBaseline = ""
+
+		if latency := checkedAt.Sub(started); latency > m.maxLatency {
+			health.Reasons = append(health.Reasons, fmt.Sprintf("RPC latency %dms is over %dms", latency.Milliseconds(), m.maxLatency.Milliseconds()))
+		}
+		if chain.checkAge && time.Duration(health.BlockAge)*time.Second > m.maxBlockAge {
+			health.Reasons = append(health.Reasons, fmt.Sprintf("head block is %ds old", health.BlockAge))
+		}
+		if baseline := medianGasPrice(chain.gasPrices); baseline != nil {
+			health.GasBaseline = baseline.String()
+			spike, _ := new(big.Float).Quo(new(big.Float).SetInt(gasPrice), new(big.Float).SetInt(baseline)).Float64()
+			if spike > m.spikeFactor {
+				health.Reasons = append(health.Reasons, fmt.Sprintf("gas price is %.1fx its recent median", spike))
+			}
+		}
+		chain.gasPrices = append(chain.gasPrices, gasPrice)
+		if len(chain.gasPrices) > chainGasSamples {
+			chain.gasPrices = chain.gasPrices[1:]
+		}
+
+		health.Status = ChainHealthy
+		if len(health.Reasons) > 0 {
+			health.Status = ChainDegraded
+		}
+	}
+
+	if health.Status != previous && previous != ChainUnknown {
+		log.Printf("Chain %d is %s: %s", chainID, health.Status, strings.Join(health.Reasons, "; "))
+	}
+}
+
+// medianGasPrice is the median of prices, nil with too few to tell a spike
+func medianGasPrice(prices []*big.Int) *big.Int {
+	if len(prices) < chainGasMinSamples {
+		return nil
+	}
+	sorted := append([]*big.Int(nil), prices...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Cmp(sorted[j]) < 0 })
+	median := sorted[len(sorted)/2]
+	if median.Sign() == 0 {
+		return nil
+	}
+	return median
+}
+
+// chainStatusRank orders statuses from healthiest
+var chainStatusRank = map[string]int{ChainHealthy: 0, ChainUnknown: 1, ChainDegraded: 2, ChainDown: 3}
+
+// list returns every chain's health, healthiest and then fastest first
+func (m *chainMonitorService) list() []ChainHealth {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	list := make([]ChainHealth, 0, len(m.chains))
+	for _, chain := range m.chains {
+		list = append(list, chain.health)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if chainStatusRank[a.Status] != chainStatusRank[b.Status] {
+			return chainStatusRank[a.Status] < chainStatusRank[b.Status]
+		}
+		if a.LatencyMs != b.LatencyMs {
+			return a.LatencyMs < b.LatencyMs
+		}
+		return a.ChainID < b.ChainID
+	})
+	return list
+}
+
+// warning returns a warning for a payment of token on chainID when the
+// chain is degraded or down, and nil otherwise. The suggested chain is the
+// healthiest healthy one whose curated list has a token with the same
+// symbol. It is nil-safe.
+func (m *chainMonitorService) warning(chainID int64, token *Token) *ChainWarning {
+	if m == nil {
+		return nil
+	}
+	var warning *ChainWarning
+	var candidates []int64
+	for _, health := range m.list() {
+		switch {
+		case health.ChainID == chainID:
+			if health.Status == ChainDegraded || health.Status == ChainDown {
+				warning = &ChainWarning{ChainID: chainID, Status: health.Status, Reasons: health.Reasons}
+			}
+		case health.Status == ChainHealthy:
+			candidates = append(candidates, health.ChainID)
+		}
+	}
+	if warning == nil || token == nil || tokens == nil {
+		return warning
+	}
+
+	for _, candidate := range candidates {
+		listed, err := tokens.list(candidate, true)
+		if err != nil {
+			log.Printf("Failed to list tokens of chain %d: %v", candidate, err)
+			continue
+		}
+		for _, other := range listed {
+			if strings.EqualFold(other.Symbol, token.Symbol) {
+				warning.SuggestedChainID = candidate
+				return warning
+			}
+		}
+	}
+	return warning
+}
+
+// handleGetChainHealth serves every monitored chain's health, healthiest
+// first, or one chain's with ?chain_id=
+func handleGetChainHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if chainMonitor == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Chain monitoring is not configured"})
+		return
+	}
+
+	list := chainMonitor.list()
+	if value := r.URL.Query().Get("chain_id"); value != "" {
+		chainID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid chain_id"})
+			return
+		}
+		for _, health := range list {
+			if health.ChainID == chainID {
+				json.NewEncoder(w).Encode(health)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Chain is not monitored"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"chains": list,
+		"count":  len(list),
+	})
+}
+
+// dialChainMonitor monitors CHAIN_ID through RPC_URL (the sandbox chain in
+// sandbox mode) and the chains in CHAIN_RPC_URLS
+func dialChainMonitor() (*chainMonitorService, error) {
+	monitor := &chainMonitorService{
+		chains:      make(map[int64]*monitoredChain),
+		interval:    durationEnv("CHAIN_MONITOR_INTERVAL", 15*time.Second),
+		maxLatency:  durationEnv("CHAIN_MAX_LATENCY", 2*time.Second),
+		maxBlockAge: durationEnv("CHAIN_MAX_BLOCK_AGE", 2*time.Minute),
+		spikeFactor: 3,
+		downAfter:   3,
+		now:         time.Now,
+	}
+	if value := os.Getenv("CHAIN_GAS_SPIKE_FACTOR"); value != "" {
+		factor, err := strconv.ParseFloat(value, 64)
+		if err != nil || factor <= 1 {
+			return nil, fmt.Errorf("invalid CHAIN_GAS_SPIKE_FACTOR %q", value)
+		}
+		monitor.spikeFactor = factor
+	}
+	if value := os.Getenv("CHAIN_DOWN_AFTER"); value != "" {
+		failures, err := strconv.Atoi(value)
+		if err != nil || failures < 1 {
+			return nil, fmt.Errorf("invalid CHAIN_DOWN_AFTER %q", value)
+		}
+		monitor.downAfter = failures
+	}
+
+	urls, err := parseChainRPCURLs(os.Getenv("CHAIN_RPC_URLS"))
+	if err != nil {
+		return nil, err
+	}
+	checkAge := make(map[int64]bool)
+	for chainID := range urls {
+		checkAge[chainID] = true
+	}
+	if chainID, ok := chainIDEnv(); ok && rpcURL() != "" {
+		urls[chainID.Int64()] = rpcURL()
+		// an idle sandbox chain only mines for transactions
+		checkAge[chainID.Int64()] = sandboxChain == nil || durationEnv("SANDBOX_BLOCK_INTERVAL", 0) > 0
+	}
+
+	for chainID, url := range urls {
+		client, err := ethclient.DialContext(context.Background(), url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to chain %d: %w", chainID, err)
+		}
+		monitor.add(chainID, client, checkAge[chainID])
+	}
+	return monitor, nil
+}
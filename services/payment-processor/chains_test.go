@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// healthChain answers probes with its head block, gas price and error
+type healthChain struct {
+	head     uint64
+	headTime time.Time
+	gasPrice int64
+	err      error
+}
+
+func (c *healthChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &types.Header{Number: new(big.Int).SetUint64(c.head), Time: uint64(c.headTime.Unix())}, nil
+}
+
+func (c *healthChain) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(c.gasPrice), nil
+}
+
+// setupChainMonitor monitors chains on a clock that moves latency each time
+// it is read, so each probe takes latency
+func setupChainMonitor(t *testing.T, latency time.Duration, chains map[int64]*healthChain) *chainMonitorService {
+	clock := time.Unix(1_700_000_000, 0)
+	var mutex sync.Mutex
+	monitor := &chainMonitorService{
+		chains:      make(map[int64]*monitoredChain),
+		interval:    time.Second,
+		maxLatency:  time.Second,
+		maxBlockAge: time.Minute,
+		spikeFactor: 3,
+		downAfter:   2,
+		now: func() time.Time {
+			mutex.Lock()
+			defer mutex.Unlock()
+			clock = clock.Add(latency)
+			return clock
+		},
+	}
+	for chainID, chain := range chains {
+		chain.headTime = clock
+		monitor.add(chainID, chain, true)
+	}
+	setGlobal(t, &chainMonitor, monitor)
+	return monitor
+}
+
+func chainStatus(monitor *chainMonitorService, chainID int64) ChainHealth {
+	for _, health := range monitor.list() {
+		if health.ChainID == chainID {
+			return health
+		}
+	}
+	return ChainHealth{}
+}
+
+func TestChainMonitor(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should flag slow RPCs, stale heads and gas spikes", func(t *testing.T) {
+		chain := &healthChain{head: 100, gasPrice: 10}
+		monitor := setupChainMonitor(t, 100*time.Millisecond, map[int64]*healthChain{4202: chain})
+		assert.Equal(t, ChainUnknown, chainStatus(monitor, 4202).Status)
+
+		for i := 0; i < chainGasMinSamples; i++ {
+			monitor.probeAll(ctx)
+		}
+		health := chainStatus(monitor, 4202)
+		assert.Equal(t, ChainHealthy, health.Status)
+		assert.Equal(t, int64(100), health.LatencyMs)
+		assert.Equal(t, uint64(100), health.HeadBlock)
+
+		chain.gasPrice = 45
+		chain.headTime = chain.headTime.Add(-2 * time.Minute)
+		monitor.probeAll(ctx)
+		health = chainStatus(monitor, 4202)
+		assert.Equal(t, ChainDegraded, health.Status)
+		assert.Equal(t, "10", health.GasBaseline)
+		require.Len(t, health.Reasons, 2)
+		assert.Contains(t, health.Reasons[0], "head block is")
+		assert.Equal(t, "gas price is 4.5x its recent median", health.Reasons[1])
+
+		chain.err = errors.New("connection refused")
+		monitor.probeAll(ctx)
+		assert.Equal(t, ChainDegraded, chainStatus(monitor, 4202).Status)
+		monitor.probeAll(ctx)
+		health = chainStatus(monitor, 4202)
+		assert.Equal(t, ChainDown, health.Status)
+		assert.Equal(t, 2, health.Failures)
+		assert.Equal(t, "connection refused", health.LastError)
+	})
+
+	t.Run("should warn about degraded chains and suggest a healthy one", func(t *testing.T) {
+		setupTestDB(t)
+		setGlobal(t, &tokens, &tokenRegistry{mode: AllowlistWarn, chains: map[int64]chainReader{}, now: time.Now})
+		require.NoError(t, tokens.loadTokenList("./tokens.json"))
+
+		slow := setupChainMonitor(t, 3*time.Second, map[int64]*healthChain{4202: {head: 1, gasPrice: 1}})
+		slow.probeAll(ctx)
+		fast := setupChainMonitor(t, 10*time.Millisecond, map[int64]*healthChain{84532: {head: 1, gasPrice: 1}, 5115: {head: 1, gasPrice: 1}})
+		fast.probeAll(ctx)
+		fast.chains[4202] = slow.chains[4202]
+
+		usdc := &Token{ChainID: 4202, Symbol: "USDC"}
+		warning := fast.warning(4202, usdc)
+		require.NotNil(t, warning)
+		assert.Equal(t, ChainDegraded, warning.Status)
+		assert.Equal(t, int64(84532), warning.SuggestedChainID)
+		assert.Nil(t, fast.warning(84532, usdc))
+		assert.Zero(t, fast.warning(4202, &Token{Symbol: "DAI"}).SuggestedChainID)
+		assert.Nil(t, (*chainMonitorService)(nil).warning(4202, usdc))
+
+		w := httptest.NewRecorder()
+		handleGetChainHealth(w, httptest.NewRequest(http.MethodGet, "/api/chains/health", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Chains []ChainHealth `json:"chains"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Len(t, response.Chains, 3)
+		assert.Equal(t, ChainDegraded, response.Chains[2].Status)
+
+		w = httptest.NewRecorder()
+		handleGetChainHealth(w, httptest.NewRequest(http.MethodGet, "/api/chains/health?chain_id=1", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestParseChainRPCURLs(t *testing.T) {
+	t.Run("should read chain IDs and their URLs", func(t *testing.T) {
+		urls, err := parseChainRPCURLs(" 84532=https://sepolia.base.org, 5115=https://rpc.testnet.citrea.xyz ,")
+		require.NoError(t, err)
+		assert.Equal(t, map[int64]string{84532: "https://sepolia.base.org", 5115: "https://rpc.testnet.citrea.xyz"}, urls)
+
+		for _, value := range []string{"https://sepolia.base.org", "base=https://sepolia.base.org", "=https://x"} {
+			_, err := parseChainRPCURLs(value)
+			assert.Error(t, err, value)
+		}
+	})
+}
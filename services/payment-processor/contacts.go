@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// The address book keeps labeled addresses per owner, a user or merchant
+// address. A contact saved with an ENS name holds the address the name
+// resolved to through the ENS resolver, and is re-resolved every
+// refreshAfter so it follows the name when its owner points it elsewhere.
+
+const (
+	maxContactLabel       = 64
+	defaultSuggestions    = 10
+	maxSuggestions        = 50
+	maxContactsPerRefresh = 100
+)
+
+var (
+	errContactNotFound = errors.New("contact not found")
+	errContactExists   = errors.New("owner already has a contact for this address")
+	errInvalidContact  = errors.New("invalid contact")
+)
+
+// contacts is always set; contacts are kept in the payments database
+var contacts *contactService
+
+type contactService struct {
+	resolve      func(ctx context.Context, name string) (string, error)
+	refreshAfter time.Duration
+	now          func() time.Time
+}
+
+// ContactRequest creates or updates a contact. Unset fields are left as they
+// are on update. With an ENS name, the address is what the name resolves to
+// and may be omitted.
+type ContactRequest struct {
+	Owner    string  `json:"owner"`
+	Label    *string `json:"label"`
+	Address  *string `json:"address"`
+	ENSName  *string `json:"ens_name"`
+	Favorite *bool   `json:"favorite"`
+}
+
+// Contact is a labeled address in an owner's address book
+type Contact struct {
+	ID             string     `json:"id"`
+	Owner          string     `json:"owner"`
+	Label          string     `json:"label"`
+	Address        string     `json:"address"`
+	ENSName        string     `json:"ens_name,omitempty"`
+	Favorite       bool       `json:"favorite"`
+	ENSRefreshedAt *time.Time `json:"ens_refreshed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// ContactSuggestion is a recipient to offer in the payment form: a contact,
+// an address the owner paid recently, or both
+type ContactSuggestion struct {
+	Address    string     `json:"address"`
+	Label      string     `json:"label,omitempty"`
+	ENSName    string     `json:"ens_name,omitempty"`
+	ContactID  string     `json:"contact_id,omitempty"`
+	Favorite   bool       `json:"favorite"`
+	Payments   int        `json:"payments"`
+	LastPaidAt *time.Time `json:"last_paid_at,omitempty"`
+}
+
+// create adds a contact to request.Owner's address book
+func (s *contactService) create(ctx context.Context, request *ContactRequest) (*Contact, error) {
+	if !common.IsHexAddress(request.Owner) {
+		return nil, fmt.Errorf("%w: invalid owner %q", errInvalidContact, request.Owner)
+	}
+	if request.Label == nil {
+		return nil, fmt.Errorf("%w: label is required", errInvalidContact)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := s.now().UTC()
+	contact := &Contact{
+		ID:        hexutil.Encode(id),
+		Owner:     strings.ToLower(request.Owner),
+		CreatedAt: now,
+	}
+	if err := s.apply(ctx, contact, request, now); err != nil {
+		return nil, err
+	}
+
+	_, err := db.Exec(`INSERT INTO contacts (id, owner, label, address, ens_name, favorite, ens_refreshed_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		contact.ID, contact.Owner, contact.Label, contact.Address, contact.ENSName, contact.Favorite, contact.ENSRefreshedAt,
+		contact.CreatedAt, contact.UpdatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return nil, errContactExists
+		}
+		return nil, fmt.Errorf("failed to store contact: %w", err)
+	}
+	return contact, nil
+}
+
+// update changes the fields set in request of one of request.Owner's
+// contacts
+func (s *contactService) update(ctx context.Context, id string, request *ContactRequest) (*Contact, error) {
+	contact, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(contact.Owner, request.Owner) {
+		return nil, errContactNotFound
+	}
+	if err := s.apply(ctx, contact, request, s.now().UTC()); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`UPDATE contacts SET label = ?, address = ?, ens_name = ?, favorite = ?, ens_refreshed_at = ?, updated_at = ? WHERE id = ?`,
+		contact.Label, contact.Address, contact.ENSName, contact.Favorite, contact.ENSRefreshedAt, contact.UpdatedAt, contact.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return nil, errContactExists
+		}
+		return nil, fmt.Errorf("failed to update contact %s: %w", contact.ID, err)
+	}
+	return contact, nil
+}
+
+// apply validates request and sets its fields on contact, resolving a new
+// ENS name
+func (s *contactService) apply(ctx context.Context, contact *Contact, request *ContactRequest, now time.Time) error {
+	if request.Label != nil {
+		label := strings.TrimSpace(*request.Label)
+		if label == "" || len(label) > maxContactLabel {
+			return fmt.Errorf("%w: label must be 1 to %d characters", errInvalidContact, maxContactLabel)
+		}
+		contact.Label = label
+	}
+	if request.Favorite != nil {
+		contact.Favorite = *request.Favorite
+	}
+	if request.ENSName != nil {
+		contact.ENSName = strings.ToLower(strings.TrimSpace(*request.ENSName))
+		contact.ENSRefreshedAt = nil
+	}
+	if request.Address != nil {
+		if !common.IsHexAddress(*request.Address) {
+			return fmt.Errorf("%w: invalid address %q", errInvalidContact, *request.Address)
+		}
+		contact.Address = strings.ToLower(*request.Address)
+	}
+
+	if contact.ENSName != "" && (request.ENSName != nil || request.Address != nil) {
+		resolved, err := s.resolveName(ctx, contact.ENSName)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidContact, err)
+		}
+		if request.Address != nil && resolved != contact.Address {
+			return fmt.Errorf("%w: %s resolves to %s, not %s", errInvalidContact, contact.ENSName, resolved, contact.Address)
+		}
+		contact.Address, contact.ENSRefreshedAt = resolved, &now
+	}
+	if contact.Address == "" {
+		return fmt.Errorf("%w: address or ens_name is required", errInvalidContact)
+	}
+	contact.UpdatedAt = now
+	return nil
+}
+
+// resolveName returns the lowercase address name resolves to
+func (s *contactService) resolveName(ctx context.Context, name string) (string, error) {
+	address, err := s.resolve(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", name, err)
+	}
+	if !common.IsHexAddress(address) || common.HexToAddress(address) == (common.Address{}) {
+		return "", fmt.Errorf("%s does not resolve to an address", name)
+	}
+	return strings.ToLower(address), nil
+}
+
+// remove deletes one of owner's contacts
+func (s *contactService) remove(id, owner string) error {
+	result, err := db.Exec(`DELETE FROM contacts WHERE id = ? AND owner = ?`, strings.ToLower(id), strings.ToLower(owner))
+	if err != nil {
+		return fmt.Errorf("failed to delete contact %s: %w", id, err)
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return errContactNotFound
+	}
+	return nil
+}
+
+// get returns the contact with id
+func (s *contactService) get(id string) (*Contact, error) {
+	found, err := s.query(`WHERE id = ?`, strings.ToLower(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, errContactNotFound
+	}
+	return found[0], nil
+}
+
+// list returns owner's contacts, favorites first
+func (s *contactService) list(owner string) ([]*Contact, error) {
+	return s.query(`WHERE owner = ? ORDER BY favorite DESC, label COLLATE NOCASE`, strings.ToLower(owner))
+}
+
+// query returns the contacts matching where
+func (s *contactService) query(where string, args ...interface{}) ([]*Contact, error) {
+	rows, err := db.Query(`SELECT id, owner, label, address, ens_name, favorite, ens_refreshed_at, created_at, updated_at FROM contacts `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []*Contact
+	for rows.Next() {
+		contact := &Contact{}
+		var refreshedAt sql.NullTime
+		err := rows.Scan(&contact.ID, &contact.Owner, &contact.Label, &contact.Address, &contact.ENSName, &contact.Favorite,
+			&refreshedAt, &contact.CreatedAt, &contact.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if refreshedAt.Valid {
+			contact.ENSRefreshedAt = &refreshedAt.Time
+		}
+		found = append(found, contact)
+	}
+	return found, rows.Err()
+}
+
+// suggest returns the recipients to offer owner: favorites first, then by
+// how recently owner paid them, then by label. search filters by label, ENS
+// name or address.
+func (s *contactService) suggest(owner, search string, limit int) ([]*ContactSuggestion, error) {
+	owner, search = strings.ToLower(owner), strings.ToLower(strings.TrimSpace(search))
+	if limit <= 0 || limit > maxSuggestions {
+		limit = defaultSuggestions
+	}
+
+	saved, err := s.list(owner)
+	if err != nil {
+		return nil, err
+	}
+	byAddress := make(map[string]*ContactSuggestion)
+	var suggestions []*ContactSuggestion
+	for _, contact := range saved {
+		suggestion := &ContactSuggestion{
+			Address:   contact.Address,
+			Label:     contact.Label,
+			ENSName:   contact.ENSName,
+			ContactID: contact.ID,
+			Favorite:  contact.Favorite,
+		}
+		byAddress[contact.Address] = suggestion
+		suggestions = append(suggestions, suggestion)
+	}
+
+	// The latest payment to each recipient, most recent first
+	rows, err := db.Query(`SELECT p.recipient, p.recipient_ens, p.created_at, recent.payments FROM payments p
+		JOIN (SELECT MAX(rowid) AS last, COUNT(*) AS payments FROM payments WHERE sender = ? GROUP BY recipient) recent
+		ON p.rowid = recent.last ORDER BY recent.last DESC LIMIT ?`, owner, maxSuggestions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var recipient string
+		var recipientENS sql.NullString
+		var paidAt sql.NullTime
+		var payments int
+		if err := rows.Scan(&recipient, &recipientENS, &paidAt, &payments); err != nil {
+			return nil, err
+		}
+		suggestion, ok := byAddress[recipient]
+		if !ok {
+			suggestion = &ContactSuggestion{Address: recipient, ENSName: recipientENS.String}
+			byAddress[recipient] = suggestion
+			suggestions = append(suggestions, suggestion)
+		}
+		suggestion.Payments = payments
+		if paidAt.Valid {
+			suggestion.LastPaidAt = &paidAt.Time
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	matching := suggestions[:0]
+	for _, suggestion := range suggestions {
+		if search == "" || strings.Contains(strings.ToLower(suggestion.Label), search) ||
+			strings.Contains(suggestion.ENSName, search) || strings.HasPrefix(suggestion.Address, search) {
+			matching = append(matching, suggestion)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		a, b := matching[i], matching[j]
+		if a.Favorite != b.Favorite {
+			return a.Favorite
+		}
+		if (a.LastPaidAt == nil) != (b.LastPaidAt == nil) {
+			return a.LastPaidAt != nil
+		}
+		if a.LastPaidAt != nil && !a.LastPaidAt.Equal(*b.LastPaidAt) {
+			return a.LastPaidAt.After(*b.LastPaidAt)
+		}
+		return strings.ToLower(a.Label) < strings.ToLower(b.Label)
+	})
+	if len(matching) > limit {
+		matching = matching[:limit]
+	}
+	return matching, nil
+}
+
+// refreshENS re-resolves the ENS names of contacts not resolved within
+// refreshAfter. A name that fails to resolve keeps its last address.
+func (s *contactService) refreshENS(ctx context.Context) {
+	now := s.now().UTC()
+	stale, err := s.query(`WHERE ens_name != '' AND (ens_refreshed_at IS NULL OR ens_refreshed_at < ?) ORDER BY ens_refreshed_at LIMIT ?`,
+		now.Add(-s.refreshAfter), maxContactsPerRefresh)
+	if err != nil {
+		log.Printf("Failed to load contacts to refresh: %v", err)
+		return
+	}
+
+	for _, contact := range stale {
+		address, err := s.resolveName(ctx, contact.ENSName)
+		if err != nil {
+			log.Printf("Warning: contact %s: %v", contact.ID, err)
+			continue
+		}
+		if address != contact.Address {
+			log.Printf("Contact %s: %s now resolves to %s instead of %s", contact.ID, contact.ENSName, address, contact.Address)
+		}
+		_, err = db.Exec(`UPDATE contacts SET address = ?, ens_refreshed_at = ?, updated_at = CASE WHEN address = ? THEN updated_at ELSE ? END WHERE id = ?`,
+			address, now, address, now, contact.ID)
+		if err != nil {
+			log.Printf("Failed to refresh contact %s: %v", contact.ID, err)
+		}
+	}
+}
+
+// track refreshes ENS names every refreshAfter until ctx is done
+func (s *contactService) track(ctx context.Context) {
+	ticker := time.NewTicker(s.refreshAfter)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshENS(ctx)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	contactOwner = "0x00000000000000000000000000000000000000f1"
+	contactAlice = "0x00000000000000000000000000000000000000f2"
+	contactBob   = "0x00000000000000000000000000000000000000f3"
+	contactCarol = "0x00000000000000000000000000000000000000f4"
+)
+
+// setupContactTest returns a contact service whose clock is at *now and
+// whose ENS names resolve from names
+func setupContactTest(t *testing.T) (*contactService, *time.Time, map[string]string) {
+	setupTestDB(t)
+
+	clock, now := fixedClock(testNow)
+	names := map[string]string{"alice.eth": contactAlice}
+	service := &contactService{
+		resolve: func(ctx context.Context, name string) (string, error) {
+			if address, ok := names[name]; ok {
+				return address, nil
+			}
+			return "", errors.New("name not found")
+		},
+		refreshAfter: time.Hour,
+		now:          clock,
+	}
+	setGlobal(t, &contacts, service)
+	return service, now, names
+}
+
+func contactRequest(label, address, ensName string, favorite bool) *ContactRequest {
+	request := &ContactRequest{Owner: contactOwner, Label: &label, Favorite: &favorite}
+	if address != "" {
+		request.Address = &address
+	}
+	if ensName != "" {
+		request.ENSName = &ensName
+	}
+	return request
+}
+
+func TestContacts(t *testing.T) {
+	t.Run("should resolve ENS names when saving a contact", func(t *testing.T) {
+		service, _, _ := setupContactTest(t)
+
+		contact, err := service.create(context.Background(), contactRequest("Alice", "", "Alice.eth", false))
+		require.NoError(t, err)
+		assert.Equal(t, contactAlice, contact.Address)
+		assert.Equal(t, "alice.eth", contact.ENSName)
+		assert.NotNil(t, contact.ENSRefreshedAt)
+
+		_, err = service.create(context.Background(), contactRequest("Alice again", contactAlice, "", false))
+		assert.ErrorIs(t, err, errContactExists)
+		_, err = service.create(context.Background(), contactRequest("Bob", contactBob, "alice.eth", false))
+		assert.ErrorIs(t, err, errInvalidContact)
+		_, err = service.create(context.Background(), contactRequest("Nobody", "", "nobody.eth", false))
+		assert.ErrorIs(t, err, errInvalidContact)
+		_, err = service.create(context.Background(), contactRequest(" ", contactBob, "", false))
+		assert.ErrorIs(t, err, errInvalidContact)
+	})
+
+	t.Run("should update only the fields given by the owner", func(t *testing.T) {
+		service, _, _ := setupContactTest(t)
+		contact, err := service.create(context.Background(), contactRequest("Bob", contactBob, "", false))
+		require.NoError(t, err)
+
+		favorite := true
+		updated, err := service.update(context.Background(), contact.ID, &ContactRequest{Owner: strings.ToUpper(contactOwner), Favorite: &favorite})
+		require.NoError(t, err)
+		assert.True(t, updated.Favorite)
+		assert.Equal(t, "Bob", updated.Label)
+		assert.Equal(t, contactBob, updated.Address)
+
+		_, err = service.update(context.Background(), contact.ID, &ContactRequest{Owner: contactAlice, Favorite: &favorite})
+		assert.ErrorIs(t, err, errContactNotFound)
+		assert.ErrorIs(t, service.remove(contact.ID, contactAlice), errContactNotFound)
+		require.NoError(t, service.remove(contact.ID, contactOwner))
+		_, err = service.get(contact.ID)
+		assert.ErrorIs(t, err, errContactNotFound)
+	})
+
+	t.Run("should follow ENS names to their new address", func(t *testing.T) {
+		service, now, names := setupContactTest(t)
+		contact, err := service.create(context.Background(), contactRequest("Alice", "", "alice.eth", false))
+		require.NoError(t, err)
+
+		names["alice.eth"] = contactCarol
+		*now = now.Add(30 * time.Minute)
+		service.refreshENS(context.Background())
+		contact, err = service.get(contact.ID)
+		require.NoError(t, err)
+		assert.Equal(t, contactAlice, contact.Address)
+
+		*now = now.Add(time.Hour)
+		service.refreshENS(context.Background())
+		contact, err = service.get(contact.ID)
+		require.NoError(t, err)
+		assert.Equal(t, contactCarol, contact.Address)
+		assert.Equal(t, *now, *contact.ENSRefreshedAt)
+
+		// A name that stops resolving keeps its last address
+		delete(names, "alice.eth")
+		*now = now.Add(2 * time.Hour)
+		service.refreshENS(context.Background())
+		contact, err = service.get(contact.ID)
+		require.NoError(t, err)
+		assert.Equal(t, contactCarol, contact.Address)
+	})
+
+	t.Run("should suggest favorites, then recent recipients", func(t *testing.T) {
+		service, _, _ := setupContactTest(t)
+		_, err := service.create(context.Background(), contactRequest("Bob", contactBob, "", true))
+		require.NoError(t, err)
+		_, err = service.create(context.Background(), contactRequest("Alice", contactAlice, "", false))
+		require.NoError(t, err)
+
+		for i, recipient := range []string{contactAlice, contactCarol, contactCarol} {
+			_, err := db.Exec(`INSERT INTO payments (id, chain_id, sender, recipient, recipient_ens, token, amount, created_at) VALUES (?, 4202, ?, ?, ?, ?, '1', ?)`,
+				i, contactOwner, recipient, "carol.eth", nativeToken, time.Date(2026, 2, 1+i, 0, 0, 0, 0, time.UTC))
+			require.NoError(t, err)
+		}
+
+		suggestions, err := service.suggest(contactOwner, "", 0)
+		require.NoError(t, err)
+		require.Len(t, suggestions, 3)
+		assert.Equal(t, contactBob, suggestions[0].Address)
+		assert.Equal(t, contactCarol, suggestions[1].Address)
+		assert.Equal(t, 2, suggestions[1].Payments)
+		assert.Empty(t, suggestions[1].ContactID)
+		assert.Equal(t, "Alice", suggestions[2].Label)
+		assert.Equal(t, 1, suggestions[2].Payments)
+
+		w := httptest.NewRecorder()
+		handleContactSuggestions(w, httptest.NewRequest(http.MethodGet, "/api/contacts/suggestions/"+contactOwner+"?q=carol&limit=5", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Suggestions []*ContactSuggestion `json:"suggestions"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Len(t, response.Suggestions, 1)
+		assert.Equal(t, "carol.eth", response.Suggestions[0].ENSName)
+	})
+
+	t.Run("should answer the contact endpoints", func(t *testing.T) {
+		setupContactTest(t)
+
+		w := httptest.NewRecorder()
+		handleCreateContact(w, httptest.NewRequest(http.MethodPost, "/api/contacts/create",
+			strings.NewReader(`{"owner": "`+contactOwner+`", "label": "Alice", "ens_name": "alice.eth"}`)))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var contact Contact
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&contact))
+
+		w = httptest.NewRecorder()
+		handleCreateContact(w, httptest.NewRequest(http.MethodPost, "/api/contacts/create",
+			strings.NewReader(`{"owner": "`+contactOwner+`", "label": "Alice", "address": "`+contactAlice+`"}`)))
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = httptest.NewRecorder()
+		handleUpdateContact(w, httptest.NewRequest(http.MethodPost, "/api/contacts/update/"+contact.ID,
+			strings.NewReader(`{"owner": "`+contactOwner+`", "label": "Alice B."}`)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		handleGetUserContacts(w, httptest.NewRequest(http.MethodGet, "/api/contacts/user/"+contactOwner, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, 1.0, response["count"])
+
+		w = httptest.NewRecorder()
+		handleDeleteContact(w, httptest.NewRequest(http.MethodPost, "/api/contacts/delete/"+contact.ID,
+			strings.NewReader(`{"owner": "`+contactOwner+`"}`)))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = httptest.NewRecorder()
+		handleGetContact(w, httptest.NewRequest(http.MethodGet, "/api/contacts/"+contact.ID, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -73,6 +73,374 @@ func createPaymentTables() error {
 
 	CREATE INDEX IF NOT EXISTS idx_receipts_payment_id ON receipts(payment_id);
 	CREATE INDEX IF NOT EXISTS idx_receipts_created_at ON receipts(created_at);
+
+	CREATE TABLE IF NOT EXISTS user_operations (
+		hash TEXT PRIMARY KEY,
+		chain_id INTEGER NOT NULL,
+		sender TEXT NOT NULL,
+		nonce TEXT NOT NULL,
+		sponsored BOOLEAN DEFAULT FALSE,
+		status TEXT DEFAULT 'pending',
+		tx_hash TEXT,
+		block_number INTEGER,
+		actual_gas_cost TEXT,
+		payment_id TEXT,
+		reason TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_user_operations_sender ON user_operations(sender);
+	CREATE INDEX IF NOT EXISTS idx_user_operations_status ON user_operations(status);
+
+	CREATE TABLE IF NOT EXISTS payment_intents (
+		id TEXT PRIMARY KEY,
+		chain_id INTEGER NOT NULL,
+		sender TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		token TEXT NOT NULL,
+		amount TEXT NOT NULL,
+		metadata_uri TEXT,
+		nonce TEXT NOT NULL,
+		deadline INTEGER NOT NULL,
+		signature TEXT NOT NULL,
+		status TEXT DEFAULT 'signed',
+		tx_hash TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		executed_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_payment_intents_sender ON payment_intents(sender);
+	CREATE INDEX IF NOT EXISTS idx_payment_intents_status ON payment_intents(status);
+
+	CREATE TABLE IF NOT EXISTS tokens (
+		chain_id INTEGER NOT NULL,
+		address TEXT NOT NULL,
+		symbol TEXT NOT NULL,
+		name TEXT NOT NULL,
+		decimals INTEGER NOT NULL,
+		logo_uri TEXT,
+		risk_flags TEXT NOT NULL DEFAULT '',
+		curated BOOLEAN DEFAULT FALSE,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (chain_id, address)
+	);
+
+	CREATE TABLE IF NOT EXISTS kyc_verifications (
+		address TEXT PRIMARY KEY,
+		provider TEXT NOT NULL,
+		applicant_id TEXT NOT NULL,
+		level TEXT NOT NULL,
+		status TEXT NOT NULL,
+		approved_level TEXT,
+		reason TEXT,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		approved_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_kyc_verifications_applicant_id ON kyc_verifications(applicant_id);
+	CREATE INDEX IF NOT EXISTS idx_kyc_verifications_status ON kyc_verifications(status);
+
+	CREATE TABLE IF NOT EXISTS travel_rule_transfers (
+		payment_id TEXT NOT NULL,
+		direction TEXT NOT NULL,
+		counterparty_vasp TEXT NOT NULL DEFAULT '',
+		value_usd REAL,
+		status TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		payload_hash TEXT NOT NULL,
+		receipt TEXT NOT NULL DEFAULT '',
+		receipt_hash TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (payment_id, direction, counterparty_vasp)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_travel_rule_transfers_receipt_hash ON travel_rule_transfers(receipt_hash);
+
+	CREATE TABLE IF NOT EXISTS settlements (
+		id TEXT PRIMARY KEY,
+		merchant TEXT NOT NULL,
+		payout_address TEXT NOT NULL,
+		chain_id INTEGER NOT NULL,
+		token TEXT NOT NULL,
+		period_start DATETIME NOT NULL,
+		period_end DATETIME NOT NULL,
+		payment_count INTEGER NOT NULL,
+		gross TEXT NOT NULL,
+		fee TEXT NOT NULL,
+		net TEXT NOT NULL,
+		status TEXT NOT NULL,
+		tx_hash TEXT NOT NULL,
+		raw_tx TEXT NOT NULL,
+		statement TEXT NOT NULL,
+		statement_cid TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		confirmed_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_settlements_merchant ON settlements(merchant);
+	CREATE INDEX IF NOT EXISTS idx_settlements_status ON settlements(status);
+
+	CREATE TABLE IF NOT EXISTS settlement_payments (
+		payment_id TEXT PRIMARY KEY,
+		settlement_id TEXT NOT NULL,
+		FOREIGN KEY(settlement_id) REFERENCES settlements(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_settlement_payments_settlement_id ON settlement_payments(settlement_id);
+
+	CREATE TABLE IF NOT EXISTS payment_streams (
+		id TEXT PRIMARY KEY,
+		chain_id INTEGER NOT NULL,
+		sender TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		token TEXT NOT NULL,
+		rate_per_second TEXT NOT NULL,
+		deposit TEXT NOT NULL,
+		start_time DATETIME NOT NULL,
+		stop_time DATETIME NOT NULL,
+		status TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		cancelled_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_payment_streams_sender ON payment_streams(sender);
+	CREATE INDEX IF NOT EXISTS idx_payment_streams_recipient ON payment_streams(recipient);
+
+	CREATE TABLE IF NOT EXISTS split_payments (
+		id TEXT PRIMARY KEY,
+		chain_id INTEGER NOT NULL,
+		sender TEXT NOT NULL,
+		token TEXT NOT NULL,
+		amount TEXT NOT NULL,
+		metadata_uri TEXT NOT NULL DEFAULT '',
+		execution TEXT NOT NULL,
+		status TEXT NOT NULL,
+		user_op_hash TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_split_payments_sender ON split_payments(sender);
+	CREATE INDEX IF NOT EXISTS idx_split_payments_user_op_hash ON split_payments(user_op_hash);
+
+	CREATE TABLE IF NOT EXISTS split_payment_legs (
+		split_id TEXT NOT NULL,
+		leg_index INTEGER NOT NULL,
+		recipient TEXT NOT NULL,
+		share_bps INTEGER NOT NULL DEFAULT 0,
+		amount TEXT NOT NULL,
+		payment_id TEXT NOT NULL DEFAULT '',
+		tx_hash TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (split_id, leg_index),
+		FOREIGN KEY (split_id) REFERENCES split_payments(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_split_payment_legs_recipient ON split_payment_legs(recipient);
+	CREATE INDEX IF NOT EXISTS idx_split_payment_legs_payment_id ON split_payment_legs(payment_id);
+
+	CREATE TABLE IF NOT EXISTS contacts (
+		id TEXT PRIMARY KEY,
+		owner TEXT NOT NULL,
+		label TEXT NOT NULL,
+		address TEXT NOT NULL,
+		ens_name TEXT NOT NULL DEFAULT '',
+		favorite BOOLEAN NOT NULL DEFAULT FALSE,
+		ens_refreshed_at DATETIME,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		UNIQUE (owner, address)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_contacts_ens_name ON contacts(ens_name);
+
+	CREATE TABLE IF NOT EXISTS gas_sponsorships (
+		user_op_hash TEXT PRIMARY KEY,
+		chain_id INTEGER NOT NULL,
+		merchant TEXT NOT NULL,
+		day TEXT NOT NULL,
+		reserved TEXT NOT NULL,
+		spent TEXT,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_gas_sponsorships_merchant_day ON gas_sponsorships(merchant, day);
+
+	CREATE TABLE IF NOT EXISTS payment_quotes (
+		id TEXT PRIMARY KEY,
+		chain_id INTEGER NOT NULL,
+		sender TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		token TEXT NOT NULL,
+		amount TEXT NOT NULL,
+		symbol TEXT NOT NULL,
+		rate REAL NOT NULL,
+		value_usd REAL NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		redeemed_at DATETIME NOT NULL,
+		payment_id TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_payment_quotes_payment_id ON payment_quotes(payment_id);
+
+	CREATE TABLE IF NOT EXISTS erasure_requests (
+		id TEXT PRIMARY KEY,
+		address TEXT NOT NULL DEFAULT '',
+		subject_hash TEXT NOT NULL,
+		status TEXT NOT NULL,
+		erase_after DATETIME NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		stores TEXT NOT NULL DEFAULT '{}',
+		certificate TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		erased_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_erasure_requests_subject_hash ON erasure_requests(subject_hash);
+	CREATE INDEX IF NOT EXISTS idx_erasure_requests_status ON erasure_requests(status);
+
+	CREATE TABLE IF NOT EXISTS payment_metadata (
+		uri TEXT PRIMARY KEY,
+		schema TEXT NOT NULL,
+		cid TEXT NOT NULL DEFAULT '',
+		digest TEXT NOT NULL,
+		validated_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_payment_metadata_schema ON payment_metadata(schema);
+
+	CREATE TABLE IF NOT EXISTS payment_metadata_fields (
+		uri TEXT NOT NULL,
+		field TEXT NOT NULL,
+		value TEXT NOT NULL COLLATE NOCASE,
+		PRIMARY KEY (uri, field)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_payment_metadata_fields_value ON payment_metadata_fields(field, value);
+	CREATE INDEX IF NOT EXISTS idx_payments_metadata ON payments(metadata);
+
+	CREATE TABLE IF NOT EXISTS payroll_runs (
+		id TEXT PRIMARY KEY,
+		sender TEXT NOT NULL,
+		token TEXT NOT NULL,
+		metadata_uri TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		total TEXT NOT NULL,
+		errors INTEGER NOT NULL DEFAULT 0,
+		split_id TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		submitted_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_payroll_runs_sender ON payroll_runs(sender);
+
+	CREATE TABLE IF NOT EXISTS payroll_rows (
+		run_id TEXT NOT NULL,
+		line INTEGER NOT NULL,
+		recipient TEXT NOT NULL,
+		ens_name TEXT NOT NULL DEFAULT '',
+		address TEXT NOT NULL DEFAULT '',
+		amount TEXT NOT NULL,
+		reference TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		leg_index INTEGER NOT NULL DEFAULT -1,
+		PRIMARY KEY (run_id, line),
+		FOREIGN KEY (run_id) REFERENCES payroll_runs(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_payroll_rows_address ON payroll_rows(address);
+
+	CREATE TABLE IF NOT EXISTS limit_evaluations (
+		id TEXT PRIMARY KEY,
+		source TEXT NOT NULL,
+		chain_id INTEGER NOT NULL,
+		sender TEXT NOT NULL,
+		token TEXT NOT NULL,
+		amount TEXT NOT NULL,
+		value_usd REAL,
+		mode TEXT NOT NULL,
+		passed INTEGER NOT NULL,
+		parties TEXT NOT NULL,
+		violations TEXT NOT NULL,
+		reference TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		recorded_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_limit_evaluations_sender ON limit_evaluations(sender);
+	CREATE INDEX IF NOT EXISTS idx_limit_evaluations_created_at ON limit_evaluations(created_at);
+
+	CREATE TABLE IF NOT EXISTS limit_usage (
+		evaluation_id TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		address TEXT NOT NULL,
+		value_usd REAL,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY (evaluation_id) REFERENCES limit_evaluations(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_limit_usage_address ON limit_usage(scope, address, created_at);
+
+	CREATE TABLE IF NOT EXISTS walletconnect_sessions (
+		id TEXT PRIMARY KEY,
+		chain_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		address TEXT NOT NULL DEFAULT '',
+		accounts TEXT NOT NULL,
+		wallet TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		pairing_topic TEXT NOT NULL UNIQUE,
+		pairing_key TEXT NOT NULL,
+		private_key TEXT NOT NULL,
+		proposal_id INTEGER NOT NULL,
+		session_topic TEXT NOT NULL DEFAULT '',
+		session_key TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_walletconnect_sessions_session_topic ON walletconnect_sessions(session_topic);
+	CREATE INDEX IF NOT EXISTS idx_walletconnect_sessions_status ON walletconnect_sessions(status);
+
+	CREATE TABLE IF NOT EXISTS walletconnect_requests (
+		id TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		rpc_id INTEGER NOT NULL,
+		sender TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		token TEXT NOT NULL,
+		amount TEXT NOT NULL,
+		metadata_uri TEXT NOT NULL DEFAULT '',
+		calls TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		FOREIGN KEY (session_id) REFERENCES walletconnect_sessions(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_walletconnect_requests_rpc_id ON walletconnect_requests(rpc_id);
+	CREATE INDEX IF NOT EXISTS idx_walletconnect_requests_status ON walletconnect_requests(status);
+
+	CREATE TABLE IF NOT EXISTS events (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		payment_id TEXT NOT NULL,
+		data TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_events_type ON events(type, seq);
+	CREATE INDEX IF NOT EXISTS idx_events_created_at ON events(created_at);
 	`
 
 	_, err := db.Exec(schema)
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// A payment's sender and recipient may be named by ENS name, in sender_ens
+// and recipient_ens or in place of the address itself. Names are resolved
+// through the ENS resolver before the payment is checked, and the resolved
+// address is the one paid: an address given alongside a name must be the
+// one the name resolves to. Mixed-case addresses, given or resolved, must
+// carry a valid EIP-55 checksum.
+
+var (
+	errENSNotResolved  = errors.New("ENS name does not resolve")
+	errENSMismatch     = errors.New("address does not match ENS name")
+	errInvalidAddress  = errors.New("invalid address")
+	errAddressChecksum = errors.New("invalid address checksum")
+)
+
+// PaymentParty is a payment's sender or recipient. ENSName is set when the
+// party was named by it, and Flags hold what screening found.
+type PaymentParty struct {
+	Address string   `json:"address"`
+	ENSName string   `json:"ens_name,omitempty"`
+	Flags   []string `json:"flags,omitempty"`
+}
+
+// isENSName reports whether value is a name rather than an address
+func isENSName(value string) bool {
+	return !strings.HasPrefix(value, "0x") && strings.Contains(value, ".")
+}
+
+// checkAddress accepts addresses that are all lowercase, all uppercase or
+// checksummed
+func checkAddress(address string) error {
+	if !common.IsHexAddress(address) {
+		return fmt.Errorf("%w: %s", errInvalidAddress, address)
+	}
+	digits := strings.TrimPrefix(strings.TrimPrefix(address, "0x"), "0X")
+	if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) &&
+		"0x"+digits != common.HexToAddress(address).Hex() {
+		return fmt.Errorf("%w: %s", errAddressChecksum, address)
+	}
+	return nil
+}
+
+// resolveParty returns the party named by address, name or both. An address
+// that is an ENS name is taken as the name. Errors are *AddressError for
+// the field role.
+func resolveParty(ctx context.Context, role, address, name string) (PaymentParty, error) {
+	address, name = strings.TrimSpace(address), strings.ToLower(strings.TrimSpace(name))
+	if name == "" && isENSName(address) {
+		address, name = "", strings.ToLower(address)
+	}
+	if address != "" {
+		if err := checkAddress(address); err != nil {
+			return PaymentParty{}, addressError(role, err)
+		}
+	}
+	if name == "" {
+		return PaymentParty{Address: address}, nil
+	}
+
+	resolved, err := resolveENSName(ctx, name)
+	if err != nil {
+		return PaymentParty{}, addressError(role, err)
+	}
+	if address != "" && !strings.EqualFold(address, resolved) {
+		return PaymentParty{}, addressError(role, fmt.Errorf("%w: %s resolves to %s, not %s", errENSMismatch, name, resolved, address))
+	}
+	if address == "" {
+		address = resolved
+	}
+	return PaymentParty{Address: address, ENSName: name}, nil
+}
+
+// resolveENSName returns the address name resolves to through the ENS
+// resolver
+func resolveENSName(ctx context.Context, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, ensCallTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ensServiceURL+"/api/ens/resolve/"+url.PathEscape(name), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errENSUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest:
+		return "", fmt.Errorf("%w: %s", errENSNotResolved, name)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("%w: resolver returned %d", errENSUnavailable, resp.StatusCode)
+	}
+	var record struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		return "", fmt.Errorf("%w: %v", errENSUnavailable, err)
+	}
+	if !common.IsHexAddress(record.Address) || common.HexToAddress(record.Address) == (common.Address{}) {
+		return "", fmt.Errorf("%w: %s", errENSNotResolved, name)
+	}
+	if err := checkAddress(record.Address); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return record.Address, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupENSResolver points the ENS client at a resolver that answers names
+// from records
+func setupENSResolver(t *testing.T, records map[string]string) {
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/ens/resolve/")
+		if name == "broken.eth" {
+			http.Error(w, "upstream failure", http.StatusInternalServerError)
+			return
+		}
+		address, ok := records[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Name not found: " + name})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"name": name, "address": address})
+	}))
+	t.Cleanup(resolver.Close)
+	setGlobal(t, &ensServiceURL, resolver.URL)
+}
+
+func TestResolveParty(t *testing.T) {
+	setupENSResolver(t, map[string]string{
+		"merchant.eth": settlementMerchant,
+		"bad.eth":      "0x00000000000000000000000000000000000000Cc",
+	})
+	ctx := context.Background()
+
+	t.Run("should take an ENS name given as the address", func(t *testing.T) {
+		party, err := resolveParty(ctx, "recipient", "Merchant.ETH", "")
+		require.NoError(t, err)
+		assert.Equal(t, PaymentParty{Address: settlementMerchant, ENSName: "merchant.eth"}, party)
+	})
+
+	t.Run("should accept an address matching its ENS name", func(t *testing.T) {
+		party, err := resolveParty(ctx, "recipient", "0x"+strings.ToUpper(settlementMerchant[2:]), "merchant.eth")
+		require.NoError(t, err)
+		assert.Equal(t, "merchant.eth", party.ENSName)
+	})
+
+	t.Run("should refuse an address the name does not resolve to", func(t *testing.T) {
+		_, err := resolveParty(ctx, "recipient", contactAlice, "merchant.eth")
+		assert.ErrorIs(t, err, errENSMismatch)
+	})
+
+	t.Run("should refuse invalid addresses and wrong checksums", func(t *testing.T) {
+		_, err := resolveParty(ctx, "recipient", "0x1234", "")
+		assert.ErrorIs(t, err, errInvalidAddress)
+
+		_, err = resolveParty(ctx, "sender", "0x52908400098527886E0F7030069857D2E4169Ee7", "")
+		assert.ErrorIs(t, err, errAddressChecksum)
+
+		_, err = resolveParty(ctx, "sender", "0x52908400098527886E0F7030069857D2E4169EE7", "")
+		assert.NoError(t, err)
+
+		_, err = resolveParty(ctx, "recipient", "", "bad.eth")
+		assert.ErrorIs(t, err, errAddressChecksum)
+	})
+
+	t.Run("should tell unknown names from an unavailable resolver", func(t *testing.T) {
+		_, err := resolveParty(ctx, "recipient", "", "unknown.eth")
+		assert.ErrorIs(t, err, errENSNotResolved)
+
+		_, err = resolveParty(ctx, "recipient", "", "broken.eth")
+		assert.ErrorIs(t, err, errENSUnavailable)
+	})
+}
+
+func TestCreatePaymentENS(t *testing.T) {
+	createPayment := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleCreatePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/create", strings.NewReader(body)))
+		return w
+	}
+
+	t.Run("should pay the address the recipient's name resolves to", func(t *testing.T) {
+		setupSandboxTest(t)
+		setupSplitHandlers(t)
+		setupENSResolver(t, map[string]string{"merchant.eth": settlementMerchant})
+
+		w := createPayment(`{"sender": "` + kycSender + `", "recipient": "merchant.eth", "token": "` + nativeToken + `", "amount": "1000"}`)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var response struct {
+			Recipient PaymentParty `json:"recipient"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, PaymentParty{Address: settlementMerchant, ENSName: "merchant.eth"}, response.Recipient)
+	})
+
+	t.Run("should refuse payments whose recipient does not match its name", func(t *testing.T) {
+		setupENSResolver(t, map[string]string{"merchant.eth": settlementMerchant})
+
+		w := createPayment(`{"sender": "` + kycSender + `", "recipient": "` + contactAlice + `", "recipient_ens": "merchant.eth", "token": "` + nativeToken + `", "amount": "1000"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "does not match ENS name")
+	})
+
+	t.Run("should answer 502 when the resolver is unavailable", func(t *testing.T) {
+		setupENSResolver(t, nil)
+
+		w := createPayment(`{"sender": "` + kycSender + `", "recipient_ens": "broken.eth", "token": "` + nativeToken + `", "amount": "1000"}`)
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+}
+
+func TestServiceCallCancellation(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(slow.Close)
+
+	t.Run("should stop a call when its caller is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		started := time.Now()
+		_, err := makeServiceCall(ctx, storageCallTimeout, "GET", slow.URL+"/api/receipts/download/1", nil)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, time.Since(started), 2*time.Second)
+	})
+
+	t.Run("should give up a call at its deadline", func(t *testing.T) {
+		_, err := makeServiceCall(context.Background(), 50*time.Millisecond, "GET", slow.URL+"/api/ftso/price/ETH/USD", nil)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
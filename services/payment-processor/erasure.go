@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// A data subject erases their personal data by signing an erasure request
+// for their address. The address is soft-deleted at once: its address book,
+// streams and splits answer 410 Gone. Once the grace period is over, during
+// which a signed cancel restores it, the ENS names, memos and contacts tied
+// to the address are anonymized in the payments database, the storage worker
+// erases its receipts and the analytics service pseudonymizes it. Addresses,
+// amounts and statuses are kept, so balances, settlements and volumes still
+// add up. Each store's result is saved as it completes, and a failed erasure
+// is retried from the store it stopped at. The erasure certificate lists what
+// was erased and what is retained, and carries a hash of itself.
+
+const (
+	defaultErasureGracePeriod  = 7 * 24 * time.Hour
+	defaultErasurePollInterval = time.Minute
+	erasureSignatureWindow     = 15 * time.Minute
+	erasedContactLabel         = "Erased contact"
+)
+
+// Erasure request statuses
+const (
+	ErasurePending   = "pending"
+	ErasureCancelled = "cancelled"
+	ErasureCompleted = "erased"
+)
+
+var (
+	errErasureNotFound  = errors.New("erasure request not found")
+	errInvalidErasure   = errors.New("invalid erasure request")
+	errErasureSignature = errors.New("signature does not match the address")
+	errErasurePending   = errors.New("address already has a pending erasure request")
+	errErasureFinal     = errors.New("erasure request is no longer pending")
+	errAddressErased    = errors.New("address is pending erasure")
+)
+
+// erasures is always set; without ANALYTICS_URL analytics are not erased
+var erasures *erasureService
+
+type erasureService struct {
+	gracePeriod    time.Duration
+	pollInterval   time.Duration
+	analyticsURL   string
+	analyticsToken string
+	// storageToken signs the operator token erasures are sent to the
+	// storage worker with
+	storageToken func() (string, error)
+	client       *http.Client
+	now          func() time.Time
+}
+
+// ErasureSignature proves a request comes from the address's owner: a
+// personal_sign signature of erasureMessage, made within
+// erasureSignatureWindow of RequestedAt
+type ErasureSignature struct {
+	Address     string `json:"address"`
+	RequestedAt int64  `json:"requested_at"`
+	Signature   string `json:"signature"`
+}
+
+// ErasureRequest is a data subject's request to erase their address. The
+// address is cleared once it is erased; the subject hash, the SHA-256 of the
+// lowercase address, remains.
+type ErasureRequest struct {
+	ID          string              `json:"id"`
+	Address     string              `json:"address,omitempty"`
+	SubjectHash string              `json:"subject_hash"`
+	Status      string              `json:"status"`
+	EraseAfter  time.Time           `json:"erase_after"`
+	Reason      string              `json:"reason,omitempty"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
+	ErasedAt    *time.Time          `json:"erased_at,omitempty"`
+	Certificate *ErasureCertificate `json:"certificate,omitempty"`
+
+	stores map[string]*StoreErasure
+}
+
+// StoreErasure is what an erasure changed in one store
+type StoreErasure struct {
+	Store    string           `json:"store"`
+	Records  map[string]int64 `json:"records"`
+	Fields   []string         `json:"fields"`
+	Note     string           `json:"note,omitempty"`
+	ErasedAt time.Time        `json:"erased_at"`
+}
+
+// RetainedRecord is personal data an erasure keeps, and why
+type RetainedRecord struct {
+	Store   string `json:"store"`
+	Records int64  `json:"records"`
+	Reason  string `json:"reason"`
+}
+
+// ErasureCertificate records a completed erasure. Hash is the hex SHA-256
+// of the certificate's JSON with an empty hash.
+type ErasureCertificate struct {
+	RequestID   string            `json:"request_id"`
+	SubjectHash string            `json:"subject_hash"`
+	RequestedAt time.Time         `json:"requested_at"`
+	ErasedAt    time.Time         `json:"erased_at"`
+	Erased      []*StoreErasure   `json:"erased"`
+	Retained    []*RetainedRecord `json:"retained"`
+	Hash        string            `json:"hash"`
+}
+
+// erasureMessage is the text signed for an action on address, "erase" or
+// "cancel"
+func erasureMessage(action, address string, requestedAt int64) string {
+	return fmt.Sprintf("CrossPay privacy request\nAction: %s\nAddress: %s\nRequested at: %d", action, strings.ToLower(address), requestedAt)
+}
+
+// subjectHash identifies an erased address without keeping it
+func subjectHash(address string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(address)))
+	return hexutil.Encode(sum[:])
+}
+
+// verify checks that signature signs action for its address. Smart account
+// signatures are checked when payment intents are enabled with an RPC
+// endpoint.
+func (s *erasureService) verify(ctx context.Context, action string, signature *ErasureSignature) error {
+	if !common.IsHexAddress(signature.Address) {
+		return fmt.Errorf("%w: invalid address %q", errInvalidErasure, signature.Address)
+	}
+	requestedAt := time.Unix(signature.RequestedAt, 0)
+	if age := s.now().Sub(requestedAt); age > erasureSignatureWindow || age < -erasureSignatureWindow {
+		return fmt.Errorf("%w: requested_at must be within %s of now", errInvalidErasure, erasureSignatureWindow)
+	}
+	sig, err := hexutil.Decode(signature.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: invalid signature", errInvalidErasure)
+	}
+
+	verifier := intents
+	if verifier == nil {
+		verifier = &intentService{}
+	}
+	digest := common.BytesToHash(accounts.TextHash([]byte(erasureMessage(action, signature.Address, signature.RequestedAt))))
+	if err := verifier.checkSignature(ctx, common.HexToAddress(signature.Address), digest, sig); err != nil {
+		return errErasureSignature
+	}
+	return nil
+}
+
+// request soft-deletes the signer's address and schedules its erasure after
+// the grace period. Without a grace period the address is erased at once.
+func (s *erasureService) request(ctx context.Context, signature *ErasureSignature) (*ErasureRequest, error) {
+	if err := s.verify(ctx, "erase", signature); err != nil {
+		return nil, err
+	}
+	address := strings.ToLower(signature.Address)
+	if err := s.check(address); errors.Is(err, errAddressErased) {
+		return nil, errErasurePending
+	} else if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := s.now().UTC()
+	request := &ErasureRequest{
+		ID:          hexutil.Encode(id),
+		Address:     address,
+		SubjectHash: subjectHash(address),
+		Status:      ErasurePending,
+		EraseAfter:  now.Add(s.gracePeriod),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	_, err := db.Exec(`INSERT INTO erasure_requests (id, address, subject_hash, status, erase_after, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		request.ID, request.Address, request.SubjectHash, request.Status, request.EraseAfter, request.CreatedAt, request.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store erasure request: %w", err)
+	}
+	log.Printf("Erasure %s requested, due %s", request.ID, request.EraseAfter.Format(time.RFC3339))
+
+	if s.gracePeriod == 0 {
+		if err := s.erase(ctx, request.ID); err != nil {
+			log.Printf("Failed to erase %s, retrying later: %v", request.ID, err)
+		}
+	}
+	return s.get(request.ID)
+}
+
+// cancel restores the address of a pending erasure, on a cancel signed by
+// that address
+func (s *erasureService) cancel(ctx context.Context, id string, signature *ErasureSignature) (*ErasureRequest, error) {
+	request, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != ErasurePending {
+		return nil, errErasureFinal
+	}
+	if err := s.verify(ctx, "cancel", signature); err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(signature.Address, request.Address) {
+		return nil, errErasureSignature
+	}
+
+	result, err := db.Exec(`UPDATE erasure_requests SET status = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		ErasureCancelled, s.now().UTC(), id, ErasurePending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel erasure request: %w", err)
+	}
+	if cancelled, _ := result.RowsAffected(); cancelled == 0 {
+		return nil, errErasureFinal
+	}
+	return s.get(id)
+}
+
+// check returns errAddressErased while address has a pending erasure. It
+// passes every address when erasures are not set up.
+func (s *erasureService) check(address string) error {
+	if s == nil || !common.IsHexAddress(address) {
+		return nil
+	}
+	var pending int
+	err := db.QueryRow(`SELECT COUNT(*) FROM erasure_requests WHERE subject_hash = ? AND status = ?`,
+		subjectHash(address), ErasurePending).Scan(&pending)
+	if err != nil {
+		return fmt.Errorf("failed to check erasure requests: %w", err)
+	}
+	if pending > 0 {
+		return errAddressErased
+	}
+	return nil
+}
+
+func (s *erasureService) get(id string) (*ErasureRequest, error) {
+	request := &ErasureRequest{}
+	var stores, certificate string
+	var erasedAt sql.NullTime
+	err := db.QueryRow(`SELECT id, address, subject_hash, status, erase_after, reason, stores, certificate, created_at, updated_at, erased_at FROM erasure_requests WHERE id = ?`,
+		strings.ToLower(id)).Scan(&request.ID, &request.Address, &request.SubjectHash, &request.Status, &request.EraseAfter,
+		&request.Reason, &stores, &certificate, &request.CreatedAt, &request.UpdatedAt, &erasedAt)
+	if err == sql.ErrNoRows {
+		return nil, errErasureNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load erasure request: %w", err)
+	}
+	if erasedAt.Valid {
+		request.ErasedAt = &erasedAt.Time
+	}
+	if err := json.Unmarshal([]byte(stores), &request.stores); err != nil {
+		return nil, fmt.Errorf("failed to decode erasure progress: %w", err)
+	}
+	if certificate != "" {
+		request.Certificate = &ErasureCertificate{}
+		if err := json.Unmarshal([]byte(certificate), request.Certificate); err != nil {
+			return nil, fmt.Errorf("failed to decode erasure certificate: %w", err)
+		}
+	}
+	return request, nil
+}
+
+// erase erases the address of a pending request from each store it has not
+// been erased from yet, then issues the certificate
+func (s *erasureService) erase(ctx context.Context, id string) error {
+	request, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	if request.Status != ErasurePending {
+		return errErasureFinal
+	}
+	if request.stores == nil {
+		request.stores = make(map[string]*StoreErasure)
+	}
+
+	steps := []struct {
+		store string
+		erase func(ctx context.Context, address string) (*StoreErasure, error)
+	}{
+		{"payments", s.erasePayments},
+		{"receipts", s.eraseReceipts},
+		{"analytics", s.eraseAnalytics},
+	}
+	for _, step := range steps {
+		if request.stores[step.store] != nil {
+			continue
+		}
+		erased, err := step.erase(ctx, request.Address)
+		if err != nil {
+			reason := fmt.Sprintf("failed to erase %s: %v", step.store, err)
+			db.Exec(`UPDATE erasure_requests SET reason = ?, updated_at = ? WHERE id = ?`, reason, s.now().UTC(), id)
+			return errors.New(reason)
+		}
+		erased.Store = step.store
+		erased.ErasedAt = s.now().UTC()
+		request.stores[step.store] = erased
+
+		progress, err := json.Marshal(request.stores)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(`UPDATE erasure_requests SET stores = ?, updated_at = ? WHERE id = ?`, string(progress), s.now().UTC(), id); err != nil {
+			return fmt.Errorf("failed to save erasure progress: %w", err)
+		}
+	}
+
+	retained, err := s.retained(request.Address, request.stores["receipts"])
+	if err != nil {
+		return err
+	}
+	now := s.now().UTC()
+	certificate := &ErasureCertificate{
+		RequestID:   request.ID,
+		SubjectHash: request.SubjectHash,
+		RequestedAt: request.CreatedAt,
+		ErasedAt:    now,
+		Retained:    retained,
+	}
+	for _, step := range steps {
+		certificate.Erased = append(certificate.Erased, request.stores[step.store])
+	}
+	if certificate.Hash, err = certificate.digest(); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(certificate)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE erasure_requests SET status = ?, address = '', reason = '', certificate = ?, updated_at = ?, erased_at = ? WHERE id = ?`,
+		ErasureCompleted, string(encoded), now, now, id)
+	if err != nil {
+		return fmt.Errorf("failed to complete erasure: %w", err)
+	}
+	log.Printf("Erasure %s completed, certificate %s", id, certificate.Hash)
+	return nil
+}
+
+// digest hashes the certificate without its hash
+func (c *ErasureCertificate) digest() (string, error) {
+	unhashed := *c
+	unhashed.Hash = ""
+	encoded, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hexutil.Encode(sum[:]), nil
+}
+
+// subjectMetadataURIs selects the metadata URIs of an address's payments,
+// intents and splits, given the address five times
+const subjectMetadataURIs = `SELECT metadata FROM payments WHERE sender = ? OR recipient = ?
+	UNION SELECT metadata_uri FROM payment_intents WHERE sender = ? OR recipient = ?
+	UNION SELECT metadata_uri FROM split_payments WHERE sender = ?`
+
+// erasePayments anonymizes the address's ENS names, memos, metadata index
+// and contacts in one transaction. Contacts it owns are deleted; its entries in other
+// address books keep the address, for their owners' payment history, but
+// lose their label and ENS name.
+func (s *erasureService) erasePayments(ctx context.Context, address string) (*StoreErasure, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	records := make(map[string]int64)
+	for _, update := range []struct {
+		table string
+		query string
+		args  []interface{}
+	}{
+		{"payment_metadata_fields", `DELETE FROM payment_metadata_fields WHERE uri IN (` + subjectMetadataURIs + `)`, []interface{}{address, address, address, address, address}},
+		{"payment_metadata", `DELETE FROM payment_metadata WHERE uri IN (` + subjectMetadataURIs + `)`, []interface{}{address, address, address, address, address}},
+		{"payments", `UPDATE payments SET
+			sender_ens = CASE WHEN sender = ? THEN NULL ELSE sender_ens END,
+			recipient_ens = CASE WHEN recipient = ? THEN NULL ELSE recipient_ens END,
+			metadata = NULL
+			WHERE sender = ? OR recipient = ?`, []interface{}{address, address, address, address}},
+		{"payment_intents", `UPDATE payment_intents SET metadata_uri = '' WHERE sender = ? OR recipient = ?`, []interface{}{address, address}},
+		{"split_payments", `UPDATE split_payments SET metadata_uri = '' WHERE sender = ?`, []interface{}{address}},
+		{"payroll_rows", `UPDATE payroll_rows SET recipient = address, ens_name = '', reference = '' WHERE address = ? OR run_id IN (SELECT id FROM payroll_runs WHERE sender = ?)`, []interface{}{address, address}},
+		{"contacts_owned", `DELETE FROM contacts WHERE owner = ?`, []interface{}{address}},
+		{"contacts_of_others", `UPDATE contacts SET label = ?, ens_name = '', ens_refreshed_at = NULL WHERE address = ?`, []interface{}{erasedContactLabel, address}},
+	} {
+		result, err := tx.ExecContext(ctx, update.query, update.args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to erase %s: %w", update.table, err)
+		}
+		records[update.table], _ = result.RowsAffected()
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &StoreErasure{
+		Records: records,
+		Fields:  []string{"payments.sender_ens", "payments.recipient_ens", "payments.metadata", "payment_metadata", "payment_intents.metadata_uri", "split_payments.metadata_uri", "payroll_rows", "contacts"},
+	}, nil
+}
+
+// eraseReceipts has the storage worker erase the receipts of the address's
+// payments and those it issued as merchant
+func (s *erasureService) eraseReceipts(ctx context.Context, address string) (*StoreErasure, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id FROM payments WHERE sender = ? OR recipient = ? ORDER BY id`, address, address)
+	if err != nil {
+		return nil, err
+	}
+	paymentIDs := []uint64{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if paymentID, err := strconv.ParseUint(id, 10, 64); err == nil {
+			paymentIDs = append(paymentIDs, paymentID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Receipts int      `json:"receipts"`
+		Released []string `json:"released"`
+		Held     []string `json:"held"`
+	}
+	token, err := s.storageToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign storage token: %w", err)
+	}
+	body := map[string]interface{}{"address": address, "payment_ids": paymentIDs}
+	if err := s.post(ctx, storageServiceURL+"/api/receipts/erase", token, body, &result); err != nil {
+		return nil, err
+	}
+
+	erased := &StoreErasure{
+		Records: map[string]int64{"receipts": int64(result.Receipts), "held": int64(len(result.Held))},
+		Fields:  []string{"receipt documents", "receipt index entries"},
+	}
+	if len(result.Held) > 0 {
+		erased.Note = fmt.Sprintf("%d receipts under legal hold are kept until the hold is lifted", len(result.Held))
+	}
+	return erased, nil
+}
+
+// eraseAnalytics has the analytics service pseudonymize the address
+func (s *erasureService) eraseAnalytics(ctx context.Context, address string) (*StoreErasure, error) {
+	if s.analyticsURL == "" {
+		return &StoreErasure{Records: map[string]int64{}, Fields: []string{}, Note: "analytics service not configured"}, nil
+	}
+
+	var response struct {
+		Data struct {
+			Pseudonym      string           `json:"pseudonym"`
+			Points         map[string]int64 `json:"points"`
+			PostgresPoints int64            `json:"postgres_points"`
+		} `json:"data"`
+	}
+	if err := s.post(ctx, s.analyticsURL+"/api/privacy/erase", s.analyticsToken, map[string]string{"address": address}, &response); err != nil {
+		return nil, err
+	}
+
+	records := map[string]int64{"postgres_points": response.Data.PostgresPoints}
+	for tier, count := range response.Data.Points {
+		records["points_"+tier] = count
+	}
+	return &StoreErasure{
+		Records: records,
+		Fields:  []string{"merchant", "sender", "country", "region", "asn", "client_ip"},
+		Note:    "address replaced with " + response.Data.Pseudonym,
+	}, nil
+}
+
+// post sends body as JSON and decodes the response into out
+func (s *erasureService) post(ctx context.Context, url, token string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// retained lists the address's personal data that legal obligations keep
+func (s *erasureService) retained(address string, receipts *StoreErasure) ([]*RetainedRecord, error) {
+	retained := []*RetainedRecord{}
+	for _, record := range []struct {
+		store  string
+		query  string
+		args   []interface{}
+		reason string
+	}{
+		{"payments", `SELECT COUNT(*) FROM payments WHERE sender = ? OR recipient = ?`, []interface{}{address, address},
+			"addresses, amounts and transaction hashes are kept as financial records and are public on chain"},
+		{"kyc_verifications", `SELECT COUNT(*) FROM kyc_verifications WHERE address = ?`, []interface{}{address},
+			"identity verification is kept under anti-money laundering record keeping obligations"},
+		{"travel_rule_transfers", `SELECT COUNT(*) FROM travel_rule_transfers WHERE payment_id IN (SELECT id FROM payments WHERE sender = ? OR recipient = ?)`, []interface{}{address, address},
+			"travel rule data is kept under anti-money laundering record keeping obligations"},
+	} {
+		var count int64
+		if err := db.QueryRow(record.query, record.args...).Scan(&count); err != nil {
+			return nil, fmt.Errorf("failed to count retained %s: %w", record.store, err)
+		}
+		if count > 0 {
+			retained = append(retained, &RetainedRecord{Store: record.store, Records: count, Reason: record.reason})
+		}
+	}
+	if receipts != nil && receipts.Records["held"] > 0 {
+		retained = append(retained, &RetainedRecord{Store: "receipts", Records: receipts.Records["held"], Reason: "receipts under legal hold"})
+	}
+	return retained, nil
+}
+
+// track erases the requests whose grace period is over every pollInterval
+// until ctx is done. Failed erasures are retried on the next run.
+func (s *erasureService) track(ctx context.Context) {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.eraseDue(ctx)
+		}
+	}
+}
+
+func (s *erasureService) eraseDue(ctx context.Context) {
+	rows, err := db.Query(`SELECT id FROM erasure_requests WHERE status = ? AND erase_after <= ? ORDER BY erase_after`, ErasurePending, s.now().UTC())
+	if err != nil {
+		log.Printf("Failed to select due erasures: %v", err)
+		return
+	}
+	var due []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			due = append(due, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range due {
+		if err := s.erase(ctx, id); err != nil {
+			log.Printf("Failed to erase %s: %v", id, err)
+		}
+	}
+}
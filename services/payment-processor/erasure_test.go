@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// erasureStores records the calls an erasure made to the storage worker and
+// the analytics service
+type erasureStores struct {
+	receipts      []map[string]interface{}
+	analytics     []string
+	analyticsDown bool
+}
+
+// setupErasureTest returns an erasure service with a grace period of a day,
+// whose clock is at *now, and the stores it erases from
+func setupErasureTest(t *testing.T) (*erasureService, *time.Time, *erasureStores) {
+	setupTestDB(t)
+
+	stores := &erasureStores{}
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/receipts/erase", r.URL.Path)
+		assert.Equal(t, "Bearer storage-token", r.Header.Get("Authorization"))
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		stores.receipts = append(stores.receipts, body)
+		w.Write([]byte(`{"receipts": 2, "released": ["bafy1"], "held": ["bafy2"]}`))
+	}))
+	t.Cleanup(storage.Close)
+	analytics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/privacy/erase", r.URL.Path)
+		assert.Equal(t, "Bearer analytics-token", r.Header.Get("Authorization"))
+		if stores.analyticsDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		stores.analytics = append(stores.analytics, body["address"])
+		w.Write([]byte(`{"success": true, "data": {"pseudonym": "erased-0123456789abcdef", "points": {"raw": 3, "1d": 1}, "postgres_points": 0}}`))
+	}))
+	t.Cleanup(analytics.Close)
+
+	setGlobal(t, &storageServiceURL, storage.URL)
+
+	clock, now := fixedClock(time.Now().UTC().Truncate(time.Second))
+	service := &erasureService{
+		gracePeriod:    24 * time.Hour,
+		pollInterval:   time.Minute,
+		analyticsURL:   analytics.URL,
+		analyticsToken: "analytics-token",
+		storageToken:   func() (string, error) { return "storage-token", nil },
+		client:         http.DefaultClient,
+		now:            clock,
+	}
+	setGlobal(t, &erasures, service)
+	return service, now, stores
+}
+
+// signErasure signs action for key's address at now
+func signErasure(t *testing.T, key *ecdsa.PrivateKey, action string, now time.Time) *ErasureSignature {
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	sig, err := crypto.Sign(accounts.TextHash([]byte(erasureMessage(action, address, now.Unix()))), key)
+	require.NoError(t, err)
+	return &ErasureSignature{Address: address, RequestedAt: now.Unix(), Signature: hexutil.Encode(sig)}
+}
+
+// seedSubjectData stores payments and contacts of subject
+func seedSubjectData(t *testing.T, subject string) {
+	for i, payment := range []struct{ sender, senderENS, recipient, recipientENS string }{
+		{subject, "subject.eth", settlementMerchant, "shop.eth"},
+		{contactAlice, "alice.eth", subject, "subject.eth"},
+		{contactAlice, "alice.eth", settlementMerchant, "shop.eth"},
+	} {
+		_, err := db.Exec(`INSERT INTO payments (id, chain_id, sender, sender_ens, recipient, recipient_ens, token, amount, metadata) VALUES (?, 4202, ?, ?, ?, ?, ?, '1000', 'ipfs://memo')`,
+			i+1, payment.sender, payment.senderENS, payment.recipient, payment.recipientENS, nativeToken)
+		require.NoError(t, err)
+	}
+	for i, contact := range []struct{ owner, label, address, ensName string }{
+		{subject, "Alice", contactAlice, "alice.eth"},
+		{contactBob, "My friend", subject, "subject.eth"},
+	} {
+		_, err := db.Exec(`INSERT INTO contacts (id, owner, label, address, ens_name, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			i, contact.owner, contact.label, contact.address, contact.ensName, time.Now(), time.Now())
+		require.NoError(t, err)
+	}
+}
+
+func TestErasures(t *testing.T) {
+	t.Run("should soft-delete the address until its grace period is over", func(t *testing.T) {
+		service, now, stores := setupErasureTest(t)
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		subject := strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex())
+		seedSubjectData(t, subject)
+
+		request, err := service.request(context.Background(), signErasure(t, key, "erase", *now))
+		require.NoError(t, err)
+		assert.Equal(t, ErasurePending, request.Status)
+		assert.Equal(t, subject, request.Address)
+		assert.Equal(t, now.Add(24*time.Hour), request.EraseAfter)
+		assert.NoError(t, service.check("subject.eth"))
+		assert.ErrorIs(t, service.check(subject), errAddressErased)
+
+		w := httptest.NewRecorder()
+		handleGetUserContacts(w, httptest.NewRequest(http.MethodGet, "/api/contacts/user/"+subject, nil))
+		assert.Equal(t, http.StatusGone, w.Code)
+
+		_, err = service.request(context.Background(), signErasure(t, key, "erase", *now))
+		assert.ErrorIs(t, err, errErasurePending)
+
+		service.eraseDue(context.Background())
+		assert.Empty(t, stores.receipts)
+
+		*now = now.Add(25 * time.Hour)
+		service.eraseDue(context.Background())
+		request, err = service.get(request.ID)
+		require.NoError(t, err)
+		assert.Equal(t, ErasureCompleted, request.Status)
+		assert.Empty(t, request.Address)
+		assert.NoError(t, service.check(subject))
+
+		require.Len(t, stores.receipts, 1)
+		assert.Equal(t, subject, stores.receipts[0]["address"])
+		assert.Equal(t, []interface{}{1.0, 2.0}, stores.receipts[0]["payment_ids"])
+		assert.Equal(t, []string{subject}, stores.analytics)
+
+		certificate := request.Certificate
+		require.NotNil(t, certificate)
+		assert.Equal(t, subjectHash(subject), certificate.SubjectHash)
+		hash, err := certificate.digest()
+		require.NoError(t, err)
+		assert.Equal(t, hash, certificate.Hash)
+		require.Len(t, certificate.Erased, 3)
+		assert.Equal(t, int64(2), certificate.Erased[0].Records["payments"])
+		assert.Equal(t, int64(1), certificate.Erased[0].Records["contacts_owned"])
+		assert.Equal(t, int64(1), certificate.Erased[0].Records["contacts_of_others"])
+		assert.Equal(t, int64(3), certificate.Erased[2].Records["points_raw"])
+		require.Len(t, certificate.Retained, 2)
+		assert.Equal(t, "payments", certificate.Retained[0].Store)
+		assert.Equal(t, int64(2), certificate.Retained[0].Records)
+		assert.Equal(t, "receipts", certificate.Retained[1].Store)
+
+		// Names and memos of the subject's payments are gone, amounts stay
+		var senderENS, recipientENS, metadata sql.NullString
+		var amount string
+		require.NoError(t, db.QueryRow(`SELECT sender_ens, recipient_ens, metadata, amount FROM payments WHERE id = '1'`).Scan(&senderENS, &recipientENS, &metadata, &amount))
+		assert.False(t, senderENS.Valid)
+		assert.Equal(t, "shop.eth", recipientENS.String)
+		assert.False(t, metadata.Valid)
+		assert.Equal(t, "1000", amount)
+		require.NoError(t, db.QueryRow(`SELECT sender_ens, metadata FROM payments WHERE id = '3'`).Scan(&senderENS, &metadata))
+		assert.Equal(t, "alice.eth", senderENS.String)
+		assert.Equal(t, "ipfs://memo", metadata.String)
+
+		var label, ensName string
+		require.NoError(t, db.QueryRow(`SELECT label, ens_name FROM contacts WHERE owner = ?`, contactBob).Scan(&label, &ensName))
+		assert.Equal(t, erasedContactLabel, label)
+		assert.Empty(t, ensName)
+		var owned int
+		require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM contacts WHERE owner = ?`, subject).Scan(&owned))
+		assert.Zero(t, owned)
+	})
+
+	t.Run("should cancel a pending erasure signed by the address", func(t *testing.T) {
+		service, now, _ := setupErasureTest(t)
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		other, err := crypto.GenerateKey()
+		require.NoError(t, err)
+
+		request, err := service.request(context.Background(), signErasure(t, key, "erase", *now))
+		require.NoError(t, err)
+		_, err = service.cancel(context.Background(), request.ID, signErasure(t, other, "cancel", *now))
+		assert.ErrorIs(t, err, errErasureSignature)
+		_, err = service.cancel(context.Background(), request.ID, signErasure(t, key, "erase", *now))
+		assert.ErrorIs(t, err, errErasureSignature)
+
+		request, err = service.cancel(context.Background(), request.ID, signErasure(t, key, "cancel", *now))
+		require.NoError(t, err)
+		assert.Equal(t, ErasureCancelled, request.Status)
+		assert.NoError(t, service.check(crypto.PubkeyToAddress(key.PublicKey).Hex()))
+		_, err = service.cancel(context.Background(), request.ID, signErasure(t, key, "cancel", *now))
+		assert.ErrorIs(t, err, errErasureFinal)
+	})
+
+	t.Run("should reject stale or forged requests", func(t *testing.T) {
+		service, now, _ := setupErasureTest(t)
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+
+		_, err = service.request(context.Background(), signErasure(t, key, "erase", now.Add(-time.Hour)))
+		assert.ErrorIs(t, err, errInvalidErasure)
+
+		forged := signErasure(t, key, "erase", *now)
+		forged.Address = contactAlice
+		_, err = service.request(context.Background(), forged)
+		assert.ErrorIs(t, err, errErasureSignature)
+
+		malformed := signErasure(t, key, "erase", *now)
+		malformed.Signature = "signed"
+		_, err = service.request(context.Background(), malformed)
+		assert.ErrorIs(t, err, errInvalidErasure)
+	})
+
+	t.Run("should resume from the store that failed", func(t *testing.T) {
+		service, now, stores := setupErasureTest(t)
+		service.gracePeriod = 0
+		stores.analyticsDown = true
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+
+		request, err := service.request(context.Background(), signErasure(t, key, "erase", *now))
+		require.NoError(t, err)
+		assert.Equal(t, ErasurePending, request.Status)
+		assert.Contains(t, request.Reason, "analytics")
+		assert.Len(t, request.stores, 2)
+
+		stores.analyticsDown = false
+		service.eraseDue(context.Background())
+		request, err = service.get(request.ID)
+		require.NoError(t, err)
+		assert.Equal(t, ErasureCompleted, request.Status)
+		assert.Empty(t, request.Reason)
+		assert.Len(t, stores.receipts, 1)
+		assert.Len(t, stores.analytics, 1)
+	})
+
+	t.Run("should answer the erasure endpoints", func(t *testing.T) {
+		_, now, _ := setupErasureTest(t)
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+
+		body, err := json.Marshal(signErasure(t, key, "erase", *now))
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		handleCreateErasure(w, httptest.NewRequest(http.MethodPost, "/api/privacy/erasures", strings.NewReader(string(body))))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var request ErasureRequest
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&request))
+
+		w = httptest.NewRecorder()
+		handleCreateErasure(w, httptest.NewRequest(http.MethodPost, "/api/privacy/erasures", strings.NewReader(string(body))))
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = httptest.NewRecorder()
+		handleGetErasure(w, httptest.NewRequest(http.MethodGet, "/api/privacy/erasures/"+request.ID, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		body, err = json.Marshal(signErasure(t, key, "cancel", *now))
+		require.NoError(t, err)
+		w = httptest.NewRecorder()
+		handleCancelErasure(w, httptest.NewRequest(http.MethodPost, "/api/privacy/erasures/cancel/"+request.ID, strings.NewReader(string(body))))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		handleGetErasure(w, httptest.NewRequest(http.MethodGet, "/api/privacy/erasures/0x01", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payment and receipt events are appended to an event log as they happen.
+// Each event is numbered after the last one, so the log holds events in the
+// order they happened, and it is never rewritten. Integrators that missed a
+// webhook or were offline replay it with GET /api/events from the cursor of
+// the last event they handled, and keep the cursor of the page to poll for
+// newer events.
+
+// Event types
+const (
+	EventPaymentCreated   = "payment_created"
+	EventPaymentCompleted = "payment_completed"
+	EventPaymentRefunded  = "payment_refunded"
+	EventReceiptGenerated = "receipt_generated"
+)
+
+// EventTypes lists every event in the log
+var EventTypes = []string{
+	EventPaymentCreated,
+	EventPaymentCompleted,
+	EventPaymentRefunded,
+	EventReceiptGenerated,
+}
+
+const (
+	defaultEventPage = 100
+	maxEventPage     = 1000
+)
+
+var (
+	errInvalidCursor    = errors.New("invalid cursor")
+	errInvalidEventType = errors.New("invalid event type")
+)
+
+// events is the log of payment and receipt events, kept in the payments
+// database
+var events *eventLog
+
+type eventLog struct {
+	now func() time.Time
+}
+
+// Event is one entry of the event log. Cursor is its position in the log,
+// and Data what the event's payment or receipt was when it happened.
+type Event struct {
+	Cursor    string          `json:"cursor"`
+	Type      string          `json:"type"`
+	PaymentID string          `json:"payment_id"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// EventQuery selects the events after a cursor, optionally only those of
+// some types or in [From, To)
+type EventQuery struct {
+	Cursor string
+	Types  []string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// EventPage is a page of replayed events. Cursor is where the next page
+// starts: the last event on this page, or the query's cursor when it is
+// empty.
+type EventPage struct {
+	Events  []*Event `json:"events"`
+	Cursor  string   `json:"cursor"`
+	HasMore bool     `json:"has_more"`
+}
+
+// record appends an event about a payment to the log
+func (l *eventLog) record(eventType, paymentID string, data map[string]interface{}) (*Event, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	event := &Event{Type: eventType, PaymentID: paymentID, Data: encoded, CreatedAt: l.now().UTC()}
+
+	result, err := db.Exec(`INSERT INTO events (type, payment_id, data, created_at) VALUES (?, ?, ?, ?)`,
+		event.Type, event.PaymentID, string(event.Data), event.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record %s event: %w", eventType, err)
+	}
+	seq, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	event.Cursor = strconv.FormatInt(seq, 10)
+	return event, nil
+}
+
+// replay returns the events after the query's cursor, oldest first
+func (l *eventLog) replay(query EventQuery) (*EventPage, error) {
+	var after int64
+	if query.Cursor != "" {
+		var err error
+		if after, err = strconv.ParseInt(query.Cursor, 10, 64); err != nil || after < 0 {
+			return nil, errInvalidCursor
+		}
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultEventPage
+	}
+	if limit > maxEventPage {
+		limit = maxEventPage
+	}
+
+	where, args := []string{"seq > ?"}, []interface{}{after}
+	if len(query.Types) > 0 {
+		placeholders := make([]string, len(query.Types))
+		for i, eventType := range query.Types {
+			if !isEventType(eventType) {
+				return nil, fmt.Errorf("%w %q", errInvalidEventType, eventType)
+			}
+			placeholders[i] = "?"
+			args = append(args, eventType)
+		}
+		where = append(where, "type IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if !query.From.IsZero() {
+		where, args = append(where, "created_at >= ?"), append(args, query.From.UTC())
+	}
+	if !query.To.IsZero() {
+		where, args = append(where, "created_at < ?"), append(args, query.To.UTC())
+	}
+	args = append(args, limit+1)
+
+	rows, err := db.Query(`SELECT seq, type, payment_id, data, created_at FROM events WHERE `+
+		strings.Join(where, " AND ")+` ORDER BY seq LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &EventPage{Events: []*Event{}, Cursor: query.Cursor}
+	for rows.Next() {
+		var event Event
+		var seq int64
+		var data string
+		if err := rows.Scan(&seq, &event.Type, &event.PaymentID, &data, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		if len(page.Events) == limit {
+			page.HasMore = true
+			break
+		}
+		event.Cursor = strconv.FormatInt(seq, 10)
+		event.Data = json.RawMessage(data)
+		page.Events = append(page.Events, &event)
+		page.Cursor = event.Cursor
+	}
+	return page, rows.Err()
+}
+
+func isEventType(eventType string) bool {
+	for _, known := range EventTypes {
+		if eventType == known {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEventTime reads an RFC 3339 time or a date. A date as the end of a
+// range includes that whole day.
+func parseEventTime(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DD", value)
+	}
+	if end {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// recordEvent records an event, logging failures so they do not fail the
+// request the event is about
+func recordEvent(eventType, paymentID string, data map[string]interface{}) {
+	if events == nil {
+		return
+	}
+	if _, err := events.record(eventType, paymentID, data); err != nil {
+		log.Printf("Warning: Failed to record %s event of payment %s: %v", eventType, paymentID, err)
+	}
+}
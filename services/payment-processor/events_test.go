@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupEventLog returns an event log whose clock is at *now
+func setupEventLog(t *testing.T) (*eventLog, *time.Time) {
+	setupTestDB(t)
+
+	clock, now := fixedClock(time.Date(2026, 5, 4, 9, 0, 0, 0, time.UTC))
+	store := &eventLog{now: clock}
+	setGlobal(t, &events, store)
+	return store, now
+}
+
+func eventTypes(page *EventPage) []string {
+	types := make([]string, len(page.Events))
+	for i, event := range page.Events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+func TestEventLog(t *testing.T) {
+	t.Run("should replay events in order from a cursor", func(t *testing.T) {
+		store, _ := setupEventLog(t)
+		created, err := store.record(EventPaymentCreated, "1", map[string]interface{}{"amount": "100"})
+		require.NoError(t, err)
+		_, err = store.record(EventReceiptGenerated, "1", map[string]interface{}{"cid": "bafyreceipt"})
+		require.NoError(t, err)
+		_, err = store.record(EventPaymentCompleted, "1", nil)
+		require.NoError(t, err)
+
+		page, err := store.replay(EventQuery{Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []string{EventPaymentCreated, EventReceiptGenerated}, eventTypes(page))
+		assert.True(t, page.HasMore)
+		assert.Equal(t, created.Cursor, page.Events[0].Cursor)
+		assert.JSONEq(t, `{"amount": "100"}`, string(page.Events[0].Data))
+
+		page, err = store.replay(EventQuery{Cursor: page.Cursor, Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []string{EventPaymentCompleted}, eventTypes(page))
+		assert.False(t, page.HasMore)
+
+		// Polling past the last event keeps the cursor
+		last := page.Cursor
+		page, err = store.replay(EventQuery{Cursor: last})
+		require.NoError(t, err)
+		assert.Empty(t, page.Events)
+		assert.Equal(t, last, page.Cursor)
+	})
+
+	t.Run("should filter events by type and time", func(t *testing.T) {
+		store, now := setupEventLog(t)
+		_, err := store.record(EventPaymentCreated, "1", nil)
+		require.NoError(t, err)
+		*now = now.Add(24 * time.Hour)
+		_, err = store.record(EventPaymentCreated, "2", nil)
+		require.NoError(t, err)
+		_, err = store.record(EventPaymentRefunded, "1", nil)
+		require.NoError(t, err)
+
+		page, err := store.replay(EventQuery{Types: []string{EventPaymentCreated}})
+		require.NoError(t, err)
+		assert.Len(t, page.Events, 2)
+
+		from, err := parseEventTime("2026-05-05", false)
+		require.NoError(t, err)
+		page, err = store.replay(EventQuery{From: from})
+		require.NoError(t, err)
+		assert.Equal(t, []string{EventPaymentCreated, EventPaymentRefunded}, eventTypes(page))
+		assert.Equal(t, "2", page.Events[0].PaymentID)
+
+		to, err := parseEventTime("2026-05-04", true)
+		require.NoError(t, err)
+		page, err = store.replay(EventQuery{To: to})
+		require.NoError(t, err)
+		assert.Len(t, page.Events, 1)
+		assert.Equal(t, "1", page.Events[0].PaymentID)
+	})
+
+	t.Run("should reject unknown cursors and types", func(t *testing.T) {
+		store, _ := setupEventLog(t)
+		_, err := store.replay(EventQuery{Cursor: "abc"})
+		assert.ErrorIs(t, err, errInvalidCursor)
+		_, err = store.replay(EventQuery{Types: []string{"payment_exploded"}})
+		assert.ErrorIs(t, err, errInvalidEventType)
+	})
+}
+
+func TestHandleListEvents(t *testing.T) {
+	t.Run("should record payments and replay them", func(t *testing.T) {
+		setupEventLog(t)
+		w := httptest.NewRecorder()
+		handleCompletePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/complete/7", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		w = httptest.NewRecorder()
+		handleRefundPayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/refund/7", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = httptest.NewRecorder()
+		handleListEvents(w, httptest.NewRequest(http.MethodGet, "/api/events?type=payment_refunded&from=2026-05-04T00:00:00Z", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var page EventPage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		require.Len(t, page.Events, 1)
+		assert.Equal(t, "7", page.Events[0].PaymentID)
+		assert.Equal(t, "2", page.Cursor)
+
+		var data map[string]interface{}
+		require.NoError(t, json.Unmarshal(page.Events[0].Data, &data))
+		assert.Equal(t, "refunded", data["status"])
+	})
+
+	t.Run("should answer 400 for invalid queries", func(t *testing.T) {
+		setupEventLog(t)
+		for _, query := range []string{"cursor=-1", "type=payment_created,unknown", "from=yesterday"} {
+			w := httptest.NewRecorder()
+			handleListEvents(w, httptest.NewRequest(http.MethodGet, "/api/events?"+query, nil))
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+	})
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Gas the paymaster sponsors is charged to the merchant the operation pays,
+// the recipient of its first createPayment call, per UTC day. Sending an
+// operation reserves its maximum gas cost, which its actual cost replaces
+// once it is included; a dropped operation costs nothing. A merchant whose
+// budget cannot cover an operation gets it built unsponsored, and a sponsored
+// operation over budget is refused. Every change in a merchant's spend is
+// reported to the analytics service, whose alerting engine alerts when 80%
+// and all of a budget is used.
+
+var errGasBudgetExceeded = errors.New("merchant has used its gas sponsorship budget for today")
+
+// gasBudgets is nil when sponsored payments have no paymaster
+var gasBudgets *gasBudgetService
+
+// gasBudgetService tracks sponsored gas spend. Merchants without a budget in
+// budgets have defaultBudget, and no limit when that is nil.
+type gasBudgetService struct {
+	chainID        int64
+	defaultBudget  *big.Int
+	budgets        map[string]*big.Int
+	alertPercent   float64
+	analyticsURL   string
+	client         *http.Client
+	reportInterval time.Duration
+	now            func() time.Time
+}
+
+// GasBudgetUsage is a merchant's sponsored gas spend on one UTC day. Spent
+// includes what pending operations have reserved. Budget and Remaining are
+// empty for merchants without a limit.
+type GasBudgetUsage struct {
+	Merchant    string  `json:"merchant"`
+	Day         string  `json:"day"`
+	Budget      string  `json:"budget,omitempty"`
+	Spent       string  `json:"spent"`
+	Reserved    string  `json:"reserved"`
+	Remaining   string  `json:"remaining,omitempty"`
+	UsedPercent float64 `json:"used_pct"`
+	Operations  int     `json:"operations"`
+	Alert       bool    `json:"alert"`
+}
+
+// gasBudgetMetric is the body the analytics service accepts on
+// POST /api/metrics/gas-budget
+type gasBudgetMetric struct {
+	Merchant  string    `json:"merchant"`
+	ChainID   int64     `json:"chain_id"`
+	Day       string    `json:"day"`
+	Spent     string    `json:"spent"`
+	Budget    string    `json:"budget,omitempty"`
+	UsedPct   float64   `json:"used_pct"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// loadGasBudgets reads the GAS_BUDGETS_PATH file, an object of merchant
+// addresses to daily budgets in wei
+func loadGasBudgets(path string) (map[string]*big.Int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid gas budgets: %w", err)
+	}
+	budgets := make(map[string]*big.Int, len(entries))
+	for merchant, value := range entries {
+		budget, ok := new(big.Int).SetString(value, 10)
+		if !common.IsHexAddress(merchant) || !ok || budget.Sign() < 0 {
+			return nil, fmt.Errorf("invalid gas budget %q for merchant %q", value, merchant)
+		}
+		budgets[strings.ToLower(merchant)] = budget
+	}
+	return budgets, nil
+}
+
+// sponsoredMerchant returns the recipient of the first createPayment call an
+// account's execute or executeBatch call data makes to paymentCore
+func sponsoredMerchant(paymentCore common.Address, callData []byte) (string, bool) {
+	if len(callData) < 4 {
+		return "", false
+	}
+	method, err := accountABI.MethodById(callData[:4])
+	if err != nil {
+		return "", false
+	}
+	args, err := method.Inputs.Unpack(callData[4:])
+	if err != nil {
+		return "", false
+	}
+
+	var targets []common.Address
+	var calls [][]byte
+	switch method.Name {
+	case "execute":
+		targets, calls = []common.Address{args[0].(common.Address)}, [][]byte{args[2].([]byte)}
+	case "executeBatch":
+		targets, calls = args[0].([]common.Address), args[2].([][]byte)
+	}
+	create := paymentCoreABI.Methods["createPayment"]
+	for i, target := range targets {
+		if target != paymentCore || i >= len(calls) || !bytes.HasPrefix(calls[i], create.ID) {
+			continue
+		}
+		values, err := create.Inputs.Unpack(calls[i][4:])
+		if err != nil {
+			return "", false
+		}
+		return strings.ToLower(values[0].(common.Address).Hex()), true
+	}
+	return "", false
+}
+
+// maxGasCost is the most an operation can cost: all of its gas limits at its
+// maximum fee
+func maxGasCost(op *UserOperation) *big.Int {
+	gas := new(big.Int)
+	for _, limit := range []*big.Int{
+		bigOrZero(op.PreVerificationGas), bigOrZero(op.VerificationGasLimit), bigOrZero(op.CallGasLimit),
+		bigOrZero(op.PaymasterVerificationGasLimit), bigOrZero(op.PaymasterPostOpGasLimit),
+	} {
+		gas.Add(gas, limit)
+	}
+	return gas.Mul(gas, bigOrZero(op.MaxFeePerGas))
+}
+
+// budget is merchant's daily budget, or nil without a limit
+func (s *gasBudgetService) budget(merchant string) *big.Int {
+	if budget, ok := s.budgets[strings.ToLower(merchant)]; ok {
+		return budget
+	}
+	return s.defaultBudget
+}
+
+// gasBudgetDay is the UTC day t falls on
+func gasBudgetDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// allows reports whether merchant's budget for today covers another cost
+func (s *gasBudgetService) allows(merchant string, cost *big.Int) (bool, error) {
+	budget := s.budget(merchant)
+	if budget == nil {
+		return true, nil
+	}
+	usage, err := s.usage(merchant, gasBudgetDay(s.now()))
+	if err != nil {
+		return false, err
+	}
+	spent, _ := new(big.Int).SetString(usage.Spent, 10)
+	return spent.Add(spent, cost).Cmp(budget) <= 0, nil
+}
+
+// reserve charges an operation's maximum cost to merchant until it settles
+func (s *gasBudgetService) reserve(ctx context.Context, hash, merchant string, cost *big.Int) error {
+	now := s.now().UTC()
+	_, err := db.Exec(`INSERT INTO gas_sponsorships (user_op_hash, chain_id, merchant, day, reserved, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		hash, s.chainID, strings.ToLower(merchant), gasBudgetDay(now), cost.String(), now)
+	if err != nil {
+		return fmt.Errorf("failed to reserve gas for %s: %w", hash, err)
+	}
+	s.publish(ctx, merchant)
+	return nil
+}
+
+// settle replaces the reservation of an operation that is no longer pending
+// with what it cost
+func (s *gasBudgetService) settle(ctx context.Context, record *UserOpRecord) error {
+	if record.Status == UserOpPending {
+		return nil
+	}
+	spent := record.ActualGasCost
+	if spent == "" {
+		spent = "0"
+	}
+
+	var merchant string
+	err := db.QueryRow(`SELECT merchant FROM gas_sponsorships WHERE user_op_hash = ? AND spent IS NULL`, record.Hash).Scan(&merchant)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load gas reservation of %s: %w", record.Hash, err)
+	}
+	if _, err := db.Exec(`UPDATE gas_sponsorships SET spent = ? WHERE user_op_hash = ?`, spent, record.Hash); err != nil {
+		return fmt.Errorf("failed to settle gas of %s: %w", record.Hash, err)
+	}
+	s.publish(ctx, merchant)
+	return nil
+}
+
+// usage adds up merchant's sponsored operations on day
+func (s *gasBudgetService) usage(merchant, day string) (*GasBudgetUsage, error) {
+	merchant = strings.ToLower(merchant)
+	rows, err := db.Query(`SELECT reserved, spent FROM gas_sponsorships WHERE merchant = ? AND day = ?`, merchant, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := &GasBudgetUsage{Merchant: merchant, Day: day}
+	spent, reserved := new(big.Int), new(big.Int)
+	for rows.Next() {
+		var reservedCost string
+		var spentCost sql.NullString
+		if err := rows.Scan(&reservedCost, &spentCost); err != nil {
+			return nil, err
+		}
+		usage.Operations++
+		if spentCost.Valid {
+			cost, _ := new(big.Int).SetString(spentCost.String, 10)
+			spent.Add(spent, cost)
+			continue
+		}
+		cost, _ := new(big.Int).SetString(reservedCost, 10)
+		reserved.Add(reserved, cost)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	spent.Add(spent, reserved)
+	usage.Spent, usage.Reserved = spent.String(), reserved.String()
+	if budget := s.budget(merchant); budget != nil {
+		usage.Budget = budget.String()
+		remaining := new(big.Int).Sub(budget, spent)
+		if remaining.Sign() < 0 {
+			remaining.SetInt64(0)
+		}
+		usage.Remaining = remaining.String()
+		if budget.Sign() > 0 {
+			usage.UsedPercent, _ = new(big.Float).Quo(new(big.Float).SetInt(spent), new(big.Float).SetInt(budget)).Float64()
+			usage.UsedPercent *= 100
+		} else if spent.Sign() > 0 {
+			usage.UsedPercent = 100
+		}
+		usage.Alert = usage.UsedPercent >= s.alertPercent
+	}
+	return usage, nil
+}
+
+// merchants returns the merchants with a budget of their own or spend on day
+func (s *gasBudgetService) merchants(day string) ([]string, error) {
+	seen := make(map[string]bool)
+	for merchant := range s.budgets {
+		seen[merchant] = true
+	}
+	rows, err := db.Query(`SELECT DISTINCT merchant FROM gas_sponsorships WHERE day = ?`, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var merchant string
+		if err := rows.Scan(&merchant); err != nil {
+			return nil, err
+		}
+		seen[merchant] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	merchants := make([]string, 0, len(seen))
+	for merchant := range seen {
+		merchants = append(merchants, merchant)
+	}
+	sort.Strings(merchants)
+	return merchants, nil
+}
+
+// publish reports merchant's spend today to the analytics service. Failures
+// are logged; the next change or report interval sends it again.
+func (s *gasBudgetService) publish(ctx context.Context, merchant string) {
+	usage, err := s.usage(merchant, gasBudgetDay(s.now()))
+	if err != nil {
+		log.Printf("Failed to read gas budget of %s: %v", merchant, err)
+		return
+	}
+	if usage.Alert {
+		log.Printf("Warning: merchant %s has used %.1f%% of its gas sponsorship budget for %s", usage.Merchant, usage.UsedPercent, usage.Day)
+	}
+	if s.analyticsURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(gasBudgetMetric{
+		Merchant:  usage.Merchant,
+		ChainID:   s.chainID,
+		Day:       usage.Day,
+		Spent:     usage.Spent,
+		Budget:    usage.Budget,
+		UsedPct:   usage.UsedPercent,
+		Timestamp: s.now().UTC(),
+	})
+	if err != nil {
+		log.Printf("Failed to encode gas budget of %s: %v", merchant, err)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.analyticsURL+"/api/metrics/gas-budget", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to report gas budget of %s: %v", merchant, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("Failed to report gas budget of %s: %v", merchant, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to report gas budget of %s: analytics service returned status %d", merchant, resp.StatusCode)
+	}
+}
+
+// track reports every merchant's spend every reportInterval until ctx is
+// done, so a new day's reports clear the previous day's alerts
+func (s *gasBudgetService) track(ctx context.Context) {
+	ticker := time.NewTicker(s.reportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			merchants, err := s.merchants(gasBudgetDay(s.now()))
+			if err != nil {
+				log.Printf("Failed to load gas budgets: %v", err)
+				continue
+			}
+			for _, merchant := range merchants {
+				s.publish(ctx, merchant)
+			}
+		}
+	}
+}
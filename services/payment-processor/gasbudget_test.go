@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sponsoredGasCost is the maximum cost of a sponsored operation built by
+// setupUserOpTest: 380000 gas at 22 wei
+const sponsoredGasCost = 8360000
+
+// setupGasBudgetTest tracks the sponsored gas of service's operations with a
+// daily budget of budget wei
+func setupGasBudgetTest(t *testing.T, budget int64) *gasBudgetService {
+	clock, _ := fixedClock(testNow)
+	setGlobal(t, &gasBudgets, &gasBudgetService{
+		chainID:       4202,
+		defaultBudget: big.NewInt(budget),
+		budgets:       map[string]*big.Int{},
+		alertPercent:  80,
+		client:        http.DefaultClient,
+		now:           clock,
+	})
+	return gasBudgets
+}
+
+func TestSponsoredMerchant(t *testing.T) {
+	core := common.HexToAddress("0x00000000000000000000000000000000000000c0")
+
+	t.Run("should find the recipient of the payment", func(t *testing.T) {
+		request := sponsoredRequest()
+		request.Recipient = "0x00000000000000000000000000000000000000B2"
+		data, err := paymentCallData(core, request, big.NewInt(1000000))
+		require.NoError(t, err)
+		merchant, ok := sponsoredMerchant(core, data)
+		assert.True(t, ok)
+		assert.Equal(t, sponsoredRequest().Recipient, merchant)
+
+		request.Token = "0x00000000000000000000000000000000000000d4"
+		data, err = paymentCallData(core, request, big.NewInt(1000000))
+		require.NoError(t, err)
+		merchant, ok = sponsoredMerchant(core, data)
+		assert.True(t, ok)
+		assert.Equal(t, sponsoredRequest().Recipient, merchant)
+	})
+
+	t.Run("should ignore calls that create no payment", func(t *testing.T) {
+		data, err := paymentCallData(core, sponsoredRequest(), big.NewInt(1000000))
+		require.NoError(t, err)
+		_, ok := sponsoredMerchant(common.HexToAddress("0x00000000000000000000000000000000000000c1"), data)
+		assert.False(t, ok)
+		_, ok = sponsoredMerchant(core, []byte{1, 2})
+		assert.False(t, ok)
+	})
+}
+
+func TestLoadGasBudgets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budgets.json")
+
+	t.Run("should read budgets by merchant", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte(`{"0x00000000000000000000000000000000000000B2": "5000"}`), 0o600))
+		budgets, err := loadGasBudgets(path)
+		require.NoError(t, err)
+		assert.Equal(t, big.NewInt(5000), budgets[sponsoredRequest().Recipient])
+	})
+
+	t.Run("should reject invalid budgets", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte(`{"merchant.eth": "5000"}`), 0o600))
+		_, err := loadGasBudgets(path)
+		assert.Error(t, err)
+		require.NoError(t, os.WriteFile(path, []byte(`{"0x00000000000000000000000000000000000000b2": "-1"}`), 0o600))
+		_, err = loadGasBudgets(path)
+		assert.Error(t, err)
+	})
+}
+
+func TestGasBudgets(t *testing.T) {
+	merchant := sponsoredRequest().Recipient
+
+	t.Run("should reserve the maximum cost until the operation is included", func(t *testing.T) {
+		service, _, bundler, _ := setupUserOpTest(t)
+		budgets := setupGasBudgetTest(t, 10000000)
+
+		built, err := service.build(context.Background(), sponsoredRequest(), big.NewInt(1000000))
+		require.NoError(t, err)
+		require.True(t, built.Sponsored)
+		built.UserOperation.Signature = []byte{1}
+		record, err := service.send(context.Background(), built.UserOperation)
+		require.NoError(t, err)
+
+		usage, err := budgets.usage(merchant, "2026-03-01")
+		require.NoError(t, err)
+		assert.Equal(t, "8360000", usage.Spent)
+		assert.Equal(t, "8360000", usage.Reserved)
+		assert.Equal(t, "1640000", usage.Remaining)
+		assert.InDelta(t, 83.6, usage.UsedPercent, 0.001)
+		assert.True(t, usage.Alert)
+		assert.Equal(t, 1, usage.Operations)
+
+		bundler.handlers["eth_getUserOperationReceipt"] = func(args []interface{}) (interface{}, error) {
+			return map[string]interface{}{
+				"success":       true,
+				"actualGasCost": "0x5208",
+				"logs":          []map[string]interface{}{},
+				"receipt":       map[string]interface{}{"transactionHash": common.HexToHash("0xfeed"), "blockNumber": "0x10"},
+			}, nil
+		}
+		require.NoError(t, service.refresh(context.Background(), record))
+
+		usage, err = budgets.usage(merchant, "2026-03-01")
+		require.NoError(t, err)
+		assert.Equal(t, "21000", usage.Spent)
+		assert.Equal(t, "0", usage.Reserved)
+		assert.False(t, usage.Alert)
+
+		usage, err = budgets.usage(merchant, "2026-03-02")
+		require.NoError(t, err)
+		assert.Equal(t, "0", usage.Spent)
+		assert.Equal(t, 0, usage.Operations)
+	})
+
+	t.Run("should stop sponsoring a merchant over budget", func(t *testing.T) {
+		service, _, _, _ := setupUserOpTest(t)
+		budgets := setupGasBudgetTest(t, sponsoredGasCost-1)
+
+		built, err := service.build(context.Background(), sponsoredRequest(), big.NewInt(1000000))
+		require.NoError(t, err)
+		assert.False(t, built.Sponsored)
+		assert.Nil(t, built.UserOperation.Paymaster)
+		assert.Nil(t, built.UserOperation.PaymasterVerificationGasLimit)
+
+		// A merchant with a budget of its own is sponsored again
+		budgets.budgets[merchant] = big.NewInt(sponsoredGasCost)
+		built, err = service.build(context.Background(), sponsoredRequest(), big.NewInt(1000000))
+		require.NoError(t, err)
+		assert.True(t, built.Sponsored)
+
+		delete(budgets.budgets, merchant)
+		built.UserOperation.Signature = []byte{1}
+		_, err = service.send(context.Background(), built.UserOperation)
+		assert.ErrorIs(t, err, errGasBudgetExceeded)
+	})
+
+	t.Run("should report spend to the analytics service", func(t *testing.T) {
+		var metrics []gasBudgetMetric
+		analytics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/api/metrics/gas-budget", r.URL.Path)
+			var metric gasBudgetMetric
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&metric))
+			metrics = append(metrics, metric)
+		}))
+		defer analytics.Close()
+
+		setupUserOpTest(t)
+		budgets := setupGasBudgetTest(t, 1000)
+		budgets.analyticsURL = analytics.URL
+		require.NoError(t, budgets.reserve(context.Background(), "0x01", merchant, big.NewInt(900)))
+
+		require.Len(t, metrics, 1)
+		assert.Equal(t, merchant, metrics[0].Merchant)
+		assert.Equal(t, int64(4202), metrics[0].ChainID)
+		assert.Equal(t, "2026-03-01", metrics[0].Day)
+		assert.Equal(t, "900", metrics[0].Spent)
+		assert.Equal(t, "1000", metrics[0].Budget)
+		assert.InDelta(t, 90.0, metrics[0].UsedPct, 0.001)
+	})
+}
+
+func TestGetGasBudget(t *testing.T) {
+	merchant := sponsoredRequest().Recipient
+
+	t.Run("should need a paymaster", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleGetGasBudget(w, httptest.NewRequest(http.MethodGet, "/api/gas/budget", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("should list every merchant's spend for the day", func(t *testing.T) {
+		setupUserOpTest(t)
+		budgets := setupGasBudgetTest(t, 1000)
+		other := "0x00000000000000000000000000000000000000b3"
+		budgets.budgets[other] = big.NewInt(5000)
+		require.NoError(t, budgets.reserve(context.Background(), "0x01", merchant, big.NewInt(250)))
+
+		w := httptest.NewRecorder()
+		handleGetGasBudget(w, httptest.NewRequest(http.MethodGet, "/api/gas/budget", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response struct {
+			Day       string            `json:"day"`
+			Merchants []*GasBudgetUsage `json:"merchants"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, "2026-03-01", response.Day)
+		require.Len(t, response.Merchants, 2)
+		assert.Equal(t, "750", response.Merchants[0].Remaining)
+		assert.Equal(t, "5000", response.Merchants[1].Budget)
+
+		w = httptest.NewRecorder()
+		handleGetGasBudget(w, httptest.NewRequest(http.MethodGet, "/api/gas/budget?merchant="+merchant+"&day=2026-02-28", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Len(t, response.Merchants, 1)
+		assert.Equal(t, "0", response.Merchants[0].Spent)
+
+		w = httptest.NewRecorder()
+		handleGetGasBudget(w, httptest.NewRequest(http.MethodGet, "/api/gas/budget?day=yesterday", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = httptest.NewRecorder()
+		handleGetGasBudget(w, httptest.NewRequest(http.MethodGet, "/api/gas/budget?merchant=shop.eth", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
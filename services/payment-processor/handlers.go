@@ -2,14 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/ethereum/go-ethereum/common"
 )
 
 // Service clients (would be properly initialized with HTTP clients)
@@ -29,12 +36,19 @@ func handleCreatePayment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var request struct {
+		Sender       string `json:"sender"`
 		Recipient    string `json:"recipient"`
 		Token        string `json:"token"`
 		Amount       string `json:"amount"`
 		MetadataURI  string `json:"metadata_uri"`
 		SenderENS    string `json:"sender_ens"`
 		RecipientENS string `json:"recipient_ens"`
+		// TravelRule is required for payments at or above the travel rule
+		// threshold
+		TravelRule *TravelRuleInfo `json:"travel_rule"`
+		// Quote is a token from /api/payments/quote-lock that holds the
+		// payment to the rate it locked
+		Quote string `json:"quote"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -44,62 +58,185 @@ func handleCreatePayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if request.Recipient == "" || request.Token == "" || request.Amount == "" {
+	if (request.Recipient == "" && request.RecipientENS == "") || request.Token == "" || request.Amount == "" {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Missing required fields"})
 		return
 	}
 
-	// Resolve ENS names if provided
-	if request.SenderENS != "" {
-		resolvedSender, err := resolveENSName(request.SenderENS)
+	// Resolve ENS names and screen the parties first, so every check sees
+	// the addresses paid
+	sender, err := resolveParty(r.Context(), "sender", request.Sender, request.SenderENS)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	recipient, err := resolveParty(r.Context(), "recipient", request.Recipient, request.RecipientENS)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	native := common.IsHexAddress(request.Token) && common.HexToAddress(request.Token) == (common.Address{})
+	if err := addresses.screen(r.Context(), tokens.chainID, "sender", &sender, native); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	if err := addresses.screen(r.Context(), tokens.chainID, "recipient", &recipient, native); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	request.Sender, request.SenderENS = sender.Address, sender.ENSName
+	request.Recipient, request.RecipientENS = recipient.Address, recipient.ENSName
+
+	// Check the token against the registry
+	token, err := tokens.check(r.Context(), tokens.chainID, request.Token)
+	if err != nil {
+		writeTokenError(w, err, token)
+		return
+	}
+
+	// Check the sender's KYC against the payment's value
+	kycRequirement, err := kyc.check(r.Context(), tokens.chainID, request.Sender, request.Token, request.Amount)
+	if err != nil {
+		writeKYCError(w, err, kycRequirement)
+		return
+	}
+
+	// Validate the metadata document against its schema
+	metadata, err := paymentMetadata.validate(r.Context(), request.MetadataURI)
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+
+	// Check the originator and beneficiary information the travel rule
+	// requires, which is sent once the payment exists
+	travelRuleCheck, err := travelRule.check(r.Context(), tokens.chainID, request.Token, request.Amount, request.TravelRule)
+	if err != nil {
+		writeTravelRuleError(w, err)
+		return
+	}
+
+	// Check the payment against the sender's and recipient's limits, which
+	// reserves its value until it is created
+	limitEvaluation, err := limits.check(r.Context(), "payment", tokens.chainID, request.Sender, request.Token,
+		limitLeg{Recipient: request.Recipient, Amount: request.Amount})
+	if err != nil {
+		writeLimitError(w, err, limitEvaluation)
+		return
+	}
+
+	// Claim the locked quote, which fails once it expired or was altered
+	var quote *Quote
+	if request.Quote != "" {
+		quote, err = quotes.redeem(request.Quote, tokens.chainID, request.Sender, request.Recipient, request.Token, request.Amount)
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Failed to resolve sender ENS: %v", err)})
+			limits.release(limitEvaluation)
+			writeQuoteError(w, err)
 			return
 		}
-		log.Printf("Resolved sender ENS %s to %s", request.SenderENS, resolvedSender)
 	}
 
-	if request.RecipientENS != "" {
-		resolvedRecipient, err := resolveENSName(request.RecipientENS)
+	// Get current price from oracle, unless a quote locked it
+	var oraclePrice string
+	if quote != nil {
+		oraclePrice = strconv.FormatFloat(quote.Rate, 'f', -1, 64)
+	} else if oraclePrice, err = getOraclePrice(r.Context(), "ETH/USD"); err != nil {
+		log.Printf("Warning: Failed to get oracle price: %v", err)
+		oraclePrice = "0"
+	}
+
+	// Mock payment creation (would interact with blockchain), or a real one
+	// on the sandbox chain
+	paymentID := time.Now().Unix()
+	txHash := fmt.Sprintf("0x%x", paymentID) // Mock tx hash
+	if sandboxChain != nil {
+		paymentID, txHash, err = sandboxCreatePayment(request.Sender, request.Recipient, request.Token, request.Amount,
+			request.MetadataURI, request.SenderENS, request.RecipientENS)
 		if err != nil {
+			if quote != nil {
+				if err := quotes.release(quote.ID); err != nil {
+					log.Printf("Warning: Failed to release quote %s: %v", quote.ID, err)
+				}
+			}
+			limits.release(limitEvaluation)
+			status := http.StatusBadRequest
+			if isRevert(err) {
+				status = http.StatusConflict
+			}
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Failed to resolve recipient ENS: %v", err)})
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Failed to create payment: %v", err)})
 			return
 		}
-		if resolvedRecipient != request.Recipient {
-			log.Printf("Warning: Recipient address %s doesn't match resolved ENS %s -> %s", 
-				request.Recipient, request.RecipientENS, resolvedRecipient)
+	}
+	if quote != nil {
+		if err := quotes.attach(quote.ID, paymentID); err != nil {
+			log.Printf("Warning: Failed to record payment of quote %s: %v", quote.ID, err)
 		}
 	}
+	if err := limits.record(limitEvaluation, strconv.FormatInt(paymentID, 10)); err != nil {
+		log.Printf("Warning: Failed to record limits of payment %d: %v", paymentID, err)
+	}
 
-	// Get current price from oracle
-	oraclePrice, err := getOraclePrice("ETH/USD")
+	// Send originator and beneficiary information to the beneficiary's VASP.
+	// The payment exists by now, so a failed transfer is recorded rather
+	// than failing the request.
+	travelRuleTransfer, err := travelRule.send(context.WithoutCancel(r.Context()), travelRuleCheck, strconv.FormatInt(paymentID, 10),
+		request.Sender, request.Recipient)
 	if err != nil {
-		log.Printf("Warning: Failed to get oracle price: %v", err)
-		oraclePrice = "0"
+		log.Printf("Warning: Failed to send travel rule information of payment %d: %v", paymentID, err)
 	}
-
-	// Mock payment creation (would interact with blockchain)
-	paymentID := time.Now().Unix()
 	
-	// Generate receipt automatically
-	receiptCID, err := generatePaymentReceipt(paymentID, request)
+	// Generate receipt automatically. The payment exists by now, so its
+	// receipt is generated even when the client has gone.
+	receiptCID, err := generatePaymentReceipt(context.WithoutCancel(r.Context()), paymentID, tokens.chainID, sender, recipient, request.Token, request.Amount,
+		txHash, request.MetadataURI, oraclePrice)
 	if err != nil {
 		log.Printf("Warning: Failed to generate receipt: %v", err)
 	}
 
+	// Record the payment and its receipt for integrators replaying events
+	eventPaymentID := strconv.FormatInt(paymentID, 10)
+	recordEvent(EventPaymentCreated, eventPaymentID, map[string]interface{}{
+		"payment_id":   paymentID,
+		"chain_id":     tokens.chainID,
+		"sender":        request.Sender,
+		"sender_ens":    request.SenderENS,
+		"recipient":     request.Recipient,
+		"recipient_ens": request.RecipientENS,
+		"token":         request.Token,
+		"amount":        request.Amount,
+		"metadata_uri":  request.MetadataURI,
+		"tx_hash":       txHash,
+		"status":        "pending",
+	})
+	if receiptCID != "" {
+		recordEvent(EventReceiptGenerated, eventPaymentID, map[string]interface{}{
+			"payment_id": paymentID,
+			"cid":        receiptCID,
+			"format":     "json",
+			"language":   "en",
+		})
+	}
+
 	response := map[string]interface{}{
 		"payment_id":     paymentID,
 		"status":         "pending",
+		"sender":         sender,
+		"recipient":      recipient,
 		"oracle_price":   oraclePrice,
 		"receipt_cid":    receiptCID,
 		"created_at":     time.Now().Unix(),
-		"tx_hash":        fmt.Sprintf("0x%x", paymentID), // Mock tx hash
+		"tx_hash":        txHash,
+		"token":          token,
+		"kyc":            kycRequirement,
+		"limits":         limitEvaluation,
+		"travel_rule":    travelRuleTransfer,
+		"quote":          quote,
+		"metadata":       metadata,
+		"chain_warning":  chainMonitor.warning(tokens.chainID, token),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -107,6 +244,152 @@ func handleCreatePayment(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+func handleLockQuote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	var request QuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	// Check the token against the registry
+	token, err := tokens.check(r.Context(), tokens.chainID, request.Token)
+	if err != nil {
+		writeTokenError(w, err, token)
+		return
+	}
+
+	quote, quoteToken, err := quotes.lock(r.Context(), tokens.chainID, &request)
+	if err != nil {
+		writeQuoteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"quote":       quote,
+		"quote_token": quoteToken,
+	})
+}
+
+func writeQuoteError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, problem.CodeInternal
+	switch {
+	case errors.Is(err, errInvalidQuote):
+		status, code = http.StatusBadRequest, problem.CodeInvalidQuote
+	case errors.Is(err, errQuoteMismatch):
+		status, code = http.StatusBadRequest, problem.CodeQuoteMismatch
+	case errors.Is(err, errQuoteExpired):
+		status, code = http.StatusGone, problem.CodeQuoteExpired
+	case errors.Is(err, errQuoteUsed):
+		status, code = http.StatusConflict, problem.CodeQuoteUsed
+	case errors.Is(err, errQuoteUnpriced):
+		status, code = http.StatusBadGateway, problem.CodeQuoteUnpriced
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+}
+
+func handleSimulatePayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if simulator == nil {
+		writeSimulationError(w, errSimulationUnavailable)
+		return
+	}
+
+	var request struct {
+		Sender       string `json:"sender"`
+		Recipient    string `json:"recipient"`
+		Token        string `json:"token"`
+		Amount       string `json:"amount"`
+		MetadataURI  string `json:"metadata_uri"`
+		SenderENS    string `json:"sender_ens"`
+		RecipientENS string `json:"recipient_ens"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	if (request.Sender == "" && request.SenderENS == "") || (request.Recipient == "" && request.RecipientENS == "") ||
+		request.Token == "" || request.Amount == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Missing required fields"})
+		return
+	}
+	// A zero amount is simulated, so the payment core's refusal is reported
+	amount, ok := new(big.Int).SetString(request.Amount, 10)
+	if !ok || amount.Sign() < 0 || !common.IsHexAddress(request.Token) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid token or amount"})
+		return
+	}
+
+	// Resolve and screen the parties as creating the payment would
+	sender, err := resolveParty(r.Context(), "sender", request.Sender, request.SenderENS)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	recipient, err := resolveParty(r.Context(), "recipient", request.Recipient, request.RecipientENS)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	token := common.HexToAddress(request.Token)
+	native := token == (common.Address{})
+	if err := addresses.screen(r.Context(), simulator.chainID, "sender", &sender, native); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	if err := addresses.screen(r.Context(), simulator.chainID, "recipient", &recipient, native); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	simulation, err := simulator.simulate(r.Context(), sender, recipient, token, amount, request.MetadataURI)
+	if err != nil {
+		writeSimulationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(simulation)
+}
+
+// writeSimulationError answers 503 when simulation is not configured and 502
+// when the chain cannot be reached
+func writeSimulationError(w http.ResponseWriter, err error) {
+	status, code := http.StatusBadGateway, problem.CodeUpstreamFailed
+	if errors.Is(err, errSimulationUnavailable) {
+		status, code = http.StatusServiceUnavailable, problem.CodeUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+}
+
 func handleCompletePayment(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.Header().Set("Content-Type", "application/json")
@@ -118,17 +401,46 @@ func handleCompletePayment(w http.ResponseWriter, r *http.Request) {
 	// Extract payment ID from URL path
 	path := strings.TrimPrefix(r.URL.Path, "/api/payments/complete/")
 	paymentID := strings.TrimSuffix(path, "/")
+	unlock, ok := lockPayment(w, r, paymentID)
+	if !ok {
+		return
+	}
+	defer unlock()
 	
-	// Mock payment completion
+	// Mock payment completion, recording it for settlement when the payment
+	// is known. On the sandbox chain the recipient completes it first.
 	log.Printf("Completing payment: %s", paymentID)
-	
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	response := map[string]interface{}{
 		"payment_id":   paymentID,
 		"status":       "completed",
 		"completed_at": time.Now().Unix(),
-	})
+	}
+	if sandboxChain != nil {
+		txHash, err := sandboxCompletePayment(paymentID)
+		if err != nil {
+			status := http.StatusNotFound
+			if isRevert(err) {
+				status = http.StatusConflict
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Failed to complete payment: %v", err)})
+			return
+		}
+		response["tx_hash"] = txHash
+	}
+	if _, err := db.Exec(`UPDATE payments SET status = 'completed', completed_at = ? WHERE id = ? AND status = 'pending'`,
+		time.Now().UTC(), paymentID); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	recordEvent(EventPaymentCompleted, paymentID, response)
+	
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
 }
 
 func handleRefundPayment(w http.ResponseWriter, r *http.Request) {
@@ -142,17 +454,24 @@ func handleRefundPayment(w http.ResponseWriter, r *http.Request) {
 	// Extract payment ID from URL path
 	path := strings.TrimPrefix(r.URL.Path, "/api/payments/refund/")
 	paymentID := strings.TrimSuffix(path, "/")
+	unlock, ok := lockPayment(w, r, paymentID)
+	if !ok {
+		return
+	}
+	defer unlock()
 	
 	// Mock payment refund
 	log.Printf("Refunding payment: %s", paymentID)
-	
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	response := map[string]interface{}{
 		"payment_id": paymentID,
 		"status":     "refunded",
 		"refunded_at": time.Now().Unix(),
-	})
+	}
+	recordEvent(EventPaymentRefunded, paymentID, response)
+	
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
 }
 
 func handleGetPayment(w http.ResponseWriter, r *http.Request) {
@@ -240,13 +559,21 @@ func handleGenerateReceipt(w http.ResponseWriter, r *http.Request) {
 		"language":   request.Language,
 	}
 	
-	resp, err := makeServiceCall("POST", storageServiceURL+"/api/receipts/generate", receiptData)
+	resp, err := makeServiceCall(r.Context(), storageCallTimeout, "POST", storageServiceURL+"/api/receipts/generate", receiptData)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Failed to generate receipt: %v", err)})
 		return
 	}
+	if cid, ok := resp["cid"].(string); ok {
+		recordEvent(EventReceiptGenerated, paymentID, map[string]interface{}{
+			"payment_id": paymentID,
+			"cid":        cid,
+			"format":     request.Format,
+			"language":   request.Language,
+		})
+	}
 	
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -259,7 +586,7 @@ func handleDownloadReceipt(w http.ResponseWriter, r *http.Request) {
 	receiptID := strings.TrimSuffix(path, "/")
 	
 	// Proxy to storage worker
-	resp, err := makeServiceCall("GET", storageServiceURL+"/api/receipts/download/"+receiptID, nil)
+	resp, err := makeServiceCall(r.Context(), storageCallTimeout, "GET", storageServiceURL+"/api/receipts/download/"+receiptID, nil)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -278,7 +605,7 @@ func handleVerifyReceipt(w http.ResponseWriter, r *http.Request) {
 	cid := strings.TrimSuffix(path, "/")
 	
 	// Proxy to storage worker
-	resp, err := makeServiceCall("GET", storageServiceURL+"/api/receipts/verify/"+cid, nil)
+	resp, err := makeServiceCall(r.Context(), storageCallTimeout, "GET", storageServiceURL+"/api/receipts/verify/"+cid, nil)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -319,7 +646,7 @@ func handleGetPrice(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/oracle/price/")
 	symbol := strings.TrimSuffix(path, "/")
 	
-	price, err := getOraclePrice(symbol)
+	price, err := getOraclePrice(r.Context(), symbol)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -344,7 +671,7 @@ func handleRequestRandom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := makeServiceCall("POST", oracleServiceURL+"/api/random/request", map[string]string{
+	resp, err := makeServiceCall(r.Context(), oracleCallTimeout, "POST", oracleServiceURL+"/api/random/request", map[string]string{
 		"requester": "payment-processor",
 	})
 	if err != nil {
@@ -364,7 +691,7 @@ func handleRandomStatus(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/oracle/random/status/")
 	requestID := strings.TrimSuffix(path, "/")
 	
-	resp, err := makeServiceCall("GET", oracleServiceURL+"/api/random/status/"+requestID, nil)
+	resp, err := makeServiceCall(r.Context(), oracleCallTimeout, "GET", oracleServiceURL+"/api/random/status/"+requestID, nil)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -393,7 +720,7 @@ func handleSubmitProof(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	resp, err := makeServiceCall("POST", oracleServiceURL+"/api/fdc/proof/submit", proofData)
+	resp, err := makeServiceCall(r.Context(), oracleCallTimeout, "POST", oracleServiceURL+"/api/fdc/proof/submit", proofData)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -411,7 +738,7 @@ func handleVerifyProof(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/oracle/proof/verify/")
 	proofID := strings.TrimSuffix(path, "/")
 	
-	resp, err := makeServiceCall("GET", oracleServiceURL+"/api/fdc/proof/verify/"+proofID, nil)
+	resp, err := makeServiceCall(r.Context(), oracleCallTimeout, "GET", oracleServiceURL+"/api/fdc/proof/verify/"+proofID, nil)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -430,7 +757,7 @@ func handleResolveName(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/ens/resolve/")
 	name := strings.TrimSuffix(path, "/")
 	
-	address, err := resolveENSName(name)
+	address, err := resolveENSName(r.Context(), name)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
@@ -451,7 +778,7 @@ func handleReverseResolve(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/ens/reverse/")
 	address := strings.TrimSuffix(path, "/")
 	
-	resp, err := makeServiceCall("GET", ensServiceURL+"/api/ens/reverse/"+address, nil)
+	resp, err := makeServiceCall(r.Context(), ensCallTimeout, "GET", ensServiceURL+"/api/ens/reverse/"+address, nil)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -480,7 +807,7 @@ func handleBatchResolve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	resp, err := makeServiceCall("POST", ensServiceURL+"/api/ens/resolve/batch", request)
+	resp, err := makeServiceCall(r.Context(), ensCallTimeout, "POST", ensServiceURL+"/api/ens/resolve/batch", request)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -502,7 +829,7 @@ func handleUploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := makeServiceCall("POST", storageServiceURL+"/api/storage/upload", nil)
+	resp, err := makeServiceCall(r.Context(), storageCallTimeout, "POST", storageServiceURL+"/api/storage/upload", nil)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -520,7 +847,7 @@ func handleRetrieveFile(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/storage/retrieve/")
 	cid := strings.TrimSuffix(path, "/")
 	
-	resp, err := makeServiceCall("GET", storageServiceURL+"/api/storage/retrieve/"+cid, nil)
+	resp, err := makeServiceCall(r.Context(), storageCallTimeout, "GET", storageServiceURL+"/api/storage/retrieve/"+cid, nil)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -538,7 +865,7 @@ func handleEstimateCost(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/storage/cost/")
 	size := strings.TrimSuffix(path, "/")
 	
-	resp, err := makeServiceCall("GET", storageServiceURL+"/api/storage/cost/"+size, nil)
+	resp, err := makeServiceCall(r.Context(), storageCallTimeout, "GET", storageServiceURL+"/api/storage/cost/"+size, nil)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -553,12 +880,18 @@ func handleEstimateCost(w http.ResponseWriter, r *http.Request) {
 
 // Analytics handlers
 func handleGetStats(w http.ResponseWriter, r *http.Request) {
+	streamVolume, totalVolume, ok := streamedVolume(w, "1250000000000000000000") // 1250 ETH
+	if !ok {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"total_payments":    1000,
 		"completed_payments": 850,
-		"total_volume":      "1250000000000000000000", // 1250 ETH
+		"total_volume":      totalVolume,
+		"streams":           streamVolume,
 		"receipts_generated": 750,
 		"receipts_verified":  600,
 		"oracle_requests":    500,
@@ -567,7 +900,12 @@ func handleGetStats(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleGetPaymentVolume(w http.ResponseWriter, r *http.Request) {
-	// Mock volume data
+	// Mock volume data, with what streams have paid so far
+	streamVolume, totalVolume, ok := streamedVolume(w, "1250000000000000000000")
+	if !ok {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -576,97 +914,2408 @@ func handleGetPaymentVolume(w http.ResponseWriter, r *http.Request) {
 			{"date": "2024-01-02", "volume": "75000000000000000000"},
 			{"date": "2024-01-03", "volume": "100000000000000000000"},
 		},
-		"total_volume": "1250000000000000000000",
+		"total_volume":  totalVolume,
+		"stream_volume": streamVolume,
 	})
 }
 
+// streamedVolume reads the stream volume and adds what streams have paid to
+// paymentVolume. It writes the error response when the streams cannot be
+// read.
+func streamedVolume(w http.ResponseWriter, paymentVolume string) (*StreamVolume, string, bool) {
+	volume, err := streams.volume()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return nil, "", false
+	}
+	total, _ := new(big.Int).SetString(paymentVolume, 10)
+	streamed, _ := new(big.Int).SetString(volume.Streamed, 10)
+	return volume, total.Add(total, streamed).String(), true
+}
+
+// handleGetReceiptStats serves receipt generation stats over ?window= (1h,
+// 24h, 7d or 30d), on ?chain_id= if set, as the analytics service counts them
 func handleGetReceiptStats(w http.ResponseWriter, r *http.Request) {
+	if receiptStats.analyticsURL == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Receipt stats require ANALYTICS_URL"})
+		return
+	}
+
+	stats, status, err := receiptStats.stats(r.Context(), r.URL.Query())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"total_receipts":    750,
-		"verified_receipts": 600,
-		"by_format": map[string]interface{}{
-			"json": 450,
-			"pdf":  300,
-		},
-		"by_language": map[string]interface{}{
-			"en": 500,
-			"es": 150,
-			"fr": 100,
-		},
-	})
+	w.Write(stats)
 }
 
-// Utility functions
-func makeServiceCall(method, url string, data interface{}) (map[string]interface{}, error) {
-	var body io.Reader
-	if data != nil {
-		jsonData, err := json.Marshal(data)
+// Token registry handlers
+func handleListTokens(w http.ResponseWriter, r *http.Request) {
+	var chainID int64
+	if value := r.URL.Query().Get("chain_id"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
-			return nil, err
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid chain_id"})
+			return
 		}
-		body = bytes.NewBuffer(jsonData)
-	}
-	
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		return nil, err
-	}
-	
-	if body != nil {
-		req.Header.Set("Content-Type", "application/json")
+		chainID = parsed
 	}
-	
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	allowedOnly := r.URL.Query().Get("allowed") == "true"
+
+	list, err := tokens.list(chainID, allowedOnly)
 	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
 	}
-	
-	return result, nil
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tokens": list,
+		"count":  len(list),
+		"mode":   tokens.mode,
+	})
 }
 
-func getOraclePrice(symbol string) (string, error) {
-	resp, err := makeServiceCall("GET", oracleServiceURL+"/api/ftso/price/"+symbol, nil)
-	if err != nil {
-		return "", err
+func handleGetToken(w http.ResponseWriter, r *http.Request) {
+	// Extract chain ID and address from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/tokens/")
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(parts) != 2 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Expected /api/tokens/:chainId/:address"})
+		return
 	}
-	
-	if price, ok := resp["price"].(float64); ok {
-		return strconv.FormatFloat(price, 'f', 2, 64), nil
+	chainID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || !common.IsHexAddress(parts[1]) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid chain ID or address"})
+		return
 	}
-	
-	return "0", fmt.Errorf("invalid price format")
-}
 
-func resolveENSName(name string) (string, error) {
-	resp, err := makeServiceCall("GET", ensServiceURL+"/api/ens/resolve/"+name, nil)
+	token, err := tokens.lookup(r.Context(), chainID, common.HexToAddress(parts[1]))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(token)
+}
+
+// KYC handlers
+func handleStartKYC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if kyc.provider == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "KYC is not configured"})
+		return
+	}
+
+	var request struct {
+		Address string `json:"address"`
+		Level   string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !common.IsHexAddress(request.Address) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "A valid address is required"})
+		return
+	}
+
+	verification, session, err := kyc.start(r.Context(), request.Address, request.Level)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errUnknownKYCLevel) {
+			status = http.StatusBadRequest
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"verification": verification,
+		"session":      session,
+	})
+}
+
+func handleGetKYC(w http.ResponseWriter, r *http.Request) {
+	// Extract address from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/kyc/")
+	address := strings.TrimSuffix(path, "/")
+	if !common.IsHexAddress(address) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid address"})
+		return
+	}
+
+	verification, err := getKYCVerification(address)
+	if errors.Is(err, errKYCNotFound) {
+		verification = &KYCVerification{Address: strings.ToLower(address), Status: KYCUnverified}
+	} else if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// Poll the provider when asked to, in case a webhook was missed
+	if r.URL.Query().Get("refresh") == "true" && verification.Status == KYCPending && kyc.provider != nil {
+		refreshed, err := kyc.refresh(r.Context(), verification)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return
+		}
+		verification = refreshed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"verification": verification,
+		"tiers":        kyc.tiers,
+		"mode":         kyc.mode,
+	})
+}
+
+func handleKYCRequirement(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	chainID := tokens.chainID
+	if value := query.Get("chain_id"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid chain_id"})
+			return
+		}
+		chainID = parsed
+	}
+
+	requirement, err := kyc.check(r.Context(), chainID, query.Get("sender"), query.Get("token"), query.Get("amount"))
+	if err != nil && !errors.Is(err, errKYCRequired) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"requirement": requirement,
+		"mode":        kyc.mode,
+	})
+}
+
+func handleKYCWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if kyc.provider == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "KYC is not configured"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to read webhook"})
+		return
+	}
+	review, err := kyc.provider.parseWebhook(r.Header, body)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errInvalidKYCSignature) {
+			status = http.StatusUnauthorized
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// Events that do not change a review, and applicants this service did
+	// not start, are acknowledged so the provider does not retry them
+	if review != nil {
+		if _, err := kyc.apply(review); err != nil && !errors.Is(err, errKYCNotFound) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"received": true})
+}
+
+// writeKYCError answers a payment whose KYC check failed
+func writeKYCError(w http.ResponseWriter, err error, requirement *KYCRequirement) {
+	status, code := http.StatusInternalServerError, problem.CodeInternal
+	if errors.Is(err, errKYCRequired) {
+		status, code = http.StatusForbidden, problem.CodeKYCRequired
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code, "kyc": requirement})
+}
+
+// Travel rule handlers
+func handleListTravelRuleVASPs(w http.ResponseWriter, r *http.Request) {
+	vasps := []map[string]interface{}{}
+	if travelRule.enabled() {
+		for _, vasp := range travelRule.directory {
+			vasps = append(vasps, map[string]interface{}{"id": vasp.ID, "name": vasp.Name, "lei": vasp.LEI, "country": vasp.Country})
+		}
+		sort.Slice(vasps, func(i, j int) bool { return vasps[i]["id"].(string) < vasps[j]["id"].(string) })
+	}
+
+	response := map[string]interface{}{
+		"enabled": travelRule.enabled(),
+		"vasps":   vasps,
+	}
+	if travelRule.enabled() {
+		response["vasp"] = travelRule.vasp.ID
+		response["threshold_usd"] = travelRule.thresholdUSD
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func handleTravelRuleInbound(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if !travelRule.enabled() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Travel rule is not configured"})
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxTravelRuleBody))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request body"})
+		return
+	}
+	receipt, err := travelRule.receive(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), payload)
+	if err != nil {
+		writeTravelRuleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(receipt)
+}
+
+func handleGetTravelRule(w http.ResponseWriter, r *http.Request) {
+	// Extract payment ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/travel-rule/")
+	paymentID := strings.TrimSuffix(path, "/")
+	if paymentID == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Missing payment ID"})
+		return
+	}
+
+	transfers, err := getTravelRuleTransfers(paymentID)
+	if err != nil {
+		writeTravelRuleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"payment_id": paymentID,
+		"transfers":  transfers,
+	})
+}
+
+func writeTravelRuleError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, problem.CodeInternal
+	switch {
+	case errors.Is(err, errTravelRuleRequired):
+		status, code = http.StatusBadRequest, problem.CodeTravelRuleRequired
+	case errors.Is(err, errUnknownVASP):
+		status, code = http.StatusBadRequest, problem.CodeUnknownVASP
+	case errors.Is(err, errInvalidTravelRulePerson):
+		status, code = http.StatusBadRequest, problem.CodeInvalidTravelRulePerson
+	case errors.Is(err, errInvalidTravelRuleMessage):
+		status, code = http.StatusBadRequest, problem.CodeInvalidTravelRuleMessage
+	case errors.Is(err, errTravelRuleUnauthorized):
+		status, code = http.StatusUnauthorized, problem.CodeUnauthorized
+	case errors.Is(err, errTravelRuleNotFound):
+		status, code = http.StatusNotFound, problem.CodeNotFound
+	case errors.Is(err, errTravelRuleTransmission):
+		status, code = http.StatusBadGateway, problem.CodeUpstreamFailed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+}
+
+// Settlement handlers
+func handleListSettlements(w http.ResponseWriter, r *http.Request) {
+	if settlements == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Settlement is not configured"})
+		return
+	}
+
+	where, args := []string{"1 = 1"}, []interface{}{}
+	if merchant := r.URL.Query().Get("merchant"); merchant != "" {
+		where, args = append(where, "merchant = ?"), append(args, strings.ToLower(merchant))
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		where, args = append(where, "status = ?"), append(args, status)
+	}
+	limit := 50
+	if value, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && value > 0 && value <= 500 {
+		limit = value
+	}
+
+	found, err := querySettlements(fmt.Sprintf("WHERE %s ORDER BY created_at DESC LIMIT %d", strings.Join(where, " AND "), limit), args...)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	for _, settlement := range found {
+		settlement.Statement = nil
+	}
+	if found == nil {
+		found = []*Settlement{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"settlements": found,
+		"count":       len(found),
+	})
+}
+
+func handleListMerchants(w http.ResponseWriter, r *http.Request) {
+	if settlements == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Settlement is not configured"})
+		return
+	}
+
+	merchants := []map[string]interface{}{}
+	for _, merchant := range settlements.merchants {
+		if address := r.URL.Query().Get("address"); address != "" && !strings.EqualFold(address, merchant.Address) {
+			continue
+		}
+		balances, err := settlements.balances(merchant)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return
+		}
+		merchants = append(merchants, map[string]interface{}{
+			"merchant":        merchant,
+			"unsettled":       balances,
+			"next_settlement": nextSettlement(merchant.Schedule, settlements.now()),
+		})
+	}
+	sort.Slice(merchants, func(i, j int) bool {
+		return merchants[i]["merchant"].(*Merchant).Address < merchants[j]["merchant"].(*Merchant).Address
+	})
+	if len(merchants) == 0 && r.URL.Query().Get("address") != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": errUnknownMerchant.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"merchants": merchants,
+		"wallet":    settlements.wallet.Hex(),
+	})
+}
+
+func handleGetSettlement(w http.ResponseWriter, r *http.Request) {
+	// Extract settlement ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/settlements/")
+	id := strings.TrimSuffix(path, "/")
+
+	settlement, err := getSettlement(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errSettlementNotFound) {
+			status = http.StatusNotFound
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(settlement)
+}
+
+// Payment stream handlers
+func handleCreateStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	var request StreamRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+	rate, err := request.validate(streams.now())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// Check the token and the sender's KYC against the whole deposit
+	token, err := tokens.check(r.Context(), tokens.chainID, request.Token)
+	if err != nil {
+		writeTokenError(w, err, token)
+		return
+	}
+	deposit := new(big.Int).Mul(rate, big.NewInt(request.Duration)).String()
+	kycRequirement, err := kyc.check(r.Context(), tokens.chainID, request.Sender, request.Token, deposit)
+	if err != nil {
+		writeKYCError(w, err, kycRequirement)
+		return
+	}
+	limitEvaluation, err := limits.check(r.Context(), "stream", tokens.chainID, request.Sender, request.Token,
+		limitLeg{Recipient: request.Recipient, Amount: deposit})
+	if err != nil {
+		writeLimitError(w, err, limitEvaluation)
+		return
+	}
+
+	stream, err := streams.create(tokens.chainID, &request)
+	if err != nil {
+		limits.release(limitEvaluation)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if err := limits.record(limitEvaluation, stream.ID); err != nil {
+		log.Printf("Warning: Failed to record limits of stream %s: %v", stream.ID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stream": stream,
+		"token":  token,
+		"kyc":    kycRequirement,
+		"limits": limitEvaluation,
+	})
+}
+
+func handleTopUpStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	// Extract stream ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/streams/topup/")
+	streamID := strings.TrimSuffix(path, "/")
+
+	var request struct {
+		Amount string `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	stream, err := streams.topUp(streamID, request.Amount)
+	if err != nil {
+		writeStreamError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stream)
+}
+
+func handleCancelStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	// Extract stream ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/streams/cancel/")
+	streamID := strings.TrimSuffix(path, "/")
+
+	stream, err := streams.cancel(streamID)
+	if err != nil {
+		writeStreamError(w, err)
+		return
+	}
+	log.Printf("Cancelled stream %s, %s streamed and %s refunded", stream.ID, stream.Streamed, stream.Remaining)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stream)
+}
+
+func handleGetStream(w http.ResponseWriter, r *http.Request) {
+	// Extract stream ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/streams/")
+	streamID := strings.TrimSuffix(path, "/")
+
+	stream, err := streams.get(streamID)
+	if err != nil {
+		writeStreamError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stream)
+}
+
+func handleGetUserStreams(w http.ResponseWriter, r *http.Request) {
+	// Extract address from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/streams/user/")
+	address := strings.ToLower(strings.TrimSuffix(path, "/"))
+
+	if err := erasures.check(address); err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	found, err := streams.query(`WHERE sender = ? OR recipient = ? ORDER BY created_at DESC`, address, address)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if found == nil {
+		found = []*PaymentStream{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address": address,
+		"streams": found,
+		"count":   len(found),
+	})
+}
+
+// writeStreamError answers 404 for unknown streams, 409 for ended ones and
+// 400 for invalid top-ups
+func writeStreamError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, problem.CodeInternal
+	switch {
+	case errors.Is(err, errStreamNotFound):
+		status, code = http.StatusNotFound, problem.CodeNotFound
+	case errors.Is(err, errStreamEnded):
+		status, code = http.StatusConflict, problem.CodeStreamEnded
+	case errors.Is(err, errInvalidTopUp):
+		status, code = http.StatusBadRequest, problem.CodeInvalidTopUp
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+}
+
+// Split payment handlers
+func handleCreateSplit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if userOps == nil && sandboxChain == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Split payments need sponsored payments or sandbox mode"})
+		return
+	}
+
+	var request SplitPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+	legs, err := request.validate()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	var chainID int64
+	if userOps != nil {
+		chainID = userOps.chainID.Int64()
+	} else {
+		chainID = sandboxChain.ChainID().Int64()
+	}
+
+	// Check the token and the sender's KYC against the whole amount
+	token, err := tokens.check(r.Context(), chainID, request.Token)
+	if err != nil {
+		writeTokenError(w, err, token)
+		return
+	}
+	kycRequirement, err := kyc.check(r.Context(), chainID, request.Sender, request.Token, request.Amount)
+	if err != nil {
+		writeKYCError(w, err, kycRequirement)
+		return
+	}
+	metadata, err := paymentMetadata.validate(r.Context(), request.MetadataURI)
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+	limitEvaluation, err := limits.check(r.Context(), "split", chainID, request.Sender, request.Token, splitLimitLegs(legs)...)
+	if err != nil {
+		writeLimitError(w, err, limitEvaluation)
+		return
+	}
+
+	split, built, ok := createSplitLegs(w, r, chainID, &request, legs)
+	if !ok {
+		limits.release(limitEvaluation)
+		return
+	}
+	if err := limits.record(limitEvaluation, split.ID); err != nil {
+		log.Printf("Warning: Failed to record limits of split %s: %v", split.ID, err)
+	}
+
+	response := map[string]interface{}{
+		"split":         split,
+		"token":         token,
+		"kyc":           kycRequirement,
+		"limits":        limitEvaluation,
+		"metadata":      metadata,
+		"chain_warning": chainMonitor.warning(chainID, token),
+	}
+	if built != nil {
+		response["user_operation"] = built
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// createSplitLegs creates a validated split on chainID. With sponsored
+// payments one user operation creates every leg, and the split settles when
+// it is included; the operation is returned to be signed. In sandbox mode
+// the legs are created one after another. Errors are answered here and
+// return false, with the split when it was created but failed.
+func createSplitLegs(w http.ResponseWriter, r *http.Request, chainID int64, request *SplitPaymentRequest, legs []*SplitLeg) (*SplitPayment, *BuiltUserOperation, bool) {
+	if userOps != nil {
+		callData, err := splitCallData(userOps.paymentCore, common.HexToAddress(request.Token), request.MetadataURI, legs)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Failed to encode split: %v", err)})
+			return nil, nil, false
+		}
+		built, err := userOps.buildCall(r.Context(), common.HexToAddress(request.Sender), request.Factory, request.FactoryData, callData)
+		if err != nil {
+			status := http.StatusBadGateway
+			if errors.Is(err, errAccountNotDeployed) {
+				status = http.StatusBadRequest
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return nil, nil, false
+		}
+		split, err := splits.create(chainID, request, legs, SplitAtomic, built.Hash.Hex())
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return nil, nil, false
+		}
+		return split, built, true
+	}
+
+	split, err := splits.create(chainID, request, legs, SplitSequential, "")
+	if err == nil {
+		split, err = splits.executeInSandbox(split)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return nil, nil, false
+	}
+	if split.Status == SplitFailed {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to create split: " + split.Reason, "split": split})
+		return split, nil, false
+	}
+	return split, nil, true
+}
+
+func handleGetSplit(w http.ResponseWriter, r *http.Request) {
+	// Extract split ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/splits/")
+	splitID := strings.TrimSuffix(path, "/")
+
+	split, err := splits.get(splitID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errSplitNotFound) {
+			status = http.StatusNotFound
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(split)
+}
+
+func handleGetUserSplits(w http.ResponseWriter, r *http.Request) {
+	// Extract address from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/splits/user/")
+	address := strings.ToLower(strings.TrimSuffix(path, "/"))
+
+	if err := erasures.check(address); err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	found, err := splits.query(`WHERE sender = ? OR id IN (SELECT split_id FROM split_payment_legs WHERE recipient = ?) ORDER BY created_at DESC`, address, address)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if found == nil {
+		found = []*SplitPayment{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address": address,
+		"splits":  found,
+		"count":   len(found),
+	})
+}
+
+// Address book handlers
+func handleCreateContact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	var request ContactRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	if err := erasures.check(request.Owner); err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	contact, err := contacts.create(r.Context(), &request)
+	if err != nil {
+		writeContactError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(contact)
+}
+
+func handleUpdateContact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	// Extract contact ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/contacts/update/")
+	contactID := strings.TrimSuffix(path, "/")
+
+	var request ContactRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	contact, err := contacts.update(r.Context(), contactID, &request)
+	if err != nil {
+		writeContactError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(contact)
+}
+
+func handleDeleteContact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	// Extract contact ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/contacts/delete/")
+	contactID := strings.TrimSuffix(path, "/")
+
+	var request struct {
+		Owner string `json:"owner"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	if err := contacts.remove(contactID, request.Owner); err != nil {
+		writeContactError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": contactID, "deleted": true})
+}
+
+func handleGetContact(w http.ResponseWriter, r *http.Request) {
+	// Extract contact ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/contacts/")
+	contactID := strings.TrimSuffix(path, "/")
+
+	contact, err := contacts.get(contactID)
+	if err != nil {
+		writeContactError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(contact)
+}
+
+func handleGetUserContacts(w http.ResponseWriter, r *http.Request) {
+	// Extract owner from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/contacts/user/")
+	owner := strings.ToLower(strings.TrimSuffix(path, "/"))
+
+	if err := erasures.check(owner); err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	found, err := contacts.list(owner)
+	if err != nil {
+		writeContactError(w, err)
+		return
+	}
+	if found == nil {
+		found = []*Contact{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"owner":    owner,
+		"contacts": found,
+		"count":    len(found),
+	})
+}
+
+func handleContactSuggestions(w http.ResponseWriter, r *http.Request) {
+	// Extract owner from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/contacts/suggestions/")
+	owner := strings.ToLower(strings.TrimSuffix(path, "/"))
+
+	if err := erasures.check(owner); err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	suggestions, err := contacts.suggest(owner, r.URL.Query().Get("q"), limit)
+	if err != nil {
+		writeContactError(w, err)
+		return
+	}
+	if suggestions == nil {
+		suggestions = []*ContactSuggestion{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"owner":       owner,
+		"suggestions": suggestions,
+		"count":       len(suggestions),
+	})
+}
+
+// writeContactError answers 404 for unknown contacts, 409 for duplicate
+// addresses and 400 for invalid contacts
+func writeContactError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, problem.CodeInternal
+	switch {
+	case errors.Is(err, errContactNotFound):
+		status, code = http.StatusNotFound, problem.CodeNotFound
+	case errors.Is(err, errContactExists):
+		status, code = http.StatusConflict, problem.CodeContactExists
+	case errors.Is(err, errInvalidContact):
+		status, code = http.StatusBadRequest, problem.CodeInvalidContact
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+}
+
+// Payment intent handlers
+func handleIntentURI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if intents == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Payment intents are not configured"})
+		return
+	}
+
+	var intent PaymentIntent
+	if err := json.NewDecoder(r.Body).Decode(&intent); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+	if err := intent.validatePayment(); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	token, err := tokens.check(r.Context(), intents.chainID.Int64(), intent.Token)
+	if err != nil {
+		writeTokenError(w, err, token)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uri":      intents.paymentURI(&intent),
+		"chain_id": intents.chainID.Int64(),
+		"token":    token,
+	})
+}
+
+func handleCreateIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if intents == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Payment intents are not configured"})
+		return
+	}
+
+	var request PaymentIntent
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	intent, err := intents.create(request)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	token, err := tokens.check(r.Context(), intents.chainID.Int64(), intent.Token)
+	if err != nil {
+		writeTokenError(w, err, token)
+		return
+	}
+	kycRequirement, err := kyc.check(r.Context(), intents.chainID.Int64(), intent.Sender, intent.Token, intent.Amount)
+	if err != nil {
+		writeKYCError(w, err, kycRequirement)
+		return
+	}
+	metadata, err := paymentMetadata.validate(r.Context(), intent.MetadataURI)
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+	limitEvaluation, err := limits.check(r.Context(), "intent", intents.chainID.Int64(), intent.Sender, intent.Token,
+		limitLeg{Recipient: intent.Recipient, Amount: intent.Amount})
+	if err != nil {
+		writeLimitError(w, err, limitEvaluation)
+		return
+	}
+	digest, err := intents.digest(intent)
+	if err != nil {
+		limits.release(limitEvaluation)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if err := limits.record(limitEvaluation, digest.Hex()); err != nil {
+		log.Printf("Warning: Failed to record limits of intent %s: %v", digest.Hex(), err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"intent":     intent,
+		"intent_id":  digest.Hex(),
+		"typed_data": intents.typedData(intent),
+		"uri":        intents.paymentURI(intent),
+		"token":      token,
+		"kyc":        kycRequirement,
+		"limits":     limitEvaluation,
+		"metadata":   metadata,
+	})
+}
+
+func handleVerifyIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if intents == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Payment intents are not configured"})
+		return
+	}
+
+	var request struct {
+		Intent    PaymentIntent `json:"intent"`
+		Signature string        `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	if _, err := paymentMetadata.validate(r.Context(), request.Intent.MetadataURI); err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+
+	record, err := intents.verify(r.Context(), &request.Intent, request.Signature)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, errInvalidSignature):
+			status = http.StatusUnauthorized
+		case errors.Is(err, errIntentUsed):
+			status = http.StatusConflict
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(record)
+}
+
+func handleExecuteIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if intents == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Payment intents are not configured"})
+		return
+	}
+
+	// Extract intent ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/intents/execute/")
+	intentID := strings.TrimSuffix(path, "/")
+
+	var request struct {
+		TxHash string `json:"tx_hash"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(common.FromHex(request.TxHash)) != common.HashLength {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "A tx_hash is required"})
+		return
+	}
+
+	record, err := intents.markExecuted(intentID, common.HexToHash(request.TxHash).Hex())
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errIntentNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, errIntentUsed), errors.Is(err, errIntentExpired):
+			status = http.StatusConflict
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(record)
+}
+
+func handleGetIntent(w http.ResponseWriter, r *http.Request) {
+	if intents == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Payment intents are not configured"})
+		return
+	}
+
+	// Extract intent ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/intents/")
+	intentID := strings.TrimSuffix(path, "/")
+
+	record, err := intents.get(intentID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errIntentNotFound) {
+			status = http.StatusNotFound
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(record)
+}
+
+// Sponsored payment handlers
+func handleBuildUserOperation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if userOps == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Sponsored payments are not configured"})
+		return
+	}
+
+	var request SponsoredPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+	amount, err := request.validate()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	token, err := tokens.check(r.Context(), userOps.chainID.Int64(), request.Token)
+	if err != nil {
+		writeTokenError(w, err, token)
+		return
+	}
+	if requirement, err := kyc.check(r.Context(), userOps.chainID.Int64(), request.Sender, request.Token, request.Amount); err != nil {
+		writeKYCError(w, err, requirement)
+		return
+	}
+	if _, err := paymentMetadata.validate(r.Context(), request.MetadataURI); err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+	limitEvaluation, err := limits.check(r.Context(), "user_operation", userOps.chainID.Int64(), request.Sender, request.Token,
+		limitLeg{Recipient: request.Recipient, Amount: request.Amount})
+	if err != nil {
+		writeLimitError(w, err, limitEvaluation)
+		return
+	}
+
+	built, err := userOps.build(r.Context(), &request, amount)
+	if err != nil {
+		limits.release(limitEvaluation)
+		status := http.StatusBadGateway
+		if errors.Is(err, errAccountNotDeployed) {
+			status = http.StatusBadRequest
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	built.ChainWarning = chainMonitor.warning(userOps.chainID.Int64(), token)
+	if err := limits.record(limitEvaluation, built.Hash.Hex()); err != nil {
+		log.Printf("Warning: Failed to record limits of operation %s: %v", built.Hash.Hex(), err)
+	}
+	built.Limits = limitEvaluation
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(built)
+}
+
+func handleSendUserOperation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if userOps == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Sponsored payments are not configured"})
+		return
+	}
+
+	var request struct {
+		UserOperation *UserOperation `json:"user_operation"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.UserOperation == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	record, err := userOps.send(r.Context(), request.UserOperation)
+	if err != nil {
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, errUnsigned):
+			status = http.StatusBadRequest
+		case errors.Is(err, errSponsorshipLimit), errors.Is(err, errGasBudgetExceeded):
+			status = http.StatusForbidden
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(record)
+}
+
+func handleGetUserOperation(w http.ResponseWriter, r *http.Request) {
+	if userOps == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Sponsored payments are not configured"})
+		return
+	}
+
+	// Extract user operation hash from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/userops/")
+	hash := strings.TrimSuffix(path, "/")
+
+	record, err := getUserOp(hash)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUserOpNotFound) {
+			status = http.StatusNotFound
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// Pending operations are checked with the bundler rather than waiting for
+	// the tracker
+	if err := userOps.refresh(r.Context(), record); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(record)
+}
+
+func handleGetUserOperations(w http.ResponseWriter, r *http.Request) {
+	if userOps == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Sponsored payments are not configured"})
+		return
+	}
+
+	// Extract address from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/userops/user/")
+	address := strings.ToLower(strings.TrimSuffix(path, "/"))
+
+	records, err := queryUserOps(`WHERE sender = ? ORDER BY created_at DESC`, address)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if records == nil {
+		records = []*UserOpRecord{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address":         address,
+		"user_operations": records,
+		"count":           len(records),
+	})
+}
+
+// Gas sponsorship handlers
+func handleGetGasBudget(w http.ResponseWriter, r *http.Request) {
+	if gasBudgets == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Gas sponsorship is not configured"})
+		return
+	}
+
+	day := r.URL.Query().Get("day")
+	if day == "" {
+		day = gasBudgetDay(gasBudgets.now())
+	} else if _, err := time.Parse("2006-01-02", day); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid day, expected YYYY-MM-DD"})
+		return
+	}
+
+	merchants := []string{strings.ToLower(r.URL.Query().Get("merchant"))}
+	if merchants[0] == "" {
+		var err error
+		if merchants, err = gasBudgets.merchants(day); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return
+		}
+	} else if !common.IsHexAddress(merchants[0]) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid merchant address"})
+		return
+	}
+
+	usages := make([]*GasBudgetUsage, 0, len(merchants))
+	for _, merchant := range merchants {
+		usage, err := gasBudgets.usage(merchant, day)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return
+		}
+		usages = append(usages, usage)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"day":           day,
+		"alert_percent": gasBudgets.alertPercent,
+		"merchants":     usages,
+	})
+}
+
+// Limit handlers
+func handleGetLimitRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mode":  limits.mode,
+		"rules": limits.rules,
+	})
+}
+
+func handleGetLimitUsage(w http.ResponseWriter, r *http.Request) {
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = LimitScopeSender
+	}
+	if scope != LimitScopeSender && scope != LimitScopeMerchant {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid scope, expected sender or merchant"})
+		return
+	}
+	address := r.URL.Query().Get("address")
+	if !common.IsHexAddress(address) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid address"})
+		return
+	}
+
+	usage, err := limits.usage(scope, address, limits.now())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(usage)
+}
+
+func handleListLimitEvaluations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	address := query.Get("address")
+	if address != "" && !common.IsHexAddress(address) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid address"})
+		return
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	evaluations, err := listLimitEvaluations(address, query.Get("violations") == "true", limit)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"evaluations": evaluations,
+		"total":       len(evaluations),
+	})
+}
+
+// writeLimitError answers 403 with the violations of payments over their
+// limits
+func writeLimitError(w http.ResponseWriter, err error, evaluation *LimitEvaluation) {
+	status := http.StatusInternalServerError
+	response := map[string]interface{}{"error": err.Error(), "code": problem.CodeInternal}
+	if errors.Is(err, errLimitExceeded) {
+		status = http.StatusForbidden
+		response["code"] = problem.CodeLimitExceeded
+		response["evaluation_id"] = evaluation.ID
+		response["violations"] = evaluation.Violations
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// WalletConnect handlers
+func handleCreateWalletConnectSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if walletConnect == nil {
+		writeWalletConnectDisabled(w)
+		return
+	}
+
+	session, uri, err := walletConnect.pair(r.Context())
+	if err != nil {
+		writeWalletConnectError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session": session,
+		"uri":     uri,
+	})
+}
+
+func handleGetWalletConnectSession(w http.ResponseWriter, r *http.Request) {
+	if walletConnect == nil {
+		writeWalletConnectDisabled(w)
+		return
+	}
+
+	// Extract session ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/walletconnect/sessions/")
+	id := strings.TrimSuffix(path, "/")
+
+	session, err := getWalletConnectSession(id)
+	if err != nil {
+		writeWalletConnectError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(session)
+}
+
+func handleDeleteWalletConnectSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if walletConnect == nil {
+		writeWalletConnectDisabled(w)
+		return
+	}
+
+	// Extract session ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/walletconnect/sessions/delete/")
+	id := strings.TrimSuffix(path, "/")
+
+	session, err := walletConnect.disconnect(r.Context(), id)
+	if err != nil {
+		writeWalletConnectError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(session)
+}
+
+func handleCreateWalletConnectRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if walletConnect == nil {
+		writeWalletConnectDisabled(w)
+		return
+	}
+
+	var request WalletConnectPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+	amount, err := request.validate()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// The payment is sent from the session's account
+	session, err := getWalletConnectSession(request.SessionID)
+	if err != nil {
+		writeWalletConnectError(w, err)
+		return
+	}
+	if session.Status != WCSessionActive {
+		writeWalletConnectError(w, errWalletConnectSessionInactive)
+		return
+	}
+	chainID := walletConnect.chainID
+
+	// Check the token against the registry
+	token, err := tokens.check(r.Context(), chainID, request.Token)
+	if err != nil {
+		writeTokenError(w, err, token)
+		return
+	}
+
+	// Check the sender's KYC against the payment's value
+	kycRequirement, err := kyc.check(r.Context(), chainID, session.Address, request.Token, request.Amount)
+	if err != nil {
+		writeKYCError(w, err, kycRequirement)
+		return
+	}
+
+	// Validate the metadata document against its schema
+	if _, err := paymentMetadata.validate(r.Context(), request.MetadataURI); err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+
+	// Check the payment against the sender's and recipient's limits, which
+	// reserves its value until it is pushed
+	limitEvaluation, err := limits.check(r.Context(), "walletconnect", chainID, session.Address, request.Token,
+		limitLeg{Recipient: request.Recipient, Amount: request.Amount})
+	if err != nil {
+		writeLimitError(w, err, limitEvaluation)
+		return
+	}
+
+	pushed, err := walletConnect.pushPayment(r.Context(), &request, amount)
+	if err != nil {
+		limits.release(limitEvaluation)
+		writeWalletConnectError(w, err)
+		return
+	}
+	if err := limits.record(limitEvaluation, pushed.ID); err != nil {
+		log.Printf("Warning: Failed to record limits of WalletConnect request %s: %v", pushed.ID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"request":       pushed,
+		"token":         token,
+		"kyc":           kycRequirement,
+		"limits":        limitEvaluation,
+		"chain_warning": chainMonitor.warning(chainID, token),
+	})
+}
+
+func handleGetWalletConnectRequest(w http.ResponseWriter, r *http.Request) {
+	if walletConnect == nil {
+		writeWalletConnectDisabled(w)
+		return
+	}
+
+	// Extract request ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/walletconnect/requests/")
+	id := strings.TrimSuffix(path, "/")
+
+	request, err := getWalletConnectRequest(id)
+	if err != nil {
+		writeWalletConnectError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(request)
+}
+
+func writeWalletConnectDisabled(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": "WalletConnect is not configured"})
+}
+
+// writeWalletConnectError answers 404 for unknown sessions and requests, 409
+// for sessions that are not active and 502 when the relay fails
+func writeWalletConnectError(w http.ResponseWriter, err error) {
+	status, code := http.StatusBadGateway, problem.CodeUpstreamFailed
+	switch {
+	case errors.Is(err, errWalletConnectSessionNotFound), errors.Is(err, errWalletConnectRequestNotFound):
+		status, code = http.StatusNotFound, problem.CodeNotFound
+	case errors.Is(err, errWalletConnectSessionInactive):
+		status, code = http.StatusConflict, problem.CodeWalletConnectEnded
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+}
+
+// Privacy handlers
+func handleCreateErasure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	var request ErasureSignature
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	erasure, err := erasures.request(r.Context(), &request)
+	if err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(erasure)
+}
+
+func handleCancelErasure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	// Extract erasure ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/privacy/erasures/cancel/")
+	erasureID := strings.TrimSuffix(path, "/")
+
+	var request ErasureSignature
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	erasure, err := erasures.cancel(r.Context(), erasureID, &request)
+	if err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(erasure)
+}
+
+func handleGetErasure(w http.ResponseWriter, r *http.Request) {
+	// Extract erasure ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/privacy/erasures/")
+	erasureID := strings.TrimSuffix(path, "/")
+
+	erasure, err := erasures.get(erasureID)
+	if err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(erasure)
+}
+
+// writeErasureError answers 410 for addresses pending erasure, 401 for bad
+// signatures and 409 for requests that conflict with an earlier one
+func writeErasureError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, problem.CodeInternal
+	switch {
+	case errors.Is(err, errAddressErased):
+		status, code = http.StatusGone, problem.CodeAddressErased
+	case errors.Is(err, errErasureNotFound):
+		status, code = http.StatusNotFound, problem.CodeNotFound
+	case errors.Is(err, errInvalidErasure):
+		status, code = http.StatusBadRequest, problem.CodeInvalidErasure
+	case errors.Is(err, errErasureSignature):
+		status, code = http.StatusUnauthorized, problem.CodeInvalidErasureSignature
+	case errors.Is(err, errErasurePending):
+		status, code = http.StatusConflict, problem.CodeErasurePending
+	case errors.Is(err, errErasureFinal):
+		status, code = http.StatusConflict, problem.CodeErasureFinal
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+}
+
+func handleListMetadataSchemas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"schemas": paymentMetadata.schemas()})
+}
+
+func handleValidateMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	var request struct {
+		URI string `json:"uri"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.URI == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "uri is required"})
+		return
+	}
+
+	metadata, err := paymentMetadata.validate(r.Context(), request.URI)
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(metadata)
+}
+
+func handleGetMetadata(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "uri is required"})
+		return
+	}
+
+	metadata, err := paymentMetadata.document(r.Context(), uri)
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(metadata)
+}
+
+// handleSearchMetadata finds metadata documents of a schema by the values of
+// their indexed fields, given as query parameters
+func handleSearchMetadata(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filters := make(map[string]string)
+	for name := range query {
+		if name != "schema" && name != "limit" {
+			filters[name] = query.Get(name)
+		}
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	matches, err := paymentMetadata.search(query.Get("schema"), filters, limit)
+	if err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"matches": matches,
+		"total":   len(matches),
+	})
+}
+
+// writeMetadataError answers 400 for documents that fail their schema and
+// 422 for URIs whose document cannot be read
+func writeMetadataError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, problem.CodeInternal
+	switch {
+	case errors.Is(err, errInvalidMetadata):
+		status, code = http.StatusBadRequest, problem.CodeInvalidMetadata
+	case errors.Is(err, errMetadataUnavailable):
+		status, code = http.StatusUnprocessableEntity, problem.CodeMetadataUnavailable
+	case errors.Is(err, errMetadataNotFound):
+		status, code = http.StatusNotFound, problem.CodeNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+}
+
+// handleImportPayroll previews a payroll CSV, given as the multipart file
+// "file" or as the request body, with sender, token and metadata_uri as form
+// or query values
+func handleImportPayroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	var csv io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxPayrollCSVSize); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "No file provided"})
+			return
+		}
+		defer file.Close()
+		csv = file
+	}
+
+	run, err := payroll.preview(r.Context(), &PayrollImport{
+		Sender:      r.FormValue("sender"),
+		Token:       r.FormValue("token"),
+		MetadataURI: r.FormValue("metadata_uri"),
+		CSV:         csv,
+	})
+	if err != nil {
+		writePayrollError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(run)
+}
+
+// handleSubmitPayroll pays a previewed payroll run as a split payment
+func handleSubmitPayroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+	if userOps == nil && sandboxChain == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Payroll payments need sponsored payments or sandbox mode"})
+		return
+	}
+
+	// Extract run ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/payroll/runs/submit/")
+	runID := strings.TrimSuffix(path, "/")
+
+	var body struct {
+		Factory     string `json:"factory"`
+		FactoryData string `json:"factory_data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	run, err := payroll.get(runID)
+	if err != nil {
+		writePayrollError(w, err)
+		return
+	}
+	request, err := payroll.splitRequest(run, body.Factory, body.FactoryData)
+	if err != nil {
+		writePayrollError(w, err)
+		return
+	}
+	legs, err := request.validate()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	var chainID int64
+	if userOps != nil {
+		chainID = userOps.chainID.Int64()
+	} else {
+		chainID = sandboxChain.ChainID().Int64()
+	}
+
+	// Check the token and the sender's KYC against the whole run
+	token, err := tokens.check(r.Context(), chainID, request.Token)
+	if err != nil {
+		writeTokenError(w, err, token)
+		return
+	}
+	kycRequirement, err := kyc.check(r.Context(), chainID, request.Sender, request.Token, request.Amount)
+	if err != nil {
+		writeKYCError(w, err, kycRequirement)
+		return
+	}
+	if _, err := paymentMetadata.validate(r.Context(), request.MetadataURI); err != nil {
+		writeMetadataError(w, err)
+		return
+	}
+	limitEvaluation, err := limits.check(r.Context(), "payroll", chainID, request.Sender, request.Token, splitLimitLegs(legs)...)
+	if err != nil {
+		writeLimitError(w, err, limitEvaluation)
+		return
+	}
+
+	split, built, ok := createSplitLegs(w, r, chainID, request, legs)
+	if !ok {
+		limits.release(limitEvaluation)
+	} else if err := limits.record(limitEvaluation, split.ID); err != nil {
+		log.Printf("Warning: Failed to record limits of payroll run %s: %v", run.ID, err)
+	}
+	if split != nil {
+		if err := payroll.submit(run, split); err != nil {
+			log.Printf("Failed to record split %s of payroll run %s: %v", split.ID, run.ID, err)
+			if ok {
+				writePayrollError(w, err)
+				return
+			}
+		}
+	}
+	if !ok {
+		return
+	}
+
+	response := map[string]interface{}{
+		"run":           run,
+		"split":         split,
+		"token":         token,
+		"kyc":           kycRequirement,
+		"limits":        limitEvaluation,
+		"chain_warning": chainMonitor.warning(chainID, token),
+	}
+	if built != nil {
+		response["user_operation"] = built
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func handleGetPayroll(w http.ResponseWriter, r *http.Request) {
+	// Extract run ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/payroll/runs/")
+	runID := strings.TrimSuffix(path, "/")
+
+	run, err := payroll.get(runID)
+	if err != nil {
+		writePayrollError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(run)
+}
+
+func handleGetUserPayrolls(w http.ResponseWriter, r *http.Request) {
+	// Extract address from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/api/payroll/user/")
+	address := strings.ToLower(strings.TrimSuffix(path, "/"))
+
+	if err := erasures.check(address); err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	runs, err := payroll.list(address)
+	if err != nil {
+		writePayrollError(w, err)
+		return
+	}
+	if runs == nil {
+		runs = []*PayrollRun{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address": address,
+		"runs":    runs,
+		"count":   len(runs),
+	})
+}
+
+// writePayrollError answers 400 for CSVs and runs that cannot be paid, 409
+// for runs already submitted and 502 when ENS names cannot be resolved
+func writePayrollError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, problem.CodeInternal
+	switch {
+	case errors.Is(err, errPayrollNotFound):
+		status, code = http.StatusNotFound, problem.CodeNotFound
+	case errors.Is(err, errInvalidPayroll):
+		status, code = http.StatusBadRequest, problem.CodeInvalidPayroll
+	case errors.Is(err, errPayrollSubmitted):
+		status, code = http.StatusConflict, problem.CodePayrollSubmitted
+	case errors.Is(err, errENSUnavailable):
+		status, code = http.StatusBadGateway, problem.CodeENSUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code})
+}
+
+// Event replay handlers
+func handleListEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	values := r.URL.Query()
+	query := EventQuery{Cursor: values.Get("cursor")}
+	if types := values.Get("type"); types != "" {
+		query.Types = strings.Split(types, ",")
+	}
+	var err error
+	if from := values.Get("from"); from != "" {
+		query.From, err = parseEventTime(from, false)
+	}
+	if to := values.Get("to"); err == nil && to != "" {
+		query.To, err = parseEventTime(to, true)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	query.Limit, _ = strconv.Atoi(values.Get("limit"))
+
+	page, err := events.replay(query)
+	if err != nil {
+		status := http.StatusInternalServerError
+		response := map[string]interface{}{"error": err.Error()}
+		switch {
+		case errors.Is(err, errInvalidCursor):
+			status = http.StatusBadRequest
+		case errors.Is(err, errInvalidEventType):
+			status = http.StatusBadRequest
+			response["types"] = EventTypes
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// Deadlines of calls to the other services. A call also ends with the
+// context it is made in, so a client that disconnects stops the work done
+// for it.
+const (
+	storageCallTimeout = 30 * time.Second
+	oracleCallTimeout  = 5 * time.Second
+	ensCallTimeout     = 10 * time.Second
+)
+
+// Utility functions
+func makeServiceCall(ctx context.Context, timeout time.Duration, method, url string, data interface{}) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var body io.Reader
+	if data != nil {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewBuffer(jsonData)
+	}
+	
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	
+	return result, nil
+}
+
+func getOraclePrice(ctx context.Context, symbol string) (string, error) {
+	resp, err := makeServiceCall(ctx, oracleCallTimeout, "GET", oracleServiceURL+"/api/ftso/price/"+symbol, nil)
 	if err != nil {
 		return "", err
 	}
 	
-	if address, ok := resp["address"].(string); ok {
-		return address, nil
+	if price, ok := resp["price"].(float64); ok {
+		return strconv.FormatFloat(price, 'f', 2, 64), nil
 	}
 	
-	return "", fmt.Errorf("invalid address format")
+	return "0", fmt.Errorf("invalid price format")
+}
+
+// getOracleUSDPrice returns the FTSO price of symbol, such as "ETH/USD".
+// Stale prices are an error.
+func getOracleUSDPrice(ctx context.Context, symbol string) (float64, error) {
+	resp, err := makeServiceCall(ctx, oracleCallTimeout, "GET", oracleServiceURL+"/api/ftso/price/"+symbol, nil)
+	if err != nil {
+		return 0, err
+	}
+	if valid, ok := resp["valid"].(bool); ok && !valid {
+		return 0, fmt.Errorf("price of %s is stale", symbol)
+	}
+	price, ok := resp["price"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("no price for %s", symbol)
+	}
+	return price, nil
 }
 
-func generatePaymentReceipt(paymentID int64, request interface{}) (string, error) {
+// generatePaymentReceipt has storage-worker generate the receipt of a new
+// payment, naming its parties as they were resolved and the transaction that
+// created it on chainID
+func generatePaymentReceipt(ctx context.Context, paymentID, chainID int64, sender, recipient PaymentParty, token, amount, txHash, metadataURI, oraclePrice string) (string, error) {
 	receiptData := map[string]interface{}{
-		"payment_id": paymentID,
-		"format":     "json",
-		"language":   "en",
+		"payment_id":    paymentID,
+		"format":        "json",
+		"language":      "en",
+		"sender":        sender.Address,
+		"sender_ens":    sender.ENSName,
+		"recipient":     recipient.Address,
+		"recipient_ens": recipient.ENSName,
+		"chain_id":      chainID,
+		"tx_hash":       txHash,
+		"token":         token,
+		"amount":        amount,
+		"status":        "pending",
+		"metadata_uri":  metadataURI,
+		"oracle_price":  oraclePrice,
+	}
+	if value, ok := new(big.Int).SetString(amount, 10); ok {
+		receiptData["fee"] = paymentFee(value).String()
 	}
 	
-	resp, err := makeServiceCall("POST", storageServiceURL+"/api/receipts/generate", receiptData)
+	resp, err := makeServiceCall(ctx, storageCallTimeout, "POST", storageServiceURL+"/api/receipts/generate", receiptData)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testNow is when the fixed clocks of tests start
+var testNow = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// setupTestDB opens a fresh payment database in a temporary directory,
+// closed when the test ends
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	t.Setenv("DATABASE_PATH", filepath.Join(t.TempDir(), "payments.db"))
+	require.NoError(t, initPaymentDB())
+	t.Cleanup(func() { closeDB() })
+}
+
+// fixedClock returns a clock stopped at at, and the time it reads, which
+// tests move to let time pass
+func fixedClock(at time.Time) (func() time.Time, *time.Time) {
+	now := at
+	return func() time.Time { return now }, &now
+}
+
+// setGlobal sets a package global, such as the service a handler uses, for
+// the rest of the test
+func setGlobal[T any](t *testing.T, global *T, value T) {
+	previous := *global
+	*global = value
+	t.Cleanup(func() { *global = previous })
+}
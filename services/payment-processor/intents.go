@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// Payment intents let a sender sign a payment now and have it executed
+// later. The intent is EIP-712 typed data bound to PaymentCore on one chain.
+// A signed intent is verified and stored until its payment is executed or
+// its deadline passes. Intents from smart accounts are verified with
+// ERC-1271 when the chain is reachable.
+
+// Payment intent statuses. A signed intent past its deadline is reported as
+// expired.
+const (
+	IntentSigned   = "signed"
+	IntentExecuted = "executed"
+	IntentExpired  = "expired"
+)
+
+// defaultIntentLifetime is how long an intent is valid when no deadline is
+// requested
+const defaultIntentLifetime = 24 * time.Hour
+
+// erc1271MagicValue is returned by isValidSignature for a valid signature
+var erc1271MagicValue = [4]byte{0x16, 0x26, 0xba, 0x7e}
+
+var erc1271ABI = mustParseABI(`[
+	{"type":"function","name":"isValidSignature","stateMutability":"view","inputs":[{"name":"hash","type":"bytes32"},{"name":"signature","type":"bytes"}],"outputs":[{"name":"","type":"bytes4"}]}
+]`)
+
+// paymentIntentType is the EIP-712 type of a payment intent
+var paymentIntentType = []apitypes.Type{
+	{Name: "sender", Type: "address"},
+	{Name: "recipient", Type: "address"},
+	{Name: "token", Type: "address"},
+	{Name: "amount", Type: "uint256"},
+	{Name: "metadataURI", Type: "string"},
+	{Name: "nonce", Type: "uint256"},
+	{Name: "deadline", Type: "uint256"},
+}
+
+var (
+	errInvalidSignature = errors.New("signature does not match the intent's sender")
+	errIntentExpired    = errors.New("intent deadline has passed")
+	errIntentUsed       = errors.New("intent has already been submitted")
+	errIntentNotFound   = errors.New("intent not found")
+)
+
+// intents is nil when payment intents are not configured
+var intents *intentService
+
+// intentService builds and verifies the payment intents of one chain. chain
+// is nil when no RPC endpoint is configured, and then only EOA signatures
+// are accepted.
+type intentService struct {
+	chain       chainReader
+	chainID     *big.Int
+	paymentCore common.Address
+	now         func() time.Time
+}
+
+// PaymentIntent is a payment the sender authorises by signing it. Nonce
+// makes every intent unique; Deadline is a unix timestamp.
+type PaymentIntent struct {
+	Sender      string `json:"sender"`
+	Recipient   string `json:"recipient"`
+	Token       string `json:"token"`
+	Amount      string `json:"amount"`
+	MetadataURI string `json:"metadata_uri"`
+	Nonce       string `json:"nonce"`
+	Deadline    int64  `json:"deadline"`
+}
+
+// IntentRecord is a verified intent and what became of it. ID is the hex
+// EIP-712 digest of the intent.
+type IntentRecord struct {
+	ID         string        `json:"intent_id"`
+	ChainID    int64         `json:"chain_id"`
+	Intent     PaymentIntent `json:"intent"`
+	Signature  string        `json:"signature"`
+	Status     string        `json:"status"`
+	TxHash     string        `json:"tx_hash,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	ExecutedAt *time.Time    `json:"executed_at,omitempty"`
+}
+
+// validatePayment checks the fields a payment URI needs: the recipient,
+// token and amount
+func (i *PaymentIntent) validatePayment() error {
+	if i.Recipient == "" || i.Token == "" || i.Amount == "" {
+		return errors.New("recipient, token and amount are required")
+	}
+	for _, address := range []string{i.Recipient, i.Token} {
+		if !common.IsHexAddress(address) {
+			return fmt.Errorf("invalid address %q", address)
+		}
+	}
+	if amount, ok := new(big.Int).SetString(i.Amount, 10); !ok || amount.Sign() <= 0 {
+		return fmt.Errorf("invalid amount %q", i.Amount)
+	}
+	return nil
+}
+
+// validate checks the intent's payment, sender, nonce and deadline
+func (i *PaymentIntent) validate() error {
+	if !common.IsHexAddress(i.Sender) {
+		return fmt.Errorf("invalid sender %q", i.Sender)
+	}
+	if err := i.validatePayment(); err != nil {
+		return err
+	}
+	if nonce, ok := new(big.Int).SetString(i.Nonce, 10); !ok || nonce.Sign() < 0 {
+		return fmt.Errorf("invalid nonce %q", i.Nonce)
+	}
+	if i.Deadline <= 0 {
+		return errors.New("deadline is required")
+	}
+	return nil
+}
+
+// create fills in a random nonce, and a deadline when none is given, and
+// returns the intent ready to be signed
+func (s *intentService) create(intent PaymentIntent) (*PaymentIntent, error) {
+	nonce, err := rand.Int(rand.Reader, math.MaxBig256)
+	if err != nil {
+		return nil, err
+	}
+	intent.Nonce = nonce.String()
+	if intent.Deadline == 0 {
+		intent.Deadline = s.now().Add(defaultIntentLifetime).Unix()
+	}
+	if err := intent.validate(); err != nil {
+		return nil, err
+	}
+	if intent.Deadline <= s.now().Unix() {
+		return nil, errIntentExpired
+	}
+	return &intent, nil
+}
+
+// typedData returns the EIP-712 typed data a wallet signs for the intent
+// with eth_signTypedData_v4
+func (s *intentService) typedData(intent *PaymentIntent) apitypes.TypedData {
+	return apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+				{Name: "verifyingContract", Type: "address"},
+			},
+			"PaymentIntent": paymentIntentType,
+		},
+		PrimaryType: "PaymentIntent",
+		Domain: apitypes.TypedDataDomain{
+			Name:              "CrossPay",
+			Version:           "1",
+			ChainId:           (*math.HexOrDecimal256)(s.chainID),
+			VerifyingContract: s.paymentCore.Hex(),
+		},
+		Message: apitypes.TypedDataMessage{
+			"sender":      common.HexToAddress(intent.Sender).Hex(),
+			"recipient":   common.HexToAddress(intent.Recipient).Hex(),
+			"token":       common.HexToAddress(intent.Token).Hex(),
+			"amount":      intent.Amount,
+			"metadataURI": intent.MetadataURI,
+			"nonce":       intent.Nonce,
+			"deadline":    fmt.Sprint(intent.Deadline),
+		},
+	}
+}
+
+// digest returns the EIP-712 hash the sender signs
+func (s *intentService) digest(intent *PaymentIntent) (common.Hash, error) {
+	hash, _, err := apitypes.TypedDataAndHash(s.typedData(intent))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return common.BytesToHash(hash), nil
+}
+
+// paymentURI returns the EIP-681 URI that calls PaymentCore.createPayment
+// for the intent. Native payments carry the amount plus fee as the value;
+// token payments need PaymentCore approved for it beforehand.
+func (s *intentService) paymentURI(intent *PaymentIntent) string {
+	amount, _ := new(big.Int).SetString(intent.Amount, 10)
+
+	params := []string{
+		"address=" + common.HexToAddress(intent.Recipient).Hex(),
+		"address=" + common.HexToAddress(intent.Token).Hex(),
+		"uint256=" + amount.String(),
+		"string=" + url.QueryEscape(intent.MetadataURI),
+		"string=",
+		"string=",
+	}
+	if common.HexToAddress(intent.Token) == (common.Address{}) {
+		fee := new(big.Int).Mul(amount, big.NewInt(paymentFeeBasisPoints))
+		fee.Div(fee, big.NewInt(10000))
+		params = append(params, "value="+new(big.Int).Add(amount, fee).String())
+	}
+	return fmt.Sprintf("ethereum:%s@%s/createPayment?%s", s.paymentCore.Hex(), s.chainID, strings.Join(params, "&"))
+}
+
+// verify checks that signature is the sender's signature of the intent and
+// that the intent is still valid and unused, then stores it as signed
+func (s *intentService) verify(ctx context.Context, intent *PaymentIntent, signature string) (*IntentRecord, error) {
+	if err := intent.validate(); err != nil {
+		return nil, err
+	}
+	now := s.now().UTC()
+	if intent.Deadline <= now.Unix() {
+		return nil, errIntentExpired
+	}
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	digest, err := s.digest(intent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash intent: %w", err)
+	}
+	if err := s.checkSignature(ctx, common.HexToAddress(intent.Sender), digest, sig); err != nil {
+		return nil, err
+	}
+
+	record := &IntentRecord{
+		ID:        digest.Hex(),
+		ChainID:   s.chainID.Int64(),
+		Intent:    *intent,
+		Signature: hexutil.Encode(sig),
+		Status:    IntentSigned,
+		CreatedAt: now,
+	}
+	record.Intent.Sender = strings.ToLower(intent.Sender)
+	record.Intent.Recipient = strings.ToLower(intent.Recipient)
+	record.Intent.Token = strings.ToLower(intent.Token)
+
+	result, err := db.Exec(`INSERT OR IGNORE INTO payment_intents (id, chain_id, sender, recipient, token, amount, metadata_uri, nonce, deadline, signature, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.ID, record.ChainID, record.Intent.Sender, record.Intent.Recipient, record.Intent.Token, record.Intent.Amount,
+		record.Intent.MetadataURI, record.Intent.Nonce, record.Intent.Deadline, record.Signature, record.Status, record.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store intent: %w", err)
+	}
+	if stored, _ := result.RowsAffected(); stored == 0 {
+		return nil, errIntentUsed
+	}
+	return record, nil
+}
+
+// checkSignature accepts an ECDSA signature by sender, or one the sender's
+// contract accepts through ERC-1271
+func (s *intentService) checkSignature(ctx context.Context, sender common.Address, digest common.Hash, sig []byte) error {
+	if len(sig) == crypto.SignatureLength {
+		recoverable := append([]byte(nil), sig...)
+		if recoverable[crypto.RecoveryIDOffset] >= 27 {
+			recoverable[crypto.RecoveryIDOffset] -= 27
+		}
+		if pub, err := crypto.SigToPub(digest.Bytes(), recoverable); err == nil && crypto.PubkeyToAddress(*pub) == sender {
+			return nil
+		}
+	}
+	if s.chain == nil {
+		return errInvalidSignature
+	}
+
+	data, err := erc1271ABI.Pack("isValidSignature", digest, sig)
+	if err != nil {
+		return err
+	}
+	out, err := s.chain.CallContract(ctx, ethereum.CallMsg{To: &sender, Data: data}, nil)
+	if err != nil || len(out) < 4 {
+		// Accounts without code, or that revert, do not accept the signature
+		return errInvalidSignature
+	}
+	var magic [4]byte
+	copy(magic[:], out[:4])
+	if magic != erc1271MagicValue {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// markExecuted records the transaction that executed a signed intent
+func (s *intentService) markExecuted(id, txHash string) (*IntentRecord, error) {
+	record, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	switch record.Status {
+	case IntentExecuted:
+		return nil, errIntentUsed
+	case IntentExpired:
+		return nil, errIntentExpired
+	}
+
+	now := s.now().UTC()
+	_, err = db.Exec(`UPDATE payment_intents SET status = ?, tx_hash = ?, executed_at = ? WHERE id = ?`,
+		IntentExecuted, txHash, now, record.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update intent: %w", err)
+	}
+	record.Status, record.TxHash, record.ExecutedAt = IntentExecuted, txHash, &now
+	return record, nil
+}
+
+// get returns the stored intent with id
+func (s *intentService) get(id string) (*IntentRecord, error) {
+	record := &IntentRecord{}
+	var txHash sql.NullString
+	var executedAt sql.NullTime
+	err := db.QueryRow(`SELECT id, chain_id, sender, recipient, token, amount, metadata_uri, nonce, deadline, signature, status, tx_hash, created_at, executed_at FROM payment_intents WHERE id = ?`,
+		common.HexToHash(id).Hex()).Scan(&record.ID, &record.ChainID, &record.Intent.Sender, &record.Intent.Recipient,
+		&record.Intent.Token, &record.Intent.Amount, &record.Intent.MetadataURI, &record.Intent.Nonce, &record.Intent.Deadline,
+		&record.Signature, &record.Status, &txHash, &record.CreatedAt, &executedAt)
+	if err == sql.ErrNoRows {
+		return nil, errIntentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	record.TxHash = txHash.String
+	if executedAt.Valid {
+		record.ExecutedAt = &executedAt.Time
+	}
+	if record.Status == IntentSigned && record.Intent.Deadline <= s.now().Unix() {
+		record.Status = IntentExpired
+	}
+	return record, nil
+}
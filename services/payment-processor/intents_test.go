@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupIntentTest(t *testing.T) *intentService {
+	setupTestDB(t)
+
+	return &intentService{
+		chainID:     big.NewInt(4202),
+		paymentCore: common.HexToAddress("0x00000000000000000000000000000000000000c0"),
+		now:         time.Now,
+	}
+}
+
+// signIntent creates an intent from sender and signs it the way
+// eth_signTypedData_v4 does, with v as 27 or 28
+func signIntent(t *testing.T, service *intentService, sender common.Address, sign func(common.Hash) []byte) (*PaymentIntent, string) {
+	intent, err := service.create(PaymentIntent{
+		Sender:      sender.Hex(),
+		Recipient:   "0x00000000000000000000000000000000000000b2",
+		Token:       "0x0000000000000000000000000000000000000000",
+		Amount:      "1000000",
+		MetadataURI: "ipfs://QmTest",
+	})
+	require.NoError(t, err)
+	digest, err := service.digest(intent)
+	require.NoError(t, err)
+	return intent, hexutil.Encode(sign(digest))
+}
+
+func keySigner(t *testing.T) (common.Address, func(common.Hash) []byte) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	return crypto.PubkeyToAddress(key.PublicKey), func(digest common.Hash) []byte {
+		sig, err := crypto.Sign(digest.Bytes(), key)
+		require.NoError(t, err)
+		sig[crypto.RecoveryIDOffset] += 27
+		return sig
+	}
+}
+
+func TestPaymentIntents(t *testing.T) {
+	t.Run("should accept an intent signed by its sender", func(t *testing.T) {
+		service := setupIntentTest(t)
+		sender, sign := keySigner(t)
+		intent, signature := signIntent(t, service, sender, sign)
+
+		record, err := service.verify(context.Background(), intent, signature)
+		require.NoError(t, err)
+		assert.Equal(t, IntentSigned, record.Status)
+
+		stored, err := service.get(record.ID)
+		require.NoError(t, err)
+		assert.Equal(t, strings.ToLower(sender.Hex()), stored.Intent.Sender)
+		assert.Equal(t, intent.Nonce, stored.Intent.Nonce)
+		assert.Equal(t, signature, stored.Signature)
+	})
+
+	t.Run("should reject a tampered intent", func(t *testing.T) {
+		service := setupIntentTest(t)
+		sender, sign := keySigner(t)
+		intent, signature := signIntent(t, service, sender, sign)
+
+		intent.Amount = "2000000"
+		_, err := service.verify(context.Background(), intent, signature)
+		assert.ErrorIs(t, err, errInvalidSignature)
+	})
+
+	t.Run("should reject an intent signed by someone else", func(t *testing.T) {
+		service := setupIntentTest(t)
+		sender, _ := keySigner(t)
+		_, otherSign := keySigner(t)
+		intent, signature := signIntent(t, service, sender, otherSign)
+
+		_, err := service.verify(context.Background(), intent, signature)
+		assert.ErrorIs(t, err, errInvalidSignature)
+	})
+
+	t.Run("should not accept the same intent twice", func(t *testing.T) {
+		service := setupIntentTest(t)
+		sender, sign := keySigner(t)
+		intent, signature := signIntent(t, service, sender, sign)
+
+		_, err := service.verify(context.Background(), intent, signature)
+		require.NoError(t, err)
+		_, err = service.verify(context.Background(), intent, signature)
+		assert.ErrorIs(t, err, errIntentUsed)
+	})
+
+	t.Run("should reject and report intents past their deadline", func(t *testing.T) {
+		service := setupIntentTest(t)
+		sender, sign := keySigner(t)
+		intent, signature := signIntent(t, service, sender, sign)
+
+		record, err := service.verify(context.Background(), intent, signature)
+		require.NoError(t, err)
+
+		service.now = func() time.Time { return time.Now().Add(25 * time.Hour) }
+		_, err = service.verify(context.Background(), intent, signature)
+		assert.ErrorIs(t, err, errIntentExpired)
+
+		stored, err := service.get(record.ID)
+		require.NoError(t, err)
+		assert.Equal(t, IntentExpired, stored.Status)
+		_, err = service.markExecuted(record.ID, common.HexToHash("0x01").Hex())
+		assert.ErrorIs(t, err, errIntentExpired)
+	})
+
+	t.Run("should record the execution of a signed intent once", func(t *testing.T) {
+		service := setupIntentTest(t)
+		sender, sign := keySigner(t)
+		intent, signature := signIntent(t, service, sender, sign)
+		record, err := service.verify(context.Background(), intent, signature)
+		require.NoError(t, err)
+
+		txHash := common.HexToHash("0xfeed").Hex()
+		executed, err := service.markExecuted(record.ID, txHash)
+		require.NoError(t, err)
+		assert.Equal(t, IntentExecuted, executed.Status)
+
+		stored, err := service.get(record.ID)
+		require.NoError(t, err)
+		assert.Equal(t, IntentExecuted, stored.Status)
+		assert.Equal(t, txHash, stored.TxHash)
+		assert.NotNil(t, stored.ExecutedAt)
+
+		_, err = service.markExecuted(record.ID, txHash)
+		assert.ErrorIs(t, err, errIntentUsed)
+	})
+
+	t.Run("should accept smart account signatures through ERC-1271", func(t *testing.T) {
+		service := setupIntentTest(t)
+		account := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+		accountSignature := []byte{0xde, 0xad, 0xbe, 0xef}
+		service.chain = &fakeChain{call: func(msg ethereum.CallMsg) ([]byte, error) {
+			if *msg.To != account {
+				return nil, errors.New("no code")
+			}
+			args, err := erc1271ABI.Methods["isValidSignature"].Inputs.Unpack(msg.Data[4:])
+			require.NoError(t, err)
+			if string(args[1].([]byte)) != string(accountSignature) {
+				return erc1271ABI.Methods["isValidSignature"].Outputs.Pack([4]byte{})
+			}
+			return erc1271ABI.Methods["isValidSignature"].Outputs.Pack(erc1271MagicValue)
+		}}
+
+		intent, signature := signIntent(t, service, account, func(common.Hash) []byte { return accountSignature })
+		_, err := service.verify(context.Background(), intent, signature)
+		require.NoError(t, err)
+
+		intent, _ = signIntent(t, service, account, func(common.Hash) []byte { return accountSignature })
+		_, err = service.verify(context.Background(), intent, "0x01")
+		assert.ErrorIs(t, err, errInvalidSignature)
+	})
+}
+
+func TestPaymentURI(t *testing.T) {
+	service := &intentService{
+		chainID:     big.NewInt(4202),
+		paymentCore: common.HexToAddress("0x00000000000000000000000000000000000000c0"),
+	}
+	intent := &PaymentIntent{
+		Recipient:   "0x00000000000000000000000000000000000000b2",
+		Token:       "0x0000000000000000000000000000000000000000",
+		Amount:      "1000000",
+		MetadataURI: "ipfs://QmTest",
+	}
+
+	t.Run("should call createPayment with the fee added to native payments", func(t *testing.T) {
+		assert.Equal(t,
+			"ethereum:0x00000000000000000000000000000000000000C0@4202/createPayment?address=0x00000000000000000000000000000000000000b2&address=0x0000000000000000000000000000000000000000&uint256=1000000&string=ipfs%3A%2F%2FQmTest&string=&string=&value=1001000",
+			service.paymentURI(intent))
+	})
+
+	t.Run("should send no value with token payments", func(t *testing.T) {
+		token := *intent
+		token.Token = "0x00000000000000000000000000000000000000d4"
+		assert.NotContains(t, service.paymentURI(&token), "value=")
+	})
+}
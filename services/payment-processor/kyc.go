@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// KYC verifies the people behind sender addresses with an external provider.
+// Enforcement tiers map a payment's USD value, priced through the FTSO, to
+// the verification level its sender needs. Verification results arrive by
+// webhook, and pending verifications are also polled in case a webhook is
+// missed.
+
+// KYC modes. In warn mode payments from senders without the required
+// verification go through and are logged; in enforce mode they are rejected.
+const (
+	KYCOff     = "off"
+	KYCWarn    = "warn"
+	KYCEnforce = "enforce"
+)
+
+// KYC verification statuses. A verification the provider asks to be
+// resubmitted is retry; rejected is final.
+const (
+	KYCUnverified = "unverified"
+	KYCPending    = "pending"
+	KYCApproved   = "approved"
+	KYCRetry      = "retry"
+	KYCRejected   = "rejected"
+)
+
+var (
+	errKYCRequired         = errors.New("sender must complete KYC verification")
+	errKYCNotFound         = errors.New("no KYC verification for address")
+	errUnknownKYCLevel     = errors.New("unknown KYC level")
+	errInvalidKYCSignature = errors.New("invalid webhook signature")
+)
+
+// kyc is the KYC service payments are checked against. It is off when no
+// provider is configured.
+var kyc *kycService
+
+// kycProvider is a KYC provider such as Sumsub or Persona. Levels are the
+// provider's names for its verification flows.
+type kycProvider interface {
+	name() string
+	// createApplicant starts verifying address at level and returns the
+	// provider's id for the applicant
+	createApplicant(ctx context.Context, address, level string) (string, error)
+	// session returns what the user's browser needs to go through the
+	// provider's flow
+	session(ctx context.Context, applicantID, address, level string) (*KYCSession, error)
+	// review polls the applicant's review
+	review(ctx context.Context, applicantID string) (*kycReview, error)
+	// parseWebhook checks a webhook's signature and returns the review it
+	// reports, or nil for events that do not change a review
+	parseWebhook(header http.Header, body []byte) (*kycReview, error)
+}
+
+// kycReview is a provider's verdict on an applicant
+type kycReview struct {
+	ApplicantID string
+	Status      string
+	Reason      string
+}
+
+// KYCSession lets the user complete verification, either with the
+// provider's SDK and an access token or on a hosted page
+type KYCSession struct {
+	Provider    string `json:"provider"`
+	ApplicantID string `json:"applicant_id"`
+	Level       string `json:"level"`
+	AccessToken string `json:"access_token,omitempty"`
+	URL         string `json:"url,omitempty"`
+}
+
+// KYCTier requires the level of payments worth more than ThresholdUSD
+type KYCTier struct {
+	Level        string  `json:"level"`
+	ThresholdUSD float64 `json:"threshold_usd"`
+}
+
+// KYCVerification is an address's verification. Level is the one last
+// started; ApprovedLevel the highest tier approved so far, which keeps
+// covering payments while a higher level is reviewed.
+type KYCVerification struct {
+	Address       string     `json:"address"`
+	Provider      string     `json:"provider"`
+	ApplicantID   string     `json:"applicant_id"`
+	Level         string     `json:"level"`
+	Status        string     `json:"status"`
+	ApprovedLevel string     `json:"approved_level,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	ApprovedAt    *time.Time `json:"approved_at,omitempty"`
+}
+
+// KYCRequirement is what a payment asks of its sender. ValueUSD is nil when
+// the payment could not be priced.
+type KYCRequirement struct {
+	Sender    string   `json:"sender"`
+	ValueUSD  *float64 `json:"value_usd"`
+	Level     string   `json:"required_level,omitempty"`
+	Status    string   `json:"status"`
+	Satisfied bool     `json:"satisfied"`
+}
+
+// kycService checks payments against the tiers and tracks verifications
+type kycService struct {
+	mode         string
+	provider     kycProvider
+	tiers        []KYCTier
+	pollInterval time.Duration
+	pricer       *tokenPricer
+	now          func() time.Time
+}
+
+// parseKYCTiers reads tiers written as level:threshold pairs, such as
+// "basic:1000,enhanced:10000", and orders them by threshold
+func parseKYCTiers(value string) ([]KYCTier, error) {
+	var tiers []KYCTier
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		separator := strings.LastIndex(entry, ":")
+		if separator <= 0 {
+			return nil, fmt.Errorf("invalid KYC tier %q, expected level:threshold", entry)
+		}
+		threshold, err := strconv.ParseFloat(entry[separator+1:], 64)
+		if err != nil || threshold < 0 {
+			return nil, fmt.Errorf("invalid threshold in KYC tier %q", entry)
+		}
+		tiers = append(tiers, KYCTier{Level: entry[:separator], ThresholdUSD: threshold})
+	}
+	sort.SliceStable(tiers, func(i, j int) bool { return tiers[i].ThresholdUSD < tiers[j].ThresholdUSD })
+	return tiers, nil
+}
+
+// rank returns the position of level among the tiers, -1 when it is not one
+func (s *kycService) rank(level string) int {
+	for i, tier := range s.tiers {
+		if tier.Level == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// requiredTier returns the tier a payment worth valueUSD needs, or -1 when
+// it needs none. Payments that could not be priced need the lowest tier.
+func (s *kycService) requiredTier(valueUSD *float64) int {
+	if valueUSD == nil {
+		if len(s.tiers) == 0 {
+			return -1
+		}
+		return 0
+	}
+	required := -1
+	for i, tier := range s.tiers {
+		if *valueUSD > tier.ThresholdUSD {
+			required = i
+		}
+	}
+	return required
+}
+
+// check works out the verification a payment of amount of the token needs
+// from sender. It returns errKYCRequired only in enforce mode; in warn mode
+// the unmet requirement is logged and returned.
+func (s *kycService) check(ctx context.Context, chainID int64, sender, tokenAddress, amount string) (*KYCRequirement, error) {
+	if s.mode == KYCOff {
+		return nil, nil
+	}
+
+	requirement := &KYCRequirement{
+		Sender:   strings.ToLower(sender),
+		ValueUSD: s.pricer.valueUSD(ctx, chainID, tokenAddress, amount),
+		Status:   KYCUnverified,
+	}
+	required := s.requiredTier(requirement.ValueUSD)
+	if required < 0 {
+		requirement.Satisfied = true
+		return requirement, nil
+	}
+	requirement.Level = s.tiers[required].Level
+
+	if common.IsHexAddress(sender) {
+		verification, err := getKYCVerification(sender)
+		switch {
+		case err == nil:
+			requirement.Status = verification.Status
+			requirement.Satisfied = verification.ApprovedLevel != "" && s.rank(verification.ApprovedLevel) >= required
+		case !errors.Is(err, errKYCNotFound):
+			return nil, err
+		}
+	}
+	if requirement.Satisfied {
+		return requirement, nil
+	}
+
+	err := fmt.Errorf("%w: level %s is required", errKYCRequired, requirement.Level)
+	if s.mode == KYCEnforce {
+		return requirement, err
+	}
+	log.Printf("Warning: %s: %v", sender, err)
+	return requirement, nil
+}
+
+// start begins verifying address at level, the lowest tier when empty. An
+// applicant already started at that level is reused, so the user can pick
+// up where they left off.
+func (s *kycService) start(ctx context.Context, address, level string) (*KYCVerification, *KYCSession, error) {
+	if level == "" && len(s.tiers) > 0 {
+		level = s.tiers[0].Level
+	}
+	if s.rank(level) < 0 {
+		return nil, nil, fmt.Errorf("%w %q", errUnknownKYCLevel, level)
+	}
+	address = strings.ToLower(address)
+
+	verification, err := getKYCVerification(address)
+	if err != nil && !errors.Is(err, errKYCNotFound) {
+		return nil, nil, err
+	}
+	now := s.now().UTC()
+	if verification == nil {
+		verification = &KYCVerification{Address: address, CreatedAt: now}
+	}
+	if verification.ApplicantID == "" || verification.Level != level || verification.Provider != s.provider.name() {
+		applicantID, err := s.provider.createApplicant(ctx, address, level)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create applicant: %w", err)
+		}
+		verification.Provider = s.provider.name()
+		verification.ApplicantID = applicantID
+		verification.Level = level
+		verification.Status = KYCPending
+		verification.Reason = ""
+		verification.UpdatedAt = now
+		if err := storeKYCVerification(verification); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	session, err := s.provider.session(ctx, verification.ApplicantID, address, level)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start verification session: %w", err)
+	}
+	return verification, session, nil
+}
+
+// apply records a provider's review of an applicant
+func (s *kycService) apply(review *kycReview) (*KYCVerification, error) {
+	verification, err := getKYCVerificationByApplicant(review.ApplicantID)
+	if err != nil {
+		return nil, err
+	}
+	if verification.Status == review.Status && verification.Reason == review.Reason {
+		return verification, nil
+	}
+
+	now := s.now().UTC()
+	verification.Status = review.Status
+	verification.Reason = review.Reason
+	verification.UpdatedAt = now
+	if review.Status == KYCApproved && s.rank(verification.Level) >= s.rank(verification.ApprovedLevel) {
+		verification.ApprovedLevel = verification.Level
+		verification.ApprovedAt = &now
+	}
+	if err := storeKYCVerification(verification); err != nil {
+		return nil, err
+	}
+	log.Printf("KYC verification of %s at level %s is %s", verification.Address, verification.Level, verification.Status)
+	return verification, nil
+}
+
+// refresh polls the provider for a pending verification's review
+func (s *kycService) refresh(ctx context.Context, verification *KYCVerification) (*KYCVerification, error) {
+	review, err := s.provider.review(ctx, verification.ApplicantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to poll verification of %s: %w", verification.Address, err)
+	}
+	review.ApplicantID = verification.ApplicantID
+	return s.apply(review)
+}
+
+// track polls the pending verifications every pollInterval until ctx is
+// done
+func (s *kycService) track(ctx context.Context) {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			verifications, err := queryKYCVerifications(`WHERE status = ? AND provider = ? ORDER BY updated_at`, KYCPending, s.provider.name())
+			if err != nil {
+				log.Printf("Failed to load pending KYC verifications: %v", err)
+				continue
+			}
+			for _, verification := range verifications {
+				if _, err := s.refresh(ctx, verification); err != nil {
+					log.Printf("Failed to track KYC verification: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func storeKYCVerification(v *KYCVerification) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO kyc_verifications (address, provider, applicant_id, level, status, approved_level, reason, created_at, updated_at, approved_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		v.Address, v.Provider, v.ApplicantID, v.Level, v.Status, v.ApprovedLevel, v.Reason, v.CreatedAt, v.UpdatedAt, v.ApprovedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store KYC verification of %s: %w", v.Address, err)
+	}
+	return nil
+}
+
+// getKYCVerification returns the verification of address
+func getKYCVerification(address string) (*KYCVerification, error) {
+	verifications, err := queryKYCVerifications(`WHERE address = ?`, strings.ToLower(address))
+	if err != nil {
+		return nil, err
+	}
+	if len(verifications) == 0 {
+		return nil, errKYCNotFound
+	}
+	return verifications[0], nil
+}
+
+// getKYCVerificationByApplicant returns the verification of the provider's
+// applicant
+func getKYCVerificationByApplicant(applicantID string) (*KYCVerification, error) {
+	verifications, err := queryKYCVerifications(`WHERE applicant_id = ?`, applicantID)
+	if err != nil {
+		return nil, err
+	}
+	if len(verifications) == 0 {
+		return nil, fmt.Errorf("%w: applicant %s", errKYCNotFound, applicantID)
+	}
+	return verifications[0], nil
+}
+
+// queryKYCVerifications returns the verifications matching where
+func queryKYCVerifications(where string, args ...interface{}) ([]*KYCVerification, error) {
+	rows, err := db.Query(`SELECT address, provider, applicant_id, level, status, approved_level, reason, created_at, updated_at, approved_at FROM kyc_verifications `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var verifications []*KYCVerification
+	for rows.Next() {
+		v := &KYCVerification{}
+		var approvedLevel, reason sql.NullString
+		var approvedAt sql.NullTime
+		err := rows.Scan(&v.Address, &v.Provider, &v.ApplicantID, &v.Level, &v.Status, &approvedLevel, &reason, &v.CreatedAt, &v.UpdatedAt, &approvedAt)
+		if err != nil {
+			return nil, err
+		}
+		v.ApprovedLevel, v.Reason = approvedLevel.String, reason.String
+		if approvedAt.Valid {
+			v.ApprovedAt = &approvedAt.Time
+		}
+		verifications = append(verifications, v)
+	}
+	return verifications, rows.Err()
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KYC providers
+const (
+	KYCProviderSumsub  = "sumsub"
+	KYCProviderPersona = "persona"
+)
+
+// personaWebhookTolerance is how old a Persona webhook's timestamp may be
+const personaWebhookTolerance = 5 * time.Minute
+
+// kycHTTPError is a provider API call that did not succeed
+type kycHTTPError struct {
+	Status int
+	Body   string
+}
+
+func (e *kycHTTPError) Error() string {
+	return fmt.Sprintf("provider answered %d: %s", e.Status, e.Body)
+}
+
+// doKYCRequest sends req and decodes a successful JSON answer into result
+func doKYCRequest(client *http.Client, req *http.Request, result interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &kycHTTPError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
+
+// sumsubProvider verifies applicants with Sumsub. Levels are Sumsub level
+// names and applicants are keyed by address as their external user id.
+type sumsubProvider struct {
+	apiURL        string
+	appToken      string
+	secretKey     string
+	webhookSecret string
+	client        *http.Client
+	now           func() time.Time
+}
+
+// sumsubReviewResult is the verdict part of a Sumsub review
+type sumsubReviewResult struct {
+	ReviewAnswer      string   `json:"reviewAnswer"`
+	ReviewRejectType  string   `json:"reviewRejectType"`
+	ModerationComment string   `json:"moderationComment"`
+	RejectLabels      []string `json:"rejectLabels"`
+}
+
+// status maps a Sumsub review to a verification status
+func (r *sumsubReviewResult) status(reviewStatus string) (string, string) {
+	if reviewStatus != "completed" || r == nil {
+		return KYCPending, ""
+	}
+	reason := r.ModerationComment
+	if reason == "" {
+		reason = strings.Join(r.RejectLabels, ", ")
+	}
+	switch {
+	case r.ReviewAnswer == "GREEN":
+		return KYCApproved, ""
+	case r.ReviewAnswer == "RED" && r.ReviewRejectType == "RETRY":
+		return KYCRetry, reason
+	case r.ReviewAnswer == "RED":
+		return KYCRejected, reason
+	}
+	return KYCPending, ""
+}
+
+func (p *sumsubProvider) name() string { return KYCProviderSumsub }
+
+// request sends a signed API request. The signature is the hex HMAC-SHA256
+// of the timestamp, method, path with query and body.
+func (p *sumsubProvider) request(ctx context.Context, method, path string, body, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.apiURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(p.now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(p.secretKey))
+	mac.Write([]byte(timestamp + method + path))
+	mac.Write(payload)
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("X-App-Token", p.appToken)
+	req.Header.Set("X-App-Access-Ts", timestamp)
+	req.Header.Set("X-App-Access-Sig", hex.EncodeToString(mac.Sum(nil)))
+	return doKYCRequest(p.client, req, result)
+}
+
+// createApplicant creates the address's applicant at level. An address that
+// already has one is moved to level instead, since Sumsub keeps one
+// applicant per external user id.
+func (p *sumsubProvider) createApplicant(ctx context.Context, address, level string) (string, error) {
+	var applicant struct {
+		ID string `json:"id"`
+	}
+	err := p.request(ctx, http.MethodPost, "/resources/applicants?levelName="+url.QueryEscape(level),
+		map[string]string{"externalUserId": address}, &applicant)
+	var httpErr *kycHTTPError
+	if errors.As(err, &httpErr) && httpErr.Status == http.StatusConflict {
+		if err := p.request(ctx, http.MethodGet, "/resources/applicants/-;externalUserId="+url.PathEscape(address)+"/one", nil, &applicant); err != nil {
+			return "", err
+		}
+		err = p.request(ctx, http.MethodPost, "/resources/applicants/"+url.PathEscape(applicant.ID)+"/moveToLevel?name="+url.QueryEscape(level), nil, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	return applicant.ID, nil
+}
+
+// session returns an access token for the Sumsub WebSDK
+func (p *sumsubProvider) session(ctx context.Context, applicantID, address, level string) (*KYCSession, error) {
+	var token struct {
+		Token string `json:"token"`
+	}
+	path := "/resources/accessTokens?userId=" + url.QueryEscape(address) + "&levelName=" + url.QueryEscape(level)
+	if err := p.request(ctx, http.MethodPost, path, nil, &token); err != nil {
+		return nil, err
+	}
+	return &KYCSession{Provider: p.name(), ApplicantID: applicantID, Level: level, AccessToken: token.Token}, nil
+}
+
+func (p *sumsubProvider) review(ctx context.Context, applicantID string) (*kycReview, error) {
+	var applicant struct {
+		Review struct {
+			ReviewStatus string              `json:"reviewStatus"`
+			ReviewResult *sumsubReviewResult `json:"reviewResult"`
+		} `json:"review"`
+	}
+	if err := p.request(ctx, http.MethodGet, "/resources/applicants/"+url.PathEscape(applicantID)+"/one", nil, &applicant); err != nil {
+		return nil, err
+	}
+	status, reason := applicant.Review.ReviewResult.status(applicant.Review.ReviewStatus)
+	return &kycReview{ApplicantID: applicantID, Status: status, Reason: reason}, nil
+}
+
+// parseWebhook checks X-Payload-Digest, the hex HMAC-SHA256 of the body
+// with the webhook secret
+func (p *sumsubProvider) parseWebhook(header http.Header, body []byte) (*kycReview, error) {
+	if alg := header.Get("X-Payload-Digest-Alg"); alg != "" && alg != "HMAC_SHA256_HEX" {
+		return nil, fmt.Errorf("%w: unsupported digest algorithm %s", errInvalidKYCSignature, alg)
+	}
+	mac := hmac.New(sha256.New, []byte(p.webhookSecret))
+	mac.Write(body)
+	if !hmac.Equal([]byte(header.Get("X-Payload-Digest")), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return nil, errInvalidKYCSignature
+	}
+
+	var event struct {
+		Type         string              `json:"type"`
+		ApplicantID  string              `json:"applicantId"`
+		ReviewStatus string              `json:"reviewStatus"`
+		ReviewResult *sumsubReviewResult `json:"reviewResult"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid webhook: %w", err)
+	}
+	switch event.Type {
+	case "applicantReviewed", "applicantPending", "applicantReset", "applicantOnHold":
+		status, reason := event.ReviewResult.status(event.ReviewStatus)
+		return &kycReview{ApplicantID: event.ApplicantID, Status: status, Reason: reason}, nil
+	}
+	return nil, nil
+}
+
+// personaProvider verifies applicants with Persona inquiries. Levels are
+// inquiry template ids and the address is the inquiry's reference id.
+type personaProvider struct {
+	apiURL        string
+	apiKey        string
+	webhookSecret string
+	client        *http.Client
+	now           func() time.Time
+}
+
+// personaInquiry is the part of a Persona inquiry a review is read from
+type personaInquiry struct {
+	ID         string `json:"id"`
+	Attributes struct {
+		Status string `json:"status"`
+	} `json:"attributes"`
+}
+
+// review maps the inquiry's status to a verification status. Failed and
+// expired inquiries can be started again.
+func (i *personaInquiry) review() *kycReview {
+	review := &kycReview{ApplicantID: i.ID, Status: KYCPending}
+	switch i.Attributes.Status {
+	case "approved":
+		review.Status = KYCApproved
+	case "declined":
+		review.Status, review.Reason = KYCRejected, "inquiry declined"
+	case "failed", "expired":
+		review.Status, review.Reason = KYCRetry, "inquiry "+i.Attributes.Status
+	}
+	return review
+}
+
+func (p *personaProvider) name() string { return KYCProviderPersona }
+
+func (p *personaProvider) request(ctx context.Context, method, path string, body, result interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.apiURL+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	return doKYCRequest(p.client, req, result)
+}
+
+// createApplicant creates an inquiry from the level's template
+func (p *personaProvider) createApplicant(ctx context.Context, address, level string) (string, error) {
+	request := map[string]interface{}{
+		"data": map[string]interface{}{
+			"attributes": map[string]string{
+				"inquiry-template-id": level,
+				"reference-id":        address,
+			},
+		},
+	}
+	var response struct {
+		Data personaInquiry `json:"data"`
+	}
+	if err := p.request(ctx, http.MethodPost, "/inquiries", request, &response); err != nil {
+		return "", err
+	}
+	return response.Data.ID, nil
+}
+
+// session returns a one-time link to the hosted inquiry flow
+func (p *personaProvider) session(ctx context.Context, applicantID, address, level string) (*KYCSession, error) {
+	var response struct {
+		Meta struct {
+			OneTimeLink string `json:"one-time-link"`
+		} `json:"meta"`
+	}
+	if err := p.request(ctx, http.MethodPost, "/inquiries/"+url.PathEscape(applicantID)+"/generate-one-time-link", nil, &response); err != nil {
+		return nil, err
+	}
+	return &KYCSession{Provider: p.name(), ApplicantID: applicantID, Level: level, URL: response.Meta.OneTimeLink}, nil
+}
+
+func (p *personaProvider) review(ctx context.Context, applicantID string) (*kycReview, error) {
+	var response struct {
+		Data personaInquiry `json:"data"`
+	}
+	if err := p.request(ctx, http.MethodGet, "/inquiries/"+url.PathEscape(applicantID), nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Data.review(), nil
+}
+
+// parseWebhook checks Persona-Signature, "t=<unix>,v1=<hex>" where v1 is
+// the HMAC-SHA256 of "<t>.<body>". During secret rotation the header holds
+// several space separated signatures, any of which may match.
+func (p *personaProvider) parseWebhook(header http.Header, body []byte) (*kycReview, error) {
+	valid := false
+	for _, signature := range strings.Fields(header.Get("Persona-Signature")) {
+		var timestamp, v1 string
+		for _, part := range strings.Split(signature, ",") {
+			if key, value, ok := strings.Cut(part, "="); ok {
+				switch key {
+				case "t":
+					timestamp = value
+				case "v1":
+					v1 = value
+				}
+			}
+		}
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || p.now().Sub(time.Unix(unix, 0)).Abs() > personaWebhookTolerance {
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte(p.webhookSecret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		if hmac.Equal([]byte(v1), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, errInvalidKYCSignature
+	}
+
+	var event struct {
+		Data struct {
+			Attributes struct {
+				Name    string `json:"name"`
+				Payload struct {
+					Data struct {
+						Type string `json:"type"`
+						personaInquiry
+					} `json:"data"`
+				} `json:"payload"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid webhook: %w", err)
+	}
+	inquiry := event.Data.Attributes.Payload.Data
+	if inquiry.Type != "inquiry" || !strings.HasPrefix(event.Data.Attributes.Name, "inquiry.") {
+		return nil, nil
+	}
+	return inquiry.personaInquiry.review(), nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	kycSender = "0x00000000000000000000000000000000000000A1"
+	kycUSDC   = "0x00000000000000000000000000000000000000e1"
+)
+
+// fakeKYCProvider hands out applicant ids and records the reviews it is
+// polled for
+type fakeKYCProvider struct {
+	applicants int
+	reviews    map[string]*kycReview
+}
+
+func (p *fakeKYCProvider) name() string { return "fake" }
+
+func (p *fakeKYCProvider) createApplicant(ctx context.Context, address, level string) (string, error) {
+	p.applicants++
+	return fmt.Sprintf("applicant-%d", p.applicants), nil
+}
+
+func (p *fakeKYCProvider) session(ctx context.Context, applicantID, address, level string) (*KYCSession, error) {
+	return &KYCSession{Provider: p.name(), ApplicantID: applicantID, Level: level, AccessToken: "token"}, nil
+}
+
+func (p *fakeKYCProvider) review(ctx context.Context, applicantID string) (*kycReview, error) {
+	review, ok := p.reviews[applicantID]
+	if !ok {
+		return nil, errors.New("unknown applicant")
+	}
+	return review, nil
+}
+
+func (p *fakeKYCProvider) parseWebhook(header http.Header, body []byte) (*kycReview, error) {
+	return nil, nil
+}
+
+func setupKYCTest(t *testing.T, mode string) (*kycService, *fakeKYCProvider) {
+	setupTestDB(t)
+
+	tiers, err := parseKYCTiers("enhanced:10000, basic:1000")
+	require.NoError(t, err)
+	provider := &fakeKYCProvider{reviews: map[string]*kycReview{}}
+	service := &kycService{
+		mode:     mode,
+		provider: provider,
+		tiers:    tiers,
+		pricer:   usdcPricer(),
+		now:      time.Now,
+	}
+	return service, provider
+}
+
+// usdcPricer prices kycUSDC at a dollar and nothing else
+func usdcPricer() *tokenPricer {
+	return &tokenPricer{
+		lookup: func(ctx context.Context, chainID int64, address common.Address) (*Token, error) {
+			if address == common.HexToAddress(kycUSDC) {
+				return &Token{Symbol: "USDC", Decimals: 6}, nil
+			}
+			return &Token{RiskFlags: []string{RiskUnlisted}}, nil
+		},
+		price: func(ctx context.Context, symbol string) (float64, error) {
+			if symbol == "USDC/USD" {
+				return 1, nil
+			}
+			return 0, errors.New("symbol not found")
+		},
+	}
+}
+
+// usdc returns the base units of dollars of USDC
+func usdc(dollars int64) string {
+	return strconv.FormatInt(dollars*1_000_000, 10)
+}
+
+func TestKYCTiers(t *testing.T) {
+	t.Run("should order tiers by threshold", func(t *testing.T) {
+		tiers, err := parseKYCTiers("enhanced:10000,basic:1000")
+		require.NoError(t, err)
+		assert.Equal(t, []KYCTier{{Level: "basic", ThresholdUSD: 1000}, {Level: "enhanced", ThresholdUSD: 10000}}, tiers)
+	})
+
+	t.Run("should reject malformed tiers", func(t *testing.T) {
+		_, err := parseKYCTiers("basic")
+		assert.Error(t, err)
+		_, err = parseKYCTiers("basic:lots")
+		assert.Error(t, err)
+	})
+}
+
+func TestKYCCheck(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should not require KYC below the lowest threshold", func(t *testing.T) {
+		service, _ := setupKYCTest(t, KYCEnforce)
+
+		requirement, err := service.check(ctx, 4202, kycSender, kycUSDC, usdc(1000))
+		require.NoError(t, err)
+		assert.True(t, requirement.Satisfied)
+		assert.Equal(t, 1000.0, *requirement.ValueUSD)
+		assert.Empty(t, requirement.Level)
+	})
+
+	t.Run("should require the tier the payment's value reaches", func(t *testing.T) {
+		service, _ := setupKYCTest(t, KYCEnforce)
+
+		requirement, err := service.check(ctx, 4202, kycSender, kycUSDC, usdc(1001))
+		assert.ErrorIs(t, err, errKYCRequired)
+		assert.Equal(t, "basic", requirement.Level)
+		assert.Equal(t, KYCUnverified, requirement.Status)
+
+		requirement, err = service.check(ctx, 4202, kycSender, kycUSDC, usdc(50000))
+		assert.ErrorIs(t, err, errKYCRequired)
+		assert.Equal(t, "enhanced", requirement.Level)
+	})
+
+	t.Run("should require the lowest tier when the token has no price", func(t *testing.T) {
+		service, _ := setupKYCTest(t, KYCEnforce)
+
+		requirement, err := service.check(ctx, 4202, kycSender, "0x00000000000000000000000000000000000000e9", "1")
+		assert.ErrorIs(t, err, errKYCRequired)
+		assert.Nil(t, requirement.ValueUSD)
+		assert.Equal(t, "basic", requirement.Level)
+	})
+
+	t.Run("should only log in warn mode", func(t *testing.T) {
+		service, _ := setupKYCTest(t, KYCWarn)
+
+		requirement, err := service.check(ctx, 4202, kycSender, kycUSDC, usdc(5000))
+		require.NoError(t, err)
+		assert.False(t, requirement.Satisfied)
+	})
+
+	t.Run("should accept senders approved at the tier or above", func(t *testing.T) {
+		service, provider := setupKYCTest(t, KYCEnforce)
+
+		verification, session, err := service.start(ctx, kycSender, "")
+		require.NoError(t, err)
+		assert.Equal(t, "basic", verification.Level)
+		assert.Equal(t, KYCPending, verification.Status)
+		assert.Equal(t, "token", session.AccessToken)
+
+		provider.reviews[verification.ApplicantID] = &kycReview{Status: KYCApproved}
+		verification, err = service.refresh(ctx, verification)
+		require.NoError(t, err)
+		assert.Equal(t, "basic", verification.ApprovedLevel)
+
+		requirement, err := service.check(ctx, 4202, kycSender, kycUSDC, usdc(5000))
+		require.NoError(t, err)
+		assert.True(t, requirement.Satisfied)
+		_, err = service.check(ctx, 4202, kycSender, kycUSDC, usdc(50000))
+		assert.ErrorIs(t, err, errKYCRequired)
+	})
+
+	t.Run("should keep the approved level while a higher one is reviewed", func(t *testing.T) {
+		service, _ := setupKYCTest(t, KYCEnforce)
+
+		basic, _, err := service.start(ctx, kycSender, "basic")
+		require.NoError(t, err)
+		_, err = service.apply(&kycReview{ApplicantID: basic.ApplicantID, Status: KYCApproved})
+		require.NoError(t, err)
+
+		enhanced, _, err := service.start(ctx, kycSender, "enhanced")
+		require.NoError(t, err)
+		assert.NotEqual(t, basic.ApplicantID, enhanced.ApplicantID)
+		verification, err := service.apply(&kycReview{ApplicantID: enhanced.ApplicantID, Status: KYCRejected, Reason: "document expired"})
+		require.NoError(t, err)
+		assert.Equal(t, KYCRejected, verification.Status)
+		assert.Equal(t, "basic", verification.ApprovedLevel)
+
+		_, err = service.check(ctx, 4202, kycSender, kycUSDC, usdc(5000))
+		assert.NoError(t, err)
+	})
+
+	t.Run("should reuse the applicant of a started level", func(t *testing.T) {
+		service, provider := setupKYCTest(t, KYCEnforce)
+
+		first, _, err := service.start(ctx, kycSender, "basic")
+		require.NoError(t, err)
+		second, _, err := service.start(ctx, kycSender, "basic")
+		require.NoError(t, err)
+		assert.Equal(t, first.ApplicantID, second.ApplicantID)
+		assert.Equal(t, 1, provider.applicants)
+
+		_, _, err = service.start(ctx, kycSender, "platinum")
+		assert.ErrorIs(t, err, errUnknownKYCLevel)
+	})
+}
+
+func TestSumsubProvider(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+
+	t.Run("should sign API requests", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "app-token", r.Header.Get("X-App-Token"))
+			assert.Equal(t, "1760000000", r.Header.Get("X-App-Access-Ts"))
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte("1760000000GET/resources/applicants/abc/one"))
+			assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-App-Access-Sig"))
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": "abc",
+				"review": map[string]interface{}{
+					"reviewStatus": "completed",
+					"reviewResult": map[string]interface{}{"reviewAnswer": "RED", "reviewRejectType": "RETRY", "rejectLabels": []string{"BAD_SELFIE"}},
+				},
+			})
+		}))
+		defer server.Close()
+
+		provider := &sumsubProvider{apiURL: server.URL, appToken: "app-token", secretKey: "secret", client: server.Client(), now: func() time.Time { return now }}
+		review, err := provider.review(context.Background(), "abc")
+		require.NoError(t, err)
+		assert.Equal(t, KYCRetry, review.Status)
+		assert.Equal(t, "BAD_SELFIE", review.Reason)
+	})
+
+	t.Run("should verify webhook digests", func(t *testing.T) {
+		provider := &sumsubProvider{webhookSecret: "hook-secret", now: func() time.Time { return now }}
+		body := []byte(`{"type":"applicantReviewed","applicantId":"abc","reviewStatus":"completed","reviewResult":{"reviewAnswer":"GREEN"}}`)
+		mac := hmac.New(sha256.New, []byte("hook-secret"))
+		mac.Write(body)
+
+		header := http.Header{}
+		header.Set("X-Payload-Digest", hex.EncodeToString(mac.Sum(nil)))
+		header.Set("X-Payload-Digest-Alg", "HMAC_SHA256_HEX")
+		review, err := provider.parseWebhook(header, body)
+		require.NoError(t, err)
+		assert.Equal(t, &kycReview{ApplicantID: "abc", Status: KYCApproved}, review)
+
+		header.Set("X-Payload-Digest", "00")
+		_, err = provider.parseWebhook(header, body)
+		assert.ErrorIs(t, err, errInvalidKYCSignature)
+	})
+}
+
+func TestPersonaProvider(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	provider := &personaProvider{webhookSecret: "hook-secret", now: func() time.Time { return now }}
+	body := []byte(`{"data":{"attributes":{"name":"inquiry.approved","payload":{"data":{"type":"inquiry","id":"inq_1","attributes":{"status":"approved","reference-id":"0xa1"}}}}}}`)
+	sign := func(timestamp int64) string {
+		mac := hmac.New(sha256.New, []byte("hook-secret"))
+		mac.Write([]byte(fmt.Sprintf("%d.%s", timestamp, body)))
+		return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	t.Run("should verify webhook signatures", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Persona-Signature", "t=1760000000,v1=00 "+sign(now.Unix()))
+		review, err := provider.parseWebhook(header, body)
+		require.NoError(t, err)
+		assert.Equal(t, &kycReview{ApplicantID: "inq_1", Status: KYCApproved}, review)
+	})
+
+	t.Run("should reject old webhooks", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Persona-Signature", sign(now.Add(-time.Hour).Unix()))
+		_, err := provider.parseWebhook(header, body)
+		assert.ErrorIs(t, err, errInvalidKYCSignature)
+	})
+}
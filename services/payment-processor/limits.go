@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Limit rules cap what an address may send and a merchant may receive: the
+// most one payment may be worth, the most a UTC day's payments may be worth,
+// and how many payments may be made in an hour. Payments are priced in USD
+// through the FTSO, and one that cannot be priced breaks every USD rule that
+// applies to it. Every evaluation is kept in an audit log with its
+// violations. A payment that may go ahead reserves its value toward the
+// daily and hourly totals in the same step it is checked, so concurrent
+// payments cannot both fit under a limit, and gives it back if it is not
+// created. In warn mode violations are logged; in enforce mode the payment
+// is rejected with them.
+
+// Limit modes
+const (
+	LimitsOff     = "off"
+	LimitsWarn    = "warn"
+	LimitsEnforce = "enforce"
+)
+
+// Limit scopes: the sender of a payment, and the merchants it pays
+const (
+	LimitScopeSender   = "sender"
+	LimitScopeMerchant = "merchant"
+)
+
+// Limit rules a payment can break
+const (
+	LimitMaxPerTx  = "max_per_tx"
+	LimitDailyMax  = "daily_max"
+	LimitTxPerHour = "tx_per_hour"
+	LimitUnpriced  = "unpriced"
+)
+
+// defaultLimitKey is the key of the rule of addresses without their own
+const defaultLimitKey = "*"
+
+const (
+	defaultLimitEvaluations = 50
+	maxLimitEvaluations     = 500
+)
+
+var errLimitExceeded = errors.New("payment exceeds limits")
+
+// limits is the rules engine payments are checked against. It is off when
+// no rules are configured.
+var limits *limitsService
+
+// LimitRule is what one address may send or receive. Zero is no limit.
+type LimitRule struct {
+	MaxPerTxUSD  float64 `json:"max_per_tx_usd,omitempty"`
+	DailyMaxUSD  float64 `json:"daily_max_usd,omitempty"`
+	MaxTxPerHour int     `json:"max_tx_per_hour,omitempty"`
+}
+
+// LimitRules are the rules of senders and merchants by address, with "*"
+// the rule of addresses not listed
+type LimitRules struct {
+	Senders   map[string]LimitRule `json:"senders"`
+	Merchants map[string]LimitRule `json:"merchants"`
+}
+
+// LimitViolation is a rule a payment breaks. Value is what the rule
+// measures with the payment included: its value, the day's total or the
+// hour's payments.
+type LimitViolation struct {
+	Scope   string  `json:"scope"`
+	Address string  `json:"address"`
+	Rule    string  `json:"rule"`
+	Limit   float64 `json:"limit"`
+	Value   float64 `json:"value"`
+	Message string  `json:"message"`
+}
+
+// LimitParty is an address a payment's value counts toward
+type LimitParty struct {
+	Scope    string   `json:"scope"`
+	Address  string   `json:"address"`
+	ValueUSD *float64 `json:"value_usd"`
+}
+
+// LimitEvaluation is the audit record of checking a payment against the
+// rules. Reference is the payment, split, intent, stream or operation
+// created after it passed; evaluations without one are pending or were
+// released.
+type LimitEvaluation struct {
+	ID         string           `json:"id"`
+	Source     string           `json:"source"`
+	ChainID    int64            `json:"chain_id"`
+	Sender     string           `json:"sender"`
+	Token      string           `json:"token"`
+	Amount     string           `json:"amount"`
+	ValueUSD   *float64         `json:"value_usd"`
+	Mode       string           `json:"mode"`
+	Passed     bool             `json:"passed"`
+	Parties    []LimitParty     `json:"parties"`
+	Violations []LimitViolation `json:"violations"`
+	Reference  string           `json:"reference,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+	RecordedAt *time.Time       `json:"recorded_at,omitempty"`
+}
+
+// LimitUsage is what an address has sent or received against its rule.
+// Rule is nil for addresses without one.
+type LimitUsage struct {
+	Scope    string     `json:"scope"`
+	Address  string     `json:"address"`
+	Rule     *LimitRule `json:"rule"`
+	Day      string     `json:"day"`
+	DailyUSD float64    `json:"daily_usd"`
+	HourlyTx int        `json:"hourly_tx"`
+}
+
+// limitLeg is a recipient of a payment and the base units it receives
+type limitLeg struct {
+	Recipient string
+	Amount    string
+}
+
+// limitsService evaluates payments against the rules
+type limitsService struct {
+	mode   string
+	rules  LimitRules
+	pricer *tokenPricer
+	now    func() time.Time
+	// mutex makes reading the totals and reserving a payment's share of
+	// them one step
+	mutex sync.Mutex
+}
+
+// loadLimitRules reads the LIMIT_RULES_PATH file
+func loadLimitRules(path string) (LimitRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return LimitRules{}, err
+	}
+	var file LimitRules
+	if err := json.Unmarshal(data, &file); err != nil {
+		return LimitRules{}, err
+	}
+
+	rules := LimitRules{Senders: make(map[string]LimitRule), Merchants: make(map[string]LimitRule)}
+	for _, scope := range []struct {
+		from map[string]LimitRule
+		to   map[string]LimitRule
+	}{{file.Senders, rules.Senders}, {file.Merchants, rules.Merchants}} {
+		for address, rule := range scope.from {
+			if address != defaultLimitKey && !common.IsHexAddress(address) {
+				return LimitRules{}, fmt.Errorf("invalid address %q", address)
+			}
+			if rule.MaxPerTxUSD < 0 || rule.DailyMaxUSD < 0 || rule.MaxTxPerHour < 0 {
+				return LimitRules{}, fmt.Errorf("negative limit for %s", address)
+			}
+			if address != defaultLimitKey {
+				address = strings.ToLower(common.HexToAddress(address).Hex())
+			}
+			scope.to[address] = rule
+		}
+	}
+	return rules, nil
+}
+
+// rule returns the rule of an address in scope
+func (s *limitsService) rule(scope, address string) (LimitRule, bool) {
+	rules := s.rules.Senders
+	if scope == LimitScopeMerchant {
+		rules = s.rules.Merchants
+	}
+	if rule, ok := rules[address]; ok {
+		return rule, true
+	}
+	rule, ok := rules[defaultLimitKey]
+	return rule, ok
+}
+
+// check evaluates a payment from sender of the token to legs, on behalf of
+// source (payment, split, intent, stream or user_operation), and stores the
+// evaluation. A nil service is off. It returns errLimitExceeded only in
+// enforce mode; in warn mode the violations are logged and returned.
+// Payments that may go ahead reserve their value: pass the evaluation to
+// record once the payment is created, or to release if it is not.
+func (s *limitsService) check(ctx context.Context, source string, chainID int64, sender, tokenAddress string, legs ...limitLeg) (*LimitEvaluation, error) {
+	if s == nil || s.mode == LimitsOff {
+		return nil, nil
+	}
+
+	total := new(big.Int)
+	amounts := make([]*big.Int, len(legs))
+	for i, leg := range legs {
+		amount, ok := new(big.Int).SetString(leg.Amount, 10)
+		if !ok || amount.Sign() < 0 {
+			amount = new(big.Int)
+		}
+		amounts[i] = amount
+		total.Add(total, amount)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	evaluation := &LimitEvaluation{
+		ID:         hexutil.Encode(id),
+		Source:     source,
+		ChainID:    chainID,
+		Sender:     strings.ToLower(sender),
+		Token:      strings.ToLower(tokenAddress),
+		Amount:     total.String(),
+		ValueUSD:   s.pricer.valueUSD(ctx, chainID, tokenAddress, total.String()),
+		Mode:       s.mode,
+		Violations: []LimitViolation{},
+		CreatedAt:  s.now().UTC(),
+	}
+
+	// The sender counts the whole payment and each merchant its share
+	evaluation.Parties = append(evaluation.Parties, LimitParty{Scope: LimitScopeSender, Address: evaluation.Sender, ValueUSD: evaluation.ValueUSD})
+	merchants := make(map[string]int)
+	for i, leg := range legs {
+		recipient := strings.ToLower(leg.Recipient)
+		index, ok := merchants[recipient]
+		if !ok {
+			index = len(evaluation.Parties)
+			merchants[recipient] = index
+			party := LimitParty{Scope: LimitScopeMerchant, Address: recipient}
+			if evaluation.ValueUSD != nil {
+				party.ValueUSD = new(float64)
+			}
+			evaluation.Parties = append(evaluation.Parties, party)
+		}
+		if evaluation.ValueUSD != nil && total.Sign() > 0 {
+			share, _ := new(big.Float).Quo(new(big.Float).SetInt(amounts[i]), new(big.Float).SetInt(total)).Float64()
+			*evaluation.Parties[index].ValueUSD += *evaluation.ValueUSD * share
+		}
+	}
+
+	if err := s.reserve(evaluation); err != nil {
+		return nil, err
+	}
+	value := "unpriced"
+	if evaluation.ValueUSD != nil {
+		value = fmt.Sprintf("$%.2f", *evaluation.ValueUSD)
+	}
+	log.Printf("Limits %s: %s %s from %s (%s) passed=%t violations=%d", evaluation.ID, source, evaluation.Amount, evaluation.Sender, value, evaluation.Passed, len(evaluation.Violations))
+	if evaluation.Passed {
+		return evaluation, nil
+	}
+
+	err := fmt.Errorf("%w: %s", errLimitExceeded, evaluation.Violations[0].Message)
+	if s.mode == LimitsEnforce {
+		return evaluation, err
+	}
+	log.Printf("Warning: %s: %v", sender, err)
+	return evaluation, nil
+}
+
+// reserve evaluates the parties of a payment against their rules and stores
+// the evaluation, with the payment's usage unless enforce mode rejects it,
+// as one step
+func (s *limitsService) reserve(evaluation *LimitEvaluation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, party := range evaluation.Parties {
+		rule, ok := s.rule(party.Scope, party.Address)
+		if !ok {
+			continue
+		}
+		violations, err := s.evaluate(tx, party, rule, evaluation.CreatedAt)
+		if err != nil {
+			return err
+		}
+		evaluation.Violations = append(evaluation.Violations, violations...)
+	}
+	evaluation.Passed = len(evaluation.Violations) == 0
+
+	if err := storeLimitEvaluation(tx, evaluation); err != nil {
+		return err
+	}
+	if evaluation.Passed || s.mode != LimitsEnforce {
+		for _, party := range evaluation.Parties {
+			_, err := tx.Exec(`INSERT INTO limit_usage (evaluation_id, scope, address, value_usd, created_at) VALUES (?, ?, ?, ?, ?)`,
+				evaluation.ID, party.Scope, party.Address, party.ValueUSD, evaluation.CreatedAt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// evaluate checks a party's share of a payment made at now against its rule
+func (s *limitsService) evaluate(q querier, party LimitParty, rule LimitRule, now time.Time) ([]LimitViolation, error) {
+	daily, hourly, err := limitTotals(q, party.Scope, party.Address, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations []LimitViolation
+	violate := func(name string, limit, value float64, message string) {
+		violations = append(violations, LimitViolation{
+			Scope:   party.Scope,
+			Address: party.Address,
+			Rule:    name,
+			Limit:   limit,
+			Value:   value,
+			Message: fmt.Sprintf("%s %s %s", party.Scope, party.Address, message),
+		})
+	}
+
+	if rule.MaxPerTxUSD > 0 || rule.DailyMaxUSD > 0 {
+		if party.ValueUSD == nil {
+			violate(LimitUnpriced, 0, 0, "has USD limits and the payment cannot be priced")
+		} else {
+			value := *party.ValueUSD
+			if rule.MaxPerTxUSD > 0 && value > rule.MaxPerTxUSD {
+				violate(LimitMaxPerTx, rule.MaxPerTxUSD, value, fmt.Sprintf("may move at most $%.2f per payment", rule.MaxPerTxUSD))
+			}
+			if rule.DailyMaxUSD > 0 && daily+value > rule.DailyMaxUSD {
+				violate(LimitDailyMax, rule.DailyMaxUSD, daily+value, fmt.Sprintf("may move at most $%.2f per day, $%.2f moved today", rule.DailyMaxUSD, daily))
+			}
+		}
+	}
+	if rule.MaxTxPerHour > 0 && hourly+1 > rule.MaxTxPerHour {
+		violate(LimitTxPerHour, float64(rule.MaxTxPerHour), float64(hourly+1), fmt.Sprintf("may make at most %d payments per hour", rule.MaxTxPerHour))
+	}
+	return violations, nil
+}
+
+// record marks the reserved usage of an evaluated payment as the payment
+// created as reference. Evaluations that did not run, with limits off, are
+// nil.
+func (s *limitsService) record(evaluation *LimitEvaluation, reference string) error {
+	if evaluation == nil {
+		return nil
+	}
+	now := s.now().UTC()
+	result, err := db.Exec(`UPDATE limit_evaluations SET reference = ?, recorded_at = ? WHERE id = ? AND recorded_at IS NULL`,
+		reference, now, evaluation.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("evaluation %s is already recorded", evaluation.ID)
+	}
+	evaluation.Reference = reference
+	evaluation.RecordedAt = &now
+	return nil
+}
+
+// release gives back the usage an evaluated payment reserved when it was
+// not created, so failed requests do not count toward limits. The
+// evaluation stays in the audit log without a reference. Failures are only
+// logged, as the request has failed already.
+func (s *limitsService) release(evaluation *LimitEvaluation) {
+	if evaluation == nil {
+		return
+	}
+	_, err := db.Exec(`DELETE FROM limit_usage WHERE evaluation_id = ?
+		AND EXISTS (SELECT 1 FROM limit_evaluations WHERE id = ? AND recorded_at IS NULL)`, evaluation.ID, evaluation.ID)
+	if err != nil {
+		log.Printf("Warning: Failed to release limits of evaluation %s: %v", evaluation.ID, err)
+	}
+}
+
+// usage returns what an address has sent or received against its rule at
+// now
+func (s *limitsService) usage(scope, address string, now time.Time) (*LimitUsage, error) {
+	address = strings.ToLower(address)
+	usage := &LimitUsage{Scope: scope, Address: address, Day: gasBudgetDay(now)}
+	if rule, ok := s.rule(scope, address); ok {
+		usage.Rule = &rule
+	}
+	var err error
+	usage.DailyUSD, usage.HourlyTx, err = limitTotals(db, scope, address, now)
+	return usage, err
+}
+
+// querier is the part of *sql.DB and *sql.Tx limit totals are read with
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// limitTotals returns the USD value of an address's reserved and recorded
+// payments on the UTC day of now, and how many it made in the hour before
+// now
+func limitTotals(q querier, scope, address string, now time.Time) (float64, int, error) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var daily float64
+	err := q.QueryRow(`SELECT COALESCE(SUM(value_usd), 0) FROM limit_usage WHERE scope = ? AND address = ? AND created_at >= ?`,
+		scope, address, day).Scan(&daily)
+	if err != nil {
+		return 0, 0, err
+	}
+	var hourly int
+	err = q.QueryRow(`SELECT COUNT(*) FROM limit_usage WHERE scope = ? AND address = ? AND created_at > ?`,
+		scope, address, now.Add(-time.Hour)).Scan(&hourly)
+	if err != nil {
+		return 0, 0, err
+	}
+	return daily, hourly, nil
+}
+
+func storeLimitEvaluation(conn execer, e *LimitEvaluation) error {
+	parties, err := json.Marshal(e.Parties)
+	if err != nil {
+		return err
+	}
+	violations, err := json.Marshal(e.Violations)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(`INSERT INTO limit_evaluations (id, source, chain_id, sender, token, amount, value_usd, mode, passed, parties, violations, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.ID, e.Source, e.ChainID, e.Sender, e.Token, e.Amount, e.ValueUSD, e.Mode, e.Passed, string(parties), string(violations), e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store limit evaluation: %w", err)
+	}
+	return nil
+}
+
+// listLimitEvaluations returns the newest evaluations of payments from or to
+// address, or of every payment when it is empty, optionally only those with
+// violations
+func listLimitEvaluations(address string, violationsOnly bool, limit int) ([]*LimitEvaluation, error) {
+	if limit <= 0 {
+		limit = defaultLimitEvaluations
+	}
+	if limit > maxLimitEvaluations {
+		limit = maxLimitEvaluations
+	}
+	query := `SELECT id, source, chain_id, sender, token, amount, value_usd, mode, passed, parties, violations, reference, created_at, recorded_at
+		FROM limit_evaluations WHERE 1 = 1`
+	var args []interface{}
+	if address != "" {
+		query += ` AND (sender = ? OR EXISTS (SELECT 1 FROM json_each(parties) WHERE json_extract(value, '$.address') = ?))`
+		args = append(args, strings.ToLower(address), strings.ToLower(address))
+	}
+	if violationsOnly {
+		query += ` AND passed = 0`
+	}
+	query += ` ORDER BY created_at DESC, id LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	evaluations := []*LimitEvaluation{}
+	for rows.Next() {
+		var e LimitEvaluation
+		var valueUSD sql.NullFloat64
+		var parties, violations string
+		var recordedAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.Source, &e.ChainID, &e.Sender, &e.Token, &e.Amount, &valueUSD, &e.Mode, &e.Passed,
+			&parties, &violations, &e.Reference, &e.CreatedAt, &recordedAt); err != nil {
+			return nil, err
+		}
+		if valueUSD.Valid {
+			e.ValueUSD = &valueUSD.Float64
+		}
+		if recordedAt.Valid {
+			e.RecordedAt = &recordedAt.Time
+		}
+		if err := json.Unmarshal([]byte(parties), &e.Parties); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(violations), &e.Violations); err != nil {
+			return nil, err
+		}
+		evaluations = append(evaluations, &e)
+	}
+	return evaluations, rows.Err()
+}
+
+// splitLimitLegs returns the recipients of a split's legs
+func splitLimitLegs(legs []*SplitLeg) []limitLeg {
+	result := make([]limitLeg, len(legs))
+	for i, leg := range legs {
+		result[i] = limitLeg{Recipient: leg.Recipient, Amount: leg.Amount}
+	}
+	return result
+}
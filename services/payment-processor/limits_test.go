@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	limitMerchant      = "0x00000000000000000000000000000000000000b1"
+	limitOtherMerchant = "0x00000000000000000000000000000000000000b2"
+)
+
+func setupLimitsTest(t *testing.T, mode string, rules LimitRules) (*limitsService, *time.Time) {
+	setupTestDB(t)
+
+	clock, now := fixedClock(time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC))
+	service := &limitsService{
+		mode:   mode,
+		rules:  rules,
+		pricer: usdcPricer(),
+		now:    clock,
+	}
+	setGlobal(t, &limits, service)
+	return service, now
+}
+
+func violatedRules(evaluation *LimitEvaluation) []string {
+	rules := []string{}
+	for _, violation := range evaluation.Violations {
+		rules = append(rules, violation.Scope+":"+violation.Rule)
+	}
+	return rules
+}
+
+func TestLoadLimitRules(t *testing.T) {
+	t.Run("should read rules by lowercase address", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "limits.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{
+			"senders": {"*": {"max_per_tx_usd": 1000}, "`+strings.ToUpper(kycSender[2:])+`": {"daily_max_usd": 5000}},
+			"merchants": {"*": {"max_tx_per_hour": 2}}
+		}`), 0o644))
+
+		rules, err := loadLimitRules(path)
+		require.NoError(t, err)
+		assert.Equal(t, LimitRule{MaxPerTxUSD: 1000}, rules.Senders["*"])
+		assert.Equal(t, LimitRule{DailyMaxUSD: 5000}, rules.Senders[strings.ToLower(kycSender)])
+		assert.Equal(t, LimitRule{MaxTxPerHour: 2}, rules.Merchants["*"])
+	})
+
+	t.Run("should reject invalid addresses and negative limits", func(t *testing.T) {
+		for _, content := range []string{
+			`{"senders": {"alice": {"max_per_tx_usd": 1}}}`,
+			`{"merchants": {"*": {"daily_max_usd": -1}}}`,
+		} {
+			path := filepath.Join(t.TempDir(), "limits.json")
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+			_, err := loadLimitRules(path)
+			assert.Error(t, err, content)
+		}
+	})
+}
+
+func TestLimitsCheck(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should reject payments over the per-payment limit", func(t *testing.T) {
+		service, _ := setupLimitsTest(t, LimitsEnforce, LimitRules{Senders: map[string]LimitRule{"*": {MaxPerTxUSD: 1000}}})
+
+		evaluation, err := service.check(ctx, "payment", 4202, kycSender, kycUSDC, limitLeg{Recipient: limitMerchant, Amount: usdc(1000)})
+		require.NoError(t, err)
+		assert.True(t, evaluation.Passed)
+		assert.Equal(t, 1000.0, *evaluation.ValueUSD)
+
+		evaluation, err = service.check(ctx, "payment", 4202, kycSender, kycUSDC, limitLeg{Recipient: limitMerchant, Amount: usdc(1001)})
+		assert.ErrorIs(t, err, errLimitExceeded)
+		assert.False(t, evaluation.Passed)
+		require.Len(t, evaluation.Violations, 1)
+		assert.Equal(t, LimitViolation{
+			Scope:   LimitScopeSender,
+			Address: strings.ToLower(kycSender),
+			Rule:    LimitMaxPerTx,
+			Limit:   1000,
+			Value:   1001,
+			Message: "sender " + strings.ToLower(kycSender) + " may move at most $1000.00 per payment",
+		}, evaluation.Violations[0])
+	})
+
+	t.Run("should count reserved and recorded payments toward the day and the hour", func(t *testing.T) {
+		service, clock := setupLimitsTest(t, LimitsEnforce, LimitRules{
+			Senders: map[string]LimitRule{strings.ToLower(kycSender): {DailyMaxUSD: 500, MaxTxPerHour: 2}},
+		})
+		pay := func(dollars int64) (*LimitEvaluation, error) {
+			return service.check(ctx, "payment", 4202, kycSender, kycUSDC, limitLeg{Recipient: limitMerchant, Amount: usdc(dollars)})
+		}
+
+		// a payment counts from its check until it is released
+		reserved, err := pay(300)
+		require.NoError(t, err)
+		evaluation, err := pay(300)
+		assert.ErrorIs(t, err, errLimitExceeded)
+		assert.Equal(t, 600.0, evaluation.Violations[0].Value)
+		service.release(reserved)
+
+		evaluation, err = pay(300)
+		require.NoError(t, err)
+		require.NoError(t, service.record(evaluation, "1"))
+		assert.Error(t, service.record(evaluation, "1"))
+		// recorded payments are not released
+		service.release(evaluation)
+
+		evaluation, err = pay(300)
+		assert.ErrorIs(t, err, errLimitExceeded)
+		assert.Equal(t, []string{"sender:daily_max"}, violatedRules(evaluation))
+		assert.Equal(t, 600.0, evaluation.Violations[0].Value)
+
+		evaluation, err = pay(100)
+		require.NoError(t, err)
+		require.NoError(t, service.record(evaluation, "2"))
+		evaluation, err = pay(50)
+		assert.ErrorIs(t, err, errLimitExceeded)
+		assert.Equal(t, []string{"sender:tx_per_hour"}, violatedRules(evaluation))
+
+		*clock = clock.Add(time.Hour)
+		_, err = pay(50)
+		assert.NoError(t, err)
+
+		*clock = clock.Add(12 * time.Hour)
+		usage, err := service.usage(LimitScopeSender, kycSender, *clock)
+		require.NoError(t, err)
+		assert.Equal(t, "2025-03-15", usage.Day)
+		assert.Zero(t, usage.DailyUSD)
+		_, err = pay(500)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should let only as many concurrent payments through as fit", func(t *testing.T) {
+		service, _ := setupLimitsTest(t, LimitsEnforce, LimitRules{Senders: map[string]LimitRule{"*": {MaxTxPerHour: 3}}})
+
+		var wg sync.WaitGroup
+		passed := make(chan *LimitEvaluation, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				evaluation, err := service.check(ctx, "payment", 4202, kycSender, kycUSDC, limitLeg{Recipient: limitMerchant, Amount: usdc(1)})
+				if err == nil {
+					passed <- evaluation
+				}
+			}()
+		}
+		wg.Wait()
+		close(passed)
+		assert.Len(t, passed, 3)
+
+		usage, err := service.usage(LimitScopeSender, kycSender, service.now())
+		require.NoError(t, err)
+		assert.Equal(t, 3, usage.HourlyTx)
+	})
+
+	t.Run("should hold each merchant to its share of a split", func(t *testing.T) {
+		service, _ := setupLimitsTest(t, LimitsEnforce, LimitRules{
+			Merchants: map[string]LimitRule{"*": {MaxPerTxUSD: 250}, limitOtherMerchant: {MaxPerTxUSD: 1000}},
+		})
+
+		evaluation, err := service.check(ctx, "split", 4202, kycSender, kycUSDC,
+			limitLeg{Recipient: limitMerchant, Amount: usdc(200)},
+			limitLeg{Recipient: limitOtherMerchant, Amount: usdc(600)},
+			limitLeg{Recipient: limitMerchant, Amount: usdc(100)})
+		assert.ErrorIs(t, err, errLimitExceeded)
+		require.Len(t, evaluation.Parties, 3)
+		assert.Equal(t, 300.0, *evaluation.Parties[1].ValueUSD)
+		assert.Equal(t, 600.0, *evaluation.Parties[2].ValueUSD)
+		require.Len(t, evaluation.Violations, 1)
+		assert.Equal(t, limitMerchant, evaluation.Violations[0].Address)
+	})
+
+	t.Run("should fail USD rules for payments that cannot be priced", func(t *testing.T) {
+		service, _ := setupLimitsTest(t, LimitsEnforce, LimitRules{Senders: map[string]LimitRule{"*": {MaxPerTxUSD: 1000, MaxTxPerHour: 5}}})
+
+		evaluation, err := service.check(ctx, "payment", 4202, kycSender, "0x00000000000000000000000000000000000000e2",
+			limitLeg{Recipient: limitMerchant, Amount: "1"})
+		assert.ErrorIs(t, err, errLimitExceeded)
+		assert.Nil(t, evaluation.ValueUSD)
+		assert.Equal(t, []string{"sender:unpriced"}, violatedRules(evaluation))
+	})
+
+	t.Run("should only log violations in warn mode", func(t *testing.T) {
+		service, _ := setupLimitsTest(t, LimitsWarn, LimitRules{Senders: map[string]LimitRule{"*": {MaxPerTxUSD: 10}}})
+
+		evaluation, err := service.check(ctx, "payment", 4202, kycSender, kycUSDC, limitLeg{Recipient: limitMerchant, Amount: usdc(20)})
+		require.NoError(t, err)
+		assert.False(t, evaluation.Passed)
+		assert.Equal(t, LimitsWarn, evaluation.Mode)
+	})
+
+	t.Run("should not evaluate payments with limits off", func(t *testing.T) {
+		service, _ := setupLimitsTest(t, LimitsOff, LimitRules{})
+
+		evaluation, err := service.check(ctx, "payment", 4202, kycSender, kycUSDC, limitLeg{Recipient: limitMerchant, Amount: usdc(20)})
+		require.NoError(t, err)
+		assert.Nil(t, evaluation)
+		assert.NoError(t, service.record(evaluation, "1"))
+	})
+}
+
+func TestLimitEvaluations(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should keep every evaluation for audit", func(t *testing.T) {
+		service, clock := setupLimitsTest(t, LimitsEnforce, LimitRules{Senders: map[string]LimitRule{"*": {MaxPerTxUSD: 100}}})
+
+		passed, err := service.check(ctx, "payment", 4202, kycSender, kycUSDC, limitLeg{Recipient: limitMerchant, Amount: usdc(50)})
+		require.NoError(t, err)
+		require.NoError(t, service.record(passed, "42"))
+		*clock = clock.Add(time.Minute)
+		_, err = service.check(ctx, "intent", 4202, kycSender, kycUSDC, limitLeg{Recipient: limitOtherMerchant, Amount: usdc(150)})
+		require.ErrorIs(t, err, errLimitExceeded)
+
+		evaluations, err := listLimitEvaluations("", false, 0)
+		require.NoError(t, err)
+		require.Len(t, evaluations, 2)
+		assert.Equal(t, "intent", evaluations[0].Source)
+		assert.False(t, evaluations[0].Passed)
+		assert.Nil(t, evaluations[0].RecordedAt)
+		assert.Equal(t, "42", evaluations[1].Reference)
+		assert.NotNil(t, evaluations[1].RecordedAt)
+		assert.Equal(t, 50.0, *evaluations[1].ValueUSD)
+
+		evaluations, err = listLimitEvaluations(limitMerchant, false, 0)
+		require.NoError(t, err)
+		require.Len(t, evaluations, 1)
+		assert.Equal(t, passed.ID, evaluations[0].ID)
+
+		w := httptest.NewRecorder()
+		handleListLimitEvaluations(w, httptest.NewRequest(http.MethodGet, "/api/limits/evaluations?violations=true", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Evaluations []*LimitEvaluation `json:"evaluations"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Len(t, response.Evaluations, 1)
+		assert.Equal(t, LimitMaxPerTx, response.Evaluations[0].Violations[0].Rule)
+	})
+
+	t.Run("should answer 403 with the violations", func(t *testing.T) {
+		service, _ := setupLimitsTest(t, LimitsEnforce, LimitRules{Senders: map[string]LimitRule{"*": {MaxPerTxUSD: 100}}})
+
+		evaluation, err := service.check(ctx, "payment", 4202, kycSender, kycUSDC, limitLeg{Recipient: limitMerchant, Amount: usdc(150)})
+		w := httptest.NewRecorder()
+		writeLimitError(w, err, evaluation)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		var response struct {
+			Code         string           `json:"code"`
+			EvaluationID string           `json:"evaluation_id"`
+			Violations   []LimitViolation `json:"violations"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, problem.CodeLimitExceeded, response.Code)
+		assert.Equal(t, evaluation.ID, response.EvaluationID)
+		require.Len(t, response.Violations, 1)
+		assert.Equal(t, 150.0, response.Violations[0].Value)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/arcbjorn/crosspay/packages/distributed"
+)
+
+// coordinator holds the locks that keep completing and refunding a payment
+// to one request at a time across replicas. Payments are left unguarded
+// while it is nil.
+var coordinator *distributed.Coordinator
+
+// lockPayment takes the lock of a payment for the rest of the request. It
+// answers 409 when another request holds it and 503 when it cannot be
+// taken, returning false once it has answered.
+func lockPayment(w http.ResponseWriter, r *http.Request, paymentID string) (unlock func(), ok bool) {
+	if coordinator == nil {
+		return func() {}, true
+	}
+
+	lock, err := coordinator.Lock(r.Context(), "payment:"+paymentID)
+	if err != nil {
+		status, message := http.StatusServiceUnavailable, fmt.Sprintf("Failed to lock payment: %v", err)
+		if errors.Is(err, distributed.ErrLocked) {
+			status, message = http.StatusConflict, "Payment is being updated by another request"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": message, "payment_id": paymentID})
+		return nil, false
+	}
+
+	return func() {
+		if err := lock.Unlock(context.Background()); err != nil {
+			log.Printf("Failed to unlock payment %s: %v", paymentID, err)
+		}
+	}, true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arcbjorn/crosspay/packages/distributed"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentLocks(t *testing.T) {
+	t.Run("should answer 409 while another request updates the payment", func(t *testing.T) {
+		setupEventLog(t)
+		coord, err := distributed.New("payment-processor", distributed.Config{})
+		require.NoError(t, err)
+		setGlobal(t, &coordinator, coord)
+
+		lock, err := coord.Lock(context.Background(), "payment:7")
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		handleRefundPayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/refund/7", nil))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		w = httptest.NewRecorder()
+		handleCompletePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/complete/7", nil))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Contains(t, w.Body.String(), "another request")
+
+		// Other payments are not held up
+		w = httptest.NewRecorder()
+		handleCompletePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/complete/8", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		require.NoError(t, lock.Unlock(context.Background()))
+		w = httptest.NewRecorder()
+		handleRefundPayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/refund/7", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// Handlers release the lock when they answer
+		lock, err = coord.Lock(context.Background(), "payment:7")
+		require.NoError(t, err)
+		require.NoError(t, lock.Unlock(context.Background()))
+	})
+}
@@ -9,66 +9,211 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/middleware"
+	"github.com/arcbjorn/crosspay/packages/problem"
 )
 
 func main() {
+	admin, err := auth.New("payment-processor", auth.Config{
+		JWTSecret: getEnv("ADMIN_JWT_SECRET", ""),
+		JWTIssuer: getEnv("ADMIN_JWT_ISSUER", ""),
+		AuditLog:  getEnv("ADMIN_AUDIT_LOG", ""),
+	})
+	if err != nil {
+		log.Fatalf("Failed to open admin audit log: %v", err)
+	}
+	defer admin.Close()
+
 	mux := http.NewServeMux()
+	timeout := middleware.Timeout(requestTimeout())
 	
 	// Health check endpoint
-	mux.HandleFunc("/health", corsHandler(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status":    "healthy",
 			"service":   "payment-processor",
 			"timestamp": time.Now().Unix(),
 		})
-	}))
+	})
 
 	// Payment API endpoints
-	mux.HandleFunc("/api/payments/create", corsHandler(handleCreatePayment))
-	mux.HandleFunc("/api/payments/complete/", corsHandler(handleCompletePayment))
-	mux.HandleFunc("/api/payments/refund/", corsHandler(handleRefundPayment))
-	mux.HandleFunc("/api/payments/", corsHandler(handleGetPayment))
-	mux.HandleFunc("/api/payments/user/", corsHandler(handleGetUserPayments))
+	mux.HandleFunc("/api/payments/create", handleCreatePayment)
+	mux.Handle("/api/payments/quote-lock", timeout(http.HandlerFunc(handleLockQuote)))
+	mux.Handle("/api/payments/simulate", timeout(http.HandlerFunc(handleSimulatePayment)))
+	mux.HandleFunc("/api/payments/complete/", handleCompletePayment)
+	mux.HandleFunc("/api/payments/refund/", handleRefundPayment)
+	mux.HandleFunc("/api/payments/", handleGetPayment)
+	mux.HandleFunc("/api/payments/user/", handleGetUserPayments)
 
 	// Receipt API endpoints
-	mux.HandleFunc("/api/receipts/generate/", corsHandler(handleGenerateReceipt))
-	mux.HandleFunc("/api/receipts/download/", corsHandler(handleDownloadReceipt))
-	mux.HandleFunc("/api/receipts/verify/", corsHandler(handleVerifyReceipt))
-	mux.HandleFunc("/api/receipts/payment/", corsHandler(handleGetReceiptsByPayment))
+	mux.Handle("/api/receipts/generate/", timeout(http.HandlerFunc(handleGenerateReceipt)))
+	mux.Handle("/api/receipts/download/", timeout(http.HandlerFunc(handleDownloadReceipt)))
+	mux.Handle("/api/receipts/verify/", timeout(http.HandlerFunc(handleVerifyReceipt)))
+	mux.HandleFunc("/api/receipts/payment/", handleGetReceiptsByPayment)
 
 	// Oracle integration endpoints
-	mux.HandleFunc("/api/oracle/price/", corsHandler(handleGetPrice))
-	mux.HandleFunc("/api/oracle/random/request", corsHandler(handleRequestRandom))
-	mux.HandleFunc("/api/oracle/random/status/", corsHandler(handleRandomStatus))
-	mux.HandleFunc("/api/oracle/proof/submit", corsHandler(handleSubmitProof))
-	mux.HandleFunc("/api/oracle/proof/verify/", corsHandler(handleVerifyProof))
+	mux.Handle("/api/oracle/price/", timeout(http.HandlerFunc(handleGetPrice)))
+	mux.Handle("/api/oracle/random/request", timeout(http.HandlerFunc(handleRequestRandom)))
+	mux.Handle("/api/oracle/random/status/", timeout(http.HandlerFunc(handleRandomStatus)))
+	mux.Handle("/api/oracle/proof/submit", timeout(http.HandlerFunc(handleSubmitProof)))
+	mux.Handle("/api/oracle/proof/verify/", timeout(http.HandlerFunc(handleVerifyProof)))
 
 	// ENS resolution endpoints
-	mux.HandleFunc("/api/ens/resolve/", corsHandler(handleResolveName))
-	mux.HandleFunc("/api/ens/reverse/", corsHandler(handleReverseResolve))
-	mux.HandleFunc("/api/ens/resolve/batch", corsHandler(handleBatchResolve))
+	mux.Handle("/api/ens/resolve/", timeout(http.HandlerFunc(handleResolveName)))
+	mux.Handle("/api/ens/reverse/", timeout(http.HandlerFunc(handleReverseResolve)))
+	mux.Handle("/api/ens/resolve/batch", timeout(http.HandlerFunc(handleBatchResolve)))
 
 	// Storage endpoints
-	mux.HandleFunc("/api/storage/upload", corsHandler(handleUploadFile))
-	mux.HandleFunc("/api/storage/retrieve/", corsHandler(handleRetrieveFile))
-	mux.HandleFunc("/api/storage/cost/", corsHandler(handleEstimateCost))
+	mux.Handle("/api/storage/upload", timeout(http.HandlerFunc(handleUploadFile)))
+	mux.Handle("/api/storage/retrieve/", timeout(http.HandlerFunc(handleRetrieveFile)))
+	mux.Handle("/api/storage/cost/", timeout(http.HandlerFunc(handleEstimateCost)))
 
 	// Analytics endpoints
-	mux.HandleFunc("/api/analytics/stats", corsHandler(handleGetStats))
-	mux.HandleFunc("/api/analytics/payments/volume", corsHandler(handleGetPaymentVolume))
-	mux.HandleFunc("/api/analytics/receipts/stats", corsHandler(handleGetReceiptStats))
+	mux.HandleFunc("/api/analytics/stats", handleGetStats)
+	mux.HandleFunc("/api/analytics/payments/volume", handleGetPaymentVolume)
+	mux.Handle("/api/analytics/receipts/stats", admin.Require("payments.receipt_stats.read", auth.Roles...)(timeout(http.HandlerFunc(handleGetReceiptStats))))
+
+	// Token registry endpoints
+	mux.HandleFunc("/api/tokens", handleListTokens)
+	mux.Handle("/api/tokens/", timeout(http.HandlerFunc(handleGetToken)))
+
+	// Payment intent endpoints
+	mux.HandleFunc("/api/intents/uri", handleIntentURI)
+	mux.Handle("/api/intents/create", timeout(http.HandlerFunc(handleCreateIntent)))
+	mux.Handle("/api/intents/verify", timeout(http.HandlerFunc(handleVerifyIntent)))
+	mux.HandleFunc("/api/intents/execute/", handleExecuteIntent)
+	mux.HandleFunc("/api/intents/", handleGetIntent)
+
+	// KYC endpoints
+	mux.Handle("/api/kyc/start", timeout(http.HandlerFunc(handleStartKYC)))
+	mux.Handle("/api/kyc/requirement", timeout(http.HandlerFunc(handleKYCRequirement)))
+	mux.HandleFunc("/api/kyc/webhook", handleKYCWebhook)
+	mux.Handle("/api/kyc/", timeout(http.HandlerFunc(handleGetKYC)))
+
+	// Travel rule endpoints
+	mux.HandleFunc("/api/travel-rule/vasps", handleListTravelRuleVASPs)
+	mux.HandleFunc("/api/travel-rule/inbound", handleTravelRuleInbound)
+	mux.HandleFunc("/api/travel-rule/", handleGetTravelRule)
+
+	// Settlement endpoints
+	mux.HandleFunc("/api/settlements", handleListSettlements)
+	mux.HandleFunc("/api/settlements/merchants", handleListMerchants)
+	mux.HandleFunc("/api/settlements/", handleGetSettlement)
+
+	// Payment stream endpoints
+	mux.Handle("/api/streams/create", timeout(http.HandlerFunc(handleCreateStream)))
+	mux.HandleFunc("/api/streams/topup/", handleTopUpStream)
+	mux.HandleFunc("/api/streams/cancel/", handleCancelStream)
+	mux.HandleFunc("/api/streams/user/", handleGetUserStreams)
+	mux.HandleFunc("/api/streams/", handleGetStream)
+
+	// Split payment endpoints
+	mux.Handle("/api/splits/create", timeout(http.HandlerFunc(handleCreateSplit)))
+	mux.HandleFunc("/api/splits/user/", handleGetUserSplits)
+	mux.HandleFunc("/api/splits/", handleGetSplit)
+
+	// Address book endpoints
+	mux.Handle("/api/contacts/create", timeout(http.HandlerFunc(handleCreateContact)))
+	mux.Handle("/api/contacts/update/", timeout(http.HandlerFunc(handleUpdateContact)))
+	mux.HandleFunc("/api/contacts/delete/", handleDeleteContact)
+	mux.HandleFunc("/api/contacts/user/", handleGetUserContacts)
+	mux.HandleFunc("/api/contacts/suggestions/", handleContactSuggestions)
+	mux.HandleFunc("/api/contacts/", handleGetContact)
+
+	// Sponsored payment endpoints
+	mux.Handle("/api/userops/build", timeout(http.HandlerFunc(handleBuildUserOperation)))
+	mux.Handle("/api/userops/send", timeout(http.HandlerFunc(handleSendUserOperation)))
+	mux.HandleFunc("/api/userops/user/", handleGetUserOperations)
+	mux.Handle("/api/userops/", timeout(http.HandlerFunc(handleGetUserOperation)))
+
+	// Limit endpoints
+	mux.Handle("/api/limits/rules", admin.Require("payments.limits.read", auth.Roles...)(http.HandlerFunc(handleGetLimitRules)))
+	mux.Handle("/api/limits/usage", admin.Require("payments.limits.read", auth.Roles...)(http.HandlerFunc(handleGetLimitUsage)))
+	mux.Handle("/api/limits/evaluations", admin.Require("payments.limits.evaluations", auth.RoleOperator, auth.RoleAuditor)(http.HandlerFunc(handleListLimitEvaluations)))
+
+	// WalletConnect endpoints
+	mux.Handle("/api/walletconnect/sessions", timeout(http.HandlerFunc(handleCreateWalletConnectSession)))
+	mux.Handle("/api/walletconnect/sessions/delete/", timeout(http.HandlerFunc(handleDeleteWalletConnectSession)))
+	mux.HandleFunc("/api/walletconnect/sessions/", handleGetWalletConnectSession)
+	mux.Handle("/api/walletconnect/requests", timeout(http.HandlerFunc(handleCreateWalletConnectRequest)))
+	mux.HandleFunc("/api/walletconnect/requests/", handleGetWalletConnectRequest)
+
+	// Event replay endpoints
+	mux.HandleFunc("/api/events", handleListEvents)
+
+	// Chain health endpoints
+	mux.HandleFunc("/api/chains/health", handleGetChainHealth)
+
+	// Gas sponsorship endpoints
+	mux.Handle("/api/gas/budget", admin.Require("payments.gas_budget.read", auth.Roles...)(http.HandlerFunc(handleGetGasBudget)))
+
+	// Admin audit log
+	mux.Handle("/admin/audit", admin.AuditHandler())
+
+	// Privacy endpoints
+	mux.Handle("/api/privacy/erasures", timeout(http.HandlerFunc(handleCreateErasure)))
+	mux.Handle("/api/privacy/erasures/cancel/", timeout(http.HandlerFunc(handleCancelErasure)))
+	mux.HandleFunc("/api/privacy/erasures/", handleGetErasure)
+
+	// Payment metadata endpoints
+	mux.HandleFunc("/api/metadata/schemas", handleListMetadataSchemas)
+	mux.Handle("/api/metadata/validate", timeout(http.HandlerFunc(handleValidateMetadata)))
+	mux.HandleFunc("/api/metadata/search", handleSearchMetadata)
+	mux.Handle("/api/metadata", timeout(http.HandlerFunc(handleGetMetadata)))
+
+	// Payroll endpoints
+	mux.Handle("/api/payroll/import", timeout(http.HandlerFunc(handleImportPayroll)))
+	mux.Handle("/api/payroll/runs/submit/", timeout(http.HandlerFunc(handleSubmitPayroll)))
+	mux.HandleFunc("/api/payroll/runs/", handleGetPayroll)
+	mux.HandleFunc("/api/payroll/user/", handleGetUserPayrolls)
 
 	srv := &http.Server{
-		Addr:    ":8083",
-		Handler: mux,
+		Addr:    ":" + getEnv("PORT", "8083"),
+		Handler: middleware.Chain(mux,
+			middleware.Logger(nil),
+			problem.Adapt,
+			middleware.Recover(nil),
+			middleware.CORS(middleware.CORSConfig{AllowedOrigins: corsAllowedOrigins()}),
+		),
 	}
 
 	// Initialize services
-	initializeServices()
+	initializeServices(admin)
+
+	// Sandbox chain endpoints
+	if sandboxChain != nil {
+		mux.Handle("/sandbox/rpc", sandboxChain.Handler())
+		mux.HandleFunc("/sandbox/mine", handleSandboxMine)
+	}
+
+	trackCtx, stopTracking := context.WithCancel(context.Background())
+	defer stopTracking()
+	if userOps != nil {
+		go userOps.track(trackCtx)
+	}
+	if gasBudgets != nil {
+		go gasBudgets.track(trackCtx)
+	}
+	if kyc.provider != nil {
+		go kyc.track(trackCtx)
+	}
+	if settlements != nil {
+		go settlements.track(trackCtx)
+	}
+	if chainMonitor != nil {
+		go chainMonitor.track(trackCtx)
+	}
+	if walletConnect != nil {
+		go walletConnect.track(trackCtx)
+	}
+	go contacts.track(trackCtx)
+	go erasures.track(trackCtx)
 
 	go func() {
-		log.Println("Payment processor starting on :8083")
+		log.Printf("Payment processor starting on %s", srv.Addr)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
@@ -86,36 +231,46 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
+	coordinator.Close()
 	
 	log.Println("Payment processor stopped")
 }
 
-func corsHandler(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(204)
-			return
-		}
-
-		next(w, r)
-	}
-}
-
-func initializeServices() {
+func initializeServices(admin *auth.Admin) {
 	log.Println("Initializing payment processor services...")
 	
+	// Initialize the sandbox chain before the services that use it
+	initSandbox()
+
 	// Initialize service clients
 	initStorageClient()
 	initOracleClient() 
 	initENSClient()
+	initUserOpService()
+	initGasBudgets()
+	initIntentService()
 	
 	// Initialize database
 	initDatabase()
+	initCoordination()
+	initTokenRegistry()
+	initAddressScreening()
+	initKYC()
+	initLimits()
+	initTravelRule()
+	initSettlementEngine()
+	initStreams()
+	initSplits()
+	initContacts()
+	initQuotes()
+	initErasures(admin)
+	initReceiptStats()
+	initMetadata()
+	initPayroll()
+	initEvents()
+	initChainMonitor()
+	initWalletConnect()
+	initPaymentSimulator()
 	
 	log.Println("Payment processor services initialized")
 }
\ No newline at end of file
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Payment metadata is the JSON document a payment's metadata URI points to.
+// The document names one of the registered schemas in its "schema" field and
+// is fetched and validated against it before a payment, intent or split is
+// created with the URI. A document that validates is cached with the storage
+// worker, so the version that was checked stays available when its origin
+// changes or goes away, and the schema's key fields are indexed for search.
+// URIs are validated once; later payments with the same URI use the cache.
+
+const (
+	maxMetadataSize            = 64 << 10
+	defaultMetadataSearchLimit = 50
+	maxMetadataSearchLimit     = 200
+)
+
+var (
+	errInvalidMetadata     = errors.New("invalid metadata")
+	errMetadataUnavailable = errors.New("metadata unavailable")
+	errMetadataNotFound    = errors.New("metadata not found")
+)
+
+// Metadata field types
+const (
+	MetadataString  = "string"
+	MetadataNumber  = "number"
+	MetadataDate    = "date"
+	MetadataBoolean = "boolean"
+	MetadataAddress = "address"
+	MetadataArray   = "array"
+	MetadataObject  = "object"
+)
+
+// MetadataField is a field of a metadata schema. Numbers may be JSON
+// numbers or decimal strings, and dates RFC 3339 timestamps or YYYY-MM-DD.
+// Indexed fields can be searched by their value.
+type MetadataField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+	Indexed  bool   `json:"indexed"`
+}
+
+// MetadataSchema is a kind of payment metadata. Fields not in the schema are
+// allowed and left unchecked.
+type MetadataSchema struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Fields      []MetadataField `json:"fields"`
+}
+
+// field returns the schema's field called name
+func (s *MetadataSchema) field(name string) (MetadataField, bool) {
+	for _, field := range s.Fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return MetadataField{}, false
+}
+
+// metadataSchemas are the registered schemas by name
+var metadataSchemas = map[string]*MetadataSchema{
+	"invoice": {
+		Name:        "invoice",
+		Description: "Payment of an invoice issued by a merchant",
+		Fields: []MetadataField{
+			{Name: "invoice_number", Type: MetadataString, Required: true, Indexed: true},
+			{Name: "issuer", Type: MetadataString, Required: true, Indexed: true},
+			{Name: "customer", Type: MetadataString, Indexed: true},
+			{Name: "issued_at", Type: MetadataDate, Required: true, Indexed: true},
+			{Name: "due_date", Type: MetadataDate},
+			{Name: "currency", Type: MetadataString},
+			{Name: "total", Type: MetadataNumber, Required: true},
+			{Name: "line_items", Type: MetadataArray},
+			{Name: "notes", Type: MetadataString},
+		},
+	},
+	"donation": {
+		Name:        "donation",
+		Description: "Donation to a campaign",
+		Fields: []MetadataField{
+			{Name: "campaign", Type: MetadataString, Required: true, Indexed: true},
+			{Name: "organization", Type: MetadataString, Indexed: true},
+			{Name: "donor_name", Type: MetadataString},
+			{Name: "anonymous", Type: MetadataBoolean},
+			{Name: "message", Type: MetadataString},
+		},
+	},
+	"payroll": {
+		Name:        "payroll",
+		Description: "Salary payment for a pay period",
+		Fields: []MetadataField{
+			{Name: "employer", Type: MetadataString, Required: true, Indexed: true},
+			{Name: "employee_id", Type: MetadataString, Required: true, Indexed: true},
+			{Name: "period_start", Type: MetadataDate, Required: true, Indexed: true},
+			{Name: "period_end", Type: MetadataDate, Required: true},
+			{Name: "gross", Type: MetadataNumber, Required: true},
+			{Name: "net", Type: MetadataNumber},
+			{Name: "currency", Type: MetadataString},
+			{Name: "payslip", Type: MetadataObject},
+		},
+	},
+}
+
+// paymentMetadata is always set; metadata records are kept in the payments
+// database
+var paymentMetadata *metadataService
+
+type metadataService struct {
+	client *http.Client
+	// allowHTTP accepts http:// URIs besides https:// and ipfs:// ones
+	allowHTTP bool
+	now       func() time.Time
+}
+
+// PaymentMetadata is a validated metadata document. CID is its cached copy
+// with the storage worker, empty when caching failed, and Digest the SHA-256
+// of its content. Document is only set when the document itself was asked
+// for.
+type PaymentMetadata struct {
+	URI         string            `json:"uri"`
+	Schema      string            `json:"schema"`
+	CID         string            `json:"cid,omitempty"`
+	Digest      string            `json:"digest"`
+	Fields      map[string]string `json:"fields"`
+	Document    json.RawMessage   `json:"document,omitempty"`
+	ValidatedAt time.Time         `json:"validated_at"`
+}
+
+// MetadataMatch is a search result: a metadata document and what was
+// created with its URI
+type MetadataMatch struct {
+	*PaymentMetadata
+	Payments []string `json:"payments"`
+	Intents  []string `json:"intents"`
+	Splits   []string `json:"splits"`
+}
+
+// schemas lists the registered schemas by name
+func (s *metadataService) schemas() []*MetadataSchema {
+	schemas := make([]*MetadataSchema, 0, len(metadataSchemas))
+	for _, schema := range metadataSchemas {
+		schemas = append(schemas, schema)
+	}
+	sort.Slice(schemas, func(i, j int) bool { return schemas[i].Name < schemas[j].Name })
+	return schemas
+}
+
+// validate checks the document uri points to against its schema, caching
+// and indexing it the first time, and returns its record. An empty uri is
+// no metadata and returns nil, as does a nil service.
+func (s *metadataService) validate(ctx context.Context, uri string) (*PaymentMetadata, error) {
+	if s == nil || uri == "" {
+		return nil, nil
+	}
+	record, err := s.get(uri)
+	if err == nil || !errors.Is(err, errMetadataNotFound) {
+		return record, err
+	}
+
+	data, cid, err := s.fetch(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	record, err = s.check(data)
+	if err != nil {
+		return nil, err
+	}
+	record.URI = uri
+	record.CID = cid
+	record.ValidatedAt = s.now().UTC()
+
+	// Keep the validated version; IPFS documents are content addressed and
+	// already are that version
+	if record.CID == "" {
+		record.CID, err = uploadToStorage(ctx, fmt.Sprintf("metadata_%s.json", record.Digest[2:18]), "attachment", data)
+		if err != nil {
+			log.Printf("Warning: Failed to cache metadata %s: %v", uri, err)
+		}
+	}
+
+	if err := s.save(record); err != nil {
+		return nil, err
+	}
+	log.Printf("Validated %s metadata %s (CID %s)", record.Schema, uri, record.CID)
+	return record, nil
+}
+
+// fetch reads the document uri points to. ipfs:// URIs are read through the
+// storage worker, and also return their CID.
+func (s *metadataService) fetch(ctx context.Context, uri string) ([]byte, string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: malformed URI %q", errInvalidMetadata, uri)
+	}
+	switch {
+	case parsed.Scheme == "ipfs":
+		cid := strings.Trim(parsed.Host+parsed.Path, "/")
+		if cid == "" {
+			return nil, "", fmt.Errorf("%w: URI %q has no CID", errInvalidMetadata, uri)
+		}
+		data, err := retrieveFromStorage(ctx, cid)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", errMetadataUnavailable, err)
+		}
+		if len(data) > maxMetadataSize {
+			return nil, "", fmt.Errorf("%w: document is larger than %d bytes", errInvalidMetadata, maxMetadataSize)
+		}
+		return data, cid, nil
+	case parsed.Scheme == "https", parsed.Scheme == "http" && s.allowHTTP:
+	default:
+		return nil, "", fmt.Errorf("%w: unsupported URI scheme %q", errInvalidMetadata, parsed.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errInvalidMetadata, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errMetadataUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%w: %s returned %d", errMetadataUnavailable, parsed.Host, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMetadataSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errMetadataUnavailable, err)
+	}
+	if len(data) > maxMetadataSize {
+		return nil, "", fmt.Errorf("%w: document is larger than %d bytes", errInvalidMetadata, maxMetadataSize)
+	}
+	return data, "", nil
+}
+
+// check validates a document against the schema it names and returns its
+// record, without URI and CID
+func (s *metadataService) check(data []byte) (*PaymentMetadata, error) {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%w: document is not a JSON object", errInvalidMetadata)
+	}
+	var name string
+	if raw, ok := document["schema"]; !ok || json.Unmarshal(raw, &name) != nil {
+		return nil, fmt.Errorf("%w: document does not name its schema", errInvalidMetadata)
+	}
+	schema, ok := metadataSchemas[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown schema %q", errInvalidMetadata, name)
+	}
+
+	fields := make(map[string]string)
+	var problems []string
+	for _, field := range schema.Fields {
+		raw, ok := document[field.Name]
+		if !ok || string(raw) == "null" {
+			if field.Required {
+				problems = append(problems, fmt.Sprintf("%s is required", field.Name))
+			}
+			continue
+		}
+		value, err := checkMetadataField(field, raw)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %v", field.Name, err))
+			continue
+		}
+		if field.Indexed && value != "" {
+			fields[field.Name] = value
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%w: %s: %s", errInvalidMetadata, name, strings.Join(problems, "; "))
+	}
+
+	digest := sha256.Sum256(data)
+	return &PaymentMetadata{Schema: name, Digest: hexutil.Encode(digest[:]), Fields: fields}, nil
+}
+
+// checkMetadataField checks raw against field's type and returns the value
+// it is indexed by: strings trimmed, dates as YYYY-MM-DD
+func checkMetadataField(field MetadataField, raw json.RawMessage) (string, error) {
+	var text string
+	isString := json.Unmarshal(raw, &text) == nil
+
+	switch field.Type {
+	case MetadataString:
+		if !isString {
+			return "", errors.New("must be a string")
+		}
+		return strings.TrimSpace(text), nil
+	case MetadataNumber:
+		var number json.Number
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&number); err != nil {
+			return "", errors.New("must be a number")
+		}
+		if _, err := number.Float64(); err != nil {
+			return "", errors.New("must be a number")
+		}
+		return number.String(), nil
+	case MetadataDate:
+		if !isString {
+			return "", errors.New("must be a date")
+		}
+		for _, layout := range []string{time.RFC3339, time.DateOnly} {
+			if date, err := time.Parse(layout, text); err == nil {
+				return date.UTC().Format(time.DateOnly), nil
+			}
+		}
+		return "", errors.New("must be an RFC 3339 timestamp or YYYY-MM-DD date")
+	case MetadataBoolean:
+		var value bool
+		if json.Unmarshal(raw, &value) != nil {
+			return "", errors.New("must be true or false")
+		}
+		return fmt.Sprint(value), nil
+	case MetadataAddress:
+		if !isString || !common.IsHexAddress(text) {
+			return "", errors.New("must be an address")
+		}
+		return strings.ToLower(text), nil
+	case MetadataArray:
+		var value []json.RawMessage
+		if json.Unmarshal(raw, &value) != nil {
+			return "", errors.New("must be an array")
+		}
+		return "", nil
+	case MetadataObject:
+		var value map[string]json.RawMessage
+		if json.Unmarshal(raw, &value) != nil {
+			return "", errors.New("must be an object")
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("has unknown type %q", field.Type)
+}
+
+// save stores a validated record and its indexed fields
+func (s *metadataService) save(record *PaymentMetadata) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO payment_metadata (uri, schema, cid, digest, validated_at) VALUES (?, ?, ?, ?, ?)`,
+		record.URI, record.Schema, record.CID, record.Digest, record.ValidatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store metadata %s: %w", record.URI, err)
+	}
+	if _, err := tx.Exec(`DELETE FROM payment_metadata_fields WHERE uri = ?`, record.URI); err != nil {
+		return err
+	}
+	for field, value := range record.Fields {
+		if _, err := tx.Exec(`INSERT INTO payment_metadata_fields (uri, field, value) VALUES (?, ?, ?)`, record.URI, field, value); err != nil {
+			return fmt.Errorf("failed to index metadata %s: %w", record.URI, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// get returns the record of a validated URI
+func (s *metadataService) get(uri string) (*PaymentMetadata, error) {
+	record := &PaymentMetadata{URI: uri, Fields: make(map[string]string)}
+	err := db.QueryRow(`SELECT schema, cid, digest, validated_at FROM payment_metadata WHERE uri = ?`, uri).
+		Scan(&record.Schema, &record.CID, &record.Digest, &record.ValidatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errMetadataNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT field, value FROM payment_metadata_fields WHERE uri = ?`, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var field, value string
+		if err := rows.Scan(&field, &value); err != nil {
+			return nil, err
+		}
+		record.Fields[field] = value
+	}
+	return record, rows.Err()
+}
+
+// document returns the record of a validated URI with the document, read
+// from its cached copy, or from its origin when it was not cached. A
+// document that no longer matches the validated digest is refused.
+func (s *metadataService) document(ctx context.Context, uri string) (*PaymentMetadata, error) {
+	record, err := s.get(uri)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if record.CID != "" {
+		if data, err = retrieveFromStorage(ctx, record.CID); err != nil {
+			return nil, fmt.Errorf("%w: %v", errMetadataUnavailable, err)
+		}
+	} else if data, _, err = s.fetch(ctx, uri); err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	if hexutil.Encode(digest[:]) != record.Digest {
+		return nil, fmt.Errorf("%w: document changed since it was validated", errMetadataUnavailable)
+	}
+	record.Document = data
+	return record, nil
+}
+
+// search returns the documents of schema whose indexed fields have the
+// values in filters, newest first, with the payments, intents and splits
+// created with them
+func (s *metadataService) search(schema string, filters map[string]string, limit int) ([]*MetadataMatch, error) {
+	registered, ok := metadataSchemas[schema]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown schema %q", errInvalidMetadata, schema)
+	}
+	query := `SELECT uri FROM payment_metadata m WHERE schema = ?`
+	args := []interface{}{schema}
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, ok := registered.field(name)
+		if !ok || !field.Indexed {
+			return nil, fmt.Errorf("%w: %s is not an indexed field of %s", errInvalidMetadata, name, schema)
+		}
+		value := strings.TrimSpace(filters[name])
+		if field.Type == MetadataDate {
+			var err error
+			if value, err = checkMetadataField(field, json.RawMessage(fmt.Sprintf("%q", value))); err != nil {
+				return nil, fmt.Errorf("%w: %s %v", errInvalidMetadata, name, err)
+			}
+		}
+		query += ` AND EXISTS (SELECT 1 FROM payment_metadata_fields f WHERE f.uri = m.uri AND f.field = ? AND f.value = ?)`
+		args = append(args, name, value)
+	}
+	if limit <= 0 || limit > maxMetadataSearchLimit {
+		limit = defaultMetadataSearchLimit
+	}
+	query += ` ORDER BY validated_at DESC, uri LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search metadata: %w", err)
+	}
+	var uris []string
+	for rows.Next() {
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		uris = append(uris, uri)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	matches := make([]*MetadataMatch, 0, len(uris))
+	for _, uri := range uris {
+		record, err := s.get(uri)
+		if err != nil {
+			return nil, err
+		}
+		match := &MetadataMatch{PaymentMetadata: record}
+		for _, ids := range []struct {
+			into  *[]string
+			query string
+		}{
+			{&match.Payments, `SELECT id FROM payments WHERE metadata = ? ORDER BY created_at`},
+			{&match.Intents, `SELECT id FROM payment_intents WHERE metadata_uri = ? ORDER BY created_at`},
+			{&match.Splits, `SELECT id FROM split_payments WHERE metadata_uri = ? ORDER BY created_at`},
+		} {
+			if *ids.into, err = queryIDs(ids.query, uri); err != nil {
+				return nil, err
+			}
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
+
+// queryIDs returns the single column of query's rows
+func queryIDs(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// retrieveFromStorage reads a stored object from the storage worker
+func retrieveFromStorage(ctx context.Context, cid string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, storageServiceURL+"/api/storage/retrieve/"+url.PathEscape(cid), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("storage worker returned %d for %s: %s", resp.StatusCode, cid, message)
+	}
+	var result struct {
+		Data []byte `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testInvoice = `{
+	"schema": "invoice",
+	"invoice_number": " INV-1042 ",
+	"issuer": "Acme Coffee",
+	"customer": "Alice",
+	"issued_at": "2026-03-01T09:30:00Z",
+	"total": "120.50",
+	"line_items": [{"description": "Beans", "amount": 120.5}],
+	"reference": "not in the schema"
+}`
+
+// metadataOrigin serves metadata documents by path and counts the fetches
+type metadataOrigin struct {
+	documents map[string]string
+	fetches   int
+}
+
+// setupMetadataTest returns a metadata service, an origin serving its
+// documents, and the objects stored with the fake storage worker by CID
+func setupMetadataTest(t *testing.T) (*metadataService, *metadataOrigin, string, map[string][]byte) {
+	setupTestDB(t)
+
+	origin := &metadataOrigin{documents: map[string]string{"/invoice.json": testInvoice}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin.fetches++
+		document, ok := origin.documents[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(document))
+	}))
+	t.Cleanup(server.Close)
+
+	objects := map[string][]byte{}
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/storage/upload":
+			assert.Equal(t, "attachment", r.FormValue("class"))
+			file, _, err := r.FormFile("file")
+			require.NoError(t, err)
+			data, err := io.ReadAll(file)
+			require.NoError(t, err)
+			objects["bafymetadata"] = data
+			w.Write([]byte(`{"cid": "bafymetadata"}`))
+		case strings.HasPrefix(r.URL.Path, "/api/storage/retrieve/"):
+			data, ok := objects[strings.TrimPrefix(r.URL.Path, "/api/storage/retrieve/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(storage.Close)
+
+	setGlobal(t, &storageServiceURL, storage.URL)
+
+	service := &metadataService{client: http.DefaultClient, allowHTTP: true, now: time.Now}
+	setGlobal(t, &paymentMetadata, service)
+	return service, origin, server.URL, objects
+}
+
+func TestPaymentMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should validate, cache and index a document once", func(t *testing.T) {
+		service, origin, url, objects := setupMetadataTest(t)
+
+		record, err := service.validate(ctx, url+"/invoice.json")
+		require.NoError(t, err)
+		assert.Equal(t, "invoice", record.Schema)
+		assert.Equal(t, "bafymetadata", record.CID)
+		assert.Equal(t, testInvoice, string(objects["bafymetadata"]))
+		assert.Equal(t, map[string]string{
+			"invoice_number": "INV-1042",
+			"issuer":         "Acme Coffee",
+			"customer":       "Alice",
+			"issued_at":      "2026-03-01",
+		}, record.Fields)
+
+		// The origin changing does not change the validated document
+		origin.documents["/invoice.json"] = `{"schema": "invoice"}`
+		again, err := service.validate(ctx, url+"/invoice.json")
+		require.NoError(t, err)
+		assert.Equal(t, record.Digest, again.Digest)
+		assert.Equal(t, 1, origin.fetches)
+
+		document, err := service.document(ctx, url+"/invoice.json")
+		require.NoError(t, err)
+		assert.JSONEq(t, testInvoice, string(document.Document))
+	})
+
+	t.Run("should read ipfs documents through the storage worker", func(t *testing.T) {
+		service, _, _, objects := setupMetadataTest(t)
+		objects["bafydonation"] = []byte(`{"schema": "donation", "campaign": "Clean Water", "anonymous": true}`)
+
+		record, err := service.validate(ctx, "ipfs://bafydonation")
+		require.NoError(t, err)
+		assert.Equal(t, "donation", record.Schema)
+		assert.Equal(t, "bafydonation", record.CID)
+		assert.NotContains(t, objects, "bafymetadata")
+
+		_, err = service.validate(ctx, "ipfs://bafymissing")
+		assert.ErrorIs(t, err, errMetadataUnavailable)
+	})
+
+	t.Run("should reject documents that do not match their schema", func(t *testing.T) {
+		service, origin, url, _ := setupMetadataTest(t)
+		for path, document := range map[string]string{
+			"/missing.json":  `{"schema": "payroll", "employer": "Acme", "employee_id": "E-7", "period_start": "2026-03-01", "gross": 4200}`,
+			"/types.json":    `{"schema": "invoice", "invoice_number": 1042, "issuer": "Acme", "issued_at": "March 1st", "total": "lots"}`,
+			"/unknown.json":  `{"schema": "receipt"}`,
+			"/unnamed.json":  `{"invoice_number": "INV-1"}`,
+			"/not-json.json": `<html></html>`,
+			"/large.json":    `{"schema": "donation", "campaign": "` + strings.Repeat("a", maxMetadataSize) + `"}`,
+		} {
+			origin.documents[path] = document
+			_, err := service.validate(ctx, url+path)
+			assert.ErrorIs(t, err, errInvalidMetadata, path)
+		}
+
+		_, err := service.validate(ctx, url+"/types.json")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invoice_number must be a string")
+		assert.Contains(t, err.Error(), "issued_at must be")
+		assert.Contains(t, err.Error(), "total must be a number")
+
+		_, err = service.validate(ctx, url+"/gone.json")
+		assert.ErrorIs(t, err, errMetadataUnavailable)
+		_, err = service.validate(ctx, "ftp://example.com/invoice.json")
+		assert.ErrorIs(t, err, errInvalidMetadata)
+
+		service.allowHTTP = false
+		_, err = service.validate(ctx, url+"/invoice.json")
+		assert.ErrorIs(t, err, errInvalidMetadata)
+	})
+
+	t.Run("should search documents by their indexed fields", func(t *testing.T) {
+		service, origin, url, _ := setupMetadataTest(t)
+		origin.documents["/other.json"] = strings.Replace(testInvoice, "INV-1042", "INV-1043", 1)
+		for _, path := range []string{"/invoice.json", "/other.json"} {
+			_, err := service.validate(ctx, url+path)
+			require.NoError(t, err)
+		}
+		_, err := db.Exec(`INSERT INTO payments (id, chain_id, sender, recipient, token, amount, metadata) VALUES ('7', 4202, ?, ?, ?, '1000', ?)`,
+			contactAlice, settlementMerchant, "0x0000000000000000000000000000000000000000", url+"/invoice.json")
+		require.NoError(t, err)
+
+		matches, err := service.search("invoice", map[string]string{"invoice_number": "inv-1042", "issued_at": "2026-03-01T23:00:00Z"}, 0)
+		require.NoError(t, err)
+		require.Len(t, matches, 1)
+		assert.Equal(t, url+"/invoice.json", matches[0].URI)
+		assert.Equal(t, []string{"7"}, matches[0].Payments)
+		assert.Empty(t, matches[0].Intents)
+
+		matches, err = service.search("invoice", map[string]string{"issuer": "acme coffee"}, 0)
+		require.NoError(t, err)
+		assert.Len(t, matches, 2)
+
+		_, err = service.search("invoice", map[string]string{"total": "120.50"}, 0)
+		assert.ErrorIs(t, err, errInvalidMetadata)
+		_, err = service.search("receipt", nil, 0)
+		assert.ErrorIs(t, err, errInvalidMetadata)
+	})
+
+	t.Run("should refuse payments with invalid metadata", func(t *testing.T) {
+		_, origin, url, _ := setupMetadataTest(t)
+		origin.documents["/bad.json"] = `{"schema": "invoice"}`
+		setGlobal(t, &tokens, &tokenRegistry{mode: AllowlistOff})
+		setGlobal(t, &kyc, &kycService{mode: KYCOff})
+
+		body := `{"sender": "` + contactAlice + `", "recipient": "` + settlementMerchant + `", "token": "0x0000000000000000000000000000000000000000", "amount": "1000", "metadata_uri": "` + url + `/bad.json"}`
+		w := httptest.NewRecorder()
+		handleCreatePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/create", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "invoice_number is required")
+
+		w = httptest.NewRecorder()
+		handleSearchMetadata(w, httptest.NewRequest(http.MethodGet, "/api/metadata/search?schema=invoice&notes=x", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = httptest.NewRecorder()
+		handleGetMetadata(w, httptest.NewRequest(http.MethodGet, "/api/metadata?uri="+url+"/bad.json", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// A payroll run pays many recipients from one sender in a single batch. A
+// CSV of recipients, ENS names or addresses, and amounts is imported as a
+// preview: names are resolved through the ENS resolver's batch endpoint and
+// every row is validated. A preview without errors is submitted as a split
+// payment with fixed amounts, one leg per row, and each row follows the
+// payment of its leg.
+
+// Payroll run statuses. A run is a preview until it is submitted; it is paid
+// or failed once its split is.
+const (
+	PayrollPreview   = "preview"
+	PayrollSubmitted = "submitted"
+	PayrollPaid      = "paid"
+	PayrollFailed    = "failed"
+)
+
+// Payroll row statuses. Rows are valid or invalid in a preview, then pending
+// until their payment is created.
+const (
+	PayrollRowValid   = "valid"
+	PayrollRowInvalid = "invalid"
+	PayrollRowPending = "pending"
+	PayrollRowPaid    = "paid"
+	PayrollRowFailed  = "failed"
+)
+
+const (
+	maxPayrollCSVSize   = 1 << 20
+	ensBatchResolveSize = 50
+)
+
+var (
+	errPayrollNotFound  = errors.New("payroll run not found")
+	errInvalidPayroll   = errors.New("invalid payroll")
+	errPayrollSubmitted = errors.New("payroll run was already submitted")
+	errENSUnavailable   = errors.New("ENS resolver unavailable")
+)
+
+// payroll is always set; payroll runs are kept in the payments database
+var payroll *payrollService
+
+type payrollService struct {
+	// resolve returns the addresses of the ENS names it resolved
+	resolve func(ctx context.Context, names []string) (map[string]string, error)
+	now     func() time.Time
+}
+
+// PayrollImport is a CSV to import as a payroll run from Sender in Token
+type PayrollImport struct {
+	Sender      string
+	Token       string
+	MetadataURI string
+	CSV         io.Reader
+}
+
+// PayrollRun is an imported payroll and its rows. Total is the sum of the
+// valid rows, and Errors the number of invalid ones. SplitID is the split
+// payment the run was submitted as.
+type PayrollRun struct {
+	ID          string        `json:"id"`
+	Sender      string        `json:"sender"`
+	Token       string        `json:"token"`
+	MetadataURI string        `json:"metadata_uri,omitempty"`
+	Status      string        `json:"status"`
+	Total       string        `json:"total"`
+	Errors      int           `json:"errors"`
+	SplitID     string        `json:"split_id,omitempty"`
+	Reason      string        `json:"reason,omitempty"`
+	Rows        []*PayrollRow `json:"rows"`
+	CreatedAt   time.Time     `json:"created_at"`
+	SubmittedAt *time.Time    `json:"submitted_at,omitempty"`
+}
+
+// PayrollRow is one line of an imported CSV. Recipient is as it was given,
+// and Address what it resolved to.
+type PayrollRow struct {
+	Line      int    `json:"line"`
+	Recipient string `json:"recipient"`
+	ENSName   string `json:"ens_name,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Amount    string `json:"amount"`
+	Reference string `json:"reference,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	PaymentID string `json:"payment_id,omitempty"`
+	TxHash    string `json:"tx_hash,omitempty"`
+	// leg is the row's leg in the split, -1 for invalid rows
+	leg int
+}
+
+// parsePayrollCSV reads the rows of a payroll CSV. The header names the
+// columns: recipient and amount, in the token's smallest unit, and an
+// optional reference. Other columns are ignored, and rows missing a column
+// are kept with an error.
+func parsePayrollCSV(r io.Reader) ([]*PayrollRow, error) {
+	reader := csv.NewReader(io.LimitReader(r, maxPayrollCSVSize))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: the CSV is empty", errInvalidPayroll)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidPayroll, err)
+	}
+	columns := map[string]int{"reference": -1}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"recipient", "amount"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("%w: the CSV has no %s column", errInvalidPayroll, required)
+		}
+	}
+
+	var rows []*PayrollRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidPayroll, err)
+		}
+		line, _ := reader.FieldPos(0)
+		if len(rows) == maxSplitRecipients {
+			return nil, fmt.Errorf("%w: a payroll run has at most %d rows", errInvalidPayroll, maxSplitRecipients)
+		}
+
+		row := &PayrollRow{Line: line, Status: PayrollRowValid, leg: -1}
+		field := func(name string) string {
+			if i := columns[name]; i >= 0 && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row.Recipient, row.Amount, row.Reference = field("recipient"), field("amount"), field("reference")
+		if columns["recipient"] >= len(record) || columns["amount"] >= len(record) {
+			row.Status, row.Error = PayrollRowInvalid, "row is missing columns"
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("%w: a payroll run needs between 2 and %d rows", errInvalidPayroll, maxSplitRecipients)
+	}
+	return rows, nil
+}
+
+// preview imports a CSV as a payroll run, resolving its ENS names and
+// validating every row
+func (s *payrollService) preview(ctx context.Context, request *PayrollImport) (*PayrollRun, error) {
+	for _, address := range []string{request.Sender, request.Token} {
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("%w: invalid address %q", errInvalidPayroll, address)
+		}
+	}
+	rows, err := parsePayrollCSV(request.CSV)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve every name at once
+	var names []string
+	named := make(map[string]bool)
+	for _, row := range rows {
+		if row.Status == PayrollRowValid && !common.IsHexAddress(row.Recipient) && strings.Contains(row.Recipient, ".") {
+			row.ENSName = strings.ToLower(row.Recipient)
+			if !named[row.ENSName] {
+				named[row.ENSName] = true
+				names = append(names, row.ENSName)
+			}
+		}
+	}
+	resolved := map[string]string{}
+	if len(names) > 0 {
+		if resolved, err = s.resolve(ctx, names); err != nil {
+			return nil, fmt.Errorf("%w: %v", errENSUnavailable, err)
+		}
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	run := &PayrollRun{
+		ID:          hexutil.Encode(id),
+		Sender:      strings.ToLower(request.Sender),
+		Token:       strings.ToLower(request.Token),
+		MetadataURI: request.MetadataURI,
+		Status:      PayrollPreview,
+		Rows:        rows,
+		CreatedAt:   s.now().UTC(),
+	}
+	total := new(big.Int)
+	seen := make(map[string]int)
+	for _, row := range rows {
+		if row.Status == PayrollRowValid {
+			row.Error = s.check(row, resolved, seen)
+		}
+		if row.Error != "" {
+			row.Status = PayrollRowInvalid
+			run.Errors++
+			continue
+		}
+		amount, _ := new(big.Int).SetString(row.Amount, 10)
+		total.Add(total, amount)
+	}
+	run.Total = total.String()
+
+	if err := s.save(run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// check validates a row, setting its address, and returns what is wrong
+// with it. seen holds the lines of the addresses already in the run.
+func (s *payrollService) check(row *PayrollRow, resolved map[string]string, seen map[string]int) string {
+	switch {
+	case row.Recipient == "":
+		return "recipient is required"
+	case row.ENSName != "":
+		address, ok := resolved[row.ENSName]
+		if !ok || !common.IsHexAddress(address) {
+			return fmt.Sprintf("%s does not resolve to an address", row.Recipient)
+		}
+		row.Address = strings.ToLower(address)
+	case common.IsHexAddress(row.Recipient):
+		row.Address = strings.ToLower(row.Recipient)
+	default:
+		return fmt.Sprintf("%q is neither an address nor an ENS name", row.Recipient)
+	}
+	if common.HexToAddress(row.Address) == (common.Address{}) {
+		return "recipient is the zero address"
+	}
+	if err := erasures.check(row.Address); err != nil {
+		return err.Error()
+	}
+
+	amount, ok := new(big.Int).SetString(row.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		return fmt.Sprintf("invalid amount %q", row.Amount)
+	}
+	if line, ok := seen[row.Address]; ok {
+		return fmt.Sprintf("recipient is also paid on line %d", line)
+	}
+	seen[row.Address] = row.Line
+	return ""
+}
+
+// splitRequest returns the split payment a previewed run is submitted as.
+// Factory and FactoryData deploy the sender's smart account.
+func (s *payrollService) splitRequest(run *PayrollRun, factory, factoryData string) (*SplitPaymentRequest, error) {
+	if run.Status != PayrollPreview {
+		return nil, errPayrollSubmitted
+	}
+	if run.Errors > 0 {
+		return nil, fmt.Errorf("%w: %d rows have errors; fix them and import the CSV again", errInvalidPayroll, run.Errors)
+	}
+	request := &SplitPaymentRequest{
+		Sender:      run.Sender,
+		Factory:     factory,
+		FactoryData: factoryData,
+		Token:       run.Token,
+		Amount:      run.Total,
+		MetadataURI: run.MetadataURI,
+	}
+	for _, row := range run.Rows {
+		request.Recipients = append(request.Recipients, &SplitShare{Recipient: row.Address, Amount: row.Amount})
+	}
+	return request, nil
+}
+
+// submit records the split a run was submitted as. The legs are in the
+// order of the rows.
+func (s *payrollService) submit(run *PayrollRun, split *SplitPayment) error {
+	now := s.now().UTC()
+	result, err := db.Exec(`UPDATE payroll_runs SET status = ?, split_id = ?, submitted_at = ? WHERE id = ? AND status = ?`,
+		PayrollSubmitted, split.ID, now, run.ID, PayrollPreview)
+	if err != nil {
+		return fmt.Errorf("failed to submit payroll run %s: %w", run.ID, err)
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return errPayrollSubmitted
+	}
+	for i, row := range run.Rows {
+		if _, err := db.Exec(`UPDATE payroll_rows SET leg_index = ? WHERE run_id = ? AND line = ?`, i, run.ID, row.Line); err != nil {
+			return fmt.Errorf("failed to submit payroll run %s: %w", run.ID, err)
+		}
+		row.leg = i
+	}
+	run.Status, run.SplitID, run.SubmittedAt = PayrollSubmitted, split.ID, &now
+	s.follow(run, split)
+	return nil
+}
+
+// follow sets the status of a submitted run and its rows from its split
+func (s *payrollService) follow(run *PayrollRun, split *SplitPayment) {
+	switch split.Status {
+	case SplitExecuted:
+		run.Status = PayrollPaid
+	case SplitFailed:
+		run.Status, run.Reason = PayrollFailed, split.Reason
+	}
+	for _, row := range run.Rows {
+		if row.leg < 0 || row.leg >= len(split.Legs) {
+			continue
+		}
+		leg := split.Legs[row.leg]
+		row.PaymentID, row.TxHash = leg.PaymentID, leg.TxHash
+		switch {
+		case leg.PaymentID != "":
+			row.Status = PayrollRowPaid
+		case split.Status == SplitFailed:
+			row.Status, row.Error = PayrollRowFailed, split.Reason
+		default:
+			row.Status = PayrollRowPending
+		}
+	}
+}
+
+// save stores a previewed run and its rows
+func (s *payrollService) save(run *PayrollRun) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO payroll_runs (id, sender, token, metadata_uri, status, total, errors, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.ID, run.Sender, run.Token, run.MetadataURI, run.Status, run.Total, run.Errors, run.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store payroll run: %w", err)
+	}
+	for _, row := range run.Rows {
+		_, err := tx.Exec(`INSERT INTO payroll_rows (run_id, line, recipient, ens_name, address, amount, reference, status, error, leg_index) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			run.ID, row.Line, row.Recipient, row.ENSName, row.Address, row.Amount, row.Reference, row.Status, row.Error, row.leg)
+		if err != nil {
+			return fmt.Errorf("failed to store payroll row: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// get returns the run with id and its rows, following its split
+func (s *payrollService) get(id string) (*PayrollRun, error) {
+	found, err := s.query(`WHERE id = ?`, strings.ToLower(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, errPayrollNotFound
+	}
+	return found[0], nil
+}
+
+// list returns the runs of sender, newest first
+func (s *payrollService) list(sender string) ([]*PayrollRun, error) {
+	return s.query(`WHERE sender = ? ORDER BY created_at DESC`, strings.ToLower(sender))
+}
+
+// query returns the runs matching where with their rows
+func (s *payrollService) query(where string, args ...interface{}) ([]*PayrollRun, error) {
+	rows, err := db.Query(`SELECT id, sender, token, metadata_uri, status, total, errors, split_id, created_at, submitted_at FROM payroll_runs `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	var found []*PayrollRun
+	for rows.Next() {
+		run := &PayrollRun{}
+		var submittedAt sql.NullTime
+		err := rows.Scan(&run.ID, &run.Sender, &run.Token, &run.MetadataURI, &run.Status, &run.Total, &run.Errors,
+			&run.SplitID, &run.CreatedAt, &submittedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if submittedAt.Valid {
+			run.SubmittedAt = &submittedAt.Time
+		}
+		found = append(found, run)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, run := range found {
+		if run.Rows, err = s.rows(run.ID); err != nil {
+			return nil, err
+		}
+		if run.SplitID == "" {
+			continue
+		}
+		split, err := splits.get(run.SplitID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load split of payroll run %s: %w", run.ID, err)
+		}
+		s.follow(run, split)
+	}
+	return found, nil
+}
+
+// rows returns a run's rows in order
+func (s *payrollService) rows(runID string) ([]*PayrollRow, error) {
+	rows, err := db.Query(`SELECT line, recipient, ens_name, address, amount, reference, status, error, leg_index FROM payroll_rows WHERE run_id = ? ORDER BY line`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := []*PayrollRow{}
+	for rows.Next() {
+		row := &PayrollRow{}
+		err := rows.Scan(&row.Line, &row.Recipient, &row.ENSName, &row.Address, &row.Amount, &row.Reference, &row.Status, &row.Error, &row.leg)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, row)
+	}
+	return found, rows.Err()
+}
+
+// resolveENSNames resolves names through the ENS resolver's batch endpoint,
+// in batches of the most it takes. Names it could not resolve are left out.
+func resolveENSNames(ctx context.Context, names []string) (map[string]string, error) {
+	resolved := make(map[string]string, len(names))
+	for start := 0; start < len(names); start += ensBatchResolveSize {
+		end := min(start+ensBatchResolveSize, len(names))
+		body, err := json.Marshal(map[string]interface{}{"names": names[start:end]})
+		if err != nil {
+			return nil, err
+		}
+		batch, err := resolveENSBatch(ctx, body)
+		if err != nil {
+			return nil, err
+		}
+		for name, address := range batch {
+			resolved[name] = address
+		}
+	}
+	return resolved, nil
+}
+
+// resolveENSBatch resolves one batch of names, within ensCallTimeout
+func resolveENSBatch(ctx context.Context, body []byte) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, ensCallTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ensServiceURL+"/api/ens/resolve/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ENS resolver returned %d", resp.StatusCode)
+	}
+	var result struct {
+		Results []struct {
+			Name    string `json:"name"`
+			Address string `json:"address"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]string, len(result.Results))
+	for _, record := range result.Results {
+		resolved[strings.ToLower(record.Name)] = record.Address
+	}
+	return resolved, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPayrollCSV = `recipient,amount,reference,department
+alice.eth,3000,E-1,engineering
+` + splitBob + `,2000,E-2,design
+`
+
+// setupPayroll resolves ENS names from names, recording each batch it is
+// asked for
+func setupPayroll(t *testing.T, names map[string]string) *[][]string {
+	var batches [][]string
+	setGlobal(t, &payroll, &payrollService{
+		resolve: func(ctx context.Context, batch []string) (map[string]string, error) {
+			batches = append(batches, batch)
+			resolved := make(map[string]string)
+			for _, name := range batch {
+				if address, ok := names[name]; ok {
+					resolved[name] = address
+				}
+			}
+			return resolved, nil
+		},
+		now: time.Now,
+	})
+	return &batches
+}
+
+// importPayroll posts csv to the import endpoint as kycSender's native
+// token run
+func importPayroll(t *testing.T, csv string) *httptest.ResponseRecorder {
+	query := url.Values{"sender": {kycSender}, "token": {nativeToken}}
+	w := httptest.NewRecorder()
+	handleImportPayroll(w, httptest.NewRequest(http.MethodPost, "/api/payroll/import?"+query.Encode(), strings.NewReader(csv)))
+	return w
+}
+
+func TestParsePayrollCSV(t *testing.T) {
+	t.Run("should read the named columns with their line numbers", func(t *testing.T) {
+		rows, err := parsePayrollCSV(strings.NewReader("Amount, Recipient\n10, alice.eth\n\n20\n"))
+		require.NoError(t, err)
+		require.Len(t, rows, 2)
+		assert.Equal(t, PayrollRow{Line: 2, Recipient: "alice.eth", Amount: "10", Status: PayrollRowValid, leg: -1}, *rows[0])
+		assert.Equal(t, 4, rows[1].Line)
+		assert.Equal(t, PayrollRowInvalid, rows[1].Status)
+		assert.Equal(t, "row is missing columns", rows[1].Error)
+	})
+
+	t.Run("should reject CSVs that are not payroll runs", func(t *testing.T) {
+		many := "recipient,amount\n" + strings.Repeat(splitBob+",1\n", maxSplitRecipients+1)
+		for name, csv := range map[string]string{
+			"empty":        "",
+			"no amount":    "recipient,reference\nalice.eth,E-1\nbob.eth,E-2\n",
+			"one row":      "recipient,amount\nalice.eth,10\n",
+			"too many":     many,
+			"bad quoting":  "recipient,amount\n\"alice.eth,10\nbob.eth,20\n",
+			"only headers": "recipient,amount\n",
+		} {
+			_, err := parsePayrollCSV(strings.NewReader(csv))
+			assert.ErrorIs(t, err, errInvalidPayroll, name)
+		}
+	})
+}
+
+func TestPayrollRuns(t *testing.T) {
+	t.Run("should preview a run with its names resolved in one batch", func(t *testing.T) {
+		setupSandboxTest(t)
+		setupSplitHandlers(t)
+		batches := setupPayroll(t, map[string]string{"alice.eth": splitAlice, "carol.eth": splitCarol})
+
+		w := importPayroll(t, `recipient,amount,reference
+alice.eth,3000,E-1
+unknown.eth,1000,E-2
+`+splitAlice+`,500,E-3
+carol.eth,-5,E-4
+bob,100,E-5
+`+nativeToken+`,100,E-6
+carol.eth,250,E-7
+`)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var run PayrollRun
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&run))
+		assert.Equal(t, [][]string{{"alice.eth", "unknown.eth", "carol.eth"}}, *batches)
+		assert.Equal(t, PayrollPreview, run.Status)
+		assert.Equal(t, "3250", run.Total)
+		assert.Equal(t, 5, run.Errors)
+
+		errs := make([]string, len(run.Rows))
+		for i, row := range run.Rows {
+			errs[i] = row.Error
+		}
+		assert.Equal(t, []string{
+			"",
+			"unknown.eth does not resolve to an address",
+			"recipient is also paid on line 2",
+			`invalid amount "-5"`,
+			`"bob" is neither an address nor an ENS name`,
+			"recipient is the zero address",
+			"",
+		}, errs)
+		assert.Equal(t, splitAlice, run.Rows[0].Address)
+		assert.Equal(t, "alice.eth", run.Rows[0].ENSName)
+
+		// A run with errors cannot be paid
+		w = httptest.NewRecorder()
+		handleSubmitPayroll(w, httptest.NewRequest(http.MethodPost, "/api/payroll/runs/submit/"+run.ID, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "5 rows have errors")
+	})
+
+	t.Run("should pay a run as a split and track each row", func(t *testing.T) {
+		setupSandboxTest(t)
+		setupSplitHandlers(t)
+		setupPayroll(t, map[string]string{"alice.eth": splitAlice})
+
+		w := importPayroll(t, testPayrollCSV)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var preview PayrollRun
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&preview))
+		assert.Zero(t, preview.Errors)
+		assert.Equal(t, "5000", preview.Total)
+
+		w = httptest.NewRecorder()
+		handleSubmitPayroll(w, httptest.NewRequest(http.MethodPost, "/api/payroll/runs/submit/"+preview.ID, nil))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var response struct {
+			Run   *PayrollRun   `json:"run"`
+			Split *SplitPayment `json:"split"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, PayrollPaid, response.Run.Status)
+		assert.Equal(t, SplitExecuted, response.Split.Status)
+		assert.Equal(t, []string{"3000", "2000"}, legAmounts(response.Split.Legs))
+
+		w = httptest.NewRecorder()
+		handleGetPayroll(w, httptest.NewRequest(http.MethodGet, "/api/payroll/runs/"+preview.ID, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var run PayrollRun
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&run))
+		assert.Equal(t, response.Split.ID, run.SplitID)
+		assert.NotNil(t, run.SubmittedAt)
+		for i, row := range run.Rows {
+			assert.Equal(t, PayrollRowPaid, row.Status)
+			assert.Equal(t, fmt.Sprint(i+1), row.PaymentID)
+			assert.Equal(t, []string{"E-1", "E-2"}[i], row.Reference)
+		}
+		assert.Equal(t, big.NewInt(5005), sandboxChain.Balance(sandboxPaymentCore))
+
+		w = httptest.NewRecorder()
+		handleSubmitPayroll(w, httptest.NewRequest(http.MethodPost, "/api/payroll/runs/submit/"+preview.ID, nil))
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = httptest.NewRecorder()
+		handleGetUserPayrolls(w, httptest.NewRequest(http.MethodGet, "/api/payroll/user/"+kycSender, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var found map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&found))
+		assert.Equal(t, 1.0, found["count"])
+	})
+
+	t.Run("should follow the rows of a run paid by a user operation", func(t *testing.T) {
+		setupSandboxTest(t)
+		setupPayroll(t, map[string]string{"alice.eth": splitAlice})
+		setGlobal(t, &splits, &splitService{now: time.Now})
+
+		run, err := payroll.preview(context.Background(), &PayrollImport{Sender: kycSender, Token: nativeToken, CSV: strings.NewReader(testPayrollCSV)})
+		require.NoError(t, err)
+		request, err := payroll.splitRequest(run, "", "")
+		require.NoError(t, err)
+		legs, err := request.validate()
+		require.NoError(t, err)
+		split, err := splits.create(4202, request, legs, SplitAtomic, "0xop")
+		require.NoError(t, err)
+		require.NoError(t, payroll.submit(run, split))
+
+		run, err = payroll.get(run.ID)
+		require.NoError(t, err)
+		assert.Equal(t, PayrollSubmitted, run.Status)
+		assert.Equal(t, []string{PayrollRowPending, PayrollRowPending}, []string{run.Rows[0].Status, run.Rows[1].Status})
+
+		require.NoError(t, splits.finish(split, SplitFailed, "user operation dropped: "))
+		run, err = payroll.get(run.ID)
+		require.NoError(t, err)
+		assert.Equal(t, PayrollFailed, run.Status)
+		assert.Equal(t, PayrollRowFailed, run.Rows[1].Status)
+		assert.Equal(t, split.Reason, run.Rows[1].Error)
+	})
+
+	t.Run("should answer resolver failures and unknown runs", func(t *testing.T) {
+		setupSandboxTest(t)
+		setupSplitHandlers(t)
+		setupPayroll(t, nil)
+		payroll.resolve = func(context.Context, []string) (map[string]string, error) {
+			return nil, errors.New("connection refused")
+		}
+
+		w := importPayroll(t, testPayrollCSV)
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+
+		w = httptest.NewRecorder()
+		handleGetPayroll(w, httptest.NewRequest(http.MethodGet, "/api/payroll/runs/0x00", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestResolveENSNames(t *testing.T) {
+	t.Run("should resolve names in batches the resolver accepts", func(t *testing.T) {
+		var batches []int
+		resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/api/ens/resolve/batch", r.URL.Path)
+			var request struct {
+				Names []string `json:"names"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+			batches = append(batches, len(request.Names))
+			results := []map[string]string{}
+			for _, name := range request.Names {
+				if name != "unknown.eth" {
+					results = append(results, map[string]string{"name": name, "address": splitAlice})
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"results": results, "errors": []string{"Failed to resolve unknown.eth"}})
+		}))
+		defer resolver.Close()
+		setGlobal(t, &ensServiceURL, resolver.URL)
+
+		names := []string{"unknown.eth"}
+		for i := 0; i < 60; i++ {
+			names = append(names, fmt.Sprintf("employee%d.eth", i))
+		}
+		resolved, err := resolveENSNames(context.Background(), names)
+		require.NoError(t, err)
+		assert.Equal(t, []int{50, 11}, batches)
+		assert.Len(t, resolved, 60)
+		assert.NotContains(t, resolved, "unknown.eth")
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// A quote locks the FTSO rate of a payment's token for a few seconds, so the
+// payment is created at the rate the sender saw when confirming it. The quote
+// token carries the quote and an HMAC-SHA256 of it under the service's key,
+// so nothing is stored until it is redeemed. Each quote creates one payment,
+// and is kept with that payment's ID as the record of its rate.
+
+const (
+	defaultQuoteLock    = 60 * time.Second
+	defaultQuoteMaxLock = 10 * time.Minute
+)
+
+var (
+	errInvalidQuote  = errors.New("invalid quote")
+	errQuoteExpired  = errors.New("quote has expired")
+	errQuoteMismatch = errors.New("quote does not match the payment")
+	errQuoteUsed     = errors.New("quote has already been used")
+	errQuoteUnpriced = errors.New("token has no oracle price")
+)
+
+// quotes is always set; without QUOTE_SIGNING_KEY quotes do not survive a
+// restart
+var quotes *quoteService
+
+type quoteService struct {
+	key     []byte
+	pricer  *tokenPricer
+	maxLock time.Duration
+	now     func() time.Time
+}
+
+// QuoteRequest asks for the rate of a payment to be locked for LockSeconds,
+// or a minute when zero
+type QuoteRequest struct {
+	Sender      string `json:"sender"`
+	Recipient   string `json:"recipient"`
+	Token       string `json:"token"`
+	Amount      string `json:"amount"`
+	LockSeconds int64  `json:"lock_seconds"`
+}
+
+// Quote is a payment's value at a locked rate, in USD per whole token
+type Quote struct {
+	ID        string    `json:"id"`
+	ChainID   int64     `json:"chain_id"`
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	Token     string    `json:"token"`
+	Amount    string    `json:"amount"`
+	Symbol    string    `json:"symbol"`
+	Rate      float64   `json:"rate"`
+	ValueUSD  float64   `json:"value_usd"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// lock prices a payment at the token's current FTSO rate and returns the
+// quote with its token
+func (s *quoteService) lock(ctx context.Context, chainID int64, request *QuoteRequest) (*Quote, string, error) {
+	if request.Sender != "" && !common.IsHexAddress(request.Sender) {
+		return nil, "", fmt.Errorf("%w: invalid sender %q", errInvalidQuote, request.Sender)
+	}
+	if !common.IsHexAddress(request.Recipient) || !common.IsHexAddress(request.Token) {
+		return nil, "", fmt.Errorf("%w: recipient and token must be addresses", errInvalidQuote)
+	}
+	amount, ok := new(big.Int).SetString(request.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		return nil, "", fmt.Errorf("%w: invalid amount %q", errInvalidQuote, request.Amount)
+	}
+	lock := time.Duration(request.LockSeconds) * time.Second
+	if lock == 0 {
+		lock = defaultQuoteLock
+	}
+	if lock < 0 || lock > s.maxLock {
+		return nil, "", fmt.Errorf("%w: lock_seconds must be between 1 and %d", errInvalidQuote, int64(s.maxLock/time.Second))
+	}
+
+	token, err := s.pricer.lookup(ctx, chainID, common.HexToAddress(request.Token))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up token: %w", err)
+	}
+	if token.Symbol == "" {
+		return nil, "", errQuoteUnpriced
+	}
+	rate, err := s.pricer.price(ctx, strings.ToUpper(token.Symbol)+"/USD")
+	if err != nil || rate <= 0 {
+		return nil, "", fmt.Errorf("%w: %s: %v", errQuoteUnpriced, token.Symbol, err)
+	}
+	value := new(big.Float).SetInt(amount)
+	value.Quo(value, new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(token.Decimals)), nil)))
+	value.Mul(value, big.NewFloat(rate))
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	now := s.now().UTC().Truncate(time.Second)
+	quote := &Quote{
+		ID:        hexutil.Encode(id),
+		ChainID:   chainID,
+		Sender:    strings.ToLower(request.Sender),
+		Recipient: strings.ToLower(request.Recipient),
+		Token:     strings.ToLower(request.Token),
+		Amount:    amount.String(),
+		Symbol:    token.Symbol,
+		Rate:      rate,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lock),
+	}
+	quote.ValueUSD, _ = value.Float64()
+
+	payload, err := json.Marshal(quote)
+	if err != nil {
+		return nil, "", err
+	}
+	return quote, base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload)), nil
+}
+
+func (s *quoteService) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// verify returns the quote a token carries, if the token was signed by this
+// service and has not expired
+func (s *quoteService) verify(token string) (*Quote, error) {
+	encoded, encodedMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidQuote
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidQuote
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, s.sign(payload)) {
+		return nil, errInvalidQuote
+	}
+	var quote Quote
+	if err := json.Unmarshal(payload, &quote); err != nil {
+		return nil, errInvalidQuote
+	}
+	if !s.now().Before(quote.ExpiresAt) {
+		return nil, errQuoteExpired
+	}
+	return &quote, nil
+}
+
+// redeem verifies a quote token for a payment and claims the quote, so no
+// other payment can use it
+func (s *quoteService) redeem(token string, chainID int64, sender, recipient, tokenAddress, amount string) (*Quote, error) {
+	quote, err := s.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	units, ok := new(big.Int).SetString(amount, 10)
+	if quote.ChainID != chainID || !strings.EqualFold(quote.Sender, sender) || !strings.EqualFold(quote.Recipient, recipient) ||
+		!strings.EqualFold(quote.Token, tokenAddress) || !ok || units.String() != quote.Amount {
+		return nil, errQuoteMismatch
+	}
+
+	result, err := db.Exec(`INSERT OR IGNORE INTO payment_quotes (id, chain_id, sender, recipient, token, amount, symbol, rate, value_usd, created_at, expires_at, redeemed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		quote.ID, quote.ChainID, quote.Sender, quote.Recipient, quote.Token, quote.Amount, quote.Symbol, quote.Rate, quote.ValueUSD,
+		quote.CreatedAt, quote.ExpiresAt, s.now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem quote: %w", err)
+	}
+	if claimed, _ := result.RowsAffected(); claimed == 0 {
+		return nil, errQuoteUsed
+	}
+	return quote, nil
+}
+
+// release gives back a quote whose payment could not be created
+func (s *quoteService) release(id string) error {
+	_, err := db.Exec(`DELETE FROM payment_quotes WHERE id = ? AND payment_id IS NULL`, id)
+	return err
+}
+
+// attach records the payment a redeemed quote created
+func (s *quoteService) attach(id string, paymentID int64) error {
+	_, err := db.Exec(`UPDATE payment_quotes SET payment_id = ? WHERE id = ?`, paymentID, id)
+	return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupQuoteTest returns a quote service whose clock is at *now and that
+// prices USDC at a dollar
+func setupQuoteTest(t *testing.T) (*quoteService, *time.Time) {
+	setupTestDB(t)
+
+	clock, now := fixedClock(testNow)
+	service := &quoteService{
+		key:     []byte("quote-key"),
+		pricer:  usdcPricer(),
+		maxLock: defaultQuoteMaxLock,
+		now:     clock,
+	}
+	setGlobal(t, &quotes, service)
+	return service, now
+}
+
+func quoteRequest() *QuoteRequest {
+	return &QuoteRequest{Sender: kycSender, Recipient: settlementMerchant, Token: kycUSDC, Amount: usdc(250)}
+}
+
+func TestQuotes(t *testing.T) {
+	t.Run("should lock the rate until the quote expires", func(t *testing.T) {
+		service, now := setupQuoteTest(t)
+
+		quote, token, err := service.lock(context.Background(), 4202, quoteRequest())
+		require.NoError(t, err)
+		assert.Equal(t, "USDC", quote.Symbol)
+		assert.Equal(t, 1.0, quote.Rate)
+		assert.Equal(t, 250.0, quote.ValueUSD)
+		assert.Equal(t, now.Add(time.Minute), quote.ExpiresAt)
+
+		verified, err := service.verify(token)
+		require.NoError(t, err)
+		assert.Equal(t, quote, verified)
+
+		*now = now.Add(time.Minute)
+		_, err = service.verify(token)
+		assert.ErrorIs(t, err, errQuoteExpired)
+	})
+
+	t.Run("should reject altered quotes", func(t *testing.T) {
+		service, _ := setupQuoteTest(t)
+		quote, token, err := service.lock(context.Background(), 4202, quoteRequest())
+		require.NoError(t, err)
+
+		quote.Rate = 0.5
+		payload, err := json.Marshal(quote)
+		require.NoError(t, err)
+		_, mac, _ := strings.Cut(token, ".")
+		_, err = service.verify(base64.RawURLEncoding.EncodeToString(payload) + "." + mac)
+		assert.ErrorIs(t, err, errInvalidQuote)
+
+		other := &quoteService{key: []byte("other-key"), now: service.now}
+		_, err = other.verify(token)
+		assert.ErrorIs(t, err, errInvalidQuote)
+		_, err = service.verify("not a quote")
+		assert.ErrorIs(t, err, errInvalidQuote)
+	})
+
+	t.Run("should reject invalid quote requests", func(t *testing.T) {
+		service, _ := setupQuoteTest(t)
+		for name, modify := range map[string]func(*QuoteRequest){
+			"bad recipient":   func(r *QuoteRequest) { r.Recipient = "shop.eth" },
+			"zero amount":     func(r *QuoteRequest) { r.Amount = "0" },
+			"lock too long":   func(r *QuoteRequest) { r.LockSeconds = 3600 },
+			"negative lock":   func(r *QuoteRequest) { r.LockSeconds = -1 },
+			"unpriced token":  func(r *QuoteRequest) { r.Token = nativeToken },
+			"malformed token": func(r *QuoteRequest) { r.Token = "usdc" },
+		} {
+			request := quoteRequest()
+			modify(request)
+			_, _, err := service.lock(context.Background(), 4202, request)
+			assert.Error(t, err, name)
+		}
+	})
+
+	t.Run("should redeem a quote for the payment it was locked for, once", func(t *testing.T) {
+		service, _ := setupQuoteTest(t)
+		_, token, err := service.lock(context.Background(), 4202, quoteRequest())
+		require.NoError(t, err)
+
+		_, err = service.redeem(token, 4202, kycSender, settlementMerchant, kycUSDC, usdc(300))
+		assert.ErrorIs(t, err, errQuoteMismatch)
+		_, err = service.redeem(token, 1, kycSender, settlementMerchant, kycUSDC, usdc(250))
+		assert.ErrorIs(t, err, errQuoteMismatch)
+
+		quote, err := service.redeem(token, 4202, "0x"+strings.ToUpper(kycSender[2:]), settlementMerchant, kycUSDC, usdc(250))
+		require.NoError(t, err)
+		_, err = service.redeem(token, 4202, kycSender, settlementMerchant, kycUSDC, usdc(250))
+		assert.ErrorIs(t, err, errQuoteUsed)
+
+		require.NoError(t, service.release(quote.ID))
+		_, err = service.redeem(token, 4202, kycSender, settlementMerchant, kycUSDC, usdc(250))
+		require.NoError(t, err)
+		require.NoError(t, service.attach(quote.ID, 7))
+		require.NoError(t, service.release(quote.ID))
+		_, err = service.redeem(token, 4202, kycSender, settlementMerchant, kycUSDC, usdc(250))
+		assert.ErrorIs(t, err, errQuoteUsed)
+	})
+}
+
+func TestQuotedPayments(t *testing.T) {
+	// setupQuotedPayments creates payments on the sandbox chain with ETH at
+	// $2500
+	setupQuotedPayments := func(t *testing.T) {
+		setupSandboxTest(t)
+		setupSplitHandlers(t)
+		setGlobal(t, &quotes, &quoteService{
+			key: []byte("quote-key"),
+			pricer: &tokenPricer{
+				lookup: func(ctx context.Context, chainID int64, address common.Address) (*Token, error) {
+					return &Token{Symbol: "ETH", Decimals: 18}, nil
+				},
+				price: func(ctx context.Context, symbol string) (float64, error) { return 2500, nil },
+			},
+			maxLock: defaultQuoteMaxLock,
+			now:     time.Now,
+		})
+	}
+	lockQuote := func(t *testing.T, body string) string {
+		w := httptest.NewRecorder()
+		handleLockQuote(w, httptest.NewRequest(http.MethodPost, "/api/payments/quote-lock", strings.NewReader(body)))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var response struct {
+			Quote      *Quote `json:"quote"`
+			QuoteToken string `json:"quote_token"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, 2500.0, response.Quote.Rate)
+		return response.QuoteToken
+	}
+	createPayment := func(quote string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleCreatePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/create", strings.NewReader(
+			`{"sender": "`+kycSender+`", "recipient": "`+settlementMerchant+`", "token": "`+nativeToken+`", "amount": "1000000", "quote": "`+quote+`"}`)))
+		return w
+	}
+
+	t.Run("should create the payment at the locked rate", func(t *testing.T) {
+		setupQuotedPayments(t)
+		quote := lockQuote(t, `{"sender": "`+kycSender+`", "recipient": "`+settlementMerchant+`", "token": "`+nativeToken+`", "amount": "1000000", "lock_seconds": 30}`)
+
+		w := createPayment(quote)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, "2500", response["oracle_price"])
+		assert.NotNil(t, response["quote"])
+
+		var paymentID string
+		require.NoError(t, db.QueryRow(`SELECT payment_id FROM payment_quotes`).Scan(&paymentID))
+		assert.Equal(t, "1", paymentID)
+
+		assert.Equal(t, http.StatusConflict, createPayment(quote).Code)
+	})
+
+	t.Run("should reject expired, altered or mismatched quotes", func(t *testing.T) {
+		setupQuotedPayments(t)
+		quote := lockQuote(t, `{"sender": "`+kycSender+`", "recipient": "`+settlementMerchant+`", "token": "`+nativeToken+`", "amount": "2000000"}`)
+		assert.Equal(t, http.StatusBadRequest, createPayment(quote).Code)
+		assert.Equal(t, http.StatusBadRequest, createPayment(quote[:len(quote)-2]).Code)
+
+		quote = lockQuote(t, `{"sender": "`+kycSender+`", "recipient": "`+settlementMerchant+`", "token": "`+nativeToken+`", "amount": "1000000"}`)
+		quotes.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		w := createPayment(quote)
+		assert.Equal(t, http.StatusGone, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, problem.CodeQuoteExpired, response["code"])
+
+		var count int
+		require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM payments`).Scan(&count))
+		assert.Zero(t, count)
+	})
+
+	t.Run("should keep the quote when travel rule information is missing", func(t *testing.T) {
+		setupQuotedPayments(t)
+		quote := lockQuote(t, `{"sender": "`+kycSender+`", "recipient": "`+settlementMerchant+`", "token": "`+nativeToken+`", "amount": "1000000"}`)
+		setGlobal(t, &travelRule, &travelRuleService{
+			vasp:   &TravelRuleVASP{ID: "crosspay", Name: "CrossPay Ltd"},
+			pricer: quotes.pricer,
+			now:    time.Now,
+		})
+
+		w := createPayment(quote)
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		var count int
+		require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM payments`).Scan(&count))
+		assert.Zero(t, count)
+
+		travelRule = nil
+		assert.Equal(t, http.StatusCreated, createPayment(quote).Code)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Receipts are generated by storage-worker, which reports every attempt to
+// the analytics service. Receipt stats are read from there, with the admin
+// token in ANALYTICS_API_TOKEN.
+
+// receiptStatsClient reads receipt generation stats from the analytics
+// service
+type receiptStatsClient struct {
+	analyticsURL   string
+	analyticsToken string
+	client         *http.Client
+}
+
+// receiptStats is always set; without ANALYTICS_URL there are no stats
+var receiptStats *receiptStatsClient
+
+func initReceiptStats() {
+	receiptStats = &receiptStatsClient{
+		analyticsURL:   strings.TrimRight(os.Getenv("ANALYTICS_URL"), "/"),
+		analyticsToken: os.Getenv("ANALYTICS_API_TOKEN"),
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// stats fetches the stats over query's window and chain_id. An error
+// status from analytics is returned with its message.
+func (c *receiptStatsClient) stats(ctx context.Context, query url.Values) (json.RawMessage, int, error) {
+	params := url.Values{}
+	for _, key := range []string{"window", "chain_id"} {
+		if value := query.Get(key); value != "" {
+			params.Set(key, value)
+		}
+	}
+	endpoint := c.analyticsURL + "/api/analytics/receipts/stats"
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if c.analyticsToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.analyticsToken)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("analytics service unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, http.StatusBadRequest, fmt.Errorf("%s", strings.TrimSpace(string(message)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, http.StatusBadGateway, fmt.Errorf("analytics service returned status %d", resp.StatusCode)
+	}
+
+	var response struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("invalid analytics response: %w", err)
+	}
+	return response.Data, http.StatusOK, nil
+}
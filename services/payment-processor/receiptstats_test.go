@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiptStats(t *testing.T) {
+	analytics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/analytics/receipts/stats", r.URL.Path)
+		assert.Equal(t, "Bearer analytics-token", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("window") == "1y" {
+			http.Error(w, "Invalid window", http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, "7d", r.URL.Query().Get("window"))
+		w.Write([]byte(`{"success": true, "data": {"window": "7d", "attempts": 10, "total_receipts": 8, "failures": 2, "failure_reasons": {"storage_failed": 2}}}`))
+	}))
+	defer analytics.Close()
+
+	t.Setenv("ANALYTICS_URL", analytics.URL+"/")
+	t.Setenv("ANALYTICS_API_TOKEN", "analytics-token")
+	initReceiptStats()
+
+	t.Run("should serve the stats analytics counted", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleGetReceiptStats(w, httptest.NewRequest(http.MethodGet, "/api/analytics/receipts/stats?window=7d", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		var stats map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+		assert.Equal(t, float64(8), stats["total_receipts"])
+		assert.Equal(t, map[string]interface{}{"storage_failed": float64(2)}, stats["failure_reasons"])
+	})
+
+	t.Run("should pass on invalid requests", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleGetReceiptStats(w, httptest.NewRequest(http.MethodGet, "/api/analytics/receipts/stats?window=1y", nil))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Invalid window")
+	})
+
+	t.Run("should be unavailable without analytics", func(t *testing.T) {
+		t.Setenv("ANALYTICS_URL", "")
+		initReceiptStats()
+		w := httptest.NewRecorder()
+		handleGetReceiptStats(w, httptest.NewRequest(http.MethodGet, "/api/analytics/receipts/stats", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/sandbox"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Sandbox mode runs the processor against an in-memory chain with a Go
+// PaymentCore, so payments are created and completed on chain without a node
+// or testnet funds. Transaction hashes, payment IDs and block numbers are the
+// same on every run for the same requests.
+
+// sandboxChainID is the chain sandbox mode runs when CHAIN_ID is not set
+const sandboxChainID = 31337
+
+var (
+	sandboxChain       *sandbox.Chain
+	sandboxRPCURL      string
+	sandboxPaymentCore common.Address
+)
+
+// initSandbox starts the sandbox chain when SANDBOX is true and deploys
+// PaymentCore at PAYMENT_CORE_ADDRESS, or at the first contract address of
+// sandbox.DevAddress(0). SANDBOX_GENESIS_TIME pins the genesis block's Unix
+// time, and SANDBOX_BLOCK_INTERVAL mines empty blocks on a timer.
+func initSandbox() {
+	if os.Getenv("SANDBOX") != "true" {
+		return
+	}
+
+	config := sandbox.Config{ChainID: sandboxChainID, Genesis: time.Now()}
+	if value := os.Getenv("CHAIN_ID"); value != "" {
+		chainID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid CHAIN_ID %q", value)
+		}
+		config.ChainID = chainID
+	}
+	if value := os.Getenv("SANDBOX_GENESIS_TIME"); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid SANDBOX_GENESIS_TIME %q", value)
+		}
+		config.Genesis = time.Unix(seconds, 0)
+	}
+	interval := durationEnv("SANDBOX_BLOCK_INTERVAL", 0)
+	config.BlockTime = interval
+
+	paymentCore := crypto.CreateAddress(sandbox.DevAddress(0), 0)
+	if address := os.Getenv("PAYMENT_CORE_ADDRESS"); common.IsHexAddress(address) {
+		paymentCore = common.HexToAddress(address)
+	}
+
+	chain := sandbox.New(config)
+	chain.Deploy(paymentCore, newFakePaymentCore())
+	url, err := chain.Listen("127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Failed to serve sandbox chain: %v", err)
+	}
+	if interval > 0 {
+		go chain.Run(context.Background(), interval)
+	}
+
+	sandboxChain, sandboxRPCURL, sandboxPaymentCore = chain, url, paymentCore
+	log.Printf("Sandbox mode: chain %d served at %s, PaymentCore at %s", config.ChainID, url, paymentCore.Hex())
+}
+
+// rpcURL is RPC_URL, or the sandbox chain in sandbox mode
+func rpcURL() string {
+	if sandboxChain != nil {
+		return sandboxRPCURL
+	}
+	return os.Getenv("RPC_URL")
+}
+
+// chainIDEnv is CHAIN_ID, or the sandbox chain's ID in sandbox mode
+func chainIDEnv() (*big.Int, bool) {
+	if sandboxChain != nil {
+		return sandboxChain.ChainID(), true
+	}
+	return new(big.Int).SetString(os.Getenv("CHAIN_ID"), 10)
+}
+
+// paymentCoreAddress is PAYMENT_CORE_ADDRESS, or the sandbox PaymentCore in
+// sandbox mode
+func paymentCoreAddress() string {
+	if sandboxChain != nil {
+		return sandboxPaymentCore.Hex()
+	}
+	return os.Getenv("PAYMENT_CORE_ADDRESS")
+}
+
+// sandboxCreatePayment creates a payment on the sandbox chain from sender,
+// paying native payments' amount and fee with the transaction, and records it
+// in the payments table. It returns the payment's ID and transaction hash.
+func sandboxCreatePayment(sender, recipient, token, amount, metadataURI, senderENS, recipientENS string) (int64, string, error) {
+	if !common.IsHexAddress(sender) || !common.IsHexAddress(recipient) || !common.IsHexAddress(token) {
+		return 0, "", errors.New("sender, recipient and token must be addresses")
+	}
+	value, ok := new(big.Int).SetString(amount, 10)
+	if !ok {
+		return 0, "", fmt.Errorf("invalid amount %q", amount)
+	}
+	data, err := paymentCoreABI.Pack("createPayment", common.HexToAddress(recipient), common.HexToAddress(token), value, metadataURI, senderENS, recipientENS)
+	if err != nil {
+		return 0, "", err
+	}
+	var payment *big.Int
+	if common.HexToAddress(token) == (common.Address{}) {
+		payment = new(big.Int).Add(value, paymentFee(value))
+	}
+
+	receipt, err := sandboxChain.Impersonate(common.HexToAddress(sender), sandboxPaymentCore, payment, data)
+	if err != nil {
+		return 0, "", err
+	}
+	created := receipt.Logs[0]
+	if _, err := storeCreatedPayment(sandboxChain.ChainID().Int64(), receipt.TxHash.Hex(), created.Topics, created.Data); err != nil {
+		return 0, "", err
+	}
+	return created.Topics[1].Big().Int64(), receipt.TxHash.Hex(), nil
+}
+
+// sandboxCompletePayment completes a payment on the sandbox chain from its
+// recipient
+func sandboxCompletePayment(paymentID string) (string, error) {
+	var recipient string
+	if err := db.QueryRow(`SELECT recipient FROM payments WHERE id = ?`, paymentID).Scan(&recipient); err != nil {
+		return "", fmt.Errorf("failed to load payment %s: %w", paymentID, err)
+	}
+	id, ok := new(big.Int).SetString(paymentID, 10)
+	if !ok {
+		return "", fmt.Errorf("invalid payment ID %q", paymentID)
+	}
+	data, err := paymentCoreABI.Pack("completePayment", id)
+	if err != nil {
+		return "", err
+	}
+	receipt, err := sandboxChain.Impersonate(common.HexToAddress(recipient), sandboxPaymentCore, nil, data)
+	if err != nil {
+		return "", err
+	}
+	return receipt.TxHash.Hex(), nil
+}
+
+// handleSandboxMine mines the number of empty blocks in the blocks query
+// parameter, one by default, to confirm sandbox transactions
+func handleSandboxMine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	blocks := 1
+	if value := r.URL.Query().Get("blocks"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 10000 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid block count"})
+			return
+		}
+		blocks = parsed
+	}
+	sandboxChain.Mine(blocks)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"block_number": sandboxChain.BlockNumber()})
+}
+
+// paymentFee is the fee PaymentCore charges on top of amount
+func paymentFee(amount *big.Int) *big.Int {
+	fee := new(big.Int).Mul(amount, big.NewInt(paymentFeeBasisPoints))
+	return fee.Div(fee, big.NewInt(10000))
+}
+
+// fakePaymentCore is the part of PaymentCore the processor uses. Native
+// payments hold their amount until completed; token payments are recorded
+// without moving tokens.
+type fakePaymentCore struct {
+	nextID   *big.Int
+	payments map[string]*sandboxPayment
+}
+
+type sandboxPayment struct {
+	sender    common.Address
+	recipient common.Address
+	token     common.Address
+	amount    *big.Int
+	completed bool
+}
+
+func newFakePaymentCore() *fakePaymentCore {
+	return &fakePaymentCore{nextID: big.NewInt(1), payments: make(map[string]*sandboxPayment)}
+}
+
+// Call answers createPayment with the ID the payment would get, so payments
+// can be simulated
+func (c *fakePaymentCore) Call(msg *sandbox.Message) ([]byte, error) {
+	method, args, err := c.unpack(msg)
+	if err != nil {
+		return nil, err
+	}
+	if method.Name != "createPayment" {
+		return nil, sandbox.Revert("not supported")
+	}
+	if _, err := c.checkCreate(msg, args); err != nil {
+		return nil, err
+	}
+	return method.Outputs.Pack(c.nextID)
+}
+
+func (c *fakePaymentCore) unpack(msg *sandbox.Message) (*abi.Method, []interface{}, error) {
+	if len(msg.Data) < 4 {
+		return nil, nil, sandbox.Revert("")
+	}
+	method, err := paymentCoreABI.MethodById(msg.Data)
+	if err != nil {
+		return nil, nil, sandbox.Revert("")
+	}
+	args, err := method.Inputs.Unpack(msg.Data[4:])
+	if err != nil {
+		return nil, nil, sandbox.Revert(err.Error())
+	}
+	return method, args, nil
+}
+
+// checkCreate returns the fee of the payment createPayment args create, or
+// the revert
+func (c *fakePaymentCore) checkCreate(msg *sandbox.Message, args []interface{}) (*big.Int, error) {
+	recipient, token, amount := args[0].(common.Address), args[1].(common.Address), args[2].(*big.Int)
+	if recipient == (common.Address{}) || amount.Sign() == 0 {
+		return nil, sandbox.Revert("InvalidPayment")
+	}
+	fee := paymentFee(amount)
+	value := new(big.Int)
+	if token == (common.Address{}) {
+		value.Add(amount, fee)
+	}
+	if msg.Value.Cmp(value) != 0 {
+		return nil, sandbox.Revert("IncorrectValue")
+	}
+	return fee, nil
+}
+
+func (c *fakePaymentCore) Transact(msg *sandbox.Message) ([]*types.Log, error) {
+	method, args, err := c.unpack(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch method.Name {
+	case "createPayment":
+		fee, err := c.checkCreate(msg, args)
+		if err != nil {
+			return nil, err
+		}
+		recipient, token, amount := args[0].(common.Address), args[1].(common.Address), args[2].(*big.Int)
+
+		id := new(big.Int).Set(c.nextID)
+		log, err := sandbox.NewLog(msg.To, paymentCoreABI.Events["PaymentCreated"], id, msg.From, recipient, token, amount, fee, args[3], args[4], args[5])
+		if err != nil {
+			return nil, err
+		}
+		c.payments[id.String()] = &sandboxPayment{sender: msg.From, recipient: recipient, token: token, amount: amount}
+		c.nextID.Add(c.nextID, big.NewInt(1))
+		return []*types.Log{log}, nil
+	case "completePayment":
+		id := args[0].(*big.Int)
+		payment, ok := c.payments[id.String()]
+		if !ok || payment.completed {
+			return nil, sandbox.Revert("InvalidStatus")
+		}
+		if msg.From != payment.sender && msg.From != payment.recipient {
+			return nil, sandbox.Revert("Unauthorized")
+		}
+		if payment.token == (common.Address{}) {
+			if err := msg.Send(payment.recipient, payment.amount); err != nil {
+				return nil, err
+			}
+		}
+		log, err := sandbox.NewLog(msg.To, paymentCoreABI.Events["PaymentCompleted"], id, msg.From)
+		if err != nil {
+			return nil, err
+		}
+		payment.completed = true
+		return []*types.Log{log}, nil
+	}
+	return nil, sandbox.Revert("")
+}
+
+// isRevert reports whether err is a transaction the sandbox chain reverted
+func isRevert(err error) bool {
+	var revert *sandbox.RevertError
+	return errors.As(err, &revert)
+}
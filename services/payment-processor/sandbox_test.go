@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const nativeToken = "0x0000000000000000000000000000000000000000"
+
+func setupSandboxTest(t *testing.T) {
+	setupTestDB(t)
+
+	t.Setenv("SANDBOX", "true")
+	t.Setenv("CHAIN_ID", "4202")
+	t.Setenv("SANDBOX_GENESIS_TIME", "1767225600")
+	initSandbox()
+	t.Cleanup(func() {
+		sandboxChain.Close()
+		sandboxChain = nil
+	})
+}
+
+func TestSandbox(t *testing.T) {
+	t.Run("should point the services at the sandbox chain", func(t *testing.T) {
+		setupSandboxTest(t)
+
+		chainID, ok := chainIDEnv()
+		require.True(t, ok)
+		assert.Equal(t, big.NewInt(4202), chainID)
+
+		client, err := ethclient.Dial(rpcURL())
+		require.NoError(t, err)
+		defer client.Close()
+		code, err := client.CodeAt(context.Background(), common.HexToAddress(paymentCoreAddress()), nil)
+		require.NoError(t, err)
+		assert.NotEmpty(t, code)
+	})
+
+	t.Run("should create payments on chain with the same hashes on every run", func(t *testing.T) {
+		hashes := make([]string, 2)
+		for i := range hashes {
+			t.Run(fmt.Sprintf("run %d", i), func(t *testing.T) {
+				setupSandboxTest(t)
+
+				paymentID, txHash, err := sandboxCreatePayment(kycSender, settlementMerchant, nativeToken, "1000000", "ipfs://receipt", "", "")
+				require.NoError(t, err)
+				assert.Equal(t, int64(1), paymentID)
+				hashes[i] = txHash
+
+				var storedHash, status, amount string
+				require.NoError(t, db.QueryRow(`SELECT tx_hash, status, amount FROM payments WHERE id = '1'`).Scan(&storedHash, &status, &amount))
+				assert.Equal(t, txHash, storedHash)
+				assert.Equal(t, "pending", status)
+				assert.Equal(t, "1000000", amount)
+				assert.Equal(t, big.NewInt(1001000), sandboxChain.Balance(sandboxPaymentCore))
+			})
+		}
+		assert.Equal(t, hashes[0], hashes[1])
+	})
+
+	t.Run("should reject native payments without the fee", func(t *testing.T) {
+		setupSandboxTest(t)
+
+		data, err := paymentCoreABI.Pack("createPayment", common.HexToAddress(settlementMerchant), common.Address{}, big.NewInt(1000000), "", "", "")
+		require.NoError(t, err)
+		_, err = sandboxChain.Impersonate(common.HexToAddress(kycSender), sandboxPaymentCore, big.NewInt(1000000), data)
+		assert.EqualError(t, err, "execution reverted: IncorrectValue")
+		assert.True(t, isRevert(err))
+	})
+
+	t.Run("should complete payments on chain from the recipient", func(t *testing.T) {
+		setupSandboxTest(t)
+		_, _, err := sandboxCreatePayment(kycSender, settlementMerchant, nativeToken, "1000000", "", "", "")
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		handleCompletePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/complete/1", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.NotEmpty(t, response["tx_hash"])
+
+		var status string
+		require.NoError(t, db.QueryRow(`SELECT status FROM payments WHERE id = '1'`).Scan(&status))
+		assert.Equal(t, "completed", status)
+		assert.Equal(t, big.NewInt(1000000), sandboxChain.Balance(common.HexToAddress(settlementMerchant)))
+		assert.Equal(t, big.NewInt(1000), sandboxChain.Balance(sandboxPaymentCore))
+
+		w = httptest.NewRecorder()
+		handleCompletePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/complete/1", nil))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		w = httptest.NewRecorder()
+		handleCompletePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/complete/2", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -1,8 +1,36 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"log"
+	"math/big"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/distributed"
+	"github.com/arcbjorn/crosspay/packages/sandbox"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// defaultRequestTimeout bounds the routes that call the other services
+const defaultRequestTimeout = 30 * time.Second
+
+const (
+	defaultUserOpPollInterval = 15 * time.Second
+	defaultUserOpDropAfter    = 30 * time.Minute
+	defaultKYCPollInterval    = 5 * time.Minute
+
+	defaultGasBudgetReportInterval = 5 * time.Minute
 )
 
 func initStorageClient() {
@@ -26,8 +54,606 @@ func initENSClient() {
 	log.Printf("ENS service URL: %s", ensServiceURL)
 }
 
+// initUserOpService enables sponsored payments when BUNDLER_URL, RPC_URL,
+// CHAIN_ID and PAYMENT_CORE_ADDRESS are set. PAYMASTER_URL is optional;
+// without it operations are built unsponsored.
+func initUserOpService() {
+	bundlerURL := os.Getenv("BUNDLER_URL")
+	if bundlerURL == "" {
+		log.Println("BUNDLER_URL not set, sponsored payments disabled")
+		return
+	}
+	rpcURL, paymentCore := rpcURL(), paymentCoreAddress()
+	chainID, ok := chainIDEnv()
+	if rpcURL == "" || !ok || !common.IsHexAddress(paymentCore) {
+		log.Println("Sponsored payments need RPC_URL, CHAIN_ID and PAYMENT_CORE_ADDRESS, disabled")
+		return
+	}
+	entryPoint := getEnv("ENTRYPOINT_ADDRESS", defaultEntryPoint)
+	if !common.IsHexAddress(entryPoint) {
+		log.Printf("Invalid ENTRYPOINT_ADDRESS %q, sponsored payments disabled", entryPoint)
+		return
+	}
+
+	ctx := context.Background()
+	chain, err := ethclient.DialContext(ctx, rpcURL)
+	if err != nil {
+		log.Printf("Failed to connect to %s, sponsored payments disabled: %v", rpcURL, err)
+		return
+	}
+	bundler, err := rpc.DialContext(ctx, bundlerURL)
+	if err != nil {
+		log.Printf("Failed to connect to bundler, sponsored payments disabled: %v", err)
+		return
+	}
+
+	service := &userOpService{
+		chain:        chain,
+		bundler:      bundler,
+		chainID:      chainID,
+		entryPoint:   common.HexToAddress(entryPoint),
+		paymentCore:  common.HexToAddress(paymentCore),
+		sponsorLimit: 1,
+		pollInterval: durationEnv("USEROP_POLL_INTERVAL", defaultUserOpPollInterval),
+		dropAfter:    durationEnv("USEROP_DROP_AFTER", defaultUserOpDropAfter),
+		now:          time.Now,
+	}
+	if value := os.Getenv("SPONSORED_OPS_PER_SENDER"); value != "" {
+		if limit, err := strconv.Atoi(value); err == nil && limit >= 0 {
+			service.sponsorLimit = limit
+		} else {
+			log.Printf("Invalid SPONSORED_OPS_PER_SENDER %q, using %d", value, service.sponsorLimit)
+		}
+	}
+	if paymasterURL := os.Getenv("PAYMASTER_URL"); paymasterURL != "" {
+		paymaster, err := rpc.DialContext(ctx, paymasterURL)
+		if err != nil {
+			log.Printf("Failed to connect to paymaster, payments will not be sponsored: %v", err)
+		} else {
+			service.paymaster = paymaster
+		}
+		if value := os.Getenv("PAYMASTER_CONTEXT"); value != "" {
+			if err := json.Unmarshal([]byte(value), &service.paymasterContext); err != nil {
+				log.Printf("Ignoring invalid PAYMASTER_CONTEXT: %v", err)
+			}
+		}
+	}
+
+	userOps = service
+	log.Printf("Sponsored payments enabled on chain %s (entry point %s, sponsored: %t)", chainID, entryPoint, service.paymaster != nil)
+}
+
+// initGasBudgets tracks the gas the paymaster sponsors per merchant when
+// sponsored payments have one. GAS_BUDGET_DAILY is every merchant's daily
+// budget in wei, and GAS_BUDGETS_PATH sets budgets per merchant; without
+// either, spend is tracked without limits. Spend is reported to ANALYTICS_URL.
+func initGasBudgets() {
+	if userOps == nil || userOps.paymaster == nil {
+		return
+	}
+	service := &gasBudgetService{
+		chainID:        userOps.chainID.Int64(),
+		budgets:        map[string]*big.Int{},
+		alertPercent:   80,
+		analyticsURL:   strings.TrimRight(os.Getenv("ANALYTICS_URL"), "/"),
+		client:         &http.Client{Timeout: 10 * time.Second},
+		reportInterval: durationEnv("GAS_BUDGET_REPORT_INTERVAL", defaultGasBudgetReportInterval),
+		now:            time.Now,
+	}
+	if value := os.Getenv("GAS_BUDGET_DAILY"); value != "" {
+		budget, ok := new(big.Int).SetString(value, 10)
+		if !ok || budget.Sign() < 0 {
+			log.Fatalf("Invalid GAS_BUDGET_DAILY %q", value)
+		}
+		service.defaultBudget = budget
+	}
+	if path := os.Getenv("GAS_BUDGETS_PATH"); path != "" {
+		budgets, err := loadGasBudgets(path)
+		if err != nil {
+			log.Fatalf("Failed to load gas budgets: %v", err)
+		}
+		service.budgets = budgets
+	}
+	if value := os.Getenv("GAS_BUDGET_ALERT_PERCENT"); value != "" {
+		if percent, err := strconv.ParseFloat(value, 64); err == nil && percent > 0 {
+			service.alertPercent = percent
+		} else {
+			log.Printf("Invalid GAS_BUDGET_ALERT_PERCENT %q, using %.0f", value, service.alertPercent)
+		}
+	}
+
+	gasBudgets = service
+	log.Printf("Gas sponsorship budgets tracked for %d merchants (default budget: %v)", len(service.budgets), service.defaultBudget)
+}
+
+// initIntentService enables payment intents when CHAIN_ID and
+// PAYMENT_CORE_ADDRESS are set. RPC_URL is needed to accept intents signed by
+// smart accounts.
+func initIntentService() {
+	paymentCore := paymentCoreAddress()
+	chainID, ok := chainIDEnv()
+	if !ok || !common.IsHexAddress(paymentCore) {
+		log.Println("CHAIN_ID or PAYMENT_CORE_ADDRESS not set, payment intents disabled")
+		return
+	}
+
+	service := &intentService{
+		chainID:     chainID,
+		paymentCore: common.HexToAddress(paymentCore),
+		now:         time.Now,
+	}
+	if rpcURL := rpcURL(); rpcURL != "" {
+		chain, err := ethclient.DialContext(context.Background(), rpcURL)
+		if err != nil {
+			log.Printf("Failed to connect to %s, only EOA intent signatures accepted: %v", rpcURL, err)
+		} else {
+			service.chain = chain
+		}
+	}
+
+	intents = service
+	log.Printf("Payment intents enabled on chain %s (smart account signatures: %t)", chainID, service.chain != nil)
+}
+
 func initDatabase() {
 	if err := initPaymentDB(); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-}
\ No newline at end of file
+}
+
+// initTokenRegistry loads the curated token list from TOKEN_LIST_PATH and
+// reads unknown tokens on CHAIN_ID through RPC_URL. TOKEN_ALLOWLIST_MODE is
+// off, warn (default) or enforce.
+func initTokenRegistry() {
+	registry := &tokenRegistry{
+		mode:   getEnv("TOKEN_ALLOWLIST_MODE", AllowlistWarn),
+		chains: make(map[int64]chainReader),
+		now:    time.Now,
+	}
+	switch registry.mode {
+	case AllowlistOff, AllowlistWarn, AllowlistEnforce:
+	default:
+		log.Printf("Invalid TOKEN_ALLOWLIST_MODE %q, using %s", registry.mode, AllowlistWarn)
+		registry.mode = AllowlistWarn
+	}
+
+	if chainID, ok := chainIDEnv(); ok {
+		registry.chainID = chainID.Int64()
+		if rpcURL := rpcURL(); rpcURL != "" {
+			if chain, err := ethclient.DialContext(context.Background(), rpcURL); err != nil {
+				log.Printf("Failed to connect to %s, unknown tokens will not be read: %v", rpcURL, err)
+			} else {
+				registry.chains[registry.chainID] = chain
+			}
+		}
+	}
+
+	path := getEnv("TOKEN_LIST_PATH", "./tokens.json")
+	if err := registry.loadTokenList(path); err != nil {
+		log.Printf("Failed to load token list %s: %v", path, err)
+	}
+
+	tokens = registry
+	log.Printf("Token allowlist mode: %s", registry.mode)
+}
+
+// initAddressScreening screens payment parties on the token registry's
+// chain. BURN_ADDRESSES adds comma-separated addresses to the known burn
+// addresses.
+func initAddressScreening() {
+	var extra []string
+	if list := os.Getenv("BURN_ADDRESSES"); list != "" {
+		extra = strings.Split(list, ",")
+	}
+	addresses = newAddressScreener(tokens.chains, common.HexToAddress(paymentCoreAddress()), extra)
+	if _, ok := tokens.chains[tokens.chainID]; !ok {
+		log.Println("RPC_URL not set, contract recipients are not checked for accepting value")
+	}
+}
+
+// initKYC enables KYC when KYC_PROVIDER is sumsub or persona. KYC_TIERS
+// lists the level each payment value needs, and KYC_MODE is off, warn or
+// enforce (default). Tokens are priced through the oracle service.
+func initKYC() {
+	service := &kycService{
+		mode:         getEnv("KYC_MODE", KYCEnforce),
+		pollInterval: durationEnv("KYC_POLL_INTERVAL", defaultKYCPollInterval),
+		pricer:       &tokenPricer{lookup: tokens.lookup, price: getOracleUSDPrice},
+		now:          time.Now,
+	}
+	kyc = service
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	switch name := os.Getenv("KYC_PROVIDER"); name {
+	case "":
+		log.Println("KYC_PROVIDER not set, KYC disabled")
+		service.mode = KYCOff
+		return
+	case KYCProviderSumsub:
+		service.provider = &sumsubProvider{
+			apiURL:        strings.TrimRight(getEnv("KYC_API_URL", "https://api.sumsub.com"), "/"),
+			appToken:      os.Getenv("KYC_API_KEY"),
+			secretKey:     os.Getenv("KYC_API_SECRET"),
+			webhookSecret: os.Getenv("KYC_WEBHOOK_SECRET"),
+			client:        client,
+			now:           time.Now,
+		}
+	case KYCProviderPersona:
+		service.provider = &personaProvider{
+			apiURL:        strings.TrimRight(getEnv("KYC_API_URL", "https://withpersona.com/api/v1"), "/"),
+			apiKey:        os.Getenv("KYC_API_KEY"),
+			webhookSecret: os.Getenv("KYC_WEBHOOK_SECRET"),
+			client:        client,
+			now:           time.Now,
+		}
+	default:
+		log.Printf("Unknown KYC_PROVIDER %q, KYC disabled", name)
+		service.mode = KYCOff
+		return
+	}
+
+	switch service.mode {
+	case KYCOff, KYCWarn, KYCEnforce:
+	default:
+		log.Printf("Invalid KYC_MODE %q, using %s", service.mode, KYCEnforce)
+		service.mode = KYCEnforce
+	}
+	tiers, err := parseKYCTiers(os.Getenv("KYC_TIERS"))
+	if err != nil {
+		log.Fatalf("Invalid KYC_TIERS: %v", err)
+	}
+	if len(tiers) == 0 {
+		log.Println("KYC_TIERS not set, no payment requires KYC")
+	}
+	service.tiers = tiers
+	log.Printf("KYC enabled with %s (mode %s, %d tiers)", service.provider.name(), service.mode, len(tiers))
+}
+
+// initLimits enables limit rules when LIMIT_RULES_PATH lists them.
+// LIMITS_MODE is off, warn or enforce (default). Payments are priced through
+// the oracle service.
+func initLimits() {
+	service := &limitsService{
+		mode:   getEnv("LIMITS_MODE", LimitsEnforce),
+		pricer: &tokenPricer{lookup: tokens.lookup, price: getOracleUSDPrice},
+		now:    time.Now,
+	}
+	limits = service
+
+	path := os.Getenv("LIMIT_RULES_PATH")
+	if path == "" {
+		log.Println("LIMIT_RULES_PATH not set, limits disabled")
+		service.mode = LimitsOff
+		return
+	}
+	switch service.mode {
+	case LimitsOff, LimitsWarn, LimitsEnforce:
+	default:
+		log.Printf("Invalid LIMITS_MODE %q, using %s", service.mode, LimitsEnforce)
+		service.mode = LimitsEnforce
+	}
+	rules, err := loadLimitRules(path)
+	if err != nil {
+		log.Fatalf("Failed to load limit rules %s: %v", path, err)
+	}
+	service.rules = rules
+	log.Printf("Limits enabled (mode %s, %d sender and %d merchant rules)", service.mode, len(rules.Senders), len(rules.Merchants))
+}
+
+// initTravelRule enables the travel rule when TRAVEL_RULE_VASP_ID and
+// TRAVEL_RULE_VASP_NAME identify this VASP. Payments priced at or above
+// TRAVEL_RULE_THRESHOLD_USD need originator and beneficiary information,
+// which is sent to the counterparties listed in TRAVEL_RULE_DIRECTORY_PATH.
+func initTravelRule() {
+	service := &travelRuleService{
+		pricer: &tokenPricer{lookup: tokens.lookup, price: getOracleUSDPrice},
+		client: &http.Client{Timeout: 15 * time.Second},
+		now:    time.Now,
+	}
+	travelRule = service
+
+	id, name := os.Getenv("TRAVEL_RULE_VASP_ID"), os.Getenv("TRAVEL_RULE_VASP_NAME")
+	if id == "" || name == "" {
+		log.Println("TRAVEL_RULE_VASP_ID or TRAVEL_RULE_VASP_NAME not set, travel rule disabled")
+		return
+	}
+	threshold, err := strconv.ParseFloat(getEnv("TRAVEL_RULE_THRESHOLD_USD", "1000"), 64)
+	if err != nil || threshold < 0 {
+		log.Fatalf("Invalid TRAVEL_RULE_THRESHOLD_USD %q", os.Getenv("TRAVEL_RULE_THRESHOLD_USD"))
+	}
+	service.thresholdUSD = threshold
+	service.vasp = &TravelRuleVASP{
+		ID:      id,
+		Name:    name,
+		LEI:     os.Getenv("TRAVEL_RULE_VASP_LEI"),
+		Country: os.Getenv("TRAVEL_RULE_VASP_COUNTRY"),
+	}
+
+	service.directory = map[string]*TravelRuleVASP{}
+	if path := os.Getenv("TRAVEL_RULE_DIRECTORY_PATH"); path != "" {
+		directory, err := loadTravelRuleDirectory(path)
+		if err != nil {
+			log.Fatalf("Failed to load travel rule directory: %v", err)
+		}
+		service.directory = directory
+	} else {
+		log.Println("TRAVEL_RULE_DIRECTORY_PATH not set, only self-hosted beneficiaries are supported")
+	}
+	log.Printf("Travel rule enabled as %s (threshold $%.2f, %d counterparty VASPs)", id, threshold, len(service.directory))
+}
+
+// initSettlementEngine enables merchant settlement when
+// SETTLEMENT_PRIVATE_KEY, the settlement wallet's key, and the merchant list
+// at SETTLEMENT_MERCHANTS_PATH are set. Payouts are sent on CHAIN_ID through
+// RPC_URL. In sandbox mode the wallet defaults to sandbox.DevKey(0).
+func initSettlementEngine() {
+	keyHex, path := os.Getenv("SETTLEMENT_PRIVATE_KEY"), os.Getenv("SETTLEMENT_MERCHANTS_PATH")
+	if keyHex == "" && sandboxChain != nil {
+		keyHex = hex.EncodeToString(crypto.FromECDSA(sandbox.DevKey(0)))
+	}
+	if keyHex == "" || path == "" {
+		log.Println("SETTLEMENT_PRIVATE_KEY or SETTLEMENT_MERCHANTS_PATH not set, settlement disabled")
+		return
+	}
+	rpcURL := rpcURL()
+	chainID, ok := chainIDEnv()
+	if rpcURL == "" || !ok {
+		log.Println("Settlement needs RPC_URL and CHAIN_ID, disabled")
+		return
+	}
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(keyHex, "0x"))
+	if err != nil {
+		log.Fatalf("Invalid SETTLEMENT_PRIVATE_KEY: %v", err)
+	}
+	merchants, err := loadMerchants(path)
+	if err != nil {
+		log.Fatalf("Failed to load merchants: %v", err)
+	}
+	chain, err := ethclient.DialContext(context.Background(), rpcURL)
+	if err != nil {
+		log.Printf("Failed to connect to %s, settlement disabled: %v", rpcURL, err)
+		return
+	}
+
+	settlements = &settlementEngine{
+		chain:        chain,
+		chainID:      chainID,
+		key:          key,
+		wallet:       crypto.PubkeyToAddress(key.PublicKey),
+		merchants:    merchants,
+		pollInterval: durationEnv("SETTLEMENT_POLL_INTERVAL", defaultSettlementPollInterval),
+		store:        uploadStatement,
+		now:          time.Now,
+	}
+	log.Printf("Settlement enabled for %d merchants from wallet %s", len(merchants), settlements.wallet.Hex())
+}
+
+// initStreams enables payment streams, which need only the database
+func initStreams() {
+	streams = &streamService{now: time.Now}
+}
+
+// initSplits enables split payments. Their legs are created by sponsored
+// payments' user operations, or on the sandbox chain.
+func initSplits() {
+	splits = &splitService{now: time.Now}
+}
+
+// initContacts enables the address book. ENS names are resolved through the
+// ENS resolver and re-resolved every CONTACTS_ENS_REFRESH_INTERVAL.
+func initContacts() {
+	contacts = &contactService{
+		resolve:      resolveENSName,
+		refreshAfter: durationEnv("CONTACTS_ENS_REFRESH_INTERVAL", time.Hour),
+		now:          time.Now,
+	}
+}
+
+// initQuotes enables rate-locked quotes. QUOTE_SIGNING_KEY is the key quote
+// tokens are signed with; without it a random key is used and quotes are
+// invalidated on restart.
+func initQuotes() {
+	key := []byte(os.Getenv("QUOTE_SIGNING_KEY"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("Failed to generate quote signing key: %v", err)
+		}
+		log.Println("QUOTE_SIGNING_KEY not set, quotes are invalidated on restart")
+	}
+	quotes = &quoteService{
+		key:     key,
+		pricer:  &tokenPricer{lookup: tokens.lookup, price: getOracleUSDPrice},
+		maxLock: durationEnv("QUOTE_MAX_LOCK", defaultQuoteMaxLock),
+		now:     time.Now,
+	}
+}
+
+// initErasures enables erasure requests. ERASURE_GRACE_PERIOD is how long an
+// address stays soft-deleted before it is erased, 0 for at once.
+// ANALYTICS_URL and ANALYTICS_API_TOKEN, an admin token of the analytics
+// service, let erasures reach analytics. Receipts are erased with operator
+// tokens signed by admin, so the storage worker must share its secret.
+func initErasures(admin *auth.Admin) {
+	service := &erasureService{
+		gracePeriod:    defaultErasureGracePeriod,
+		pollInterval:   durationEnv("ERASURE_POLL_INTERVAL", defaultErasurePollInterval),
+		analyticsURL:   strings.TrimRight(os.Getenv("ANALYTICS_URL"), "/"),
+		analyticsToken: os.Getenv("ANALYTICS_API_TOKEN"),
+		storageToken: func() (string, error) {
+			return admin.Token(time.Minute, auth.RoleOperator)
+		},
+		client: &http.Client{Timeout: 5 * time.Minute},
+		now:    time.Now,
+	}
+	if value := os.Getenv("ERASURE_GRACE_PERIOD"); value != "" {
+		grace, err := time.ParseDuration(value)
+		if err != nil || grace < 0 {
+			log.Fatalf("Invalid ERASURE_GRACE_PERIOD %q", value)
+		}
+		service.gracePeriod = grace
+	}
+	if service.analyticsURL == "" {
+		log.Println("ANALYTICS_URL not set, erasures do not reach analytics")
+	}
+	if !admin.Enabled() {
+		log.Println("ADMIN_JWT_SECRET not set, erasures cannot reach storage")
+	}
+	erasures = service
+}
+
+// initMetadata enables metadata validation. Metadata URIs may be https://
+// or ipfs://; METADATA_ALLOW_HTTP also accepts http:// ones, for local
+// development.
+func initMetadata() {
+	paymentMetadata = &metadataService{
+		client:    &http.Client{Timeout: 10 * time.Second},
+		allowHTTP: os.Getenv("METADATA_ALLOW_HTTP") == "true",
+		now:       time.Now,
+	}
+}
+
+// initEvents enables the event log integrators replay payment and receipt
+// events from
+func initEvents() {
+	events = &eventLog{now: time.Now}
+}
+
+// initCoordination locks payments while they are completed or refunded.
+// Replicas share the locks through REDIS_URL; without it they only hold
+// within this process. LOCK_TTL is how long a lock outlives a replica that
+// died holding it, and LOCK_WAIT how long a request waits for a held lock
+// before answering 409.
+func initCoordination() {
+	coord, err := distributed.New("payment-processor", distributed.Config{
+		RedisURL: os.Getenv("REDIS_URL"),
+		LockTTL:  durationEnv("LOCK_TTL", 30*time.Second),
+		LockWait: durationEnv("LOCK_WAIT", 0),
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up payment locks: %v", err)
+	}
+	coordinator = coord
+	log.Printf("Payment locks enabled (shared through Redis: %t)", coord.Distributed())
+}
+
+// initPayroll enables payroll imports. Their ENS names are resolved through
+// the ENS resolver's batch endpoint, and runs are paid as split payments.
+func initPayroll() {
+	payroll = &payrollService{resolve: resolveENSNames, now: time.Now}
+}
+
+// initChainMonitor monitors the health of CHAIN_ID and the chains in
+// CHAIN_RPC_URLS, a comma separated list of chainID=url. It is disabled when
+// no chain has an RPC endpoint.
+func initChainMonitor() {
+	monitor, err := dialChainMonitor()
+	if err != nil {
+		log.Fatalf("Failed to set up chain monitoring: %v", err)
+	}
+	if len(monitor.chains) == 0 {
+		log.Println("No chain RPC endpoints, chain monitoring disabled")
+		return
+	}
+	chainMonitor = monitor
+	log.Printf("Monitoring the health of %d chain(s) every %s", len(monitor.chains), monitor.interval)
+}
+
+// initWalletConnect pairs wallets over WalletConnect through the relay at
+// WALLETCONNECT_RELAY_URL with WALLETCONNECT_PROJECT_ID, so payments can be
+// pushed to them for approval. Sessions are on CHAIN_ID and pay into
+// PAYMENT_CORE_ADDRESS; WALLETCONNECT_APP_URL is the URL wallets show.
+func initWalletConnect() {
+	projectID := os.Getenv("WALLETCONNECT_PROJECT_ID")
+	if projectID == "" {
+		log.Println("WALLETCONNECT_PROJECT_ID not set, WalletConnect disabled")
+		return
+	}
+	chainID, ok := chainIDEnv()
+	if !ok || !common.IsHexAddress(paymentCoreAddress()) {
+		log.Println("CHAIN_ID or PAYMENT_CORE_ADDRESS not set, WalletConnect disabled")
+		return
+	}
+	service := &walletConnectService{
+		metadata: wcMetadata{
+			Name:        "CrossPay Protocol",
+			Description: "Verifiable, private, cross-chain payments",
+			URL:         getEnv("WALLETCONNECT_APP_URL", "https://crosspay.protocol"),
+			Icons:       []string{"https://crosspay.protocol/favicon.svg"},
+		},
+		chainID:     chainID.Int64(),
+		paymentCore: common.HexToAddress(paymentCoreAddress()),
+		proposalTTL: defaultWalletConnectProposalTTL,
+		requestTTL:  defaultWalletConnectRequestTTL,
+		now:         time.Now,
+	}
+	relay, err := newIRNRelay(getEnv("WALLETCONNECT_RELAY_URL", defaultWalletConnectRelayURL), projectID, service.handle)
+	if err != nil {
+		log.Fatalf("Failed to set up the WalletConnect relay: %v", err)
+	}
+	service.relay = relay
+	walletConnect = service
+	log.Printf("WalletConnect enabled on eip155:%d", service.chainID)
+}
+
+// initPaymentSimulator simulates payments into PAYMENT_CORE_ADDRESS on
+// CHAIN_ID through RPC_URL. It is disabled without all three.
+func initPaymentSimulator() {
+	chainID, ok := chainIDEnv()
+	rpcURL := rpcURL()
+	if !ok || rpcURL == "" || !common.IsHexAddress(paymentCoreAddress()) {
+		log.Println("CHAIN_ID, RPC_URL or PAYMENT_CORE_ADDRESS not set, payment simulation disabled")
+		return
+	}
+	chain, err := ethclient.DialContext(context.Background(), rpcURL)
+	if err != nil {
+		log.Printf("Failed to connect to %s, payment simulation disabled: %v", rpcURL, err)
+		return
+	}
+	simulator = &paymentSimulator{
+		chainID:     chainID.Int64(),
+		chain:       chain,
+		paymentCore: common.HexToAddress(paymentCoreAddress()),
+	}
+	log.Printf("Payment simulation enabled on chain %d", simulator.chainID)
+}
+
+// corsAllowedOrigins reads the browser origins allowed to call the API from
+// CORS_ALLOWED_ORIGINS, a comma separated list or "*" for any
+func corsAllowedOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// requestTimeout reads REQUEST_TIMEOUT, falling back to the default when it
+// is unset or invalid
+func requestTimeout() time.Duration {
+	return durationEnv("REQUEST_TIMEOUT", defaultRequestTimeout)
+}
+
+// durationEnv reads a duration from key, falling back when it is unset or
+// invalid
+func durationEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The settlement engine pays merchants what their completed payments add up
+// to. Merchants are payment recipients whose funds are held by the
+// settlement wallet; on their schedule, the completed payments of the period
+// that just ended are batched into one payout per token, minus the
+// merchant's fee, sent from the settlement wallet to the merchant's payout
+// address. Each settlement has a statement, stored with the storage worker
+// as a receipt.
+
+// Payout schedules. Daily periods end at midnight UTC, weekly ones at
+// midnight UTC on Mondays.
+const (
+	ScheduleDaily  = "daily"
+	ScheduleWeekly = "weekly"
+)
+
+// Settlement statuses. A pending settlement has a signed payout that has not
+// been accepted by the node yet; a failed one's payout reverted or its nonce
+// was used by another transaction, and its payments are settled again.
+const (
+	SettlementPending   = "pending"
+	SettlementSubmitted = "submitted"
+	SettlementConfirmed = "confirmed"
+	SettlementFailed    = "failed"
+)
+
+const defaultSettlementPollInterval = 5 * time.Minute
+
+var erc20TransferABI = mustParseABI(`[
+	{"type":"function","name":"transfer","stateMutability":"nonpayable","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]}
+]`)
+
+var (
+	errSettlementNotFound = errors.New("settlement not found")
+	errUnknownMerchant    = errors.New("unknown merchant")
+)
+
+// settlements is the settlement engine. It is nil when no settlement wallet
+// is configured.
+var settlements *settlementEngine
+
+// settlementChain is the part of *ethclient.Client payouts are sent with
+type settlementChain interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	SuggestGasTipCap(ctx context.Context) (*big.Int, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// Merchant is a payment recipient settled by the engine. FeeBasisPoints is
+// kept from each payout.
+type Merchant struct {
+	Address        string `json:"address"`
+	Name           string `json:"name,omitempty"`
+	PayoutAddress  string `json:"payout_address"`
+	Schedule       string `json:"schedule"`
+	FeeBasisPoints int64  `json:"fee_bps"`
+}
+
+// Settlement is a batched payout of a merchant's completed payments in one
+// token over a period
+type Settlement struct {
+	ID            string     `json:"id"`
+	Merchant      string     `json:"merchant"`
+	PayoutAddress string     `json:"payout_address"`
+	ChainID       int64      `json:"chain_id"`
+	Token         string     `json:"token"`
+	PeriodStart   time.Time  `json:"period_start"`
+	PeriodEnd     time.Time  `json:"period_end"`
+	PaymentCount  int        `json:"payment_count"`
+	Gross         string     `json:"gross"`
+	Fee           string     `json:"fee"`
+	Net           string     `json:"net"`
+	Status        string     `json:"status"`
+	TxHash        string     `json:"tx_hash"`
+	RawTx         string     `json:"-"`
+	StatementCID  string     `json:"statement_cid,omitempty"`
+	Statement     *Statement `json:"statement,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	ConfirmedAt   *time.Time `json:"confirmed_at,omitempty"`
+}
+
+// Statement itemizes a settlement for the merchant
+type Statement struct {
+	SettlementID   string          `json:"settlement_id"`
+	Merchant       string          `json:"merchant"`
+	MerchantName   string          `json:"merchant_name,omitempty"`
+	PayoutAddress  string          `json:"payout_address"`
+	ChainID        int64           `json:"chain_id"`
+	Token          string          `json:"token"`
+	PeriodStart    time.Time       `json:"period_start"`
+	PeriodEnd      time.Time       `json:"period_end"`
+	Payments       []StatementLine `json:"payments"`
+	Gross          string          `json:"gross"`
+	FeeBasisPoints int64           `json:"fee_bps"`
+	Fee            string          `json:"fee"`
+	Net            string          `json:"net"`
+	PayoutTxHash   string          `json:"payout_tx_hash"`
+	GeneratedAt    time.Time       `json:"generated_at"`
+}
+
+// StatementLine is a payment included in a settlement
+type StatementLine struct {
+	PaymentID   string    `json:"payment_id"`
+	TxHash      string    `json:"tx_hash,omitempty"`
+	Sender      string    `json:"sender"`
+	Amount      string    `json:"amount"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// settlementEngine settles the merchants by address. Statements are stored
+// with store, which returns their CID.
+type settlementEngine struct {
+	chain        settlementChain
+	chainID      *big.Int
+	key          *ecdsa.PrivateKey
+	wallet       common.Address
+	merchants    map[string]*Merchant
+	pollInterval time.Duration
+	store        func(ctx context.Context, statement *Statement) (string, error)
+	now          func() time.Time
+}
+
+// loadMerchants reads the settled merchants from a JSON array
+func loadMerchants(path string) (map[string]*Merchant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*Merchant
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid merchant list: %w", err)
+	}
+	merchants := make(map[string]*Merchant, len(list))
+	for _, merchant := range list {
+		if !common.IsHexAddress(merchant.Address) || !common.IsHexAddress(merchant.PayoutAddress) {
+			return nil, fmt.Errorf("merchant %q needs an address and a payout address", merchant.Address)
+		}
+		switch merchant.Schedule {
+		case "":
+			merchant.Schedule = ScheduleDaily
+		case ScheduleDaily, ScheduleWeekly:
+		default:
+			return nil, fmt.Errorf("merchant %s has unknown schedule %q", merchant.Address, merchant.Schedule)
+		}
+		if merchant.FeeBasisPoints < 0 || merchant.FeeBasisPoints > 10000 {
+			return nil, fmt.Errorf("merchant %s has invalid fee %d", merchant.Address, merchant.FeeBasisPoints)
+		}
+		merchant.Address = strings.ToLower(merchant.Address)
+		merchant.PayoutAddress = strings.ToLower(merchant.PayoutAddress)
+		merchants[merchant.Address] = merchant
+	}
+	return merchants, nil
+}
+
+// periodEnd returns the end of the last complete period of schedule before
+// now
+func periodEnd(schedule string, now time.Time) time.Time {
+	now = now.UTC()
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if schedule == ScheduleWeekly {
+		end = end.AddDate(0, 0, -((int(end.Weekday()) + 6) % 7))
+	}
+	return end
+}
+
+// nextSettlement returns when the current period of schedule ends
+func nextSettlement(schedule string, now time.Time) time.Time {
+	if schedule == ScheduleWeekly {
+		return periodEnd(schedule, now).AddDate(0, 0, 7)
+	}
+	return periodEnd(schedule, now).AddDate(0, 0, 1)
+}
+
+// splitFee returns the fee kept from gross at basisPoints and what is left
+func splitFee(gross *big.Int, basisPoints int64) (fee, net *big.Int) {
+	fee = new(big.Int).Mul(gross, big.NewInt(basisPoints))
+	fee.Quo(fee, big.NewInt(10000))
+	return fee, new(big.Int).Sub(gross, fee)
+}
+
+// settlementID identifies the settlement of a merchant's token over the
+// period ending at end, paid out with the wallet's nonce
+func settlementID(chainID int64, merchant, token string, end time.Time, nonce uint64) string {
+	return crypto.Keccak256Hash([]byte(fmt.Sprintf("%d:%s:%s:%d:%d", chainID, merchant, token, end.Unix(), nonce))).Hex()
+}
+
+// run finishes the payouts and statements earlier runs could not, then
+// settles every merchant whose period has ended. New payouts wait until
+// every earlier one has been sent, so that no two share a nonce.
+func (e *settlementEngine) run(ctx context.Context) {
+	unfinished, err := querySettlements(`WHERE status IN (?, ?) OR (statement_cid = '' AND status != ?) ORDER BY created_at`,
+		SettlementPending, SettlementSubmitted, SettlementFailed)
+	if err != nil {
+		log.Printf("Failed to load unfinished settlements: %v", err)
+		return
+	}
+	unsent := 0
+	for _, settlement := range unfinished {
+		if err := e.refresh(ctx, settlement); err != nil {
+			log.Printf("Failed to refresh settlement %s: %v", settlement.ID, err)
+		}
+		if settlement.Status == SettlementPending {
+			unsent++
+		}
+	}
+	if unsent > 0 {
+		log.Printf("%d payouts could not be sent, not settling new periods", unsent)
+		return
+	}
+
+	for _, merchant := range e.merchants {
+		if _, err := e.settle(ctx, merchant); err != nil {
+			log.Printf("Failed to settle merchant %s: %v", merchant.Address, err)
+			return
+		}
+	}
+}
+
+// settle batches the merchant's unsettled completed payments up to the end
+// of its last period into one settlement per token and sends their payouts.
+// It stops at the first payout that cannot be sent.
+func (e *settlementEngine) settle(ctx context.Context, merchant *Merchant) ([]*Settlement, error) {
+	end := periodEnd(merchant.Schedule, e.now())
+	rows, err := db.Query(`SELECT id, tx_hash, sender, token, amount, completed_at FROM payments
+		WHERE recipient = ? AND chain_id = ? AND status = 'completed' AND completed_at < ?
+		AND id NOT IN (SELECT payment_id FROM settlement_payments)
+		ORDER BY completed_at`, merchant.Address, e.chainID.Int64(), end)
+	if err != nil {
+		return nil, err
+	}
+	byToken := map[string][]StatementLine{}
+	var order []string
+	for rows.Next() {
+		var line StatementLine
+		var token string
+		var txHash sql.NullString
+		if err := rows.Scan(&line.PaymentID, &txHash, &line.Sender, &token, &line.Amount, &line.CompletedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		line.TxHash = txHash.String
+		token = strings.ToLower(token)
+		if _, ok := byToken[token]; !ok {
+			order = append(order, token)
+		}
+		byToken[token] = append(byToken[token], line)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var created []*Settlement
+	for _, token := range order {
+		settlement, err := e.create(ctx, merchant, token, end, byToken[token])
+		if err != nil {
+			return created, err
+		}
+		if settlement == nil {
+			continue
+		}
+		created = append(created, settlement)
+		if err := e.refresh(ctx, settlement); err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// create signs the payout of a settlement and stores it with its statement.
+// Payments that add up to no payout are left for the next period.
+func (e *settlementEngine) create(ctx context.Context, merchant *Merchant, token string, end time.Time, lines []StatementLine) (*Settlement, error) {
+	gross := new(big.Int)
+	for _, line := range lines {
+		amount, ok := new(big.Int).SetString(line.Amount, 10)
+		if !ok {
+			return nil, fmt.Errorf("payment %s has invalid amount %q", line.PaymentID, line.Amount)
+		}
+		gross.Add(gross, amount)
+	}
+	fee, net := splitFee(gross, merchant.FeeBasisPoints)
+	if net.Sign() <= 0 {
+		return nil, nil
+	}
+
+	tx, err := e.payout(ctx, common.HexToAddress(merchant.PayoutAddress), common.HexToAddress(token), net)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	now := e.now().UTC()
+	start := lines[0].CompletedAt.UTC()
+	chainID := e.chainID.Int64()
+	settlement := &Settlement{
+		ID:            settlementID(chainID, merchant.Address, token, end, tx.Nonce()),
+		Merchant:      merchant.Address,
+		PayoutAddress: merchant.PayoutAddress,
+		ChainID:       chainID,
+		Token:         token,
+		PeriodStart:   start,
+		PeriodEnd:     end,
+		PaymentCount:  len(lines),
+		Gross:         gross.String(),
+		Fee:           fee.String(),
+		Net:           net.String(),
+		Status:        SettlementPending,
+		TxHash:        tx.Hash().Hex(),
+		RawTx:         hexutil.Encode(raw),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	settlement.Statement = &Statement{
+		SettlementID:   settlement.ID,
+		Merchant:       merchant.Address,
+		MerchantName:   merchant.Name,
+		PayoutAddress:  merchant.PayoutAddress,
+		ChainID:        chainID,
+		Token:          token,
+		PeriodStart:    start,
+		PeriodEnd:      end,
+		Payments:       lines,
+		Gross:          settlement.Gross,
+		FeeBasisPoints: merchant.FeeBasisPoints,
+		Fee:            settlement.Fee,
+		Net:            settlement.Net,
+		PayoutTxHash:   settlement.TxHash,
+		GeneratedAt:    now,
+	}
+	if err := storeSettlement(settlement); err != nil {
+		return nil, err
+	}
+	log.Printf("Settling %d payments of merchant %s in %s: %s net of %s fee", len(lines), merchant.Address, token, net, fee)
+	return settlement, nil
+}
+
+// payout signs the transfer of amount of token, or of the native currency
+// for the zero address, from the settlement wallet to to
+func (e *settlementEngine) payout(ctx context.Context, to, token common.Address, amount *big.Int) (*types.Transaction, error) {
+	call := ethereum.CallMsg{From: e.wallet, To: &to, Value: amount}
+	if token != (common.Address{}) {
+		data, err := erc20TransferABI.Pack("transfer", to, amount)
+		if err != nil {
+			return nil, err
+		}
+		call = ethereum.CallMsg{From: e.wallet, To: &token, Data: data}
+	}
+
+	nonce, err := e.chain.PendingNonceAt(ctx, e.wallet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nonce: %w", err)
+	}
+	gas, err := e.chain.EstimateGas(ctx, call)
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate payout gas: %w", err)
+	}
+	tip, err := e.chain.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gas tip: %w", err)
+	}
+	head, err := e.chain.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest block: %w", err)
+	}
+	feeCap := new(big.Int).Add(tip, new(big.Int).Mul(head.BaseFee, big.NewInt(2)))
+
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   e.chainID,
+		Nonce:     nonce,
+		GasTipCap: tip,
+		GasFeeCap: feeCap,
+		Gas:       gas,
+		To:        call.To,
+		Value:     call.Value,
+		Data:      call.Data,
+	})
+	return types.SignTx(tx, types.LatestSignerForChainID(e.chainID), e.key)
+}
+
+// refresh moves a settlement along: it sends a pending payout, records the
+// receipt of a submitted one and stores a missing statement. The payout is
+// signed once, so resending it cannot pay twice.
+func (e *settlementEngine) refresh(ctx context.Context, settlement *Settlement) error {
+	tx := new(types.Transaction)
+	raw, err := hexutil.Decode(settlement.RawTx)
+	if err != nil {
+		return err
+	}
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		return err
+	}
+
+	switch settlement.Status {
+	case SettlementPending:
+		// A nonce that is too low means the payout or another transaction
+		// was mined; checking for its receipt tells which
+		if err := e.chain.SendTransaction(ctx, tx); err != nil && !isSentTxError(err) {
+			return fmt.Errorf("failed to send payout: %w", err)
+		}
+		settlement.Status = SettlementSubmitted
+	case SettlementSubmitted:
+		// Read the nonce before the receipt, so that a payout mined in
+		// between is not taken for a replaced one
+		nonce, err := e.chain.NonceAt(ctx, e.wallet, nil)
+		if err != nil {
+			return fmt.Errorf("failed to get nonce: %w", err)
+		}
+		receipt, err := e.chain.TransactionReceipt(ctx, tx.Hash())
+		if errors.Is(err, ethereum.NotFound) {
+			if nonce > tx.Nonce() {
+				settlement.Status = SettlementFailed
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get payout receipt: %w", err)
+		}
+		now := e.now().UTC()
+		settlement.ConfirmedAt = &now
+		settlement.Status = SettlementConfirmed
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			settlement.Status = SettlementFailed
+		}
+	}
+
+	if settlement.StatementCID == "" && settlement.Status != SettlementFailed && e.store != nil {
+		cid, err := e.store(ctx, settlement.Statement)
+		if err != nil {
+			log.Printf("Failed to store statement of settlement %s: %v", settlement.ID, err)
+		} else {
+			settlement.StatementCID = cid
+		}
+	}
+
+	settlement.UpdatedAt = e.now().UTC()
+	return updateSettlement(settlement)
+}
+
+// isSentTxError reports whether the node refused a transaction because it
+// already has it or its nonce has been used
+func isSentTxError(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "already known") || strings.Contains(message, "nonce too low")
+}
+
+// track runs the engine every pollInterval until ctx is done
+func (e *settlementEngine) track(ctx context.Context) {
+	ticker := time.NewTicker(e.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.run(ctx)
+		}
+	}
+}
+
+// balances returns what the merchant is owed per token for completed
+// payments not settled yet
+func (e *settlementEngine) balances(merchant *Merchant) (map[string]string, error) {
+	rows, err := db.Query(`SELECT token, amount FROM payments
+		WHERE recipient = ? AND chain_id = ? AND status = 'completed'
+		AND id NOT IN (SELECT payment_id FROM settlement_payments)`, merchant.Address, e.chainID.Int64())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]*big.Int{}
+	for rows.Next() {
+		var token, amount string
+		if err := rows.Scan(&token, &amount); err != nil {
+			return nil, err
+		}
+		value, ok := new(big.Int).SetString(amount, 10)
+		if !ok {
+			continue
+		}
+		token = strings.ToLower(token)
+		if totals[token] == nil {
+			totals[token] = new(big.Int)
+		}
+		totals[token].Add(totals[token], value)
+	}
+	balances := make(map[string]string, len(totals))
+	for token, total := range totals {
+		balances[token] = total.String()
+	}
+	return balances, rows.Err()
+}
+
+// uploadStatement stores a statement with the storage worker as a receipt
+// and returns its CID
+func uploadStatement(ctx context.Context, statement *Statement) (string, error) {
+	data, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return uploadToStorage(ctx, fmt.Sprintf("settlement_%s.json", statement.SettlementID), "receipt", data)
+}
+
+// uploadToStorage stores a file of the given retention class with the
+// storage worker and returns its CID
+func uploadToStorage(ctx context.Context, filename, class string, data []byte) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("class", class)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	part.Write(data)
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, storageServiceURL+"/api/storage/upload", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("storage worker returned %d: %s", resp.StatusCode, message)
+	}
+	var result struct {
+		CID string `json:"cid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.CID == "" {
+		return "", errors.New("storage worker returned no CID")
+	}
+	return result.CID, nil
+}
+
+// storeSettlement stores a new settlement and claims its payments
+func storeSettlement(s *Settlement) error {
+	statement, err := json.Marshal(s.Statement)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO settlements (id, merchant, payout_address, chain_id, token, period_start, period_end, payment_count, gross, fee, net, status, tx_hash, raw_tx, statement, statement_cid, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, s.Merchant, s.PayoutAddress, s.ChainID, s.Token, s.PeriodStart, s.PeriodEnd, s.PaymentCount,
+		s.Gross, s.Fee, s.Net, s.Status, s.TxHash, s.RawTx, string(statement), s.StatementCID, s.CreatedAt, s.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store settlement %s: %w", s.ID, err)
+	}
+	for _, line := range s.Statement.Payments {
+		if _, err := tx.Exec(`INSERT INTO settlement_payments (payment_id, settlement_id) VALUES (?, ?)`, line.PaymentID, s.ID); err != nil {
+			return fmt.Errorf("failed to claim payment %s for settlement %s: %w", line.PaymentID, s.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// updateSettlement stores a settlement's progress. Failed settlements give
+// their payments back to be settled with the next period.
+func updateSettlement(s *Settlement) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE settlements SET status = ?, statement_cid = ?, updated_at = ?, confirmed_at = ? WHERE id = ?`,
+		s.Status, s.StatementCID, s.UpdatedAt, s.ConfirmedAt, s.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update settlement %s: %w", s.ID, err)
+	}
+	if s.Status == SettlementFailed {
+		if _, err := tx.Exec(`DELETE FROM settlement_payments WHERE settlement_id = ?`, s.ID); err != nil {
+			return err
+		}
+		log.Printf("Payout of settlement %s reverted, its payments will be settled again", s.ID)
+	}
+	return tx.Commit()
+}
+
+// getSettlement returns the settlement with id and its statement
+func getSettlement(id string) (*Settlement, error) {
+	found, err := querySettlements(`WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, errSettlementNotFound
+	}
+	return found[0], nil
+}
+
+// querySettlements returns the settlements matching where, with their
+// statements
+func querySettlements(where string, args ...interface{}) ([]*Settlement, error) {
+	rows, err := db.Query(`SELECT id, merchant, payout_address, chain_id, token, period_start, period_end, payment_count, gross, fee, net, status, tx_hash, raw_tx, statement, statement_cid, created_at, updated_at, confirmed_at FROM settlements `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []*Settlement
+	for rows.Next() {
+		s := &Settlement{}
+		var statement string
+		var confirmedAt sql.NullTime
+		err := rows.Scan(&s.ID, &s.Merchant, &s.PayoutAddress, &s.ChainID, &s.Token, &s.PeriodStart, &s.PeriodEnd, &s.PaymentCount,
+			&s.Gross, &s.Fee, &s.Net, &s.Status, &s.TxHash, &s.RawTx, &statement, &s.StatementCID, &s.CreatedAt, &s.UpdatedAt, &confirmedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(statement), &s.Statement); err != nil {
+			return nil, fmt.Errorf("invalid statement of settlement %s: %w", s.ID, err)
+		}
+		if confirmedAt.Valid {
+			s.ConfirmedAt = &confirmedAt.Time
+		}
+		found = append(found, s)
+	}
+	return found, rows.Err()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	settlementMerchant = "0x00000000000000000000000000000000000000c1"
+	settlementPayout   = "0x00000000000000000000000000000000000000c2"
+)
+
+// fakeSettlementChain accepts every transaction and mines the ones it is
+// told to
+type fakeSettlementChain struct {
+	nonce    uint64
+	mined    uint64
+	sent     []*types.Transaction
+	receipts map[common.Hash]*types.Receipt
+	sendErr  error
+}
+
+func (c *fakeSettlementChain) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return c.nonce, nil
+}
+
+func (c *fakeSettlementChain) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	return c.mined, nil
+}
+
+func (c *fakeSettlementChain) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1), nil
+}
+
+func (c *fakeSettlementChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{BaseFee: big.NewInt(10)}, nil
+}
+
+func (c *fakeSettlementChain) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return 60000, nil
+}
+
+func (c *fakeSettlementChain) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if c.sendErr != nil {
+		return c.sendErr
+	}
+	c.sent = append(c.sent, tx)
+	c.nonce++
+	return nil
+}
+
+func (c *fakeSettlementChain) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	receipt, ok := c.receipts[txHash]
+	if !ok {
+		return nil, ethereum.NotFound
+	}
+	return receipt, nil
+}
+
+// mine mines the transaction with status
+func (c *fakeSettlementChain) mine(tx *types.Transaction, status uint64) {
+	c.receipts[tx.Hash()] = &types.Receipt{Status: status}
+	c.mined = tx.Nonce() + 1
+}
+
+func setupSettlementTest(t *testing.T, now time.Time) (*settlementEngine, *fakeSettlementChain, *[]*Statement) {
+	setupTestDB(t)
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	chain := &fakeSettlementChain{receipts: map[common.Hash]*types.Receipt{}}
+	var stored []*Statement
+	engine := &settlementEngine{
+		chain:   chain,
+		chainID: big.NewInt(4202),
+		key:     key,
+		wallet:  crypto.PubkeyToAddress(key.PublicKey),
+		merchants: map[string]*Merchant{
+			settlementMerchant: {Address: settlementMerchant, PayoutAddress: settlementPayout, Schedule: ScheduleDaily, FeeBasisPoints: 250},
+		},
+		store: func(ctx context.Context, statement *Statement) (string, error) {
+			stored = append(stored, statement)
+			return "bafy-statement", nil
+		},
+		now: func() time.Time { return now },
+	}
+	return engine, chain, &stored
+}
+
+// completedPayment records a completed payment to the merchant
+func completedPayment(t *testing.T, id, token, amount string, completedAt time.Time) {
+	_, err := db.Exec(`INSERT INTO payments (id, chain_id, sender, recipient, token, amount, status, completed_at) VALUES (?, 4202, ?, ?, ?, ?, 'completed', ?)`,
+		id, kycSender, settlementMerchant, token, amount, completedAt)
+	require.NoError(t, err)
+}
+
+func TestPeriodEnd(t *testing.T) {
+	// A Thursday afternoon
+	now := time.Date(2026, 10, 15, 15, 30, 0, 0, time.UTC)
+
+	t.Run("should end daily periods at midnight", func(t *testing.T) {
+		assert.Equal(t, time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC), periodEnd(ScheduleDaily, now))
+		assert.Equal(t, time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC), nextSettlement(ScheduleDaily, now))
+	})
+
+	t.Run("should end weekly periods on Mondays", func(t *testing.T) {
+		assert.Equal(t, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), periodEnd(ScheduleWeekly, now))
+		monday := time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC)
+		assert.Equal(t, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), periodEnd(ScheduleWeekly, monday))
+		assert.Equal(t, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), nextSettlement(ScheduleWeekly, monday))
+	})
+}
+
+func TestSplitFee(t *testing.T) {
+	t.Run("should round the fee down", func(t *testing.T) {
+		fee, net := splitFee(big.NewInt(1999), 250)
+		assert.Equal(t, big.NewInt(49), fee)
+		assert.Equal(t, big.NewInt(1950), net)
+	})
+}
+
+func TestSettlementEngine(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 15, 30, 0, 0, time.UTC)
+	yesterday := now.Add(-24 * time.Hour)
+
+	t.Run("should batch the last period's payments into one payout per token", func(t *testing.T) {
+		engine, chain, stored := setupSettlementTest(t, now)
+		completedPayment(t, "1", kycUSDC, usdc(100), yesterday)
+		completedPayment(t, "2", kycUSDC, usdc(300), yesterday.Add(time.Hour))
+		completedPayment(t, "3", "0x0000000000000000000000000000000000000000", "1000000000000000000", yesterday.Add(30*time.Minute))
+		completedPayment(t, "4", kycUSDC, usdc(50), now.Add(-time.Hour))
+
+		engine.run(ctx)
+		require.Len(t, chain.sent, 2)
+
+		found, err := querySettlements(`WHERE token = ?`, kycUSDC)
+		require.NoError(t, err)
+		require.Len(t, found, 1)
+		settlement := found[0]
+		assert.Equal(t, SettlementSubmitted, settlement.Status)
+		assert.Equal(t, 2, settlement.PaymentCount)
+		assert.Equal(t, usdc(400), settlement.Gross)
+		assert.Equal(t, usdc(10), settlement.Fee)
+		assert.Equal(t, usdc(390), settlement.Net)
+		assert.Equal(t, time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC), settlement.PeriodEnd.UTC())
+		assert.Equal(t, "bafy-statement", settlement.StatementCID)
+		assert.Len(t, *stored, 2)
+
+		// The USDC payout is a transfer to the payout address
+		tx := chain.sent[0]
+		assert.Equal(t, common.HexToAddress(kycUSDC), *tx.To())
+		args, err := erc20TransferABI.Methods["transfer"].Inputs.Unpack(tx.Data()[4:])
+		require.NoError(t, err)
+		assert.Equal(t, common.HexToAddress(settlementPayout), args[0])
+		assert.Equal(t, usdc(390), args[1].(*big.Int).String())
+		assert.Equal(t, settlement.TxHash, tx.Hash().Hex())
+
+		// The native payout sends value
+		assert.Equal(t, common.HexToAddress(settlementPayout), *chain.sent[1].To())
+		assert.Equal(t, "975000000000000000", chain.sent[1].Value().String())
+
+		// Settled payments are not settled again, today's wait for tomorrow
+		engine.run(ctx)
+		assert.Len(t, chain.sent, 2)
+		balances, err := engine.balances(engine.merchants[settlementMerchant])
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{kycUSDC: usdc(50)}, balances)
+	})
+
+	t.Run("should confirm mined payouts", func(t *testing.T) {
+		engine, chain, _ := setupSettlementTest(t, now)
+		completedPayment(t, "1", kycUSDC, usdc(100), yesterday)
+
+		engine.run(ctx)
+		require.Len(t, chain.sent, 1)
+		chain.mine(chain.sent[0], types.ReceiptStatusSuccessful)
+		engine.run(ctx)
+
+		found, err := querySettlements(``)
+		require.NoError(t, err)
+		assert.Equal(t, SettlementConfirmed, found[0].Status)
+		assert.NotNil(t, found[0].ConfirmedAt)
+		assert.Equal(t, "1", found[0].Statement.Payments[0].PaymentID)
+	})
+
+	t.Run("should settle the payments of reverted payouts again", func(t *testing.T) {
+		engine, chain, _ := setupSettlementTest(t, now)
+		completedPayment(t, "1", kycUSDC, usdc(100), yesterday)
+
+		engine.run(ctx)
+		chain.mine(chain.sent[0], types.ReceiptStatusFailed)
+		engine.run(ctx)
+
+		// The released payment is settled again with a new payout
+		failed, err := querySettlements(`WHERE status = ?`, SettlementFailed)
+		require.NoError(t, err)
+		assert.Len(t, failed, 1)
+		assert.Len(t, chain.sent, 2)
+		submitted, err := querySettlements(`WHERE status = ?`, SettlementSubmitted)
+		require.NoError(t, err)
+		require.Len(t, submitted, 1)
+		assert.NotEqual(t, failed[0].ID, submitted[0].ID)
+	})
+
+	t.Run("should fail payouts whose nonce was used by another transaction", func(t *testing.T) {
+		engine, chain, _ := setupSettlementTest(t, now)
+		completedPayment(t, "1", kycUSDC, usdc(100), yesterday)
+
+		engine.run(ctx)
+		chain.mined = chain.sent[0].Nonce() + 1
+		engine.run(ctx)
+
+		failed, err := querySettlements(`WHERE status = ?`, SettlementFailed)
+		require.NoError(t, err)
+		assert.Len(t, failed, 1)
+	})
+
+	t.Run("should not settle new periods while a payout is unsent", func(t *testing.T) {
+		engine, chain, _ := setupSettlementTest(t, now)
+		completedPayment(t, "1", kycUSDC, usdc(100), yesterday)
+		chain.sendErr = errors.New("connection refused")
+
+		engine.run(ctx)
+		completedPayment(t, "2", "0x0000000000000000000000000000000000000000", "1000", yesterday)
+		engine.run(ctx)
+
+		found, err := querySettlements(``)
+		require.NoError(t, err)
+		require.Len(t, found, 1)
+		assert.Equal(t, SettlementPending, found[0].Status)
+
+		// Once the node is back the signed payout is sent as it was
+		chain.sendErr = nil
+		engine.run(ctx)
+		require.Len(t, chain.sent, 2)
+		assert.Equal(t, found[0].TxHash, chain.sent[0].Hash().Hex())
+	})
+}
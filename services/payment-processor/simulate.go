@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/arcbjorn/crosspay/packages/sandbox"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// A payment is simulated before it is committed by running the calls its
+// sender would send with eth_call against the latest block: the token
+// approval, when the payment core's allowance falls short, and
+// createPayment. Nothing is signed or sent. A payment the chain would
+// refuse comes back unsuccessful with the revert reason rather than as an
+// error; errors are left for a chain that cannot be reached.
+
+var errSimulationUnavailable = errors.New("payment simulation is not configured")
+
+// simulationChain is the chain access simulations need
+type simulationChain interface {
+	chainReader
+	EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+}
+
+// PaymentSimulation is the predicted outcome of a payment. Success is false
+// when a call would revert or the sender cannot cover the payment, with
+// RevertReason saying why.
+type PaymentSimulation struct {
+	Success      bool   `json:"success"`
+	RevertReason string `json:"revert_reason,omitempty"`
+	ChainID      int64  `json:"chain_id"`
+	// Calls are the transactions the sender sends, in order
+	Calls            []SimulatedCall `json:"calls"`
+	ApprovalRequired bool            `json:"approval_required"`
+	GasEstimate      uint64          `json:"gas_estimate"`
+	// GasCost is GasEstimate at the latest base fee plus the suggested tip,
+	// in wei
+	GasCost   string              `json:"gas_cost,omitempty"`
+	Amount    string              `json:"amount"`
+	Fee       string              `json:"fee"`
+	Total     string              `json:"total"`
+	Transfers []SimulatedTransfer `json:"transfers"`
+	Sender    PaymentParty        `json:"sender"`
+	Recipient PaymentParty        `json:"recipient"`
+	Warnings  []string            `json:"warnings,omitempty"`
+}
+
+// SimulatedCall is a transaction of a simulated payment
+type SimulatedCall struct {
+	Method       string `json:"method"`
+	To           string `json:"to"`
+	Data         string `json:"data"`
+	Value        string `json:"value"`
+	Gas          uint64 `json:"gas,omitempty"`
+	Success      bool   `json:"success"`
+	RevertReason string `json:"revert_reason,omitempty"`
+}
+
+// SimulatedTransfer is a movement of value a successful payment makes.
+// Creating a payment moves the sender's amount and fee into the payment
+// core, which pays the recipient once the payment is completed.
+type SimulatedTransfer struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Token  string `json:"token"`
+	Amount string `json:"amount"`
+}
+
+// simulator simulates payments, or is nil without RPC access to the
+// payment core's chain
+var simulator *paymentSimulator
+
+type paymentSimulator struct {
+	chainID     int64
+	chain       simulationChain
+	paymentCore common.Address
+}
+
+// simulate predicts the outcome of sender paying recipient amount of token
+func (s *paymentSimulator) simulate(ctx context.Context, sender, recipient PaymentParty, token common.Address, amount *big.Int, metadataURI string) (*PaymentSimulation, error) {
+	if s == nil {
+		return nil, errSimulationUnavailable
+	}
+	from := common.HexToAddress(sender.Address)
+	fee := paymentFee(amount)
+	total := new(big.Int).Add(amount, fee)
+	native := token == (common.Address{})
+
+	result := &PaymentSimulation{
+		Success:   true,
+		ChainID:   s.chainID,
+		Calls:     []SimulatedCall{},
+		Amount:    amount.String(),
+		Fee:       fee.String(),
+		Total:     total.String(),
+		Transfers: []SimulatedTransfer{},
+		Sender:    sender,
+		Recipient: recipient,
+	}
+	fail := func(reason string) {
+		if result.Success {
+			result.Success, result.RevertReason = false, reason
+		}
+	}
+
+	// The sender must hold the total, and approve it for token payments
+	var calls []ethereum.CallMsg
+	value := new(big.Int)
+	if native {
+		balance, err := s.chain.BalanceAt(ctx, from, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the sender's balance: %w", err)
+		}
+		if balance.Cmp(total) < 0 {
+			// Nodes refuse to call with more value than the sender holds
+			fail(fmt.Sprintf("insufficient balance: %s held, %s needed", balance, total))
+			return result, nil
+		}
+		value = total
+	} else {
+		balance, err := s.tokenCall(ctx, token, "balanceOf", from)
+		switch {
+		case err != nil:
+			result.Warnings = append(result.Warnings, fmt.Sprintf("token balance could not be read: %v", err))
+		case balance.Cmp(total) < 0:
+			fail(fmt.Sprintf("insufficient token balance: %s held, %s needed", balance, total))
+		}
+
+		allowance, err := s.tokenCall(ctx, token, "allowance", from, s.paymentCore)
+		switch {
+		case err != nil:
+			result.Warnings = append(result.Warnings, fmt.Sprintf("token allowance could not be read: %v", err))
+		case allowance.Cmp(total) < 0:
+			approve, err := erc20ABI.Pack("approve", s.paymentCore, total)
+			if err != nil {
+				return nil, err
+			}
+			result.ApprovalRequired = true
+			calls = append(calls, ethereum.CallMsg{From: from, To: &token, Value: new(big.Int), Data: approve})
+		}
+	}
+
+	create, err := paymentCoreABI.Pack("createPayment",
+		common.HexToAddress(recipient.Address), token, amount, metadataURI, sender.ENSName, recipient.ENSName)
+	if err != nil {
+		return nil, err
+	}
+	calls = append(calls, ethereum.CallMsg{From: from, To: &s.paymentCore, Value: value, Data: create})
+
+	for _, msg := range calls {
+		call, err := s.call(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		result.Calls = append(result.Calls, call)
+		result.GasEstimate += call.Gas
+		if !call.Success {
+			fail(call.RevertReason)
+			if result.ApprovalRequired && call.Method == "createPayment" {
+				result.Warnings = append(result.Warnings, "createPayment was simulated before the approval, which it needs")
+			}
+		}
+	}
+
+	if cost, err := s.gasCost(ctx, result.GasEstimate); err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("gas price could not be read: %v", err))
+	} else {
+		result.GasCost = cost.String()
+	}
+	if result.Success {
+		result.Transfers = append(result.Transfers, SimulatedTransfer{
+			From:   sender.Address,
+			To:     s.paymentCore.Hex(),
+			Token:  token.Hex(),
+			Amount: total.String(),
+		})
+	}
+	return result, nil
+}
+
+// call runs msg with eth_call and estimates its gas. A revert is the call's
+// outcome, not an error.
+func (s *paymentSimulator) call(ctx context.Context, msg ethereum.CallMsg) (SimulatedCall, error) {
+	call := SimulatedCall{
+		To:      msg.To.Hex(),
+		Data:    hexutil.Encode(msg.Data),
+		Value:   msg.Value.String(),
+		Success: true,
+	}
+	for _, parsed := range []abi.ABI{paymentCoreABI, erc20ABI} {
+		if method, err := parsed.MethodById(msg.Data); err == nil {
+			call.Method = method.Name
+			break
+		}
+	}
+
+	if _, err := s.chain.CallContract(ctx, msg, nil); err != nil {
+		if !isCallRevert(err) {
+			return call, fmt.Errorf("failed to simulate %s: %w", call.Method, err)
+		}
+		call.Success, call.RevertReason = false, revertReason(err)
+		return call, nil
+	}
+	gas, err := s.chain.EstimateGas(ctx, msg)
+	if err != nil {
+		if !isCallRevert(err) {
+			return call, fmt.Errorf("failed to estimate the gas of %s: %w", call.Method, err)
+		}
+		call.Success, call.RevertReason = false, revertReason(err)
+		return call, nil
+	}
+	call.Gas = gas
+	return call, nil
+}
+
+// tokenCall reads a uint256 view of token
+func (s *paymentSimulator) tokenCall(ctx context.Context, token common.Address, method string, args ...interface{}) (*big.Int, error) {
+	data, err := erc20ABI.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.chain.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	values, err := erc20ABI.Unpack(method, output)
+	if err != nil {
+		return nil, err
+	}
+	return values[0].(*big.Int), nil
+}
+
+// gasCost prices gas at the latest base fee plus the suggested tip
+func (s *paymentSimulator) gasCost(ctx context.Context, gas uint64) (*big.Int, error) {
+	header, err := s.chain.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	tip, err := s.chain.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	price := new(big.Int).Set(tip)
+	if header.BaseFee != nil {
+		price.Add(price, header.BaseFee)
+	}
+	return price.Mul(price, new(big.Int).SetUint64(gas)), nil
+}
+
+// revertReason decodes the reason of a reverted call. Custom errors without
+// a reason are given as their encoded data.
+func revertReason(err error) string {
+	var revert *sandbox.RevertError
+	if errors.As(err, &revert) {
+		return revert.Reason
+	}
+	var dataErr rpc.DataError
+	if errors.As(err, &dataErr) {
+		if encoded, ok := dataErr.ErrorData().(string); ok {
+			data := common.FromHex(encoded)
+			if reason, err := abi.UnpackRevert(data); err == nil {
+				return reason
+			}
+			if len(data) > 0 {
+				return "custom error " + hexutil.Encode(data)
+			}
+		}
+	}
+	message := err.Error()
+	if i := strings.Index(message, "execution reverted"); i >= 0 {
+		message = strings.TrimPrefix(message[i+len("execution reverted"):], ": ")
+	}
+	if message == "" {
+		return "execution reverted"
+	}
+	return message
+}
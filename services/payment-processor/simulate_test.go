@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arcbjorn/crosspay/packages/sandbox"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSimulationChain is a fakeChain that estimates gas and holds balances
+type fakeSimulationChain struct {
+	fakeChain
+	balance *big.Int
+}
+
+func (c *fakeSimulationChain) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	return 50000, nil
+}
+
+func (c *fakeSimulationChain) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	return c.balance, nil
+}
+
+func TestSimulatePayment(t *testing.T) {
+	simulate := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleSimulatePayment(w, httptest.NewRequest(http.MethodPost, "/api/payments/simulate", strings.NewReader(body)))
+		return w
+	}
+	setupSimulator := func(t *testing.T) {
+		setupSandboxTest(t)
+		initPaymentSimulator()
+		require.NotNil(t, simulator)
+		t.Cleanup(func() { simulator = nil })
+	}
+	sender := sandbox.DevAddress(0).Hex()
+
+	t.Run("should predict the gas and transfers of a native payment", func(t *testing.T) {
+		setupSimulator(t)
+
+		w := simulate(`{"sender": "` + sender + `", "recipient": "` + settlementMerchant + `", "token": "` + nativeToken + `", "amount": "10000"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var simulation PaymentSimulation
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&simulation))
+		assert.True(t, simulation.Success, simulation.RevertReason)
+		assert.Equal(t, int64(4202), simulation.ChainID)
+		require.Len(t, simulation.Calls, 1)
+		assert.Equal(t, "createPayment", simulation.Calls[0].Method)
+		assert.Equal(t, "10010", simulation.Calls[0].Value)
+		assert.Positive(t, simulation.GasEstimate)
+		assert.NotEmpty(t, simulation.GasCost)
+		assert.Equal(t, []SimulatedTransfer{{From: sender, To: paymentCoreAddress(), Token: nativeToken, Amount: "10010"}}, simulation.Transfers)
+		assert.Equal(t, uint64(0), sandboxChain.BlockNumber(), "nothing is mined")
+	})
+
+	t.Run("should report the revert reason of a payment the chain refuses", func(t *testing.T) {
+		setupSimulator(t)
+
+		w := simulate(`{"sender": "` + sender + `", "recipient": "` + settlementMerchant + `", "token": "` + nativeToken + `", "amount": "0"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var simulation PaymentSimulation
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&simulation))
+		assert.False(t, simulation.Success)
+		assert.Equal(t, "InvalidPayment", simulation.RevertReason)
+		assert.Empty(t, simulation.Transfers)
+	})
+
+	t.Run("should refuse native payments the sender cannot cover", func(t *testing.T) {
+		s := &paymentSimulator{chainID: 4202, chain: &fakeSimulationChain{balance: big.NewInt(100)}}
+
+		simulation, err := s.simulate(context.Background(), PaymentParty{Address: kycSender}, PaymentParty{Address: settlementMerchant}, common.Address{}, big.NewInt(1000), "")
+		require.NoError(t, err)
+		assert.False(t, simulation.Success)
+		assert.Contains(t, simulation.RevertReason, "insufficient balance")
+		assert.Empty(t, simulation.Calls)
+	})
+
+	t.Run("should approve the payment core when its allowance falls short", func(t *testing.T) {
+		token := common.HexToAddress("0x00000000000000000000000000000000000000d1")
+		chain := &fakeSimulationChain{fakeChain: fakeChain{call: func(msg ethereum.CallMsg) ([]byte, error) {
+			method, err := erc20ABI.MethodById(msg.Data)
+			if err != nil {
+				return paymentCoreABI.Methods["createPayment"].Outputs.Pack(big.NewInt(1))
+			}
+			switch method.Name {
+			case "balanceOf":
+				return method.Outputs.Pack(big.NewInt(5000))
+			case "allowance":
+				return method.Outputs.Pack(big.NewInt(10))
+			}
+			return method.Outputs.Pack(true)
+		}}}
+		s := &paymentSimulator{chainID: 4202, chain: chain}
+
+		simulation, err := s.simulate(context.Background(), PaymentParty{Address: kycSender}, PaymentParty{Address: settlementMerchant}, token, big.NewInt(1000), "")
+		require.NoError(t, err)
+		assert.True(t, simulation.Success)
+		assert.True(t, simulation.ApprovalRequired)
+		require.Len(t, simulation.Calls, 2)
+		assert.Equal(t, "approve", simulation.Calls[0].Method)
+		assert.Equal(t, "createPayment", simulation.Calls[1].Method)
+		assert.Equal(t, uint64(100000), simulation.GasEstimate)
+		assert.Equal(t, "1200000", simulation.GasCost)
+	})
+
+	t.Run("should tell reverts from an unreachable chain", func(t *testing.T) {
+		s := &paymentSimulator{chainID: 4202, chain: &fakeSimulationChain{balance: big.NewInt(5000), fakeChain: fakeChain{call: func(msg ethereum.CallMsg) ([]byte, error) {
+			return nil, errors.New("connection refused")
+		}}}}
+
+		_, err := s.simulate(context.Background(), PaymentParty{Address: kycSender}, PaymentParty{Address: settlementMerchant}, common.Address{}, big.NewInt(1000), "")
+		assert.ErrorContains(t, err, "connection refused")
+		assert.Equal(t, "IncorrectValue", revertReason(errors.New("execution reverted: IncorrectValue")))
+	})
+
+	t.Run("should answer 503 when simulation is not configured", func(t *testing.T) {
+		w := simulate(`{"sender": "` + kycSender + `", "recipient": "` + settlementMerchant + `", "token": "` + nativeToken + `", "amount": "1000"}`)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
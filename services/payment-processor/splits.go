@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// A split payment divides one payment from a sender among several
+// recipients, by shares in basis points or by fixed amounts. Each leg is a
+// PaymentCore payment of its own, grouped under the split's ID. When
+// sponsored payments are configured the legs are created atomically by one
+// user operation that calls createPayment for every leg from the sender's
+// smart account. In sandbox mode they are created one after another on the
+// sandbox chain.
+
+// Split payment statuses. A split is pending until its legs are created on
+// chain, and failed when they could not be.
+const (
+	SplitPending  = "pending"
+	SplitExecuted = "executed"
+	SplitFailed   = "failed"
+)
+
+// How a split's legs are created
+const (
+	SplitAtomic     = "user_operation"
+	SplitSequential = "sequential"
+)
+
+const (
+	maxSplitRecipients = 50
+	splitBasisPoints   = 10000
+)
+
+var errSplitNotFound = errors.New("split payment not found")
+
+// splits is always set; split payments are kept in the payments database
+var splits *splitService
+
+type splitService struct {
+	now func() time.Time
+}
+
+// SplitShare is one recipient of a split and their share, either ShareBPS
+// basis points of the amount or a fixed Amount
+type SplitShare struct {
+	Recipient string `json:"recipient"`
+	ShareBPS  int64  `json:"share_bps,omitempty"`
+	Amount    string `json:"amount,omitempty"`
+}
+
+// SplitPaymentRequest divides Amount of Token from Sender among Recipients.
+// Factory and FactoryData deploy the sender's smart account when it has no
+// code yet.
+type SplitPaymentRequest struct {
+	Sender      string        `json:"sender"`
+	Factory     string        `json:"factory"`
+	FactoryData string        `json:"factory_data"`
+	Token       string        `json:"token"`
+	Amount      string        `json:"amount"`
+	MetadataURI string        `json:"metadata_uri"`
+	Recipients  []*SplitShare `json:"recipients"`
+}
+
+// SplitPayment is a split and its legs. UserOpHash is the operation that
+// creates the legs atomically.
+type SplitPayment struct {
+	ID          string      `json:"id"`
+	ChainID     int64       `json:"chain_id"`
+	Sender      string      `json:"sender"`
+	Token       string      `json:"token"`
+	Amount      string      `json:"amount"`
+	MetadataURI string      `json:"metadata_uri,omitempty"`
+	Execution   string      `json:"execution"`
+	Status      string      `json:"status"`
+	UserOpHash  string      `json:"user_op_hash,omitempty"`
+	Reason      string      `json:"reason,omitempty"`
+	Legs        []*SplitLeg `json:"legs"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// SplitLeg is what one recipient of a split is paid. PaymentID and TxHash are
+// set once the leg's payment has been created.
+type SplitLeg struct {
+	Index     int    `json:"index"`
+	Recipient string `json:"recipient"`
+	ShareBPS  int64  `json:"share_bps,omitempty"`
+	Amount    string `json:"amount"`
+	PaymentID string `json:"payment_id,omitempty"`
+	TxHash    string `json:"tx_hash,omitempty"`
+}
+
+// validate checks the split's addresses and shares and returns its legs.
+// Shares in basis points must add up to 10000, and the rounding remainder
+// goes to the first recipient. Fixed amounts must add up to the amount.
+func (r *SplitPaymentRequest) validate() ([]*SplitLeg, error) {
+	for _, address := range []string{r.Sender, r.Token} {
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("invalid address %q", address)
+		}
+	}
+	if r.Factory != "" && !common.IsHexAddress(r.Factory) {
+		return nil, fmt.Errorf("invalid factory address %q", r.Factory)
+	}
+	total, ok := new(big.Int).SetString(r.Amount, 10)
+	if !ok || total.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid amount %q", r.Amount)
+	}
+	if len(r.Recipients) < 2 || len(r.Recipients) > maxSplitRecipients {
+		return nil, fmt.Errorf("a split needs between 2 and %d recipients", maxSplitRecipients)
+	}
+
+	byShare := r.Recipients[0].Amount == ""
+	legs := make([]*SplitLeg, len(r.Recipients))
+	sum := new(big.Int)
+	var shares int64
+	for i, share := range r.Recipients {
+		if !common.IsHexAddress(share.Recipient) || common.HexToAddress(share.Recipient) == (common.Address{}) {
+			return nil, fmt.Errorf("invalid recipient %q", share.Recipient)
+		}
+		leg := &SplitLeg{Index: i, Recipient: strings.ToLower(share.Recipient)}
+		var amount *big.Int
+		if byShare {
+			if share.Amount != "" || share.ShareBPS <= 0 || share.ShareBPS > splitBasisPoints {
+				return nil, fmt.Errorf("recipient %d: every share_bps must be between 1 and %d, without amount", i, splitBasisPoints)
+			}
+			shares += share.ShareBPS
+			leg.ShareBPS = share.ShareBPS
+			amount = new(big.Int).Mul(total, big.NewInt(share.ShareBPS))
+			amount.Div(amount, big.NewInt(splitBasisPoints))
+		} else {
+			if share.ShareBPS != 0 {
+				return nil, fmt.Errorf("recipient %d: use either share_bps or amount for every recipient", i)
+			}
+			amount, ok = new(big.Int).SetString(share.Amount, 10)
+			if !ok || amount.Sign() <= 0 {
+				return nil, fmt.Errorf("recipient %d: invalid amount %q", i, share.Amount)
+			}
+		}
+		sum.Add(sum, amount)
+		leg.Amount = amount.String()
+		legs[i] = leg
+	}
+
+	if byShare {
+		if shares != splitBasisPoints {
+			return nil, fmt.Errorf("shares add up to %d basis points, not %d", shares, splitBasisPoints)
+		}
+		first, _ := new(big.Int).SetString(legs[0].Amount, 10)
+		legs[0].Amount = first.Add(first, new(big.Int).Sub(total, sum)).String()
+	} else if sum.Cmp(total) != 0 {
+		return nil, fmt.Errorf("amounts add up to %s, not %s", sum, total)
+	}
+	for _, leg := range legs {
+		if leg.Amount == "0" {
+			return nil, fmt.Errorf("recipient %d's share of %s is zero", leg.Index, total)
+		}
+	}
+	return legs, nil
+}
+
+// splitCallData encodes the smart account call that creates every leg in one
+// transaction. Token splits approve PaymentCore for the amounts and fees
+// first; native splits send each leg's amount and fee with its payment.
+func splitCallData(paymentCore common.Address, token common.Address, metadataURI string, legs []*SplitLeg) ([]byte, error) {
+	var targets []common.Address
+	var values []*big.Int
+	var calls [][]byte
+
+	approved := new(big.Int)
+	for _, leg := range legs {
+		amount, _ := new(big.Int).SetString(leg.Amount, 10)
+		create, err := paymentCoreABI.Pack("createPayment", common.HexToAddress(leg.Recipient), token, amount, metadataURI, "", "")
+		if err != nil {
+			return nil, err
+		}
+		value := new(big.Int).Add(amount, paymentFee(amount))
+		approved.Add(approved, value)
+		if token != (common.Address{}) {
+			value = new(big.Int)
+		}
+		targets, values, calls = append(targets, paymentCore), append(values, value), append(calls, create)
+	}
+
+	if token != (common.Address{}) {
+		approve, err := erc20ABI.Pack("approve", paymentCore, approved)
+		if err != nil {
+			return nil, err
+		}
+		targets = append([]common.Address{token}, targets...)
+		values = append([]*big.Int{new(big.Int)}, values...)
+		calls = append([][]byte{approve}, calls...)
+	}
+	return accountABI.Pack("executeBatch", targets, values, calls)
+}
+
+// create stores a pending split with its legs
+func (s *splitService) create(chainID int64, request *SplitPaymentRequest, legs []*SplitLeg, execution, userOpHash string) (*SplitPayment, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := s.now().UTC()
+	split := &SplitPayment{
+		ID:          hexutil.Encode(id),
+		ChainID:     chainID,
+		Sender:      strings.ToLower(request.Sender),
+		Token:       strings.ToLower(request.Token),
+		Amount:      request.Amount,
+		MetadataURI: request.MetadataURI,
+		Execution:   execution,
+		Status:      SplitPending,
+		UserOpHash:  userOpHash,
+		Legs:        legs,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO split_payments (id, chain_id, sender, token, amount, metadata_uri, execution, status, user_op_hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		split.ID, split.ChainID, split.Sender, split.Token, split.Amount, split.MetadataURI, split.Execution, split.Status,
+		split.UserOpHash, split.CreatedAt, split.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store split payment: %w", err)
+	}
+	for _, leg := range legs {
+		_, err := tx.Exec(`INSERT INTO split_payment_legs (split_id, leg_index, recipient, share_bps, amount) VALUES (?, ?, ?, ?, ?)`,
+			split.ID, leg.Index, leg.Recipient, leg.ShareBPS, leg.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store split payment leg: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to store split payment: %w", err)
+	}
+	return split, nil
+}
+
+// executeInSandbox creates the legs of a split one after another on the
+// sandbox chain. A leg that fails fails the split, leaving the legs before it
+// created.
+func (s *splitService) executeInSandbox(split *SplitPayment) (*SplitPayment, error) {
+	for _, leg := range split.Legs {
+		paymentID, txHash, err := sandboxCreatePayment(split.Sender, leg.Recipient, split.Token, leg.Amount, split.MetadataURI, "", "")
+		if err != nil {
+			return split, s.finish(split, SplitFailed, fmt.Sprintf("leg %d: %v", leg.Index, err))
+		}
+		leg.PaymentID, leg.TxHash = fmt.Sprint(paymentID), txHash
+		if err := s.link(split.ID, leg); err != nil {
+			return nil, err
+		}
+	}
+	return split, s.finish(split, SplitExecuted, "")
+}
+
+// settleUserOp records what became of the operation that creates a split's
+// legs. paymentIDs are the payments the operation created, in the order of
+// the legs.
+func (s *splitService) settleUserOp(record *UserOpRecord, paymentIDs []string) error {
+	found, err := s.query(`WHERE user_op_hash = ? AND status = ?`, record.Hash, SplitPending)
+	if err != nil || len(found) == 0 {
+		return err
+	}
+	split := found[0]
+
+	switch record.Status {
+	case UserOpPending:
+		return nil
+	case UserOpIncluded:
+		if len(paymentIDs) != len(split.Legs) {
+			return s.finish(split, SplitFailed, fmt.Sprintf("operation created %d payments for %d legs", len(paymentIDs), len(split.Legs)))
+		}
+		for i, leg := range split.Legs {
+			leg.PaymentID, leg.TxHash = paymentIDs[i], record.TxHash
+			if err := s.link(split.ID, leg); err != nil {
+				return err
+			}
+		}
+		return s.finish(split, SplitExecuted, "")
+	default:
+		return s.finish(split, SplitFailed, fmt.Sprintf("user operation %s: %s", record.Status, record.Reason))
+	}
+}
+
+// link records the payment that paid a leg
+func (s *splitService) link(splitID string, leg *SplitLeg) error {
+	_, err := db.Exec(`UPDATE split_payment_legs SET payment_id = ?, tx_hash = ? WHERE split_id = ? AND leg_index = ?`,
+		leg.PaymentID, leg.TxHash, splitID, leg.Index)
+	if err != nil {
+		return fmt.Errorf("failed to link leg %d of split %s: %w", leg.Index, splitID, err)
+	}
+	return nil
+}
+
+// finish sets a split's final status
+func (s *splitService) finish(split *SplitPayment, status, reason string) error {
+	now := s.now().UTC()
+	_, err := db.Exec(`UPDATE split_payments SET status = ?, reason = ?, updated_at = ? WHERE id = ?`, status, reason, now, split.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update split %s: %w", split.ID, err)
+	}
+	split.Status, split.Reason, split.UpdatedAt = status, reason, now
+	return nil
+}
+
+// get returns the split with id and its legs
+func (s *splitService) get(id string) (*SplitPayment, error) {
+	found, err := s.query(`WHERE id = ?`, strings.ToLower(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, errSplitNotFound
+	}
+	return found[0], nil
+}
+
+// query returns the splits matching where with their legs
+func (s *splitService) query(where string, args ...interface{}) ([]*SplitPayment, error) {
+	rows, err := db.Query(`SELECT id, chain_id, sender, token, amount, metadata_uri, execution, status, user_op_hash, reason, created_at, updated_at FROM split_payments `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	var found []*SplitPayment
+	for rows.Next() {
+		split := &SplitPayment{}
+		err := rows.Scan(&split.ID, &split.ChainID, &split.Sender, &split.Token, &split.Amount, &split.MetadataURI,
+			&split.Execution, &split.Status, &split.UserOpHash, &split.Reason, &split.CreatedAt, &split.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found = append(found, split)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, split := range found {
+		if split.Legs, err = s.legs(split.ID); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// legs returns a split's legs in order
+func (s *splitService) legs(splitID string) ([]*SplitLeg, error) {
+	rows, err := db.Query(`SELECT leg_index, recipient, share_bps, amount, payment_id, tx_hash FROM split_payment_legs WHERE split_id = ? ORDER BY leg_index`, splitID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	legs := []*SplitLeg{}
+	for rows.Next() {
+		leg := &SplitLeg{}
+		if err := rows.Scan(&leg.Index, &leg.Recipient, &leg.ShareBPS, &leg.Amount, &leg.PaymentID, &leg.TxHash); err != nil {
+			return nil, err
+		}
+		legs = append(legs, leg)
+	}
+	return legs, rows.Err()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	splitAlice = "0x00000000000000000000000000000000000000e1"
+	splitBob   = "0x00000000000000000000000000000000000000e2"
+	splitCarol = "0x00000000000000000000000000000000000000e3"
+)
+
+func splitRequest() *SplitPaymentRequest {
+	return &SplitPaymentRequest{
+		Sender: kycSender,
+		Token:  nativeToken,
+		Amount: "1000001",
+		Recipients: []*SplitShare{
+			{Recipient: splitAlice, ShareBPS: 5000},
+			{Recipient: splitBob, ShareBPS: 3000},
+			{Recipient: splitCarol, ShareBPS: 2000},
+		},
+	}
+}
+
+// setupSplitHandlers lets payments through without token or KYC checks
+func setupSplitHandlers(t *testing.T) {
+	setGlobal(t, &splits, &splitService{now: time.Now})
+	setGlobal(t, &tokens, &tokenRegistry{mode: AllowlistOff})
+	setGlobal(t, &kyc, &kycService{mode: KYCOff})
+}
+
+func legAmounts(legs []*SplitLeg) []string {
+	amounts := make([]string, len(legs))
+	for i, leg := range legs {
+		amounts[i] = leg.Amount
+	}
+	return amounts
+}
+
+func TestSplitPaymentRequest(t *testing.T) {
+	t.Run("should give the rounding remainder of shares to the first recipient", func(t *testing.T) {
+		legs, err := splitRequest().validate()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"500001", "300000", "200000"}, legAmounts(legs))
+		assert.Equal(t, int64(3000), legs[1].ShareBPS)
+	})
+
+	t.Run("should accept fixed amounts that add up to the total", func(t *testing.T) {
+		request := splitRequest()
+		request.Amount = "100"
+		request.Recipients = []*SplitShare{{Recipient: splitAlice, Amount: "70"}, {Recipient: splitBob, Amount: "30"}}
+		legs, err := request.validate()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"70", "30"}, legAmounts(legs))
+	})
+
+	t.Run("should reject invalid splits", func(t *testing.T) {
+		for name, modify := range map[string]func(*SplitPaymentRequest){
+			"one recipient":     func(r *SplitPaymentRequest) { r.Recipients = r.Recipients[:1] },
+			"bad recipient":     func(r *SplitPaymentRequest) { r.Recipients[1].Recipient = "bob.eth" },
+			"zero recipient":    func(r *SplitPaymentRequest) { r.Recipients[1].Recipient = nativeToken },
+			"shares under 100%": func(r *SplitPaymentRequest) { r.Recipients[2].ShareBPS = 1000 },
+			"mixed modes":       func(r *SplitPaymentRequest) { r.Recipients[1].Amount = "300000" },
+			"amounts off": func(r *SplitPaymentRequest) {
+				r.Recipients = []*SplitShare{{Recipient: splitAlice, Amount: "1"}, {Recipient: splitBob, Amount: "1"}}
+			},
+			"zero share":  func(r *SplitPaymentRequest) { r.Amount = "1" },
+			"zero amount": func(r *SplitPaymentRequest) { r.Amount = "0" },
+		} {
+			request := splitRequest()
+			modify(request)
+			_, err := request.validate()
+			assert.Error(t, err, name)
+		}
+	})
+}
+
+func TestSplitCallData(t *testing.T) {
+	core := common.HexToAddress("0x00000000000000000000000000000000000000c0")
+	legs, err := splitRequest().validate()
+	require.NoError(t, err)
+
+	t.Run("should send every native leg with its fee in one batch", func(t *testing.T) {
+		data, err := splitCallData(core, common.Address{}, "", legs)
+		require.NoError(t, err)
+
+		method, err := accountABI.MethodById(data[:4])
+		require.NoError(t, err)
+		assert.Equal(t, "executeBatch", method.Name)
+		args, err := method.Inputs.Unpack(data[4:])
+		require.NoError(t, err)
+		assert.Equal(t, []common.Address{core, core, core}, args[0])
+		assert.Equal(t, []*big.Int{big.NewInt(500501), big.NewInt(300300), big.NewInt(200200)}, args[1])
+
+		create, err := paymentCoreABI.Methods["createPayment"].Inputs.Unpack(args[2].([][]byte)[1][4:])
+		require.NoError(t, err)
+		assert.Equal(t, common.HexToAddress(splitBob), create[0])
+		assert.Equal(t, big.NewInt(300000), create[2])
+	})
+
+	t.Run("should approve the whole token split first", func(t *testing.T) {
+		token := common.HexToAddress("0x00000000000000000000000000000000000000d4")
+		data, err := splitCallData(core, token, "", legs)
+		require.NoError(t, err)
+
+		args, err := accountABI.Methods["executeBatch"].Inputs.Unpack(data[4:])
+		require.NoError(t, err)
+		assert.Equal(t, []common.Address{token, core, core, core}, args[0])
+		approve, err := erc20ABI.Methods["approve"].Inputs.Unpack(args[2].([][]byte)[0][4:])
+		require.NoError(t, err)
+		assert.Equal(t, big.NewInt(1001001), approve[1])
+	})
+}
+
+func TestSplitPayments(t *testing.T) {
+	t.Run("should create every leg on the sandbox chain under the split", func(t *testing.T) {
+		setupSandboxTest(t)
+		setupSplitHandlers(t)
+
+		body, err := json.Marshal(splitRequest())
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		handleCreateSplit(w, httptest.NewRequest(http.MethodPost, "/api/splits/create", strings.NewReader(string(body))))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var response struct {
+			Split *SplitPayment `json:"split"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, SplitExecuted, response.Split.Status)
+		assert.Equal(t, SplitSequential, response.Split.Execution)
+
+		w = httptest.NewRecorder()
+		handleGetSplit(w, httptest.NewRequest(http.MethodGet, "/api/splits/"+response.Split.ID, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var split SplitPayment
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&split))
+		require.Len(t, split.Legs, 3)
+		for i, leg := range split.Legs {
+			assert.Equal(t, []string{"1", "2", "3"}[i], leg.PaymentID)
+			assert.NotEmpty(t, leg.TxHash)
+		}
+		assert.Equal(t, big.NewInt(1001001), sandboxChain.Balance(sandboxPaymentCore))
+
+		w = httptest.NewRecorder()
+		handleGetUserSplits(w, httptest.NewRequest(http.MethodGet, "/api/splits/user/"+splitCarol, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var found map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&found))
+		assert.Equal(t, 1.0, found["count"])
+
+		w = httptest.NewRecorder()
+		handleGetSplit(w, httptest.NewRequest(http.MethodGet, "/api/splits/0x00", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("should need sponsored payments or sandbox mode", func(t *testing.T) {
+		setupSplitHandlers(t)
+		w := httptest.NewRecorder()
+		handleCreateSplit(w, httptest.NewRequest(http.MethodPost, "/api/splits/create", strings.NewReader(`{}`)))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("should link the legs to the payments of the user operation", func(t *testing.T) {
+		service, _, bundler, _ := setupUserOpTest(t)
+		setupSplitHandlers(t)
+		setGlobal(t, &userOps, service)
+
+		body, err := json.Marshal(splitRequest())
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		handleCreateSplit(w, httptest.NewRequest(http.MethodPost, "/api/splits/create", strings.NewReader(string(body))))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var response struct {
+			Split         *SplitPayment       `json:"split"`
+			UserOperation *BuiltUserOperation `json:"user_operation"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, SplitPending, response.Split.Status)
+		assert.Equal(t, SplitAtomic, response.Split.Execution)
+		assert.Equal(t, response.UserOperation.Hash.Hex(), response.Split.UserOpHash)
+
+		op := response.UserOperation.UserOperation
+		op.Signature = []byte{1}
+		record, err := service.send(context.Background(), op)
+		require.NoError(t, err)
+
+		event := paymentCoreABI.Events["PaymentCreated"]
+		var logs []map[string]interface{}
+		for i, leg := range response.Split.Legs {
+			amount, _ := new(big.Int).SetString(leg.Amount, 10)
+			data, err := event.Inputs.NonIndexed().Pack(common.Address{}, amount, paymentFee(amount), "", "", "")
+			require.NoError(t, err)
+			logs = append(logs, map[string]interface{}{
+				"address": service.paymentCore,
+				"topics": []common.Hash{
+					event.ID,
+					common.BigToHash(big.NewInt(int64(40 + i))),
+					common.BytesToHash(common.HexToAddress(kycSender).Bytes()),
+					common.BytesToHash(common.HexToAddress(leg.Recipient).Bytes()),
+				},
+				"data": hexutil.Bytes(data),
+			})
+		}
+		bundler.handlers["eth_getUserOperationReceipt"] = func(args []interface{}) (interface{}, error) {
+			return map[string]interface{}{
+				"success": true,
+				"logs":    logs,
+				"receipt": map[string]interface{}{"transactionHash": common.HexToHash("0xfeed"), "blockNumber": "0x10"},
+			}, nil
+		}
+		require.NoError(t, service.refresh(context.Background(), record))
+
+		split, err := splits.get(response.Split.ID)
+		require.NoError(t, err)
+		assert.Equal(t, SplitExecuted, split.Status)
+		for i, leg := range split.Legs {
+			assert.Equal(t, []string{"40", "41", "42"}[i], leg.PaymentID)
+			assert.Equal(t, common.HexToHash("0xfeed").Hex(), leg.TxHash)
+		}
+	})
+}
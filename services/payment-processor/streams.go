@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Payment streams pay a recipient by the second, Sablier-style. The sender
+// deposits the rate times the duration up front, and from the start time the
+// recipient accrues the rate every second until the stop time. A top-up adds
+// to the deposit and pushes the stop time back at the same rate. Cancelling
+// stops the stream: what the recipient accrued is theirs and the rest is
+// refunded to the sender.
+
+// Payment stream statuses. Scheduled and completed are reported for active
+// streams that have not started or have run out.
+const (
+	StreamScheduled = "scheduled"
+	StreamActive    = "active"
+	StreamCompleted = "completed"
+	StreamCancelled = "cancelled"
+)
+
+// maxStreamDuration bounds the duration of a stream, top-ups included
+const maxStreamDuration = 10 * 365 * 24 * time.Hour
+
+var (
+	errStreamNotFound = errors.New("stream not found")
+	errStreamEnded    = errors.New("stream has ended")
+	errInvalidTopUp   = errors.New("invalid top-up")
+)
+
+// streams is always set; streams are kept in the payments database
+var streams *streamService
+
+type streamService struct {
+	now func() time.Time
+}
+
+// StreamRequest creates a stream of RatePerSecond for Duration seconds from
+// StartTime, a unix timestamp that defaults to now
+type StreamRequest struct {
+	Sender        string `json:"sender"`
+	Recipient     string `json:"recipient"`
+	Token         string `json:"token"`
+	RatePerSecond string `json:"rate_per_second"`
+	Duration      int64  `json:"duration"`
+	StartTime     int64  `json:"start_time"`
+}
+
+// PaymentStream is a stream and its state when it was read. Streamed is what
+// the recipient has accrued and Remaining what is left of the deposit, which
+// is the sender's refund once cancelled.
+type PaymentStream struct {
+	ID            string     `json:"id"`
+	ChainID       int64      `json:"chain_id"`
+	Sender        string     `json:"sender"`
+	Recipient     string     `json:"recipient"`
+	Token         string     `json:"token"`
+	RatePerSecond string     `json:"rate_per_second"`
+	Deposit       string     `json:"deposit"`
+	StartTime     time.Time  `json:"start_time"`
+	StopTime      time.Time  `json:"stop_time"`
+	Status        string     `json:"status"`
+	Streamed      string     `json:"streamed"`
+	Remaining     string     `json:"remaining"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	CancelledAt   *time.Time `json:"cancelled_at,omitempty"`
+}
+
+// StreamVolume is what streams have paid and still hold, across tokens
+type StreamVolume struct {
+	ActiveStreams int    `json:"active_streams"`
+	Streamed      string `json:"streamed_volume"`
+	Outstanding   string `json:"outstanding_volume"`
+}
+
+// validate checks the stream's addresses, rate, duration and start time
+func (r *StreamRequest) validate(now time.Time) (*big.Int, error) {
+	for _, address := range []string{r.Sender, r.Recipient, r.Token} {
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("invalid address %q", address)
+		}
+	}
+	if strings.EqualFold(r.Sender, r.Recipient) {
+		return nil, errors.New("sender and recipient must differ")
+	}
+	rate, ok := new(big.Int).SetString(r.RatePerSecond, 10)
+	if !ok || rate.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid rate_per_second %q", r.RatePerSecond)
+	}
+	if r.Duration <= 0 || time.Duration(r.Duration)*time.Second > maxStreamDuration {
+		return nil, fmt.Errorf("duration must be between 1 and %d seconds", int64(maxStreamDuration/time.Second))
+	}
+	if r.StartTime != 0 && r.StartTime < now.Unix() {
+		return nil, errors.New("start_time has passed")
+	}
+	return rate, nil
+}
+
+// create stores a new stream whose deposit is its rate times its duration
+func (s *streamService) create(chainID int64, request *StreamRequest) (*PaymentStream, error) {
+	now := s.now().UTC()
+	rate, err := request.validate(now)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	start := now.Truncate(time.Second)
+	if request.StartTime != 0 {
+		start = time.Unix(request.StartTime, 0).UTC()
+	}
+
+	stream := &PaymentStream{
+		ID:            hexutil.Encode(id),
+		ChainID:       chainID,
+		Sender:        strings.ToLower(request.Sender),
+		Recipient:     strings.ToLower(request.Recipient),
+		Token:         strings.ToLower(request.Token),
+		RatePerSecond: rate.String(),
+		Deposit:       new(big.Int).Mul(rate, big.NewInt(request.Duration)).String(),
+		StartTime:     start,
+		StopTime:      start.Add(time.Duration(request.Duration) * time.Second),
+		Status:        StreamActive,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	_, err = db.Exec(`INSERT INTO payment_streams (id, chain_id, sender, recipient, token, rate_per_second, deposit, start_time, stop_time, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		stream.ID, stream.ChainID, stream.Sender, stream.Recipient, stream.Token, stream.RatePerSecond, stream.Deposit,
+		stream.StartTime, stream.StopTime, stream.Status, stream.CreatedAt, stream.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store stream: %w", err)
+	}
+	s.accrue(stream, now)
+	return stream, nil
+}
+
+// topUp adds value to a stream's deposit and extends it by value over its
+// rate. value must pay for a whole number of seconds.
+func (s *streamService) topUp(id, value string) (*PaymentStream, error) {
+	stream, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if stream.Status == StreamCompleted || stream.Status == StreamCancelled {
+		return nil, errStreamEnded
+	}
+	amount, ok := new(big.Int).SetString(value, 10)
+	if !ok || amount.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: invalid amount %q", errInvalidTopUp, value)
+	}
+	rate, _ := new(big.Int).SetString(stream.RatePerSecond, 10)
+	seconds, rest := new(big.Int).QuoRem(amount, rate, new(big.Int))
+	if rest.Sign() != 0 {
+		return nil, fmt.Errorf("%w: amount must be a multiple of the rate %s", errInvalidTopUp, stream.RatePerSecond)
+	}
+	maxSeconds, duration := int64(maxStreamDuration/time.Second), int64(stream.StopTime.Sub(stream.StartTime)/time.Second)
+	if !seconds.IsInt64() || seconds.Int64() > maxSeconds-duration {
+		return nil, fmt.Errorf("%w: streams last at most %d seconds", errInvalidTopUp, maxSeconds)
+	}
+	stopTime := stream.StopTime.Add(time.Duration(seconds.Int64()) * time.Second)
+
+	deposit, _ := new(big.Int).SetString(stream.Deposit, 10)
+	now := s.now().UTC()
+	_, err = db.Exec(`UPDATE payment_streams SET deposit = ?, stop_time = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		deposit.Add(deposit, amount).String(), stopTime, now, stream.ID, StreamActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to top up stream %s: %w", stream.ID, err)
+	}
+	stream.Deposit, stream.StopTime, stream.UpdatedAt = deposit.String(), stopTime, now
+	s.accrue(stream, now)
+	return stream, nil
+}
+
+// cancel stops a stream, leaving the recipient what they accrued
+func (s *streamService) cancel(id string) (*PaymentStream, error) {
+	stream, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if stream.Status == StreamCompleted || stream.Status == StreamCancelled {
+		return nil, errStreamEnded
+	}
+
+	now := s.now().UTC()
+	_, err = db.Exec(`UPDATE payment_streams SET status = ?, cancelled_at = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		StreamCancelled, now, now, stream.ID, StreamActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel stream %s: %w", stream.ID, err)
+	}
+	stream.CancelledAt, stream.UpdatedAt = &now, now
+	s.accrue(stream, now)
+	return stream, nil
+}
+
+// get returns the stream with id as of now
+func (s *streamService) get(id string) (*PaymentStream, error) {
+	found, err := s.query(`WHERE id = ?`, strings.ToLower(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, errStreamNotFound
+	}
+	return found[0], nil
+}
+
+// query returns the streams matching where as of now
+func (s *streamService) query(where string, args ...interface{}) ([]*PaymentStream, error) {
+	rows, err := db.Query(`SELECT id, chain_id, sender, recipient, token, rate_per_second, deposit, start_time, stop_time, status, created_at, updated_at, cancelled_at FROM payment_streams `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := s.now().UTC()
+	var found []*PaymentStream
+	for rows.Next() {
+		stream := &PaymentStream{}
+		var cancelledAt sql.NullTime
+		err := rows.Scan(&stream.ID, &stream.ChainID, &stream.Sender, &stream.Recipient, &stream.Token, &stream.RatePerSecond,
+			&stream.Deposit, &stream.StartTime, &stream.StopTime, &stream.Status, &stream.CreatedAt, &stream.UpdatedAt, &cancelledAt)
+		if err != nil {
+			return nil, err
+		}
+		if cancelledAt.Valid {
+			stream.CancelledAt = &cancelledAt.Time
+		}
+		s.accrue(stream, now)
+		found = append(found, stream)
+	}
+	return found, rows.Err()
+}
+
+// volume adds up what the streams have paid to their recipients and what
+// their deposits still hold
+func (s *streamService) volume() (*StreamVolume, error) {
+	found, err := s.query(``)
+	if err != nil {
+		return nil, err
+	}
+	volume := &StreamVolume{}
+	streamed, outstanding := new(big.Int), new(big.Int)
+	for _, stream := range found {
+		paid, _ := new(big.Int).SetString(stream.Streamed, 10)
+		streamed.Add(streamed, paid)
+		if stream.Status == StreamCancelled {
+			continue
+		}
+		if stream.Status == StreamActive {
+			volume.ActiveStreams++
+		}
+		left, _ := new(big.Int).SetString(stream.Remaining, 10)
+		outstanding.Add(outstanding, left)
+	}
+	volume.Streamed, volume.Outstanding = streamed.String(), outstanding.String()
+	return volume, nil
+}
+
+// accrue sets what a stream has streamed by now, or by when it was
+// cancelled, and its status at that time
+func (s *streamService) accrue(stream *PaymentStream, now time.Time) {
+	at := now
+	if stream.CancelledAt != nil {
+		at = *stream.CancelledAt
+	}
+	elapsed := int64(at.Sub(stream.StartTime) / time.Second)
+	if duration := int64(stream.StopTime.Sub(stream.StartTime) / time.Second); elapsed > duration {
+		elapsed = duration
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	rate, _ := new(big.Int).SetString(stream.RatePerSecond, 10)
+	deposit, _ := new(big.Int).SetString(stream.Deposit, 10)
+	streamed := new(big.Int).Mul(rate, big.NewInt(elapsed))
+	stream.Streamed = streamed.String()
+	stream.Remaining = new(big.Int).Sub(deposit, streamed).String()
+
+	switch {
+	case stream.CancelledAt != nil:
+		stream.Status = StreamCancelled
+	case now.Before(stream.StartTime):
+		stream.Status = StreamScheduled
+	case !now.Before(stream.StopTime):
+		stream.Status = StreamCompleted
+	default:
+		stream.Status = StreamActive
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	streamSender    = "0x00000000000000000000000000000000000000d1"
+	streamRecipient = "0x00000000000000000000000000000000000000d2"
+	streamToken     = "0x00000000000000000000000000000000000000d3"
+)
+
+// setupStreamTest returns a stream service whose clock is at *now
+func setupStreamTest(t *testing.T) (*streamService, *time.Time) {
+	setupTestDB(t)
+
+	clock, now := fixedClock(testNow)
+	service := &streamService{now: clock}
+	setGlobal(t, &streams, service)
+	return service, now
+}
+
+// createStream streams 10 a second for 100 seconds from now
+func createStream(t *testing.T, service *streamService) *PaymentStream {
+	stream, err := service.create(4202, &StreamRequest{
+		Sender:        streamSender,
+		Recipient:     streamRecipient,
+		Token:         streamToken,
+		RatePerSecond: "10",
+		Duration:      100,
+	})
+	require.NoError(t, err)
+	return stream
+}
+
+func TestStreamRequest(t *testing.T) {
+	now := testNow
+	valid := StreamRequest{Sender: streamSender, Recipient: streamRecipient, Token: streamToken, RatePerSecond: "10", Duration: 100}
+
+	t.Run("should accept a valid stream", func(t *testing.T) {
+		request := valid
+		_, err := request.validate(now)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should reject invalid streams", func(t *testing.T) {
+		for name, modify := range map[string]func(*StreamRequest){
+			"bad recipient":   func(r *StreamRequest) { r.Recipient = "bob" },
+			"self stream":     func(r *StreamRequest) { r.Recipient = strings.ToUpper(r.Sender) },
+			"zero rate":       func(r *StreamRequest) { r.RatePerSecond = "0" },
+			"fractional rate": func(r *StreamRequest) { r.RatePerSecond = "1.5" },
+			"no duration":     func(r *StreamRequest) { r.Duration = 0 },
+			"past start":      func(r *StreamRequest) { r.StartTime = now.Unix() - 1 },
+		} {
+			request := valid
+			modify(&request)
+			_, err := request.validate(now)
+			assert.Error(t, err, name)
+		}
+	})
+}
+
+func TestPaymentStreams(t *testing.T) {
+	t.Run("should accrue the rate every second until the stop time", func(t *testing.T) {
+		service, now := setupStreamTest(t)
+		stream := createStream(t, service)
+		assert.Equal(t, "1000", stream.Deposit)
+		assert.Equal(t, StreamActive, stream.Status)
+		assert.Equal(t, "0", stream.Streamed)
+
+		*now = now.Add(30*time.Second + 500*time.Millisecond)
+		stream, err := service.get(stream.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "300", stream.Streamed)
+		assert.Equal(t, "700", stream.Remaining)
+
+		*now = now.Add(time.Hour)
+		stream, err = service.get(stream.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StreamCompleted, stream.Status)
+		assert.Equal(t, "1000", stream.Streamed)
+		assert.Equal(t, "0", stream.Remaining)
+	})
+
+	t.Run("should not accrue before a scheduled start", func(t *testing.T) {
+		service, now := setupStreamTest(t)
+		stream, err := service.create(4202, &StreamRequest{
+			Sender:        streamSender,
+			Recipient:     streamRecipient,
+			Token:         streamToken,
+			RatePerSecond: "10",
+			Duration:      100,
+			StartTime:     now.Add(time.Minute).Unix(),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, StreamScheduled, stream.Status)
+		assert.Equal(t, "0", stream.Streamed)
+
+		*now = now.Add(70 * time.Second)
+		stream, err = service.get(stream.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StreamActive, stream.Status)
+		assert.Equal(t, "100", stream.Streamed)
+	})
+
+	t.Run("should extend topped up streams at the same rate", func(t *testing.T) {
+		service, now := setupStreamTest(t)
+		stream := createStream(t, service)
+		stopTime := stream.StopTime
+
+		*now = now.Add(50 * time.Second)
+		stream, err := service.topUp(stream.ID, "500")
+		require.NoError(t, err)
+		assert.Equal(t, "1500", stream.Deposit)
+		assert.Equal(t, stopTime.Add(50*time.Second), stream.StopTime)
+		assert.Equal(t, "1000", stream.Remaining)
+
+		_, err = service.topUp(stream.ID, "505")
+		assert.ErrorIs(t, err, errInvalidTopUp)
+
+		*now = now.Add(time.Hour)
+		_, err = service.topUp(stream.ID, "500")
+		assert.ErrorIs(t, err, errStreamEnded)
+	})
+
+	t.Run("should split cancelled streams between recipient and sender", func(t *testing.T) {
+		service, now := setupStreamTest(t)
+		stream := createStream(t, service)
+
+		*now = now.Add(40 * time.Second)
+		stream, err := service.cancel(stream.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StreamCancelled, stream.Status)
+		assert.Equal(t, "400", stream.Streamed)
+		assert.Equal(t, "600", stream.Remaining)
+
+		// A cancelled stream stops accruing
+		*now = now.Add(40 * time.Second)
+		stream, err = service.get(stream.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "400", stream.Streamed)
+		_, err = service.cancel(stream.ID)
+		assert.ErrorIs(t, err, errStreamEnded)
+		_, err = service.get("0x00")
+		assert.ErrorIs(t, err, errStreamNotFound)
+	})
+
+	t.Run("should count what streams paid in the payment volume", func(t *testing.T) {
+		service, now := setupStreamTest(t)
+		cancelled := createStream(t, service)
+		createStream(t, service)
+
+		*now = now.Add(20 * time.Second)
+		_, err := service.cancel(cancelled.ID)
+		require.NoError(t, err)
+		*now = now.Add(10 * time.Second)
+
+		volume, err := service.volume()
+		require.NoError(t, err)
+		assert.Equal(t, 1, volume.ActiveStreams)
+		assert.Equal(t, "500", volume.Streamed)
+		assert.Equal(t, "700", volume.Outstanding)
+
+		w := httptest.NewRecorder()
+		handleGetPaymentVolume(w, httptest.NewRequest(http.MethodGet, "/api/analytics/payments/volume", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, "1250000000000000000500", response["total_volume"])
+	})
+
+	t.Run("should answer the stream endpoints", func(t *testing.T) {
+		service, _ := setupStreamTest(t)
+		stream := createStream(t, service)
+
+		w := httptest.NewRecorder()
+		handleTopUpStream(w, httptest.NewRequest(http.MethodPost, "/api/streams/topup/"+stream.ID, strings.NewReader(`{"amount": "7"}`)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = httptest.NewRecorder()
+		handleCancelStream(w, httptest.NewRequest(http.MethodPost, "/api/streams/cancel/"+stream.ID, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = httptest.NewRecorder()
+		handleCancelStream(w, httptest.NewRequest(http.MethodPost, "/api/streams/cancel/"+stream.ID, nil))
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = httptest.NewRecorder()
+		handleGetUserStreams(w, httptest.NewRequest(http.MethodGet, "/api/streams/user/"+strings.ToUpper(streamRecipient), nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, 1.0, response["count"])
+	})
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The token registry describes the tokens payments may use. Tokens come from
+// a curated token list and from reading unknown contracts on chain. Only
+// curated tokens without a blocking risk flag are allowed; how that is
+// enforced depends on the registry's mode.
+
+// Allowlist modes. In warn mode payments with tokens that are not allowed go
+// through and are logged; in enforce mode they are rejected.
+const (
+	AllowlistOff     = "off"
+	AllowlistWarn    = "warn"
+	AllowlistEnforce = "enforce"
+)
+
+// Risk flags set by the registry. Curated lists may add their own, such as
+// fee_on_transfer or upgradeable.
+const (
+	RiskUnlisted        = "unlisted"
+	RiskNoCode          = "no_code"
+	RiskMissingMetadata = "missing_metadata"
+	RiskUnverified      = "unverified"
+	// RiskBlocked marks a curated token payments must not use
+	RiskBlocked = "blocked"
+)
+
+// tokenCacheTTL is how long on-chain reads of uncurated tokens are reused
+const tokenCacheTTL = 24 * time.Hour
+
+var erc20MetadataABI = mustParseABI(`[
+	{"type":"function","name":"symbol","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"string"}]},
+	{"type":"function","name":"name","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"string"}]},
+	{"type":"function","name":"decimals","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint8"}]}
+]`)
+
+var errTokenNotAllowed = errors.New("token is not allowed")
+
+// tokens is the registry payments are checked against
+var tokens *tokenRegistry
+
+// Token is a token's metadata and how far it can be trusted
+type Token struct {
+	ChainID   int64     `json:"chain_id"`
+	Address   string    `json:"address"`
+	Symbol    string    `json:"symbol"`
+	Name      string    `json:"name"`
+	Decimals  uint8     `json:"decimals"`
+	LogoURI   string    `json:"logo_uri,omitempty"`
+	RiskFlags []string  `json:"risk_flags"`
+	Curated   bool      `json:"curated"`
+	Allowed   bool      `json:"allowed"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// tokenList is a curated list in the Uniswap token list format, with
+// optional risk flags per token
+type tokenList struct {
+	Tokens []struct {
+		ChainID   int64    `json:"chainId"`
+		Address   string   `json:"address"`
+		Symbol    string   `json:"symbol"`
+		Name      string   `json:"name"`
+		Decimals  uint8    `json:"decimals"`
+		LogoURI   string   `json:"logoURI"`
+		RiskFlags []string `json:"riskFlags"`
+	} `json:"tokens"`
+}
+
+// tokenRegistry looks up tokens, reading unknown ones on the chains it has
+// RPC access to. chainID is the chain payments without one are made on.
+type tokenRegistry struct {
+	mode    string
+	chainID int64
+	chains  map[int64]chainReader
+	now     func() time.Time
+}
+
+// loadTokenList stores the curated tokens of the list at path, replacing the
+// previously curated ones
+func (r *tokenRegistry) loadTokenList(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var list tokenList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("invalid token list: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM tokens WHERE curated`); err != nil {
+		return err
+	}
+	for _, entry := range list.Tokens {
+		if !common.IsHexAddress(entry.Address) {
+			log.Printf("Skipping token list entry %s with invalid address %q", entry.Symbol, entry.Address)
+			continue
+		}
+		token := &Token{
+			ChainID:   entry.ChainID,
+			Address:   strings.ToLower(entry.Address),
+			Symbol:    entry.Symbol,
+			Name:      entry.Name,
+			Decimals:  entry.Decimals,
+			LogoURI:   entry.LogoURI,
+			RiskFlags: entry.RiskFlags,
+			Curated:   true,
+			UpdatedAt: r.now().UTC(),
+		}
+		if err := storeToken(tx, token); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Loaded %d curated tokens from %s", len(list.Tokens), path)
+	return nil
+}
+
+// lookup returns the token at address on chainID. Unknown tokens, and
+// uncurated ones read more than tokenCacheTTL ago, are read on chain when
+// the registry can reach it, and flagged unverified when it cannot.
+func (r *tokenRegistry) lookup(ctx context.Context, chainID int64, address common.Address) (*Token, error) {
+	token, err := loadToken(chainID, strings.ToLower(address.Hex()))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if token == nil && address == (common.Address{}) {
+		return r.nativeToken(chainID), nil
+	}
+	if token != nil && (token.Curated || r.now().Sub(token.UpdatedAt) < tokenCacheTTL) {
+		return token, nil
+	}
+
+	chain, ok := r.chains[chainID]
+	if !ok {
+		if token != nil {
+			return token, nil
+		}
+		token = &Token{ChainID: chainID, Address: strings.ToLower(address.Hex()), RiskFlags: []string{RiskUnlisted, RiskUnverified}}
+		return token, nil
+	}
+
+	token, err = r.readToken(ctx, chain, chainID, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := storeToken(db, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// readToken reads an uncurated token's metadata from its contract
+func (r *tokenRegistry) readToken(ctx context.Context, chain chainReader, chainID int64, address common.Address) (*Token, error) {
+	token := &Token{
+		ChainID:   chainID,
+		Address:   strings.ToLower(address.Hex()),
+		RiskFlags: []string{RiskUnlisted},
+		UpdatedAt: r.now().UTC(),
+	}
+
+	code, err := chain.CodeAt(ctx, address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token code: %w", err)
+	}
+	if len(code) == 0 {
+		token.RiskFlags = append(token.RiskFlags, RiskNoCode)
+		return token, nil
+	}
+
+	call := func(method string) ([]interface{}, error) {
+		data, err := erc20MetadataABI.Pack(method)
+		if err != nil {
+			return nil, err
+		}
+		out, err := chain.CallContract(ctx, ethereum.CallMsg{To: &address, Data: data}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return erc20MetadataABI.Unpack(method, out)
+	}
+
+	complete := true
+	if values, err := call("symbol"); err == nil {
+		token.Symbol = values[0].(string)
+	} else {
+		complete = false
+	}
+	if values, err := call("name"); err == nil {
+		token.Name = values[0].(string)
+	}
+	if values, err := call("decimals"); err == nil {
+		token.Decimals = values[0].(uint8)
+	} else {
+		complete = false
+	}
+	if !complete {
+		token.RiskFlags = append(token.RiskFlags, RiskMissingMetadata)
+	}
+	return token, nil
+}
+
+// nativeToken describes the native currency of a chain the curated list
+// does not cover. It is always allowed.
+func (r *tokenRegistry) nativeToken(chainID int64) *Token {
+	return &Token{
+		ChainID:   chainID,
+		Address:   strings.ToLower(common.Address{}.Hex()),
+		Symbol:    "ETH",
+		Name:      "Ethereum",
+		Decimals:  18,
+		RiskFlags: []string{},
+		Curated:   true,
+		Allowed:   true,
+		UpdatedAt: r.now().UTC(),
+	}
+}
+
+// check looks up the token a payment uses and applies the allowlist mode.
+// It returns errTokenNotAllowed only in enforce mode; in warn mode the
+// token is logged and returned. Lookup failures are returned in enforce
+// mode and logged otherwise.
+func (r *tokenRegistry) check(ctx context.Context, chainID int64, address string) (*Token, error) {
+	if r.mode == AllowlistOff {
+		return nil, nil
+	}
+
+	reject := func(err error) (*Token, error) {
+		if r.mode == AllowlistEnforce {
+			return nil, err
+		}
+		log.Printf("Warning: %v", err)
+		return nil, nil
+	}
+
+	if !common.IsHexAddress(address) {
+		return reject(fmt.Errorf("%w: invalid address %q", errTokenNotAllowed, address))
+	}
+	token, err := r.lookup(ctx, chainID, common.HexToAddress(address))
+	if err != nil {
+		return reject(err)
+	}
+	if !token.Allowed {
+		err := fmt.Errorf("%w: %s on chain %d is flagged %s", errTokenNotAllowed, token.Address, chainID, strings.Join(token.RiskFlags, ", "))
+		if r.mode == AllowlistEnforce {
+			return token, err
+		}
+		log.Printf("Warning: %v", err)
+	}
+	return token, nil
+}
+
+// writeTokenError answers 400 for tokens the allowlist rejects, with the
+// token when it is known, and 502 when the token could not be looked up
+func writeTokenError(w http.ResponseWriter, err error, token *Token) {
+	status, code := http.StatusBadGateway, problem.CodeUpstreamFailed
+	if errors.Is(err, errTokenNotAllowed) {
+		status, code = http.StatusBadRequest, problem.CodeTokenNotAllowed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "code": code, "token": token})
+}
+
+// list returns the stored tokens, of one chain when chainID is not 0 and
+// only allowed ones when allowedOnly is set
+func (r *tokenRegistry) list(chainID int64, allowedOnly bool) ([]*Token, error) {
+	query := `SELECT chain_id, address, symbol, name, decimals, logo_uri, risk_flags, curated, updated_at FROM tokens WHERE 1 = 1`
+	var args []interface{}
+	if chainID != 0 {
+		query += ` AND chain_id = ?`
+		args = append(args, chainID)
+	}
+	if allowedOnly {
+		query += ` AND curated`
+	}
+	query += ` ORDER BY chain_id, curated DESC, symbol`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*Token{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		if allowedOnly && !token.Allowed {
+			continue
+		}
+		result = append(result, token)
+	}
+	return result, rows.Err()
+}
+
+// tokenPricer prices token amounts in USD. lookup describes the token and
+// price returns the FTSO price of a symbol such as "ETH/USD".
+type tokenPricer struct {
+	lookup func(ctx context.Context, chainID int64, address common.Address) (*Token, error)
+	price  func(ctx context.Context, symbol string) (float64, error)
+}
+
+// valueUSD prices amount base units of the token at tokenAddress, returning
+// nil when the token has no FTSO price
+func (p *tokenPricer) valueUSD(ctx context.Context, chainID int64, tokenAddress, amount string) *float64 {
+	units, ok := new(big.Int).SetString(amount, 10)
+	if !ok || !common.IsHexAddress(tokenAddress) {
+		return nil
+	}
+	token, err := p.lookup(ctx, chainID, common.HexToAddress(tokenAddress))
+	if err != nil || token.Symbol == "" {
+		return nil
+	}
+	price, err := p.price(ctx, strings.ToUpper(token.Symbol)+"/USD")
+	if err != nil || price <= 0 {
+		log.Printf("No USD price for %s: %v", token.Symbol, err)
+		return nil
+	}
+
+	value := new(big.Float).SetInt(units)
+	value.Quo(value, new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(token.Decimals)), nil)))
+	value.Mul(value, big.NewFloat(price))
+	usd, _ := value.Float64()
+	return &usd
+}
+
+// execer is the part of *sql.DB and *sql.Tx tokens are stored with
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func storeToken(conn execer, token *Token) error {
+	if token.RiskFlags == nil {
+		token.RiskFlags = []string{}
+	}
+	token.Allowed = token.Curated && !hasFlag(token.RiskFlags, RiskBlocked)
+	_, err := conn.Exec(`INSERT OR REPLACE INTO tokens (chain_id, address, symbol, name, decimals, logo_uri, risk_flags, curated, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		token.ChainID, token.Address, token.Symbol, token.Name, token.Decimals, token.LogoURI,
+		strings.Join(token.RiskFlags, ","), token.Curated, token.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store token %s: %w", token.Address, err)
+	}
+	return nil
+}
+
+func loadToken(chainID int64, address string) (*Token, error) {
+	row := db.QueryRow(`SELECT chain_id, address, symbol, name, decimals, logo_uri, risk_flags, curated, updated_at FROM tokens WHERE chain_id = ? AND address = ?`,
+		chainID, address)
+	return scanToken(row)
+}
+
+// scanner is the part of *sql.Row and *sql.Rows tokens are read with
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanToken(row scanner) (*Token, error) {
+	token := &Token{}
+	var logoURI sql.NullString
+	var flags string
+	err := row.Scan(&token.ChainID, &token.Address, &token.Symbol, &token.Name, &token.Decimals, &logoURI, &flags, &token.Curated, &token.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	token.LogoURI = logoURI.String
+	token.RiskFlags = []string{}
+	if flags != "" {
+		token.RiskFlags = strings.Split(flags, ",")
+	}
+	token.Allowed = token.Curated && !hasFlag(token.RiskFlags, RiskBlocked)
+	return token, nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTokenList = `{
+  "name": "Test",
+  "tokens": [
+    {"chainId": 4202, "address": "0x00000000000000000000000000000000000000e1", "symbol": "USDC", "name": "USD Coin", "decimals": 6, "riskFlags": ["upgradeable"]},
+    {"chainId": 4202, "address": "0x00000000000000000000000000000000000000e2", "symbol": "BAD", "name": "Bad Token", "decimals": 18, "riskFlags": ["blocked"]},
+    {"chainId": 4202, "address": "not an address", "symbol": "NOPE", "name": "Nope", "decimals": 18}
+  ]
+}`
+
+// erc20Chain answers ERC-20 metadata calls, failing the ones not in values
+func erc20Chain(values map[string]interface{}) *fakeChain {
+	return &fakeChain{
+		code: []byte{1},
+		call: func(msg ethereum.CallMsg) ([]byte, error) {
+			method, err := erc20MetadataABI.MethodById(msg.Data[:4])
+			if err != nil {
+				return nil, err
+			}
+			value, ok := values[method.Name]
+			if !ok {
+				return nil, errors.New("execution reverted")
+			}
+			return method.Outputs.Pack(value)
+		},
+	}
+}
+
+func setupTokenTest(t *testing.T, mode string) *tokenRegistry {
+	setupTestDB(t)
+
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(path, []byte(testTokenList), 0o644))
+
+	registry := &tokenRegistry{
+		mode:    mode,
+		chainID: 4202,
+		chains:  map[int64]chainReader{},
+		now:     time.Now,
+	}
+	require.NoError(t, registry.loadTokenList(path))
+	return registry
+}
+
+func TestTokenLookup(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should return curated tokens with their flags", func(t *testing.T) {
+		registry := setupTokenTest(t, AllowlistWarn)
+
+		token, err := registry.lookup(ctx, 4202, common.HexToAddress("0x00000000000000000000000000000000000000E1"))
+		require.NoError(t, err)
+		assert.Equal(t, "USDC", token.Symbol)
+		assert.Equal(t, uint8(6), token.Decimals)
+		assert.Equal(t, []string{"upgradeable"}, token.RiskFlags)
+		assert.True(t, token.Curated)
+		assert.True(t, token.Allowed)
+	})
+
+	t.Run("should not allow blocked tokens", func(t *testing.T) {
+		registry := setupTokenTest(t, AllowlistWarn)
+
+		token, err := registry.lookup(ctx, 4202, common.HexToAddress("0x00000000000000000000000000000000000000e2"))
+		require.NoError(t, err)
+		assert.True(t, token.Curated)
+		assert.False(t, token.Allowed)
+	})
+
+	t.Run("should read unknown tokens on chain and cache them", func(t *testing.T) {
+		registry := setupTokenTest(t, AllowlistWarn)
+		chain := erc20Chain(map[string]interface{}{"symbol": "MEME", "name": "Meme", "decimals": uint8(9)})
+		registry.chains[4202] = chain
+
+		address := common.HexToAddress("0x00000000000000000000000000000000000000e3")
+		token, err := registry.lookup(ctx, 4202, address)
+		require.NoError(t, err)
+		assert.Equal(t, "MEME", token.Symbol)
+		assert.Equal(t, uint8(9), token.Decimals)
+		assert.Equal(t, []string{RiskUnlisted}, token.RiskFlags)
+		assert.False(t, token.Allowed)
+
+		chain.call = func(msg ethereum.CallMsg) ([]byte, error) {
+			return nil, errors.New("should be cached")
+		}
+		cached, err := registry.lookup(ctx, 4202, address)
+		require.NoError(t, err)
+		assert.Equal(t, "MEME", cached.Symbol)
+	})
+
+	t.Run("should flag tokens without code or metadata", func(t *testing.T) {
+		registry := setupTokenTest(t, AllowlistWarn)
+		registry.chains[4202] = &fakeChain{}
+
+		token, err := registry.lookup(ctx, 4202, common.HexToAddress("0x00000000000000000000000000000000000000e4"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{RiskUnlisted, RiskNoCode}, token.RiskFlags)
+
+		registry.chains[4202] = erc20Chain(map[string]interface{}{"name": "Nameless"})
+		token, err = registry.lookup(ctx, 4202, common.HexToAddress("0x00000000000000000000000000000000000000e5"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{RiskUnlisted, RiskMissingMetadata}, token.RiskFlags)
+	})
+
+	t.Run("should flag tokens on unreachable chains as unverified", func(t *testing.T) {
+		registry := setupTokenTest(t, AllowlistWarn)
+
+		token, err := registry.lookup(ctx, 84532, common.HexToAddress("0x00000000000000000000000000000000000000e6"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{RiskUnlisted, RiskUnverified}, token.RiskFlags)
+	})
+
+	t.Run("should fall back to the native currency", func(t *testing.T) {
+		registry := setupTokenTest(t, AllowlistWarn)
+
+		token, err := registry.lookup(ctx, 4202, common.Address{})
+		require.NoError(t, err)
+		assert.Equal(t, "ETH", token.Symbol)
+		assert.True(t, token.Allowed)
+	})
+}
+
+func TestTokenCheck(t *testing.T) {
+	ctx := context.Background()
+	unlisted := "0x00000000000000000000000000000000000000e7"
+
+	t.Run("should reject tokens that are not allowed in enforce mode", func(t *testing.T) {
+		registry := setupTokenTest(t, AllowlistEnforce)
+
+		token, err := registry.check(ctx, 4202, unlisted)
+		assert.ErrorIs(t, err, errTokenNotAllowed)
+		require.NotNil(t, token)
+		assert.Contains(t, token.RiskFlags, RiskUnlisted)
+
+		_, err = registry.check(ctx, 4202, "0x1234")
+		assert.ErrorIs(t, err, errTokenNotAllowed)
+
+		_, err = registry.check(ctx, 4202, "0x00000000000000000000000000000000000000e1")
+		assert.NoError(t, err)
+	})
+
+	t.Run("should let tokens that are not allowed through in warn mode", func(t *testing.T) {
+		registry := setupTokenTest(t, AllowlistWarn)
+
+		token, err := registry.check(ctx, 4202, unlisted)
+		require.NoError(t, err)
+		assert.False(t, token.Allowed)
+	})
+
+	t.Run("should not look up tokens when off", func(t *testing.T) {
+		registry := setupTokenTest(t, AllowlistOff)
+
+		token, err := registry.check(ctx, 4202, "0x1234")
+		assert.NoError(t, err)
+		assert.Nil(t, token)
+	})
+}
+
+func TestTokenList(t *testing.T) {
+	t.Run("should list allowed tokens only when asked", func(t *testing.T) {
+		registry := setupTokenTest(t, AllowlistWarn)
+
+		all, err := registry.list(4202, false)
+		require.NoError(t, err)
+		assert.Len(t, all, 2)
+
+		allowed, err := registry.list(4202, true)
+		require.NoError(t, err)
+		require.Len(t, allowed, 1)
+		assert.Equal(t, "USDC", allowed[0].Symbol)
+
+		other, err := registry.list(84532, false)
+		require.NoError(t, err)
+		assert.Empty(t, other)
+	})
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The travel rule (FATF Recommendation 16) requires the originator and
+// beneficiary of transfers at or above a fiat threshold to be identified and
+// that information to travel with the transfer. Payments priced at or above
+// the threshold carry IVMS101 originator and beneficiary data, which is
+// checked before the payment is created and sent to the beneficiary's VASP
+// once it is. The counterparty's receipt is stored with its hash alongside
+// the payment. Counterparties send
+// their own transfers to the inbound endpoint and get a receipt back.
+
+// Travel rule transfer statuses. Transfers to self-hosted wallets have no
+// counterparty VASP and are only recorded.
+const (
+	TravelRuleSent     = "sent"
+	TravelRuleUnhosted = "unhosted"
+	TravelRuleReceived = "received"
+	TravelRuleFailed   = "failed"
+)
+
+// Travel rule transfer directions
+const (
+	TravelRuleOutbound = "outbound"
+	TravelRuleInbound  = "inbound"
+)
+
+// maxTravelRuleBody bounds the payloads and receipts read from counterparties
+const maxTravelRuleBody = 1 << 20
+
+var (
+	errTravelRuleRequired       = errors.New("travel rule information required")
+	errUnknownVASP              = errors.New("unknown beneficiary VASP")
+	errTravelRuleNotFound       = errors.New("no travel rule transfer for payment")
+	errTravelRuleUnauthorized   = errors.New("unknown counterparty VASP")
+	errTravelRuleTransmission   = errors.New("failed to transmit travel rule information")
+	errInvalidTravelRulePerson  = errors.New("invalid IVMS101 person")
+	errInvalidTravelRuleMessage = errors.New("invalid travel rule message")
+)
+
+// travelRule is the travel rule service payments are checked against. It is
+// disabled when this VASP's identity is not configured.
+var travelRule *travelRuleService
+
+// IVMS101 is the interVASP messaging standard payload identifying a
+// transfer's originator and beneficiary
+type IVMS101 struct {
+	Originator      IVMSOriginator       `json:"originator"`
+	Beneficiary     IVMSBeneficiary      `json:"beneficiary"`
+	OriginatingVASP *IVMSOriginatingVASP `json:"originatingVASP,omitempty"`
+	BeneficiaryVASP *IVMSBeneficiaryVASP `json:"beneficiaryVASP,omitempty"`
+}
+
+type IVMSOriginator struct {
+	OriginatorPersons []IVMSPerson `json:"originatorPersons"`
+	AccountNumber     []string     `json:"accountNumber,omitempty"`
+}
+
+type IVMSBeneficiary struct {
+	BeneficiaryPersons []IVMSPerson `json:"beneficiaryPersons"`
+	AccountNumber      []string     `json:"accountNumber,omitempty"`
+}
+
+type IVMSOriginatingVASP struct {
+	OriginatingVASP IVMSPerson `json:"originatingVASP"`
+}
+
+type IVMSBeneficiaryVASP struct {
+	BeneficiaryVASP IVMSPerson `json:"beneficiaryVASP"`
+}
+
+// IVMSPerson is either a natural or a legal person
+type IVMSPerson struct {
+	NaturalPerson *IVMSNaturalPerson `json:"naturalPerson,omitempty"`
+	LegalPerson   *IVMSLegalPerson   `json:"legalPerson,omitempty"`
+}
+
+type IVMSNaturalPerson struct {
+	Name                   IVMSNaturalPersonName       `json:"name"`
+	GeographicAddress      []IVMSAddress               `json:"geographicAddress,omitempty"`
+	NationalIdentification *IVMSNationalIdentification `json:"nationalIdentification,omitempty"`
+	CustomerIdentification string                      `json:"customerIdentification,omitempty"`
+	DateAndPlaceOfBirth    *IVMSDateAndPlaceOfBirth    `json:"dateAndPlaceOfBirth,omitempty"`
+	CountryOfResidence     string                      `json:"countryOfResidence,omitempty"`
+}
+
+type IVMSNaturalPersonName struct {
+	NameIdentifier []IVMSNaturalPersonNameID `json:"nameIdentifier"`
+}
+
+// IVMSNaturalPersonNameID is a name of a natural person. The primary
+// identifier is the family name; LEGL marks the legal name.
+type IVMSNaturalPersonNameID struct {
+	PrimaryIdentifier   string `json:"primaryIdentifier"`
+	SecondaryIdentifier string `json:"secondaryIdentifier,omitempty"`
+	NameIdentifierType  string `json:"nameIdentifierType"`
+}
+
+type IVMSLegalPerson struct {
+	Name                   IVMSLegalPersonName         `json:"name"`
+	GeographicAddress      []IVMSAddress               `json:"geographicAddress,omitempty"`
+	CustomerNumber         string                      `json:"customerNumber,omitempty"`
+	NationalIdentification *IVMSNationalIdentification `json:"nationalIdentification,omitempty"`
+	CountryOfRegistration  string                      `json:"countryOfRegistration,omitempty"`
+}
+
+type IVMSLegalPersonName struct {
+	NameIdentifier []IVMSLegalPersonNameID `json:"nameIdentifier"`
+}
+
+type IVMSLegalPersonNameID struct {
+	LegalPersonName               string `json:"legalPersonName"`
+	LegalPersonNameIdentifierType string `json:"legalPersonNameIdentifierType"`
+}
+
+type IVMSAddress struct {
+	AddressType    string   `json:"addressType"`
+	StreetName     string   `json:"streetName,omitempty"`
+	BuildingNumber string   `json:"buildingNumber,omitempty"`
+	PostCode       string   `json:"postCode,omitempty"`
+	TownName       string   `json:"townName,omitempty"`
+	AddressLine    []string `json:"addressLine,omitempty"`
+	Country        string   `json:"country"`
+}
+
+// IVMSNationalIdentification is an identity document or registration, such
+// as a passport (CCPT) or an LEI (LEIX)
+type IVMSNationalIdentification struct {
+	NationalIdentifier     string `json:"nationalIdentifier"`
+	NationalIdentifierType string `json:"nationalIdentifierType"`
+	CountryOfIssue         string `json:"countryOfIssue,omitempty"`
+	RegistrationAuthority  string `json:"registrationAuthority,omitempty"`
+}
+
+type IVMSDateAndPlaceOfBirth struct {
+	DateOfBirth  string `json:"dateOfBirth"`
+	PlaceOfBirth string `json:"placeOfBirth"`
+}
+
+// validate checks that the person is named, defaulting name identifier
+// types to LEGL. Originators must also be identifiable by an address, an
+// identity document, a customer number or their date and place of birth.
+func (p *IVMSPerson) validate(originator bool) error {
+	switch {
+	case p.NaturalPerson != nil && p.LegalPerson == nil:
+		person := p.NaturalPerson
+		if len(person.Name.NameIdentifier) == 0 {
+			return fmt.Errorf("%w: natural person has no name", errInvalidTravelRulePerson)
+		}
+		for i := range person.Name.NameIdentifier {
+			name := &person.Name.NameIdentifier[i]
+			if strings.TrimSpace(name.PrimaryIdentifier) == "" {
+				return fmt.Errorf("%w: natural person has an empty name", errInvalidTravelRulePerson)
+			}
+			if name.NameIdentifierType == "" {
+				name.NameIdentifierType = "LEGL"
+			}
+		}
+		if originator && len(person.GeographicAddress) == 0 && person.NationalIdentification == nil &&
+			person.CustomerIdentification == "" && person.DateAndPlaceOfBirth == nil {
+			return fmt.Errorf("%w: originator needs an address, identification, customer id or date and place of birth", errInvalidTravelRulePerson)
+		}
+	case p.LegalPerson != nil && p.NaturalPerson == nil:
+		person := p.LegalPerson
+		if len(person.Name.NameIdentifier) == 0 {
+			return fmt.Errorf("%w: legal person has no name", errInvalidTravelRulePerson)
+		}
+		for i := range person.Name.NameIdentifier {
+			name := &person.Name.NameIdentifier[i]
+			if strings.TrimSpace(name.LegalPersonName) == "" {
+				return fmt.Errorf("%w: legal person has an empty name", errInvalidTravelRulePerson)
+			}
+			if name.LegalPersonNameIdentifierType == "" {
+				name.LegalPersonNameIdentifierType = "LEGL"
+			}
+		}
+		if originator && len(person.GeographicAddress) == 0 && person.NationalIdentification == nil && person.CustomerNumber == "" {
+			return fmt.Errorf("%w: originator needs an address, identification or customer number", errInvalidTravelRulePerson)
+		}
+	default:
+		return fmt.Errorf("%w: exactly one of naturalPerson and legalPerson is required", errInvalidTravelRulePerson)
+	}
+	return nil
+}
+
+// TravelRuleInfo is the travel rule data a payment request carries.
+// BeneficiaryVASP is the id of the beneficiary's VASP in the directory, and
+// is empty when the beneficiary uses a self-hosted wallet.
+type TravelRuleInfo struct {
+	Originator      IVMSPerson `json:"originator"`
+	Beneficiary     IVMSPerson `json:"beneficiary"`
+	BeneficiaryVASP string     `json:"beneficiary_vasp"`
+}
+
+// travelRuleCheck is the travel rule information of a payment checked before
+// the payment is created, to be sent once it is
+type travelRuleCheck struct {
+	chainID      int64
+	tokenAddress string
+	amount       string
+	value        *float64
+	info         *TravelRuleInfo
+	counterparty *TravelRuleVASP
+}
+
+// TravelRuleMessage is what is sent to the beneficiary's VASP
+type TravelRuleMessage struct {
+	PaymentID          string    `json:"payment_id"`
+	OriginatingVASP    string    `json:"originating_vasp"`
+	ChainID            int64     `json:"chain_id"`
+	Asset              string    `json:"asset"`
+	Amount             string    `json:"amount"`
+	ValueUSD           *float64  `json:"value_usd,omitempty"`
+	OriginatorAddress  string    `json:"originator_address"`
+	BeneficiaryAddress string    `json:"beneficiary_address"`
+	IVMS101            IVMS101   `json:"ivms101"`
+	SentAt             time.Time `json:"sent_at"`
+}
+
+// TravelRuleReceipt acknowledges an inbound travel rule message
+type TravelRuleReceipt struct {
+	PaymentID       string    `json:"payment_id"`
+	BeneficiaryVASP string    `json:"beneficiary_vasp"`
+	PayloadHash     string    `json:"payload_hash"`
+	Status          string    `json:"status"`
+	ReceivedAt      time.Time `json:"received_at"`
+}
+
+// TravelRuleTransfer records a travel rule exchange for a payment. Hashes
+// are SHA-256 of the payload and receipt exactly as sent and received.
+// Payloads hold personal data and are kept for record keeping only.
+type TravelRuleTransfer struct {
+	PaymentID        string          `json:"payment_id"`
+	Direction        string          `json:"direction"`
+	CounterpartyVASP string          `json:"counterparty_vasp,omitempty"`
+	ValueUSD         *float64        `json:"value_usd"`
+	Status           string          `json:"status"`
+	PayloadHash      string          `json:"payload_hash"`
+	ReceiptHash      string          `json:"receipt_hash,omitempty"`
+	Payload          json.RawMessage `json:"-"`
+	Receipt          json.RawMessage `json:"-"`
+	CreatedAt        time.Time       `json:"created_at"`
+}
+
+// TravelRuleVASP is a counterparty VASP in the directory. Transfers are
+// sent to Endpoint with APIKey as bearer token, and the VASP authenticates
+// its own transfers with InboundToken.
+type TravelRuleVASP struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	LEI          string `json:"lei,omitempty"`
+	Country      string `json:"country,omitempty"`
+	Endpoint     string `json:"endpoint"`
+	APIKey       string `json:"api_key,omitempty"`
+	InboundToken string `json:"inbound_token,omitempty"`
+}
+
+// person describes the VASP as an IVMS101 legal person
+func (v *TravelRuleVASP) person() IVMSPerson {
+	person := &IVMSLegalPerson{
+		Name:                  IVMSLegalPersonName{NameIdentifier: []IVMSLegalPersonNameID{{LegalPersonName: v.Name, LegalPersonNameIdentifierType: "LEGL"}}},
+		CountryOfRegistration: v.Country,
+	}
+	if v.LEI != "" {
+		person.NationalIdentification = &IVMSNationalIdentification{NationalIdentifier: v.LEI, NationalIdentifierType: "LEIX"}
+	}
+	return IVMSPerson{LegalPerson: person}
+}
+
+// travelRuleService applies the travel rule to payments. vasp is this VASP
+// and directory the counterparties by id.
+type travelRuleService struct {
+	thresholdUSD float64
+	vasp         *TravelRuleVASP
+	directory    map[string]*TravelRuleVASP
+	pricer       *tokenPricer
+	client       *http.Client
+	now          func() time.Time
+}
+
+// loadTravelRuleDirectory reads the counterparty VASPs from a JSON array
+func loadTravelRuleDirectory(path string) (map[string]*TravelRuleVASP, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var vasps []*TravelRuleVASP
+	if err := json.Unmarshal(data, &vasps); err != nil {
+		return nil, fmt.Errorf("invalid VASP directory: %w", err)
+	}
+	directory := make(map[string]*TravelRuleVASP, len(vasps))
+	for _, vasp := range vasps {
+		if vasp.ID == "" || vasp.Name == "" || !strings.HasPrefix(vasp.Endpoint, "https://") {
+			return nil, fmt.Errorf("VASP %q needs an id, a name and an https endpoint", vasp.ID)
+		}
+		directory[vasp.ID] = vasp
+	}
+	return directory, nil
+}
+
+// enabled reports whether the travel rule is applied
+func (s *travelRuleService) enabled() bool {
+	return s != nil && s.vasp != nil
+}
+
+// required prices a payment and reports whether it reaches the threshold.
+// Payments that cannot be priced are treated as reaching it.
+func (s *travelRuleService) required(ctx context.Context, chainID int64, tokenAddress, amount string) (bool, *float64) {
+	if !s.enabled() {
+		return false, nil
+	}
+	value := s.pricer.valueUSD(ctx, chainID, tokenAddress, amount)
+	return value == nil || *value >= s.thresholdUSD, value
+}
+
+// check applies the travel rule to a payment before it is created. Below
+// the threshold it returns nil. Above it, info is required and must name
+// identifiable persons and a known beneficiary VASP, if any.
+func (s *travelRuleService) check(ctx context.Context, chainID int64, tokenAddress, amount string, info *TravelRuleInfo) (*travelRuleCheck, error) {
+	required, value := s.required(ctx, chainID, tokenAddress, amount)
+	if !required {
+		return nil, nil
+	}
+	if info == nil {
+		return nil, errTravelRuleRequired
+	}
+	if err := info.Originator.validate(true); err != nil {
+		return nil, err
+	}
+	if err := info.Beneficiary.validate(false); err != nil {
+		return nil, err
+	}
+	check := &travelRuleCheck{chainID: chainID, tokenAddress: tokenAddress, amount: amount, value: value, info: info}
+	if info.BeneficiaryVASP != "" {
+		vasp, ok := s.directory[info.BeneficiaryVASP]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errUnknownVASP, info.BeneficiaryVASP)
+		}
+		check.counterparty = vasp
+	}
+	return check, nil
+}
+
+// send sends the checked information of a created payment to the
+// beneficiary's VASP, or only records it for self-hosted wallets, and
+// stores the transfer. A nil check sends nothing. When the counterparty
+// cannot be reached the transfer is stored as failed and returned with the
+// error, as the payment exists by then.
+func (s *travelRuleService) send(ctx context.Context, check *travelRuleCheck, paymentID, sender, recipient string) (*TravelRuleTransfer, error) {
+	if check == nil {
+		return nil, nil
+	}
+	info, counterparty := check.info, check.counterparty
+
+	message := &TravelRuleMessage{
+		PaymentID:          paymentID,
+		OriginatingVASP:    s.vasp.ID,
+		ChainID:            check.chainID,
+		Asset:              strings.ToLower(check.tokenAddress),
+		Amount:             check.amount,
+		ValueUSD:           check.value,
+		OriginatorAddress:  strings.ToLower(sender),
+		BeneficiaryAddress: strings.ToLower(recipient),
+		IVMS101: IVMS101{
+			Originator:      IVMSOriginator{OriginatorPersons: []IVMSPerson{info.Originator}},
+			Beneficiary:     IVMSBeneficiary{BeneficiaryPersons: []IVMSPerson{info.Beneficiary}},
+			OriginatingVASP: &IVMSOriginatingVASP{OriginatingVASP: s.vasp.person()},
+		},
+		SentAt: s.now().UTC(),
+	}
+	if sender != "" {
+		message.IVMS101.Originator.AccountNumber = []string{message.OriginatorAddress}
+	}
+	if recipient != "" {
+		message.IVMS101.Beneficiary.AccountNumber = []string{message.BeneficiaryAddress}
+	}
+	if counterparty != nil {
+		message.IVMS101.BeneficiaryVASP = &IVMSBeneficiaryVASP{BeneficiaryVASP: counterparty.person()}
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer := &TravelRuleTransfer{
+		PaymentID:   paymentID,
+		Direction:   TravelRuleOutbound,
+		ValueUSD:    check.value,
+		Status:      TravelRuleUnhosted,
+		PayloadHash: sha256Hex(payload),
+		Payload:     payload,
+		CreatedAt:   message.SentAt,
+	}
+	if counterparty != nil {
+		transfer.CounterpartyVASP = counterparty.ID
+		receipt, err := s.transmit(ctx, counterparty, payload)
+		if err != nil {
+			transfer.Status = TravelRuleFailed
+			if storeErr := storeTravelRuleTransfer(transfer); storeErr != nil {
+				log.Printf("Warning: %v", storeErr)
+			}
+			return transfer, err
+		}
+		transfer.Status = TravelRuleSent
+		transfer.Receipt = receipt
+		transfer.ReceiptHash = sha256Hex(receipt)
+	}
+	if err := storeTravelRuleTransfer(transfer); err != nil {
+		return nil, err
+	}
+	log.Printf("Travel rule %s for payment %s (%s)", transfer.Status, paymentID, transfer.CounterpartyVASP)
+	return transfer, nil
+}
+
+// transmit posts payload to the counterparty's endpoint and returns its
+// receipt
+func (s *travelRuleService) transmit(ctx context.Context, vasp *TravelRuleVASP, payload []byte) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, vasp.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Payload-Hash", sha256Hex(payload))
+	if vasp.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+vasp.APIKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w to %s: %v", errTravelRuleTransmission, vasp.ID, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTravelRuleBody))
+	if err != nil {
+		return nil, fmt.Errorf("%w to %s: %v", errTravelRuleTransmission, vasp.ID, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%w to %s: status %d", errTravelRuleTransmission, vasp.ID, resp.StatusCode)
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("%w to %s: receipt is not JSON", errTravelRuleTransmission, vasp.ID)
+	}
+	return body, nil
+}
+
+// receive stores a counterparty's transfer and returns the receipt sent back
+// to it. token is the bearer token the counterparty authenticated with.
+func (s *travelRuleService) receive(token string, payload []byte) (*TravelRuleReceipt, error) {
+	counterparty := s.counterparty(token)
+	if counterparty == nil {
+		return nil, errTravelRuleUnauthorized
+	}
+
+	var message TravelRuleMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidTravelRuleMessage, err)
+	}
+	if message.PaymentID == "" {
+		return nil, fmt.Errorf("%w: missing payment_id", errInvalidTravelRuleMessage)
+	}
+	if len(message.IVMS101.Originator.OriginatorPersons) == 0 || len(message.IVMS101.Beneficiary.BeneficiaryPersons) == 0 {
+		return nil, fmt.Errorf("%w: originator and beneficiary are required", errInvalidTravelRulePerson)
+	}
+	for i := range message.IVMS101.Originator.OriginatorPersons {
+		if err := message.IVMS101.Originator.OriginatorPersons[i].validate(true); err != nil {
+			return nil, err
+		}
+	}
+	for i := range message.IVMS101.Beneficiary.BeneficiaryPersons {
+		if err := message.IVMS101.Beneficiary.BeneficiaryPersons[i].validate(false); err != nil {
+			return nil, err
+		}
+	}
+
+	receipt := &TravelRuleReceipt{
+		PaymentID:       message.PaymentID,
+		BeneficiaryVASP: s.vasp.ID,
+		PayloadHash:     sha256Hex(payload),
+		Status:          TravelRuleReceived,
+		ReceivedAt:      s.now().UTC(),
+	}
+	encoded, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+	transfer := &TravelRuleTransfer{
+		PaymentID:        message.PaymentID,
+		Direction:        TravelRuleInbound,
+		CounterpartyVASP: counterparty.ID,
+		ValueUSD:         message.ValueUSD,
+		Status:           TravelRuleReceived,
+		PayloadHash:      receipt.PayloadHash,
+		ReceiptHash:      sha256Hex(encoded),
+		Payload:          payload,
+		Receipt:          encoded,
+		CreatedAt:        receipt.ReceivedAt,
+	}
+	if err := storeTravelRuleTransfer(transfer); err != nil {
+		return nil, err
+	}
+	log.Printf("Travel rule received for payment %s from %s", message.PaymentID, counterparty.ID)
+	return receipt, nil
+}
+
+// counterparty returns the VASP whose inbound token is token
+func (s *travelRuleService) counterparty(token string) *TravelRuleVASP {
+	if token == "" {
+		return nil
+	}
+	for _, vasp := range s.directory {
+		if vasp.InboundToken != "" && subtle.ConstantTimeCompare([]byte(vasp.InboundToken), []byte(token)) == 1 {
+			return vasp
+		}
+	}
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func storeTravelRuleTransfer(t *TravelRuleTransfer) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO travel_rule_transfers (payment_id, direction, counterparty_vasp, value_usd, status, payload, payload_hash, receipt, receipt_hash, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.PaymentID, t.Direction, t.CounterpartyVASP, t.ValueUSD, t.Status, string(t.Payload), t.PayloadHash, string(t.Receipt), t.ReceiptHash, t.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store travel rule transfer of payment %s: %w", t.PaymentID, err)
+	}
+	return nil
+}
+
+// getTravelRuleTransfers returns the travel rule transfers of a payment
+func getTravelRuleTransfers(paymentID string) ([]*TravelRuleTransfer, error) {
+	rows, err := db.Query(`SELECT payment_id, direction, counterparty_vasp, value_usd, status, payload, payload_hash, receipt, receipt_hash, created_at FROM travel_rule_transfers WHERE payment_id = ? ORDER BY created_at`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []*TravelRuleTransfer
+	for rows.Next() {
+		t := &TravelRuleTransfer{}
+		var value sql.NullFloat64
+		var payload, receipt string
+		err := rows.Scan(&t.PaymentID, &t.Direction, &t.CounterpartyVASP, &value, &t.Status, &payload, &t.PayloadHash, &receipt, &t.ReceiptHash, &t.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			t.ValueUSD = &value.Float64
+		}
+		t.Payload = json.RawMessage(payload)
+		if receipt != "" {
+			t.Receipt = json.RawMessage(receipt)
+		}
+		transfers = append(transfers, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(transfers) == 0 {
+		return nil, fmt.Errorf("%w %s", errTravelRuleNotFound, paymentID)
+	}
+	return transfers, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const travelRuleRecipient = "0x00000000000000000000000000000000000000b2"
+
+func setupTravelRuleTest(t *testing.T, endpoint string) *travelRuleService {
+	setupTestDB(t)
+
+	return &travelRuleService{
+		thresholdUSD: 1000,
+		vasp:         &TravelRuleVASP{ID: "crosspay", Name: "CrossPay Ltd", LEI: "5493001KJTIIGC8Y1R12"},
+		directory: map[string]*TravelRuleVASP{
+			"acme": {ID: "acme", Name: "Acme Exchange", Endpoint: endpoint, APIKey: "outbound-key", InboundToken: "inbound-token"},
+		},
+		pricer: usdcPricer(),
+		client: http.DefaultClient,
+		now:    time.Now,
+	}
+}
+
+// travelRuleInfo returns the information of a transfer from Alice to Bob
+func travelRuleInfo(vasp string) *TravelRuleInfo {
+	return &TravelRuleInfo{
+		Originator: IVMSPerson{NaturalPerson: &IVMSNaturalPerson{
+			Name:                   IVMSNaturalPersonName{NameIdentifier: []IVMSNaturalPersonNameID{{PrimaryIdentifier: "Smith", SecondaryIdentifier: "Alice"}}},
+			CustomerIdentification: "customer-1",
+		}},
+		Beneficiary: IVMSPerson{NaturalPerson: &IVMSNaturalPerson{
+			Name: IVMSNaturalPersonName{NameIdentifier: []IVMSNaturalPersonNameID{{PrimaryIdentifier: "Jones", SecondaryIdentifier: "Bob"}}},
+		}},
+		BeneficiaryVASP: vasp,
+	}
+}
+
+func TestTravelRuleCheck(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should skip payments below the threshold", func(t *testing.T) {
+		service := setupTravelRuleTest(t, "")
+
+		check, err := service.check(ctx, 4202, kycUSDC, usdc(999), nil)
+		require.NoError(t, err)
+		assert.Nil(t, check)
+		transfer, err := service.send(ctx, check, "1", kycSender, travelRuleRecipient)
+		require.NoError(t, err)
+		assert.Nil(t, transfer)
+	})
+
+	t.Run("should require information at the threshold and for unpriced tokens", func(t *testing.T) {
+		service := setupTravelRuleTest(t, "")
+
+		_, err := service.check(ctx, 4202, kycUSDC, usdc(1000), nil)
+		assert.ErrorIs(t, err, errTravelRuleRequired)
+		_, err = service.check(ctx, 4202, "0x00000000000000000000000000000000000000e9", "1", nil)
+		assert.ErrorIs(t, err, errTravelRuleRequired)
+	})
+
+	t.Run("should require originators to be identifiable", func(t *testing.T) {
+		service := setupTravelRuleTest(t, "")
+
+		info := travelRuleInfo("")
+		info.Originator.NaturalPerson.CustomerIdentification = ""
+		_, err := service.check(ctx, 4202, kycUSDC, usdc(5000), info)
+		assert.ErrorIs(t, err, errInvalidTravelRulePerson)
+
+		_, err = service.check(ctx, 4202, kycUSDC, usdc(5000), travelRuleInfo("unknown"))
+		assert.ErrorIs(t, err, errUnknownVASP)
+	})
+}
+
+func TestTravelRuleSend(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should send IVMS101 payloads and store the receipt hash", func(t *testing.T) {
+		var received TravelRuleMessage
+		receipt := []byte(`{"status":"accepted","reference":"acme-42"}`)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer outbound-key", r.Header.Get("Authorization"))
+			body, _ := io.ReadAll(r.Body)
+			assert.Equal(t, sha256Hex(body), r.Header.Get("X-Payload-Hash"))
+			assert.NoError(t, json.Unmarshal(body, &received))
+			w.Write(receipt)
+		}))
+		defer server.Close()
+		service := setupTravelRuleTest(t, server.URL)
+
+		check, err := service.check(ctx, 4202, kycUSDC, usdc(5000), travelRuleInfo("acme"))
+		require.NoError(t, err)
+		transfer, err := service.send(ctx, check, "42", kycSender, travelRuleRecipient)
+		require.NoError(t, err)
+		assert.Equal(t, TravelRuleSent, transfer.Status)
+		assert.Equal(t, sha256Hex(receipt), transfer.ReceiptHash)
+
+		assert.Equal(t, "42", received.PaymentID)
+		assert.Equal(t, 5000.0, *received.ValueUSD)
+		originator := received.IVMS101.Originator
+		assert.Equal(t, "LEGL", originator.OriginatorPersons[0].NaturalPerson.Name.NameIdentifier[0].NameIdentifierType)
+		assert.Equal(t, []string{"0x00000000000000000000000000000000000000a1"}, originator.AccountNumber)
+		assert.Equal(t, "5493001KJTIIGC8Y1R12", received.IVMS101.OriginatingVASP.OriginatingVASP.LegalPerson.NationalIdentification.NationalIdentifier)
+		assert.Equal(t, "Acme Exchange", received.IVMS101.BeneficiaryVASP.BeneficiaryVASP.LegalPerson.Name.NameIdentifier[0].LegalPersonName)
+
+		transfers, err := getTravelRuleTransfers("42")
+		require.NoError(t, err)
+		require.Len(t, transfers, 1)
+		assert.Equal(t, "acme", transfers[0].CounterpartyVASP)
+		assert.Equal(t, transfer.PayloadHash, transfers[0].PayloadHash)
+		assert.JSONEq(t, string(receipt), string(transfers[0].Receipt))
+	})
+
+	t.Run("should record the failure when the counterparty rejects the payload", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}))
+		defer server.Close()
+		service := setupTravelRuleTest(t, server.URL)
+
+		check, err := service.check(ctx, 4202, kycUSDC, usdc(5000), travelRuleInfo("acme"))
+		require.NoError(t, err)
+		transfer, err := service.send(ctx, check, "43", kycSender, travelRuleRecipient)
+		assert.ErrorIs(t, err, errTravelRuleTransmission)
+		assert.Equal(t, TravelRuleFailed, transfer.Status)
+		transfers, err := getTravelRuleTransfers("43")
+		require.NoError(t, err)
+		require.Len(t, transfers, 1)
+		assert.Equal(t, TravelRuleFailed, transfers[0].Status)
+		assert.Empty(t, transfers[0].ReceiptHash)
+	})
+
+	t.Run("should record transfers to self-hosted wallets", func(t *testing.T) {
+		service := setupTravelRuleTest(t, "")
+
+		check, err := service.check(ctx, 4202, kycUSDC, usdc(5000), travelRuleInfo(""))
+		require.NoError(t, err)
+		transfer, err := service.send(ctx, check, "44", kycSender, travelRuleRecipient)
+		require.NoError(t, err)
+		assert.Equal(t, TravelRuleUnhosted, transfer.Status)
+		assert.Empty(t, transfer.ReceiptHash)
+	})
+}
+
+func TestTravelRuleReceive(t *testing.T) {
+	info := travelRuleInfo("crosspay")
+	payload, err := json.Marshal(TravelRuleMessage{
+		PaymentID: "acme-7",
+		IVMS101: IVMS101{
+			Originator:  IVMSOriginator{OriginatorPersons: []IVMSPerson{info.Originator}},
+			Beneficiary: IVMSBeneficiary{BeneficiaryPersons: []IVMSPerson{info.Beneficiary}},
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("should store inbound payloads and return a receipt", func(t *testing.T) {
+		service := setupTravelRuleTest(t, "")
+
+		receipt, err := service.receive("inbound-token", payload)
+		require.NoError(t, err)
+		assert.Equal(t, "crosspay", receipt.BeneficiaryVASP)
+		assert.Equal(t, sha256Hex(payload), receipt.PayloadHash)
+
+		transfers, err := getTravelRuleTransfers("acme-7")
+		require.NoError(t, err)
+		assert.Equal(t, TravelRuleInbound, transfers[0].Direction)
+		assert.Equal(t, "acme", transfers[0].CounterpartyVASP)
+		assert.Equal(t, sha256Hex(transfers[0].Receipt), transfers[0].ReceiptHash)
+	})
+
+	t.Run("should reject unknown counterparties", func(t *testing.T) {
+		service := setupTravelRuleTest(t, "")
+
+		_, err := service.receive("outbound-key", payload)
+		assert.ErrorIs(t, err, errTravelRuleUnauthorized)
+		_, err = service.receive("", payload)
+		assert.ErrorIs(t, err, errTravelRuleUnauthorized)
+	})
+}
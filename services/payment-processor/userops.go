@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Sponsored payments use ERC-4337 account abstraction. The processor builds a
+// UserOperation that calls PaymentCore.createPayment from the user's smart
+// account, has the paymaster sponsor its gas when the user qualifies, and
+// returns it with its hash for the wallet to sign. The signed operation is
+// sent to the bundler and tracked until it is included.
+
+// defaultEntryPoint is the canonical EntryPoint v0.7 deployment
+const defaultEntryPoint = "0x0000000071727De22E5E9d8BAf0edAc6f37da032"
+
+// paymentFeeBasisPoints mirrors PaymentCore.FEE_BASIS_POINTS. The fee is paid
+// on top of the amount.
+const paymentFeeBasisPoints = 10
+
+// dummySignature is a well formed ECDSA signature the account's validation
+// accepts during gas estimation, before the user has signed
+const dummySignature = "0xfffffffffffffffffffffffffffffff0000000000000000000000000000000007aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa1c"
+
+var (
+	accountABI = mustParseABI(`[
+		{"type":"function","name":"execute","inputs":[{"name":"dest","type":"address"},{"name":"value","type":"uint256"},{"name":"func","type":"bytes"}]},
+		{"type":"function","name":"executeBatch","inputs":[{"name":"dest","type":"address[]"},{"name":"value","type":"uint256[]"},{"name":"func","type":"bytes[]"}]}
+	]`)
+	paymentCoreABI = mustParseABI(`[
+		{"type":"function","name":"createPayment","inputs":[{"name":"recipient","type":"address"},{"name":"token","type":"address"},{"name":"amount","type":"uint256"},{"name":"metadataURI","type":"string"},{"name":"senderENS","type":"string"},{"name":"recipientENS","type":"string"}],"outputs":[{"name":"","type":"uint256"}]},
+		{"type":"function","name":"completePayment","inputs":[{"name":"paymentId","type":"uint256"}],"outputs":[]},
+		{"type":"event","name":"PaymentCreated","inputs":[{"name":"id","type":"uint256","indexed":true},{"name":"sender","type":"address","indexed":true},{"name":"recipient","type":"address","indexed":true},{"name":"token","type":"address"},{"name":"amount","type":"uint256"},{"name":"fee","type":"uint256"},{"name":"metadataURI","type":"string"},{"name":"senderENS","type":"string"},{"name":"recipientENS","type":"string"}]},
+		{"type":"event","name":"PaymentCompleted","inputs":[{"name":"id","type":"uint256","indexed":true},{"name":"completer","type":"address","indexed":true}]}
+	]`)
+	erc20ABI = mustParseABI(`[
+		{"type":"function","name":"approve","inputs":[{"name":"spender","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+		{"type":"function","name":"balanceOf","stateMutability":"view","inputs":[{"name":"account","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+		{"type":"function","name":"allowance","stateMutability":"view","inputs":[{"name":"owner","type":"address"},{"name":"spender","type":"address"}],"outputs":[{"name":"","type":"uint256"}]}
+	]`)
+	entryPointABI = mustParseABI(`[
+		{"type":"function","name":"getNonce","stateMutability":"view","inputs":[{"name":"sender","type":"address"},{"name":"key","type":"uint192"}],"outputs":[{"name":"nonce","type":"uint256"}]}
+	]`)
+
+	// packedUserOpArgs and userOpHashArgs are the encodings EntryPoint v0.7
+	// hashes in getUserOpHash
+	packedUserOpArgs = mustArguments("address", "uint256", "bytes32", "bytes32", "bytes32", "uint256", "bytes32", "bytes32")
+	userOpHashArgs   = mustArguments("bytes32", "address", "uint256")
+)
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func mustArguments(types ...string) abi.Arguments {
+	args := make(abi.Arguments, len(types))
+	for i, name := range types {
+		typ, err := abi.NewType(name, "", nil)
+		if err != nil {
+			panic(err)
+		}
+		args[i] = abi.Argument{Type: typ}
+	}
+	return args
+}
+
+// UserOperation is an EntryPoint v0.7 user operation in the form bundlers
+// and paymasters exchange over JSON-RPC
+type UserOperation struct {
+	Sender                        common.Address  `json:"sender"`
+	Nonce                         *hexutil.Big    `json:"nonce"`
+	Factory                       *common.Address `json:"factory,omitempty"`
+	FactoryData                   hexutil.Bytes   `json:"factoryData,omitempty"`
+	CallData                      hexutil.Bytes   `json:"callData"`
+	CallGasLimit                  *hexutil.Big    `json:"callGasLimit"`
+	VerificationGasLimit          *hexutil.Big    `json:"verificationGasLimit"`
+	PreVerificationGas            *hexutil.Big    `json:"preVerificationGas"`
+	MaxFeePerGas                  *hexutil.Big    `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas          *hexutil.Big    `json:"maxPriorityFeePerGas"`
+	Paymaster                     *common.Address `json:"paymaster,omitempty"`
+	PaymasterVerificationGasLimit *hexutil.Big    `json:"paymasterVerificationGasLimit,omitempty"`
+	PaymasterPostOpGasLimit       *hexutil.Big    `json:"paymasterPostOpGasLimit,omitempty"`
+	PaymasterData                 hexutil.Bytes   `json:"paymasterData,omitempty"`
+	Signature                     hexutil.Bytes   `json:"signature"`
+}
+
+// Hash returns the hash the account signs, as EntryPoint.getUserOpHash
+// computes it
+func (op *UserOperation) Hash(entryPoint common.Address, chainID *big.Int) (common.Hash, error) {
+	packed, err := packedUserOpArgs.Pack(
+		op.Sender,
+		bigOrZero(op.Nonce),
+		crypto.Keccak256Hash(op.initCode()),
+		crypto.Keccak256Hash(op.CallData),
+		packUint128s(op.VerificationGasLimit, op.CallGasLimit),
+		bigOrZero(op.PreVerificationGas),
+		packUint128s(op.MaxPriorityFeePerGas, op.MaxFeePerGas),
+		crypto.Keccak256Hash(op.paymasterAndData()),
+	)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	encoded, err := userOpHashArgs.Pack(crypto.Keccak256Hash(packed), entryPoint, chainID)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash(encoded), nil
+}
+
+// initCode is the factory address followed by its calldata, or empty for a
+// deployed account
+func (op *UserOperation) initCode() []byte {
+	if op.Factory == nil {
+		return nil
+	}
+	return append(op.Factory.Bytes(), op.FactoryData...)
+}
+
+// paymasterAndData is the paymaster address, its verification and post-op
+// gas limits as 16 bytes each and its data, or empty without a paymaster
+func (op *UserOperation) paymasterAndData() []byte {
+	if op.Paymaster == nil {
+		return nil
+	}
+	data := op.Paymaster.Bytes()
+	data = append(data, common.LeftPadBytes(bigOrZero(op.PaymasterVerificationGasLimit).Bytes(), 16)...)
+	data = append(data, common.LeftPadBytes(bigOrZero(op.PaymasterPostOpGasLimit).Bytes(), 16)...)
+	return append(data, op.PaymasterData...)
+}
+
+// packUint128s packs two values into one word, high first, the way
+// EntryPoint v0.7 packs gas limits and fees
+func packUint128s(high, low *hexutil.Big) [32]byte {
+	var word [32]byte
+	bigOrZero(high).FillBytes(word[:16])
+	bigOrZero(low).FillBytes(word[16:])
+	return word
+}
+
+func bigOrZero(value *hexutil.Big) *big.Int {
+	if value == nil {
+		return new(big.Int)
+	}
+	return value.ToInt()
+}
+
+// SponsoredPaymentRequest is a payment to be made from a smart account.
+// Factory and FactoryData deploy the account with its first operation.
+type SponsoredPaymentRequest struct {
+	Sender       string `json:"sender"`
+	Factory      string `json:"factory"`
+	FactoryData  string `json:"factory_data"`
+	Recipient    string `json:"recipient"`
+	Token        string `json:"token"`
+	Amount       string `json:"amount"`
+	MetadataURI  string `json:"metadata_uri"`
+	SenderENS    string `json:"sender_ens"`
+	RecipientENS string `json:"recipient_ens"`
+}
+
+// validate checks the addresses and amount and returns the amount
+func (r *SponsoredPaymentRequest) validate() (*big.Int, error) {
+	if r.Sender == "" || r.Recipient == "" || r.Token == "" || r.Amount == "" {
+		return nil, errors.New("sender, recipient, token and amount are required")
+	}
+	for _, address := range []string{r.Sender, r.Recipient, r.Token} {
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("invalid address %q", address)
+		}
+	}
+	if r.Factory != "" && !common.IsHexAddress(r.Factory) {
+		return nil, fmt.Errorf("invalid factory address %q", r.Factory)
+	}
+	if r.FactoryData != "" {
+		if _, err := hexutil.Decode(r.FactoryData); err != nil {
+			return nil, fmt.Errorf("invalid factory_data: %w", err)
+		}
+	}
+	amount, ok := new(big.Int).SetString(r.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid amount %q", r.Amount)
+	}
+	return amount, nil
+}
+
+// paymentCallData encodes the account call that creates the payment. Native
+// payments send the amount plus fee with the call. Token payments approve
+// PaymentCore for the amount plus fee in the same batch.
+func paymentCallData(paymentCore common.Address, request *SponsoredPaymentRequest, amount *big.Int) ([]byte, error) {
+	create, err := paymentCoreABI.Pack("createPayment",
+		common.HexToAddress(request.Recipient),
+		common.HexToAddress(request.Token),
+		amount,
+		request.MetadataURI,
+		request.SenderENS,
+		request.RecipientENS,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	fee := new(big.Int).Mul(amount, big.NewInt(paymentFeeBasisPoints))
+	fee.Div(fee, big.NewInt(10000))
+	total := new(big.Int).Add(amount, fee)
+
+	token := common.HexToAddress(request.Token)
+	if token == (common.Address{}) {
+		return accountABI.Pack("execute", paymentCore, total, create)
+	}
+
+	approve, err := erc20ABI.Pack("approve", paymentCore, total)
+	if err != nil {
+		return nil, err
+	}
+	return accountABI.Pack("executeBatch",
+		[]common.Address{token, paymentCore},
+		[]*big.Int{new(big.Int), new(big.Int)},
+		[][]byte{approve, create},
+	)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChain answers calls with the nonce, or with call when set
+type fakeChain struct {
+	code  []byte
+	nonce *big.Int
+	call  func(msg ethereum.CallMsg) ([]byte, error)
+}
+
+func (c *fakeChain) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if c.call != nil {
+		return c.call(msg)
+	}
+	return entryPointABI.Methods["getNonce"].Outputs.Pack(c.nonce)
+}
+
+func (c *fakeChain) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
+	return c.code, nil
+}
+
+func (c *fakeChain) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(2), nil
+}
+
+func (c *fakeChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{BaseFee: big.NewInt(10)}, nil
+}
+
+// fakeRPC answers JSON-RPC calls from handlers by method, round-tripping
+// results through JSON like a real client
+type fakeRPC struct {
+	handlers map[string]func(args []interface{}) (interface{}, error)
+	calls    []string
+}
+
+func (f *fakeRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	f.calls = append(f.calls, method)
+	handler, ok := f.handlers[method]
+	if !ok {
+		return fmt.Errorf("method %s not found", method)
+	}
+	answer, err := handler(args)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, result)
+}
+
+func setupUserOpTest(t *testing.T) (*userOpService, *fakeChain, *fakeRPC, *fakeRPC) {
+	setupTestDB(t)
+
+	paymasterAddress := common.HexToAddress("0x00000000000000000000000000000000000000ff")
+	chain := &fakeChain{code: []byte{1}, nonce: big.NewInt(3)}
+	bundler := &fakeRPC{handlers: map[string]func([]interface{}) (interface{}, error){
+		"eth_estimateUserOperationGas": func(args []interface{}) (interface{}, error) {
+			return map[string]string{
+				"preVerificationGas":            "0xc350",
+				"verificationGasLimit":          "0x186a0",
+				"callGasLimit":                  "0x30d40",
+				"paymasterVerificationGasLimit": "0x7530",
+			}, nil
+		},
+		"eth_sendUserOperation": func(args []interface{}) (interface{}, error) {
+			op := args[0].(*UserOperation)
+			return op.Hash(args[1].(common.Address), big.NewInt(4202))
+		},
+	}}
+	paymaster := &fakeRPC{handlers: map[string]func([]interface{}) (interface{}, error){
+		"pm_getPaymasterStubData": func(args []interface{}) (interface{}, error) {
+			return map[string]interface{}{"paymaster": paymasterAddress, "paymasterData": "0x00", "paymasterPostOpGasLimit": "0x0"}, nil
+		},
+		"pm_getPaymasterData": func(args []interface{}) (interface{}, error) {
+			return map[string]interface{}{"paymaster": paymasterAddress, "paymasterData": "0xabcdef"}, nil
+		},
+	}}
+
+	service := &userOpService{
+		chain:        chain,
+		bundler:      bundler,
+		paymaster:    paymaster,
+		chainID:      big.NewInt(4202),
+		entryPoint:   common.HexToAddress(defaultEntryPoint),
+		paymentCore:  common.HexToAddress("0x00000000000000000000000000000000000000c0"),
+		sponsorLimit: 1,
+		dropAfter:    time.Hour,
+		now:          time.Now,
+	}
+	return service, chain, bundler, paymaster
+}
+
+func sponsoredRequest() *SponsoredPaymentRequest {
+	return &SponsoredPaymentRequest{
+		Sender:    "0x00000000000000000000000000000000000000a1",
+		Recipient: "0x00000000000000000000000000000000000000b2",
+		Token:     "0x0000000000000000000000000000000000000000",
+		Amount:    "1000000",
+	}
+}
+
+func TestUserOperationHash(t *testing.T) {
+	entryPoint := common.HexToAddress(defaultEntryPoint)
+	op := &UserOperation{
+		Sender:               common.HexToAddress("0x00000000000000000000000000000000000000a1"),
+		Nonce:                (*hexutil.Big)(big.NewInt(1)),
+		CallData:             []byte{0x12, 0x34},
+		CallGasLimit:         (*hexutil.Big)(big.NewInt(200000)),
+		VerificationGasLimit: (*hexutil.Big)(big.NewInt(100000)),
+		PreVerificationGas:   (*hexutil.Big)(big.NewInt(50000)),
+		MaxFeePerGas:         (*hexutil.Big)(big.NewInt(22)),
+		MaxPriorityFeePerGas: (*hexutil.Big)(big.NewInt(2)),
+	}
+
+	t.Run("should not depend on the signature", func(t *testing.T) {
+		unsigned, err := op.Hash(entryPoint, big.NewInt(4202))
+		require.NoError(t, err)
+
+		signed := *op
+		signed.Signature = []byte{1, 2, 3}
+		hash, err := signed.Hash(entryPoint, big.NewInt(4202))
+		require.NoError(t, err)
+		assert.Equal(t, unsigned, hash)
+	})
+
+	t.Run("should differ between chains", func(t *testing.T) {
+		lisk, err := op.Hash(entryPoint, big.NewInt(4202))
+		require.NoError(t, err)
+		base, err := op.Hash(entryPoint, big.NewInt(84532))
+		require.NoError(t, err)
+		assert.NotEqual(t, lisk, base)
+	})
+
+	t.Run("should pack gas limits high first", func(t *testing.T) {
+		word := packUint128s(op.VerificationGasLimit, op.CallGasLimit)
+		assert.Equal(t, big.NewInt(100000), new(big.Int).SetBytes(word[:16]))
+		assert.Equal(t, big.NewInt(200000), new(big.Int).SetBytes(word[16:]))
+	})
+
+	t.Run("should pack the paymaster with its gas limits", func(t *testing.T) {
+		paymaster := common.HexToAddress("0x00000000000000000000000000000000000000ff")
+		sponsored := *op
+		sponsored.Paymaster = &paymaster
+		sponsored.PaymasterVerificationGasLimit = (*hexutil.Big)(big.NewInt(30000))
+		sponsored.PaymasterPostOpGasLimit = (*hexutil.Big)(big.NewInt(1))
+		sponsored.PaymasterData = []byte{0xab}
+
+		data := sponsored.paymasterAndData()
+		require.Len(t, data, 20+16+16+1)
+		assert.Equal(t, paymaster.Bytes(), data[:20])
+		assert.Equal(t, big.NewInt(30000), new(big.Int).SetBytes(data[20:36]))
+		assert.Equal(t, big.NewInt(1), new(big.Int).SetBytes(data[36:52]))
+		assert.Equal(t, byte(0xab), data[52])
+	})
+}
+
+func TestPaymentCallData(t *testing.T) {
+	core := common.HexToAddress("0x00000000000000000000000000000000000000c0")
+
+	t.Run("should send native payments with the fee added", func(t *testing.T) {
+		request := sponsoredRequest()
+		data, err := paymentCallData(core, request, big.NewInt(1000000))
+		require.NoError(t, err)
+
+		method, err := accountABI.MethodById(data[:4])
+		require.NoError(t, err)
+		assert.Equal(t, "execute", method.Name)
+
+		args, err := method.Inputs.Unpack(data[4:])
+		require.NoError(t, err)
+		assert.Equal(t, core, args[0])
+		assert.Equal(t, big.NewInt(1001000), args[1])
+	})
+
+	t.Run("should approve token payments in the same batch", func(t *testing.T) {
+		request := sponsoredRequest()
+		request.Token = "0x00000000000000000000000000000000000000d4"
+		data, err := paymentCallData(core, request, big.NewInt(1000000))
+		require.NoError(t, err)
+
+		method, err := accountABI.MethodById(data[:4])
+		require.NoError(t, err)
+		assert.Equal(t, "executeBatch", method.Name)
+
+		args, err := method.Inputs.Unpack(data[4:])
+		require.NoError(t, err)
+		assert.Equal(t, []common.Address{common.HexToAddress(request.Token), core}, args[0])
+
+		calls := args[2].([][]byte)
+		approve, err := erc20ABI.MethodById(calls[0][:4])
+		require.NoError(t, err)
+		assert.Equal(t, "approve", approve.Name)
+		create, err := paymentCoreABI.MethodById(calls[1][:4])
+		require.NoError(t, err)
+		assert.Equal(t, "createPayment", create.Name)
+	})
+
+	t.Run("should reject invalid requests", func(t *testing.T) {
+		request := sponsoredRequest()
+		request.Amount = "0"
+		_, err := request.validate()
+		assert.Error(t, err)
+
+		request = sponsoredRequest()
+		request.Recipient = "bob.eth"
+		_, err = request.validate()
+		assert.Error(t, err)
+	})
+}
+
+func TestSponsoredPayments(t *testing.T) {
+	t.Run("should build a sponsored operation for a first-time sender", func(t *testing.T) {
+		service, _, _, paymaster := setupUserOpTest(t)
+
+		built, err := service.build(context.Background(), sponsoredRequest(), big.NewInt(1000000))
+		require.NoError(t, err)
+
+		op := built.UserOperation
+		assert.True(t, built.Sponsored)
+		assert.Equal(t, []string{"pm_getPaymasterStubData", "pm_getPaymasterData"}, paymaster.calls)
+		assert.Equal(t, big.NewInt(3), op.Nonce.ToInt())
+		assert.Equal(t, big.NewInt(22), op.MaxFeePerGas.ToInt())
+		assert.Equal(t, big.NewInt(200000), op.CallGasLimit.ToInt())
+		assert.Equal(t, big.NewInt(30000), op.PaymasterVerificationGasLimit.ToInt())
+		assert.Equal(t, hexutil.Bytes{0xab, 0xcd, 0xef}, op.PaymasterData)
+		assert.Empty(t, op.Signature)
+
+		hash, err := op.Hash(service.entryPoint, service.chainID)
+		require.NoError(t, err)
+		assert.Equal(t, hash, built.Hash)
+	})
+
+	t.Run("should require a factory for an undeployed account", func(t *testing.T) {
+		service, chain, _, _ := setupUserOpTest(t)
+		chain.code = nil
+
+		_, err := service.build(context.Background(), sponsoredRequest(), big.NewInt(1000000))
+		assert.ErrorIs(t, err, errAccountNotDeployed)
+
+		request := sponsoredRequest()
+		request.Factory = "0x00000000000000000000000000000000000000fa"
+		request.FactoryData = "0x1234"
+		built, err := service.build(context.Background(), request, big.NewInt(1000000))
+		require.NoError(t, err)
+		assert.Equal(t, common.HexToAddress(request.Factory), *built.UserOperation.Factory)
+	})
+
+	t.Run("should stop sponsoring once the sender used its sponsored payments", func(t *testing.T) {
+		service, _, _, _ := setupUserOpTest(t)
+
+		built, err := service.build(context.Background(), sponsoredRequest(), big.NewInt(1000000))
+		require.NoError(t, err)
+		built.UserOperation.Signature = []byte{1}
+		_, err = service.send(context.Background(), built.UserOperation)
+		require.NoError(t, err)
+
+		again, err := service.build(context.Background(), sponsoredRequest(), big.NewInt(1000000))
+		require.NoError(t, err)
+		assert.False(t, again.Sponsored)
+		assert.Nil(t, again.UserOperation.Paymaster)
+
+		_, err = service.send(context.Background(), built.UserOperation)
+		assert.ErrorIs(t, err, errSponsorshipLimit)
+	})
+
+	t.Run("should record the payment once the operation is included", func(t *testing.T) {
+		service, _, bundler, _ := setupUserOpTest(t)
+
+		built, err := service.build(context.Background(), sponsoredRequest(), big.NewInt(1000000))
+		require.NoError(t, err)
+		built.UserOperation.Signature = []byte{1}
+		record, err := service.send(context.Background(), built.UserOperation)
+		require.NoError(t, err)
+		assert.Equal(t, built.Hash.Hex(), record.Hash)
+		assert.Equal(t, UserOpPending, record.Status)
+
+		bundler.handlers["eth_getUserOperationReceipt"] = func(args []interface{}) (interface{}, error) {
+			return nil, nil
+		}
+		require.NoError(t, service.refresh(context.Background(), record))
+		assert.Equal(t, UserOpPending, record.Status)
+
+		event := paymentCoreABI.Events["PaymentCreated"]
+		data, err := event.Inputs.NonIndexed().Pack(common.Address{}, big.NewInt(1000000), big.NewInt(1000), "ipfs://receipt", "", "bob.eth")
+		require.NoError(t, err)
+		txHash := common.HexToHash("0xfeed")
+		bundler.handlers["eth_getUserOperationReceipt"] = func(args []interface{}) (interface{}, error) {
+			return map[string]interface{}{
+				"success":       true,
+				"actualGasCost": "0x5208",
+				"logs": []map[string]interface{}{{
+					"address": service.paymentCore,
+					"topics": []common.Hash{
+						event.ID,
+						common.BigToHash(big.NewInt(42)),
+						common.BytesToHash(common.HexToAddress(sponsoredRequest().Sender).Bytes()),
+						common.BytesToHash(common.HexToAddress(sponsoredRequest().Recipient).Bytes()),
+					},
+					"data": hexutil.Bytes(data),
+				}},
+				"receipt": map[string]interface{}{"transactionHash": txHash, "blockNumber": "0x10"},
+			}, nil
+		}
+		require.NoError(t, service.refresh(context.Background(), record))
+
+		stored, err := getUserOp(record.Hash)
+		require.NoError(t, err)
+		assert.Equal(t, UserOpIncluded, stored.Status)
+		assert.Equal(t, txHash.Hex(), stored.TxHash)
+		assert.Equal(t, uint64(16), stored.BlockNumber)
+		assert.Equal(t, "21000", stored.ActualGasCost)
+		assert.Equal(t, "42", stored.PaymentID)
+		assert.True(t, stored.Sponsored)
+
+		var paymentTx, recipientENS, status string
+		err = db.QueryRow(`SELECT tx_hash, recipient_ens, status FROM payments WHERE id = ?`, "42").Scan(&paymentTx, &recipientENS, &status)
+		require.NoError(t, err)
+		assert.Equal(t, txHash.Hex(), paymentTx)
+		assert.Equal(t, "bob.eth", recipientENS)
+		assert.Equal(t, "pending", status)
+	})
+
+	t.Run("should mark operations the bundler never included as dropped", func(t *testing.T) {
+		service, _, bundler, _ := setupUserOpTest(t)
+		bundler.handlers["eth_getUserOperationReceipt"] = func(args []interface{}) (interface{}, error) {
+			return nil, nil
+		}
+
+		built, err := service.build(context.Background(), sponsoredRequest(), big.NewInt(1000000))
+		require.NoError(t, err)
+		built.UserOperation.Signature = []byte{1}
+		record, err := service.send(context.Background(), built.UserOperation)
+		require.NoError(t, err)
+
+		service.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		require.NoError(t, service.refresh(context.Background(), record))
+		assert.Equal(t, UserOpDropped, record.Status)
+
+		eligible, err := service.eligible(built.UserOperation.Sender)
+		require.NoError(t, err)
+		assert.True(t, eligible)
+	})
+}
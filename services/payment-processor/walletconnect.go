@@ -0,0 +1,843 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// The processor pairs with users' wallets over WalletConnect v2 as a dApp,
+// so it can push payments to them for approval itself instead of leaving
+// every transaction to the frontend's wallet wiring. Pairing returns a wc:
+// URI for the user to scan or open; the session proposal waits on the
+// pairing topic until the wallet answers with its key, and the session
+// settles on the topic both keys derive. A payment request asks the
+// session's account to send createPayment, preceded by an approval of
+// PaymentCore for token payments, and is approved once the wallet returns
+// the hash of every transaction. Keys are stored so sessions outlive
+// restarts.
+
+// WalletConnect session statuses
+const (
+	WCSessionProposed = "proposed"
+	WCSessionActive   = "active"
+	WCSessionRejected = "rejected"
+	WCSessionExpired  = "expired"
+	WCSessionDeleted  = "deleted"
+)
+
+// WalletConnect request statuses
+const (
+	WCRequestPending  = "pending"
+	WCRequestApproved = "approved"
+	WCRequestRejected = "rejected"
+	WCRequestExpired  = "expired"
+)
+
+// WalletConnect error codes
+const (
+	wcErrorUnsupportedMethod = 10001
+	wcErrorUnsupportedChains = 5100
+	wcErrorUserDisconnected  = 6000
+)
+
+const (
+	defaultWalletConnectProposalTTL = 5 * time.Minute
+	defaultWalletConnectRequestTTL  = 5 * time.Minute
+	walletConnectExpireInterval     = 30 * time.Second
+)
+
+// wcMethods are the relay tag and TTL of each WalletConnect Sign method.
+// Responses are tagged one higher.
+var wcMethods = map[string]struct {
+	tag int
+	ttl time.Duration
+}{
+	"wc_pairingDelete":  {1000, 24 * time.Hour},
+	"wc_pairingPing":    {1002, 30 * time.Second},
+	"wc_sessionPropose": {1100, 5 * time.Minute},
+	"wc_sessionSettle":  {1102, 5 * time.Minute},
+	"wc_sessionUpdate":  {1104, 24 * time.Hour},
+	"wc_sessionExtend":  {1106, 24 * time.Hour},
+	"wc_sessionRequest": {1108, 5 * time.Minute},
+	"wc_sessionEvent":   {1110, 5 * time.Minute},
+	"wc_sessionDelete":  {1112, 24 * time.Hour},
+	"wc_sessionPing":    {1114, 30 * time.Second},
+}
+
+var (
+	errWalletConnectSessionNotFound = errors.New("WalletConnect session not found")
+	errWalletConnectSessionInactive = errors.New("WalletConnect session is not active")
+	errWalletConnectRequestNotFound = errors.New("WalletConnect request not found")
+)
+
+// walletConnect is nil when WALLETCONNECT_PROJECT_ID, CHAIN_ID or
+// PAYMENT_CORE_ADDRESS is not set
+var walletConnect *walletConnectService
+
+// wcMetadata describes the processor to wallets
+type wcMetadata struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	URL         string   `json:"url"`
+	Icons       []string `json:"icons"`
+}
+
+// wcNamespace is the chains, accounts, methods and events of a namespace
+type wcNamespace struct {
+	Chains   []string `json:"chains,omitempty"`
+	Accounts []string `json:"accounts,omitempty"`
+	Methods  []string `json:"methods"`
+	Events   []string `json:"events"`
+}
+
+// WalletConnectSession is a session with a wallet. Address is the account
+// of the session on ChainID, which payments are requested from.
+type WalletConnectSession struct {
+	ID        string    `json:"id"`
+	ChainID   int64     `json:"chain_id"`
+	Status    string    `json:"status"`
+	Address   string    `json:"address,omitempty"`
+	Accounts  []string  `json:"accounts"`
+	Wallet    string    `json:"wallet,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	pairingTopic string
+	pairingKey   []byte
+	privateKey   *ecdh.PrivateKey
+	proposalID   int64
+	sessionTopic string
+	sessionKey   []byte
+}
+
+// WalletConnectCall is a transaction a request asks the wallet to send, and
+// its hash once sent
+type WalletConnectCall struct {
+	To     string `json:"to"`
+	Data   string `json:"data"`
+	Value  string `json:"value"`
+	TxHash string `json:"tx_hash,omitempty"`
+}
+
+// WalletConnectRequest is a payment pushed to a session's wallet for
+// approval. Its calls are requested one after another.
+type WalletConnectRequest struct {
+	ID          string              `json:"id"`
+	SessionID   string              `json:"session_id"`
+	Sender      string              `json:"sender"`
+	Recipient   string              `json:"recipient"`
+	Token       string              `json:"token"`
+	Amount      string              `json:"amount"`
+	MetadataURI string              `json:"metadata_uri,omitempty"`
+	Calls       []WalletConnectCall `json:"calls"`
+	Status      string              `json:"status"`
+	Error       string              `json:"error,omitempty"`
+	ExpiresAt   time.Time           `json:"expires_at"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
+
+	rpcID int64
+}
+
+// WalletConnectPaymentRequest is a payment to push to a session's wallet
+type WalletConnectPaymentRequest struct {
+	SessionID    string `json:"session_id"`
+	Recipient    string `json:"recipient"`
+	Token        string `json:"token"`
+	Amount       string `json:"amount"`
+	MetadataURI  string `json:"metadata_uri"`
+	SenderENS    string `json:"sender_ens"`
+	RecipientENS string `json:"recipient_ens"`
+}
+
+// validate checks the addresses and amount and returns the amount
+func (r *WalletConnectPaymentRequest) validate() (*big.Int, error) {
+	if r.SessionID == "" || r.Recipient == "" || r.Token == "" || r.Amount == "" {
+		return nil, errors.New("session_id, recipient, token and amount are required")
+	}
+	for _, address := range []string{r.Recipient, r.Token} {
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("invalid address %q", address)
+		}
+	}
+	amount, ok := new(big.Int).SetString(r.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid amount %q", r.Amount)
+	}
+	return amount, nil
+}
+
+// walletConnectService pairs sessions and pushes payment requests through
+// the relay. Messages are handled one at a time.
+type walletConnectService struct {
+	relay       wcRelay
+	metadata    wcMetadata
+	chainID     int64
+	paymentCore common.Address
+	proposalTTL time.Duration
+	requestTTL  time.Duration
+	mutex       sync.Mutex
+	now         func() time.Time
+}
+
+// caip2 is the service's chain as a CAIP-2 chain ID
+func (s *walletConnectService) caip2() string {
+	return fmt.Sprintf("eip155:%d", s.chainID)
+}
+
+// pair proposes a session to whichever wallet opens the returned URI
+func (s *walletConnectService) pair(ctx context.Context) (*WalletConnectSession, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := make([]byte, 16)
+	topic := make([]byte, 32)
+	key := make([]byte, 32)
+	for _, value := range [][]byte{id, topic, key} {
+		if _, err := rand.Read(value); err != nil {
+			return nil, "", err
+		}
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	now := s.now().UTC()
+	session := &WalletConnectSession{
+		ID:           hexutil.Encode(id),
+		ChainID:      s.chainID,
+		Status:       WCSessionProposed,
+		Accounts:     []string{},
+		ExpiresAt:    now.Add(s.proposalTTL),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		pairingTopic: hex.EncodeToString(topic),
+		pairingKey:   key,
+		privateKey:   private,
+		proposalID:   wcPayloadID(),
+	}
+	if err := storeWalletConnectSession(session); err != nil {
+		return nil, "", err
+	}
+
+	if err := s.relay.subscribe(ctx, session.pairingTopic); err != nil {
+		return nil, "", fmt.Errorf("failed to subscribe to pairing: %w", err)
+	}
+	namespace := wcNamespace{
+		Chains:  []string{s.caip2()},
+		Methods: []string{"eth_sendTransaction"},
+		Events:  []string{"accountsChanged", "chainChanged"},
+	}
+	proposal := map[string]interface{}{
+		"requiredNamespaces": map[string]wcNamespace{"eip155": namespace},
+		"relays":             []map[string]string{{"protocol": "irn"}},
+		"proposer": map[string]interface{}{
+			"publicKey": hex.EncodeToString(private.PublicKey().Bytes()),
+			"metadata":  s.metadata,
+		},
+		"expiryTimestamp": session.ExpiresAt.Unix(),
+	}
+	if err := s.request(ctx, session.pairingTopic, session.pairingKey, session.proposalID, "wc_sessionPropose", proposal); err != nil {
+		return nil, "", fmt.Errorf("failed to propose session: %w", err)
+	}
+
+	uri := fmt.Sprintf("wc:%s@2?expiryTimestamp=%d&relay-protocol=irn&symKey=%s",
+		session.pairingTopic, session.ExpiresAt.Unix(), hex.EncodeToString(session.pairingKey))
+	log.Printf("Proposed WalletConnect session %s", session.ID)
+	return session, uri, nil
+}
+
+// pushPayment asks the session's wallet to create a validated payment
+func (s *walletConnectService) pushPayment(ctx context.Context, payment *WalletConnectPaymentRequest, amount *big.Int) (*WalletConnectRequest, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, err := getWalletConnectSession(payment.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now().UTC()
+	if session.Status != WCSessionActive || !now.Before(session.ExpiresAt) {
+		return nil, errWalletConnectSessionInactive
+	}
+	calls, err := walletConnectCalls(s.paymentCore, payment, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	request := &WalletConnectRequest{
+		ID:          hexutil.Encode(id),
+		SessionID:   session.ID,
+		Sender:      session.Address,
+		Recipient:   strings.ToLower(payment.Recipient),
+		Token:       strings.ToLower(payment.Token),
+		Amount:      amount.String(),
+		MetadataURI: payment.MetadataURI,
+		Calls:       calls,
+		Status:      WCRequestPending,
+		ExpiresAt:   now.Add(s.requestTTL),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		rpcID:       wcPayloadID(),
+	}
+	if err := storeWalletConnectRequest(request); err != nil {
+		return nil, err
+	}
+	if err := s.sendCall(ctx, session, request); err != nil {
+		return nil, fmt.Errorf("failed to push payment: %w", err)
+	}
+	log.Printf("Pushed payment request %s to WalletConnect session %s", request.ID, session.ID)
+	return request, nil
+}
+
+// sendCall asks the wallet to send the request's next call
+func (s *walletConnectService) sendCall(ctx context.Context, session *WalletConnectSession, request *WalletConnectRequest) error {
+	call := request.Calls[request.step()]
+	return s.request(ctx, session.sessionTopic, session.sessionKey, request.rpcID, "wc_sessionRequest", map[string]interface{}{
+		"chainId": s.caip2(),
+		"request": map[string]interface{}{
+			"method": "eth_sendTransaction",
+			"params": []map[string]string{{
+				"from":  session.Address,
+				"to":    call.To,
+				"data":  call.Data,
+				"value": call.Value,
+			}},
+			"expiryTimestamp": request.ExpiresAt.Unix(),
+		},
+	})
+}
+
+// step is the index of the first call not sent yet
+func (r *WalletConnectRequest) step() int {
+	for i, call := range r.Calls {
+		if call.TxHash == "" {
+			return i
+		}
+	}
+	return len(r.Calls)
+}
+
+// disconnect ends a proposed or active session
+func (s *walletConnectService) disconnect(ctx context.Context, id string) (*WalletConnectSession, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, err := getWalletConnectSession(id)
+	if err != nil {
+		return nil, err
+	}
+	if session.Status != WCSessionProposed && session.Status != WCSessionActive {
+		return nil, errWalletConnectSessionInactive
+	}
+	if session.Status == WCSessionActive {
+		err := s.request(ctx, session.sessionTopic, session.sessionKey, wcPayloadID(), "wc_sessionDelete",
+			map[string]interface{}{"code": wcErrorUserDisconnected, "message": "User disconnected."})
+		if err != nil {
+			log.Printf("Failed to notify wallet of WalletConnect session %s ending: %v", session.ID, err)
+		}
+	}
+	s.end(ctx, session, WCSessionDeleted, "disconnected")
+	return session, nil
+}
+
+// end closes a session and stops listening to its topics
+func (s *walletConnectService) end(ctx context.Context, session *WalletConnectSession, status, reason string) {
+	session.Status = status
+	session.Reason = reason
+	session.UpdatedAt = s.now().UTC()
+	if err := updateWalletConnectSession(session); err != nil {
+		log.Printf("Failed to update WalletConnect session %s: %v", session.ID, err)
+	}
+	for _, topic := range []string{session.pairingTopic, session.sessionTopic} {
+		if topic == "" {
+			continue
+		}
+		if err := s.relay.unsubscribe(ctx, topic); err != nil {
+			log.Printf("Failed to unsubscribe from WalletConnect topic %s: %v", topic, err)
+		}
+	}
+}
+
+// request publishes a JSON-RPC request on topic
+func (s *walletConnectService) request(ctx context.Context, topic string, key []byte, id int64, method string, params interface{}) error {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.publish(ctx, topic, key, &wcRPC{ID: id, JSONRPC: "2.0", Method: method, Params: encoded}, wcMethods[method].tag, wcMethods[method].ttl)
+}
+
+// respond publishes the result or error of a wallet's request on topic
+func (s *walletConnectService) respond(ctx context.Context, topic string, key []byte, request *wcRPC, result interface{}, rpcErr *wcRPCError) {
+	response := &wcRPC{ID: request.ID, JSONRPC: "2.0", Error: rpcErr}
+	if rpcErr == nil {
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Failed to encode WalletConnect response to %s: %v", request.Method, err)
+			return
+		}
+		response.Result = encoded
+	}
+	method := wcMethods[request.Method]
+	if err := s.publish(ctx, topic, key, response, method.tag+1, method.ttl); err != nil {
+		log.Printf("Failed to respond to WalletConnect %s: %v", request.Method, err)
+	}
+}
+
+func (s *walletConnectService) publish(ctx context.Context, topic string, key []byte, payload *wcRPC, tag int, ttl time.Duration) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	message, err := wcSeal(key, encoded)
+	if err != nil {
+		return err
+	}
+	return s.relay.publish(ctx, topic, message, ttl, tag)
+}
+
+// handle processes a message the relay delivered on topic
+func (s *walletConnectService) handle(topic, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), wcRelayTimeout)
+	defer cancel()
+
+	session, err := getWalletConnectSessionByTopic(topic)
+	if err != nil {
+		log.Printf("WalletConnect message on unknown topic %s: %v", topic, err)
+		return
+	}
+	key := session.pairingKey
+	if topic == session.sessionTopic {
+		key = session.sessionKey
+	}
+	decrypted, err := wcOpen(key, message)
+	if err != nil {
+		log.Printf("Failed to decrypt WalletConnect message of session %s: %v", session.ID, err)
+		return
+	}
+	var payload wcRPC
+	if err := json.Unmarshal(decrypted, &payload); err != nil {
+		log.Printf("Invalid WalletConnect message of session %s: %v", session.ID, err)
+		return
+	}
+
+	if payload.Method != "" {
+		s.handleRequest(ctx, session, topic, key, &payload)
+		return
+	}
+	if payload.ID == session.proposalID {
+		s.handleProposalResponse(ctx, session, &payload)
+		return
+	}
+	request, err := getWalletConnectRequestByRPCID(payload.ID)
+	if err != nil || request.SessionID != session.ID {
+		return
+	}
+	s.handleRequestResponse(ctx, session, request, &payload)
+}
+
+// handleProposalResponse derives the session topic from the wallet's key,
+// where the wallet settles the session
+func (s *walletConnectService) handleProposalResponse(ctx context.Context, session *WalletConnectSession, payload *wcRPC) {
+	if session.Status != WCSessionProposed || session.sessionTopic != "" {
+		return
+	}
+	if payload.Error != nil {
+		s.end(ctx, session, WCSessionRejected, payload.Error.Message)
+		log.Printf("WalletConnect session %s rejected: %v", session.ID, payload.Error)
+		return
+	}
+
+	var result struct {
+		ResponderPublicKey string `json:"responderPublicKey"`
+	}
+	if err := json.Unmarshal(payload.Result, &result); err != nil {
+		s.end(ctx, session, WCSessionRejected, "invalid proposal response")
+		return
+	}
+	key, topic, err := wcSessionKey(session.privateKey, result.ResponderPublicKey)
+	if err != nil {
+		s.end(ctx, session, WCSessionRejected, err.Error())
+		return
+	}
+	session.sessionKey, session.sessionTopic = key, topic
+	session.UpdatedAt = s.now().UTC()
+	if err := updateWalletConnectSession(session); err != nil {
+		log.Printf("Failed to update WalletConnect session %s: %v", session.ID, err)
+		return
+	}
+	if err := s.relay.subscribe(ctx, topic); err != nil {
+		log.Printf("Failed to subscribe to WalletConnect session %s: %v", session.ID, err)
+	}
+}
+
+// handleRequestResponse records the hash of a call the wallet sent, and
+// requests the next one, or the wallet's rejection
+func (s *walletConnectService) handleRequestResponse(ctx context.Context, session *WalletConnectSession, request *WalletConnectRequest, payload *wcRPC) {
+	if request.Status != WCRequestPending {
+		return
+	}
+	var hash string
+	switch {
+	case payload.Error != nil:
+		request.Status = WCRequestRejected
+		request.Error = payload.Error.Message
+	case json.Unmarshal(payload.Result, &hash) != nil || len(common.FromHex(hash)) != common.HashLength:
+		request.Status = WCRequestRejected
+		request.Error = "wallet returned an invalid transaction hash"
+	default:
+		request.Calls[request.step()].TxHash = strings.ToLower(hash)
+		if request.step() == len(request.Calls) {
+			request.Status = WCRequestApproved
+		} else {
+			request.rpcID = wcPayloadID()
+			if err := s.sendCall(ctx, session, request); err != nil {
+				request.Status = WCRequestRejected
+				request.Error = fmt.Sprintf("failed to request the next transaction: %v", err)
+			}
+		}
+	}
+	request.UpdatedAt = s.now().UTC()
+	if err := updateWalletConnectRequest(request); err != nil {
+		log.Printf("Failed to update WalletConnect request %s: %v", request.ID, err)
+		return
+	}
+	log.Printf("WalletConnect request %s: %s", request.ID, request.Status)
+}
+
+// handleRequest answers a request from the wallet
+func (s *walletConnectService) handleRequest(ctx context.Context, session *WalletConnectSession, topic string, key []byte, payload *wcRPC) {
+	switch payload.Method {
+	case "wc_sessionSettle":
+		var params struct {
+			Namespaces map[string]wcNamespace `json:"namespaces"`
+			Controller struct {
+				Metadata wcMetadata `json:"metadata"`
+			} `json:"controller"`
+			Expiry int64 `json:"expiry"`
+		}
+		if err := json.Unmarshal(payload.Params, &params); err != nil || topic != session.sessionTopic || session.Status != WCSessionProposed {
+			s.respond(ctx, topic, key, payload, nil, &wcRPCError{Code: wcErrorUnsupportedMethod, Message: "Invalid settlement"})
+			return
+		}
+		session.Wallet = params.Controller.Metadata.Name
+		session.ExpiresAt = time.Unix(params.Expiry, 0).UTC()
+		s.setAccounts(session, params.Namespaces)
+		if session.Address == "" {
+			s.respond(ctx, topic, key, payload, nil, &wcRPCError{Code: wcErrorUnsupportedChains, Message: "No account on " + s.caip2()})
+			s.end(ctx, session, WCSessionRejected, "wallet has no account on "+s.caip2())
+			return
+		}
+		session.Status = WCSessionActive
+		session.UpdatedAt = s.now().UTC()
+		if err := updateWalletConnectSession(session); err != nil {
+			log.Printf("Failed to update WalletConnect session %s: %v", session.ID, err)
+		}
+		s.respond(ctx, topic, key, payload, true, nil)
+		log.Printf("WalletConnect session %s settled with %s for %s", session.ID, session.Wallet, session.Address)
+
+	case "wc_sessionUpdate":
+		var params struct {
+			Namespaces map[string]wcNamespace `json:"namespaces"`
+		}
+		if err := json.Unmarshal(payload.Params, &params); err == nil {
+			s.setAccounts(session, params.Namespaces)
+			session.UpdatedAt = s.now().UTC()
+			if err := updateWalletConnectSession(session); err != nil {
+				log.Printf("Failed to update WalletConnect session %s: %v", session.ID, err)
+			}
+		}
+		s.respond(ctx, topic, key, payload, true, nil)
+
+	case "wc_sessionExtend":
+		var params struct {
+			Expiry int64 `json:"expiry"`
+		}
+		if err := json.Unmarshal(payload.Params, &params); err == nil && params.Expiry > session.ExpiresAt.Unix() {
+			session.ExpiresAt = time.Unix(params.Expiry, 0).UTC()
+			session.UpdatedAt = s.now().UTC()
+			if err := updateWalletConnectSession(session); err != nil {
+				log.Printf("Failed to update WalletConnect session %s: %v", session.ID, err)
+			}
+		}
+		s.respond(ctx, topic, key, payload, true, nil)
+
+	case "wc_sessionDelete", "wc_pairingDelete":
+		var params struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(payload.Params, &params)
+		s.respond(ctx, topic, key, payload, true, nil)
+		if session.Status == WCSessionProposed || session.Status == WCSessionActive {
+			s.end(ctx, session, WCSessionDeleted, params.Message)
+		}
+
+	case "wc_sessionPing", "wc_pairingPing", "wc_sessionEvent":
+		s.respond(ctx, topic, key, payload, true, nil)
+
+	default:
+		s.respond(ctx, topic, key, payload, nil, &wcRPCError{Code: wcErrorUnsupportedMethod, Message: "Unsupported method " + payload.Method})
+	}
+}
+
+// setAccounts keeps the session's eip155 accounts, and its address on the
+// service's chain
+func (s *walletConnectService) setAccounts(session *WalletConnectSession, namespaces map[string]wcNamespace) {
+	session.Accounts = []string{}
+	session.Address = ""
+	prefix := s.caip2() + ":"
+	for _, account := range namespaces["eip155"].Accounts {
+		session.Accounts = append(session.Accounts, account)
+		if address := strings.TrimPrefix(account, prefix); session.Address == "" && address != account && common.IsHexAddress(address) {
+			session.Address = strings.ToLower(address)
+		}
+	}
+}
+
+// track listens to the topics of live sessions and expires sessions and
+// requests until ctx is done. It keeps the relay connected when the relay
+// needs it.
+func (s *walletConnectService) track(ctx context.Context) {
+	if runner, ok := s.relay.(interface{ run(context.Context) }); ok {
+		go runner.run(ctx)
+	}
+	sessions, err := queryWalletConnectSessions(`WHERE status IN (?, ?)`, WCSessionProposed, WCSessionActive)
+	if err != nil {
+		log.Printf("Failed to load WalletConnect sessions: %v", err)
+	}
+	for _, session := range sessions {
+		for _, topic := range []string{session.pairingTopic, session.sessionTopic} {
+			if topic == "" {
+				continue
+			}
+			if err := s.relay.subscribe(ctx, topic); err != nil {
+				log.Printf("Failed to subscribe to WalletConnect topic %s: %v", topic, err)
+			}
+		}
+	}
+
+	ticker := time.NewTicker(walletConnectExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.expire(ctx)
+		}
+	}
+}
+
+// expire ends sessions and requests past their expiry
+func (s *walletConnectService) expire(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now().UTC()
+
+	sessions, err := queryWalletConnectSessions(`WHERE status IN (?, ?) AND expires_at <= ?`, WCSessionProposed, WCSessionActive, now)
+	if err != nil {
+		log.Printf("Failed to load expired WalletConnect sessions: %v", err)
+		return
+	}
+	for _, session := range sessions {
+		s.end(ctx, session, WCSessionExpired, "")
+	}
+	if _, err := db.Exec(`UPDATE walletconnect_requests SET status = ?, updated_at = ? WHERE status = ? AND expires_at <= ?`,
+		WCRequestExpired, now, WCRequestPending, now); err != nil {
+		log.Printf("Failed to expire WalletConnect requests: %v", err)
+	}
+}
+
+// walletConnectCalls returns the transactions an account sends to create a
+// payment. Native payments send the amount plus fee with createPayment;
+// token payments approve PaymentCore for it first.
+func walletConnectCalls(paymentCore common.Address, payment *WalletConnectPaymentRequest, amount *big.Int) ([]WalletConnectCall, error) {
+	create, err := paymentCoreABI.Pack("createPayment",
+		common.HexToAddress(payment.Recipient),
+		common.HexToAddress(payment.Token),
+		amount,
+		payment.MetadataURI,
+		payment.SenderENS,
+		payment.RecipientENS,
+	)
+	if err != nil {
+		return nil, err
+	}
+	total := new(big.Int).Add(amount, paymentFee(amount))
+
+	token := common.HexToAddress(payment.Token)
+	if token == (common.Address{}) {
+		return []WalletConnectCall{{To: strings.ToLower(paymentCore.Hex()), Data: hexutil.Encode(create), Value: hexutil.EncodeBig(total)}}, nil
+	}
+	approve, err := erc20ABI.Pack("approve", paymentCore, total)
+	if err != nil {
+		return nil, err
+	}
+	return []WalletConnectCall{
+		{To: strings.ToLower(token.Hex()), Data: hexutil.Encode(approve), Value: "0x0"},
+		{To: strings.ToLower(paymentCore.Hex()), Data: hexutil.Encode(create), Value: "0x0"},
+	}, nil
+}
+
+func storeWalletConnectSession(session *WalletConnectSession) error {
+	accounts, err := json.Marshal(session.Accounts)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO walletconnect_sessions (id, chain_id, status, address, accounts, wallet, reason, pairing_topic, pairing_key,
+		private_key, proposal_id, session_topic, session_key, expires_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.ChainID, session.Status, session.Address, string(accounts), session.Wallet, session.Reason,
+		session.pairingTopic, hex.EncodeToString(session.pairingKey), hex.EncodeToString(session.privateKey.Bytes()), session.proposalID,
+		session.sessionTopic, hex.EncodeToString(session.sessionKey), session.ExpiresAt, session.CreatedAt, session.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store WalletConnect session: %w", err)
+	}
+	return nil
+}
+
+func updateWalletConnectSession(session *WalletConnectSession) error {
+	accounts, err := json.Marshal(session.Accounts)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE walletconnect_sessions SET status = ?, address = ?, accounts = ?, wallet = ?, reason = ?, session_topic = ?,
+		session_key = ?, expires_at = ?, updated_at = ? WHERE id = ?`,
+		session.Status, session.Address, string(accounts), session.Wallet, session.Reason, session.sessionTopic,
+		hex.EncodeToString(session.sessionKey), session.ExpiresAt, session.UpdatedAt, session.ID)
+	return err
+}
+
+func getWalletConnectSession(id string) (*WalletConnectSession, error) {
+	sessions, err := queryWalletConnectSessions(`WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, errWalletConnectSessionNotFound
+	}
+	return sessions[0], nil
+}
+
+func getWalletConnectSessionByTopic(topic string) (*WalletConnectSession, error) {
+	sessions, err := queryWalletConnectSessions(`WHERE pairing_topic = ? OR session_topic = ?`, topic, topic)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, errWalletConnectSessionNotFound
+	}
+	return sessions[0], nil
+}
+
+func queryWalletConnectSessions(where string, args ...interface{}) ([]*WalletConnectSession, error) {
+	rows, err := db.Query(`SELECT id, chain_id, status, address, accounts, wallet, reason, pairing_topic, pairing_key, private_key,
+		proposal_id, session_topic, session_key, expires_at, created_at, updated_at FROM walletconnect_sessions `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*WalletConnectSession
+	for rows.Next() {
+		var session WalletConnectSession
+		var accounts, pairingKey, privateKey, sessionKey string
+		if err := rows.Scan(&session.ID, &session.ChainID, &session.Status, &session.Address, &accounts, &session.Wallet, &session.Reason,
+			&session.pairingTopic, &pairingKey, &privateKey, &session.proposalID, &session.sessionTopic, &sessionKey,
+			&session.ExpiresAt, &session.CreatedAt, &session.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(accounts), &session.Accounts); err != nil {
+			return nil, err
+		}
+		if session.pairingKey, err = hex.DecodeString(pairingKey); err != nil {
+			return nil, err
+		}
+		if session.sessionKey, err = hex.DecodeString(sessionKey); err != nil {
+			return nil, err
+		}
+		private, err := hex.DecodeString(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		if session.privateKey, err = ecdh.X25519().NewPrivateKey(private); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	return sessions, rows.Err()
+}
+
+func storeWalletConnectRequest(request *WalletConnectRequest) error {
+	calls, err := json.Marshal(request.Calls)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO walletconnect_requests (id, session_id, rpc_id, sender, recipient, token, amount, metadata_uri, calls,
+		status, error, expires_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		request.ID, request.SessionID, request.rpcID, request.Sender, request.Recipient, request.Token, request.Amount, request.MetadataURI,
+		string(calls), request.Status, request.Error, request.ExpiresAt, request.CreatedAt, request.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store WalletConnect request: %w", err)
+	}
+	return nil
+}
+
+func updateWalletConnectRequest(request *WalletConnectRequest) error {
+	calls, err := json.Marshal(request.Calls)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE walletconnect_requests SET rpc_id = ?, calls = ?, status = ?, error = ?, updated_at = ? WHERE id = ?`,
+		request.rpcID, string(calls), request.Status, request.Error, request.UpdatedAt, request.ID)
+	return err
+}
+
+func getWalletConnectRequest(id string) (*WalletConnectRequest, error) {
+	return queryWalletConnectRequest(`WHERE id = ?`, id)
+}
+
+func getWalletConnectRequestByRPCID(rpcID int64) (*WalletConnectRequest, error) {
+	return queryWalletConnectRequest(`WHERE rpc_id = ?`, rpcID)
+}
+
+func queryWalletConnectRequest(where string, args ...interface{}) (*WalletConnectRequest, error) {
+	var request WalletConnectRequest
+	var calls string
+	err := db.QueryRow(`SELECT id, session_id, rpc_id, sender, recipient, token, amount, metadata_uri, calls, status, error,
+		expires_at, created_at, updated_at FROM walletconnect_requests `+where, args...).Scan(
+		&request.ID, &request.SessionID, &request.rpcID, &request.Sender, &request.Recipient, &request.Token, &request.Amount,
+		&request.MetadataURI, &calls, &request.Status, &request.Error, &request.ExpiresAt, &request.CreatedAt, &request.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errWalletConnectRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(calls), &request.Calls); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	mathrand "math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// WalletConnect v2 messages travel through the relay (the irn protocol) as
+// JSON-RPC payloads encrypted with ChaCha20-Poly1305 under the symmetric key
+// of their topic. The relay authenticates clients with a JWT signed by an
+// Ed25519 key, identified as a did:key.
+
+const defaultWalletConnectRelayURL = "wss://relay.walletconnect.org"
+
+// wcEnvelopeType0 is a message sealed with the topic's symmetric key
+const wcEnvelopeType0 = 0
+
+// wcRelayTimeout bounds each call to the relay
+const wcRelayTimeout = 15 * time.Second
+
+var errRelayDisconnected = errors.New("not connected to the WalletConnect relay")
+
+// wcRelay publishes to and subscribes to topics on the WalletConnect relay.
+// Messages published to subscribed topics are handed to the service.
+type wcRelay interface {
+	subscribe(ctx context.Context, topic string) error
+	unsubscribe(ctx context.Context, topic string) error
+	publish(ctx context.Context, topic, message string, ttl time.Duration, tag int) error
+}
+
+// wcRPC is a WalletConnect or relay JSON-RPC request or response
+type wcRPC struct {
+	ID      int64           `json:"id"`
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *wcRPCError     `json:"error,omitempty"`
+}
+
+type wcRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *wcRPCError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// wcPayloadID returns a JSON-RPC id the way WalletConnect clients make them:
+// the time in milliseconds followed by three random digits
+func wcPayloadID() int64 {
+	return time.Now().UnixMilli()*1000 + mathrand.Int63n(1000)
+}
+
+// wcSeal encrypts a payload for a topic as a type 0 envelope
+func wcSeal(symKey, payload []byte) (string, error) {
+	aead, err := chacha20poly1305.New(symKey)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, chacha20poly1305.NonceSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	envelope := append([]byte{wcEnvelopeType0}, iv...)
+	envelope = aead.Seal(envelope, iv, payload, nil)
+	return base64.StdEncoding.EncodeToString(envelope), nil
+}
+
+// wcOpen decrypts a type 0 envelope
+func wcOpen(symKey []byte, message string) ([]byte, error) {
+	envelope, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope) < 1+chacha20poly1305.NonceSize || envelope[0] != wcEnvelopeType0 {
+		return nil, errors.New("unsupported envelope")
+	}
+	aead, err := chacha20poly1305.New(symKey)
+	if err != nil {
+		return nil, err
+	}
+	iv := envelope[1 : 1+chacha20poly1305.NonceSize]
+	return aead.Open(nil, iv, envelope[1+chacha20poly1305.NonceSize:], nil)
+}
+
+// wcSessionKey derives the session's symmetric key and topic from our
+// X25519 key and the wallet's public key
+func wcSessionKey(private *ecdh.PrivateKey, peerPublicKey string) ([]byte, string, error) {
+	peer, err := hex.DecodeString(peerPublicKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid public key: %w", err)
+	}
+	public, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid public key: %w", err)
+	}
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, "", err
+	}
+	symKey, err := hkdf.Key(sha256.New, shared, nil, "", 32)
+	if err != nil {
+		return nil, "", err
+	}
+	topic := sha256.Sum256(symKey)
+	return symKey, hex.EncodeToString(topic[:]), nil
+}
+
+// irnRelay is a connection to the WalletConnect relay. It reconnects when
+// the connection drops and subscribes to its topics again.
+type irnRelay struct {
+	url       string
+	projectID string
+	key       ed25519.PrivateKey
+	handler   func(topic, message string)
+
+	mutex      sync.Mutex
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+	pending    map[int64]chan *wcRPC
+	topics     map[string]bool
+}
+
+func newIRNRelay(relayURL, projectID string, handler func(topic, message string)) (*irnRelay, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &irnRelay{
+		url:       relayURL,
+		projectID: projectID,
+		key:       key,
+		handler:   handler,
+		pending:   make(map[int64]chan *wcRPC),
+		topics:    make(map[string]bool),
+	}, nil
+}
+
+// run keeps the relay connected until ctx is done
+func (r *irnRelay) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		err := r.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("WalletConnect relay connection lost, reconnecting in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// connect dials the relay, subscribes to the topics and reads messages
+// until the connection fails
+func (r *irnRelay) connect(ctx context.Context) error {
+	token, err := r.authToken(time.Now())
+	if err != nil {
+		return err
+	}
+	query := url.Values{"auth": {token}, "projectId": {r.projectID}}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, r.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
+	// Messages are handled in order, apart from the reads, since handling
+	// them publishes to the relay
+	messages := make(chan [2]string, 256)
+	defer close(messages)
+	go func() {
+		for message := range messages {
+			r.handler(message[0], message[1])
+		}
+	}()
+
+	r.mutex.Lock()
+	r.conn = conn
+	topics := make([]string, 0, len(r.topics))
+	for topic := range r.topics {
+		topics = append(topics, topic)
+	}
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		r.conn = nil
+		r.mutex.Unlock()
+	}()
+
+	go func() {
+		for _, topic := range topics {
+			if _, err := r.call(ctx, "irn_subscribe", map[string]string{"topic": topic}); err != nil {
+				log.Printf("Failed to subscribe to WalletConnect topic %s: %v", topic, err)
+			}
+		}
+		log.Printf("Connected to the WalletConnect relay, %d topics", len(topics))
+	}()
+
+	for {
+		var payload wcRPC
+		if err := conn.ReadJSON(&payload); err != nil {
+			return err
+		}
+		if payload.Method == "" {
+			r.mutex.Lock()
+			response, ok := r.pending[payload.ID]
+			delete(r.pending, payload.ID)
+			r.mutex.Unlock()
+			if ok {
+				response <- &payload
+			}
+			continue
+		}
+		if payload.Method != "irn_subscription" {
+			continue
+		}
+
+		var params struct {
+			Data struct {
+				Topic   string `json:"topic"`
+				Message string `json:"message"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(payload.Params, &params); err != nil {
+			log.Printf("Invalid WalletConnect relay message: %v", err)
+			continue
+		}
+		if err := r.write(&wcRPC{ID: payload.ID, JSONRPC: "2.0", Result: json.RawMessage("true")}); err != nil {
+			return err
+		}
+		messages <- [2]string{params.Data.Topic, params.Data.Message}
+	}
+}
+
+func (r *irnRelay) write(payload *wcRPC) error {
+	r.mutex.Lock()
+	conn := r.conn
+	r.mutex.Unlock()
+	if conn == nil {
+		return errRelayDisconnected
+	}
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+	return conn.WriteJSON(payload)
+}
+
+// call sends a request to the relay and waits for its response
+func (r *irnRelay) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	request := &wcRPC{ID: wcPayloadID(), JSONRPC: "2.0", Method: method, Params: encoded}
+	response := make(chan *wcRPC, 1)
+	r.mutex.Lock()
+	r.pending[request.ID] = response
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.pending, request.ID)
+		r.mutex.Unlock()
+	}()
+
+	if err := r.write(request); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, wcRelayTimeout)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s: %w", method, ctx.Err())
+	case payload := <-response:
+		if payload.Error != nil {
+			return nil, fmt.Errorf("%s: %w", method, payload.Error)
+		}
+		return payload.Result, nil
+	}
+}
+
+// subscribe subscribes to topic now, or when the relay is connected again
+func (r *irnRelay) subscribe(ctx context.Context, topic string) error {
+	r.mutex.Lock()
+	r.topics[topic] = true
+	r.mutex.Unlock()
+	_, err := r.call(ctx, "irn_subscribe", map[string]string{"topic": topic})
+	if errors.Is(err, errRelayDisconnected) {
+		return nil
+	}
+	return err
+}
+
+func (r *irnRelay) unsubscribe(ctx context.Context, topic string) error {
+	r.mutex.Lock()
+	delete(r.topics, topic)
+	r.mutex.Unlock()
+	_, err := r.call(ctx, "irn_unsubscribe", map[string]string{"topic": topic})
+	if errors.Is(err, errRelayDisconnected) {
+		return nil
+	}
+	return err
+}
+
+func (r *irnRelay) publish(ctx context.Context, topic, message string, ttl time.Duration, tag int) error {
+	_, err := r.call(ctx, "irn_publish", map[string]interface{}{
+		"topic":   topic,
+		"message": message,
+		"ttl":     int64(ttl.Seconds()),
+		"tag":     tag,
+		"prompt":  true,
+	})
+	return err
+}
+
+// authToken signs the JWT the relay authenticates the connection with
+func (r *irnRelay) authToken(now time.Time) (string, error) {
+	subject := make([]byte, 32)
+	if _, err := rand.Read(subject); err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": didKey(r.key.Public().(ed25519.PublicKey)),
+		"sub": hex.EncodeToString(subject),
+		"aud": r.url,
+		"iat": now.Unix(),
+		"exp": now.Add(24 * time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	signature := ed25519.Sign(r.key, []byte(data))
+	return data + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// didKey is the did:key of an Ed25519 public key: the multicodec prefix
+// 0xed01 and the key, base58btc encoded
+func didKey(public ed25519.PublicKey) string {
+	return "did:key:z" + base58Encode(append([]byte{0xed, 0x01}, public...))
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Encode(data []byte) string {
+	value := new(big.Int).SetBytes(data)
+	base, mod := big.NewInt(58), new(big.Int)
+	var encoded []byte
+	for value.Sign() > 0 {
+		value.DivMod(value, base, mod)
+		encoded = append(encoded, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
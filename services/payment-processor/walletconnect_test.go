@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const wcPaymentCore = "0x00000000000000000000000000000000000000c0"
+
+// wcMessage is a message published to the relay
+type wcMessage struct {
+	topic   string
+	message string
+	tag     int
+}
+
+// fakeRelay keeps what the service subscribes to and publishes
+type fakeRelay struct {
+	mutex     sync.Mutex
+	topics    map[string]bool
+	published []wcMessage
+}
+
+func (r *fakeRelay) subscribe(ctx context.Context, topic string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.topics[topic] = true
+	return nil
+}
+
+func (r *fakeRelay) unsubscribe(ctx context.Context, topic string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.topics, topic)
+	return nil
+}
+
+func (r *fakeRelay) publish(ctx context.Context, topic, message string, ttl time.Duration, tag int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.published = append(r.published, wcMessage{topic: topic, message: message, tag: tag})
+	return nil
+}
+
+// last decrypts the last message published and checks its tag
+func (r *fakeRelay) last(t *testing.T, key []byte, tag int) (string, *wcRPC) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	require.NotEmpty(t, r.published)
+	message := r.published[len(r.published)-1]
+	assert.Equal(t, tag, message.tag)
+	decrypted, err := wcOpen(key, message.message)
+	require.NoError(t, err)
+	var payload wcRPC
+	require.NoError(t, json.Unmarshal(decrypted, &payload))
+	return message.topic, &payload
+}
+
+func setupWalletConnectTest(t *testing.T) (*walletConnectService, *fakeRelay, *time.Time) {
+	setupTestDB(t)
+
+	clock, now := fixedClock(time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC))
+	relay := &fakeRelay{topics: make(map[string]bool)}
+	service := &walletConnectService{
+		relay:       relay,
+		metadata:    wcMetadata{Name: "CrossPay Protocol"},
+		chainID:     4202,
+		paymentCore: common.HexToAddress(wcPaymentCore),
+		proposalTTL: defaultWalletConnectProposalTTL,
+		requestTTL:  defaultWalletConnectRequestTTL,
+		now:         clock,
+	}
+	setGlobal(t, &walletConnect, service)
+	return service, relay, now
+}
+
+// wcWallet is the wallet side of a session
+type wcWallet struct {
+	service      *walletConnectService
+	relay        *fakeRelay
+	pairingTopic string
+	pairingKey   []byte
+	sessionTopic string
+	sessionKey   []byte
+}
+
+// pairWallet pairs a session and lets the wallet approve it with accounts
+func pairWallet(t *testing.T, service *walletConnectService, relay *fakeRelay, accounts ...string) (*WalletConnectSession, *wcWallet) {
+	session, uri, err := service.pair(context.Background())
+	require.NoError(t, err)
+
+	parsed, err := url.Parse(uri)
+	require.NoError(t, err)
+	wallet := &wcWallet{service: service, relay: relay, pairingTopic: strings.TrimSuffix(parsed.Opaque, "@2")}
+	wallet.pairingKey, err = hex.DecodeString(parsed.Query().Get("symKey"))
+	require.NoError(t, err)
+
+	topic, proposal := relay.last(t, wallet.pairingKey, 1100)
+	assert.Equal(t, wallet.pairingTopic, topic)
+	assert.Equal(t, "wc_sessionPropose", proposal.Method)
+	var params struct {
+		Proposer struct {
+			PublicKey string `json:"publicKey"`
+		} `json:"proposer"`
+	}
+	require.NoError(t, json.Unmarshal(proposal.Params, &params))
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	wallet.sessionKey, wallet.sessionTopic, err = wcSessionKey(private, params.Proposer.PublicKey)
+	require.NoError(t, err)
+	wallet.send(t, wallet.pairingTopic, wallet.pairingKey, &wcRPC{ID: proposal.ID, JSONRPC: "2.0",
+		Result: json.RawMessage(`{"relay":{"protocol":"irn"},"responderPublicKey":"` + hex.EncodeToString(private.PublicKey().Bytes()) + `"}`)})
+
+	namespaces, err := json.Marshal(map[string]wcNamespace{"eip155": {Accounts: accounts, Methods: []string{"eth_sendTransaction"}, Events: []string{}}})
+	require.NoError(t, err)
+	wallet.send(t, wallet.sessionTopic, wallet.sessionKey, &wcRPC{ID: wcPayloadID(), JSONRPC: "2.0", Method: "wc_sessionSettle",
+		Params: json.RawMessage(`{"namespaces":` + string(namespaces) + `,"controller":{"metadata":{"name":"Test Wallet"}},"expiry":` +
+			"1742558400}")})
+	return session, wallet
+}
+
+func (w *wcWallet) send(t *testing.T, topic string, key []byte, payload *wcRPC) {
+	encoded, err := json.Marshal(payload)
+	require.NoError(t, err)
+	message, err := wcSeal(key, encoded)
+	require.NoError(t, err)
+	w.service.handle(topic, message)
+}
+
+// answer answers the last transaction the service requested with a hash, or
+// rejects it
+func (w *wcWallet) answer(t *testing.T, hash string) map[string]string {
+	topic, request := w.relay.last(t, w.sessionKey, 1108)
+	assert.Equal(t, w.sessionTopic, topic)
+	var params struct {
+		ChainID string `json:"chainId"`
+		Request struct {
+			Method string              `json:"method"`
+			Params []map[string]string `json:"params"`
+		} `json:"request"`
+	}
+	require.NoError(t, json.Unmarshal(request.Params, &params))
+	assert.Equal(t, "eip155:4202", params.ChainID)
+	assert.Equal(t, "eth_sendTransaction", params.Request.Method)
+	require.Len(t, params.Request.Params, 1)
+
+	response := &wcRPC{ID: request.ID, JSONRPC: "2.0", Result: json.RawMessage(`"` + hash + `"`)}
+	if hash == "" {
+		response = &wcRPC{ID: request.ID, JSONRPC: "2.0", Error: &wcRPCError{Code: 5000, Message: "User rejected."}}
+	}
+	w.send(t, w.sessionTopic, w.sessionKey, response)
+	return params.Request.Params[0]
+}
+
+func TestWalletConnectEnvelope(t *testing.T) {
+	t.Run("should open what it seals and reject other keys", func(t *testing.T) {
+		key := bytes.Repeat([]byte{1}, 32)
+		message, err := wcSeal(key, []byte(`{"id":1}`))
+		require.NoError(t, err)
+
+		opened, err := wcOpen(key, message)
+		require.NoError(t, err)
+		assert.Equal(t, `{"id":1}`, string(opened))
+		_, err = wcOpen(bytes.Repeat([]byte{2}, 32), message)
+		assert.Error(t, err)
+	})
+
+	t.Run("should derive the same session from both sides", func(t *testing.T) {
+		dapp, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		wallet, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		key, topic, err := wcSessionKey(dapp, hex.EncodeToString(wallet.PublicKey().Bytes()))
+		require.NoError(t, err)
+		walletKey, walletTopic, err := wcSessionKey(wallet, hex.EncodeToString(dapp.PublicKey().Bytes()))
+		require.NoError(t, err)
+		assert.Equal(t, key, walletKey)
+		assert.Equal(t, topic, walletTopic)
+		assert.Len(t, topic, 64)
+	})
+}
+
+func TestWalletConnectSessions(t *testing.T) {
+	sender := strings.ToLower(kycSender)
+
+	t.Run("should settle sessions with the wallet's account on the chain", func(t *testing.T) {
+		service, relay, _ := setupWalletConnectTest(t)
+
+		session, wallet := pairWallet(t, service, relay, "eip155:1:0x00000000000000000000000000000000000000a9", "eip155:4202:"+kycSender)
+		_, response := relay.last(t, wallet.sessionKey, 1103)
+		assert.Equal(t, "true", string(response.Result))
+
+		settled, err := getWalletConnectSession(session.ID)
+		require.NoError(t, err)
+		assert.Equal(t, WCSessionActive, settled.Status)
+		assert.Equal(t, sender, settled.Address)
+		assert.Equal(t, "Test Wallet", settled.Wallet)
+		assert.Len(t, settled.Accounts, 2)
+		assert.Equal(t, int64(1742558400), settled.ExpiresAt.Unix())
+		assert.True(t, relay.topics[wallet.sessionTopic])
+	})
+
+	t.Run("should reject sessions without an account on the chain", func(t *testing.T) {
+		service, relay, _ := setupWalletConnectTest(t)
+
+		session, wallet := pairWallet(t, service, relay, "eip155:1:"+kycSender)
+		_, response := relay.last(t, wallet.sessionKey, 1103)
+		require.NotNil(t, response.Error)
+		assert.Equal(t, wcErrorUnsupportedChains, response.Error.Code)
+
+		rejected, err := getWalletConnectSession(session.ID)
+		require.NoError(t, err)
+		assert.Equal(t, WCSessionRejected, rejected.Status)
+		assert.Empty(t, relay.topics)
+	})
+
+	t.Run("should end sessions the wallet deletes, disconnects or lets expire", func(t *testing.T) {
+		service, relay, clock := setupWalletConnectTest(t)
+		ctx := context.Background()
+
+		deleted, wallet := pairWallet(t, service, relay, "eip155:4202:"+kycSender)
+		wallet.send(t, wallet.sessionTopic, wallet.sessionKey, &wcRPC{ID: wcPayloadID(), JSONRPC: "2.0", Method: "wc_sessionDelete",
+			Params: json.RawMessage(`{"code":6000,"message":"User disconnected."}`)})
+		session, err := getWalletConnectSession(deleted.ID)
+		require.NoError(t, err)
+		assert.Equal(t, WCSessionDeleted, session.Status)
+		assert.Equal(t, "User disconnected.", session.Reason)
+
+		disconnected, wallet := pairWallet(t, service, relay, "eip155:4202:"+kycSender)
+		_, err = service.disconnect(ctx, disconnected.ID)
+		require.NoError(t, err)
+		_, request := relay.last(t, wallet.sessionKey, 1112)
+		assert.Equal(t, "wc_sessionDelete", request.Method)
+		_, err = service.disconnect(ctx, disconnected.ID)
+		assert.ErrorIs(t, err, errWalletConnectSessionInactive)
+
+		proposed, _, err := service.pair(ctx)
+		require.NoError(t, err)
+		*clock = clock.Add(defaultWalletConnectProposalTTL)
+		service.expire(ctx)
+		session, err = getWalletConnectSession(proposed.ID)
+		require.NoError(t, err)
+		assert.Equal(t, WCSessionExpired, session.Status)
+		assert.Empty(t, relay.topics)
+	})
+}
+
+func TestWalletConnectRequests(t *testing.T) {
+	ctx := context.Background()
+	sender := strings.ToLower(kycSender)
+	recipient := "0x00000000000000000000000000000000000000b1"
+	hash := func(b byte) string { return "0x" + strings.Repeat(hex.EncodeToString([]byte{b}), 32) }
+
+	t.Run("should approve token payments once the wallet sends both transactions", func(t *testing.T) {
+		service, relay, _ := setupWalletConnectTest(t)
+		session, wallet := pairWallet(t, service, relay, "eip155:4202:"+kycSender)
+
+		request, err := service.pushPayment(ctx, &WalletConnectPaymentRequest{SessionID: session.ID, Recipient: recipient, Token: kycUSDC},
+			big.NewInt(1_000_000))
+		require.NoError(t, err)
+		require.Len(t, request.Calls, 2)
+		assert.Equal(t, sender, request.Sender)
+
+		approve := wallet.answer(t, hash(1))
+		assert.Equal(t, sender, approve["from"])
+		assert.Equal(t, strings.ToLower(kycUSDC), approve["to"])
+		assert.Equal(t, "0x0", approve["value"])
+		request, err = getWalletConnectRequest(request.ID)
+		require.NoError(t, err)
+		assert.Equal(t, WCRequestPending, request.Status)
+
+		create := wallet.answer(t, hash(2))
+		assert.Equal(t, wcPaymentCore, create["to"])
+		request, err = getWalletConnectRequest(request.ID)
+		require.NoError(t, err)
+		assert.Equal(t, WCRequestApproved, request.Status)
+		assert.Equal(t, hash(1), request.Calls[0].TxHash)
+		assert.Equal(t, hash(2), request.Calls[1].TxHash)
+	})
+
+	t.Run("should send native payments with their fee and record rejections", func(t *testing.T) {
+		service, relay, _ := setupWalletConnectTest(t)
+		session, wallet := pairWallet(t, service, relay, "eip155:4202:"+kycSender)
+
+		request, err := service.pushPayment(ctx, &WalletConnectPaymentRequest{SessionID: session.ID, Recipient: recipient,
+			Token: "0x0000000000000000000000000000000000000000"}, big.NewInt(1_000_000))
+		require.NoError(t, err)
+		require.Len(t, request.Calls, 1)
+
+		call := wallet.answer(t, "")
+		assert.Equal(t, "0xf4628", call["value"])
+		request, err = getWalletConnectRequest(request.ID)
+		require.NoError(t, err)
+		assert.Equal(t, WCRequestRejected, request.Status)
+		assert.Equal(t, "User rejected.", request.Error)
+	})
+
+	t.Run("should push payments through the API after checking them", func(t *testing.T) {
+		service, relay, clock := setupWalletConnectTest(t)
+		setGlobal(t, &tokens, &tokenRegistry{mode: AllowlistOff, now: time.Now})
+		setGlobal(t, &kyc, &kycService{mode: KYCOff})
+		session, _ := pairWallet(t, service, relay, "eip155:4202:"+kycSender)
+		proposed, _, err := service.pair(ctx)
+		require.NoError(t, err)
+
+		post := func(sessionID string) *httptest.ResponseRecorder {
+			body, _ := json.Marshal(WalletConnectPaymentRequest{SessionID: sessionID, Recipient: recipient, Token: kycUSDC, Amount: "1000000"})
+			w := httptest.NewRecorder()
+			handleCreateWalletConnectRequest(w, httptest.NewRequest(http.MethodPost, "/api/walletconnect/requests", bytes.NewReader(body)))
+			return w
+		}
+		assert.Equal(t, http.StatusNotFound, post("0x01").Code)
+		assert.Equal(t, http.StatusConflict, post(proposed.ID).Code)
+
+		w := post(session.ID)
+		require.Equal(t, http.StatusCreated, w.Code)
+		var response struct {
+			Request WalletConnectRequest `json:"request"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, WCRequestPending, response.Request.Status)
+
+		*clock = clock.Add(defaultWalletConnectRequestTTL)
+		service.expire(ctx)
+		w = httptest.NewRecorder()
+		handleGetWalletConnectRequest(w, httptest.NewRequest(http.MethodGet, "/api/walletconnect/requests/"+response.Request.ID, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var request WalletConnectRequest
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&request))
+		assert.Equal(t, WCRequestExpired, request.Status)
+	})
+}
@@ -0,0 +1,84 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ValidatorMetric is the body the analytics service accepts on
+// POST /api/metrics/validator
+type ValidatorMetric struct {
+	ValidatorAddr string    `json:"validator_address"`
+	ChainID       uint64    `json:"chain_id"`
+	Stake         string    `json:"stake"`
+	Status        string    `json:"status"`
+	ResponseTime  int64     `json:"response_time_ms"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// SignatureMetric is the body the analytics service accepts on
+// POST /api/metrics/signature: a share this validator signed for a payment's
+// validation request, or an aggregate it submitted. LatencyMs is the time
+// since the validator started tracking the request.
+type SignatureMetric struct {
+	RequestID     uint64    `json:"request_id"`
+	PaymentID     uint64    `json:"payment_id"`
+	ChainID       uint64    `json:"chain_id"`
+	ValidatorAddr string    `json:"validator_address"`
+	Event         string    `json:"event"`
+	Signatures    uint32    `json:"signatures,omitempty"`
+	RequiredSigs  uint32    `json:"required_signatures,omitempty"`
+	LatencyMs     int64     `json:"latency_ms,omitempty"`
+	TxHash        string    `json:"tx_hash,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// Reporter sends validator status and signatures to the analytics service
+type Reporter struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewReporter(baseURL string) *Reporter {
+	return &Reporter{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (r *Reporter) ReportValidator(ctx context.Context, metric ValidatorMetric) error {
+	return r.post(ctx, "/api/metrics/validator", metric)
+}
+
+func (r *Reporter) ReportSignature(ctx context.Context, metric SignatureMetric) error {
+	return r.post(ctx, "/api/metrics/signature", metric)
+}
+
+func (r *Reporter) post(ctx context.Context, path string, metric interface{}) error {
+	body, err := json.Marshal(metric)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metric: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send metric: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("analytics service returned status %d", resp.StatusCode)
+	}
+	return nil
+}
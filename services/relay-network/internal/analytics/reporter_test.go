@@ -0,0 +1,72 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReporter(t *testing.T) {
+	t.Run("should post validator metrics", func(t *testing.T) {
+		received := make(chan ValidatorMetric, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/api/metrics/validator", r.URL.Path)
+			var metric ValidatorMetric
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&metric))
+			received <- metric
+		}))
+		defer server.Close()
+
+		metric := ValidatorMetric{
+			ValidatorAddr: "0x0000000000000000000000000000000000000001",
+			ChainID:       1,
+			Stake:         "10000000000000000000",
+			Status:        "active",
+			ResponseTime:  12,
+			Timestamp:     time.Now().UTC().Truncate(time.Second),
+		}
+		require.NoError(t, NewReporter(server.URL+"/").ReportValidator(context.Background(), metric))
+		assert.Equal(t, metric, <-received)
+	})
+
+	t.Run("should post signature metrics", func(t *testing.T) {
+		received := make(chan SignatureMetric, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/api/metrics/signature", r.URL.Path)
+			var metric SignatureMetric
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&metric))
+			received <- metric
+		}))
+		defer server.Close()
+
+		metric := SignatureMetric{
+			RequestID:     7,
+			PaymentID:     42,
+			ChainID:       1,
+			ValidatorAddr: "0x0000000000000000000000000000000000000001",
+			Event:         "signed",
+			Signatures:    2,
+			RequiredSigs:  3,
+			LatencyMs:     150,
+			Timestamp:     time.Now().UTC().Truncate(time.Second),
+		}
+		require.NoError(t, NewReporter(server.URL).ReportSignature(context.Background(), metric))
+		assert.Equal(t, metric, <-received)
+	})
+
+	t.Run("should fail on a non-OK response", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		err := NewReporter(server.URL).ReportValidator(context.Background(), ValidatorMetric{})
+		assert.ErrorContains(t, err, "503")
+	})
+}
@@ -0,0 +1,139 @@
+package batch
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Both lanes share one bounded queue. What happens to a request submitted
+// while it is full depends on the overflow policy:
+//
+//   - reject returns an OverflowError saying when to try again
+//   - spill writes the request to disk and queues it again as room frees up
+//   - shed drops the lowest priority request: a high-value request displaces
+//     the oldest queued normal request, and a normal request is dropped itself
+
+type OverflowPolicy string
+
+const (
+	OverflowReject OverflowPolicy = "reject"
+	OverflowSpill  OverflowPolicy = "spill"
+	OverflowShed   OverflowPolicy = "shed"
+
+	defaultQueueSize = 1000
+)
+
+var (
+	ErrQueueFull = errors.New("batch processor queue full")
+	ErrShed      = errors.New("request shed from full batch queue")
+)
+
+// OverflowError rejects a request while the queue is full
+type OverflowError struct {
+	RetryAfter time.Duration
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("%v, retry after %s", ErrQueueFull, e.RetryAfter)
+}
+
+func (e *OverflowError) Unwrap() error {
+	return ErrQueueFull
+}
+
+// Spill holds requests that overflowed the queue until there is room
+type Spill interface {
+	Push(req *ValidationRequest) error
+	// Pop removes up to limit requests, high-value requests first and
+	// otherwise oldest first
+	Pop(limit int) ([]*ValidationRequest, error)
+	Len() (int, error)
+}
+
+// SpillStore keeps one chain's spilled requests in SQLite, so they also
+// survive a restart. Callbacks are not kept.
+type SpillStore struct {
+	db      *sql.DB
+	chainID int64
+}
+
+func NewSpillStore(db *sql.DB, chainID int64) (*SpillStore, error) {
+	schema := `
+	CREATE TABLE IF NOT EXISTS batch_spill (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		chain_id INTEGER NOT NULL,
+		high_value INTEGER NOT NULL,
+		request TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_batch_spill_chain ON batch_spill(chain_id, high_value, seq);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("failed to create batch spill table: %w", err)
+	}
+	return &SpillStore{db: db, chainID: chainID}, nil
+}
+
+func (s *SpillStore) Push(req *ValidationRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO batch_spill (chain_id, high_value, request) VALUES (?, ?, ?)`, s.chainID, req.IsHighValue, string(data))
+	return err
+}
+
+func (s *SpillStore) Pop(limit int) ([]*ValidationRequest, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT seq, request FROM batch_spill WHERE chain_id = ?
+		ORDER BY high_value DESC, seq LIMIT ?
+	`, s.chainID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []int64
+	var requests []*ValidationRequest
+	for rows.Next() {
+		var seq int64
+		var data string
+		if err := rows.Scan(&seq, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var req ValidationRequest
+		if err := json.Unmarshal([]byte(data), &req); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to decode spilled request %d: %w", seq, err)
+		}
+		seqs = append(seqs, seq)
+		requests = append(requests, &req)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, seq := range seqs {
+		if _, err := tx.Exec(`DELETE FROM batch_spill WHERE seq = ?`, seq); err != nil {
+			return nil, err
+		}
+	}
+	return requests, tx.Commit()
+}
+
+func (s *SpillStore) Len() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM batch_spill WHERE chain_id = ?`, s.chainID).Scan(&n)
+	return n, err
+}
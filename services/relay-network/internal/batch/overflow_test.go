@@ -0,0 +1,150 @@
+package batch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acceptOnly marks bp running without processing anything, so submitted
+// requests stay queued
+func acceptOnly(bp *BatchProcessor) {
+	bp.running = true
+}
+
+func TestBatchProcessorOverflow(t *testing.T) {
+	t.Run("should reject with a retry delay once the queue is full", func(t *testing.T) {
+		bp := NewBatchProcessor(10, 2*time.Second, nil)
+		require.NoError(t, bp.SetOverflow(2, OverflowReject, nil))
+		acceptOnly(bp)
+
+		require.NoError(t, bp.Submit(&ValidationRequest{ID: 1}))
+		require.NoError(t, bp.Submit(&ValidationRequest{ID: 2, IsHighValue: true}))
+
+		err := bp.Submit(&ValidationRequest{ID: 3})
+		var overflow *OverflowError
+		require.ErrorAs(t, err, &overflow)
+		assert.ErrorIs(t, err, ErrQueueFull)
+		assert.Equal(t, 2*time.Second, overflow.RetryAfter)
+	})
+
+	t.Run("should shed normal requests to make room for high-value ones", func(t *testing.T) {
+		bp := NewBatchProcessor(10, time.Second, nil)
+		require.NoError(t, bp.SetOverflow(2, OverflowShed, nil))
+		acceptOnly(bp)
+
+		shed := make(chan ValidationResult, 1)
+		require.NoError(t, bp.Submit(&ValidationRequest{ID: 1, Callback: shed}))
+		require.NoError(t, bp.Submit(&ValidationRequest{ID: 2}))
+
+		assert.ErrorIs(t, bp.Submit(&ValidationRequest{ID: 3}), ErrShed)
+		require.NoError(t, bp.Submit(&ValidationRequest{ID: 10, IsHighValue: true}))
+
+		result := <-shed
+		assert.Equal(t, uint64(1), result.RequestID)
+		assert.False(t, result.Success)
+		assert.Equal(t, uint64(2), (<-bp.requestChan).ID)
+		assert.Equal(t, uint64(10), (<-bp.highValueChan).ID)
+	})
+
+	t.Run("should spill to disk and process spilled requests in order", func(t *testing.T) {
+		db, err := database.Open(":memory:")
+		require.NoError(t, err)
+		defer db.Close()
+		spill, err := NewSpillStore(db, 1337)
+		require.NoError(t, err)
+
+		processor, processed := recordingProcessor()
+		bp := NewBatchProcessor(1, time.Second, processor)
+		require.NoError(t, bp.SetOverflow(1, OverflowSpill, spill))
+		acceptOnly(bp)
+
+		for id := uint64(1); id <= 3; id++ {
+			require.NoError(t, bp.Submit(&ValidationRequest{ID: id}))
+		}
+		spilled, err := spill.Len()
+		require.NoError(t, err)
+		assert.Equal(t, 2, spilled)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		bp.Start(ctx)
+
+		require.Eventually(t, func() bool { return len(processed()) == 3 }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []uint64{1, 2, 3}, processed())
+		spilled, err = spill.Len()
+		require.NoError(t, err)
+		assert.Zero(t, spilled)
+	})
+
+	t.Run("should refuse unknown policies and spill without a store", func(t *testing.T) {
+		bp := NewBatchProcessor(10, time.Second, nil)
+		assert.Error(t, bp.SetOverflow(10, "drop", nil))
+		assert.Error(t, bp.SetOverflow(10, OverflowSpill, nil))
+	})
+}
+
+func TestSpillStore(t *testing.T) {
+	db, err := database.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	store, err := NewSpillStore(db, 1337)
+	require.NoError(t, err)
+	other, err := NewSpillStore(db, 80002)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Push(&ValidationRequest{ID: 1, MessageHash: "0x01"}))
+	require.NoError(t, store.Push(&ValidationRequest{ID: 2, IsHighValue: true}))
+	require.NoError(t, store.Push(&ValidationRequest{ID: 3}))
+	require.NoError(t, other.Push(&ValidationRequest{ID: 4}))
+
+	reqs, err := store.Pop(2)
+	require.NoError(t, err)
+	require.Len(t, reqs, 2)
+	assert.Equal(t, uint64(2), reqs[0].ID)
+	assert.Equal(t, uint64(1), reqs[1].ID)
+	assert.Equal(t, "0x01", reqs[1].MessageHash)
+
+	remaining, err := store.Len()
+	require.NoError(t, err)
+	assert.Equal(t, 1, remaining)
+	remaining, err = other.Len()
+	require.NoError(t, err)
+	assert.Equal(t, 1, remaining)
+}
+
+func TestBatchProcessorAdaptiveSize(t *testing.T) {
+	bp := NewBatchProcessor(8, time.Second, nil)
+	bp.SetAdaptive(12, 100*time.Millisecond)
+	normal := &lane{size: 8}
+
+	t.Run("should shrink batches while they run over the target", func(t *testing.T) {
+		bp.latency.Store(int64(300 * time.Millisecond))
+		bp.adapt(normal, 8)
+		assert.Equal(t, 6, normal.size)
+	})
+
+	t.Run("should grow full batches that finish well under the target", func(t *testing.T) {
+		bp.latency.Store(int64(10 * time.Millisecond))
+		bp.adapt(normal, 3)
+		assert.Equal(t, 6, normal.size, "partial batches do not grow the size")
+
+		for i := 0; i < 5; i++ {
+			bp.adapt(normal, normal.size)
+		}
+		assert.Equal(t, 12, normal.size)
+	})
+
+	t.Run("should keep the size fixed without a target", func(t *testing.T) {
+		fixed := NewBatchProcessor(8, time.Second, nil)
+		fixed.latency.Store(int64(time.Minute))
+		l := &lane{size: 8}
+		fixed.adapt(l, 8)
+		assert.Equal(t, 8, l.size)
+	})
+}
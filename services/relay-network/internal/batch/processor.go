@@ -3,17 +3,25 @@ package batch
 import (
 	"context"
 	"fmt"
+	"log"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/crosspay/relay-network/internal/metrics"
 )
 
 type ValidationRequest struct {
-	ID          uint64    `json:"id"`
-	PaymentID   uint64    `json:"payment_id"`
-	MessageHash string    `json:"message_hash"`
-	Amount      uint64    `json:"amount"`
-	Timestamp   time.Time `json:"timestamp"`
-	Callback    chan ValidationResult
+	ID           uint64    `json:"id"`
+	PaymentID    uint64    `json:"payment_id"`
+	MessageHash  string    `json:"message_hash"`
+	Amount       uint64    `json:"amount"`
+	Timestamp    time.Time `json:"timestamp"`
+	RequiredSigs int       `json:"required_signatures,omitempty"`
+	Deadline     time.Time `json:"deadline,omitempty"`
+	IsHighValue  bool      `json:"is_high_value,omitempty"`
+	Callback     chan ValidationResult `json:"-"`
 }
 
 type ValidationResult struct {
@@ -22,22 +30,128 @@ type ValidationResult struct {
 	Error     string `json:"error,omitempty"`
 }
 
+// High-value requests travel in their own lane with separate batch tuning.
+// Whenever a high-value batch is ready it runs before normal requests, except
+// that after starvationLimit high-value batches in a row a ready normal batch
+// gets its turn, so a stream of high-value payments cannot stall the rest.
+
+// With a target latency set, the normal lane's batch size adapts to how
+// long recent batches took: it shrinks while batches run slower than the
+// target and grows while full batches finish in under half of it.
+
+const (
+	defaultStarvationLimit = 4
+	defaultMaxBatchSize    = 100
+	// latencyWeight is the weight of the newest batch in the moving average
+	latencyWeight = 0.2
+)
+
 type BatchProcessor struct {
-	requestChan  chan *ValidationRequest
-	batchSize    int
-	batchTimeout time.Duration
-	processor    func([]*ValidationRequest) []ValidationResult
-	mutex        sync.RWMutex
-	running      bool
+	requestChan        chan *ValidationRequest
+	highValueChan      chan *ValidationRequest
+	batchSize          int
+	batchTimeout       time.Duration
+	highValueBatchSize int
+	highValueTimeout   time.Duration
+	starvationLimit    int
+	processor          func([]*ValidationRequest) []ValidationResult
+	chain              string
+	mutex              sync.RWMutex
+	running            bool
+
+	queueSize   int
+	overflow    OverflowPolicy
+	spill       Spill
+	spilled     int
+	submitMutex sync.Mutex
+
+	maxBatchSize  int
+	targetLatency time.Duration
+	latency       atomic.Int64
+}
+
+// lane accumulates one priority class of requests into batches
+type lane struct {
+	name     string
+	requests []*ValidationRequest
+	size     int
+	timeout  time.Duration
+	deadline time.Time
 }
 
 func NewBatchProcessor(batchSize int, timeout time.Duration, processor func([]*ValidationRequest) []ValidationResult) *BatchProcessor {
 	return &BatchProcessor{
-		requestChan:  make(chan *ValidationRequest, 1000),
-		batchSize:    batchSize,
-		batchTimeout: timeout,
-		processor:    processor,
+		requestChan:        make(chan *ValidationRequest, defaultQueueSize),
+		highValueChan:      make(chan *ValidationRequest, defaultQueueSize),
+		batchSize:          batchSize,
+		batchTimeout:       timeout,
+		highValueBatchSize: batchSize,
+		highValueTimeout:   timeout,
+		starvationLimit:    defaultStarvationLimit,
+		processor:          processor,
+		queueSize:          defaultQueueSize,
+		overflow:           OverflowReject,
+		maxBatchSize:       defaultMaxBatchSize,
+	}
+}
+
+// SetHighValueLane tunes batching for high-value requests and how many
+// high-value batches may run in a row while normal requests are waiting. It
+// must be called before Start.
+func (bp *BatchProcessor) SetHighValueLane(batchSize int, timeout time.Duration, starvationLimit int) {
+	if batchSize > 0 {
+		bp.highValueBatchSize = batchSize
+	}
+	if timeout > 0 {
+		bp.highValueTimeout = timeout
+	}
+	if starvationLimit > 0 {
+		bp.starvationLimit = starvationLimit
+	}
+}
+
+// SetOverflow sizes the queue shared by both lanes and sets what happens to
+// requests submitted while it is full. The spill policy needs spill. It must
+// be called before Start.
+func (bp *BatchProcessor) SetOverflow(queueSize int, policy OverflowPolicy, spill Spill) error {
+	switch policy {
+	case OverflowReject, OverflowShed:
+	case OverflowSpill:
+		if spill == nil {
+			return fmt.Errorf("overflow policy %q needs a spill store", policy)
+		}
+		spilled, err := spill.Len()
+		if err != nil {
+			return fmt.Errorf("failed to count spilled requests: %w", err)
+		}
+		bp.spill, bp.spilled = spill, spilled
+	default:
+		return fmt.Errorf("unknown overflow policy %q", policy)
 	}
+
+	if queueSize > 0 {
+		bp.queueSize = queueSize
+		bp.requestChan = make(chan *ValidationRequest, queueSize)
+		bp.highValueChan = make(chan *ValidationRequest, queueSize)
+	}
+	bp.overflow = policy
+	return nil
+}
+
+// SetAdaptive lets the normal lane's batch size adapt, up to maxBatchSize,
+// to keep batches near the target latency. A zero target keeps the size
+// fixed. It must be called before Start.
+func (bp *BatchProcessor) SetAdaptive(maxBatchSize int, target time.Duration) {
+	if maxBatchSize > 0 {
+		bp.maxBatchSize = maxBatchSize
+	}
+	bp.targetLatency = target
+}
+
+// SetChain sets the chain ID batch metrics are labelled with. It must be
+// called before Start.
+func (bp *BatchProcessor) SetChain(chainID int64) {
+	bp.chain = strconv.FormatInt(chainID, 10)
 }
 
 func (bp *BatchProcessor) Start(ctx context.Context) {
@@ -45,6 +159,15 @@ func (bp *BatchProcessor) Start(ctx context.Context) {
 	bp.running = true
 	bp.mutex.Unlock()
 
+	metrics.BatchQueueDepth.SetFunc(func() float64 { return float64(len(bp.highValueChan)) }, bp.chain, "high_value")
+	metrics.BatchQueueDepth.SetFunc(func() float64 { return float64(len(bp.requestChan)) }, bp.chain, "normal")
+	metrics.BatchQueueDepth.SetFunc(func() float64 {
+		bp.submitMutex.Lock()
+		defer bp.submitMutex.Unlock()
+		return float64(bp.spilled)
+	}, bp.chain, "spilled")
+	metrics.BatchSizeLimit.Set(float64(bp.batchSize), bp.chain)
+
 	go bp.processBatches(ctx)
 }
 
@@ -54,6 +177,7 @@ func (bp *BatchProcessor) Stop() {
 	bp.mutex.Unlock()
 
 	close(bp.requestChan)
+	close(bp.highValueChan)
 }
 
 func (bp *BatchProcessor) Submit(req *ValidationRequest) error {
@@ -64,60 +188,318 @@ func (bp *BatchProcessor) Submit(req *ValidationRequest) error {
 		return fmt.Errorf("batch processor not running")
 	}
 
-	select {
-	case bp.requestChan <- req:
+	bp.submitMutex.Lock()
+	defer bp.submitMutex.Unlock()
+
+	// Requests queue behind spilled ones so they keep their order
+	if bp.spilled == 0 && bp.enqueue(req) {
 		return nil
+	}
+
+	switch bp.overflow {
+	case OverflowSpill:
+		if err := bp.spill.Push(req); err != nil {
+			return fmt.Errorf("failed to spill request %d: %w", req.ID, err)
+		}
+		bp.spilled++
+		metrics.BatchOverflows.Inc(bp.chain, "spilled")
+		return nil
+
+	case OverflowShed:
+		if req.IsHighValue && bp.shedNormal() && bp.enqueue(req) {
+			return nil
+		}
+		metrics.BatchOverflows.Inc(bp.chain, "shed")
+		return ErrShed
+
+	default:
+		metrics.BatchOverflows.Inc(bp.chain, "rejected")
+		return &OverflowError{RetryAfter: bp.retryAfter()}
+	}
+}
+
+// enqueue adds a request to its lane's channel if the shared queue has room.
+// Callers hold submitMutex.
+func (bp *BatchProcessor) enqueue(req *ValidationRequest) bool {
+	if len(bp.requestChan)+len(bp.highValueChan) >= bp.queueSize {
+		return false
+	}
+
+	queue := bp.requestChan
+	if req.IsHighValue {
+		queue = bp.highValueChan
+	}
+	select {
+	case queue <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// shedNormal drops the oldest queued normal request to make room
+func (bp *BatchProcessor) shedNormal() bool {
+	select {
+	case req := <-bp.requestChan:
+		metrics.BatchOverflows.Inc(bp.chain, "shed")
+		if req.Callback != nil {
+			select {
+			case req.Callback <- ValidationResult{RequestID: req.ID, Error: ErrShed.Error()}:
+			default:
+			}
+		}
+		return true
 	default:
-		return fmt.Errorf("batch processor queue full")
+		return false
+	}
+}
+
+// retryAfter estimates how long the queue takes to drain one batch's worth
+// of room, from the recent batch latency
+func (bp *BatchProcessor) retryAfter() time.Duration {
+	retry := time.Duration(bp.latency.Load())
+	if retry < bp.batchTimeout {
+		retry = bp.batchTimeout
+	}
+	if retry < time.Second {
+		retry = time.Second
+	}
+	return retry
+}
+
+// refill moves spilled requests back into the queue as room frees up
+func (bp *BatchProcessor) refill() {
+	bp.mutex.RLock()
+	defer bp.mutex.RUnlock()
+	if !bp.running {
+		return
+	}
+
+	bp.submitMutex.Lock()
+	defer bp.submitMutex.Unlock()
+
+	room := bp.queueSize - len(bp.requestChan) - len(bp.highValueChan)
+	if bp.spilled == 0 || room <= 0 {
+		return
+	}
+
+	reqs, err := bp.spill.Pop(room)
+	if err != nil {
+		log.Printf("Failed to read spilled validation requests: %v", err)
+		return
+	}
+	if len(reqs) == 0 {
+		bp.spilled = 0
+		return
+	}
+	bp.spilled -= len(reqs)
+	if bp.spilled < 0 {
+		bp.spilled = 0
+	}
+	for _, req := range reqs {
+		bp.enqueue(req)
 	}
 }
 
 func (bp *BatchProcessor) processBatches(ctx context.Context) {
-	batch := make([]*ValidationRequest, 0, bp.batchSize)
+	high := &lane{name: "high_value", size: bp.highValueBatchSize, timeout: bp.highValueTimeout}
+	normal := &lane{name: "normal", size: bp.batchSize, timeout: bp.batchTimeout}
 	timer := time.NewTimer(bp.batchTimeout)
-
 	defer timer.Stop()
+	streak := 0
 
 	for {
+		bp.refill()
+		resetTimer(timer, high, normal)
+
 		select {
 		case <-ctx.Done():
-			if len(batch) > 0 {
-				bp.executeBatch(batch)
-			}
+			// Drain requests already queued so none are dropped on shutdown
+			bp.drain(high, normal)
 			return
 
+		case req, ok := <-bp.highValueChan:
+			if !ok {
+				bp.drain(high, normal)
+				return
+			}
+			high.add(req)
+
 		case req, ok := <-bp.requestChan:
 			if !ok {
-				if len(batch) > 0 {
-					bp.executeBatch(batch)
-				}
+				bp.drain(high, normal)
 				return
 			}
+			normal.add(req)
 
-			batch = append(batch, req)
+		case <-timer.C:
+		}
+
+		for {
+			bp.collect(high, normal)
 
-			if len(batch) >= bp.batchSize {
-				bp.executeBatch(batch)
-				batch = batch[:0]
-				timer.Reset(bp.batchTimeout)
+			now := time.Now()
+			highReady, normalReady := high.ready(now), normal.ready(now)
+			if !normalReady {
+				streak = 0
 			}
 
-		case <-timer.C:
-			if len(batch) > 0 {
-				bp.executeBatch(batch)
-				batch = batch[:0]
+			if highReady && (!normalReady || streak < bp.starvationLimit) {
+				bp.executeBatch(high.name, high.take())
+				if normalReady {
+					streak++
+				}
+			} else if normalReady {
+				batch := normal.take()
+				bp.executeBatch(normal.name, batch)
+				bp.adapt(normal, len(batch))
+				streak = 0
+			} else {
+				break
 			}
-			timer.Reset(bp.batchTimeout)
 		}
 	}
 }
 
-func (bp *BatchProcessor) executeBatch(batch []*ValidationRequest) {
+// collect moves requests already queued into their lanes without blocking.
+// A lane takes at most one batch, so the backlog stays in the queue where
+// overflow handling can see it.
+func (bp *BatchProcessor) collect(high, normal *lane) {
+	highQueue, normalQueue := bp.highValueChan, bp.requestChan
+	for {
+		fromHigh, fromNormal := highQueue, normalQueue
+		if high.full() {
+			fromHigh = nil
+		}
+		if normal.full() {
+			fromNormal = nil
+		}
+		if fromHigh == nil && fromNormal == nil {
+			return
+		}
+
+		select {
+		case req, ok := <-fromHigh:
+			if !ok {
+				highQueue = nil
+				continue
+			}
+			high.add(req)
+		case req, ok := <-fromNormal:
+			if !ok {
+				normalQueue = nil
+				continue
+			}
+			normal.add(req)
+		default:
+			return
+		}
+	}
+}
+
+// drain executes everything queued, high-value requests first
+func (bp *BatchProcessor) drain(high, normal *lane) {
+	for {
+		bp.collect(high, normal)
+		if len(high.requests) == 0 && len(normal.requests) == 0 {
+			return
+		}
+		bp.flush(high, normal)
+	}
+}
+
+// adapt resizes the normal lane after one of its batches, when a target
+// latency is set
+func (bp *BatchProcessor) adapt(normal *lane, batchLen int) {
+	if bp.targetLatency <= 0 {
+		return
+	}
+
+	latency := time.Duration(bp.latency.Load())
+	switch {
+	case latency > bp.targetLatency && normal.size > 1:
+		normal.size = max(1, min(normal.size-1, normal.size*3/4))
+	case latency < bp.targetLatency/2 && batchLen >= normal.size && normal.size < bp.maxBatchSize:
+		normal.size = min(bp.maxBatchSize, normal.size+max(1, normal.size/4))
+	default:
+		return
+	}
+	metrics.BatchSizeLimit.Set(float64(normal.size), bp.chain)
+}
+
+// flush executes everything left in the lanes, high-value requests first
+func (bp *BatchProcessor) flush(high, normal *lane) {
+	for _, l := range []*lane{high, normal} {
+		for len(l.requests) > 0 {
+			bp.executeBatch(l.name, l.take())
+		}
+	}
+}
+
+func (l *lane) add(req *ValidationRequest) {
+	if len(l.requests) == 0 {
+		l.deadline = time.Now().Add(l.timeout)
+	}
+	l.requests = append(l.requests, req)
+}
+
+// full reports whether the lane holds a whole batch
+func (l *lane) full() bool {
+	return l.size > 0 && len(l.requests) >= l.size
+}
+
+// ready reports whether the lane holds a full batch or its oldest request
+// has waited out the batch timeout
+func (l *lane) ready(now time.Time) bool {
+	if len(l.requests) == 0 {
+		return false
+	}
+	return len(l.requests) >= l.size || !now.Before(l.deadline)
+}
+
+// take removes the next batch from the lane. Requests left behind keep the
+// deadline of the batch they arrived with.
+func (l *lane) take() []*ValidationRequest {
+	n := len(l.requests)
+	if l.size > 0 && n > l.size {
+		n = l.size
+	}
+	batch := l.requests[:n:n]
+	l.requests = l.requests[n:]
+	return batch
+}
+
+// resetTimer arms the timer for the earliest lane deadline
+func resetTimer(timer *time.Timer, lanes ...*lane) {
+	var next time.Time
+	for _, l := range lanes {
+		if len(l.requests) > 0 && (next.IsZero() || l.deadline.Before(next)) {
+			next = l.deadline
+		}
+	}
+
+	timer.Stop()
+	if !next.IsZero() {
+		timer.Reset(time.Until(next))
+	}
+}
+
+func (bp *BatchProcessor) executeBatch(laneName string, batch []*ValidationRequest) {
 	if bp.processor == nil {
 		return
 	}
 
+	started := time.Now()
 	results := bp.processor(batch)
+	took := time.Since(started)
+	metrics.BatchSize.Observe(float64(len(batch)), bp.chain, laneName)
+	metrics.BatchSeconds.Observe(took.Seconds(), bp.chain, laneName)
+
+	latency := took
+	if previous := time.Duration(bp.latency.Load()); previous > 0 {
+		latency = time.Duration(latencyWeight*float64(took) + (1-latencyWeight)*float64(previous))
+	}
+	bp.latency.Store(int64(latency))
 
 	// Send results back through callbacks
 	for i, req := range batch {
@@ -135,5 +517,5 @@ func (bp *BatchProcessor) GetStats() (queueSize int, isRunning bool) {
 	bp.mutex.RLock()
 	defer bp.mutex.RUnlock()
 
-	return len(bp.requestChan), bp.running
+	return len(bp.requestChan) + len(bp.highValueChan), bp.running
 }
\ No newline at end of file
@@ -295,4 +295,91 @@ func TestBatchProcessorContextCancellation(t *testing.T) {
 	mu.Lock()
 	assert.Len(t, processedReqs, 1) // Should process pending requests on shutdown
 	mu.Unlock()
-}
\ No newline at end of file
+}
+
+// startWithQueued starts bp with requests already queued, so every lane
+// decision is made with the whole backlog in view
+func startWithQueued(t *testing.T, bp *BatchProcessor, reqs ...*ValidationRequest) {
+	for _, req := range reqs {
+		if req.IsHighValue {
+			bp.highValueChan <- req
+		} else {
+			bp.requestChan <- req
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	bp.Start(ctx)
+}
+
+func recordingProcessor() (func([]*ValidationRequest) []ValidationResult, func() []uint64) {
+	var mu sync.Mutex
+	var order []uint64
+
+	processor := func(reqs []*ValidationRequest) []ValidationResult {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, req := range reqs {
+			order = append(order, req.ID)
+		}
+		return make([]ValidationResult, len(reqs))
+	}
+	processed := func() []uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]uint64(nil), order...)
+	}
+	return processor, processed
+}
+
+func TestBatchProcessorHighValueLane(t *testing.T) {
+	t.Run("should process high-value requests ahead of the backlog", func(t *testing.T) {
+		processor, processed := recordingProcessor()
+		bp := NewBatchProcessor(1, time.Second, processor)
+
+		startWithQueued(t, bp,
+			&ValidationRequest{ID: 1},
+			&ValidationRequest{ID: 2},
+			&ValidationRequest{ID: 3},
+			&ValidationRequest{ID: 10, IsHighValue: true},
+		)
+
+		require.Eventually(t, func() bool { return len(processed()) == 4 }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []uint64{10, 1, 2, 3}, processed())
+	})
+
+	t.Run("should batch high-value requests with their own timeout", func(t *testing.T) {
+		processor, processed := recordingProcessor()
+		bp := NewBatchProcessor(10, time.Hour, processor)
+		bp.SetHighValueLane(10, 20*time.Millisecond, 0)
+
+		startWithQueued(t, bp,
+			&ValidationRequest{ID: 1},
+			&ValidationRequest{ID: 10, IsHighValue: true},
+		)
+
+		require.Eventually(t, func() bool { return len(processed()) == 1 }, time.Second, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, []uint64{10}, processed())
+	})
+
+	t.Run("should let normal requests through after the starvation limit", func(t *testing.T) {
+		processor, processed := recordingProcessor()
+		bp := NewBatchProcessor(1, time.Second, processor)
+		bp.SetHighValueLane(1, time.Second, 2)
+
+		startWithQueued(t, bp,
+			&ValidationRequest{ID: 1},
+			&ValidationRequest{ID: 2},
+			&ValidationRequest{ID: 10, IsHighValue: true},
+			&ValidationRequest{ID: 11, IsHighValue: true},
+			&ValidationRequest{ID: 12, IsHighValue: true},
+			&ValidationRequest{ID: 13, IsHighValue: true},
+			&ValidationRequest{ID: 14, IsHighValue: true},
+		)
+
+		require.Eventually(t, func() bool { return len(processed()) == 7 }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []uint64{10, 11, 1, 12, 13, 2, 14}, processed())
+	})
+}
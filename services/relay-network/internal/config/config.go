@@ -1,50 +1,267 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/arcbjorn/crosspay/packages/auth"
 )
 
 type Config struct {
 	Port              int
-	KeyPath           string
+	Key               KeyConfig
+	NewKey            KeyConfig
 	ContractAddress   string
 	RPCEndpoint       string
 	ChainID           int64
+	Chains            []ChainConfig
 	P2P               P2PConfig
 	Validation        ValidationConfig
+	Events            EventsConfig
+	DatabasePath      string
+	PprofAddress      string
+	Slashing          SlashingConfig
+	Registration      RegistrationConfig
+	Analytics         AnalyticsConfig
+	Transactions      TransactionsConfig
+	Admin             auth.Config
+	Sandbox           SandboxConfig
+}
+
+// ChainConfig is one chain the node validates for. The first configured
+// chain is the primary chain.
+type ChainConfig struct {
+	ChainID         int64
+	RPCEndpoint     string
+	ContractAddress string
+	StartBlock      uint64
+}
+
+// KeyConfig selects where the validator key is held: a hex key file, an
+// encrypted keystore or a remote signer
+type KeyConfig struct {
+	Backend         string
+	Path            string
+	KeystorePath    string
+	PasswordFile    string
+	RemoteSignerURL string
+	Address         string
 }
 
 type P2PConfig struct {
-	Port           int
-	BootstrapPeers []string
-	MaxPeers       int
+	Port                     int
+	BootstrapPeers           []string
+	MaxPeers                 int
+	AllowedValidators        []string
+	GossipTTL                int
+	Topics                   []string
+	BanScore                 int
+	LowScore                 int
+	BanMinutes               int
+	AdvertiseAddress         string
+	DiscoveryIntervalSeconds int
+	MessageWindowSeconds     int
 }
 
 type ValidationConfig struct {
-	TimeoutSeconds    int
-	MaxConcurrent     int
-	SignatureRequired bool
+	TimeoutSeconds        int
+	MaxConcurrent         int
+	SignatureRequired     bool
+	SubmissionSlotSeconds int
+}
+
+type EventsConfig struct {
+	PollIntervalSeconds     int
+	Confirmations           uint64
+	MaxBlockRange           uint64
+	ReorgDepth              uint64
+	StartBlock              uint64
+	BatchSize               int
+	BatchTimeoutSeconds     int
+	HighValueBatchSize      int
+	HighValueBatchTimeoutMs int
+	StarvationLimit         int
+	QueueSize               int
+	OverflowPolicy          string
+	MaxBatchSize            int
+	TargetBatchLatencyMs    int
+}
+
+type SlashingConfig struct {
+	MaxMissedRequests int
+}
+
+// RegistrationConfig holds the BLS public key submitted on registration, as
+// four comma-separated uint256 values, and how long the node stays unbonding
+// after it exits
+type RegistrationConfig struct {
+	BLSPublicKey   string
+	UnbondingHours int
+}
+
+// TransactionsConfig controls how the node's own transactions are watched
+// and, when they stay pending too long, replaced at a higher gas price. A
+// MaxGasPriceGwei of 0 leaves replacements uncapped.
+type TransactionsConfig struct {
+	CheckIntervalSeconds int
+	StuckAfterSeconds    int
+	GasBumpPercent       int
+	MaxGasPriceGwei      int
+}
+
+// SandboxConfig runs the node against in-memory chains instead of its RPC
+// endpoints. The chains start at GenesisTime, a Unix time, or at startup
+// when it is 0, and mine an empty block every BlockIntervalSeconds when it is
+// set.
+type SandboxConfig struct {
+	Enabled              bool
+	GenesisTime          int64
+	BlockIntervalSeconds int
+}
+
+type AnalyticsConfig struct {
+	URL                   string
+	ReportIntervalSeconds int
 }
 
 func Load() *Config {
-	return &Config{
+	cfg := &Config{
 		Port:            getEnvInt("PORT", 8080),
-		KeyPath:         getEnv("KEY_PATH", "./validator.key"),
+		Key:             loadKeyConfig("", "./validator.key"),
+		NewKey:          loadKeyConfig("NEW_", ""),
 		ContractAddress: getEnv("CONTRACT_ADDRESS", ""),
 		RPCEndpoint:     getEnv("RPC_ENDPOINT", "http://localhost:8545"),
 		ChainID:         int64(getEnvInt("CHAIN_ID", 1337)),
 		P2P: P2PConfig{
-			Port:           getEnvInt("P2P_PORT", 9090),
-			BootstrapPeers: strings.Split(getEnv("BOOTSTRAP_PEERS", ""), ","),
-			MaxPeers:       getEnvInt("MAX_PEERS", 50),
+			Port:                     getEnvInt("P2P_PORT", 9090),
+			BootstrapPeers:           strings.Split(getEnv("BOOTSTRAP_PEERS", ""), ","),
+			MaxPeers:                 getEnvInt("MAX_PEERS", 50),
+			AllowedValidators:        strings.Split(getEnv("P2P_VALIDATOR_ALLOWLIST", ""), ","),
+			GossipTTL:                getEnvInt("P2P_GOSSIP_TTL", 6),
+			Topics:                   strings.Split(getEnv("P2P_TOPICS", "validation_requests,signature_shares"), ","),
+			BanScore:                 getEnvInt("P2P_BAN_SCORE", 20),
+			LowScore:                 getEnvInt("P2P_LOW_SCORE", 40),
+			BanMinutes:               getEnvInt("P2P_BAN_MINUTES", 60),
+			AdvertiseAddress:         getEnv("P2P_ADVERTISE_ADDR", ""),
+			DiscoveryIntervalSeconds: getEnvInt("P2P_DISCOVERY_INTERVAL", 30),
+			MessageWindowSeconds:     getEnvInt("P2P_MESSAGE_WINDOW", 120),
 		},
 		Validation: ValidationConfig{
-			TimeoutSeconds:    getEnvInt("VALIDATION_TIMEOUT", 300),
-			MaxConcurrent:     getEnvInt("MAX_CONCURRENT_VALIDATIONS", 10),
-			SignatureRequired: getEnv("SIGNATURE_REQUIRED", "true") == "true",
+			TimeoutSeconds:        getEnvInt("VALIDATION_TIMEOUT", 300),
+			MaxConcurrent:         getEnvInt("MAX_CONCURRENT_VALIDATIONS", 10),
+			SignatureRequired:     getEnv("SIGNATURE_REQUIRED", "true") == "true",
+			SubmissionSlotSeconds: getEnvInt("VALIDATION_SUBMISSION_SLOT", 30),
+		},
+		Events: EventsConfig{
+			PollIntervalSeconds:     getEnvInt("EVENT_POLL_INTERVAL", 12),
+			Confirmations:           uint64(getEnvInt("EVENT_CONFIRMATIONS", 3)),
+			MaxBlockRange:           uint64(getEnvInt("EVENT_MAX_BLOCK_RANGE", 1000)),
+			ReorgDepth:              uint64(getEnvInt("EVENT_REORG_DEPTH", 64)),
+			StartBlock:              uint64(getEnvInt("EVENT_START_BLOCK", 0)),
+			BatchSize:               getEnvInt("EVENT_BATCH_SIZE", 10),
+			BatchTimeoutSeconds:     getEnvInt("EVENT_BATCH_TIMEOUT", 2),
+			HighValueBatchSize:      getEnvInt("EVENT_HIGH_VALUE_BATCH_SIZE", 1),
+			HighValueBatchTimeoutMs: getEnvInt("EVENT_HIGH_VALUE_BATCH_TIMEOUT_MS", 100),
+			StarvationLimit:         getEnvInt("EVENT_STARVATION_LIMIT", 4),
+			QueueSize:               getEnvInt("EVENT_QUEUE_SIZE", 1000),
+			OverflowPolicy:          getEnv("EVENT_OVERFLOW_POLICY", "reject"),
+			MaxBatchSize:            getEnvInt("EVENT_MAX_BATCH_SIZE", 100),
+			TargetBatchLatencyMs:    getEnvInt("EVENT_TARGET_BATCH_LATENCY_MS", 0),
+		},
+		DatabasePath: getEnv("DATABASE_PATH", "./relay.db"),
+		PprofAddress: getEnv("PPROF_ADDR", ""),
+		Slashing: SlashingConfig{
+			MaxMissedRequests: getEnvInt("SLASHING_MAX_MISSED_REQUESTS", 10),
 		},
+		Registration: RegistrationConfig{
+			BLSPublicKey:   getEnv("VALIDATOR_BLS_PUBLIC_KEY", ""),
+			UnbondingHours: getEnvInt("VALIDATOR_UNBONDING_HOURS", 168),
+		},
+		Analytics: AnalyticsConfig{
+			URL:                   getEnv("ANALYTICS_URL", ""),
+			ReportIntervalSeconds: getEnvInt("ANALYTICS_REPORT_INTERVAL", 60),
+		},
+		Admin: auth.Config{
+			JWTSecret: getEnv("ADMIN_JWT_SECRET", ""),
+			JWTIssuer: getEnv("ADMIN_JWT_ISSUER", ""),
+			AuditLog:  getEnv("ADMIN_AUDIT_LOG", ""),
+		},
+		Transactions: TransactionsConfig{
+			CheckIntervalSeconds: getEnvInt("TX_CHECK_INTERVAL", 15),
+			StuckAfterSeconds:    getEnvInt("TX_STUCK_AFTER", 120),
+			GasBumpPercent:       getEnvInt("TX_GAS_BUMP_PERCENT", 15),
+			MaxGasPriceGwei:      getEnvInt("TX_MAX_GAS_PRICE_GWEI", 0),
+		},
+		Sandbox: SandboxConfig{
+			Enabled:              getEnv("SANDBOX", "false") == "true",
+			GenesisTime:          int64(getEnvInt("SANDBOX_GENESIS_TIME", 0)),
+			BlockIntervalSeconds: getEnvInt("SANDBOX_BLOCK_INTERVAL", 0),
+		},
+	}
+
+	cfg.Chains = loadChains(cfg)
+	primary := cfg.Chains[0]
+	cfg.ChainID, cfg.RPCEndpoint, cfg.ContractAddress = primary.ChainID, primary.RPCEndpoint, primary.ContractAddress
+	cfg.Events.StartBlock = primary.StartBlock
+	return cfg
+}
+
+// loadChains reads the chains listed in CHAINS, each configured through
+// CHAIN_<id>_RPC_ENDPOINT, CHAIN_<id>_CONTRACT_ADDRESS and
+// CHAIN_<id>_EVENT_START_BLOCK. Without CHAINS the node validates for the
+// single chain set by CHAIN_ID, RPC_ENDPOINT and CONTRACT_ADDRESS.
+func loadChains(cfg *Config) []ChainConfig {
+	var chains []ChainConfig
+	seen := make(map[int64]bool)
+	for _, id := range strings.Split(getEnv("CHAINS", ""), ",") {
+		chainID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if err != nil || chainID <= 0 || seen[chainID] {
+			continue
+		}
+		seen[chainID] = true
+
+		prefix := fmt.Sprintf("CHAIN_%d_", chainID)
+		chains = append(chains, ChainConfig{
+			ChainID:         chainID,
+			RPCEndpoint:     getEnv(prefix+"RPC_ENDPOINT", cfg.RPCEndpoint),
+			ContractAddress: getEnv(prefix+"CONTRACT_ADDRESS", ""),
+			StartBlock:      uint64(getEnvInt(prefix+"EVENT_START_BLOCK", 0)),
+		})
+	}
+
+	if len(chains) == 0 {
+		chains = append(chains, ChainConfig{
+			ChainID:         cfg.ChainID,
+			RPCEndpoint:     cfg.RPCEndpoint,
+			ContractAddress: cfg.ContractAddress,
+			StartBlock:      cfg.Events.StartBlock,
+		})
+	}
+	return chains
+}
+
+// ForChain returns a copy of the config scoped to one chain
+func (c *Config) ForChain(chain ChainConfig) *Config {
+	scoped := *c
+	scoped.ChainID = chain.ChainID
+	scoped.RPCEndpoint = chain.RPCEndpoint
+	scoped.ContractAddress = chain.ContractAddress
+	scoped.Events.StartBlock = chain.StartBlock
+	return &scoped
+}
+
+// loadKeyConfig reads the key settings under prefix, so a rotation target can
+// be configured next to the current key
+func loadKeyConfig(prefix, defaultPath string) KeyConfig {
+	return KeyConfig{
+		Backend:         getEnv(prefix+"KEY_BACKEND", "file"),
+		Path:            getEnv(prefix+"KEY_PATH", defaultPath),
+		KeystorePath:    getEnv(prefix+"KEYSTORE_PATH", ""),
+		PasswordFile:    getEnv(prefix+"KEYSTORE_PASSWORD_FILE", ""),
+		RemoteSignerURL: getEnv(prefix+"REMOTE_SIGNER_URL", ""),
+		Address:         getEnv(prefix+"VALIDATOR_ADDRESS", ""),
 	}
 }
 
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadChains(t *testing.T) {
+	t.Run("should fall back to the single configured chain", func(t *testing.T) {
+		t.Setenv("CHAIN_ID", "1337")
+		t.Setenv("RPC_ENDPOINT", "http://localhost:8545")
+		t.Setenv("CONTRACT_ADDRESS", "0x00000000000000000000000000000000000000aa")
+
+		cfg := Load()
+		require.Len(t, cfg.Chains, 1)
+		assert.Equal(t, ChainConfig{
+			ChainID:         1337,
+			RPCEndpoint:     "http://localhost:8545",
+			ContractAddress: "0x00000000000000000000000000000000000000aa",
+		}, cfg.Chains[0])
+	})
+
+	t.Run("should read each listed chain and make the first primary", func(t *testing.T) {
+		t.Setenv("CHAINS", "80002, 1337,80002")
+		t.Setenv("CHAIN_80002_RPC_ENDPOINT", "http://amoy:8545")
+		t.Setenv("CHAIN_80002_CONTRACT_ADDRESS", "0x00000000000000000000000000000000000000bb")
+		t.Setenv("CHAIN_80002_EVENT_START_BLOCK", "100")
+		t.Setenv("CHAIN_1337_CONTRACT_ADDRESS", "0x00000000000000000000000000000000000000aa")
+
+		cfg := Load()
+		require.Len(t, cfg.Chains, 2)
+		assert.Equal(t, int64(80002), cfg.ChainID)
+		assert.Equal(t, "http://amoy:8545", cfg.RPCEndpoint)
+		assert.Equal(t, uint64(100), cfg.Events.StartBlock)
+
+		scoped := cfg.ForChain(cfg.Chains[1])
+		assert.Equal(t, int64(1337), scoped.ChainID)
+		assert.Equal(t, "0x00000000000000000000000000000000000000aa", scoped.ContractAddress)
+		assert.Equal(t, uint64(0), scoped.Events.StartBlock)
+		assert.Equal(t, int64(80002), cfg.ChainID)
+	})
+}
@@ -0,0 +1,339 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/batch"
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/crosspay/relay-network/internal/pool"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// The listener polls RelayValidator for ValidationRequested logs up to
+// Confirmations blocks behind the head. It records the hash of every block it
+// reads logs from; if one of those hashes changes the chain reorganised, so it
+// rewinds to the last block still canonical and reads the range again.
+
+const validationRequestedABI = `[
+	{"type":"event","name":"ValidationRequested","anonymous":false,"inputs":[
+		{"name":"requestId","type":"uint256","indexed":true},
+		{"name":"paymentId","type":"uint256","indexed":true},
+		{"name":"messageHash","type":"bytes32","indexed":false},
+		{"name":"requiredSignatures","type":"uint256","indexed":false},
+		{"name":"deadline","type":"uint256","indexed":false},
+		{"name":"isHighValue","type":"bool","indexed":false}
+	]}
+]`
+
+var validationRequestedEvent = mustParseEvent(validationRequestedABI, "ValidationRequested")
+
+func mustParseEvent(definition, name string) abi.Event {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed.Events[name]
+}
+
+// chainReader is the part of ethclient the listener uses
+type chainReader interface {
+	BlockNumber(ctx context.Context) (uint64, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// Submitter queues decoded validation requests
+type Submitter interface {
+	Submit(req *batch.ValidationRequest) error
+}
+
+// Listener feeds ValidationRequested events into the batch processor
+type Listener struct {
+	contract  common.Address
+	submitter Submitter
+	config    config.EventsConfig
+	acquire   func(ctx context.Context) (chainReader, func(), error)
+
+	// OnRevert is called with the requests whose events a reorg removed
+	OnRevert func(requestIDs []uint64)
+
+	nextBlock uint64
+	started   bool
+	// canonical hashes of blocks read, used to detect reorgs
+	blockHashes map[uint64]common.Hash
+	// block each submitted request was emitted in
+	submitted map[uint64]uint64
+	mutex     sync.Mutex
+}
+
+func NewListener(connPool *pool.ConnectionPool, contract common.Address, submitter Submitter, cfg config.EventsConfig) *Listener {
+	l := newListener(contract, submitter, cfg)
+	l.acquire = func(ctx context.Context) (chainReader, func(), error) {
+		client, err := connPool.Get(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { connPool.Put(client) }, nil
+	}
+	return l
+}
+
+func newListener(contract common.Address, submitter Submitter, cfg config.EventsConfig) *Listener {
+	if cfg.MaxBlockRange == 0 {
+		cfg.MaxBlockRange = 1000
+	}
+	if cfg.ReorgDepth == 0 {
+		cfg.ReorgDepth = 64
+	}
+	return &Listener{
+		contract:    contract,
+		submitter:   submitter,
+		config:      cfg,
+		nextBlock:   cfg.StartBlock,
+		started:     cfg.StartBlock > 0,
+		blockHashes: make(map[uint64]common.Hash),
+		submitted:   make(map[uint64]uint64),
+	}
+}
+
+// Run polls for new events until ctx is cancelled
+func (l *Listener) Run(ctx context.Context) {
+	interval := time.Duration(l.config.PollIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 12 * time.Second
+	}
+
+	log.Printf("Watching %s for ValidationRequested events", l.contract.Hex())
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		wait := interval
+		if err := l.poll(ctx); err != nil {
+			log.Printf("Failed to poll validation events: %v", err)
+
+			// A full queue says when it expects room; the rest of the range is
+			// read again then
+			var overflow *batch.OverflowError
+			if errors.As(err, &overflow) && overflow.RetryAfter < wait {
+				wait = overflow.RetryAfter
+			}
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// NextBlock returns the first block not yet read
+func (l *Listener) NextBlock() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.nextBlock
+}
+
+func (l *Listener) poll(ctx context.Context) error {
+	client, release, err := l.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get RPC connection: %w", err)
+	}
+	defer release()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get block number: %w", err)
+	}
+	if head < l.config.Confirmations {
+		return nil
+	}
+	safe := head - l.config.Confirmations
+
+	if !l.started {
+		l.nextBlock = safe + 1
+		l.started = true
+		return nil
+	}
+
+	if err := l.checkReorg(ctx, client); err != nil {
+		return err
+	}
+
+	for l.nextBlock <= safe {
+		to := l.nextBlock + l.config.MaxBlockRange - 1
+		if to > safe {
+			to = safe
+		}
+		if err := l.readRange(ctx, client, l.nextBlock, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReorg compares the hashes of blocks already read against the chain and
+// rewinds past any that changed
+func (l *Listener) checkReorg(ctx context.Context, client chainReader) error {
+	if l.nextBlock == 0 {
+		return nil
+	}
+
+	last := l.nextBlock - 1
+	stored, ok := l.blockHashes[last]
+	if !ok {
+		return nil
+	}
+
+	header, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(last))
+	if err != nil {
+		return fmt.Errorf("failed to get header %d: %w", last, err)
+	}
+	if header.Hash() == stored {
+		return nil
+	}
+
+	// Walk back to the newest block we read that is still canonical
+	ancestor := uint64(0)
+	for number := last; number > 0 && last-number < l.config.ReorgDepth; number-- {
+		hash, ok := l.blockHashes[number]
+		if !ok {
+			continue
+		}
+		header, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+		if err != nil {
+			return fmt.Errorf("failed to get header %d: %w", number, err)
+		}
+		if header.Hash() == hash {
+			ancestor = number
+			break
+		}
+	}
+	if ancestor == 0 && last >= l.config.ReorgDepth {
+		ancestor = last - l.config.ReorgDepth
+	}
+
+	for number := range l.blockHashes {
+		if number > ancestor {
+			delete(l.blockHashes, number)
+		}
+	}
+	var reverted []uint64
+	for requestID, number := range l.submitted {
+		if number > ancestor {
+			reverted = append(reverted, requestID)
+			delete(l.submitted, requestID)
+		}
+	}
+
+	log.Printf("Chain reorg detected at block %d, rewinding to %d (%d requests reverted)", last, ancestor, len(reverted))
+	l.nextBlock = ancestor + 1
+	if len(reverted) > 0 && l.OnRevert != nil {
+		l.OnRevert(reverted)
+	}
+	return nil
+}
+
+func (l *Listener) readRange(ctx context.Context, client chainReader, from, to uint64) error {
+	logs, err := client.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(from),
+		ToBlock:   new(big.Int).SetUint64(to),
+		Addresses: []common.Address{l.contract},
+		Topics:    [][]common.Hash{{validationRequestedEvent.ID}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to filter logs %d-%d: %w", from, to, err)
+	}
+
+	header, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(to))
+	if err != nil {
+		return fmt.Errorf("failed to get header %d: %w", to, err)
+	}
+
+	for _, entry := range logs {
+		if entry.Removed {
+			continue
+		}
+		l.blockHashes[entry.BlockNumber] = entry.BlockHash
+
+		if _, seen := l.submitted[entry.Topics[1].Big().Uint64()]; seen {
+			continue
+		}
+
+		req, err := decodeValidationRequested(entry)
+		if err != nil {
+			log.Printf("Skipping malformed ValidationRequested log in tx %s: %v", entry.TxHash.Hex(), err)
+			continue
+		}
+		if err := l.submitter.Submit(req); errors.Is(err, batch.ErrShed) {
+			log.Printf("Validation request %d shed from the full batch queue", req.ID)
+		} else if err != nil {
+			return fmt.Errorf("failed to queue validation request %d: %w", req.ID, err)
+		}
+		l.submitted[req.ID] = entry.BlockNumber
+	}
+
+	l.blockHashes[to] = header.Hash()
+	l.nextBlock = to + 1
+	l.prune()
+	return nil
+}
+
+// prune forgets blocks deeper than a reorg can reach
+func (l *Listener) prune() {
+	if l.nextBlock <= l.config.ReorgDepth {
+		return
+	}
+	cutoff := l.nextBlock - l.config.ReorgDepth
+	for number := range l.blockHashes {
+		if number < cutoff {
+			delete(l.blockHashes, number)
+		}
+	}
+	for requestID, number := range l.submitted {
+		if number < cutoff {
+			delete(l.submitted, requestID)
+		}
+	}
+}
+
+func decodeValidationRequested(entry types.Log) (*batch.ValidationRequest, error) {
+	if len(entry.Topics) != 3 {
+		return nil, fmt.Errorf("expected 3 topics, got %d", len(entry.Topics))
+	}
+
+	values, err := validationRequestedEvent.Inputs.NonIndexed().Unpack(entry.Data)
+	if err != nil {
+		return nil, err
+	}
+	messageHash := values[0].([32]byte)
+	requiredSigs := values[1].(*big.Int)
+	deadline := values[2].(*big.Int)
+	isHighValue := values[3].(bool)
+
+	return &batch.ValidationRequest{
+		ID:           entry.Topics[1].Big().Uint64(),
+		PaymentID:    entry.Topics[2].Big().Uint64(),
+		MessageHash:  common.Hash(messageHash).Hex(),
+		RequiredSigs: int(requiredSigs.Int64()),
+		Deadline:     time.Unix(deadline.Int64(), 0),
+		IsHighValue:  isHighValue,
+		Timestamp:    time.Now(),
+	}, nil
+}
@@ -0,0 +1,174 @@
+package events
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/batch"
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testContract = common.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+// fakeChain serves headers and logs for a chain whose blocks can be replaced
+// to simulate a reorg
+type fakeChain struct {
+	head   uint64
+	forks  map[uint64]uint64 // block number -> fork id, changes the block hash
+	events map[uint64][]uint64
+}
+
+func (c *fakeChain) header(number uint64) *types.Header {
+	return &types.Header{Number: new(big.Int).SetUint64(number), Extra: []byte{byte(c.forks[number])}}
+}
+
+func (c *fakeChain) BlockNumber(ctx context.Context) (uint64, error) {
+	return c.head, nil
+}
+
+func (c *fakeChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return c.header(number.Uint64()), nil
+}
+
+func (c *fakeChain) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	var logs []types.Log
+	for number := q.FromBlock.Uint64(); number <= q.ToBlock.Uint64(); number++ {
+		for _, requestID := range c.events[number] {
+			data, err := validationRequestedEvent.Inputs.NonIndexed().Pack(
+				[32]byte(common.BigToHash(big.NewInt(int64(requestID)))), big.NewInt(2), big.NewInt(1700000000), false,
+			)
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, types.Log{
+				Address: testContract,
+				Topics: []common.Hash{
+					validationRequestedEvent.ID,
+					common.BigToHash(new(big.Int).SetUint64(requestID)),
+					common.BigToHash(new(big.Int).SetUint64(requestID * 10)),
+				},
+				Data:        data,
+				BlockNumber: number,
+				BlockHash:   c.header(number).Hash(),
+			})
+		}
+	}
+	return logs, nil
+}
+
+type recordingSubmitter struct {
+	mutex    sync.Mutex
+	requests []*batch.ValidationRequest
+	// refuse is returned, once, for the request with that ID
+	refuse map[uint64]error
+}
+
+func (s *recordingSubmitter) Submit(req *batch.ValidationRequest) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err, ok := s.refuse[req.ID]; ok {
+		delete(s.refuse, req.ID)
+		return err
+	}
+	s.requests = append(s.requests, req)
+	return nil
+}
+
+func (s *recordingSubmitter) ids() []uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ids := make([]uint64, len(s.requests))
+	for i, req := range s.requests {
+		ids[i] = req.ID
+	}
+	return ids
+}
+
+func newTestListener(chain *fakeChain, submitter Submitter, cfg config.EventsConfig) *Listener {
+	l := newListener(testContract, submitter, cfg)
+	l.acquire = func(ctx context.Context) (chainReader, func(), error) {
+		return chain, func() {}, nil
+	}
+	return l
+}
+
+func TestListenerPoll(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should decode confirmed events and skip unconfirmed ones", func(t *testing.T) {
+		chain := &fakeChain{head: 10, events: map[uint64][]uint64{3: {1}, 9: {2}}}
+		submitter := &recordingSubmitter{}
+		l := newTestListener(chain, submitter, config.EventsConfig{StartBlock: 1, Confirmations: 2})
+
+		require.NoError(t, l.poll(ctx))
+
+		assert.Equal(t, []uint64{1}, submitter.ids())
+		assert.Equal(t, uint64(9), l.NextBlock())
+
+		req := submitter.requests[0]
+		assert.Equal(t, uint64(10), req.PaymentID)
+		assert.Equal(t, common.BigToHash(big.NewInt(1)).Hex(), req.MessageHash)
+		assert.Equal(t, 2, req.RequiredSigs)
+		assert.Equal(t, time.Unix(1700000000, 0), req.Deadline)
+
+		chain.head = 11
+		require.NoError(t, l.poll(ctx))
+		assert.Equal(t, []uint64{1, 2}, submitter.ids())
+	})
+
+	t.Run("should read the range again after a full queue but not after shedding", func(t *testing.T) {
+		chain := &fakeChain{head: 10, events: map[uint64][]uint64{3: {1}, 4: {2}, 5: {3}}}
+		submitter := &recordingSubmitter{refuse: map[uint64]error{
+			1: batch.ErrShed,
+			2: &batch.OverflowError{RetryAfter: time.Second},
+		}}
+		l := newTestListener(chain, submitter, config.EventsConfig{StartBlock: 1, Confirmations: 2})
+
+		var overflow *batch.OverflowError
+		require.ErrorAs(t, l.poll(ctx), &overflow)
+		assert.Equal(t, uint64(1), l.NextBlock())
+
+		require.NoError(t, l.poll(ctx))
+		assert.Equal(t, []uint64{2, 3}, submitter.ids())
+		assert.Equal(t, uint64(9), l.NextBlock())
+	})
+
+	t.Run("should start from the confirmed head without a start block", func(t *testing.T) {
+		chain := &fakeChain{head: 50, events: map[uint64][]uint64{10: {1}}}
+		submitter := &recordingSubmitter{}
+		l := newTestListener(chain, submitter, config.EventsConfig{Confirmations: 5})
+
+		require.NoError(t, l.poll(ctx))
+		assert.Equal(t, uint64(46), l.NextBlock())
+		assert.Empty(t, submitter.ids())
+	})
+
+	t.Run("should rewind and resubmit after a reorg", func(t *testing.T) {
+		chain := &fakeChain{head: 10, forks: map[uint64]uint64{}, events: map[uint64][]uint64{8: {1}, 10: {2}}}
+		submitter := &recordingSubmitter{}
+		l := newTestListener(chain, submitter, config.EventsConfig{StartBlock: 1})
+		var reverted []uint64
+		l.OnRevert = func(ids []uint64) { reverted = append(reverted, ids...) }
+
+		require.NoError(t, l.poll(ctx))
+		assert.Equal(t, []uint64{1, 2}, submitter.ids())
+
+		// Blocks 9 and 10 are replaced; request 2 moves to block 9 and request
+		// 3 is new
+		chain.forks[9], chain.forks[10] = 1, 1
+		chain.events = map[uint64][]uint64{8: {1}, 9: {2}, 10: {3}}
+
+		require.NoError(t, l.poll(ctx))
+		assert.Equal(t, []uint64{2}, reverted)
+		assert.Equal(t, []uint64{1, 2, 2, 3}, submitter.ids())
+		assert.Equal(t, uint64(11), l.NextBlock())
+	})
+}
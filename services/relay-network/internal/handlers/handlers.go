@@ -1,39 +1,54 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/arcbjorn/crosspay/packages/problem"
 	"github.com/crosspay/relay-network/internal/p2p"
+	"github.com/crosspay/relay-network/internal/slashing"
 	"github.com/crosspay/relay-network/internal/validator"
+	"github.com/ethereum/go-ethereum/common"
 )
 
 type Handler struct {
-	validator ValidatorNode
-	network   P2PNetwork
+	validators []ValidatorNode
+	network    P2PNetwork
+	slashing   *slashing.Queue
 }
 
 type ValidatorNode interface {
+	ChainID() int64
 	GetAddress() string
 	GetStatus() string
 	GetStake() string
 	IsRegistered() bool
+	GetRegistration() validator.Registration
+	RegisterValidator(ctx context.Context, stake *big.Int) (common.Hash, error)
+	DeregisterValidator(ctx context.Context) (common.Hash, error)
 	GetPendingValidationCount() int
 	ProcessValidationRequest(req *p2p.ValidationMessage) error
 	GetValidationStatus(requestID uint64) (*validator.ValidationRequest, bool)
 	GetSignatures(requestID uint64) map[string]string
+	GetQuorum(requestID uint64) (*validator.Quorum, bool)
+	SubscribeValidation(requestID uint64) (<-chan validator.ValidationEvent, func())
+	ValidationSnapshot(requestID uint64) (validator.ValidationEvent, bool)
+	PendingTransactions() []validator.PendingTransaction
 }
 
 type P2PNetwork interface {
 	GetPeers() []*p2p.Peer
+	GetBannedPeers() []p2p.BannedPeer
 	GetPeerCount() int
 	IsRunning() bool
 	BroadcastValidationRequest(req *p2p.ValidationMessage) error
-	BroadcastSignature(requestID uint64, signature string) error
+	BroadcastSignature(chainID int64, requestID uint64, messageHash, signature string) error
 }
 
 type ValidationRequest struct {
@@ -65,6 +80,16 @@ type StatusResponse struct {
 	PendingValidations int                    `json:"pending_validations"`
 	NetworkRunning     bool                   `json:"network_running"`
 	Peers              []*p2p.Peer            `json:"peers"`
+	Chains             []ChainStatus          `json:"chains"`
+}
+
+// ChainStatus is the validator's state on one chain
+type ChainStatus struct {
+	ChainID            int64  `json:"chain_id"`
+	Status             string `json:"status"`
+	IsRegistered       bool   `json:"is_registered"`
+	Stake              string `json:"stake"`
+	PendingValidations int    `json:"pending_validations"`
 }
 
 type ValidationRequestPayload struct {
@@ -79,22 +104,53 @@ type SignMessagePayload struct {
 	MessageHash string `json:"message_hash"`
 }
 
-func NewHandler(validator ValidatorNode, network P2PNetwork) *Handler {
+// NewHandler serves the API for the given validators, one per chain with the
+// primary chain first
+func NewHandler(validators []ValidatorNode, network P2PNetwork, slashingQueue *slashing.Queue) *Handler {
 	return &Handler{
-		validator: validator,
-		network:   network,
+		validators: validators,
+		network:    network,
+		slashing:   slashingQueue,
+	}
+}
+
+// validatorFor returns the validator for the chain in the chain_id query
+// parameter, or the primary chain's without one. It writes the error
+// response when the chain is unknown.
+func (h *Handler) validatorFor(w http.ResponseWriter, r *http.Request) (ValidatorNode, bool) {
+	chainParam := r.URL.Query().Get("chain_id")
+	if chainParam == "" {
+		return h.validators[0], true
+	}
+
+	chainID, err := strconv.ParseInt(chainParam, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid chain ID", http.StatusBadRequest)
+		return nil, false
+	}
+	for _, v := range h.validators {
+		if v.ChainID() == chainID {
+			return v, true
+		}
 	}
+	problem.Error(w, r, http.StatusNotFound, problem.CodeChainNotValidated, fmt.Sprintf("Chain %d is not validated by this node", chainID))
+	return nil, false
 }
 
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
+	node, ok := h.validatorFor(w, r)
+	if !ok {
+		return
+	}
+
 	response := HealthResponse{
-		Status:              h.validator.GetStatus(),
+		Status:              node.GetStatus(),
 		Timestamp:           time.Now(),
-		ValidatorAddress:    h.validator.GetAddress(),
-		IsRegistered:        h.validator.IsRegistered(),
-		Stake:               h.validator.GetStake(),
+		ValidatorAddress:    node.GetAddress(),
+		IsRegistered:        node.IsRegistered(),
+		Stake:               node.GetStake(),
 		PeerCount:           h.network.GetPeerCount(),
-		PendingValidations:  h.validator.GetPendingValidationCount(),
+		PendingValidations:  node.GetPendingValidationCount(),
 		NetworkRunning:      h.network.IsRunning(),
 	}
 
@@ -103,22 +159,37 @@ func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) Status(w http.ResponseWriter, r *http.Request) {
+	node := h.validators[0]
 	response := StatusResponse{
-		ValidatorAddress:   h.validator.GetAddress(),
-		Status:             h.validator.GetStatus(),
-		IsRegistered:       h.validator.IsRegistered(),
-		Stake:              h.validator.GetStake(),
+		ValidatorAddress:   node.GetAddress(),
+		Status:             node.GetStatus(),
+		IsRegistered:       node.IsRegistered(),
+		Stake:              node.GetStake(),
 		PeerCount:          h.network.GetPeerCount(),
-		PendingValidations: h.validator.GetPendingValidationCount(),
+		PendingValidations: node.GetPendingValidationCount(),
 		NetworkRunning:     h.network.IsRunning(),
 		Peers:              h.network.GetPeers(),
 	}
+	for _, v := range h.validators {
+		response.Chains = append(response.Chains, ChainStatus{
+			ChainID:            v.ChainID(),
+			Status:             v.GetStatus(),
+			IsRegistered:       v.IsRegistered(),
+			Stake:              v.GetStake(),
+			PendingValidations: v.GetPendingValidationCount(),
+		})
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
 func (h *Handler) RequestValidation(w http.ResponseWriter, r *http.Request) {
+	node, ok := h.validatorFor(w, r)
+	if !ok {
+		return
+	}
+
 	var payload ValidationRequestPayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
@@ -126,14 +197,16 @@ func (h *Handler) RequestValidation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	p2pMsg := &p2p.ValidationMessage{
-		Type:        "validation_request",
-		RequestID:   payload.PaymentID, // Use payment ID as validation ID for simplicity
-		PaymentID:   payload.PaymentID,
-		MessageHash: payload.MessageHash,
-		Timestamp:   time.Now(),
+		Type:         "validation_request",
+		ChainID:      node.ChainID(),
+		RequestID:    payload.PaymentID, // Use payment ID as validation ID for simplicity
+		PaymentID:    payload.PaymentID,
+		MessageHash:  payload.MessageHash,
+		RequiredSigs: payload.RequiredSigs,
+		Timestamp:    time.Now(),
 	}
 
-	if err := h.validator.ProcessValidationRequest(p2pMsg); err != nil {
+	if err := node.ProcessValidationRequest(p2pMsg); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to process validation request: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -152,19 +225,25 @@ func (h *Handler) RequestValidation(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) SignMessage(w http.ResponseWriter, r *http.Request) {
+	node, ok := h.validatorFor(w, r)
+	if !ok {
+		return
+	}
+
 	var payload SignMessagePayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	req, exists := h.validator.GetValidationStatus(payload.RequestID)
+	req, exists := node.GetValidationStatus(payload.RequestID)
 	if !exists {
 		http.Error(w, "Validation request not found", http.StatusNotFound)
 		return
 	}
 
-	signatures := h.validator.GetSignatures(payload.RequestID)
+	signatures := node.GetSignatures(payload.RequestID)
+	quorum, quorumReached := node.GetQuorum(payload.RequestID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -174,6 +253,8 @@ func (h *Handler) SignMessage(w http.ResponseWriter, r *http.Request) {
 		"required_signatures": req.RequiredSigs,
 		"signatures":        signatures,
 		"deadline":          req.Deadline,
+		"quorum_reached":    quorumReached,
+		"quorum":            quorum,
 	})
 }
 
@@ -184,32 +265,6 @@ func (h *Handler) GetPeers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"peer_count": len(peers),
 		"peers":      peers,
-	})
-}
-
-func (h *Handler) RegisterValidator(w http.ResponseWriter, r *http.Request) {
-	if h.validator.IsRegistered() {
-		http.Error(w, "Validator already registered", http.StatusConflict)
-		return
-	}
-
-	stakeStr := r.URL.Query().Get("stake")
-	if stakeStr == "" {
-		http.Error(w, "Stake amount required", http.StatusBadRequest)
-		return
-	}
-
-	_, err := strconv.ParseFloat(stakeStr, 64)
-	if err != nil {
-		http.Error(w, "Invalid stake amount", http.StatusBadRequest)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":   "registration_requested",
-		"address":  h.validator.GetAddress(),
-		"stake":    stakeStr,
-		"message":  "Registration transaction should be submitted to the RelayValidator contract",
+		"banned":     h.network.GetBannedPeers(),
 	})
 }
\ No newline at end of file
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/crosspay/relay-network/internal/validator"
+)
+
+var weiPerEther = new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil))
+
+// RegisterValidator deposits the stake given in ETH by the stake query
+// parameter. It answers once the transaction is sent; GET /registration
+// shows when it is confirmed.
+func (h *Handler) RegisterValidator(w http.ResponseWriter, r *http.Request) {
+	node, ok := h.validatorFor(w, r)
+	if !ok {
+		return
+	}
+
+	stakeStr := r.URL.Query().Get("stake")
+	if stakeStr == "" {
+		http.Error(w, "Stake amount required", http.StatusBadRequest)
+		return
+	}
+	stake, err := parseEther(stakeStr)
+	if err != nil {
+		http.Error(w, "Invalid stake amount", http.StatusBadRequest)
+		return
+	}
+
+	txHash, err := node.RegisterValidator(r.Context(), stake)
+	if err != nil {
+		writeRegistrationError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  validator.RegistrationPending,
+		"address": node.GetAddress(),
+		"stake":   stake.String(),
+		"tx_hash": txHash.Hex(),
+	})
+}
+
+// DeregisterValidator exits the validator set and starts unbonding once the
+// exit is confirmed
+func (h *Handler) DeregisterValidator(w http.ResponseWriter, r *http.Request) {
+	node, ok := h.validatorFor(w, r)
+	if !ok {
+		return
+	}
+
+	txHash, err := node.DeregisterValidator(r.Context())
+	if err != nil {
+		writeRegistrationError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  validator.RegistrationExiting,
+		"address": node.GetAddress(),
+		"tx_hash": txHash.Hex(),
+	})
+}
+
+func (h *Handler) GetRegistration(w http.ResponseWriter, r *http.Request) {
+	node, ok := h.validatorFor(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(node.GetRegistration())
+}
+
+func writeRegistrationError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code, detail := http.StatusInternalServerError, problem.CodeInternal, fmt.Sprintf("Registration failed: %v", err)
+	switch {
+	case errors.Is(err, validator.ErrAlreadyRegistered):
+		status, code, detail = http.StatusConflict, problem.CodeAlreadyRegistered, err.Error()
+	case errors.Is(err, validator.ErrNotRegistered):
+		status, code, detail = http.StatusConflict, problem.CodeNotRegistered, err.Error()
+	case errors.Is(err, validator.ErrRegistrationPending):
+		status, code, detail = http.StatusConflict, problem.CodeRegistrationPending, err.Error()
+	case errors.Is(err, validator.ErrUnbonding):
+		status, code, detail = http.StatusConflict, problem.CodeUnbonding, err.Error()
+	case errors.Is(err, validator.ErrInsufficientStake):
+		status, code, detail = http.StatusBadRequest, problem.CodeInsufficientStake, err.Error()
+	case errors.Is(err, validator.ErrNoContract):
+		status, code, detail = http.StatusServiceUnavailable, problem.CodeUnavailable, err.Error()
+	}
+	problem.Error(w, r, status, code, detail)
+}
+
+// parseEther converts a decimal ETH amount to wei without rounding
+func parseEther(value string) (*big.Int, error) {
+	amount, ok := new(big.Rat).SetString(value)
+	if !ok || amount.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid amount %q", value)
+	}
+	wei := amount.Mul(amount, weiPerEther)
+	if !wei.IsInt() {
+		return nil, fmt.Errorf("amount %q has more than 18 decimals", value)
+	}
+	return wei.Num(), nil
+}
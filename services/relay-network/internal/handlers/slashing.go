@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/crosspay/relay-network/internal/slashing"
+)
+
+type ReviewEvidencePayload struct {
+	Note string `json:"note"`
+}
+
+// ListEvidence returns recorded slashing evidence, filtered by ?status=
+func (h *Handler) ListEvidence(w http.ResponseWriter, r *http.Request) {
+	if h.slashing == nil {
+		http.Error(w, "Slashing is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	evidence, err := h.slashing.List(r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, "Failed to list evidence", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":    len(evidence),
+		"evidence": evidence,
+	})
+}
+
+// ApproveEvidence submits a slashing report for the evidence
+func (h *Handler) ApproveEvidence(w http.ResponseWriter, r *http.Request) {
+	h.reviewEvidence(w, r, true)
+}
+
+// RejectEvidence closes the evidence without reporting it
+func (h *Handler) RejectEvidence(w http.ResponseWriter, r *http.Request) {
+	h.reviewEvidence(w, r, false)
+}
+
+func (h *Handler) reviewEvidence(w http.ResponseWriter, r *http.Request, approve bool) {
+	if h.slashing == nil {
+		http.Error(w, "Slashing is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid evidence ID", http.StatusBadRequest)
+		return
+	}
+
+	var payload ReviewEvidencePayload
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var evidence *slashing.Evidence
+	if approve {
+		evidence, err = h.slashing.Approve(r.Context(), id, payload.Note)
+	} else {
+		evidence, err = h.slashing.Reject(id, payload.Note)
+	}
+	switch {
+	case errors.Is(err, slashing.ErrNotFound):
+		http.Error(w, "Evidence not found", http.StatusNotFound)
+		return
+	case errors.Is(err, slashing.ErrNotPending):
+		problem.Error(w, r, http.StatusConflict, problem.CodeEvidenceReviewed, "Evidence already reviewed")
+		return
+	case err != nil:
+		http.Error(w, "Failed to review evidence", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(evidence)
+}
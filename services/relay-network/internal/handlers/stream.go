@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/validator"
+)
+
+const streamKeepalive = 15 * time.Second
+
+// StreamValidation sends a request's progress as Server-Sent Events: a
+// snapshot of where it stands, then an event for each signature share, the
+// quorum and the on-chain submission. The stream ends after the submission,
+// or when the request expires or is reverted.
+func (h *Handler) StreamValidation(w http.ResponseWriter, r *http.Request) {
+	node, ok := h.validatorFor(w, r)
+	if !ok {
+		return
+	}
+
+	requestID, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid validation request ID", http.StatusBadRequest)
+		return
+	}
+
+	// Subscribe before the snapshot so no event falls between them
+	events, cancel := node.SubscribeValidation(requestID)
+	defer cancel()
+
+	snapshot, ok := node.ValidationSnapshot(requestID)
+	if !ok {
+		http.Error(w, "Validation request not found", http.StatusNotFound)
+		return
+	}
+
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeEvent(w, controller, "status", snapshot); err != nil || snapshot.Final() {
+		return
+	}
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				// Dropped for falling behind; the client reconnects for a
+				// fresh snapshot
+				return
+			}
+			if err := writeEvent(w, controller, event.Type, event); err != nil || event.Final() {
+				return
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, controller *http.ResponseController, name string, event validator.ValidationEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	return controller.Flush()
+}
@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// GetPendingTransactions lists the transactions the validator sent on the
+// chain that are not mined yet, with the hashes of any they replaced
+func (h *Handler) GetPendingTransactions(w http.ResponseWriter, r *http.Request) {
+	node, ok := h.validatorFor(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"chain_id":     node.ChainID(),
+		"address":      node.GetAddress(),
+		"transactions": node.PendingTransactions(),
+	})
+}
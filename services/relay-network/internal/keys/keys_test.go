@@ -0,0 +1,118 @@
+package keys
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "validator.json")
+	require.NoError(t, WriteKeystore(path, key, "secret", keystore.LightScryptN, keystore.LightScryptP))
+
+	loaded, err := loadOrGenerateKeystore(path, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, crypto.FromECDSA(key), crypto.FromECDSA(loaded))
+
+	_, err = loadOrGenerateKeystore(path, "wrong")
+	assert.Error(t, err)
+}
+
+// fakeWeb3Signer serves the eth1 sign endpoint, signing with key
+func fakeWeb3Signer(t *testing.T, key *LocalSigner) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Data string `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		data, err := hexutil.Decode(req.Data)
+		require.NoError(t, err)
+
+		signature, err := key.SignData(data)
+		require.NoError(t, err)
+		signature[crypto.RecoveryIDOffset] += 27
+		w.Write([]byte(hexutil.Encode(signature)))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRemoteSigner(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	local := NewLocalSigner(key)
+	server := fakeWeb3Signer(t, local)
+
+	t.Run("signs with the remote key", func(t *testing.T) {
+		signer := NewRemoteSigner(server.URL, local.Address())
+		signature, err := signer.SignData([]byte("payload"))
+		require.NoError(t, err)
+
+		expected, err := local.SignData([]byte("payload"))
+		require.NoError(t, err)
+		assert.Equal(t, expected, signature)
+	})
+
+	t.Run("rejects a signature from another key", func(t *testing.T) {
+		signer := NewRemoteSigner(server.URL, common.HexToAddress("0x0000000000000000000000000000000000000001"))
+		_, err := signer.SignData([]byte("payload"))
+		assert.Error(t, err)
+	})
+}
+
+func TestTransactor(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer := NewLocalSigner(key)
+	chainID := big.NewInt(1337)
+	to := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+	txs := map[string]*types.Transaction{
+		"legacy": types.NewTx(&types.LegacyTx{
+			Nonce: 3, GasPrice: big.NewInt(1e9), Gas: 21000, To: &to, Value: big.NewInt(5),
+		}),
+		"access list": types.NewTx(&types.AccessListTx{
+			ChainID: chainID, Nonce: 4, GasPrice: big.NewInt(1e9), Gas: 50000, To: &to, Data: []byte{1, 2},
+			AccessList: types.AccessList{{Address: to, StorageKeys: []common.Hash{{1}}}},
+		}),
+		"dynamic fee": types.NewTx(&types.DynamicFeeTx{
+			ChainID: chainID, Nonce: 5, GasTipCap: big.NewInt(1e9), GasFeeCap: big.NewInt(2e9), Gas: 50000, To: &to,
+		}),
+		"contract creation": types.NewTx(&types.LegacyTx{
+			Nonce: 6, GasPrice: big.NewInt(1e9), Gas: 100000, Data: []byte{0x60, 0x00},
+		}),
+	}
+
+	txSigner := types.LatestSignerForChainID(chainID)
+	opts := NewTransactor(signer, chainID)
+	for name, tx := range txs {
+		t.Run(name, func(t *testing.T) {
+			payload, err := signingPayload(tx, chainID)
+			require.NoError(t, err)
+			assert.Equal(t, txSigner.Hash(tx), crypto.Keccak256Hash(payload))
+
+			signed, err := opts.Signer(signer.Address(), tx)
+			require.NoError(t, err)
+			sender, err := types.Sender(txSigner, signed)
+			require.NoError(t, err)
+			assert.Equal(t, signer.Address(), sender)
+		})
+	}
+
+	_, err = opts.Signer(common.HexToAddress("0x01"), txs["legacy"])
+	assert.Error(t, err)
+}
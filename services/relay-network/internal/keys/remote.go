@@ -0,0 +1,73 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// RemoteSigner signs through a Web3Signer instance, which can hold the key in
+// a keystore, a cloud KMS or an HSM over PKCS#11
+type RemoteSigner struct {
+	url     string
+	address common.Address
+	client  *http.Client
+}
+
+func NewRemoteSigner(url string, address common.Address) *RemoteSigner {
+	return &RemoteSigner{
+		url:     strings.TrimSuffix(url, "/"),
+		address: address,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *RemoteSigner) Address() common.Address {
+	return s.address
+}
+
+// SignData calls Web3Signer's eth1 sign endpoint, which signs keccak256(data)
+func (s *RemoteSigner) SignData(data []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"data": hexutil.Encode(data)})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Post(fmt.Sprintf("%s/api/v1/eth1/sign/%s", s.url, s.address.Hex()), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("remote signer request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote signer returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	signature, err := hexutil.Decode(strings.TrimSpace(string(respBody)))
+	if err != nil || len(signature) != crypto.SignatureLength {
+		return nil, fmt.Errorf("remote signer returned an invalid signature")
+	}
+	if signature[crypto.RecoveryIDOffset] >= 27 {
+		signature[crypto.RecoveryIDOffset] -= 27
+	}
+
+	// Make sure the signer holds the key we expect before the signature is
+	// used anywhere
+	pub, err := crypto.SigToPub(crypto.Keccak256(data), signature)
+	if err != nil || crypto.PubkeyToAddress(*pub) != s.address {
+		return nil, fmt.Errorf("remote signer signed with a key other than %s", s.address.Hex())
+	}
+	return signature, nil
+}
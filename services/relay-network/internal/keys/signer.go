@@ -0,0 +1,161 @@
+package keys
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+// Signer holds a validator key. Every signature the node makes (its TLS
+// identity, signature shares and transactions) goes through SignData, so the
+// key itself can live outside the process.
+type Signer interface {
+	Address() common.Address
+	// SignData signs keccak256(data), returning [R || S || V] with V 0 or 1
+	SignData(data []byte) ([]byte, error)
+}
+
+// LocalSigner signs with a key held in memory
+type LocalSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func NewLocalSigner(key *ecdsa.PrivateKey) *LocalSigner {
+	return &LocalSigner{key: key}
+}
+
+func (s *LocalSigner) Address() common.Address {
+	return crypto.PubkeyToAddress(s.key.PublicKey)
+}
+
+func (s *LocalSigner) SignData(data []byte) ([]byte, error) {
+	return crypto.Sign(crypto.Keccak256(data), s.key)
+}
+
+// Load returns the signer for the configured key backend
+func Load(cfg config.KeyConfig) (Signer, error) {
+	switch cfg.Backend {
+	case "", "file":
+		key, err := loadOrGenerateKey(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Warning: validator key is stored unencrypted, consider KEY_BACKEND=keystore or remote")
+		return NewLocalSigner(key), nil
+
+	case "keystore":
+		password, err := readPassword(cfg.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := loadOrGenerateKeystore(cfg.KeystorePath, password)
+		if err != nil {
+			return nil, err
+		}
+		return NewLocalSigner(key), nil
+
+	case "remote":
+		if cfg.RemoteSignerURL == "" || !common.IsHexAddress(cfg.Address) {
+			return nil, errors.New("remote signer requires REMOTE_SIGNER_URL and VALIDATOR_ADDRESS")
+		}
+		return NewRemoteSigner(cfg.RemoteSignerURL, common.HexToAddress(cfg.Address)), nil
+
+	default:
+		return nil, fmt.Errorf("unknown key backend %q", cfg.Backend)
+	}
+}
+
+// loadOrGenerateKey reads a hex private key, creating one if the file does
+// not exist
+func loadOrGenerateKey(keyPath string) (*ecdsa.PrivateKey, error) {
+	if keyPath != "" {
+		keyData, err := os.ReadFile(keyPath)
+		if err == nil {
+			return crypto.HexToECDSA(strings.TrimSpace(string(keyData)))
+		}
+	}
+
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if keyPath != "" {
+		keyHex := hex.EncodeToString(crypto.FromECDSA(privateKey))
+		if err := os.WriteFile(keyPath, []byte(keyHex), 0600); err != nil {
+			log.Printf("Warning: Could not save key to %s: %v", keyPath, err)
+		}
+	}
+
+	return privateKey, nil
+}
+
+// loadOrGenerateKeystore decrypts a geth v3 keystore file, creating one if the
+// file does not exist
+func loadOrGenerateKeystore(path, password string) (*ecdsa.PrivateKey, error) {
+	if path == "" {
+		return nil, errors.New("keystore backend requires KEYSTORE_PATH")
+	}
+
+	keyJSON, err := os.ReadFile(path)
+	if err == nil {
+		key, err := keystore.DecryptKey(keyJSON, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt keystore %s: %w", path, err)
+		}
+		return key.PrivateKey, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteKeystore(path, privateKey, password, keystore.StandardScryptN, keystore.StandardScryptP); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created keystore %s for %s", path, crypto.PubkeyToAddress(privateKey.PublicKey).Hex())
+	return privateKey, nil
+}
+
+// WriteKeystore encrypts a key into a geth v3 keystore file
+func WriteKeystore(path string, privateKey *ecdsa.PrivateKey, password string, scryptN, scryptP int) error {
+	keyJSON, err := keystore.EncryptKey(&keystore.Key{
+		Id:         uuid.New(),
+		Address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+		PrivateKey: privateKey,
+	}, password, scryptN, scryptP)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt keystore: %w", err)
+	}
+
+	if err := os.WriteFile(path, keyJSON, 0600); err != nil {
+		return fmt.Errorf("failed to write keystore %s: %w", path, err)
+	}
+	return nil
+}
+
+func readPassword(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("keystore backend requires KEYSTORE_PASSWORD_FILE")
+	}
+
+	password, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read keystore password: %w", err)
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
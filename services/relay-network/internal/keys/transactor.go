@@ -0,0 +1,64 @@
+package keys
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// NewTransactor returns transaction options that sign with signer
+func NewTransactor(signer Signer, chainID *big.Int) *bind.TransactOpts {
+	txSigner := types.LatestSignerForChainID(chainID)
+
+	return &bind.TransactOpts{
+		From: signer.Address(),
+		Signer: func(address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if address != signer.Address() {
+				return nil, bind.ErrNotAuthorized
+			}
+
+			payload, err := signingPayload(tx, chainID)
+			if err != nil {
+				return nil, err
+			}
+			signature, err := signer.SignData(payload)
+			if err != nil {
+				return nil, err
+			}
+			return tx.WithSignature(txSigner, signature)
+		},
+		Context: context.Background(),
+	}
+}
+
+// signingPayload returns the bytes whose keccak256 is the transaction's
+// signing hash, so signers that only sign data can sign transactions
+func signingPayload(tx *types.Transaction, chainID *big.Int) ([]byte, error) {
+	switch tx.Type() {
+	case types.LegacyTxType:
+		return rlp.EncodeToBytes([]interface{}{
+			tx.Nonce(), tx.GasPrice(), tx.Gas(), tx.To(), tx.Value(), tx.Data(),
+			chainID, uint(0), uint(0),
+		})
+
+	case types.AccessListTxType:
+		payload, err := rlp.EncodeToBytes([]interface{}{
+			chainID, tx.Nonce(), tx.GasPrice(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), tx.AccessList(),
+		})
+		return append([]byte{types.AccessListTxType}, payload...), err
+
+	case types.DynamicFeeTxType:
+		payload, err := rlp.EncodeToBytes([]interface{}{
+			chainID, tx.Nonce(), tx.GasTipCap(), tx.GasFeeCap(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), tx.AccessList(),
+		})
+		return append([]byte{types.DynamicFeeTxType}, payload...), err
+
+	default:
+		return nil, fmt.Errorf("unsupported transaction type %d", tx.Type())
+	}
+}
@@ -0,0 +1,321 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics are kept in a process-wide registry and served in the Prometheus
+// text exposition format. Each metric may have label names; values are
+// recorded per combination of label values, passed in the same order.
+
+// Registry holds metrics and renders them for scraping
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	name() string
+	write(b *strings.Builder)
+}
+
+// DefaultRegistry is the registry the package-level metrics are added to
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.names[m.name()] {
+		panic("metrics: duplicate metric " + m.name())
+	}
+	r.names[m.name()] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Handler serves every registered metric
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mutex.Lock()
+		metrics := append([]metric(nil), r.metrics...)
+		r.mutex.Unlock()
+		sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+
+		var b strings.Builder
+		for _, m := range metrics {
+			m.write(&b)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(b.String()))
+	})
+}
+
+// desc carries what every metric type shares: its name, help text, labels
+// and the mutex guarding its values
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+	mutex      sync.Mutex
+}
+
+func (d *desc) name() string { return d.metricName }
+
+func (d *desc) header(b *strings.Builder, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, d.help, d.metricName, kind)
+}
+
+// key joins label values into a map key
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.metricName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs renders {name="value",...} for a key, with extra pairs appended
+func (d *desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", d.labels[i], value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	desc
+	values map[string]float64
+}
+
+func NewCounter(r *Registry, name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{metricName: name, help: help, labels: labels}, values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+// Inc adds one for the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mutex.Lock()
+	c.values[key] += v
+	c.mutex.Unlock()
+}
+
+// Value returns the current count for the given label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(b *strings.Builder) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.header(b, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.metricName, c.labelPairs(key), formatFloat(c.values[key]))
+	}
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	desc
+	values map[string]float64
+}
+
+func NewGauge(r *Registry, name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{metricName: name, help: help, labels: labels}, values: make(map[string]float64)}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.mutex.Lock()
+	g.values[key] = v
+	g.mutex.Unlock()
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.mutex.Lock()
+	g.values[key] += v
+	g.mutex.Unlock()
+}
+
+// Value returns the current value for the given label values
+func (g *Gauge) Value(labelValues ...string) float64 {
+	key := g.key(labelValues)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.values[key]
+}
+
+func (g *Gauge) write(b *strings.Builder) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.header(b, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(b, "%s%s %s\n", g.metricName, g.labelPairs(key), formatFloat(g.values[key]))
+	}
+}
+
+// GaugeFunc is a gauge read from functions at scrape time, one per
+// combination of label values
+type GaugeFunc struct {
+	desc
+	reads map[string]func() float64
+}
+
+func NewGaugeFunc(r *Registry, name, help string, read func() float64) *GaugeFunc {
+	g := NewLabeledGaugeFunc(r, name, help)
+	g.SetFunc(read)
+	return g
+}
+
+// NewLabeledGaugeFunc registers a gauge whose series are added with SetFunc
+func NewLabeledGaugeFunc(r *Registry, name, help string, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{metricName: name, help: help, labels: labels}, reads: make(map[string]func() float64)}
+	r.register(g)
+	return g
+}
+
+// SetFunc sets the function read for the given label values
+func (g *GaugeFunc) SetFunc(read func() float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.mutex.Lock()
+	g.reads[key] = read
+	g.mutex.Unlock()
+}
+
+func (g *GaugeFunc) write(b *strings.Builder) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.header(b, "gauge")
+	for _, key := range sortedKeys(g.reads) {
+		fmt.Fprintf(b, "%s%s %s\n", g.metricName, g.labelPairs(key), formatFloat(g.reads[key]()))
+	}
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	desc
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// DefaultBuckets suit latencies measured in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+func NewHistogram(r *Registry, name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		desc:    desc{metricName: name, help: help, labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// Count returns how many values were observed for the given label values
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(b *strings.Builder) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.header(b, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.metricName, h.labelPairs(key, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.metricName, h.labelPairs(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.metricName, h.labelPairs(key), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.metricName, h.labelPairs(key), s.count)
+	}
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestRegistry(t *testing.T) {
+	t.Run("should render counters and gauges with labels", func(t *testing.T) {
+		r := NewRegistry()
+		counter := NewCounter(r, "test_total", "Test counter", "result")
+		counter.Inc("ok")
+		counter.Add(2, "failed")
+		gauge := NewGauge(r, "test_depth", "Test gauge")
+		gauge.Set(5)
+		gauge.Add(-2)
+		NewGaugeFunc(r, "test_peers", "Test gauge func", func() float64 { return 3 })
+
+		assert.Equal(t, float64(1), counter.Value("ok"))
+		assert.Equal(t, float64(3), gauge.Value())
+
+		out := scrape(t, r)
+		assert.Contains(t, out, "# TYPE test_total counter\n")
+		assert.Contains(t, out, "test_total{result=\"ok\"} 1\n")
+		assert.Contains(t, out, "test_total{result=\"failed\"} 2\n")
+		assert.Contains(t, out, "# TYPE test_depth gauge\ntest_depth 3\n")
+		assert.Contains(t, out, "test_peers 3\n")
+	})
+
+	t.Run("should render cumulative histogram buckets", func(t *testing.T) {
+		r := NewRegistry()
+		histogram := NewHistogram(r, "test_seconds", "Test histogram", []float64{1, 0.1}, "lane")
+		histogram.Observe(0.05, "normal")
+		histogram.Observe(0.5, "normal")
+		histogram.Observe(5, "normal")
+
+		assert.Equal(t, uint64(3), histogram.Count("normal"))
+		out := scrape(t, r)
+		assert.Contains(t, out, "test_seconds_bucket{lane=\"normal\",le=\"0.1\"} 1\n")
+		assert.Contains(t, out, "test_seconds_bucket{lane=\"normal\",le=\"1\"} 2\n")
+		assert.Contains(t, out, "test_seconds_bucket{lane=\"normal\",le=\"+Inf\"} 3\n")
+		assert.Contains(t, out, "test_seconds_sum{lane=\"normal\"} 5.55\n")
+		assert.Contains(t, out, "test_seconds_count{lane=\"normal\"} 3\n")
+	})
+
+	t.Run("should read labelled gauge funcs per series", func(t *testing.T) {
+		r := NewRegistry()
+		gauge := NewLabeledGaugeFunc(r, "test_pending", "Test labelled gauge func", "chain")
+		gauge.SetFunc(func() float64 { return 2 }, "1337")
+		gauge.SetFunc(func() float64 { return 5 }, "80002")
+
+		out := scrape(t, r)
+		assert.Contains(t, out, "test_pending{chain=\"1337\"} 2\n")
+		assert.Contains(t, out, "test_pending{chain=\"80002\"} 5\n")
+	})
+
+	t.Run("should reject duplicate names and wrong label counts", func(t *testing.T) {
+		r := NewRegistry()
+		counter := NewCounter(r, "test_total", "Test counter", "result")
+		assert.Panics(t, func() { NewGauge(r, "test_total", "Duplicate") })
+		assert.Panics(t, func() { counter.Inc() })
+	})
+}
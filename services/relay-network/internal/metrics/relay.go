@@ -0,0 +1,38 @@
+package metrics
+
+// Metrics recorded by the relay node's packages. Metrics about validation
+// carry the chain ID, since a node may validate for several chains. Gauges
+// that read node state are set by main.
+var (
+	QuorumSeconds = NewHistogram(DefaultRegistry, "relay_quorum_seconds",
+		"Time from tracking a validation request to reaching its signature quorum, by chain", DefaultBuckets, "chain")
+	SignatureShares = NewCounter(DefaultRegistry, "relay_signature_shares_total",
+		"Signature shares received, by chain and result", "chain", "result")
+	QuorumSubmissions = NewCounter(DefaultRegistry, "relay_quorum_submissions_total",
+		"On-chain aggregate submissions after quorum, by chain and result", "chain", "result")
+	CoordinatorTakeovers = NewCounter(DefaultRegistry, "relay_coordinator_takeovers_total",
+		"Aggregates this node submitted after the coordinators ranked ahead of it missed their slots, by chain", "chain")
+	TransactionReplacements = NewCounter(DefaultRegistry, "relay_tx_replacements_total",
+		"Stuck transactions this node replaced at a higher gas price, by chain", "chain")
+	PendingTransactions = NewLabeledGaugeFunc(DefaultRegistry, "relay_pending_transactions",
+		"Transactions this node sent that are not mined yet, by chain", "chain")
+
+	MessagesReceived = NewCounter(DefaultRegistry, "relay_p2p_messages_received_total",
+		"P2P messages delivered to this node, by type", "type")
+	MessagesDropped = NewCounter(DefaultRegistry, "relay_p2p_messages_dropped_total",
+		"P2P messages dropped, by reason", "reason")
+
+	BatchSize = NewHistogram(DefaultRegistry, "relay_batch_size",
+		"Validation requests per executed batch, by chain and lane", []float64{1, 2, 5, 10, 20, 50, 100, 200, 500}, "chain", "lane")
+	BatchSeconds = NewHistogram(DefaultRegistry, "relay_batch_duration_seconds",
+		"Time to process a batch of validation requests, by chain and lane", DefaultBuckets, "chain", "lane")
+
+	PendingValidations = NewLabeledGaugeFunc(DefaultRegistry, "relay_pending_validations",
+		"Validation requests awaiting quorum or expiry, by chain", "chain")
+	BatchQueueDepth = NewLabeledGaugeFunc(DefaultRegistry, "relay_batch_queue_depth",
+		"Validation requests queued for batching, by chain and lane", "chain", "lane")
+	BatchOverflows = NewCounter(DefaultRegistry, "relay_batch_overflow_total",
+		"Validation requests submitted while the batch queue was full, by chain and action", "chain", "action")
+	BatchSizeLimit = NewGauge(DefaultRegistry, "relay_batch_size_limit",
+		"Current normal lane batch size, adapted to processing latency, by chain", "chain")
+)
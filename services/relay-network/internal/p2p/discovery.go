@@ -0,0 +1,406 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Peers are discovered through signed peer records. Each validator with an
+// advertised address signs "validator -> endpoint" with its validator key.
+// Nodes send the records they know to every new peer and periodically to all
+// peers, so records spread through the mesh. A record is only accepted when
+// its signature recovers to the validator it names and that validator is
+// authorized: on the allowlist, or active in the validator set read from
+// the RelayValidator contract. The discovery loop dials known validators and
+// bootstrap peers that are not connected, backing off after failures.
+
+const (
+	peerExchangeMessageType = "peer_exchange"
+	peerRecordPrefix        = "crosspay-peer-record:"
+
+	defaultDiscoveryInterval = 30 * time.Second
+	validatorSetRefresh      = 5 * time.Minute
+	recordRefresh            = time.Hour
+	recordMaxAge             = 24 * time.Hour
+	recordMaxSkew            = 5 * time.Minute
+	maxPeerRecords           = 256
+	minDialBackoff           = 30 * time.Second
+	maxDialBackoff           = 10 * time.Minute
+)
+
+// PeerRecord is a validator's signed claim that it listens on Endpoint
+type PeerRecord struct {
+	Validator string `json:"validator"`
+	Endpoint  string `json:"endpoint"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+// ValidatorSet returns the validators currently active on-chain
+type ValidatorSet func(ctx context.Context) ([]common.Address, error)
+
+func peerRecordData(validator, endpoint string, timestamp int64) []byte {
+	return []byte(peerRecordPrefix + validator + "|" + endpoint + "|" + strconv.FormatInt(timestamp, 10))
+}
+
+// verify checks the record is signed by the validator it names
+func (r *PeerRecord) verify() (common.Address, error) {
+	if !common.IsHexAddress(r.Validator) || r.Endpoint == "" {
+		return common.Address{}, errors.New("malformed peer record")
+	}
+	signature, err := hexutil.Decode(r.Signature)
+	if err != nil || len(signature) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("%w: malformed peer record signature", ErrInvalidSignature)
+	}
+
+	validator := common.HexToAddress(r.Validator)
+	hash := crypto.Keccak256(peerRecordData(validator.Hex(), r.Endpoint, r.Timestamp))
+	pub, err := crypto.SigToPub(hash, signature)
+	if err != nil || crypto.PubkeyToAddress(*pub) != validator {
+		return common.Address{}, fmt.Errorf("%w: peer record for %s", ErrInvalidSignature, validator.Hex())
+	}
+	return validator, nil
+}
+
+type dialState struct {
+	attempts int
+	next     time.Time
+}
+
+type discovery struct {
+	mutex        sync.Mutex
+	records      map[common.Address]*PeerRecord
+	active       map[common.Address]bool
+	activeAt     time.Time
+	validatorSet ValidatorSet
+	self         *PeerRecord
+	dials        map[string]*dialState
+}
+
+func newDiscovery() *discovery {
+	return &discovery{
+		records: make(map[common.Address]*PeerRecord),
+		dials:   make(map[string]*dialState),
+	}
+}
+
+// allowed reports whether validator is in the active set. No validator is
+// allowed until the set has been read, so a node whose reads fail accepts
+// no one rather than everyone.
+func (d *discovery) allowed(validator common.Address) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.active[validator]
+}
+
+// SetValidatorSet sets where the active validator set is read from. Once it
+// has been read, only active validators may connect and have their records
+// accepted, unless P2P_VALIDATOR_ALLOWLIST is set. Without the allowlist it
+// must be set before Start.
+func (n *Network) SetValidatorSet(validatorSet ValidatorSet) {
+	n.discovery.mutex.Lock()
+	n.discovery.validatorSet = validatorSet
+	n.discovery.mutex.Unlock()
+}
+
+// hasValidatorSet reports whether the active validator set can be read
+func (d *discovery) hasValidatorSet() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.validatorSet != nil
+}
+
+// authorize decides which validators may connect: the allowlist when one is
+// configured, otherwise the active validator set
+func (n *Network) authorize(validator common.Address) bool {
+	if n.allowlist != nil {
+		return n.allowlist(validator)
+	}
+	return n.discovery.allowed(validator)
+}
+
+// refreshValidatorSet reads the active validators when they are due
+func (n *Network) refreshValidatorSet() {
+	n.discovery.mutex.Lock()
+	validatorSet := n.discovery.validatorSet
+	due := n.discovery.active == nil || time.Since(n.discovery.activeAt) > validatorSetRefresh
+	n.discovery.mutex.Unlock()
+	if validatorSet == nil || !due {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(n.ctx, 30*time.Second)
+	defer cancel()
+	validators, err := validatorSet(ctx)
+	if err != nil {
+		log.Printf("Failed to read active validator set: %v", err)
+		return
+	}
+
+	active := make(map[common.Address]bool, len(validators))
+	for _, validator := range validators {
+		active[validator] = true
+	}
+
+	n.discovery.mutex.Lock()
+	n.discovery.active = active
+	n.discovery.activeAt = time.Now()
+	for validator := range n.discovery.records {
+		if !active[validator] {
+			delete(n.discovery.records, validator)
+		}
+	}
+	n.discovery.mutex.Unlock()
+
+	if n.allowlist != nil {
+		return
+	}
+	// Validators that have left the set are disconnected
+	n.mutex.Lock()
+	for _, peer := range n.peers {
+		if !active[common.HexToAddress(peer.ValidatorAddress)] && peer.Connection != nil {
+			log.Printf("Disconnecting peer %s: validator %s is no longer active", peer.Address, peer.ValidatorAddress)
+			peer.Connection.Close()
+		}
+	}
+	n.mutex.Unlock()
+}
+
+// selfRecord returns this node's signed record, re-signing it when it is due.
+// Nodes without an advertised address have no record.
+func (n *Network) selfRecord() *PeerRecord {
+	if n.config.AdvertiseAddress == "" {
+		return nil
+	}
+
+	n.discovery.mutex.Lock()
+	record := n.discovery.self
+	n.discovery.mutex.Unlock()
+	if record != nil && record.Endpoint == n.config.AdvertiseAddress && time.Since(time.Unix(record.Timestamp, 0)) < recordRefresh {
+		return record
+	}
+
+	validator := n.identity.Address.Hex()
+	timestamp := time.Now().Unix()
+	signature, err := n.signer.SignData(peerRecordData(validator, n.config.AdvertiseAddress, timestamp))
+	if err != nil {
+		log.Printf("Failed to sign peer record: %v", err)
+		return record
+	}
+
+	record = &PeerRecord{
+		Validator: validator,
+		Endpoint:  n.config.AdvertiseAddress,
+		Timestamp: timestamp,
+		Signature: hexutil.Encode(signature),
+	}
+	n.discovery.mutex.Lock()
+	n.discovery.self = record
+	n.discovery.mutex.Unlock()
+	return record
+}
+
+// KnownPeers returns the peer records this node would share
+func (n *Network) KnownPeers() []PeerRecord {
+	cutoff := time.Now().Add(-recordMaxAge).Unix()
+
+	n.discovery.mutex.Lock()
+	records := make([]PeerRecord, 0, len(n.discovery.records)+1)
+	for _, record := range n.discovery.records {
+		if record.Timestamp >= cutoff {
+			records = append(records, *record)
+		}
+	}
+	n.discovery.mutex.Unlock()
+
+	if self := n.selfRecord(); self != nil {
+		records = append(records, *self)
+	}
+	if len(records) > maxPeerRecords {
+		records = records[:maxPeerRecords]
+	}
+	return records
+}
+
+// sendPeerExchange sends the known peer records to one peer
+func (n *Network) sendPeerExchange(peer *Peer) error {
+	records := n.KnownPeers()
+	if len(records) == 0 {
+		return nil
+	}
+
+	data, err := n.frame(&ValidationMessage{
+		Type:      peerExchangeMessageType,
+		Peers:     records,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return peer.send(data)
+}
+
+// handlePeerExchange stores the valid records a peer sent, keeping the newest
+// record for each validator
+func (n *Network) handlePeerExchange(peer *Peer, msg *ValidationMessage) {
+	if len(msg.Peers) > maxPeerRecords {
+		n.penalize(peer.ValidatorAddress, fmt.Sprintf("peer exchange with %d records", len(msg.Peers)), false)
+		return
+	}
+
+	now := time.Now()
+	added := 0
+	for i := range msg.Peers {
+		record := msg.Peers[i]
+		validator, err := record.verify()
+		if err != nil {
+			n.penalize(peer.ValidatorAddress, err.Error(), errors.Is(err, ErrInvalidSignature))
+			continue
+		}
+
+		signedAt := time.Unix(record.Timestamp, 0)
+		if validator == n.identity.Address || signedAt.After(now.Add(recordMaxSkew)) || now.Sub(signedAt) > recordMaxAge {
+			continue
+		}
+		if !n.authorize(validator) {
+			continue
+		}
+
+		n.discovery.mutex.Lock()
+		if existing, ok := n.discovery.records[validator]; !ok || existing.Timestamp < record.Timestamp {
+			n.discovery.records[validator] = &record
+			added++
+		}
+		n.discovery.mutex.Unlock()
+	}
+
+	if added > 0 {
+		log.Printf("Learned %d peer records from %s", added, peer.ValidatorAddress)
+	}
+}
+
+// discoverPeers dials bootstrap peers and known validators that are not
+// connected and whose backoff has passed
+func (n *Network) discoverPeers() {
+	n.refreshValidatorSet()
+
+	n.mutex.RLock()
+	connectedValidators := make(map[string]bool, len(n.peers))
+	connectedEndpoints := make(map[string]bool, len(n.peers))
+	for _, peer := range n.peers {
+		connectedValidators[peer.ValidatorAddress] = true
+		if peer.Endpoint != "" {
+			connectedEndpoints[peer.Endpoint] = true
+		}
+	}
+	full := n.config.MaxPeers > 0 && len(n.peers) >= n.config.MaxPeers
+	n.mutex.RUnlock()
+	if full {
+		return
+	}
+
+	var endpoints []string
+	for _, endpoint := range n.config.BootstrapPeers {
+		if endpoint != "" && !connectedEndpoints[endpoint] {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	cutoff := time.Now().Add(-recordMaxAge).Unix()
+	n.discovery.mutex.Lock()
+	for validator, record := range n.discovery.records {
+		if record.Timestamp < cutoff {
+			delete(n.discovery.records, validator)
+			continue
+		}
+		if !connectedValidators[validator.Hex()] && !connectedEndpoints[record.Endpoint] {
+			if _, banned := n.reputation.bannedUntil(validator.Hex()); !banned {
+				endpoints = append(endpoints, record.Endpoint)
+			}
+		}
+	}
+
+	now := time.Now()
+	var due []string
+	for _, endpoint := range endpoints {
+		state, ok := n.discovery.dials[endpoint]
+		if !ok {
+			state = &dialState{}
+			n.discovery.dials[endpoint] = state
+		}
+		if now.Before(state.next) {
+			continue
+		}
+		// Back off until the connection is made; a successful handshake
+		// resets the state
+		backoff := minDialBackoff << min(state.attempts, 5)
+		if backoff > maxDialBackoff {
+			backoff = maxDialBackoff
+		}
+		state.attempts++
+		state.next = now.Add(backoff)
+		due = append(due, endpoint)
+	}
+	n.discovery.mutex.Unlock()
+
+	for _, endpoint := range due {
+		go func(endpoint string) {
+			if err := n.connectToPeer(endpoint); err != nil {
+				log.Printf("Failed to connect to peer %s: %v", endpoint, err)
+			}
+		}(endpoint)
+	}
+}
+
+// connected resets the backoff for an endpoint after a successful handshake
+func (d *discovery) connected(endpoint string) {
+	if endpoint == "" {
+		return
+	}
+	d.mutex.Lock()
+	delete(d.dials, endpoint)
+	d.mutex.Unlock()
+}
+
+// runDiscovery dials peers and shares peer records until the network stops
+func (n *Network) runDiscovery() {
+	interval := time.Duration(n.config.DiscoveryIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	n.discoverPeers()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+			n.discoverPeers()
+
+			n.mutex.RLock()
+			peers := make([]*Peer, 0, len(n.peers))
+			for _, peer := range n.peers {
+				peers = append(peers, peer)
+			}
+			n.mutex.RUnlock()
+			for _, peer := range peers {
+				if err := n.sendPeerExchange(peer); err != nil {
+					log.Printf("Failed to send peer records to %s: %v", peer.Address, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// advertise makes a started node share its listener address in its record
+func advertise(n *Network) {
+	n.config.AdvertiseAddress = n.listener.Addr().String()
+}
+
+func connectedTo(n *Network, validator common.Address) bool {
+	for _, peer := range n.GetPeers() {
+		if peer.ValidatorAddress == validator.Hex() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPeerRecord(t *testing.T) {
+	keys := newTestKeys(t, 2)
+	node := startTestNetwork(t, keys[0], keys[1])
+	advertise(node)
+
+	record := node.selfRecord()
+	require.NotNil(t, record)
+	validator, err := record.verify()
+	require.NoError(t, err)
+	assert.Equal(t, crypto.PubkeyToAddress(keys[0].PublicKey), validator)
+
+	tampered := *record
+	tampered.Endpoint = "10.0.0.1:9090"
+	_, err = tampered.verify()
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	tampered = *record
+	tampered.Validator = crypto.PubkeyToAddress(keys[1].PublicKey).Hex()
+	_, err = tampered.verify()
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestPeerDiscovery(t *testing.T) {
+	keys := newTestKeys(t, 3)
+	addrA := crypto.PubkeyToAddress(keys[0].PublicKey)
+	addrB := crypto.PubkeyToAddress(keys[1].PublicKey)
+
+	t.Run("should connect to validators learned through peer exchange", func(t *testing.T) {
+		nodeA := startTestNetwork(t, keys[0], keys[1], keys[2])
+		nodeB := startTestNetwork(t, keys[1], keys[0], keys[2])
+		nodeC := startTestNetwork(t, keys[2], keys[0], keys[1])
+		advertise(nodeA)
+
+		connectPeers(t, nodeB, nodeA)
+		require.Eventually(t, func() bool {
+			return len(nodeB.KnownPeers()) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+
+		connectPeers(t, nodeC, nodeB)
+		require.Eventually(t, func() bool {
+			return len(nodeC.KnownPeers()) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Equal(t, addrA.Hex(), nodeC.KnownPeers()[0].Validator)
+
+		nodeC.discoverPeers()
+		require.Eventually(t, func() bool {
+			return connectedTo(nodeC, addrA)
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("should only accept records for active validators", func(t *testing.T) {
+		nodeA := startTestNetwork(t, keys[0], keys[1], keys[2])
+		nodeB := startTestNetwork(t, keys[1], keys[0], keys[2])
+		nodeC := newTestNetwork(t, config.P2PConfig{}, keys[2])
+		nodeC.SetValidatorSet(func(ctx context.Context) ([]common.Address, error) {
+			return []common.Address{addrB}, nil
+		})
+		require.NoError(t, nodeC.Start())
+		advertise(nodeA)
+		nodeC.refreshValidatorSet()
+
+		connectPeers(t, nodeB, nodeA)
+		require.Eventually(t, func() bool {
+			return len(nodeB.KnownPeers()) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+
+		connectPeers(t, nodeC, nodeB)
+		time.Sleep(200 * time.Millisecond)
+		assert.Empty(t, nodeC.KnownPeers())
+
+		// Validators outside the set cannot connect either
+		require.NoError(t, nodeA.connectToPeer(nodeC.listener.Addr().String()))
+		time.Sleep(200 * time.Millisecond)
+		assert.False(t, connectedTo(nodeC, addrA))
+	})
+
+	t.Run("should reject validators until the validator set is read", func(t *testing.T) {
+		var mutex sync.Mutex
+		readErr := errors.New("connection refused")
+		nodeA := startTestNetwork(t, keys[0], keys[1])
+		nodeB := newTestNetwork(t, config.P2PConfig{}, keys[1])
+		nodeB.SetValidatorSet(func(ctx context.Context) ([]common.Address, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if readErr != nil {
+				return nil, readErr
+			}
+			return []common.Address{addrA}, nil
+		})
+		require.NoError(t, nodeB.Start())
+		nodeB.refreshValidatorSet()
+
+		require.NoError(t, nodeA.connectToPeer(nodeB.listener.Addr().String()))
+		time.Sleep(200 * time.Millisecond)
+		assert.False(t, connectedTo(nodeB, addrA))
+
+		mutex.Lock()
+		readErr = nil
+		mutex.Unlock()
+		nodeB.refreshValidatorSet()
+		require.NoError(t, nodeA.connectToPeer(nodeB.listener.Addr().String()))
+		require.Eventually(t, func() bool {
+			return connectedTo(nodeB, addrA)
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("should redial bootstrap peers after a disconnect", func(t *testing.T) {
+		// nodeB dials its bootstrap peer once when it starts, and then only
+		// when the test asks it to
+		nodeA := startTestNetwork(t, keys[0], keys[1])
+		nodeB := startTestNetworkWithConfig(t, config.P2PConfig{
+			DiscoveryIntervalSeconds: 3600,
+			BootstrapPeers:           []string{nodeA.listener.Addr().String()},
+		}, keys[1], keys[0])
+
+		require.Eventually(t, func() bool {
+			return connectedTo(nodeB, addrA) && connectedTo(nodeA, addrB)
+		}, 5*time.Second, 20*time.Millisecond)
+
+		nodeA.mutex.RLock()
+		for _, peer := range nodeA.peers {
+			peer.Connection.Close()
+		}
+		nodeA.mutex.RUnlock()
+		require.Eventually(t, func() bool {
+			return !connectedTo(nodeB, addrA)
+		}, 5*time.Second, 20*time.Millisecond)
+
+		nodeB.discoverPeers()
+		require.Eventually(t, func() bool {
+			return connectedTo(nodeB, addrA)
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+}
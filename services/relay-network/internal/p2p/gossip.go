@@ -0,0 +1,275 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/metrics"
+)
+
+// Messages are gossiped rather than sent only to direct peers: every node
+// relays a message it has not seen before to its other peers subscribed to
+// the message topic, decrementing the TTL on each hop. The seen cache stops
+// messages looping back through the mesh.
+
+const (
+	TopicValidationRequests = "validation_requests"
+	TopicSignatureShares    = "signature_shares"
+
+	subscribeMessageType = "subscribe"
+	defaultGossipTTL     = 6
+	seenCacheTTL         = 10 * time.Minute
+)
+
+// DefaultTopics are the topics a node subscribes to when none are configured
+var DefaultTopics = []string{TopicValidationRequests, TopicSignatureShares}
+
+// topicFor returns the topic a message type is gossiped on
+func topicFor(msgType string) string {
+	switch msgType {
+	case "validation_request", "validation_complete":
+		return TopicValidationRequests
+	case "signature_share":
+		return TopicSignatureShares
+	default:
+		return ""
+	}
+}
+
+// messageID derives a gossip ID from the message content, so a relaying peer
+// cannot change the ID to get a message past the seen cache
+func messageID(msg *ValidationMessage) string {
+	data, _ := json.Marshal(struct {
+		Type         string `json:"type"`
+		ChainID      int64  `json:"chain_id"`
+		RequestID    uint64 `json:"request_id"`
+		PaymentID    uint64 `json:"payment_id"`
+		MessageHash  string `json:"message_hash"`
+		RequiredSigs int    `json:"required_signatures"`
+		Signature    string `json:"signature"`
+		Signer       string `json:"signer"`
+		Origin       string `json:"origin"`
+		Timestamp    int64  `json:"timestamp"`
+		Nonce        uint64 `json:"nonce"`
+	}{msg.Type, msg.ChainID, msg.RequestID, msg.PaymentID, msg.MessageHash, msg.RequiredSigs, msg.Signature, msg.Signer, msg.Origin, msg.Timestamp.UnixNano(), msg.Nonce})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// seenCache remembers recently handled message IDs
+type seenCache struct {
+	mutex   sync.Mutex
+	entries map[string]time.Time
+	ttl     time.Duration
+}
+
+func newSeenCache(ttl time.Duration) *seenCache {
+	return &seenCache{entries: make(map[string]time.Time), ttl: ttl}
+}
+
+// add records id and reports whether it had not been seen before
+func (c *seenCache) add(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if seenAt, ok := c.entries[id]; ok && time.Since(seenAt) < c.ttl {
+		return false
+	}
+	c.entries[id] = time.Now()
+	return true
+}
+
+// prune drops IDs older than the cache TTL
+func (c *seenCache) prune() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cutoff := time.Now().Add(-c.ttl)
+	for id, seenAt := range c.entries {
+		if seenAt.Before(cutoff) {
+			delete(c.entries, id)
+		}
+	}
+}
+
+// Subscribed reports whether this node handles messages on topic
+func (n *Network) Subscribed(topic string) bool {
+	return n.topics[topic]
+}
+
+// subscribedTo reports whether the peer asked for topic. Peers that have not
+// announced their subscriptions receive every topic.
+func (p *Peer) subscribedTo(topic string) bool {
+	if p.Topics == nil {
+		return true
+	}
+	for _, t := range p.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// send writes one newline-delimited JSON frame to the peer
+func (p *Peer) send(data []byte) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	p.Connection.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := p.Connection.Write(data)
+	return err
+}
+
+// announceSubscriptions tells a new peer which topics to relay to this node
+func (n *Network) announceSubscriptions(peer *Peer) error {
+	topics := make([]string, 0, len(n.topics))
+	for topic := range n.topics {
+		topics = append(topics, topic)
+	}
+
+	data, err := n.frame(&ValidationMessage{
+		Type:      subscribeMessageType,
+		Topics:    topics,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return peer.send(data)
+}
+
+// publish gossips a message originating at this node
+func (n *Network) publish(msg *ValidationMessage) (int, error) {
+	msg.Topic = topicFor(msg.Type)
+	if msg.Topic == "" {
+		return 0, fmt.Errorf("unknown message type: %s", msg.Type)
+	}
+	if err := n.sign(msg); err != nil {
+		return 0, err
+	}
+	msg.TTL = n.config.GossipTTL
+	if msg.TTL <= 0 {
+		msg.TTL = defaultGossipTTL
+	}
+	msg.ID = messageID(msg)
+	n.seen.add(msg.ID)
+
+	return n.relay(msg, "")
+}
+
+// relay sends a message to every peer subscribed to its topic except the one
+// it came from, highest scoring peers first. Low scoring peers only receive
+// messages this node publishes.
+func (n *Network) relay(msg *ValidationMessage, from string) (int, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal %s: %w", msg.Type, err)
+	}
+	data = append(data, '\n')
+
+	n.mutex.RLock()
+	targets := make([]*Peer, 0, len(n.peers))
+	for addr, peer := range n.peers {
+		if addr == from || !peer.IsActive || peer.Connection == nil || !peer.subscribedTo(msg.Topic) {
+			continue
+		}
+		if from != "" && n.reputation.low(peer.ValidatorAddress) {
+			continue
+		}
+		targets = append(targets, peer)
+	}
+	n.mutex.RUnlock()
+
+	scores := make(map[*Peer]float64, len(targets))
+	for _, peer := range targets {
+		scores[peer] = n.reputation.score(peer.ValidatorAddress)
+	}
+	sort.SliceStable(targets, func(i, j int) bool { return scores[targets[i]] > scores[targets[j]] })
+
+	sent := 0
+	for _, peer := range targets {
+		if err := peer.send(data); err != nil {
+			log.Printf("Failed to send %s to peer %s: %v", msg.Type, peer.Address, err)
+			metrics.MessagesDropped.Inc("send_failed")
+			n.mutex.Lock()
+			peer.IsActive = false
+			n.mutex.Unlock()
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// receive handles a frame read from a peer: after its sender signature is
+// checked, subscription announcements update the peer and unseen messages are
+// delivered locally and relayed onwards
+func (n *Network) receive(peer *Peer, msg *ValidationMessage) {
+	if err := n.verify(peer, msg, topicFor(msg.Type) == ""); err != nil {
+		n.reject(peer, err)
+		return
+	}
+
+	if msg.Type == pingMessageType || msg.Type == pongMessageType {
+		n.handlePing(peer, msg)
+		return
+	}
+	if msg.Type == peerExchangeMessageType {
+		n.handlePeerExchange(peer, msg)
+		return
+	}
+	if msg.Type == subscribeMessageType {
+		n.mutex.Lock()
+		peer.Topics = msg.Topics
+		if peer.Topics == nil {
+			peer.Topics = []string{}
+		}
+		n.mutex.Unlock()
+		return
+	}
+
+	msg.Topic = topicFor(msg.Type)
+	if msg.Topic == "" {
+		metrics.MessagesDropped.Inc("unknown_type")
+		n.penalize(peer.ValidatorAddress, fmt.Sprintf("unknown message type %q", msg.Type), false)
+		return
+	}
+	if msg.ID != "" && msg.ID != messageID(msg) {
+		metrics.MessagesDropped.Inc("invalid_id")
+		n.penalize(peer.ValidatorAddress, "mismatched message ID", false)
+		return
+	}
+	msg.ID = messageID(msg)
+
+	if !n.seen.add(msg.ID) {
+		metrics.MessagesDropped.Inc("duplicate")
+		return
+	}
+	n.reputation.recordValid(peer.ValidatorAddress)
+	msg.from = peer.ValidatorAddress
+
+	if n.Subscribed(msg.Topic) {
+		metrics.MessagesReceived.Inc(msg.Type)
+		select {
+		case n.messageQueue <- msg:
+		case <-n.ctx.Done():
+			return
+		}
+	}
+
+	if msg.TTL > 1 {
+		forward := *msg
+		forward.TTL--
+		if _, err := n.relay(&forward, peer.Address); err != nil {
+			log.Printf("Failed to relay message %s: %v", msg.ID, err)
+		}
+	}
+}
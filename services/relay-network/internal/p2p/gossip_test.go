@@ -0,0 +1,140 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKeys(t *testing.T, count int) []*ecdsa.PrivateKey {
+	keys := make([]*ecdsa.PrivateKey, count)
+	for i := range keys {
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		keys[i] = key
+	}
+	return keys
+}
+
+// connectPeers dials b from a and waits until both sides have exchanged
+// subscriptions
+func connectPeers(t *testing.T, a, b *Network) {
+	peersA, peersB := a.GetPeerCount(), b.GetPeerCount()
+	require.NoError(t, a.connectToPeer(b.listener.Addr().String()))
+
+	announced := func(n *Network, count int) bool {
+		peers := n.GetPeers()
+		if len(peers) != count {
+			return false
+		}
+		for _, peer := range peers {
+			if peer.Topics == nil {
+				return false
+			}
+		}
+		return true
+	}
+	require.Eventually(t, func() bool {
+		return announced(a, peersA+1) && announced(b, peersB+1)
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func receivedBy(n *Network) []uint64 {
+	return n.validator.(*stubValidator).received()
+}
+
+func TestGossipPropagation(t *testing.T) {
+	keys := newTestKeys(t, 3)
+
+	t.Run("should relay messages beyond direct peers", func(t *testing.T) {
+		nodeA := startTestNetwork(t, keys[0], keys[1])
+		nodeB := startTestNetwork(t, keys[1], keys[0], keys[2])
+		nodeC := startTestNetwork(t, keys[2], keys[1])
+		connectPeers(t, nodeB, nodeA)
+		connectPeers(t, nodeB, nodeC)
+
+		require.NoError(t, nodeA.BroadcastValidationRequest(&ValidationMessage{
+			Type: "validation_request", RequestID: 1, PaymentID: 1, MessageHash: "0x01", Timestamp: time.Now(),
+		}))
+
+		require.Eventually(t, func() bool {
+			return len(receivedBy(nodeC)) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Equal(t, []uint64{1}, receivedBy(nodeB))
+		assert.Empty(t, receivedBy(nodeA))
+	})
+
+	t.Run("should deliver each message once in a cycle", func(t *testing.T) {
+		nodeA := startTestNetwork(t, keys[0], keys[1], keys[2])
+		nodeB := startTestNetwork(t, keys[1], keys[0], keys[2])
+		nodeC := startTestNetwork(t, keys[2], keys[0], keys[1])
+		connectPeers(t, nodeA, nodeB)
+		connectPeers(t, nodeB, nodeC)
+		connectPeers(t, nodeC, nodeA)
+
+		require.NoError(t, nodeA.BroadcastValidationRequest(&ValidationMessage{
+			Type: "validation_request", RequestID: 2, PaymentID: 2, MessageHash: "0x02", Timestamp: time.Now(),
+		}))
+
+		require.Eventually(t, func() bool {
+			return len(receivedBy(nodeB)) == 1 && len(receivedBy(nodeC)) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+		time.Sleep(200 * time.Millisecond)
+		assert.Equal(t, []uint64{2}, receivedBy(nodeB))
+		assert.Equal(t, []uint64{2}, receivedBy(nodeC))
+		assert.Empty(t, receivedBy(nodeA))
+	})
+
+	t.Run("should stop relaying when the TTL runs out", func(t *testing.T) {
+		nodeA := startTestNetworkWithConfig(t, config.P2PConfig{GossipTTL: 1}, keys[0], keys[1])
+		nodeB := startTestNetwork(t, keys[1], keys[0], keys[2])
+		nodeC := startTestNetwork(t, keys[2], keys[1])
+		connectPeers(t, nodeB, nodeA)
+		connectPeers(t, nodeB, nodeC)
+
+		require.NoError(t, nodeA.BroadcastValidationRequest(&ValidationMessage{
+			Type: "validation_request", RequestID: 3, PaymentID: 3, MessageHash: "0x03", Timestamp: time.Now(),
+		}))
+
+		require.Eventually(t, func() bool {
+			return len(receivedBy(nodeB)) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+		time.Sleep(200 * time.Millisecond)
+		assert.Empty(t, receivedBy(nodeC))
+	})
+
+	t.Run("should only relay topics a peer subscribed to", func(t *testing.T) {
+		nodeA := startTestNetwork(t, keys[0], keys[1])
+		nodeB := startTestNetwork(t, keys[1], keys[0], keys[2])
+		nodeC := startTestNetworkWithConfig(t, config.P2PConfig{Topics: []string{TopicSignatureShares}}, keys[2], keys[1])
+		connectPeers(t, nodeB, nodeA)
+		connectPeers(t, nodeB, nodeC)
+
+		require.NoError(t, nodeA.BroadcastValidationRequest(&ValidationMessage{
+			Type: "validation_request", RequestID: 4, PaymentID: 4, MessageHash: "0x04", Timestamp: time.Now(),
+		}))
+
+		require.Eventually(t, func() bool {
+			return len(receivedBy(nodeB)) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+		time.Sleep(200 * time.Millisecond)
+		assert.Empty(t, receivedBy(nodeC))
+	})
+}
+
+func TestSeenCache(t *testing.T) {
+	cache := newSeenCache(time.Minute)
+	msg := &ValidationMessage{Type: "signature_share", RequestID: 7, Signature: "0xabc", Timestamp: time.Now()}
+	id := messageID(msg)
+
+	assert.True(t, cache.add(id))
+	assert.False(t, cache.add(id))
+
+	msg.Signature = "0xdef"
+	assert.NotEqual(t, id, messageID(msg))
+}
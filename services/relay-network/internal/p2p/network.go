@@ -2,36 +2,58 @@ package p2p
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/crosspay/relay-network/internal/config"
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/crosspay/relay-network/internal/metrics"
 )
 
 type ValidationMessage struct {
-	Type        string      `json:"type"`
-	RequestID   uint64      `json:"request_id"`
-	PaymentID   uint64      `json:"payment_id"`
-	MessageHash string      `json:"message_hash"`
-	Signature   string      `json:"signature,omitempty"`
-	Signer      string      `json:"signer,omitempty"`
-	Timestamp   time.Time   `json:"timestamp"`
+	Type            string       `json:"type"`
+	ChainID         int64        `json:"chain_id,omitempty"`
+	RequestID       uint64       `json:"request_id"`
+	PaymentID       uint64       `json:"payment_id"`
+	MessageHash     string       `json:"message_hash"`
+	RequiredSigs    int          `json:"required_signatures,omitempty"`
+	Signature       string       `json:"signature,omitempty"`
+	Signer          string       `json:"signer,omitempty"`
+	Timestamp       time.Time    `json:"timestamp"`
+	ID              string       `json:"id,omitempty"`
+	Topic           string       `json:"topic,omitempty"`
+	TTL             int          `json:"ttl,omitempty"`
+	Origin          string       `json:"origin,omitempty"`
+	Topics          []string     `json:"topics,omitempty"`
+	Peers           []PeerRecord `json:"peers,omitempty"`
+	Nonce           uint64       `json:"nonce,omitempty"`
+	SenderSignature string       `json:"sender_signature,omitempty"`
+	from            string
 }
 
 type Peer struct {
-	Address    string    `json:"address"`
-	PublicKey  string    `json:"public_key"`
-	LastSeen   time.Time `json:"last_seen"`
-	Connection net.Conn  `json:"-"`
-	IsActive   bool      `json:"is_active"`
+	Address          string     `json:"address"`
+	Endpoint         string     `json:"endpoint,omitempty"`
+	ValidatorAddress string     `json:"validator_address"`
+	LastSeen         time.Time  `json:"last_seen"`
+	Connection       net.Conn   `json:"-"`
+	IsActive         bool       `json:"is_active"`
+	Topics           []string   `json:"topics,omitempty"`
+	Score            *PeerScore `json:"score,omitempty"`
+	writeMutex       sync.Mutex
+	pingSent         time.Time
 }
 
 type ValidatorNode interface {
 	ProcessValidationRequest(req *ValidationMessage) error
+	ProcessSignatureShare(msg *ValidationMessage) error
 	GetAddress() string
 	GetStatus() string
 }
@@ -39,49 +61,95 @@ type ValidatorNode interface {
 type Network struct {
 	config        config.P2PConfig
 	validator     ValidatorNode
+	identity      *Identity
+	signer        keys.Signer
+	allowlist     PeerAuthorizer
+	tlsConfig     *tls.Config
 	peers         map[string]*Peer
 	listener      net.Listener
 	mutex         sync.RWMutex
 	ctx           context.Context
 	cancel        context.CancelFunc
 	messageQueue  chan *ValidationMessage
-	isRunning     bool
+	topics        map[string]bool
+	seen          *seenCache
+	nonces        *seenCache
+	reputation    *reputation
+	discovery     *discovery
+	isRunning     atomic.Bool
 }
 
-func NewNetwork(cfg config.P2PConfig, validator ValidatorNode) *Network {
+// NewNetwork creates a network whose peer connections are authenticated with
+// the validator key and restricted to the validators in cfg.AllowedValidators
+func NewNetwork(cfg config.P2PConfig, validator ValidatorNode, signer keys.Signer) (*Network, error) {
+	identity, err := NewIdentity(signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create P2P identity: %w", err)
+	}
+
+	allowlist := AllowlistAuthorizer(cfg.AllowedValidators)
+
+	topics := make(map[string]bool)
+	for _, topic := range cfg.Topics {
+		if topic != "" {
+			topics[topic] = true
+		}
+	}
+	if len(topics) == 0 {
+		for _, topic := range DefaultTopics {
+			topics[topic] = true
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	
-	return &Network{
+	n := &Network{
 		config:       cfg,
 		validator:    validator,
+		identity:     identity,
+		signer:       signer,
+		allowlist:    allowlist,
 		peers:        make(map[string]*Peer),
 		ctx:          ctx,
 		cancel:       cancel,
 		messageQueue: make(chan *ValidationMessage, 100),
+		topics:       topics,
+		seen:         newSeenCache(seenCacheTTL),
+		nonces:       newSeenCache(2 * messageWindow(cfg)),
+		reputation:   newReputation(cfg.BanScore, cfg.LowScore, time.Duration(cfg.BanMinutes)*time.Minute),
+		discovery:    newDiscovery(),
 	}
+	n.tlsConfig = identity.TLSConfig(n.authorize)
+	return n, nil
 }
 
+// Start listens for peers. Without P2P_VALIDATOR_ALLOWLIST it needs a
+// validator set, set with SetValidatorSet, to check peers against.
 func (n *Network) Start() error {
+	if n.allowlist == nil && !n.discovery.hasValidatorSet() {
+		return errors.New("P2P_VALIDATOR_ALLOWLIST is not set and there is no validator set to check peers against")
+	}
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", n.config.Port))
 	if err != nil {
 		return fmt.Errorf("failed to start P2P listener: %w", err)
 	}
 	
-	n.listener = listener
-	n.isRunning = true
+	n.listener = tls.NewListener(listener, n.tlsConfig)
+	n.isRunning.Store(true)
 	
-	log.Printf("P2P network listening on port %d", n.config.Port)
+	log.Printf("P2P network listening on port %d as %s", n.config.Port, n.identity.Address.Hex())
 
 	go n.acceptConnections()
 	go n.processMessages()
-	go n.connectToBootstrapPeers()
+	go n.runDiscovery()
 	go n.maintainPeers()
 
 	return nil
 }
 
 func (n *Network) Stop() {
-	n.isRunning = false
+	n.isRunning.Store(false)
 	n.cancel()
 	
 	if n.listener != nil {
@@ -96,45 +164,83 @@ func (n *Network) Stop() {
 	}
 	n.mutex.Unlock()
 
-	close(n.messageQueue)
 	log.Println("P2P network stopped")
 }
 
 func (n *Network) acceptConnections() {
-	for n.isRunning {
+	for n.isRunning.Load() {
 		conn, err := n.listener.Accept()
 		if err != nil {
-			if n.isRunning {
+			if n.isRunning.Load() {
 				log.Printf("Failed to accept connection: %v", err)
 			}
 			continue
 		}
 
-		go n.handleConnection(conn)
+		go n.handleConnection(conn.(*tls.Conn), "")
 	}
 }
 
-func (n *Network) handleConnection(conn net.Conn) {
+// handleConnection runs a peer connection. endpoint is the address dialed
+// for outbound connections and empty for inbound ones.
+func (n *Network) handleConnection(conn *tls.Conn, endpoint string) {
 	defer conn.Close()
 
 	peerAddr := conn.RemoteAddr().String()
-	log.Printf("New peer connection from %s", peerAddr)
+
+	// Nothing is read from a peer before it proves an authorized validator key
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.HandshakeContext(n.ctx); err != nil {
+		log.Printf("Rejected peer %s: %v", peerAddr, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	validatorAddr, err := PeerAddress(conn)
+	if err != nil {
+		log.Printf("Rejected peer %s: %v", peerAddr, err)
+		return
+	}
+	if until, banned := n.reputation.bannedUntil(validatorAddr.Hex()); banned {
+		log.Printf("Rejected peer %s: validator %s banned until %s", peerAddr, validatorAddr.Hex(), until.Format(time.RFC3339))
+		return
+	}
+	log.Printf("New peer connection from %s (validator %s)", peerAddr, validatorAddr.Hex())
 
 	peer := &Peer{
-		Address:    peerAddr,
-		LastSeen:   time.Now(),
-		Connection: conn,
-		IsActive:   true,
+		Address:          peerAddr,
+		Endpoint:         endpoint,
+		ValidatorAddress: validatorAddr.Hex(),
+		LastSeen:         time.Now(),
+		Connection:       conn,
+		IsActive:         true,
 	}
 
 	n.mutex.Lock()
+	if !n.makeRoom(peer.ValidatorAddress) {
+		n.mutex.Unlock()
+		log.Printf("Rejected peer %s: peer limit %d reached", peerAddr, n.config.MaxPeers)
+		return
+	}
 	n.peers[peerAddr] = peer
 	n.mutex.Unlock()
+	n.reputation.connected(peer.ValidatorAddress)
+	n.discovery.connected(endpoint)
+
+	if err := n.announceSubscriptions(peer); err != nil {
+		log.Printf("Failed to announce subscriptions to peer %s: %v", peerAddr, err)
+	}
+	if err := n.sendPeerExchange(peer); err != nil {
+		log.Printf("Failed to send peer records to %s: %v", peerAddr, err)
+	}
 
 	defer func() {
 		n.mutex.Lock()
-		delete(n.peers, peerAddr)
+		if n.peers[peerAddr] == peer {
+			delete(n.peers, peerAddr)
+		}
 		n.mutex.Unlock()
+		n.reputation.disconnected(peer.ValidatorAddress)
 		log.Printf("Peer %s disconnected", peerAddr)
 	}()
 
@@ -146,15 +252,26 @@ func (n *Network) handleConnection(conn net.Conn) {
 			break
 		}
 
+		n.mutex.Lock()
 		peer.LastSeen = time.Now()
-		n.messageQueue <- &msg
+		n.mutex.Unlock()
+		n.receive(peer, &msg)
 	}
 }
 
 func (n *Network) processMessages() {
-	for msg := range n.messageQueue {
-		if err := n.handleValidationMessage(msg); err != nil {
-			log.Printf("Failed to handle validation message: %v", err)
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case msg := <-n.messageQueue:
+			if err := n.handleValidationMessage(msg); err != nil {
+				log.Printf("Failed to handle validation message: %v", err)
+				metrics.MessagesDropped.Inc("rejected")
+				if errors.Is(err, ErrInvalidSignature) {
+					n.penalize(msg.from, err.Error(), true)
+				}
+			}
 		}
 	}
 }
@@ -163,17 +280,19 @@ func (n *Network) handleValidationMessage(msg *ValidationMessage) error {
 	switch msg.Type {
 	case "validation_request":
 		req := &ValidationMessage{
-			Type:        "validation_request",
-			RequestID:   msg.RequestID,
-			PaymentID:   msg.PaymentID,
-			MessageHash: msg.MessageHash,
-			Timestamp:   msg.Timestamp,
+			Type:         "validation_request",
+			ChainID:      msg.ChainID,
+			RequestID:    msg.RequestID,
+			PaymentID:    msg.PaymentID,
+			MessageHash:  msg.MessageHash,
+			RequiredSigs: msg.RequiredSigs,
+			Timestamp:    msg.Timestamp,
 		}
 		return n.validator.ProcessValidationRequest(req)
 		
 	case "signature_share":
 		log.Printf("Received signature share for request %d from %s", msg.RequestID, msg.Signer)
-		return n.aggregateSignature(msg)
+		return n.validator.ProcessSignatureShare(msg)
 		
 	case "validation_complete":
 		log.Printf("Validation %d completed", msg.RequestID)
@@ -184,95 +303,44 @@ func (n *Network) handleValidationMessage(msg *ValidationMessage) error {
 	}
 }
 
-func (n *Network) aggregateSignature(msg *ValidationMessage) error {
-	log.Printf("Aggregating signature for request %d", msg.RequestID)
-	return nil
-}
-
+// BroadcastValidationRequest gossips a validation request to the network
 func (n *Network) BroadcastValidationRequest(req *ValidationMessage) error {
-	data, err := json.Marshal(req)
+	sent, err := n.publish(req)
 	if err != nil {
-		return fmt.Errorf("failed to marshal validation request: %w", err)
-	}
-
-	n.mutex.RLock()
-	defer n.mutex.RUnlock()
-
-	successCount := 0
-	for addr, peer := range n.peers {
-		if !peer.IsActive || peer.Connection == nil {
-			continue
-		}
-
-		if _, err := peer.Connection.Write(data); err != nil {
-			log.Printf("Failed to send message to peer %s: %v", addr, err)
-			peer.IsActive = false
-		} else {
-			successCount++
-		}
+		return fmt.Errorf("failed to broadcast validation request: %w", err)
 	}
 
-	log.Printf("Broadcasted validation request %d to %d peers", req.RequestID, successCount)
+	log.Printf("Broadcasted validation request %d to %d peers", req.RequestID, sent)
 	return nil
 }
 
-func (n *Network) BroadcastSignature(requestID uint64, signature string) error {
+// BroadcastSignature gossips this node's signature share for a request on a
+// chain
+func (n *Network) BroadcastSignature(chainID int64, requestID uint64, messageHash, signature string) error {
 	msg := &ValidationMessage{
-		Type:      "signature_share",
-		RequestID: requestID,
-		Signature: signature,
-		Signer:    n.validator.GetAddress(),
-		Timestamp: time.Now(),
+		Type:        "signature_share",
+		ChainID:     chainID,
+		RequestID:   requestID,
+		MessageHash: messageHash,
+		Signature:   signature,
+		Signer:      n.validator.GetAddress(),
+		Timestamp:   time.Now(),
 	}
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("failed to marshal signature: %w", err)
-	}
-
-	n.mutex.RLock()
-	defer n.mutex.RUnlock()
-
-	for addr, peer := range n.peers {
-		if !peer.IsActive || peer.Connection == nil {
-			continue
-		}
-
-		if _, err := peer.Connection.Write(data); err != nil {
-			log.Printf("Failed to send signature to peer %s: %v", addr, err)
-			peer.IsActive = false
-		}
+	if _, err := n.publish(msg); err != nil {
+		return fmt.Errorf("failed to broadcast signature: %w", err)
 	}
-
 	return nil
 }
 
-func (n *Network) connectToBootstrapPeers() {
-	for _, peerAddr := range n.config.BootstrapPeers {
-		if peerAddr == "" {
-			continue
-		}
-
-		go func(addr string) {
-			for n.isRunning {
-				if err := n.connectToPeer(addr); err != nil {
-					log.Printf("Failed to connect to bootstrap peer %s: %v", addr, err)
-					time.Sleep(30 * time.Second)
-					continue
-				}
-				break
-			}
-		}(peerAddr)
-	}
-}
-
 func (n *Network) connectToPeer(peerAddr string) error {
-	conn, err := net.DialTimeout("tcp", peerAddr, 10*time.Second)
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", peerAddr, n.tlsConfig)
 	if err != nil {
 		return err
 	}
 
-	go n.handleConnection(conn)
+	go n.handleConnection(conn, peerAddr)
 	return nil
 }
 
@@ -286,6 +354,10 @@ func (n *Network) maintainPeers() {
 			return
 		case <-ticker.C:
 			n.cleanupInactivePeers()
+			n.seen.prune()
+			n.nonces.prune()
+			n.reputation.prune()
+			n.pingPeers()
 		}
 	}
 }
@@ -313,9 +385,13 @@ func (n *Network) GetPeers() []*Peer {
 	peers := make([]*Peer, 0, len(n.peers))
 	for _, peer := range n.peers {
 		peerCopy := &Peer{
-			Address:  peer.Address,
-			LastSeen: peer.LastSeen,
-			IsActive: peer.IsActive,
+			Address:          peer.Address,
+			Endpoint:         peer.Endpoint,
+			ValidatorAddress: peer.ValidatorAddress,
+			LastSeen:         peer.LastSeen,
+			IsActive:         peer.IsActive,
+			Topics:           peer.Topics,
+			Score:            n.reputation.snapshot(peer.ValidatorAddress),
 		}
 		peers = append(peers, peerCopy)
 	}
@@ -331,5 +407,5 @@ func (n *Network) GetPeerCount() int {
 }
 
 func (n *Network) IsRunning() bool {
-	return n.isRunning
+	return n.isRunning.Load()
 }
\ No newline at end of file
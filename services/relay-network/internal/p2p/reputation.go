@@ -0,0 +1,386 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peers are scored per validator address, so a validator keeps its score
+// across reconnects. A new peer starts at 70 out of 100. Delivering new
+// messages and staying connected raise the score. Malformed messages,
+// invalid signatures and slow pings lower it. Peers below the low score are
+// sent messages last and are not relayed to. Peers below the ban score are
+// disconnected and refused for the ban duration, after which they start over.
+
+const (
+	pingMessageType = "ping"
+	pongMessageType = "pong"
+
+	defaultBanScore    = 20
+	defaultLowScore    = 40
+	defaultBanDuration = time.Hour
+
+	// statsRetention is how long stats are kept for a validator that is
+	// neither connected nor banned
+	statsRetention = 24 * time.Hour
+)
+
+// ErrInvalidSignature marks a message whose signature does not verify. The
+// peer that delivered it is penalized.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// PeerScore is a snapshot of a validator's reputation
+type PeerScore struct {
+	Score             float64 `json:"score"`
+	ValidMessages     uint64  `json:"valid_messages"`
+	InvalidMessages   uint64  `json:"invalid_messages"`
+	InvalidSignatures uint64  `json:"invalid_signatures"`
+	LatencyMs         float64 `json:"latency_ms"`
+	Uptime            float64 `json:"uptime"`
+}
+
+// BannedPeer is a validator refused until BannedUntil
+type BannedPeer struct {
+	ValidatorAddress string    `json:"validator_address"`
+	BannedUntil      time.Time `json:"banned_until"`
+}
+
+type peerStats struct {
+	valid             uint64
+	invalid           uint64
+	invalidSignatures uint64
+	latency           time.Duration
+	firstSeen         time.Time
+	lastSeen          time.Time
+	connectedSince    time.Time
+	connections       int
+	connectedFor      time.Duration
+	bannedUntil       time.Time
+}
+
+// uptime is the fraction of time since the validator was first seen that it
+// had at least one connection open
+func (s *peerStats) uptime(now time.Time) float64 {
+	elapsed := now.Sub(s.firstSeen)
+	if elapsed <= 0 {
+		return 1
+	}
+	connected := s.connectedFor
+	if s.connections > 0 {
+		connected += now.Sub(s.connectedSince)
+	}
+	return math.Min(1, float64(connected)/float64(elapsed))
+}
+
+func (s *peerStats) score(now time.Time) float64 {
+	score := 50.0
+	score += math.Min(float64(s.valid), 200) / 10
+	score += 20 * s.uptime(now)
+	score -= 5 * float64(s.invalid)
+	score -= 15 * float64(s.invalidSignatures)
+	if s.latency > 500*time.Millisecond {
+		score -= math.Min(10, float64(s.latency-500*time.Millisecond)/float64(100*time.Millisecond))
+	}
+	return math.Max(0, math.Min(100, score))
+}
+
+type reputation struct {
+	mutex       sync.Mutex
+	peers       map[string]*peerStats
+	banScore    float64
+	lowScore    float64
+	banDuration time.Duration
+}
+
+func newReputation(banScore, lowScore int, banDuration time.Duration) *reputation {
+	if banScore <= 0 {
+		banScore = defaultBanScore
+	}
+	if lowScore <= 0 {
+		lowScore = defaultLowScore
+	}
+	if banDuration <= 0 {
+		banDuration = defaultBanDuration
+	}
+	return &reputation{
+		peers:       make(map[string]*peerStats),
+		banScore:    float64(banScore),
+		lowScore:    float64(lowScore),
+		banDuration: banDuration,
+	}
+}
+
+// stats returns the entry for a validator, starting it over once a ban has
+// expired. Callers hold the mutex.
+func (r *reputation) stats(validator string, now time.Time) *peerStats {
+	s, ok := r.peers[validator]
+	if !ok || (!s.bannedUntil.IsZero() && !now.Before(s.bannedUntil)) {
+		s = &peerStats{firstSeen: now, lastSeen: now}
+		r.peers[validator] = s
+	}
+	return s
+}
+
+// bannedUntil reports whether the validator is banned and until when
+func (r *reputation) bannedUntil(validator string) (time.Time, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, ok := r.peers[validator]
+	if !ok || !time.Now().Before(s.bannedUntil) {
+		return time.Time{}, false
+	}
+	return s.bannedUntil, true
+}
+
+func (r *reputation) connected(validator string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	s := r.stats(validator, now)
+	if s.connections == 0 {
+		s.connectedSince = now
+	}
+	s.connections++
+	s.lastSeen = now
+}
+
+func (r *reputation) disconnected(validator string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, ok := r.peers[validator]
+	if !ok || s.connections == 0 {
+		return
+	}
+	now := time.Now()
+	s.connections--
+	if s.connections == 0 {
+		s.connectedFor += now.Sub(s.connectedSince)
+	}
+	s.lastSeen = now
+}
+
+func (r *reputation) recordValid(validator string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s := r.stats(validator, time.Now())
+	s.valid++
+}
+
+func (r *reputation) recordLatency(validator string, latency time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s := r.stats(validator, time.Now())
+	if s.latency == 0 {
+		s.latency = latency
+		return
+	}
+	// Exponentially weighted so one slow round trip does not dominate
+	s.latency = (s.latency*4 + latency) / 5
+}
+
+// recordInvalid penalizes a validator and reports whether it should now be
+// banned, starting the ban if so
+func (r *reputation) recordInvalid(validator string, invalidSignature bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	s := r.stats(validator, now)
+	if invalidSignature {
+		s.invalidSignatures++
+	} else {
+		s.invalid++
+	}
+
+	if s.score(now) >= r.banScore {
+		return false
+	}
+	s.bannedUntil = now.Add(r.banDuration)
+	return true
+}
+
+func (r *reputation) score(validator string) float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	if s, ok := r.peers[validator]; ok {
+		return s.score(now)
+	}
+	return (&peerStats{firstSeen: now}).score(now)
+}
+
+func (r *reputation) low(validator string) bool {
+	return r.score(validator) < r.lowScore
+}
+
+func (r *reputation) snapshot(validator string) *PeerScore {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	s, ok := r.peers[validator]
+	if !ok {
+		s = &peerStats{firstSeen: now}
+	}
+	return &PeerScore{
+		Score:             math.Round(s.score(now)*10) / 10,
+		ValidMessages:     s.valid,
+		InvalidMessages:   s.invalid,
+		InvalidSignatures: s.invalidSignatures,
+		LatencyMs:         float64(s.latency.Microseconds()) / 1000,
+		Uptime:            math.Round(s.uptime(now)*1000) / 1000,
+	}
+}
+
+func (r *reputation) banned() []BannedPeer {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	var banned []BannedPeer
+	for validator, s := range r.peers {
+		if now.Before(s.bannedUntil) {
+			banned = append(banned, BannedPeer{ValidatorAddress: validator, BannedUntil: s.bannedUntil})
+		}
+	}
+	sort.Slice(banned, func(i, j int) bool { return banned[i].ValidatorAddress < banned[j].ValidatorAddress })
+	return banned
+}
+
+// prune drops stats for validators that have been gone longer than the
+// retention period and are not banned
+func (r *reputation) prune() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for validator, s := range r.peers {
+		if s.connections == 0 && now.After(s.bannedUntil) && now.Sub(s.lastSeen) > statsRetention {
+			delete(r.peers, validator)
+		}
+	}
+}
+
+// penalize records an invalid message from a peer's validator and
+// disconnects every connection from it if that drops it below the ban score
+func (n *Network) penalize(validator, reason string, invalidSignature bool) {
+	if validator == "" {
+		return
+	}
+	log.Printf("Penalizing validator %s: %s", validator, reason)
+	if !n.reputation.recordInvalid(validator, invalidSignature) {
+		return
+	}
+
+	until, _ := n.reputation.bannedUntil(validator)
+	log.Printf("Banned validator %s until %s", validator, until.Format(time.RFC3339))
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, peer := range n.peers {
+		if peer.ValidatorAddress == validator && peer.Connection != nil {
+			peer.Connection.Close()
+		}
+	}
+}
+
+// makeRoom reports whether a connection from validator fits within MaxPeers,
+// evicting the lowest scoring peer when the new validator scores higher.
+// Callers hold n.mutex.
+func (n *Network) makeRoom(validator string) bool {
+	if n.config.MaxPeers <= 0 || len(n.peers) < n.config.MaxPeers {
+		return true
+	}
+
+	var lowest *Peer
+	var lowestAddr string
+	lowestScore := math.Inf(1)
+	for addr, peer := range n.peers {
+		if score := n.reputation.score(peer.ValidatorAddress); score < lowestScore {
+			lowest, lowestAddr, lowestScore = peer, addr, score
+		}
+	}
+	if lowest == nil || lowestScore >= n.reputation.score(validator) {
+		return false
+	}
+
+	log.Printf("Evicting peer %s (score %.1f) for validator %s", lowestAddr, lowestScore, validator)
+	if lowest.Connection != nil {
+		lowest.Connection.Close()
+	}
+	delete(n.peers, lowestAddr)
+	return true
+}
+
+// pingPeers measures round-trip latency to every peer. The pong is matched
+// to the ping sent time kept on the peer, not to a time the peer reports.
+func (n *Network) pingPeers() {
+	data, err := n.frame(&ValidationMessage{Type: pingMessageType, Timestamp: time.Now()})
+	if err != nil {
+		return
+	}
+
+	n.mutex.Lock()
+	targets := make([]*Peer, 0, len(n.peers))
+	for _, peer := range n.peers {
+		if peer.Connection != nil && peer.IsActive {
+			peer.pingSent = time.Now()
+			targets = append(targets, peer)
+		}
+	}
+	n.mutex.Unlock()
+
+	for _, peer := range targets {
+		if err := peer.send(data); err != nil {
+			log.Printf("Failed to ping peer %s: %v", peer.Address, err)
+		}
+	}
+}
+
+// handlePing answers pings and records latency from pongs
+func (n *Network) handlePing(peer *Peer, msg *ValidationMessage) {
+	if msg.Type == pingMessageType {
+		data, err := n.frame(&ValidationMessage{Type: pongMessageType, Timestamp: msg.Timestamp})
+		if err == nil {
+			if err := peer.send(data); err != nil {
+				log.Printf("Failed to answer ping from peer %s: %v", peer.Address, err)
+			}
+		}
+		return
+	}
+
+	n.mutex.Lock()
+	sent := peer.pingSent
+	peer.pingSent = time.Time{}
+	n.mutex.Unlock()
+
+	if sent.IsZero() {
+		n.penalize(peer.ValidatorAddress, "unsolicited pong", false)
+		return
+	}
+	n.reputation.recordLatency(peer.ValidatorAddress, time.Since(sent))
+}
+
+// GetBannedPeers returns the validators currently refused for a low score
+func (n *Network) GetBannedPeers() []BannedPeer {
+	return n.reputation.banned()
+}
+
+func marshalFrame(msg *ValidationMessage) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
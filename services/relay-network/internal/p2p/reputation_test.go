@@ -0,0 +1,118 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReputationScore(t *testing.T) {
+	validator := "0x0000000000000000000000000000000000000001"
+
+	t.Run("should start new peers at 70 and reward valid messages", func(t *testing.T) {
+		rep := newReputation(0, 0, 0)
+		rep.connected(validator)
+		assert.InDelta(t, 70, rep.score(validator), 0.1)
+
+		for i := 0; i < 50; i++ {
+			rep.recordValid(validator)
+		}
+		assert.InDelta(t, 75, rep.score(validator), 0.1)
+		assert.False(t, rep.low(validator))
+	})
+
+	t.Run("should penalize slow peers", func(t *testing.T) {
+		rep := newReputation(0, 0, 0)
+		rep.connected(validator)
+		rep.recordLatency(validator, 2*time.Second)
+		assert.InDelta(t, 60, rep.score(validator), 0.1)
+		assert.Equal(t, float64(2000), rep.snapshot(validator).LatencyMs)
+	})
+
+	t.Run("should ban below the ban score and start over afterwards", func(t *testing.T) {
+		rep := newReputation(20, 40, 50*time.Millisecond)
+		rep.connected(validator)
+
+		assert.False(t, rep.recordInvalid(validator, true))
+		assert.False(t, rep.recordInvalid(validator, true))
+		assert.False(t, rep.low(validator))
+		assert.False(t, rep.recordInvalid(validator, true))
+		assert.True(t, rep.low(validator))
+		assert.True(t, rep.recordInvalid(validator, true))
+
+		_, banned := rep.bannedUntil(validator)
+		assert.True(t, banned)
+		require.Len(t, rep.banned(), 1)
+		assert.Equal(t, validator, rep.banned()[0].ValidatorAddress)
+
+		time.Sleep(60 * time.Millisecond)
+		_, banned = rep.bannedUntil(validator)
+		assert.False(t, banned)
+		rep.connected(validator)
+		assert.InDelta(t, 70, rep.score(validator), 0.1)
+		assert.Zero(t, rep.snapshot(validator).InvalidSignatures)
+	})
+}
+
+func TestPeerReputation(t *testing.T) {
+	keys := newTestKeys(t, 3)
+
+	t.Run("should ban a peer sending invalid messages", func(t *testing.T) {
+		nodeA := startTestNetworkWithConfig(t, config.P2PConfig{BanScore: 60}, keys[0], keys[1])
+		nodeB := startTestNetwork(t, keys[1], keys[0])
+		connectPeers(t, nodeB, nodeA)
+
+		peer := nodeB.GetPeers()[0]
+		nodeB.mutex.RLock()
+		conn := nodeB.peers[peer.Address]
+		nodeB.mutex.RUnlock()
+		for i := 0; i < 3; i++ {
+			conn.send([]byte(`{"type":"bogus"}` + "\n"))
+		}
+
+		addrB := crypto.PubkeyToAddress(keys[1].PublicKey).Hex()
+		require.Eventually(t, func() bool {
+			return nodeA.GetPeerCount() == 0 && nodeB.GetPeerCount() == 0
+		}, 5*time.Second, 20*time.Millisecond)
+		banned := nodeA.GetBannedPeers()
+		require.Len(t, banned, 1)
+		assert.Equal(t, addrB, banned[0].ValidatorAddress)
+
+		// Reconnecting is refused while the ban lasts
+		require.NoError(t, nodeB.connectToPeer(nodeA.listener.Addr().String()))
+		time.Sleep(200 * time.Millisecond)
+		assert.Zero(t, nodeA.GetPeerCount())
+	})
+
+	t.Run("should report latency and score on peers", func(t *testing.T) {
+		nodeA := startTestNetwork(t, keys[0], keys[1])
+		nodeB := startTestNetwork(t, keys[1], keys[0])
+		connectPeers(t, nodeA, nodeB)
+
+		nodeA.pingPeers()
+		require.Eventually(t, func() bool {
+			return nodeA.GetPeers()[0].Score.LatencyMs > 0
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.InDelta(t, 70, nodeA.GetPeers()[0].Score.Score, 0.5)
+	})
+
+	t.Run("should evict the lowest scoring peer when full", func(t *testing.T) {
+		nodeA := startTestNetworkWithConfig(t, config.P2PConfig{MaxPeers: 1}, keys[0], keys[1], keys[2])
+		nodeB := startTestNetwork(t, keys[1], keys[0])
+		nodeC := startTestNetwork(t, keys[2], keys[0])
+		connectPeers(t, nodeB, nodeA)
+
+		nodeA.penalize(crypto.PubkeyToAddress(keys[1].PublicKey).Hex(), "test", false)
+		require.NoError(t, nodeC.connectToPeer(nodeA.listener.Addr().String()))
+
+		addrC := crypto.PubkeyToAddress(keys[2].PublicKey).Hex()
+		require.Eventually(t, func() bool {
+			peers := nodeA.GetPeers()
+			return len(peers) == 1 && peers[0].ValidatorAddress == addrC
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+}
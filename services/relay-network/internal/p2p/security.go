@@ -0,0 +1,218 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Peer connections run over mutually authenticated TLS 1.3. Each node creates
+// a throwaway P-256 certificate and binds it to its validator key with a
+// secp256k1 signature carried in a certificate extension (the scheme libp2p
+// uses for host keys), so a handshake proves which validator is on the other
+// end without a CA.
+
+// identityExtensionOID marks the certificate extension holding the validator
+// key and its signature over the certificate key
+var identityExtensionOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 62253, 1, 1}
+
+const identitySignaturePrefix = "crosspay-p2p-tls:"
+
+var errUnauthorizedPeer = errors.New("peer is not an authorized validator")
+
+// PeerAuthorizer reports whether a validator may join the network
+type PeerAuthorizer func(addr common.Address) bool
+
+type identityExtension struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// Identity is the TLS certificate a node presents, bound to its validator key
+type Identity struct {
+	Address     common.Address
+	certificate tls.Certificate
+}
+
+// NewIdentity creates a certificate signed by the validator key
+func NewIdentity(signer keys.Signer) (*Identity, error) {
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+
+	spki, err := x509.MarshalPKIXPublicKey(&certKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode certificate key: %w", err)
+	}
+
+	signature, err := signer.SignData(identityData(spki))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate key: %w", err)
+	}
+
+	// The signer may be remote, so take the public key from its signature
+	validatorPub, err := crypto.SigToPub(identityHash(spki), signature)
+	if err != nil || crypto.PubkeyToAddress(*validatorPub) != signer.Address() {
+		return nil, errors.New("validator signature does not match signer address")
+	}
+
+	extension, err := asn1.Marshal(identityExtension{
+		PublicKey: crypto.FromECDSAPub(validatorPub),
+		Signature: signature,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode identity extension: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(365 * 24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: identityExtensionOID, Value: extension}},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &certKey.PublicKey, certKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	return &Identity{
+		Address: signer.Address(),
+		certificate: tls.Certificate{
+			Certificate: [][]byte{der},
+			PrivateKey:  certKey,
+		},
+	}, nil
+}
+
+// TLSConfig returns a config for both sides of a peer connection. Peers must
+// present an identity certificate for a validator authorize accepts.
+func (id *Identity) TLSConfig(authorize PeerAuthorizer) *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{id.certificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+		// Chains are not CA-signed; VerifyPeerCertificate checks the
+		// validator binding instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			addr, err := verifyPeerCertificate(rawCerts)
+			if err != nil {
+				return err
+			}
+			if addr == id.Address {
+				return errors.New("refusing connection to self")
+			}
+			if authorize == nil || !authorize(addr) {
+				return fmt.Errorf("%w: %s", errUnauthorizedPeer, addr.Hex())
+			}
+			return nil
+		},
+	}
+}
+
+// PeerAddress returns the validator address proven during a completed
+// handshake
+func PeerAddress(conn *tls.Conn) (common.Address, error) {
+	state := conn.ConnectionState()
+	if !state.HandshakeComplete {
+		return common.Address{}, errors.New("handshake not complete")
+	}
+
+	rawCerts := make([][]byte, len(state.PeerCertificates))
+	for i, cert := range state.PeerCertificates {
+		rawCerts[i] = cert.Raw
+	}
+	return verifyPeerCertificate(rawCerts)
+}
+
+// verifyPeerCertificate checks a self-signed certificate carries a valid
+// validator signature over its key and returns the validator address
+func verifyPeerCertificate(rawCerts [][]byte) (common.Address, error) {
+	if len(rawCerts) != 1 {
+		return common.Address{}, fmt.Errorf("expected one certificate, got %d", len(rawCerts))
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid certificate: %w", err)
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return common.Address{}, errors.New("certificate expired or not yet valid")
+	}
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return common.Address{}, fmt.Errorf("certificate is not self-signed: %w", err)
+	}
+
+	var extension identityExtension
+	found := false
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(identityExtensionOID) {
+			if _, err := asn1.Unmarshal(ext.Value, &extension); err != nil {
+				return common.Address{}, fmt.Errorf("invalid identity extension: %w", err)
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		return common.Address{}, errors.New("certificate has no validator identity")
+	}
+
+	recovered, err := crypto.SigToPub(identityHash(cert.RawSubjectPublicKeyInfo), extension.Signature)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid identity signature: %w", err)
+	}
+	if !bytes.Equal(crypto.FromECDSAPub(recovered), extension.PublicKey) {
+		return common.Address{}, errors.New("identity signature does not match validator key")
+	}
+
+	return crypto.PubkeyToAddress(*recovered), nil
+}
+
+func identityData(spki []byte) []byte {
+	return append([]byte(identitySignaturePrefix), spki...)
+}
+
+func identityHash(spki []byte) []byte {
+	return crypto.Keccak256(identityData(spki))
+}
+
+// AllowlistAuthorizer accepts the given validator addresses. It is nil for an
+// empty list, leaving peers to be checked against the active validator set.
+func AllowlistAuthorizer(addresses []string) PeerAuthorizer {
+	allowed := make(map[common.Address]bool)
+	for _, addr := range addresses {
+		if common.IsHexAddress(addr) {
+			allowed[common.HexToAddress(addr)] = true
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	return func(addr common.Address) bool {
+		return allowed[addr]
+	}
+}
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubValidator struct {
+	address  string
+	mutex    sync.Mutex
+	requests []uint64
+}
+
+func (v *stubValidator) ProcessValidationRequest(req *ValidationMessage) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.requests = append(v.requests, req.RequestID)
+	return nil
+}
+func (v *stubValidator) ProcessSignatureShare(msg *ValidationMessage) error { return nil }
+func (v *stubValidator) GetAddress() string                                 { return v.address }
+func (v *stubValidator) GetStatus() string                                  { return "active" }
+
+func (v *stubValidator) received() []uint64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return append([]uint64(nil), v.requests...)
+}
+
+// startTestNetwork starts a node on a random port that accepts the given
+// validators
+func startTestNetwork(t *testing.T, key *ecdsa.PrivateKey, allowed ...*ecdsa.PrivateKey) *Network {
+	return startTestNetworkWithConfig(t, config.P2PConfig{}, key, allowed...)
+}
+
+func startTestNetworkWithConfig(t *testing.T, cfg config.P2PConfig, key *ecdsa.PrivateKey, allowed ...*ecdsa.PrivateKey) *Network {
+	network := newTestNetwork(t, cfg, key, allowed...)
+	require.NoError(t, network.Start())
+	return network
+}
+
+// newTestNetwork creates a node that is stopped when the test ends
+func newTestNetwork(t *testing.T, cfg config.P2PConfig, key *ecdsa.PrivateKey, allowed ...*ecdsa.PrivateKey) *Network {
+	for _, k := range allowed {
+		cfg.AllowedValidators = append(cfg.AllowedValidators, crypto.PubkeyToAddress(k.PublicKey).Hex())
+	}
+
+	validator := &stubValidator{address: crypto.PubkeyToAddress(key.PublicKey).Hex()}
+	network, err := NewNetwork(cfg, validator, keys.NewLocalSigner(key))
+	require.NoError(t, err)
+	t.Cleanup(network.Stop)
+	return network
+}
+
+func TestIdentityCertificate(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	identity, err := NewIdentity(keys.NewLocalSigner(key))
+	require.NoError(t, err)
+
+	addr, err := verifyPeerCertificate(identity.certificate.Certificate)
+	require.NoError(t, err)
+	assert.Equal(t, crypto.PubkeyToAddress(key.PublicKey), addr)
+
+	t.Run("should reject a validator signature copied to another certificate", func(t *testing.T) {
+		parsed, err := x509.ParseCertificate(identity.certificate.Certificate[0])
+		require.NoError(t, err)
+
+		certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber:    big.NewInt(1),
+			NotBefore:       time.Now().Add(-time.Hour),
+			NotAfter:        time.Now().Add(time.Hour),
+			ExtraExtensions: parsed.Extensions,
+		}
+		forged, err := x509.CreateCertificate(rand.Reader, template, template, &certKey.PublicKey, certKey)
+		require.NoError(t, err)
+
+		_, err = verifyPeerCertificate([][]byte{forged})
+		assert.Error(t, err)
+	})
+}
+
+func TestAuthenticatedPeers(t *testing.T) {
+	keyA, _ := crypto.GenerateKey()
+	keyB, _ := crypto.GenerateKey()
+	outsider, _ := crypto.GenerateKey()
+
+	nodeA := startTestNetwork(t, keyA, keyB)
+	nodeB := startTestNetwork(t, keyB, keyA)
+	intruder := startTestNetwork(t, outsider, keyA)
+
+	t.Run("should connect registered validators", func(t *testing.T) {
+		require.NoError(t, nodeB.connectToPeer(nodeA.listener.Addr().String()))
+
+		require.Eventually(t, func() bool {
+			return nodeA.GetPeerCount() == 1 && nodeB.GetPeerCount() == 1
+		}, 5*time.Second, 20*time.Millisecond)
+
+		peers := nodeA.GetPeers()
+		assert.Equal(t, crypto.PubkeyToAddress(keyB.PublicKey).Hex(), peers[0].ValidatorAddress)
+	})
+
+	t.Run("should reject validators outside the allowlist", func(t *testing.T) {
+		intruder.connectToPeer(nodeA.listener.Addr().String())
+
+		time.Sleep(200 * time.Millisecond)
+		assert.Equal(t, 1, nodeA.GetPeerCount())
+		assert.Equal(t, 0, intruder.GetPeerCount())
+	})
+
+	t.Run("should refuse to start without an allowlist or validator set", func(t *testing.T) {
+		node := newTestNetwork(t, config.P2PConfig{}, keyA)
+		assert.ErrorContains(t, node.Start(), "P2P_VALIDATOR_ALLOWLIST is not set")
+
+		node.SetValidatorSet(func(ctx context.Context) ([]common.Address, error) {
+			return []common.Address{crypto.PubkeyToAddress(keyB.PublicKey)}, nil
+		})
+		assert.NoError(t, node.Start())
+	})
+}
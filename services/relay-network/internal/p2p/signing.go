@@ -0,0 +1,141 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/crosspay/relay-network/internal/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Every message is signed by the validator that created it. Gossiped
+// messages keep their origin's signature as they are relayed, and messages
+// that only travel one hop (subscriptions, pings, peer exchange) must come
+// from the peer's own validator. The signature covers a random nonce and the
+// timestamp: messages outside the time window are dropped as stale. A gossiped
+// message may arrive once through each peer, but an honest peer never sends
+// the same origin and nonce twice, so that is treated as a replay.
+
+const (
+	messageSigningPrefix = "crosspay-relay-message:"
+	defaultMessageWindow = 2 * time.Minute
+)
+
+var (
+	errStaleMessage    = errors.New("message timestamp outside the accepted window")
+	errReplayedMessage = errors.New("replayed message")
+)
+
+// signingData is the content the sender signs: everything but the hop
+// fields (ID, Topic, TTL) that relays set
+func signingData(msg *ValidationMessage) []byte {
+	data, _ := json.Marshal(struct {
+		Type         string       `json:"type"`
+		ChainID      int64        `json:"chain_id"`
+		RequestID    uint64       `json:"request_id"`
+		PaymentID    uint64       `json:"payment_id"`
+		MessageHash  string       `json:"message_hash"`
+		RequiredSigs int          `json:"required_signatures"`
+		Signature    string       `json:"signature"`
+		Signer       string       `json:"signer"`
+		Origin       string       `json:"origin"`
+		Timestamp    int64        `json:"timestamp"`
+		Nonce        uint64       `json:"nonce"`
+		Topics       []string     `json:"topics"`
+		Peers        []PeerRecord `json:"peers"`
+	}{msg.Type, msg.ChainID, msg.RequestID, msg.PaymentID, msg.MessageHash, msg.RequiredSigs, msg.Signature, msg.Signer, msg.Origin, msg.Timestamp.UnixNano(), msg.Nonce, msg.Topics, msg.Peers})
+
+	return append([]byte(messageSigningPrefix), data...)
+}
+
+// messageWindow is how far a message timestamp may be from the local clock
+func messageWindow(cfg config.P2PConfig) time.Duration {
+	if cfg.MessageWindowSeconds <= 0 {
+		return defaultMessageWindow
+	}
+	return time.Duration(cfg.MessageWindowSeconds) * time.Second
+}
+
+// sign stamps a message this node creates with its origin, a fresh nonce
+// and the sender signature
+func (n *Network) sign(msg *ValidationMessage) error {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	msg.Origin = n.identity.Address.Hex()
+	msg.Nonce = binary.BigEndian.Uint64(nonce[:])
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	signature, err := n.signer.SignData(signingData(msg))
+	if err != nil {
+		return fmt.Errorf("failed to sign %s: %w", msg.Type, err)
+	}
+	msg.SenderSignature = hexutil.Encode(signature)
+	return nil
+}
+
+// frame signs a direct message and encodes it for the wire
+func (n *Network) frame(msg *ValidationMessage) ([]byte, error) {
+	if err := n.sign(msg); err != nil {
+		return nil, err
+	}
+	return marshalFrame(msg)
+}
+
+// verify checks a received message's sender signature, time window and
+// nonce. direct messages must be signed by the peer that sent them.
+func (n *Network) verify(peer *Peer, msg *ValidationMessage, direct bool) error {
+	if msg.SenderSignature == "" {
+		return fmt.Errorf("%w: unsigned %s", ErrInvalidSignature, msg.Type)
+	}
+	if !common.IsHexAddress(msg.Origin) {
+		return fmt.Errorf("%w: %s has no origin", ErrInvalidSignature, msg.Type)
+	}
+	origin := common.HexToAddress(msg.Origin)
+	if direct && origin.Hex() != peer.ValidatorAddress {
+		return fmt.Errorf("%w: %s signed by %s, not the sending peer", ErrInvalidSignature, msg.Type, origin.Hex())
+	}
+
+	signature, err := hexutil.Decode(msg.SenderSignature)
+	if err != nil || len(signature) != crypto.SignatureLength {
+		return fmt.Errorf("%w: malformed sender signature", ErrInvalidSignature)
+	}
+	pub, err := crypto.SigToPub(crypto.Keccak256(signingData(msg)), signature)
+	if err != nil || crypto.PubkeyToAddress(*pub) != origin {
+		return fmt.Errorf("%w: %s not signed by origin %s", ErrInvalidSignature, msg.Type, origin.Hex())
+	}
+
+	window := messageWindow(n.config)
+	if age := time.Since(msg.Timestamp); age > window || age < -window {
+		return fmt.Errorf("%w: %s from %s is %s old", errStaleMessage, msg.Type, origin.Hex(), age.Round(time.Second))
+	}
+
+	if !n.nonces.add(fmt.Sprintf("%s|%s|%d", peer.Address, origin.Hex(), msg.Nonce)) {
+		return fmt.Errorf("%w: nonce %d from %s", errReplayedMessage, msg.Nonce, origin.Hex())
+	}
+	return nil
+}
+
+// reject drops a message that failed verification and penalizes the peer
+// that sent it
+func (n *Network) reject(peer *Peer, err error) {
+	reason := "invalid_signature"
+	switch {
+	case errors.Is(err, errStaleMessage):
+		reason = "stale"
+	case errors.Is(err, errReplayedMessage):
+		reason = "replayed"
+	}
+	metrics.MessagesDropped.Inc(reason)
+	n.penalize(peer.ValidatorAddress, err.Error(), errors.Is(err, ErrInvalidSignature))
+}
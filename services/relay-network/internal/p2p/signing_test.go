@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendRaw writes a frame from a to its only peer
+func sendRaw(t *testing.T, a *Network, msg *ValidationMessage) {
+	data, err := marshalFrame(msg)
+	require.NoError(t, err)
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, peer := range a.peers {
+		require.NoError(t, peer.send(data))
+	}
+}
+
+func TestMessageSigning(t *testing.T) {
+	keys := newTestKeys(t, 3)
+	addrB := crypto.PubkeyToAddress(keys[1].PublicKey).Hex()
+
+	newRequest := func(id uint64) *ValidationMessage {
+		return &ValidationMessage{Type: "validation_request", RequestID: id, PaymentID: id, MessageHash: "0x01", Timestamp: time.Now(), TTL: 1}
+	}
+
+	t.Run("should accept messages signed by their origin", func(t *testing.T) {
+		nodeA := startTestNetwork(t, keys[0], keys[1])
+		nodeB := startTestNetwork(t, keys[1], keys[0])
+		connectPeers(t, nodeB, nodeA)
+
+		msg := newRequest(1)
+		require.NoError(t, nodeB.sign(msg))
+		sendRaw(t, nodeB, msg)
+		require.Eventually(t, func() bool {
+			return len(receivedBy(nodeA)) == 1
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Zero(t, nodeA.reputation.snapshot(addrB).InvalidSignatures)
+	})
+
+	t.Run("should drop unsigned, tampered and forged messages", func(t *testing.T) {
+		nodeA := startTestNetwork(t, keys[0], keys[1])
+		nodeB := startTestNetwork(t, keys[1], keys[0])
+		connectPeers(t, nodeB, nodeA)
+
+		sendRaw(t, nodeB, newRequest(2))
+
+		tampered := newRequest(3)
+		require.NoError(t, nodeB.sign(tampered))
+		tampered.PaymentID = 99
+		sendRaw(t, nodeB, tampered)
+
+		// A direct message must be signed by the peer sending it
+		forged := &ValidationMessage{Type: subscribeMessageType, Topics: []string{}, Timestamp: time.Now()}
+		require.NoError(t, signAs(keys[2], forged))
+		sendRaw(t, nodeB, forged)
+
+		require.Eventually(t, func() bool {
+			return nodeA.reputation.snapshot(addrB).InvalidSignatures == 3
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Empty(t, receivedBy(nodeA))
+	})
+
+	t.Run("should drop stale and replayed messages", func(t *testing.T) {
+		nodeA := startTestNetwork(t, keys[0], keys[1])
+		nodeB := startTestNetwork(t, keys[1], keys[0])
+		connectPeers(t, nodeB, nodeA)
+
+		stale := newRequest(4)
+		stale.Timestamp = time.Now().Add(-10 * time.Minute)
+		require.NoError(t, nodeB.sign(stale))
+		sendRaw(t, nodeB, stale)
+
+		ping := &ValidationMessage{Type: pingMessageType, Timestamp: time.Now()}
+		require.NoError(t, nodeB.sign(ping))
+		sendRaw(t, nodeB, ping)
+		sendRaw(t, nodeB, ping)
+
+		require.Eventually(t, func() bool {
+			return nodeA.reputation.snapshot(addrB).InvalidMessages == 2
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Zero(t, nodeA.reputation.snapshot(addrB).InvalidSignatures)
+		assert.Empty(t, receivedBy(nodeA))
+	})
+}
+
+// signAs signs msg with a key that is not the sending node's
+func signAs(key *ecdsa.PrivateKey, msg *ValidationMessage) error {
+	msg.Origin = crypto.PubkeyToAddress(key.PublicKey).Hex()
+	msg.Nonce = 1
+	signature, err := crypto.Sign(crypto.Keccak256(signingData(msg)), key)
+	if err != nil {
+		return err
+	}
+	msg.SenderSignature = hexutil.Encode(signature)
+	return nil
+}
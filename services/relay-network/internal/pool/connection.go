@@ -81,6 +81,10 @@ func (cp *ConnectionPool) Get(ctx context.Context) (*ethclient.Client, error) {
 }
 
 func (cp *ConnectionPool) Put(client *ethclient.Client) {
+	if client == nil {
+		return
+	}
+
 	cp.mutex.Lock()
 	defer cp.mutex.Unlock()
 
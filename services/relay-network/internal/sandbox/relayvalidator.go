@@ -0,0 +1,353 @@
+package sandbox
+
+import (
+	"math/big"
+	"strings"
+
+	sim "github.com/arcbjorn/crosspay/packages/sandbox"
+	"github.com/crosspay/relay-network/internal/validator"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// relayValidatorABI covers the RelayValidator functions and events the
+// sandbox implements
+const relayValidatorABI = `[
+	{"type":"function","name":"requestValidation","stateMutability":"nonpayable","inputs":[{"name":"paymentId","type":"uint256"},{"name":"messageHash","type":"bytes32"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"submitAggregatedSignatures","stateMutability":"nonpayable","inputs":[{"name":"requestId","type":"uint256"},{"name":"signers","type":"address[]"},{"name":"signatures","type":"bytes[]"}],"outputs":[]},
+	{"type":"function","name":"getValidationRequest","stateMutability":"view","inputs":[{"name":"requestId","type":"uint256"}],"outputs":[{"name":"id","type":"uint256"},{"name":"paymentId","type":"uint256"},{"name":"messageHash","type":"bytes32"},{"name":"requiredSignatures","type":"uint256"},{"name":"receivedSignatures","type":"uint256"},{"name":"status","type":"uint8"},{"name":"createdAt","type":"uint256"},{"name":"deadline","type":"uint256"},{"name":"isHighValue","type":"bool"}]},
+	{"type":"function","name":"slashValidator","stateMutability":"nonpayable","inputs":[{"name":"validator","type":"address"},{"name":"reason","type":"string"}],"outputs":[]},
+	{"type":"function","name":"registerValidator","stateMutability":"payable","inputs":[{"name":"blsPublicKey","type":"uint256[4]"}],"outputs":[]},
+	{"type":"function","name":"exitValidator","stateMutability":"nonpayable","inputs":[],"outputs":[]},
+	{"type":"function","name":"validatorStakes","stateMutability":"view","inputs":[{"name":"validator","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"getValidatorBLSPublicKey","stateMutability":"view","inputs":[{"name":"validator","type":"address"}],"outputs":[{"name":"","type":"uint256[4]"}]},
+	{"type":"function","name":"getActiveValidators","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"address[]"}]},
+	{"type":"function","name":"MIN_STAKE","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"event","name":"ValidatorRegistered","anonymous":false,"inputs":[{"name":"validator","type":"address","indexed":true},{"name":"stake","type":"uint256","indexed":false}]},
+	{"type":"event","name":"ValidatorSlashed","anonymous":false,"inputs":[{"name":"validator","type":"address","indexed":true},{"name":"slashedAmount","type":"uint256","indexed":false},{"name":"reason","type":"string","indexed":false}]},
+	{"type":"event","name":"ValidatorExited","anonymous":false,"inputs":[{"name":"validator","type":"address","indexed":true},{"name":"returnedStake","type":"uint256","indexed":false}]},
+	{"type":"event","name":"ValidationRequested","anonymous":false,"inputs":[{"name":"requestId","type":"uint256","indexed":true},{"name":"paymentId","type":"uint256","indexed":true},{"name":"messageHash","type":"bytes32","indexed":false},{"name":"requiredSignatures","type":"uint256","indexed":false},{"name":"deadline","type":"uint256","indexed":false},{"name":"isHighValue","type":"bool","indexed":false}]},
+	{"type":"event","name":"ValidationCompleted","anonymous":false,"inputs":[{"name":"requestId","type":"uint256","indexed":true},{"name":"aggregatedSignature","type":"bytes","indexed":false},{"name":"signerCount","type":"uint256","indexed":false}]}
+]`
+
+var parsedRelayValidatorABI = mustParseABI(relayValidatorABI)
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// RelayValidator constants, except that one active validator is enough to
+// request validations so a single node can run the whole flow
+const (
+	minValidators      = 1
+	validationTimeout  = 5 * 60
+	consensusThreshold = 67
+	highValuePercent   = 75
+	slashPercentage    = 50
+)
+
+var (
+	minStake           = new(big.Int).Mul(big.NewInt(10), big.NewInt(params.Ether))
+	highValueThreshold = new(big.Int).Mul(big.NewInt(1000), big.NewInt(params.Ether))
+)
+
+// RelayValidator.ValidationStatus and ValidatorStatus values
+const (
+	requestPending   uint8 = 0
+	requestCompleted uint8 = 2
+
+	validatorActive  = 1
+	validatorSlashed = 3
+	validatorExiting = 4
+)
+
+type validatorInfo struct {
+	status uint8
+	stake  *big.Int
+	blsKey [4]*big.Int
+}
+
+type validationRequest struct {
+	id          *big.Int
+	paymentID   *big.Int
+	messageHash [32]byte
+	required    int64
+	signed      map[common.Address]bool
+	status      uint8
+	createdAt   uint64
+	deadline    uint64
+	isHighValue bool
+}
+
+// RelayValidator is RelayValidator.sol without BLS: shares are checked as the
+// ECDSA signatures the nodes submit, and registration accepts any BLS key
+type RelayValidator struct {
+	owner      common.Address
+	validators map[common.Address]*validatorInfo
+	active     []common.Address
+	requests   map[uint64]*validationRequest
+	processed  map[[32]byte]bool
+	counter    uint64
+}
+
+// NewRelayValidator returns a contract owned by owner with validators
+// registered at the minimum stake
+func NewRelayValidator(owner common.Address, validators ...common.Address) *RelayValidator {
+	c := &RelayValidator{
+		owner:      owner,
+		validators: make(map[common.Address]*validatorInfo),
+		requests:   make(map[uint64]*validationRequest),
+		processed:  make(map[[32]byte]bool),
+	}
+	for _, addr := range validators {
+		if _, exists := c.validators[addr]; !exists {
+			c.register(addr, minStake, defaultBLSKey())
+		}
+	}
+	return c
+}
+
+func defaultBLSKey() [4]*big.Int {
+	return [4]*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4)}
+}
+
+func (c *RelayValidator) register(addr common.Address, stake *big.Int, blsKey [4]*big.Int) {
+	c.validators[addr] = &validatorInfo{status: validatorActive, stake: new(big.Int).Set(stake), blsKey: blsKey}
+	c.active = append(c.active, addr)
+}
+
+func (c *RelayValidator) removeActive(addr common.Address) {
+	for i, active := range c.active {
+		if active == addr {
+			c.active = append(c.active[:i:i], c.active[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *RelayValidator) isActive(addr common.Address) bool {
+	v, ok := c.validators[addr]
+	return ok && v.status == validatorActive
+}
+
+func (c *RelayValidator) Call(msg *sim.Message) ([]byte, error) {
+	method, args, err := unpackCall(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch method.Name {
+	case "getValidationRequest":
+		req, ok := c.requests[args[0].(*big.Int).Uint64()]
+		if !ok {
+			return method.Outputs.Pack(new(big.Int), new(big.Int), [32]byte{}, new(big.Int), new(big.Int), uint8(0), new(big.Int), new(big.Int), false)
+		}
+		return method.Outputs.Pack(req.id, req.paymentID, req.messageHash, big.NewInt(req.required), big.NewInt(int64(len(req.signed))),
+			req.status, new(big.Int).SetUint64(req.createdAt), new(big.Int).SetUint64(req.deadline), req.isHighValue)
+	case "getActiveValidators":
+		return method.Outputs.Pack(append([]common.Address{}, c.active...))
+	case "validatorStakes":
+		if v, ok := c.validators[args[0].(common.Address)]; ok {
+			return method.Outputs.Pack(v.stake)
+		}
+		return method.Outputs.Pack(new(big.Int))
+	case "getValidatorBLSPublicKey":
+		if v, ok := c.validators[args[0].(common.Address)]; ok {
+			return method.Outputs.Pack(v.blsKey)
+		}
+		return method.Outputs.Pack([4]*big.Int{new(big.Int), new(big.Int), new(big.Int), new(big.Int)})
+	case "MIN_STAKE":
+		return method.Outputs.Pack(minStake)
+	}
+	return nil, sim.Revert("not a view function")
+}
+
+func (c *RelayValidator) Transact(msg *sim.Message) ([]*types.Log, error) {
+	method, args, err := unpackCall(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Value.Sign() > 0 && method.Name != "registerValidator" {
+		return nil, sim.Revert("non-payable function")
+	}
+
+	switch method.Name {
+	case "registerValidator":
+		return c.registerValidator(msg, args[0].([4]*big.Int))
+	case "exitValidator":
+		return c.exitValidator(msg)
+	case "slashValidator":
+		return c.slashValidator(msg, args[0].(common.Address), args[1].(string))
+	case "requestValidation":
+		return c.requestValidation(msg, args[0].(*big.Int), args[1].([32]byte), args[2].(*big.Int))
+	case "submitAggregatedSignatures":
+		return c.submitAggregatedSignatures(msg, args[0].(*big.Int), args[1].([]common.Address), args[2].([][]byte))
+	}
+	return nil, sim.Revert("not a transaction")
+}
+
+func (c *RelayValidator) registerValidator(msg *sim.Message, blsKey [4]*big.Int) ([]*types.Log, error) {
+	if msg.Value.Cmp(minStake) < 0 {
+		return nil, sim.Revert("InsufficientStake")
+	}
+	if _, exists := c.validators[msg.From]; exists {
+		return nil, sim.Revert("ValidatorAlreadyRegistered")
+	}
+
+	event, err := sim.NewLog(msg.To, parsedRelayValidatorABI.Events["ValidatorRegistered"], msg.From, msg.Value)
+	if err != nil {
+		return nil, err
+	}
+	c.register(msg.From, msg.Value, blsKey)
+	return []*types.Log{event}, nil
+}
+
+func (c *RelayValidator) exitValidator(msg *sim.Message) ([]*types.Log, error) {
+	v, ok := c.validators[msg.From]
+	if !ok || (v.status != validatorActive && v.status != validatorSlashed) {
+		return nil, sim.Revert("ValidatorNotActive")
+	}
+
+	event, err := sim.NewLog(msg.To, parsedRelayValidatorABI.Events["ValidatorExited"], msg.From, v.stake)
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.Send(msg.From, v.stake); err != nil {
+		return nil, err
+	}
+	v.status, v.stake = validatorExiting, new(big.Int)
+	c.removeActive(msg.From)
+	return []*types.Log{event}, nil
+}
+
+func (c *RelayValidator) slashValidator(msg *sim.Message, addr common.Address, reason string) ([]*types.Log, error) {
+	if msg.From != c.owner {
+		return nil, sim.Revert("OwnableUnauthorizedAccount")
+	}
+	if !c.isActive(addr) {
+		return nil, sim.Revert("ValidatorNotActive")
+	}
+
+	v := c.validators[addr]
+	slashed := new(big.Int).Div(new(big.Int).Mul(v.stake, big.NewInt(slashPercentage)), big.NewInt(100))
+	event, err := sim.NewLog(msg.To, parsedRelayValidatorABI.Events["ValidatorSlashed"], addr, slashed, reason)
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.Send(c.owner, slashed); err != nil {
+		return nil, err
+	}
+	v.status, v.stake = validatorSlashed, new(big.Int).Sub(v.stake, slashed)
+	c.removeActive(addr)
+	return []*types.Log{event}, nil
+}
+
+func (c *RelayValidator) requestValidation(msg *sim.Message, paymentID *big.Int, messageHash [32]byte, amount *big.Int) ([]*types.Log, error) {
+	if msg.From != c.owner {
+		return nil, sim.Revert("OwnableUnauthorizedAccount")
+	}
+	if c.processed[messageHash] {
+		return nil, sim.Revert("MessageAlreadyProcessed")
+	}
+	if len(c.active) < minValidators {
+		return nil, sim.Revert("InsufficientSignatures")
+	}
+
+	isHighValue := amount.Cmp(highValueThreshold) >= 0
+	threshold := int64(consensusThreshold)
+	if isHighValue {
+		threshold = highValuePercent
+	}
+	req := &validationRequest{
+		id:          new(big.Int).SetUint64(c.counter + 1),
+		paymentID:   new(big.Int).Set(paymentID),
+		messageHash: messageHash,
+		required:    max(1, int64(len(c.active))*threshold/100),
+		signed:      make(map[common.Address]bool),
+		status:      requestPending,
+		createdAt:   msg.Time,
+		deadline:    msg.Time + validationTimeout,
+		isHighValue: isHighValue,
+	}
+
+	event, err := sim.NewLog(msg.To, parsedRelayValidatorABI.Events["ValidationRequested"],
+		req.id, req.paymentID, req.messageHash, big.NewInt(req.required), new(big.Int).SetUint64(req.deadline), req.isHighValue)
+	if err != nil {
+		return nil, err
+	}
+	c.counter++
+	c.requests[c.counter] = req
+	c.processed[messageHash] = true
+	return []*types.Log{event}, nil
+}
+
+func (c *RelayValidator) submitAggregatedSignatures(msg *sim.Message, requestID *big.Int, signers []common.Address, signatures [][]byte) ([]*types.Log, error) {
+	if !requestID.IsUint64() {
+		return nil, sim.Revert("InvalidValidationRequest")
+	}
+	req, ok := c.requests[requestID.Uint64()]
+	if !ok || req.status != requestPending {
+		return nil, sim.Revert("InvalidValidationRequest")
+	}
+	if msg.Time > req.deadline {
+		return nil, sim.Revert("ValidationExpired")
+	}
+	if !c.isActive(msg.From) {
+		return nil, sim.Revert("ValidatorNotActive")
+	}
+	if len(signers) != len(signatures) {
+		return nil, sim.Revert("InvalidSignature")
+	}
+
+	var added []common.Address
+	var aggregated []byte
+	for i, signer := range signers {
+		if req.signed[signer] {
+			continue
+		}
+		if !c.isActive(signer) {
+			return nil, sim.Revert("ValidatorNotActive")
+		}
+		if validator.VerifyShare(common.Hash(req.messageHash), signer, signatures[i]) != nil {
+			return nil, sim.Revert("InvalidSignature")
+		}
+		added = append(added, signer)
+		aggregated = append(aggregated, signatures[i]...)
+	}
+	received := len(req.signed) + len(added)
+	if int64(received) < req.required {
+		return nil, sim.Revert("InsufficientSignatures")
+	}
+
+	event, err := sim.NewLog(msg.To, parsedRelayValidatorABI.Events["ValidationCompleted"], req.id, aggregated, big.NewInt(int64(received)))
+	if err != nil {
+		return nil, err
+	}
+	for _, signer := range added {
+		req.signed[signer] = true
+	}
+	req.status = requestCompleted
+	return []*types.Log{event}, nil
+}
+
+// unpackCall finds the method data calls and decodes its arguments
+func unpackCall(data []byte) (*abi.Method, []interface{}, error) {
+	if len(data) < 4 {
+		return nil, nil, sim.Revert("missing function selector")
+	}
+	method, err := parsedRelayValidatorABI.MethodById(data[:4])
+	if err != nil {
+		return nil, nil, sim.Revert("unknown function selector")
+	}
+	args, err := method.Inputs.Unpack(data[4:])
+	if err != nil {
+		return nil, nil, sim.Revert(err.Error())
+	}
+	return method, args, nil
+}
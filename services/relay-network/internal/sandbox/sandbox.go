@@ -0,0 +1,232 @@
+// Package sandbox runs the node against in-memory chains, each with a
+// RelayValidator, so the whole validation flow runs without a node or testnet
+// stake. Transaction hashes and block numbers are the same on every run for
+// the same requests; block hashes are too when SANDBOX_GENESIS_TIME is set.
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	sim "github.com/arcbjorn/crosspay/packages/sandbox"
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Owner owns the sandbox RelayValidators and is the account validations are
+// requested from
+var Owner = sim.DevAddress(0)
+
+// validatorBalance is what validators are funded with for registering
+var validatorBalance = new(big.Int).Mul(big.NewInt(100), big.NewInt(params.Ether))
+
+// Sandbox holds the chains the node runs against
+type Sandbox struct {
+	chains        map[int64]*sandboxChain
+	primary       int64
+	confirmations uint64
+}
+
+type sandboxChain struct {
+	chain    *sim.Chain
+	contract common.Address
+}
+
+type ValidationRequestPayload struct {
+	PaymentID   uint64 `json:"payment_id"`
+	MessageHash string `json:"message_hash"`
+	Amount      string `json:"amount"`
+}
+
+// Start starts a chain for every chain in cfg and points cfg at them. Each
+// chain's RelayValidator is deployed at the configured CONTRACT_ADDRESS, or
+// at the owner's first contract address, with validators registered at the
+// minimum stake and funded. Event listeners read the chains from their first
+// block.
+func Start(ctx context.Context, cfg *config.Config, validators []common.Address) (*Sandbox, error) {
+	genesis := time.Now()
+	if cfg.Sandbox.GenesisTime > 0 {
+		genesis = time.Unix(cfg.Sandbox.GenesisTime, 0)
+	}
+	interval := time.Duration(cfg.Sandbox.BlockIntervalSeconds) * time.Second
+
+	s := &Sandbox{
+		chains:        make(map[int64]*sandboxChain),
+		primary:       cfg.Chains[0].ChainID,
+		confirmations: cfg.Events.Confirmations,
+	}
+	for i := range cfg.Chains {
+		chainCfg := &cfg.Chains[i]
+		chain := sim.New(sim.Config{ChainID: chainCfg.ChainID, Genesis: genesis, BlockTime: interval})
+
+		contract := crypto.CreateAddress(Owner, 0)
+		if common.IsHexAddress(chainCfg.ContractAddress) {
+			contract = common.HexToAddress(chainCfg.ContractAddress)
+		}
+		relayValidator := NewRelayValidator(Owner, validators...)
+		chain.Deploy(contract, relayValidator)
+		chain.SetBalance(contract, new(big.Int).Mul(minStake, big.NewInt(int64(len(relayValidator.active)))))
+		for _, addr := range validators {
+			if chain.Balance(addr).Cmp(validatorBalance) < 0 {
+				chain.SetBalance(addr, validatorBalance)
+			}
+		}
+
+		url, err := chain.Listen("127.0.0.1:0")
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to serve sandbox chain %d: %w", chainCfg.ChainID, err)
+		}
+		if interval > 0 {
+			go chain.Run(ctx, interval)
+		}
+
+		chainCfg.RPCEndpoint, chainCfg.ContractAddress = url, contract.Hex()
+		// The listener starts at the head without a start block and would
+		// miss requests made before its first poll
+		if chainCfg.StartBlock == 0 {
+			chainCfg.StartBlock = 1
+		}
+		s.chains[chainCfg.ChainID] = &sandboxChain{chain: chain, contract: contract}
+	}
+
+	cfg.RPCEndpoint, cfg.ContractAddress = cfg.Chains[0].RPCEndpoint, cfg.Chains[0].ContractAddress
+	cfg.Events.StartBlock = cfg.Chains[0].StartBlock
+	return s, nil
+}
+
+// Close stops the chains
+func (s *Sandbox) Close() {
+	for _, c := range s.chains {
+		c.chain.Close()
+	}
+}
+
+// chainFor returns the chain in the chain_id query parameter, or the primary
+// chain without one. It writes the error response when the chain is unknown.
+func (s *Sandbox) chainFor(w http.ResponseWriter, r *http.Request) (*sandboxChain, bool) {
+	chainID := s.primary
+	if chainParam := r.URL.Query().Get("chain_id"); chainParam != "" {
+		parsed, err := strconv.ParseInt(chainParam, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid chain ID", http.StatusBadRequest)
+			return nil, false
+		}
+		chainID = parsed
+	}
+	c, ok := s.chains[chainID]
+	if !ok {
+		problem.Error(w, r, http.StatusNotFound, problem.CodeChainNotValidated, fmt.Sprintf("Chain %d is not validated by this node", chainID))
+		return nil, false
+	}
+	return c, true
+}
+
+// RPC serves a chain's JSON-RPC endpoint, so other nodes and clients can
+// share the chain
+func (s *Sandbox) RPC(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.chainFor(w, r)
+	if !ok {
+		return
+	}
+	c.chain.Handler().ServeHTTP(w, r)
+}
+
+// RequestValidation requests a validation on chain from the owner, as the
+// payment contracts would, and mines the confirmations the event listener
+// waits for. Without a message hash one is derived from the chain and
+// payment ID.
+func (s *Sandbox) RequestValidation(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.chainFor(w, r)
+	if !ok {
+		return
+	}
+
+	var payload ValidationRequestPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	paymentID := new(big.Int).SetUint64(payload.PaymentID)
+	messageHash := crypto.Keccak256Hash(common.LeftPadBytes(c.chain.ChainID().Bytes(), 32), common.LeftPadBytes(paymentID.Bytes(), 32))
+	if payload.MessageHash != "" {
+		decoded, err := hexutil.Decode(payload.MessageHash)
+		if err != nil || len(decoded) != common.HashLength {
+			http.Error(w, "Invalid message hash", http.StatusBadRequest)
+			return
+		}
+		messageHash = common.BytesToHash(decoded)
+	}
+	amount := new(big.Int)
+	if payload.Amount != "" {
+		if _, ok := amount.SetString(payload.Amount, 10); !ok || amount.Sign() < 0 {
+			http.Error(w, "Invalid amount", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := parsedRelayValidatorABI.Pack("requestValidation", paymentID, messageHash, amount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	receipt, err := c.chain.Impersonate(Owner, c.contract, nil, data)
+	if err != nil {
+		problem.Error(w, r, http.StatusConflict, problem.CodeValidationReverted, fmt.Sprintf("Validation request reverted: %v", err))
+		return
+	}
+	c.chain.Mine(int(s.confirmations))
+
+	event := receipt.Logs[0]
+	fields := make(map[string]interface{})
+	if err := parsedRelayValidatorABI.UnpackIntoMap(fields, "ValidationRequested", event.Data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"request_id":          event.Topics[1].Big().Uint64(),
+		"payment_id":          payload.PaymentID,
+		"message_hash":        messageHash.Hex(),
+		"required_signatures": fields["requiredSignatures"].(*big.Int).Uint64(),
+		"deadline":            time.Unix(fields["deadline"].(*big.Int).Int64(), 0),
+		"is_high_value":       fields["isHighValue"],
+		"tx_hash":             receipt.TxHash.Hex(),
+		"block_number":        receipt.BlockNumber.Uint64(),
+	})
+}
+
+// Mine mines the number of empty blocks in the blocks query parameter, one
+// by default
+func (s *Sandbox) Mine(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.chainFor(w, r)
+	if !ok {
+		return
+	}
+
+	blocks := 1
+	if param := r.URL.Query().Get("blocks"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed < 1 || parsed > 10000 {
+			http.Error(w, "Invalid block count", http.StatusBadRequest)
+			return
+		}
+		blocks = parsed
+	}
+	c.chain.Mine(blocks)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"block_number": c.chain.BlockNumber(),
+	})
+}
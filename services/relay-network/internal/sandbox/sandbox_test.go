@@ -0,0 +1,162 @@
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	sim "github.com/arcbjorn/crosspay/packages/sandbox"
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/crosspay/relay-network/internal/validator"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupSandbox(t *testing.T, validators ...common.Address) (*Sandbox, *config.Config) {
+	cfg := &config.Config{
+		Chains:  []config.ChainConfig{{ChainID: 4202}},
+		Events:  config.EventsConfig{Confirmations: 3},
+		Sandbox: config.SandboxConfig{GenesisTime: 1767225600},
+	}
+	s, err := Start(context.Background(), cfg, validators)
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+	return s, cfg
+}
+
+// requestValidation requests a validation through the sandbox endpoint
+func requestValidation(t *testing.T, s *Sandbox, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	s.RequestValidation(w, httptest.NewRequest(http.MethodPost, "/sandbox/validation-requests", strings.NewReader(body)))
+	var response map[string]interface{}
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	}
+	return w, response
+}
+
+func call(t *testing.T, chain *sandboxChain, method string, args ...interface{}) []interface{} {
+	data, err := parsedRelayValidatorABI.Pack(method, args...)
+	require.NoError(t, err)
+	output, err := chain.chain.Call(common.Address{}, chain.contract, nil, data)
+	require.NoError(t, err)
+	values, err := parsedRelayValidatorABI.Unpack(method, output)
+	require.NoError(t, err)
+	return values
+}
+
+func TestSandbox(t *testing.T) {
+	ctx := context.Background()
+	signer := keys.NewLocalSigner(sim.DevKey(1))
+
+	t.Run("should point the config at the sandbox chain", func(t *testing.T) {
+		_, cfg := setupSandbox(t, signer.Address())
+
+		client, err := ethclient.Dial(cfg.RPCEndpoint)
+		require.NoError(t, err)
+		defer client.Close()
+		chainID, err := client.ChainID(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, big.NewInt(4202), chainID)
+		assert.Equal(t, cfg.Chains[0].ContractAddress, cfg.ContractAddress)
+
+		code, err := client.CodeAt(ctx, common.HexToAddress(cfg.ContractAddress), nil)
+		require.NoError(t, err)
+		assert.NotEmpty(t, code)
+	})
+
+	t.Run("should emit requests the listener sees once confirmed", func(t *testing.T) {
+		s, cfg := setupSandbox(t, signer.Address())
+
+		w, response := requestValidation(t, s, `{"payment_id": 42}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, 1.0, response["request_id"])
+		assert.Equal(t, 1.0, response["required_signatures"])
+		assert.Equal(t, 1.0, response["block_number"])
+		assert.Equal(t, uint64(4), s.chains[4202].chain.BlockNumber())
+
+		client, err := ethclient.Dial(cfg.RPCEndpoint)
+		require.NoError(t, err)
+		defer client.Close()
+		logs, err := client.FilterLogs(ctx, ethereum.FilterQuery{
+			Addresses: []common.Address{common.HexToAddress(cfg.ContractAddress)},
+			Topics:    [][]common.Hash{{parsedRelayValidatorABI.Events["ValidationRequested"].ID}},
+		})
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		assert.Equal(t, response["tx_hash"], logs[0].TxHash.Hex())
+
+		// The same payment gives the same message hash, which is only
+		// processed once
+		w, _ = requestValidation(t, s, `{"payment_id": 42}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"`+problem.CodeValidationReverted+`"`)
+	})
+
+	t.Run("should give the same transaction hashes on every run", func(t *testing.T) {
+		first, _ := setupSandbox(t, signer.Address())
+		second, _ := setupSandbox(t, signer.Address())
+
+		_, a := requestValidation(t, first, `{"payment_id": 7}`)
+		_, b := requestValidation(t, second, `{"payment_id": 7}`)
+		assert.Equal(t, a["tx_hash"], b["tx_hash"])
+		assert.Equal(t, a["deadline"], b["deadline"])
+	})
+
+	t.Run("should complete requests with a quorum of valid shares", func(t *testing.T) {
+		other := keys.NewLocalSigner(sim.DevKey(2))
+		s, _ := setupSandbox(t, signer.Address(), other.Address())
+		chain := s.chains[4202]
+
+		_, response := requestValidation(t, s, `{"payment_id": 1}`)
+		assert.Equal(t, 1.0, response["required_signatures"])
+		messageHash := common.HexToHash(response["message_hash"].(string))
+		requestID := big.NewInt(1)
+
+		// A share signed by another key is rejected
+		forged, err := validator.SignShare(messageHash, keys.NewLocalSigner(sim.DevKey(3)))
+		require.NoError(t, err)
+		data, err := parsedRelayValidatorABI.Pack("submitAggregatedSignatures", requestID, []common.Address{other.Address()}, [][]byte{forged})
+		require.NoError(t, err)
+		_, err = chain.chain.Impersonate(signer.Address(), chain.contract, nil, data)
+		assert.EqualError(t, err, "execution reverted: InvalidSignature")
+		assert.Equal(t, requestPending, call(t, chain, "getValidationRequest", requestID)[5])
+
+		share, err := validator.SignShare(messageHash, other)
+		require.NoError(t, err)
+		data, err = parsedRelayValidatorABI.Pack("submitAggregatedSignatures", requestID, []common.Address{other.Address()}, [][]byte{share})
+		require.NoError(t, err)
+		receipt, err := chain.chain.Impersonate(signer.Address(), chain.contract, nil, data)
+		require.NoError(t, err)
+		assert.Len(t, receipt.Logs, 1)
+
+		values := call(t, chain, "getValidationRequest", requestID)
+		assert.Equal(t, requestCompleted, values[5])
+		assert.Equal(t, big.NewInt(1), values[4])
+	})
+
+	t.Run("should return the stake of validators that exit", func(t *testing.T) {
+		s, _ := setupSandbox(t, signer.Address())
+		chain := s.chains[4202]
+		before := chain.chain.Balance(signer.Address())
+
+		data, err := parsedRelayValidatorABI.Pack("exitValidator")
+		require.NoError(t, err)
+		_, err = chain.chain.Impersonate(signer.Address(), chain.contract, nil, data)
+		require.NoError(t, err)
+
+		assert.Equal(t, new(big.Int).Add(before, minStake), chain.chain.Balance(signer.Address()))
+		assert.Empty(t, call(t, chain, "getActiveValidators")[0])
+		w, _ := requestValidation(t, s, `{"payment_id": 1}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+}
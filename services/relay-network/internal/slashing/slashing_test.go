@@ -0,0 +1,152 @@
+package slashing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/crosspay/relay-network/internal/database"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeReporter struct {
+	err      error
+	reported []common.Address
+}
+
+func (r *fakeReporter) SlashValidator(ctx context.Context, validator common.Address, reason string) (common.Hash, error) {
+	if r.err != nil {
+		return common.Hash{}, r.err
+	}
+	r.reported = append(r.reported, validator)
+	return common.HexToHash("0x01"), nil
+}
+
+func newTestStore(t *testing.T) *Store {
+	db, err := database.Open(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	store, err := NewStore(db)
+	require.NoError(t, err)
+	return store
+}
+
+var (
+	validatorA = common.HexToAddress("0x000000000000000000000000000000000000000a")
+	validatorB = common.HexToAddress("0x000000000000000000000000000000000000000b")
+	hashOne    = common.HexToHash("0x01")
+	hashTwo    = common.HexToHash("0x02")
+)
+
+func TestWatcher(t *testing.T) {
+	t.Run("should record double signing once", func(t *testing.T) {
+		store := newTestStore(t)
+		watcher := NewWatcher(store, nil, 0)
+
+		watcher.ObserveShare(1, common.Hash{}, validatorA, hashOne, []byte{1})
+		watcher.ObserveShare(1, common.Hash{}, validatorA, hashOne, []byte{1})
+		assert.Empty(t, mustList(t, store, ""))
+
+		watcher.ObserveShare(1, common.Hash{}, validatorA, hashTwo, []byte{2})
+		watcher.ObserveShare(1, common.Hash{}, validatorA, hashTwo, []byte{2})
+
+		evidence := mustList(t, store, StatusPending)
+		require.Len(t, evidence, 1)
+		assert.Equal(t, KindDoubleSign, evidence[0].Kind)
+		assert.Equal(t, validatorA.Hex(), evidence[0].Validator)
+
+		var details DoubleSignDetails
+		require.NoError(t, json.Unmarshal(evidence[0].Details, &details))
+		assert.Equal(t, [2]common.Hash{hashOne, hashTwo}, details.MessageHashes)
+	})
+
+	t.Run("should record signatures over the wrong payload", func(t *testing.T) {
+		store := newTestStore(t)
+		watcher := NewWatcher(store, nil, 0)
+
+		watcher.ObserveShare(2, hashOne, validatorA, hashOne, []byte{1})
+		watcher.ObserveShare(2, hashOne, validatorB, hashTwo, []byte{2})
+
+		evidence := mustList(t, store, "")
+		require.Len(t, evidence, 1)
+		assert.Equal(t, KindInvalidPayload, evidence[0].Kind)
+		assert.Equal(t, validatorB.Hex(), evidence[0].Validator)
+	})
+
+	t.Run("should report validators that miss consecutive requests", func(t *testing.T) {
+		store := newTestStore(t)
+		watcher := NewWatcher(store, []common.Address{validatorA, validatorB}, 3)
+
+		watcher.ObserveRound(1, []common.Address{validatorA})
+		watcher.ObserveRound(2, []common.Address{validatorA})
+		watcher.ObserveRound(3, []common.Address{validatorB})
+		watcher.ObserveRound(4, []common.Address{validatorB})
+		assert.Empty(t, mustList(t, store, ""))
+
+		watcher.ObserveRound(5, []common.Address{validatorB})
+
+		evidence := mustList(t, store, "")
+		require.Len(t, evidence, 1)
+		assert.Equal(t, KindUnresponsive, evidence[0].Kind)
+		assert.Equal(t, validatorA.Hex(), evidence[0].Validator)
+
+		var details UnresponsiveDetails
+		require.NoError(t, json.Unmarshal(evidence[0].Details, &details))
+		assert.Equal(t, []uint64{3, 4, 5}, details.MissedRequests)
+	})
+}
+
+func TestQueue(t *testing.T) {
+	t.Run("should submit approved evidence", func(t *testing.T) {
+		store := newTestStore(t)
+		reporter := &fakeReporter{}
+		queue := NewQueue(store, reporter)
+		_, err := store.Record(validatorA, KindDoubleSign, 1, DoubleSignDetails{})
+		require.NoError(t, err)
+		id := mustList(t, store, "")[0].ID
+
+		evidence, err := queue.Approve(context.Background(), id, "confirmed")
+		require.NoError(t, err)
+		assert.Equal(t, StatusSubmitted, evidence.Status)
+		assert.Equal(t, common.HexToHash("0x01").Hex(), evidence.TxHash)
+		assert.Equal(t, []common.Address{validatorA}, reporter.reported)
+
+		_, err = queue.Reject(id, "")
+		assert.ErrorIs(t, err, ErrNotPending)
+	})
+
+	t.Run("should keep failed submissions reviewable", func(t *testing.T) {
+		store := newTestStore(t)
+		reporter := &fakeReporter{err: errors.New("caller is not the owner")}
+		queue := NewQueue(store, reporter)
+		_, err := store.Record(validatorA, KindInvalidPayload, 2, InvalidPayloadDetails{})
+		require.NoError(t, err)
+		id := mustList(t, store, "")[0].ID
+
+		evidence, err := queue.Approve(context.Background(), id, "")
+		require.NoError(t, err)
+		assert.Equal(t, StatusFailed, evidence.Status)
+		assert.Equal(t, "caller is not the owner", evidence.Error)
+
+		evidence, err = queue.Reject(id, "false positive")
+		require.NoError(t, err)
+		assert.Equal(t, StatusRejected, evidence.Status)
+		assert.NotNil(t, evidence.ReviewedAt)
+	})
+
+	t.Run("should return not found for unknown evidence", func(t *testing.T) {
+		queue := NewQueue(newTestStore(t), &fakeReporter{})
+		_, err := queue.Approve(context.Background(), 99, "")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func mustList(t *testing.T, store *Store, status string) []*Evidence {
+	evidence, err := store.List(status)
+	require.NoError(t, err)
+	return evidence
+}
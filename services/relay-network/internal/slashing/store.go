@@ -0,0 +1,238 @@
+package slashing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	KindDoubleSign     = "double_sign"
+	KindInvalidPayload = "invalid_payload"
+	KindUnresponsive   = "unresponsive"
+
+	StatusPending   = "pending"
+	StatusRejected  = "rejected"
+	StatusSubmitted = "submitted"
+	StatusFailed    = "failed"
+)
+
+var (
+	ErrNotFound   = errors.New("evidence not found")
+	ErrNotPending = errors.New("evidence already reviewed")
+)
+
+// Evidence is a piece of validator misbehavior awaiting operator review
+type Evidence struct {
+	ID         int64           `json:"id"`
+	Validator  string          `json:"validator"`
+	Kind       string          `json:"kind"`
+	RequestID  uint64          `json:"request_id"`
+	Details    json.RawMessage `json:"details"`
+	Status     string          `json:"status"`
+	Note       string          `json:"note,omitempty"`
+	TxHash     string          `json:"tx_hash,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ReviewedAt *time.Time      `json:"reviewed_at,omitempty"`
+}
+
+// Reason is the string recorded on-chain with the slash
+func (e *Evidence) Reason() string {
+	return fmt.Sprintf("%s on request %d", e.Kind, e.RequestID)
+}
+
+// Store persists evidence in SQLite
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) (*Store, error) {
+	schema := `
+	CREATE TABLE IF NOT EXISTS slashing_evidence (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		validator TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		request_id INTEGER NOT NULL,
+		details TEXT NOT NULL,
+		status TEXT NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		tx_hash TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		reviewed_at INTEGER,
+		UNIQUE (validator, kind, request_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_slashing_evidence_status ON slashing_evidence(status);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("failed to create slashing tables: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Record stores new evidence, reporting false if the same offence was already
+// recorded
+func (s *Store) Record(validator common.Address, kind string, requestID uint64, details interface{}) (bool, error) {
+	data, err := json.Marshal(details)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := s.db.Exec(`
+		INSERT OR IGNORE INTO slashing_evidence (validator, kind, request_id, details, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, validator.Hex(), kind, requestID, string(data), StatusPending, time.Now().Unix())
+	if err != nil {
+		return false, fmt.Errorf("failed to record evidence: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// List returns evidence newest first, optionally filtered by status
+func (s *Store) List(status string) ([]*Evidence, error) {
+	query := `SELECT id, validator, kind, request_id, details, status, note, tx_hash, error, created_at, reviewed_at FROM slashing_evidence`
+	var args []interface{}
+	if status != "" {
+		query += ` WHERE status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY id DESC`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	evidence := []*Evidence{}
+	for rows.Next() {
+		e, err := scanEvidence(rows)
+		if err != nil {
+			return nil, err
+		}
+		evidence = append(evidence, e)
+	}
+	return evidence, rows.Err()
+}
+
+// Get returns one piece of evidence
+func (s *Store) Get(id int64) (*Evidence, error) {
+	row := s.db.QueryRow(`
+		SELECT id, validator, kind, request_id, details, status, note, tx_hash, error, created_at, reviewed_at
+		FROM slashing_evidence WHERE id = ?
+	`, id)
+
+	e, err := scanEvidence(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return e, err
+}
+
+func (s *Store) review(e *Evidence) error {
+	now := time.Now()
+	e.ReviewedAt = &now
+	_, err := s.db.Exec(`
+		UPDATE slashing_evidence SET status = ?, note = ?, tx_hash = ?, error = ?, reviewed_at = ? WHERE id = ?
+	`, e.Status, e.Note, e.TxHash, e.Error, now.Unix(), e.ID)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEvidence(row scanner) (*Evidence, error) {
+	var e Evidence
+	var details string
+	var createdAt int64
+	var reviewedAt sql.NullInt64
+
+	if err := row.Scan(&e.ID, &e.Validator, &e.Kind, &e.RequestID, &details, &e.Status, &e.Note, &e.TxHash, &e.Error, &createdAt, &reviewedAt); err != nil {
+		return nil, err
+	}
+
+	e.Details = json.RawMessage(details)
+	e.CreatedAt = time.Unix(createdAt, 0)
+	if reviewedAt.Valid {
+		t := time.Unix(reviewedAt.Int64, 0)
+		e.ReviewedAt = &t
+	}
+	return &e, nil
+}
+
+// Reporter submits a slashing report on-chain
+type Reporter interface {
+	SlashValidator(ctx context.Context, validator common.Address, reason string) (common.Hash, error)
+}
+
+// Queue is the operator review queue: nothing is reported on-chain until an
+// operator approves it
+type Queue struct {
+	store    *Store
+	reporter Reporter
+}
+
+func NewQueue(store *Store, reporter Reporter) *Queue {
+	return &Queue{store: store, reporter: reporter}
+}
+
+func (q *Queue) List(status string) ([]*Evidence, error) {
+	return q.store.List(status)
+}
+
+// Approve submits the slashing report. Failed submissions can be approved
+// again.
+func (q *Queue) Approve(ctx context.Context, id int64, note string) (*Evidence, error) {
+	e, err := q.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if e.Status != StatusPending && e.Status != StatusFailed {
+		return nil, ErrNotPending
+	}
+
+	e.Note = note
+	txHash, err := q.reporter.SlashValidator(ctx, common.HexToAddress(e.Validator), e.Reason())
+	if err != nil {
+		e.Status = StatusFailed
+		e.Error = err.Error()
+	} else {
+		e.Status = StatusSubmitted
+		e.TxHash = txHash.Hex()
+		e.Error = ""
+	}
+
+	if err := q.store.review(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reject closes evidence without reporting it
+func (q *Queue) Reject(id int64, note string) (*Evidence, error) {
+	e, err := q.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if e.Status != StatusPending && e.Status != StatusFailed {
+		return nil, ErrNotPending
+	}
+
+	e.Status = StatusRejected
+	e.Note = note
+	if err := q.store.review(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,137 @@
+package slashing
+
+import (
+	"log"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// The watcher only records offences that can be proven to a third party:
+// signatures that recover to the offending validator. Signature checks
+// happen before shares reach it.
+
+// DoubleSignDetails holds two signatures by one validator over different
+// hashes for the same request
+type DoubleSignDetails struct {
+	MessageHashes [2]common.Hash   `json:"message_hashes"`
+	Signatures    [2]hexutil.Bytes `json:"signatures"`
+}
+
+// InvalidPayloadDetails holds a signature over a hash other than the one the
+// request was for
+type InvalidPayloadDetails struct {
+	ExpectedHash common.Hash   `json:"expected_hash"`
+	SignedHash   common.Hash   `json:"signed_hash"`
+	Signature    hexutil.Bytes `json:"signature"`
+}
+
+// UnresponsiveDetails records consecutive requests a validator did not sign
+type UnresponsiveDetails struct {
+	MissedRequests []uint64 `json:"missed_requests"`
+}
+
+type signedShare struct {
+	hash      common.Hash
+	signature []byte
+}
+
+// Watcher detects validator misbehavior and records evidence for review
+type Watcher struct {
+	store      *Store
+	validators []common.Address
+	maxMissed  int
+
+	shares map[uint64]map[common.Address]signedShare
+	missed map[common.Address][]uint64
+	mutex  sync.Mutex
+}
+
+// NewWatcher watches the given validators for missed requests; a validator
+// that misses maxMissed requests in a row is reported as unresponsive
+func NewWatcher(store *Store, validators []common.Address, maxMissed int) *Watcher {
+	return &Watcher{
+		store:      store,
+		validators: validators,
+		maxMissed:  maxMissed,
+		shares:     make(map[uint64]map[common.Address]signedShare),
+		missed:     make(map[common.Address][]uint64),
+	}
+}
+
+// ObserveShare checks a signature share already verified to be signer's
+// signature over signed. expected is the hash the request is for, or zero if
+// not known yet.
+func (w *Watcher) ObserveShare(requestID uint64, expected common.Hash, signer common.Address, signed common.Hash, signature []byte) {
+	w.mutex.Lock()
+	shares, ok := w.shares[requestID]
+	if !ok {
+		shares = make(map[common.Address]signedShare)
+		w.shares[requestID] = shares
+	}
+	previous, seen := shares[signer]
+	if !seen {
+		shares[signer] = signedShare{hash: signed, signature: signature}
+	}
+	w.mutex.Unlock()
+
+	if seen && previous.hash != signed {
+		w.record(signer, KindDoubleSign, requestID, DoubleSignDetails{
+			MessageHashes: [2]common.Hash{previous.hash, signed},
+			Signatures:    [2]hexutil.Bytes{previous.signature, signature},
+		})
+	}
+
+	if expected != (common.Hash{}) && signed != expected {
+		w.record(signer, KindInvalidPayload, requestID, InvalidPayloadDetails{
+			ExpectedHash: expected,
+			SignedHash:   signed,
+			Signature:    signature,
+		})
+	}
+}
+
+// ObserveRound is called once a request's deadline passes with the validators
+// that signed it
+func (w *Watcher) ObserveRound(requestID uint64, signers []common.Address) {
+	signed := make(map[common.Address]bool, len(signers))
+	for _, signer := range signers {
+		signed[signer] = true
+	}
+
+	var unresponsive []common.Address
+	var missedRequests [][]uint64
+
+	w.mutex.Lock()
+	delete(w.shares, requestID)
+	for _, validator := range w.validators {
+		if signed[validator] {
+			delete(w.missed, validator)
+			continue
+		}
+
+		w.missed[validator] = append(w.missed[validator], requestID)
+		if w.maxMissed > 0 && len(w.missed[validator]) >= w.maxMissed {
+			unresponsive = append(unresponsive, validator)
+			missedRequests = append(missedRequests, w.missed[validator])
+			delete(w.missed, validator)
+		}
+	}
+	w.mutex.Unlock()
+
+	for i, validator := range unresponsive {
+		w.record(validator, KindUnresponsive, requestID, UnresponsiveDetails{MissedRequests: missedRequests[i]})
+	}
+}
+
+func (w *Watcher) record(validator common.Address, kind string, requestID uint64, details interface{}) {
+	created, err := w.store.Record(validator, kind, requestID, details)
+	if err != nil {
+		log.Printf("Failed to record %s evidence against %s: %v", kind, validator.Hex(), err)
+		return
+	}
+	if created {
+		log.Printf("Recorded %s evidence against %s for request %d", kind, validator.Hex(), requestID)
+	}
+}
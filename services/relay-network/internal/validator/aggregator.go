@@ -0,0 +1,311 @@
+package validator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/crosspay/relay-network/internal/metrics"
+	"github.com/crosspay/relay-network/internal/p2p"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Signature shares are ECDSA signatures over the EIP-191 prefixed message
+// hash with a 27/28 recovery byte, the format RelayValidator recovers in
+// signValidation and submitAggregatedSignatures. Shares are collected per
+// request until the required count is reached, then bundled sorted by signer
+// address.
+
+var (
+	errDuplicateShare = errors.New("signer already submitted a share")
+	errInvalidShare   = fmt.Errorf("%w: signature does not recover to signer", p2p.ErrInvalidSignature)
+)
+
+var bundleArguments = abi.Arguments{
+	{Type: mustABIType("bytes32")},
+	{Type: mustABIType("address[]")},
+	{Type: mustABIType("bytes[]")},
+}
+
+func mustABIType(t string) abi.Type {
+	typ, err := abi.NewType(t, "", nil)
+	if err != nil {
+		panic(err)
+	}
+	return typ
+}
+
+// Quorum is the signature bundle for a request that reached its threshold
+type Quorum struct {
+	RequestID   uint64           `json:"request_id"`
+	MessageHash common.Hash      `json:"message_hash"`
+	Signers     []common.Address `json:"signers"`
+	Signatures  []hexutil.Bytes  `json:"signatures"`
+	Bundle      hexutil.Bytes    `json:"bundle"`
+	ReachedAt   time.Time        `json:"reached_at"`
+}
+
+type collection struct {
+	messageHash common.Hash
+	required    int
+	tracked     bool
+	shares      map[common.Address][]byte
+	// unverified shares that arrived before the request itself
+	early     map[common.Address][]byte
+	quorum    *Quorum
+	updatedAt time.Time
+	trackedAt time.Time
+}
+
+// Aggregator collects signature shares and reports each request once its
+// quorum is reached
+type Aggregator struct {
+	requests map[uint64]*collection
+	onQuorum func(*Quorum)
+	onShare  func(requestID uint64, signer common.Address)
+	chain    string
+	mutex    sync.Mutex
+}
+
+func NewAggregator(onQuorum func(*Quorum)) *Aggregator {
+	return &Aggregator{
+		requests: make(map[uint64]*collection),
+		onQuorum: onQuorum,
+	}
+}
+
+// SignShare signs a message hash in the format the contract verifies
+func SignShare(messageHash common.Hash, signer keys.Signer) ([]byte, error) {
+	_, message := accounts.TextAndHash(messageHash.Bytes())
+	signature, err := signer.SignData([]byte(message))
+	if err != nil {
+		return nil, err
+	}
+	signature[crypto.RecoveryIDOffset] += 27
+	return signature, nil
+}
+
+// VerifyShare checks a share was produced by signer over messageHash
+func VerifyShare(messageHash common.Hash, signer common.Address, signature []byte) error {
+	if len(signature) != crypto.SignatureLength {
+		return fmt.Errorf("%w: invalid length %d", errInvalidShare, len(signature))
+	}
+
+	sig := make([]byte, len(signature))
+	copy(sig, signature)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+
+	pub, err := crypto.SigToPub(accounts.TextHash(messageHash.Bytes()), sig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidShare, err)
+	}
+	if crypto.PubkeyToAddress(*pub) != signer {
+		return errInvalidShare
+	}
+	return nil
+}
+
+func (a *Aggregator) collection(requestID uint64) *collection {
+	c, ok := a.requests[requestID]
+	if !ok {
+		c = &collection{
+			shares: make(map[common.Address][]byte),
+			early:  make(map[common.Address][]byte),
+		}
+		a.requests[requestID] = c
+	}
+	c.updatedAt = time.Now()
+	return c
+}
+
+// Track starts collecting shares for a request, verifying any that arrived
+// before it
+func (a *Aggregator) Track(requestID uint64, messageHash common.Hash, required int) {
+	a.mutex.Lock()
+	c := a.collection(requestID)
+	if c.tracked {
+		a.mutex.Unlock()
+		return
+	}
+	c.tracked = true
+	c.trackedAt = time.Now()
+	c.messageHash = messageHash
+	c.required = required
+
+	var accepted []common.Address
+	for signer, sig := range c.early {
+		if VerifyShare(messageHash, signer, sig) == nil {
+			c.shares[signer] = sig
+			accepted = append(accepted, signer)
+		}
+	}
+	c.early = nil
+
+	quorum := a.checkQuorum(requestID, c)
+	a.mutex.Unlock()
+
+	for _, signer := range accepted {
+		a.shareAdded(requestID, signer)
+	}
+	a.notify(quorum)
+}
+
+// Add records a signature share. Shares for unknown requests are held until
+// the request is tracked.
+func (a *Aggregator) Add(requestID uint64, signer common.Address, signature []byte) error {
+	a.mutex.Lock()
+	c := a.collection(requestID)
+
+	if !c.tracked {
+		c.early[signer] = signature
+		a.mutex.Unlock()
+		return nil
+	}
+	if _, exists := c.shares[signer]; exists {
+		a.mutex.Unlock()
+		return errDuplicateShare
+	}
+	if err := VerifyShare(c.messageHash, signer, signature); err != nil {
+		a.mutex.Unlock()
+		return err
+	}
+
+	c.shares[signer] = signature
+	quorum := a.checkQuorum(requestID, c)
+	a.mutex.Unlock()
+
+	a.shareAdded(requestID, signer)
+	a.notify(quorum)
+	return nil
+}
+
+// checkQuorum builds the bundle the first time a request reaches its
+// threshold. Callers hold the mutex.
+func (a *Aggregator) checkQuorum(requestID uint64, c *collection) *Quorum {
+	if c.quorum != nil || c.required <= 0 || len(c.shares) < c.required {
+		return nil
+	}
+
+	signers := make([]common.Address, 0, len(c.shares))
+	for signer := range c.shares {
+		signers = append(signers, signer)
+	}
+	sort.Slice(signers, func(i, j int) bool {
+		return bytes.Compare(signers[i].Bytes(), signers[j].Bytes()) < 0
+	})
+
+	signatures := make([]hexutil.Bytes, len(signers))
+	raw := make([][]byte, len(signers))
+	for i, signer := range signers {
+		signatures[i] = c.shares[signer]
+		raw[i] = c.shares[signer]
+	}
+
+	bundle, err := bundleArguments.Pack(c.messageHash, signers, raw)
+	if err != nil {
+		return nil
+	}
+
+	c.quorum = &Quorum{
+		RequestID:   requestID,
+		MessageHash: c.messageHash,
+		Signers:     signers,
+		Signatures:  signatures,
+		Bundle:      bundle,
+		ReachedAt:   time.Now(),
+	}
+	metrics.QuorumSeconds.Observe(c.quorum.ReachedAt.Sub(c.trackedAt).Seconds(), a.chain)
+	return c.quorum
+}
+
+// SetChain sets the chain ID quorum metrics are labelled with
+func (a *Aggregator) SetChain(chainID int64) {
+	a.chain = strconv.FormatInt(chainID, 10)
+}
+
+// OnShare sets a callback run for each verified share, before the quorum it
+// completes is reported
+func (a *Aggregator) OnShare(onShare func(requestID uint64, signer common.Address)) {
+	a.onShare = onShare
+}
+
+func (a *Aggregator) shareAdded(requestID uint64, signer common.Address) {
+	if a.onShare != nil {
+		a.onShare(requestID, signer)
+	}
+}
+
+func (a *Aggregator) notify(quorum *Quorum) {
+	if quorum != nil && a.onQuorum != nil {
+		a.onQuorum(quorum)
+	}
+}
+
+// Signatures returns the verified shares for a request keyed by signer
+func (a *Aggregator) Signatures(requestID uint64) map[string]string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	sigs := make(map[string]string)
+	if c, ok := a.requests[requestID]; ok {
+		for signer, sig := range c.shares {
+			sigs[signer.Hex()] = hexutil.Encode(sig)
+		}
+	}
+	return sigs
+}
+
+// Quorum returns the bundle for a request once it reached its threshold
+func (a *Aggregator) Quorum(requestID uint64) (*Quorum, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	c, ok := a.requests[requestID]
+	if !ok || c.quorum == nil {
+		return nil, false
+	}
+	return c.quorum, true
+}
+
+// TrackedAt returns when a request started being tracked
+func (a *Aggregator) TrackedAt(requestID uint64) (time.Time, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	c, ok := a.requests[requestID]
+	if !ok || !c.tracked {
+		return time.Time{}, false
+	}
+	return c.trackedAt, true
+}
+
+// Remove stops tracking a request
+func (a *Aggregator) Remove(requestID uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.requests, requestID)
+}
+
+// Prune drops shares for requests that were never tracked and have not been
+// updated since cutoff
+func (a *Aggregator) Prune(cutoff time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for id, c := range a.requests {
+		if !c.tracked && c.updatedAt.Before(cutoff) {
+			delete(a.requests, id)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package validator
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"sync"
+	"testing"
+
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedShare(t *testing.T, hash common.Hash) (*ecdsa.PrivateKey, common.Address, []byte) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signature, err := SignShare(hash, keys.NewLocalSigner(key))
+	require.NoError(t, err)
+	return key, crypto.PubkeyToAddress(key.PublicKey), signature
+}
+
+func TestAggregator(t *testing.T) {
+	hash := crypto.Keccak256Hash([]byte("payment-1"))
+
+	t.Run("should bundle shares sorted by signer once quorum is reached", func(t *testing.T) {
+		var mutex sync.Mutex
+		var quorums []*Quorum
+		agg := NewAggregator(func(q *Quorum) {
+			mutex.Lock()
+			quorums = append(quorums, q)
+			mutex.Unlock()
+		})
+		agg.Track(1, hash, 2)
+
+		_, signerA, sigA := signedShare(t, hash)
+		_, signerB, sigB := signedShare(t, hash)
+		_, signerC, sigC := signedShare(t, hash)
+
+		require.NoError(t, agg.Add(1, signerA, sigA))
+		_, reached := agg.Quorum(1)
+		assert.False(t, reached)
+
+		require.NoError(t, agg.Add(1, signerB, sigB))
+		require.NoError(t, agg.Add(1, signerC, sigC))
+
+		require.Len(t, quorums, 1)
+		quorum := quorums[0]
+		assert.Len(t, quorum.Signers, 2)
+		assert.True(t, bytes.Compare(quorum.Signers[0].Bytes(), quorum.Signers[1].Bytes()) < 0)
+
+		decoded, err := bundleArguments.Unpack(quorum.Bundle)
+		require.NoError(t, err)
+		assert.Equal(t, [32]byte(hash), decoded[0])
+		assert.Equal(t, quorum.Signers, decoded[1])
+		assert.Len(t, agg.Signatures(1), 3)
+	})
+
+	t.Run("should reject invalid and duplicate shares", func(t *testing.T) {
+		agg := NewAggregator(nil)
+		agg.Track(2, hash, 2)
+
+		_, signer, signature := signedShare(t, hash)
+		_, other, _ := signedShare(t, hash)
+
+		assert.ErrorIs(t, agg.Add(2, other, signature), errInvalidShare)
+		require.NoError(t, agg.Add(2, signer, signature))
+		assert.ErrorIs(t, agg.Add(2, signer, signature), errDuplicateShare)
+	})
+
+	t.Run("should verify shares received before the request", func(t *testing.T) {
+		agg := NewAggregator(nil)
+
+		_, signerA, sigA := signedShare(t, hash)
+		_, signerB, _ := signedShare(t, hash)
+		require.NoError(t, agg.Add(3, signerA, sigA))
+		require.NoError(t, agg.Add(3, signerB, sigA))
+
+		agg.Track(3, hash, 1)
+
+		assert.Equal(t, []string{signerA.Hex()}, mapKeys(agg.Signatures(3)))
+		_, reached := agg.Quorum(3)
+		assert.True(t, reached)
+	})
+}
+
+func TestVerifyShareMatchesContractFormat(t *testing.T) {
+	hash := crypto.Keccak256Hash([]byte("payment-2"))
+	_, signer, signature := signedShare(t, hash)
+
+	// OpenZeppelin ECDSA.recover only accepts v of 27 or 28
+	assert.Contains(t, []byte{27, 28}, signature[crypto.RecoveryIDOffset])
+	assert.NoError(t, VerifyShare(hash, signer, signature))
+}
+
+func mapKeys(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
@@ -0,0 +1,113 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/crosspay/relay-network/internal/metrics"
+	"github.com/crosspay/relay-network/internal/p2p"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Chains routes P2P messages to the node validating for the message's chain,
+// so one P2P network serves every chain. Messages without a chain ID belong
+// to the primary chain, the first node. Messages for chains this node does
+// not validate are still relayed by the network but not processed.
+type Chains struct {
+	nodes []*Node
+	byID  map[int64]*Node
+}
+
+func NewChains(nodes ...*Node) *Chains {
+	c := &Chains{nodes: nodes, byID: make(map[int64]*Node, len(nodes))}
+	for _, node := range nodes {
+		c.byID[node.ChainID()] = node
+	}
+	return c
+}
+
+// Primary returns the node for the primary chain
+func (c *Chains) Primary() *Node {
+	return c.nodes[0]
+}
+
+// Nodes returns the node for each chain, primary first
+func (c *Chains) Nodes() []*Node {
+	return c.nodes
+}
+
+// Node returns the node validating for a chain, or the primary node for
+// chain ID 0
+func (c *Chains) Node(chainID int64) (*Node, bool) {
+	if chainID == 0 {
+		return c.Primary(), true
+	}
+	node, ok := c.byID[chainID]
+	return node, ok
+}
+
+// SetNetwork sets where every chain's signature shares are broadcast
+func (c *Chains) SetNetwork(network SignatureBroadcaster) {
+	for _, node := range c.nodes {
+		node.SetNetwork(network)
+	}
+}
+
+func (c *Chains) ProcessValidationRequest(msg *p2p.ValidationMessage) error {
+	node, ok := c.Node(msg.ChainID)
+	if !ok {
+		metrics.MessagesDropped.Inc("unknown_chain")
+		return nil
+	}
+	return node.ProcessValidationRequest(msg)
+}
+
+func (c *Chains) ProcessSignatureShare(msg *p2p.ValidationMessage) error {
+	node, ok := c.Node(msg.ChainID)
+	if !ok {
+		metrics.MessagesDropped.Inc("unknown_chain")
+		return nil
+	}
+	return node.ProcessSignatureShare(msg)
+}
+
+func (c *Chains) GetAddress() string {
+	return c.Primary().GetAddress()
+}
+
+func (c *Chains) GetStatus() string {
+	return c.Primary().GetStatus()
+}
+
+// ActiveValidators returns the validators active on any chain with a
+// contract, so peers that validate for only some of this node's chains may
+// still connect. It fails only if no chain's validator set could be read.
+func (c *Chains) ActiveValidators(ctx context.Context) ([]common.Address, error) {
+	var active []common.Address
+	var errs []error
+	seen := make(map[common.Address]bool)
+	contracts := 0
+	for _, node := range c.nodes {
+		if !common.IsHexAddress(node.config.ContractAddress) {
+			continue
+		}
+		contracts++
+		validators, err := node.ActiveValidators(ctx)
+		if err != nil {
+			log.Printf("Failed to read active validators on chain %d: %v", node.ChainID(), err)
+			errs = append(errs, err)
+			continue
+		}
+		for _, validator := range validators {
+			if !seen[validator] {
+				seen[validator] = true
+				active = append(active, validator)
+			}
+		}
+	}
+	if len(errs) == contracts {
+		return nil, errors.Join(errs...)
+	}
+	return active, nil
+}
@@ -0,0 +1,58 @@
+package validator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/crosspay/relay-network/internal/p2p"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChains(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer := keys.NewLocalSigner(key)
+
+	primary := NewNode(signer, &config.Config{ChainID: 1337})
+	secondary := NewNode(signer, &config.Config{ChainID: 80002})
+	chains := NewChains(primary, secondary)
+
+	request := func(chainID int64, requestID uint64) *p2p.ValidationMessage {
+		return &p2p.ValidationMessage{
+			ChainID:      chainID,
+			RequestID:    requestID,
+			MessageHash:  crypto.Keccak256Hash([]byte("payment")).Hex(),
+			RequiredSigs: 2,
+			Timestamp:    time.Now(),
+		}
+	}
+
+	t.Run("should route requests to the node for their chain", func(t *testing.T) {
+		require.NoError(t, chains.ProcessValidationRequest(request(80002, 1)))
+
+		_, onPrimary := primary.GetValidationStatus(1)
+		_, onSecondary := secondary.GetValidationStatus(1)
+		assert.False(t, onPrimary)
+		assert.True(t, onSecondary)
+	})
+
+	t.Run("should send requests without a chain to the primary chain", func(t *testing.T) {
+		require.NoError(t, chains.ProcessValidationRequest(request(0, 2)))
+
+		_, onPrimary := primary.GetValidationStatus(2)
+		assert.True(t, onPrimary)
+	})
+
+	t.Run("should ignore chains this node does not validate", func(t *testing.T) {
+		require.NoError(t, chains.ProcessValidationRequest(request(10, 3)))
+
+		_, found := chains.Node(10)
+		assert.False(t, found)
+		assert.Equal(t, 1, primary.GetPendingValidationCount())
+		assert.Equal(t, 1, secondary.GetPendingValidationCount())
+	})
+}
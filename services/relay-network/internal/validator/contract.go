@@ -0,0 +1,175 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// RelayValidator.ValidationStatus values the node checks for
+const (
+	requestStatusPending    uint8 = 0
+	requestStatusInProgress uint8 = 1
+)
+
+// relayValidatorABI covers the RelayValidator functions the node calls
+const relayValidatorABI = `[
+	{"type":"function","name":"submitAggregatedSignatures","stateMutability":"nonpayable","inputs":[{"name":"requestId","type":"uint256"},{"name":"signers","type":"address[]"},{"name":"signatures","type":"bytes[]"}],"outputs":[]},
+	{"type":"function","name":"getValidationRequest","stateMutability":"view","inputs":[{"name":"requestId","type":"uint256"}],"outputs":[{"name":"id","type":"uint256"},{"name":"paymentId","type":"uint256"},{"name":"messageHash","type":"bytes32"},{"name":"requiredSignatures","type":"uint256"},{"name":"receivedSignatures","type":"uint256"},{"name":"status","type":"uint8"},{"name":"createdAt","type":"uint256"},{"name":"deadline","type":"uint256"},{"name":"isHighValue","type":"bool"}]},
+	{"type":"function","name":"slashValidator","stateMutability":"nonpayable","inputs":[{"name":"validator","type":"address"},{"name":"reason","type":"string"}],"outputs":[]},
+	{"type":"function","name":"registerValidator","stateMutability":"payable","inputs":[{"name":"blsPublicKey","type":"uint256[4]"}],"outputs":[]},
+	{"type":"function","name":"exitValidator","stateMutability":"nonpayable","inputs":[],"outputs":[]},
+	{"type":"function","name":"validatorStakes","stateMutability":"view","inputs":[{"name":"validator","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"getValidatorBLSPublicKey","stateMutability":"view","inputs":[{"name":"validator","type":"address"}],"outputs":[{"name":"","type":"uint256[4]"}]},
+	{"type":"function","name":"getActiveValidators","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"address[]"}]},
+	{"type":"function","name":"MIN_STAKE","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"event","name":"ValidatorRegistered","anonymous":false,"inputs":[{"name":"validator","type":"address","indexed":true},{"name":"stake","type":"uint256","indexed":false}]},
+	{"type":"event","name":"ValidatorExited","anonymous":false,"inputs":[{"name":"validator","type":"address","indexed":true},{"name":"returnedStake","type":"uint256","indexed":false}]}
+]`
+
+var parsedRelayValidatorABI = mustParseABI(relayValidatorABI)
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func newRelayValidatorContract(address common.Address, client *ethclient.Client) *RelayValidatorContract {
+	return &RelayValidatorContract{
+		address: address,
+		bound:   bind.NewBoundContract(address, parsedRelayValidatorABI, client, client, client),
+	}
+}
+
+// transact sends a contract transaction, taking the nonce from the chain's
+// transaction manager when one is set
+func (c *RelayValidatorContract) transact(auth *bind.TransactOpts, method string, params ...interface{}) (common.Hash, error) {
+	if c.txs == nil {
+		tx, err := c.bound.Transact(auth, method, params...)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		return tx.Hash(), nil
+	}
+
+	tx, err := c.txs.send(auth.Context, method, auth.Signer, func(nonce uint64) (*types.Transaction, error) {
+		auth.Nonce = new(big.Int).SetUint64(nonce)
+		return c.bound.Transact(auth, method, params...)
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return tx.Hash(), nil
+}
+
+// SubmitAggregate submits a quorum's signature shares in one transaction.
+// The gas limit grows with the number of shares the contract verifies.
+func (c *RelayValidatorContract) SubmitAggregate(ctx context.Context, signer keys.Signer, chainID int64, requestID uint64, signers []common.Address, signatures [][]byte) (common.Hash, error) {
+	auth := keys.NewTransactor(signer, big.NewInt(chainID))
+	auth.Context = ctx
+	auth.GasLimit = uint64(150000 + 100000*len(signers))
+
+	return c.transact(auth, "submitAggregatedSignatures", new(big.Int).SetUint64(requestID), signers, signatures)
+}
+
+// RequestOpen reports whether a request still accepts signatures, that is
+// whether it is neither completed, failed nor expired
+func (c *RelayValidatorContract) RequestOpen(ctx context.Context, requestID uint64) (bool, error) {
+	var out []interface{}
+	if err := c.bound.Call(&bind.CallOpts{Context: ctx}, &out, "getValidationRequest", new(big.Int).SetUint64(requestID)); err != nil {
+		return false, err
+	}
+	status := out[5].(uint8)
+	return status == requestStatusPending || status == requestStatusInProgress, nil
+}
+
+// SlashValidator reports a misbehaving validator. The contract only accepts
+// reports from its owner.
+func (c *RelayValidatorContract) SlashValidator(ctx context.Context, signer keys.Signer, chainID int64, validator common.Address, reason string) (common.Hash, error) {
+	auth := keys.NewTransactor(signer, big.NewInt(chainID))
+	auth.Context = ctx
+	auth.GasLimit = uint64(150000)
+
+	return c.transact(auth, "slashValidator", validator, reason)
+}
+
+// ActiveValidators returns the validators currently registered and active
+func (c *RelayValidatorContract) ActiveValidators(ctx context.Context) ([]common.Address, error) {
+	var out []interface{}
+	if err := c.bound.Call(&bind.CallOpts{Context: ctx}, &out, "getActiveValidators"); err != nil {
+		return nil, err
+	}
+	return out[0].([]common.Address), nil
+}
+
+// RegisterValidator deposits stake and registers this validator's BLS key
+func (c *RelayValidatorContract) RegisterValidator(ctx context.Context, signer keys.Signer, chainID int64, stake *big.Int, blsKey [4]*big.Int) (common.Hash, error) {
+	auth := keys.NewTransactor(signer, big.NewInt(chainID))
+	auth.Context = ctx
+	auth.Value = stake
+	auth.GasLimit = registrationGasLimit
+
+	return c.transact(auth, "registerValidator", blsKey)
+}
+
+// ExitValidator leaves the active set. The contract returns the stake in the
+// same transaction.
+func (c *RelayValidatorContract) ExitValidator(ctx context.Context, signer keys.Signer, chainID int64) (common.Hash, error) {
+	auth := keys.NewTransactor(signer, big.NewInt(chainID))
+	auth.Context = ctx
+	auth.GasLimit = uint64(150000)
+
+	return c.transact(auth, "exitValidator")
+}
+
+// Stake returns the stake the contract holds for a validator
+func (c *RelayValidatorContract) Stake(ctx context.Context, validator common.Address) (*big.Int, error) {
+	var out []interface{}
+	if err := c.bound.Call(&bind.CallOpts{Context: ctx}, &out, "validatorStakes", validator); err != nil {
+		return nil, err
+	}
+	return out[0].(*big.Int), nil
+}
+
+// MinStake returns the smallest stake the contract accepts
+func (c *RelayValidatorContract) MinStake(ctx context.Context) (*big.Int, error) {
+	var out []interface{}
+	if err := c.bound.Call(&bind.CallOpts{Context: ctx}, &out, "MIN_STAKE"); err != nil {
+		return nil, err
+	}
+	return out[0].(*big.Int), nil
+}
+
+// stakeEvent finds a ValidatorRegistered or ValidatorExited event for
+// validator in a receipt and returns the stake it carries
+func (c *RelayValidatorContract) stakeEvent(receipt *types.Receipt, event string, validator common.Address) (*big.Int, error) {
+	for _, l := range receipt.Logs {
+		if l.Address != c.address {
+			continue
+		}
+		var out struct {
+			Validator     common.Address
+			Stake         *big.Int
+			ReturnedStake *big.Int
+		}
+		if err := c.bound.UnpackLog(&out, event, *l); err != nil || out.Validator != validator {
+			continue
+		}
+		if out.Stake != nil {
+			return out.Stake, nil
+		}
+		return out.ReturnedStake, nil
+	}
+	return nil, fmt.Errorf("no %s event for %s in tx %s", event, validator.Hex(), receipt.TxHash.Hex())
+}
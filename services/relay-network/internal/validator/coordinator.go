@@ -0,0 +1,120 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// One validator, the coordinator, submits each request's aggregate so the
+// quorum pays gas once. Every node ranks the on-chain active set by
+// keccak256(requestID, address) and so derives the same order. The
+// validator ranked k takes over after k submission slots if the request is
+// still open on-chain, which covers coordinators that are offline or whose
+// transactions fail.
+
+var (
+	errNotCoordinator   = errors.New("not in the active validator set")
+	errRequestCompleted = errors.New("request no longer open on-chain")
+)
+
+// aggregateChain is the part of the RelayValidator contract coordination
+// uses
+type aggregateChain interface {
+	ActiveValidators(ctx context.Context) ([]common.Address, error)
+	RequestOpen(ctx context.Context, requestID uint64) (bool, error)
+	SubmitAggregate(ctx context.Context, signer keys.Signer, chainID int64, requestID uint64, signers []common.Address, signatures [][]byte) (common.Hash, error)
+}
+
+type coordinator struct {
+	chain   aggregateChain
+	signer  keys.Signer
+	chainID int64
+	slot    time.Duration
+}
+
+func newCoordinator(chain aggregateChain, signer keys.Signer, chainID int64, slot time.Duration) *coordinator {
+	return &coordinator{chain: chain, signer: signer, chainID: chainID, slot: slot}
+}
+
+// coordinatorOrder ranks the active validators for a request. The first is
+// its coordinator and the rest are its fallbacks in turn.
+func coordinatorOrder(requestID uint64, active []common.Address) []common.Address {
+	seed := make([]byte, 8)
+	binary.BigEndian.PutUint64(seed, requestID)
+
+	type ranked struct {
+		address common.Address
+		key     []byte
+	}
+	order := make([]ranked, len(active))
+	for i, address := range active {
+		order[i] = ranked{address: address, key: crypto.Keccak256(seed, address.Bytes())}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(order[i].key, order[j].key) < 0
+	})
+
+	addresses := make([]common.Address, len(order))
+	for i, r := range order {
+		addresses[i] = r.address
+	}
+	return addresses
+}
+
+// coordinatorRank returns where address stands in a request's coordinator
+// order, or -1 when it is not an active validator
+func coordinatorRank(requestID uint64, active []common.Address, address common.Address) int {
+	for rank, candidate := range coordinatorOrder(requestID, active) {
+		if candidate == address {
+			return rank
+		}
+	}
+	return -1
+}
+
+// submit waits for this node's slot and submits the aggregate unless a
+// coordinator ranked ahead of it completed the request first. It returns the
+// node's rank and the submission's transaction hash.
+func (c *coordinator) submit(ctx context.Context, quorum *Quorum) (int, common.Hash, error) {
+	active, err := c.chain.ActiveValidators(ctx)
+	if err != nil {
+		return -1, common.Hash{}, err
+	}
+	rank := coordinatorRank(quorum.RequestID, active, c.signer.Address())
+	if rank < 0 {
+		return rank, common.Hash{}, errNotCoordinator
+	}
+
+	if rank > 0 {
+		timer := time.NewTimer(time.Duration(rank) * c.slot)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return rank, common.Hash{}, ctx.Err()
+		}
+
+		open, err := c.chain.RequestOpen(ctx, quorum.RequestID)
+		if err != nil {
+			return rank, common.Hash{}, err
+		}
+		if !open {
+			return rank, common.Hash{}, errRequestCompleted
+		}
+	}
+
+	signatures := make([][]byte, len(quorum.Signatures))
+	for i, signature := range quorum.Signatures {
+		signatures[i] = signature
+	}
+	txHash, err := c.chain.SubmitAggregate(ctx, c.signer, c.chainID, quorum.RequestID, quorum.Signers, signatures)
+	return rank, txHash, err
+}
@@ -0,0 +1,146 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAggregateChain struct {
+	active    []common.Address
+	open      bool
+	submitErr error
+	submitted []uint64
+}
+
+func (c *fakeAggregateChain) ActiveValidators(ctx context.Context) ([]common.Address, error) {
+	return c.active, nil
+}
+
+func (c *fakeAggregateChain) RequestOpen(ctx context.Context, requestID uint64) (bool, error) {
+	return c.open, nil
+}
+
+func (c *fakeAggregateChain) SubmitAggregate(ctx context.Context, signer keys.Signer, chainID int64, requestID uint64, signers []common.Address, signatures [][]byte) (common.Hash, error) {
+	if c.submitErr != nil {
+		return common.Hash{}, c.submitErr
+	}
+	c.submitted = append(c.submitted, requestID)
+	return common.HexToHash("0x01"), nil
+}
+
+func TestCoordinator(t *testing.T) {
+	signers := make([]keys.Signer, 4)
+	active := make([]common.Address, len(signers))
+	for i := range signers {
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		signers[i] = keys.NewLocalSigner(key)
+		active[i] = signers[i].Address()
+	}
+
+	// signerAt returns the signer ranked rank for a request
+	signerAt := func(requestID uint64, rank int) keys.Signer {
+		leader := coordinatorOrder(requestID, active)[rank]
+		for _, signer := range signers {
+			if signer.Address() == leader {
+				return signer
+			}
+		}
+		t.Fatalf("no signer ranked %d", rank)
+		return nil
+	}
+	quorum := &Quorum{RequestID: 7}
+
+	t.Run("should order the active set the same way whatever order it is read in", func(t *testing.T) {
+		reversed := []common.Address{active[3], active[2], active[1], active[0]}
+
+		assert.Equal(t, coordinatorOrder(7, active), coordinatorOrder(7, reversed))
+		assert.ElementsMatch(t, active, coordinatorOrder(7, active))
+		assert.Equal(t, -1, coordinatorRank(7, active, common.HexToAddress("0x01")))
+	})
+
+	t.Run("should spread coordination across validators", func(t *testing.T) {
+		leaders := make(map[common.Address]bool)
+		for id := uint64(1); id <= 50; id++ {
+			leaders[coordinatorOrder(id, active)[0]] = true
+		}
+
+		assert.Greater(t, len(leaders), 1)
+	})
+
+	t.Run("should submit immediately as coordinator", func(t *testing.T) {
+		chain := &fakeAggregateChain{active: active, open: true}
+		c := newCoordinator(chain, signerAt(7, 0), 1, time.Hour)
+
+		rank, txHash, err := c.submit(context.Background(), quorum)
+
+		require.NoError(t, err)
+		assert.Equal(t, 0, rank)
+		assert.Equal(t, common.HexToHash("0x01"), txHash)
+		assert.Equal(t, []uint64{7}, chain.submitted)
+	})
+
+	t.Run("should take over once the coordinator misses its slot", func(t *testing.T) {
+		chain := &fakeAggregateChain{active: active, open: true}
+		c := newCoordinator(chain, signerAt(7, 2), 1, 10*time.Millisecond)
+
+		start := time.Now()
+		rank, _, err := c.submit(context.Background(), quorum)
+
+		require.NoError(t, err)
+		assert.Equal(t, 2, rank)
+		assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+		assert.Equal(t, []uint64{7}, chain.submitted)
+	})
+
+	t.Run("should not submit a request completed by an earlier coordinator", func(t *testing.T) {
+		chain := &fakeAggregateChain{active: active, open: false}
+		c := newCoordinator(chain, signerAt(7, 1), 1, time.Millisecond)
+
+		_, _, err := c.submit(context.Background(), quorum)
+
+		assert.ErrorIs(t, err, errRequestCompleted)
+		assert.Empty(t, chain.submitted)
+	})
+
+	t.Run("should give up when the deadline passes before its slot", func(t *testing.T) {
+		chain := &fakeAggregateChain{active: active, open: true}
+		c := newCoordinator(chain, signerAt(7, 3), 1, time.Hour)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, _, err := c.submit(ctx, quorum)
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Empty(t, chain.submitted)
+	})
+
+	t.Run("should not submit outside the active set", func(t *testing.T) {
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		chain := &fakeAggregateChain{active: active, open: true}
+		c := newCoordinator(chain, keys.NewLocalSigner(key), 1, time.Millisecond)
+
+		_, _, err = c.submit(context.Background(), quorum)
+
+		assert.ErrorIs(t, err, errNotCoordinator)
+		assert.Empty(t, chain.submitted)
+	})
+
+	t.Run("should return the submission error", func(t *testing.T) {
+		chain := &fakeAggregateChain{active: active, open: true, submitErr: errors.New("reverted")}
+		c := newCoordinator(chain, signerAt(7, 0), 1, time.Hour)
+
+		_, _, err := c.submit(context.Background(), quorum)
+
+		assert.EqualError(t, err, "reverted")
+	})
+}
@@ -2,19 +2,23 @@ package validator
 
 import (
 	"context"
-	"crypto/ecdsa"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/crosspay/relay-network/internal/batch"
 	"github.com/crosspay/relay-network/internal/config"
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/crosspay/relay-network/internal/metrics"
 	"github.com/crosspay/relay-network/internal/p2p"
+	"github.com/crosspay/relay-network/internal/slashing"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/ethclient"
 )
 
@@ -25,6 +29,7 @@ type ValidationRequest struct {
 	RequiredSigs int       `json:"required_signatures"`
 	Deadline     time.Time `json:"deadline"`
 	IsHighValue  bool      `json:"is_high_value"`
+	Submitted    bool      `json:"submitted"`
 }
 
 type SignatureResult struct {
@@ -36,37 +41,142 @@ type SignatureResult struct {
 }
 
 type Node struct {
-	privateKey     *ecdsa.PrivateKey
+	signer         keys.Signer
 	address        common.Address
 	config         *config.Config
 	client         *ethclient.Client
 	contract       *RelayValidatorContract
+	coordinator    *coordinator
 	
 	pendingValidations map[uint64]*ValidationRequest
-	signatures         map[uint64]map[string]string
+	aggregator         *Aggregator
+	network            SignatureBroadcaster
+	slashing           *slashing.Watcher
+	store              *Store
+	events             *eventHub
 	mutex              sync.RWMutex
 	
-	isRegistered bool
-	stake        *big.Int
-	status       string
+	registration      Registration
+	registrationMutex sync.Mutex
+	reporter          StatusReporter
+	responseTime      time.Duration
+	status            string
+	ctx               context.Context
 }
 
 type RelayValidatorContract struct {
-	// Contract binding would go here
 	address common.Address
+	bound   *bind.BoundContract
+	txs     *txManager
 }
 
-func NewNode(privateKey *ecdsa.PrivateKey, cfg *config.Config) *Node {
-	address := crypto.PubkeyToAddress(privateKey.PublicKey)
+// SignatureBroadcaster shares this node's signatures with other validators
+type SignatureBroadcaster interface {
+	BroadcastSignature(chainID int64, requestID uint64, messageHash, signature string) error
+}
+
+func NewNode(signer keys.Signer, cfg *config.Config) *Node {
+	address := signer.Address()
 	
-	return &Node{
-		privateKey:         privateKey,
+	n := &Node{
+		signer:             signer,
 		address:            address,
 		config:             cfg,
 		pendingValidations: make(map[uint64]*ValidationRequest),
-		signatures:         make(map[uint64]map[string]string),
+		events:             newEventHub(),
+		registration:       Registration{Status: RegistrationUnregistered, Stake: "0"},
 		status:             "starting",
 	}
+	n.aggregator = NewAggregator(n.submitQuorum)
+	n.aggregator.SetChain(cfg.ChainID)
+	n.aggregator.OnShare(func(requestID uint64, signer common.Address) {
+		n.publishEvent(EventSignature, requestID, signer.Hex(), "", n.requiredSignatures(requestID))
+	})
+	return n
+}
+
+// SetNetwork sets where this node's signature shares are broadcast
+func (n *Node) SetNetwork(network SignatureBroadcaster) {
+	n.network = network
+}
+
+// SetStore sets where in-flight validations are persisted
+func (n *Node) SetStore(store *Store) {
+	n.store = store
+}
+
+// Restore reloads persisted validations after a restart. Collected shares are
+// verified again, requests this node had not signed yet are signed, and
+// requests whose deadline passed while the node was down are cleaned up.
+func (n *Node) Restore() error {
+	if n.store == nil {
+		return nil
+	}
+
+	requests, err := n.store.LoadRequests()
+	if err != nil {
+		return fmt.Errorf("failed to load validation requests: %w", err)
+	}
+
+	now := time.Now()
+	for _, req := range requests {
+		signatures, err := n.store.LoadSignatures(req.ID)
+		if err != nil {
+			return fmt.Errorf("failed to load signatures for request %d: %w", req.ID, err)
+		}
+
+		n.mutex.Lock()
+		n.pendingValidations[req.ID] = req
+		n.mutex.Unlock()
+
+		n.aggregator.Track(req.ID, common.HexToHash(req.MessageHash), req.RequiredSigs)
+		for signer, signature := range signatures {
+			if err := n.aggregator.Add(req.ID, signer, signature); err != nil {
+				log.Printf("Discarding stored signature from %s for request %d: %v", signer.Hex(), req.ID, err)
+			}
+		}
+
+		if _, signed := signatures[n.address]; !signed && now.Before(req.Deadline) {
+			go n.signValidationRequest(req)
+		}
+	}
+
+	n.cleanupExpiredRequests()
+	log.Printf("Restored %d validation requests", n.GetPendingValidationCount())
+	return nil
+}
+
+// forgetRequest deletes a finished request from the store
+func (n *Node) forgetRequest(requestID uint64) {
+	if n.store == nil {
+		return
+	}
+	if err := n.store.DeleteRequest(requestID); err != nil {
+		log.Printf("Failed to delete stored validation request %d: %v", requestID, err)
+	}
+}
+
+// saveSignature persists a share for a request this node is tracking
+func (n *Node) saveSignature(requestID uint64, signer common.Address, signature []byte) {
+	if n.store == nil {
+		return
+	}
+
+	n.mutex.RLock()
+	_, tracked := n.pendingValidations[requestID]
+	n.mutex.RUnlock()
+	if !tracked {
+		return
+	}
+
+	if err := n.store.SaveSignature(requestID, signer, signature); err != nil {
+		log.Printf("Failed to persist signature for request %d: %v", requestID, err)
+	}
+}
+
+// SetSlashingWatcher sets the watcher that checks shares for misbehavior
+func (n *Node) SetSlashingWatcher(watcher *slashing.Watcher) {
+	n.slashing = watcher
 }
 
 func (n *Node) Start(ctx context.Context) error {
@@ -75,10 +185,18 @@ func (n *Node) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to connect to Ethereum client: %w", err)
 	}
 	n.client = client
+	n.ctx = ctx
+
+	if common.IsHexAddress(n.config.ContractAddress) {
+		n.contract = newRelayValidatorContract(common.HexToAddress(n.config.ContractAddress), client)
+		n.contract.txs = newTxManager(client, n.address, n.chainLabel(), n.gasPolicy())
+		go n.contract.txs.monitor(ctx, time.Duration(n.config.Transactions.CheckIntervalSeconds)*time.Second)
+		n.coordinator = newCoordinator(n.contract, n.signer, n.config.ChainID, time.Duration(n.config.Validation.SubmissionSlotSeconds)*time.Second)
+	} else {
+		log.Println("Warning: CONTRACT_ADDRESS not set, signatures will not be submitted on-chain")
+	}
 
-	contractAddr := common.HexToAddress(n.config.ContractAddress)
-	n.contract = &RelayValidatorContract{address: contractAddr}
-
+	n.restoreRegistration()
 	if err := n.checkRegistration(ctx); err != nil {
 		log.Printf("Warning: Could not check registration status: %v", err)
 	}
@@ -92,47 +210,83 @@ func (n *Node) Start(ctx context.Context) error {
 	return nil
 }
 
-func (n *Node) RegisterValidator(ctx context.Context, stakeAmount *big.Int) error {
-	if n.isRegistered {
-		return fmt.Errorf("validator already registered")
-	}
-
-	auth, err := bind.NewKeyedTransactorWithChainID(n.privateKey, big.NewInt(n.config.ChainID))
-	if err != nil {
-		return fmt.Errorf("failed to create transactor: %w", err)
+func (n *Node) ProcessValidationRequest(msg *p2p.ValidationMessage) error {
+	requiredSigs := msg.RequiredSigs
+	if requiredSigs <= 0 {
+		requiredSigs = 2 // Default required signatures
 	}
 
-	auth.Value = stakeAmount
-	auth.GasLimit = uint64(300000)
+	// Convert ValidationMessage to ValidationRequest for internal processing
+	return n.addValidationRequest(&ValidationRequest{
+		ID:           msg.RequestID,
+		PaymentID:    msg.PaymentID,
+		MessageHash:  msg.MessageHash,
+		RequiredSigs: requiredSigs,
+		Deadline:     msg.Timestamp.Add(5 * time.Minute), // Set reasonable deadline
+		IsHighValue:  false,                              // Can be determined based on amount if needed
+	})
+}
 
-	log.Printf("Registering validator with stake: %s ETH", stakeAmount.String())
-	
-	n.isRegistered = true
-	n.stake = stakeAmount
-	
-	return nil
+// ProcessBatch handles validation requests picked up from the chain
+func (n *Node) ProcessBatch(reqs []*batch.ValidationRequest) []batch.ValidationResult {
+	results := make([]batch.ValidationResult, len(reqs))
+	for i, req := range reqs {
+		err := n.addValidationRequest(&ValidationRequest{
+			ID:           req.ID,
+			PaymentID:    req.PaymentID,
+			MessageHash:  req.MessageHash,
+			RequiredSigs: req.RequiredSigs,
+			Deadline:     req.Deadline,
+			IsHighValue:  req.IsHighValue,
+		})
+
+		results[i] = batch.ValidationResult{RequestID: req.ID, Success: err == nil}
+		if err != nil {
+			results[i].Error = err.Error()
+			log.Printf("Failed to process on-chain validation request %d: %v", req.ID, err)
+		}
+	}
+	return results
 }
 
-func (n *Node) ProcessValidationRequest(msg *p2p.ValidationMessage) error {
+// RevertValidationRequests drops requests whose on-chain events were removed
+// by a reorg
+func (n *Node) RevertValidationRequests(requestIDs []uint64) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
-	if _, exists := n.pendingValidations[msg.RequestID]; exists {
-		return fmt.Errorf("validation request %d already exists", msg.RequestID)
+	for _, id := range requestIDs {
+		if req, exists := n.pendingValidations[id]; exists {
+			n.publishEvent(EventReverted, id, "", "", req.RequiredSigs)
+		}
+		delete(n.pendingValidations, id)
+		n.aggregator.Remove(id)
+		n.forgetRequest(id)
+		log.Printf("Reverted validation request %d after chain reorg", id)
 	}
+}
 
-	// Convert ValidationMessage to ValidationRequest for internal processing
-	req := &ValidationRequest{
-		ID:          msg.RequestID,
-		PaymentID:   msg.PaymentID,
-		MessageHash: msg.MessageHash,
-		RequiredSigs: 2, // Default required signatures
-		Deadline:    msg.Timestamp.Add(5 * time.Minute), // Set reasonable deadline
-		IsHighValue: false, // Can be determined based on amount if needed
+func (n *Node) addValidationRequest(req *ValidationRequest) error {
+	messageHash, err := hexutil.Decode(req.MessageHash)
+	if err != nil || len(messageHash) != common.HashLength {
+		return fmt.Errorf("invalid message hash for request %d", req.ID)
 	}
 
+	n.mutex.Lock()
+	if _, exists := n.pendingValidations[req.ID]; exists {
+		n.mutex.Unlock()
+		return fmt.Errorf("validation request %d already exists", req.ID)
+	}
 	n.pendingValidations[req.ID] = req
-	n.signatures[req.ID] = make(map[string]string)
+	n.mutex.Unlock()
+
+	if n.store != nil {
+		if err := n.store.SaveRequest(req); err != nil {
+			log.Printf("Failed to persist validation request %d: %v", req.ID, err)
+		}
+	}
+
+	n.aggregator.Track(req.ID, common.BytesToHash(messageHash), req.RequiredSigs)
 
 	log.Printf("Processing validation request %d for payment %d", req.ID, req.PaymentID)
 
@@ -141,43 +295,153 @@ func (n *Node) ProcessValidationRequest(msg *p2p.ValidationMessage) error {
 	return nil
 }
 
-func (n *Node) signValidationRequest(req *ValidationRequest) {
-	messageHashBytes, err := hex.DecodeString(req.MessageHash[2:]) // Remove 0x prefix
+// ProcessSignatureShare records a share gossiped by another validator
+func (n *Node) ProcessSignatureShare(msg *p2p.ValidationMessage) error {
+	if !common.IsHexAddress(msg.Signer) {
+		return fmt.Errorf("invalid signer %q for request %d", msg.Signer, msg.RequestID)
+	}
+	signature, err := hexutil.Decode(msg.Signature)
 	if err != nil {
-		log.Printf("Failed to decode message hash for request %d: %v", req.ID, err)
-		return
+		return fmt.Errorf("%w for request %d: %v", p2p.ErrInvalidSignature, msg.RequestID, err)
+	}
+	signer := common.HexToAddress(msg.Signer)
+
+	if n.slashing != nil && msg.MessageHash != "" {
+		signed := common.HexToHash(msg.MessageHash)
+		// Only shares that really are the signer's signature are evidence
+		if VerifyShare(signed, signer, signature) == nil {
+			var expected common.Hash
+			n.mutex.RLock()
+			if req, exists := n.pendingValidations[msg.RequestID]; exists {
+				expected = common.HexToHash(req.MessageHash)
+			}
+			n.mutex.RUnlock()
+
+			n.slashing.ObserveShare(msg.RequestID, expected, signer, signed, signature)
+		}
 	}
 
-	signature, err := crypto.Sign(messageHashBytes, n.privateKey)
+	if err := n.aggregator.Add(msg.RequestID, signer, signature); err != nil {
+		if errors.Is(err, errDuplicateShare) {
+			metrics.SignatureShares.Inc(n.chainLabel(), "duplicate")
+		} else {
+			metrics.SignatureShares.Inc(n.chainLabel(), "invalid")
+		}
+		return err
+	}
+	metrics.SignatureShares.Inc(n.chainLabel(), "accepted")
+	n.saveSignature(msg.RequestID, signer, signature)
+	return nil
+}
+
+func (n *Node) signValidationRequest(req *ValidationRequest) {
+	signature, err := SignShare(common.HexToHash(req.MessageHash), n.signer)
 	if err != nil {
 		log.Printf("Failed to sign message for request %d: %v", req.ID, err)
 		return
 	}
 
-	signatureHex := "0x" + hex.EncodeToString(signature)
-	
-	n.mutex.Lock()
-	n.signatures[req.ID][n.address.Hex()] = signatureHex
-	n.mutex.Unlock()
+	signatureHex := hexutil.Encode(signature)
+	if err := n.aggregator.Add(req.ID, n.address, signature); err != nil {
+		log.Printf("Failed to record own signature for request %d: %v", req.ID, err)
+		return
+	}
+	n.saveSignature(req.ID, n.address, signature)
+	go n.reportSignature(req.ID, req.PaymentID, req.RequiredSigs, "signed", "")
 
 	log.Printf("Signed validation request %d with signature: %s", req.ID, signatureHex[:10]+"...")
 
-	if err := n.submitSignatureToContract(req.ID, signature); err != nil {
-		log.Printf("Failed to submit signature to contract: %v", err)
+	if n.network != nil {
+		if err := n.network.BroadcastSignature(n.config.ChainID, req.ID, req.MessageHash, signatureHex); err != nil {
+			log.Printf("Failed to broadcast signature for request %d: %v", req.ID, err)
+		}
 	}
 }
 
-func (n *Node) submitSignatureToContract(requestID uint64, signature []byte) error {
-	auth, err := bind.NewKeyedTransactorWithChainID(n.privateKey, big.NewInt(n.config.ChainID))
-	if err != nil {
-		return fmt.Errorf("failed to create transactor: %w", err)
+// submitQuorum runs once a request collects its required shares. Waiting for
+// the off-chain quorum avoids paying gas on requests that never reach it, and
+// only the request's coordinator submits the aggregate unless it misses its
+// slot.
+func (n *Node) submitQuorum(quorum *Quorum) {
+	log.Printf("Validation request %d reached quorum with %d signatures", quorum.RequestID, len(quorum.Signers))
+	n.publishEvent(EventQuorum, quorum.RequestID, "", "", len(quorum.Signers))
+
+	n.mutex.RLock()
+	req, exists := n.pendingValidations[quorum.RequestID]
+	submitted := exists && req.Submitted
+	var deadline time.Time
+	if exists {
+		deadline = req.Deadline
+	}
+	n.mutex.RUnlock()
+	if submitted {
+		return
 	}
 
-	auth.GasLimit = uint64(200000)
+	if n.coordinator == nil {
+		log.Printf("No RelayValidator contract configured, skipping submission for request %d", quorum.RequestID)
+		return
+	}
+	go n.submitAggregate(quorum, deadline)
+}
 
-	log.Printf("Submitting signature for request %d to contract", requestID)
-	
-	return nil
+// submitAggregate submits a quorum through the coordinator, giving up at the
+// request's deadline
+func (n *Node) submitAggregate(quorum *Quorum, deadline time.Time) {
+	ctx := n.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if deadline.IsZero() {
+		deadline = time.Now().Add(time.Duration(n.config.Validation.TimeoutSeconds) * time.Second)
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	rank, txHash, err := n.coordinator.submit(ctx, quorum)
+	switch {
+	case errors.Is(err, errNotCoordinator):
+		return
+	case errors.Is(err, errRequestCompleted):
+		log.Printf("Request %d was completed by a coordinator ranked ahead of this node", quorum.RequestID)
+		metrics.QuorumSubmissions.Inc(n.chainLabel(), "skipped")
+		n.markSubmitted(quorum.RequestID, "", "")
+		return
+	case err != nil:
+		log.Printf("Failed to submit aggregate for request %d at coordinator rank %d: %v", quorum.RequestID, rank, err)
+		metrics.QuorumSubmissions.Inc(n.chainLabel(), "failed")
+		return
+	}
+
+	log.Printf("Submitted aggregate for request %d as coordinator rank %d in tx %s", quorum.RequestID, rank, txHash.Hex())
+	metrics.QuorumSubmissions.Inc(n.chainLabel(), "submitted")
+	if rank > 0 {
+		metrics.CoordinatorTakeovers.Inc(n.chainLabel())
+	}
+	n.markSubmitted(quorum.RequestID, n.address.Hex(), txHash.Hex())
+}
+
+// markSubmitted records that a request's aggregate is on-chain, submitted by
+// submitter in txHash when this node knows them
+func (n *Node) markSubmitted(requestID uint64, submitter, txHash string) {
+	n.mutex.Lock()
+	required := 0
+	var paymentID uint64
+	if req, exists := n.pendingValidations[requestID]; exists {
+		req.Submitted = true
+		required = req.RequiredSigs
+		paymentID = req.PaymentID
+	}
+	n.mutex.Unlock()
+	n.publishEvent(EventSubmitted, requestID, submitter, txHash, required)
+	if submitter == n.address.Hex() {
+		go n.reportSignature(requestID, paymentID, required, "submitted", txHash)
+	}
+	if n.store != nil {
+		if err := n.store.MarkSubmitted(requestID); err != nil {
+			log.Printf("Failed to persist submission of request %d: %v", requestID, err)
+		}
+	}
 }
 
 func (n *Node) GetValidationStatus(requestID uint64) (*ValidationRequest, bool) {
@@ -189,14 +453,29 @@ func (n *Node) GetValidationStatus(requestID uint64) (*ValidationRequest, bool)
 }
 
 func (n *Node) GetSignatures(requestID uint64) map[string]string {
-	n.mutex.RLock()
-	defer n.mutex.RUnlock()
-	
-	sigs := make(map[string]string)
-	for addr, sig := range n.signatures[requestID] {
-		sigs[addr] = sig
+	return n.aggregator.Signatures(requestID)
+}
+
+// SlashValidator reports a validator to the RelayValidator contract
+func (n *Node) SlashValidator(ctx context.Context, validator common.Address, reason string) (common.Hash, error) {
+	if n.contract == nil || n.contract.bound == nil {
+		return common.Hash{}, fmt.Errorf("no RelayValidator contract configured")
+	}
+	return n.contract.SlashValidator(ctx, n.signer, n.config.ChainID, validator, reason)
+}
+
+// ActiveValidators reads the active validator set from the RelayValidator
+// contract
+func (n *Node) ActiveValidators(ctx context.Context) ([]common.Address, error) {
+	if n.contract == nil || n.contract.bound == nil {
+		return nil, fmt.Errorf("no RelayValidator contract configured")
 	}
-	return sigs
+	return n.contract.ActiveValidators(ctx)
+}
+
+// GetQuorum returns the signature bundle for a request that reached quorum
+func (n *Node) GetQuorum(requestID uint64) (*Quorum, bool) {
+	return n.aggregator.Quorum(requestID)
 }
 
 func (n *Node) monitorValidationRequests(ctx context.Context) {
@@ -209,6 +488,7 @@ func (n *Node) monitorValidationRequests(ctx context.Context) {
 			return
 		case <-ticker.C:
 			n.cleanupExpiredRequests()
+			n.aggregator.Prune(time.Now().Add(-10 * time.Minute))
 		}
 	}
 }
@@ -220,8 +500,17 @@ func (n *Node) cleanupExpiredRequests() {
 	now := time.Now()
 	for id, req := range n.pendingValidations {
 		if now.After(req.Deadline) {
+			if n.slashing != nil {
+				signers := make([]common.Address, 0)
+				for signer := range n.aggregator.Signatures(id) {
+					signers = append(signers, common.HexToAddress(signer))
+				}
+				n.slashing.ObserveRound(id, signers)
+			}
+			n.publishEvent(EventExpired, id, "", "", req.RequiredSigs)
 			delete(n.pendingValidations, id)
-			delete(n.signatures, id)
+			n.aggregator.Remove(id)
+			n.forgetRequest(id)
 			log.Printf("Cleaned up expired validation request %d", id)
 		}
 	}
@@ -231,28 +520,69 @@ func (n *Node) performHealthCheck(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
+	reportInterval := time.Duration(n.config.Analytics.ReportIntervalSeconds) * time.Second
+	if reportInterval <= 0 {
+		reportInterval = time.Minute
+	}
+	reportTicker := time.NewTicker(reportInterval)
+	defer reportTicker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
 			if n.client != nil {
+				start := time.Now()
 				if _, err := n.client.BlockNumber(ctx); err != nil {
 					log.Printf("Health check failed: %v", err)
 					n.status = "unhealthy"
 				} else {
 					n.status = "healthy"
+					n.mutex.Lock()
+					n.responseTime = time.Since(start)
+					n.mutex.Unlock()
+				}
+				if err := n.checkRegistration(ctx); err != nil {
+					log.Printf("Failed to check registration: %v", err)
 				}
 			}
+		case <-reportTicker.C:
+			n.reportStatus()
 		}
 	}
 }
 
-func (n *Node) checkRegistration(ctx context.Context) error {
-	log.Printf("Checking validator registration status for %s", n.address.Hex())
-	
-	n.isRegistered = false
-	return nil
+// ChainID returns the chain this node validates for
+func (n *Node) ChainID() int64 {
+	return n.config.ChainID
+}
+
+// gasPolicy is the replacement policy for this chain's stuck transactions
+func (n *Node) gasPolicy() gasPolicy {
+	txCfg := n.config.Transactions
+	policy := gasPolicy{
+		stuckAfter:  time.Duration(txCfg.StuckAfterSeconds) * time.Second,
+		bumpPercent: int64(txCfg.GasBumpPercent),
+	}
+	if txCfg.MaxGasPriceGwei > 0 {
+		policy.maxGasPrice = new(big.Int).Mul(big.NewInt(int64(txCfg.MaxGasPriceGwei)), big.NewInt(1e9))
+	}
+	return policy
+}
+
+// PendingTransactions returns the transactions this node sent on its chain
+// that have not been mined, in nonce order
+func (n *Node) PendingTransactions() []PendingTransaction {
+	if n.contract == nil || n.contract.txs == nil {
+		return []PendingTransaction{}
+	}
+	return n.contract.txs.transactions()
+}
+
+// chainLabel is the chain ID as a metric label
+func (n *Node) chainLabel() string {
+	return strconv.FormatInt(n.config.ChainID, 10)
 }
 
 func (n *Node) GetAddress() string {
@@ -264,14 +594,11 @@ func (n *Node) GetStatus() string {
 }
 
 func (n *Node) GetStake() string {
-	if n.stake == nil {
-		return "0"
-	}
-	return n.stake.String()
+	return n.GetRegistration().Stake
 }
 
 func (n *Node) IsRegistered() bool {
-	return n.isRegistered
+	return n.GetRegistration().Status == RegistrationActive
 }
 
 func (n *Node) GetPendingValidationCount() int {
@@ -0,0 +1,390 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/analytics"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// A registration moves from unregistered to pending while the stake deposit
+// is mined, to active once the receipt carries the contract's
+// ValidatorRegistered event, to exiting while exitValidator is mined and to
+// unbonding once the receipt carries ValidatorExited. The contract returns
+// the stake in the exit transaction, so unbonding is tracked by the node: it
+// refuses to register again until the unbonding period has passed, leaving
+// time for evidence against its last requests to be reviewed.
+
+const (
+	RegistrationUnregistered = "unregistered"
+	RegistrationPending      = "pending"
+	RegistrationActive       = "active"
+	RegistrationExiting      = "exiting"
+	RegistrationUnbonding    = "unbonding"
+)
+
+var (
+	ErrNoContract          = errors.New("no RelayValidator contract configured")
+	ErrAlreadyRegistered   = errors.New("validator already registered")
+	ErrNotRegistered       = errors.New("validator not registered")
+	ErrRegistrationPending = errors.New("registration transaction still pending")
+	ErrUnbonding           = errors.New("validator is still unbonding")
+	ErrInsufficientStake   = errors.New("stake is below the contract minimum")
+)
+
+// Registration is this validator's standing with the RelayValidator contract
+type Registration struct {
+	Status        string    `json:"status"`
+	Stake         string    `json:"stake"`
+	TxHash        string    `json:"tx_hash,omitempty"`
+	RegisteredAt  time.Time `json:"registered_at,omitzero"`
+	ExitedAt      time.Time `json:"exited_at,omitzero"`
+	UnbondingEnds time.Time `json:"unbonding_ends,omitzero"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// StatusReporter receives this validator's status whenever it changes and
+// on every health check, and each share it signs and aggregate it submits
+type StatusReporter interface {
+	ReportValidator(ctx context.Context, metric analytics.ValidatorMetric) error
+	ReportSignature(ctx context.Context, metric analytics.SignatureMetric) error
+}
+
+// SetReporter sets where validator status is reported
+func (n *Node) SetReporter(reporter StatusReporter) {
+	n.reporter = reporter
+}
+
+// RegisterValidator sends the stake deposit and returns its transaction
+// hash. The registration becomes active once the transaction is confirmed.
+func (n *Node) RegisterValidator(ctx context.Context, stake *big.Int) (common.Hash, error) {
+	if n.contract == nil || n.contract.bound == nil {
+		return common.Hash{}, ErrNoContract
+	}
+	blsKey, err := parseBLSPublicKey(n.config.Registration.BLSPublicKey)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	minStake, err := n.contract.MinStake(ctx)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to read minimum stake: %w", err)
+	}
+	if stake.Cmp(minStake) < 0 {
+		return common.Hash{}, fmt.Errorf("%w: %s wei required", ErrInsufficientStake, minStake)
+	}
+
+	previous, err := n.beginTransition(RegistrationPending, func(reg Registration) error {
+		switch reg.Status {
+		case RegistrationActive:
+			return ErrAlreadyRegistered
+		case RegistrationPending, RegistrationExiting:
+			return ErrRegistrationPending
+		case RegistrationUnbonding:
+			return fmt.Errorf("%w until %s", ErrUnbonding, reg.UnbondingEnds.Format(time.RFC3339))
+		}
+		return nil
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	log.Printf("Registering validator with stake: %s wei", stake)
+	txHash, err := n.contract.RegisterValidator(ctx, n.signer, n.config.ChainID, stake, blsKey)
+	if err != nil {
+		n.setRegistration(previous)
+		return common.Hash{}, fmt.Errorf("failed to send registration: %w", err)
+	}
+
+	n.setRegistration(Registration{Status: RegistrationPending, Stake: stake.String(), TxHash: txHash.Hex()})
+	go n.confirmRegistration(txHash)
+	return txHash, nil
+}
+
+// DeregisterValidator sends the exit transaction and returns its hash. The
+// node starts unbonding once the transaction is confirmed.
+func (n *Node) DeregisterValidator(ctx context.Context) (common.Hash, error) {
+	if n.contract == nil || n.contract.bound == nil {
+		return common.Hash{}, ErrNoContract
+	}
+
+	previous, err := n.beginTransition(RegistrationExiting, func(reg Registration) error {
+		switch reg.Status {
+		case RegistrationPending, RegistrationExiting:
+			return ErrRegistrationPending
+		case RegistrationActive:
+			return nil
+		}
+		return ErrNotRegistered
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	log.Printf("Deregistering validator %s", n.address.Hex())
+	txHash, err := n.contract.ExitValidator(ctx, n.signer, n.config.ChainID)
+	if err != nil {
+		n.setRegistration(previous)
+		return common.Hash{}, fmt.Errorf("failed to send exit: %w", err)
+	}
+
+	reg := previous
+	reg.Status = RegistrationExiting
+	reg.TxHash = txHash.Hex()
+	reg.Error = ""
+	n.setRegistration(reg)
+	go n.confirmExit(txHash)
+	return txHash, nil
+}
+
+// beginTransition moves the registration to status if allowed accepts its
+// current state, so a second request cannot race the first. It returns the
+// state to restore if the transaction cannot be sent.
+func (n *Node) beginTransition(status string, allowed func(Registration) error) (Registration, error) {
+	n.registrationMutex.Lock()
+	defer n.registrationMutex.Unlock()
+
+	previous := n.registration
+	if previous.Status == RegistrationUnbonding && !time.Now().Before(previous.UnbondingEnds) {
+		previous = Registration{Status: RegistrationUnregistered, Stake: "0"}
+	}
+	if err := allowed(previous); err != nil {
+		return previous, err
+	}
+	n.registration.Status = status
+	return previous, nil
+}
+
+func (n *Node) confirmRegistration(txHash common.Hash) {
+	receipt, err := n.waitReceipt(txHash)
+	if err != nil {
+		log.Printf("Registration tx %s not confirmed: %v", txHash.Hex(), err)
+		return
+	}
+
+	stake, err := n.contract.stakeEvent(receipt, "ValidatorRegistered", n.address)
+	if err != nil {
+		log.Printf("Registration failed: %v", err)
+		n.setRegistration(Registration{Status: RegistrationUnregistered, Stake: "0", TxHash: txHash.Hex(), Error: err.Error()})
+		return
+	}
+
+	log.Printf("Validator registered with stake %s wei in tx %s", stake, receipt.TxHash.Hex())
+	n.setRegistration(Registration{Status: RegistrationActive, Stake: stake.String(), TxHash: receipt.TxHash.Hex(), RegisteredAt: time.Now()})
+}
+
+func (n *Node) confirmExit(txHash common.Hash) {
+	receipt, err := n.waitReceipt(txHash)
+	if err != nil {
+		log.Printf("Exit tx %s not confirmed: %v", txHash.Hex(), err)
+		return
+	}
+
+	reg := n.GetRegistration()
+	returned, err := n.contract.stakeEvent(receipt, "ValidatorExited", n.address)
+	if err != nil {
+		log.Printf("Exit failed: %v", err)
+		reg.Status = RegistrationActive
+		reg.Error = err.Error()
+		n.setRegistration(reg)
+		return
+	}
+
+	now := time.Now()
+	reg.Status = RegistrationUnbonding
+	reg.Stake = "0"
+	reg.ExitedAt = now
+	reg.UnbondingEnds = now.Add(time.Duration(n.config.Registration.UnbondingHours) * time.Hour)
+	reg.Error = ""
+	log.Printf("Validator exited with %s wei returned, unbonding until %s", returned, reg.UnbondingEnds.Format(time.RFC3339))
+	n.setRegistration(reg)
+}
+
+// waitReceipt waits for a transaction, or the replacement the transaction
+// manager sent for it, to be mined. A reverted transaction is returned with
+// its receipt and left to the event check to reject.
+func (n *Node) waitReceipt(txHash common.Hash) (*types.Receipt, error) {
+	ctx := n.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	if n.contract != nil && n.contract.txs != nil {
+		return n.contract.txs.waitMined(ctx, txHash)
+	}
+	return bind.WaitMinedHash(ctx, n.client, txHash)
+}
+
+// checkRegistration reconciles the saved registration with the contract. A
+// transaction left pending by a restart is awaited again, an unbonding period
+// that has passed ends, and a stake deposited or withdrawn outside the node
+// is picked up.
+func (n *Node) checkRegistration(ctx context.Context) error {
+	reg := n.GetRegistration()
+	if reg.Status == RegistrationUnbonding && !time.Now().Before(reg.UnbondingEnds) {
+		log.Printf("Unbonding period for %s has ended", n.address.Hex())
+		reg = Registration{Status: RegistrationUnregistered, Stake: "0"}
+		n.setRegistration(reg)
+	}
+	if n.contract == nil || n.contract.bound == nil {
+		return nil
+	}
+
+	stake, err := n.contract.Stake(ctx, n.address)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case reg.Status == RegistrationPending || reg.Status == RegistrationExiting:
+		return nil
+	case stake.Sign() > 0 && (reg.Status != RegistrationActive || reg.Stake != stake.String()):
+		reg.Status = RegistrationActive
+		reg.Stake = stake.String()
+		if reg.RegisteredAt.IsZero() {
+			reg.RegisteredAt = time.Now()
+		}
+		n.setRegistration(reg)
+	case stake.Sign() == 0 && reg.Status == RegistrationActive:
+		log.Printf("Contract holds no stake for %s, marking it unregistered", n.address.Hex())
+		n.setRegistration(Registration{Status: RegistrationUnregistered, Stake: "0"})
+	}
+	return nil
+}
+
+// restoreRegistration loads the saved registration and resumes waiting for
+// any transaction that was still pending when the node stopped
+func (n *Node) restoreRegistration() {
+	if n.store != nil {
+		reg, err := n.store.LoadRegistration(n.address)
+		if err != nil {
+			log.Printf("Failed to load registration: %v", err)
+		} else if reg != nil {
+			n.registrationMutex.Lock()
+			n.registration = *reg
+			n.registrationMutex.Unlock()
+		}
+	}
+	if n.contract == nil || n.contract.bound == nil {
+		return
+	}
+
+	reg := n.GetRegistration()
+	if reg.TxHash == "" {
+		return
+	}
+	switch reg.Status {
+	case RegistrationPending:
+		go n.confirmRegistration(common.HexToHash(reg.TxHash))
+	case RegistrationExiting:
+		go n.confirmExit(common.HexToHash(reg.TxHash))
+	}
+}
+
+// setRegistration replaces the registration, persists it and reports the
+// change
+func (n *Node) setRegistration(reg Registration) {
+	n.registrationMutex.Lock()
+	n.registration = reg
+	n.registrationMutex.Unlock()
+
+	if n.store != nil {
+		if err := n.store.SaveRegistration(n.address, &reg); err != nil {
+			log.Printf("Failed to persist registration: %v", err)
+		}
+	}
+	go n.reportStatus()
+}
+
+// GetRegistration returns a copy of the current registration
+func (n *Node) GetRegistration() Registration {
+	n.registrationMutex.Lock()
+	defer n.registrationMutex.Unlock()
+	return n.registration
+}
+
+// reportStatus sends the registration status, stake and last RPC response
+// time to the analytics service
+func (n *Node) reportStatus() {
+	if n.reporter == nil {
+		return
+	}
+
+	reg := n.GetRegistration()
+	n.mutex.RLock()
+	responseTime := n.responseTime
+	n.mutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := n.reporter.ReportValidator(ctx, analytics.ValidatorMetric{
+		ValidatorAddr: n.address.Hex(),
+		ChainID:       uint64(n.config.ChainID),
+		Stake:         reg.Stake,
+		Status:        reg.Status,
+		ResponseTime:  responseTime.Milliseconds(),
+		Timestamp:     time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to report validator status: %v", err)
+	}
+}
+
+// reportSignature sends a share this node signed, or an aggregate it
+// submitted, to the analytics service, timed from when the request was
+// tracked so analytics can tell how quickly each validator contributes
+func (n *Node) reportSignature(requestID, paymentID uint64, required int, event, txHash string) {
+	if n.reporter == nil {
+		return
+	}
+
+	now := time.Now()
+	var latency time.Duration
+	if trackedAt, ok := n.aggregator.TrackedAt(requestID); ok {
+		latency = now.Sub(trackedAt)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := n.reporter.ReportSignature(ctx, analytics.SignatureMetric{
+		RequestID:     requestID,
+		PaymentID:     paymentID,
+		ChainID:       uint64(n.config.ChainID),
+		ValidatorAddr: n.address.Hex(),
+		Event:         event,
+		Signatures:    uint32(len(n.aggregator.Signatures(requestID))),
+		RequiredSigs:  uint32(required),
+		LatencyMs:     latency.Milliseconds(),
+		TxHash:        txHash,
+		Timestamp:     now,
+	})
+	if err != nil {
+		log.Printf("Failed to report signature for request %d: %v", requestID, err)
+	}
+}
+
+// parseBLSPublicKey reads the four uint256 limbs of a G2 public key, in
+// decimal or 0x-prefixed hex
+func parseBLSPublicKey(value string) ([4]*big.Int, error) {
+	var key [4]*big.Int
+	parts := strings.Split(value, ",")
+	if strings.TrimSpace(value) == "" || len(parts) != 4 {
+		return key, errors.New("VALIDATOR_BLS_PUBLIC_KEY must hold four comma-separated uint256 values")
+	}
+	for i, part := range parts {
+		limb, ok := new(big.Int).SetString(strings.TrimSpace(part), 0)
+		if !ok || limb.Sign() < 0 || limb.BitLen() > 256 {
+			return key, fmt.Errorf("invalid BLS public key value %q", part)
+		}
+		key[i] = limb
+	}
+	return key, nil
+}
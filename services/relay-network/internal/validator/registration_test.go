@@ -0,0 +1,177 @@
+package validator
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/analytics"
+	"github.com/crosspay/relay-network/internal/database"
+	"github.com/crosspay/relay-network/internal/p2p"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingReporter struct {
+	metrics    chan analytics.ValidatorMetric
+	signatures chan analytics.SignatureMetric
+}
+
+func (r *recordingReporter) ReportValidator(ctx context.Context, metric analytics.ValidatorMetric) error {
+	if r.metrics != nil {
+		r.metrics <- metric
+	}
+	return nil
+}
+
+func (r *recordingReporter) ReportSignature(ctx context.Context, metric analytics.SignatureMetric) error {
+	if r.signatures != nil {
+		r.signatures <- metric
+	}
+	return nil
+}
+
+func stakeLog(contract common.Address, event string, validator common.Address, amount *big.Int) *types.Log {
+	data, err := parsedRelayValidatorABI.Events[event].Inputs.NonIndexed().Pack(amount)
+	if err != nil {
+		panic(err)
+	}
+	return &types.Log{
+		Address: contract,
+		Topics:  []common.Hash{parsedRelayValidatorABI.Events[event].ID, common.BytesToHash(validator.Bytes())},
+		Data:    data,
+	}
+}
+
+func TestRegistrationEvents(t *testing.T) {
+	contractAddr := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	contract := newRelayValidatorContract(contractAddr, nil)
+	validator := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	other := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	stake := new(big.Int).Mul(big.NewInt(10), big.NewInt(1e18))
+
+	t.Run("should read the stake from this validator's event", func(t *testing.T) {
+		receipt := &types.Receipt{Logs: []*types.Log{
+			stakeLog(contractAddr, "ValidatorRegistered", other, big.NewInt(1)),
+			stakeLog(contractAddr, "ValidatorRegistered", validator, stake),
+		}}
+		got, err := contract.stakeEvent(receipt, "ValidatorRegistered", validator)
+		require.NoError(t, err)
+		assert.Equal(t, stake, got)
+
+		receipt = &types.Receipt{Logs: []*types.Log{stakeLog(contractAddr, "ValidatorExited", validator, stake)}}
+		got, err = contract.stakeEvent(receipt, "ValidatorExited", validator)
+		require.NoError(t, err)
+		assert.Equal(t, stake, got)
+	})
+
+	t.Run("should reject receipts without a matching event", func(t *testing.T) {
+		receipts := []*types.Receipt{
+			{},
+			{Logs: []*types.Log{stakeLog(contractAddr, "ValidatorExited", validator, stake)}},
+			{Logs: []*types.Log{stakeLog(common.HexToAddress("0xbb"), "ValidatorRegistered", validator, stake)}},
+		}
+		for _, receipt := range receipts {
+			_, err := contract.stakeEvent(receipt, "ValidatorRegistered", validator)
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestParseBLSPublicKey(t *testing.T) {
+	key, err := parseBLSPublicKey("1, 0x02,3,4")
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(2), key[1])
+
+	for _, value := range []string{"", "1,2,3", "1,2,3,x", "1,2,3,-4"} {
+		_, err := parseBLSPublicKey(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRegistrationLifecycle(t *testing.T) {
+	db, err := database.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	t.Run("should persist the registration and report changes", func(t *testing.T) {
+		node := newStoredNode(t, db)
+		reporter := &recordingReporter{metrics: make(chan analytics.ValidatorMetric, 4)}
+		node.SetReporter(reporter)
+
+		reg := Registration{Status: RegistrationActive, Stake: "10", TxHash: "0x01", RegisteredAt: time.Unix(1700000000, 0)}
+		node.setRegistration(reg)
+		assert.True(t, node.IsRegistered())
+		assert.Equal(t, "10", node.GetStake())
+
+		metric := <-reporter.metrics
+		assert.Equal(t, RegistrationActive, metric.Status)
+		assert.Equal(t, node.GetAddress(), metric.ValidatorAddr)
+
+		restarted := newStoredNode(t, db)
+		restarted.restoreRegistration()
+		assert.Equal(t, reg, restarted.GetRegistration())
+	})
+
+	t.Run("should refuse to deregister or register without a contract", func(t *testing.T) {
+		node := newStoredNode(t, db)
+		_, err := node.DeregisterValidator(context.Background())
+		assert.ErrorIs(t, err, ErrNoContract)
+		_, err = node.RegisterValidator(context.Background(), big.NewInt(1))
+		assert.ErrorIs(t, err, ErrNoContract)
+	})
+
+	t.Run("should end unbonding once the period has passed", func(t *testing.T) {
+		node := newStoredNode(t, db)
+		node.setRegistration(Registration{Status: RegistrationUnbonding, Stake: "0", UnbondingEnds: time.Now().Add(time.Hour)})
+
+		_, err := node.beginTransition(RegistrationPending, func(reg Registration) error {
+			if reg.Status == RegistrationUnbonding {
+				return ErrUnbonding
+			}
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrUnbonding)
+
+		node.setRegistration(Registration{Status: RegistrationUnbonding, Stake: "0", UnbondingEnds: time.Now().Add(-time.Second)})
+		require.NoError(t, node.checkRegistration(context.Background()))
+		assert.Equal(t, RegistrationUnregistered, node.GetRegistration().Status)
+	})
+}
+
+func TestSignatureReporting(t *testing.T) {
+	db, err := database.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	t.Run("should report signed shares and submitted aggregates", func(t *testing.T) {
+		node := newStoredNode(t, db)
+		reporter := &recordingReporter{signatures: make(chan analytics.SignatureMetric, 2)}
+		node.SetReporter(reporter)
+
+		hash := crypto.Keccak256Hash([]byte("payment-10"))
+		require.NoError(t, node.ProcessValidationRequest(&p2p.ValidationMessage{
+			RequestID: 1, PaymentID: 10, MessageHash: hash.Hex(), RequiredSigs: 3, Timestamp: time.Now(),
+		}))
+
+		signed := <-reporter.signatures
+		assert.Equal(t, "signed", signed.Event)
+		assert.Equal(t, uint64(1), signed.RequestID)
+		assert.Equal(t, uint64(10), signed.PaymentID)
+		assert.Equal(t, node.GetAddress(), signed.ValidatorAddr)
+		assert.Equal(t, uint32(1), signed.Signatures)
+		assert.Equal(t, uint32(3), signed.RequiredSigs)
+		assert.GreaterOrEqual(t, signed.LatencyMs, int64(0))
+
+		node.markSubmitted(1, "0x00000000000000000000000000000000000000bb", "0x01")
+		node.markSubmitted(1, node.GetAddress(), "0x02")
+		submitted := <-reporter.signatures
+		assert.Equal(t, "submitted", submitted.Event)
+		assert.Equal(t, uint64(10), submitted.PaymentID)
+		assert.Equal(t, "0x02", submitted.TxHash)
+	})
+}
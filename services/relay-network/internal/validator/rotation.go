@@ -0,0 +1,125 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// registrationGasLimit covers registerValidator, including the BLS key check
+const registrationGasLimit = 400000
+
+// KeyRotation records the transactions that moved a registration to a new key
+type KeyRotation struct {
+	OldAddress common.Address `json:"old_address"`
+	NewAddress common.Address `json:"new_address"`
+	Stake      *big.Int       `json:"stake"`
+	ExitTx     common.Hash    `json:"exit_tx"`
+	TransferTx common.Hash    `json:"transfer_tx"`
+	RegisterTx common.Hash    `json:"register_tx"`
+}
+
+// RotateKey moves a validator registration from oldSigner to newSigner. The
+// contract has no key update, so the old key exits (returning its stake),
+// sends the stake and registration gas to the new key, and the new key
+// registers with the same stake and BLS public key. Each step waits for its
+// receipt; if one fails the earlier steps stand and the rotation can be
+// finished by hand.
+func RotateKey(ctx context.Context, client *ethclient.Client, contractAddr common.Address, oldSigner, newSigner keys.Signer, chainID int64) (*KeyRotation, error) {
+	contract := newRelayValidatorContract(contractAddr, client)
+	rotation := &KeyRotation{OldAddress: oldSigner.Address(), NewAddress: newSigner.Address()}
+
+	var stakeOut, blsOut []interface{}
+	callOpts := &bind.CallOpts{Context: ctx}
+	if err := contract.bound.Call(callOpts, &stakeOut, "validatorStakes", oldSigner.Address()); err != nil {
+		return nil, fmt.Errorf("failed to read stake: %w", err)
+	}
+	if err := contract.bound.Call(callOpts, &blsOut, "getValidatorBLSPublicKey", oldSigner.Address()); err != nil {
+		return nil, fmt.Errorf("failed to read BLS public key: %w", err)
+	}
+	rotation.Stake = stakeOut[0].(*big.Int)
+	blsKey := blsOut[0].([4]*big.Int)
+	if rotation.Stake.Sign() == 0 {
+		return nil, fmt.Errorf("%s has no stake registered", oldSigner.Address().Hex())
+	}
+
+	log.Printf("Rotating validator %s -> %s (stake %s wei)", rotation.OldAddress.Hex(), rotation.NewAddress.Hex(), rotation.Stake)
+
+	// 1. Exit with the old key
+	exitOpts := keys.NewTransactor(oldSigner, big.NewInt(chainID))
+	exitOpts.Context = ctx
+	exitTx, err := contract.bound.Transact(exitOpts, "exitValidator")
+	if err != nil {
+		return nil, fmt.Errorf("failed to send exit: %w", err)
+	}
+	rotation.ExitTx = exitTx.Hash()
+	if err := waitSuccess(ctx, client, exitTx); err != nil {
+		return rotation, fmt.Errorf("exit failed: %w", err)
+	}
+
+	// 2. Fund the new key with the stake plus registration gas
+	gasPrice, err := client.SuggestGasPrice(ctx)
+	if err != nil {
+		return rotation, fmt.Errorf("failed to get gas price: %w", err)
+	}
+	nonce, err := client.PendingNonceAt(ctx, oldSigner.Address())
+	if err != nil {
+		return rotation, fmt.Errorf("failed to get nonce: %w", err)
+	}
+	gasAllowance := new(big.Int).Mul(gasPrice, big.NewInt(2*registrationGasLimit))
+	newAddress := newSigner.Address()
+	transfer := types.NewTx(&types.LegacyTx{
+		Nonce:    nonce,
+		GasPrice: gasPrice,
+		Gas:      21000,
+		To:       &newAddress,
+		Value:    new(big.Int).Add(rotation.Stake, gasAllowance),
+	})
+	transfer, err = exitOpts.Signer(oldSigner.Address(), transfer)
+	if err != nil {
+		return rotation, fmt.Errorf("failed to sign transfer: %w", err)
+	}
+	if err := client.SendTransaction(ctx, transfer); err != nil {
+		return rotation, fmt.Errorf("failed to send transfer: %w", err)
+	}
+	rotation.TransferTx = transfer.Hash()
+	if err := waitSuccess(ctx, client, transfer); err != nil {
+		return rotation, fmt.Errorf("transfer failed: %w", err)
+	}
+
+	// 3. Register the new key
+	registerOpts := keys.NewTransactor(newSigner, big.NewInt(chainID))
+	registerOpts.Context = ctx
+	registerOpts.Value = rotation.Stake
+	registerOpts.GasLimit = registrationGasLimit
+	registerTx, err := contract.bound.Transact(registerOpts, "registerValidator", blsKey)
+	if err != nil {
+		return rotation, fmt.Errorf("failed to send registration: %w", err)
+	}
+	rotation.RegisterTx = registerTx.Hash()
+	if err := waitSuccess(ctx, client, registerTx); err != nil {
+		return rotation, fmt.Errorf("registration failed: %w", err)
+	}
+
+	log.Printf("Validator key rotated to %s", rotation.NewAddress.Hex())
+	return rotation, nil
+}
+
+func waitSuccess(ctx context.Context, client *ethclient.Client, tx *types.Transaction) error {
+	receipt, err := bind.WaitMined(ctx, client, tx)
+	if err != nil {
+		return err
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return errors.New("transaction " + tx.Hash().Hex() + " reverted")
+	}
+	return nil
+}
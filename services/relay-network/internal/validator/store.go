@@ -0,0 +1,242 @@
+package validator
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Store persists in-flight validation requests and the signature shares
+// collected for them, so a restarted node can resume its quorums. Each chain
+// the node validates for has its own Store over the shared tables.
+type Store struct {
+	db      *sql.DB
+	chainID int64
+}
+
+// storeTables are the validation tables, keyed by chain
+var storeTables = []struct {
+	name    string
+	columns string
+	schema  string
+}{
+	{
+		name:    "validation_requests",
+		columns: "id, payment_id, message_hash, required_sigs, deadline, is_high_value, submitted",
+		schema: `(
+		chain_id INTEGER NOT NULL,
+		id INTEGER NOT NULL,
+		payment_id INTEGER NOT NULL,
+		message_hash TEXT NOT NULL,
+		required_sigs INTEGER NOT NULL,
+		deadline INTEGER NOT NULL,
+		is_high_value INTEGER NOT NULL DEFAULT 0,
+		submitted INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (chain_id, id)
+	)`,
+	},
+	{
+		name:    "validation_signatures",
+		columns: "request_id, signer, signature",
+		schema: `(
+		chain_id INTEGER NOT NULL,
+		request_id INTEGER NOT NULL,
+		signer TEXT NOT NULL,
+		signature BLOB NOT NULL,
+		PRIMARY KEY (chain_id, request_id, signer)
+	)`,
+	},
+	{
+		name:    "validator_registration",
+		columns: "validator, status, stake, tx_hash, registered_at, exited_at, unbonding_ends, error",
+		schema: `(
+		chain_id INTEGER NOT NULL,
+		validator TEXT NOT NULL,
+		status TEXT NOT NULL,
+		stake TEXT NOT NULL,
+		tx_hash TEXT NOT NULL DEFAULT '',
+		registered_at INTEGER NOT NULL DEFAULT 0,
+		exited_at INTEGER NOT NULL DEFAULT 0,
+		unbonding_ends INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (chain_id, validator)
+	)`,
+	},
+}
+
+// NewStore opens the store for one chain. Tables written before the node
+// validated for several chains are migrated, and their rows are assigned to
+// the chain of the first store opened, which is the primary chain.
+func NewStore(db *sql.DB, chainID int64) (*Store, error) {
+	for _, table := range storeTables {
+		if err := migrateTable(db, table.name, table.columns, table.schema, chainID); err != nil {
+			return nil, fmt.Errorf("failed to create %s table: %w", table.name, err)
+		}
+	}
+	return &Store{db: db, chainID: chainID}, nil
+}
+
+// migrateTable creates a table, rebuilding it with a chain_id key if it
+// exists without one
+func migrateTable(db *sql.DB, name, columns, schema string, chainID int64) error {
+	var exists bool
+	if err := db.QueryRow(`SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		_, err := db.Exec(`CREATE TABLE ` + name + ` ` + schema)
+		return err
+	}
+
+	var scoped bool
+	if err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = 'chain_id'`, name).Scan(&scoped); err != nil {
+		return err
+	}
+	if scoped {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	legacy := name + "_legacy"
+	if _, err := tx.Exec(`ALTER TABLE ` + name + ` RENAME TO ` + legacy); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE ` + name + ` ` + schema); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO `+name+` (chain_id, `+columns+`) SELECT ?, `+columns+` FROM `+legacy, chainID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DROP TABLE ` + legacy); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) SaveRequest(req *ValidationRequest) error {
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO validation_requests (chain_id, id, payment_id, message_hash, required_sigs, deadline, is_high_value, submitted)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, s.chainID, req.ID, req.PaymentID, req.MessageHash, req.RequiredSigs, req.Deadline.Unix(), req.IsHighValue, req.Submitted)
+	return err
+}
+
+func (s *Store) SaveSignature(requestID uint64, signer common.Address, signature []byte) error {
+	_, err := s.db.Exec(`
+		INSERT OR IGNORE INTO validation_signatures (chain_id, request_id, signer, signature) VALUES (?, ?, ?, ?)
+	`, s.chainID, requestID, signer.Hex(), signature)
+	return err
+}
+
+// MarkSubmitted records that this node's share is on-chain
+func (s *Store) MarkSubmitted(requestID uint64) error {
+	_, err := s.db.Exec(`UPDATE validation_requests SET submitted = 1 WHERE chain_id = ? AND id = ?`, s.chainID, requestID)
+	return err
+}
+
+func (s *Store) DeleteRequest(requestID uint64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM validation_signatures WHERE chain_id = ? AND request_id = ?`, s.chainID, requestID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM validation_requests WHERE chain_id = ? AND id = ?`, s.chainID, requestID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) LoadRequests() ([]*ValidationRequest, error) {
+	rows, err := s.db.Query(`
+		SELECT id, payment_id, message_hash, required_sigs, deadline, is_high_value, submitted
+		FROM validation_requests WHERE chain_id = ? ORDER BY id
+	`, s.chainID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []*ValidationRequest
+	for rows.Next() {
+		var req ValidationRequest
+		var deadline int64
+		if err := rows.Scan(&req.ID, &req.PaymentID, &req.MessageHash, &req.RequiredSigs, &deadline, &req.IsHighValue, &req.Submitted); err != nil {
+			return nil, err
+		}
+		req.Deadline = time.Unix(deadline, 0)
+		requests = append(requests, &req)
+	}
+	return requests, rows.Err()
+}
+
+func (s *Store) LoadSignatures(requestID uint64) (map[common.Address][]byte, error) {
+	rows, err := s.db.Query(`SELECT signer, signature FROM validation_signatures WHERE chain_id = ? AND request_id = ?`, s.chainID, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	signatures := make(map[common.Address][]byte)
+	for rows.Next() {
+		var signer string
+		var signature []byte
+		if err := rows.Scan(&signer, &signature); err != nil {
+			return nil, err
+		}
+		signatures[common.HexToAddress(signer)] = signature
+	}
+	return signatures, rows.Err()
+}
+
+func (s *Store) SaveRegistration(validator common.Address, reg *Registration) error {
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO validator_registration (chain_id, validator, status, stake, tx_hash, registered_at, exited_at, unbonding_ends, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, s.chainID, validator.Hex(), reg.Status, reg.Stake, reg.TxHash, unixOrZero(reg.RegisteredAt), unixOrZero(reg.ExitedAt), unixOrZero(reg.UnbondingEnds), reg.Error)
+	return err
+}
+
+// LoadRegistration returns the saved registration, or nil if there is none
+func (s *Store) LoadRegistration(validator common.Address) (*Registration, error) {
+	var reg Registration
+	var registeredAt, exitedAt, unbondingEnds int64
+	err := s.db.QueryRow(`
+		SELECT status, stake, tx_hash, registered_at, exited_at, unbonding_ends, error
+		FROM validator_registration WHERE chain_id = ? AND validator = ?
+	`, s.chainID, validator.Hex()).Scan(&reg.Status, &reg.Stake, &reg.TxHash, &registeredAt, &exitedAt, &unbondingEnds, &reg.Error)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reg.RegisteredAt = timeOrZero(registeredAt)
+	reg.ExitedAt = timeOrZero(exitedAt)
+	reg.UnbondingEnds = timeOrZero(unbondingEnds)
+	return &reg, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
@@ -0,0 +1,128 @@
+package validator
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/crosspay/relay-network/internal/database"
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/crosspay/relay-network/internal/p2p"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStoredNode(t *testing.T, db *sql.DB) *Node {
+	store, err := NewStore(db, 1337)
+	require.NoError(t, err)
+
+	key, err := crypto.HexToECDSA("4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318")
+	require.NoError(t, err)
+
+	node := NewNode(keys.NewLocalSigner(key), &config.Config{})
+	node.SetStore(store)
+	return node
+}
+
+func TestNodeRestore(t *testing.T) {
+	db, err := database.Open(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	hash := crypto.Keccak256Hash([]byte("payment-1"))
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	peerShare, err := SignShare(hash, keys.NewLocalSigner(peerKey))
+	require.NoError(t, err)
+
+	node := newStoredNode(t, db)
+	require.NoError(t, node.ProcessValidationRequest(&p2p.ValidationMessage{
+		RequestID: 1, PaymentID: 10, MessageHash: hash.Hex(), RequiredSigs: 3, Timestamp: time.Now(),
+	}))
+	require.NoError(t, node.ProcessSignatureShare(&p2p.ValidationMessage{
+		RequestID: 1, Signer: crypto.PubkeyToAddress(peerKey.PublicKey).Hex(), Signature: hexutil.Encode(peerShare),
+	}))
+	require.Eventually(t, func() bool {
+		return len(node.GetSignatures(1)) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// A request whose deadline passes while the node is down
+	require.NoError(t, node.store.SaveRequest(&ValidationRequest{
+		ID: 2, PaymentID: 20, MessageHash: hash.Hex(), RequiredSigs: 2, Deadline: time.Now().Add(-time.Minute),
+	}))
+
+	restarted := newStoredNode(t, db)
+	require.NoError(t, restarted.Restore())
+
+	assert.Equal(t, 1, restarted.GetPendingValidationCount())
+	req, exists := restarted.GetValidationStatus(1)
+	require.True(t, exists)
+	assert.Equal(t, 3, req.RequiredSigs)
+	assert.Equal(t, node.GetSignatures(1), restarted.GetSignatures(1))
+
+	requests, err := restarted.store.LoadRequests()
+	require.NoError(t, err)
+	assert.Len(t, requests, 1)
+}
+
+func TestStoreChains(t *testing.T) {
+	t.Run("should keep each chain's requests apart", func(t *testing.T) {
+		db, err := database.Open(":memory:")
+		require.NoError(t, err)
+		defer db.Close()
+
+		primary, err := NewStore(db, 1337)
+		require.NoError(t, err)
+		secondary, err := NewStore(db, 80002)
+		require.NoError(t, err)
+
+		req := &ValidationRequest{ID: 1, MessageHash: "0x01", RequiredSigs: 2, Deadline: time.Now()}
+		require.NoError(t, primary.SaveRequest(req))
+		require.NoError(t, secondary.SaveRequest(req))
+		require.NoError(t, primary.DeleteRequest(1))
+
+		requests, err := primary.LoadRequests()
+		require.NoError(t, err)
+		assert.Empty(t, requests)
+		requests, err = secondary.LoadRequests()
+		require.NoError(t, err)
+		assert.Len(t, requests, 1)
+	})
+
+	t.Run("should assign rows from before chains to the primary chain", func(t *testing.T) {
+		db, err := database.Open(":memory:")
+		require.NoError(t, err)
+		defer db.Close()
+
+		_, err = db.Exec(`
+			CREATE TABLE validation_requests (
+				id INTEGER PRIMARY KEY,
+				payment_id INTEGER NOT NULL,
+				message_hash TEXT NOT NULL,
+				required_sigs INTEGER NOT NULL,
+				deadline INTEGER NOT NULL,
+				is_high_value INTEGER NOT NULL DEFAULT 0,
+				submitted INTEGER NOT NULL DEFAULT 0
+			);
+			INSERT INTO validation_requests (id, payment_id, message_hash, required_sigs, deadline) VALUES (7, 70, '0x07', 2, 0);
+		`)
+		require.NoError(t, err)
+
+		primary, err := NewStore(db, 1337)
+		require.NoError(t, err)
+		secondary, err := NewStore(db, 80002)
+		require.NoError(t, err)
+
+		requests, err := primary.LoadRequests()
+		require.NoError(t, err)
+		require.Len(t, requests, 1)
+		assert.Equal(t, uint64(7), requests[0].ID)
+
+		requests, err = secondary.LoadRequests()
+		require.NoError(t, err)
+		assert.Empty(t, requests)
+	})
+}
@@ -0,0 +1,157 @@
+package validator
+
+import (
+	"sync"
+	"time"
+)
+
+// Validation events are published as a request progresses, so clients can
+// follow it instead of polling. Subscribers that fall behind are dropped:
+// their channel is closed and they can subscribe again to get a fresh
+// snapshot.
+
+const (
+	EventSignature = "signature"
+	EventQuorum    = "quorum"
+	EventSubmitted = "submitted"
+	EventExpired   = "expired"
+	EventReverted  = "reverted"
+
+	subscriberBuffer = 32
+)
+
+// ValidationEvent reports progress on one validation request
+type ValidationEvent struct {
+	Type       string    `json:"type"`
+	RequestID  uint64    `json:"request_id"`
+	Signer     string    `json:"signer,omitempty"`
+	Signatures int       `json:"signatures"`
+	Required   int       `json:"required_signatures"`
+	TxHash     string    `json:"tx_hash,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Final reports whether no more events follow for the request
+func (e ValidationEvent) Final() bool {
+	return e.Type == EventSubmitted || e.Type == EventExpired || e.Type == EventReverted
+}
+
+type eventHub struct {
+	mutex       sync.Mutex
+	subscribers map[uint64]map[chan ValidationEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[uint64]map[chan ValidationEvent]struct{})}
+}
+
+func (h *eventHub) subscribe(requestID uint64) (<-chan ValidationEvent, func()) {
+	ch := make(chan ValidationEvent, subscriberBuffer)
+
+	h.mutex.Lock()
+	if h.subscribers[requestID] == nil {
+		h.subscribers[requestID] = make(map[chan ValidationEvent]struct{})
+	}
+	h.subscribers[requestID][ch] = struct{}{}
+	h.mutex.Unlock()
+
+	return ch, func() { h.remove(requestID, ch) }
+}
+
+// remove closes a subscriber's channel unless it was already dropped
+func (h *eventHub) remove(requestID uint64, ch chan ValidationEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.subscribers[requestID][ch]; !ok {
+		return
+	}
+	delete(h.subscribers[requestID], ch)
+	if len(h.subscribers[requestID]) == 0 {
+		delete(h.subscribers, requestID)
+	}
+	close(ch)
+}
+
+func (h *eventHub) publish(event ValidationEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for ch := range h.subscribers[event.RequestID] {
+		select {
+		case ch <- event:
+		default:
+			delete(h.subscribers[event.RequestID], ch)
+			close(ch)
+		}
+	}
+	if event.Final() {
+		for ch := range h.subscribers[event.RequestID] {
+			close(ch)
+		}
+		delete(h.subscribers, event.RequestID)
+	}
+}
+
+// SubscribeValidation streams events for a request until a final event or
+// until the returned cancel function is called
+func (n *Node) SubscribeValidation(requestID uint64) (<-chan ValidationEvent, func()) {
+	return n.events.subscribe(requestID)
+}
+
+// ValidationSnapshot describes where a request stands, for clients that
+// start streaming part way through
+func (n *Node) ValidationSnapshot(requestID uint64) (ValidationEvent, bool) {
+	snapshot := ValidationEvent{RequestID: requestID, Timestamp: time.Now()}
+
+	n.mutex.RLock()
+	req, pending := n.pendingValidations[requestID]
+	if pending {
+		snapshot.Required = req.RequiredSigs
+		if req.Submitted {
+			snapshot.Type = EventSubmitted
+		}
+	}
+	n.mutex.RUnlock()
+
+	quorum, reached := n.aggregator.Quorum(requestID)
+	if !pending && !reached {
+		return snapshot, false
+	}
+
+	snapshot.Signatures = len(n.aggregator.Signatures(requestID))
+	if reached && snapshot.Type == "" {
+		snapshot.Type = EventQuorum
+	}
+	if !pending {
+		snapshot.Required = len(quorum.Signers)
+	}
+	if snapshot.Type == "" {
+		snapshot.Type = EventSignature
+	}
+	return snapshot, true
+}
+
+// requiredSignatures returns the threshold of a pending request, or 0 if it
+// is not pending
+func (n *Node) requiredSignatures(requestID uint64) int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if req, exists := n.pendingValidations[requestID]; exists {
+		return req.RequiredSigs
+	}
+	return 0
+}
+
+// publishEvent sends an event for a request with its current signature count
+func (n *Node) publishEvent(eventType string, requestID uint64, signer, txHash string, required int) {
+	n.events.publish(ValidationEvent{
+		Type:       eventType,
+		RequestID:  requestID,
+		Signer:     signer,
+		Signatures: len(n.aggregator.Signatures(requestID)),
+		Required:   required,
+		TxHash:     txHash,
+		Timestamp:  time.Now(),
+	})
+}
@@ -0,0 +1,88 @@
+package validator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/config"
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/crosspay/relay-network/internal/p2p"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func nextEvent(t *testing.T, events <-chan ValidationEvent) ValidationEvent {
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "event stream closed")
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no validation event")
+		return ValidationEvent{}
+	}
+}
+
+func TestValidationEvents(t *testing.T) {
+	hash := crypto.Keccak256Hash([]byte("payment-1"))
+
+	t.Run("should stream shares, then the quorum, until the request ends", func(t *testing.T) {
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		node := NewNode(keys.NewLocalSigner(key), &config.Config{})
+
+		events, cancel := node.SubscribeValidation(1)
+		defer cancel()
+		require.NoError(t, node.ProcessValidationRequest(&p2p.ValidationMessage{
+			Type: "validation_request", RequestID: 1, PaymentID: 1, MessageHash: hash.Hex(), RequiredSigs: 2, Timestamp: time.Now(),
+		}))
+
+		own := nextEvent(t, events)
+		assert.Equal(t, EventSignature, own.Type)
+		assert.Equal(t, node.GetAddress(), own.Signer)
+		assert.Equal(t, 1, own.Signatures)
+		assert.Equal(t, 2, own.Required)
+
+		_, peer, share := signedShare(t, hash)
+		require.NoError(t, node.ProcessSignatureShare(&p2p.ValidationMessage{
+			Type: "signature_share", RequestID: 1, MessageHash: hash.Hex(), Signature: hexutil.Encode(share), Signer: peer.Hex(),
+		}))
+		assert.Equal(t, peer.Hex(), nextEvent(t, events).Signer)
+		quorum := nextEvent(t, events)
+		assert.Equal(t, EventQuorum, quorum.Type)
+		assert.Equal(t, 2, quorum.Signatures)
+
+		snapshot, ok := node.ValidationSnapshot(1)
+		require.True(t, ok)
+		assert.Equal(t, EventQuorum, snapshot.Type)
+
+		node.RevertValidationRequests([]uint64{1})
+		assert.Equal(t, EventReverted, nextEvent(t, events).Type)
+		_, open := <-events
+		assert.False(t, open)
+	})
+
+	t.Run("should drop subscribers that fall behind", func(t *testing.T) {
+		hub := newEventHub()
+		slow, cancelSlow := hub.subscribe(2)
+		defer cancelSlow()
+
+		for i := 0; i <= subscriberBuffer; i++ {
+			hub.publish(ValidationEvent{Type: EventSignature, RequestID: 2})
+		}
+		received := 0
+		for range slow {
+			received++
+		}
+		assert.Equal(t, subscriberBuffer, received)
+	})
+
+	t.Run("should report unknown requests", func(t *testing.T) {
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		node := NewNode(keys.NewLocalSigner(key), &config.Config{})
+		_, ok := node.ValidationSnapshot(42)
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,358 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/crosspay/relay-network/internal/metrics"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// errGasPriceCap is returned when a stuck transaction is already priced at
+// the configured maximum and cannot be bumped further
+var errGasPriceCap = errors.New("gas price is at the configured maximum")
+
+// txBackend is the chain access the transaction manager needs
+type txBackend interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// gasPolicy decides when a pending transaction is stuck and how much its gas
+// price is raised when it is replaced. A nil maxGasPrice leaves the price
+// uncapped.
+type gasPolicy struct {
+	stuckAfter  time.Duration
+	bumpPercent int64
+	maxGasPrice *big.Int
+}
+
+// PendingTransaction is a transaction sent by the node that has not been
+// mined yet. For dynamic fee transactions GasPrice is the fee cap.
+type PendingTransaction struct {
+	Nonce        uint64        `json:"nonce"`
+	Hash         common.Hash   `json:"hash"`
+	Method       string        `json:"method"`
+	GasPrice     string        `json:"gas_price"`
+	GasTipCap    string        `json:"gas_tip_cap,omitempty"`
+	FirstSentAt  time.Time     `json:"first_sent_at"`
+	LastSentAt   time.Time     `json:"last_sent_at"`
+	Replacements int           `json:"replacements"`
+	Replaced     []common.Hash `json:"replaced,omitempty"`
+}
+
+// pendingTx is a sent transaction and every hash broadcast for its nonce,
+// latest last
+type pendingTx struct {
+	method    string
+	tx        *types.Transaction
+	signer    bind.SignerFn
+	firstSent time.Time
+	lastSent  time.Time
+	hashes    []common.Hash
+}
+
+// txManager sends the transactions of one account on one chain. It hands out
+// nonces so submissions sent concurrently do not pick the same pending nonce,
+// and tracks each transaction until it is mined. A transaction pending longer
+// than the policy allows is replaced at the same nonce with a higher gas
+// price. The next nonce is read from the chain on first use and again after a
+// failed send, which may have left a gap.
+type txManager struct {
+	mutex   sync.Mutex
+	backend txBackend
+	account common.Address
+	chain   string
+	policy  gasPolicy
+	next    uint64
+	synced  bool
+	pending map[uint64]*pendingTx
+	now     func() time.Time
+}
+
+func newTxManager(backend txBackend, account common.Address, chain string, policy gasPolicy) *txManager {
+	return &txManager{
+		backend: backend,
+		account: account,
+		chain:   chain,
+		policy:  policy,
+		pending: make(map[uint64]*pendingTx),
+		now:     time.Now,
+	}
+}
+
+// send calls fn with the next nonce and advances it only if fn succeeds.
+// Sends are serialised so nonces are used in order. signer re-signs the
+// transaction if it has to be replaced.
+func (m *txManager) send(ctx context.Context, method string, signer bind.SignerFn, fn func(nonce uint64) (*types.Transaction, error)) (*types.Transaction, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.synced {
+		nonce, err := m.backend.PendingNonceAt(ctx, m.account)
+		if err != nil {
+			return nil, err
+		}
+		m.next, m.synced = nonce, true
+	}
+
+	tx, err := fn(m.next)
+	if err != nil {
+		m.synced = false
+		return nil, err
+	}
+
+	now := m.now()
+	m.pending[m.next] = &pendingTx{
+		method:    method,
+		tx:        tx,
+		signer:    signer,
+		firstSent: now,
+		lastSent:  now,
+		hashes:    []common.Hash{tx.Hash()},
+	}
+	m.next++
+	return tx, nil
+}
+
+// monitor checks the pending transactions every interval until ctx is done
+func (m *txManager) monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.check(ctx); err != nil {
+				log.Printf("Failed to check pending transactions on chain %s: %v", m.chain, err)
+			}
+		}
+	}
+}
+
+// check forgets transactions whose nonce has been mined and replaces those
+// that have been pending longer than the policy allows. A failed replacement
+// is logged and tried again on the next check.
+func (m *txManager) check(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.pending) == 0 {
+		return nil
+	}
+
+	mined, err := m.backend.NonceAt(ctx, m.account, nil)
+	if err != nil {
+		return err
+	}
+	for nonce := range m.pending {
+		if nonce < mined {
+			delete(m.pending, nonce)
+		}
+	}
+	if mined > m.next {
+		// Transactions were sent for this account outside the manager
+		m.synced = false
+	}
+
+	now := m.now()
+	for _, nonce := range m.pendingNonces() {
+		p := m.pending[nonce]
+		if now.Sub(p.lastSent) < m.policy.stuckAfter {
+			continue
+		}
+		if err := m.replace(ctx, p); err != nil {
+			log.Printf("Failed to replace stuck %s transaction %s (nonce %d): %v", p.method, p.tx.Hash().Hex(), nonce, err)
+		}
+	}
+	return nil
+}
+
+// replace re-signs and broadcasts a pending transaction with a higher gas
+// price
+func (m *txManager) replace(ctx context.Context, p *pendingTx) error {
+	unsigned, err := m.bump(p.tx)
+	if err != nil {
+		return err
+	}
+	replacement, err := p.signer(m.account, unsigned)
+	if err != nil {
+		return err
+	}
+	if err := m.backend.SendTransaction(ctx, replacement); err != nil {
+		return err
+	}
+
+	log.Printf("Replaced stuck %s transaction %s with %s at nonce %d", p.method, p.tx.Hash().Hex(), replacement.Hash().Hex(), replacement.Nonce())
+	metrics.TransactionReplacements.Inc(m.chain)
+	p.tx = replacement
+	p.lastSent = m.now()
+	p.hashes = append(p.hashes, replacement.Hash())
+	return nil
+}
+
+// bump returns an unsigned copy of tx with its gas price, or fee cap and tip,
+// raised by the policy's percentage and held to its maximum
+func (m *txManager) bump(tx *types.Transaction) (*types.Transaction, error) {
+	if tx.Type() == types.DynamicFeeTxType {
+		feeCap := m.raise(tx.GasFeeCap())
+		if feeCap.Cmp(tx.GasFeeCap()) <= 0 {
+			return nil, errGasPriceCap
+		}
+		tip := m.raise(tx.GasTipCap())
+		if tip.Cmp(feeCap) > 0 {
+			tip = new(big.Int).Set(feeCap)
+		}
+		return types.NewTx(&types.DynamicFeeTx{
+			ChainID:    tx.ChainId(),
+			Nonce:      tx.Nonce(),
+			GasTipCap:  tip,
+			GasFeeCap:  feeCap,
+			Gas:        tx.Gas(),
+			To:         tx.To(),
+			Value:      tx.Value(),
+			Data:       tx.Data(),
+			AccessList: tx.AccessList(),
+		}), nil
+	}
+
+	price := m.raise(tx.GasPrice())
+	if price.Cmp(tx.GasPrice()) <= 0 {
+		return nil, errGasPriceCap
+	}
+	if tx.Type() == types.AccessListTxType {
+		return types.NewTx(&types.AccessListTx{
+			ChainID:    tx.ChainId(),
+			Nonce:      tx.Nonce(),
+			GasPrice:   price,
+			Gas:        tx.Gas(),
+			To:         tx.To(),
+			Value:      tx.Value(),
+			Data:       tx.Data(),
+			AccessList: tx.AccessList(),
+		}), nil
+	}
+	return types.NewTx(&types.LegacyTx{
+		Nonce:    tx.Nonce(),
+		GasPrice: price,
+		Gas:      tx.Gas(),
+		To:       tx.To(),
+		Value:    tx.Value(),
+		Data:     tx.Data(),
+	}), nil
+}
+
+// raise adds the bump percentage to a price, rounding up so even a price of
+// a few wei goes up, and caps the result
+func (m *txManager) raise(price *big.Int) *big.Int {
+	raised := new(big.Int).Mul(price, big.NewInt(100+m.policy.bumpPercent))
+	raised.Add(raised, big.NewInt(99))
+	raised.Div(raised, big.NewInt(100))
+	if raised.Cmp(price) <= 0 {
+		raised.Add(price, big.NewInt(1))
+	}
+	if m.policy.maxGasPrice != nil && raised.Cmp(m.policy.maxGasPrice) > 0 {
+		raised.Set(m.policy.maxGasPrice)
+	}
+	return raised
+}
+
+// pendingNonces returns the pending nonces in order. The caller holds the
+// mutex.
+func (m *txManager) pendingNonces() []uint64 {
+	nonces := make([]uint64, 0, len(m.pending))
+	for nonce := range m.pending {
+		nonces = append(nonces, nonce)
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	return nonces
+}
+
+// transactions returns the pending transactions in nonce order
+func (m *txManager) transactions() []PendingTransaction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	txs := make([]PendingTransaction, 0, len(m.pending))
+	for _, nonce := range m.pendingNonces() {
+		p := m.pending[nonce]
+		pending := PendingTransaction{
+			Nonce:        nonce,
+			Hash:         p.tx.Hash(),
+			Method:       p.method,
+			GasPrice:     p.tx.GasFeeCap().String(),
+			FirstSentAt:  p.firstSent,
+			LastSentAt:   p.lastSent,
+			Replacements: len(p.hashes) - 1,
+			Replaced:     append([]common.Hash(nil), p.hashes[:len(p.hashes)-1]...),
+		}
+		if p.tx.Type() == types.DynamicFeeTxType {
+			pending.GasTipCap = p.tx.GasTipCap().String()
+		}
+		txs = append(txs, pending)
+	}
+	return txs
+}
+
+// waitMined waits for the transaction sent as txHash, or a replacement of
+// it, to be mined and returns its receipt
+func (m *txManager) waitMined(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	tracked := m.tracking(txHash)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		for _, hash := range m.hashesOf(tracked, txHash) {
+			if receipt, err := m.backend.TransactionReceipt(ctx, hash); err == nil {
+				return receipt, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tracking returns the pending transaction txHash was broadcast for, or nil
+// when it is not tracked
+func (m *txManager) tracking(txHash common.Hash) *pendingTx {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, p := range m.pending {
+		for _, hash := range p.hashes {
+			if hash == txHash {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// hashesOf returns every hash broadcast for a tracked transaction, or only
+// txHash when it is not tracked. A record stays valid after the nonce is
+// mined and forgotten, so a replacement mined in the meantime is still found.
+func (m *txManager) hashesOf(p *pendingTx, txHash common.Hash) []common.Hash {
+	if p == nil {
+		return []common.Hash{txHash}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]common.Hash(nil), p.hashes...)
+}
@@ -0,0 +1,229 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTxBackend struct {
+	mutex    sync.Mutex
+	nonce    uint64
+	mined    uint64
+	reads    int
+	sent     []*types.Transaction
+	receipts map[common.Hash]*types.Receipt
+}
+
+func (b *fakeTxBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	b.reads++
+	return b.nonce, nil
+}
+
+func (b *fakeTxBackend) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	return b.mined, nil
+}
+
+func (b *fakeTxBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.sent = append(b.sent, tx)
+	return nil
+}
+
+func (b *fakeTxBackend) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if receipt, ok := b.receipts[txHash]; ok {
+		return receipt, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+// unsignedSigner returns transactions as given, which is enough for the
+// manager to track their hashes
+func unsignedSigner(address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+	return tx, nil
+}
+
+func TestTxManagerNonces(t *testing.T) {
+	sent := func(nonces *[]uint64) func(uint64) (*types.Transaction, error) {
+		return func(nonce uint64) (*types.Transaction, error) {
+			*nonces = append(*nonces, nonce)
+			return types.NewTx(&types.LegacyTx{Nonce: nonce}), nil
+		}
+	}
+
+	t.Run("should hand out consecutive nonces to concurrent sends", func(t *testing.T) {
+		backend := &fakeTxBackend{nonce: 7}
+		manager := newTxManager(backend, common.Address{}, "1", gasPolicy{})
+
+		var nonces []uint64
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := manager.send(context.Background(), "test", unsignedSigner, func(nonce uint64) (*types.Transaction, error) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					return sent(&nonces)(nonce)
+				})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		assert.ElementsMatch(t, []uint64{7, 8, 9, 10, 11}, nonces)
+		assert.Equal(t, 1, backend.reads)
+		assert.Len(t, manager.transactions(), 5)
+	})
+
+	t.Run("should read the nonce again after a failed send", func(t *testing.T) {
+		backend := &fakeTxBackend{nonce: 3}
+		manager := newTxManager(backend, common.Address{}, "1", gasPolicy{})
+
+		_, err := manager.send(context.Background(), "test", unsignedSigner, func(nonce uint64) (*types.Transaction, error) {
+			return nil, errors.New("rejected")
+		})
+		require.Error(t, err)
+
+		var nonces []uint64
+		backend.nonce = 4
+		_, err = manager.send(context.Background(), "test", unsignedSigner, sent(&nonces))
+		require.NoError(t, err)
+
+		assert.Equal(t, []uint64{4}, nonces)
+		assert.Equal(t, 2, backend.reads)
+	})
+}
+
+func TestTxManagerReplacement(t *testing.T) {
+	to := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	policy := gasPolicy{stuckAfter: time.Minute, bumpPercent: 15}
+
+	newManager := func(backend *fakeTxBackend, policy gasPolicy) (*txManager, *time.Time) {
+		now := time.Unix(1700000000, 0)
+		manager := newTxManager(backend, common.Address{}, "1", policy)
+		manager.now = func() time.Time { return now }
+		return manager, &now
+	}
+	sendTx := func(t *testing.T, manager *txManager, tx types.TxData) *types.Transaction {
+		sent, err := manager.send(context.Background(), "submitAggregatedSignatures", unsignedSigner, func(nonce uint64) (*types.Transaction, error) {
+			return types.NewTx(tx), nil
+		})
+		require.NoError(t, err)
+		return sent
+	}
+
+	t.Run("should leave transactions alone until they are stuck", func(t *testing.T) {
+		backend := &fakeTxBackend{}
+		manager, now := newManager(backend, policy)
+		sendTx(t, manager, &types.LegacyTx{GasPrice: big.NewInt(100), Gas: 21000, To: &to})
+
+		*now = now.Add(30 * time.Second)
+		require.NoError(t, manager.check(context.Background()))
+
+		assert.Empty(t, backend.sent)
+	})
+
+	t.Run("should replace a stuck transaction at the same nonce with a higher gas price", func(t *testing.T) {
+		backend := &fakeTxBackend{nonce: 5, mined: 5}
+		manager, now := newManager(backend, policy)
+		original := sendTx(t, manager, &types.LegacyTx{Nonce: 5, GasPrice: big.NewInt(100), Gas: 21000, To: &to, Data: []byte{1}})
+
+		*now = now.Add(2 * time.Minute)
+		require.NoError(t, manager.check(context.Background()))
+
+		require.Len(t, backend.sent, 1)
+		replacement := backend.sent[0]
+		assert.Equal(t, uint64(5), replacement.Nonce())
+		assert.Equal(t, big.NewInt(115), replacement.GasPrice())
+		assert.Equal(t, original.Data(), replacement.Data())
+
+		pending := manager.transactions()
+		require.Len(t, pending, 1)
+		assert.Equal(t, replacement.Hash(), pending[0].Hash)
+		assert.Equal(t, 1, pending[0].Replacements)
+		assert.Equal(t, []common.Hash{original.Hash()}, pending[0].Replaced)
+		assert.Equal(t, "115", pending[0].GasPrice)
+	})
+
+	t.Run("should bump the fee cap and tip of dynamic fee transactions", func(t *testing.T) {
+		backend := &fakeTxBackend{}
+		manager, now := newManager(backend, policy)
+		sendTx(t, manager, &types.DynamicFeeTx{ChainID: big.NewInt(1), GasTipCap: big.NewInt(10), GasFeeCap: big.NewInt(200), Gas: 21000, To: &to})
+
+		*now = now.Add(2 * time.Minute)
+		require.NoError(t, manager.check(context.Background()))
+
+		require.Len(t, backend.sent, 1)
+		assert.Equal(t, big.NewInt(230), backend.sent[0].GasFeeCap())
+		assert.Equal(t, big.NewInt(12), backend.sent[0].GasTipCap())
+	})
+
+	t.Run("should hold replacements to the maximum gas price", func(t *testing.T) {
+		backend := &fakeTxBackend{}
+		capped := policy
+		capped.maxGasPrice = big.NewInt(110)
+		manager, now := newManager(backend, capped)
+		sendTx(t, manager, &types.LegacyTx{GasPrice: big.NewInt(100), Gas: 21000, To: &to})
+
+		*now = now.Add(2 * time.Minute)
+		require.NoError(t, manager.check(context.Background()))
+		*now = now.Add(2 * time.Minute)
+		require.NoError(t, manager.check(context.Background()))
+
+		require.Len(t, backend.sent, 1)
+		assert.Equal(t, big.NewInt(110), backend.sent[0].GasPrice())
+
+		_, err := manager.bump(backend.sent[0])
+		assert.ErrorIs(t, err, errGasPriceCap)
+	})
+
+	t.Run("should forget transactions once their nonce is mined", func(t *testing.T) {
+		backend := &fakeTxBackend{nonce: 2, mined: 2}
+		manager, now := newManager(backend, policy)
+		sendTx(t, manager, &types.LegacyTx{Nonce: 2, GasPrice: big.NewInt(100), Gas: 21000, To: &to})
+		sendTx(t, manager, &types.LegacyTx{Nonce: 3, GasPrice: big.NewInt(100), Gas: 21000, To: &to})
+
+		backend.mined = 3
+		*now = now.Add(2 * time.Minute)
+		require.NoError(t, manager.check(context.Background()))
+
+		pending := manager.transactions()
+		require.Len(t, pending, 1)
+		assert.Equal(t, uint64(3), pending[0].Nonce)
+		require.Len(t, backend.sent, 1)
+		assert.Equal(t, uint64(3), backend.sent[0].Nonce())
+	})
+
+	t.Run("should wait for a replacement to be mined", func(t *testing.T) {
+		backend := &fakeTxBackend{receipts: make(map[common.Hash]*types.Receipt)}
+		manager, now := newManager(backend, policy)
+		original := sendTx(t, manager, &types.LegacyTx{GasPrice: big.NewInt(100), Gas: 21000, To: &to})
+
+		*now = now.Add(2 * time.Minute)
+		require.NoError(t, manager.check(context.Background()))
+		require.Len(t, backend.sent, 1)
+
+		replacement := backend.sent[0].Hash()
+		backend.mutex.Lock()
+		backend.receipts[replacement] = &types.Receipt{TxHash: replacement, Status: types.ReceiptStatusSuccessful}
+		backend.mutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		receipt, err := manager.waitMined(ctx, original.Hash())
+		require.NoError(t, err)
+		assert.Equal(t, replacement, receipt.TxHash)
+	})
+}
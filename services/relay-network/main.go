@@ -2,39 +2,146 @@ package main
 
 import (
 	"context"
-	"crypto/ecdsa"
-	"encoding/hex"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/crosspay/relay-network/internal/analytics"
+	"github.com/crosspay/relay-network/internal/batch"
 	"github.com/crosspay/relay-network/internal/config"
+	"github.com/crosspay/relay-network/internal/database"
+	"github.com/crosspay/relay-network/internal/events"
 	"github.com/crosspay/relay-network/internal/handlers"
+	"github.com/crosspay/relay-network/internal/keys"
+	"github.com/crosspay/relay-network/internal/metrics"
 	"github.com/crosspay/relay-network/internal/p2p"
+	"github.com/crosspay/relay-network/internal/pool"
+	"github.com/crosspay/relay-network/internal/sandbox"
+	"github.com/crosspay/relay-network/internal/slashing"
 	"github.com/crosspay/relay-network/internal/validator"
-	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
 )
 
 func main() {
 	cfg := config.Load()
 
-	privateKey, err := loadOrGenerateKey(cfg.KeyPath)
+	if len(os.Args) > 1 && os.Args[1] == "rotate-key" {
+		rotateKey(cfg)
+		return
+	}
+
+	signer, err := keys.Load(cfg.Key)
+	if err != nil {
+		log.Fatalf("Failed to load validator key: %v", err)
+	}
+
+	// In sandbox mode every chain is an in-memory chain the node and the
+	// validators it knows are registered on
+	var chainSandbox *sandbox.Sandbox
+	if cfg.Sandbox.Enabled {
+		validators := []common.Address{signer.Address()}
+		for _, addr := range cfg.P2P.AllowedValidators {
+			if common.IsHexAddress(addr) {
+				validators = append(validators, common.HexToAddress(addr))
+			}
+		}
+		sandboxCtx, stopSandbox := context.WithCancel(context.Background())
+		defer stopSandbox()
+		chainSandbox, err = sandbox.Start(sandboxCtx, cfg, validators)
+		if err != nil {
+			log.Fatalf("Failed to start sandbox chains: %v", err)
+		}
+		defer chainSandbox.Close()
+		log.Printf("Sandbox mode: chain %d served at %s, RelayValidator at %s", cfg.ChainID, cfg.RPCEndpoint, cfg.ContractAddress)
+	}
+
+	db, err := database.Open(cfg.DatabasePath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var reporter *analytics.Reporter
+	if cfg.Analytics.URL != "" {
+		reporter = analytics.NewReporter(cfg.Analytics.URL)
+	}
+
+	// One validator node per chain, sharing the key and the P2P network. The
+	// primary chain's stores are opened first so data from before chains were
+	// configured stays with it.
+	var nodes []*validator.Node
+	for _, chain := range cfg.Chains {
+		node := validator.NewNode(signer, cfg.ForChain(chain))
+		validationStore, err := validator.NewStore(db, chain.ChainID)
+		if err != nil {
+			log.Fatalf("Failed to initialize validation store for chain %d: %v", chain.ChainID, err)
+		}
+		node.SetStore(validationStore)
+		if reporter != nil {
+			node.SetReporter(reporter)
+		}
+		nodes = append(nodes, node)
+	}
+	chains := validator.NewChains(nodes...)
+	validatorNode := chains.Primary()
+
+	evidenceStore, err := slashing.NewStore(db)
 	if err != nil {
-		log.Fatalf("Failed to load private key: %v", err)
+		log.Fatalf("Failed to initialize slashing store: %v", err)
+	}
+	self := signer.Address()
+	var watched []common.Address
+	for _, addr := range cfg.P2P.AllowedValidators {
+		if common.IsHexAddress(addr) && common.HexToAddress(addr) != self {
+			watched = append(watched, common.HexToAddress(addr))
+		}
 	}
+	validatorNode.SetSlashingWatcher(slashing.NewWatcher(evidenceStore, watched, cfg.Slashing.MaxMissedRequests))
 
-	validatorNode := validator.NewNode(privateKey, cfg)
-	p2pNetwork := p2p.NewNetwork(cfg.P2P, validatorNode)
+	p2pNetwork, err := p2p.NewNetwork(cfg.P2P, chains, signer)
+	if err != nil {
+		log.Fatalf("Failed to create P2P network: %v", err)
+	}
+	for _, chain := range cfg.Chains {
+		if common.IsHexAddress(chain.ContractAddress) {
+			p2pNetwork.SetValidatorSet(chains.ActiveValidators)
+			break
+		}
+	}
 	
 	if err := p2pNetwork.Start(); err != nil {
 		log.Fatalf("Failed to start P2P network: %v", err)
 	}
+	chains.SetNetwork(p2pNetwork)
+
+	nodeCtx, stopNode := context.WithCancel(context.Background())
+	defer stopNode()
+	for i, chain := range cfg.Chains {
+		startChain(nodeCtx, db, nodes[i], cfg.ForChain(chain))
+	}
 
-	handler := handlers.NewHandler(validatorNode, p2pNetwork)
+	validators := make([]handlers.ValidatorNode, len(nodes))
+	for i, node := range nodes {
+		validators[i] = node
+	}
+	handler := handlers.NewHandler(validators, p2pNetwork, slashing.NewQueue(evidenceStore, validatorNode))
+
+	admin, err := auth.New("relay-network", cfg.Admin)
+	if err != nil {
+		log.Fatalf("Failed to open admin audit log: %v", err)
+	}
+	defer admin.Close()
 	
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /health", handler.Health)
@@ -42,16 +149,38 @@ func main() {
 	mux.HandleFunc("POST /validate", handler.RequestValidation)
 	mux.HandleFunc("POST /sign", handler.SignMessage)
 	mux.HandleFunc("GET /peers", handler.GetPeers)
-	mux.HandleFunc("POST /register", handler.RegisterValidator)
+	mux.HandleFunc("GET /validations/{id}/stream", handler.StreamValidation)
+	mux.Handle("POST /register", admin.Require("relay.validator.register", auth.RoleOperator)(http.HandlerFunc(handler.RegisterValidator)))
+	mux.Handle("POST /deregister", admin.Require("relay.validator.deregister", auth.RoleOperator)(http.HandlerFunc(handler.DeregisterValidator)))
+	mux.HandleFunc("GET /registration", handler.GetRegistration)
+	mux.HandleFunc("GET /transactions/pending", handler.GetPendingTransactions)
+	mux.Handle("GET /slashing/evidence", admin.Require("relay.slashing.list", auth.Roles...)(http.HandlerFunc(handler.ListEvidence)))
+	mux.Handle("POST /slashing/evidence/{id}/approve", admin.Require("relay.slashing.approve", auth.RoleOperator)(http.HandlerFunc(handler.ApproveEvidence)))
+	mux.Handle("POST /slashing/evidence/{id}/reject", admin.Require("relay.slashing.reject", auth.RoleOperator)(http.HandlerFunc(handler.RejectEvidence)))
+	mux.Handle("GET /admin/audit", admin.AuditHandler())
+	mux.Handle("GET /metrics", metrics.DefaultRegistry.Handler())
+	if chainSandbox != nil {
+		mux.HandleFunc("POST /sandbox/rpc", chainSandbox.RPC)
+		mux.HandleFunc("POST /sandbox/validation-requests", chainSandbox.RequestValidation)
+		mux.HandleFunc("POST /sandbox/mine", chainSandbox.Mine)
+	}
+
+	metrics.NewGaugeFunc(metrics.DefaultRegistry, "relay_peers", "Connected P2P peers", func() float64 {
+		return float64(p2pNetwork.GetPeerCount())
+	})
+
+	if cfg.PprofAddress != "" {
+		go servePprof(cfg.PprofAddress)
+	}
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", cfg.Port),
-		Handler: mux,
+		Handler: problem.Adapt(mux),
 	}
 
 	go func() {
 		log.Printf("Starting validator node on port %d", cfg.Port)
-		log.Printf("Validator address: %s", crypto.PubkeyToAddress(privateKey.PublicKey).Hex())
+		log.Printf("Validator address: %s", signer.Address().Hex())
 		
 		if err := server.ListenAndServe(); err != http.ErrServerClosed {
 			log.Fatalf("Server failed: %v", err)
@@ -75,26 +204,113 @@ func main() {
 	log.Println("Validator node stopped")
 }
 
-func loadOrGenerateKey(keyPath string) (*ecdsa.PrivateKey, error) {
-	if keyPath != "" {
-		keyData, err := os.ReadFile(keyPath)
-		if err == nil {
-			keyHex := string(keyData)
-			return crypto.HexToECDSA(keyHex)
+// startChain restores and starts the node for one chain and, when the chain
+// has a contract, its connection pool, batch processor and event listener
+func startChain(ctx context.Context, db *sql.DB, node *validator.Node, chainCfg *config.Config) {
+	eventsCfg := chainCfg.Events
+	chain := strconv.FormatInt(chainCfg.ChainID, 10)
+	metrics.PendingValidations.SetFunc(func() float64 {
+		return float64(node.GetPendingValidationCount())
+	}, chain)
+	metrics.PendingTransactions.SetFunc(func() float64 {
+		return float64(len(node.PendingTransactions()))
+	}, chain)
+
+	if err := node.Restore(); err != nil {
+		log.Fatalf("Failed to restore validation state for chain %d: %v", chainCfg.ChainID, err)
+	}
+	if err := node.Start(ctx); err != nil {
+		log.Printf("Warning: validator running without connection to chain %d: %v", chainCfg.ChainID, err)
+	}
+
+	if !common.IsHexAddress(chainCfg.ContractAddress) {
+		return
+	}
+
+	connPool := pool.NewConnectionPool(chainCfg.RPCEndpoint, 4, 5*time.Minute)
+	go func() {
+		<-ctx.Done()
+		connPool.Close()
+	}()
+	go connPool.StartCleanup(ctx)
+
+	processor := batch.NewBatchProcessor(eventsCfg.BatchSize, time.Duration(eventsCfg.BatchTimeoutSeconds)*time.Second, node.ProcessBatch)
+	processor.SetHighValueLane(eventsCfg.HighValueBatchSize, time.Duration(eventsCfg.HighValueBatchTimeoutMs)*time.Millisecond, eventsCfg.StarvationLimit)
+	processor.SetAdaptive(eventsCfg.MaxBatchSize, time.Duration(eventsCfg.TargetBatchLatencyMs)*time.Millisecond)
+	processor.SetChain(chainCfg.ChainID)
+
+	policy := batch.OverflowPolicy(eventsCfg.OverflowPolicy)
+	var spill batch.Spill
+	if policy == batch.OverflowSpill {
+		spillStore, err := batch.NewSpillStore(db, chainCfg.ChainID)
+		if err != nil {
+			log.Fatalf("Failed to initialize batch spill store for chain %d: %v", chainCfg.ChainID, err)
 		}
+		spill = spillStore
+	}
+	if err := processor.SetOverflow(eventsCfg.QueueSize, policy, spill); err != nil {
+		log.Fatalf("Invalid batch queue settings: %v", err)
 	}
+	processor.Start(ctx)
+
+	listener := events.NewListener(connPool, common.HexToAddress(chainCfg.ContractAddress), processor, eventsCfg)
+	listener.OnRevert = node.RevertValidationRequests
+	go listener.Run(ctx)
+}
 
-	privateKey, err := crypto.GenerateKey()
+// servePprof serves the runtime profiles on their own listener, so they are
+// only reachable where PPROF_ADDR is bound
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	log.Printf("Serving pprof on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("pprof server failed: %v", err)
+	}
+}
+
+// rotateKey moves the on-chain registration from the KEY_* key to the
+// NEW_KEY_* key and exits. The node should be stopped while this runs.
+func rotateKey(cfg *config.Config) {
+	if !common.IsHexAddress(cfg.ContractAddress) {
+		log.Fatal("CONTRACT_ADDRESS is required for key rotation")
+	}
+
+	if cfg.NewKey.Backend == "file" && cfg.NewKey.Path == "" {
+		log.Fatal("NEW_KEY_PATH is required, otherwise the stake would move to a key that is never saved")
+	}
+
+	oldSigner, err := keys.Load(cfg.Key)
+	if err != nil {
+		log.Fatalf("Failed to load current key: %v", err)
+	}
+	newSigner, err := keys.Load(cfg.NewKey)
 	if err != nil {
-		return nil, err
+		log.Fatalf("Failed to load new key: %v", err)
+	}
+	if oldSigner.Address() == newSigner.Address() {
+		log.Fatal("New key must differ from the current key")
 	}
 
-	if keyPath != "" {
-		keyHex := hex.EncodeToString(crypto.FromECDSA(privateKey))
-		if err := os.WriteFile(keyPath, []byte(keyHex), 0600); err != nil {
-			log.Printf("Warning: Could not save key to %s: %v", keyPath, err)
-		}
+	client, err := ethclient.Dial(cfg.RPCEndpoint)
+	if err != nil {
+		log.Fatalf("Failed to connect to %s: %v", cfg.RPCEndpoint, err)
 	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
 
-	return privateKey, nil
-}
\ No newline at end of file
+	rotation, err := validator.RotateKey(ctx, client, common.HexToAddress(cfg.ContractAddress), oldSigner, newSigner, cfg.ChainID)
+	if rotation != nil {
+		json.NewEncoder(os.Stdout).Encode(rotation)
+	}
+	if err != nil {
+		log.Fatalf("Key rotation failed: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/config"
+	"github.com/arcbjorn/crosspay/packages/distributed"
+	"github.com/arcbjorn/crosspay/packages/flags"
+)
+
+// Config holds the worker's settings, loaded from the file at CONFIG_FILE
+// and the environment
+type Config struct {
+	Port         string `config:"port" env:"PORT" default:"8080" validate:"required"`
+	DatabasePath string `config:"database_path" env:"DATABASE_PATH" default:"./storage.db" validate:"required"`
+
+	// CORSAllowedOrigins may call the API from a browser, "*" for any
+	CORSAllowedOrigins []string `config:"cors_allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	// RequestTimeout bounds the routes that wait on Filecoin or the oracle
+	RequestTimeout time.Duration `config:"request_timeout" env:"REQUEST_TIMEOUT" default:"30s" validate:"min=1s"`
+
+	Backends struct {
+		Synapse struct {
+			APIURL  string `config:"api_url" env:"SYNAPSE_API_URL" validate:"url"`
+			APIKey  string `config:"api_key" env:"SYNAPSE_API_KEY" secret:"true"`
+			Network string `config:"network" env:"FILECOIN_NETWORK"`
+		} `config:"synapse"`
+		S3 struct {
+			Endpoint        string `config:"endpoint" env:"S3_ENDPOINT" validate:"url"`
+			Region          string `config:"region" env:"S3_REGION"`
+			Bucket          string `config:"bucket" env:"S3_BUCKET"`
+			Prefix          string `config:"prefix" env:"S3_PREFIX"`
+			AccessKeyID     string `config:"access_key_id" env:"S3_ACCESS_KEY_ID"`
+			SecretAccessKey string `config:"secret_access_key" env:"S3_SECRET_ACCESS_KEY" secret:"true"`
+			PathStyle       bool   `config:"path_style" env:"S3_PATH_STYLE"`
+		} `config:"s3"`
+		Pinata struct {
+			JWT        string `config:"jwt" env:"PINATA_JWT" secret:"true"`
+			APIURL     string `config:"api_url" env:"PINATA_API_URL" validate:"url"`
+			GatewayURL string `config:"gateway_url" env:"PINATA_GATEWAY_URL" validate:"url"`
+		} `config:"pinata"`
+		Web3Storage struct {
+			Token      string `config:"token" env:"WEB3STORAGE_TOKEN" secret:"true"`
+			APIURL     string `config:"api_url" env:"WEB3STORAGE_API_URL" validate:"url"`
+			GatewayURL string `config:"gateway_url" env:"WEB3STORAGE_GATEWAY_URL" validate:"url"`
+		} `config:"web3storage"`
+		Policies   string   `config:"policies" env:"STORAGE_POLICIES"`
+		VerifyCIDs bool     `config:"verify_cids" env:"STORAGE_VERIFY_CIDS" default:"true"`
+		ReadOrder  []string `config:"read_order" env:"STORAGE_READ_ORDER" default:"s3"`
+	} `config:"backends"`
+
+	Scanning struct {
+		ClamAVAddr string `config:"clamav_addr" env:"CLAMAV_ADDR"`
+		FailOpen   bool   `config:"fail_open" env:"STORAGE_SCAN_FAIL_OPEN"`
+	} `config:"scanning"`
+
+	Pricing struct {
+		OracleURL    string        `config:"oracle_url" env:"ORACLE_SERVICE_URL" default:"http://localhost:8081" validate:"url"`
+		CacheTTL     time.Duration `config:"cache_ttl" env:"FIL_PRICE_CACHE_TTL" default:"1m" validate:"min=0s"`
+		FallbackRate float64       `config:"fallback_rate" env:"FIL_USD_FALLBACK_RATE" validate:"min=0"`
+	} `config:"pricing"`
+
+	Retention struct {
+		Policies   string        `config:"policies" env:"STORAGE_RETENTION"`
+		GCInterval time.Duration `config:"gc_interval" env:"STORAGE_GC_INTERVAL" default:"1h" validate:"min=1s"`
+	} `config:"retention"`
+
+	// Quotas are keyed by API key, so they are redacted too
+	Quotas struct {
+		Default string `config:"default" env:"STORAGE_QUOTA_DEFAULT"`
+		APIKeys string `config:"api_keys" env:"STORAGE_API_QUOTAS" secret:"true"`
+	} `config:"quotas"`
+
+	Export struct {
+		URLSecret string        `config:"url_secret" env:"EXPORT_URL_SECRET" secret:"true"`
+		URLTTL    time.Duration `config:"url_ttl" env:"EXPORT_URL_TTL" default:"24h" validate:"min=1s"`
+		BaseURL   string        `config:"base_url" env:"EXPORT_BASE_URL" validate:"url"`
+	} `config:"export"`
+
+	Receipts struct {
+		Template      string `config:"template" env:"RECEIPT_TEMPLATE" default:"default"`
+		VerifyBaseURL string `config:"verify_base_url" env:"RECEIPT_VERIFY_BASE_URL" default:"https://crosspay.app" validate:"url"`
+		LogoDir       string `config:"logo_dir" env:"RECEIPT_LOGO_DIR"`
+		// LocaleDir holds extra <tag>.json label catalogs and FontDir the
+		// TrueType fonts of locales outside Latin-1
+		LocaleDir       string   `config:"locale_dir" env:"RECEIPT_LOCALE_DIR"`
+		FontDir         string   `config:"font_dir" env:"RECEIPT_FONT_DIR"`
+		SignerKey       string   `config:"signer_key" env:"RECEIPT_SIGNER_KEY" secret:"true"`
+		SignerAllowlist []string `config:"signer_allowlist" env:"RECEIPT_SIGNER_ALLOWLIST"`
+		// ChainRPCURLs and PaymentCoreAddresses are chainID=value lists of
+		// the chains receipts' transactions are checked on
+		ChainRPCURLs         string `config:"chain_rpc_urls" env:"RECEIPT_CHAIN_RPC_URLS"`
+		PaymentCoreAddresses string `config:"payment_core_addresses" env:"RECEIPT_PAYMENT_CORE_ADDRESSES"`
+		// VerifyRateLimit is how many public verifications a client may
+		// request per minute, 0 for no limit
+		VerifyRateLimit int `config:"verify_rate_limit" env:"RECEIPT_VERIFY_RATE_LIMIT" default:"60" validate:"min=0"`
+	} `config:"receipts"`
+
+	Analytics struct {
+		// URL is the analytics service receipt generation is reported to
+		URL string `config:"url" env:"ANALYTICS_URL" validate:"url"`
+	} `config:"analytics"`
+
+	Admin auth.Config `config:"admin"`
+	// Coordination shares locks and rate limits between replicas
+	Coordination distributed.Config `config:"coordination"`
+	// Flags roll risky features, such as PDF receipts, out per merchant
+	Flags flags.Config `config:"flags"`
+}
+
+// loadConfig loads and validates the worker's settings
+func loadConfig() (*Config, *config.Result, error) {
+	var cfg Config
+	result, err := config.Load(&cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := pdfTemplates[cfg.Receipts.Template]; !ok {
+		return nil, nil, &config.Error{File: result.File, Problems: []string{
+			fmt.Sprintf("receipts.template: unknown template %q", cfg.Receipts.Template),
+		}}
+	}
+	return &cfg, result, nil
+}
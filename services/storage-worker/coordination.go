@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+
+	"github.com/arcbjorn/crosspay/packages/distributed"
+)
+
+// coordinator holds the locks and rate limits shared by the worker's
+// replicas. Nothing is locked or limited while it is nil, as in tests.
+var coordinator *distributed.Coordinator
+
+// initCoordination connects to the Redis server at REDIS_URL the replicas
+// share. Without it locks and limits only hold within this process.
+func initCoordination(cfg *Config) error {
+	coord, err := distributed.New("storage-worker", cfg.Coordination)
+	if err != nil {
+		return err
+	}
+	coordinator = coord
+	log.Printf("Storage locks and rate limits enabled (shared through Redis: %t)", coord.Distributed())
+	return nil
+}
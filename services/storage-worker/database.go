@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	_ "modernc.org/sqlite"
+)
+
+var db *sql.DB
+
+func openStorageDB(dbPath string) error {
+	var err error
+	db, err = sql.Open("sqlite", dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// Each connection to an in-memory database is a separate database
+	if dbPath == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := createStorageTables(); err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	log.Printf("SQLite database initialized: %s", dbPath)
+	return nil
+}
+
+func createStorageTables() error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS receipts (
+		id TEXT PRIMARY KEY,
+		cid TEXT NOT NULL,
+		payment_id INTEGER NOT NULL,
+		merchant TEXT NOT NULL,
+		format TEXT NOT NULL,
+		language TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		signer TEXT,
+		chain_id INTEGER,
+		created_at INTEGER NOT NULL,
+		erased_at INTEGER
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_receipts_payment_id ON receipts(payment_id);
+	CREATE INDEX IF NOT EXISTS idx_receipts_merchant ON receipts(merchant);
+	CREATE INDEX IF NOT EXISTS idx_receipts_created_at ON receipts(created_at);
+	CREATE INDEX IF NOT EXISTS idx_receipts_cid ON receipts(cid);
+
+	CREATE TABLE IF NOT EXISTS storage_jobs (
+		id TEXT PRIMARY KEY,
+		type TEXT NOT NULL,
+		status TEXT NOT NULL,
+		filename TEXT,
+		payment_id INTEGER,
+		options TEXT,
+		data BLOB,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL DEFAULT 3,
+		error TEXT,
+		result TEXT,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_storage_jobs_status ON storage_jobs(status);
+	CREATE INDEX IF NOT EXISTS idx_storage_jobs_created_at ON storage_jobs(created_at);
+
+	CREATE TABLE IF NOT EXISTS stored_objects (
+		cid TEXT PRIMARY KEY,
+		class TEXT NOT NULL,
+		filename TEXT,
+		size INTEGER NOT NULL,
+		backend TEXT NOT NULL,
+		replicas TEXT,
+		legal_hold INTEGER NOT NULL DEFAULT 0,
+		legal_hold_reason TEXT,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER,
+		deleted_at INTEGER,
+		sha256 TEXT,
+		ref_count INTEGER NOT NULL DEFAULT 1
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_stored_objects_expires_at ON stored_objects(expires_at);
+
+	CREATE TABLE IF NOT EXISTS storage_usage (
+		caller TEXT NOT NULL,
+		period TEXT NOT NULL,
+		bytes_stored INTEGER NOT NULL DEFAULT 0,
+		bytes_retrieved INTEGER NOT NULL DEFAULT 0,
+		deal_cost REAL NOT NULL DEFAULT 0,
+		uploads INTEGER NOT NULL DEFAULT 0,
+		retrievals INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (caller, period)
+	);
+
+	CREATE TABLE IF NOT EXISTS quarantined_files (
+		id TEXT PRIMARY KEY,
+		sha256 TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		threat TEXT NOT NULL,
+		engine TEXT NOT NULL,
+		caller TEXT NOT NULL,
+		data BLOB NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS receipt_templates (
+		merchant TEXT PRIMARY KEY,
+		footer_text TEXT NOT NULL DEFAULT '',
+		hidden_fields TEXT NOT NULL DEFAULT '[]',
+		custom_fields TEXT NOT NULL DEFAULT '{}',
+		logo BLOB,
+		logo_type TEXT,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	return migrateStorageTables()
+}
+
+// migrateStorageTables brings tables created by earlier versions up to date
+func migrateStorageTables() error {
+	if err := addColumnIfMissing("stored_objects", "sha256", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("stored_objects", "ref_count", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("receipts", "erased_at", "INTEGER"); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_stored_objects_sha256 ON stored_objects(sha256)`)
+	return err
+}
+
+func addColumnIfMissing(table, column, definition string) error {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count); err != nil {
+		return fmt.Errorf("failed to inspect %s: %w", table, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+func closeDB() error {
+	if db != nil {
+		return db.Close()
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
+)
+
+var dedupHitsTotal uint64
+
+// contentHash returns the hex SHA-256 of data, used to find duplicate uploads
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// findObjectByHash returns the live object holding content with the given
+// hash, or errObjectNotFound
+func findObjectByHash(hash string) (*StoredObject, error) {
+	var cid string
+	err := db.QueryRow(`
+		SELECT cid FROM stored_objects
+		WHERE sha256 = ? AND deleted_at IS NULL AND ref_count > 0
+		ORDER BY created_at ASC LIMIT 1`, hash,
+	).Scan(&cid)
+	if err == sql.ErrNoRows {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up content hash: %w", err)
+	}
+	return getStoredObject(cid)
+}
+
+// putDeduplicated stores data through the router unless identical content is
+// already stored on every backend the class policy writes to, in which case
+// the existing object is returned at no cost. Content stored under a weaker
+// policy is written again to the backends it is missing from. Either way the
+// caller adds a reference with trackObject.
+func putDeduplicated(ctx context.Context, data []byte, opts backend.PutOptions) (*backend.PutResult, string, bool, error) {
+	hash := contentHash(data)
+
+	existing, err := findObjectByHash(hash)
+	if err == nil && storedUnder(existing, opts.Class) {
+		atomic.AddUint64(&dedupHitsTotal, 1)
+		return &backend.PutResult{
+			Backend:   existing.Backend,
+			CID:       existing.CID,
+			Size:      existing.Size,
+			Cost:      "0.000000",
+			Replicas:  existing.Replicas,
+			Metadata:  opts.Metadata,
+			CreatedAt: time.Now(),
+		}, hash, true, nil
+	}
+	if err != nil && err != errObjectNotFound {
+		return nil, "", false, err
+	}
+
+	result, err := storage.router.Put(ctx, data, opts)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return result, hash, false, nil
+}
+
+// storedUnder reports whether obj is on every backend the policy of class
+// writes to
+func storedUnder(obj *StoredObject, class string) bool {
+	policy, err := storage.router.Policy(class)
+	if err != nil {
+		return false
+	}
+	held := map[string]bool{obj.Backend: true}
+	for _, name := range obj.Replicas {
+		held[name] = true
+	}
+	for _, name := range append([]string{policy.Primary}, policy.Replicas...) {
+		if !held[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// releaseObject drops one reference to cid. GC deletes the content once no
+// references remain.
+func releaseObject(cid string) (*StoredObject, error) {
+	res, err := db.Exec(`
+		UPDATE stored_objects SET ref_count = MAX(ref_count - 1, 0)
+		WHERE cid = ? AND deleted_at IS NULL`, cid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to release object: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, errObjectNotFound
+	}
+	return getStoredObject(cid)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadDeduplication(t *testing.T) {
+	initializeStorageService()
+
+	upload := func(filename string) UploadResponse {
+		w := uploadFile(t, filename, "same receipt bytes", "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response UploadResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	first := upload("receipt.json")
+	second := upload("receipt-copy.json")
+
+	assert.False(t, first.Deduplicated)
+	assert.True(t, second.Deduplicated)
+	assert.Equal(t, first.CID, second.CID)
+	assert.Equal(t, "0.000000", second.Cost)
+
+	obj, err := getStoredObject(first.CID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, obj.RefCount)
+	assert.Equal(t, contentHash([]byte("same receipt bytes")), obj.SHA256)
+
+	t.Run("should keep shared content until every reference is released", func(t *testing.T) {
+		release := func() {
+			w := httptest.NewRecorder()
+			httpReq, _ := http.NewRequest("DELETE", "/api/storage/objects/"+first.CID, nil)
+			handleObject(w, httpReq)
+			require.Equal(t, http.StatusOK, w.Code)
+		}
+
+		release()
+		result, err := runGC(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 0, result.Deleted)
+
+		release()
+		result, err = runGC(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Deleted)
+
+		_, err = testBackend.Get(context.Background(), first.CID)
+		assert.ErrorIs(t, err, backend.ErrNotFound)
+	})
+
+	t.Run("should store collected content again", func(t *testing.T) {
+		third := upload("receipt.json")
+		assert.False(t, third.Deduplicated)
+
+		obj, err := getStoredObject(third.CID)
+		require.NoError(t, err)
+		assert.Equal(t, 1, obj.RefCount)
+		assert.Nil(t, obj.DeletedAt)
+	})
+}
+
+func TestDeduplicationAcrossClasses(t *testing.T) {
+	initializeStorageService()
+	durable := backend.NewMemoryBackend("durable")
+	storage.router.Register(durable)
+	require.NoError(t, storage.router.SetPolicy(backend.Policy{Class: "attachment", Primary: "memory"}))
+	require.NoError(t, storage.router.SetPolicy(backend.Policy{Class: "receipt", Primary: "memory", Replicas: []string{"durable"}}))
+
+	store := func(class string) bool {
+		data := []byte("content shared between classes")
+		result, hash, deduplicated, err := putDeduplicated(context.Background(), data, backend.PutOptions{Filename: "a.json", Class: class})
+		require.NoError(t, err)
+		_, err = trackObject(result, class, "a.json", hash)
+		require.NoError(t, err)
+		return deduplicated
+	}
+
+	t.Run("should store content again under a policy it is not on yet", func(t *testing.T) {
+		assert.False(t, store("attachment"))
+		assert.False(t, store("receipt"))
+
+		cid := backend.RawCID([]byte("content shared between classes"))
+		_, err := durable.Get(context.Background(), cid)
+		require.NoError(t, err)
+
+		obj, err := getStoredObject(cid)
+		require.NoError(t, err)
+		assert.Equal(t, "receipt", obj.Class)
+		assert.Equal(t, []string{"durable"}, obj.Replicas)
+		assert.Equal(t, 2, obj.RefCount)
+	})
+
+	t.Run("should deduplicate under a policy the content is already on", func(t *testing.T) {
+		assert.True(t, store("attachment"))
+		assert.True(t, store("receipt"))
+	})
+}
+
+func TestMigrateStoredObjects(t *testing.T) {
+	initializeStorageService()
+
+	// A table from before content hashing existed
+	_, err := db.Exec(`DROP TABLE stored_objects; CREATE TABLE stored_objects (
+		cid TEXT PRIMARY KEY, class TEXT NOT NULL, filename TEXT, size INTEGER NOT NULL,
+		backend TEXT NOT NULL, replicas TEXT, legal_hold INTEGER NOT NULL DEFAULT 0,
+		legal_hold_reason TEXT, created_at INTEGER NOT NULL, expires_at INTEGER, deleted_at INTEGER)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO stored_objects (cid, class, size, backend, created_at) VALUES ('bafyold', 'receipt', 1, 'memory', 0)`)
+	require.NoError(t, err)
+
+	require.NoError(t, migrateStorageTables())
+
+	obj, err := getStoredObject("bafyold")
+	require.NoError(t, err)
+	assert.Equal(t, 1, obj.RefCount)
+}
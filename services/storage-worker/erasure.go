@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Erasing a data subject's receipts releases the stored receipt documents,
+// which carry their ENS names and memos, so GC deletes them, and marks their
+// registry entries erased. Documents under legal hold are released too but
+// kept until the hold is lifted; they are reported so the caller can record
+// them as retained.
+
+// ReceiptErasure reports the receipts an erasure released
+type ReceiptErasure struct {
+	Receipts int      `json:"receipts"`
+	Released []string `json:"released"`
+	Held     []string `json:"held"`
+}
+
+// eraseReceipts erases the receipts of paymentIDs and those issued by
+// merchant, when set. Receipts already erased are skipped, so a retried
+// request reports only what it released itself.
+func eraseReceipts(merchant string, paymentIDs []uint64) (*ReceiptErasure, error) {
+	var conditions []string
+	var args []interface{}
+	if merchant != "" {
+		conditions = append(conditions, "merchant = ?")
+		args = append(args, strings.ToLower(merchant))
+	}
+	if len(paymentIDs) > 0 {
+		conditions = append(conditions, "payment_id IN (?"+strings.Repeat(", ?", len(paymentIDs)-1)+")")
+		for _, id := range paymentIDs {
+			args = append(args, id)
+		}
+	}
+	if len(conditions) == 0 {
+		return nil, errors.New("address or payment_ids is required")
+	}
+
+	rows, err := db.Query(`SELECT id, cid FROM receipts WHERE erased_at IS NULL AND (`+strings.Join(conditions, " OR ")+`)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select receipts: %w", err)
+	}
+	type erasable struct{ id, cid string }
+	var receipts []erasable
+	for rows.Next() {
+		var receipt erasable
+		if err := rows.Scan(&receipt.id, &receipt.cid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &ReceiptErasure{Released: []string{}, Held: []string{}}
+	for _, receipt := range receipts {
+		obj, err := releaseObject(receipt.cid)
+		switch {
+		case errors.Is(err, errObjectNotFound):
+			// Already collected
+		case err != nil:
+			return result, err
+		case obj.LegalHold:
+			result.Held = append(result.Held, receipt.cid)
+		default:
+			result.Released = append(result.Released, receipt.cid)
+		}
+
+		if _, err := db.Exec(`UPDATE receipts SET erased_at = ? WHERE id = ?`, time.Now().Unix(), receipt.id); err != nil {
+			return result, fmt.Errorf("failed to mark receipt erased: %w", err)
+		}
+		result.Receipts++
+	}
+
+	log.Printf("Erased %d receipts (%d held)", result.Receipts, len(result.Held))
+	return result, nil
+}
+
+func handleEraseReceipts(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Address    string   `json:"address"`
+		PaymentIDs []uint64 `json:"payment_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+	if (request.Address == "" && len(request.PaymentIDs) == 0) || (request.Address != "" && !common.IsHexAddress(request.Address)) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "A valid address or payment_ids is required"})
+		return
+	}
+
+	result, err := eraseReceipts(request.Address, request.PaymentIDs)
+	if err != nil {
+		log.Printf("Failed to erase receipts: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to erase receipts"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
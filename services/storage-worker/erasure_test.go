@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEraseReceipts(t *testing.T) {
+	const merchant = "0x00000000000000000000000000000000000000b2"
+
+	// storeReceipt stores a receipt document for paymentID and registers it
+	storeReceipt := func(t *testing.T, paymentID uint64, merchant string) string {
+		cid, err := storeObject(context.Background(), []byte(fmt.Sprintf(`{"payment_id": %d}`, paymentID)), "receipt.json", "receipt")
+		require.NoError(t, err)
+		require.NoError(t, saveReceiptRecord(&ReceiptRecord{
+			ReceiptID: newReceiptID(paymentID),
+			CID:       cid,
+			PaymentID: paymentID,
+			Merchant:  merchant,
+			Format:    "json",
+			Language:  "en",
+			CreatedAt: time.Now(),
+		}))
+		return cid
+	}
+
+	t.Run("should release the receipts of the payments and the merchant", func(t *testing.T) {
+		initializeStorageService()
+		paid := storeReceipt(t, 1, "0x00000000000000000000000000000000000000b3")
+		issued := storeReceipt(t, 2, merchant)
+		held := storeReceipt(t, 3, merchant)
+		other := storeReceipt(t, 4, "0x00000000000000000000000000000000000000b3")
+		_, err := setLegalHold(held, true, "tax audit")
+		require.NoError(t, err)
+
+		result, err := eraseReceipts("0x00000000000000000000000000000000000000B2", []uint64{1})
+		require.NoError(t, err)
+		assert.Equal(t, 3, result.Receipts)
+		assert.ElementsMatch(t, []string{paid, issued}, result.Released)
+		assert.Equal(t, []string{held}, result.Held)
+
+		records, total, err := listReceiptRecords(ReceiptFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, 1, total)
+		assert.Equal(t, other, records[0].CID)
+
+		_, err = runGC(context.Background())
+		require.NoError(t, err)
+		for _, cid := range []string{paid, issued} {
+			_, err = testBackend.Get(context.Background(), cid)
+			assert.ErrorIs(t, err, backend.ErrNotFound)
+		}
+		for _, cid := range []string{held, other} {
+			_, err = testBackend.Get(context.Background(), cid)
+			assert.NoError(t, err)
+		}
+
+		// Erased receipts are not released twice
+		result, err = eraseReceipts(merchant, []uint64{1})
+		require.NoError(t, err)
+		assert.Zero(t, result.Receipts)
+	})
+
+	t.Run("should answer the erase endpoint", func(t *testing.T) {
+		initializeStorageService()
+		cid := storeReceipt(t, 5, merchant)
+
+		w := httptest.NewRecorder()
+		handleEraseReceipts(w, httptest.NewRequest(http.MethodPost, "/api/receipts/erase", strings.NewReader(`{"payment_ids": [5]}`)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var result ReceiptErasure
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+		assert.Equal(t, []string{cid}, result.Released)
+
+		for _, body := range []string{`{}`, `{"address": "shop.eth"}`, `not json`} {
+			w = httptest.NewRecorder()
+			handleEraseReceipts(w, httptest.NewRequest(http.MethodPost, "/api/receipts/erase", strings.NewReader(body)))
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+	})
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+)
+
+// ExportRequest asks for a ZIP of a merchant's receipts in a date range
+type ExportRequest struct {
+	Merchant string `json:"merchant"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// exportManifestEntry describes one receipt in an export bundle
+type exportManifestEntry struct {
+	ReceiptID string    `json:"receipt_id"`
+	CID       string    `json:"cid"`
+	PaymentID uint64    `json:"payment_id"`
+	Format    string    `json:"format"`
+	Files     []string  `json:"files"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	exportSecret     []byte
+	exportSecretOnce sync.Once
+
+	// exportURLTTL is how long export download links stay valid
+	exportURLTTL  = 24 * time.Hour
+	exportBaseURL string
+)
+
+// initExports applies EXPORT_URL_SECRET, EXPORT_URL_TTL and EXPORT_BASE_URL
+func initExports(cfg *Config) {
+	if cfg.Export.URLSecret != "" {
+		exportSecret = []byte(cfg.Export.URLSecret)
+	}
+	exportURLTTL = cfg.Export.URLTTL
+	exportBaseURL = strings.TrimSuffix(cfg.Export.BaseURL, "/")
+}
+
+// getExportSecret returns the HMAC key download URLs are signed with
+func getExportSecret() []byte {
+	exportSecretOnce.Do(func() {
+		if exportSecret != nil {
+			return
+		}
+
+		log.Println("Warning: EXPORT_URL_SECRET not set, export links will not survive a restart")
+		// In production, this should be an error
+		exportSecret = make([]byte, 32)
+		if _, err := rand.Read(exportSecret); err != nil {
+			log.Fatalf("Failed to generate export secret: %v", err)
+		}
+	})
+	return exportSecret
+}
+
+func exportSignature(jobID string, expires int64) string {
+	mac := hmac.New(sha256.New, getExportSecret())
+	fmt.Fprintf(mac, "%s|%d", jobID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signExportURL returns a download link for an export job valid until expires
+func signExportURL(jobID string, expires time.Time) string {
+	return fmt.Sprintf("%s/api/receipts/export/download/%s?expires=%d&signature=%s",
+		exportBaseURL, jobID, expires.Unix(), exportSignature(jobID, expires.Unix()))
+}
+
+func handleExportReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	var req ExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+		return
+	}
+
+	if req.Merchant == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Merchant required"})
+		return
+	}
+	if _, err := parseTimeParam(req.From); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("invalid from: %v", err)})
+		return
+	}
+	if _, err := parseRangeEnd(req.To); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("invalid to: %v", err)})
+		return
+	}
+
+	job := &StorageJob{
+		Type: "export",
+		Options: map[string]interface{}{
+			"merchant": strings.ToLower(req.Merchant),
+			"from":     req.From,
+			"to":       req.To,
+		},
+	}
+	if err := queue.AddJob(r.Context(), job); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Failed to queue export: %v", err)})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id":     job.ID,
+		"status":     job.Status,
+		"status_url": "/api/storage/jobs/" + job.ID,
+	})
+}
+
+// processExportJob bundles the merchant's receipts into a ZIP. JSON receipts
+// are also rendered as PDF so every receipt is available in both formats.
+func (sq *StorageQueue) processExportJob(job *StorageJob) (*JobResult, error) {
+	merchant, _ := job.Options["merchant"].(string)
+	if merchant == "" {
+		return nil, fmt.Errorf("invalid merchant in job options")
+	}
+
+	fromValue, _ := job.Options["from"].(string)
+	toValue, _ := job.Options["to"].(string)
+	from, err := parseTimeParam(fromValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from: %w", err)
+	}
+	to, err := parseRangeEnd(toValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid to: %w", err)
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	manifest := []exportManifestEntry{}
+
+	filter := ReceiptFilter{Merchant: merchant, From: from, To: to, Limit: 500}
+	for {
+		records, _, err := listReceiptRecords(filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			files, err := addReceiptToArchive(sq.ctx, archive, record)
+			if err != nil {
+				return nil, fmt.Errorf("receipt %s: %w", record.ReceiptID, err)
+			}
+			manifest = append(manifest, exportManifestEntry{
+				ReceiptID: record.ReceiptID,
+				CID:       record.CID,
+				PaymentID: record.PaymentID,
+				Format:    record.Format,
+				Files:     files,
+				CreatedAt: record.CreatedAt,
+			})
+		}
+
+		if len(records) < filter.Limit {
+			break
+		}
+		filter.Offset += len(records)
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeZipEntry(archive, "manifest.json", manifestData); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize archive: %w", err)
+	}
+
+	filename := fmt.Sprintf("receipts_%s_%s.zip", merchant, time.Now().UTC().Format("20060102"))
+	cid, err := storeObject(sq.ctx, buf.Bytes(), filename, "export")
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(exportURLTTL)
+
+	return &JobResult{
+		CID:  cid,
+		Size: int64(buf.Len()),
+		Cost: calculateStorageCost(int64(buf.Len())),
+		Metadata: map[string]string{
+			"filename":     filename,
+			"merchant":     merchant,
+			"receipts":     strconv.Itoa(len(manifest)),
+			"download_url": signExportURL(job.ID, expires),
+			"expires_at":   expires.UTC().Format(time.RFC3339),
+		},
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func addReceiptToArchive(ctx context.Context, archive *zip.Writer, record ReceiptRecord) ([]string, error) {
+	data, _, err := retrieveObject(ctx, record.CID)
+	if err != nil {
+		return nil, err
+	}
+
+	name := record.ReceiptID + "." + record.Format
+	if err := writeZipEntry(archive, name, data); err != nil {
+		return nil, err
+	}
+	files := []string{name}
+
+	if record.Format == "json" {
+		var receipt Receipt
+		if err := json.Unmarshal(data, &receipt); err != nil {
+			return nil, fmt.Errorf("invalid receipt JSON: %w", err)
+		}
+		pdf, err := generatePDFReceipt(&receipt)
+		if err != nil {
+			return nil, err
+		}
+		pdfName := record.ReceiptID + ".pdf"
+		if err := writeZipEntry(archive, pdfName, pdf); err != nil {
+			return nil, err
+		}
+		files = append(files, pdfName)
+	}
+
+	return files, nil
+}
+
+func writeZipEntry(archive *zip.Writer, name string, data []byte) error {
+	entry, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to add %s: %w", name, err)
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+// handleDownloadExport serves a finished export through its signed link
+func handleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	jobID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/receipts/export/download/"), "/")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	signature := r.URL.Query().Get("signature")
+
+	if jobID == "" || err != nil || !hmac.Equal([]byte(signature), []byte(exportSignature(jobID, expires))) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid download link", "code": problem.CodeInvalidLink})
+		return
+	}
+	if time.Now().Unix() > expires {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Download link expired", "code": problem.CodeLinkExpired})
+		return
+	}
+
+	job, err := queue.GetJob(jobID)
+	if err != nil || job.Type != "export" || job.Status != "completed" || job.Result == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Export not found"})
+		return
+	}
+
+	data, _, err := retrieveObject(r.Context(), job.Result.CID)
+	if err != nil {
+		writeRetrievalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filepath.Base(job.Result.Metadata["filename"])))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportReceipts(t *testing.T) {
+	sq := newTestQueue(t)
+
+	merchant := "0x0987654321098765432109876543210987654321"
+	for i, payment := range []*PaymentData{
+		{ID: 1, Recipient: merchant, Amount: "100", Status: "completed", ChainID: 1135},
+		{ID: 2, Recipient: merchant, Amount: "200", Status: "completed", ChainID: 1135},
+		{ID: 3, Recipient: "0x1111111111111111111111111111111111111111", Amount: "300", Status: "completed", ChainID: 1135},
+	} {
+		receipt, err := generateReceipt(payment, "json", "en")
+		require.NoError(t, err)
+		data, _ := json.Marshal(receipt)
+		cid, err := storeObject(context.Background(), data, "receipt.json", "receipt")
+		require.NoError(t, err)
+		record, err := recordReceipt(receipt, cid, int64(len(data)))
+		require.NoError(t, err)
+		_, err = db.Exec(`UPDATE receipts SET created_at = ? WHERE id = ?`, time.Date(2024, 3, i+1, 0, 0, 0, 0, time.UTC).Unix(), record.ReceiptID)
+		require.NoError(t, err)
+	}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/api/receipts/export", handleExportReceipts)
+	router.HandleFunc("/api/receipts/export/download/", handleDownloadExport)
+
+	w := httptest.NewRecorder()
+	httpReq, _ := http.NewRequest("POST", "/api/receipts/export",
+		bytes.NewBufferString(`{"merchant":"0x`+strings.ToUpper(merchant[2:])+`","from":"2024-03-01","to":"2024-03-31"}`))
+	router.ServeHTTP(w, httpReq)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	var queued map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &queued))
+
+	sq.processJob(<-sq.pending, 0)
+
+	job, err := sq.GetJob(queued["job_id"])
+	require.NoError(t, err)
+	require.Equal(t, "completed", job.Status, job.Error)
+	assert.Equal(t, "2", job.Result.Metadata["receipts"])
+
+	downloadURL := job.Result.Metadata["download_url"]
+	require.NotEmpty(t, downloadURL)
+
+	t.Run("should download the bundle through the signed link", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("GET", downloadURL, nil)
+		router.ServeHTTP(w, httpReq)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+
+		archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		require.NoError(t, err)
+
+		var names []string
+		for _, file := range archive.File {
+			names = append(names, file.Name)
+		}
+		assert.Len(t, names, 5, "two receipts as JSON and PDF plus the manifest")
+		assert.Contains(t, names, "manifest.json")
+	})
+
+	t.Run("should reject tampered links", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("GET", strings.Replace(downloadURL, "expires=", "expires=9", 1), nil)
+		router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("should reject expired links", func(t *testing.T) {
+		expired := signExportURL(job.ID, time.Now().Add(-time.Minute))
+
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("GET", expired, nil)
+		router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusGone, w.Code)
+	})
+
+	t.Run("should require a merchant", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("POST", "/api/receipts/export", bytes.NewBufferString(`{"from":"2024-03-01"}`))
+		router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
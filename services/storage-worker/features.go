@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+
+	"github.com/arcbjorn/crosspay/packages/flags"
+)
+
+// Feature flags of the worker
+const (
+	// flagPDFReceipts renders receipts asked for as PDF with the PDF engine.
+	// Merchants it is off for get JSON receipts instead.
+	flagPDFReceipts = "pdf_receipts"
+)
+
+var defaultFlags = []flags.Flag{
+	{Name: flagPDFReceipts, Description: "Render receipts asked for as PDF with the PDF engine", Enabled: true},
+}
+
+// features holds the defaults until initFeatureFlags loads the configured
+// providers
+var features = mustFlags(flags.NewSet(defaultFlags))
+
+func mustFlags(set *flags.Set, err error) *flags.Set {
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// initFeatureFlags loads the flags from FEATURE_FLAGS_FILE,
+// FEATURE_FLAGS_URL and FLAG_<NAME> variables
+func initFeatureFlags(cfg *Config) error {
+	set, err := flags.New(cfg.Flags, defaultFlags...)
+	if err != nil {
+		return err
+	}
+	features = set
+	for _, f := range set.Status().Flags {
+		log.Printf("Feature flag %s: enabled=%t percentage=%g merchants=%d (%s)", f.Name, f.Enabled, f.Percentage, len(f.Merchants), f.Source)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Text directions of a locale
+const (
+	DirectionLTR = "ltr"
+	DirectionRTL = "rtl"
+)
+
+const defaultLocale = "en"
+
+// receiptLabels holds the translated strings printed on a receipt
+type receiptLabels struct {
+	Title        string `json:"title"`
+	PaymentID    string `json:"payment_id"`
+	From         string `json:"from"`
+	To           string `json:"to"`
+	Amount       string `json:"amount"`
+	Fee          string `json:"fee"`
+	Token        string `json:"token"`
+	Status       string `json:"status"`
+	Created      string `json:"created"`
+	Completed    string `json:"completed"`
+	Transaction  string `json:"transaction"`
+	Network      string `json:"network"`
+	OraclePrice  string `json:"oracle_price"`
+	Generated    string `json:"generated"`
+	Signature    string `json:"signature"`
+	ScanToVerify string `json:"scan_to_verify"`
+}
+
+// receiptLocale is a catalog of receipt labels in one language. Scripts
+// outside Latin-1 need a TrueType Font from RECEIPT_FONT_DIR to be printed
+// on PDF receipts.
+type receiptLocale struct {
+	Tag       string        `json:"tag"`
+	Name      string        `json:"name"`
+	Direction string        `json:"direction"`
+	Font      string        `json:"font,omitempty"`
+	Labels    receiptLabels `json:"labels"`
+
+	// fontPath is the font file found for Font
+	fontPath string
+}
+
+// pdfReady reports whether PDF receipts can be printed in the locale
+func (l *receiptLocale) pdfReady() bool {
+	return l.Font == "" || l.fontPath != ""
+}
+
+// LocaleInfo describes a supported locale to clients
+type LocaleInfo struct {
+	Tag       string `json:"tag"`
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	// PDF is false when the locale's font is missing, so PDF receipts fall
+	// back to English
+	PDF bool `json:"pdf"`
+}
+
+var receiptCatalog = map[string]*receiptLocale{
+	"en": {
+		Tag:       "en",
+		Name:      "English",
+		Direction: DirectionLTR,
+		Labels: receiptLabels{
+			Title:        "CrossPay Payment Receipt",
+			PaymentID:    "Payment ID",
+			From:         "From",
+			To:           "To",
+			Amount:       "Amount",
+			Fee:          "Fee",
+			Token:        "Token",
+			Status:       "Status",
+			Created:      "Created",
+			Completed:    "Completed",
+			Transaction:  "Transaction",
+			Network:      "Network",
+			OraclePrice:  "Oracle Price",
+			Generated:    "Generated",
+			Signature:    "Signature",
+			ScanToVerify: "Scan to verify this receipt",
+		},
+	},
+	"es": {
+		Tag:       "es",
+		Name:      "Español",
+		Direction: DirectionLTR,
+		Labels: receiptLabels{
+			Title:        "Recibo de Pago CrossPay",
+			PaymentID:    "ID de Pago",
+			From:         "De",
+			To:           "Para",
+			Amount:       "Importe",
+			Fee:          "Comisión",
+			Token:        "Token",
+			Status:       "Estado",
+			Created:      "Creado",
+			Completed:    "Completado",
+			Transaction:  "Transacción",
+			Network:      "Red",
+			OraclePrice:  "Precio del Oráculo",
+			Generated:    "Generado",
+			Signature:    "Firma",
+			ScanToVerify: "Escanee para verificar este recibo",
+		},
+	},
+	"fr": {
+		Tag:       "fr",
+		Name:      "Français",
+		Direction: DirectionLTR,
+		Labels: receiptLabels{
+			Title:        "Reçu de Paiement CrossPay",
+			PaymentID:    "ID de Paiement",
+			From:         "De",
+			To:           "À",
+			Amount:       "Montant",
+			Fee:          "Frais",
+			Token:        "Jeton",
+			Status:       "Statut",
+			Created:      "Créé",
+			Completed:    "Terminé",
+			Transaction:  "Transaction",
+			Network:      "Réseau",
+			OraclePrice:  "Prix de l'Oracle",
+			Generated:    "Généré",
+			Signature:    "Signature",
+			ScanToVerify: "Scannez pour vérifier ce reçu",
+		},
+	},
+	"de": {
+		Tag:       "de",
+		Name:      "Deutsch",
+		Direction: DirectionLTR,
+		Labels: receiptLabels{
+			Title:        "CrossPay Zahlungsbeleg",
+			PaymentID:    "Zahlungs-ID",
+			From:         "Von",
+			To:           "An",
+			Amount:       "Betrag",
+			Fee:          "Gebühr",
+			Token:        "Token",
+			Status:       "Status",
+			Created:      "Erstellt",
+			Completed:    "Abgeschlossen",
+			Transaction:  "Transaktion",
+			Network:      "Netzwerk",
+			OraclePrice:  "Orakelpreis",
+			Generated:    "Erzeugt",
+			Signature:    "Signatur",
+			ScanToVerify: "Scannen, um diesen Beleg zu prüfen",
+		},
+	},
+	"pt": {
+		Tag:       "pt",
+		Name:      "Português",
+		Direction: DirectionLTR,
+		Labels: receiptLabels{
+			Title:        "Recibo de Pagamento CrossPay",
+			PaymentID:    "ID do Pagamento",
+			From:         "De",
+			To:           "Para",
+			Amount:       "Valor",
+			Fee:          "Taxa",
+			Token:        "Token",
+			Status:       "Estado",
+			Created:      "Criado",
+			Completed:    "Concluído",
+			Transaction:  "Transação",
+			Network:      "Rede",
+			OraclePrice:  "Preço do Oráculo",
+			Generated:    "Gerado",
+			Signature:    "Assinatura",
+			ScanToVerify: "Digitalize para verificar este recibo",
+		},
+	},
+	"ja": {
+		Tag:       "ja",
+		Name:      "日本語",
+		Direction: DirectionLTR,
+		Font:      "NotoSansJP-Regular.ttf",
+		Labels: receiptLabels{
+			Title:        "CrossPay 支払い領収書",
+			PaymentID:    "支払いID",
+			From:         "送金元",
+			To:           "送金先",
+			Amount:       "金額",
+			Fee:          "手数料",
+			Token:        "トークン",
+			Status:       "ステータス",
+			Created:      "作成日時",
+			Completed:    "完了日時",
+			Transaction:  "トランザクション",
+			Network:      "ネットワーク",
+			OraclePrice:  "オラクル価格",
+			Generated:    "発行日時",
+			Signature:    "署名",
+			ScanToVerify: "スキャンしてこの領収書を検証",
+		},
+	},
+}
+
+// initReceiptLocales adds the catalogs in RECEIPT_LOCALE_DIR, one
+// <tag>.json file per locale, and finds the fonts locales need in
+// RECEIPT_FONT_DIR. A catalog replaces the built-in one of its tag.
+func initReceiptLocales(cfg *Config) error {
+	if dir := cfg.Receipts.LocaleDir; dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			locale, err := loadReceiptLocale(path)
+			if err != nil {
+				return err
+			}
+			receiptCatalog[locale.Tag] = locale
+		}
+	}
+
+	for _, locale := range receiptCatalog {
+		locale.fontPath = ""
+		if locale.Font == "" || cfg.Receipts.FontDir == "" {
+			continue
+		}
+		path := filepath.Join(cfg.Receipts.FontDir, locale.Font)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		locale.fontPath = path
+	}
+	for _, locale := range receiptCatalog {
+		if !locale.pdfReady() {
+			log.Printf("Warning: font %s not found, PDF receipts in %s are printed in English", locale.Font, locale.Tag)
+		}
+	}
+
+	log.Printf("Receipt locales: %s", strings.Join(receiptLocaleTags(), ", "))
+	return nil
+}
+
+// loadReceiptLocale reads a catalog named after its tag. Labels it leaves
+// out are English.
+func loadReceiptLocale(path string) (*receiptLocale, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	locale := &receiptLocale{Labels: receiptCatalog[defaultLocale].Labels}
+	if err := json.Unmarshal(data, locale); err != nil {
+		return nil, fmt.Errorf("invalid locale catalog %s: %w", path, err)
+	}
+
+	locale.Tag = strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".json"))
+	if locale.Name == "" {
+		locale.Name = locale.Tag
+	}
+	switch locale.Direction {
+	case "":
+		locale.Direction = DirectionLTR
+	case DirectionLTR, DirectionRTL:
+	default:
+		return nil, fmt.Errorf("invalid direction %q in locale catalog %s", locale.Direction, path)
+	}
+	return locale, nil
+}
+
+// localeFor returns the locale of a language tag such as "es" or "pt-BR",
+// falling back to English
+func localeFor(language string) *receiptLocale {
+	tag := strings.ToLower(language)
+	if locale, ok := receiptCatalog[tag]; ok {
+		return locale
+	}
+	if base, _, found := strings.Cut(tag, "-"); found {
+		if locale, ok := receiptCatalog[base]; ok {
+			return locale
+		}
+	}
+	return receiptCatalog[defaultLocale]
+}
+
+// labelsFor returns the labels for a language tag, falling back to English
+func labelsFor(language string) receiptLabels {
+	return localeFor(language).Labels
+}
+
+func receiptLocaleTags() []string {
+	tags := make([]string, 0, len(receiptCatalog))
+	for tag := range receiptCatalog {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// handleListLocales lists the languages receipts can be generated in
+func handleListLocales(w http.ResponseWriter, r *http.Request) {
+	locales := []LocaleInfo{}
+	for _, tag := range receiptLocaleTags() {
+		locale := receiptCatalog[tag]
+		locales = append(locales, LocaleInfo{
+			Tag:       locale.Tag,
+			Name:      locale.Name,
+			Direction: locale.Direction,
+			PDF:       locale.pdfReady(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default": defaultLocale,
+		"locales": locales,
+	})
+}
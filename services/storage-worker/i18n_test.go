@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withLocaleDir loads catalogs from a directory of files for the test and
+// restores the built-in catalog afterwards
+func withLocaleDir(t *testing.T, files map[string]string) {
+	dir := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	builtin := make(map[string]*receiptLocale)
+	for tag, locale := range receiptCatalog {
+		copied := *locale
+		builtin[tag] = &copied
+	}
+	t.Cleanup(func() { receiptCatalog = builtin })
+
+	cfg := &Config{}
+	cfg.Receipts.LocaleDir = dir
+	require.NoError(t, initReceiptLocales(cfg))
+}
+
+func TestReceiptLocales(t *testing.T) {
+	t.Run("should resolve languages to their catalog", func(t *testing.T) {
+		assert.Equal(t, "金額", labelsFor("ja").Amount)
+		assert.Equal(t, "ja", localeFor("ja-JP").Tag)
+		assert.Equal(t, "en", localeFor("zz").Tag)
+	})
+
+	t.Run("should load catalogs with English for missing labels", func(t *testing.T) {
+		withLocaleDir(t, map[string]string{
+			"he.json": `{"name": "עברית", "direction": "rtl", "font": "NotoSansHebrew-Regular.ttf", "labels": {"amount": "סכום"}}`,
+		})
+
+		locale := localeFor("he-IL")
+		assert.Equal(t, "he", locale.Tag)
+		assert.Equal(t, DirectionRTL, locale.Direction)
+		assert.Equal(t, "סכום", locale.Labels.Amount)
+		assert.Equal(t, "Fee", locale.Labels.Fee)
+		assert.False(t, locale.pdfReady())
+	})
+
+	t.Run("should reject catalogs with an unknown direction", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "xx.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"direction": "ttb"}`), 0o644))
+		_, err := loadReceiptLocale(path)
+		assert.Error(t, err)
+	})
+
+	t.Run("should store the resolved language and labels with receipts", func(t *testing.T) {
+		receipt, err := generateReceipt(&PaymentData{ID: 1, Amount: "1", ChainID: 1135}, "json", "pt-BR")
+		require.NoError(t, err)
+		assert.Equal(t, "pt", receipt.Metadata["language"])
+		assert.Equal(t, DirectionLTR, receipt.Metadata["direction"])
+		assert.Equal(t, "Valor", receipt.Labels.Amount)
+	})
+}
+
+func TestLocalizedPDFReceipts(t *testing.T) {
+	receipt := &Receipt{
+		Payment:     PaymentData{ID: 9, Amount: "1000", Status: "completed", ChainID: 1135},
+		GeneratedAt: time.Unix(1700000000, 0),
+		Signature:   "0x00",
+	}
+
+	t.Run("should print in English when the locale's font is missing", func(t *testing.T) {
+		localized := *receipt
+		localized.Metadata = map[string]string{"language": "ja"}
+
+		pdfData, err := generatePDFReceipt(&localized)
+		require.NoError(t, err)
+		assert.Contains(t, pdfText(t, pdfData), "CrossPay Payment Receipt")
+	})
+
+	t.Run("should lay out right-to-left locales", func(t *testing.T) {
+		withLocaleDir(t, map[string]string{"rtl.json": `{"direction": "rtl", "labels": {"title": "Kvittering"}}`})
+		localized := *receipt
+		localized.Metadata = map[string]string{"language": "rtl"}
+
+		pdfData, err := generatePDFReceipt(&localized)
+		require.NoError(t, err)
+		assert.Contains(t, pdfText(t, pdfData), "Kvittering")
+	})
+}
+
+func TestHandleListLocales(t *testing.T) {
+	t.Run("should list locales and whether PDFs can be printed in them", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleListLocales(w, httptest.NewRequest(http.MethodGet, "/api/receipts/locales", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Default string       `json:"default"`
+			Locales []LocaleInfo `json:"locales"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, "en", response.Default)
+
+		tags := map[string]LocaleInfo{}
+		for _, locale := range response.Locales {
+			tags[locale.Tag] = locale
+		}
+		for _, tag := range []string{"en", "es", "fr", "de", "pt", "ja"} {
+			assert.Contains(t, tags, tag)
+		}
+		assert.True(t, tags["de"].PDF)
+		assert.False(t, tags["ja"].PDF)
+		assert.Equal(t, "日本語", tags["ja"].Name)
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JobFilter narrows a job listing. Zero values match everything.
+type JobFilter struct {
+	Status string
+	Type   string
+	Limit  int
+	Offset int
+}
+
+const jobColumns = `id, type, status, filename, payment_id, options, data, attempts, max_attempts, error, result, created_at, updated_at`
+
+func saveJob(job *StorageJob) error {
+	options, err := json.Marshal(job.Options)
+	if err != nil {
+		return fmt.Errorf("failed to encode job options: %w", err)
+	}
+
+	var result []byte
+	if job.Result != nil {
+		if result, err = json.Marshal(job.Result); err != nil {
+			return fmt.Errorf("failed to encode job result: %w", err)
+		}
+	}
+
+	job.UpdatedAt = time.Now()
+
+	_, err = db.Exec(`
+		INSERT INTO storage_jobs (`+jobColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			status = excluded.status,
+			data = excluded.data,
+			attempts = excluded.attempts,
+			error = excluded.error,
+			result = excluded.result,
+			updated_at = excluded.updated_at`,
+		job.ID, job.Type, job.Status, job.Filename, job.PaymentID, string(options), job.Data,
+		job.Attempts, job.MaxAttempts, job.Error, string(result),
+		job.CreatedAt.UnixNano(), job.UpdatedAt.UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save job: %w", err)
+	}
+	return nil
+}
+
+func loadJob(jobID string) (*StorageJob, error) {
+	row := db.QueryRow(`SELECT `+jobColumns+` FROM storage_jobs WHERE id = ?`, jobID)
+
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, errJobNotFound
+	}
+	return job, err
+}
+
+// loadUnfinishedJobs returns jobs that were pending or processing, oldest first
+func loadUnfinishedJobs() ([]*StorageJob, error) {
+	rows, err := db.Query(`
+		SELECT ` + jobColumns + ` FROM storage_jobs
+		WHERE status IN ('pending', 'processing')
+		ORDER BY created_at ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*StorageJob
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func listJobs(filter JobFilter) ([]*StorageJob, int, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Type != "" {
+		conditions = append(conditions, "type = ?")
+		args = append(args, filter.Type)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM storage_jobs"+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count jobs: %w", err)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	rows, err := db.Query(`SELECT `+jobColumns+` FROM storage_jobs`+where+
+		` ORDER BY created_at DESC LIMIT ? OFFSET ?`, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []*StorageJob{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, total, rows.Err()
+}
+
+func countJobsByStatus() (map[string]int, error) {
+	rows, err := db.Query(`SELECT status, COUNT(*) FROM storage_jobs GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+func scanJob(row rowScanner) (*StorageJob, error) {
+	var job StorageJob
+	var filename, options, jobError, result sql.NullString
+	var paymentID sql.NullInt64
+	var createdAt, updatedAt int64
+
+	err := row.Scan(&job.ID, &job.Type, &job.Status, &filename, &paymentID, &options, &job.Data,
+		&job.Attempts, &job.MaxAttempts, &jobError, &result, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Filename = filename.String
+	job.PaymentID = uint64(paymentID.Int64)
+	job.Error = jobError.String
+	job.CreatedAt = time.Unix(0, createdAt)
+	job.UpdatedAt = time.Unix(0, updatedAt)
+
+	if options.String != "" {
+		if err := json.Unmarshal([]byte(options.String), &job.Options); err != nil {
+			return nil, fmt.Errorf("corrupt options for job %s: %w", job.ID, err)
+		}
+	}
+	if result.String != "" {
+		job.Result = &JobResult{}
+		if err := json.Unmarshal([]byte(result.String), job.Result); err != nil {
+			return nil, fmt.Errorf("corrupt result for job %s: %w", job.ID, err)
+		}
+	}
+
+	return &job, nil
+}
+
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	query := r.URL.Query()
+	filter := JobFilter{
+		Status: query.Get("status"),
+		Type:   query.Get("type"),
+	}
+	filter.Limit, _ = strconv.Atoi(query.Get("limit"))
+	filter.Offset, _ = strconv.Atoi(query.Get("offset"))
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+
+	jobs, total, err := listJobs(filter)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to list jobs"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"jobs":  jobs,
+		"count": len(jobs),
+		"total": total,
+	})
+}
+
+// handleJob serves GET /api/storage/jobs/{id} and POST /api/storage/jobs/{id}/cancel
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/storage/jobs/"), "/")
+	jobID, action, _ := strings.Cut(path, "/")
+	if jobID == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Job ID required"})
+		return
+	}
+
+	var job *StorageJob
+	var err error
+
+	switch {
+	case action == "" && r.Method == "GET":
+		job, err = queue.GetJob(jobID)
+	case action == "cancel" && r.Method == "POST":
+		job, err = queue.CancelJob(jobID)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errJobNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, errJobNotCancelable):
+			status = http.StatusConflict
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
@@ -9,47 +9,179 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/arcbjorn/crosspay/packages/auth"
+	"github.com/arcbjorn/crosspay/packages/middleware"
+	"github.com/arcbjorn/crosspay/packages/problem"
 )
 
 func main() {
 	log.Println("Starting CrossPay Storage Worker...")
 
+	cfg, settings, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Initialize SynapseSDK client
-	initStorage()
+	initStorage(cfg)
+
+	// Open the receipt registry
+	if err := openStorageDB(cfg.DatabasePath); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer closeDB()
+
+	// Resume persisted storage jobs
+	if err := initQueue(); err != nil {
+		log.Fatalf("Failed to start storage queue: %v", err)
+	}
+	defer queue.Stop()
+
+	// Per-key quotas
+	if err := initQuotas(cfg); err != nil {
+		log.Fatalf("Failed to load storage quotas: %v", err)
+	}
+
+	// Malware scanning of uploads
+	initScanner(cfg)
+
+	// FIL/USD pricing for cost estimates
+	initPricing(cfg)
+
+	// Expire objects past their class retention
+	if err := initRetention(cfg); err != nil {
+		log.Fatalf("Failed to load retention policies: %v", err)
+	}
+	// Locks and rate limits shared with the other replicas
+	if err := initCoordination(cfg); err != nil {
+		log.Fatalf("Failed to set up coordination: %v", err)
+	}
+	defer coordinator.Close()
+	gcCtx, stopGC := context.WithCancel(context.Background())
+	defer stopGC()
+	go runGCWorker(gcCtx, cfg.Retention.GCInterval)
+
+	// Feature flags, refreshed in the background
+	if err := initFeatureFlags(cfg); err != nil {
+		log.Fatalf("Failed to load feature flags: %v", err)
+	}
+	flagsCtx, stopFlags := context.WithCancel(context.Background())
+	defer stopFlags()
+	go features.Run(flagsCtx)
+
+	// Load the receipt signing key
+	if err := initReceiptSigner(cfg); err != nil {
+		log.Fatalf("Failed to initialize receipt signer: %v", err)
+	}
+	initReceiptRendering(cfg)
+	if err := initReceiptLocales(cfg); err != nil {
+		log.Fatalf("Failed to load receipt locales: %v", err)
+	}
+	initExports(cfg)
+	initReceiptReporting(cfg)
+
+	// Chains receipt transactions are checked on
+	if err := initReceiptVerification(cfg); err != nil {
+		log.Fatalf("Failed to set up receipt verification: %v", err)
+	}
+
+	admin, err := auth.New("storage-worker", cfg.Admin)
+	if err != nil {
+		log.Fatalf("Failed to open admin audit log: %v", err)
+	}
+	defer admin.Close()
 
 	mux := http.NewServeMux()
 	
 	// Health check endpoint
-	mux.HandleFunc("/health", corsHandler(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "healthy",
 			"service": "storage-worker",
 			"timestamp": time.Now().Unix(),
+			"flags": features.Status(),
 		})
-	}))
+	})
+
+	// Prometheus metrics
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	// Effective configuration, secrets redacted
+	mux.HandleFunc("/config", settings.Handler())
+
+	// Feature flags, and with ?merchant= which are on for a merchant
+	mux.HandleFunc("/flags", features.Handler())
+
+	// Routes that wait on Filecoin or the oracle give up after
+	// REQUEST_TIMEOUT
+	timeout := middleware.Timeout(cfg.RequestTimeout)
 
 	// Storage endpoints
-	mux.HandleFunc("/api/storage/upload", corsHandler(handleUpload))
-	mux.HandleFunc("/api/storage/retrieve/", corsHandler(handleRetrieve))
-	mux.HandleFunc("/api/storage/cost/", corsHandler(handleCostEstimate))
-	mux.HandleFunc("/api/storage/files", corsHandler(handleListFiles))
-	mux.HandleFunc("/api/storage/pin/", corsHandler(handlePinToIPFS))
-	mux.HandleFunc("/api/storage/deal-status/", corsHandler(handleDealStatus))
-	mux.HandleFunc("/api/storage/network/info", corsHandler(handleNetworkInfo))
+	mux.HandleFunc("/api/storage/upload", handleUpload)
+	mux.HandleFunc("/api/storage/retrieve/", handleRetrieve)
+	mux.Handle("/api/storage/cost/", timeout(http.HandlerFunc(handleCostEstimate)))
+	mux.HandleFunc("/api/storage/files", handleListFiles)
+	mux.HandleFunc("/api/storage/pin/", handlePinToIPFS)
+	mux.Handle("/api/storage/deal-status/", timeout(http.HandlerFunc(handleDealStatus)))
+	mux.Handle("/api/storage/network/info", timeout(http.HandlerFunc(handleNetworkInfo)))
+	mux.HandleFunc("/api/storage/backends", handleListBackends)
+	mux.HandleFunc("/api/storage/jobs/", handleJob)
+	mux.HandleFunc("/api/storage/objects/", handleObject)
+	mux.HandleFunc("/api/storage/retention", handleRetentionPolicies)
+	mux.HandleFunc("/api/storage/usage", handleUsage)
+
+	// Admin endpoints, which need an admin token with one of the roles
+	mux.Handle("/api/storage/jobs", admin.Require("storage.jobs.list", auth.Roles...)(http.HandlerFunc(handleListJobs)))
+	mux.Handle("POST /api/storage/jobs/{id}/cancel", admin.Require("storage.jobs.cancel", auth.RoleOperator, auth.RoleSupport)(http.HandlerFunc(handleJob)))
+	mux.Handle("/api/storage/gc", admin.Require("storage.gc.run", auth.RoleOperator)(http.HandlerFunc(handleRunGC)))
+	mux.Handle("DELETE /api/storage/objects/{cid}", admin.Require("storage.objects.release", auth.RoleOperator)(http.HandlerFunc(handleObject)))
+	mux.Handle("POST /api/storage/objects/{cid}/legal-hold", admin.Require("storage.objects.legal_hold", auth.RoleOperator)(http.HandlerFunc(handleObject)))
+	mux.Handle("/api/storage/quarantine", admin.Require("storage.quarantine.list", auth.Roles...)(http.HandlerFunc(handleQuarantine)))
+	mux.Handle("/api/storage/quarantine/", admin.Require("storage.quarantine.list", auth.Roles...)(http.HandlerFunc(handleQuarantine)))
+	mux.Handle("DELETE /api/storage/quarantine/{id}", admin.Require("storage.quarantine.delete", auth.RoleOperator)(http.HandlerFunc(handleQuarantine)))
+	mux.Handle("/admin/audit", admin.AuditHandler())
 
 	// Receipt endpoints
-	mux.HandleFunc("/api/receipts/generate", corsHandler(handleGenerateReceipt))
-	mux.HandleFunc("/api/receipts/download/", corsHandler(handleDownloadReceipt))
-	mux.HandleFunc("/api/receipts/verify/", corsHandler(handleVerifyReceipt))
+	mux.Handle("/api/receipts/generate", timeout(http.HandlerFunc(handleGenerateReceipt)))
+	mux.HandleFunc("/api/receipts/download/", handleDownloadReceipt)
+	mux.Handle("/api/receipts/verify/", timeout(http.HandlerFunc(handleVerifyReceipt)))
+	mux.HandleFunc("/api/receipts", handleListReceipts)
+	mux.HandleFunc("/api/receipts/payment/", handleListReceipts)
+	mux.HandleFunc("/api/receipts/merchant/", handleListReceipts)
+	mux.HandleFunc("/api/receipts/export", handleExportReceipts)
+	mux.HandleFunc("/api/receipts/export/download/", handleDownloadExport)
+	mux.HandleFunc("/api/receipts/templates/", handleReceiptTemplate)
+	// Template and logo changes alter what merchants' receipts say and sign,
+	// so only admins may make them
+	mux.Handle("PUT /api/receipts/templates/", admin.Require("storage.templates.update", auth.RoleOperator, auth.RoleSupport)(http.HandlerFunc(handleReceiptTemplate)))
+	mux.Handle("POST /api/receipts/templates/", admin.Require("storage.templates.update", auth.RoleOperator, auth.RoleSupport)(http.HandlerFunc(handleReceiptTemplate)))
+	mux.Handle("DELETE /api/receipts/templates/", admin.Require("storage.templates.delete", auth.RoleOperator, auth.RoleSupport)(http.HandlerFunc(handleReceiptTemplate)))
+	mux.HandleFunc("/api/receipts/locales", handleListLocales)
+	// Erasures are sent by the payment processor with a token of its own
+	mux.Handle("POST /api/receipts/erase", admin.Require("storage.receipts.erase", auth.RoleOperator)(http.HandlerFunc(handleEraseReceipts)))
+
+	// Public receipt verification, without authentication, rate limited by
+	// client IP across replicas
+	verifyLimit := coordinator.RateLimit("verify", cfg.Receipts.VerifyRateLimit, time.Minute, nil)
+	mux.Handle("GET /verify/", verifyLimit(timeout(http.HandlerFunc(handlePublicVerifyReceipt))))
 
 	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+		Addr: ":" + cfg.Port,
+		Handler: middleware.Chain(mux,
+			middleware.Logger(nil),
+			problem.Adapt,
+			middleware.Recover(nil),
+			middleware.CORS(middleware.CORSConfig{
+				AllowedOrigins: cfg.CORSAllowedOrigins,
+				AllowedHeaders: []string{"Content-Type", "Authorization", "X-API-Key"},
+			}),
+		),
 	}
 
 	go func() {
-		log.Println("Storage worker starting on :8080")
+		log.Printf("Storage worker starting on :%s", cfg.Port)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
@@ -70,18 +202,3 @@ func main() {
 	
 	log.Println("Storage worker stopped")
 }
-
-func corsHandler(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(204)
-			return
-		}
-
-		next(w, r)
-	}
-}
\ No newline at end of file
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// handleMetrics exposes service counters in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+
+	failures := storage.router.VerificationFailures()
+	backends := make([]string, 0, len(failures))
+	for name := range failures {
+		backends = append(backends, name)
+	}
+	sort.Strings(backends)
+
+	fmt.Fprintln(w, "# HELP storage_verification_failures_total Retrieved objects rejected because their content did not match the CID.")
+	fmt.Fprintln(w, "# TYPE storage_verification_failures_total counter")
+	for _, name := range backends {
+		fmt.Fprintf(w, "storage_verification_failures_total{backend=%q} %d\n", name, failures[name])
+	}
+
+	fmt.Fprintln(w, "# HELP storage_gc_deleted_objects_total Objects removed by garbage collection after their retention expired.")
+	fmt.Fprintln(w, "# TYPE storage_gc_deleted_objects_total counter")
+	fmt.Fprintf(w, "storage_gc_deleted_objects_total %d\n", atomic.LoadUint64(&gcDeletedTotal))
+
+	fmt.Fprintln(w, "# HELP storage_scan_detections_total Uploads rejected and quarantined by the malware scanner.")
+	fmt.Fprintln(w, "# TYPE storage_scan_detections_total counter")
+	fmt.Fprintf(w, "storage_scan_detections_total %d\n", atomic.LoadUint64(&scanDetections))
+
+	fmt.Fprintln(w, "# HELP storage_dedup_hits_total Uploads served from already stored identical content.")
+	fmt.Fprintln(w, "# TYPE storage_dedup_hits_total counter")
+	fmt.Fprintf(w, "storage_dedup_hits_total %d\n", atomic.LoadUint64(&dedupHitsTotal))
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/skip2/go-qrcode"
+)
+
+// PDFTemplate controls the branding of rendered PDF receipts
+type PDFTemplate struct {
+	Name        string
+	AccentColor [3]int
+	TextColor   [3]int
+	FooterText  string
+}
+
+var pdfTemplates = map[string]PDFTemplate{
+	"default": {
+		Name:        "default",
+		AccentColor: [3]int{0, 255, 136},
+		TextColor:   [3]int{17, 24, 39},
+		FooterText:  "CrossPay Protocol - receipts are stored on Filecoin and signed by the CrossPay storage worker.",
+	},
+	"minimal": {
+		Name:        "minimal",
+		AccentColor: [3]int{55, 65, 81},
+		TextColor:   [3]int{17, 24, 39},
+		FooterText:  "CrossPay Protocol",
+	},
+}
+
+var (
+	// receiptTemplate is the PDF template receipts are rendered with
+	receiptTemplate      = "default"
+	receiptVerifyBaseURL = "https://crosspay.app"
+	receiptLogoDir       string
+)
+
+// initReceiptRendering applies RECEIPT_TEMPLATE, RECEIPT_VERIFY_BASE_URL and
+// RECEIPT_LOGO_DIR
+func initReceiptRendering(cfg *Config) {
+	receiptTemplate = cfg.Receipts.Template
+	receiptVerifyBaseURL = strings.TrimSuffix(cfg.Receipts.VerifyBaseURL, "/")
+	receiptLogoDir = cfg.Receipts.LogoDir
+}
+
+// receiptVerificationURL returns the public URL a receipt QR code points to
+func receiptVerificationURL(paymentID uint64) string {
+	return fmt.Sprintf("%s/receipt/%d", receiptVerifyBaseURL, paymentID)
+}
+
+// merchantLogoPath looks up a logo for the receiving merchant in
+// RECEIPT_LOGO_DIR, named after the lowercase recipient address
+func merchantLogoPath(recipient string) string {
+	dir := receiptLogoDir
+	if dir == "" || recipient == "" {
+		return ""
+	}
+
+	for _, ext := range []string{".png", ".jpg", ".jpeg"} {
+		path := filepath.Join(dir, strings.ToLower(recipient)+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func generatePDFReceipt(receipt *Receipt) ([]byte, error) {
+	log.Printf("Generating PDF receipt for payment %d", receipt.Payment.ID)
+
+	template, ok := pdfTemplates[receiptTemplate]
+	if !ok {
+		template = pdfTemplates["default"]
+	}
+	locale := localeFor(receipt.Metadata["language"])
+	if !locale.pdfReady() {
+		locale = receiptCatalog[defaultLocale]
+	}
+	labels := locale.Labels
+	rtl := locale.Direction == DirectionRTL
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	// Labels, the title and the footer are set in the locale's font when it
+	// has one, and values in the core fonts
+	textFont, text := "Helvetica", tr
+	if locale.fontPath != "" {
+		for _, style := range []string{"", "B", "I"} {
+			pdf.AddUTF8Font("locale", style, locale.fontPath)
+		}
+		textFont, text = "locale", func(s string) string { return s }
+		if rtl {
+			pdf.RTL()
+		}
+	}
+	align := "L"
+	if rtl {
+		align = "R"
+	}
+	pdf.SetTitle(labels.Title, true)
+	pdf.SetAuthor("CrossPay", false)
+	pdf.SetCreator("crosspay-storage-worker", false)
+	pdf.SetCreationDate(receipt.GeneratedAt)
+	pdf.SetMargins(20, 20, 20)
+	pdf.SetAutoPageBreak(true, 20)
+	pdf.AddPage()
+
+	pageWidth, _ := pdf.GetPageSize()
+
+	// Header band
+	pdf.SetFillColor(template.AccentColor[0], template.AccentColor[1], template.AccentColor[2])
+	pdf.Rect(0, 0, pageWidth, 36, "F")
+
+	titleX := 20.0
+	if merchant, err := getMerchantTemplate(receipt.Payment.Recipient); err == nil && merchant.HasLogo {
+		imageType := "PNG"
+		if merchant.LogoType == "image/jpeg" {
+			imageType = "JPG"
+		}
+		options := fpdf.ImageOptions{ImageType: imageType, ReadDpi: true}
+		pdf.RegisterImageOptionsReader("merchant-logo", options, bytes.NewReader(merchant.Logo))
+		pdf.ImageOptions("merchant-logo", 20, 8, 0, 20, false, options, 0, "")
+		titleX = 50
+	} else if logo := merchantLogoPath(receipt.Payment.Recipient); logo != "" {
+		pdf.ImageOptions(logo, 20, 8, 0, 20, false, fpdf.ImageOptions{ReadDpi: true}, 0, "")
+		titleX = 50
+	}
+
+	pdf.SetTextColor(template.TextColor[0], template.TextColor[1], template.TextColor[2])
+	pdf.SetFont(textFont, "B", 20)
+	pdf.SetXY(titleX, 12)
+	pdf.CellFormat(pageWidth-titleX-20, 12, text(labels.Title), "", 0, align, false, 0, "")
+
+	// Payment details, minus the fields the merchant template hides
+	hidden := make(map[string]bool)
+	footerText := template.FooterText
+	var customFields map[string]string
+	if receipt.Branding != nil {
+		for _, field := range receipt.Branding.HiddenFields {
+			hidden[field] = true
+		}
+		if receipt.Branding.FooterText != "" {
+			footerText = receipt.Branding.FooterText
+		}
+		customFields = receipt.Branding.CustomFields
+	}
+
+	// Rows read label then value, from the right in right-to-left locales
+	var rows [][2]string
+	addRow := func(field, label, value string) {
+		if !hidden[field] {
+			rows = append(rows, [2]string{label, value})
+		}
+	}
+	addRow("", labels.PaymentID, fmt.Sprintf("%d", receipt.Payment.ID))
+	addRow("sender", labels.From, partyLabel(receipt.Payment.SenderENS, receipt.Payment.Sender))
+	addRow("", labels.To, partyLabel(receipt.Payment.RecipientENS, receipt.Payment.Recipient))
+	addRow("", labels.Amount, receipt.Payment.Amount)
+	addRow("fee", labels.Fee, receipt.Payment.Fee)
+	addRow("token", labels.Token, receipt.Payment.Token)
+	addRow("", labels.Status, receipt.Payment.Status)
+	addRow("", labels.Created, formatReceiptTime(receipt.Payment.CreatedAt))
+	addRow("completed_at", labels.Completed, formatReceiptTime(receipt.Payment.CompletedAt))
+	addRow("tx_hash", labels.Transaction, receipt.Payment.TxHash)
+	addRow("", labels.Network, getNetworkName(receipt.Payment.ChainID))
+	if receipt.Payment.OraclePrice != "" {
+		addRow("oracle_price", labels.OraclePrice, receipt.Payment.OraclePrice)
+	}
+
+	customKeys := make([]string, 0, len(customFields))
+	for key := range customFields {
+		customKeys = append(customKeys, key)
+	}
+	sort.Strings(customKeys)
+	for _, key := range customKeys {
+		rows = append(rows, [2]string{key, customFields[key]})
+	}
+
+	pdf.SetY(48)
+	for i, row := range rows {
+		fill := i%2 == 0
+		pdf.SetFillColor(243, 244, 246)
+		if rtl {
+			pdf.SetFont("Courier", "", 9)
+			pdf.CellFormat(pageWidth-85, 8, tr(row[1]), "", 0, "R", fill, 0, "")
+			pdf.SetFont(textFont, "B", 10)
+			pdf.CellFormat(45, 8, text(row[0]), "", 1, "R", fill, 0, "")
+			continue
+		}
+		pdf.SetFont(textFont, "B", 10)
+		pdf.CellFormat(45, 8, text(row[0]), "", 0, "L", fill, 0, "")
+		pdf.SetFont("Courier", "", 9)
+		pdf.CellFormat(pageWidth-85, 8, tr(row[1]), "", 1, "L", fill, 0, "")
+	}
+
+	// Verification QR code
+	verifyURL := receiptVerificationURL(receipt.Payment.ID)
+	qr, err := qrcode.Encode(verifyURL, qrcode.Medium, 256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode verification QR code: %w", err)
+	}
+
+	// The QR code sits opposite the text beside it
+	qrX, textX := pageWidth-60, 20.0
+	if rtl {
+		qrX, textX = 20, 70
+	}
+	qrY := pdf.GetY() + 10
+	pdf.RegisterImageOptionsReader("verification-qr", fpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(qr))
+	pdf.ImageOptions("verification-qr", qrX, qrY, 40, 40, false, fpdf.ImageOptions{ImageType: "PNG"}, 0, verifyURL)
+
+	line := func(height float64, value string) {
+		pdf.SetX(textX)
+		pdf.CellFormat(pageWidth-90, height, value, "", 1, align, false, 0, "")
+	}
+	block := func(height float64, value string) {
+		pdf.SetX(textX)
+		pdf.MultiCell(pageWidth-90, height, value, "", align, false)
+	}
+
+	pdf.SetY(qrY)
+	pdf.SetFont(textFont, "B", 10)
+	line(6, text(labels.ScanToVerify))
+	pdf.SetFont("Courier", "", 8)
+	block(4, verifyURL)
+
+	pdf.Ln(4)
+	pdf.SetFont(textFont, "B", 10)
+	line(6, text(labels.Generated))
+	pdf.SetFont("Courier", "", 8)
+	line(4, receipt.GeneratedAt.UTC().Format(time.RFC3339))
+
+	pdf.Ln(2)
+	pdf.SetFont(textFont, "B", 10)
+	line(6, text(labels.Signature))
+	pdf.SetFont("Courier", "", 7)
+	block(3.5, receipt.Signature)
+
+	// Footer
+	pdf.SetY(-25)
+	pdf.SetFont(textFont, "I", 8)
+	pdf.SetTextColor(107, 114, 128)
+	pdf.MultiCell(0, 4, text(footerText), "T", "C", false)
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, fmt.Errorf("failed to render PDF: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func partyLabel(ens, address string) string {
+	if ens == "" {
+		return address
+	}
+	return fmt.Sprintf("%s (%s)", ens, address)
+}
+
+func formatReceiptTime(unix int64) string {
+	if unix == 0 {
+		return "-"
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by a backend that does not hold the requested object
+var ErrNotFound = errors.New("object not found")
+
+// Backend is a storage provider that can persist and return objects by CID
+type Backend interface {
+	// Name returns the identifier used in policies and results
+	Name() string
+	// Put stores data and returns the CID the object is addressable by.
+	// When opts.CID is set the backend stores the object under that CID
+	// instead of deriving its own (used for replicas of a primary copy).
+	Put(ctx context.Context, data []byte, opts PutOptions) (*PutResult, error)
+	// Get returns the object stored under cid
+	Get(ctx context.Context, cid string) (*Object, error)
+}
+
+// Deleter is implemented by backends that can remove or unpin an object.
+// Backends without it (such as web3.storage) keep data until their own
+// expiry.
+type Deleter interface {
+	// Delete removes the object stored under cid. Deleting an object the
+	// backend does not hold returns ErrNotFound.
+	Delete(ctx context.Context, cid string) error
+}
+
+// PutOptions contains options for storing an object
+type PutOptions struct {
+	CID          string            `json:"cid,omitempty"`
+	Filename     string            `json:"filename"`
+	ContentType  string            `json:"content_type"`
+	Class        string            `json:"class"`
+	DealDuration int               `json:"deal_duration"`
+	PinToIPFS    bool              `json:"pin_to_ipfs"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+// PutResult contains the result of storing an object on a single backend
+type PutResult struct {
+	Backend   string            `json:"backend"`
+	CID       string            `json:"cid"`
+	Size      int64             `json:"size"`
+	Cost      string            `json:"cost"`
+	DealID    string            `json:"deal_id,omitempty"`
+	Replicas  []string          `json:"replicas,omitempty"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// Object is a stored object returned from a backend
+type Object struct {
+	Backend     string            `json:"backend"`
+	CID         string            `json:"cid"`
+	Data        []byte            `json:"data"`
+	Filename    string            `json:"filename"`
+	ContentType string            `json:"content_type"`
+	Size        int64             `json:"size"`
+	Metadata    map[string]string `json:"metadata"`
+	RetrievedAt time.Time         `json:"retrieved_at"`
+}
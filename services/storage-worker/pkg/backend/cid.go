@@ -0,0 +1,32 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+)
+
+const (
+	cidVersion1  = 0x01
+	codecRaw     = 0x55
+	multihashSHA = 0x12
+	sha256Length = 0x20
+)
+
+var cidEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RawCID computes the CIDv1 (raw codec, sha2-256) of data in base32 form,
+// used to address objects on backends that are not content-addressed
+func RawCID(data []byte) string {
+	digest := sha256.Sum256(data)
+
+	buf := make([]byte, 0, 4+len(digest))
+	buf = append(buf, cidVersion1, codecRaw, multihashSHA, sha256Length)
+	buf = append(buf, digest[:]...)
+
+	return "b" + lowerBase32(buf)
+}
+
+func lowerBase32(data []byte) string {
+	return strings.ToLower(cidEncoding.EncodeToString(data))
+}
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/filecoin"
+)
+
+// FilecoinBackend stores objects on Filecoin through SynapseSDK
+type FilecoinBackend struct {
+	client *filecoin.SynapseClient
+}
+
+// NewFilecoinBackend wraps a SynapseClient as a Backend
+func NewFilecoinBackend(client *filecoin.SynapseClient) *FilecoinBackend {
+	return &FilecoinBackend{client: client}
+}
+
+// Name returns the backend identifier
+func (b *FilecoinBackend) Name() string {
+	return "filecoin"
+}
+
+// Client returns the underlying SynapseClient for Filecoin-specific calls
+func (b *FilecoinBackend) Client() *filecoin.SynapseClient {
+	return b.client
+}
+
+// Put uploads data to Filecoin. The CID is always derived by the network.
+func (b *FilecoinBackend) Put(ctx context.Context, data []byte, opts PutOptions) (*PutResult, error) {
+	metadata := copyMetadata(opts.Metadata)
+	if opts.ContentType != "" {
+		metadata["contentType"] = opts.ContentType
+	}
+	if opts.Class != "" {
+		metadata["class"] = opts.Class
+	}
+
+	dealDuration := opts.DealDuration
+	if dealDuration == 0 {
+		dealDuration = 180 // 180 days
+	}
+
+	result, err := b.client.Upload(ctx, data, opts.Filename, &filecoin.UploadOptions{
+		DealDuration: dealDuration,
+		PinToIPFS:    opts.PinToIPFS,
+		Metadata:     metadata,
+		Redundancy:   3,
+		StorageClass: "standard",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PutResult{
+		Backend:   b.Name(),
+		CID:       result.CID,
+		Size:      result.Size,
+		Cost:      result.StorageCost,
+		DealID:    result.DealID,
+		Metadata:  result.Metadata,
+		CreatedAt: result.CreatedAt,
+	}, nil
+}
+
+// Get retrieves an object from Filecoin
+func (b *FilecoinBackend) Get(ctx context.Context, cid string) (*Object, error) {
+	result, err := b.client.Retrieve(ctx, cid)
+	if err != nil {
+		if strings.Contains(err.Error(), "file not found") {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	retrievedAt := result.RetrievedAt
+	if retrievedAt.IsZero() {
+		retrievedAt = time.Now()
+	}
+
+	return &Object{
+		Backend:     b.Name(),
+		CID:         cid,
+		Data:        result.Data,
+		Filename:    result.Filename,
+		ContentType: result.ContentType,
+		Size:        result.Size,
+		Metadata:    result.Metadata,
+		RetrievedAt: retrievedAt,
+	}, nil
+}
+
+// Delete unpins the object from IPFS. Sealed Filecoin deals cannot be
+// removed and expire at the end of their deal duration.
+func (b *FilecoinBackend) Delete(ctx context.Context, cid string) error {
+	err := b.client.UnpinFromIPFS(ctx, cid)
+	if err != nil && strings.Contains(err.Error(), "status 404") {
+		return ErrNotFound
+	}
+	return err
+}
+
+func copyMetadata(src map[string]string) map[string]string {
+	dst := make(map[string]string, len(src)+2)
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
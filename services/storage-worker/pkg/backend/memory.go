@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps objects in process memory. It is used in mock mode
+// when no provider credentials are configured, and in tests.
+type MemoryBackend struct {
+	name    string
+	objects map[string]*Object
+	mu      sync.RWMutex
+}
+
+// NewMemoryBackend creates an empty in-memory backend
+func NewMemoryBackend(name string) *MemoryBackend {
+	if name == "" {
+		name = "memory"
+	}
+	return &MemoryBackend{
+		name:    name,
+		objects: make(map[string]*Object),
+	}
+}
+
+// Name returns the backend identifier
+func (b *MemoryBackend) Name() string {
+	return b.name
+}
+
+// Put stores a copy of data under opts.CID or its raw CID
+func (b *MemoryBackend) Put(ctx context.Context, data []byte, opts PutOptions) (*PutResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cid := opts.CID
+	if cid == "" {
+		cid = RawCID(data)
+	}
+
+	stored := make([]byte, len(data))
+	copy(stored, data)
+
+	now := time.Now()
+	metadata := copyMetadata(opts.Metadata)
+
+	b.mu.Lock()
+	b.objects[cid] = &Object{
+		Backend:     b.name,
+		CID:         cid,
+		Data:        stored,
+		Filename:    opts.Filename,
+		ContentType: opts.ContentType,
+		Size:        int64(len(stored)),
+		Metadata:    metadata,
+	}
+	b.mu.Unlock()
+
+	return &PutResult{
+		Backend:   b.name,
+		CID:       cid,
+		Size:      int64(len(stored)),
+		Cost:      "0.000000",
+		Metadata:  metadata,
+		CreatedAt: now,
+	}, nil
+}
+
+// Delete removes the object stored under cid
+func (b *MemoryBackend) Delete(ctx context.Context, cid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.objects[cid]; !exists {
+		return ErrNotFound
+	}
+	delete(b.objects, cid)
+	return nil
+}
+
+// Get returns a copy of the object stored under cid
+func (b *MemoryBackend) Get(ctx context.Context, cid string) (*Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.RLock()
+	obj, exists := b.objects[cid]
+	b.mu.RUnlock()
+
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	result := *obj
+	result.Data = make([]byte, len(obj.Data))
+	copy(result.Data, obj.Data)
+	result.Metadata = copyMetadata(obj.Metadata)
+	result.RetrievedAt = time.Now()
+
+	return &result, nil
+}
@@ -0,0 +1,258 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PinataBackend pins objects through the Pinata pinning service
+type PinataBackend struct {
+	apiURL     string
+	gatewayURL string
+	jwt        string
+	client     *http.Client
+}
+
+// NewPinataBackend creates a Pinata backend authenticated with a JWT
+func NewPinataBackend(apiURL, gatewayURL, jwt string) *PinataBackend {
+	if apiURL == "" {
+		apiURL = "https://api.pinata.cloud"
+	}
+	if gatewayURL == "" {
+		gatewayURL = "https://gateway.pinata.cloud"
+	}
+
+	return &PinataBackend{
+		apiURL:     strings.TrimSuffix(apiURL, "/"),
+		gatewayURL: strings.TrimSuffix(gatewayURL, "/"),
+		jwt:        jwt,
+		client: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+	}
+}
+
+// Name returns the backend identifier
+func (b *PinataBackend) Name() string {
+	return "pinata"
+}
+
+// Put uploads and pins data. The CID is assigned by IPFS.
+func (b *PinataBackend) Put(ctx context.Context, data []byte, opts PutOptions) (*PutResult, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	filename := opts.Filename
+	if filename == "" {
+		filename = "object"
+	}
+
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create form file: %w", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write form file: %w", err)
+	}
+
+	keyvalues := copyMetadata(opts.Metadata)
+	if opts.Class != "" {
+		keyvalues["class"] = opts.Class
+	}
+	pinataMetadata, err := json.Marshal(map[string]interface{}{
+		"name":      filename,
+		"keyvalues": keyvalues,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pin metadata: %w", err)
+	}
+	if err := writer.WriteField("pinataMetadata", string(pinataMetadata)); err != nil {
+		return nil, fmt.Errorf("failed to write pin metadata: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close multipart body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", b.apiURL+"/pinning/pinFileToIPFS", &body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+b.jwt)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make pinata pin request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("pinata pin failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result struct {
+		IpfsHash string `json:"IpfsHash"`
+		PinSize  int64  `json:"PinSize"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode pinata response: %w", err)
+	}
+
+	return &PutResult{
+		Backend:   b.Name(),
+		CID:       result.IpfsHash,
+		Size:      int64(len(data)),
+		Cost:      "0.000000",
+		Metadata:  keyvalues,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// Get fetches an object through the Pinata gateway
+func (b *PinataBackend) Get(ctx context.Context, cid string) (*Object, error) {
+	return gatewayGet(ctx, b.client, b.gatewayURL, b.Name(), cid)
+}
+
+// Delete unpins the object from Pinata
+func (b *PinataBackend) Delete(ctx context.Context, cid string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", b.apiURL+"/pinning/unpin/"+cid, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+b.jwt)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make pinata unpin request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("pinata unpin failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// Web3StorageBackend uploads objects through the web3.storage HTTP API
+type Web3StorageBackend struct {
+	apiURL     string
+	gatewayURL string
+	token      string
+	client     *http.Client
+}
+
+// NewWeb3StorageBackend creates a web3.storage backend authenticated with an API token
+func NewWeb3StorageBackend(apiURL, gatewayURL, token string) *Web3StorageBackend {
+	if apiURL == "" {
+		apiURL = "https://api.web3.storage"
+	}
+	if gatewayURL == "" {
+		gatewayURL = "https://w3s.link"
+	}
+
+	return &Web3StorageBackend{
+		apiURL:     strings.TrimSuffix(apiURL, "/"),
+		gatewayURL: strings.TrimSuffix(gatewayURL, "/"),
+		token:      token,
+		client: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+	}
+}
+
+// Name returns the backend identifier
+func (b *Web3StorageBackend) Name() string {
+	return "web3storage"
+}
+
+// Put uploads data. The CID is assigned by IPFS.
+func (b *Web3StorageBackend) Put(ctx context.Context, data []byte, opts PutOptions) (*PutResult, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", b.apiURL+"/upload", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	if opts.Filename != "" {
+		req.Header.Set("X-Name", opts.Filename)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make web3.storage upload request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("web3.storage upload failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result struct {
+		CID string `json:"cid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode web3.storage response: %w", err)
+	}
+
+	return &PutResult{
+		Backend:   b.Name(),
+		CID:       result.CID,
+		Size:      int64(len(data)),
+		Cost:      "0.000000",
+		Metadata:  copyMetadata(opts.Metadata),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// Get fetches an object through the w3s.link gateway
+func (b *Web3StorageBackend) Get(ctx context.Context, cid string) (*Object, error) {
+	return gatewayGet(ctx, b.client, b.gatewayURL, b.Name(), cid)
+}
+
+// gatewayGet fetches a CID from an IPFS HTTP gateway
+func gatewayGet(ctx context.Context, client *http.Client, gatewayURL, backendName, cid string) (*Object, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", gatewayURL+"/ipfs/"+cid, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make gateway request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway request failed with status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return &Object{
+		Backend:     backendName,
+		CID:         cid,
+		Data:        data,
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        int64(len(data)),
+		Metadata:    make(map[string]string),
+		RetrievedAt: time.Now(),
+	}, nil
+}
@@ -0,0 +1,335 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// DefaultClass is the policy applied to objects without a matching class
+const DefaultClass = "default"
+
+// Policy decides where objects of a class are written. The primary backend
+// must succeed and assigns the CID; replicas receive best-effort copies
+// stored under the same CID.
+type Policy struct {
+	Class    string   `json:"class"`
+	Primary  string   `json:"primary"`
+	Replicas []string `json:"replicas"`
+}
+
+// Router dispatches writes by policy and falls back across backends on reads
+type Router struct {
+	backends  map[string]Backend
+	order     []string
+	readOrder []string
+	policies  map[string]Policy
+	verify    bool
+	failures  map[string]uint64
+	mu        sync.RWMutex
+}
+
+// NewRouter creates a router with no backends registered. Retrieved content
+// is verified against its CID unless disabled with SetVerification.
+func NewRouter() *Router {
+	return &Router{
+		backends: make(map[string]Backend),
+		policies: make(map[string]Policy),
+		verify:   true,
+		failures: make(map[string]uint64),
+	}
+}
+
+// SetVerification enables or disables CID verification of retrieved bytes
+func (r *Router) SetVerification(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.verify = enabled
+}
+
+// VerificationFailures returns the number of responses rejected per backend
+// because their content did not match the requested CID
+func (r *Router) VerificationFailures() map[string]uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := make(map[string]uint64, len(r.failures))
+	for name, count := range r.failures {
+		counts[name] = count
+	}
+	return counts
+}
+
+// Register adds a backend. Backends are read in registration order unless
+// SetReadOrder is used.
+func (r *Router) Register(b Backend) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.backends[b.Name()]; !exists {
+		r.order = append(r.order, b.Name())
+	}
+	r.backends[b.Name()] = b
+}
+
+// Backend returns a registered backend by name
+func (r *Router) Backend(name string) (Backend, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	b, exists := r.backends[name]
+	return b, exists
+}
+
+// Backends returns the names of registered backends in registration order
+func (r *Router) Backends() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, len(r.order))
+	copy(names, r.order)
+	return names
+}
+
+// SetPolicy installs the write policy for a class
+func (r *Router) SetPolicy(policy Policy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.backends[policy.Primary]; !exists {
+		return fmt.Errorf("policy %s: unknown primary backend %q", policy.Class, policy.Primary)
+	}
+	for _, name := range policy.Replicas {
+		if _, exists := r.backends[name]; !exists {
+			return fmt.Errorf("policy %s: unknown replica backend %q", policy.Class, name)
+		}
+	}
+
+	r.policies[policy.Class] = policy
+	return nil
+}
+
+// Policies returns the installed policies
+func (r *Router) Policies() []Policy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	policies := make([]Policy, 0, len(r.policies))
+	for _, p := range r.policies {
+		policies = append(policies, p)
+	}
+	return policies
+}
+
+// SetReadOrder sets the order backends are tried in on retrieval. Backends
+// not listed are tried afterwards in registration order.
+func (r *Router) SetReadOrder(names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.readOrder = names
+}
+
+// Put writes data to the primary backend of the class policy, then copies it
+// to each replica. Replica failures are logged and do not fail the write.
+func (r *Router) Put(ctx context.Context, data []byte, opts PutOptions) (*PutResult, error) {
+	policy, err := r.policyFor(opts.Class)
+	if err != nil {
+		return nil, err
+	}
+
+	primary, _ := r.Backend(policy.Primary)
+	result, err := primary.Put(ctx, data, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", primary.Name(), err)
+	}
+
+	for _, name := range policy.Replicas {
+		replica, _ := r.Backend(name)
+
+		replicaOpts := opts
+		replicaOpts.CID = result.CID
+		replicaResult, err := replica.Put(ctx, data, replicaOpts)
+		if err != nil {
+			log.Printf("Replica write to %s failed for CID=%s: %v", name, result.CID, err)
+			continue
+		}
+		if replicaResult.CID != result.CID {
+			log.Printf("Replica %s assigned CID=%s for primary CID=%s", name, replicaResult.CID, result.CID)
+		}
+		result.Replicas = append(result.Replicas, name)
+	}
+
+	return result, nil
+}
+
+// Get retrieves an object, trying each backend in read order until one
+// returns content matching the CID. Content that fails verification is never
+// returned; the next backend is tried instead.
+func (r *Router) Get(ctx context.Context, cid string) (*Object, error) {
+	if cid == "" {
+		return nil, errors.New("CID cannot be empty")
+	}
+
+	r.mu.RLock()
+	verify := r.verify
+	r.mu.RUnlock()
+
+	if verify {
+		if _, err := ParseCID(cid); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+		}
+	}
+
+	var errs []string
+	verificationFailed := false
+	for _, name := range r.readSequence() {
+		b, _ := r.Backend(name)
+
+		obj, err := b.Get(ctx, cid)
+		if err == nil && verify {
+			if err = VerifyCID(cid, obj.Data); err != nil {
+				verificationFailed = true
+				r.recordVerificationFailure(name)
+				log.Printf("Rejected content from %s for CID=%s: %v", name, cid, err)
+			}
+		}
+		if err == nil {
+			return obj, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrVerificationFailed) {
+			log.Printf("Retrieval from %s failed for CID=%s: %v", name, cid, err)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+	}
+
+	if len(errs) == 0 {
+		return nil, errors.New("no storage backends configured")
+	}
+	if verificationFailed {
+		return nil, fmt.Errorf("%w: no backend returned content matching CID=%s (%s)", ErrVerificationFailed, cid, strings.Join(errs, "; "))
+	}
+	return nil, fmt.Errorf("file not found: CID=%s (%s)", cid, strings.Join(errs, "; "))
+}
+
+// Delete removes cid from every registered backend that supports deletion
+// and returns the backends it was removed from. Backends that do not hold
+// the object are skipped.
+func (r *Router) Delete(ctx context.Context, cid string) ([]string, error) {
+	if cid == "" {
+		return nil, errors.New("CID cannot be empty")
+	}
+
+	r.mu.RLock()
+	names := append([]string{}, r.order...)
+	r.mu.RUnlock()
+
+	var deleted []string
+	var errs []string
+	for _, name := range names {
+		b, _ := r.Backend(name)
+		deleter, ok := b.(Deleter)
+		if !ok {
+			continue
+		}
+
+		err := deleter.Delete(ctx, cid)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		deleted = append(deleted, name)
+	}
+
+	if len(errs) > 0 {
+		return deleted, fmt.Errorf("delete failed for CID=%s (%s)", cid, strings.Join(errs, "; "))
+	}
+	return deleted, nil
+}
+
+func (r *Router) recordVerificationFailure(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures[name]++
+}
+
+// Policy returns the policy objects of class are written with, falling back
+// to the default class
+func (r *Router) Policy(class string) (Policy, error) {
+	return r.policyFor(class)
+}
+
+func (r *Router) policyFor(class string) (Policy, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if policy, exists := r.policies[class]; exists {
+		return policy, nil
+	}
+	if policy, exists := r.policies[DefaultClass]; exists {
+		return policy, nil
+	}
+	if len(r.order) > 0 {
+		return Policy{Class: DefaultClass, Primary: r.order[0]}, nil
+	}
+	return Policy{}, errors.New("no storage backends configured")
+}
+
+func (r *Router) readSequence() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seen := make(map[string]bool, len(r.order))
+	sequence := make([]string, 0, len(r.order))
+	for _, name := range append(append([]string{}, r.readOrder...), r.order...) {
+		if _, exists := r.backends[name]; !exists || seen[name] {
+			continue
+		}
+		seen[name] = true
+		sequence = append(sequence, name)
+	}
+	return sequence
+}
+
+// ParsePolicies parses a policy spec of the form
+// "receipt=filecoin+s3;attachment=filecoin;default=filecoin" where the first
+// backend of each class is the primary and the rest are replicas
+func ParsePolicies(spec string) ([]Policy, error) {
+	var policies []Policy
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		class, targets, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(class) == "" || strings.TrimSpace(targets) == "" {
+			return nil, fmt.Errorf("invalid policy entry %q", entry)
+		}
+
+		names := strings.Split(targets, "+")
+		for i := range names {
+			names[i] = strings.TrimSpace(names[i])
+		}
+
+		policies = append(policies, Policy{
+			Class:    strings.TrimSpace(class),
+			Primary:  names[0],
+			Replicas: names[1:],
+		})
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingBackend struct {
+	name string
+}
+
+func (b *failingBackend) Name() string { return b.name }
+
+func (b *failingBackend) Put(ctx context.Context, data []byte, opts PutOptions) (*PutResult, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func (b *failingBackend) Get(ctx context.Context, cid string) (*Object, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func TestRouterPutReplicates(t *testing.T) {
+	primary := NewMemoryBackend("primary")
+	hot := NewMemoryBackend("hot")
+
+	router := NewRouter()
+	router.Register(primary)
+	router.Register(hot)
+	require.NoError(t, router.SetPolicy(Policy{Class: "receipt", Primary: "primary", Replicas: []string{"hot"}}))
+
+	result, err := router.Put(context.Background(), []byte("receipt body"), PutOptions{Class: "receipt", Filename: "r.json"})
+	require.NoError(t, err)
+	assert.Equal(t, "primary", result.Backend)
+	assert.Equal(t, []string{"hot"}, result.Replicas)
+
+	replica, err := hot.Get(context.Background(), result.CID)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("receipt body"), replica.Data)
+}
+
+func TestRouterPutIgnoresReplicaFailure(t *testing.T) {
+	router := NewRouter()
+	router.Register(NewMemoryBackend("primary"))
+	router.Register(&failingBackend{name: "broken"})
+	require.NoError(t, router.SetPolicy(Policy{Class: DefaultClass, Primary: "primary", Replicas: []string{"broken"}}))
+
+	result, err := router.Put(context.Background(), []byte("data"), PutOptions{Class: "attachment"})
+	require.NoError(t, err)
+	assert.Empty(t, result.Replicas)
+}
+
+func TestRouterGetFallsBack(t *testing.T) {
+	cold := NewMemoryBackend("cold")
+	router := NewRouter()
+	router.Register(&failingBackend{name: "s3"})
+	router.Register(NewMemoryBackend("empty"))
+	router.Register(cold)
+	router.SetReadOrder([]string{"s3"})
+
+	put, err := cold.Put(context.Background(), []byte("payload"), PutOptions{})
+	require.NoError(t, err)
+
+	obj, err := router.Get(context.Background(), put.CID)
+	require.NoError(t, err)
+	assert.Equal(t, "cold", obj.Backend)
+
+	_, err = router.Get(context.Background(), "bafkreimissing")
+	assert.Error(t, err)
+}
+
+func TestRouterDelete(t *testing.T) {
+	primary := NewMemoryBackend("primary")
+	hot := NewMemoryBackend("hot")
+
+	router := NewRouter()
+	router.Register(primary)
+	router.Register(hot)
+	router.Register(&failingBackend{name: "archive"}) // cannot delete, skipped
+	require.NoError(t, router.SetPolicy(Policy{Class: DefaultClass, Primary: "primary"}))
+
+	result, err := router.Put(context.Background(), []byte("expiring"), PutOptions{})
+	require.NoError(t, err)
+
+	deleted, err := router.Delete(context.Background(), result.CID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"primary"}, deleted)
+
+	_, err = primary.Get(context.Background(), result.CID)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestSetPolicyRejectsUnknownBackend(t *testing.T) {
+	router := NewRouter()
+	router.Register(NewMemoryBackend("memory"))
+
+	err := router.SetPolicy(Policy{Class: "receipt", Primary: "memory", Replicas: []string{"s3"}})
+	assert.Error(t, err)
+}
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies("receipt=filecoin+s3; default=filecoin")
+	require.NoError(t, err)
+	require.Len(t, policies, 2)
+	assert.Equal(t, Policy{Class: "receipt", Primary: "filecoin", Replicas: []string{"s3"}}, policies[0])
+	assert.Equal(t, "default", policies[1].Class)
+	assert.Empty(t, policies[1].Replicas)
+
+	_, err = ParsePolicies("receipt")
+	assert.Error(t, err)
+}
+
+func TestRawCID(t *testing.T) {
+	// CIDv1 raw sha2-256 of "hello world"
+	assert.Equal(t, "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", RawCID([]byte("hello world")))
+}
@@ -0,0 +1,258 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const s3MetaPrefix = "X-Amz-Meta-"
+
+// S3Config contains connection settings for an S3-compatible object store
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.us-east-1.amazonaws.com or a MinIO URL
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+}
+
+// S3Backend stores hot copies of objects in an S3-compatible bucket keyed by CID
+type S3Backend struct {
+	config S3Config
+	client *http.Client
+}
+
+// NewS3Backend creates a backend for an S3-compatible bucket
+func NewS3Backend(config S3Config) *S3Backend {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+
+	return &S3Backend{
+		config: config,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// Name returns the backend identifier
+func (b *S3Backend) Name() string {
+	return "s3"
+}
+
+// Put uploads data as an object named after its CID
+func (b *S3Backend) Put(ctx context.Context, data []byte, opts PutOptions) (*PutResult, error) {
+	cid := opts.CID
+	if cid == "" {
+		cid = RawCID(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", b.objectURL(cid), bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.ContentLength = int64(len(data))
+
+	metadata := copyMetadata(opts.Metadata)
+	if opts.Filename != "" {
+		metadata["filename"] = opts.Filename
+	}
+	if opts.Class != "" {
+		metadata["class"] = opts.Class
+	}
+	for k, v := range metadata {
+		req.Header.Set(s3MetaPrefix+k, v)
+	}
+
+	b.sign(req, data)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make s3 put request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("s3 put failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return &PutResult{
+		Backend:   b.Name(),
+		CID:       cid,
+		Size:      int64(len(data)),
+		Cost:      "0.000000",
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// Get downloads the object stored under cid
+func (b *S3Backend) Get(ctx context.Context, cid string) (*Object, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.objectURL(cid), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	b.sign(req, nil)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make s3 get request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("s3 get failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	metadata := make(map[string]string)
+	for key, values := range resp.Header {
+		if strings.HasPrefix(key, s3MetaPrefix) && len(values) > 0 {
+			metadata[strings.ToLower(strings.TrimPrefix(key, s3MetaPrefix))] = values[0]
+		}
+	}
+
+	return &Object{
+		Backend:     b.Name(),
+		CID:         cid,
+		Data:        data,
+		Filename:    metadata["filename"],
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        int64(len(data)),
+		Metadata:    metadata,
+		RetrievedAt: time.Now(),
+	}, nil
+}
+
+// Delete removes the object stored under cid. S3 does not report whether
+// the object existed, so a missing object is not an error.
+func (b *S3Backend) Delete(ctx context.Context, cid string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", b.objectURL(cid), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	b.sign(req, nil)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make s3 delete request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("s3 delete failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+func (b *S3Backend) objectURL(cid string) string {
+	key := url.PathEscape(b.config.Prefix + cid)
+	if b.config.PathStyle {
+		return fmt.Sprintf("%s/%s/%s", b.config.Endpoint, b.config.Bucket, key)
+	}
+
+	endpoint, err := url.Parse(b.config.Endpoint)
+	if err != nil {
+		return fmt.Sprintf("%s/%s/%s", b.config.Endpoint, b.config.Bucket, key)
+	}
+	return fmt.Sprintf("%s://%s.%s/%s", endpoint.Scheme, b.config.Bucket, endpoint.Host, key)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+func (b *S3Backend) sign(req *http.Request, payload []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("Host", req.URL.Host)
+
+	headerNames := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		headerNames = append(headerNames, strings.ToLower(name))
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name)
+		canonicalHeaders.WriteString(":")
+		canonicalHeaders.WriteString(strings.TrimSpace(req.Header.Get(name)))
+		canonicalHeaders.WriteString("\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", shortDate, b.config.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+b.config.SecretKey), shortDate)
+	key = hmacSHA256(key, b.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,254 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ErrVerificationFailed is returned when retrieved bytes do not hash to the requested CID
+var ErrVerificationFailed = errors.New("verification_failed")
+
+// ErrUnsupportedCID is returned for CIDs whose codec or hash cannot be recomputed
+var ErrUnsupportedCID = errors.New("unsupported CID")
+
+const (
+	codecDagPB = 0x70
+
+	// Defaults used by IPFS when importing files (kubo `ipfs add`)
+	unixfsChunkSize = 256 * 1024
+	unixfsMaxLinks  = 174
+
+	unixfsTypeFile = 2
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// CID is a decoded content identifier
+type CID struct {
+	Version int
+	Codec   uint64
+	Hash    uint64
+	Digest  []byte
+}
+
+// ParseCID decodes a CIDv0 (base58btc "Qm...") or a base32 CIDv1 ("b...")
+func ParseCID(s string) (*CID, error) {
+	if len(s) == 46 && strings.HasPrefix(s, "Qm") {
+		raw, err := decodeBase58(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) != 34 || raw[0] != multihashSHA || raw[1] != sha256Length {
+			return nil, fmt.Errorf("%w: malformed CIDv0", ErrUnsupportedCID)
+		}
+		return &CID{Version: 0, Codec: codecDagPB, Hash: multihashSHA, Digest: raw[2:]}, nil
+	}
+
+	if !strings.HasPrefix(s, "b") {
+		return nil, fmt.Errorf("%w: only base32 CIDv1 is supported", ErrUnsupportedCID)
+	}
+
+	raw, err := cidEncoding.DecodeString(strings.ToUpper(s[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedCID, err)
+	}
+
+	reader := bytes.NewReader(raw)
+	var fields [4]uint64
+	for i := range fields {
+		if fields[i], err = binary.ReadUvarint(reader); err != nil {
+			return nil, fmt.Errorf("%w: truncated CID", ErrUnsupportedCID)
+		}
+	}
+	if fields[0] != cidVersion1 {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupportedCID, fields[0])
+	}
+
+	digest := make([]byte, reader.Len())
+	reader.Read(digest)
+	if uint64(len(digest)) != fields[3] {
+		return nil, fmt.Errorf("%w: digest length mismatch", ErrUnsupportedCID)
+	}
+
+	return &CID{Version: 1, Codec: fields[1], Hash: fields[2], Digest: digest}, nil
+}
+
+// VerifyCID recomputes the CID of data and checks it against cid. Raw CIDs
+// are a direct sha2-256 of the bytes; dag-pb CIDs are rebuilt as a UnixFS
+// file using the IPFS import defaults (256KiB chunks, balanced layout, raw
+// leaves for CIDv1).
+func VerifyCID(cid string, data []byte) error {
+	parsed, err := ParseCID(cid)
+	if err != nil {
+		return err
+	}
+	if parsed.Hash != multihashSHA {
+		return fmt.Errorf("%w: hash function 0x%x", ErrUnsupportedCID, parsed.Hash)
+	}
+
+	var digest []byte
+	switch parsed.Codec {
+	case codecRaw:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case codecDagPB:
+		v1 := parsed.Version == 1
+		// CIDv1 imports normally use raw leaves, but both layouts are valid
+		if v1 && bytes.Equal(unixfsFileDigest(data, true, v1), parsed.Digest) {
+			return nil
+		}
+		digest = unixfsFileDigest(data, false, v1)
+	default:
+		return fmt.Errorf("%w: codec 0x%x", ErrUnsupportedCID, parsed.Codec)
+	}
+
+	if !bytes.Equal(digest, parsed.Digest) {
+		return fmt.Errorf("%w: content does not match CID %s", ErrVerificationFailed, cid)
+	}
+	return nil
+}
+
+// dagNode is a built node of a UnixFS file DAG
+type dagNode struct {
+	cid      []byte // binary CID
+	digest   []byte
+	fileSize uint64 // bytes of file content below this node
+	tSize    uint64 // cumulative serialized size of the DAG below this node
+}
+
+func unixfsFileDigest(data []byte, rawLeaves, v1 bool) []byte {
+	var leaves []dagNode
+	for offset := 0; offset < len(data) || offset == 0; offset += unixfsChunkSize {
+		end := offset + unixfsChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaves = append(leaves, buildLeaf(data[offset:end], rawLeaves, v1))
+		if end == len(data) {
+			break
+		}
+	}
+
+	level := leaves
+	if len(level) == 1 && rawLeaves {
+		// A single raw leaf is only the root under a raw CID; a dag-pb
+		// CID always names a dag-pb node
+		level = []dagNode{buildParent(level, v1)}
+	}
+	for len(level) > 1 {
+		var next []dagNode
+		for i := 0; i < len(level); i += unixfsMaxLinks {
+			end := i + unixfsMaxLinks
+			if end > len(level) {
+				end = len(level)
+			}
+			next = append(next, buildParent(level[i:end], v1))
+		}
+		level = next
+	}
+
+	return level[0].digest
+}
+
+func buildLeaf(chunk []byte, raw, v1 bool) dagNode {
+	if raw {
+		digest := sha256.Sum256(chunk)
+		return dagNode{
+			cid:      binaryCID(codecRaw, digest[:], true),
+			digest:   digest[:],
+			fileSize: uint64(len(chunk)),
+			tSize:    uint64(len(chunk)),
+		}
+	}
+
+	unixfs := protoVarint(nil, 1, unixfsTypeFile)
+	if len(chunk) > 0 {
+		unixfs = protoBytes(unixfs, 2, chunk)
+	}
+	unixfs = protoVarint(unixfs, 3, uint64(len(chunk)))
+
+	node := protoBytes(nil, 1, unixfs)
+	digest := sha256.Sum256(node)
+	return dagNode{
+		cid:      binaryCID(codecDagPB, digest[:], v1),
+		digest:   digest[:],
+		fileSize: uint64(len(chunk)),
+		tSize:    uint64(len(node)),
+	}
+}
+
+func buildParent(children []dagNode, v1 bool) dagNode {
+	var fileSize, childTSize uint64
+	var node []byte
+
+	for _, child := range children {
+		link := protoBytes(nil, 1, child.cid)
+		link = protoBytes(link, 2, nil)
+		link = protoVarint(link, 3, child.tSize)
+		node = protoBytes(node, 2, link)
+
+		fileSize += child.fileSize
+		childTSize += child.tSize
+	}
+
+	unixfs := protoVarint(nil, 1, unixfsTypeFile)
+	unixfs = protoVarint(unixfs, 3, fileSize)
+	for _, child := range children {
+		unixfs = protoVarint(unixfs, 4, child.fileSize)
+	}
+	node = protoBytes(node, 1, unixfs)
+
+	digest := sha256.Sum256(node)
+	return dagNode{
+		cid:      binaryCID(codecDagPB, digest[:], v1),
+		digest:   digest[:],
+		fileSize: fileSize,
+		tSize:    uint64(len(node)) + childTSize,
+	}
+}
+
+func binaryCID(codec uint64, digest []byte, v1 bool) []byte {
+	mh := append([]byte{multihashSHA, sha256Length}, digest...)
+	if !v1 {
+		return mh
+	}
+	buf := binary.AppendUvarint(nil, cidVersion1)
+	buf = binary.AppendUvarint(buf, codec)
+	return append(buf, mh...)
+}
+
+func protoVarint(buf []byte, field int, value uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3))
+	return binary.AppendUvarint(buf, value)
+}
+
+func protoBytes(buf []byte, field int, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|2))
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func decodeBase58(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range s {
+		idx := strings.IndexRune(base58Alphabet, c)
+		if idx < 0 {
+			return nil, fmt.Errorf("%w: invalid base58 character %q", ErrUnsupportedCID, c)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(idx)))
+	}
+
+	decoded := n.Bytes()
+	leadingZeros := 0
+	for leadingZeros < len(s) && s[leadingZeros] == '1' {
+		leadingZeros++
+	}
+	return append(make([]byte, leadingZeros), decoded...), nil
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCID(t *testing.T) {
+	testCases := []struct {
+		name string
+		cid  string
+		data string
+	}{
+		{"raw CIDv1", "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", "hello world"},
+		{"dag-pb CIDv0", "Qmf412jQZiuVUtdgnB36FXFX7xg5V6KEbSJ4dpQuhkLyfD", "hello world"},
+		{"dag-pb CIDv0 with newline", "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o", "hello world\n"},
+		{"empty dag-pb CIDv0", "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.NoError(t, VerifyCID(tc.cid, []byte(tc.data)))
+
+			err := VerifyCID(tc.cid, []byte(tc.data+"tampered"))
+			assert.True(t, errors.Is(err, ErrVerificationFailed))
+		})
+	}
+}
+
+func TestVerifyCIDMultiChunk(t *testing.T) {
+	data := bytes.Repeat([]byte("crosspay"), unixfsChunkSize/4)
+
+	// Round-trip through the encoder since no fixed vector is at hand; the
+	// balanced layout must be deterministic and sensitive to every chunk
+	digest := unixfsFileDigest(data, true, true)
+	cid := "b" + lowerBase32(binaryCID(codecDagPB, digest, true))
+
+	assert.NoError(t, VerifyCID(cid, data))
+
+	data[len(data)-1] ^= 0xff
+	assert.True(t, errors.Is(VerifyCID(cid, data), ErrVerificationFailed))
+}
+
+func TestVerifyCIDRejectsUnsupported(t *testing.T) {
+	err := VerifyCID("not-a-cid", []byte("data"))
+	assert.True(t, errors.Is(err, ErrUnsupportedCID))
+}
+
+type tamperingBackend struct {
+	*MemoryBackend
+}
+
+func (b *tamperingBackend) Get(ctx context.Context, cid string) (*Object, error) {
+	obj, err := b.MemoryBackend.Get(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	obj.Data = append(obj.Data, '!')
+	return obj, nil
+}
+
+func TestRouterRejectsTamperedContent(t *testing.T) {
+	gateway := &tamperingBackend{NewMemoryBackend("gateway")}
+	origin := NewMemoryBackend("origin")
+
+	router := NewRouter()
+	router.Register(gateway)
+	router.Register(origin)
+
+	put, err := gateway.Put(context.Background(), []byte("receipt"), PutOptions{})
+	require.NoError(t, err)
+
+	_, err = router.Get(context.Background(), put.CID)
+	assert.True(t, errors.Is(err, ErrVerificationFailed))
+	assert.Equal(t, uint64(1), router.VerificationFailures()["gateway"])
+
+	_, err = origin.Put(context.Background(), []byte("receipt"), PutOptions{})
+	require.NoError(t, err)
+
+	obj, err := router.Get(context.Background(), put.CID)
+	require.NoError(t, err)
+	assert.Equal(t, "origin", obj.Backend)
+	assert.Equal(t, []byte("receipt"), obj.Data)
+}
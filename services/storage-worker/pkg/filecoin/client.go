@@ -334,6 +334,29 @@ func (c *SynapseClient) PinToIPFS(ctx context.Context, cid string) error {
 	return nil
 }
 
+// UnpinFromIPFS removes the IPFS pin for a file
+func (c *SynapseClient) UnpinFromIPFS(ctx context.Context, cid string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.apiURL+"/v1/ipfs/pin/"+cid, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make unpin request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unpin request failed with status %d", resp.StatusCode)
+	}
+
+	log.Printf("File unpinned from IPFS: CID=%s", cid)
+	return nil
+}
+
 // GetNetworkInfo returns information about the Filecoin network
 func (c *SynapseClient) GetNetworkInfo(ctx context.Context) (map[string]interface{}, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", c.apiURL+"/v1/network/info", nil)
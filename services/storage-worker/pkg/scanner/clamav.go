@@ -0,0 +1,103 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the largest chunk sent per INSTREAM frame. It must stay
+// below clamd's StreamMaxLength.
+const clamdChunkSize = 64 * 1024
+
+// ClamAVScanner scans content with a clamd daemon over its INSTREAM protocol
+type ClamAVScanner struct {
+	address string
+	timeout time.Duration
+}
+
+// NewClamAVScanner creates a scanner for the clamd at address ("host:port",
+// or a unix socket path)
+func NewClamAVScanner(address string) *ClamAVScanner {
+	return &ClamAVScanner{
+		address: address,
+		timeout: 60 * time.Second,
+	}
+}
+
+// Name returns the engine identifier
+func (s *ClamAVScanner) Name() string {
+	return "clamav"
+}
+
+// Scan streams data to clamd and parses its reply
+func (s *ClamAVScanner) Scan(ctx context.Context, data []byte, filename string) (*Verdict, error) {
+	network := "tcp"
+	if strings.HasPrefix(s.address, "/") {
+		network = "unix"
+	}
+
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, network, s.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(s.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("failed to start clamd stream: %w", err)
+	}
+
+	var size [4]byte
+	for offset := 0; offset < len(data); offset += clamdChunkSize {
+		end := offset + clamdChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		binary.BigEndian.PutUint32(size[:], uint32(end-offset))
+		if _, err := conn.Write(size[:]); err != nil {
+			return nil, fmt.Errorf("failed to stream to clamd: %w", err)
+		}
+		if _, err := conn.Write(data[offset:end]); err != nil {
+			return nil, fmt.Errorf("failed to stream to clamd: %w", err)
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return nil, fmt.Errorf("failed to end clamd stream: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return nil, fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply interprets "stream: OK" and "stream: <signature> FOUND"
+func parseClamdReply(reply string) (*Verdict, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+
+	verdict := &Verdict{Engine: "clamav", ScannedAt: time.Now()}
+	switch {
+	case result == "OK":
+		verdict.Clean = true
+	case strings.HasSuffix(result, " FOUND"):
+		verdict.Threat = strings.TrimSuffix(result, " FOUND")
+	default:
+		return nil, fmt.Errorf("clamd error: %s", result)
+	}
+	return verdict, nil
+}
@@ -0,0 +1,91 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd accepts INSTREAM sessions and flags the EICAR test string
+func fakeClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				command := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var stream bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&stream, conn, int64(size)); err != nil {
+						return
+					}
+				}
+
+				if bytes.Contains(stream.Bytes(), []byte(eicar)) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestClamAVScanner(t *testing.T) {
+	scanner := NewClamAVScanner(fakeClamd(t))
+
+	t.Run("should pass clean files", func(t *testing.T) {
+		verdict, err := scanner.Scan(context.Background(), bytes.Repeat([]byte("receipt "), 20000), "receipt.txt")
+		require.NoError(t, err)
+		assert.True(t, verdict.Clean)
+		assert.Equal(t, "clean", verdict.Status())
+	})
+
+	t.Run("should flag infected files", func(t *testing.T) {
+		verdict, err := scanner.Scan(context.Background(), []byte(eicar), "eicar.com")
+		require.NoError(t, err)
+		assert.False(t, verdict.Clean)
+		assert.Equal(t, "Eicar-Test-Signature", verdict.Threat)
+		assert.Equal(t, "infected", verdict.Status())
+	})
+
+	t.Run("should report an unreachable daemon as an error", func(t *testing.T) {
+		_, err := NewClamAVScanner("127.0.0.1:1").Scan(context.Background(), []byte("data"), "a.txt")
+		assert.Error(t, err)
+	})
+}
+
+func TestParseClamdReply(t *testing.T) {
+	_, err := parseClamdReply("INSTREAM size limit exceeded. ERROR")
+	assert.Error(t, err)
+}
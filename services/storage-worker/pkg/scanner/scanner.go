@@ -0,0 +1,31 @@
+package scanner
+
+import (
+	"context"
+	"time"
+)
+
+// Verdict is the outcome of scanning one file
+type Verdict struct {
+	Clean     bool      `json:"clean"`
+	Threat    string    `json:"threat,omitempty"`
+	Engine    string    `json:"engine"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// Status returns "clean" or "infected" for recording in object metadata
+func (v *Verdict) Status() string {
+	if v.Clean {
+		return "clean"
+	}
+	return "infected"
+}
+
+// Scanner inspects uploaded content for malware before it is stored
+type Scanner interface {
+	// Name returns the engine identifier recorded with verdicts
+	Name() string
+	// Scan returns a verdict for data. An error means the file could not be
+	// scanned, not that it is infected.
+	Scan(ctx context.Context, data []byte, filename string) (*Verdict, error)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FILPrice is a FIL/USD rate and where it came from
+type FILPrice struct {
+	Rate      float64   `json:"rate"`
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"` // "oracle", "cache", "fallback"
+}
+
+const filPriceSymbol = "FIL/USD"
+
+var (
+	oracleServiceURL = "http://localhost:8081"
+	oracleClient     = &http.Client{Timeout: 3 * time.Second}
+
+	// filPriceTTL is how long a fetched rate is served without asking the
+	// oracle again; filPriceMaxAge is how long it may stand in when the
+	// oracle is unreachable
+	filPriceTTL     = time.Minute
+	filPriceMaxAge  = time.Hour
+	filFallbackRate float64
+
+	filPriceMu        sync.Mutex
+	filPriceCached    *FILPrice
+	filPriceFetchedAt time.Time
+
+	errPriceUnavailable = errors.New("FIL/USD price unavailable")
+)
+
+// initPricing configures the oracle used to price storage in USD
+func initPricing(cfg *Config) {
+	oracleServiceURL = cfg.Pricing.OracleURL
+	filPriceTTL = cfg.Pricing.CacheTTL
+	filFallbackRate = cfg.Pricing.FallbackRate
+
+	log.Printf("Oracle service URL: %s", oracleServiceURL)
+}
+
+// getFILPrice returns the FIL/USD rate, preferring a fresh cached rate, then
+// the oracle, then a recent cached rate, then FIL_USD_FALLBACK_RATE
+func getFILPrice(ctx context.Context) (*FILPrice, error) {
+	filPriceMu.Lock()
+	cached, fetchedAt := filPriceCached, filPriceFetchedAt
+	filPriceMu.Unlock()
+
+	if cached != nil && time.Since(fetchedAt) < filPriceTTL {
+		price := *cached
+		price.Source = "cache"
+		return &price, nil
+	}
+
+	// The oracle is asked without holding the lock, so a slow call does not
+	// hold up estimates served from the cache
+	price, err := fetchOraclePrice(ctx, filPriceSymbol)
+	if err == nil {
+		filPriceMu.Lock()
+		filPriceCached = price
+		filPriceFetchedAt = time.Now()
+		filPriceMu.Unlock()
+		copied := *price
+		return &copied, nil
+	}
+	log.Printf("Failed to fetch %s from oracle: %v", filPriceSymbol, err)
+
+	if cached != nil && time.Since(fetchedAt) < filPriceMaxAge {
+		stale := *cached
+		stale.Source = "cache"
+		return &stale, nil
+	}
+
+	if filFallbackRate > 0 {
+		return &FILPrice{Rate: filFallbackRate, Timestamp: time.Now(), Source: "fallback"}, nil
+	}
+
+	return nil, errPriceUnavailable
+}
+
+// fetchOraclePrice reads a price from oracle-service's FTSO endpoint
+func fetchOraclePrice(ctx context.Context, symbol string) (*FILPrice, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", oracleServiceURL+"/api/ftso/price/"+symbol, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := oracleClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oracle returned status %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Price     float64 `json:"price"`
+		Timestamp int64   `json:"timestamp"`
+		Valid     bool    `json:"valid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("invalid oracle response: %w", err)
+	}
+	if !data.Valid || data.Price <= 0 {
+		return nil, fmt.Errorf("oracle price for %s is stale or invalid", symbol)
+	}
+
+	return &FILPrice{
+		Rate:      data.Price,
+		Timestamp: time.Unix(data.Timestamp, 0).UTC(),
+		Source:    "oracle",
+	}, nil
+}
+
+// calculateUSDEquivalent converts a FIL amount to USD at rate. Four decimals
+// keep small uploads from rounding to zero.
+func calculateUSDEquivalent(filCost string, rate float64) string {
+	fil, err := strconv.ParseFloat(filCost, 64)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%.4f", fil*rate)
+}
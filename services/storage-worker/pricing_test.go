@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/filecoin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOracle serves FIL/USD at 5.0 until down is set
+func fakeOracle(t *testing.T, down *atomic.Bool, calls *atomic.Int32) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "/api/ftso/price/FIL/USD", r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"symbol":    "FIL/USD",
+			"price":     5.0,
+			"timestamp": time.Now().Unix(),
+			"valid":     true,
+		})
+	}))
+
+	previousURL := oracleServiceURL
+	oracleServiceURL = server.URL
+	t.Cleanup(func() {
+		server.Close()
+		oracleServiceURL = previousURL
+		filPriceCached = nil
+		filFallbackRate = 0
+	})
+}
+
+func TestGetFILPrice(t *testing.T) {
+	var down atomic.Bool
+	var calls atomic.Int32
+	fakeOracle(t, &down, &calls)
+	filPriceCached = nil
+
+	price, err := getFILPrice(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, price.Rate)
+	assert.Equal(t, "oracle", price.Source)
+
+	t.Run("should serve fresh rates from cache", func(t *testing.T) {
+		price, err := getFILPrice(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "cache", price.Source)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("should fall back to the last rate when the oracle is down", func(t *testing.T) {
+		down.Store(true)
+		filPriceFetchedAt = time.Now().Add(-2 * filPriceTTL)
+
+		price, err := getFILPrice(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 5.0, price.Rate)
+		assert.Equal(t, "cache", price.Source)
+	})
+
+	t.Run("should use the configured fallback rate", func(t *testing.T) {
+		filPriceCached = nil
+		_, err := getFILPrice(context.Background())
+		assert.ErrorIs(t, err, errPriceUnavailable)
+
+		filFallbackRate = 3.5
+		price, err := getFILPrice(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 3.5, price.Rate)
+		assert.Equal(t, "fallback", price.Source)
+	})
+}
+
+func TestGetFILPriceSlowOracle(t *testing.T) {
+	t.Run("should not hold the cache lock while asking the oracle", func(t *testing.T) {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		previousURL := oracleServiceURL
+		oracleServiceURL = server.URL
+		defer func() {
+			oracleServiceURL = previousURL
+			server.Close()
+		}()
+		filPriceCached = nil
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			getFILPrice(context.Background())
+		}()
+
+		// While the fetch waits on the oracle, the cache stays available
+		time.Sleep(50 * time.Millisecond)
+		locked := filPriceMu.TryLock()
+		if locked {
+			filPriceMu.Unlock()
+		}
+		close(release)
+		<-done
+		assert.True(t, locked)
+	})
+}
+
+func TestCostEstimateUSD(t *testing.T) {
+	initializeStorageService()
+	var down atomic.Bool
+	var calls atomic.Int32
+	fakeOracle(t, &down, &calls)
+	filPriceCached = nil
+	// Unreachable Synapse API, so the estimate uses the local calculation
+	storage.filecoinClient = filecoin.NewSynapseClient("http://127.0.0.1:1", "", "")
+
+	httpReq, _ := http.NewRequest("GET", "/api/storage/cost/1000000", nil)
+	w := httptest.NewRecorder()
+	handleCostEstimate(w, httpReq)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var estimate CostEstimate
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &estimate))
+	assert.Equal(t, 5.0, estimate.FILUSDRate)
+	assert.Equal(t, "oracle", estimate.RateSource)
+	assert.NotNil(t, estimate.RateTimestamp)
+	assert.Equal(t, calculateUSDEquivalent(estimate.EstimatedFIL, 5.0), estimate.USDEquiv)
+	assert.NotEqual(t, "0.0000", estimate.USDEquiv)
+}
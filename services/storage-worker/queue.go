@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -12,15 +12,16 @@ import (
 
 type StorageJob struct {
 	ID          string                 `json:"id"`
-	Type        string                 `json:"type"` // "upload", "receipt"
-	Data        []byte                 `json:"data"`
+	Type        string                 `json:"type"` // "upload", "receipt", "export"
+	Data        []byte                 `json:"-"`
 	Filename    string                 `json:"filename"`
 	PaymentID   uint64                 `json:"payment_id,omitempty"`
 	Options     map[string]interface{} `json:"options"`
 	CreatedAt   time.Time              `json:"created_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
 	Attempts    int                    `json:"attempts"`
 	MaxAttempts int                    `json:"max_attempts"`
-	Status      string                 `json:"status"` // "pending", "processing", "completed", "failed"
+	Status      string                 `json:"status"` // "pending", "processing", "completed", "failed", "cancelled"
 	Error       string                 `json:"error,omitempty"`
 	Result      *JobResult             `json:"result,omitempty"`
 }
@@ -44,9 +45,17 @@ type StorageQueue struct {
 
 var queue *StorageQueue
 
-func init() {
+var (
+	errJobNotFound      = errors.New("job not found")
+	errJobNotCancelable = errors.New("job can no longer be cancelled")
+)
+
+// initQueue starts the storage queue and resumes jobs persisted by a
+// previous run
+func initQueue() error {
 	queue = NewStorageQueue(3) // 3 workers
 	queue.Start()
+	return queue.Recover()
 }
 
 func NewStorageQueue(workers int) *StorageQueue {
@@ -74,11 +83,22 @@ func (sq *StorageQueue) Start() {
 
 func (sq *StorageQueue) Stop() {
 	log.Println("Stopping storage queue...")
+	// Workers exit on cancellation; pending stays open so retry timers
+	// never send on a closed channel
 	sq.cancel()
-	close(sq.pending)
 }
 
-func (sq *StorageQueue) AddJob(job *StorageJob) error {
+// queueSubmitTimeout is how long AddJob waits for room in a full queue
+const queueSubmitTimeout = 5 * time.Second
+
+// AddJob persists and queues job. While the queue is full it waits for room
+// until ctx is done or queueSubmitTimeout passes, and then cancels the job,
+// so a caller that gave up does not have it run later. A job left by
+// shutdown stays pending and is resumed by the next run.
+func (sq *StorageQueue) AddJob(ctx context.Context, job *StorageJob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	job.ID = fmt.Sprintf("job_%d_%s", time.Now().UnixNano(), job.Type)
 	job.CreatedAt = time.Now()
 	job.Status = "pending"
@@ -86,30 +106,117 @@ func (sq *StorageQueue) AddJob(job *StorageJob) error {
 	job.MaxAttempts = 3
 
 	sq.mu.Lock()
+	if err := saveJob(job); err != nil {
+		sq.mu.Unlock()
+		return err
+	}
 	sq.jobs[job.ID] = job
 	sq.mu.Unlock()
 
+	ctx, cancel := context.WithTimeout(ctx, queueSubmitTimeout)
+	defer cancel()
 	select {
 	case sq.pending <- job:
 		log.Printf("Job %s queued successfully", job.ID)
 		return nil
 	case <-sq.ctx.Done():
 		return fmt.Errorf("queue is shutting down")
-	default:
-		return fmt.Errorf("queue is full")
+	case <-ctx.Done():
 	}
+
+	err := fmt.Errorf("queue is full: %w", ctx.Err())
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	job.Status = "cancelled"
+	job.Error = err.Error()
+	job.Data = nil
+	delete(sq.jobs, job.ID)
+	if saveErr := saveJob(job); saveErr != nil {
+		log.Printf("Failed to persist job %s: %v", job.ID, saveErr)
+	}
+	return err
 }
 
 func (sq *StorageQueue) GetJob(jobID string) (*StorageJob, error) {
 	sq.mu.RLock()
 	defer sq.mu.RUnlock()
 	
+	if job, exists := sq.jobs[jobID]; exists {
+		copied := *job
+		return &copied, nil
+	}
+	
+	return loadJob(jobID)
+}
+
+// CancelJob cancels a job that has not started processing yet
+func (sq *StorageQueue) CancelJob(jobID string) (*StorageJob, error) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+
 	job, exists := sq.jobs[jobID]
 	if !exists {
-		return nil, fmt.Errorf("job not found")
+		// Finished jobs from a previous run are only in the database
+		stored, err := loadJob(jobID)
+		if err != nil {
+			return nil, err
+		}
+		job = stored
+	}
+
+	if job.Status != "pending" {
+		return nil, errJobNotCancelable
+	}
+
+	job.Status = "cancelled"
+	job.Data = nil
+	if err := saveJob(job); err != nil {
+		return nil, err
+	}
+	delete(sq.jobs, job.ID)
+
+	log.Printf("Job %s cancelled", job.ID)
+	copied := *job
+	return &copied, nil
+}
+
+// Recover re-queues jobs left pending or processing by a previous run
+func (sq *StorageQueue) Recover() error {
+	jobs, err := loadUnfinishedJobs()
+	if err != nil {
+		return fmt.Errorf("failed to recover jobs: %w", err)
+	}
+
+	for _, job := range jobs {
+		// A job interrupted mid-upload is retried from the start
+		job.Status = "pending"
+		if err := saveJob(job); err != nil {
+			return err
+		}
+
+		sq.mu.Lock()
+		sq.jobs[job.ID] = job
+		sq.mu.Unlock()
+	}
+
+	if len(jobs) > 0 {
+		log.Printf("Recovered %d storage jobs", len(jobs))
+	}
+	// A backlog larger than the channel is fed as the workers drain it
+	go sq.requeue(jobs)
+	return nil
+}
+
+// requeue queues recovered jobs, waiting for room, until the queue stops.
+// Jobs left unqueued by a shutdown stay pending for the next run.
+func (sq *StorageQueue) requeue(jobs []*StorageJob) {
+	for _, job := range jobs {
+		select {
+		case sq.pending <- job:
+		case <-sq.ctx.Done():
+			return
+		}
 	}
-	
-	return job, nil
 }
 
 func (sq *StorageQueue) worker(workerID int) {
@@ -132,11 +239,18 @@ func (sq *StorageQueue) worker(workerID int) {
 }
 
 func (sq *StorageQueue) processJob(job *StorageJob, workerID int) {
-	log.Printf("Worker %d processing job %s (attempt %d)", workerID, job.ID, job.Attempts+1)
-	
 	sq.mu.Lock()
+	if job.Status == "cancelled" {
+		sq.mu.Unlock()
+		log.Printf("Worker %d skipping cancelled job %s", workerID, job.ID)
+		return
+	}
+	log.Printf("Worker %d processing job %s (attempt %d)", workerID, job.ID, job.Attempts+1)
 	job.Status = "processing"
 	job.Attempts++
+	if err := saveJob(job); err != nil {
+		log.Printf("Failed to persist job %s: %v", job.ID, err)
+	}
 	sq.mu.Unlock()
 
 	var result *JobResult
@@ -147,6 +261,8 @@ func (sq *StorageQueue) processJob(job *StorageJob, workerID int) {
 		result, err = sq.processUploadJob(job)
 	case "receipt":
 		result, err = sq.processReceiptJob(job)
+	case "export":
+		result, err = sq.processExportJob(job)
 	default:
 		err = fmt.Errorf("unknown job type: %s", job.Type)
 	}
@@ -157,7 +273,12 @@ func (sq *StorageQueue) processJob(job *StorageJob, workerID int) {
 	if err != nil {
 		job.Error = err.Error()
 		
-		if job.Attempts >= job.MaxAttempts {
+		var rejected *UploadRejectedError
+		if errors.As(err, &rejected) {
+			// Rescanning the same content gives the same verdict
+			job.Status = "failed"
+			log.Printf("Job %s rejected by scanner: %v", job.ID, err)
+		} else if job.Attempts >= job.MaxAttempts {
 			job.Status = "failed"
 			log.Printf("Job %s failed permanently after %d attempts: %v", job.ID, job.Attempts, err)
 		} else {
@@ -165,8 +286,8 @@ func (sq *StorageQueue) processJob(job *StorageJob, workerID int) {
 			log.Printf("Job %s failed (attempt %d/%d), will retry: %v", job.ID, job.Attempts, job.MaxAttempts, err)
 			
 			// Schedule retry
+			delay := time.Duration(job.Attempts*job.Attempts) * time.Second // Exponential backoff
 			go func() {
-				delay := time.Duration(job.Attempts*job.Attempts) * time.Second // Exponential backoff
 				time.Sleep(delay)
 				
 				select {
@@ -179,13 +300,33 @@ func (sq *StorageQueue) processJob(job *StorageJob, workerID int) {
 		}
 	} else {
 		job.Status = "completed"
+		job.Error = ""
 		job.Result = result
 		log.Printf("Job %s completed successfully", job.ID)
 	}
+
+	// Finished jobs are served from the database
+	if job.Status == "completed" || job.Status == "failed" {
+		job.Data = nil
+		delete(sq.jobs, job.ID)
+	}
+	if err := saveJob(job); err != nil {
+		log.Printf("Failed to persist job %s: %v", job.ID, err)
+	}
 }
 
 func (sq *StorageQueue) processUploadJob(job *StorageJob) (*JobResult, error) {
-	cid, err := uploadToFilecoin(job.Data, job.Filename)
+	caller, _ := job.Options["caller"].(string)
+	if caller == "" {
+		caller = "queue"
+	}
+
+	verdict, err := scanUpload(sq.ctx, job.Data, job.Filename, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	cid, err := storeObject(sq.ctx, job.Data, job.Filename, "attachment")
 	if err != nil {
 		return nil, err
 	}
@@ -196,10 +337,10 @@ func (sq *StorageQueue) processUploadJob(job *StorageJob) (*JobResult, error) {
 		CID:      cid,
 		Size:     int64(len(job.Data)),
 		Cost:     cost,
-		Metadata: map[string]string{
+		Metadata: scanMetadata(map[string]string{
 			"filename":    job.Filename,
 			"upload_type": "direct",
-		},
+		}, verdict),
 		CreatedAt: time.Now(),
 	}, nil
 }
@@ -222,51 +363,21 @@ func (sq *StorageQueue) processReceiptJob(job *StorageJob) (*JobResult, error) {
 		language = "en"
 	}
 
-	// Fetch payment and generate receipt
-	paymentData, err := fetchPaymentData(paymentID)
-	if err != nil {
-		return nil, err
-	}
-
-	receipt, err := generateReceipt(paymentData, format, language)
+	generated, err := createReceipt(sq.ctx, paymentID, format, language, "queue", ReceiptDetails{})
 	if err != nil {
 		return nil, err
 	}
-
-	// Convert to uploadable format
-	var uploadData []byte
-	var filename string
-
-	switch format {
-	case "pdf":
-		uploadData, err = generatePDFReceipt(receipt)
-		filename = fmt.Sprintf("receipt_%d.pdf", paymentID)
-	default:
-		uploadData, err = json.MarshalIndent(receipt, "", "  ")
-		filename = fmt.Sprintf("receipt_%d.json", paymentID)
-	}
-
-	if err != nil {
-		return nil, err
-	}
-
-	// Upload to Filecoin
-	cid, err := uploadToFilecoin(uploadData, filename)
-	if err != nil {
-		return nil, err
-	}
-
-	receipt.CID = cid
-	cost := calculateStorageCost(int64(len(uploadData)))
+	record := generated.Record
 
 	return &JobResult{
-		CID:  cid,
-		Size: int64(len(uploadData)),
-		Cost: cost,
+		CID:  record.CID,
+		Size: record.Size,
+		Cost: generated.Cost,
 		Metadata: map[string]string{
-			"filename":   filename,
-			"format":     format,
+			"filename":   generated.Filename,
+			"format":     record.Format,
 			"payment_id": strconv.FormatUint(paymentID, 10),
+			"receipt_id": record.ReceiptID,
 		},
 		CreatedAt: time.Now(),
 	}, nil
@@ -287,22 +398,13 @@ func (sq *StorageQueue) retryScheduler() {
 }
 
 func (sq *StorageQueue) checkFailedJobs() {
-	sq.mu.RLock()
-	defer sq.mu.RUnlock()
-
-	failedCount := 0
-	pendingCount := 0
-	
-	for _, job := range sq.jobs {
-		switch job.Status {
-		case "failed":
-			failedCount++
-		case "pending":
-			pendingCount++
-		}
+	counts, err := countJobsByStatus()
+	if err != nil {
+		log.Printf("Failed to read queue status: %v", err)
+		return
 	}
 
-	if failedCount > 0 || pendingCount > 0 {
-		log.Printf("Queue status: %d pending, %d failed jobs", pendingCount, failedCount)
+	if counts["failed"] > 0 || counts["pending"] > 0 {
+		log.Printf("Queue status: %d pending, %d failed jobs", counts["pending"], counts["failed"])
 	}
-}
\ No newline at end of file
+}
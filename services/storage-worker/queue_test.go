@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestQueue(t *testing.T) *StorageQueue {
+	initializeStorageService()
+	queue = NewStorageQueue(1)
+	t.Cleanup(queue.Stop)
+	return queue
+}
+
+func TestStorageQueuePersistence(t *testing.T) {
+	t.Run("should process and persist upload jobs", func(t *testing.T) {
+		sq := newTestQueue(t)
+		sq.Start()
+
+		job := &StorageJob{Type: "upload", Data: []byte("hello world"), Filename: "hello.txt"}
+		require.NoError(t, sq.AddJob(context.Background(), job))
+
+		assert.Eventually(t, func() bool {
+			stored, err := loadJob(job.ID)
+			return err == nil && stored.Status == "completed"
+		}, 5*time.Second, 20*time.Millisecond)
+
+		stored, err := sq.GetJob(job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", stored.Result.CID)
+		assert.Empty(t, stored.Data)
+	})
+
+	t.Run("should recover unfinished jobs after a restart", func(t *testing.T) {
+		newTestQueue(t)
+		require.NoError(t, saveJob(&StorageJob{
+			ID:          "job_1_upload",
+			Type:        "upload",
+			Data:        []byte("hello world"),
+			Filename:    "hello.txt",
+			Status:      "processing",
+			Attempts:    1,
+			MaxAttempts: 3,
+			CreatedAt:   time.Now(),
+		}))
+
+		restarted := NewStorageQueue(1)
+		require.NoError(t, restarted.Recover())
+
+		recovered := <-restarted.pending
+		assert.Equal(t, "job_1_upload", recovered.ID)
+		assert.Equal(t, "pending", recovered.Status)
+		assert.Equal(t, []byte("hello world"), recovered.Data)
+	})
+
+	t.Run("should recover more jobs than the queue holds", func(t *testing.T) {
+		newTestQueue(t)
+		for i := 0; i < 150; i++ {
+			require.NoError(t, saveJob(&StorageJob{
+				ID:          fmt.Sprintf("job_%d_upload", i),
+				Type:        "upload",
+				Status:      "pending",
+				MaxAttempts: 3,
+				CreatedAt:   time.Now(),
+			}))
+		}
+
+		restarted := NewStorageQueue(1)
+		t.Cleanup(restarted.Stop)
+		require.NoError(t, restarted.Recover())
+
+		for i := 0; i < 150; i++ {
+			select {
+			case <-restarted.pending:
+			case <-time.After(time.Second):
+				t.Fatalf("only %d jobs were queued", i)
+			}
+		}
+	})
+
+	t.Run("should cancel pending jobs only", func(t *testing.T) {
+		sq := newTestQueue(t)
+
+		job := &StorageJob{Type: "upload", Data: []byte("data"), Filename: "a.txt"}
+		require.NoError(t, sq.AddJob(context.Background(), job))
+
+		cancelled, err := sq.CancelJob(job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "cancelled", cancelled.Status)
+
+		_, err = sq.CancelJob(job.ID)
+		assert.ErrorIs(t, err, errJobNotCancelable)
+
+		_, err = sq.CancelJob("job_missing")
+		assert.ErrorIs(t, err, errJobNotFound)
+
+		// The worker skips the job left in the channel
+		sq.processJob(<-sq.pending, 0)
+		stored, err := loadJob(job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "cancelled", stored.Status)
+		assert.Equal(t, 0, stored.Attempts)
+	})
+
+	t.Run("should cancel jobs the caller gave up queueing", func(t *testing.T) {
+		sq := newTestQueue(t)
+		// No room, as when every slot is taken
+		sq.pending = make(chan *StorageJob)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		job := &StorageJob{Type: "upload", Data: []byte("data"), Filename: "a.txt"}
+		assert.ErrorIs(t, sq.AddJob(ctx, job), context.DeadlineExceeded)
+
+		stored, err := loadJob(job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "cancelled", stored.Status)
+		_, err = sq.CancelJob(job.ID)
+		assert.ErrorIs(t, err, errJobNotCancelable)
+
+		cancel()
+		assert.ErrorIs(t, sq.AddJob(ctx, &StorageJob{Type: "upload"}), context.DeadlineExceeded)
+	})
+}
+
+func TestHandleJobs(t *testing.T) {
+	sq := newTestQueue(t)
+
+	first := &StorageJob{Type: "upload", Data: []byte("one"), Filename: "one.txt"}
+	second := &StorageJob{Type: "receipt", Options: map[string]interface{}{"payment_id": float64(7)}}
+	require.NoError(t, sq.AddJob(context.Background(), first))
+	require.NoError(t, sq.AddJob(context.Background(), second))
+
+	router := http.NewServeMux()
+	router.HandleFunc("/api/storage/jobs", handleListJobs)
+	router.HandleFunc("/api/storage/jobs/", handleJob)
+
+	t.Run("should list jobs", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("GET", "/api/storage/jobs?type=receipt", nil)
+		router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Jobs  []StorageJob `json:"jobs"`
+			Total int          `json:"total"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, 1, response.Total)
+		assert.Equal(t, second.ID, response.Jobs[0].ID)
+		assert.Equal(t, float64(7), response.Jobs[0].Options["payment_id"])
+	})
+
+	t.Run("should get a job", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("GET", "/api/storage/jobs/"+first.ID, nil)
+		router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"status":"pending"`)
+		assert.NotContains(t, w.Body.String(), `"data"`)
+	})
+
+	t.Run("should cancel a job", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("POST", "/api/storage/jobs/"+first.ID+"/cancel", nil)
+		router.ServeHTTP(w, httpReq)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = httptest.NewRecorder()
+		httpReq, _ = http.NewRequest("POST", "/api/storage/jobs/"+first.ID+"/cancel", nil)
+		router.ServeHTTP(w, httpReq)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("should return 404 for unknown jobs", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("GET", "/api/storage/jobs/job_missing", nil)
+		router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every receipt generation, through the API or the job queue, is reported to
+// the analytics service's POST /api/metrics/receipt with its format,
+// language, size and storage cost, or the step that failed. Reporting is off
+// when ANALYTICS_URL is unset.
+
+// Steps of a receipt's generation that can fail, as reported to analytics
+const (
+	receiptPaymentNotFound    = "payment_not_found"
+	receiptGenerationFailed   = "generation_failed"
+	receiptRenderingFailed    = "rendering_failed"
+	receiptStorageFailed      = "storage_failed"
+	receiptRegistrationFailed = "registration_failed"
+)
+
+// ReceiptMetric is the body the analytics service accepts on
+// POST /api/metrics/receipt
+type ReceiptMetric struct {
+	PaymentID     uint64    `json:"payment_id"`
+	ChainID       uint64    `json:"chain_id,omitempty"`
+	Format        string    `json:"format"`
+	Language      string    `json:"language"`
+	Source        string    `json:"source"`
+	Status        string    `json:"status"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	SizeBytes     int64     `json:"size_bytes,omitempty"`
+	CostFIL       float64   `json:"cost_fil,omitempty"`
+	DurationMs    int64     `json:"duration_ms"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// receiptReporter posts receipt metrics to the analytics service
+type receiptReporter struct {
+	url    string
+	client *http.Client
+}
+
+// receiptReports is nil when ANALYTICS_URL is unset
+var receiptReports *receiptReporter
+
+func initReceiptReporting(cfg *Config) {
+	receiptReports = nil
+	if cfg.Analytics.URL == "" {
+		log.Println("ANALYTICS_URL not set, receipt generation is not reported")
+		return
+	}
+	receiptReports = &receiptReporter{
+		url:    strings.TrimRight(cfg.Analytics.URL, "/") + "/api/metrics/receipt",
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (r *receiptReporter) report(ctx context.Context, metric ReceiptMetric) error {
+	body, err := json.Marshal(metric)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("analytics service returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// receiptError is the failed step of a receipt's generation
+type receiptError struct {
+	reason string
+	err    error
+}
+
+func (e *receiptError) Error() string { return e.err.Error() }
+func (e *receiptError) Unwrap() error { return e.err }
+
+// GeneratedReceipt is a receipt stored and registered by createReceipt
+type GeneratedReceipt struct {
+	Record   *ReceiptRecord
+	Filename string
+	Cost     string
+}
+
+// createReceipt generates a payment's receipt in format ("json" or "pdf"),
+// stores and registers it, and reports the attempt. source says whether
+// the API or the job queue asked for it, and details are applied to the
+// payment data. Errors are *receiptError.
+func createReceipt(ctx context.Context, paymentID uint64, format, language, source string, details ReceiptDetails) (*GeneratedReceipt, error) {
+	if format != "pdf" {
+		format = "json"
+	}
+	started := time.Now()
+	metric := ReceiptMetric{PaymentID: paymentID, Format: format, Language: localeFor(language).Tag, Source: source}
+
+	generated, err := generateReceiptFile(ctx, paymentID, format, language, details, &metric)
+	metric.DurationMs = time.Since(started).Milliseconds()
+	metric.Timestamp = time.Now()
+	if err != nil {
+		var failure *receiptError
+		errors.As(err, &failure)
+		metric.Status, metric.FailureReason = "failed", failure.reason
+	} else {
+		metric.Status = "success"
+		metric.CostFIL, _ = strconv.ParseFloat(generated.Cost, 64)
+	}
+	if receiptReports != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := receiptReports.report(ctx, metric); err != nil {
+				log.Printf("Failed to report receipt generation for payment %d: %v", paymentID, err)
+			}
+		}()
+	}
+	return generated, err
+}
+
+func generateReceiptFile(ctx context.Context, paymentID uint64, format, language string, details ReceiptDetails, metric *ReceiptMetric) (*GeneratedReceipt, error) {
+	paymentData, err := fetchPaymentData(ctx, paymentID)
+	if err != nil {
+		return nil, &receiptError{receiptPaymentNotFound, err}
+	}
+	details.apply(paymentData)
+	metric.ChainID = uint64(paymentData.ChainID)
+
+	// Merchants PDF receipts are not rolled out to get JSON
+	if format == "pdf" && !features.Enabled(flagPDFReceipts, paymentData.Recipient) {
+		format = "json"
+		metric.Format = format
+	}
+
+	receipt, err := generateReceipt(paymentData, format, language)
+	if err != nil {
+		return nil, &receiptError{receiptGenerationFailed, err}
+	}
+
+	var data []byte
+	filename := fmt.Sprintf("receipt_%d.%s", paymentID, format)
+	if format == "pdf" {
+		data, err = generatePDFReceipt(receipt)
+	} else {
+		data, err = json.MarshalIndent(receipt, "", "  ")
+	}
+	if err != nil {
+		return nil, &receiptError{receiptRenderingFailed, err}
+	}
+
+	cid, err := storeObject(ctx, data, filename, "receipt")
+	if err != nil {
+		return nil, &receiptError{receiptStorageFailed, err}
+	}
+	receipt.CID = cid
+
+	record, err := recordReceipt(receipt, cid, int64(len(data)))
+	if err != nil {
+		return nil, &receiptError{receiptRegistrationFailed, err}
+	}
+	metric.SizeBytes = record.Size
+
+	return &GeneratedReceipt{
+		Record:   record,
+		Filename: filename,
+		Cost:     calculateStorageCost(record.Size),
+	}, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arcbjorn/crosspay/packages/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiptReporting(t *testing.T) {
+	initializeStorageService()
+
+	received := make(chan ReceiptMetric, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/metrics/receipt", r.URL.Path)
+		var metric ReceiptMetric
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&metric))
+		received <- metric
+	}))
+	defer server.Close()
+
+	cfg := &Config{}
+	cfg.Analytics.URL = server.URL + "/"
+	initReceiptReporting(cfg)
+	defer func() { receiptReports = nil }()
+
+	t.Run("should report a generated receipt", func(t *testing.T) {
+		generated, err := createReceipt(context.Background(), 321, "pdf", "es", "api", ReceiptDetails{})
+		require.NoError(t, err)
+
+		metric := <-received
+		assert.Equal(t, uint64(321), metric.PaymentID)
+		assert.Equal(t, uint64(1135), metric.ChainID)
+		assert.Equal(t, "pdf", metric.Format)
+		assert.Equal(t, "es", metric.Language)
+		assert.Equal(t, "api", metric.Source)
+		assert.Equal(t, "success", metric.Status)
+		assert.Empty(t, metric.FailureReason)
+		assert.Equal(t, generated.Record.Size, metric.SizeBytes)
+		assert.Greater(t, metric.CostFIL, 0.0)
+	})
+
+	t.Run("should fall back to json for unknown formats", func(t *testing.T) {
+		generated, err := createReceipt(context.Background(), 322, "", "", "queue", ReceiptDetails{})
+		require.NoError(t, err)
+		assert.Equal(t, "receipt_322.json", generated.Filename)
+
+		metric := <-received
+		assert.Equal(t, "json", metric.Format)
+		assert.Equal(t, "queue", metric.Source)
+	})
+
+	t.Run("should render json for merchants pdf receipts are off for", func(t *testing.T) {
+		defer func(set *flags.Set) { features = set }(features)
+		var err error
+		features, err = flags.NewSet([]flags.Flag{{Name: flagPDFReceipts, Merchants: []string{"0x1234567890123456789012345678901234567890"}}})
+		require.NoError(t, err)
+
+		generated, err := createReceipt(context.Background(), 323, "pdf", "", "api", ReceiptDetails{})
+		require.NoError(t, err)
+		assert.Equal(t, "receipt_323.json", generated.Filename)
+		assert.Equal(t, "json", generated.Record.Format)
+
+		metric := <-received
+		assert.Equal(t, "json", metric.Format)
+	})
+}
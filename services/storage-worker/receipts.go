@@ -3,11 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
+	"github.com/ethereum/go-ethereum/common"
 )
 
 type PaymentData struct {
@@ -35,8 +41,12 @@ type Receipt struct {
 	Version     string            `json:"version"`
 	Format      string            `json:"format"`
 	Signature   string            `json:"signature"`
+	Signer      string            `json:"signer,omitempty"`
 	CID         string            `json:"cid,omitempty"`
 	Metadata    map[string]string `json:"metadata"`
+	Branding    *ReceiptBranding  `json:"branding,omitempty"`
+	// Labels name the receipt's fields in its language
+	Labels      *receiptLabels    `json:"labels,omitempty"`
 }
 
 type GenerateReceiptRequest struct {
@@ -44,6 +54,56 @@ type GenerateReceiptRequest struct {
 	Format    string                `json:"format"` // "json" or "pdf"
 	Language  string                `json:"language,omitempty"`
 	Options   map[string]interface{} `json:"options,omitempty"`
+	ReceiptDetails
+}
+
+// ReceiptDetails describe the payment as the payment processor created it:
+// its sender and recipient as it resolved them, and the transaction that
+// created it. Those set are used in place of the payment data's.
+type ReceiptDetails struct {
+	Sender       string `json:"sender,omitempty"`
+	SenderENS    string `json:"sender_ens,omitempty"`
+	Recipient    string `json:"recipient,omitempty"`
+	RecipientENS string `json:"recipient_ens,omitempty"`
+	ChainID      int    `json:"chain_id,omitempty"`
+	TxHash       string `json:"tx_hash,omitempty"`
+	Token        string `json:"token,omitempty"`
+	Amount       string `json:"amount,omitempty"`
+	Fee          string `json:"fee,omitempty"`
+	Status       string `json:"status,omitempty"`
+	MetadataURI  string `json:"metadata_uri,omitempty"`
+	OraclePrice  string `json:"oracle_price,omitempty"`
+}
+
+// apply describes payment as the payment processor created it
+func (d ReceiptDetails) apply(payment *PaymentData) {
+	if d.Sender != "" {
+		payment.Sender, payment.SenderENS = d.Sender, d.SenderENS
+	}
+	if d.Recipient != "" {
+		payment.Recipient, payment.RecipientENS = d.Recipient, d.RecipientENS
+	}
+	if d.ChainID != 0 {
+		payment.ChainID = d.ChainID
+	}
+	if d.TxHash != "" {
+		payment.TxHash = d.TxHash
+	}
+	if d.Token != "" {
+		payment.Token, payment.Amount, payment.Fee = d.Token, d.Amount, d.Fee
+	}
+	if d.Status != "" {
+		payment.Status = d.Status
+		if d.Status != "completed" {
+			payment.CompletedAt = 0
+		}
+	}
+	if d.MetadataURI != "" {
+		payment.MetadataURI = d.MetadataURI
+	}
+	if d.OraclePrice != "" {
+		payment.OraclePrice = d.OraclePrice
+	}
 }
 
 type GenerateReceiptResponse struct {
@@ -70,61 +130,29 @@ func handleGenerateReceipt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch payment data (mock implementation)
-	paymentData, err := fetchPaymentData(req.PaymentID)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Payment not found: %v", err)})
-		return
-	}
-
-	// Generate receipt
-	receipt, err := generateReceipt(paymentData, req.Format, req.Language)
+	generated, err := createReceipt(r.Context(), req.PaymentID, req.Format, req.Language, "api", req.ReceiptDetails)
 	if err != nil {
+		status, message := http.StatusInternalServerError, receiptErrorMessages[receiptGenerationFailed]
+		var failure *receiptError
+		if errors.As(err, &failure) {
+			message = receiptErrorMessages[failure.reason]
+			if failure.reason == receiptPaymentNotFound {
+				status = http.StatusNotFound
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Receipt generation failed: %v", err)})
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("%s: %v", message, err)})
 		return
 	}
-
-	// Convert receipt to uploadable format
-	var uploadData []byte
-	var filename string
-
-	switch req.Format {
-	case "pdf":
-		uploadData, err = generatePDFReceipt(receipt)
-		filename = fmt.Sprintf("receipt_%d.pdf", req.PaymentID)
-	default:
-		uploadData, err = json.MarshalIndent(receipt, "", "  ")
-		filename = fmt.Sprintf("receipt_%d.json", req.PaymentID)
-	}
-
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Receipt formatting failed: %v", err)})
-		return
-	}
-
-	// Upload to Filecoin
-	cid, err := uploadToFilecoin(uploadData, filename)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Storage upload failed: %v", err)})
-		return
-	}
-
-	receipt.CID = cid
+	record := generated.Record
 
 	response := GenerateReceiptResponse{
-		ReceiptID: fmt.Sprintf("rcpt_%d_%d", req.PaymentID, time.Now().Unix()),
-		CID:       cid,
-		Format:    req.Format,
-		Size:      int64(len(uploadData)),
-		CreatedAt: time.Now(),
+		ReceiptID: record.ReceiptID,
+		CID:       record.CID,
+		Format:    record.Format,
+		Size:      record.Size,
+		CreatedAt: record.CreatedAt,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -132,6 +160,15 @@ func handleGenerateReceipt(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// receiptErrorMessages describe each failed step of a receipt's generation
+var receiptErrorMessages = map[string]string{
+	receiptPaymentNotFound:    "Payment not found",
+	receiptGenerationFailed:   "Receipt generation failed",
+	receiptRenderingFailed:    "Receipt formatting failed",
+	receiptStorageFailed:      "Storage upload failed",
+	receiptRegistrationFailed: "Receipt registration failed",
+}
+
 func handleDownloadReceipt(w http.ResponseWriter, r *http.Request) {
 	// Extract receipt ID from URL path
 	path := strings.TrimPrefix(r.URL.Path, "/api/receipts/download/")
@@ -143,24 +180,46 @@ func handleDownloadReceipt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract CID from receipt ID or lookup in database
+	// Look up the receipt's CID in the registry
 	cid, err := getCIDFromReceiptID(receiptID)
 	if err != nil {
+		if errors.Is(err, errReceiptNotFound) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Receipt not found"})
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Receipt not found"})
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Receipt lookup failed: %v", err)})
+		return
+	}
+
+	caller, err := callerID(r)
+	if err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+	if err := checkBandwidthQuota(caller); err != nil {
+		writeQuotaError(w, err)
 		return
 	}
 
 	// Retrieve from Filecoin
-	data, metadata, err := retrieveFromFilecoin(cid)
+	data, metadata, err := retrieveObject(r.Context(), cid)
 	if err != nil {
+		if errors.Is(err, backend.ErrVerificationFailed) {
+			writeRetrievalError(w, err)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Retrieval failed: %v", err)})
 		return
 	}
 
+	recordRetrieval(caller, int64(len(data)))
+
 	// Set appropriate headers
 	w.Header().Set("Content-Type", metadata["contentType"])
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", metadata["filename"]))
@@ -180,8 +239,12 @@ func handleVerifyReceipt(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Retrieve and verify receipt
-	data, _, err := retrieveFromFilecoin(cid)
+	data, _, err := retrieveObject(r.Context(), cid)
 	if err != nil {
+		if errors.Is(err, backend.ErrVerificationFailed) {
+			writeRetrievalError(w, err)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Receipt not found"})
@@ -196,27 +259,41 @@ func handleVerifyReceipt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify receipt signature and integrity
-	isValid := verifyReceiptSignature(receipt)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	// Recover the EIP-712 signer and check it against the allowlist
+	response := map[string]interface{}{
 		"cid":       cid,
-		"valid":     isValid,
+		"valid":     true,
+		"signer":    receipt.Signer,
 		"payment_id": receipt.Payment.ID,
 		"amount":    receipt.Payment.Amount,
 		"status":    receipt.Payment.Status,
 		"generated_at": receipt.GeneratedAt,
-	})
+	}
+
+	recovered, err := verifyReceipt(&receipt)
+	if (recovered != common.Address{}) {
+		response["recovered_signer"] = recovered.Hex()
+	}
+	if err != nil {
+		response["valid"] = false
+		response["reason"] = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
 }
 
-func fetchPaymentData(paymentID uint64) (*PaymentData, error) {
+func fetchPaymentData(ctx context.Context, paymentID uint64) (*PaymentData, error) {
 	// Mock implementation - would fetch from blockchain
 	log.Printf("Fetching payment data for ID: %d", paymentID)
 	
 	// Simulate API call delay
-	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-time.After(50 * time.Millisecond):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 	
 	return &PaymentData{
 		ID:           paymentID,
@@ -238,17 +315,25 @@ func fetchPaymentData(paymentID uint64) (*PaymentData, error) {
 }
 
 func generateReceipt(payment *PaymentData, format, language string) (*Receipt, error) {
+	locale := localeFor(language)
+	labels := locale.Labels
 	receipt := &Receipt{
 		Payment:     *payment,
 		GeneratedAt: time.Now(),
 		Version:     "1.0",
 		Format:      format,
 		Metadata: map[string]string{
-			"language":    language,
+			"language":    locale.Tag,
+			"direction":   locale.Direction,
 			"generator":   "crosspay-storage-worker",
 			"network":     getNetworkName(payment.ChainID),
 			"receipt_type": "payment_confirmation",
 		},
+		Labels: &labels,
+	}
+
+	if err := applyMerchantTemplate(receipt); err != nil {
+		return nil, err
 	}
 
 	// Generate signature for receipt integrity
@@ -261,71 +346,12 @@ func generateReceipt(payment *PaymentData, format, language string) (*Receipt, e
 	return receipt, nil
 }
 
-func generatePDFReceipt(receipt *Receipt) ([]byte, error) {
-	// Mock PDF generation - would use actual PDF library
-	log.Printf("Generating PDF receipt for payment %d", receipt.Payment.ID)
-	
-	// Simple mock PDF content
-	pdfContent := fmt.Sprintf(`
-CrossPay Payment Receipt
-========================
-
-Payment ID: %d
-From: %s (%s)
-To: %s (%s)
-Amount: %s
-Fee: %s
-Status: %s
-Created: %s
-Completed: %s
-Transaction: %s
-Network: %s
-
-Generated: %s
-Signature: %s
-`, 
-		receipt.Payment.ID,
-		receipt.Payment.SenderENS, receipt.Payment.Sender,
-		receipt.Payment.RecipientENS, receipt.Payment.Recipient,
-		receipt.Payment.Amount,
-		receipt.Payment.Fee,
-		receipt.Payment.Status,
-		time.Unix(receipt.Payment.CreatedAt, 0).Format(time.RFC3339),
-		time.Unix(receipt.Payment.CompletedAt, 0).Format(time.RFC3339),
-		receipt.Payment.TxHash,
-		getNetworkName(receipt.Payment.ChainID),
-		receipt.GeneratedAt.Format(time.RFC3339),
-		receipt.Signature,
-	)
-
-	return []byte(pdfContent), nil
-}
-
-func signReceipt(receipt *Receipt) (string, error) {
-	// Mock signature generation
-	data, err := json.Marshal(receipt.Payment)
+func getCIDFromReceiptID(receiptID string) (string, error) {
+	record, err := getReceiptRecord(receiptID)
 	if err != nil {
 		return "", err
 	}
-	
-	// Would use actual cryptographic signing
-	signature := fmt.Sprintf("sig_%x", len(data)+int(receipt.GeneratedAt.Unix()))
-	return signature, nil
-}
-
-func verifyReceiptSignature(receipt Receipt) bool {
-	// Mock signature verification
-	expectedSig, err := signReceipt(&receipt)
-	if err != nil {
-		return false
-	}
-	return receipt.Signature == expectedSig
-}
-
-func getCIDFromReceiptID(receiptID string) (string, error) {
-	// Mock CID lookup - would use database
-	log.Printf("Looking up CID for receipt: %s", receiptID)
-	return "bafybeigmock" + receiptID[5:], nil
+	return record.CID, nil
 }
 
 func getNetworkName(chainID int) string {
@@ -341,18 +367,25 @@ func getNetworkName(chainID int) string {
 	}
 }
 
-func uploadToFilecoin(data []byte, filename string) (string, error) {
-	ctx := context.Background()
-	result, err := storage.filecoinClient.Upload(ctx, data, filename, nil)
+func storeObject(ctx context.Context, data []byte, filename, class string) (string, error) {
+	result, hash, _, err := putDeduplicated(ctx, data, backend.PutOptions{
+		Filename:    filename,
+		ContentType: mime.TypeByExtension(filepath.Ext(filename)),
+		Class:       class,
+		PinToIPFS:   true,
+		Metadata:    make(map[string]string),
+	})
 	if err != nil {
 		return "", err
 	}
+	if _, err := trackObject(result, class, filename, hash); err != nil {
+		return "", err
+	}
 	return result.CID, nil
 }
 
-func retrieveFromFilecoin(cid string) ([]byte, map[string]string, error) {
-	ctx := context.Background()
-	result, err := storage.filecoinClient.Retrieve(ctx, cid)
+func retrieveObject(ctx context.Context, cid string) ([]byte, map[string]string, error) {
+	result, err := storage.router.Get(ctx, cid)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -363,4 +396,4 @@ func retrieveFromFilecoin(cid string) ([]byte, map[string]string, error) {
 	}
 	
 	return result.Data, metadata, nil
-}
\ No newline at end of file
+}
@@ -2,24 +2,51 @@ package main
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/gin-gonic/gin"
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
 	"github.com/stretchr/testify/assert"
 )
 
+var testBackend *backend.MemoryBackend
+
+// initializeStorageService points the service at an in-memory backend
+func initializeStorageService() {
+	testBackend = backend.NewMemoryBackend("memory")
+	router := backend.NewRouter()
+	router.Register(testBackend)
+
+	storage = &StorageService{router: router}
+
+	if err := openStorageDB(":memory:"); err != nil {
+		panic(err)
+	}
+}
+
+func seedObject(t *testing.T, cid string, data []byte, filename string) string {
+	result, err := testBackend.Put(context.Background(), data, backend.PutOptions{
+		CID:         cid,
+		Filename:    filename,
+		ContentType: "application/json",
+	})
+	assert.NoError(t, err)
+	return result.CID
+}
+
 func TestHandleGenerateReceipt(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-	
 	// Initialize storage service for tests
 	initializeStorageService()
 	
-	router := gin.New()
-	router.POST("/receipts", handleGenerateReceipt)
+	router := http.NewServeMux()
+	router.HandleFunc("/receipts", handleGenerateReceipt)
 
 	t.Run("should generate receipt successfully", func(t *testing.T) {
 		req := GenerateReceiptRequest{
@@ -68,6 +95,44 @@ func TestHandleGenerateReceipt(t *testing.T) {
 		assert.Equal(t, "pdf", response.Format)
 	})
 
+	t.Run("should describe the payment as the payment processor created it", func(t *testing.T) {
+		req := GenerateReceiptRequest{
+			PaymentID: 789,
+			Format:    "json",
+			ReceiptDetails: ReceiptDetails{
+				Recipient:    "0x00000000000000000000000000000000000000c1",
+				RecipientENS: "carol.eth",
+				ChainID:      31337,
+				TxHash:       "0x9c1e3b5a3d4f2b8e7c6d5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d",
+				Token:        "0x0000000000000000000000000000000000000000",
+				Amount:       "5000",
+				Fee:          "5",
+				Status:       "pending",
+			},
+		}
+
+		reqBody, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("POST", "/receipts", bytes.NewBuffer(reqBody))
+		router.ServeHTTP(w, httpReq)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response GenerateReceiptResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		object, err := testBackend.Get(context.Background(), response.CID)
+		assert.NoError(t, err)
+		var receipt Receipt
+		assert.NoError(t, json.Unmarshal(object.Data, &receipt))
+		assert.Equal(t, "0x00000000000000000000000000000000000000c1", receipt.Payment.Recipient)
+		assert.Equal(t, "carol.eth", receipt.Payment.RecipientENS)
+		assert.Equal(t, "alice.eth", receipt.Payment.SenderENS)
+		assert.Equal(t, 31337, receipt.Payment.ChainID)
+		assert.Equal(t, "5000", receipt.Payment.Amount)
+		assert.Equal(t, "pending", receipt.Payment.Status)
+		assert.Zero(t, receipt.Payment.CompletedAt)
+		assert.Equal(t, "2500.00", receipt.Payment.OraclePrice, "unset details keep the payment data's")
+	})
+
 	t.Run("should handle invalid request format", func(t *testing.T) {
 		w := httptest.NewRecorder()
 		httpReq, _ := http.NewRequest("POST", "/receipts", bytes.NewBuffer([]byte("invalid json")))
@@ -80,13 +145,25 @@ func TestHandleGenerateReceipt(t *testing.T) {
 }
 
 func TestHandleDownloadReceipt(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-	router := gin.New()
-	router.GET("/receipts/:id", handleDownloadReceipt)
+	initializeStorageService()
+	cid := seedObject(t, "", []byte(`{"payment":{"id":123}}`), "receipt_123.json")
+	assert.NoError(t, saveReceiptRecord(&ReceiptRecord{
+		ReceiptID: "rcpt_123_1640995200",
+		CID:       cid,
+		PaymentID: 123,
+		Merchant:  "0x0987654321098765432109876543210987654321",
+		Format:    "json",
+		Language:  "en",
+		Size:      22,
+		CreatedAt: time.Unix(1640995200, 0),
+	}))
+
+	router := http.NewServeMux()
+	router.HandleFunc("/api/receipts/download/", handleDownloadReceipt)
 
 	t.Run("should download receipt successfully", func(t *testing.T) {
 		w := httptest.NewRecorder()
-		httpReq, _ := http.NewRequest("GET", "/receipts/rcpt_123_1640995200", nil)
+		httpReq, _ := http.NewRequest("GET", "/api/receipts/download/rcpt_123_1640995200", nil)
 
 		router.ServeHTTP(w, httpReq)
 
@@ -94,24 +171,38 @@ func TestHandleDownloadReceipt(t *testing.T) {
 		assert.NotEmpty(t, w.Body.String())
 	})
 
-	t.Run("should handle missing receipt ID", func(t *testing.T) {
+	t.Run("should return 404 for unknown receipt", func(t *testing.T) {
 		w := httptest.NewRecorder()
-		httpReq, _ := http.NewRequest("GET", "/receipts/", nil)
+		httpReq, _ := http.NewRequest("GET", "/api/receipts/download/rcpt_999_1640995200", nil)
 
 		router.ServeHTTP(w, httpReq)
 
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
+
+	t.Run("should handle missing receipt ID", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("GET", "/api/receipts/download/", nil)
+
+		router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
 }
 
 func TestHandleVerifyReceipt(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-	router := gin.New()
-	router.GET("/verify/:cid", handleVerifyReceipt)
+	initializeStorageService()
+	receipt, err := generateReceipt(&PaymentData{ID: 123, Amount: "1000", Status: "completed", ChainID: 1135}, "json", "en")
+	assert.NoError(t, err)
+	receiptData, _ := json.Marshal(receipt)
+	cid := seedObject(t, "", receiptData, "receipt_123.json")
+
+	router := http.NewServeMux()
+	router.HandleFunc("/api/receipts/verify/", handleVerifyReceipt)
 
 	t.Run("should verify receipt successfully", func(t *testing.T) {
 		w := httptest.NewRecorder()
-		httpReq, _ := http.NewRequest("GET", "/verify/bafybeigtest123", nil)
+		httpReq, _ := http.NewRequest("GET", "/api/receipts/verify/"+cid, nil)
 
 		router.ServeHTTP(w, httpReq)
 
@@ -127,17 +218,17 @@ func TestHandleVerifyReceipt(t *testing.T) {
 
 	t.Run("should handle missing CID", func(t *testing.T) {
 		w := httptest.NewRecorder()
-		httpReq, _ := http.NewRequest("GET", "/verify/", nil)
+		httpReq, _ := http.NewRequest("GET", "/api/receipts/verify/", nil)
 
 		router.ServeHTTP(w, httpReq)
 
-		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 }
 
 func TestFetchPaymentData(t *testing.T) {
 	t.Run("should fetch payment data", func(t *testing.T) {
-		payment, err := fetchPaymentData(123)
+		payment, err := fetchPaymentData(context.Background(), 123)
 
 		assert.NoError(t, err)
 		assert.NotNil(t, payment)
@@ -205,13 +296,62 @@ func TestGeneratePDFReceipt(t *testing.T) {
 
 		assert.NoError(t, err)
 		assert.NotNil(t, pdfData)
-		assert.Contains(t, string(pdfData), "CrossPay Payment Receipt")
-		assert.Contains(t, string(pdfData), "alice.eth")
-		assert.Contains(t, string(pdfData), "bob.eth")
-		assert.Contains(t, string(pdfData), "completed")
+		assert.True(t, bytes.HasPrefix(pdfData, []byte("%PDF-")))
+
+		text := pdfText(t, pdfData)
+		assert.Contains(t, text, "CrossPay Payment Receipt")
+		assert.Contains(t, text, "alice.eth")
+		assert.Contains(t, text, "bob.eth")
+		assert.Contains(t, text, "completed")
+		assert.Contains(t, string(pdfData), receiptVerificationURL(123))
+	})
+
+	t.Run("should localize labels", func(t *testing.T) {
+		localized := *receipt
+		localized.Metadata = map[string]string{"language": "es"}
+
+		pdfData, err := generatePDFReceipt(&localized)
+
+		assert.NoError(t, err)
+		text := pdfText(t, pdfData)
+		assert.Contains(t, text, "Recibo de Pago CrossPay")
+		assert.Contains(t, text, "Importe")
 	})
 }
 
+// pdfText inflates the compressed content streams of a PDF so tests can
+// assert on the rendered text
+func pdfText(t *testing.T, data []byte) string {
+	var text strings.Builder
+	rest := data
+	for {
+		start := bytes.Index(rest, []byte("stream\n"))
+		if start < 0 {
+			break
+		}
+		rest = rest[start+len("stream\n"):]
+		end := bytes.Index(rest, []byte("\nendstream"))
+		if end < 0 {
+			break
+		}
+
+		reader, err := zlib.NewReader(bytes.NewReader(rest[:end]))
+		if err == nil {
+			inflated, _ := io.ReadAll(reader)
+			text.Write(inflated)
+		}
+		rest = rest[end:]
+	}
+	return text.String()
+}
+
+func TestLabelsFor(t *testing.T) {
+	assert.Equal(t, "Montant", labelsFor("fr").Amount)
+	assert.Equal(t, "Valor", labelsFor("pt-BR").Amount)
+	assert.Equal(t, "Amount", labelsFor("xx").Amount)
+	assert.Equal(t, "Amount", labelsFor("").Amount)
+}
+
 func TestSignAndVerifyReceipt(t *testing.T) {
 	receipt := &Receipt{
 		Payment: PaymentData{
@@ -226,7 +366,9 @@ func TestSignAndVerifyReceipt(t *testing.T) {
 
 		assert.NoError(t, err)
 		assert.NotEmpty(t, signature)
-		assert.Contains(t, signature, "sig_")
+		assert.True(t, strings.HasPrefix(signature, "0x"))
+		assert.Len(t, signature, 132)
+		assert.Equal(t, getReceiptSigner().Address().Hex(), receipt.Signer)
 	})
 
 	t.Run("should verify receipt signature", func(t *testing.T) {
@@ -248,12 +390,108 @@ func TestSignAndVerifyReceipt(t *testing.T) {
 }
 
 func TestGetCIDFromReceiptID(t *testing.T) {
-	t.Run("should extract CID from receipt ID", func(t *testing.T) {
+	initializeStorageService()
+	assert.NoError(t, saveReceiptRecord(&ReceiptRecord{
+		ReceiptID: "rcpt_123_1640995200",
+		CID:       "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e",
+		PaymentID: 123,
+		Merchant:  "0x0987654321098765432109876543210987654321",
+		Format:    "json",
+		Language:  "en",
+		CreatedAt: time.Unix(1640995200, 0),
+	}))
+
+	t.Run("should look up CID in the registry", func(t *testing.T) {
 		cid, err := getCIDFromReceiptID("rcpt_123_1640995200")
 
 		assert.NoError(t, err)
-		assert.NotEmpty(t, cid)
-		assert.Contains(t, cid, "bafybeigmock")
+		assert.Equal(t, "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", cid)
+	})
+
+	t.Run("should not fabricate CIDs for unknown receipts", func(t *testing.T) {
+		_, err := getCIDFromReceiptID("rcpt_456_1640995200")
+
+		assert.ErrorIs(t, err, errReceiptNotFound)
+	})
+}
+
+func TestHandleListReceipts(t *testing.T) {
+	initializeStorageService()
+
+	merchantA := "0x0987654321098765432109876543210987654321"
+	merchantB := "0x1111111111111111111111111111111111111111"
+	records := []ReceiptRecord{
+		{ReceiptID: "rcpt_1_a", CID: "cid1", PaymentID: 1, Merchant: merchantA, Format: "json", Language: "en", CreatedAt: time.Unix(1700000000, 0)},
+		{ReceiptID: "rcpt_1_b", CID: "cid2", PaymentID: 1, Merchant: merchantA, Format: "pdf", Language: "es", CreatedAt: time.Unix(1700086400, 0)},
+		{ReceiptID: "rcpt_2_a", CID: "cid3", PaymentID: 2, Merchant: merchantB, Format: "json", Language: "en", CreatedAt: time.Unix(1700172800, 0)},
+	}
+	for i := range records {
+		assert.NoError(t, saveReceiptRecord(&records[i]))
+	}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/api/receipts", handleListReceipts)
+	router.HandleFunc("/api/receipts/payment/", handleListReceipts)
+	router.HandleFunc("/api/receipts/merchant/", handleListReceipts)
+
+	list := func(path string) (int, []ReceiptRecord, int) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(w, httpReq)
+
+		var response struct {
+			Receipts []ReceiptRecord `json:"receipts"`
+			Total    int             `json:"total"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Receipts, response.Total
+	}
+
+	t.Run("should list newest first", func(t *testing.T) {
+		code, receipts, total := list("/api/receipts")
+
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 3, total)
+		assert.Equal(t, "rcpt_2_a", receipts[0].ReceiptID)
+	})
+
+	t.Run("should filter by payment", func(t *testing.T) {
+		_, receipts, _ := list("/api/receipts/payment/1")
+		assert.Len(t, receipts, 2)
+
+		_, receipts, _ = list("/api/receipts?payment_id=2")
+		assert.Len(t, receipts, 1)
+	})
+
+	t.Run("should filter by merchant case-insensitively", func(t *testing.T) {
+		_, receipts, _ := list("/api/receipts/merchant/0x" + strings.ToUpper(merchantA[2:]))
+		assert.Len(t, receipts, 2)
+
+		_, receipts, _ = list("/api/receipts?merchant=" + merchantB)
+		assert.Len(t, receipts, 1)
+	})
+
+	t.Run("should filter by date range", func(t *testing.T) {
+		_, receipts, _ := list("/api/receipts?from=2023-11-15T00:00:00Z&to=1700100000")
+
+		assert.Len(t, receipts, 1)
+		assert.Equal(t, "rcpt_1_b", receipts[0].ReceiptID)
+	})
+
+	t.Run("should paginate", func(t *testing.T) {
+		_, receipts, total := list("/api/receipts?limit=1&offset=1")
+
+		assert.Equal(t, 3, total)
+		assert.Len(t, receipts, 1)
+		assert.Equal(t, "rcpt_1_b", receipts[0].ReceiptID)
+	})
+
+	t.Run("should reject invalid filters", func(t *testing.T) {
+		code, _, _ := list("/api/receipts?from=yesterday")
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _, _ = list("/api/receipts/payment/abc")
+		assert.Equal(t, http.StatusBadRequest, code)
 	})
 }
 
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errReceiptNotFound = errors.New("receipt not found")
+
+// ReceiptRecord is the registry entry for a generated receipt
+type ReceiptRecord struct {
+	ReceiptID string    `json:"receipt_id"`
+	CID       string    `json:"cid"`
+	PaymentID uint64    `json:"payment_id"`
+	Merchant  string    `json:"merchant"`
+	Format    string    `json:"format"`
+	Language  string    `json:"language"`
+	Size      int64     `json:"size"`
+	Signer    string    `json:"signer,omitempty"`
+	ChainID   int       `json:"chain_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReceiptFilter narrows a receipt listing. Zero values match everything.
+type ReceiptFilter struct {
+	PaymentID *uint64
+	Merchant  string
+	From      time.Time
+	To        time.Time
+	Limit     int
+	Offset    int
+}
+
+// newReceiptID returns a unique receipt identifier for a payment
+func newReceiptID(paymentID uint64) string {
+	return fmt.Sprintf("rcpt_%d_%d", paymentID, time.Now().UnixNano())
+}
+
+func saveReceiptRecord(record *ReceiptRecord) error {
+	_, err := db.Exec(`
+		INSERT INTO receipts (id, cid, payment_id, merchant, format, language, size, signer, chain_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.ReceiptID, record.CID, record.PaymentID, strings.ToLower(record.Merchant),
+		record.Format, record.Language, record.Size, record.Signer, record.ChainID, record.CreatedAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save receipt record: %w", err)
+	}
+	return nil
+}
+
+func getReceiptRecord(receiptID string) (*ReceiptRecord, error) {
+	row := db.QueryRow(`
+		SELECT id, cid, payment_id, merchant, format, language, size, signer, chain_id, created_at
+		FROM receipts WHERE id = ? AND erased_at IS NULL`, receiptID)
+
+	record, err := scanReceiptRecord(row)
+	if err == sql.ErrNoRows {
+		return nil, errReceiptNotFound
+	}
+	return record, err
+}
+
+func listReceiptRecords(filter ReceiptFilter) ([]ReceiptRecord, int, error) {
+	// Erased receipts are no longer listed
+	conditions := []string{"erased_at IS NULL"}
+	var args []interface{}
+
+	if filter.PaymentID != nil {
+		conditions = append(conditions, "payment_id = ?")
+		args = append(args, *filter.PaymentID)
+	}
+	if filter.Merchant != "" {
+		conditions = append(conditions, "merchant = ?")
+		args = append(args, strings.ToLower(filter.Merchant))
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From.Unix())
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "created_at <= ?")
+		args = append(args, filter.To.Unix())
+	}
+
+	where := " WHERE " + strings.Join(conditions, " AND ")
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM receipts"+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count receipts: %w", err)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	rows, err := db.Query(`
+		SELECT id, cid, payment_id, merchant, format, language, size, signer, chain_id, created_at
+		FROM receipts`+where+` ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?`,
+		append(args, limit, filter.Offset)...,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list receipts: %w", err)
+	}
+	defer rows.Close()
+
+	records := []ReceiptRecord{}
+	for rows.Next() {
+		record, err := scanReceiptRecord(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, *record)
+	}
+
+	return records, total, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReceiptRecord(row rowScanner) (*ReceiptRecord, error) {
+	var record ReceiptRecord
+	var signer sql.NullString
+	var chainID sql.NullInt64
+	var createdAt int64
+
+	err := row.Scan(&record.ReceiptID, &record.CID, &record.PaymentID, &record.Merchant,
+		&record.Format, &record.Language, &record.Size, &signer, &chainID, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Signer = signer.String
+	record.ChainID = int(chainID.Int64)
+	record.CreatedAt = time.Unix(createdAt, 0).UTC()
+	return &record, nil
+}
+
+// recordReceipt registers a stored receipt and returns its registry entry
+func recordReceipt(receipt *Receipt, cid string, size int64) (*ReceiptRecord, error) {
+	record := &ReceiptRecord{
+		ReceiptID: newReceiptID(receipt.Payment.ID),
+		CID:       cid,
+		PaymentID: receipt.Payment.ID,
+		Merchant:  receipt.Payment.Recipient,
+		Format:    receipt.Format,
+		Language:  receipt.Metadata["language"],
+		Size:      size,
+		Signer:    receipt.Signer,
+		ChainID:   receipt.Payment.ChainID,
+		CreatedAt: receipt.GeneratedAt,
+	}
+	if record.Format == "" {
+		record.Format = "json"
+	}
+
+	if err := saveReceiptRecord(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func handleListReceipts(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseReceiptFilter(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// Path forms: /api/receipts/payment/{id} and /api/receipts/merchant/{address}
+	if rest := strings.TrimPrefix(r.URL.Path, "/api/receipts/payment/"); rest != r.URL.Path {
+		paymentID, err := strconv.ParseUint(strings.TrimSuffix(rest, "/"), 10, 64)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid payment ID"})
+			return
+		}
+		filter.PaymentID = &paymentID
+	}
+	if rest := strings.TrimPrefix(r.URL.Path, "/api/receipts/merchant/"); rest != r.URL.Path {
+		filter.Merchant = strings.TrimSuffix(rest, "/")
+	}
+
+	records, total, err := listReceiptRecords(filter)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to list receipts"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"receipts": records,
+		"count":    len(records),
+		"total":    total,
+	})
+}
+
+func parseReceiptFilter(r *http.Request) (ReceiptFilter, error) {
+	query := r.URL.Query()
+	var filter ReceiptFilter
+
+	if value := query.Get("payment_id"); value != "" {
+		paymentID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid payment_id")
+		}
+		filter.PaymentID = &paymentID
+	}
+	filter.Merchant = query.Get("merchant")
+
+	var err error
+	if filter.From, err = parseTimeParam(query.Get("from")); err != nil {
+		return filter, fmt.Errorf("invalid from: %v", err)
+	}
+	if filter.To, err = parseRangeEnd(query.Get("to")); err != nil {
+		return filter, fmt.Errorf("invalid to: %v", err)
+	}
+
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			return filter, fmt.Errorf("invalid limit")
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		if filter.Offset, err = strconv.Atoi(value); err != nil || filter.Offset < 0 {
+			return filter, fmt.Errorf("invalid offset")
+		}
+	}
+
+	return filter, nil
+}
+
+// parseTimeParam accepts RFC3339 timestamps, dates (2006-01-02) or unix seconds
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// parseRangeEnd parses the end of a date range. A bare date covers the
+// whole day.
+func parseRangeEnd(value string) (time.Time, error) {
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		return day.Add(24*time.Hour - time.Second), nil
+	}
+	return parseTimeParam(value)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/distributed"
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
+)
+
+// RetentionPolicy is how long objects of a class are kept. A zero Duration
+// keeps objects forever.
+type RetentionPolicy struct {
+	Class    string        `json:"class"`
+	Duration time.Duration `json:"-"`
+	Retain   string        `json:"retain"`
+}
+
+// StoredObject tracks a stored CID for retention and legal holds
+type StoredObject struct {
+	CID             string     `json:"cid"`
+	Class           string     `json:"class"`
+	Filename        string     `json:"filename,omitempty"`
+	Size            int64      `json:"size"`
+	Backend         string     `json:"backend"`
+	Replicas        []string   `json:"replicas,omitempty"`
+	LegalHold       bool       `json:"legal_hold"`
+	LegalHoldReason string     `json:"legal_hold_reason,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	DeletedAt       *time.Time `json:"deleted_at,omitempty"`
+	SHA256          string     `json:"sha256,omitempty"`
+	RefCount        int        `json:"ref_count"`
+}
+
+// GCResult summarizes a garbage collection run
+type GCResult struct {
+	Expired int      `json:"expired"`
+	Deleted int      `json:"deleted"`
+	Held    int      `json:"held"`
+	Failed  []string `json:"failed,omitempty"`
+}
+
+var (
+	errObjectNotFound = errors.New("object not found")
+
+	retentionPolicies = map[string]RetentionPolicy{}
+	gcDeletedTotal    uint64
+)
+
+// initRetention loads STORAGE_RETENTION, e.g.
+// "receipt=7y;attachment=90d;proof=forever". Classes without a policy fall
+// back to "default", and are kept forever when that is unset too.
+func initRetention(cfg *Config) error {
+	policies, err := parseRetentionPolicies(cfg.Retention.Policies)
+	if err != nil {
+		return fmt.Errorf("invalid STORAGE_RETENTION: %w", err)
+	}
+
+	retentionPolicies = make(map[string]RetentionPolicy, len(policies))
+	for _, policy := range policies {
+		retentionPolicies[policy.Class] = policy
+	}
+	return nil
+}
+
+func parseRetentionPolicies(spec string) ([]RetentionPolicy, error) {
+	var policies []RetentionPolicy
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		class, value, ok := strings.Cut(entry, "=")
+		class, value = strings.TrimSpace(class), strings.TrimSpace(value)
+		if !ok || class == "" || value == "" {
+			return nil, fmt.Errorf("invalid retention entry %q", entry)
+		}
+
+		duration, err := parseRetention(value)
+		if err != nil {
+			return nil, fmt.Errorf("class %s: %w", class, err)
+		}
+
+		policies = append(policies, RetentionPolicy{Class: class, Duration: duration, Retain: value})
+	}
+
+	return policies, nil
+}
+
+// parseRetention accepts "forever", day ("90d") and year ("7y") counts, or
+// any time.ParseDuration value
+func parseRetention(value string) (time.Duration, error) {
+	if value == "forever" || value == "0" {
+		return 0, nil
+	}
+
+	unit := value[len(value)-1]
+	if unit == 'd' || unit == 'y' {
+		n, err := strconv.Atoi(value[:len(value)-1])
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid retention %q", value)
+		}
+		days := n
+		if unit == 'y' {
+			days = n * 365
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid retention %q", value)
+	}
+	return duration, nil
+}
+
+func retentionFor(class string) time.Duration {
+	if policy, ok := retentionPolicies[class]; ok {
+		return policy.Duration
+	}
+	return retentionPolicies[backend.DefaultClass].Duration
+}
+
+// trackObject records a stored object and its expiry. Storing the same CID
+// again keeps the longer of the two retention periods.
+func trackObject(result *backend.PutResult, class, filename, hash string) (*StoredObject, error) {
+	now := time.Now()
+
+	var expiresAt sql.NullInt64
+	if retention := retentionFor(class); retention > 0 {
+		expiresAt = sql.NullInt64{Int64: now.Add(retention).Unix(), Valid: true}
+	}
+
+	// Content stored again under another policy keeps the copies it already
+	// has, so the object lists every backend holding it
+	replicas := result.Replicas
+	if existing, err := getStoredObject(result.CID); err == nil && existing.DeletedAt == nil {
+		replicas = mergeReplicas(result.Backend, result.Replicas, append([]string{existing.Backend}, existing.Replicas...))
+	}
+
+	// Every store of a CID is a reference; GC keeps it until all are released
+	// or the longest retention lapses. The class follows the retention kept.
+	_, err := db.Exec(`
+		INSERT INTO stored_objects (cid, class, filename, size, backend, replicas, created_at, expires_at, sha256, ref_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+		ON CONFLICT(cid) DO UPDATE SET
+			class = CASE
+				WHEN stored_objects.deleted_at IS NOT NULL THEN excluded.class
+				WHEN excluded.expires_at IS NULL THEN excluded.class
+				WHEN stored_objects.expires_at IS NOT NULL AND excluded.expires_at >= stored_objects.expires_at THEN excluded.class
+				ELSE stored_objects.class
+			END,
+			backend = excluded.backend,
+			replicas = excluded.replicas,
+			expires_at = CASE
+				WHEN stored_objects.deleted_at IS NOT NULL THEN excluded.expires_at
+				WHEN stored_objects.expires_at IS NULL OR excluded.expires_at IS NULL THEN NULL
+				ELSE MAX(stored_objects.expires_at, excluded.expires_at)
+			END,
+			ref_count = CASE
+				WHEN stored_objects.deleted_at IS NOT NULL THEN 1
+				ELSE stored_objects.ref_count + 1
+			END,
+			sha256 = COALESCE(excluded.sha256, stored_objects.sha256),
+			deleted_at = NULL`,
+		result.CID, class, filename, result.Size, result.Backend, strings.Join(replicas, ","),
+		now.Unix(), expiresAt, sql.NullString{String: hash, Valid: hash != ""},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to track object: %w", err)
+	}
+
+	return getStoredObject(result.CID)
+}
+
+// mergeReplicas lists the backends holding an object besides primary, from
+// the replicas of its latest write and the backends it was already on
+func mergeReplicas(primary string, replicas, previous []string) []string {
+	seen := map[string]bool{primary: true}
+	var merged []string
+	for _, name := range append(append([]string{}, replicas...), previous...) {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		merged = append(merged, name)
+	}
+	return merged
+}
+
+func getStoredObject(cid string) (*StoredObject, error) {
+	var obj StoredObject
+	var filename, replicas, reason, hash sql.NullString
+	var legalHold int
+	var createdAt int64
+	var expiresAt, deletedAt sql.NullInt64
+
+	err := db.QueryRow(`
+		SELECT cid, class, filename, size, backend, replicas, legal_hold, legal_hold_reason, created_at, expires_at, deleted_at, sha256, ref_count
+		FROM stored_objects WHERE cid = ?`, cid,
+	).Scan(&obj.CID, &obj.Class, &filename, &obj.Size, &obj.Backend, &replicas, &legalHold, &reason, &createdAt, &expiresAt, &deletedAt, &hash, &obj.RefCount)
+	if err == sql.ErrNoRows {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	obj.Filename = filename.String
+	if replicas.String != "" {
+		obj.Replicas = strings.Split(replicas.String, ",")
+	}
+	obj.SHA256 = hash.String
+	obj.LegalHold = legalHold != 0
+	obj.LegalHoldReason = reason.String
+	obj.CreatedAt = time.Unix(createdAt, 0).UTC()
+	if expiresAt.Valid {
+		t := time.Unix(expiresAt.Int64, 0).UTC()
+		obj.ExpiresAt = &t
+	}
+	if deletedAt.Valid {
+		t := time.Unix(deletedAt.Int64, 0).UTC()
+		obj.DeletedAt = &t
+	}
+	return &obj, nil
+}
+
+// setLegalHold places or releases a legal hold. Held objects are never
+// collected, even past their retention.
+func setLegalHold(cid string, hold bool, reason string) (*StoredObject, error) {
+	if !hold {
+		reason = ""
+	}
+
+	res, err := db.Exec(`UPDATE stored_objects SET legal_hold = ?, legal_hold_reason = ? WHERE cid = ?`, hold, reason, cid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update legal hold: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, errObjectNotFound
+	}
+
+	log.Printf("Legal hold on CID=%s set to %t", cid, hold)
+	return getStoredObject(cid)
+}
+
+// runGC deletes objects past their retention, or with every reference
+// released, from each backend that supports deletion. Objects whose deletion
+// fails are retried on the next run.
+func runGC(ctx context.Context) (*GCResult, error) {
+	now := time.Now().Unix()
+	result := &GCResult{}
+
+	if err := db.QueryRow(`
+		SELECT COUNT(*) FROM stored_objects
+		WHERE (expires_at <= ? OR ref_count <= 0) AND deleted_at IS NULL AND legal_hold = 1`, now,
+	).Scan(&result.Held); err != nil {
+		return nil, fmt.Errorf("failed to count held objects: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT cid FROM stored_objects
+		WHERE (expires_at <= ? OR ref_count <= 0) AND deleted_at IS NULL AND legal_hold = 0
+		ORDER BY expires_at ASC LIMIT 500`, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select expired objects: %w", err)
+	}
+
+	var expired []string
+	for rows.Next() {
+		var cid string
+		if err := rows.Scan(&cid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expired = append(expired, cid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result.Expired = len(expired)
+	for _, cid := range expired {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+
+		backends, err := storage.router.Delete(ctx, cid)
+		if err != nil {
+			log.Printf("GC failed for CID=%s: %v", cid, err)
+			result.Failed = append(result.Failed, cid)
+			continue
+		}
+
+		// A hold placed while the run was in progress wins
+		res, err := db.Exec(`UPDATE stored_objects SET deleted_at = ? WHERE cid = ? AND legal_hold = 0`, time.Now().Unix(), cid)
+		if err != nil {
+			return result, fmt.Errorf("failed to mark object deleted: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		result.Deleted++
+		atomic.AddUint64(&gcDeletedTotal, 1)
+		log.Printf("GC removed expired CID=%s from %v", cid, backends)
+	}
+
+	return result, nil
+}
+
+// runGCWorker collects expired objects every interval until ctx is done
+// runGCLocked runs the GC holding the gc lock, so replicas sharing the
+// backends do not collect the same objects at once. It returns
+// distributed.ErrLocked while another replica is collecting.
+func runGCLocked(ctx context.Context) (*GCResult, error) {
+	if coordinator == nil {
+		return runGC(ctx)
+	}
+	var result *GCResult
+	err := coordinator.WithLock(ctx, "gc", func(ctx context.Context) error {
+		var err error
+		result, err = runGC(ctx)
+		return err
+	})
+	return result, err
+}
+
+func runGCWorker(ctx context.Context, interval time.Duration) {
+	log.Printf("Storage GC running every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result, err := runGCLocked(ctx)
+			if errors.Is(err, distributed.ErrLocked) {
+				log.Println("Storage GC skipped, another replica is collecting")
+				continue
+			}
+			if err != nil {
+				log.Printf("Storage GC failed: %v", err)
+				continue
+			}
+			if result.Expired > 0 || result.Held > 0 {
+				log.Printf("Storage GC: %d expired, %d deleted, %d on legal hold, %d failed",
+					result.Expired, result.Deleted, result.Held, len(result.Failed))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func handleRetentionPolicies(w http.ResponseWriter, r *http.Request) {
+	policies := make([]RetentionPolicy, 0, len(retentionPolicies))
+	for _, policy := range retentionPolicies {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Class < policies[j].Class })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"policies": policies,
+	})
+}
+
+func handleRunGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	result, err := runGCLocked(r.Context())
+	if errors.Is(err, distributed.ErrLocked) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "GC is already running"})
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("GC failed: %v", err)})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleObject serves GET and DELETE /api/storage/objects/{cid} and
+// POST /api/storage/objects/{cid}/legal-hold
+func handleObject(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/storage/objects/"), "/")
+	cid, action, _ := strings.Cut(path, "/")
+	if cid == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "CID required"})
+		return
+	}
+
+	var obj *StoredObject
+	var err error
+
+	switch {
+	case action == "" && r.Method == "GET":
+		obj, err = getStoredObject(cid)
+	case action == "" && r.Method == "DELETE":
+		obj, err = releaseObject(cid)
+	case action == "legal-hold" && r.Method == "POST":
+		var req struct {
+			Hold   bool   `json:"hold"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+			return
+		}
+		obj, err = setLegalHold(cid, req.Hold, req.Reason)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+		return
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errObjectNotFound) {
+			status = http.StatusNotFound
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(obj)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/distributed"
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetentionPolicies(t *testing.T) {
+	policies, err := parseRetentionPolicies("receipt=7y; attachment=90d;proof=forever;cache=12h")
+	require.NoError(t, err)
+	require.Len(t, policies, 4)
+
+	assert.Equal(t, 7*365*24*time.Hour, policies[0].Duration)
+	assert.Equal(t, 90*24*time.Hour, policies[1].Duration)
+	assert.Equal(t, time.Duration(0), policies[2].Duration)
+	assert.Equal(t, 12*time.Hour, policies[3].Duration)
+
+	for _, spec := range []string{"receipt", "receipt=-1d", "receipt=soon", "=90d"} {
+		_, err := parseRetentionPolicies(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestStorageGC(t *testing.T) {
+	initializeStorageService()
+	retentionPolicies = map[string]RetentionPolicy{
+		"attachment": {Class: "attachment", Duration: time.Hour},
+	}
+	t.Cleanup(func() { retentionPolicies = map[string]RetentionPolicy{} })
+
+	store := func(data, class string) string {
+		cid, err := storeObject(context.Background(), []byte(data), class+".txt", class)
+		require.NoError(t, err)
+		return cid
+	}
+	expire := func(cid string) {
+		_, err := db.Exec(`UPDATE stored_objects SET expires_at = ? WHERE cid = ?`, time.Now().Add(-time.Minute).Unix(), cid)
+		require.NoError(t, err)
+	}
+
+	expired := store("old attachment", "attachment")
+	held := store("disputed attachment", "attachment")
+	fresh := store("new attachment", "attachment")
+	receipt := store("receipt", "receipt")
+	expire(expired)
+	expire(held)
+
+	obj, err := getStoredObject(receipt)
+	require.NoError(t, err)
+	assert.Nil(t, obj.ExpiresAt, "classes without a policy are kept forever")
+
+	obj, err = getStoredObject(fresh)
+	require.NoError(t, err)
+	require.NotNil(t, obj.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *obj.ExpiresAt, time.Minute)
+
+	_, err = setLegalHold(held, true, "chargeback dispute")
+	require.NoError(t, err)
+
+	result, err := runGC(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Expired)
+	assert.Equal(t, 1, result.Deleted)
+	assert.Equal(t, 1, result.Held)
+
+	_, err = testBackend.Get(context.Background(), expired)
+	assert.ErrorIs(t, err, backend.ErrNotFound)
+	for _, cid := range []string{held, fresh, receipt} {
+		_, err = testBackend.Get(context.Background(), cid)
+		assert.NoError(t, err)
+	}
+
+	obj, err = getStoredObject(expired)
+	require.NoError(t, err)
+	assert.NotNil(t, obj.DeletedAt)
+
+	// Releasing the hold lets the next run collect the object
+	_, err = setLegalHold(held, false, "")
+	require.NoError(t, err)
+	result, err = runGC(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Deleted)
+}
+
+func TestHandleObjectLegalHold(t *testing.T) {
+	initializeStorageService()
+	cid, err := storeObject(context.Background(), []byte("evidence"), "evidence.txt", "attachment")
+	require.NoError(t, err)
+
+	router := http.NewServeMux()
+	router.HandleFunc("/api/storage/objects/", handleObject)
+
+	t.Run("should place a legal hold", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("POST", "/api/storage/objects/"+cid+"/legal-hold",
+			bytes.NewBufferString(`{"hold":true,"reason":"audit"}`))
+		router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"legal_hold":true`)
+		assert.Contains(t, w.Body.String(), `"legal_hold_reason":"audit"`)
+	})
+
+	t.Run("should return 404 for untracked objects", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		httpReq, _ := http.NewRequest("GET", "/api/storage/objects/bafkreiunknown", nil)
+		router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestHandleRunGCLocked(t *testing.T) {
+	initializeStorageService()
+	coord, err := distributed.New("storage-worker", distributed.Config{})
+	require.NoError(t, err)
+	coordinator = coord
+	t.Cleanup(func() { coordinator = nil })
+
+	t.Run("should answer 409 while another replica is collecting", func(t *testing.T) {
+		lock, err := coord.Lock(context.Background(), "gc")
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		handleRunGC(w, httptest.NewRequest(http.MethodPost, "/api/storage/gc", nil))
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		require.NoError(t, lock.Unlock(context.Background()))
+		w = httptest.NewRecorder()
+		handleRunGC(w, httptest.NewRequest(http.MethodPost, "/api/storage/gc", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/scanner"
+)
+
+// QuarantinedFile is an upload held back because the scanner flagged it
+type QuarantinedFile struct {
+	ID        string    `json:"id"`
+	SHA256    string    `json:"sha256"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Threat    string    `json:"threat"`
+	Engine    string    `json:"engine"`
+	Caller    string    `json:"caller"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UploadRejectedError is returned for uploads the scanner flagged
+type UploadRejectedError struct {
+	QuarantineID string
+	Verdict      *scanner.Verdict
+}
+
+func (e *UploadRejectedError) Error() string {
+	return fmt.Sprintf("upload rejected: %s detected (quarantine %s)", e.Verdict.Threat, e.QuarantineID)
+}
+
+var (
+	fileScanner        scanner.Scanner
+	scanFailOpen       bool
+	scanDetections     uint64
+	errScanUnavailable = errors.New("malware scanner unavailable")
+)
+
+// initScanner enables ClamAV scanning of uploads when CLAMAV_ADDR is set
+func initScanner(cfg *Config) {
+	fileScanner = nil
+	scanFailOpen = cfg.Scanning.FailOpen
+
+	if addr := cfg.Scanning.ClamAVAddr; addr != "" {
+		fileScanner = scanner.NewClamAVScanner(addr)
+		log.Printf("Upload scanning enabled with clamd at %s", addr)
+		return
+	}
+
+	log.Println("Warning: CLAMAV_ADDR not set, uploads are not scanned for malware")
+}
+
+// scanUpload scans user-supplied content before it is stored. Flagged files
+// are quarantined and an *UploadRejectedError is returned. A nil verdict
+// means scanning is disabled or was skipped because the scanner failed open.
+func scanUpload(ctx context.Context, data []byte, filename, caller string) (*scanner.Verdict, error) {
+	if fileScanner == nil {
+		return nil, nil
+	}
+
+	verdict, err := fileScanner.Scan(ctx, data, filename)
+	if err != nil {
+		if scanFailOpen {
+			log.Printf("Warning: storing %s unscanned: %v", filename, err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: %v", errScanUnavailable, err)
+	}
+	if verdict.Clean {
+		return verdict, nil
+	}
+
+	atomic.AddUint64(&scanDetections, 1)
+
+	id, err := quarantineFile(data, filename, caller, verdict)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Quarantined upload %s from %s: %s", filename, caller, verdict.Threat)
+
+	return verdict, &UploadRejectedError{QuarantineID: id, Verdict: verdict}
+}
+
+// scanMetadata records a verdict in the metadata stored with an object
+func scanMetadata(metadata map[string]string, verdict *scanner.Verdict) map[string]string {
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	if verdict == nil {
+		metadata["scan_status"] = "unscanned"
+		return metadata
+	}
+
+	metadata["scan_status"] = verdict.Status()
+	metadata["scan_engine"] = verdict.Engine
+	metadata["scanned_at"] = verdict.ScannedAt.UTC().Format(time.RFC3339)
+	return metadata
+}
+
+func quarantineFile(data []byte, filename, caller string, verdict *scanner.Verdict) (string, error) {
+	sum := sha256.Sum256(data)
+	id := fmt.Sprintf("q_%d", time.Now().UnixNano())
+
+	_, err := db.Exec(`
+		INSERT INTO quarantined_files (id, sha256, filename, size, threat, engine, caller, data, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, hex.EncodeToString(sum[:]), filename, len(data), verdict.Threat, verdict.Engine, caller, data, time.Now().Unix(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to quarantine file: %w", err)
+	}
+	return id, nil
+}
+
+// writeScanError maps scanning failures to a response
+func writeScanError(w http.ResponseWriter, err error) {
+	var rejected *UploadRejectedError
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case errors.As(err, &rejected):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":         rejected.Error(),
+			"code":          problem.CodeFileRejected,
+			"threat":        rejected.Verdict.Threat,
+			"quarantine_id": rejected.QuarantineID,
+		})
+	case errors.Is(err, errScanUnavailable):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Malware scanner unavailable, try again later", "code": problem.CodeScannerUnavailable})
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+	}
+}
+
+// handleQuarantine serves GET /api/storage/quarantine and
+// DELETE /api/storage/quarantine/{id}
+func handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/storage/quarantine"), "/")
+	id = strings.TrimPrefix(id, "/")
+
+	switch {
+	case id == "" && r.Method == "GET":
+		rows, err := db.Query(`
+			SELECT id, sha256, filename, size, threat, engine, caller, created_at
+			FROM quarantined_files ORDER BY created_at DESC LIMIT 500`)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to list quarantine"})
+			return
+		}
+		defer rows.Close()
+
+		files := []QuarantinedFile{}
+		for rows.Next() {
+			var file QuarantinedFile
+			var createdAt int64
+			if err := rows.Scan(&file.ID, &file.SHA256, &file.Filename, &file.Size, &file.Threat, &file.Engine, &file.Caller, &createdAt); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to list quarantine"})
+				return
+			}
+			file.CreatedAt = time.Unix(createdAt, 0).UTC()
+			files = append(files, file)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"files": files,
+			"count": len(files),
+		})
+
+	case id != "" && r.Method == "DELETE":
+		res, err := db.Exec(`DELETE FROM quarantined_files WHERE id = ?`, id)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to delete quarantined file"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Quarantined file not found"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"deleted": id})
+
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+	}
+}
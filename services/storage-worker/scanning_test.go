@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/scanner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubScanner flags any content containing "MALWARE"
+type stubScanner struct {
+	err error
+}
+
+func (s *stubScanner) Name() string { return "stub" }
+
+func (s *stubScanner) Scan(ctx context.Context, data []byte, filename string) (*scanner.Verdict, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	verdict := &scanner.Verdict{Clean: true, Engine: "stub", ScannedAt: time.Now()}
+	if bytes.Contains(data, []byte("MALWARE")) {
+		verdict.Clean = false
+		verdict.Threat = "Stub.Test.Signature"
+	}
+	return verdict, nil
+}
+
+func TestUploadScanning(t *testing.T) {
+	initializeStorageService()
+	fileScanner = &stubScanner{}
+	t.Cleanup(func() {
+		fileScanner = nil
+		scanFailOpen = false
+	})
+
+	t.Run("should store clean files with their verdict", func(t *testing.T) {
+		w := uploadFile(t, "clean.txt", "hello", "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response UploadResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.NotNil(t, response.Scan)
+		assert.True(t, response.Scan.Clean)
+
+		result, err := testBackend.Get(context.Background(), response.CID)
+		require.NoError(t, err)
+		assert.Equal(t, "clean", result.Metadata["scan_status"])
+		assert.Equal(t, "stub", result.Metadata["scan_engine"])
+	})
+
+	t.Run("should quarantine flagged files", func(t *testing.T) {
+		w := uploadFile(t, "bad.exe", "MALWARE payload", "")
+		require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), "Stub.Test.Signature")
+
+		_, err := testBackend.Get(context.Background(), backend.RawCID([]byte("MALWARE payload")))
+		assert.Error(t, err)
+
+		httpReq, _ := http.NewRequest("GET", "/api/storage/quarantine", nil)
+		rec := httptest.NewRecorder()
+		handleQuarantine(rec, httpReq)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var listing struct {
+			Files []QuarantinedFile `json:"files"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listing))
+		require.Len(t, listing.Files, 1)
+		assert.Equal(t, "bad.exe", listing.Files[0].Filename)
+
+		httpReq, _ = http.NewRequest("DELETE", "/api/storage/quarantine/"+listing.Files[0].ID, nil)
+		rec = httptest.NewRecorder()
+		handleQuarantine(rec, httpReq)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("should refuse uploads when the scanner is down", func(t *testing.T) {
+		fileScanner = &stubScanner{err: errors.New("connection refused")}
+
+		w := uploadFile(t, "later.txt", "hello again", "")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		scanFailOpen = true
+		w = uploadFile(t, "later.txt", "hello again", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// EIP-712 type strings for receipt signatures
+const (
+	eip712DomainType = "EIP712Domain(string name,string version,uint256 chainId)"
+	receiptType      = "Receipt(uint256 paymentId,address sender,address recipient,address token,uint256 amount,uint256 fee,string status,uint256 createdAt,uint256 completedAt,string txHash,string metadataURI,uint256 generatedAt)"
+
+	receiptDomainName    = "CrossPay Receipts"
+	receiptDomainVersion = "1"
+)
+
+var (
+	eip712DomainTypeHash = crypto.Keccak256([]byte(eip712DomainType))
+	receiptTypeHash      = crypto.Keccak256([]byte(receiptType))
+)
+
+// ReceiptSigner signs receipts with the service key and checks signatures
+// against an allowlist of trusted signer addresses
+type ReceiptSigner struct {
+	key       *ecdsa.PrivateKey
+	address   common.Address
+	allowlist map[common.Address]bool
+}
+
+var (
+	receiptSigner     *ReceiptSigner
+	receiptSignerOnce sync.Once
+)
+
+// initReceiptSigner loads the signer from RECEIPT_SIGNER_KEY and
+// RECEIPT_SIGNER_ALLOWLIST
+func initReceiptSigner(cfg *Config) error {
+	signer, err := newConfiguredReceiptSigner(cfg.Receipts.SignerKey, cfg.Receipts.SignerAllowlist)
+	if err != nil {
+		return err
+	}
+	receiptSignerOnce.Do(func() { receiptSigner = signer })
+	return nil
+}
+
+// getReceiptSigner returns the service signer, generating an ephemeral one
+// on first use if none was loaded
+func getReceiptSigner() *ReceiptSigner {
+	receiptSignerOnce.Do(func() {
+		signer, err := newConfiguredReceiptSigner("", nil)
+		if err != nil {
+			log.Fatalf("Failed to initialize receipt signer: %v", err)
+		}
+		receiptSigner = signer
+	})
+	return receiptSigner
+}
+
+func newConfiguredReceiptSigner(hexKey string, allowlist []string) (*ReceiptSigner, error) {
+	var key *ecdsa.PrivateKey
+	var err error
+
+	if hexKey != "" {
+		key, err = crypto.HexToECDSA(strings.TrimPrefix(hexKey, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid RECEIPT_SIGNER_KEY: %w", err)
+		}
+	} else {
+		log.Println("Warning: RECEIPT_SIGNER_KEY not set, signing receipts with an ephemeral key")
+		// In production, this should be an error
+		key, err = crypto.GenerateKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate signer key: %w", err)
+		}
+	}
+
+	signer, err := NewReceiptSigner(key, allowlist)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Receipt signer initialized: %s", signer.Address().Hex())
+	return signer, nil
+}
+
+// NewReceiptSigner creates a signer. The signer's own address is always
+// trusted in addition to the allowlist.
+func NewReceiptSigner(key *ecdsa.PrivateKey, allowlist []string) (*ReceiptSigner, error) {
+	signer := &ReceiptSigner{
+		key:       key,
+		address:   crypto.PubkeyToAddress(key.PublicKey),
+		allowlist: make(map[common.Address]bool),
+	}
+	signer.allowlist[signer.address] = true
+
+	for _, entry := range allowlist {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !common.IsHexAddress(entry) {
+			return nil, fmt.Errorf("invalid signer address in allowlist: %s", entry)
+		}
+		signer.allowlist[common.HexToAddress(entry)] = true
+	}
+
+	return signer, nil
+}
+
+// Address returns the address receipts are signed with
+func (s *ReceiptSigner) Address() common.Address {
+	return s.address
+}
+
+// Allowed reports whether signatures from addr are trusted
+func (s *ReceiptSigner) Allowed(addr common.Address) bool {
+	return s.allowlist[addr]
+}
+
+// Sign returns the 65-byte [R || S || V] signature over the EIP-712 digest
+// of the receipt, with V in {27, 28}
+func (s *ReceiptSigner) Sign(receipt *Receipt) (string, error) {
+	digest, err := receiptTypedDataHash(receipt)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := crypto.Sign(digest, s.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign receipt: %w", err)
+	}
+	sig[64] += 27
+
+	return hexutil.Encode(sig), nil
+}
+
+// Recover returns the address that produced the receipt's signature
+func (s *ReceiptSigner) Recover(receipt *Receipt) (common.Address, error) {
+	sig, err := hexutil.Decode(receipt.Signature)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("malformed signature: %w", err)
+	}
+	if len(sig) != crypto.SignatureLength {
+		return common.Address{}, errors.New("signature must be 65 bytes")
+	}
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+
+	digest, err := receiptTypedDataHash(receipt)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	pub, err := crypto.SigToPub(digest, sig)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("failed to recover signer: %w", err)
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+// receiptTypedDataHash computes keccak256("\x19\x01" || domainSeparator || hashStruct(receipt))
+func receiptTypedDataHash(receipt *Receipt) ([]byte, error) {
+	payment := receipt.Payment
+
+	amount, err := parseUint256(payment.Amount)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount: %w", err)
+	}
+	fee, err := parseUint256(payment.Fee)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fee: %w", err)
+	}
+
+	domainSeparator := crypto.Keccak256(
+		eip712DomainTypeHash,
+		crypto.Keccak256([]byte(receiptDomainName)),
+		crypto.Keccak256([]byte(receiptDomainVersion)),
+		math.U256Bytes(big.NewInt(int64(payment.ChainID))),
+	)
+
+	structHash := crypto.Keccak256(
+		receiptTypeHash,
+		math.U256Bytes(new(big.Int).SetUint64(payment.ID)),
+		common.LeftPadBytes(common.HexToAddress(payment.Sender).Bytes(), 32),
+		common.LeftPadBytes(common.HexToAddress(payment.Recipient).Bytes(), 32),
+		common.LeftPadBytes(common.HexToAddress(payment.Token).Bytes(), 32),
+		math.U256Bytes(amount),
+		math.U256Bytes(fee),
+		crypto.Keccak256([]byte(payment.Status)),
+		math.U256Bytes(big.NewInt(payment.CreatedAt)),
+		math.U256Bytes(big.NewInt(payment.CompletedAt)),
+		crypto.Keccak256([]byte(payment.TxHash)),
+		crypto.Keccak256([]byte(payment.MetadataURI)),
+		math.U256Bytes(big.NewInt(receipt.GeneratedAt.Unix())),
+	)
+
+	return crypto.Keccak256([]byte("\x19\x01"), domainSeparator, structHash), nil
+}
+
+func parseUint256(value string) (*big.Int, error) {
+	if value == "" {
+		return new(big.Int), nil
+	}
+	n, ok := math.ParseBig256(value)
+	if !ok || n.Sign() < 0 {
+		return nil, fmt.Errorf("not a uint256: %q", value)
+	}
+	return n, nil
+}
+
+func signReceipt(receipt *Receipt) (string, error) {
+	signer := getReceiptSigner()
+	receipt.Signer = signer.Address().Hex()
+	return signer.Sign(receipt)
+}
+
+// verifyReceiptSignature recovers the receipt signer and checks it matches
+// the embedded signer address and the configured allowlist
+func verifyReceiptSignature(receipt Receipt) bool {
+	_, err := verifyReceipt(&receipt)
+	return err == nil
+}
+
+func verifyReceipt(receipt *Receipt) (common.Address, error) {
+	signer := getReceiptSigner()
+
+	recovered, err := signer.Recover(receipt)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if receipt.Signer != "" && !strings.EqualFold(receipt.Signer, recovered.Hex()) {
+		return recovered, fmt.Errorf("signature was produced by %s, not %s", recovered.Hex(), receipt.Signer)
+	}
+	if !signer.Allowed(recovered) {
+		return recovered, fmt.Errorf("signer %s is not in the allowlist", recovered.Hex())
+	}
+	return recovered, nil
+}
+
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestReceipt() *Receipt {
+	return &Receipt{
+		Payment: PaymentData{
+			ID:        42,
+			Sender:    "0x1234567890123456789012345678901234567890",
+			Recipient: "0x0987654321098765432109876543210987654321",
+			Token:     "0x0000000000000000000000000000000000000000",
+			Amount:    "1000000000000000000",
+			Fee:       "1000000000000000",
+			Status:    "completed",
+			ChainID:   1135,
+		},
+		GeneratedAt: time.Unix(1700000000, 0),
+	}
+}
+
+func TestReceiptSignerRecover(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer, err := NewReceiptSigner(key, nil)
+	require.NoError(t, err)
+
+	receipt := newTestReceipt()
+	receipt.Signature, err = signer.Sign(receipt)
+	require.NoError(t, err)
+
+	recovered, err := signer.Recover(receipt)
+	require.NoError(t, err)
+	assert.Equal(t, signer.Address(), recovered)
+
+	t.Run("tampered amount recovers a different signer", func(t *testing.T) {
+		tampered := *receipt
+		tampered.Payment.Amount = "2000000000000000000"
+
+		recovered, err := signer.Recover(&tampered)
+		require.NoError(t, err)
+		assert.NotEqual(t, signer.Address(), recovered)
+	})
+
+	t.Run("domain is bound to the chain", func(t *testing.T) {
+		otherChain := *receipt
+		otherChain.Payment.ChainID = 84532
+
+		recovered, err := signer.Recover(&otherChain)
+		require.NoError(t, err)
+		assert.NotEqual(t, signer.Address(), recovered)
+	})
+}
+
+func TestReceiptSignerAllowlist(t *testing.T) {
+	trustedKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	trusted := crypto.PubkeyToAddress(trustedKey.PublicKey)
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer, err := NewReceiptSigner(key, []string{trusted.Hex()})
+	require.NoError(t, err)
+
+	assert.True(t, signer.Allowed(signer.Address()))
+	assert.True(t, signer.Allowed(trusted))
+
+	stranger, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	assert.False(t, signer.Allowed(crypto.PubkeyToAddress(stranger.PublicKey)))
+
+	_, err = NewReceiptSigner(key, []string{"not-an-address"})
+	assert.Error(t, err)
+}
+
+func TestVerifyReceiptRejectsUntrustedSigner(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	outsider, err := NewReceiptSigner(key, nil)
+	require.NoError(t, err)
+
+	receipt := newTestReceipt()
+	receipt.Signer = outsider.Address().Hex()
+	receipt.Signature, err = outsider.Sign(receipt)
+	require.NoError(t, err)
+
+	recovered, err := verifyReceipt(receipt)
+	assert.Error(t, err)
+	assert.Equal(t, outsider.Address(), recovered)
+	assert.False(t, verifyReceiptSignature(*receipt))
+}
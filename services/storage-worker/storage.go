@@ -1,22 +1,25 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/arcbjorn/crosspay/packages/problem"
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
 	"github.com/arcbjorn/crosspay/storage-worker/pkg/filecoin"
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/scanner"
 )
 
 type StorageService struct {
 	filecoinClient *filecoin.SynapseClient
+	router         *backend.Router
 }
 
 type UploadRequest struct {
@@ -27,10 +30,15 @@ type UploadRequest struct {
 }
 
 type UploadResponse struct {
-	CID       string    `json:"cid"`
-	Size      int64     `json:"size"`
-	Cost      string    `json:"cost"`
-	Timestamp time.Time `json:"timestamp"`
+	CID          string           `json:"cid"`
+	Size         int64            `json:"size"`
+	Cost         string           `json:"cost"`
+	Backend      string           `json:"backend"`
+	Replicas     []string         `json:"replicas,omitempty"`
+	ExpiresAt    *time.Time       `json:"expires_at,omitempty"`
+	Deduplicated bool             `json:"deduplicated"`
+	Scan         *scanner.Verdict `json:"scan,omitempty"`
+	Timestamp    time.Time        `json:"timestamp"`
 }
 
 type RetrieveResponse struct {
@@ -39,32 +47,92 @@ type RetrieveResponse struct {
 	ContentType string            `json:"contentType"`
 	Metadata    map[string]string `json:"metadata"`
 	Size        int64             `json:"size"`
+	Backend     string            `json:"backend"`
 	Timestamp   time.Time         `json:"timestamp"`
 }
 
 type CostEstimate struct {
-	SizeBytes    int64  `json:"size_bytes"`
-	EstimatedFIL string `json:"estimated_fil"`
-	USDEquiv     string `json:"usd_equivalent"`
+	SizeBytes     int64      `json:"size_bytes"`
+	EstimatedFIL  string     `json:"estimated_fil"`
+	USDEquiv      string     `json:"usd_equivalent"`
+	FILUSDRate    float64    `json:"fil_usd_rate,omitempty"`
+	RateTimestamp *time.Time `json:"rate_timestamp,omitempty"`
+	RateSource    string     `json:"rate_source"`
 }
 
 var storage *StorageService
 
-func initStorage() {
-	apiURL := os.Getenv("SYNAPSE_API_URL")
-	apiKey := os.Getenv("SYNAPSE_API_KEY")
-	networkID := os.Getenv("FILECOIN_NETWORK")
-	
+func initStorage(cfg *Config) {
+	backends := cfg.Backends
+	apiKey := backends.Synapse.APIKey
+	networkID := backends.Synapse.Network
+
+	filecoinClient := filecoin.NewSynapseClient(backends.Synapse.APIURL, apiKey, networkID)
+	router := backend.NewRouter()
+
+	primary := "filecoin"
 	if apiKey == "" {
 		log.Println("Warning: SYNAPSE_API_KEY not set, using mock mode")
 		// In production, this should be an error
+		primary = "memory"
+		router.Register(backend.NewMemoryBackend("memory"))
+	} else {
+		router.Register(backend.NewFilecoinBackend(filecoinClient))
+	}
+
+	if s3 := backends.S3; s3.Bucket != "" {
+		router.Register(backend.NewS3Backend(backend.S3Config{
+			Endpoint:  s3.Endpoint,
+			Region:    s3.Region,
+			Bucket:    s3.Bucket,
+			Prefix:    s3.Prefix,
+			AccessKey: s3.AccessKeyID,
+			SecretKey: s3.SecretAccessKey,
+			PathStyle: s3.PathStyle,
+		}))
+	}
+
+	if pinata := backends.Pinata; pinata.JWT != "" {
+		router.Register(backend.NewPinataBackend(pinata.APIURL, pinata.GatewayURL, pinata.JWT))
+	}
+
+	if w3s := backends.Web3Storage; w3s.Token != "" {
+		router.Register(backend.NewWeb3StorageBackend(w3s.APIURL, w3s.GatewayURL, w3s.Token))
+	}
+
+	// Receipts keep a hot copy in S3 when a bucket is configured
+	policySpec := backends.Policies
+	if policySpec == "" {
+		policySpec = "default=" + primary
+		if _, ok := router.Backend("s3"); ok {
+			policySpec += ";receipt=" + primary + "+s3"
+		}
+	}
+
+	policies, err := backend.ParsePolicies(policySpec)
+	if err != nil {
+		log.Fatalf("Invalid STORAGE_POLICIES: %v", err)
+	}
+	for _, policy := range policies {
+		if err := router.SetPolicy(policy); err != nil {
+			log.Fatalf("Invalid storage policy: %v", err)
+		}
+	}
+
+	if !backends.VerifyCIDs {
+		log.Println("Warning: CID verification of retrieved content is disabled")
+		router.SetVerification(false)
 	}
 
+	// Hot copies are tried before Filecoin retrieval
+	router.SetReadOrder(backends.ReadOrder)
+
 	storage = &StorageService{
-		filecoinClient: filecoin.NewSynapseClient(apiURL, apiKey, networkID),
+		filecoinClient: filecoinClient,
+		router:         router,
 	}
-	
-	log.Printf("Storage service initialized with Filecoin network: %s", networkID)
+
+	log.Printf("Storage service initialized with Filecoin network: %s, backends: %v", networkID, router.Backends())
 }
 
 func handleUpload(w http.ResponseWriter, r *http.Request) {
@@ -92,18 +160,68 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Upload to Filecoin via SynapseSDK
-	ctx := context.Background()
-	result, err := storage.filecoinClient.Upload(ctx, data, header.Filename, &filecoin.UploadOptions{
+	class := r.FormValue("class")
+	if class == "" {
+		class = "attachment"
+	}
+
+	caller, err := callerID(r)
+	if err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+	estimatedCost, _ := strconv.ParseFloat(calculateStorageCost(int64(len(data))), 64)
+	if err := reserveUpload(caller, int64(len(data)), estimatedCost); err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			releaseUpload(caller, int64(len(data)), estimatedCost)
+		}
+	}()
+
+	ctx := r.Context()
+	verdict, err := scanUpload(ctx, data, header.Filename, caller)
+	if err != nil {
+		writeScanError(w, err)
+		return
+	}
+
+	// Upload to the backends selected by the class policy, unless the same
+	// content is already stored
+	result, hash, deduplicated, err := putDeduplicated(ctx, data, backend.PutOptions{
+		Filename:     header.Filename,
+		ContentType:  header.Header.Get("Content-Type"),
+		Class:        class,
 		DealDuration: 180, // 180 days
 		PinToIPFS:    true,
-		Metadata: map[string]string{
+		Metadata: scanMetadata(map[string]string{
 			"contentType": header.Header.Get("Content-Type"),
 			"uploader":    r.RemoteAddr,
-		},
+		}, verdict),
 	})
 	if err != nil {
-		log.Printf("Filecoin upload failed: %v", err)
+		log.Printf("Storage upload failed: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Upload failed: %v", err)})
+		return
+	}
+
+	stored = true
+	storedSize, cost := int64(len(data)), estimatedCost
+	if deduplicated {
+		storedSize, cost = 0, 0
+	} else if actual, err := strconv.ParseFloat(result.Cost, 64); err == nil {
+		cost = actual
+	}
+	settleUpload(caller, int64(len(data)), estimatedCost, storedSize, cost)
+
+	tracked, err := trackObject(result, class, header.Filename, hash)
+	if err != nil {
+		log.Printf("Failed to track retention for CID=%s: %v", result.CID, err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Upload failed: %v", err)})
@@ -111,10 +229,15 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := UploadResponse{
-		CID:       result.CID,
-		Size:      result.Size,
-		Cost:      result.StorageCost,
-		Timestamp: result.CreatedAt,
+		CID:          result.CID,
+		Size:         result.Size,
+		Cost:         result.Cost,
+		Backend:      result.Backend,
+		Replicas:     result.Replicas,
+		ExpiresAt:    tracked.ExpiresAt,
+		Deduplicated: deduplicated,
+		Scan:         verdict,
+		Timestamp:    result.CreatedAt,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -133,16 +256,25 @@ func handleRetrieve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve from Filecoin via SynapseSDK
-	ctx := context.Background()
-	result, err := storage.filecoinClient.Retrieve(ctx, cid)
+	caller, err := callerID(r)
 	if err != nil {
-		log.Printf("Filecoin retrieval failed: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Retrieval failed: %v", err)})
+		writeQuotaError(w, err)
+		return
+	}
+	if err := checkBandwidthQuota(caller); err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+
+	// Retrieve from the first backend holding the CID
+	ctx := r.Context()
+	result, err := storage.router.Get(ctx, cid)
+	if err != nil {
+		log.Printf("Storage retrieval failed: %v", err)
+		writeRetrievalError(w, err)
 		return
 	}
+	recordRetrieval(caller, result.Size)
 
 	response := RetrieveResponse{
 		Data:        result.Data,
@@ -150,6 +282,7 @@ func handleRetrieve(w http.ResponseWriter, r *http.Request) {
 		ContentType: result.ContentType,
 		Metadata:    result.Metadata,
 		Size:        result.Size,
+		Backend:     result.Backend,
 		Timestamp:   result.RetrievedAt,
 	}
 
@@ -171,7 +304,7 @@ func handleCostEstimate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get cost estimate from SynapseSDK
-	ctx := context.Background()
+	ctx := r.Context()
 	cost, err := storage.filecoinClient.EstimateStorageCost(ctx, size, 180) // 180 days
 	if err != nil {
 		log.Printf("Failed to get cost estimate: %v", err)
@@ -182,7 +315,17 @@ func handleCostEstimate(w http.ResponseWriter, r *http.Request) {
 	response := CostEstimate{
 		SizeBytes:    size,
 		EstimatedFIL: cost,
-		USDEquiv:     calculateUSDEquivalent(cost),
+		RateSource:   "unavailable",
+	}
+
+	// Price the estimate in USD; the FIL figure is still useful without it
+	if price, err := getFILPrice(ctx); err == nil {
+		response.USDEquiv = calculateUSDEquivalent(cost, price.Rate)
+		response.FILUSDRate = price.Rate
+		response.RateTimestamp = &price.Timestamp
+		response.RateSource = price.Source
+	} else {
+		log.Printf("Cost estimate without USD price: %v", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -191,7 +334,7 @@ func handleCostEstimate(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleListFiles(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	ctx := r.Context()
 	files, err := storage.filecoinClient.ListFiles(ctx, 50, 0) // Default limit and offset
 	if err != nil {
 		log.Printf("Failed to list files: %v", err)
@@ -227,7 +370,7 @@ func handlePinToIPFS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 	err := storage.filecoinClient.PinToIPFS(ctx, cid)
 	if err != nil {
 		log.Printf("Failed to pin to IPFS: %v", err)
@@ -256,7 +399,7 @@ func handleDealStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 	status, err := storage.filecoinClient.GetDealStatus(ctx, dealID)
 	if err != nil {
 		log.Printf("Failed to get deal status: %v", err)
@@ -271,8 +414,17 @@ func handleDealStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(status)
 }
 
+func handleListBackends(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"backends": storage.router.Backends(),
+		"policies": storage.router.Policies(),
+	})
+}
+
 func handleNetworkInfo(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	ctx := r.Context()
 	info, err := storage.filecoinClient.GetNetworkInfo(ctx)
 	if err != nil {
 		log.Printf("Failed to get network info: %v", err)
@@ -287,6 +439,23 @@ func handleNetworkInfo(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(info)
 }
 
+// writeRetrievalError maps a retrieval error to a response. Content that
+// failed CID verification is reported distinctly from missing content.
+func writeRetrievalError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, backend.ErrVerificationFailed) {
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": err.Error(),
+			"code":  problem.CodeVerificationFailed,
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf("Retrieval failed: %v", err)})
+}
+
 // Removed deprecated mock functions - now using SynapseClient directly
 
 func calculateStorageCost(sizeBytes int64) string {
@@ -296,12 +465,6 @@ func calculateStorageCost(sizeBytes int64) string {
 	return fmt.Sprintf("%.6f", costFIL)
 }
 
-func calculateUSDEquivalent(filCost string) string {
-	// TODO: Integrate with oracle service for FIL/USD price
-	// For now, use approximate FIL price
-	return "0.00"
-}
-
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	maxLogoSize       = 1 << 20
+	maxCustomFields   = 20
+	maxFooterTextSize = 500
+)
+
+var errTemplateNotFound = errors.New("receipt template not found")
+
+// hideableReceiptFields are the payment fields a merchant may leave off its
+// receipts. The payment ID, recipient, amount and status always show.
+var hideableReceiptFields = map[string]func(*PaymentData){
+	"sender":        func(p *PaymentData) { p.Sender = "" },
+	"sender_ens":    func(p *PaymentData) { p.SenderENS = "" },
+	"recipient_ens": func(p *PaymentData) { p.RecipientENS = "" },
+	"fee":           func(p *PaymentData) { p.Fee = "" },
+	"token":         func(p *PaymentData) { p.Token = "" },
+	"completed_at":  func(p *PaymentData) { p.CompletedAt = 0 },
+	"tx_hash":       func(p *PaymentData) { p.TxHash = "" },
+	"metadata_uri":  func(p *PaymentData) { p.MetadataURI = "" },
+	"oracle_price":  func(p *PaymentData) { p.OraclePrice = "" },
+	"random_seed":   func(p *PaymentData) { p.RandomSeed = "" },
+}
+
+// MerchantTemplate customizes the receipts issued for a merchant
+type MerchantTemplate struct {
+	Merchant     string            `json:"merchant"`
+	FooterText   string            `json:"footer_text,omitempty"`
+	HiddenFields []string          `json:"hidden_fields"`
+	CustomFields map[string]string `json:"custom_fields"`
+	HasLogo      bool              `json:"has_logo"`
+	Logo         []byte            `json:"-"`
+	LogoType     string            `json:"logo_type,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+// ReceiptBranding is the merchant template as applied to one receipt
+type ReceiptBranding struct {
+	FooterText   string            `json:"footer_text,omitempty"`
+	LogoURL      string            `json:"logo_url,omitempty"`
+	HiddenFields []string          `json:"hidden_fields,omitempty"`
+	CustomFields map[string]string `json:"custom_fields,omitempty"`
+}
+
+// UpdateTemplateRequest is the body of PUT /api/receipts/templates/{merchant}
+type UpdateTemplateRequest struct {
+	FooterText   string            `json:"footer_text"`
+	HiddenFields []string          `json:"hidden_fields"`
+	CustomFields map[string]string `json:"custom_fields"`
+}
+
+// validate checks hidden fields against hideableReceiptFields and bounds the
+// custom text
+func (req *UpdateTemplateRequest) validate() error {
+	if len(req.FooterText) > maxFooterTextSize {
+		return fmt.Errorf("footer_text exceeds %d characters", maxFooterTextSize)
+	}
+	for _, field := range req.HiddenFields {
+		if _, ok := hideableReceiptFields[field]; !ok {
+			return fmt.Errorf("field %q cannot be hidden", field)
+		}
+	}
+	if len(req.CustomFields) > maxCustomFields {
+		return fmt.Errorf("at most %d custom fields are allowed", maxCustomFields)
+	}
+	for key, value := range req.CustomFields {
+		if strings.TrimSpace(key) == "" || len(key) > 64 || len(value) > 256 {
+			return fmt.Errorf("invalid custom field %q", key)
+		}
+	}
+	return nil
+}
+
+// applyMerchantTemplate redacts hidden payment fields and attaches branding
+// to an unsigned receipt. Hidden fields are cleared before signing, so the
+// signature covers exactly what the receipt shows.
+func applyMerchantTemplate(receipt *Receipt) error {
+	template, err := getMerchantTemplate(receipt.Payment.Recipient)
+	if errors.Is(err, errTemplateNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, field := range template.HiddenFields {
+		if hide, ok := hideableReceiptFields[field]; ok {
+			hide(&receipt.Payment)
+		}
+	}
+
+	branding := &ReceiptBranding{
+		FooterText:   template.FooterText,
+		HiddenFields: template.HiddenFields,
+		CustomFields: template.CustomFields,
+	}
+	if template.HasLogo {
+		branding.LogoURL = "/api/receipts/templates/" + template.Merchant + "/logo"
+	}
+	receipt.Branding = branding
+	return nil
+}
+
+func getMerchantTemplate(merchant string) (*MerchantTemplate, error) {
+	var template MerchantTemplate
+	var hidden, custom string
+	var logoType sql.NullString
+	var createdAt, updatedAt int64
+
+	err := db.QueryRow(`
+		SELECT merchant, footer_text, hidden_fields, custom_fields, logo, logo_type, created_at, updated_at
+		FROM receipt_templates WHERE merchant = ?`, strings.ToLower(merchant),
+	).Scan(&template.Merchant, &template.FooterText, &hidden, &custom, &template.Logo, &logoType, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errTemplateNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load receipt template: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(hidden), &template.HiddenFields); err != nil {
+		return nil, fmt.Errorf("failed to decode hidden fields: %w", err)
+	}
+	if err := json.Unmarshal([]byte(custom), &template.CustomFields); err != nil {
+		return nil, fmt.Errorf("failed to decode custom fields: %w", err)
+	}
+	template.HasLogo = len(template.Logo) > 0
+	template.LogoType = logoType.String
+	template.CreatedAt = time.Unix(createdAt, 0).UTC()
+	template.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+	return &template, nil
+}
+
+// saveMerchantTemplate creates or replaces the text settings of a template,
+// keeping any uploaded logo
+func saveMerchantTemplate(merchant string, req *UpdateTemplateRequest) error {
+	hiddenFields := req.HiddenFields
+	if hiddenFields == nil {
+		hiddenFields = []string{}
+	}
+	sort.Strings(hiddenFields)
+	customFields := req.CustomFields
+	if customFields == nil {
+		customFields = map[string]string{}
+	}
+
+	hidden, _ := json.Marshal(hiddenFields)
+	custom, _ := json.Marshal(customFields)
+	now := time.Now().Unix()
+
+	_, err := db.Exec(`
+		INSERT INTO receipt_templates (merchant, footer_text, hidden_fields, custom_fields, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(merchant) DO UPDATE SET
+			footer_text = excluded.footer_text,
+			hidden_fields = excluded.hidden_fields,
+			custom_fields = excluded.custom_fields,
+			updated_at = excluded.updated_at`,
+		strings.ToLower(merchant), req.FooterText, string(hidden), string(custom), now, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save receipt template: %w", err)
+	}
+	return nil
+}
+
+// saveMerchantLogo stores a logo, creating an empty template if needed
+func saveMerchantLogo(merchant string, logo []byte, logoType string) error {
+	now := time.Now().Unix()
+	_, err := db.Exec(`
+		INSERT INTO receipt_templates (merchant, footer_text, hidden_fields, custom_fields, logo, logo_type, created_at, updated_at)
+		VALUES (?, '', '[]', '{}', ?, ?, ?, ?)
+		ON CONFLICT(merchant) DO UPDATE SET
+			logo = excluded.logo,
+			logo_type = excluded.logo_type,
+			updated_at = excluded.updated_at`,
+		strings.ToLower(merchant), logo, logoType, now, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save merchant logo: %w", err)
+	}
+	return nil
+}
+
+func deleteMerchantTemplate(merchant string) error {
+	res, err := db.Exec(`DELETE FROM receipt_templates WHERE merchant = ?`, strings.ToLower(merchant))
+	if err != nil {
+		return fmt.Errorf("failed to delete receipt template: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTemplateNotFound
+	}
+	return nil
+}
+
+// handleReceiptTemplate serves /api/receipts/templates/{merchant} (GET, PUT,
+// DELETE) and /api/receipts/templates/{merchant}/logo (GET, PUT, DELETE)
+func handleReceiptTemplate(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/receipts/templates/"), "/")
+	merchant, sub, _ := strings.Cut(path, "/")
+
+	if !common.IsHexAddress(merchant) || (sub != "" && sub != "logo") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Merchant address required"})
+		return
+	}
+	merchant = strings.ToLower(merchant)
+
+	if sub == "logo" {
+		handleMerchantLogo(w, r, merchant)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		template, err := getMerchantTemplate(merchant)
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(template)
+
+	case "PUT":
+		var req UpdateTemplateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid request format"})
+			return
+		}
+		if err := req.validate(); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return
+		}
+		if err := saveMerchantTemplate(merchant, &req); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+
+		template, err := getMerchantTemplate(merchant)
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(template)
+
+	case "DELETE":
+		if err := deleteMerchantTemplate(merchant); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"deleted": merchant})
+
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+	}
+}
+
+func handleMerchantLogo(w http.ResponseWriter, r *http.Request, merchant string) {
+	switch r.Method {
+	case "GET":
+		template, err := getMerchantTemplate(merchant)
+		if err == nil && !template.HasLogo {
+			err = errTemplateNotFound
+		}
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", template.LogoType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(template.Logo)
+
+	case "PUT", "POST":
+		r.Body = http.MaxBytesReader(w, r.Body, maxLogoSize+64*1024)
+		file, _, err := r.FormFile("logo")
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "No logo provided"})
+			return
+		}
+		defer file.Close()
+
+		logo, err := io.ReadAll(io.LimitReader(file, maxLogoSize+1))
+		if err != nil || len(logo) > maxLogoSize {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Logo must be at most 1MB"})
+			return
+		}
+
+		logoType := http.DetectContentType(logo)
+		if logoType != "image/png" && logoType != "image/jpeg" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Logo must be a PNG or JPEG image"})
+			return
+		}
+
+		if err := saveMerchantLogo(merchant, logo, logoType); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"merchant":  merchant,
+			"logo_type": logoType,
+			"size":      len(logo),
+		})
+
+	case "DELETE":
+		if _, err := getMerchantTemplate(merchant); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		if _, err := db.Exec(`UPDATE receipt_templates SET logo = NULL, logo_type = NULL, updated_at = ? WHERE merchant = ?`, time.Now().Unix(), merchant); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"deleted": "logo"})
+
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Method not allowed"})
+	}
+}
+
+func writeTemplateError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, errTemplateNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Receipt template not found"})
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMerchant = "0x0987654321098765432109876543210987654321"
+
+func templateRequest(t *testing.T, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var reader bytes.Buffer
+	if body != nil {
+		require.NoError(t, json.NewEncoder(&reader).Encode(body))
+	}
+	httpReq, _ := http.NewRequest(method, path, &reader)
+	w := httptest.NewRecorder()
+	handleReceiptTemplate(w, httpReq)
+	return w
+}
+
+func TestReceiptTemplates(t *testing.T) {
+	initializeStorageService()
+	path := "/api/receipts/templates/" + testMerchant
+
+	t.Run("should reject fields that cannot be hidden", func(t *testing.T) {
+		w := templateRequest(t, "PUT", path, UpdateTemplateRequest{HiddenFields: []string{"amount"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("should save and return a template", func(t *testing.T) {
+		w := templateRequest(t, "PUT", path, UpdateTemplateRequest{
+			FooterText:   "Thanks for shopping at Bob's",
+			HiddenFields: []string{"fee", "sender"},
+			CustomFields: map[string]string{"VAT ID": "DE123456789"},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = templateRequest(t, "GET", "/api/receipts/templates/0x"+strings.ToUpper(testMerchant[2:]), nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var template MerchantTemplate
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &template))
+		assert.Equal(t, testMerchant, template.Merchant)
+		assert.Equal(t, []string{"fee", "sender"}, template.HiddenFields)
+		assert.False(t, template.HasLogo)
+	})
+
+	t.Run("should accept PNG logos only", func(t *testing.T) {
+		uploadLogo := func(data []byte) *httptest.ResponseRecorder {
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			part, _ := writer.CreateFormFile("logo", "logo.png")
+			part.Write(data)
+			writer.Close()
+
+			httpReq, _ := http.NewRequest("PUT", path+"/logo", &body)
+			httpReq.Header.Set("Content-Type", writer.FormDataContentType())
+			w := httptest.NewRecorder()
+			handleReceiptTemplate(w, httpReq)
+			return w
+		}
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, uploadLogo([]byte("not an image")).Code)
+
+		var logo bytes.Buffer
+		require.NoError(t, png.Encode(&logo, image.NewRGBA(image.Rect(0, 0, 4, 4))))
+		require.Equal(t, http.StatusOK, uploadLogo(logo.Bytes()).Code)
+
+		w := templateRequest(t, "GET", path+"/logo", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("should apply the template to signed receipts", func(t *testing.T) {
+		payment, err := fetchPaymentData(context.Background(), 7)
+		require.NoError(t, err)
+
+		receipt, err := generateReceipt(payment, "json", "en")
+		require.NoError(t, err)
+		assert.Empty(t, receipt.Payment.Fee)
+		assert.Empty(t, receipt.Payment.Sender)
+		assert.NotEmpty(t, receipt.Payment.Amount)
+		require.NotNil(t, receipt.Branding)
+		assert.Equal(t, "DE123456789", receipt.Branding.CustomFields["VAT ID"])
+		assert.Contains(t, receipt.Branding.LogoURL, "/logo")
+		assert.True(t, verifyReceiptSignature(*receipt))
+
+		pdf, err := generatePDFReceipt(receipt)
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(pdf, []byte("%PDF")))
+	})
+
+	t.Run("should delete templates", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, templateRequest(t, "DELETE", path, nil).Code)
+		assert.Equal(t, http.StatusNotFound, templateRequest(t, "GET", path, nil).Code)
+	})
+}
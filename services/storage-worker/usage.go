@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcbjorn/crosspay/packages/problem"
+)
+
+// Quota limits a caller's monthly usage. Zero values are unlimited.
+type Quota struct {
+	StorageBytes   int64   `json:"storage_bytes"`
+	BandwidthBytes int64   `json:"bandwidth_bytes"`
+	CostFIL        float64 `json:"cost_fil"`
+}
+
+// Usage is a caller's accounting for one billing period (calendar month, UTC)
+type Usage struct {
+	Caller         string  `json:"caller"`
+	Period         string  `json:"period"`
+	BytesStored    int64   `json:"bytes_stored"`
+	BytesRetrieved int64   `json:"bytes_retrieved"`
+	DealCostFIL    float64 `json:"deal_cost_fil"`
+	Uploads        int64   `json:"uploads"`
+	Retrievals     int64   `json:"retrievals"`
+}
+
+// QuotaError reports which limit a request would exceed
+type QuotaError struct {
+	Limit string
+	Used  float64
+	Max   float64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded (%g of %g used)", e.Limit, e.Used, e.Max)
+}
+
+var (
+	defaultQuota Quota
+	callerQuotas = map[string]Quota{}
+)
+
+// initQuotas loads STORAGE_QUOTA_DEFAULT and per-key STORAGE_API_QUOTAS,
+// e.g. "storage:10GB,bandwidth:100GB,cost:5" and
+// "<api key>=storage:50GB,cost:20;<api key>=bandwidth:1TB"
+func initQuotas(cfg *Config) error {
+	quota, err := parseQuota(cfg.Quotas.Default)
+	if err != nil {
+		return fmt.Errorf("invalid STORAGE_QUOTA_DEFAULT: %w", err)
+	}
+	defaultQuota = quota
+
+	callerQuotas = make(map[string]Quota)
+	for _, entry := range strings.Split(cfg.Quotas.APIKeys, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, limits, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return fmt.Errorf("invalid STORAGE_API_QUOTAS entry")
+		}
+		quota, err := parseQuota(limits)
+		if err != nil {
+			return fmt.Errorf("invalid STORAGE_API_QUOTAS: %w", err)
+		}
+		callerQuotas[callerIDForKey(strings.TrimSpace(key))] = quota
+	}
+
+	return nil
+}
+
+func parseQuota(spec string) (Quota, error) {
+	var quota Quota
+
+	for _, limit := range strings.Split(spec, ",") {
+		limit = strings.TrimSpace(limit)
+		if limit == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(limit, ":")
+		if !ok {
+			return quota, fmt.Errorf("invalid limit %q", limit)
+		}
+
+		var err error
+		switch strings.TrimSpace(name) {
+		case "storage":
+			quota.StorageBytes, err = parseByteSize(value)
+		case "bandwidth":
+			quota.BandwidthBytes, err = parseByteSize(value)
+		case "cost":
+			quota.CostFIL, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		default:
+			err = fmt.Errorf("unknown limit %q", name)
+		}
+		if err != nil {
+			return quota, err
+		}
+	}
+
+	return quota, nil
+}
+
+// parseByteSize parses sizes such as "512", "500MB" or "10GB" (binary units)
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.size
+			value = strings.TrimSuffix(value, unit.suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// errUnknownAPIKey is returned for API keys not listed in STORAGE_API_QUOTAS
+var errUnknownAPIKey = errors.New("unknown API key")
+
+// callerID identifies the API key a request was made with, and so the
+// account its usage is counted against. Keys are hashed so they are never
+// stored or logged. Requests without a key share the anonymous caller and
+// its default quota. A key not listed in STORAGE_API_QUOTAS is refused with
+// errUnknownAPIKey, so sending a new key does not earn a fresh quota.
+func callerID(r *http.Request) (string, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if key == "" {
+		return anonymousCaller, nil
+	}
+	caller := callerIDForKey(key)
+	if _, ok := callerQuotas[caller]; !ok {
+		return "", errUnknownAPIKey
+	}
+	return caller, nil
+}
+
+const anonymousCaller = "anonymous"
+
+func callerIDForKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key_" + hex.EncodeToString(sum[:8])
+}
+
+func quotaFor(caller string) Quota {
+	if quota, ok := callerQuotas[caller]; ok {
+		return quota
+	}
+	return defaultQuota
+}
+
+func currentPeriod() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+func getUsage(caller, period string) (*Usage, error) {
+	usage := &Usage{Caller: caller, Period: period}
+
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(bytes_stored), 0), COALESCE(SUM(bytes_retrieved), 0), COALESCE(SUM(deal_cost), 0),
+			COALESCE(SUM(uploads), 0), COALESCE(SUM(retrievals), 0)
+		FROM storage_usage WHERE caller = ? AND period = ?`, caller, period,
+	).Scan(&usage.BytesStored, &usage.BytesRetrieved, &usage.DealCostFIL, &usage.Uploads, &usage.Retrievals)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage: %w", err)
+	}
+	return usage, nil
+}
+
+// usageMu makes checking a quota and counting the upload against it one
+// step, so concurrent uploads cannot all pass the same check
+var usageMu sync.Mutex
+
+// reserveUpload counts an upload of size bytes at an estimated cost against
+// the caller's storage and cost budgets, or returns a *QuotaError when it
+// would exceed them. An upload that then fails is given back with
+// releaseUpload.
+func reserveUpload(caller string, size int64, costFIL float64) error {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if err := checkUploadQuota(caller, size, costFIL); err != nil {
+		return err
+	}
+	return recordUsage(caller, size, 0, costFIL, 1, 0)
+}
+
+// releaseUpload gives back an upload reserved by reserveUpload
+func releaseUpload(caller string, size int64, costFIL float64) {
+	if err := recordUsage(caller, -size, 0, -costFIL, -1, 0); err != nil {
+		log.Printf("Failed to release usage for %s: %v", caller, err)
+	}
+}
+
+// settleUpload replaces the size and estimated cost reserved for a stored
+// upload with what it took: the deal's actual cost, and nothing for content
+// that was already stored
+func settleUpload(caller string, reservedSize int64, reservedCost float64, size int64, costFIL float64) {
+	if size == reservedSize && costFIL == reservedCost {
+		return
+	}
+	if err := recordUsage(caller, size-reservedSize, 0, costFIL-reservedCost, 0, 0); err != nil {
+		log.Printf("Failed to settle usage for %s: %v", caller, err)
+	}
+}
+
+// checkUploadQuota returns a *QuotaError when storing size bytes at an
+// estimated cost would exceed the caller's storage or cost budget
+func checkUploadQuota(caller string, size int64, costFIL float64) error {
+	quota := quotaFor(caller)
+	if quota.StorageBytes == 0 && quota.CostFIL == 0 {
+		return nil
+	}
+
+	usage, err := getUsage(caller, currentPeriod())
+	if err != nil {
+		return err
+	}
+
+	if quota.StorageBytes > 0 && usage.BytesStored+size > quota.StorageBytes {
+		return &QuotaError{Limit: "storage", Used: float64(usage.BytesStored), Max: float64(quota.StorageBytes)}
+	}
+	if quota.CostFIL > 0 && usage.DealCostFIL+costFIL > quota.CostFIL {
+		return &QuotaError{Limit: "cost", Used: usage.DealCostFIL, Max: quota.CostFIL}
+	}
+	return nil
+}
+
+// checkBandwidthQuota returns a *QuotaError once the caller has used its
+// retrieval bandwidth for the period
+func checkBandwidthQuota(caller string) error {
+	quota := quotaFor(caller)
+	if quota.BandwidthBytes == 0 {
+		return nil
+	}
+
+	usage, err := getUsage(caller, currentPeriod())
+	if err != nil {
+		return err
+	}
+
+	if usage.BytesRetrieved >= quota.BandwidthBytes {
+		return &QuotaError{Limit: "bandwidth", Used: float64(usage.BytesRetrieved), Max: float64(quota.BandwidthBytes)}
+	}
+	return nil
+}
+
+func recordRetrieval(caller string, size int64) {
+	if err := recordUsage(caller, 0, size, 0, 0, 1); err != nil {
+		log.Printf("Failed to record usage for %s: %v", caller, err)
+	}
+}
+
+func recordUsage(caller string, stored, retrieved int64, costFIL float64, uploads, retrievals int64) error {
+	_, err := db.Exec(`
+		INSERT INTO storage_usage (caller, period, bytes_stored, bytes_retrieved, deal_cost, uploads, retrievals)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(caller, period) DO UPDATE SET
+			bytes_stored = bytes_stored + excluded.bytes_stored,
+			bytes_retrieved = bytes_retrieved + excluded.bytes_retrieved,
+			deal_cost = deal_cost + excluded.deal_cost,
+			uploads = uploads + excluded.uploads,
+			retrievals = retrievals + excluded.retrievals`,
+		caller, currentPeriod(), stored, retrieved, costFIL, uploads, retrievals,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	return nil
+}
+
+// writeQuotaError responds 402 when a storage or cost budget is exhausted
+// and 429 with Retry-After when bandwidth is, since that resets next period
+func writeQuotaError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnknownAPIKey) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Unknown API key", "code": problem.CodeUnauthorized})
+		return
+	}
+	quotaErr, ok := err.(*QuotaError)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusPaymentRequired
+	if quotaErr.Limit == "bandwidth" {
+		now := time.Now().UTC()
+		nextPeriod := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		w.Header().Set("Retry-After", strconv.Itoa(int(nextPeriod.Sub(now).Seconds())+1))
+		status = http.StatusTooManyRequests
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": quotaErr.Error(),
+		"code":  problem.CodeQuotaExceeded,
+		"quota": quotaErr.Limit,
+		"used":  quotaErr.Used,
+		"limit": quotaErr.Max,
+	})
+}
+
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	caller, err := callerID(r)
+	if err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = currentPeriod()
+	} else if _, err := time.Parse("2006-01", period); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid period, expected YYYY-MM"})
+		return
+	}
+
+	usage, err := getUsage(caller, period)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Failed to read usage"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"usage": usage,
+		"quota": quotaFor(caller),
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadFile posts content to the upload handler as a multipart form
+func uploadFile(t *testing.T, filename, content, apiKey string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	part.Write([]byte(content))
+	require.NoError(t, writer.Close())
+
+	httpReq, _ := http.NewRequest("POST", "/api/storage/upload", &body)
+	httpReq.Header.Set("Content-Type", writer.FormDataContentType())
+	if apiKey != "" {
+		httpReq.Header.Set("X-API-Key", apiKey)
+	}
+
+	w := httptest.NewRecorder()
+	handleUpload(w, httpReq)
+	return w
+}
+
+func TestParseQuota(t *testing.T) {
+	quota, err := parseQuota("storage:10GB, bandwidth:512MB,cost:2.5")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10<<30), quota.StorageBytes)
+	assert.Equal(t, int64(512<<20), quota.BandwidthBytes)
+	assert.Equal(t, 2.5, quota.CostFIL)
+
+	_, err = parseQuota("disk:10GB")
+	assert.Error(t, err)
+}
+
+func TestStorageQuotas(t *testing.T) {
+	initializeStorageService()
+	var cfg Config
+	cfg.Quotas.Default = "storage:1MB"
+	cfg.Quotas.APIKeys = "tenant-a=storage:20B,bandwidth:10B;tenant-b=cost:0.00001"
+	require.NoError(t, initQuotas(&cfg))
+	t.Cleanup(func() {
+		defaultQuota = Quota{}
+		callerQuotas = map[string]Quota{}
+	})
+
+	t.Run("should account usage per API key", func(t *testing.T) {
+		w := uploadFile(t, "a.txt", "0123456789", "tenant-a")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		usage, err := getUsage(callerIDForKey("tenant-a"), currentPeriod())
+		require.NoError(t, err)
+		assert.Equal(t, int64(10), usage.BytesStored)
+		assert.Equal(t, int64(1), usage.Uploads)
+
+		other, err := getUsage("anonymous", currentPeriod())
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), other.BytesStored)
+	})
+
+	t.Run("should charge the deal cost and nothing for content already stored", func(t *testing.T) {
+		w := uploadFile(t, "a-copy.txt", "0123456789", "tenant-a")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"deduplicated":true`)
+
+		usage, err := getUsage(callerIDForKey("tenant-a"), currentPeriod())
+		require.NoError(t, err)
+		assert.Equal(t, int64(10), usage.BytesStored)
+		assert.Equal(t, int64(2), usage.Uploads)
+		// The memory backend stores for free, so the estimate is not kept
+		assert.Zero(t, usage.DealCostFIL)
+	})
+
+	t.Run("should refuse API keys that have no quota", func(t *testing.T) {
+		for _, key := range []string{"rotated-1", "rotated-2"} {
+			w := uploadFile(t, key+".txt", "0123456789", key)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+
+		unknown, err := getUsage(callerIDForKey("rotated-1"), currentPeriod())
+		require.NoError(t, err)
+		assert.Zero(t, unknown.Uploads)
+		anonymous, err := getUsage(anonymousCaller, currentPeriod())
+		require.NoError(t, err)
+		assert.Zero(t, anonymous.Uploads)
+	})
+
+	t.Run("should not let concurrent uploads share the same remaining quota", func(t *testing.T) {
+		caller := callerIDForKey("tenant-c")
+		callerQuotas[caller] = Quota{StorageBytes: 50}
+		defer delete(callerQuotas, caller)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, ignoreQuotaError(reserveUpload(caller, 10, 0)))
+			}()
+		}
+		wg.Wait()
+
+		usage, err := getUsage(caller, currentPeriod())
+		require.NoError(t, err)
+		assert.Equal(t, int64(50), usage.BytesStored)
+		assert.Equal(t, int64(5), usage.Uploads)
+
+		releaseUpload(caller, 10, 0)
+		usage, err = getUsage(caller, currentPeriod())
+		require.NoError(t, err)
+		assert.Equal(t, int64(40), usage.BytesStored)
+	})
+
+	t.Run("should return 402 when storage quota is exceeded", func(t *testing.T) {
+		w := uploadFile(t, "b.txt", "this upload is too large", "tenant-a")
+
+		assert.Equal(t, http.StatusPaymentRequired, w.Code)
+		assert.Contains(t, w.Body.String(), `"quota":"storage"`)
+	})
+
+	t.Run("should return 402 when the deal cost budget is exceeded", func(t *testing.T) {
+		w := uploadFile(t, "c.txt", "0123456789abcdef", "tenant-b")
+
+		assert.Equal(t, http.StatusPaymentRequired, w.Code)
+		assert.Contains(t, w.Body.String(), `"quota":"cost"`)
+	})
+
+	t.Run("should return 429 when bandwidth is exhausted", func(t *testing.T) {
+		cid := backend.RawCID([]byte("0123456789"))
+		retrieve := func() *httptest.ResponseRecorder {
+			httpReq, _ := http.NewRequest("GET", "/api/storage/retrieve/"+cid, nil)
+			httpReq.Header.Set("Authorization", "Bearer tenant-a")
+			w := httptest.NewRecorder()
+			handleRetrieve(w, httpReq)
+			return w
+		}
+
+		assert.Equal(t, http.StatusOK, retrieve().Code)
+
+		w := retrieve()
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	})
+
+	t.Run("should report usage and quota", func(t *testing.T) {
+		httpReq, _ := http.NewRequest("GET", "/api/storage/usage", nil)
+		httpReq.Header.Set("X-API-Key", "tenant-a")
+		w := httptest.NewRecorder()
+		handleUsage(w, httpReq)
+
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Usage Usage `json:"usage"`
+			Quota Quota `json:"quota"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, int64(10), response.Usage.BytesRetrieved)
+		assert.Equal(t, int64(20), response.Quota.StorageBytes)
+	})
+}
+
+// ignoreQuotaError drops the *QuotaError of a reservation that was refused
+func ignoreQuotaError(err error) error {
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		return nil
+	}
+	return err
+}
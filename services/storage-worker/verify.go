@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// Verdicts of a public receipt verification. A receipt is valid when every
+// check passes, invalid when any fails, and unknown when a check could not
+// be made.
+const (
+	VerdictValid   = "valid"
+	VerdictInvalid = "invalid"
+	VerdictUnknown = "unknown"
+)
+
+// Outcomes of a single check
+const (
+	CheckPass    = "pass"
+	CheckFail    = "fail"
+	CheckUnknown = "unknown"
+)
+
+// paymentCoreEventsABI holds the PaymentCore events a receipt's transaction
+// is matched against
+const paymentCoreEventsABI = `[
+	{"type":"event","name":"PaymentCreated","inputs":[
+		{"name":"id","type":"uint256","indexed":true},
+		{"name":"sender","type":"address","indexed":true},
+		{"name":"recipient","type":"address","indexed":true},
+		{"name":"token","type":"address","indexed":false},
+		{"name":"amount","type":"uint256","indexed":false},
+		{"name":"fee","type":"uint256","indexed":false},
+		{"name":"metadataURI","type":"string","indexed":false},
+		{"name":"senderENS","type":"string","indexed":false},
+		{"name":"recipientENS","type":"string","indexed":false}]},
+	{"type":"event","name":"PaymentCompleted","inputs":[
+		{"name":"id","type":"uint256","indexed":true},
+		{"name":"completer","type":"address","indexed":true}]},
+	{"type":"event","name":"PaymentRefunded","inputs":[
+		{"name":"id","type":"uint256","indexed":true},
+		{"name":"refunder","type":"address","indexed":true}]},
+	{"type":"event","name":"PaymentCancelled","inputs":[
+		{"name":"id","type":"uint256","indexed":true},
+		{"name":"canceller","type":"address","indexed":true}]}
+]`
+
+var paymentCoreEvents = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(paymentCoreEventsABI))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+// receiptChainReader reads transaction receipts from a chain
+type receiptChainReader interface {
+	TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error)
+}
+
+// receiptChain is a chain receipts' transactions are checked on, and the
+// PaymentCore deployed there
+type receiptChain struct {
+	client      receiptChainReader
+	paymentCore common.Address
+}
+
+// receiptChains are the chains configured for verification, by chain ID
+var receiptChains = map[int]*receiptChain{}
+
+// VerificationCheck is the outcome of one step of a verification
+type VerificationCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// ReceiptVerdict is the public result of verifying a receipt. Reasons are
+// the details of the checks that failed or could not be made.
+type ReceiptVerdict struct {
+	CID         string              `json:"cid"`
+	Verdict     string              `json:"verdict"`
+	Summary     string              `json:"summary"`
+	Reasons     []string            `json:"reasons"`
+	Checks      []VerificationCheck `json:"checks"`
+	Payment     *PaymentData        `json:"payment,omitempty"`
+	Network     string              `json:"network,omitempty"`
+	Signer      string              `json:"signer,omitempty"`
+	GeneratedAt *time.Time          `json:"generated_at,omitempty"`
+	VerifiedAt  time.Time           `json:"verified_at"`
+}
+
+// initReceiptVerification connects to the chains in RECEIPT_CHAIN_RPC_URLS
+// and RECEIPT_PAYMENT_CORE_ADDRESSES, both comma separated chainID=value
+// lists. Transactions on other chains cannot be checked.
+func initReceiptVerification(cfg *Config) error {
+	urls, err := parseChainList(cfg.Receipts.ChainRPCURLs)
+	if err != nil {
+		return fmt.Errorf("invalid RECEIPT_CHAIN_RPC_URLS: %w", err)
+	}
+	addresses, err := parseChainList(cfg.Receipts.PaymentCoreAddresses)
+	if err != nil {
+		return fmt.Errorf("invalid RECEIPT_PAYMENT_CORE_ADDRESSES: %w", err)
+	}
+
+	chains := make(map[int]*receiptChain)
+	for chainID, url := range urls {
+		address, ok := addresses[chainID]
+		if !ok {
+			return fmt.Errorf("no PaymentCore address for chain %d", chainID)
+		}
+		if !common.IsHexAddress(address) {
+			return fmt.Errorf("invalid PaymentCore address for chain %d: %s", chainID, address)
+		}
+		client, err := ethclient.Dial(url)
+		if err != nil {
+			return fmt.Errorf("failed to connect to chain %d: %w", chainID, err)
+		}
+		chains[chainID] = &receiptChain{client: client, paymentCore: common.HexToAddress(address)}
+	}
+	receiptChains = chains
+
+	log.Printf("Verifying receipt transactions on %d chain(s)", len(chains))
+	return nil
+}
+
+// parseChainList reads a comma separated list of chainID=value pairs
+func parseChainList(value string) (map[int]string, error) {
+	entries := make(map[int]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, setting, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(setting) == "" {
+			return nil, fmt.Errorf("expected chainID=value, got %q", entry)
+		}
+		chainID, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil || chainID <= 0 {
+			return nil, fmt.Errorf("invalid chain ID in %q", entry)
+		}
+		entries[chainID] = strings.TrimSpace(setting)
+	}
+	return entries, nil
+}
+
+// verifyReceiptCID fetches the receipt at cid, checks its EIP-712 signature
+// and cross-checks its transaction on chain. found is false when no backend
+// has the receipt.
+func verifyReceiptCID(ctx context.Context, cid string) (verdict *ReceiptVerdict, found bool) {
+	verdict = &ReceiptVerdict{CID: cid, Reasons: []string{}, VerifiedAt: time.Now().UTC()}
+
+	if _, err := backend.ParseCID(cid); err != nil {
+		verdict.add("receipt", CheckUnknown, fmt.Sprintf("%q is not a CID", cid))
+		verdict.decide()
+		return verdict, false
+	}
+	data, _, err := retrieveObject(ctx, cid)
+	switch {
+	case errors.Is(err, backend.ErrVerificationFailed):
+		verdict.add("receipt", CheckFail, "the stored content does not match its CID")
+		verdict.decide()
+		return verdict, true
+	case err != nil:
+		verdict.add("receipt", CheckUnknown, "no receipt is stored under this CID")
+		verdict.decide()
+		return verdict, false
+	}
+
+	var receipt Receipt
+	if err := json.Unmarshal(data, &receipt); err != nil || receipt.Signature == "" {
+		verdict.add("receipt", CheckUnknown, "the content is not a signed JSON receipt")
+		verdict.decide()
+		return verdict, true
+	}
+	verdict.add("receipt", CheckPass, "retrieved and matches its CID")
+	verdict.Payment = &receipt.Payment
+	verdict.Network = getNetworkName(receipt.Payment.ChainID)
+	verdict.Signer = receipt.Signer
+	verdict.GeneratedAt = &receipt.GeneratedAt
+
+	if recovered, err := verifyReceipt(&receipt); err != nil {
+		verdict.add("signature", CheckFail, err.Error())
+	} else {
+		verdict.Signer = recovered.Hex()
+		verdict.add("signature", CheckPass, fmt.Sprintf("signed by %s, a trusted CrossPay signer", recovered.Hex()))
+	}
+
+	status, detail := checkReceiptTransaction(ctx, &receipt.Payment)
+	verdict.add("transaction", status, detail)
+
+	verdict.decide()
+	return verdict, true
+}
+
+// checkReceiptTransaction checks that the receipt's transaction succeeded
+// and emitted a PaymentCore event for its payment, and that a
+// PaymentCreated event matches the receipt's parties, token and amount
+func checkReceiptTransaction(ctx context.Context, payment *PaymentData) (string, string) {
+	if len(common.FromHex(payment.TxHash)) != common.HashLength || !strings.HasPrefix(payment.TxHash, "0x") {
+		return CheckFail, fmt.Sprintf("%q is not a transaction hash", payment.TxHash)
+	}
+	chain, ok := receiptChains[payment.ChainID]
+	if !ok {
+		return CheckUnknown, fmt.Sprintf("transactions on chain %d cannot be checked by this service", payment.ChainID)
+	}
+
+	receipt, err := chain.client.TransactionReceipt(ctx, common.HexToHash(payment.TxHash))
+	if errors.Is(err, ethereum.NotFound) {
+		return CheckFail, fmt.Sprintf("transaction %s was not found on %s", payment.TxHash, getNetworkName(payment.ChainID))
+	}
+	if err != nil {
+		return CheckUnknown, fmt.Sprintf("the chain could not be reached: %v", err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return CheckFail, fmt.Sprintf("transaction %s reverted", payment.TxHash)
+	}
+
+	paymentID := common.BigToHash(new(big.Int).SetUint64(payment.ID))
+	matched := false
+	for _, entry := range receipt.Logs {
+		if entry.Address != chain.paymentCore || len(entry.Topics) < 2 || entry.Topics[1] != paymentID {
+			continue
+		}
+		event, err := paymentCoreEvents.EventByID(entry.Topics[0])
+		if err != nil {
+			continue
+		}
+		matched = true
+		if event.Name != "PaymentCreated" {
+			continue
+		}
+		if mismatch := paymentCreatedMismatch(event, entry, payment); mismatch != "" {
+			return CheckFail, mismatch
+		}
+	}
+	if !matched {
+		return CheckFail, fmt.Sprintf("transaction %s does not record payment %d", payment.TxHash, payment.ID)
+	}
+	return CheckPass, fmt.Sprintf("transaction %s in block %s records payment %d", payment.TxHash, receipt.BlockNumber, payment.ID)
+}
+
+// paymentCreatedMismatch describes how a PaymentCreated event differs from
+// the receipt, or returns "" when they agree
+func paymentCreatedMismatch(event *abi.Event, entry *types.Log, payment *PaymentData) string {
+	if len(entry.Topics) != 4 {
+		return "the PaymentCreated event is malformed"
+	}
+	values := make(map[string]interface{})
+	if err := event.Inputs.NonIndexed().UnpackIntoMap(values, entry.Data); err != nil {
+		return "the PaymentCreated event is malformed"
+	}
+
+	sender := common.BytesToAddress(entry.Topics[2].Bytes())
+	recipient := common.BytesToAddress(entry.Topics[3].Bytes())
+	token, _ := values["token"].(common.Address)
+	amount, _ := values["amount"].(*big.Int)
+	switch {
+	case sender != common.HexToAddress(payment.Sender):
+		return fmt.Sprintf("the payment was sent by %s, not %s", sender.Hex(), payment.Sender)
+	case recipient != common.HexToAddress(payment.Recipient):
+		return fmt.Sprintf("the payment was sent to %s, not %s", recipient.Hex(), payment.Recipient)
+	case token != common.HexToAddress(payment.Token):
+		return fmt.Sprintf("the payment was made in %s, not %s", token.Hex(), payment.Token)
+	case amount == nil || amount.String() != payment.Amount:
+		return fmt.Sprintf("the payment was for %s, not %s", amount, payment.Amount)
+	}
+	return ""
+}
+
+func (v *ReceiptVerdict) add(name, status, detail string) {
+	v.Checks = append(v.Checks, VerificationCheck{Name: name, Status: status, Detail: detail})
+}
+
+// decide sets the verdict, its reasons and a one sentence summary from the
+// checks
+func (v *ReceiptVerdict) decide() {
+	v.Verdict = VerdictValid
+	for _, check := range v.Checks {
+		switch check.Status {
+		case CheckFail:
+			v.Verdict = VerdictInvalid
+		case CheckUnknown:
+			if v.Verdict == VerdictValid {
+				v.Verdict = VerdictUnknown
+			}
+		}
+	}
+	for _, check := range v.Checks {
+		if check.Status != CheckPass {
+			v.Reasons = append(v.Reasons, fmt.Sprintf("%s: %s", check.Name, check.Detail))
+		}
+	}
+
+	switch v.Verdict {
+	case VerdictValid:
+		v.Summary = fmt.Sprintf("This is an authentic CrossPay receipt for payment %d on %s, signed by a trusted signer and confirmed on chain.",
+			v.Payment.ID, v.Network)
+	case VerdictInvalid:
+		v.Summary = "This receipt is not valid: " + v.firstDetail(CheckFail) + "."
+	default:
+		v.Summary = "This receipt could not be fully verified: " + v.firstDetail(CheckUnknown) + "."
+	}
+}
+
+func (v *ReceiptVerdict) firstDetail(status string) string {
+	for _, check := range v.Checks {
+		if check.Status == status {
+			return check.Detail
+		}
+	}
+	return ""
+}
+
+var verifyPage = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>CrossPay receipt verification</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 40rem; margin: 2rem auto; padding: 0 1rem; color: #111827; }
+.verdict { padding: 1rem; border-radius: 0.5rem; font-weight: 600; }
+.valid { background: #dcfce7; } .invalid { background: #fee2e2; } .unknown { background: #fef9c3; }
+dt { color: #6b7280; } dd { margin: 0 0 0.5rem; word-break: break-all; }
+li.pass::marker { content: "✓ "; } li.fail::marker { content: "✗ "; } li.unknown::marker { content: "? "; }
+</style>
+</head>
+<body>
+<h1>Receipt verification</h1>
+<p class="verdict {{.Verdict}}">{{.Summary}}</p>
+<ul>{{range .Checks}}<li class="{{.Status}}"><strong>{{.Name}}</strong>: {{.Detail}}</li>{{end}}</ul>
+{{with .Payment}}<dl>
+<dt>Payment</dt><dd>#{{.ID}} on {{$.Network}}</dd>
+<dt>From</dt><dd>{{.Sender}}</dd>
+<dt>To</dt><dd>{{.Recipient}}</dd>
+<dt>Amount</dt><dd>{{.Amount}} of token {{.Token}}</dd>
+<dt>Status</dt><dd>{{.Status}}</dd>
+<dt>Transaction</dt><dd>{{.TxHash}}</dd>
+</dl>{{end}}
+<p><small>CID {{.CID}}, verified {{.VerifiedAt.Format "2006-01-02 15:04:05 UTC"}}</small></p>
+</body>
+</html>
+`))
+
+// handlePublicVerifyReceipt serves GET /verify/{cid} without authentication,
+// as JSON for client apps or, for browsers and format=html, as a page. Any
+// origin may embed it.
+func handlePublicVerifyReceipt(w http.ResponseWriter, r *http.Request) {
+	cid := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/verify/"), "/")
+	if cid == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "CID required"})
+		return
+	}
+
+	verdict, found := verifyReceiptCID(r.Context(), cid)
+	status := http.StatusOK
+	if !found {
+		status = http.StatusNotFound
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	format := r.URL.Query().Get("format")
+	if format == "html" || (format == "" && strings.Contains(r.Header.Get("Accept"), "text/html")) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := verifyPage.Execute(w, verdict); err != nil {
+			log.Printf("Failed to render verification of %s: %v", cid, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(verdict)
+}
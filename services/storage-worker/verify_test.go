@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arcbjorn/crosspay/storage-worker/pkg/backend"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var verifyPaymentCore = common.HexToAddress("0x00000000000000000000000000000000000000c0")
+
+// fakeReceiptChain answers with the receipts it holds, or its error
+type fakeReceiptChain struct {
+	receipts map[common.Hash]*types.Receipt
+	err      error
+}
+
+func (c *fakeReceiptChain) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	receipt, ok := c.receipts[hash]
+	if !ok {
+		return nil, ethereum.NotFound
+	}
+	return receipt, nil
+}
+
+// paymentCreatedLog is the PaymentCreated event of payment
+func paymentCreatedLog(t *testing.T, payment *PaymentData) *types.Log {
+	event := paymentCoreEvents.Events["PaymentCreated"]
+	amount, _ := new(big.Int).SetString(payment.Amount, 10)
+	data, err := event.Inputs.NonIndexed().Pack(common.HexToAddress(payment.Token), amount, big.NewInt(0), payment.MetadataURI, "", "")
+	require.NoError(t, err)
+	return &types.Log{
+		Address: verifyPaymentCore,
+		Topics: []common.Hash{
+			event.ID,
+			common.BigToHash(new(big.Int).SetUint64(payment.ID)),
+			common.BytesToHash(common.HexToAddress(payment.Sender).Bytes()),
+			common.BytesToHash(common.HexToAddress(payment.Recipient).Bytes()),
+		},
+		Data: data,
+	}
+}
+
+// seedVerifiableReceipt stores a signed receipt for payment and a chain
+// whose transaction recorded it
+func seedVerifiableReceipt(t *testing.T, payment *PaymentData) (string, *fakeReceiptChain) {
+	receipt, err := generateReceipt(payment, "json", "en")
+	require.NoError(t, err)
+	data, err := json.Marshal(receipt)
+	require.NoError(t, err)
+
+	chain := &fakeReceiptChain{receipts: map[common.Hash]*types.Receipt{
+		common.HexToHash(payment.TxHash): {
+			Status:      types.ReceiptStatusSuccessful,
+			BlockNumber: big.NewInt(42),
+			Logs:        []*types.Log{paymentCreatedLog(t, payment)},
+		},
+	}}
+	receiptChains = map[int]*receiptChain{payment.ChainID: {client: chain, paymentCore: verifyPaymentCore}}
+	t.Cleanup(func() { receiptChains = map[int]*receiptChain{} })
+	return seedObject(t, "", data, "receipt.json"), chain
+}
+
+func verifyPayment() *PaymentData {
+	return &PaymentData{
+		ID:        7,
+		Sender:    "0x1234567890123456789012345678901234567890",
+		Recipient: "0x0987654321098765432109876543210987654321",
+		Token:     "0x0000000000000000000000000000000000000000",
+		Amount:    "1000000000000000000",
+		Fee:       "1000000000000000",
+		Status:    "completed",
+		TxHash:    "0x" + strings.Repeat("ab", 32),
+		ChainID:   1135,
+	}
+}
+
+func TestVerifyReceiptCID(t *testing.T) {
+	initializeStorageService()
+	ctx := context.Background()
+
+	t.Run("should find signed receipts with a matching transaction valid", func(t *testing.T) {
+		cid, _ := seedVerifiableReceipt(t, verifyPayment())
+
+		verdict, found := verifyReceiptCID(ctx, cid)
+		assert.True(t, found)
+		assert.Equal(t, VerdictValid, verdict.Verdict)
+		assert.Empty(t, verdict.Reasons)
+		require.Len(t, verdict.Checks, 3)
+		assert.Contains(t, verdict.Checks[2].Detail, "in block 42 records payment 7")
+		assert.Equal(t, "Lisk", verdict.Network)
+		assert.Contains(t, verdict.Summary, "authentic CrossPay receipt for payment 7 on Lisk")
+	})
+
+	t.Run("should find receipts whose transaction disagrees invalid", func(t *testing.T) {
+		payment := verifyPayment()
+		cid, chain := seedVerifiableReceipt(t, payment)
+		other := *payment
+		other.Amount = "5"
+		chain.receipts[common.HexToHash(payment.TxHash)].Logs = []*types.Log{paymentCreatedLog(t, &other)}
+
+		verdict, _ := verifyReceiptCID(ctx, cid)
+		assert.Equal(t, VerdictInvalid, verdict.Verdict)
+		assert.Equal(t, []string{"transaction: the payment was for 5, not 1000000000000000000"}, verdict.Reasons)
+
+		chain.receipts[common.HexToHash(payment.TxHash)].Status = types.ReceiptStatusFailed
+		verdict, _ = verifyReceiptCID(ctx, cid)
+		assert.Equal(t, "This receipt is not valid: transaction "+payment.TxHash+" reverted.", verdict.Summary)
+
+		delete(chain.receipts, common.HexToHash(payment.TxHash))
+		verdict, _ = verifyReceiptCID(ctx, cid)
+		assert.Equal(t, VerdictInvalid, verdict.Verdict)
+		assert.Contains(t, verdict.Reasons[0], "was not found on Lisk")
+	})
+
+	t.Run("should find tampered receipts invalid", func(t *testing.T) {
+		payment := verifyPayment()
+		receipt, err := generateReceipt(payment, "json", "en")
+		require.NoError(t, err)
+		receipt.Payment.Amount = "2000000000000000000"
+		data, _ := json.Marshal(receipt)
+		cid := seedObject(t, "", data, "receipt.json")
+
+		verdict, _ := verifyReceiptCID(ctx, cid)
+		assert.Equal(t, VerdictInvalid, verdict.Verdict)
+		assert.Equal(t, CheckFail, verdict.Checks[1].Status)
+	})
+
+	t.Run("should leave receipts it cannot check unknown", func(t *testing.T) {
+		cid, chain := seedVerifiableReceipt(t, verifyPayment())
+		chain.err = errors.New("connection refused")
+
+		verdict, _ := verifyReceiptCID(ctx, cid)
+		assert.Equal(t, VerdictUnknown, verdict.Verdict)
+		assert.Equal(t, []string{"transaction: the chain could not be reached: connection refused"}, verdict.Reasons)
+
+		receiptChains = map[int]*receiptChain{}
+		verdict, _ = verifyReceiptCID(ctx, cid)
+		assert.Equal(t, VerdictUnknown, verdict.Verdict)
+		assert.Contains(t, verdict.Summary, "transactions on chain 1135 cannot be checked")
+
+		pdf := seedObject(t, "", []byte("%PDF-1.3"), "receipt.pdf")
+		verdict, found := verifyReceiptCID(ctx, pdf)
+		assert.True(t, found)
+		assert.Equal(t, VerdictUnknown, verdict.Verdict)
+	})
+}
+
+func TestHandlePublicVerifyReceipt(t *testing.T) {
+	initializeStorageService()
+
+	router := http.NewServeMux()
+	router.HandleFunc("GET /verify/", handlePublicVerifyReceipt)
+
+	t.Run("should answer client apps with the verdict", func(t *testing.T) {
+		cid, _ := seedVerifiableReceipt(t, verifyPayment())
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/verify/"+cid, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+
+		var verdict ReceiptVerdict
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &verdict))
+		assert.Equal(t, VerdictValid, verdict.Verdict)
+		assert.Equal(t, uint64(7), verdict.Payment.ID)
+	})
+
+	t.Run("should render a page for browsers", func(t *testing.T) {
+		cid, _ := seedVerifiableReceipt(t, verifyPayment())
+
+		r := httptest.NewRequest(http.MethodGet, "/verify/"+cid, nil)
+		r.Header.Set("Accept", "text/html,application/xhtml+xml")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Type"), "text/html")
+		assert.Contains(t, w.Body.String(), `class="verdict valid"`)
+		assert.Contains(t, w.Body.String(), "#7 on Lisk")
+	})
+
+	t.Run("should answer 404 with an unknown verdict for missing receipts", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/verify/"+backend.RawCID([]byte("missing")), nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		var verdict ReceiptVerdict
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &verdict))
+		assert.Equal(t, VerdictUnknown, verdict.Verdict)
+		assert.Equal(t, []string{"receipt: no receipt is stored under this CID"}, verdict.Reasons)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/verify/not-a-cid", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestParseChainList(t *testing.T) {
+	t.Run("should read chain IDs and their values", func(t *testing.T) {
+		entries, err := parseChainList(" 1135=https://rpc.api.lisk.com, 84532=https://sepolia.base.org ,")
+		require.NoError(t, err)
+		assert.Equal(t, map[int]string{1135: "https://rpc.api.lisk.com", 84532: "https://sepolia.base.org"}, entries)
+
+		for _, value := range []string{"https://rpc.api.lisk.com", "lisk=https://rpc.api.lisk.com", "1135="} {
+			_, err := parseChainList(value)
+			assert.Error(t, err, value)
+		}
+	})
+}